@@ -48,6 +48,9 @@ func (a *Account) IsValid() bool {
 type AccountOptions struct {
 	Key     *jose.JSONWebKey
 	Contact []string
+	// ExternalAccountBinding is the optional JWS that binds the account key
+	// to an external account key.
+	ExternalAccountBinding *jose.JSONWebSignature
 }
 
 // account represents an ACME account.
@@ -167,6 +170,42 @@ func (a *account) deactivate(db nosql.DB) (*account, error) {
 	return &b, nil
 }
 
+// changeKey binds the acme account to a new key. The index of the new key is
+// created first, so the operation fails if the key already belongs to another
+// account, and the account is only updated if it has not changed since the
+// last read.
+func (a *account) changeKey(db nosql.DB, key *jose.JSONWebKey) (*account, error) {
+	oldKid, err := keyToID(a.Key)
+	if err != nil {
+		return nil, err
+	}
+	newKid, err := keyToID(key)
+	if err != nil {
+		return nil, err
+	}
+	newKidB := []byte(newKid)
+
+	// Set the new jwkID -> acme account ID index
+	_, swapped, err := db.CmpAndSwap(accountByKeyIDTable, newKidB, nil, []byte(a.ID))
+	switch {
+	case err != nil:
+		return nil, ServerInternalErr(errors.Wrap(err, "error setting key-id to account-id index"))
+	case !swapped:
+		return nil, AccountKeyConflictErr(errors.Errorf("key-id %s is already bound to an account", newKid))
+	}
+
+	b := *a
+	b.Key = key
+	if err := b.save(db, a); err != nil {
+		db.Del(accountByKeyIDTable, newKidB)
+		return nil, err
+	}
+	if err := db.Del(accountByKeyIDTable, []byte(oldKid)); err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error deleting old key-id to account-id index"))
+	}
+	return &b, nil
+}
+
 // getAccountByID retrieves the account with the given ID.
 func getAccountByID(db nosql.DB, id string) (*account, error) {
 	ab, err := db.Get(accountTable, []byte(id))
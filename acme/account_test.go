@@ -690,6 +690,148 @@ func TestAccountUpdate(t *testing.T) {
 	}
 }
 
+func TestAccountChangeKey(t *testing.T) {
+	type test struct {
+		acc *account
+		key *jose.JSONWebKey
+		db  nosql.DB
+		err *Error
+	}
+	newKey := func(t *testing.T) (*jose.JSONWebKey, string) {
+		jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+		assert.FatalError(t, err)
+		pub := jwk.Public()
+		kid, err := keyToID(&pub)
+		assert.FatalError(t, err)
+		return &pub, kid
+	}
+	tests := map[string]func(t *testing.T) test{
+		"fail/index-error": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			key, kid := newKey(t)
+			return test{
+				acc: acc,
+				key: key,
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						assert.Equals(t, bucket, accountByKeyIDTable)
+						assert.Equals(t, key, []byte(kid))
+						assert.Equals(t, old, nil)
+						assert.Equals(t, newval, []byte(acc.ID))
+						return nil, false, errors.New("force")
+					},
+				},
+				err: ServerInternalErr(errors.New("error setting key-id to account-id index: force")),
+			}
+		},
+		"fail/conflict": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			key, kid := newKey(t)
+			return test{
+				acc: acc,
+				key: key,
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						assert.Equals(t, bucket, accountByKeyIDTable)
+						return []byte("other"), false, nil
+					},
+				},
+				err: AccountKeyConflictErr(errors.Errorf("key-id %s is already bound to an account", kid)),
+			}
+		},
+		"fail/save-error": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			key, kid := newKey(t)
+			var deleted bool
+			return test{
+				acc: acc,
+				key: key,
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						if string(bucket) == string(accountByKeyIDTable) {
+							return nil, true, nil
+						}
+						assert.Equals(t, bucket, accountTable)
+						return nil, false, errors.New("force")
+					},
+					MDel: func(bucket, key []byte) error {
+						// The new index is removed.
+						assert.Equals(t, bucket, accountByKeyIDTable)
+						assert.Equals(t, key, []byte(kid))
+						assert.False(t, deleted)
+						deleted = true
+						return nil
+					},
+				},
+				err: ServerInternalErr(errors.New("error storing account: force")),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			oldKid, err := keyToID(acc.Key)
+			assert.FatalError(t, err)
+			oldb, err := json.Marshal(acc)
+			assert.FatalError(t, err)
+			key, kid := newKey(t)
+			count := 0
+			return test{
+				acc: acc,
+				key: key,
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						switch count {
+						case 0:
+							assert.Equals(t, bucket, accountByKeyIDTable)
+							assert.Equals(t, key, []byte(kid))
+						case 1:
+							assert.Equals(t, bucket, accountTable)
+							assert.Equals(t, key, []byte(acc.ID))
+							assert.Equals(t, old, oldb)
+							var a account
+							assert.FatalError(t, json.Unmarshal(newval, &a))
+							newKid, err := keyToID(a.Key)
+							assert.FatalError(t, err)
+							assert.Equals(t, newKid, kid)
+						}
+						count++
+						return nil, true, nil
+					},
+					MDel: func(bucket, key []byte) error {
+						// The old index is removed.
+						assert.Equals(t, bucket, accountByKeyIDTable)
+						assert.Equals(t, key, []byte(oldKid))
+						return nil
+					},
+				},
+			}
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			acc, err := tc.acc.changeKey(tc.db, tc.key)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					ae, ok := err.(*Error)
+					assert.True(t, ok)
+					assert.HasPrefix(t, ae.Error(), tc.err.Error())
+					assert.Equals(t, ae.StatusCode(), tc.err.StatusCode())
+					assert.Equals(t, ae.Type, tc.err.Type)
+				}
+			} else {
+				if assert.Nil(t, tc.err) {
+					assert.Equals(t, acc.ID, tc.acc.ID)
+					assert.Equals(t, acc.Key, tc.key)
+				}
+			}
+		})
+	}
+}
+
 func TestAccountDeactivate(t *testing.T) {
 	type test struct {
 		acc *account
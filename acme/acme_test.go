@@ -0,0 +1,1645 @@
+package acme_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
+	acmeAPI "github.com/smallstep/certificates/acme/api"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/jose"
+	"github.com/smallstep/nosql"
+	xacme "golang.org/x/crypto/acme"
+)
+
+var stepOIDProvisioner = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37476, 9000, 64, 1}
+
+// challengeStub answers the http-01 and dns-01 validation requests with the
+// values registered by the ACME client.
+type challengeStub struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (s *challengeStub) set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = value
+}
+
+func (s *challengeStub) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.records[key]
+	return v, ok
+}
+
+func (s *challengeStub) httpGet(url string) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	if v, ok := s.get(url); ok {
+		rec.WriteString(v)
+	} else {
+		rec.WriteHeader(http.StatusNotFound)
+	}
+	return rec.Result(), nil
+}
+
+func (s *challengeStub) lookupTxt(name string) ([]string, error) {
+	if v, ok := s.get(name); ok {
+		return []string{v}, nil
+	}
+	return nil, errors.Errorf("no TXT record for %s", name)
+}
+
+func (s *challengeStub) tlsDial(network, addr string, config *tls.Config) (*tls.Conn, error) {
+	return nil, errors.New("tls-alpn-01 is not supported")
+}
+
+func TestACME_endToEnd(t *testing.T) {
+	duration := func(d time.Duration) *provisioner.Duration {
+		return &provisioner.Duration{Duration: d}
+	}
+	provisioners := provisioner.List{
+		&provisioner.ACME{
+			Type:       "ACME",
+			Name:       "dns",
+			Challenges: []string{provisioner.ACMEChallengeDNS01},
+			Claims: &provisioner.Claims{
+				DefaultTLSDur: duration(time.Hour),
+			},
+		},
+		&provisioner.ACME{
+			Type:       "ACME",
+			Name:       "http",
+			Challenges: []string{provisioner.ACMEChallengeHTTP01},
+			Claims: &provisioner.Claims{
+				DefaultTLSDur: duration(12 * time.Hour),
+			},
+		},
+	}
+
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioners,
+			Backdate:     duration(0),
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+	stub := &challengeStub{records: make(map[string]string)}
+	acmeAuth.SetValidateOptions(stub.httpGet, stub.lookupTxt, stub.tlsDial)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	root, err := pemutil.ReadCertificate("../ca/testdata/secrets/root_ca.crt")
+	assert.FatalError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	tests := []struct {
+		provisioner string
+		challenge   string
+		duration    time.Duration
+	}{
+		{"dns", "dns-01", time.Hour},
+		{"http", "http-01", 12 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provisioner, func(t *testing.T) {
+			ctx := context.Background()
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			assert.FatalError(t, err)
+			client := &xacme.Client{
+				Key:          key,
+				DirectoryURL: srv.URL + "/acme/" + tt.provisioner + "/directory",
+				HTTPClient:   srv.Client(),
+			}
+			_, err = client.Register(ctx, &xacme.Account{}, xacme.AcceptTOS)
+			assert.FatalError(t, err)
+
+			order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.com"))
+			assert.FatalError(t, err)
+			assert.True(t, strings.HasPrefix(order.URI, srv.URL+"/acme/"+tt.provisioner+"/"))
+
+			for _, u := range order.AuthzURLs {
+				z, err := client.GetAuthorization(ctx, u)
+				assert.FatalError(t, err)
+				// Only the challenge types enabled in the provisioner are
+				// offered.
+				assert.Len(t, 1, z.Challenges)
+				chal := z.Challenges[0]
+				assert.Equals(t, tt.challenge, chal.Type)
+
+				switch chal.Type {
+				case "dns-01":
+					record, err := client.DNS01ChallengeRecord(chal.Token)
+					assert.FatalError(t, err)
+					stub.set("_acme-challenge."+z.Identifier.Value, record)
+				case "http-01":
+					resp, err := client.HTTP01ChallengeResponse(chal.Token)
+					assert.FatalError(t, err)
+					stub.set("http://"+z.Identifier.Value+client.HTTP01ChallengePath(chal.Token), resp)
+				}
+
+				_, err = client.Accept(ctx, chal)
+				assert.FatalError(t, err)
+				_, err = client.WaitAuthorization(ctx, z.URI)
+				assert.FatalError(t, err)
+			}
+
+			order, err = client.WaitOrder(ctx, order.URI)
+			assert.FatalError(t, err)
+			assert.Equals(t, xacme.StatusReady, order.Status)
+
+			priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			assert.FatalError(t, err)
+			csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "example.com"},
+				DNSNames: []string{"example.com"},
+			}, priv)
+			assert.FatalError(t, err)
+			chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+			assert.FatalError(t, err)
+			assert.Len(t, 2, chain)
+
+			leaf, err := x509.ParseCertificate(chain[0])
+			assert.FatalError(t, err)
+			intermediate, err := x509.ParseCertificate(chain[1])
+			assert.FatalError(t, err)
+			intermediates := x509.NewCertPool()
+			intermediates.AddCert(intermediate)
+			_, err = leaf.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				DNSName:       "example.com",
+			})
+			assert.FatalError(t, err)
+
+			// The provisioner claims apply to the certificate.
+			assert.Equals(t, tt.duration, leaf.NotAfter.Sub(leaf.NotBefore))
+			var found bool
+			for _, ext := range leaf.Extensions {
+				if ext.Id.Equal(stepOIDProvisioner) {
+					found = true
+					assert.True(t, bytes.Contains(ext.Value, []byte(tt.provisioner)))
+				}
+			}
+			assert.True(t, found)
+		})
+	}
+}
+
+func TestACME_revokeCert(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{
+					Type:       "ACME",
+					Name:       "revoke",
+					Challenges: []string{provisioner.ACMEChallengeDNS01},
+				},
+			},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+	stub := &challengeStub{records: make(map[string]string)}
+	acmeAuth.SetValidateOptions(stub.httpGet, stub.lookupTxt, stub.tlsDial)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	ctx := context.Background()
+	newClient := func(t *testing.T) (*xacme.Client, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		client := &xacme.Client{
+			Key:          key,
+			DirectoryURL: srv.URL + "/acme/revoke/directory",
+			HTTPClient:   srv.Client(),
+		}
+		acc, err := client.Register(ctx, &xacme.Account{}, xacme.AcceptTOS)
+		assert.FatalError(t, err)
+		return client, acc.URI[strings.LastIndex(acc.URI, "/")+1:]
+	}
+	// issue orders a certificate for example.com and returns it with its key.
+	issue := func(t *testing.T, client *xacme.Client) (*x509.Certificate, *ecdsa.PrivateKey) {
+		order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.com"))
+		assert.FatalError(t, err)
+		for _, u := range order.AuthzURLs {
+			z, err := client.GetAuthorization(ctx, u)
+			assert.FatalError(t, err)
+			chal := z.Challenges[0]
+			record, err := client.DNS01ChallengeRecord(chal.Token)
+			assert.FatalError(t, err)
+			stub.set("_acme-challenge."+z.Identifier.Value, record)
+			_, err = client.Accept(ctx, chal)
+			assert.FatalError(t, err)
+			_, err = client.WaitAuthorization(ctx, z.URI)
+			assert.FatalError(t, err)
+		}
+		order, err = client.WaitOrder(ctx, order.URI)
+		assert.FatalError(t, err)
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			DNSNames: []string{"example.com"},
+		}, priv)
+		assert.FatalError(t, err)
+		chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+		assert.FatalError(t, err)
+		leaf, err := x509.ParseCertificate(chain[0])
+		assert.FatalError(t, err)
+		return leaf, priv
+	}
+	// assertRevoked checks that the certificate is revoked and it is in the
+	// CRL with the reason code.
+	assertRevoked := func(t *testing.T, leaf *x509.Certificate, reason int) {
+		isRevoked, err := auth.IsRevoked(leaf.SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.True(t, isRevoked)
+		crl, err := auth.GetCRL()
+		assert.FatalError(t, err)
+		list, err := x509.ParseDERCRL(crl)
+		assert.FatalError(t, err)
+		for _, rc := range list.TBSCertList.RevokedCertificates {
+			if rc.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				var code asn1.Enumerated
+				if reason != 0 {
+					assert.Len(t, 1, rc.Extensions)
+					_, err := asn1.Unmarshal(rc.Extensions[0].Value, &code)
+					assert.FatalError(t, err)
+				}
+				assert.Equals(t, reason, int(code))
+				return
+			}
+		}
+		t.Errorf("certificate %s not found in the CRL", leaf.SerialNumber)
+	}
+	// assertProblem checks the acme problem returned by the CA.
+	assertProblem := func(t *testing.T, err error, status int, typ, detail string) {
+		if assert.Error(t, err) {
+			ae, ok := err.(*xacme.Error)
+			assert.Fatal(t, ok, "error is not an acme error")
+			assert.Equals(t, status, ae.StatusCode)
+			assert.Equals(t, "urn:ietf:params:acme:error:"+typ, ae.ProblemType)
+			assert.True(t, strings.Contains(ae.Detail, detail), ae.Detail)
+		}
+	}
+
+	client, accID := newClient(t)
+	otherClient, _ := newClient(t)
+
+	t.Run("ok/account", func(t *testing.T) {
+		leaf, _ := issue(t, client)
+		assert.FatalError(t, client.RevokeCert(ctx, nil, leaf.Raw, xacme.CRLReasonSuperseded))
+		assertRevoked(t, leaf, int(xacme.CRLReasonSuperseded))
+
+		// The client ignores the alreadyRevoked errors.
+		err := acmeAuth.RevokeCertificate(accID, nil, leaf, 0)
+		ae, ok := err.(*acme.Error)
+		assert.Fatal(t, ok, "error is not an acme error")
+		assert.Equals(t, "urn:ietf:params:acme:error:alreadyRevoked", ae.ToACME().Type)
+		assert.Equals(t, 400, ae.StatusCode())
+	})
+
+	t.Run("ok/certificate-key", func(t *testing.T) {
+		leaf, priv := issue(t, client)
+		assert.FatalError(t, otherClient.RevokeCert(ctx, priv, leaf.Raw, xacme.CRLReasonKeyCompromise))
+		assertRevoked(t, leaf, int(xacme.CRLReasonKeyCompromise))
+	})
+
+	t.Run("fail/wrong-account", func(t *testing.T) {
+		leaf, _ := issue(t, client)
+		err := otherClient.RevokeCert(ctx, nil, leaf.Raw, xacme.CRLReasonUnspecified)
+		assertProblem(t, err, 401, "unauthorized", "account does not own certificate")
+		isRevoked, err := auth.IsRevoked(leaf.SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.False(t, isRevoked)
+	})
+
+	t.Run("fail/wrong-key", func(t *testing.T) {
+		leaf, _ := issue(t, client)
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		err = client.RevokeCert(ctx, priv, leaf.Raw, xacme.CRLReasonKeyCompromise)
+		assertProblem(t, err, 401, "unauthorized", "request is not signed by the key of certificate")
+	})
+
+	t.Run("fail/reason", func(t *testing.T) {
+		leaf, priv := issue(t, client)
+		err := client.RevokeCert(ctx, nil, leaf.Raw, xacme.CRLReasonCertificateHold)
+		assertProblem(t, err, 400, "badRevocationReason", "revocation reason 6 is not allowed")
+		err = client.RevokeCert(ctx, priv, leaf.Raw, xacme.CRLReasonSuperseded)
+		assertProblem(t, err, 400, "badRevocationReason", "revocation reason 4 is not allowed")
+	})
+
+	t.Run("fail/not-issued-by-ca", func(t *testing.T) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1234),
+			DNSNames:     []string{"example.com"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+		assert.FatalError(t, err)
+		err = client.RevokeCert(ctx, priv, der, xacme.CRLReasonKeyCompromise)
+		assertProblem(t, err, 401, "unauthorized", "certificate 1234 was not issued by this CA")
+	})
+}
+
+func TestACME_orderValidity(t *testing.T) {
+	duration := func(d time.Duration) *provisioner.Duration {
+		return &provisioner.Duration{Duration: d}
+	}
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{
+					Type:       "ACME",
+					Name:       "validity",
+					Challenges: []string{provisioner.ACMEChallengeDNS01},
+					Claims: &provisioner.Claims{
+						MinTLSDur:     duration(5 * time.Minute),
+						MaxTLSDur:     duration(24 * time.Hour),
+						DefaultTLSDur: duration(time.Hour),
+					},
+				},
+			},
+			Backdate: duration(0),
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+	stub := &challengeStub{records: make(map[string]string)}
+	acmeAuth.SetValidateOptions(stub.httpGet, stub.lookupTxt, stub.tlsDial)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	client := &xacme.Client{
+		Key:          key,
+		DirectoryURL: srv.URL + "/acme/validity/directory",
+		HTTPClient:   srv.Client(),
+	}
+	_, err = client.Register(ctx, &xacme.Account{}, xacme.AcceptTOS)
+	assert.FatalError(t, err)
+
+	// issue completes an order for example.com and returns the certificate.
+	issue := func(t *testing.T, order *xacme.Order) *x509.Certificate {
+		for _, u := range order.AuthzURLs {
+			z, err := client.GetAuthorization(ctx, u)
+			assert.FatalError(t, err)
+			chal := z.Challenges[0]
+			record, err := client.DNS01ChallengeRecord(chal.Token)
+			assert.FatalError(t, err)
+			stub.set("_acme-challenge."+z.Identifier.Value, record)
+			_, err = client.Accept(ctx, chal)
+			assert.FatalError(t, err)
+			_, err = client.WaitAuthorization(ctx, z.URI)
+			assert.FatalError(t, err)
+		}
+		order, err := client.WaitOrder(ctx, order.URI)
+		assert.FatalError(t, err)
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			DNSNames: []string{"example.com"},
+		}, priv)
+		assert.FatalError(t, err)
+		chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+		assert.FatalError(t, err)
+		leaf, err := x509.ParseCertificate(chain[0])
+		assert.FatalError(t, err)
+		return leaf
+	}
+
+	t.Run("ok/default", func(t *testing.T) {
+		order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.com"))
+		assert.FatalError(t, err)
+		assert.True(t, order.NotBefore.IsZero())
+		assert.True(t, order.NotAfter.IsZero())
+		leaf := issue(t, order)
+		assert.Equals(t, time.Hour, leaf.NotAfter.Sub(leaf.NotBefore))
+	})
+
+	t.Run("ok/notAfter", func(t *testing.T) {
+		notAfter := time.Now().Add(12 * time.Hour).Truncate(time.Second).UTC()
+		order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.com"), xacme.WithOrderNotAfter(notAfter))
+		assert.FatalError(t, err)
+		assert.Equals(t, notAfter, order.NotAfter)
+		leaf := issue(t, order)
+		assert.Equals(t, notAfter, leaf.NotAfter.UTC())
+	})
+
+	t.Run("ok/notBefore-notAfter", func(t *testing.T) {
+		notBefore := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+		notAfter := notBefore.Add(2 * time.Hour)
+		order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.com"),
+			xacme.WithOrderNotBefore(notBefore), xacme.WithOrderNotAfter(notAfter))
+		assert.FatalError(t, err)
+		assert.Equals(t, notBefore, order.NotBefore)
+		assert.Equals(t, notAfter, order.NotAfter)
+		leaf := issue(t, order)
+		assert.Equals(t, notBefore, leaf.NotBefore.UTC())
+		assert.Equals(t, notAfter, leaf.NotAfter.UTC())
+	})
+
+	fail := map[string]struct {
+		opts   []xacme.OrderOption
+		detail string
+	}{
+		"fail/over-max": {
+			[]xacme.OrderOption{xacme.WithOrderNotAfter(time.Now().Add(48 * time.Hour))},
+			"requested duration of 4",
+		},
+		"fail/under-min": {
+			[]xacme.OrderOption{xacme.WithOrderNotAfter(time.Now().Add(time.Minute))},
+			"requested duration of ",
+		},
+		"fail/past": {
+			[]xacme.OrderOption{xacme.WithOrderNotAfter(time.Now().Add(-time.Hour))},
+			"notAfter cannot be in the past",
+		},
+		"fail/before-notBefore": {
+			[]xacme.OrderOption{
+				xacme.WithOrderNotBefore(time.Now().Add(2 * time.Hour)),
+				xacme.WithOrderNotAfter(time.Now().Add(time.Hour)),
+			},
+			"notAfter cannot be before notBefore",
+		},
+	}
+	for name, tc := range fail {
+		t.Run(name, func(t *testing.T) {
+			_, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.com"), tc.opts...)
+			if assert.Error(t, err) {
+				ae, ok := err.(*xacme.Error)
+				assert.Fatal(t, ok, "error is not an acme error")
+				assert.Equals(t, 400, ae.StatusCode)
+				assert.Equals(t, "urn:ietf:params:acme:error:malformed", ae.ProblemType)
+				assert.True(t, strings.Contains(ae.Detail, tc.detail), ae.Detail)
+			}
+		})
+	}
+}
+
+func TestACME_wildcard(t *testing.T) {
+	dns := acme.NewTestDNSServer(t)
+	defer dns.Close()
+
+	provisioners := provisioner.List{
+		&provisioner.ACME{
+			Type:     "ACME",
+			Name:     "wildcard",
+			Resolver: dns.Addr(),
+		},
+		&provisioner.ACME{
+			Type:                 "ACME",
+			Name:                 "nowildcard",
+			Resolver:             dns.Addr(),
+			DisableWildcardNames: true,
+		},
+	}
+
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioners,
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(t *testing.T, prov string) *xacme.Client {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		client := &xacme.Client{
+			Key:          key,
+			DirectoryURL: srv.URL + "/acme/" + prov + "/directory",
+			HTTPClient:   srv.Client(),
+		}
+		_, err = client.Register(context.Background(), &xacme.Account{}, xacme.AcceptTOS)
+		assert.FatalError(t, err)
+		return client
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		ctx := context.Background()
+		client := newClient(t, "wildcard")
+		order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.internal", "*.example.internal"))
+		assert.FatalError(t, err)
+		// The base domain and the wildcard have separate authorizations.
+		assert.Len(t, 2, order.AuthzURLs)
+
+		var records []string
+		var challenges []*xacme.Challenge
+		authzs := make(map[bool]*xacme.Authorization)
+		for _, u := range order.AuthzURLs {
+			z, err := client.GetAuthorization(ctx, u)
+			assert.FatalError(t, err)
+			assert.Equals(t, "example.internal", z.Identifier.Value)
+			authzs[z.Wildcard] = z
+
+			var types []string
+			for _, chal := range z.Challenges {
+				types = append(types, chal.Type)
+				if chal.Type == "dns-01" {
+					record, err := client.DNS01ChallengeRecord(chal.Token)
+					assert.FatalError(t, err)
+					records = append(records, record)
+					challenges = append(challenges, chal)
+				}
+			}
+			if z.Wildcard {
+				// Wildcards can only be validated with dns-01.
+				assert.Equals(t, []string{"dns-01"}, types)
+			} else {
+				assert.Len(t, 3, types)
+			}
+		}
+		assert.Len(t, 2, authzs)
+
+		// Both authorizations are validated with the same record name.
+		dns.SetTXT("_acme-challenge.example.internal.", records...)
+		for _, chal := range challenges {
+			_, err = client.Accept(ctx, chal)
+			assert.FatalError(t, err)
+		}
+		for _, z := range authzs {
+			_, err = client.WaitAuthorization(ctx, z.URI)
+			assert.FatalError(t, err)
+		}
+
+		order, err = client.WaitOrder(ctx, order.URI)
+		assert.FatalError(t, err)
+		assert.Equals(t, xacme.StatusReady, order.Status)
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "example.internal"},
+			DNSNames: []string{"example.internal", "*.example.internal"},
+		}, priv)
+		assert.FatalError(t, err)
+		chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+		assert.FatalError(t, err)
+
+		leaf, err := x509.ParseCertificate(chain[0])
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{"*.example.internal", "example.internal"}, leaf.DNSNames)
+		assert.NoError(t, leaf.VerifyHostname("www.example.internal"))
+		assert.Error(t, leaf.VerifyHostname("a.www.example.internal"))
+	})
+
+	t.Run("fail/disabled", func(t *testing.T) {
+		client := newClient(t, "nowildcard")
+		_, err := client.AuthorizeOrder(context.Background(), xacme.DomainIDs("example.internal", "*.example.internal"))
+		if assert.Error(t, err) {
+			ae, ok := err.(*xacme.Error)
+			assert.Fatal(t, ok, "error is not an acme error")
+			assert.Equals(t, "urn:ietf:params:acme:error:rejectedIdentifier", ae.ProblemType)
+		}
+	})
+}
+
+// newAccountRequest sends a new-account request signed with the given account
+// key. If eab is not nil, the request includes an external account binding
+// signed with the given HMAC key.
+func newAccountRequest(t *testing.T, client *http.Client, baseURL string, key *ecdsa.PrivateKey, eab *acme.ExternalAccountKey, hmacKey []byte) (int, *acme.AError) {
+	t.Helper()
+	resp, err := client.Head(baseURL + "/new-nonce")
+	assert.FatalError(t, err)
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+
+	accountURL := baseURL + "/new-account"
+	payload := map[string]interface{}{"termsOfServiceAgreed": true}
+	if eab != nil {
+		jwk, err := json.Marshal(jose.JSONWebKey{Key: key.Public()})
+		assert.FatalError(t, err)
+		so := new(jose.SignerOptions)
+		so.WithHeader("kid", eab.ID)
+		so.WithHeader("url", accountURL)
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: hmacKey}, so)
+		assert.FatalError(t, err)
+		jws, err := signer.Sign(jwk)
+		assert.FatalError(t, err)
+		payload["externalAccountBinding"] = json.RawMessage(jws.FullSerialize())
+	}
+	b, err := json.Marshal(payload)
+	assert.FatalError(t, err)
+
+	so := &jose.SignerOptions{EmbedJWK: true}
+	so.WithHeader("nonce", nonce)
+	so.WithHeader("url", accountURL)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, so)
+	assert.FatalError(t, err)
+	jws, err := signer.Sign(b)
+	assert.FatalError(t, err)
+
+	resp, err = client.Post(accountURL, "application/jose+json", strings.NewReader(jws.FullSerialize()))
+	assert.FatalError(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		ae := new(acme.AError)
+		assert.FatalError(t, json.NewDecoder(resp.Body).Decode(ae))
+		return resp.StatusCode, ae
+	}
+	return resp.StatusCode, nil
+}
+
+func TestACME_externalAccountBinding(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{Type: "ACME", Name: "eab", RequireEAB: true},
+				&provisioner.ACME{Type: "ACME", Name: "reuse", RequireEAB: true, AllowEABKeyReuse: true},
+				&provisioner.ACME{Type: "ACME", Name: "optional"},
+			},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+	client := srv.Client()
+
+	newKey := func(t *testing.T) *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		return key
+	}
+	createKey := func(t *testing.T, name string) (*acme.ExternalAccountKey, []byte) {
+		p, err := auth.LoadProvisionerByName(name)
+		assert.FatalError(t, err)
+		eak, err := acmeAuth.CreateExternalAccountKey(p, "test")
+		assert.FatalError(t, err)
+		hmacKey, err := base64.RawURLEncoding.DecodeString(eak.HmacKey)
+		assert.FatalError(t, err)
+		return eak, hmacKey
+	}
+	getKeys := func(t *testing.T, name string) []*acme.ExternalAccountKey {
+		p, err := auth.LoadProvisionerByName(name)
+		assert.FatalError(t, err)
+		keys, err := acmeAuth.GetExternalAccountKeys(p)
+		assert.FatalError(t, err)
+		return keys
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		p, err := auth.LoadProvisionerByName("eab")
+		assert.FatalError(t, err)
+		assert.Equals(t, &acme.DirectoryMeta{ExternalAccountRequired: true}, acmeAuth.GetDirectory(p).Meta)
+		p, err = auth.LoadProvisionerByName("optional")
+		assert.FatalError(t, err)
+		assert.Nil(t, acmeAuth.GetDirectory(p).Meta)
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		eak, hmacKey := createKey(t, "eab")
+		code, ae := newAccountRequest(t, client, srv.URL+"/acme/eab", newKey(t), eak, hmacKey)
+		assert.Equals(t, http.StatusCreated, code)
+		assert.Nil(t, ae)
+
+		// The list of keys shows the bound account, but not the HMAC key.
+		keys := getKeys(t, "eab")
+		assert.Len(t, 1, keys)
+		assert.Equals(t, eak.ID, keys[0].ID)
+		assert.Equals(t, "", keys[0].HmacKey)
+		assert.Equals(t, acme.StatusValid, keys[0].Status)
+		assert.Len(t, 1, keys[0].Accounts)
+	})
+
+	t.Run("ok/optional", func(t *testing.T) {
+		code, _ := newAccountRequest(t, client, srv.URL+"/acme/optional", newKey(t), nil, nil)
+		assert.Equals(t, http.StatusCreated, code)
+		eak, hmacKey := createKey(t, "optional")
+		code, _ = newAccountRequest(t, client, srv.URL+"/acme/optional", newKey(t), eak, hmacKey)
+		assert.Equals(t, http.StatusCreated, code)
+	})
+
+	t.Run("ok/reuse", func(t *testing.T) {
+		eak, hmacKey := createKey(t, "reuse")
+		for i := 0; i < 2; i++ {
+			code, _ := newAccountRequest(t, client, srv.URL+"/acme/reuse", newKey(t), eak, hmacKey)
+			assert.Equals(t, http.StatusCreated, code)
+		}
+		keys := getKeys(t, "reuse")
+		assert.Len(t, 1, keys)
+		assert.Len(t, 2, keys[0].Accounts)
+	})
+
+	t.Run("fail/missing", func(t *testing.T) {
+		code, ae := newAccountRequest(t, client, srv.URL+"/acme/eab", newKey(t), nil, nil)
+		assert.Equals(t, http.StatusBadRequest, code)
+		assert.Equals(t, "urn:ietf:params:acme:error:externalAccountRequired", ae.Type)
+	})
+
+	t.Run("fail/wrong-hmac", func(t *testing.T) {
+		eak, _ := createKey(t, "eab")
+		code, ae := newAccountRequest(t, client, srv.URL+"/acme/eab", newKey(t), eak, []byte("the-wrong-hmac-key-the-wrong-key"))
+		assert.Equals(t, http.StatusUnauthorized, code)
+		assert.HasPrefix(t, ae.Detail, "error verifying external account binding")
+	})
+
+	t.Run("fail/reused", func(t *testing.T) {
+		eak, hmacKey := createKey(t, "eab")
+		code, _ := newAccountRequest(t, client, srv.URL+"/acme/eab", newKey(t), eak, hmacKey)
+		assert.Equals(t, http.StatusCreated, code)
+		code, ae := newAccountRequest(t, client, srv.URL+"/acme/eab", newKey(t), eak, hmacKey)
+		assert.Equals(t, http.StatusUnauthorized, code)
+		assert.Equals(t, "external account key "+eak.ID+" has already been used", ae.Detail)
+	})
+
+	t.Run("fail/revoked", func(t *testing.T) {
+		p, err := auth.LoadProvisionerByName("eab")
+		assert.FatalError(t, err)
+		eak, hmacKey := createKey(t, "eab")
+		revoked, err := acmeAuth.RevokeExternalAccountKey(p, eak.ID)
+		assert.FatalError(t, err)
+		assert.Equals(t, acme.StatusRevoked, revoked.Status)
+		code, ae := newAccountRequest(t, client, srv.URL+"/acme/eab", newKey(t), eak, hmacKey)
+		assert.Equals(t, http.StatusUnauthorized, code)
+		assert.Equals(t, "external account key "+eak.ID+" has been revoked", ae.Detail)
+	})
+
+	t.Run("fail/other-provisioner", func(t *testing.T) {
+		eak, hmacKey := createKey(t, "reuse")
+		code, ae := newAccountRequest(t, client, srv.URL+"/acme/eab", newKey(t), eak, hmacKey)
+		assert.Equals(t, http.StatusUnauthorized, code)
+		assert.Equals(t, "external account key "+eak.ID+" does not belong to provisioner eab", ae.Detail)
+	})
+}
+
+// postAsAccount posts the payload to the url signed with the kid of the
+// account and returns the status code, the headers and the decoded body.
+func postAsAccount(t *testing.T, client *http.Client, baseURL, url string, key *ecdsa.PrivateKey, kid string, payload []byte, v interface{}) (int, http.Header) {
+	t.Helper()
+	resp, err := client.Head(baseURL + "/new-nonce")
+	assert.FatalError(t, err)
+	resp.Body.Close()
+
+	so := new(jose.SignerOptions)
+	so.WithHeader("nonce", resp.Header.Get("Replay-Nonce"))
+	so.WithHeader("url", url)
+	so.WithHeader("kid", kid)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, so)
+	assert.FatalError(t, err)
+	jws, err := signer.Sign(payload)
+	assert.FatalError(t, err)
+	// The full serialization omits an empty payload, the flattened JSON is
+	// built from the compact one to send the POST-as-GET requests.
+	compact, err := jws.CompactSerialize()
+	assert.FatalError(t, err)
+	parts := strings.Split(compact, ".")
+	body, err := json.Marshal(map[string]string{
+		"protected": parts[0],
+		"payload":   parts[1],
+		"signature": parts[2],
+	})
+	assert.FatalError(t, err)
+
+	resp, err = client.Post(url, "application/jose+json", bytes.NewReader(body))
+	assert.FatalError(t, err)
+	defer resp.Body.Close()
+	assert.FatalError(t, json.NewDecoder(resp.Body).Decode(v))
+	return resp.StatusCode, resp.Header
+}
+
+func TestACME_deviceAttest01(t *testing.T) {
+	// Fabricated attestation root and device certificates with a YubiKey
+	// serial number.
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Attestation Root"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, rootKey.Public(), rootKey)
+	assert.FatalError(t, err)
+	root, err := x509.ParseCertificate(rootDER)
+	assert.FatalError(t, err)
+	issueDevice := func(t *testing.T, serial int, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		value, err := asn1.Marshal(serial)
+		assert.FatalError(t, err)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(serial)),
+			Subject:      pkix.Name{CommonName: "YubiKey PIV Attestation"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtraExtensions: []pkix.Extension{
+				{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}, Value: value},
+			},
+		}, issuer, key.Public(), issuerKey)
+		assert.FatalError(t, err)
+		return key, der
+	}
+
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{
+					Type:               "ACME",
+					Name:               "attest",
+					Challenges:         []string{provisioner.ACMEChallengeDeviceAttest01},
+					AttestationFormats: []string{"step"},
+					AttestationRoots:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}),
+				},
+			},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	ctx := context.Background()
+	baseURL := srv.URL + "/acme/attest"
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	client := &xacme.Client{
+		Key:          accountKey,
+		DirectoryURL: baseURL + "/directory",
+		HTTPClient:   srv.Client(),
+	}
+	acct, err := client.Register(ctx, &xacme.Account{}, xacme.AcceptTOS)
+	assert.FatalError(t, err)
+
+	// attest creates an order for the permanent identifier and responds to
+	// its challenge with a step attestation of the device key.
+	attest := func(t *testing.T, id string, deviceKey *ecdsa.PrivateKey, x5c []byte) (*xacme.Order, *acme.Challenge) {
+		order, err := client.AuthorizeOrder(ctx, []xacme.AuthzID{{Type: "permanent-identifier", Value: id}})
+		assert.FatalError(t, err)
+		z, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+		assert.FatalError(t, err)
+		assert.Equals(t, "permanent-identifier", z.Identifier.Type)
+		assert.Len(t, 1, z.Challenges)
+		chal := z.Challenges[0]
+		assert.Equals(t, "device-attest-01", chal.Type)
+
+		keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+		assert.FatalError(t, err)
+		sum := sha256.Sum256([]byte(keyAuth))
+		sig, err := ecdsa.SignASN1(rand.Reader, deviceKey, sum[:])
+		assert.FatalError(t, err)
+		attObj, err := cbor.Marshal(map[string]interface{}{
+			"fmt": "step",
+			"attStmt": map[string]interface{}{
+				"x5c": [][]byte{x5c},
+				"alg": -7,
+				"sig": sig,
+			},
+		})
+		assert.FatalError(t, err)
+		payload, err := json.Marshal(map[string]string{
+			"attObj": base64.RawURLEncoding.EncodeToString(attObj),
+		})
+		assert.FatalError(t, err)
+
+		ch := new(acme.Challenge)
+		code, _ := postAsAccount(t, srv.Client(), baseURL, chal.URI, accountKey, acct.URI, payload, ch)
+		assert.Equals(t, http.StatusOK, code)
+		return order, ch
+	}
+	csr := func(t *testing.T, key *ecdsa.PrivateKey, cn string) []byte {
+		b, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: cn},
+		}, key)
+		assert.FatalError(t, err)
+		return b
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		deviceKey, x5c := issueDevice(t, 12345678, root, rootKey)
+		order, ch := attest(t, "12345678", deviceKey, x5c)
+		assert.Equals(t, acme.StatusValid, ch.Status)
+		order, err := client.WaitOrder(ctx, order.URI)
+		assert.FatalError(t, err)
+		assert.Equals(t, acme.StatusReady, order.Status)
+
+		// The CSR key must be the attested key.
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, csr(t, otherKey, "12345678"), true)
+		if assert.Error(t, err) {
+			ae, ok := err.(*xacme.Error)
+			assert.Fatal(t, ok, "error is not an acme error")
+			assert.Equals(t, "urn:ietf:params:acme:error:badCSR", ae.ProblemType)
+			assert.Equals(t, "error finalizing order: CSR public key does not match the attested key", ae.Detail)
+		}
+
+		chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr(t, deviceKey, "12345678"), true)
+		assert.FatalError(t, err)
+		leaf, err := x509.ParseCertificate(chain[0])
+		assert.FatalError(t, err)
+		assert.Equals(t, "12345678", leaf.Subject.CommonName)
+		assert.Equals(t, "12345678", leaf.Subject.SerialNumber)
+		assert.Equals(t, deviceKey.Public(), leaf.PublicKey)
+	})
+
+	t.Run("fail/identifier", func(t *testing.T) {
+		deviceKey, x5c := issueDevice(t, 12345678, root, rootKey)
+		_, ch := attest(t, "87654321", deviceKey, x5c)
+		assert.Equals(t, acme.StatusInvalid, ch.Status)
+		if assert.NotNil(t, ch.Error) {
+			assert.Equals(t, "urn:ietf:params:acme:error:rejectedIdentifier", ch.Error.Type)
+		}
+	})
+
+	t.Run("fail/untrusted", func(t *testing.T) {
+		otherRootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		deviceKey, x5c := issueDevice(t, 12345678, rootTmpl, otherRootKey)
+		_, ch := attest(t, "12345678", deviceKey, x5c)
+		assert.Equals(t, acme.StatusInvalid, ch.Status)
+		if assert.NotNil(t, ch.Error) {
+			assert.Equals(t, "urn:ietf:params:acme:error:rejectedIdentifier", ch.Error.Type)
+		}
+	})
+}
+
+func TestACME_asyncValidation(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{
+					Type:       "ACME",
+					Name:       "http",
+					Challenges: []string{provisioner.ACMEChallengeHTTP01},
+					RetryAfter: &provisioner.Duration{Duration: 2 * time.Second},
+				},
+			},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+
+	// The http-01 validations wait until they are released.
+	stub := &challengeStub{records: make(map[string]string)}
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var requests int
+	acmeAuth.SetValidateOptions(func(url string) (*http.Response, error) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		<-release
+		return stub.httpGet(url)
+	}, stub.lookupTxt, stub.tlsDial)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	ctx := context.Background()
+	baseURL := srv.URL + "/acme/http"
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	client := &xacme.Client{
+		Key:          accountKey,
+		DirectoryURL: baseURL + "/directory",
+		HTTPClient:   srv.Client(),
+	}
+	acct, err := client.Register(ctx, &xacme.Account{}, xacme.AcceptTOS)
+	assert.FatalError(t, err)
+
+	// newChallenge creates an order for the name and returns its
+	// authorization and http-01 challenge.
+	newChallenge := func(t *testing.T, name string) (*xacme.Authorization, *xacme.Challenge) {
+		order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs(name))
+		assert.FatalError(t, err)
+		z, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+		assert.FatalError(t, err)
+		assert.Len(t, 1, z.Challenges)
+		return z, z.Challenges[0]
+	}
+	// poll posts to the challenge url until its status is not processing.
+	poll := func(t *testing.T, url string) (*acme.Challenge, http.Header) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			ch := new(acme.Challenge)
+			code, header := postAsAccount(t, srv.Client(), baseURL, url, accountKey, acct.URI, []byte("{}"), ch)
+			assert.Equals(t, http.StatusOK, code)
+			if ch.Status != acme.StatusProcessing || time.Now().After(deadline) {
+				return ch, header
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	z, chal := newChallenge(t, "example.com")
+	keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+	assert.FatalError(t, err)
+	stub.set("http://example.com"+client.HTTP01ChallengePath(chal.Token), keyAuth)
+
+	// The request that triggers the validation returns immediately, and the
+	// challenge and its authorization are processing while it runs.
+	for i := 0; i < 3; i++ {
+		ch := new(acme.Challenge)
+		code, header := postAsAccount(t, srv.Client(), baseURL, chal.URI, accountKey, acct.URI, []byte("{}"), ch)
+		assert.Equals(t, http.StatusOK, code)
+		assert.Equals(t, acme.StatusProcessing, ch.Status)
+		assert.Equals(t, "2", header.Get("Retry-After"))
+	}
+	az := new(acme.Authz)
+	code, header := postAsAccount(t, srv.Client(), baseURL, z.URI, accountKey, acct.URI, nil, az)
+	assert.Equals(t, http.StatusOK, code)
+	assert.Equals(t, acme.StatusPending, az.Status)
+	assert.Equals(t, acme.StatusProcessing, az.Challenges[0].Status)
+	assert.Equals(t, "2", header.Get("Retry-After"))
+
+	close(release)
+	ch, header := poll(t, chal.URI)
+	assert.Equals(t, acme.StatusValid, ch.Status)
+	assert.Equals(t, "", header.Get("Retry-After"))
+	_, err = client.WaitAuthorization(ctx, z.URI)
+	assert.FatalError(t, err)
+
+	// The concurrent polls only started one validation.
+	mu.Lock()
+	assert.Equals(t, 1, requests)
+	mu.Unlock()
+
+	// A failed validation stores its error in the challenge.
+	_, chal = newChallenge(t, "fail.example.com")
+	ch = new(acme.Challenge)
+	postAsAccount(t, srv.Client(), baseURL, chal.URI, accountKey, acct.URI, []byte("{}"), ch)
+	assert.Equals(t, acme.StatusProcessing, ch.Status)
+	ch, _ = poll(t, chal.URI)
+	assert.Equals(t, acme.StatusInvalid, ch.Status)
+	if assert.NotNil(t, ch.Error) {
+		assert.Equals(t, "urn:ietf:params:acme:error:connection", ch.Error.Type)
+		assert.True(t, strings.Contains(ch.Error.Detail, "status code 404"))
+	}
+}
+
+func TestACME_ipIdentifier(t *testing.T) {
+	// The http-01 validations of 127.0.0.1 are sent to a local listener on the
+	// port of the provisioner, from the source address of the provisioner.
+	var mu sync.Mutex
+	keyAuths := make(map[string]string)
+	challengeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keyAuth, ok := keyAuths[r.URL.Path]
+		mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(keyAuth))
+	}))
+	defer challengeSrv.Close()
+	challengePort := challengeSrv.Listener.Addr().(*net.TCPAddr).Port
+
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{
+					Type:                    "ACME",
+					Name:                    "ip",
+					RetryAfter:              &provisioner.Duration{Duration: time.Second},
+					X509Policy:              &provisioner.X509Policy{AllowedIPRanges: []string{"127.0.0.0/8"}},
+					HTTP01Port:              challengePort,
+					ValidationSourceAddress: "127.0.0.1",
+				},
+				&provisioner.ACME{
+					Type:                 "ACME",
+					Name:                 "noip",
+					DisableIPIdentifiers: true,
+				},
+			},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(t *testing.T, prov string) *xacme.Client {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		client := &xacme.Client{
+			Key:          key,
+			DirectoryURL: srv.URL + "/acme/" + prov + "/directory",
+			HTTPClient:   srv.Client(),
+		}
+		_, err = client.Register(context.Background(), &xacme.Account{}, xacme.AcceptTOS)
+		assert.FatalError(t, err)
+		return client
+	}
+	assertRejected := func(t *testing.T, err error) {
+		if assert.Error(t, err) {
+			ae, ok := err.(*xacme.Error)
+			assert.Fatal(t, ok, "error is not an acme error")
+			assert.Equals(t, "urn:ietf:params:acme:error:rejectedIdentifier", ae.ProblemType)
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		ctx := context.Background()
+		client := newClient(t, "ip")
+		order, err := client.AuthorizeOrder(ctx, xacme.IPIDs("127.0.0.1"))
+		assert.FatalError(t, err)
+		assert.Len(t, 1, order.AuthzURLs)
+
+		z, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+		assert.FatalError(t, err)
+		assert.Equals(t, xacme.AuthzID{Type: "ip", Value: "127.0.0.1"}, z.Identifier)
+
+		// IP addresses cannot be validated with dns-01.
+		var types []string
+		var chal *xacme.Challenge
+		for _, c := range z.Challenges {
+			types = append(types, c.Type)
+			if c.Type == "http-01" {
+				chal = c
+			}
+		}
+		assert.Equals(t, []string{"http-01", "tls-alpn-01"}, types)
+
+		keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+		assert.FatalError(t, err)
+		mu.Lock()
+		keyAuths[client.HTTP01ChallengePath(chal.Token)] = keyAuth
+		mu.Unlock()
+		_, err = client.Accept(ctx, chal)
+		assert.FatalError(t, err)
+		_, err = client.WaitAuthorization(ctx, z.URI)
+		assert.FatalError(t, err)
+
+		order, err = client.WaitOrder(ctx, order.URI)
+		assert.FatalError(t, err)
+		assert.Equals(t, xacme.StatusReady, order.Status)
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		}, priv)
+		assert.FatalError(t, err)
+		chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+		assert.FatalError(t, err)
+
+		// The address is signed as an IP SAN.
+		leaf, err := x509.ParseCertificate(chain[0])
+		assert.FatalError(t, err)
+		assert.Len(t, 0, leaf.DNSNames)
+		if assert.Len(t, 1, leaf.IPAddresses) {
+			assert.True(t, leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+		}
+	})
+
+	t.Run("fail/policy", func(t *testing.T) {
+		_, err := newClient(t, "ip").AuthorizeOrder(context.Background(), xacme.IPIDs("10.0.0.1"))
+		assertRejected(t, err)
+	})
+
+	t.Run("fail/disabled", func(t *testing.T) {
+		_, err := newClient(t, "noip").AuthorizeOrder(context.Background(), xacme.IPIDs("127.0.0.1"))
+		assertRejected(t, err)
+	})
+}
+
+func TestACME_termsOfService(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{
+					Type:           "ACME",
+					Name:           "tos",
+					TermsOfService: "https://example.com/acme/tos",
+					Website:        "https://example.com",
+					CAAIdentities:  []string{"ca.example.com"},
+					RequireEAB:     true,
+				},
+				&provisioner.ACME{
+					Type:           "ACME",
+					Name:           "open",
+					TermsOfService: "https://example.com/acme/tos",
+				},
+				&provisioner.ACME{
+					Type: "ACME",
+					Name: "plain",
+				},
+			},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	getMeta := func(t *testing.T, prov string) json.RawMessage {
+		resp, err := srv.Client().Get(srv.URL + "/acme/" + prov + "/directory")
+		assert.FatalError(t, err)
+		defer resp.Body.Close()
+		var dir map[string]json.RawMessage
+		assert.FatalError(t, json.NewDecoder(resp.Body).Decode(&dir))
+		return dir["meta"]
+	}
+	newClient := func(t *testing.T, prov string) *xacme.Client {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		return &xacme.Client{
+			Key:          key,
+			DirectoryURL: srv.URL + "/acme/" + prov + "/directory",
+			HTTPClient:   srv.Client(),
+		}
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		assert.Equals(t, `{"termsOfService":"https://example.com/acme/tos","website":"https://example.com",`+
+			`"caaIdentities":["ca.example.com"],"externalAccountRequired":true}`, string(getMeta(t, "tos")))
+		assert.Equals(t, `{"termsOfService":"https://example.com/acme/tos"}`, string(getMeta(t, "open")))
+		assert.Nil(t, getMeta(t, "plain"))
+
+		dir, err := newClient(t, "tos").Discover(context.Background())
+		assert.FatalError(t, err)
+		assert.Equals(t, "https://example.com/acme/tos", dir.Terms)
+		assert.Equals(t, "https://example.com", dir.Website)
+		assert.Equals(t, []string{"ca.example.com"}, dir.CAA)
+		assert.True(t, dir.ExternalAccountRequired)
+	})
+
+	t.Run("fail/not-agreed", func(t *testing.T) {
+		var prompted string
+		_, err := newClient(t, "open").Register(context.Background(), &xacme.Account{}, func(tosURL string) bool {
+			prompted = tosURL
+			return false
+		})
+		assert.Equals(t, "https://example.com/acme/tos", prompted)
+		if assert.Error(t, err) {
+			ae, ok := err.(*xacme.Error)
+			assert.Fatal(t, ok, "error is not an acme error")
+			assert.Equals(t, http.StatusForbidden, ae.StatusCode)
+			assert.Equals(t, "urn:ietf:params:acme:error:userActionRequired", ae.ProblemType)
+			assert.True(t, strings.Contains(strings.Join(ae.Header["Link"], ","),
+				`<https://example.com/acme/tos>;rel="terms-of-service"`))
+		}
+	})
+
+	t.Run("ok/agreed", func(t *testing.T) {
+		acct, err := newClient(t, "open").Register(context.Background(), &xacme.Account{}, xacme.AcceptTOS)
+		assert.FatalError(t, err)
+		assert.Equals(t, xacme.StatusValid, acct.Status)
+	})
+
+	t.Run("ok/no-terms", func(t *testing.T) {
+		_, err := newClient(t, "plain").Register(context.Background(), &xacme.Account{}, func(string) bool {
+			t.Error("unexpected terms of service prompt")
+			return false
+		})
+		assert.FatalError(t, err)
+	})
+}
+
+func TestACME_renewalInfo(t *testing.T) {
+	duration := func(d time.Duration) *provisioner.Duration {
+		return &provisioner.Duration{Duration: d}
+	}
+	const day = 24 * time.Hour
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.ACME{
+					Type:       "ACME",
+					Name:       "internal",
+					Challenges: []string{provisioner.ACMEChallengeDNS01},
+					Claims: &provisioner.Claims{
+						MaxTLSDur:     duration(day),
+						DefaultTLSDur: duration(day),
+					},
+				},
+				&provisioner.ACME{
+					Type:       "ACME",
+					Name:       "partner",
+					Challenges: []string{provisioner.ACMEChallengeDNS01},
+					Claims: &provisioner.Claims{
+						MaxTLSDur:     duration(90 * day),
+						DefaultTLSDur: duration(90 * day),
+					},
+				},
+			},
+			Backdate: duration(0),
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), srv.Listener.Addr().String(), "acme", auth)
+	assert.FatalError(t, err)
+	stub := &challengeStub{records: make(map[string]string)}
+	acmeAuth.SetValidateOptions(stub.httpGet, stub.lookupTxt, stub.tlsDial)
+
+	mux := chi.NewRouter()
+	mux.Route("/acme", func(r chi.Router) {
+		acmeAPI.New(acmeAuth).Route(r)
+	})
+	srv.Config.Handler = mux
+	srv.StartTLS()
+	defer srv.Close()
+
+	ctx := context.Background()
+	newClient := func(t *testing.T, prov string) *xacme.Client {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		client := &xacme.Client{
+			Key:          key,
+			DirectoryURL: srv.URL + "/acme/" + prov + "/directory",
+			HTTPClient:   srv.Client(),
+		}
+		_, err = client.Register(ctx, &xacme.Account{}, xacme.AcceptTOS)
+		assert.FatalError(t, err)
+		return client
+	}
+	// issue completes an order for example.com and returns the certificate.
+	issue := func(t *testing.T, client *xacme.Client, opts ...xacme.OrderOption) *x509.Certificate {
+		order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("example.com"), opts...)
+		assert.FatalError(t, err)
+		for _, u := range order.AuthzURLs {
+			z, err := client.GetAuthorization(ctx, u)
+			assert.FatalError(t, err)
+			chal := z.Challenges[0]
+			record, err := client.DNS01ChallengeRecord(chal.Token)
+			assert.FatalError(t, err)
+			stub.set("_acme-challenge."+z.Identifier.Value, record)
+			_, err = client.Accept(ctx, chal)
+			assert.FatalError(t, err)
+			_, err = client.WaitAuthorization(ctx, z.URI)
+			assert.FatalError(t, err)
+		}
+		order, err = client.WaitOrder(ctx, order.URI)
+		assert.FatalError(t, err)
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			DNSNames: []string{"example.com"},
+		}, priv)
+		assert.FatalError(t, err)
+		chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+		assert.FatalError(t, err)
+		leaf, err := x509.ParseCertificate(chain[0])
+		assert.FatalError(t, err)
+		return leaf
+	}
+	// getRenewalInfo returns the renewal information of a certificate from
+	// the URL in the directory of the provisioner.
+	getRenewalInfo := func(t *testing.T, prov string, leaf *x509.Certificate) *acme.RenewalInfo {
+		resp, err := srv.Client().Get(srv.URL + "/acme/" + prov + "/directory")
+		assert.FatalError(t, err)
+		var dir acme.Directory
+		err = json.NewDecoder(resp.Body).Decode(&dir)
+		resp.Body.Close()
+		assert.FatalError(t, err)
+
+		resp, err = srv.Client().Get(dir.RenewalInfo + "/" + acme.RenewalInfoID(leaf))
+		assert.FatalError(t, err)
+		defer resp.Body.Close()
+		assert.Equals(t, http.StatusOK, resp.StatusCode)
+		assert.Equals(t, "21600", resp.Header.Get("Retry-After"))
+		var ri acme.RenewalInfo
+		assert.FatalError(t, json.NewDecoder(resp.Body).Decode(&ri))
+		return &ri
+	}
+
+	tests := map[string]struct {
+		provisioner string
+		notAfter    time.Duration
+		duration    time.Duration
+	}{
+		"internal":          {"internal", 0, day},
+		"partner":           {"partner", 0, 90 * day},
+		"partner/notAfter":  {"partner", 30 * day, 30 * day},
+		"internal/notAfter": {"internal", 12 * time.Hour, 12 * time.Hour},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var opts []xacme.OrderOption
+			if tc.notAfter > 0 {
+				opts = append(opts, xacme.WithOrderNotAfter(time.Now().Add(tc.notAfter).Truncate(time.Second)))
+			}
+			leaf := issue(t, newClient(t, tc.provisioner), opts...)
+			d := leaf.NotAfter.Sub(leaf.NotBefore)
+			// An explicit notAfter is truncated to the second.
+			assert.True(t, d <= tc.duration && d > tc.duration-2*time.Second, d)
+
+			// The window goes from two thirds to five sixths of the validity.
+			ri := getRenewalInfo(t, tc.provisioner, leaf)
+			assert.Equals(t, leaf.NotBefore.Add(d*2/3).UTC(), ri.SuggestedWindow.Start)
+			assert.Equals(t, leaf.NotBefore.Add(d*5/6).UTC(), ri.SuggestedWindow.End)
+		})
+	}
+
+	t.Run("fail/over-max", func(t *testing.T) {
+		// The partner lifetime is not allowed in the internal provisioner.
+		_, err := newClient(t, "internal").AuthorizeOrder(ctx, xacme.DomainIDs("example.com"),
+			xacme.WithOrderNotAfter(time.Now().Add(30*day)))
+		if assert.Error(t, err) {
+			ae, ok := err.(*xacme.Error)
+			assert.Fatal(t, ok, "error is not an acme error")
+			assert.Equals(t, "urn:ietf:params:acme:error:malformed", ae.ProblemType)
+		}
+	})
+
+	t.Run("fail/unknown-certificate", func(t *testing.T) {
+		resp, err := srv.Client().Get(srv.URL + "/acme/internal/renewal-info/AQID.AQI")
+		assert.FatalError(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
@@ -3,26 +3,48 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/logging"
+	"github.com/smallstep/cli/jose"
 )
 
 // NewAccountRequest represents the payload for a new account request.
 type NewAccountRequest struct {
-	Contact              []string `json:"contact"`
-	OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
-	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	Contact                []string        `json:"contact"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+	TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
 }
 
+// validateContacts checks the contacts of an account, only mailto URLs with
+// one email address and without header fields are supported.
 func validateContacts(cs []string) error {
 	for _, c := range cs {
 		if len(c) == 0 {
 			return acme.MalformedErr(errors.New("contact cannot be empty string"))
 		}
+		u, err := url.Parse(c)
+		if err != nil || u.Scheme == "" {
+			return acme.InvalidContactErr(errors.Errorf("contact %s is not a valid URL", c))
+		}
+		if !strings.EqualFold(u.Scheme, "mailto") {
+			return acme.UnsupportedContactErr(errors.Errorf("contact %s: only mailto contacts are supported", c))
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return acme.InvalidContactErr(errors.Errorf("contact %s cannot have header fields", c))
+		}
+		addr, err := mail.ParseAddress(u.Opaque)
+		if err != nil || addr.Name != "" || addr.Address != u.Opaque {
+			return acme.InvalidContactErr(errors.Errorf("contact %s is not a valid email address", c))
+		}
 	}
 	return nil
 }
@@ -69,6 +91,27 @@ func (u *UpdateAccountRequest) Validate() error {
 	}
 }
 
+// KeyChangeRequest represents the payload of the inner JWS of a key-change
+// request.
+type KeyChangeRequest struct {
+	Account string           `json:"account"`
+	OldKey  *jose.JSONWebKey `json:"oldKey"`
+}
+
+// Validate validates a key-change request body.
+func (k *KeyChangeRequest) Validate() error {
+	switch {
+	case k.Account == "":
+		return acme.MalformedErr(errors.New("key-change account cannot be empty"))
+	case k.OldKey == nil:
+		return acme.MalformedErr(errors.New("key-change oldKey cannot be empty"))
+	case !k.OldKey.Valid():
+		return acme.MalformedErr(errors.New("key-change oldKey is not a valid jwk"))
+	default:
+		return nil
+	}
+}
+
 // NewAccount is the handler resource for creating new ACME accounts.
 func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 	prov, err := provisionerFromContext(r)
@@ -107,15 +150,27 @@ func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 			api.WriteError(w, acme.AccountDoesNotExistErr(nil))
 			return
 		}
+		// The terms of service of the provisioner, if any, must be agreed.
+		if tos := termsOfService(prov); tos != "" && !nar.TermsOfServiceAgreed {
+			w.Header().Add("Link", link(tos, "terms-of-service"))
+			api.WriteError(w, acme.UserActionRequiredErr(errors.Errorf("the terms of service at %s must be agreed", tos)))
+			return
+		}
 		jwk, err := jwkFromContext(r)
 		if err != nil {
 			api.WriteError(w, err)
 			return
 		}
+		eab, err := parseExternalAccountBinding(r, &nar)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
 
 		if acc, err = h.Auth.NewAccount(prov, acme.AccountOptions{
-			Key:     jwk,
-			Contact: nar.Contact,
+			Key:                    jwk,
+			Contact:                nar.Contact,
+			ExternalAccountBinding: eab,
 		}); err != nil {
 			api.WriteError(w, err)
 			return
@@ -130,6 +185,41 @@ func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 	api.JSONStatus(w, acc, httpStatus)
 }
 
+// termsOfService returns the URL of the terms of service of an ACME
+// provisioner, or an empty string if it does not have them.
+func termsOfService(p provisioner.Interface) string {
+	if acmeProv, ok := p.(*provisioner.ACME); ok {
+		return acmeProv.TermsOfService
+	}
+	return ""
+}
+
+// parseExternalAccountBinding parses the external account binding in the
+// new-account request, if any, and validates that its url header matches the
+// url of the request. The signature is validated by the ACME authority.
+func parseExternalAccountBinding(r *http.Request, nar *NewAccountRequest) (*jose.JSONWebSignature, error) {
+	if len(nar.ExternalAccountBinding) == 0 {
+		return nil, nil
+	}
+	eab, err := jose.ParseJWS(string(nar.ExternalAccountBinding))
+	if err != nil {
+		return nil, acme.MalformedErr(errors.Wrap(err, "failed to parse external account binding"))
+	}
+	if len(eab.Signatures) != 1 {
+		return nil, acme.MalformedErr(errors.New("external account binding must have one signature"))
+	}
+	jws, err := jwsFromContext(r)
+	if err != nil {
+		return nil, err
+	}
+	eabURL, _ := eab.Signatures[0].Protected.ExtraHeaders["url"].(string)
+	jwsURL, _ := jws.Signatures[0].Protected.ExtraHeaders["url"].(string)
+	if eabURL != jwsURL {
+		return nil, acme.MalformedErr(errors.Errorf("url header in external account binding (%s) does not match request url (%s)", eabURL, jwsURL))
+	}
+	return eab, nil
+}
+
 // GetUpdateAccount is the api for updating an ACME account.
 func (h *Handler) GetUpdateAccount(w http.ResponseWriter, r *http.Request) {
 	prov, err := provisionerFromContext(r)
@@ -173,6 +263,114 @@ func (h *Handler) GetUpdateAccount(w http.ResponseWriter, r *http.Request) {
 	api.JSON(w, acc)
 }
 
+// KeyChange is the api for rolling over the key of an ACME account. The outer
+// JWS is signed with the current key of the account, and its payload is an
+// inner JWS signed with the new key.
+func (h *Handler) KeyChange(w http.ResponseWriter, r *http.Request) {
+	prov, err := provisionerFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	acc, err := accountFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	outer, err := jwsFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	payload, err := payloadFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	newKey, kcr, err := parseKeyChangeJWS(string(payload.value), outer.Signatures[0].Protected)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	// The kid of the outer JWS has been validated by the middleware.
+	if kid := outer.Signatures[0].Protected.KeyID; kcr.Account != kid {
+		api.WriteError(w, acme.MalformedErr(errors.Errorf("account in key-change "+
+			"request (%s) does not match the jws kid (%s)", kcr.Account, kid)))
+		return
+	}
+
+	newAcc, err := h.Auth.ChangeAccountKey(prov, acc.GetID(), kcr.OldKey, newKey)
+	if err != nil {
+		// A conflict includes the location of the account using the new key.
+		if ae, ok := err.(*acme.Error); ok && ae.StatusCode() == http.StatusConflict {
+			if other, err := h.Auth.GetAccountByKey(prov, newKey); err == nil {
+				w.Header().Set("Location", h.Auth.GetLink(acme.AccountLink, acme.URLSafeProvisionerName(prov), true, other.GetID()))
+			}
+		}
+		api.WriteError(w, err)
+		return
+	}
+	w.Header().Set("Location", h.Auth.GetLink(acme.AccountLink, acme.URLSafeProvisionerName(prov), true, newAcc.GetID()))
+	api.JSON(w, newAcc)
+}
+
+// parseKeyChangeJWS parses and verifies the inner JWS of a key-change request.
+// The inner JWS must be signed with the new key, embedded in the jwk header,
+// it must have the same url as the outer JWS and it cannot have a nonce. It
+// returns the new key and the key-change payload.
+func parseKeyChangeJWS(s string, outer jose.Header) (*jose.JSONWebKey, *KeyChangeRequest, error) {
+	jws, err := jose.ParseJWS(s)
+	if err != nil {
+		return nil, nil, acme.MalformedErr(errors.Wrap(err, "failed to parse key-change inner JWS"))
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, nil, acme.MalformedErr(errors.New("key-change inner JWS must have one signature"))
+	}
+	sig := jws.Signatures[0]
+	if uh := sig.Unprotected; len(uh.KeyID) > 0 || uh.JSONWebKey != nil || len(uh.Algorithm) > 0 ||
+		len(uh.Nonce) > 0 || len(uh.ExtraHeaders) > 0 {
+		return nil, nil, acme.MalformedErr(errors.New("key-change inner JWS must not use the unprotected header"))
+	}
+	hdr := sig.Protected
+	if err := validateJWSAlgorithm(hdr); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case hdr.JSONWebKey == nil:
+		return nil, nil, acme.MalformedErr(errors.New("key-change inner JWS must have a jwk header"))
+	case !hdr.JSONWebKey.Valid():
+		return nil, nil, acme.MalformedErr(errors.New("invalid jwk in key-change inner JWS"))
+	case len(hdr.KeyID) > 0:
+		return nil, nil, acme.MalformedErr(errors.New("key-change inner JWS must not have a kid header"))
+	case len(hdr.Nonce) > 0:
+		return nil, nil, acme.MalformedErr(errors.New("key-change inner JWS must not have a nonce header"))
+	}
+	innerURL, _ := hdr.ExtraHeaders["url"].(string)
+	outerURL, _ := outer.ExtraHeaders["url"].(string)
+	if innerURL != outerURL {
+		return nil, nil, acme.MalformedErr(errors.Errorf("url header in key-change "+
+			"inner JWS (%s) does not match the outer JWS url (%s)", innerURL, outerURL))
+	}
+
+	newKey := hdr.JSONWebKey
+	if len(newKey.Algorithm) != 0 && newKey.Algorithm != hdr.Algorithm {
+		return nil, nil, acme.MalformedErr(errors.New("verifier and signature algorithm do not match"))
+	}
+	b, err := jws.Verify(newKey)
+	if err != nil {
+		return nil, nil, acme.MalformedErr(errors.Wrap(err, "error verifying key-change inner JWS"))
+	}
+	kcr := new(KeyChangeRequest)
+	if err := json.Unmarshal(b, kcr); err != nil {
+		return nil, nil, acme.MalformedErr(errors.Wrap(err, "failed to unmarshal key-change request payload"))
+	}
+	if err := kcr.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return newKey, kcr, nil
+}
+
 func logOrdersByAccount(w http.ResponseWriter, oids []string) {
 	if rl, ok := w.(logging.ResponseLogger); ok {
 		m := map[string]interface{}{
@@ -3,10 +3,14 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,7 +18,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db/memory"
 	"github.com/smallstep/cli/jose"
 )
 
@@ -50,7 +56,7 @@ func TestNewAccountRequestValidate(t *testing.T) {
 			return test{
 				nar: &NewAccountRequest{
 					OnlyReturnExisting: true,
-					Contact:            []string{"foo", "bar"},
+					Contact:            []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 				},
 				err: acme.MalformedErr(errors.Errorf("incompatible input; onlyReturnExisting must be alone")),
 			}
@@ -58,15 +64,55 @@ func TestNewAccountRequestValidate(t *testing.T) {
 		"fail/bad-contact": func(t *testing.T) test {
 			return test{
 				nar: &NewAccountRequest{
-					Contact: []string{"foo", ""},
+					Contact: []string{"mailto:foo@example.com", ""},
 				},
 				err: acme.MalformedErr(errors.Errorf("contact cannot be empty string")),
 			}
 		},
+		"fail/contact-not-url": func(t *testing.T) test {
+			return test{
+				nar: &NewAccountRequest{
+					Contact: []string{"foo@example.com"},
+				},
+				err: acme.InvalidContactErr(errors.Errorf("contact foo@example.com is not a valid URL")),
+			}
+		},
+		"fail/unsupported-contact": func(t *testing.T) test {
+			return test{
+				nar: &NewAccountRequest{
+					Contact: []string{"tel:+15551234567"},
+				},
+				err: acme.UnsupportedContactErr(errors.Errorf("contact tel:+15551234567: only mailto contacts are supported")),
+			}
+		},
+		"fail/contact-hfields": func(t *testing.T) test {
+			return test{
+				nar: &NewAccountRequest{
+					Contact: []string{"mailto:foo@example.com?subject=hello"},
+				},
+				err: acme.InvalidContactErr(errors.Errorf("contact mailto:foo@example.com?subject=hello cannot have header fields")),
+			}
+		},
+		"fail/contact-multiple-addresses": func(t *testing.T) test {
+			return test{
+				nar: &NewAccountRequest{
+					Contact: []string{"mailto:foo@example.com,bar@example.com"},
+				},
+				err: acme.InvalidContactErr(errors.Errorf("contact mailto:foo@example.com,bar@example.com is not a valid email address")),
+			}
+		},
+		"fail/contact-bad-address": func(t *testing.T) test {
+			return test{
+				nar: &NewAccountRequest{
+					Contact: []string{"mailto:foo"},
+				},
+				err: acme.InvalidContactErr(errors.Errorf("contact mailto:foo is not a valid email address")),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			return test{
 				nar: &NewAccountRequest{
-					Contact: []string{"foo", "bar"},
+					Contact: []string{"mailto:foo@example.com", "MAILTO:bar@example.com"},
 				},
 			}
 		},
@@ -105,7 +151,7 @@ func TestUpdateAccountRequestValidate(t *testing.T) {
 		"fail/incompatible-input": func(t *testing.T) test {
 			return test{
 				uar: &UpdateAccountRequest{
-					Contact: []string{"foo", "bar"},
+					Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 					Status:  "foo",
 				},
 				err: acme.MalformedErr(errors.Errorf("incompatible input; " +
@@ -115,7 +161,7 @@ func TestUpdateAccountRequestValidate(t *testing.T) {
 		"fail/bad-contact": func(t *testing.T) test {
 			return test{
 				uar: &UpdateAccountRequest{
-					Contact: []string{"foo", ""},
+					Contact: []string{"mailto:foo@example.com", ""},
 				},
 				err: acme.MalformedErr(errors.Errorf("contact cannot be empty string")),
 			}
@@ -132,7 +178,7 @@ func TestUpdateAccountRequestValidate(t *testing.T) {
 		"ok/contact": func(t *testing.T) test {
 			return test{
 				uar: &UpdateAccountRequest{
-					Contact: []string{"foo", "bar"},
+					Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 				},
 			}
 		},
@@ -304,6 +350,12 @@ func TestHandlerNewAccount(t *testing.T) {
 		Orders: fmt.Sprintf("https://ca.smallstep.com/acme/account/%s/orders", accID),
 	}
 	prov := newProv()
+	tosProv := &provisioner.ACME{
+		Type:           "ACME",
+		Name:           "test@acme-provisioner.com",
+		TermsOfService: "https://example.com/tos",
+	}
+	assert.FatalError(t, tosProv.Init(provisioner.Config{Claims: globalProvisionerClaims}))
 
 	url := "https://ca.smallstep.com/acme/new-account"
 
@@ -312,6 +364,7 @@ func TestHandlerNewAccount(t *testing.T) {
 		ctx        context.Context
 		statusCode int
 		problem    *acme.Error
+		link       []string
 	}
 	var tests = map[string]func(t *testing.T) test{
 		"fail/no-provisioner": func(t *testing.T) test {
@@ -356,7 +409,7 @@ func TestHandlerNewAccount(t *testing.T) {
 		},
 		"fail/malformed-payload-error": func(t *testing.T) test {
 			nar := &NewAccountRequest{
-				Contact: []string{"foo", ""},
+				Contact: []string{"mailto:foo@example.com", ""},
 			}
 			b, err := json.Marshal(nar)
 			assert.FatalError(t, err)
@@ -384,7 +437,7 @@ func TestHandlerNewAccount(t *testing.T) {
 		},
 		"fail/no-jwk": func(t *testing.T) test {
 			nar := &NewAccountRequest{
-				Contact: []string{"foo", "bar"},
+				Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 			}
 			b, err := json.Marshal(nar)
 			assert.FatalError(t, err)
@@ -398,7 +451,7 @@ func TestHandlerNewAccount(t *testing.T) {
 		},
 		"fail/nil-jwk": func(t *testing.T) test {
 			nar := &NewAccountRequest{
-				Contact: []string{"foo", "bar"},
+				Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 			}
 			b, err := json.Marshal(nar)
 			assert.FatalError(t, err)
@@ -413,7 +466,7 @@ func TestHandlerNewAccount(t *testing.T) {
 		},
 		"fail/NewAccount-error": func(t *testing.T) test {
 			nar := &NewAccountRequest{
-				Contact: []string{"foo", "bar"},
+				Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 			}
 			b, err := json.Marshal(nar)
 			assert.FatalError(t, err)
@@ -436,9 +489,51 @@ func TestHandlerNewAccount(t *testing.T) {
 				problem:    acme.ServerInternalErr(errors.New("force")),
 			}
 		},
+		"fail/terms-of-service-not-agreed": func(t *testing.T) test {
+			nar := &NewAccountRequest{
+				Contact: []string{"mailto:foo@example.com"},
+			}
+			b, err := json.Marshal(nar)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, tosProv)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				statusCode: 403,
+				problem:    acme.UserActionRequiredErr(errors.New("the terms of service at https://example.com/tos must be agreed")),
+				link:       []string{`<https://example.com/tos>;rel="terms-of-service"`},
+			}
+		},
+		"ok/terms-of-service-agreed": func(t *testing.T) test {
+			nar := &NewAccountRequest{
+				Contact:              []string{"mailto:foo@example.com"},
+				TermsOfServiceAgreed: true,
+			}
+			b, err := json.Marshal(nar)
+			assert.FatalError(t, err)
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, tosProv)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			return test{
+				auth: &mockAcmeAuthority{
+					newAccount: func(p provisioner.Interface, ops acme.AccountOptions) (*acme.Account, error) {
+						assert.Equals(t, p, tosProv)
+						return &acc, nil
+					},
+					getLink: func(typ acme.Link, provID string, abs bool, in ...string) string {
+						return fmt.Sprintf("https://ca.smallstep.com/acme/%s/account/%s",
+							acme.URLSafeProvisionerName(prov), accID)
+					},
+				},
+				ctx:        ctx,
+				statusCode: 201,
+			}
+		},
 		"ok/new-account": func(t *testing.T) test {
 			nar := &NewAccountRequest{
-				Contact: []string{"foo", "bar"},
+				Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 			}
 			b, err := json.Marshal(nar)
 			assert.FatalError(t, err)
@@ -518,6 +613,7 @@ func TestHandlerNewAccount(t *testing.T) {
 				assert.Equals(t, ae.Detail, prob.Detail)
 				assert.Equals(t, ae.Identifier, prob.Identifier)
 				assert.Equals(t, ae.Subproblems, prob.Subproblems)
+				assert.Equals(t, res.Header["Link"], tc.link)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
 			} else {
 				expB, err := json.Marshal(acc)
@@ -613,7 +709,7 @@ func TestHandlerGetUpdateAccount(t *testing.T) {
 		},
 		"fail/malformed-payload-error": func(t *testing.T) test {
 			uar := &UpdateAccountRequest{
-				Contact: []string{"foo", ""},
+				Contact: []string{"mailto:foo@example.com", ""},
 			}
 			b, err := json.Marshal(uar)
 			assert.FatalError(t, err)
@@ -650,7 +746,7 @@ func TestHandlerGetUpdateAccount(t *testing.T) {
 		},
 		"fail/UpdateAccount-error": func(t *testing.T) test {
 			uar := &UpdateAccountRequest{
-				Contact: []string{"foo", "bar"},
+				Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 			}
 			b, err := json.Marshal(uar)
 			assert.FatalError(t, err)
@@ -702,7 +798,7 @@ func TestHandlerGetUpdateAccount(t *testing.T) {
 		},
 		"ok/new-account": func(t *testing.T) test {
 			uar := &UpdateAccountRequest{
-				Contact: []string{"foo", "bar"},
+				Contact: []string{"mailto:foo@example.com", "mailto:bar@example.com"},
 			}
 			b, err := json.Marshal(uar)
 			assert.FatalError(t, err)
@@ -788,3 +884,462 @@ func TestHandlerGetUpdateAccount(t *testing.T) {
 		})
 	}
 }
+
+type accountFlowSignAuth struct {
+	prov provisioner.Interface
+}
+
+func (s *accountFlowSignAuth) Sign(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *accountFlowSignAuth) LoadProvisionerByID(id string) (provisioner.Interface, error) {
+	if id != s.prov.GetID() {
+		return nil, acme.AccountDoesNotExistErr(errors.Errorf("provisioner %s not found", id))
+	}
+	return s.prov, nil
+}
+
+func (s *accountFlowSignAuth) GetIntermediateCertificate() *x509.Certificate {
+	return nil
+}
+
+func (s *accountFlowSignAuth) GetCertificate(serial string) (*authority.CertificateInfo, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *accountFlowSignAuth) IsRevoked(serial string) (bool, error) {
+	return false, errors.New("not implemented")
+}
+
+func (s *accountFlowSignAuth) Revoke(ctx context.Context, opts *authority.RevokeOptions) error {
+	return errors.New("not implemented")
+}
+
+func TestHandler_accountFlow(t *testing.T) {
+	prov := newProv()
+	provName := url.PathEscape(prov.GetName())
+
+	tests := map[string]struct {
+		dns string
+	}{
+		"ok":              {"ca.smallstep.com"},
+		"ok/external-url": {"proxy.example.com/ca"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			acmeAuth, err := acme.NewAuthority(memory.New(), tc.dns, "acme", &accountFlowSignAuth{prov: prov})
+			assert.FatalError(t, err)
+			router := chi.NewRouter()
+			router.Route("/acme", func(r chi.Router) {
+				New(acmeAuth).Route(r)
+			})
+
+			// do sends the request to the CA as a proxy would, the absolute
+			// links use the external url.
+			do := func(method, link string, body []byte) (*http.Response, []byte) {
+				target := "https://ca.internal" + strings.TrimPrefix(link, "https://"+tc.dns)
+				req := httptest.NewRequest(method, target, bytes.NewReader(body))
+				if body != nil {
+					req.Header.Set("Content-Type", "application/jose+json")
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				res := w.Result()
+				b, err := ioutil.ReadAll(res.Body)
+				assert.FatalError(t, err)
+				res.Body.Close()
+				return res, b
+			}
+
+			// Directory
+			res, body := do("GET", "https://"+tc.dns+"/acme/"+provName+"/directory", nil)
+			if res.StatusCode != 200 {
+				t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+			}
+			var dir acme.Directory
+			assert.FatalError(t, json.Unmarshal(body, &dir))
+			assert.Equals(t, "https://"+tc.dns+"/acme/"+provName+"/new-account", dir.NewAccount)
+
+			// New nonce
+			res, _ = do("HEAD", dir.NewNonce, nil)
+			assert.Equals(t, 200, res.StatusCode)
+			nonce := res.Header.Get("Replay-Nonce")
+			assert.True(t, nonce != "")
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			pub := jwk.Public()
+			sign := func(headers map[string]interface{}, payload interface{}) []byte {
+				so := new(jose.SignerOptions)
+				for k, v := range headers {
+					so.WithHeader(jose.HeaderKey(k), v)
+				}
+				signer, err := jose.NewSigner(jose.SigningKey{
+					Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+					Key:       jwk.Key,
+				}, so)
+				assert.FatalError(t, err)
+				// A nil payload is a POST-as-GET request.
+				b := []byte{}
+				if payload != nil {
+					b, err = json.Marshal(payload)
+					assert.FatalError(t, err)
+				}
+				jws, err := signer.Sign(b)
+				assert.FatalError(t, err)
+				return []byte(jws.FullSerialize())
+			}
+			problem := func(body []byte) *acme.AError {
+				ae := new(acme.AError)
+				assert.FatalError(t, json.Unmarshal(body, ae))
+				return ae
+			}
+
+			// New account with an invalid contact
+			res, body = do("POST", dir.NewAccount, sign(map[string]interface{}{
+				"jwk": &pub, "nonce": nonce, "url": dir.NewAccount,
+			}, &NewAccountRequest{Contact: []string{"tel:+15551234567"}}))
+			assert.Equals(t, 400, res.StatusCode)
+			assert.Equals(t, "urn:ietf:params:acme:error:unsupportedContact", problem(body).Type)
+			nonce = res.Header.Get("Replay-Nonce")
+
+			// New account
+			res, body = do("POST", dir.NewAccount, sign(map[string]interface{}{
+				"jwk": &pub, "nonce": nonce, "url": dir.NewAccount,
+			}, &NewAccountRequest{Contact: []string{"mailto:jane@example.com"}, TermsOfServiceAgreed: true}))
+			if res.StatusCode != 201 {
+				t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+			}
+			kid := res.Header.Get("Location")
+			assert.True(t, strings.HasPrefix(kid, "https://"+tc.dns+"/acme/"+provName+"/account/"))
+			var acc acme.Account
+			assert.FatalError(t, json.Unmarshal(body, &acc))
+			assert.Equals(t, []string{"mailto:jane@example.com"}, acc.Contact)
+			usedNonce := nonce
+			nonce = res.Header.Get("Replay-Nonce")
+
+			// Account requests must use the kid
+			res, body = do("POST", kid, sign(map[string]interface{}{
+				"jwk": &pub, "nonce": nonce, "url": kid,
+			}, &UpdateAccountRequest{Contact: []string{"mailto:john@example.com"}}))
+			assert.Equals(t, 400, res.StatusCode)
+			assert.Equals(t, "urn:ietf:params:acme:error:malformed", problem(body).Type)
+			nonce = res.Header.Get("Replay-Nonce")
+
+			// Update the account
+			res, body = do("POST", kid, sign(map[string]interface{}{
+				"kid": kid, "nonce": nonce, "url": kid,
+			}, &UpdateAccountRequest{Contact: []string{"mailto:john@example.com"}}))
+			if res.StatusCode != 200 {
+				t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+			}
+			acc = acme.Account{}
+			assert.FatalError(t, json.Unmarshal(body, &acc))
+			assert.Equals(t, []string{"mailto:john@example.com"}, acc.Contact)
+			assert.Equals(t, kid, res.Header.Get("Location"))
+
+			// Replayed nonce
+			res, body = do("POST", kid, sign(map[string]interface{}{
+				"kid": kid, "nonce": usedNonce, "url": kid,
+			}, &UpdateAccountRequest{Contact: []string{"mailto:jane@example.com"}}))
+			assert.Equals(t, 400, res.StatusCode)
+			assert.Equals(t, "urn:ietf:params:acme:error:badNonce", problem(body).Type)
+
+			// The account has not changed
+			res, body = do("POST", kid, sign(map[string]interface{}{
+				"kid": kid, "nonce": res.Header.Get("Replay-Nonce"), "url": kid,
+			}, nil))
+			if res.StatusCode != 200 {
+				t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+			}
+			acc = acme.Account{}
+			assert.FatalError(t, json.Unmarshal(body, &acc))
+			assert.Equals(t, []string{"mailto:john@example.com"}, acc.Contact)
+		})
+	}
+}
+
+// testFlow sends signed requests to the routes of a handler backed by an
+// in-memory database.
+type testFlow struct {
+	t       *testing.T
+	auth    *acme.Authority
+	router  chi.Router
+	baseURL string
+}
+
+func newTestFlow(t *testing.T, prov provisioner.Interface) *testFlow {
+	acmeAuth, err := acme.NewAuthority(memory.New(), "ca.smallstep.com", "acme", &accountFlowSignAuth{prov: prov})
+	assert.FatalError(t, err)
+	router := chi.NewRouter()
+	router.Route("/acme", func(r chi.Router) {
+		New(acmeAuth).Route(r)
+	})
+	return &testFlow{
+		t:       t,
+		auth:    acmeAuth,
+		router:  router,
+		baseURL: "https://ca.smallstep.com/acme/" + url.PathEscape(prov.GetName()),
+	}
+}
+
+func (f *testFlow) do(link string, body []byte) (*http.Response, []byte) {
+	req := httptest.NewRequest("POST", link, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/jose+json")
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	res := w.Result()
+	b, err := ioutil.ReadAll(res.Body)
+	assert.FatalError(f.t, err)
+	res.Body.Close()
+	return res, b
+}
+
+func (f *testFlow) nonce() string {
+	req := httptest.NewRequest("HEAD", f.baseURL+"/new-nonce", nil)
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w.Result().Header.Get("Replay-Nonce")
+}
+
+func (f *testFlow) newKey() *jose.JSONWebKey {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(f.t, err)
+	return jwk
+}
+
+func (f *testFlow) sign(jwk *jose.JSONWebKey, headers map[string]interface{}, payload []byte) []byte {
+	so := new(jose.SignerOptions)
+	for k, v := range headers {
+		so.WithHeader(jose.HeaderKey(k), v)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+		Key:       jwk.Key,
+	}, so)
+	assert.FatalError(f.t, err)
+	jws, err := signer.Sign(payload)
+	assert.FatalError(f.t, err)
+	return []byte(jws.FullSerialize())
+}
+
+func (f *testFlow) marshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	assert.FatalError(f.t, err)
+	return b
+}
+
+func (f *testFlow) problem(body []byte) *acme.AError {
+	ae := new(acme.AError)
+	assert.FatalError(f.t, json.Unmarshal(body, ae))
+	return ae
+}
+
+// newAccount creates an account for the key and returns its kid.
+func (f *testFlow) newAccount(jwk *jose.JSONWebKey) string {
+	res, body := f.lookupAccount(jwk, &NewAccountRequest{TermsOfServiceAgreed: true})
+	if res.StatusCode != 201 {
+		f.t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+	}
+	return res.Header.Get("Location")
+}
+
+// lookupAccount sends a new-account request signed with the jwk.
+func (f *testFlow) lookupAccount(jwk *jose.JSONWebKey, nar *NewAccountRequest) (*http.Response, []byte) {
+	pub := jwk.Public()
+	return f.do(f.baseURL+"/new-account", f.sign(jwk, map[string]interface{}{
+		"jwk": &pub, "nonce": f.nonce(), "url": f.baseURL + "/new-account",
+	}, f.marshal(nar)))
+}
+
+// post sends a request signed with the account key, a nil payload is a
+// POST-as-GET request.
+func (f *testFlow) post(jwk *jose.JSONWebKey, kid, link string, payload interface{}) (*http.Response, []byte) {
+	b := []byte{}
+	if payload != nil {
+		b = f.marshal(payload)
+	}
+	return f.do(link, f.sign(jwk, map[string]interface{}{
+		"kid": kid, "nonce": f.nonce(), "url": link,
+	}, b))
+}
+
+func TestHandler_keyChange(t *testing.T) {
+	prov := newProv()
+	f := newTestFlow(t, prov)
+	keyChangeURL := f.baseURL + "/key-change"
+	sign, marshal, problem, newKey := f.sign, f.marshal, f.problem, f.newKey
+
+	// keyChange sends a key-change request signed by the old key with the
+	// given inner JWS.
+	keyChange := func(oldKey *jose.JSONWebKey, kid string, inner []byte) (*http.Response, []byte) {
+		return f.do(keyChangeURL, sign(oldKey, map[string]interface{}{
+			"kid": kid, "nonce": f.nonce(), "url": keyChangeURL,
+		}, inner))
+	}
+	// postAsGet returns the status of a POST-as-GET request to the account.
+	postAsGet := func(jwk *jose.JSONWebKey, kid string) int {
+		res, _ := f.post(jwk, kid, kid, nil)
+		return res.StatusCode
+	}
+
+	oldKey := newKey()
+	oldPub := oldKey.Public()
+	kid := f.newAccount(oldKey)
+	otherKey := newKey()
+	otherKid := f.newAccount(otherKey)
+
+	t.Run("fail", func(t *testing.T) {
+		key := newKey()
+		pub := key.Public()
+		randomPub := newKey().Public()
+		tests := map[string][]byte{
+			"account-mismatch": sign(key, map[string]interface{}{"jwk": &pub, "url": keyChangeURL},
+				marshal(&KeyChangeRequest{Account: otherKid, OldKey: &oldPub})),
+			"old-key-mismatch": sign(key, map[string]interface{}{"jwk": &pub, "url": keyChangeURL},
+				marshal(&KeyChangeRequest{Account: kid, OldKey: &randomPub})),
+			"missing-old-key": sign(key, map[string]interface{}{"jwk": &pub, "url": keyChangeURL},
+				marshal(&KeyChangeRequest{Account: kid})),
+			"url-mismatch": sign(key, map[string]interface{}{"jwk": &pub, "url": kid},
+				marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub})),
+			"inner-nonce": sign(key, map[string]interface{}{"jwk": &pub, "url": keyChangeURL, "nonce": f.nonce()},
+				marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub})),
+			"inner-kid": sign(key, map[string]interface{}{"kid": kid, "url": keyChangeURL},
+				marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub})),
+			"inner-signature": sign(key, map[string]interface{}{"jwk": &randomPub, "url": keyChangeURL},
+				marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub})),
+			"same-key": sign(oldKey, map[string]interface{}{"jwk": &oldPub, "url": keyChangeURL},
+				marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub})),
+			"not-a-jws": marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub}),
+		}
+		details := map[string]string{
+			"account-mismatch": "account in key-change request (" + otherKid + ") does not match the jws kid",
+			"old-key-mismatch": "old key does not match the current key of the account",
+			"missing-old-key":  "key-change oldKey cannot be empty",
+			"url-mismatch":     "url header in key-change inner JWS (" + kid + ") does not match the outer JWS url",
+			"inner-nonce":      "key-change inner JWS must not have a nonce header",
+			"inner-kid":        "key-change inner JWS must have a jwk header",
+			"inner-signature":  "error verifying key-change inner JWS",
+			"same-key":         "new key must be different from the current key of the account",
+			"not-a-jws":        "failed to parse key-change inner JWS",
+		}
+		for name, inner := range tests {
+			t.Run(name, func(t *testing.T) {
+				res, body := keyChange(oldKey, kid, inner)
+				assert.Equals(t, 400, res.StatusCode)
+				assert.Equals(t, "urn:ietf:params:acme:error:malformed", problem(body).Type)
+				assert.HasPrefix(t, problem(body).Detail, details[name])
+			})
+		}
+		// The account still uses the old key.
+		assert.Equals(t, 200, postAsGet(oldKey, kid))
+		assert.Equals(t, 400, postAsGet(key, kid))
+	})
+
+	t.Run("fail/conflict", func(t *testing.T) {
+		otherPub := otherKey.Public()
+		res, body := keyChange(oldKey, kid, sign(otherKey, map[string]interface{}{"jwk": &otherPub, "url": keyChangeURL},
+			marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub})))
+		assert.Equals(t, 409, res.StatusCode)
+		assert.Equals(t, "urn:ietf:params:acme:error:malformed", problem(body).Type)
+		assert.Equals(t, otherKid, res.Header.Get("Location"))
+		// Both accounts keep their keys.
+		assert.Equals(t, 200, postAsGet(oldKey, kid))
+		assert.Equals(t, 200, postAsGet(otherKey, otherKid))
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		key := newKey()
+		pub := key.Public()
+		res, body := keyChange(oldKey, kid, sign(key, map[string]interface{}{"jwk": &pub, "url": keyChangeURL},
+			marshal(&KeyChangeRequest{Account: kid, OldKey: &oldPub})))
+		if res.StatusCode != 200 {
+			t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+		}
+		assert.Equals(t, kid, res.Header.Get("Location"))
+		var acc acme.Account
+		assert.FatalError(t, json.Unmarshal(body, &acc))
+		assert.Equals(t, acme.StatusValid, acc.Status)
+
+		// The account is now bound to the new key.
+		assert.Equals(t, 400, postAsGet(oldKey, kid))
+		assert.Equals(t, 200, postAsGet(key, kid))
+		lookup := func(jwk *jose.JSONWebKey) (*http.Response, []byte) {
+			return f.lookupAccount(jwk, &NewAccountRequest{OnlyReturnExisting: true})
+		}
+		res, _ = lookup(key)
+		assert.Equals(t, 200, res.StatusCode)
+		assert.Equals(t, kid, res.Header.Get("Location"))
+		res, body = lookup(oldKey)
+		assert.Equals(t, 400, res.StatusCode)
+		assert.Equals(t, "urn:ietf:params:acme:error:accountDoesNotExist", problem(body).Type)
+	})
+}
+
+func TestHandler_deactivateAccount(t *testing.T) {
+	prov := newProv()
+	f := newTestFlow(t, prov)
+	newOrderURL := f.baseURL + "/new-order"
+	nor := &NewOrderRequest{Identifiers: []acme.Identifier{{Type: "dns", Value: "example.com"}}}
+
+	key := f.newKey()
+	kid := f.newAccount(key)
+	accID := kid[strings.LastIndex(kid, "/")+1:]
+
+	res, body := f.post(key, kid, newOrderURL, nor)
+	if res.StatusCode != 201 {
+		t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+	}
+	orderURL := res.Header.Get("Location")
+	orderID := orderURL[strings.LastIndex(orderURL, "/")+1:]
+	var o acme.Order
+	assert.FatalError(t, json.Unmarshal(body, &o))
+	assert.Equals(t, acme.StatusPending, o.Status)
+
+	// Deactivate the account
+	res, body = f.post(key, kid, kid, &UpdateAccountRequest{Status: acme.StatusDeactivated})
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+	}
+	var acc acme.Account
+	assert.FatalError(t, json.Unmarshal(body, &acc))
+	assert.Equals(t, acme.StatusDeactivated, acc.Status)
+
+	// The pending order and its authorizations are invalid.
+	order, err := f.auth.GetOrder(prov, accID, orderID)
+	assert.FatalError(t, err)
+	assert.Equals(t, acme.StatusInvalid, order.Status)
+	if ae, ok := order.Error.(*acme.AError); assert.True(t, ok) {
+		assert.Equals(t, "urn:ietf:params:acme:error:unauthorized", ae.Type)
+	}
+	azID := o.Authorizations[0][strings.LastIndex(o.Authorizations[0], "/")+1:]
+	az, err := f.auth.GetAuthz(prov, accID, azID)
+	assert.FatalError(t, err)
+	assert.Equals(t, acme.StatusInvalid, az.Status)
+
+	// Any further request signed with the account key is unauthorized, and
+	// the account cannot be reactivated.
+	tests := map[string]struct {
+		link    string
+		payload interface{}
+	}{
+		"new-order":  {newOrderURL, nor},
+		"order":      {orderURL, nil},
+		"account":    {kid, nil},
+		"reactivate": {kid, &UpdateAccountRequest{Status: acme.StatusValid}},
+		"update":     {kid, &UpdateAccountRequest{Contact: []string{"mailto:jane@example.com"}}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, body := f.post(key, kid, tc.link, tc.payload)
+			assert.Equals(t, 401, res.StatusCode)
+			assert.Equals(t, "urn:ietf:params:acme:error:unauthorized", f.problem(body).Type)
+		})
+	}
+
+	// The key still belongs to the deactivated account.
+	res, body = f.lookupAccount(key, &NewAccountRequest{TermsOfServiceAgreed: true})
+	assert.Equals(t, 401, res.StatusCode)
+	assert.Equals(t, "urn:ietf:params:acme:error:unauthorized", f.problem(body).Type)
+}
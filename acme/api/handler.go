@@ -2,7 +2,10 @@ package api
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
@@ -16,6 +19,16 @@ func link(url, typ string) string {
 	return fmt.Sprintf("<%s>;rel=\"%s\"", url, typ)
 }
 
+// setRetryAfter sets the Retry-After header, in seconds, of the responses of
+// the challenges being validated and their authorizations.
+func setRetryAfter(w http.ResponseWriter, p provisioner.Interface) {
+	d := provisioner.DefaultACMERetryAfter
+	if acmeProv, ok := p.(*provisioner.ACME); ok {
+		d = acmeProv.GetRetryAfter()
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
 type contextKey string
 
 const (
@@ -93,9 +106,13 @@ func (h *Handler) Route(r api.Router) {
 	extractPayloadByKid := func(next nextHTTP) nextHTTP {
 		return h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.lookupJWK(h.verifyAndExtractJWSPayload(next))))))))
 	}
+	extractPayloadByKidOrJWK := func(next nextHTTP) nextHTTP {
+		return h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.extractOrLookupJWK(h.verifyAndExtractJWSPayload(next))))))))
+	}
 
 	r.MethodFunc("POST", getLink(acme.NewAccountLink, "{provisionerID}", false), extractPayloadByJWK(h.NewAccount))
 	r.MethodFunc("POST", getLink(acme.AccountLink, "{provisionerID}", false, "{accID}"), extractPayloadByKid(h.GetUpdateAccount))
+	r.MethodFunc("POST", getLink(acme.KeyChangeLink, "{provisionerID}", false), extractPayloadByKid(h.KeyChange))
 	r.MethodFunc("POST", getLink(acme.NewOrderLink, "{provisionerID}", false), extractPayloadByKid(h.NewOrder))
 	r.MethodFunc("POST", getLink(acme.OrderLink, "{provisionerID}", false, "{ordID}"), extractPayloadByKid(h.isPostAsGet(h.GetOrder)))
 	r.MethodFunc("POST", getLink(acme.OrdersByAccountLink, "{provisionerID}", false, "{accID}"), extractPayloadByKid(h.isPostAsGet(h.GetOrdersByAccount)))
@@ -103,6 +120,9 @@ func (h *Handler) Route(r api.Router) {
 	r.MethodFunc("POST", getLink(acme.AuthzLink, "{provisionerID}", false, "{authzID}"), extractPayloadByKid(h.isPostAsGet(h.GetAuthz)))
 	r.MethodFunc("POST", getLink(acme.ChallengeLink, "{provisionerID}", false, "{chID}"), extractPayloadByKid(h.GetChallenge))
 	r.MethodFunc("POST", getLink(acme.CertificateLink, "{provisionerID}", false, "{certID}"), extractPayloadByKid(h.isPostAsGet(h.GetCertificate)))
+	r.MethodFunc("POST", getLink(acme.RevokeCertLink, "{provisionerID}", false), extractPayloadByKidOrJWK(h.RevokeCert))
+	// The renewal information is not authenticated.
+	r.MethodFunc("GET", getLink(acme.RenewalInfoLink, "{provisionerID}", false, "{certID}"), h.lookupProvisioner(h.GetRenewalInfo))
 }
 
 // GetNonce just sets the right header since a Nonce is added to each response
@@ -145,6 +165,12 @@ func (h *Handler) GetAuthz(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, ch := range authz.Challenges {
+		if ch.Status == acme.StatusProcessing {
+			setRetryAfter(w, prov)
+			break
+		}
+	}
 	w.Header().Set("Location", h.Auth.GetLink(acme.AuthzLink, acme.URLSafeProvisionerName(prov), true, authz.GetID()))
 	api.JSON(w, authz)
 }
@@ -163,7 +189,7 @@ func (h *Handler) GetChallenge(w http.ResponseWriter, r *http.Request) {
 	}
 	// Just verify that the payload was set, since we're not strictly adhering
 	// to ACME V2 spec for reasons specified below.
-	_, err = payloadFromContext(r)
+	payload, err := payloadFromContext(r)
 	if err != nil {
 		api.WriteError(w, err)
 		return
@@ -173,17 +199,21 @@ func (h *Handler) GetChallenge(w http.ResponseWriter, r *http.Request) {
 	// that the payload is an empty JSON block ({}). However, older ACME clients
 	// still send a vestigial body (rather than an empty JSON block) and
 	// strict enforcement would render these clients broken. For the time being
-	// we'll just ignore the body.
+	// we'll just ignore the body, except in the device-attest-01 challenge
+	// which carries the attestation object.
 	var (
 		ch   *acme.Challenge
 		chID = chi.URLParam(r, "chID")
 	)
-	ch, err = h.Auth.ValidateChallenge(prov, acc.GetID(), chID, acc.GetKey())
+	ch, err = h.Auth.ValidateChallenge(prov, acc.GetID(), chID, acc.GetKey(), payload.value)
 	if err != nil {
 		api.WriteError(w, err)
 		return
 	}
 
+	if ch.Status == acme.StatusProcessing {
+		setRetryAfter(w, prov)
+	}
 	getLink := h.Auth.GetLink
 	w.Header().Add("Link", link(getLink(acme.AuthzLink, acme.URLSafeProvisionerName(prov), true, ch.GetAuthzID()), "up"))
 	w.Header().Set("Location", getLink(acme.ChallengeLink, acme.URLSafeProvisionerName(prov), true, ch.GetID()))
@@ -207,3 +237,19 @@ func (h *Handler) GetCertificate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/pem-certificate-chain; charset=utf-8")
 	w.Write(certBytes)
 }
+
+// renewalInfoRetryAfter is the time the clients are told to wait before
+// polling the renewal information of a certificate again.
+const renewalInfoRetryAfter = 6 * time.Hour
+
+// GetRenewalInfo ACME api for retrieving the renewal information of a
+// certificate.
+func (h *Handler) GetRenewalInfo(w http.ResponseWriter, r *http.Request) {
+	ri, err := h.Auth.GetRenewalInfo(chi.URLParam(r, "certID"))
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(renewalInfoRetryAfter.Seconds())))
+	api.JSON(w, ri)
+}
@@ -23,6 +23,7 @@ import (
 )
 
 type mockAcmeAuthority struct {
+	changeAccountKey    func(p provisioner.Interface, id string, oldKey, newKey *jose.JSONWebKey) (*acme.Account, error)
 	deactivateAccount   func(provisioner.Interface, string) (*acme.Account, error)
 	finalizeOrder       func(p provisioner.Interface, accID string, id string, csr *x509.CertificateRequest) (*acme.Order, error)
 	getAccount          func(p provisioner.Interface, id string) (*acme.Account, error)
@@ -34,17 +35,28 @@ type mockAcmeAuthority struct {
 	getLink             func(acme.Link, string, bool, ...string) string
 	getOrder            func(p provisioner.Interface, accID string, id string) (*acme.Order, error)
 	getOrdersByAccount  func(p provisioner.Interface, id string) ([]string, error)
+	getRenewalInfo      func(id string) (*acme.RenewalInfo, error)
 	loadProvisionerByID func(string) (provisioner.Interface, error)
 	newAccount          func(provisioner.Interface, acme.AccountOptions) (*acme.Account, error)
 	newNonce            func() (string, error)
 	newOrder            func(provisioner.Interface, acme.OrderOptions) (*acme.Order, error)
+	revokeCertificate   func(accID string, jwk *jose.JSONWebKey, crt *x509.Certificate, reasonCode int) error
 	updateAccount       func(provisioner.Interface, string, []string) (*acme.Account, error)
 	useNonce            func(string) error
-	validateChallenge   func(p provisioner.Interface, accID string, id string, jwk *jose.JSONWebKey) (*acme.Challenge, error)
+	validateChallenge   func(p provisioner.Interface, accID string, id string, jwk *jose.JSONWebKey, payload []byte) (*acme.Challenge, error)
 	ret1                interface{}
 	err                 error
 }
 
+func (m *mockAcmeAuthority) ChangeAccountKey(p provisioner.Interface, id string, oldKey, newKey *jose.JSONWebKey) (*acme.Account, error) {
+	if m.changeAccountKey != nil {
+		return m.changeAccountKey(p, id, oldKey, newKey)
+	} else if m.err != nil {
+		return nil, m.err
+	}
+	return m.ret1.(*acme.Account), m.err
+}
+
 func (m *mockAcmeAuthority) DeactivateAccount(p provisioner.Interface, id string) (*acme.Account, error) {
 	if m.deactivateAccount != nil {
 		return m.deactivateAccount(p, id)
@@ -140,6 +152,15 @@ func (m *mockAcmeAuthority) GetOrdersByAccount(p provisioner.Interface, id strin
 	return m.ret1.([]string), m.err
 }
 
+func (m *mockAcmeAuthority) GetRenewalInfo(id string) (*acme.RenewalInfo, error) {
+	if m.getRenewalInfo != nil {
+		return m.getRenewalInfo(id)
+	} else if m.err != nil {
+		return nil, m.err
+	}
+	return m.ret1.(*acme.RenewalInfo), m.err
+}
+
 func (m *mockAcmeAuthority) LoadProvisionerByID(provID string) (provisioner.Interface, error) {
 	if m.loadProvisionerByID != nil {
 		return m.loadProvisionerByID(provID)
@@ -176,6 +197,13 @@ func (m *mockAcmeAuthority) NewOrder(p provisioner.Interface, ops acme.OrderOpti
 	return m.ret1.(*acme.Order), m.err
 }
 
+func (m *mockAcmeAuthority) RevokeCertificate(accID string, jwk *jose.JSONWebKey, crt *x509.Certificate, reasonCode int) error {
+	if m.revokeCertificate != nil {
+		return m.revokeCertificate(accID, jwk, crt, reasonCode)
+	}
+	return m.err
+}
+
 func (m *mockAcmeAuthority) UpdateAccount(p provisioner.Interface, id string, contact []string) (*acme.Account, error) {
 	if m.updateAccount != nil {
 		return m.updateAccount(p, id, contact)
@@ -192,10 +220,10 @@ func (m *mockAcmeAuthority) UseNonce(nonce string) error {
 	return m.err
 }
 
-func (m *mockAcmeAuthority) ValidateChallenge(p provisioner.Interface, accID string, id string, jwk *jose.JSONWebKey) (*acme.Challenge, error) {
+func (m *mockAcmeAuthority) ValidateChallenge(p provisioner.Interface, accID string, id string, jwk *jose.JSONWebKey, payload []byte) (*acme.Challenge, error) {
 	switch {
 	case m.validateChallenge != nil:
-		return m.validateChallenge(p, accID, id, jwk)
+		return m.validateChallenge(p, accID, id, jwk, payload)
 	case m.err != nil:
 		return nil, m.err
 	default:
@@ -237,11 +265,12 @@ func TestHandlerGetDirectory(t *testing.T) {
 	url := fmt.Sprintf("http://ca.smallstep.com/acme/%s/directory", acme.URLSafeProvisionerName(prov))
 
 	expDir := acme.Directory{
-		NewNonce:   fmt.Sprintf("https://ca.smallstep.com/acme/%s/new-nonce", acme.URLSafeProvisionerName(prov)),
-		NewAccount: fmt.Sprintf("https://ca.smallstep.com/acme/%s/new-account", acme.URLSafeProvisionerName(prov)),
-		NewOrder:   fmt.Sprintf("https://ca.smallstep.com/acme/%s/new-order", acme.URLSafeProvisionerName(prov)),
-		RevokeCert: fmt.Sprintf("https://ca.smallstep.com/acme/%s/revoke-cert", acme.URLSafeProvisionerName(prov)),
-		KeyChange:  fmt.Sprintf("https://ca.smallstep.com/acme/%s/key-change", acme.URLSafeProvisionerName(prov)),
+		NewNonce:    fmt.Sprintf("https://ca.smallstep.com/acme/%s/new-nonce", acme.URLSafeProvisionerName(prov)),
+		NewAccount:  fmt.Sprintf("https://ca.smallstep.com/acme/%s/new-account", acme.URLSafeProvisionerName(prov)),
+		NewOrder:    fmt.Sprintf("https://ca.smallstep.com/acme/%s/new-order", acme.URLSafeProvisionerName(prov)),
+		RevokeCert:  fmt.Sprintf("https://ca.smallstep.com/acme/%s/revoke-cert", acme.URLSafeProvisionerName(prov)),
+		KeyChange:   fmt.Sprintf("https://ca.smallstep.com/acme/%s/key-change", acme.URLSafeProvisionerName(prov)),
+		RenewalInfo: fmt.Sprintf("https://ca.smallstep.com/acme/%s/renewal-info", acme.URLSafeProvisionerName(prov)),
 	}
 
 	type test struct {
@@ -581,6 +610,77 @@ func TestHandlerGetCertificate(t *testing.T) {
 	}
 }
 
+func TestHandlerGetRenewalInfo(t *testing.T) {
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("certID", "AQID.AQI")
+	url := "http://ca.smallstep.com/acme/renewal-info/AQID.AQI"
+	ri := &acme.RenewalInfo{SuggestedWindow: acme.RenewalWindow{
+		Start: time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+		End:   time.Now().Add(2 * time.Hour).Truncate(time.Second).UTC(),
+	}}
+
+	type test struct {
+		auth       acme.Interface
+		statusCode int
+		problem    *acme.Error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/GetRenewalInfo-error": func(t *testing.T) test {
+			return test{
+				auth: &mockAcmeAuthority{
+					err: acme.MalformedErr(errors.New("certificate AQID.AQI not found")),
+				},
+				statusCode: 400,
+				problem:    acme.MalformedErr(errors.New("certificate AQID.AQI not found")),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			return test{
+				auth: &mockAcmeAuthority{
+					getRenewalInfo: func(id string) (*acme.RenewalInfo, error) {
+						assert.Equals(t, "AQID.AQI", id)
+						return ri, nil
+					},
+				},
+				statusCode: 200,
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			h := New(tc.auth).(*Handler)
+			req := httptest.NewRequest("GET", url, nil)
+			req = req.WithContext(context.WithValue(context.Background(), chi.RouteCtxKey, chiCtx))
+			w := httptest.NewRecorder()
+			h.GetRenewalInfo(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tc.statusCode)
+
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tc.problem) {
+				var ae acme.AError
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				prob := tc.problem.ToACME()
+
+				assert.Equals(t, ae.Type, prob.Type)
+				assert.Equals(t, ae.Detail, prob.Detail)
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+			} else {
+				expB, err := json.Marshal(ri)
+				assert.FatalError(t, err)
+				assert.Equals(t, bytes.TrimSpace(body), expB)
+				assert.Equals(t, res.Header["Retry-After"], []string{"21600"})
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/json"})
+			}
+		})
+	}
+}
+
 func ch() acme.Challenge {
 	return acme.Challenge{
 		Type:    "http-01",
@@ -603,6 +703,7 @@ func TestHandlerGetChallenge(t *testing.T) {
 		ctx        context.Context
 		statusCode int
 		ch         acme.Challenge
+		retryAfter []string
 		problem    *acme.Error
 	}
 	var tests = map[string]func(t *testing.T) test{
@@ -693,7 +794,7 @@ func TestHandlerGetChallenge(t *testing.T) {
 			acc := &acme.Account{ID: "accID", Key: key}
 			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
 			ctx = context.WithValue(ctx, accContextKey, acc)
-			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{isEmptyJSON: true})
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: []byte(`{"attObj":"foo"}`)})
 			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
 			ch := ch()
 			ch.Status = "valid"
@@ -701,11 +802,12 @@ func TestHandlerGetChallenge(t *testing.T) {
 			count := 0
 			return test{
 				auth: &mockAcmeAuthority{
-					validateChallenge: func(p provisioner.Interface, accID, id string, jwk *jose.JSONWebKey) (*acme.Challenge, error) {
+					validateChallenge: func(p provisioner.Interface, accID, id string, jwk *jose.JSONWebKey, payload []byte) (*acme.Challenge, error) {
 						assert.Equals(t, p, prov)
 						assert.Equals(t, accID, acc.ID)
 						assert.Equals(t, id, ch.ID)
 						assert.Equals(t, jwk.KeyID, key.KeyID)
+						assert.Equals(t, []byte(`{"attObj":"foo"}`), payload)
 						return &ch, nil
 					},
 					getLink: func(typ acme.Link, provID string, abs bool, in ...string) string {
@@ -733,6 +835,32 @@ func TestHandlerGetChallenge(t *testing.T) {
 				ch:         ch,
 			}
 		},
+		"ok/processing": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{isEmptyJSON: true})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			ch := ch()
+			ch.Status = acme.StatusProcessing
+			return test{
+				auth: &mockAcmeAuthority{
+					validateChallenge: func(p provisioner.Interface, accID, id string, jwk *jose.JSONWebKey, payload []byte) (*acme.Challenge, error) {
+						return &ch, nil
+					},
+					getLink: func(typ acme.Link, provID string, abs bool, in ...string) string {
+						if typ == acme.AuthzLink {
+							return fmt.Sprintf("https://ca.smallstep.com/acme/authz/%s", ch.AuthzID)
+						}
+						return url
+					},
+				},
+				ctx:        ctx,
+				statusCode: 200,
+				ch:         ch,
+				retryAfter: []string{"3"},
+			}
+		},
 	}
 	for name, run := range tests {
 		tc := run(t)
@@ -766,6 +894,7 @@ func TestHandlerGetChallenge(t *testing.T) {
 				assert.Equals(t, bytes.TrimSpace(body), expB)
 				assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<https://ca.smallstep.com/acme/authz/%s>;rel=\"up\"", tc.ch.AuthzID)})
 				assert.Equals(t, res.Header["Location"], []string{url})
+				assert.Equals(t, res.Header["Retry-After"], tc.retryAfter)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/json"})
 			}
 		})
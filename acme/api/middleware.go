@@ -13,6 +13,7 @@ import (
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/logging"
 	"github.com/smallstep/cli/crypto/keys"
 	"github.com/smallstep/cli/jose"
@@ -30,6 +31,16 @@ func logNonce(w http.ResponseWriter, nonce string) {
 	}
 }
 
+// logTemplate adds the source of the x509 template used to sign a certificate
+// to the log entry.
+func logTemplate(w http.ResponseWriter, source string) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		rl.WithFields(map[string]interface{}{
+			"template": source,
+		})
+	}
+}
+
 // addNonce is a middleware that adds a nonce to the response header.
 func (h *Handler) addNonce(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -93,6 +104,11 @@ func (h *Handler) parseJWS(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
+			// Bodies over the limit are not an internal error.
+			if e, ok := err.(*errs.Error); ok && e.StatusCode() == http.StatusRequestEntityTooLarge {
+				api.WriteError(w, e)
+				return
+			}
 			api.WriteError(w, acme.ServerInternalErr(errors.Wrap(err, "failed to read request body")))
 			return
 		}
@@ -114,13 +130,13 @@ func (h *Handler) parseJWS(next nextHTTP) nextHTTP {
 // The JWS Unprotected Header [RFC7515] MUST NOT be used
 // The JWS Payload MUST NOT be detached
 // The JWS Protected Header MUST include the following fields:
-//   * “alg” (Algorithm)
-//     * This field MUST NOT contain “none” or a Message Authentication Code
-//       (MAC) algorithm (e.g. one in which the algorithm registry description
-//       mentions MAC/HMAC).
-//   * “nonce” (defined in Section 6.5)
-//   * “url” (defined in Section 6.4)
-//   * Either “jwk” (JSON Web Key) or “kid” (Key ID) as specified below<Paste>
+//   - “alg” (Algorithm)
+//   - This field MUST NOT contain “none” or a Message Authentication Code
+//     (MAC) algorithm (e.g. one in which the algorithm registry description
+//     mentions MAC/HMAC).
+//   - “nonce” (defined in Section 6.5)
+//   - “url” (defined in Section 6.4)
+//   - Either “jwk” (JSON Web Key) or “kid” (Key ID) as specified below<Paste>
 func (h *Handler) validateJWS(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
 		jws, err := jwsFromContext(r)
@@ -148,26 +164,8 @@ func (h *Handler) validateJWS(next nextHTTP) nextHTTP {
 			return
 		}
 		hdr := sig.Protected
-		switch hdr.Algorithm {
-		case jose.RS256, jose.RS384, jose.RS512:
-			if hdr.JSONWebKey != nil {
-				switch k := hdr.JSONWebKey.Key.(type) {
-				case *rsa.PublicKey:
-					if k.Size() < keys.MinRSAKeyBytes {
-						api.WriteError(w, acme.MalformedErr(errors.Errorf("rsa "+
-							"keys must be at least %d bits (%d bytes) in size",
-							8*keys.MinRSAKeyBytes, keys.MinRSAKeyBytes)))
-						return
-					}
-				default:
-					api.WriteError(w, acme.MalformedErr(errors.Errorf("jws key type and algorithm do not match")))
-					return
-				}
-			}
-		case jose.ES256, jose.ES384, jose.ES512, jose.EdDSA:
-			// we good
-		default:
-			api.WriteError(w, acme.MalformedErr(errors.Errorf("unsuitable algorithm: %s", hdr.Algorithm)))
+		if err := validateJWSAlgorithm(hdr); err != nil {
+			api.WriteError(w, err)
 			return
 		}
 
@@ -183,9 +181,8 @@ func (h *Handler) validateJWS(next nextHTTP) nextHTTP {
 			api.WriteError(w, acme.MalformedErr(errors.Errorf("jws missing url protected header")))
 			return
 		}
-		reqURL := &url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path}
-		if jwsURL != reqURL.String() {
-			api.WriteError(w, acme.MalformedErr(errors.Errorf("url header in JWS (%s) does not match request url (%s)", jwsURL, reqURL)))
+		if reqURLs := h.requestURLs(r); !containsString(reqURLs, jwsURL) {
+			api.WriteError(w, acme.MalformedErr(errors.Errorf("url header in JWS (%s) does not match request url (%s)", jwsURL, reqURLs[0])))
 			return
 		}
 
@@ -201,6 +198,61 @@ func (h *Handler) validateJWS(next nextHTTP) nextHTTP {
 	}
 }
 
+// validateJWSAlgorithm checks that the algorithm of the protected header is
+// suitable for ACME requests and that it matches the embedded jwk, if any.
+func validateJWSAlgorithm(hdr jose.Header) error {
+	switch hdr.Algorithm {
+	case jose.RS256, jose.RS384, jose.RS512:
+		if hdr.JSONWebKey != nil {
+			switch k := hdr.JSONWebKey.Key.(type) {
+			case *rsa.PublicKey:
+				if k.Size() < keys.MinRSAKeyBytes {
+					return acme.MalformedErr(errors.Errorf("rsa "+
+						"keys must be at least %d bits (%d bytes) in size",
+						8*keys.MinRSAKeyBytes, keys.MinRSAKeyBytes))
+				}
+			default:
+				return acme.MalformedErr(errors.Errorf("jws key type and algorithm do not match"))
+			}
+		}
+	case jose.ES256, jose.ES384, jose.ES512, jose.EdDSA:
+		// we good
+	default:
+		return acme.MalformedErr(errors.Errorf("unsuitable algorithm: %s", hdr.Algorithm))
+	}
+	return nil
+}
+
+// requestURLs returns the urls of the request that are valid in the url header
+// of a JWS. The first one uses the host of the request, the second one the
+// absolute links of the directory, that use the external url of the CA if it
+// is behind a proxy.
+func (h *Handler) requestURLs(r *http.Request) []string {
+	reqURL := &url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path}
+	urls := []string{reqURL.String()}
+	prov, err := provisionerFromContext(r)
+	if err != nil {
+		return urls
+	}
+	name := acme.URLSafeProvisionerName(prov)
+	suffix := "/" + acme.DirectoryLink.String()
+	base := strings.TrimSuffix(h.Auth.GetLink(acme.DirectoryLink, name, true), suffix)
+	provPath := strings.TrimSuffix(h.Auth.GetLink(acme.DirectoryLink, name, false), suffix) + "/"
+	if p := reqURL.EscapedPath(); strings.Contains(p, provPath) {
+		urls = append(urls, base+p[strings.Index(p, provPath)+len(provPath)-1:])
+	}
+	return urls
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
 // extractJWK is a middleware that extracts the JWK from the JWS and saves it
 // in the context. Make sure to parse and validate the JWS before running this
 // middleware.
@@ -289,6 +341,11 @@ func (h *Handler) lookupJWK(next nextHTTP) nextHTTP {
 			return
 		}
 
+		// Only the new-account requests are signed with the jwk of the account.
+		if jws.Signatures[0].Protected.JSONWebKey != nil {
+			api.WriteError(w, acme.MalformedErr(errors.Errorf("kid expected in protected header")))
+			return
+		}
 		kidPrefix := h.Auth.GetLink(acme.AccountLink, acme.URLSafeProvisionerName(prov), true, "")
 		kid := jws.Signatures[0].Protected.KeyID
 		if !strings.HasPrefix(kid, kidPrefix) {
@@ -319,6 +376,24 @@ func (h *Handler) lookupJWK(next nextHTTP) nextHTTP {
 	}
 }
 
+// extractOrLookupJWK is the middleware of the requests that can be signed by
+// an account or by another key. It calls extractJWK if the JWS includes a jwk,
+// and lookupJWK otherwise.
+func (h *Handler) extractOrLookupJWK(next nextHTTP) nextHTTP {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jws, err := jwsFromContext(r)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		if jws.Signatures[0].Protected.JSONWebKey != nil {
+			h.extractJWK(next)(w, r)
+		} else {
+			h.lookupJWK(next)(w, r)
+		}
+	}
+}
+
 // verifyAndExtractJWSPayload extracts the JWK from the JWS and saves it in the context.
 // Make sure to parse and validate the JWS before running this middleware.
 func (h *Handler) verifyAndExtractJWSPayload(next nextHTTP) nextHTTP {
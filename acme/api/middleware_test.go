@@ -1173,6 +1173,58 @@ func TestHandlerExtractJWK(t *testing.T) {
 	}
 }
 
+func TestHandlerExtractOrLookupJWK(t *testing.T) {
+	prov := newProv()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+	kidPrefix := fmt.Sprintf("https://ca.smallstep.com/acme/%s/account/", acme.URLSafeProvisionerName(prov))
+	url := fmt.Sprintf("https://ca.smallstep.com/acme/%s/revoke-cert", acme.URLSafeProvisionerName(prov))
+	acc := &acme.Account{ID: "accID", Key: &pub, Status: "valid"}
+	auth := &mockAcmeAuthority{
+		getAccount: func(p provisioner.Interface, id string) (*acme.Account, error) {
+			assert.Equals(t, id, acc.ID)
+			return acc, nil
+		},
+		getAccountByKey: func(p provisioner.Interface, jwk *jose.JSONWebKey) (*acme.Account, error) {
+			return nil, database.ErrNotFound
+		},
+		getLink: func(typ acme.Link, provID string, abs bool, in ...string) string {
+			assert.Equals(t, typ, acme.AccountLink)
+			return kidPrefix
+		},
+	}
+	tests := map[string]struct {
+		hdr jose.Header
+		acc *acme.Account
+	}{
+		"ok/jwk": {jose.Header{JSONWebKey: &pub}, nil},
+		"ok/kid": {jose.Header{KeyID: kidPrefix + acc.ID}, acc},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, jwsContextKey, &jose.JSONWebSignature{
+				Signatures: []jose.Signature{{Protected: tc.hdr}},
+			})
+			h := New(auth).(*Handler)
+			req := httptest.NewRequest("POST", url, nil)
+			req = req.WithContext(ctx)
+			w := httptest.NewRecorder()
+			h.extractOrLookupJWK(func(w http.ResponseWriter, r *http.Request) {
+				_jwk, err := jwkFromContext(r)
+				assert.FatalError(t, err)
+				assert.Equals(t, _jwk.Key, pub.Key)
+				_acc, _ := accountFromContext(r)
+				assert.Equals(t, _acc, tc.acc)
+				w.Write(testBody)
+			})(w, req)
+			res := w.Result()
+			assert.Equals(t, res.StatusCode, 200)
+		})
+	}
+}
+
 func TestHandlerValidateJWS(t *testing.T) {
 	url := "https://ca.smallstep.com/acme/account/1234"
 	type test struct {
@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"net"
 	"net/http"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
 )
 
 // NewOrderRequest represents the body for a NewOrder request.
@@ -18,6 +20,11 @@ type NewOrderRequest struct {
 	Identifiers []acme.Identifier `json:"identifiers"`
 	NotBefore   time.Time         `json:"notBefore,omitempty"`
 	NotAfter    time.Time         `json:"notAfter,omitempty"`
+	// TemplateData is an optional JSON object available in the X.509
+	// template of the provisioner as .Insecure.User. It is not part of RFC
+	// 8555 and it is controlled by the requester.
+	TemplateData json.RawMessage `json:"templateData,omitempty"`
+	userData     map[string]interface{}
 }
 
 // Validate validates a new-order request body.
@@ -26,10 +33,23 @@ func (n *NewOrderRequest) Validate() error {
 		return acme.MalformedErr(errors.Errorf("identifiers list cannot be empty"))
 	}
 	for _, id := range n.Identifiers {
-		if id.Type != "dns" {
+		switch id.Type {
+		case "dns", "permanent-identifier":
+		case "ip":
+			if net.ParseIP(id.Value) == nil {
+				return acme.MalformedErr(errors.Errorf("invalid IP address: %s", id.Value))
+			}
+		default:
 			return acme.MalformedErr(errors.Errorf("identifier type unsupported: %s", id.Type))
 		}
 	}
+	if len(n.TemplateData) > 0 {
+		v, err := provisioner.ParseUserData(n.TemplateData)
+		if err != nil {
+			return acme.MalformedErr(err)
+		}
+		n.userData = v
+	}
 	return nil
 }
 
@@ -89,6 +109,7 @@ func (h *Handler) NewOrder(w http.ResponseWriter, r *http.Request) {
 		Identifiers: nor.Identifiers,
 		NotBefore:   nor.NotBefore,
 		NotAfter:    nor.NotAfter,
+		UserData:    nor.userData,
 	})
 	if err != nil {
 		api.WriteError(w, err)
@@ -156,6 +177,9 @@ func (h *Handler) FinalizeOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p, ok := prov.(*provisioner.ACME); ok {
+		logTemplate(w, p.X509TemplateSource())
+	}
 	w.Header().Set("Location", h.Auth.GetLink(acme.OrderLink, acme.URLSafeProvisionerName(prov), true, o.ID))
 	api.JSON(w, o)
 }
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,6 +45,16 @@ func TestNewOrderRequestValidate(t *testing.T) {
 				err: acme.MalformedErr(errors.Errorf("identifier type unsupported: foo")),
 			}
 		},
+		"fail/bad-ip": func(t *testing.T) test {
+			return test{
+				nor: &NewOrderRequest{
+					Identifiers: []acme.Identifier{
+						{Type: "ip", Value: "[2001:db8::1]"},
+					},
+				},
+				err: acme.MalformedErr(errors.Errorf("invalid IP address: [2001:db8::1]")),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			nbf := time.Now().UTC().Add(time.Minute)
 			naf := time.Now().UTC().Add(5 * time.Minute)
@@ -60,6 +71,61 @@ func TestNewOrderRequestValidate(t *testing.T) {
 				naf: naf,
 			}
 		},
+		"ok/permanent-identifier": func(t *testing.T) test {
+			nbf := time.Now().UTC().Add(time.Minute)
+			naf := time.Now().UTC().Add(5 * time.Minute)
+			return test{
+				nor: &NewOrderRequest{
+					Identifiers: []acme.Identifier{
+						{Type: "permanent-identifier", Value: "12345678"},
+					},
+					NotAfter:  naf,
+					NotBefore: nbf,
+				},
+				nbf: nbf,
+				naf: naf,
+			}
+		},
+		"fail/oversized-templateData": func(t *testing.T) test {
+			return test{
+				nor: &NewOrderRequest{
+					Identifiers:  []acme.Identifier{{Type: "dns", Value: "example.com"}},
+					TemplateData: []byte(`{"a": "` + strings.Repeat("a", provisioner.MaxUserDataSize) + `"}`),
+				},
+				err: acme.MalformedErr(errors.Errorf("templateData cannot be larger than 4096 bytes")),
+			}
+		},
+		"ok/templateData": func(t *testing.T) test {
+			nbf := time.Now().UTC().Add(time.Minute)
+			naf := time.Now().UTC().Add(5 * time.Minute)
+			return test{
+				nor: &NewOrderRequest{
+					Identifiers:  []acme.Identifier{{Type: "dns", Value: "example.com"}},
+					NotAfter:     naf,
+					NotBefore:    nbf,
+					TemplateData: []byte(`{"deploymentID": "d-1234"}`),
+				},
+				nbf: nbf,
+				naf: naf,
+			}
+		},
+		"ok/ip": func(t *testing.T) test {
+			nbf := time.Now().UTC().Add(time.Minute)
+			naf := time.Now().UTC().Add(5 * time.Minute)
+			return test{
+				nor: &NewOrderRequest{
+					Identifiers: []acme.Identifier{
+						{Type: "ip", Value: "10.0.0.1"},
+						{Type: "ip", Value: "2001:db8::1"},
+						{Type: "dns", Value: "example.com"},
+					},
+					NotAfter:  naf,
+					NotBefore: nbf,
+				},
+				nbf: nbf,
+				naf: naf,
+			}
+		},
 	}
 	for name, run := range tests {
 		tc := run(t)
@@ -429,6 +495,35 @@ func TestHandlerNewOrder(t *testing.T) {
 				problem:    acme.MalformedErr(errors.New("force")),
 			}
 		},
+		"fail/NewOrder-subproblems": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "example.com"},
+					{Type: "dns", Value: "bar.com"},
+					{Type: "dns", Value: "foo.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			problem := acme.SubproblemsErr(
+				acme.RejectedIdentifierErr(errors.New("dns name bar.com is denied")).WithIdentifier(nor.Identifiers[1]),
+				acme.RejectedIdentifierErr(errors.New("dns name foo.com is denied")).WithIdentifier(nor.Identifiers[2]),
+			)
+			return test{
+				auth: &mockAcmeAuthority{
+					newOrder: func(p provisioner.Interface, ops acme.OrderOptions) (*acme.Order, error) {
+						return nil, problem
+					},
+				},
+				ctx:        ctx,
+				statusCode: 400,
+				problem:    problem,
+			}
+		},
 		"ok": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
 			nor := &NewOrderRequest{
@@ -466,6 +561,31 @@ func TestHandlerNewOrder(t *testing.T) {
 				statusCode: 201,
 			}
 		},
+		"ok/templateData": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers:  []acme.Identifier{{Type: "dns", Value: "example.com"}},
+				TemplateData: []byte(`{"deploymentID":"d-1234"}`),
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				auth: &mockAcmeAuthority{
+					newOrder: func(p provisioner.Interface, ops acme.OrderOptions) (*acme.Order, error) {
+						assert.Equals(t, map[string]interface{}{"deploymentID": "d-1234"}, ops.UserData)
+						return &o, nil
+					},
+					getLink: func(typ acme.Link, provID string, abs bool, in ...string) string {
+						return fmt.Sprintf("https://ca.smallstep.com/acme/order/%s", o.ID)
+					},
+				},
+				ctx:        ctx,
+				statusCode: 201,
+			}
+		},
 		"ok/default-naf-nbf": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
 			nor := &NewOrderRequest{
@@ -527,7 +647,12 @@ func TestHandlerNewOrder(t *testing.T) {
 				assert.Equals(t, ae.Type, prob.Type)
 				assert.Equals(t, ae.Detail, prob.Detail)
 				assert.Equals(t, ae.Identifier, prob.Identifier)
-				assert.Equals(t, ae.Subproblems, prob.Subproblems)
+				// The subproblems in the response are decoded as maps.
+				var expSub []interface{}
+				b, err := json.Marshal(prob.Subproblems)
+				assert.FatalError(t, err)
+				assert.FatalError(t, json.Unmarshal(b, &expSub))
+				assert.Equals(t, expSub, ae.Subproblems)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
 			} else {
 				expB, err := json.Marshal(o)
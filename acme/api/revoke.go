@@ -0,0 +1,79 @@
+package api
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/api"
+)
+
+// RevokeCertRequest captures the body for a revoke-cert request.
+type RevokeCertRequest struct {
+	Certificate string `json:"certificate"`
+	Reason      int    `json:"reason,omitempty"`
+	crt         *x509.Certificate
+}
+
+// Validate validates a revoke-cert request body.
+func (r *RevokeCertRequest) Validate() error {
+	crtBytes, err := base64.RawURLEncoding.DecodeString(r.Certificate)
+	if err != nil {
+		return acme.MalformedErr(errors.Wrap(err, "error base64url decoding certificate"))
+	}
+	r.crt, err = x509.ParseCertificate(crtBytes)
+	if err != nil {
+		return acme.MalformedErr(errors.Wrap(err, "unable to parse certificate"))
+	}
+	return nil
+}
+
+// RevokeCert ACME api for revoking a certificate. The request is signed with
+// the kid of the account that ordered the certificate or with the jwk of the
+// certificate key.
+func (h *Handler) RevokeCert(w http.ResponseWriter, r *http.Request) {
+	jws, err := jwsFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	jwk, err := jwkFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	payload, err := payloadFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	var rr RevokeCertRequest
+	if err := json.Unmarshal(payload.value, &rr); err != nil {
+		api.WriteError(w, acme.MalformedErr(errors.Wrap(err, "failed to unmarshal revoke-cert request payload")))
+		return
+	}
+	if err := rr.Validate(); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	// The account is only used if the request is signed with its kid; a
+	// request signed with a jwk is authorized by the certificate key.
+	var accID string
+	if len(jws.Signatures[0].Protected.KeyID) > 0 {
+		acc, err := accountFromContext(r)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		accID = acc.GetID()
+	}
+	if err := h.Auth.RevokeCertificate(accID, jwk, rr.crt, rr.Reason); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/jose"
+)
+
+func TestRevokeCertRequestValidate(t *testing.T) {
+	crt, err := pemutil.ReadCertificate("../../authority/testdata/certs/foo.crt")
+	assert.FatalError(t, err)
+	type test struct {
+		rr  *RevokeCertRequest
+		err *acme.Error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/base64": func(t *testing.T) test {
+			return test{
+				rr:  &RevokeCertRequest{Certificate: "!"},
+				err: acme.MalformedErr(errors.New("error base64url decoding certificate")),
+			}
+		},
+		"fail/parse": func(t *testing.T) test {
+			return test{
+				rr:  &RevokeCertRequest{Certificate: base64.RawURLEncoding.EncodeToString([]byte("foo"))},
+				err: acme.MalformedErr(errors.New("unable to parse certificate")),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			return test{
+				rr: &RevokeCertRequest{Certificate: base64.RawURLEncoding.EncodeToString(crt.Raw), Reason: 1},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			if err := tc.rr.Validate(); err != nil {
+				if assert.NotNil(t, tc.err) {
+					ae, ok := err.(*acme.Error)
+					assert.True(t, ok)
+					assert.HasPrefix(t, ae.Error(), tc.err.Error())
+					assert.Equals(t, ae.StatusCode(), tc.err.StatusCode())
+					assert.Equals(t, ae.Type, tc.err.Type)
+				}
+			} else {
+				if assert.Nil(t, tc.err) {
+					assert.Equals(t, tc.rr.crt.Raw, crt.Raw)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerRevokeCert(t *testing.T) {
+	crt, err := pemutil.ReadCertificate("../../authority/testdata/certs/foo.crt")
+	assert.FatalError(t, err)
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	prov := newProv()
+	url := fmt.Sprintf("http://ca.smallstep.com/acme/%s/revoke-cert", acme.URLSafeProvisionerName(prov))
+	payload, err := json.Marshal(&RevokeCertRequest{
+		Certificate: base64.RawURLEncoding.EncodeToString(crt.Raw),
+		Reason:      1,
+	})
+	assert.FatalError(t, err)
+	kidJWS := &jose.JSONWebSignature{Signatures: []jose.Signature{{
+		Protected: jose.Header{KeyID: "https://ca.smallstep.com/acme/account/accID"},
+	}}}
+	jwkJWS := &jose.JSONWebSignature{Signatures: []jose.Signature{{
+		Protected: jose.Header{JSONWebKey: jwk},
+	}}}
+
+	type test struct {
+		auth       acme.Interface
+		ctx        context.Context
+		statusCode int
+		problem    *acme.Error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/no-jws": func(t *testing.T) test {
+			return test{
+				ctx:        context.Background(),
+				statusCode: 500,
+				problem:    acme.ServerInternalErr(errors.New("jws expected in request context")),
+			}
+		},
+		"fail/no-jwk": func(t *testing.T) test {
+			return test{
+				ctx:        context.WithValue(context.Background(), jwsContextKey, kidJWS),
+				statusCode: 500,
+				problem:    acme.ServerInternalErr(errors.New("jwk expected in request context")),
+			}
+		},
+		"fail/no-payload": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), jwsContextKey, kidJWS)
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			return test{
+				ctx:        ctx,
+				statusCode: 500,
+				problem:    acme.ServerInternalErr(errors.New("payload expected in request context")),
+			}
+		},
+		"fail/unmarshal-payload-error": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), jwsContextKey, kidJWS)
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: []byte("{")})
+			return test{
+				ctx:        ctx,
+				statusCode: 400,
+				problem:    acme.MalformedErr(errors.New("failed to unmarshal revoke-cert request payload: unexpected end of JSON input")),
+			}
+		},
+		"fail/malformed-payload-error": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), jwsContextKey, kidJWS)
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: []byte("{}")})
+			_, err := x509.ParseCertificate(nil)
+			return test{
+				ctx:        ctx,
+				statusCode: 400,
+				problem:    acme.MalformedErr(errors.Wrap(err, "unable to parse certificate")),
+			}
+		},
+		"fail/no-account": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), jwsContextKey, kidJWS)
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payload})
+			return test{
+				ctx:        ctx,
+				statusCode: 400,
+				problem:    acme.AccountDoesNotExistErr(nil),
+			}
+		},
+		"fail/RevokeCertificate-error": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), jwsContextKey, kidJWS)
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "accID"})
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payload})
+			return test{
+				auth: &mockAcmeAuthority{
+					revokeCertificate: func(accID string, key *jose.JSONWebKey, c *x509.Certificate, reasonCode int) error {
+						return acme.AlreadyRevokedErr(errors.New("force"))
+					},
+				},
+				ctx:        ctx,
+				statusCode: 400,
+				problem:    acme.AlreadyRevokedErr(errors.New("force")),
+			}
+		},
+		"ok/kid": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), jwsContextKey, kidJWS)
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "accID"})
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payload})
+			return test{
+				auth: &mockAcmeAuthority{
+					revokeCertificate: func(accID string, key *jose.JSONWebKey, c *x509.Certificate, reasonCode int) error {
+						assert.Equals(t, "accID", accID)
+						assert.Equals(t, jwk, key)
+						assert.Equals(t, crt.Raw, c.Raw)
+						assert.Equals(t, 1, reasonCode)
+						return nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 200,
+			}
+		},
+		"ok/jwk": func(t *testing.T) test {
+			// The account of the jwk, if any, is not used.
+			ctx := context.WithValue(context.Background(), jwsContextKey, jwkJWS)
+			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "accID"})
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payload})
+			return test{
+				auth: &mockAcmeAuthority{
+					revokeCertificate: func(accID string, key *jose.JSONWebKey, c *x509.Certificate, reasonCode int) error {
+						assert.Equals(t, "", accID)
+						assert.Equals(t, jwk, key)
+						assert.Equals(t, crt.Raw, c.Raw)
+						assert.Equals(t, 1, reasonCode)
+						return nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 200,
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			h := New(tc.auth).(*Handler)
+			req := httptest.NewRequest("POST", url, nil)
+			req = req.WithContext(tc.ctx)
+			w := httptest.NewRecorder()
+			h.RevokeCert(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tc.statusCode)
+
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tc.problem) {
+				var ae acme.AError
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				prob := tc.problem.ToACME()
+
+				assert.Equals(t, ae.Type, prob.Type)
+				assert.Equals(t, ae.Detail, prob.Detail)
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+			} else {
+				assert.Equals(t, len(body), 0)
+			}
+		})
+	}
+}
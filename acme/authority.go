@@ -1,24 +1,32 @@
 package acme
 
 import (
+	"bytes"
+	"context"
 	"crypto"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"time"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
 	database "github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/cli/jose"
 	"github.com/smallstep/nosql"
+	"golang.org/x/crypto/ocsp"
 )
 
 // Interface is the acme authority interface.
 type Interface interface {
+	ChangeAccountKey(provisioner.Interface, string, *jose.JSONWebKey, *jose.JSONWebKey) (*Account, error)
 	DeactivateAccount(provisioner.Interface, string) (*Account, error)
 	FinalizeOrder(provisioner.Interface, string, string, *x509.CertificateRequest) (*Order, error)
 	GetAccount(provisioner.Interface, string) (*Account, error)
@@ -29,13 +37,15 @@ type Interface interface {
 	GetLink(Link, string, bool, ...string) string
 	GetOrder(provisioner.Interface, string, string) (*Order, error)
 	GetOrdersByAccount(provisioner.Interface, string) ([]string, error)
+	GetRenewalInfo(string) (*RenewalInfo, error)
 	LoadProvisionerByID(string) (provisioner.Interface, error)
 	NewAccount(provisioner.Interface, AccountOptions) (*Account, error)
 	NewNonce() (string, error)
 	NewOrder(provisioner.Interface, OrderOptions) (*Order, error)
+	RevokeCertificate(string, *jose.JSONWebKey, *x509.Certificate, int) error
 	UpdateAccount(provisioner.Interface, string, []string) (*Account, error)
 	UseNonce(string) error
-	ValidateChallenge(provisioner.Interface, string, string, *jose.JSONWebKey) (*Challenge, error)
+	ValidateChallenge(provisioner.Interface, string, string, *jose.JSONWebKey, []byte) (*Challenge, error)
 }
 
 // Authority is the layer that handles all ACME interactions.
@@ -43,28 +53,49 @@ type Authority struct {
 	db       nosql.DB
 	dir      *directory
 	signAuth SignAuthority
+	// validateOptions overrides the default functions used to validate the
+	// challenges. It's only used in tests.
+	validateOptions *validateOptions
+	// validationDialer, if set, opens the connections of the http-01 and
+	// tls-alpn-01 validations.
+	validationDialer ValidationDialer
+	// validations runs the background validations of the challenges.
+	validations *validationPool
 }
 
 var (
-	accountTable           = []byte("acme_accounts")
-	accountByKeyIDTable    = []byte("acme_keyID_accountID_index")
-	authzTable             = []byte("acme_authzs")
-	challengeTable         = []byte("acme_challenges")
-	nonceTable             = []byte("nonces")
-	orderTable             = []byte("acme_orders")
-	ordersByAccountIDTable = []byte("acme_account_orders_index")
-	certTable              = []byte("acme_certs")
+	accountTable            = []byte("acme_accounts")
+	accountByKeyIDTable     = []byte("acme_keyID_accountID_index")
+	authzTable              = []byte("acme_authzs")
+	challengeTable          = []byte("acme_challenges")
+	nonceTable              = []byte("nonces")
+	orderTable              = []byte("acme_orders")
+	ordersByAccountIDTable  = []byte("acme_account_orders_index")
+	certTable               = []byte("acme_certs")
+	certIDBySerialTable     = []byte("acme_serial_certID_index")
+	externalAccountKeyTable = []byte("acme_external_account_keys")
+
+	// acmeTables are the tables created by NewAuthority.
+	acmeTables = [][]byte{accountTable, accountByKeyIDTable, authzTable,
+		challengeTable, nonceTable, orderTable, ordersByAccountIDTable,
+		certTable, certIDBySerialTable, externalAccountKeyTable}
 )
 
-// NewAuthority returns a new Authority that implements the ACME interface.
+func init() {
+	// Export the ACME tables with the authority ones.
+	database.RegisterTables(acmeTables...)
+	// Delete the nonces that are never used.
+	database.RegisterExpiry(nonceTable, nonceExpiry)
+}
+
+// NewAuthority returns a new Authority that implements the ACME interface. The
+// absolute links are https://<dns>/<prefix>/..., dns is the host of the CA and
+// it can include the path where a proxy serves the CA.
 func NewAuthority(db nosql.DB, dns, prefix string, signAuth SignAuthority) (*Authority, error) {
 	if _, ok := db.(*database.SimpleDB); !ok {
 		// If it's not a SimpleDB then go ahead and bootstrap the DB with the
 		// necessary ACME tables. SimpleDB should ONLY be used for testing.
-		tables := [][]byte{accountTable, accountByKeyIDTable, authzTable,
-			challengeTable, nonceTable, orderTable, ordersByAccountIDTable,
-			certTable}
-		for _, b := range tables {
+		for _, b := range acmeTables {
 			if err := db.CreateTable(b); err != nil {
 				return nil, errors.Wrapf(err, "error creating table %s",
 					string(b))
@@ -73,24 +104,53 @@ func NewAuthority(db nosql.DB, dns, prefix string, signAuth SignAuthority) (*Aut
 	}
 	return &Authority{
 		db: db, dir: newDirectory(dns, prefix), signAuth: signAuth,
+		validations: newValidationPool(maxValidations),
 	}, nil
 }
 
+// Shutdown cancels the background validations of the challenges and waits for
+// them to finish. The challenges cancelled are pending again, so the clients
+// can retry them, and no new validations are started after it.
+func (a *Authority) Shutdown() {
+	a.validations.stop()
+}
+
+// SetValidationDialer sets the function that opens the connections of the
+// http-01 and tls-alpn-01 validations, e.g. to route them through a proxy. The
+// validationSourceAddress of the provisioners is not used with it.
+func (a *Authority) SetValidationDialer(dial ValidationDialer) {
+	a.validationDialer = dial
+}
+
 // GetLink returns the requested link from the directory.
 func (a *Authority) GetLink(typ Link, provID string, abs bool, inputs ...string) string {
 	return a.dir.getLink(typ, provID, abs, inputs...)
 }
 
-// GetDirectory returns the ACME directory object.
+// GetDirectory returns the ACME directory object. The metadata of an ACME
+// provisioner, if any, is published in the meta object.
 func (a *Authority) GetDirectory(p provisioner.Interface) *Directory {
 	name := url.PathEscape(p.GetName())
-	return &Directory{
-		NewNonce:   a.dir.getLink(NewNonceLink, name, true),
-		NewAccount: a.dir.getLink(NewAccountLink, name, true),
-		NewOrder:   a.dir.getLink(NewOrderLink, name, true),
-		RevokeCert: a.dir.getLink(RevokeCertLink, name, true),
-		KeyChange:  a.dir.getLink(KeyChangeLink, name, true),
+	dir := &Directory{
+		NewNonce:    a.dir.getLink(NewNonceLink, name, true),
+		NewAccount:  a.dir.getLink(NewAccountLink, name, true),
+		NewOrder:    a.dir.getLink(NewOrderLink, name, true),
+		RevokeCert:  a.dir.getLink(RevokeCertLink, name, true),
+		KeyChange:   a.dir.getLink(KeyChangeLink, name, true),
+		RenewalInfo: a.dir.getLink(RenewalInfoLink, name, true),
+	}
+	if acmeProv, ok := p.(*provisioner.ACME); ok {
+		meta := &DirectoryMeta{
+			TermsOfService:          acmeProv.TermsOfService,
+			Website:                 acmeProv.Website,
+			CAAIdentities:           acmeProv.CAAIdentities,
+			ExternalAccountRequired: acmeProv.RequireEAB,
+		}
+		if meta.TermsOfService != "" || meta.Website != "" || len(meta.CAAIdentities) > 0 || meta.ExternalAccountRequired {
+			dir.Meta = meta
+		}
 	}
+	return dir
 }
 
 // LoadProvisionerByID calls out to the SignAuthority interface to load a
@@ -114,11 +174,27 @@ func (a *Authority) UseNonce(nonce string) error {
 }
 
 // NewAccount creates, stores, and returns a new ACME account.
+//
+// If the provisioner requires an external account binding, the account options
+// must include a valid binding signed with an external account key of the
+// provisioner.
 func (a *Authority) NewAccount(p provisioner.Interface, ao AccountOptions) (*Account, error) {
+	eak, err := a.validateExternalAccountBinding(p, ao)
+	if err != nil {
+		return nil, err
+	}
 	acc, err := newAccount(a.db, ao)
 	if err != nil {
 		return nil, err
 	}
+	if eak != nil {
+		if err := eak.bind(a.db, acc.ID); err != nil {
+			// The key has been used by another request in the meantime, the
+			// account cannot be used.
+			acc.deactivate(a.db)
+			return nil, Wrap(err, "error binding external account key")
+		}
+	}
 	return acc.toACME(a.db, a.dir, p)
 }
 
@@ -134,6 +210,41 @@ func (a *Authority) UpdateAccount(p provisioner.Interface, id string, contact []
 	return acc.toACME(a.db, a.dir, p)
 }
 
+// ChangeAccountKey replaces the key of an ACME account. The old key must be
+// the current key of the account, and the new key cannot belong to another
+// account.
+func (a *Authority) ChangeAccountKey(p provisioner.Interface, id string, oldKey, newKey *jose.JSONWebKey) (*Account, error) {
+	acc, err := getAccountByID(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Status != StatusValid {
+		return nil, UnauthorizedErr(errors.New("account is not active"))
+	}
+	currentKid, err := keyToID(acc.Key)
+	if err != nil {
+		return nil, err
+	}
+	oldKid, err := keyToID(oldKey)
+	if err != nil {
+		return nil, err
+	}
+	if oldKid != currentKid {
+		return nil, MalformedErr(errors.New("old key does not match the current key of the account"))
+	}
+	newKid, err := keyToID(newKey)
+	if err != nil {
+		return nil, err
+	}
+	if newKid == currentKid {
+		return nil, MalformedErr(errors.New("new key must be different from the current key of the account"))
+	}
+	if acc, err = acc.changeKey(a.db, newKey); err != nil {
+		return nil, err
+	}
+	return acc.toACME(a.db, a.dir, p)
+}
+
 // GetAccount returns an ACME account.
 func (a *Authority) GetAccount(p provisioner.Interface, id string) (*Account, error) {
 	acc, err := getAccountByID(a.db, id)
@@ -152,6 +263,21 @@ func (a *Authority) DeactivateAccount(p provisioner.Interface, id string) (*Acco
 	if acc, err = acc.deactivate(a.db); err != nil {
 		return nil, err
 	}
+	// The pending orders and authorizations of the account cannot be
+	// completed anymore.
+	oids, err := getOrderIDsByAccount(a.db, acc.ID)
+	if err != nil {
+		return nil, Wrap(err, "error invalidating orders")
+	}
+	for _, oid := range oids {
+		o, err := getOrder(a.db, oid)
+		if err != nil {
+			return nil, Wrap(err, "error invalidating orders")
+		}
+		if _, err := o.invalidate(a.db, UnauthorizedErr(errors.New("account has been deactivated"))); err != nil {
+			return nil, Wrap(err, "error invalidating orders")
+		}
+	}
 	return acc.toACME(a.db, a.dir, p)
 }
 
@@ -214,6 +340,31 @@ func (a *Authority) GetOrdersByAccount(p provisioner.Interface, id string) ([]st
 
 // NewOrder generates, stores, and returns a new ACME order.
 func (a *Authority) NewOrder(p provisioner.Interface, ops OrderOptions) (*Order, error) {
+	// All the identifiers are validated, the identifiers rejected are
+	// reported in the subproblems of the error.
+	var errs []*Error
+	for _, identifier := range ops.Identifiers {
+		if identifier.Type == "permanent-identifier" && len(ops.Identifiers) > 1 {
+			return nil, MalformedErr(errors.New("an order with a permanent-identifier cannot contain other identifiers"))
+		}
+		if err := validateOrderIdentifier(p, identifier); err != nil {
+			errs = append(errs, err.WithIdentifier(identifier))
+		}
+	}
+	if err := SubproblemsErr(errs...); err != nil {
+		return nil, err
+	}
+	if acmeProv, ok := p.(*provisioner.ACME); ok {
+		// The requested validity must be allowed by the provisioner claims.
+		if err := acmeProv.AuthorizeOrderValidity(ops.NotBefore, ops.NotAfter); err != nil {
+			return nil, MalformedErr(err)
+		}
+		// Only create the challenges enabled in the provisioner.
+		ops.Challenges = acmeProv.Challenges
+		if ops.UserData != nil && !acmeProv.AllowsUserData() {
+			return nil, MalformedErr(errors.New("the provisioner does not allow template data in the orders"))
+		}
+	}
 	order, err := newOrder(a.db, ops)
 	if err != nil {
 		return nil, Wrap(err, "error creating order")
@@ -221,6 +372,58 @@ func (a *Authority) NewOrder(p provisioner.Interface, ops OrderOptions) (*Order,
 	return order.toACME(a.db, a.dir, p)
 }
 
+// validateOrderIdentifier returns a rejectedIdentifier error if the identifier
+// cannot be ordered with the provisioner. Wildcards are only supported as the
+// leftmost label of the name, and they can be disabled in the provisioner, as
+// the IP addresses.
+func validateOrderIdentifier(p provisioner.Interface, identifier Identifier) *Error {
+	switch identifier.Type {
+	case "permanent-identifier":
+		// The permanent identifiers are authorized by the attestation of the
+		// device, the name checks only apply to the dns identifiers.
+		return nil
+	case "ip":
+		return validateOrderIP(p, identifier.Value)
+	}
+	name := identifier.Value
+	if strings.Contains(name, "*") {
+		if !strings.HasPrefix(name, "*.") || strings.Contains(name[2:], "*") || len(name) == 2 {
+			return RejectedIdentifierErr(errors.Errorf("invalid wildcard identifier %s", name))
+		}
+	}
+	acmeProv, ok := p.(*provisioner.ACME)
+	if !ok {
+		return nil
+	}
+	if acmeProv.DisableWildcardNames && strings.HasPrefix(name, "*.") {
+		return RejectedIdentifierErr(errors.Errorf("wildcard identifier %s is not allowed by the provisioner", name))
+	}
+	if err := acmeProv.AuthorizeDNSName(name); err != nil {
+		return RejectedIdentifierErr(err)
+	}
+	return nil
+}
+
+// validateOrderIP returns a rejectedIdentifier error if the IP address cannot
+// be ordered with the provisioner.
+func validateOrderIP(p provisioner.Interface, value string) *Error {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return MalformedErr(errors.Errorf("invalid IP address %s", value))
+	}
+	acmeProv, ok := p.(*provisioner.ACME)
+	if !ok {
+		return nil
+	}
+	if acmeProv.DisableIPIdentifiers {
+		return RejectedIdentifierErr(errors.Errorf("IP identifier %s is not allowed by the provisioner", value))
+	}
+	if err := acmeProv.AuthorizeIP(ip); err != nil {
+		return RejectedIdentifierErr(err)
+	}
+	return nil
+}
+
 // FinalizeOrder attempts to finalize an order and generate a new certificate.
 func (a *Authority) FinalizeOrder(p provisioner.Interface, accID, orderID string, csr *x509.CertificateRequest) (*Order, error) {
 	o, err := getOrder(a.db, orderID)
@@ -254,8 +457,11 @@ func (a *Authority) GetAuthz(p provisioner.Interface, accID, authzID string) (*A
 	return az.toACME(a.db, a.dir, p)
 }
 
-// ValidateChallenge attempts to validate the challenge.
-func (a *Authority) ValidateChallenge(p provisioner.Interface, accID, chID string, jwk *jose.JSONWebKey) (*Challenge, error) {
+// ValidateChallenge starts the validation of a pending challenge and returns
+// it in processing, the network checks run in the background until the
+// challenge is valid or invalid. The challenges that are not pending are
+// returned as they are.
+func (a *Authority) ValidateChallenge(p provisioner.Interface, accID, chID string, jwk *jose.JSONWebKey, payload []byte) (*Challenge, error) {
 	ch, err := getChallenge(a.db, chID)
 	if err != nil {
 		return nil, err
@@ -263,23 +469,177 @@ func (a *Authority) ValidateChallenge(p provisioner.Interface, accID, chID strin
 	if accID != ch.getAccountID() {
 		return nil, UnauthorizedErr(errors.New("account does not own challenge"))
 	}
-	client := http.Client{
-		Timeout: time.Duration(30 * time.Second),
+	vo := a.getValidateOptions(p)
+	vo.payload = payload
+
+	// The attestation of the device-attest-01 challenge is in the request, it
+	// is verified without network checks.
+	if ch.getType() == "device-attest-01" {
+		ch, err = ch.validate(a.db, jwk, vo)
+		if err != nil {
+			return nil, Wrap(err, "error attempting challenge validation")
+		}
+		return ch.toACME(a.db, a.dir, p)
+	}
+	if ch.getStatus() != StatusPending {
+		return ch.toACME(a.db, a.dir, p)
 	}
-	dialer := &net.Dialer{
-		Timeout: 30 * time.Second,
+
+	// Only the request that moves the challenge to processing starts the
+	// validation, the rest return the challenge as it is now. The slot in the
+	// pool is taken first, so a challenge does not stay in processing without
+	// a validation.
+	if err := a.validations.acquire(); err != nil {
+		return nil, err
 	}
-	ch, err = ch.validate(a.db, jwk, validateOptions{
-		httpGet:   client.Get,
-		lookupTxt: net.LookupTXT,
-		tlsDial: func(network, addr string, config *tls.Config) (*tls.Conn, error) {
-			return tls.DialWithDialer(dialer, network, addr, config)
-		},
+	upd := ch.clone()
+	upd.Status = StatusProcessing
+	if err := upd.save(a.db, ch); err != nil {
+		a.validations.release()
+		cur, gerr := getChallenge(a.db, chID)
+		if gerr != nil || cur.getStatus() == StatusPending {
+			return nil, Wrap(err, "error attempting challenge validation")
+		}
+		return cur.toACME(a.db, a.dir, p)
+	}
+	a.validations.start(func(ctx context.Context) {
+		a.validateChallenge(ctx, chID, jwk, vo)
 	})
+	return upd.toACME(a.db, a.dir, p)
+}
+
+// validateChallenge performs the network checks of a challenge in
+// processing. The validation stores the challenge as valid or invalid, and
+// the errors it does not store also make the challenge invalid, so it does
+// not stay in processing. If the context is cancelled the challenge is pending
+// again.
+func (a *Authority) validateChallenge(ctx context.Context, chID string, jwk *jose.JSONWebKey, vo validateOptions) {
+	vo.ctx = ctx
+	ch, err := getChallenge(a.db, chID)
 	if err != nil {
-		return nil, Wrap(err, "error attempting challenge validation")
+		log.Printf("error validating challenge %s: %v", chID, err)
+		return
+	}
+	if _, err := ch.validate(a.db, jwk, vo); err != nil {
+		if ctx.Err() != nil {
+			upd := ch.clone()
+			upd.Status = StatusPending
+			if serr := upd.save(a.db, ch); serr != nil {
+				log.Printf("error cancelling the validation of challenge %s: %v", chID, serr)
+			}
+			return
+		}
+		if _, serr := ch.clone().storeInvalid(a.db, Wrap(err, "error validating challenge")); serr != nil {
+			log.Printf("error validating challenge %s: %v", chID, err)
+		}
+	}
+}
+
+// maxValidations is the maximum number of challenges validated at the same
+// time in the background.
+const maxValidations = 100
+
+// validationPool runs the background validations of the challenges, up to a
+// maximum at the same time, until it is stopped.
+type validationPool struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newValidationPool(size int) *validationPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &validationPool{
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, size),
+	}
+}
+
+// acquire takes a slot for a new validation, it fails if all the slots are in
+// use or if the pool is stopped.
+func (p *validationPool) acquire() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx.Err() != nil {
+		return ServerInternalErr(errors.New("the ACME authority is shutting down"))
+	}
+	select {
+	case p.slots <- struct{}{}:
+		p.wg.Add(1)
+		return nil
+	default:
+		return RateLimitedErr(errors.New("too many challenges are being validated, try again later"))
+	}
+}
+
+// release frees a slot taken with acquire.
+func (p *validationPool) release() {
+	<-p.slots
+	p.wg.Done()
+}
+
+// start runs the validation in the slot taken with acquire, and frees it when
+// the validation finishes.
+func (p *validationPool) start(fn func(ctx context.Context)) {
+	go func() {
+		defer p.release()
+		fn(p.ctx)
+	}()
+}
+
+// stop cancels the validations and waits for them.
+func (p *validationPool) stop() {
+	p.mu.Lock()
+	p.cancel()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// getValidateOptions returns the functions used to validate the challenges.
+// The http-01 and tls-alpn-01 validations use the ports and the source address
+// of the provisioner, and the dns-01 validations use its resolver and
+// propagation time.
+func (a *Authority) getValidateOptions(p provisioner.Interface) validateOptions {
+	acmeProv, isACME := p.(*provisioner.ACME)
+	if a.validateOptions != nil {
+		vo := *a.validateOptions
+		if isACME {
+			vo.verifyAttestation = acmeProv.VerifyAttestation
+		}
+		return vo
+	}
+	httpPort, tlsPort := "80", "443"
+	var source net.IP
+	if isACME {
+		httpPort = strconv.Itoa(acmeProv.GetHTTP01Port())
+		tlsPort = strconv.Itoa(acmeProv.GetTLSALPN01Port())
+		source = acmeProv.GetValidationSourceAddress()
+	}
+	dial := a.validationDialer
+	if dial == nil {
+		dial = newValidationDialer(source)
 	}
-	return ch.toACME(a.db, a.dir, p)
+	vo := validateOptions{
+		httpGet:     newHTTP01Getter(httpPort, dial),
+		httpPort:    httpPort,
+		tlsPort:     tlsPort,
+		lookupTxt:   net.LookupTXT,
+		lookupCNAME: net.LookupCNAME,
+		tlsDial:     newTLSALPN01Dialer(dial, tlsALPN01Timeout),
+	}
+	if isACME {
+		vo.verifyAttestation = acmeProv.VerifyAttestation
+		if acmeProv.Resolver != "" {
+			vo.lookupTxt, vo.lookupCNAME = newDNS01Lookups(acmeProv.Resolver)
+		}
+		if acmeProv.DNSPropagation != nil {
+			vo.dnsPropagation = acmeProv.DNSPropagation.Duration
+		}
+	}
+	return vo
 }
 
 // GetCertificate retrieves the Certificate by ID.
@@ -293,3 +653,134 @@ func (a *Authority) GetCertificate(accID, certID string) ([]byte, error) {
 	}
 	return cert.toACME(a.db, a.dir)
 }
+
+// GetRenewalInfo returns the renewal information of a certificate issued with
+// ACME, id is the identifier returned by RenewalInfoID.
+func (a *Authority) GetRenewalInfo(id string) (*RenewalInfo, error) {
+	aki, serial, err := parseRenewalInfoID(id)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := getCertBySerial(a.db, serial.String())
+	switch {
+	case nosql.IsErrNotFound(err):
+		return nil, MalformedErr(errors.Errorf("certificate %s not found", id))
+	case err != nil:
+		return nil, err
+	}
+	leaf, err := cert.parseLeaf()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(leaf.AuthorityKeyId, aki) {
+		return nil, MalformedErr(errors.Errorf("certificate %s not found", id))
+	}
+	isRevoked, err := a.signAuth.IsRevoked(leaf.SerialNumber.String())
+	if err != nil {
+		return nil, ServerInternalErr(errors.Wrapf(err, "error checking revocation of certificate %s", id))
+	}
+	return newRenewalInfo(leaf, isRevoked, clock.Now()), nil
+}
+
+// RevokeCertificate revokes a certificate issued by the CA. The request is
+// authorized by the account that ordered the certificate, or, if accID is
+// empty, by the key of the certificate, jwk must be the key that signed the
+// request. The revocation is stored with the other revocations of the CA, so
+// the certificate cannot be renewed and it is published in the CRL.
+func (a *Authority) RevokeCertificate(accID string, jwk *jose.JSONWebKey, crt *x509.Certificate, reasonCode int) error {
+	serial := crt.SerialNumber.String()
+	issued, err := a.isIssuedByCA(crt)
+	if err != nil {
+		return err
+	}
+	if !issued {
+		return UnauthorizedErr(errors.Errorf("certificate %s was not issued by this CA", serial))
+	}
+
+	if accID != "" {
+		if err := validateRevocationReason(reasonCode, accountRevocationReasons); err != nil {
+			return err
+		}
+		cert, err := getCertBySerial(a.db, serial)
+		switch {
+		case nosql.IsErrNotFound(err):
+			return UnauthorizedErr(errors.Errorf("account does not own certificate %s", serial))
+		case err != nil:
+			return err
+		case cert.AccountID != accID:
+			return UnauthorizedErr(errors.Errorf("account does not own certificate %s", serial))
+		}
+	} else {
+		if err := validateRevocationReason(reasonCode, keyRevocationReasons); err != nil {
+			return err
+		}
+		kid, err := keyToID(jwk)
+		if err != nil {
+			return err
+		}
+		crtKid, err := keyToID(&jose.JSONWebKey{Key: crt.PublicKey})
+		if err != nil {
+			return err
+		}
+		if kid != crtKid {
+			return UnauthorizedErr(errors.Errorf("request is not signed by the key of certificate %s", serial))
+		}
+	}
+
+	isRevoked, err := a.signAuth.IsRevoked(serial)
+	if err != nil {
+		return ServerInternalErr(errors.Wrapf(err, "error checking revocation of certificate %s", serial))
+	}
+	if isRevoked {
+		return AlreadyRevokedErr(errors.Errorf("certificate %s has already been revoked", serial))
+	}
+
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.RevokeMethod)
+	if err := a.signAuth.Revoke(ctx, &authority.RevokeOptions{
+		Serial:     serial,
+		ReasonCode: reasonCode,
+		MTLS:       true,
+		Crt:        crt,
+	}); err != nil {
+		return ServerInternalErr(errors.Wrapf(err, "error revoking certificate %s", serial))
+	}
+	return nil
+}
+
+// isIssuedByCA returns true if the certificate is stored in the certificates
+// database of the CA. The certificates issued before a rotation of the
+// intermediate are not signed by the current one, so the signature is only
+// checked if the database does not support lookups or does not have the
+// certificate.
+func (a *Authority) isIssuedByCA(crt *x509.Certificate) (bool, error) {
+	info, err := a.signAuth.GetCertificate(crt.SerialNumber.String())
+	if err == nil {
+		return bytes.Equal(info.Certificate.Raw, crt.Raw), nil
+	}
+	if sc, ok := err.(errs.StatusCoder); !ok || (sc.StatusCode() != http.StatusNotFound && sc.StatusCode() != http.StatusNotImplemented) {
+		return false, ServerInternalErr(errors.Wrapf(err, "error loading certificate %s", crt.SerialNumber))
+	}
+	intermediate := a.signAuth.GetIntermediateCertificate()
+	return intermediate != nil && crt.CheckSignatureFrom(intermediate) == nil, nil
+}
+
+// The revocation reasons allowed to the account that ordered a certificate and
+// to the holder of the certificate key. The reasons asserted by the CA, the
+// certificateHold, that ACME cannot release, and removeFromCRL, that is only
+// used in delta CRLs, are never allowed.
+var (
+	accountRevocationReasons = []int{ocsp.Unspecified, ocsp.KeyCompromise,
+		ocsp.AffiliationChanged, ocsp.Superseded, ocsp.CessationOfOperation}
+	keyRevocationReasons = []int{ocsp.Unspecified, ocsp.KeyCompromise}
+)
+
+// validateRevocationReason returns a badRevocationReason error if the reason
+// code is not in the allowed list.
+func validateRevocationReason(reasonCode int, allowed []int) error {
+	for _, code := range allowed {
+		if reasonCode == code {
+			return nil
+		}
+	}
+	return BadRevocationReasonErr(errors.Errorf("revocation reason %d is not allowed", reasonCode))
+}
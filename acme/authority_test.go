@@ -1,16 +1,34 @@
 package acme
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/cli/jose"
 	"github.com/smallstep/nosql/database"
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestAuthorityGetLink(t *testing.T) {
@@ -80,6 +98,24 @@ func TestAuthorityGetDirectory(t *testing.T) {
 	//assert.Equals(t, acmeDir.NewOrder, "httsp://ca.smallstep.com/acme/new-authz")
 	assert.Equals(t, acmeDir.RevokeCert, fmt.Sprintf("https://ca.smallstep.com/acme/%s/revoke-cert", URLSafeProvisionerName(prov)))
 	assert.Equals(t, acmeDir.KeyChange, fmt.Sprintf("https://ca.smallstep.com/acme/%s/key-change", URLSafeProvisionerName(prov)))
+	assert.Equals(t, acmeDir.RenewalInfo, fmt.Sprintf("https://ca.smallstep.com/acme/%s/renewal-info", URLSafeProvisionerName(prov)))
+	assert.Nil(t, acmeDir.Meta)
+
+	// The metadata of the provisioner is published in the meta object.
+	acmeDir = auth.GetDirectory(&provisioner.ACME{
+		Type:           "ACME",
+		Name:           "meta",
+		TermsOfService: "https://example.com/tos",
+		Website:        "https://example.com",
+		CAAIdentities:  []string{"example.com"},
+		RequireEAB:     true,
+	})
+	assert.Equals(t, &DirectoryMeta{
+		TermsOfService:          "https://example.com/tos",
+		Website:                 "https://example.com",
+		CAAIdentities:           []string{"example.com"},
+		ExternalAccountRequired: true,
+	}, acmeDir.Meta)
 }
 
 func TestAuthorityNewNonce(t *testing.T) {
@@ -748,7 +784,7 @@ func TestAuthorityGetAuthz(t *testing.T) {
 			}
 			az, err := newAuthz(mockdb, "1234", Identifier{
 				Type: "dns", Value: "acme.example.com",
-			})
+			}, nil)
 			assert.FatalError(t, err)
 			_az, ok := az.(*dnsAuthz)
 			assert.Fatal(t, ok)
@@ -852,11 +888,176 @@ func TestAuthorityNewOrder(t *testing.T) {
 	prov := newProv()
 	type test struct {
 		auth *Authority
+		prov provisioner.Interface
 		ops  OrderOptions
 		err  *Error
 		o    **Order
 	}
+	wildcardOps := func(names ...string) OrderOptions {
+		ops := defaultOrderOps()
+		ops.Identifiers = nil
+		for _, name := range names {
+			ops.Identifiers = append(ops.Identifiers, Identifier{Type: "dns", Value: name})
+		}
+		return ops
+	}
+	newACMEProv := func(p *provisioner.ACME) provisioner.Interface {
+		p.Type, p.Name = "ACME", "test@acme-provisioner.com"
+		assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+		return p
+	}
 	tests := map[string]func(t *testing.T) test{
+		"fail/invalid-wildcard": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth: auth,
+				ops:  wildcardOps("example.com", "foo.*.example.com"),
+				err:  RejectedIdentifierErr(errors.New("invalid wildcard identifier foo.*.example.com")),
+			}
+		},
+		"fail/double-wildcard": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth: auth,
+				ops:  wildcardOps("*.*.example.com"),
+				err:  RejectedIdentifierErr(errors.New("invalid wildcard identifier *.*.example.com")),
+			}
+		},
+		"fail/wildcard-disabled": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{DisableWildcardNames: true}),
+				ops:  wildcardOps("example.com", "*.example.com"),
+				err:  RejectedIdentifierErr(errors.New("wildcard identifier *.example.com is not allowed by the provisioner")),
+			}
+		},
+		"fail/policy-denied": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{X509Policy: &provisioner.X509Policy{
+					AllowedDNSNames: []string{"*.example.com"},
+					DeniedDNSNames:  []string{"admin.example.com"},
+				}}),
+				ops: wildcardOps("*.example.com"),
+				err: RejectedIdentifierErr(errors.New("dns name *.example.com is denied by the provisioner policy")),
+			}
+		},
+		"fail/policy-not-allowed": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{X509Policy: &provisioner.X509Policy{
+					AllowedDNSNames: []string{"www.example.com"},
+				}}),
+				ops: wildcardOps("*.example.com"),
+				err: RejectedIdentifierErr(errors.New("dns name *.example.com is not allowed by the provisioner policy")),
+			}
+		},
+		"fail/policy-subproblems": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{X509Policy: &provisioner.X509Policy{
+					AllowedDNSNames: []string{"*.example.com"},
+					DeniedDNSNames:  []string{"admin.example.com"},
+				}}),
+				ops: wildcardOps("www.example.com", "admin.example.com", "example.org"),
+				err: SubproblemsErr(
+					RejectedIdentifierErr(errors.New("dns name admin.example.com is denied by the provisioner policy")).
+						WithIdentifier(Identifier{Type: "dns", Value: "admin.example.com"}),
+					RejectedIdentifierErr(errors.New("dns name example.org is not allowed by the provisioner policy")).
+						WithIdentifier(Identifier{Type: "dns", Value: "example.org"}),
+				),
+			}
+		},
+		"fail/ip-disabled": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			ops := defaultOrderOps()
+			ops.Identifiers = []Identifier{{Type: "ip", Value: "10.0.0.1"}}
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{DisableIPIdentifiers: true}),
+				ops:  ops,
+				err:  RejectedIdentifierErr(errors.New("IP identifier 10.0.0.1 is not allowed by the provisioner")),
+			}
+		},
+		"fail/user-data-disabled": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			ops := defaultOrderOps()
+			ops.UserData = map[string]interface{}{"deviceID": "1234"}
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{X509: &provisioner.X509Options{DisableUserData: true}}),
+				ops:  ops,
+				err:  MalformedErr(errors.New("the provisioner does not allow template data in the orders")),
+			}
+		},
+		"fail/ip-policy-not-allowed": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			ops := defaultOrderOps()
+			ops.Identifiers = []Identifier{{Type: "ip", Value: "192.168.0.1"}}
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{X509Policy: &provisioner.X509Policy{
+					AllowedIPRanges: []string{"10.0.0.0/8"},
+				}}),
+				ops: ops,
+				err: RejectedIdentifierErr(errors.New("IP address 192.168.0.1 is not allowed by the provisioner policy")),
+			}
+		},
+		"fail/ip-policy-denied-by-default": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			ops := defaultOrderOps()
+			ops.Identifiers = []Identifier{{Type: "ip", Value: "2001:db8::1"}}
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{X509Policy: &provisioner.X509Policy{
+					AllowedDNSNames: []string{"*.example.com"},
+					DefaultIPAction: "deny",
+				}}),
+				ops: ops,
+				err: RejectedIdentifierErr(errors.New("IP address 2001:db8::1 is denied by default by the provisioner policy")),
+			}
+		},
+		"fail/permanent-identifier-with-others": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			ops := defaultOrderOps()
+			ops.Identifiers = []Identifier{
+				{Type: "permanent-identifier", Value: "12345678"},
+				{Type: "dns", Value: "example.com"},
+			}
+			return test{
+				auth: auth,
+				ops:  ops,
+				err:  MalformedErr(errors.New("an order with a permanent-identifier cannot contain other identifiers")),
+			}
+		},
+		"fail/validity-not-allowed": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			ops := defaultOrderOps()
+			ops.NotBefore = time.Time{}
+			ops.NotAfter = time.Now().Add(-time.Minute)
+			return test{
+				auth: auth,
+				prov: newACMEProv(&provisioner.ACME{}),
+				ops:  ops,
+				err:  MalformedErr(errors.New("notAfter cannot be in the past")),
+			}
+		},
 		"fail/newOrder-error": func(t *testing.T) test {
 			auth, err := NewAuthority(&db.MockNoSQLDB{
 				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
@@ -928,13 +1129,24 @@ func TestAuthorityNewOrder(t *testing.T) {
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
 			tc := run(t)
-			if acmeO, err := tc.auth.NewOrder(prov, tc.ops); err != nil {
+			if tc.prov == nil {
+				tc.prov = prov
+			}
+			if acmeO, err := tc.auth.NewOrder(tc.prov, tc.ops); err != nil {
 				if assert.NotNil(t, tc.err) {
 					ae, ok := err.(*Error)
 					assert.True(t, ok)
 					assert.HasPrefix(t, ae.Error(), tc.err.Error())
 					assert.Equals(t, ae.StatusCode(), tc.err.StatusCode())
 					assert.Equals(t, ae.Type, tc.err.Type)
+					assert.Equals(t, ae.Identifier, tc.err.Identifier)
+					if assert.Equals(t, len(ae.Sub), len(tc.err.Sub)) {
+						for i, sub := range ae.Sub {
+							assert.HasPrefix(t, sub.Error(), tc.err.Sub[i].Error())
+							assert.Equals(t, sub.Type, tc.err.Sub[i].Type)
+							assert.Equals(t, sub.Identifier, tc.err.Sub[i].Identifier)
+						}
+					}
 				}
 			} else {
 				if assert.Nil(t, tc.err) {
@@ -1297,7 +1509,7 @@ func TestAuthorityValidateChallenge(t *testing.T) {
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
 			tc := run(t)
-			if acmeCh, err := tc.auth.ValidateChallenge(prov, tc.accID, tc.id, nil); err != nil {
+			if acmeCh, err := tc.auth.ValidateChallenge(prov, tc.accID, tc.id, nil, nil); err != nil {
 				if assert.NotNil(t, tc.err) {
 					ae, ok := err.(*Error)
 					assert.True(t, ok)
@@ -1322,6 +1534,287 @@ func TestAuthorityValidateChallenge(t *testing.T) {
 	}
 }
 
+func TestAuthorityValidateChallenge_processing(t *testing.T) {
+	prov := newProv()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	mdb := newMemoryDB(t)
+	auth, err := NewAuthority(mdb, "ca.smallstep.com", "acme", nil)
+	assert.FatalError(t, err)
+	ch, err := newHTTP01Challenge(mdb, testOps)
+	assert.FatalError(t, err)
+	keyAuth, err := KeyAuthorization(ch.getToken(), jwk)
+	assert.FatalError(t, err)
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var requests int
+	auth.validateOptions = &validateOptions{
+		httpGet: func(url string) (*http.Response, error) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			<-release
+			rec := httptest.NewRecorder()
+			rec.WriteString(keyAuth)
+			return rec.Result(), nil
+		},
+	}
+
+	// The concurrent requests see the challenge in processing, and only one
+	// of them starts the validation.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acmeCh, err := auth.ValidateChallenge(prov, ch.getAccountID(), ch.getID(), jwk, nil)
+			if assert.NoError(t, err) {
+				assert.Equals(t, StatusProcessing, acmeCh.Status)
+			}
+		}()
+	}
+	wg.Wait()
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := getChallenge(mdb, ch.getID())
+		assert.FatalError(t, err)
+		if got.getStatus() != StatusProcessing || time.Now().After(deadline) {
+			assert.Equals(t, StatusValid, got.getStatus())
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	assert.Equals(t, 1, requests)
+	mu.Unlock()
+
+	// The valid challenge is not validated again.
+	acmeCh, err := auth.ValidateChallenge(prov, ch.getAccountID(), ch.getID(), jwk, nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusValid, acmeCh.Status)
+	mu.Lock()
+	assert.Equals(t, 1, requests)
+	mu.Unlock()
+}
+
+func TestAuthorityValidateChallenge_pool(t *testing.T) {
+	prov := newProv()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	mdb := newMemoryDB(t)
+	auth, err := NewAuthority(mdb, "ca.smallstep.com", "acme", nil)
+	assert.FatalError(t, err)
+	auth.validations = newValidationPool(1)
+
+	// The http-01 validations fail with a transient error and wait to retry.
+	started := make(chan struct{}, 2)
+	auth.validateOptions = &validateOptions{
+		httpGet: func(url string) (*http.Response, error) {
+			started <- struct{}{}
+			return nil, io.EOF
+		},
+	}
+	ch, err := newHTTP01Challenge(mdb, testOps)
+	assert.FatalError(t, err)
+	acmeCh, err := auth.ValidateChallenge(prov, ch.getAccountID(), ch.getID(), jwk, nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusProcessing, acmeCh.Status)
+	<-started
+
+	// The pool is full, the other challenge stays pending.
+	other, err := newHTTP01Challenge(mdb, testOps)
+	assert.FatalError(t, err)
+	_, err = auth.ValidateChallenge(prov, other.getAccountID(), other.getID(), jwk, nil)
+	if assert.NotNil(t, err) {
+		assert.Equals(t, rateLimitedErr, err.(*Error).Type)
+	}
+	got, err := getChallenge(mdb, other.getID())
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusPending, got.getStatus())
+
+	// Shutdown cancels the retry and waits for the validation, without
+	// waiting for the retry interval, and the challenge is pending again.
+	start := time.Now()
+	auth.Shutdown()
+	assert.True(t, time.Since(start) < http01RetryInterval)
+	got, err = getChallenge(mdb, ch.getID())
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusPending, got.getStatus())
+	assert.Equals(t, 0, len(started))
+
+	// No validations are started after the shutdown.
+	_, err = auth.ValidateChallenge(prov, ch.getAccountID(), ch.getID(), jwk, nil)
+	if assert.NotNil(t, err) {
+		assert.Equals(t, serverInternalErr, err.(*Error).Type)
+	}
+	got, err = getChallenge(mdb, ch.getID())
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusPending, got.getStatus())
+}
+
+func TestAuthorityChangeAccountKey(t *testing.T) {
+	prov := newProv()
+	newKey := func(t *testing.T) *jose.JSONWebKey {
+		jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+		assert.FatalError(t, err)
+		pub := jwk.Public()
+		return &pub
+	}
+	type test struct {
+		auth   *Authority
+		id     string
+		oldKey *jose.JSONWebKey
+		newKey *jose.JSONWebKey
+		err    *Error
+	}
+	tests := map[string]func(t *testing.T) test{
+		"fail/getAccount-error": func(t *testing.T) test {
+			auth, err := NewAuthority(&db.MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					return nil, errors.New("force")
+				},
+			}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth:   auth,
+				id:     "foo",
+				oldKey: newKey(t),
+				newKey: newKey(t),
+				err:    ServerInternalErr(errors.New("error loading account foo: force")),
+			}
+		},
+		"fail/deactivated": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			acc.Status = StatusDeactivated
+			b, err := json.Marshal(acc)
+			assert.FatalError(t, err)
+			auth, err := NewAuthority(&db.MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					return b, nil
+				},
+			}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth:   auth,
+				id:     acc.ID,
+				oldKey: acc.Key,
+				newKey: newKey(t),
+				err:    UnauthorizedErr(errors.New("account is not active")),
+			}
+		},
+		"fail/old-key-mismatch": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			b, err := json.Marshal(acc)
+			assert.FatalError(t, err)
+			auth, err := NewAuthority(&db.MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					return b, nil
+				},
+			}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth:   auth,
+				id:     acc.ID,
+				oldKey: newKey(t),
+				newKey: newKey(t),
+				err:    MalformedErr(errors.New("old key does not match the current key of the account")),
+			}
+		},
+		"fail/same-key": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			b, err := json.Marshal(acc)
+			assert.FatalError(t, err)
+			auth, err := NewAuthority(&db.MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					return b, nil
+				},
+			}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth:   auth,
+				id:     acc.ID,
+				oldKey: acc.Key,
+				newKey: acc.Key,
+				err:    MalformedErr(errors.New("new key must be different from the current key of the account")),
+			}
+		},
+		"fail/conflict": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			b, err := json.Marshal(acc)
+			assert.FatalError(t, err)
+			auth, err := NewAuthority(&db.MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					return b, nil
+				},
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					return []byte("other"), false, nil
+				},
+			}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth:   auth,
+				id:     acc.ID,
+				oldKey: acc.Key,
+				newKey: newKey(t),
+				err:    AccountKeyConflictErr(errors.New("key-id")),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			b, err := json.Marshal(acc)
+			assert.FatalError(t, err)
+			auth, err := NewAuthority(&db.MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					return b, nil
+				},
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					return nil, true, nil
+				},
+				MDel: func(bucket, key []byte) error {
+					return nil
+				},
+			}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth:   auth,
+				id:     acc.ID,
+				oldKey: acc.Key,
+				newKey: newKey(t),
+			}
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			acc, err := tc.auth.ChangeAccountKey(prov, tc.id, tc.oldKey, tc.newKey)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					ae, ok := err.(*Error)
+					assert.True(t, ok)
+					assert.HasPrefix(t, ae.Error(), tc.err.Error())
+					assert.Equals(t, ae.StatusCode(), tc.err.StatusCode())
+					assert.Equals(t, ae.Type, tc.err.Type)
+				}
+			} else {
+				if assert.Nil(t, tc.err) {
+					assert.Equals(t, acc.ID, tc.id)
+					assert.Equals(t, acc.Key, tc.newKey)
+				}
+			}
+		})
+	}
+}
+
 func TestAuthorityUpdateAccount(t *testing.T) {
 	contact := []string{"baz", "zap"}
 	prov := newProv()
@@ -1488,6 +1981,9 @@ func TestAuthorityDeactivateAccount(t *testing.T) {
 			clone.Deactivated = clock.Now()
 			auth, err := NewAuthority(&db.MockNoSQLDB{
 				MGet: func(bucket, key []byte) ([]byte, error) {
+					if string(bucket) == string(ordersByAccountIDTable) {
+						return nil, database.ErrNotFound
+					}
 					return b, nil
 				},
 				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
@@ -1503,6 +1999,31 @@ func TestAuthorityDeactivateAccount(t *testing.T) {
 				acc:  clone,
 			}
 		},
+		"fail/orderIDs-error": func(t *testing.T) test {
+			acc, err := newAcc()
+			assert.FatalError(t, err)
+			b, err := json.Marshal(acc)
+			assert.FatalError(t, err)
+
+			auth, err := NewAuthority(&db.MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					if string(bucket) == string(ordersByAccountIDTable) {
+						assert.Equals(t, key, []byte(acc.ID))
+						return nil, errors.New("force")
+					}
+					return b, nil
+				},
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					return nil, true, nil
+				},
+			}, "ca.smallstep.com", "acme", nil)
+			assert.FatalError(t, err)
+			return test{
+				auth: auth,
+				id:   acc.ID,
+				err:  ServerInternalErr(errors.Errorf("error invalidating orders: error loading orderIDs for account %s: force", acc.ID)),
+			}
+		},
 	}
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -1531,3 +2052,439 @@ func TestAuthorityDeactivateAccount(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthorityDeactivateAccount_orders(t *testing.T) {
+	prov := newProv()
+	mdb := memory.New()
+	auth, err := NewAuthority(mdb, "ca.smallstep.com", "acme", nil)
+	assert.FatalError(t, err)
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+	acc, err := auth.NewAccount(prov, AccountOptions{Key: &pub})
+	assert.FatalError(t, err)
+
+	newTestOrder := func(status string) *order {
+		o, err := newOrder(mdb, OrderOptions{
+			AccountID:   acc.ID,
+			Identifiers: []Identifier{{Type: "dns", Value: "example.com"}},
+			NotBefore:   clock.Now(),
+			NotAfter:    clock.Now().Add(time.Hour),
+		})
+		assert.FatalError(t, err)
+		if status != StatusPending {
+			_o := *o
+			_o.Status = status
+			assert.FatalError(t, _o.save(mdb, o))
+			o = &_o
+		}
+		return o
+	}
+	pending := newTestOrder(StatusPending)
+	ready := newTestOrder(StatusReady)
+	valid := newTestOrder(StatusValid)
+
+	// A valid authz of a pending order is not modified.
+	az, err := getAuthz(mdb, pending.Authorizations[0])
+	assert.FatalError(t, err)
+	other, err := newOrder(mdb, OrderOptions{
+		AccountID:   acc.ID,
+		Identifiers: []Identifier{{Type: "dns", Value: "example.com"}, {Type: "dns", Value: "example.org"}},
+	})
+	assert.FatalError(t, err)
+	validAz, err := getAuthz(mdb, other.Authorizations[0])
+	assert.FatalError(t, err)
+	_validAz := *validAz.clone()
+	_validAz.Status = StatusValid
+	assert.FatalError(t, _validAz.save(mdb, validAz))
+
+	deactivated, err := auth.DeactivateAccount(prov, acc.ID)
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusDeactivated, deactivated.Status)
+
+	for _, o := range []*order{pending, ready, other} {
+		got, err := getOrder(mdb, o.ID)
+		assert.FatalError(t, err)
+		assert.Equals(t, StatusInvalid, got.Status)
+		if assert.NotNil(t, got.Error) {
+			assert.Equals(t, "urn:ietf:params:acme:error:unauthorized", got.Error.Type)
+		}
+	}
+	got, err := getOrder(mdb, valid.ID)
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusValid, got.Status)
+
+	az, err = getAuthz(mdb, az.getID())
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusInvalid, az.getStatus())
+	validAz, err = getAuthz(mdb, validAz.getID())
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusValid, validAz.getStatus())
+	az, err = getAuthz(mdb, other.Authorizations[1])
+	assert.FatalError(t, err)
+	assert.Equals(t, StatusInvalid, az.getStatus())
+}
+
+func TestAuthorityGetValidateOptions(t *testing.T) {
+	srv := newTestDNSServer(t)
+	defer srv.Close()
+	srv.setTXT("_acme-challenge.example.com.", "foo")
+
+	a := &Authority{}
+	vo := a.getValidateOptions(&provisioner.ACME{
+		Type:           "ACME",
+		Name:           "acme",
+		Resolver:       srv.Addr(),
+		DNSPropagation: &provisioner.Duration{Duration: time.Minute},
+	})
+	assert.Equals(t, time.Minute, vo.dnsPropagation)
+	assert.Equals(t, "80", vo.httpPort)
+	txt, err := vo.lookupTxt("_acme-challenge.example.com")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"foo"}, txt)
+
+	vo = a.getValidateOptions(newProv())
+	assert.Equals(t, time.Duration(0), vo.dnsPropagation)
+	assert.NotNil(t, vo.lookupCNAME)
+	assert.Equals(t, "80", vo.httpPort)
+	assert.Equals(t, "443", vo.tlsPort)
+
+	// The validations use the ports of the provisioner and the dialer of the
+	// authority.
+	var addrs []string
+	a.SetValidationDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addrs = append(addrs, addr)
+		return nil, errors.New("force")
+	})
+	vo = a.getValidateOptions(&provisioner.ACME{
+		Type:          "ACME",
+		Name:          "acme",
+		HTTP01Port:    8080,
+		TLSALPN01Port: 8443,
+	})
+	assert.Equals(t, "8080", vo.httpPort)
+	assert.Equals(t, "8443", vo.tlsPort)
+	_, err = vo.httpGet("http://example.com:8080/.well-known/acme-challenge/foo")
+	assert.Error(t, err)
+	_, err = vo.tlsDial("tcp", "example.com:8443", &tls.Config{})
+	assert.Error(t, err)
+	assert.Equals(t, []string{"example.com:8080", "example.com:8443"}, addrs)
+}
+
+func TestAuthorityRevokeCertificate(t *testing.T) {
+	// newCA returns a self-signed CA and a leaf signed by it.
+	newCA := func(t *testing.T, serial int64) (*x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		caTmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Test Intermediate CA"},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+		assert.FatalError(t, err)
+		ca, err := x509.ParseCertificate(caDER)
+		assert.FatalError(t, err)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			DNSNames:     []string{"example.com"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, ca, key.Public(), caKey)
+		assert.FatalError(t, err)
+		leaf, err := x509.ParseCertificate(leafDER)
+		assert.FatalError(t, err)
+		return ca, leaf, key
+	}
+	ca, leaf, key := newCA(t, 1234)
+	otherCA, otherLeaf, _ := newCA(t, 5678)
+	crtKey := &jose.JSONWebKey{Key: key.Public()}
+	otherKey, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	type test struct {
+		auth       *Authority
+		accID      string
+		jwk        *jose.JSONWebKey
+		crt        *x509.Certificate
+		reasonCode int
+		revoked    *authority.RevokeOptions
+		err        *Error
+	}
+	// newTest returns the test of a CA that has issued the leaf through the
+	// account accID.
+	newTest := func(t *testing.T, sa *mockSignAuth) test {
+		mdb := memory.New()
+		auth, err := NewAuthority(mdb, "ca.smallstep.com", "acme", sa)
+		assert.FatalError(t, err)
+		_, err = newCert(mdb, CertOptions{AccountID: "accID", OrderID: "ordID", Leaf: leaf})
+		assert.FatalError(t, err)
+		return test{auth: auth, accID: "accID", crt: leaf}
+	}
+	tests := map[string]func(t *testing.T) test{
+		"fail/not-issued-by-ca": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: otherCA})
+			tc.err = UnauthorizedErr(errors.New("certificate 1234 was not issued by this CA"))
+			return tc
+		},
+		"fail/no-intermediate": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{})
+			tc.err = UnauthorizedErr(errors.New("certificate 1234 was not issued by this CA"))
+			return tc
+		},
+		"fail/not-stored": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: otherCA, getCertificate: func(serial string) (*authority.CertificateInfo, error) {
+				return nil, errs.NotFound("certificate %s not found", serial)
+			}})
+			tc.err = UnauthorizedErr(errors.New("certificate 1234 was not issued by this CA"))
+			return tc
+		},
+		"fail/stored-other-certificate": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca, getCertificate: func(serial string) (*authority.CertificateInfo, error) {
+				return &authority.CertificateInfo{Certificate: otherLeaf}, nil
+			}})
+			tc.err = UnauthorizedErr(errors.New("certificate 1234 was not issued by this CA"))
+			return tc
+		},
+		"fail/getCertificate-error": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca, getCertificate: func(serial string) (*authority.CertificateInfo, error) {
+				return nil, errors.New("force")
+			}})
+			tc.err = ServerInternalErr(errors.New("error loading certificate 1234: force"))
+			return tc
+		},
+		"fail/account/reason": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca})
+			tc.reasonCode = ocsp.CertificateHold
+			tc.err = BadRevocationReasonErr(errors.New("revocation reason 6 is not allowed"))
+			return tc
+		},
+		"fail/account/wrong-account": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca})
+			tc.accID = "otherAccID"
+			tc.err = UnauthorizedErr(errors.New("account does not own certificate 1234"))
+			return tc
+		},
+		"fail/account/not-ordered": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: otherCA})
+			tc.crt = otherLeaf
+			tc.err = UnauthorizedErr(errors.New("account does not own certificate 5678"))
+			return tc
+		},
+		"fail/key/reason": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca})
+			tc.accID, tc.jwk = "", crtKey
+			tc.reasonCode = ocsp.Superseded
+			tc.err = BadRevocationReasonErr(errors.New("revocation reason 4 is not allowed"))
+			return tc
+		},
+		"fail/key/wrong-key": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca})
+			tc.accID, tc.jwk = "", otherKey
+			tc.err = UnauthorizedErr(errors.New("request is not signed by the key of certificate 1234"))
+			return tc
+		},
+		"fail/isRevoked-error": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca, err: errors.New("force")})
+			tc.err = ServerInternalErr(errors.New("error checking revocation of certificate 1234: force"))
+			return tc
+		},
+		"fail/already-revoked": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca, isRevoked: func(serial string) (bool, error) {
+				assert.Equals(t, "1234", serial)
+				return true, nil
+			}})
+			tc.err = AlreadyRevokedErr(errors.New("certificate 1234 has already been revoked"))
+			return tc
+		},
+		"fail/revoke-error": func(t *testing.T) test {
+			tc := newTest(t, &mockSignAuth{intermediate: ca, revoke: func(ctx context.Context, opts *authority.RevokeOptions) error {
+				return errors.New("force")
+			}})
+			tc.err = ServerInternalErr(errors.New("error revoking certificate 1234: force"))
+			return tc
+		},
+		"ok/account": func(t *testing.T) test {
+			var revoked authority.RevokeOptions
+			tc := newTest(t, &mockSignAuth{intermediate: ca, revoke: func(ctx context.Context, opts *authority.RevokeOptions) error {
+				assert.Equals(t, provisioner.RevokeMethod, provisioner.MethodFromContext(ctx))
+				revoked = *opts
+				return nil
+			}})
+			tc.reasonCode = ocsp.Superseded
+			tc.revoked = &revoked
+			return tc
+		},
+		"ok/previous-intermediate": func(t *testing.T) test {
+			// The leaf was issued before the intermediate was rotated.
+			var revoked authority.RevokeOptions
+			tc := newTest(t, &mockSignAuth{intermediate: otherCA, getCertificate: func(serial string) (*authority.CertificateInfo, error) {
+				assert.Equals(t, "1234", serial)
+				return &authority.CertificateInfo{Certificate: leaf}, nil
+			}, revoke: func(ctx context.Context, opts *authority.RevokeOptions) error {
+				revoked = *opts
+				return nil
+			}})
+			tc.revoked = &revoked
+			return tc
+		},
+		"ok/key": func(t *testing.T) test {
+			var revoked authority.RevokeOptions
+			tc := newTest(t, &mockSignAuth{intermediate: ca, revoke: func(ctx context.Context, opts *authority.RevokeOptions) error {
+				revoked = *opts
+				return nil
+			}})
+			tc.accID, tc.jwk = "", crtKey
+			tc.reasonCode = ocsp.KeyCompromise
+			tc.revoked = &revoked
+			return tc
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			if err := tc.auth.RevokeCertificate(tc.accID, tc.jwk, tc.crt, tc.reasonCode); err != nil {
+				if assert.NotNil(t, tc.err) {
+					ae, ok := err.(*Error)
+					assert.True(t, ok)
+					assert.HasPrefix(t, ae.Error(), tc.err.Error())
+					assert.Equals(t, ae.StatusCode(), tc.err.StatusCode())
+					assert.Equals(t, ae.Type, tc.err.Type)
+				}
+			} else {
+				if assert.Nil(t, tc.err) {
+					assert.Equals(t, &authority.RevokeOptions{
+						Serial:     "1234",
+						ReasonCode: tc.reasonCode,
+						MTLS:       true,
+						Crt:        tc.crt,
+					}, tc.revoked)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorityGetRenewalInfo(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Intermediate CA"},
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	notBefore := time.Now().Truncate(time.Second)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(24 * time.Hour),
+	}, caTmpl, key.Public(), caKey)
+	assert.FatalError(t, err)
+	leaf, err := x509.ParseCertificate(leafDER)
+	assert.FatalError(t, err)
+	// other has the serial of the leaf and another authority key identifier.
+	other := &x509.Certificate{SerialNumber: leaf.SerialNumber, AuthorityKeyId: []byte{5, 6}}
+
+	type test struct {
+		id  string
+		sa  *mockSignAuth
+		ri  *RenewalInfo
+		err *Error
+	}
+	tests := map[string]func(t *testing.T) test{
+		"fail/malformed-id": func(t *testing.T) test {
+			return test{
+				id:  "foo",
+				sa:  &mockSignAuth{},
+				err: MalformedErr(errors.New("invalid renewalInfo identifier foo")),
+			}
+		},
+		"fail/not-found": func(t *testing.T) test {
+			id := RenewalInfoID(&x509.Certificate{SerialNumber: big.NewInt(5678), AuthorityKeyId: leaf.AuthorityKeyId})
+			return test{
+				id:  id,
+				sa:  &mockSignAuth{},
+				err: MalformedErr(errors.Errorf("certificate %s not found", id)),
+			}
+		},
+		"fail/other-authority-key-id": func(t *testing.T) test {
+			return test{
+				id:  RenewalInfoID(other),
+				sa:  &mockSignAuth{},
+				err: MalformedErr(errors.Errorf("certificate %s not found", RenewalInfoID(other))),
+			}
+		},
+		"fail/isRevoked-error": func(t *testing.T) test {
+			return test{
+				id: RenewalInfoID(leaf),
+				sa: &mockSignAuth{isRevoked: func(serial string) (bool, error) {
+					return false, errors.New("force")
+				}},
+				err: ServerInternalErr(errors.Errorf("error checking revocation of certificate %s: force", RenewalInfoID(leaf))),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			return test{
+				id: RenewalInfoID(leaf),
+				sa: &mockSignAuth{isRevoked: func(serial string) (bool, error) {
+					assert.Equals(t, "1234", serial)
+					return false, nil
+				}},
+				ri: &RenewalInfo{SuggestedWindow: RenewalWindow{
+					Start: notBefore.Add(16 * time.Hour).UTC(),
+					End:   notBefore.Add(20 * time.Hour).UTC(),
+				}},
+			}
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			mdb := memory.New()
+			auth, err := NewAuthority(mdb, "ca.smallstep.com", "acme", tc.sa)
+			assert.FatalError(t, err)
+			_, err = newCert(mdb, CertOptions{AccountID: "accID", OrderID: "ordID", Leaf: leaf})
+			assert.FatalError(t, err)
+			ri, err := auth.GetRenewalInfo(tc.id)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					ae, ok := err.(*Error)
+					assert.True(t, ok)
+					assert.HasPrefix(t, ae.Error(), tc.err.Error())
+					assert.Equals(t, ae.StatusCode(), tc.err.StatusCode())
+					assert.Equals(t, ae.Type, tc.err.Type)
+				}
+			} else if assert.Nil(t, tc.err) {
+				assert.Equals(t, tc.ri, ri)
+			}
+		})
+	}
+
+	// The window of a revoked certificate has already started, it ends now,
+	// rounded to seconds by the clock.
+	mdb := memory.New()
+	auth, err := NewAuthority(mdb, "ca.smallstep.com", "acme", &mockSignAuth{isRevoked: func(serial string) (bool, error) {
+		return true, nil
+	}})
+	assert.FatalError(t, err)
+	_, err = newCert(mdb, CertOptions{AccountID: "accID", OrderID: "ordID", Leaf: leaf})
+	assert.FatalError(t, err)
+	ri, err := auth.GetRenewalInfo(RenewalInfoID(leaf))
+	assert.FatalError(t, err)
+	assert.True(t, ri.SuggestedWindow.Start.Before(time.Now()))
+	assert.False(t, ri.SuggestedWindow.End.After(time.Now().Add(time.Second)))
+}
@@ -51,6 +51,7 @@ type authz interface {
 	getChallenges() []string
 	getCreated() time.Time
 	updateStatus(db nosql.DB) (authz, error)
+	invalidate(db nosql.DB, reason *Error) (authz, error)
 	toACME(nosql.DB, *directory, provisioner.Interface) (*Authz, error)
 }
 
@@ -64,7 +65,7 @@ type baseAuthz struct {
 	Challenges []string   `json:"challenges"`
 	Wildcard   bool       `json:"wildcard"`
 	Created    time.Time  `json:"created"`
-	Error      *Error     `json:"error"`
+	Error      *AError    `json:"error"`
 }
 
 func newBaseAuthz(accID string, identifier Identifier) (*baseAuthz, error) {
@@ -196,7 +197,14 @@ func (ba *baseAuthz) clone() *baseAuthz {
 }
 
 func (ba *baseAuthz) parent() authz {
-	return &dnsAuthz{ba}
+	switch ba.Identifier.Type {
+	case "permanent-identifier":
+		return &permanentIdentifierAuthz{ba}
+	case "ip":
+		return &ipAuthz{ba}
+	default:
+		return &dnsAuthz{ba}
+	}
 }
 
 // updateStatus attempts to update the status on a baseAuthz and stores the
@@ -214,11 +222,14 @@ func (ba *baseAuthz) updateStatus(db nosql.DB) (authz, error) {
 		// check expiry
 		if now.After(ba.Expires) {
 			newAuthz.Status = StatusInvalid
-			newAuthz.Error = MalformedErr(errors.New("authz has expired"))
+			newAuthz.Error = MalformedErr(errors.New("authz has expired")).ToACME()
 			break
 		}
 
-		var isValid = false
+		// The authz is valid if one of the challenges is valid, and invalid
+		// if a challenge has failed and none is valid.
+		var isValid bool
+		var invalid challenge
 		for _, chID := range ba.Challenges {
 			ch, err := getChallenge(db, chID)
 			if err != nil {
@@ -228,13 +239,21 @@ func (ba *baseAuthz) updateStatus(db nosql.DB) (authz, error) {
 				isValid = true
 				break
 			}
+			if ch.getStatus() == StatusInvalid && invalid == nil {
+				invalid = ch
+			}
 		}
 
-		if !isValid {
+		switch {
+		case isValid:
+			newAuthz.Status = StatusValid
+			newAuthz.Error = nil
+		case invalid != nil:
+			newAuthz.Status = StatusInvalid
+			newAuthz.Error = UnauthorizedErr(errors.Errorf("%s challenge %s is invalid", invalid.getType(), invalid.getID())).ToACME()
+		default:
 			return ba.parent(), nil
 		}
-		newAuthz.Status = StatusValid
-		newAuthz.Error = nil
 	default:
 		return nil, ServerInternalErr(errors.Errorf("unrecognized authz status: %s", ba.Status))
 	}
@@ -245,6 +264,21 @@ func (ba *baseAuthz) updateStatus(db nosql.DB) (authz, error) {
 	return newAuthz.parent(), nil
 }
 
+// invalidate marks a pending authz as invalid with the given reason. Authzs in
+// any other state are not modified.
+func (ba *baseAuthz) invalidate(db nosql.DB, reason *Error) (authz, error) {
+	if ba.Status != StatusPending {
+		return ba.parent(), nil
+	}
+	newAuthz := ba.clone()
+	newAuthz.Status = StatusInvalid
+	newAuthz.Error = reason.ToACME()
+	if err := newAuthz.save(db, ba); err != nil {
+		return ba, err
+	}
+	return newAuthz.parent(), nil
+}
+
 // unmarshalAuthz unmarshals an authz type into the correct sub-type.
 func unmarshalAuthz(data []byte) (authz, error) {
 	var getType struct {
@@ -261,6 +295,18 @@ func unmarshalAuthz(data []byte) (authz, error) {
 			return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling authz type into dnsAuthz"))
 		}
 		return &dnsAuthz{&ba}, nil
+	case "ip":
+		var ba baseAuthz
+		if err := json.Unmarshal(data, &ba); err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling authz type into ipAuthz"))
+		}
+		return &ipAuthz{&ba}, nil
+	case "permanent-identifier":
+		var ba baseAuthz
+		if err := json.Unmarshal(data, &ba); err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling authz type into permanentIdentifierAuthz"))
+		}
+		return &permanentIdentifierAuthz{&ba}, nil
 	default:
 		return nil, ServerInternalErr(errors.Errorf("unexpected authz type %s",
 			getType.Identifier.Type))
@@ -273,11 +319,16 @@ type dnsAuthz struct {
 }
 
 // newAuthz returns a new acme authorization object based on the identifier
-// type.
-func newAuthz(db nosql.DB, accID string, identifier Identifier) (a authz, err error) {
+// type. Only the given challenge types are created, an empty list enables all
+// of them.
+func newAuthz(db nosql.DB, accID string, identifier Identifier, challenges []string) (a authz, err error) {
 	switch identifier.Type {
 	case "dns":
-		a, err = newDNSAuthz(db, accID, identifier)
+		a, err = newDNSAuthz(db, accID, identifier, challenges)
+	case "ip":
+		a, err = newIPAuthz(db, accID, identifier, challenges)
+	case "permanent-identifier":
+		a, err = newPermanentIdentifierAuthz(db, accID, identifier, challenges)
 	default:
 		err = MalformedErr(errors.Errorf("unexpected authz type %s",
 			identifier.Type))
@@ -286,7 +337,7 @@ func newAuthz(db nosql.DB, accID string, identifier Identifier) (a authz, err er
 }
 
 // newDNSAuthz returns a new dns acme authorization object.
-func newDNSAuthz(db nosql.DB, accID string, identifier Identifier) (authz, error) {
+func newDNSAuthz(db nosql.DB, accID string, identifier Identifier, challenges []string) (authz, error) {
 	ba, err := newBaseAuthz(accID, identifier)
 	if err != nil {
 		return nil, err
@@ -295,40 +346,153 @@ func newDNSAuthz(db nosql.DB, accID string, identifier Identifier) (authz, error
 	ba.Challenges = []string{}
 	if !ba.Wildcard {
 		// http and alpn challenges are only permitted if the DNS is not a wildcard dns.
-		ch1, err := newHTTP01Challenge(db, ChallengeOptions{
+		if isChallengeEnabled(challenges, "http-01") {
+			ch1, err := newHTTP01Challenge(db, ChallengeOptions{
+				AccountID:  accID,
+				AuthzID:    ba.ID,
+				Identifier: ba.Identifier})
+			if err != nil {
+				return nil, Wrap(err, "error creating http challenge")
+			}
+			ba.Challenges = append(ba.Challenges, ch1.getID())
+		}
+
+		if isChallengeEnabled(challenges, "tls-alpn-01") {
+			ch2, err := newTLSALPN01Challenge(db, ChallengeOptions{
+				AccountID:  accID,
+				AuthzID:    ba.ID,
+				Identifier: ba.Identifier,
+			})
+			if err != nil {
+				return nil, Wrap(err, "error creating alpn challenge")
+			}
+			ba.Challenges = append(ba.Challenges, ch2.getID())
+		}
+	}
+	if isChallengeEnabled(challenges, "dns-01") {
+		ch3, err := newDNS01Challenge(db, ChallengeOptions{
 			AccountID:  accID,
 			AuthzID:    ba.ID,
-			Identifier: ba.Identifier})
+			Identifier: identifier})
 		if err != nil {
-			return nil, Wrap(err, "error creating http challenge")
+			return nil, Wrap(err, "error creating dns challenge")
 		}
-		ba.Challenges = append(ba.Challenges, ch1.getID())
+		ba.Challenges = append(ba.Challenges, ch3.getID())
+	}
+	if len(ba.Challenges) == 0 {
+		return nil, RejectedIdentifierErr(errors.Errorf("no challenge types are enabled for identifier %s",
+			identifier.Value))
+	}
 
-		ch2, err := newTLSALPN01Challenge(db, ChallengeOptions{
+	da := &dnsAuthz{ba}
+	if err := da.save(db, nil); err != nil {
+		return nil, err
+	}
+
+	return da, nil
+}
+
+// ipAuthz represents an authorization of an IP address, RFC 8738.
+type ipAuthz struct {
+	*baseAuthz
+}
+
+// newIPAuthz returns a new ip acme authorization object. IP addresses are
+// only validated with the http-01 and tls-alpn-01 challenges, there is no DNS
+// name to publish a dns-01 record in.
+func newIPAuthz(db nosql.DB, accID string, identifier Identifier, challenges []string) (authz, error) {
+	ba, err := newBaseAuthz(accID, identifier)
+	if err != nil {
+		return nil, err
+	}
+	ba.Wildcard = false
+	ba.Identifier = identifier
+
+	ba.Challenges = []string{}
+	if isChallengeEnabled(challenges, "http-01") {
+		ch, err := newHTTP01Challenge(db, ChallengeOptions{
 			AccountID:  accID,
 			AuthzID:    ba.ID,
-			Identifier: ba.Identifier,
+			Identifier: identifier,
+		})
+		if err != nil {
+			return nil, Wrap(err, "error creating http challenge")
+		}
+		ba.Challenges = append(ba.Challenges, ch.getID())
+	}
+	if isChallengeEnabled(challenges, "tls-alpn-01") {
+		ch, err := newTLSALPN01Challenge(db, ChallengeOptions{
+			AccountID:  accID,
+			AuthzID:    ba.ID,
+			Identifier: identifier,
 		})
 		if err != nil {
 			return nil, Wrap(err, "error creating alpn challenge")
 		}
-		ba.Challenges = append(ba.Challenges, ch2.getID())
+		ba.Challenges = append(ba.Challenges, ch.getID())
+	}
+	if len(ba.Challenges) == 0 {
+		return nil, RejectedIdentifierErr(errors.Errorf("no challenge types are enabled for identifier %s",
+			identifier.Value))
+	}
+
+	ia := &ipAuthz{ba}
+	if err := ia.save(db, nil); err != nil {
+		return nil, err
 	}
-	ch3, err := newDNS01Challenge(db, ChallengeOptions{
+	return ia, nil
+}
+
+// permanentIdentifierAuthz represents an authorization of the permanent
+// identifier of a device, e.g. its serial number.
+type permanentIdentifierAuthz struct {
+	*baseAuthz
+}
+
+// newPermanentIdentifierAuthz returns a new permanent-identifier acme
+// authorization object. It is only validated with the device-attest-01
+// challenge.
+func newPermanentIdentifierAuthz(db nosql.DB, accID string, identifier Identifier, challenges []string) (authz, error) {
+	if !isChallengeEnabled(challenges, "device-attest-01") {
+		return nil, RejectedIdentifierErr(errors.Errorf("no challenge types are enabled for identifier %s",
+			identifier.Value))
+	}
+	ba, err := newBaseAuthz(accID, identifier)
+	if err != nil {
+		return nil, err
+	}
+	ba.Wildcard = false
+	ba.Identifier = identifier
+
+	ch, err := newDeviceAttest01Challenge(db, ChallengeOptions{
 		AccountID:  accID,
 		AuthzID:    ba.ID,
-		Identifier: identifier})
+		Identifier: identifier,
+	})
 	if err != nil {
-		return nil, Wrap(err, "error creating dns challenge")
+		return nil, Wrap(err, "error creating device-attest challenge")
 	}
-	ba.Challenges = append(ba.Challenges, ch3.getID())
+	ba.Challenges = []string{ch.getID()}
 
-	da := &dnsAuthz{ba}
-	if err := da.save(db, nil); err != nil {
+	pa := &permanentIdentifierAuthz{ba}
+	if err := pa.save(db, nil); err != nil {
 		return nil, err
 	}
+	return pa, nil
+}
 
-	return da, nil
+// isChallengeEnabled returns true if the challenge type is in the list of
+// enabled challenges or if the list is empty.
+func isChallengeEnabled(challenges []string, typ string) bool {
+	if len(challenges) == 0 {
+		return true
+	}
+	for _, ch := range challenges {
+		if ch == typ {
+			return true
+		}
+	}
+	return false
 }
 
 // getAuthz retrieves and unmarshals an ACME authz type from the database.
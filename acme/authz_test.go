@@ -2,6 +2,7 @@ package acme
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/db/memory"
 	"github.com/smallstep/nosql"
 	"github.com/smallstep/nosql/database"
 )
@@ -21,7 +23,7 @@ func newAz() (authz, error) {
 	}
 	return newAuthz(mockdb, "1234", Identifier{
 		Type: "dns", Value: "acme.example.com",
-	})
+	}, nil)
 }
 
 func TestGetAuthz(t *testing.T) {
@@ -150,10 +152,11 @@ func TestNewAuthz(t *testing.T) {
 	}
 	accID := "1234"
 	type test struct {
-		iden   Identifier
-		db     nosql.DB
-		err    *Error
-		resChs *([]string)
+		iden       Identifier
+		challenges []string
+		db         nosql.DB
+		err        *Error
+		resChs     *([]string)
 	}
 	tests := map[string]func(t *testing.T) test{
 		"fail/unexpected-type": func(t *testing.T) test {
@@ -205,6 +208,18 @@ func TestNewAuthz(t *testing.T) {
 				err: ServerInternalErr(errors.New("error creating dns challenge: error saving acme challenge: force")),
 			}
 		},
+		"fail/no-challenges-enabled": func(t *testing.T) test {
+			return test{
+				iden:       Identifier{Type: "dns", Value: "*.acme.example.com"},
+				challenges: []string{"http-01", "tls-alpn-01"},
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						return nil, true, nil
+					},
+				},
+				err: RejectedIdentifierErr(errors.New("no challenge types are enabled for identifier *.acme.example.com")),
+			}
+		},
 		"fail/save-authz-error": func(t *testing.T) test {
 			count := 0
 			return test{
@@ -257,6 +272,36 @@ func TestNewAuthz(t *testing.T) {
 				resChs: chs,
 			}
 		},
+		"ok/dns-01-only": func(t *testing.T) test {
+			chs := &([]string{})
+			count := 0
+			return test{
+				iden:       iden,
+				challenges: []string{"dns-01"},
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						switch count {
+						case 0:
+							assert.Equals(t, bucket, challengeTable)
+							ch, err := unmarshalChallenge(newval)
+							assert.FatalError(t, err)
+							assert.Equals(t, ch.getType(), "dns-01")
+						case 1:
+							assert.Equals(t, bucket, authzTable)
+							az, err := unmarshalAuthz(newval)
+							assert.FatalError(t, err)
+							*chs = az.getChallenges()
+							assert.Len(t, 1, *chs)
+						default:
+							t.Fatalf("unexpected call to CmpAndSwap")
+						}
+						count++
+						return nil, true, nil
+					},
+				},
+				resChs: chs,
+			}
+		},
 		"ok/wildcard": func(t *testing.T) test {
 			chs := &([]string{})
 			count := 0
@@ -300,7 +345,7 @@ func TestNewAuthz(t *testing.T) {
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
-			az, err := newAuthz(tc.db, accID, tc.iden)
+			az, err := newAuthz(tc.db, accID, tc.iden, tc.challenges)
 			if err != nil {
 				if assert.NotNil(t, tc.err) {
 					ae, ok := err.(*Error)
@@ -367,7 +412,7 @@ func TestAuthzToACME(t *testing.T) {
 	iden := Identifier{
 		Type: "dns", Value: "acme.example.com",
 	}
-	az, err := newAuthz(mockdb, "1234", iden)
+	az, err := newAuthz(mockdb, "1234", iden, nil)
 	assert.FatalError(t, err)
 	prov := newProv()
 
@@ -584,6 +629,17 @@ func TestAuthzUnmarshal(t *testing.T) {
 				azb: b,
 			}
 		},
+		"ok/permanent-identifier": func(t *testing.T) test {
+			az, err := newPermanentIdentifierAuthz(newMemoryDB(t), "1234",
+				Identifier{Type: "permanent-identifier", Value: "12345678"}, nil)
+			assert.FatalError(t, err)
+			b, err := json.Marshal(az)
+			assert.FatalError(t, err)
+			return test{
+				az:  az,
+				azb: b,
+			}
+		},
 	}
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -605,12 +661,102 @@ func TestAuthzUnmarshal(t *testing.T) {
 					assert.Equals(t, tc.az.getExpiry(), az.getExpiry())
 					assert.Equals(t, tc.az.getWildcard(), az.getWildcard())
 					assert.Equals(t, tc.az.getChallenges(), az.getChallenges())
+					assert.Equals(t, fmt.Sprintf("%T", tc.az), fmt.Sprintf("%T", az))
 				}
 			}
 		})
 	}
 }
 
+// newMemoryDB returns an in-memory database with the acme tables.
+func newMemoryDB(t *testing.T) nosql.DB {
+	mdb := memory.New()
+	for _, b := range acmeTables {
+		assert.FatalError(t, mdb.CreateTable(b))
+	}
+	return mdb
+}
+
+func TestNewPermanentIdentifierAuthz(t *testing.T) {
+	iden := Identifier{Type: "permanent-identifier", Value: "12345678"}
+	t.Run("fail/no-challenges-enabled", func(t *testing.T) {
+		_, err := newAuthz(newMemoryDB(t), "1234", iden, []string{"http-01", "dns-01"})
+		if assert.NotNil(t, err) {
+			ae, ok := err.(*Error)
+			assert.True(t, ok)
+			assert.Equals(t, ae.Type, rejectedIdentifierErr)
+			assert.HasPrefix(t, ae.Error(), "no challenge types are enabled for identifier 12345678")
+		}
+	})
+	for _, challenges := range [][]string{nil, {"device-attest-01"}} {
+		mdb := newMemoryDB(t)
+		az, err := newAuthz(mdb, "1234", iden, challenges)
+		assert.FatalError(t, err)
+		_, ok := az.(*permanentIdentifierAuthz)
+		assert.True(t, ok)
+		assert.Equals(t, az.getType(), "permanent-identifier")
+		assert.Equals(t, az.getIdentifier(), iden)
+		assert.False(t, az.getWildcard())
+		assert.Equals(t, az.getStatus(), StatusPending)
+		if assert.Len(t, 1, az.getChallenges()) {
+			ch, err := getChallenge(mdb, az.getChallenges()[0])
+			assert.FatalError(t, err)
+			assert.Equals(t, ch.getType(), "device-attest-01")
+			assert.Equals(t, ch.getValue(), "12345678")
+			assert.Equals(t, ch.getAuthzID(), az.getID())
+		}
+		got, err := getAuthz(mdb, az.getID())
+		assert.FatalError(t, err)
+		_, ok = got.(*permanentIdentifierAuthz)
+		assert.True(t, ok)
+	}
+}
+
+func TestNewIPAuthz(t *testing.T) {
+	iden := Identifier{Type: "ip", Value: "2001:db8::1"}
+	t.Run("fail/no-challenges-enabled", func(t *testing.T) {
+		_, err := newAuthz(newMemoryDB(t), "1234", iden, []string{"dns-01", "device-attest-01"})
+		if assert.NotNil(t, err) {
+			ae, ok := err.(*Error)
+			assert.True(t, ok)
+			assert.Equals(t, ae.Type, rejectedIdentifierErr)
+			assert.HasPrefix(t, ae.Error(), "no challenge types are enabled for identifier 2001:db8::1")
+		}
+	})
+	tests := map[string]struct {
+		challenges []string
+		want       []string
+	}{
+		"all":         {nil, []string{"http-01", "tls-alpn-01"}},
+		"http-01":     {[]string{"http-01", "dns-01"}, []string{"http-01"}},
+		"tls-alpn-01": {[]string{"tls-alpn-01"}, []string{"tls-alpn-01"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdb := newMemoryDB(t)
+			az, err := newAuthz(mdb, "1234", iden, tc.challenges)
+			assert.FatalError(t, err)
+			_, ok := az.(*ipAuthz)
+			assert.True(t, ok)
+			assert.Equals(t, az.getType(), "ip")
+			assert.Equals(t, az.getIdentifier(), iden)
+			assert.False(t, az.getWildcard())
+			var types []string
+			for _, id := range az.getChallenges() {
+				ch, err := getChallenge(mdb, id)
+				assert.FatalError(t, err)
+				assert.Equals(t, ch.getValue(), "2001:db8::1")
+				types = append(types, ch.getType())
+			}
+			assert.Equals(t, tc.want, types)
+			got, err := getAuthz(mdb, az.getID())
+			assert.FatalError(t, err)
+			_, ok = got.(*ipAuthz)
+			assert.True(t, ok)
+		})
+	}
+}
+
 func TestAuthzUpdateStatus(t *testing.T) {
 	type test struct {
 		az, res authz
@@ -677,7 +823,7 @@ func TestAuthzUpdateStatus(t *testing.T) {
 			_az.baseAuthz.Expires = time.Now().UTC().Add(-time.Minute)
 
 			clone := az.clone()
-			clone.Error = MalformedErr(errors.New("authz has expired"))
+			clone.Error = MalformedErr(errors.New("authz has expired")).ToACME()
 			clone.Status = StatusInvalid
 			return test{
 				az:  az,
@@ -730,11 +876,11 @@ func TestAuthzUpdateStatus(t *testing.T) {
 			iden := Identifier{
 				Type: "dns", Value: "acme.example.com",
 			}
-			az, err := newAuthz(mockdb, "1234", iden)
+			az, err := newAuthz(mockdb, "1234", iden, nil)
 			assert.FatalError(t, err)
 			_az, ok := az.(*dnsAuthz)
 			assert.Fatal(t, ok)
-			_az.baseAuthz.Error = MalformedErr(nil)
+			_az.baseAuthz.Error = MalformedErr(nil).ToACME()
 
 			_ch, ok := ch3.(*dns01Challenge)
 			assert.Fatal(t, ok)
@@ -768,6 +914,64 @@ func TestAuthzUpdateStatus(t *testing.T) {
 				},
 			}
 		},
+		"ok/invalid": func(t *testing.T) test {
+			var ch1Bytes, ch2Bytes, ch3Bytes = &([]byte{}), &([]byte{}), &([]byte{})
+
+			count := 0
+			mockdb := &db.MockNoSQLDB{
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					switch count {
+					case 0:
+						*ch1Bytes = newval
+					case 1:
+						*ch2Bytes = newval
+					case 2:
+						*ch3Bytes = newval
+					}
+					count++
+					return nil, true, nil
+				},
+			}
+			iden := Identifier{
+				Type: "dns", Value: "acme.example.com",
+			}
+			az, err := newAuthz(mockdb, "1234", iden, nil)
+			assert.FatalError(t, err)
+
+			ch1, err := unmarshalChallenge(*ch1Bytes)
+			assert.FatalError(t, err)
+			bc := ch1.clone()
+			bc.Status = StatusInvalid
+			bc.Error = ConnectionErr(errors.New("force")).ToACME()
+			chb, err := json.Marshal(bc)
+			assert.FatalError(t, err)
+
+			clone := az.clone()
+			clone.Status = StatusInvalid
+			clone.Error = UnauthorizedErr(errors.Errorf("%s challenge %s is invalid", ch1.getType(), ch1.getID())).ToACME()
+
+			count = 0
+			return test{
+				az:  az,
+				res: clone.parent(),
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						count++
+						switch count {
+						case 1:
+							return chb, nil
+						case 2:
+							return *ch2Bytes, nil
+						default:
+							return *ch3Bytes, nil
+						}
+					},
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						return nil, true, nil
+					},
+				},
+			}
+		},
 		"ok/still-pending": func(t *testing.T) test {
 			var ch1Bytes, ch2Bytes = &([]byte{}), &([]byte{})
 
@@ -786,7 +990,7 @@ func TestAuthzUpdateStatus(t *testing.T) {
 			iden := Identifier{
 				Type: "dns", Value: "acme.example.com",
 			}
-			az, err := newAuthz(mockdb, "1234", iden)
+			az, err := newAuthz(mockdb, "1234", iden, nil)
 			assert.FatalError(t, err)
 
 			count = 0
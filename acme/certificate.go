@@ -2,8 +2,11 @@ package acme
 
 import (
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"math/big"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -65,9 +68,14 @@ func newCert(db nosql.DB, ops CertOptions) (*certificate, error) {
 	case !swapped:
 		return nil, ServerInternalErr(errors.New("error storing certificate; " +
 			"value has changed since last read"))
-	default:
-		return cert, nil
 	}
+
+	// Index the certificate by serial number, the revocation requests only
+	// include the certificate.
+	if err := db.Set(certIDBySerialTable, []byte(ops.Leaf.SerialNumber.String()), []byte(id)); err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error storing certificate index"))
+	}
+	return cert, nil
 }
 
 func (c *certificate) toACME(db nosql.DB, dir *directory) ([]byte, error) {
@@ -87,3 +95,98 @@ func getCert(db nosql.DB, id string) (*certificate, error) {
 	}
 	return &cert, nil
 }
+
+// getCertBySerial retrieves the certificate with the given serial number. It
+// returns a nosql not found error if the certificate was not issued by ACME.
+func getCertBySerial(db nosql.DB, serial string) (*certificate, error) {
+	id, err := db.Get(certIDBySerialTable, []byte(serial))
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return nil, err
+		}
+		return nil, ServerInternalErr(errors.Wrapf(err, "error loading certificate index for serial %s", serial))
+	}
+	return getCert(db, string(id))
+}
+
+// parseLeaf returns the leaf of a stored certificate.
+func (c *certificate) parseLeaf() (*x509.Certificate, error) {
+	block, _ := pem.Decode(c.Leaf)
+	if block == nil {
+		return nil, ServerInternalErr(errors.Errorf("error decoding certificate %s", c.ID))
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, ServerInternalErr(errors.Wrapf(err, "error parsing certificate %s", c.ID))
+	}
+	return leaf, nil
+}
+
+// RenewalInfo is the renewal information of a certificate, the window in which
+// the client should renew it.
+type RenewalInfo struct {
+	SuggestedWindow RenewalWindow `json:"suggestedWindow"`
+}
+
+// RenewalWindow is the time window suggested to renew a certificate.
+type RenewalWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// ToLog enables response logging for the RenewalInfo type.
+func (ri *RenewalInfo) ToLog() (interface{}, error) {
+	b, err := json.Marshal(ri)
+	if err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error marshaling renewalInfo for logging"))
+	}
+	return string(b), nil
+}
+
+// newRenewalInfo returns the renewal information of a certificate. The window
+// goes from two thirds to five sixths of the validity. The window of a revoked
+// certificate has already started, so it is renewed immediately.
+func newRenewalInfo(leaf *x509.Certificate, revoked bool, now time.Time) *RenewalInfo {
+	d := leaf.NotAfter.Sub(leaf.NotBefore)
+	window := RenewalWindow{
+		Start: leaf.NotBefore.Add(d * 2 / 3).UTC(),
+		End:   leaf.NotBefore.Add(d * 5 / 6).UTC(),
+	}
+	if revoked {
+		window = RenewalWindow{Start: now.Add(-time.Hour).UTC(), End: now.UTC()}
+	}
+	return &RenewalInfo{SuggestedWindow: window}
+}
+
+// RenewalInfoID returns the identifier of a certificate in the renewalInfo
+// URLs: the base64url encoded authority key identifier and serial number of
+// the certificate, separated by a dot.
+func RenewalInfoID(crt *x509.Certificate) string {
+	serial := crt.SerialNumber.Bytes()
+	// The serial is encoded as the value of a DER integer.
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(crt.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial)
+}
+
+// parseRenewalInfoID returns the authority key identifier and the serial
+// number in a renewalInfo identifier.
+func parseRenewalInfoID(id string) ([]byte, *big.Int, error) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 2 {
+		return nil, nil, MalformedErr(errors.Errorf("invalid renewalInfo identifier %s", id))
+	}
+	aki, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(aki) == 0 {
+		return nil, nil, MalformedErr(errors.Errorf("invalid renewalInfo identifier %s: "+
+			"invalid authority key identifier", id))
+	}
+	serial, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(serial) == 0 || serial[0]&0x80 != 0 {
+		return nil, nil, MalformedErr(errors.Errorf("invalid renewalInfo identifier %s: "+
+			"invalid serial number", id))
+	}
+	return aki, new(big.Int).SetBytes(serial), nil
+}
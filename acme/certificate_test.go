@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"math/big"
 	"testing"
 	"time"
 
@@ -87,6 +88,24 @@ func TestNewCert(t *testing.T) {
 				err: ServerInternalErr(errors.Errorf("error storing certificate; value has changed since last read")),
 			}
 		},
+		"fail/index-error": func(t *testing.T) test {
+			ops, err := defaultCertOps()
+			assert.FatalError(t, err)
+			return test{
+				ops: *ops,
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						return nil, true, nil
+					},
+					MSet: func(bucket, key, value []byte) error {
+						assert.Equals(t, bucket, certIDBySerialTable)
+						assert.Equals(t, key, []byte(ops.Leaf.SerialNumber.String()))
+						return errors.New("force")
+					},
+				},
+				err: ServerInternalErr(errors.Errorf("error storing certificate index: force")),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			ops, err := defaultCertOps()
 			assert.FatalError(t, err)
@@ -251,3 +270,45 @@ func TestCertificateToACME(t *testing.T) {
 	assert.FatalError(t, err)
 	assert.Equals(t, append(cert.Leaf, cert.Intermediates...), acmeCert)
 }
+
+func TestRenewalInfoID(t *testing.T) {
+	tests := map[string]struct {
+		crt *x509.Certificate
+		id  string
+	}{
+		"ok":        {&x509.Certificate{SerialNumber: big.NewInt(0x0102), AuthorityKeyId: []byte{1, 2, 3}}, "AQID.AQI"},
+		"ok/zero":   {&x509.Certificate{SerialNumber: big.NewInt(0), AuthorityKeyId: []byte{1, 2, 3}}, "AQID.AA"},
+		"ok/padded": {&x509.Certificate{SerialNumber: big.NewInt(0x87), AuthorityKeyId: []byte{1, 2, 3}}, "AQID.AIc"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equals(t, tc.id, RenewalInfoID(tc.crt))
+			aki, serial, err := parseRenewalInfoID(tc.id)
+			assert.FatalError(t, err)
+			assert.Equals(t, tc.crt.AuthorityKeyId, aki)
+			assert.Equals(t, 0, tc.crt.SerialNumber.Cmp(serial))
+		})
+	}
+
+	for _, id := range []string{"", "AQID", "AQID.AQI.AQI", ".AQI", "AQID.", "AQID.!", "AQID.hw"} {
+		t.Run("fail/"+id, func(t *testing.T) {
+			_, _, err := parseRenewalInfoID(id)
+			if assert.Error(t, err) {
+				assert.Equals(t, "malformed", err.(*Error).Type.String())
+			}
+		})
+	}
+}
+
+func TestNewRenewalInfo(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	leaf := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}
+	assert.Equals(t, &RenewalInfo{SuggestedWindow: RenewalWindow{
+		Start: now.Add(60 * 24 * time.Hour).UTC(),
+		End:   now.Add(75 * 24 * time.Hour).UTC(),
+	}}, newRenewalInfo(leaf, false, now))
+	assert.Equals(t, &RenewalInfo{SuggestedWindow: RenewalWindow{
+		Start: now.Add(-time.Hour).UTC(),
+		End:   now.UTC(),
+	}}, newRenewalInfo(leaf, true, now))
+}
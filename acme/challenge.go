@@ -1,21 +1,26 @@
 package acme
 
 import (
+	"context"
 	"crypto"
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/cli/jose"
@@ -56,12 +61,204 @@ func (c *Challenge) GetAuthzID() string {
 
 type httpGetter func(string) (*http.Response, error)
 type lookupTxt func(string) ([]string, error)
+type lookupCNAME func(string) (string, error)
 type tlsDialer func(network, addr string, config *tls.Config) (*tls.Conn, error)
+type attestationVerifier func(format string, statement, challenge []byte) (*provisioner.AttestationData, error)
 
 type validateOptions struct {
 	httpGet   httpGetter
 	lookupTxt lookupTxt
 	tlsDial   tlsDialer
+	// httpPort is the port used in the http-01 validations, it defaults to
+	// 80.
+	httpPort string
+	// tlsPort is the port used in the tls-alpn-01 validations, it defaults
+	// to 443.
+	tlsPort string
+	// lookupCNAME is used to follow the delegation of the dns-01 challenge
+	// label, it is not followed if nil.
+	lookupCNAME lookupCNAME
+	// dnsPropagation is the time a dns-01 validation is retried waiting for
+	// the TXT record.
+	dnsPropagation time.Duration
+	// payload is the body of the request that triggered the validation, it
+	// contains the attestation object of the device-attest-01 challenge.
+	payload []byte
+	// verifyAttestation verifies the attestation statements of the
+	// device-attest-01 challenge, it is not supported if nil.
+	verifyAttestation attestationVerifier
+	// ctx cancels the retries of the background validations, it is not used
+	// if nil.
+	ctx context.Context
+}
+
+// wait waits the given time before a retry, it returns an error if the
+// validation is cancelled before.
+func (vo *validateOptions) wait(d time.Duration) error {
+	if vo.ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-vo.ctx.Done():
+		return vo.ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+const (
+	// http01MaxBodySize is the maximum size of the response of an http-01
+	// validation, a key authorization is less than 100 bytes.
+	http01MaxBodySize = 1 << 12
+	// http01MaxRedirects is the maximum number of redirects followed in an
+	// http-01 validation.
+	http01MaxRedirects = 10
+	// tlsALPN01Timeout is the timeout of the connection and the handshake
+	// of a tls-alpn-01 validation.
+	tlsALPN01Timeout = 30 * time.Second
+)
+
+var (
+	// http01Retries is the number of times an http-01 validation is retried
+	// on transient network errors, waiting http01RetryInterval between them.
+	http01Retries       = 2
+	http01RetryInterval = 2 * time.Second
+	// dns01RetryInterval is the time between the lookups of a dns-01
+	// validation while the TXT record propagates.
+	dns01RetryInterval = 5 * time.Second
+)
+
+const (
+	// dns01LookupTimeout is the timeout of each lookup in a dns-01
+	// validation when a resolver is configured.
+	dns01LookupTimeout = 10 * time.Second
+	// dns01MaxCNAMEs is the maximum number of CNAME records followed in a
+	// dns-01 validation.
+	dns01MaxCNAMEs = 8
+)
+
+// newDNS01Lookups returns the functions used in the dns-01 validations to
+// query the DNS server in the given address.
+func newDNS01Lookups(addr string) (lookupTxt, lookupCNAME) {
+	dialer := &net.Dialer{
+		Timeout: dns01LookupTimeout,
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	txt := func(name string) ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dns01LookupTimeout)
+		defer cancel()
+		return resolver.LookupTXT(ctx, name)
+	}
+	cname := func(name string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dns01LookupTimeout)
+		defer cancel()
+		return resolver.LookupCNAME(ctx, name)
+	}
+	return txt, cname
+}
+
+// ValidationDialer opens the connections of the http-01 and tls-alpn-01
+// validations.
+type ValidationDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newValidationDialer returns the default ValidationDialer, the connections
+// are made from the given local IP address if it is not nil.
+func newValidationDialer(source net.IP) ValidationDialer {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+	}
+	if source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	return dialer.DialContext
+}
+
+// newHTTP01Getter returns the httpGetter used in the http-01 validations. The
+// client uses the given dialer and its own timeouts, and it follows up to
+// http01MaxRedirects redirects to http or https urls on the ports 80, 443 or
+// the given validation port.
+func newHTTP01Getter(port string, dial ValidationDialer) httpGetter {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:           dial,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			DisableKeepAlives:     true,
+			// The redirects to https are not required to have a trusted
+			// certificate, the key authorization is what it is validated.
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= http01MaxRedirects {
+				return errors.Errorf("stopped after %d redirects", http01MaxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.Errorf("redirect to %s is not allowed: invalid scheme", req.URL)
+			}
+			switch req.URL.Port() {
+			case "", "80", "443", port:
+				return nil
+			default:
+				return errors.Errorf("redirect to %s is not allowed: invalid port", req.URL)
+			}
+		},
+	}
+	return client.Get
+}
+
+// newTLSALPN01Dialer returns the tlsDialer used in the tls-alpn-01
+// validations, the connection is opened with the given dialer and the
+// handshake must be completed within the timeout.
+func newTLSALPN01Dialer(dial ValidationDialer, timeout time.Duration) tlsDialer {
+	return func(network, addr string, config *tls.Config) (*tls.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		rawConn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(rawConn, config)
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		if err := conn.Handshake(); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// isTransientError returns true if the error of an http request is a network
+// error that might not happen again, like a timeout or a reset connection.
+func isTransientError(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	switch e := err.(type) {
+	case *net.DNSError:
+		return e.Temporary()
+	case net.Error:
+		return true
+	default:
+		return err == io.EOF || err == io.ErrUnexpectedEOF
+	}
 }
 
 // challenge is the interface ACME challenege types must implement.
@@ -79,6 +276,7 @@ type challenge interface {
 	getAccountID() string
 	getValidated() time.Time
 	getCreated() time.Time
+	getAttestedKey() []byte
 	toACME(nosql.DB, *directory, provisioner.Interface) (*Challenge, error)
 }
 
@@ -101,6 +299,9 @@ type baseChallenge struct {
 	Validated time.Time `json:"validated"`
 	Created   time.Time `json:"created"`
 	Error     *AError   `json:"error"`
+	// AttestedKey is the PKIX public key attested in a device-attest-01
+	// challenge.
+	AttestedKey []byte `json:"attestedKey,omitempty"`
 }
 
 func newBaseChallenge(accountID, authzID string) (*baseChallenge, error) {
@@ -173,6 +374,11 @@ func (bc *baseChallenge) getError() *AError {
 	return bc.Error
 }
 
+// getAttestedKey returns the key attested in a device-attest-01 challenge.
+func (bc *baseChallenge) getAttestedKey() []byte {
+	return bc.AttestedKey
+}
+
 // toACME converts the internal Challenge type into the public acmeChallenge
 // type for presentation in the ACME protocol.
 func (bc *baseChallenge) toACME(db nosql.DB, dir *directory, p provisioner.Interface) (*Challenge, error) {
@@ -241,6 +447,18 @@ func (bc *baseChallenge) storeError(db nosql.DB, err *Error) error {
 	return clone.save(db, bc)
 }
 
+// storeInvalid marks the challenge as invalid and stores the error that caused
+// it. It returns the updated challenge.
+func (bc *baseChallenge) storeInvalid(db nosql.DB, err *Error) (*baseChallenge, error) {
+	clone := bc.clone()
+	clone.Status = StatusInvalid
+	clone.Error = err.ToACME()
+	if err := clone.save(db, bc); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
 // unmarshalChallenge unmarshals a challenge type into the correct sub-type.
 func unmarshalChallenge(data []byte) (challenge, error) {
 	var getType struct {
@@ -272,6 +490,13 @@ func unmarshalChallenge(data []byte) (challenge, error) {
 				"challenge type into tlsALPN01Challenge"))
 		}
 		return &tlsALPN01Challenge{&bc}, nil
+	case "device-attest-01":
+		var bc baseChallenge
+		if err := json.Unmarshal(data, &bc); err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling "+
+				"challenge type into deviceAttest01Challenge"))
+		}
+		return &deviceAttest01Challenge{&bc}, nil
 	default:
 		return nil, ServerInternalErr(errors.Errorf("unexpected challenge type %s", getType.Type))
 	}
@@ -300,36 +525,56 @@ func newHTTP01Challenge(db nosql.DB, ops ChallengeOptions) (challenge, error) {
 
 // Validate attempts to validate the challenge. If the challenge has been
 // satisfactorily validated, the 'status' and 'validated' attributes are
-// updated.
+// updated, if not, the challenge is marked as invalid with the error found.
+// Transient network errors are retried before giving up.
 func (hc *http01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validateOptions) (challenge, error) {
 	// If already valid or invalid then return without performing validation.
 	if hc.getStatus() == StatusValid || hc.getStatus() == StatusInvalid {
 		return hc, nil
 	}
-	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", hc.Value, hc.Token)
-
-	resp, err := vo.httpGet(url)
-	if err != nil {
-		if err = hc.storeError(db, ConnectionErr(errors.Wrapf(err,
-			"error doing http GET for url %s", url))); err != nil {
+	invalid := func(e *Error) (challenge, error) {
+		upd, err := hc.storeInvalid(db, e)
+		if err != nil {
 			return nil, err
 		}
-		return hc, nil
+		return &http01Challenge{upd}, nil
 	}
-	if resp.StatusCode >= 400 {
-		if err = hc.storeError(db,
-			ConnectionErr(errors.Errorf("error doing http GET for url %s with status code %d",
-				url, resp.StatusCode))); err != nil {
+
+	// IPv6 addresses are enclosed in brackets in the URL.
+	host := hc.Value
+	if vo.httpPort != "" && vo.httpPort != "80" {
+		host = net.JoinHostPort(hc.Value, vo.httpPort)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", host, hc.Token)
+
+	resp, err := vo.httpGet(url)
+	for i := 0; i < http01Retries && err != nil && isTransientError(err); i++ {
+		if err := vo.wait(http01RetryInterval); err != nil {
 			return nil, err
 		}
-		return hc, nil
+		resp, err = vo.httpGet(url)
+	}
+	if err != nil {
+		return invalid(ConnectionErr(errors.Wrapf(err,
+			"error doing http GET for url %s", url)))
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return invalid(ConnectionErr(errors.Errorf("error doing http GET for url %s with status code %d",
+			url, resp.StatusCode)))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, http01MaxBodySize+1))
 	if err != nil {
-		return nil, ServerInternalErr(errors.Wrapf(err, "error reading "+
-			"response body for url %s", url))
+		return invalid(ConnectionErr(errors.Wrapf(err, "error reading "+
+			"response body for url %s", url)))
+	}
+	if len(body) > http01MaxBodySize {
+		return invalid(RejectedIdentifierErr(errors.Errorf("response body for url %s "+
+			"is larger than %d bytes", url, http01MaxBodySize)))
 	}
 	keyAuth := strings.Trim(string(body), "\r\n")
 
@@ -338,12 +583,8 @@ func (hc *http01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo valida
 		return nil, err
 	}
 	if keyAuth != expected {
-		if err = hc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("keyAuthorization does not match; "+
-				"expected %s, but got %s", expected, keyAuth))); err != nil {
-			return nil, err
-		}
-		return hc, nil
+		return invalid(RejectedIdentifierErr(errors.Errorf("keyAuthorization does not match; "+
+			"expected %s, but got %s", expected, keyAuth)))
 	}
 
 	// Update and store the challenge.
@@ -383,22 +624,37 @@ func (tc *tlsALPN01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo val
 	if tc.getStatus() == StatusValid || tc.getStatus() == StatusInvalid {
 		return tc, nil
 	}
+	invalid := func(e *Error) (challenge, error) {
+		upd, err := tc.storeInvalid(db, e)
+		if err != nil {
+			return nil, err
+		}
+		return &tlsALPN01Challenge{upd}, nil
+	}
+
+	// RFC8738: the SNI of an IP address is its reverse DNS name, and the
+	// certificate must contain the address as its only iPAddress SAN.
+	ip := net.ParseIP(tc.Value)
+	serverName := tc.Value
+	if ip != nil {
+		serverName = reverseDNSName(ip)
+	}
 
 	config := &tls.Config{
 		NextProtos:         []string{"acme-tls/1"},
-		ServerName:         tc.Value,
+		ServerName:         serverName,
 		InsecureSkipVerify: true, // we expect a self-signed challenge certificate
 	}
 
-	hostPort := net.JoinHostPort(tc.Value, "443")
+	port := vo.tlsPort
+	if port == "" {
+		port = "443"
+	}
+	hostPort := net.JoinHostPort(tc.Value, port)
 
 	conn, err := vo.tlsDial("tcp", hostPort, config)
 	if err != nil {
-		if err = tc.storeError(db,
-			ConnectionErr(errors.Wrapf(err, "error doing TLS dial for %s", hostPort))); err != nil {
-			return nil, err
-		}
-		return tc, nil
+		return invalid(ConnectionErr(errors.Wrapf(err, "error doing TLS dial for %s", hostPort)))
 	}
 	defer conn.Close()
 
@@ -406,32 +662,29 @@ func (tc *tlsALPN01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo val
 	certs := cs.PeerCertificates
 
 	if len(certs) == 0 {
-		if err = tc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("%s challenge for %s resulted in no certificates",
-				tc.Type, tc.Value))); err != nil {
-			return nil, err
-		}
-		return tc, nil
+		return invalid(RejectedIdentifierErr(errors.Errorf("%s challenge for %s resulted in no certificates",
+			tc.Type, tc.Value)))
 	}
 
 	if !cs.NegotiatedProtocolIsMutual || cs.NegotiatedProtocol != "acme-tls/1" {
-		if err = tc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("cannot negotiate ALPN acme-tls/1 protocol for "+
-				"tls-alpn-01 challenge"))); err != nil {
-			return nil, err
-		}
-		return tc, nil
+		return invalid(RejectedIdentifierErr(errors.Errorf("cannot negotiate ALPN acme-tls/1 protocol for " +
+			"tls-alpn-01 challenge")))
 	}
 
 	leafCert := certs[0]
 
-	if len(leafCert.DNSNames) != 1 || !strings.EqualFold(leafCert.DNSNames[0], tc.Value) {
-		if err = tc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
-				"leaf certificate must contain a single DNS name, %v", tc.Value))); err != nil {
-			return nil, err
+	// The certificate must have only one SAN, the dNSName or the iPAddress of
+	// the identifier.
+	if ip != nil {
+		if len(leafCert.IPAddresses) != 1 || !leafCert.IPAddresses[0].Equal(ip) ||
+			len(leafCert.DNSNames) > 0 || len(leafCert.EmailAddresses) > 0 || len(leafCert.URIs) > 0 {
+			return invalid(RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
+				"leaf certificate must contain a single IP address, %v", tc.Value)))
 		}
-		return tc, nil
+	} else if len(leafCert.DNSNames) != 1 || !strings.EqualFold(leafCert.DNSNames[0], tc.Value) ||
+		len(leafCert.IPAddresses) > 0 || len(leafCert.EmailAddresses) > 0 || len(leafCert.URIs) > 0 {
+		return invalid(RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
+			"leaf certificate must contain a single DNS name, %v", tc.Value)))
 	}
 
 	idPeAcmeIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
@@ -447,34 +700,22 @@ func (tc *tlsALPN01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo val
 	for _, ext := range leafCert.Extensions {
 		if idPeAcmeIdentifier.Equal(ext.Id) {
 			if !ext.Critical {
-				if err = tc.storeError(db,
-					RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
-						"acmeValidationV1 extension not critical"))); err != nil {
-					return nil, err
-				}
-				return tc, nil
+				return invalid(RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: " +
+					"acmeValidationV1 extension not critical")))
 			}
 
 			var extValue []byte
 			rest, err := asn1.Unmarshal(ext.Value, &extValue)
 
 			if err != nil || len(rest) > 0 || len(hashedKeyAuth) != len(extValue) {
-				if err = tc.storeError(db,
-					RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
-						"malformed acmeValidationV1 extension value"))); err != nil {
-					return nil, err
-				}
-				return tc, nil
+				return invalid(RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: " +
+					"malformed acmeValidationV1 extension value")))
 			}
 
 			if subtle.ConstantTimeCompare(hashedKeyAuth[:], extValue) != 1 {
-				if err = tc.storeError(db,
-					RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
-						"expected acmeValidationV1 extension value %s for this challenge but got %s",
-						hex.EncodeToString(hashedKeyAuth[:]), hex.EncodeToString(extValue)))); err != nil {
-					return nil, err
-				}
-				return tc, nil
+				return invalid(RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
+					"expected acmeValidationV1 extension value %s for this challenge but got %s",
+					hex.EncodeToString(hashedKeyAuth[:]), hex.EncodeToString(extValue))))
 			}
 
 			upd := &tlsALPN01Challenge{tc.baseChallenge.clone()}
@@ -494,20 +735,30 @@ func (tc *tlsALPN01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo val
 	}
 
 	if foundIDPeAcmeIdentifierV1Obsolete {
-		if err = tc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
-				"obsolete id-pe-acmeIdentifier in acmeValidationV1 extension"))); err != nil {
-			return nil, err
-		}
-		return tc, nil
+		return invalid(RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: " +
+			"obsolete id-pe-acmeIdentifier in acmeValidationV1 extension")))
 	}
 
-	if err = tc.storeError(db,
-		RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: "+
-			"missing acmeValidationV1 extension"))); err != nil {
-		return nil, err
+	return invalid(RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: " +
+		"missing acmeValidationV1 extension")))
+}
+
+// reverseDNSName returns the in-addr.arpa or ip6.arpa name of an IP address,
+// e.g. 1.0.0.10.in-addr.arpa for 10.0.0.1.
+func reverseDNSName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	var sb strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		sb.WriteByte(hexDigits[ip[i]&0xf])
+		sb.WriteByte('.')
+		sb.WriteByte(hexDigits[ip[i]>>4])
+		sb.WriteByte('.')
 	}
-	return tc, nil
+	sb.WriteString("ip6.arpa")
+	return sb.String()
 }
 
 // dns01Challenge represents an dns-01 acme challenge.
@@ -544,7 +795,9 @@ func KeyAuthorization(token string, jwk *jose.JSONWebKey) (string, error) {
 
 // validate attempts to validate the challenge. If the challenge has been
 // satisfactorily validated, the 'status' and 'validated' attributes are
-// updated.
+// updated. The lookups are retried for the dnsPropagation time of the
+// options, if the TXT record is not found after that the challenge is marked
+// as invalid.
 func (dc *dns01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validateOptions) (challenge, error) {
 	// If already valid or invalid then return without performing validation.
 	if dc.getStatus() == StatusValid || dc.getStatus() == StatusInvalid {
@@ -557,44 +810,179 @@ func (dc *dns01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validat
 	// Instead perform txt lookup for _acme-challenge.example.com
 	domain := strings.TrimPrefix(dc.Value, "*.")
 
-	txtRecords, err := vo.lookupTxt("_acme-challenge." + domain)
-	if err != nil {
-		if err = dc.storeError(db,
-			DNSErr(errors.Wrapf(err, "error looking up TXT "+
-				"records for domain %s", domain))); err != nil {
+	deadline := time.Now().Add(vo.dnsPropagation)
+	for {
+		var failure *Error
+		txtRecords, err := lookupDNS01TXT(vo, "_acme-challenge."+domain)
+		if err != nil {
+			failure = DNSErr(errors.Wrapf(err, "error looking up TXT "+
+				"records for domain %s", domain))
+		} else {
+			expectedKeyAuth, err := KeyAuthorization(dc.Token, jwk)
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.Sum256([]byte(expectedKeyAuth))
+			expected := base64.RawURLEncoding.EncodeToString(h[:])
+			for _, r := range txtRecords {
+				if r == expected {
+					return dc.storeValid(db)
+				}
+			}
+			failure = RejectedIdentifierErr(errors.Errorf("keyAuthorization "+
+				"does not match; expected %s, but got %s", expectedKeyAuth, txtRecords))
+		}
+
+		if time.Now().Add(dns01RetryInterval).After(deadline) {
+			upd, err := dc.storeInvalid(db, failure)
+			if err != nil {
+				return nil, err
+			}
+			return &dns01Challenge{upd}, nil
+		}
+		if err := vo.wait(dns01RetryInterval); err != nil {
 			return nil, err
 		}
+	}
+}
+
+// storeValid marks the challenge as valid and stores it.
+func (dc *dns01Challenge) storeValid(db nosql.DB) (challenge, error) {
+	upd := &dns01Challenge{dc.baseChallenge.clone()}
+	upd.Status = StatusValid
+	upd.Error = nil
+	upd.Validated = time.Now().UTC()
+
+	if err := upd.save(db, dc); err != nil {
+		return nil, err
+	}
+	return upd, nil
+}
+
+// lookupDNS01TXT returns the TXT records of the given name. If the name has no
+// TXT records, it follows up to dns01MaxCNAMEs CNAME records, a common way to
+// delegate the challenge label to another zone.
+func lookupDNS01TXT(vo validateOptions, name string) ([]string, error) {
+	for i := 0; ; i++ {
+		txtRecords, err := vo.lookupTxt(name)
+		if (err == nil && len(txtRecords) > 0) || vo.lookupCNAME == nil || i == dns01MaxCNAMEs {
+			return txtRecords, err
+		}
+		target, cerr := vo.lookupCNAME(name)
+		if cerr != nil || target == "" || strings.EqualFold(strings.TrimSuffix(target, "."), strings.TrimSuffix(name, ".")) {
+			return txtRecords, err
+		}
+		name = target
+	}
+}
+
+// deviceAttest01Challenge represents a device-attest-01 acme challenge. The
+// client responds with an attestation of the device that proves its permanent
+// identifier and the key that will be in the certificate request.
+type deviceAttest01Challenge struct {
+	*baseChallenge
+}
+
+// newDeviceAttest01Challenge returns a new acme device-attest-01 challenge.
+func newDeviceAttest01Challenge(db nosql.DB, ops ChallengeOptions) (challenge, error) {
+	bc, err := newBaseChallenge(ops.AccountID, ops.AuthzID)
+	if err != nil {
+		return nil, err
+	}
+	bc.Type = "device-attest-01"
+	bc.Value = ops.Identifier.Value
+
+	dc := &deviceAttest01Challenge{bc}
+	if err := dc.save(db, nil); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// deviceAttest01Payload is the body of the request that responds to a
+// device-attest-01 challenge.
+type deviceAttest01Payload struct {
+	AttObj string `json:"attObj"`
+}
+
+// attestationObject is the CBOR attestation object of the device-attest-01
+// challenge.
+type attestationObject struct {
+	Format       string                 `cbor:"fmt"`
+	AttStatement map[string]interface{} `cbor:"attStmt"`
+}
+
+// validate verifies the attestation object in the payload. The statement must
+// be bound to the SHA-256 digest of the key authorization, and the permanent
+// identifier of the challenge must be one of the attested identifiers. If the
+// attestation is valid, the attested key is stored with the challenge and it
+// must be the key in the certificate request.
+func (dc *deviceAttest01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validateOptions) (challenge, error) {
+	// If already valid or invalid then return without performing validation.
+	if dc.getStatus() == StatusValid || dc.getStatus() == StatusInvalid {
 		return dc, nil
 	}
+	if vo.verifyAttestation == nil {
+		return nil, ServerInternalErr(errors.New("device-attest-01 challenge is not supported by the provisioner"))
+	}
+	invalid := func(e *Error) (challenge, error) {
+		upd, err := dc.storeInvalid(db, e)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceAttest01Challenge{upd}, nil
+	}
+
+	var payload deviceAttest01Payload
+	if err := json.Unmarshal(vo.payload, &payload); err != nil {
+		return nil, MalformedErr(errors.Wrap(err, "error unmarshaling device-attest-01 challenge payload"))
+	}
+	if payload.AttObj == "" {
+		return nil, MalformedErr(errors.New("device-attest-01 challenge payload must contain the attObj"))
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload.AttObj)
+	if err != nil {
+		return nil, MalformedErr(errors.Wrap(err, "error base64url decoding attObj"))
+	}
+	var att attestationObject
+	if err := cbor.Unmarshal(b, &att); err != nil {
+		return nil, MalformedErr(errors.Wrap(err, "error unmarshaling attObj"))
+	}
+	statement, err := json.Marshal(att.AttStatement)
+	if err != nil {
+		return nil, MalformedErr(errors.Wrap(err, "error encoding attStmt"))
+	}
 
-	expectedKeyAuth, err := KeyAuthorization(dc.Token, jwk)
+	keyAuth, err := KeyAuthorization(dc.Token, jwk)
 	if err != nil {
 		return nil, err
 	}
-	h := sha256.Sum256([]byte(expectedKeyAuth))
-	expected := base64.RawURLEncoding.EncodeToString(h[:])
+	sum := sha256.Sum256([]byte(keyAuth))
+	data, err := vo.verifyAttestation(att.Format, statement, sum[:])
+	if err != nil {
+		return invalid(RejectedIdentifierErr(err))
+	}
 	var found bool
-	for _, r := range txtRecords {
-		if r == expected {
+	for _, id := range data.PermanentIdentifiers {
+		if id == dc.Value {
 			found = true
 			break
 		}
 	}
 	if !found {
-		if err = dc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("keyAuthorization "+
-				"does not match; expected %s, but got %s", expectedKeyAuth, txtRecords))); err != nil {
-			return nil, err
-		}
-		return dc, nil
+		return invalid(RejectedIdentifierErr(errors.Errorf("permanent identifier %s does not match "+
+			"the attested identifiers %v", dc.Value, data.PermanentIdentifiers)))
+	}
+	key, err := x509.MarshalPKIXPublicKey(data.PublicKey)
+	if err != nil {
+		return invalid(RejectedIdentifierErr(errors.Wrap(err, "error marshaling attested key")))
 	}
 
-	// Update and store the challenge.
-	upd := &dns01Challenge{dc.baseChallenge.clone()}
+	upd := &deviceAttest01Challenge{dc.baseChallenge.clone()}
 	upd.Status = StatusValid
 	upd.Error = nil
 	upd.Validated = time.Now().UTC()
-
+	upd.AttestedKey = key
 	if err := upd.save(db, dc); err != nil {
 		return nil, err
 	}
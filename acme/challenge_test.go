@@ -2,6 +2,7 @@ package acme
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
@@ -20,15 +21,21 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/cli/jose"
 	"github.com/smallstep/nosql"
 	"github.com/smallstep/nosql/database"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 var testOps = ChallengeOptions{
@@ -703,7 +710,16 @@ func (errReader) Close() error {
 	return nil
 }
 
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 func TestHTTP01Validate(t *testing.T) {
+	defer func(d time.Duration) { http01RetryInterval = d }(http01RetryInterval)
+	http01RetryInterval = time.Millisecond
+
 	type test struct {
 		vo  validateOptions
 		ch  challenge
@@ -744,6 +760,7 @@ func TestHTTP01Validate(t *testing.T) {
 			expErr := ConnectionErr(errors.Errorf("error doing http GET for url "+
 				"http://zap.internal/.well-known/acme-challenge/%s: force", ch.getToken()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &http01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -764,7 +781,7 @@ func TestHTTP01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/http-get->=400": func(t *testing.T) test {
@@ -776,6 +793,7 @@ func TestHTTP01Validate(t *testing.T) {
 			expErr := ConnectionErr(errors.Errorf("error doing http GET for url "+
 				"http://zap.internal/.well-known/acme-challenge/%s with status code 400", ch.getToken()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &http01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -786,6 +804,7 @@ func TestHTTP01Validate(t *testing.T) {
 					httpGet: func(url string) (*http.Response, error) {
 						return &http.Response{
 							StatusCode: http.StatusBadRequest,
+							Body:       ioutil.NopCloser(bytes.NewBufferString("")),
 						}, nil
 					},
 				},
@@ -798,16 +817,24 @@ func TestHTTP01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
-		"fail/read-body": func(t *testing.T) test {
+		"ok/read-body-error": func(t *testing.T) test {
 			ch, err := newHTTPCh()
 			assert.FatalError(t, err)
-			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			oldb, err := json.Marshal(ch)
 			assert.FatalError(t, err)
-			jwk.Key = "foo"
 
+			expErr := ConnectionErr(errors.Errorf("error reading response "+
+				"body for url http://zap.internal/.well-known/acme-challenge/%s: force",
+				ch.getToken()))
+			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
+			baseClone.Error = expErr.ToACME()
+			newCh := &http01Challenge{baseClone}
+			newb, err := json.Marshal(newCh)
+			assert.FatalError(t, err)
 			return test{
 				ch: ch,
 				vo: validateOptions{
@@ -817,10 +844,87 @@ func TestHTTP01Validate(t *testing.T) {
 						}, nil
 					},
 				},
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						assert.Equals(t, old, oldb)
+						assert.Equals(t, newval, newb)
+						return nil, true, nil
+					},
+				},
+				res: newCh,
+			}
+		},
+		"ok/body-too-large": func(t *testing.T) test {
+			ch, err := newHTTPCh()
+			assert.FatalError(t, err)
+			oldb, err := json.Marshal(ch)
+			assert.FatalError(t, err)
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			expKeyAuth, err := KeyAuthorization(ch.getToken(), jwk)
+			assert.FatalError(t, err)
+
+			expErr := RejectedIdentifierErr(errors.Errorf("response body for url "+
+				"http://zap.internal/.well-known/acme-challenge/%s is larger than 4096 bytes",
+				ch.getToken()))
+			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
+			baseClone.Error = expErr.ToACME()
+			newCh := &http01Challenge{baseClone}
+			newb, err := json.Marshal(newCh)
+			assert.FatalError(t, err)
+			return test{
+				ch: ch,
+				vo: validateOptions{
+					httpGet: func(url string) (*http.Response, error) {
+						// The key authorization followed by garbage.
+						body := expKeyAuth + strings.Repeat("\n", http01MaxBodySize)
+						return &http.Response{
+							Body: ioutil.NopCloser(bytes.NewBufferString(body)),
+						}, nil
+					},
+				},
 				jwk: jwk,
-				err: ServerInternalErr(errors.Errorf("error reading response "+
-					"body for url http://zap.internal/.well-known/acme-challenge/%s: force",
-					ch.getToken())),
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						assert.Equals(t, old, oldb)
+						assert.Equals(t, newval, newb)
+						return nil, true, nil
+					},
+				},
+				res: newCh,
+			}
+		},
+		"ok/retries-exhausted": func(t *testing.T) test {
+			ch, err := newHTTPCh()
+			assert.FatalError(t, err)
+
+			var calls int
+			expErr := ConnectionErr(errors.Errorf("error doing http GET for url "+
+				"http://zap.internal/.well-known/acme-challenge/%s: i/o timeout", ch.getToken()))
+			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
+			baseClone.Error = expErr.ToACME()
+			newCh := &http01Challenge{baseClone}
+			newb, err := json.Marshal(newCh)
+			assert.FatalError(t, err)
+			return test{
+				ch: ch,
+				vo: validateOptions{
+					httpGet: func(url string) (*http.Response, error) {
+						calls++
+						return nil, timeoutError{}
+					},
+				},
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						assert.Equals(t, 1+http01Retries, calls)
+						assert.Equals(t, newval, newb)
+						return nil, true, nil
+					},
+				},
+				res: newCh,
 			}
 		},
 		"fail/key-authorization-gen-error": func(t *testing.T) test {
@@ -857,6 +961,7 @@ func TestHTTP01Validate(t *testing.T) {
 			expErr := RejectedIdentifierErr(errors.Errorf("keyAuthorization does not match; "+
 				"expected %s, but got foo", expKeyAuth))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &http01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -881,7 +986,7 @@ func TestHTTP01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"fail/save-error": func(t *testing.T) test {
@@ -911,6 +1016,44 @@ func TestHTTP01Validate(t *testing.T) {
 				err: ServerInternalErr(errors.New("error saving acme challenge: force")),
 			}
 		},
+		"ok/retry-transient-error": func(t *testing.T) test {
+			ch, err := newHTTPCh()
+			assert.FatalError(t, err)
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			expKeyAuth, err := KeyAuthorization(ch.getToken(), jwk)
+			assert.FatalError(t, err)
+
+			var calls int
+			baseClone := ch.clone()
+			baseClone.Status = StatusValid
+			newCh := &http01Challenge{baseClone}
+			return test{
+				ch:  ch,
+				res: newCh,
+				vo: validateOptions{
+					httpGet: func(u string) (*http.Response, error) {
+						if calls++; calls == 1 {
+							return nil, &url.Error{Op: "Get", URL: u, Err: io.ErrUnexpectedEOF}
+						}
+						return &http.Response{
+							Body: ioutil.NopCloser(bytes.NewBufferString(expKeyAuth + "\r\n")),
+						}, nil
+					},
+				},
+				jwk: jwk,
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						assert.Equals(t, 2, calls)
+						httpCh, err := unmarshalChallenge(newval)
+						assert.FatalError(t, err)
+						baseClone.Validated = httpCh.getValidated()
+						return nil, true, nil
+					},
+				},
+			}
+		},
 		"ok": func(t *testing.T) test {
 			ch, err := newHTTPCh()
 			assert.FatalError(t, err)
@@ -989,6 +1132,139 @@ func TestHTTP01Validate(t *testing.T) {
 	}
 }
 
+func TestHTTP01ValidateServer(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	var keyAuth string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/acme-challenge/", func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.Host)
+		assert.FatalError(t, err)
+		if host == "localhost" {
+			http.Redirect(w, r, "http://127.0.0.1:"+port+r.URL.Path, http.StatusFound)
+			return
+		}
+		fmt.Fprintln(w, keyAuth)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, keyAuth+strings.Repeat("\n", http01MaxBodySize))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://127.0.0.1/foo", http.StatusFound)
+	})
+	mux.HandleFunc("/port", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://127.0.0.1:8443/foo", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	assert.FatalError(t, err)
+
+	tests := map[string]struct {
+		value   string
+		port    string
+		path    string
+		status  string
+		errType string
+	}{
+		"ok":                      {"127.0.0.1", port, "", StatusValid, ""},
+		"ok/redirect":             {"localhost", port, "", StatusValid, ""},
+		"fail/connection":         {"127.0.0.1", "1", "", StatusInvalid, "urn:ietf:params:acme:error:connection"},
+		"fail/not-found":          {"127.0.0.1", port, "/missing", StatusInvalid, "urn:ietf:params:acme:error:connection"},
+		"fail/too-large":          {"127.0.0.1", port, "/large", StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier"},
+		"fail/too-many-redirects": {"127.0.0.1", port, "/loop", StatusInvalid, "urn:ietf:params:acme:error:connection"},
+		"fail/redirect-scheme":    {"127.0.0.1", port, "/ftp", StatusInvalid, "urn:ietf:params:acme:error:connection"},
+		"fail/redirect-port":      {"127.0.0.1", port, "/port", StatusInvalid, "urn:ietf:params:acme:error:connection"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdb := &db.MockNoSQLDB{
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					return nil, true, nil
+				},
+			}
+			ch, err := newHTTP01Challenge(mdb, ChallengeOptions{
+				AccountID:  "accID",
+				AuthzID:    "authzID",
+				Identifier: Identifier{Type: "dns", Value: tc.value},
+			})
+			assert.FatalError(t, err)
+			keyAuth, err = KeyAuthorization(ch.getToken(), jwk)
+			assert.FatalError(t, err)
+
+			httpGet := newHTTP01Getter(tc.port, newValidationDialer(nil))
+			if tc.path != "" {
+				// Send the validation to one of the test endpoints.
+				httpGet = func(string) (*http.Response, error) {
+					return newHTTP01Getter(tc.port, newValidationDialer(nil))(srv.URL + tc.path)
+				}
+			}
+			vo := validateOptions{httpGet: httpGet, httpPort: tc.port}
+
+			defer func(n int) { http01Retries = n }(http01Retries)
+			http01Retries = 0
+			res, err := ch.validate(mdb, jwk, vo)
+			assert.FatalError(t, err)
+			assert.Equals(t, tc.status, res.getStatus())
+			if tc.errType == "" {
+				assert.Nil(t, res.getError())
+			} else if assert.NotNil(t, res.getError()) {
+				assert.Equals(t, tc.errType, res.getError().Type)
+			}
+		})
+	}
+}
+
+func TestHTTP01ValidateURL(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	// IPv6 addresses are enclosed in brackets, with or without a port.
+	tests := map[string]struct {
+		value string
+		port  string
+		host  string
+	}{
+		"dns":          {"example.com", "80", "example.com"},
+		"dns/port":     {"example.com", "8080", "example.com:8080"},
+		"ipv4":         {"10.0.0.1", "80", "10.0.0.1"},
+		"ipv4/port":    {"10.0.0.1", "8080", "10.0.0.1:8080"},
+		"ipv6":         {"2001:db8::1", "80", "[2001:db8::1]"},
+		"ipv6/port":    {"2001:db8::1", "8080", "[2001:db8::1]:8080"},
+		"ipv6/no-port": {"2001:db8::1", "", "[2001:db8::1]"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdb := &db.MockNoSQLDB{
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					return nil, true, nil
+				},
+			}
+			ch, err := newHTTP01Challenge(mdb, ChallengeOptions{
+				AccountID:  "accID",
+				AuthzID:    "authzID",
+				Identifier: Identifier{Type: "dns", Value: tc.value},
+			})
+			assert.FatalError(t, err)
+			var got string
+			vo := validateOptions{
+				httpGet: func(url string) (*http.Response, error) {
+					got = url
+					return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+				},
+				httpPort: tc.port,
+			}
+			_, err = ch.validate(mdb, jwk, vo)
+			assert.FatalError(t, err)
+			assert.Equals(t, fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", tc.host, ch.getToken()), got)
+		})
+	}
+}
+
 func TestTLSALPN01Validate(t *testing.T) {
 	type test struct {
 		srv *httptest.Server
@@ -1032,6 +1308,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := ConnectionErr(errors.Errorf("error doing TLS dial for %v:443: force", ch.getValue()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1053,7 +1330,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/timeout": func(t *testing.T) test {
@@ -1062,12 +1339,10 @@ func TestTLSALPN01Validate(t *testing.T) {
 			oldb, err := json.Marshal(ch)
 			assert.FatalError(t, err)
 
-			expErr := ConnectionErr(errors.Errorf("error doing TLS dial for %v:443: tls: DialWithDialer timed out", ch.getValue()))
+			// The message of the timeout depends on the Go version.
 			baseClone := ch.clone()
-			baseClone.Error = expErr.ToACME()
+			baseClone.Status = StatusInvalid
 			newCh := &tlsALPN01Challenge{baseClone}
-			newb, err := json.Marshal(newCh)
-			assert.FatalError(t, err)
 
 			srv, tlsDial := newTestTLSALPNServer(nil)
 			// srv.Start() - do not start server to cause timeout
@@ -1083,11 +1358,18 @@ func TestTLSALPN01Validate(t *testing.T) {
 						assert.Equals(t, bucket, challengeTable)
 						assert.Equals(t, key, []byte(ch.getID()))
 						assert.Equals(t, old, oldb)
-						assert.Equals(t, string(newval), string(newb))
+						upd, err := unmarshalChallenge(newval)
+						assert.FatalError(t, err)
+						assert.Equals(t, StatusInvalid, upd.getStatus())
+						if assert.NotNil(t, upd.getError()) {
+							assert.Equals(t, "urn:ietf:params:acme:error:connection", upd.getError().Type)
+							assert.HasPrefix(t, upd.getError().Detail, "error doing TLS dial for zap.internal:443: ")
+						}
+						baseClone.Error = ConnectionErr(errors.New(upd.getError().Detail)).ToACME()
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/no-certificates": func(t *testing.T) test {
@@ -1098,6 +1380,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.Errorf("tls-alpn-01 challenge for %v resulted in no certificates", ch.getValue()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1119,7 +1402,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/no-names": func(t *testing.T) test {
@@ -1130,6 +1413,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: leaf certificate must contain a single DNS name, %v", ch.getValue()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1164,7 +1448,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/too-many-names": func(t *testing.T) test {
@@ -1175,6 +1459,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: leaf certificate must contain a single DNS name, %v", ch.getValue()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1209,7 +1494,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/wrong-name": func(t *testing.T) test {
@@ -1220,6 +1505,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.Errorf("incorrect certificate for tls-alpn-01 challenge: leaf certificate must contain a single DNS name, %v", ch.getValue()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1254,7 +1540,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/no-extension": func(t *testing.T) test {
@@ -1265,6 +1551,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.New("incorrect certificate for tls-alpn-01 challenge: missing acmeValidationV1 extension"))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1295,7 +1582,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/extension-not-critical": func(t *testing.T) test {
@@ -1306,6 +1593,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.New("incorrect certificate for tls-alpn-01 challenge: acmeValidationV1 extension not critical"))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1340,7 +1628,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/extension-malformed": func(t *testing.T) test {
@@ -1351,6 +1639,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.New("incorrect certificate for tls-alpn-01 challenge: malformed acmeValidationV1 extension value"))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1381,7 +1670,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/no-protocol": func(t *testing.T) test {
@@ -1395,12 +1684,20 @@ func TestTLSALPN01Validate(t *testing.T) {
 
 			expErr := RejectedIdentifierErr(errors.New("cannot negotiate ALPN acme-tls/1 protocol for tls-alpn-01 challenge"))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
 			assert.FatalError(t, err)
 
-			srv := httptest.NewTLSServer(nil)
+			// A server without ALPN support, the handshake does not fail.
+			cert, err := newTLSALPNValidationCert(nil, false, true, ch.getValue())
+			assert.FatalError(t, err)
+			srv := httptest.NewUnstartedServer(nil)
+			srv.Listener = tls.NewListener(srv.Listener, &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+			})
+			srv.Start()
 
 			return test{
 				srv: srv,
@@ -1420,7 +1717,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/mismatched-token": func(t *testing.T) test {
@@ -1441,6 +1738,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 				"expected acmeValidationV1 extension value %s for this challenge but got %s",
 				hex.EncodeToString(expKeyAuthHash[:]), hex.EncodeToString(incorrectTokenHash[:])))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1468,7 +1766,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/obsolete-oid": func(t *testing.T) test {
@@ -1483,6 +1781,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 			expErr := RejectedIdentifierErr(errors.New("incorrect certificate for tls-alpn-01 challenge: " +
 				"obsolete id-pe-acmeIdentifier in acmeValidationV1 extension"))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &tlsALPN01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1514,7 +1813,7 @@ func TestTLSALPN01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok": func(t *testing.T) test {
@@ -1612,6 +1911,117 @@ func TestTLSALPN01Validate(t *testing.T) {
 	}
 }
 
+func TestTLSALPN01ValidateServer(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	var (
+		mu     sync.Mutex
+		cert   *tls.Certificate
+		gotSNI string
+	)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		NextProtos: []string{"acme-tls/1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			gotSNI = hello.ServerName
+			return cert, nil
+		},
+	})
+	assert.FatalError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	assert.FatalError(t, err)
+
+	// The identifier is "localhost" unless value is set, and the SNI of an IP
+	// address is its reverse DNS name.
+	tests := map[string]struct {
+		digest  func(h []byte) []byte
+		names   []string
+		status  string
+		errType string
+		value   string
+		sni     string
+	}{
+		"ok":              {nil, []string{"localhost"}, StatusValid, "", "", ""},
+		"ok/case":         {nil, []string{"LocalHost"}, StatusValid, "", "", ""},
+		"fail/digest":     {func(h []byte) []byte { h[0]++; return h }, []string{"localhost"}, StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier", "", ""},
+		"fail/extra-dns":  {nil, []string{"localhost", "www.localhost"}, StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier", "", ""},
+		"fail/extra-ip":   {nil, []string{"localhost", "127.0.0.1"}, StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier", "", ""},
+		"fail/wrong-name": {nil, []string{"www.localhost"}, StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier", "", ""},
+		"ok/ip":           {nil, []string{"127.0.0.1"}, StatusValid, "", "127.0.0.1", "1.0.0.127.in-addr.arpa"},
+		"ok/ipv6": {nil, []string{"::1"}, StatusValid, "", "::1",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa"},
+		"fail/ip-dns-name":  {nil, []string{"localhost"}, StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier", "127.0.0.1", "1.0.0.127.in-addr.arpa"},
+		"fail/ip-extra-dns": {nil, []string{"127.0.0.1", "localhost"}, StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier", "127.0.0.1", "1.0.0.127.in-addr.arpa"},
+		"fail/wrong-ip":     {nil, []string{"127.0.0.2"}, StatusInvalid, "urn:ietf:params:acme:error:rejectedIdentifier", "127.0.0.1", "1.0.0.127.in-addr.arpa"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			value, typ, sni := "localhost", "dns", "localhost"
+			if tc.value != "" {
+				value, typ, sni = tc.value, "ip", tc.sni
+			}
+			mdb := &db.MockNoSQLDB{
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					return nil, true, nil
+				},
+			}
+			ch, err := newTLSALPN01Challenge(mdb, ChallengeOptions{
+				AccountID:  "accID",
+				AuthzID:    "authzID",
+				Identifier: Identifier{Type: typ, Value: value},
+			})
+			assert.FatalError(t, err)
+			keyAuth, err := KeyAuthorization(ch.getToken(), jwk)
+			assert.FatalError(t, err)
+			h := sha256.Sum256([]byte(keyAuth))
+			digest := h[:]
+			if tc.digest != nil {
+				digest = tc.digest(digest)
+			}
+			mu.Lock()
+			cert, err = newTLSALPNValidationCert(digest, false, true, tc.names...)
+			mu.Unlock()
+			assert.FatalError(t, err)
+
+			vo := validateOptions{
+				tlsDial: func(network, addr string, config *tls.Config) (*tls.Conn, error) {
+					// localhost might resolve to ::1 first.
+					host, p, err := net.SplitHostPort(addr)
+					assert.FatalError(t, err)
+					assert.Equals(t, value, host)
+					assert.Equals(t, port, p)
+					return tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, network, net.JoinHostPort("127.0.0.1", p), config)
+				},
+				tlsPort: port,
+			}
+			res, err := ch.validate(mdb, jwk, vo)
+			assert.FatalError(t, err)
+			assert.Equals(t, tc.status, res.getStatus())
+			if tc.errType == "" {
+				assert.Nil(t, res.getError())
+			} else if assert.NotNil(t, res.getError()) {
+				assert.Equals(t, tc.errType, res.getError().Type)
+			}
+			mu.Lock()
+			assert.Equals(t, sni, gotSNI)
+			mu.Unlock()
+		})
+	}
+}
+
 func newTestTLSALPNServer(validationCert *tls.Certificate) (*httptest.Server, tlsDialer) {
 	srv := httptest.NewUnstartedServer(http.NewServeMux())
 
@@ -1640,9 +2050,11 @@ func newTestTLSALPNServer(validationCert *tls.Certificate) (*httptest.Server, tl
 	srv.Listener = tls.NewListener(srv.Listener, srv.TLS)
 	//srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // hush
 
-	return srv, func(network, addr string, config *tls.Config) (conn *tls.Conn, err error) {
-		return tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", srv.Listener.Addr().String(), config)
-	}
+	// The validations are sent to the server whatever the address.
+	dial := newValidationDialer(nil)
+	return srv, newTLSALPN01Dialer(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dial(ctx, network, srv.Listener.Addr().String())
+	}, time.Second)
 }
 
 // noopConn is a mock net.Conn that does nothing.
@@ -1673,7 +2085,13 @@ func newTLSALPNValidationCert(keyAuthHash []byte, obsoleteOID, critical bool, na
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              names,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			certTemplate.IPAddresses = append(certTemplate.IPAddresses, ip)
+		} else {
+			certTemplate.DNSNames = append(certTemplate.DNSNames, name)
+		}
 	}
 
 	if keyAuthHash != nil {
@@ -1745,6 +2163,7 @@ func TestDNS01Validate(t *testing.T) {
 			expErr := DNSErr(errors.Errorf("error looking up TXT records for "+
 				"domain %s: force", ch.getValue()))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &dns01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1765,7 +2184,7 @@ func TestDNS01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"ok/lookup-txt-wildcard": func(t *testing.T) test {
@@ -1841,6 +2260,7 @@ func TestDNS01Validate(t *testing.T) {
 			expErr := RejectedIdentifierErr(errors.Errorf("keyAuthorization does not match; "+
 				"expected %s, but got %s", expKeyAuth, []string{"foo", "bar"}))
 			baseClone := ch.clone()
+			baseClone.Status = StatusInvalid
 			baseClone.Error = expErr.ToACME()
 			newCh := &http01Challenge{baseClone}
 			newb, err := json.Marshal(newCh)
@@ -1863,7 +2283,7 @@ func TestDNS01Validate(t *testing.T) {
 						return nil, true, nil
 					},
 				},
-				res: ch,
+				res: newCh,
 			}
 		},
 		"fail/save-error": func(t *testing.T) test {
@@ -1970,3 +2390,375 @@ func TestDNS01Validate(t *testing.T) {
 		})
 	}
 }
+
+// testDNSServer is an authoritative DNS server for the dns-01 tests. It
+// answers the TXT records of its zone, and a CNAME record to any query of a
+// delegated name. It counts the TXT queries of each name.
+type testDNSServer struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	txt     map[string][]string
+	cname   map[string]string
+	queries map[string]int
+	// onQuery is called on each TXT query before it is answered.
+	onQuery func(name string, n int)
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	srv := &testDNSServer{
+		conn:    conn,
+		txt:     make(map[string][]string),
+		cname:   make(map[string]string),
+		queries: make(map[string]int),
+	}
+	go srv.serve()
+	return srv
+}
+
+func (s *testDNSServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testDNSServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *testDNSServer) setTXT(name string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txt[name] = values
+}
+
+func (s *testDNSServer) count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[name]
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if b, err := s.answer(buf[:n]); err == nil {
+			s.conn.WriteTo(b, addr)
+		}
+	}
+}
+
+func (s *testDNSServer) answer(msg []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(q.Name.String())
+
+	s.mu.Lock()
+	if q.Type == dnsmessage.TypeTXT {
+		s.queries[name]++
+		if s.onQuery != nil {
+			s.onQuery(name, s.queries[name])
+		}
+	}
+	txt, hasTXT := s.txt[name]
+	target, hasCNAME := s.cname[name]
+	s.mu.Unlock()
+
+	rh := dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true}
+	if !hasTXT && !hasCNAME {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch {
+	case hasCNAME:
+		err = b.CNAMEResource(rr, dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)})
+	case hasTXT && q.Type == dnsmessage.TypeTXT:
+		for _, v := range txt {
+			if err = b.TXTResource(rr, dnsmessage.TXTResource{TXT: []string{v}}); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+func TestDNS01ValidateServer(t *testing.T) {
+	defer func(d time.Duration) { dns01RetryInterval = d }(dns01RetryInterval)
+	dns01RetryInterval = 10 * time.Millisecond
+
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	type test struct {
+		value       string
+		propagation time.Duration
+		setup       func(srv *testDNSServer, record string)
+		status      string
+		errType     string
+		queries     map[string]int
+	}
+	tests := map[string]test{
+		"ok": {
+			value: "example.com",
+			setup: func(srv *testDNSServer, record string) {
+				srv.setTXT("_acme-challenge.example.com.", "foo", record)
+			},
+			status:  StatusValid,
+			queries: map[string]int{"_acme-challenge.example.com.": 1},
+		},
+		"ok/wildcard": {
+			value: "*.example.com",
+			setup: func(srv *testDNSServer, record string) {
+				srv.setTXT("_acme-challenge.example.com.", record)
+			},
+			status: StatusValid,
+		},
+		"ok/cname": {
+			value: "www.example.com",
+			setup: func(srv *testDNSServer, record string) {
+				srv.cname["_acme-challenge.www.example.com."] = "www.acme.example.net."
+				srv.cname["www.acme.example.net."] = "_acme-challenge.example.net."
+				srv.setTXT("_acme-challenge.example.net.", record)
+			},
+			status: StatusValid,
+		},
+		"ok/propagation": {
+			value:       "example.com",
+			propagation: time.Minute,
+			setup: func(srv *testDNSServer, record string) {
+				srv.onQuery = func(name string, n int) {
+					if name == "_acme-challenge.example.com." && n == 3 {
+						srv.txt[name] = []string{record}
+					}
+				}
+			},
+			status:  StatusValid,
+			queries: map[string]int{"_acme-challenge.example.com.": 3},
+		},
+		"fail/not-found": {
+			value:   "example.com",
+			setup:   func(srv *testDNSServer, record string) {},
+			status:  StatusInvalid,
+			errType: "urn:ietf:params:acme:error:dns",
+		},
+		"fail/mismatch": {
+			value: "example.com",
+			setup: func(srv *testDNSServer, record string) {
+				srv.setTXT("_acme-challenge.example.com.", "foo")
+			},
+			status:  StatusInvalid,
+			errType: "urn:ietf:params:acme:error:rejectedIdentifier",
+		},
+		"fail/propagation-timeout": {
+			value:       "example.com",
+			propagation: 100 * time.Millisecond,
+			setup: func(srv *testDNSServer, record string) {
+				srv.setTXT("_acme-challenge.example.com.", "foo")
+			},
+			status:  StatusInvalid,
+			errType: "urn:ietf:params:acme:error:rejectedIdentifier",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestDNSServer(t)
+			defer srv.Close()
+
+			mdb := &db.MockNoSQLDB{
+				MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+					return nil, true, nil
+				},
+			}
+			ch, err := newDNS01Challenge(mdb, ChallengeOptions{
+				AccountID:  "accID",
+				AuthzID:    "authzID",
+				Identifier: Identifier{Type: "dns", Value: tc.value},
+			})
+			assert.FatalError(t, err)
+			keyAuth, err := KeyAuthorization(ch.getToken(), jwk)
+			assert.FatalError(t, err)
+			h := sha256.Sum256([]byte(keyAuth))
+			tc.setup(srv, base64.RawURLEncoding.EncodeToString(h[:]))
+
+			vo := validateOptions{dnsPropagation: tc.propagation}
+			vo.lookupTxt, vo.lookupCNAME = newDNS01Lookups(srv.Addr())
+			start := time.Now()
+			res, err := ch.validate(mdb, jwk, vo)
+			assert.FatalError(t, err)
+			assert.Equals(t, tc.status, res.getStatus())
+			if tc.errType == "" {
+				assert.Nil(t, res.getError())
+			} else if assert.NotNil(t, res.getError()) {
+				assert.Equals(t, tc.errType, res.getError().Type)
+			}
+			for name, n := range tc.queries {
+				assert.Equals(t, n, srv.count(name))
+			}
+			if tc.status == StatusInvalid && tc.propagation > 0 {
+				assert.True(t, time.Since(start) >= tc.propagation-dns01RetryInterval)
+				assert.True(t, srv.count("_acme-challenge.example.com.") > 1)
+			}
+		})
+	}
+}
+
+func TestDeviceAttest01Validate(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	attestedKey, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	attestedDER, err := x509.MarshalPKIXPublicKey(attestedKey.Public().Key)
+	assert.FatalError(t, err)
+
+	newCh := func(t *testing.T) (nosql.DB, challenge) {
+		mdb := newMemoryDB(t)
+		ch, err := newDeviceAttest01Challenge(mdb, ChallengeOptions{
+			AccountID:  "accID",
+			AuthzID:    "authzID",
+			Identifier: Identifier{Type: "permanent-identifier", Value: "12345678"},
+		})
+		assert.FatalError(t, err)
+		return mdb, ch
+	}
+	attObj := func(t *testing.T, v interface{}) []byte {
+		b, err := cbor.Marshal(v)
+		assert.FatalError(t, err)
+		return []byte(`{"attObj":"` + base64.RawURLEncoding.EncodeToString(b) + `"}`)
+	}
+	payload := attObj(t, map[string]interface{}{
+		"fmt":     "step",
+		"attStmt": map[string]interface{}{"x5c": [][]byte{[]byte("leaf")}, "alg": -7},
+	})
+	// verifier checks the attestation object and the challenge binding, and
+	// returns the given identifiers.
+	verifier := func(t *testing.T, ch challenge, ids ...string) attestationVerifier {
+		return func(format string, statement, challenge []byte) (*provisioner.AttestationData, error) {
+			assert.Equals(t, "step", format)
+			assert.Equals(t, `{"alg":-7,"x5c":["bGVhZg=="]}`, string(statement))
+			keyAuth, err := KeyAuthorization(ch.getToken(), jwk)
+			assert.FatalError(t, err)
+			sum := sha256.Sum256([]byte(keyAuth))
+			assert.Equals(t, sum[:], challenge)
+			return &provisioner.AttestationData{
+				PublicKey:            attestedKey.Public().Key,
+				PermanentIdentifiers: ids,
+			}, nil
+		}
+	}
+
+	type test struct {
+		db      nosql.DB
+		ch      challenge
+		vo      validateOptions
+		status  string
+		errType ProbType
+		err     *Error
+	}
+	tests := map[string]func(t *testing.T) test{
+		"ok/status-already-valid": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			upd := ch.clone()
+			upd.Status = StatusValid
+			assert.FatalError(t, upd.save(mdb, ch))
+			return test{db: mdb, ch: &deviceAttest01Challenge{upd}, status: StatusValid}
+		},
+		"fail/not-supported": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{payload: payload},
+				err: ServerInternalErr(errors.New("device-attest-01 challenge is not supported by the provisioner"))}
+		},
+		"fail/payload": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{payload: []byte("{"), verifyAttestation: verifier(t, ch)},
+				err: MalformedErr(errors.New("error unmarshaling device-attest-01 challenge payload"))}
+		},
+		"fail/missing-attObj": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{payload: []byte("{}"), verifyAttestation: verifier(t, ch)},
+				err: MalformedErr(errors.New("device-attest-01 challenge payload must contain the attObj"))}
+		},
+		"fail/base64": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{payload: []byte(`{"attObj":"!"}`), verifyAttestation: verifier(t, ch)},
+				err: MalformedErr(errors.New("error base64url decoding attObj"))}
+		},
+		"fail/cbor": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{payload: attObj(t, "foo"), verifyAttestation: verifier(t, ch)},
+				err: MalformedErr(errors.New("error unmarshaling attObj"))}
+		},
+		"ok/invalid-attestation": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{
+				payload: payload,
+				verifyAttestation: func(format string, statement, challenge []byte) (*provisioner.AttestationData, error) {
+					return nil, errors.New("force")
+				},
+			}, status: StatusInvalid, errType: rejectedIdentifierErr}
+		},
+		"ok/identifier-mismatch": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{payload: payload, verifyAttestation: verifier(t, ch, "87654321")},
+				status: StatusInvalid, errType: rejectedIdentifierErr}
+		},
+		"ok": func(t *testing.T) test {
+			mdb, ch := newCh(t)
+			return test{db: mdb, ch: ch, vo: validateOptions{payload: payload, verifyAttestation: verifier(t, ch, "foo", "12345678")},
+				status: StatusValid}
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			ch, err := tc.ch.validate(tc.db, jwk, tc.vo)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					ae, ok := err.(*Error)
+					assert.True(t, ok)
+					assert.HasPrefix(t, ae.Error(), tc.err.Error())
+					assert.Equals(t, ae.StatusCode(), tc.err.StatusCode())
+					assert.Equals(t, ae.Type, tc.err.Type)
+				}
+				return
+			}
+			if assert.Nil(t, tc.err) {
+				assert.Equals(t, tc.status, ch.getStatus())
+				stored, err := getChallenge(tc.db, ch.getID())
+				assert.FatalError(t, err)
+				assert.Equals(t, ch.getStatus(), stored.getStatus())
+				switch {
+				case tc.errType != 0:
+					if assert.NotNil(t, stored.getError()) {
+						assert.Equals(t, "urn:ietf:params:acme:error:"+tc.errType.String(), stored.getError().Type)
+					}
+				case tc.status == StatusValid && tc.ch.getStatus() == StatusPending:
+					assert.Equals(t, attestedDER, stored.getAttestedKey())
+					assert.False(t, stored.getValidated().IsZero())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// DefaultCleanupInterval is the default time between the deletions of the
+// expired ACME objects.
+const DefaultCleanupInterval = time.Hour
+
+// DefaultCleanupRetention is the default time the expired ACME objects are
+// kept before they are deleted.
+const DefaultCleanupRetention = 7 * 24 * time.Hour
+
+// DefaultCleanupBatchSize is the default number of expired objects of a table
+// deleted after each scan of the table.
+const DefaultCleanupBatchSize = 1000
+
+// maxIndexUpdates is the number of times the index of orders of an account is
+// read again if it changes while an order is removed from it.
+const maxIndexUpdates = 10
+
+// errStopScan stops the scan of a table without an error.
+var errStopScan = errors.New("stop scan")
+
+// CleanupOptions are the options of the deletion of the expired ACME objects.
+// The zero values use the defaults.
+type CleanupOptions struct {
+	// Interval is the time between deletions, 1h by default.
+	Interval time.Duration
+	// Retention is the time an object is kept after its expiration, 7 days by
+	// default.
+	Retention time.Duration
+	// BatchSize is the maximum number of objects deleted after each scan of a
+	// table, 1000 by default.
+	BatchSize int
+	// Deleted, if set, is called with the table and the number of entries
+	// deleted after each batch.
+	Deleted func(table string, n int)
+}
+
+func (o *CleanupOptions) interval() time.Duration {
+	if o.Interval <= 0 {
+		return DefaultCleanupInterval
+	}
+	return o.Interval
+}
+
+func (o *CleanupOptions) retention() time.Duration {
+	if o.Retention <= 0 {
+		return DefaultCleanupRetention
+	}
+	return o.Retention
+}
+
+func (o *CleanupOptions) batchSize() int {
+	if o.BatchSize <= 0 {
+		return DefaultCleanupBatchSize
+	}
+	return o.BatchSize
+}
+
+func (o *CleanupOptions) deleted(table []byte, n int) {
+	if o.Deleted != nil && n > 0 {
+		o.Deleted(string(table), n)
+	}
+}
+
+// StartCleanup starts the deletion of the expired ACME objects, on start and
+// after every interval, and returns the function that stops it.
+//
+// The CAs sharing a database can run it at the same time: an entry is only
+// reported by the CA that deletes it, and the index of orders of an account
+// is updated with compare-and-swap.
+func (a *Authority) StartCleanup(opts CleanupOptions) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(opts.interval())
+		defer ticker.Stop()
+		for {
+			if err := a.Cleanup(ctx, time.Now(), opts); err != nil && ctx.Err() == nil {
+				log.Printf("error deleting expired ACME objects: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Cleanup deletes once the ACME objects that expired before now minus the
+// retention:
+//
+//   - the orders, which are also removed from the index of their account.
+//   - the authorizations not referenced by the orders kept, and their
+//     challenges.
+//   - the certificates, and their serial number index, once the certificate
+//     itself has expired.
+//
+// The nonces are not deleted here, they are used once and the unused ones are
+// deleted by the cleanup of the authority database.
+func (a *Authority) Cleanup(ctx context.Context, now time.Time, opts CleanupOptions) error {
+	deadline := now.Add(-opts.retention())
+	if err := deleteExpiredOrders(ctx, a.db, deadline, &opts); err != nil {
+		return err
+	}
+	if err := deleteExpiredAuthzs(ctx, a.db, deadline, &opts); err != nil {
+		return err
+	}
+	return deleteExpiredCerts(ctx, a.db, deadline, &opts)
+}
+
+// deleteExpiredOrders deletes the orders that expired before the deadline.
+func deleteExpiredOrders(ctx context.Context, db nosql.DB, deadline time.Time, opts *CleanupOptions) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var expired []*order
+		err := scanTable(db, orderTable, func(e *database.Entry) error {
+			var o order
+			if err := json.Unmarshal(e.Value, &o); err != nil || o.Expires.IsZero() || !o.Expires.Before(deadline) {
+				return nil
+			}
+			expired = append(expired, &o)
+			if len(expired) == opts.batchSize() {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var n int
+		for _, o := range expired {
+			// Remove the order from the index first, the index must not
+			// reference an order that does not exist.
+			if err := removeOrderID(db, o.AccountID, o.ID); err != nil {
+				return err
+			}
+			ok, err := deleteEntry(db, orderTable, []byte(o.ID))
+			if err != nil {
+				return err
+			}
+			if ok {
+				n++
+			}
+		}
+		opts.deleted(orderTable, n)
+		if len(expired) < opts.batchSize() {
+			return nil
+		}
+	}
+}
+
+// deleteExpiredAuthzs deletes the authorizations that expired before the
+// deadline and are not referenced by any order, and their challenges.
+func deleteExpiredAuthzs(ctx context.Context, db nosql.DB, deadline time.Time, opts *CleanupOptions) error {
+	referenced := make(map[string]bool)
+	err := scanTable(db, orderTable, func(e *database.Entry) error {
+		var o order
+		if err := json.Unmarshal(e.Value, &o); err == nil {
+			for _, id := range o.Authorizations {
+				referenced[id] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var expired []*baseAuthz
+		err := scanTable(db, authzTable, func(e *database.Entry) error {
+			var az baseAuthz
+			if err := json.Unmarshal(e.Value, &az); err != nil || az.Expires.IsZero() || !az.Expires.Before(deadline) || referenced[az.ID] {
+				return nil
+			}
+			expired = append(expired, &az)
+			if len(expired) == opts.batchSize() {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var n, nch int
+		for _, az := range expired {
+			// Delete the challenges first, an authorization whose deletion is
+			// interrupted is found again in the next cleanup.
+			for _, id := range az.Challenges {
+				ok, err := deleteEntry(db, challengeTable, []byte(id))
+				if err != nil {
+					return err
+				}
+				if ok {
+					nch++
+				}
+			}
+			ok, err := deleteEntry(db, authzTable, []byte(az.ID))
+			if err != nil {
+				return err
+			}
+			if ok {
+				n++
+			}
+		}
+		opts.deleted(challengeTable, nch)
+		opts.deleted(authzTable, n)
+		if len(expired) < opts.batchSize() {
+			return nil
+		}
+	}
+}
+
+// deleteExpiredCerts deletes the certificates that expired before the
+// deadline, and their serial number index.
+func deleteExpiredCerts(ctx context.Context, db nosql.DB, deadline time.Time, opts *CleanupOptions) error {
+	type expiredCert struct {
+		id, serial string
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var expired []expiredCert
+		err := scanTable(db, certTable, func(e *database.Entry) error {
+			var c certificate
+			if err := json.Unmarshal(e.Value, &c); err != nil {
+				return nil
+			}
+			leaf, err := c.parseLeaf()
+			if err != nil || !leaf.NotAfter.Before(deadline) {
+				return nil
+			}
+			expired = append(expired, expiredCert{c.ID, leaf.SerialNumber.String()})
+			if len(expired) == opts.batchSize() {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var n int
+		for _, c := range expired {
+			if err := db.Del(certIDBySerialTable, []byte(c.serial)); err != nil && !nosql.IsErrNotFound(err) {
+				return errors.Wrapf(err, "error deleting certificate index %s", c.serial)
+			}
+			ok, err := deleteEntry(db, certTable, []byte(c.id))
+			if err != nil {
+				return err
+			}
+			if ok {
+				n++
+			}
+		}
+		opts.deleted(certTable, n)
+		if len(expired) < opts.batchSize() {
+			return nil
+		}
+	}
+}
+
+// removeOrderID removes an order from the index of orders of its account. The
+// index is updated with compare-and-swap, and read again if another request
+// or CA has changed it in the meantime.
+func removeOrderID(db nosql.DB, accID, oid string) error {
+	for i := 0; i < maxIndexUpdates; i++ {
+		old, err := db.Get(ordersByAccountIDTable, []byte(accID))
+		switch {
+		case nosql.IsErrNotFound(err):
+			return nil
+		case err != nil:
+			return errors.Wrapf(err, "error loading orderIDs for account %s", accID)
+		}
+		var oids []string
+		if err := json.Unmarshal(old, &oids); err != nil {
+			return errors.Wrapf(err, "error unmarshaling orderIDs for account %s", accID)
+		}
+		newOids := make([]string, 0, len(oids))
+		for _, id := range oids {
+			if id != oid {
+				newOids = append(newOids, id)
+			}
+		}
+		if len(newOids) == len(oids) {
+			return nil
+		}
+		b, err := json.Marshal(newOids)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling order IDs slice")
+		}
+		_, swapped, err := db.CmpAndSwap(ordersByAccountIDTable, []byte(accID), old, b)
+		if err != nil {
+			return errors.Wrapf(err, "error storing order IDs for account %s", accID)
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return errors.Errorf("error storing order IDs for account %s; order IDs changed since last read", accID)
+}
+
+// deleteEntry deletes an entry if it exists. It returns false if the entry
+// does not exist, e.g. it has been deleted by the cleanup of another CA.
+func deleteEntry(db nosql.DB, table, key []byte) (bool, error) {
+	err := db.Update(&database.Tx{
+		Operations: []*database.TxEntry{
+			{Bucket: table, Key: key, Cmd: database.Get},
+			{Bucket: table, Key: key, Cmd: database.Delete},
+		},
+	})
+	switch {
+	case nosql.IsErrNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, errors.Wrapf(err, "error deleting %s %s", table, key)
+	default:
+		return true, nil
+	}
+}
+
+// scanTable calls fn with the entries of the table until fn returns
+// errStopScan or another error. A table that does not exist is empty.
+func scanTable(db nosql.DB, table []byte, fn func(e *database.Entry) error) error {
+	entries, err := db.List(table)
+	if err == nil {
+		for _, e := range entries {
+			if err = fn(e); err != nil {
+				break
+			}
+		}
+	}
+	switch {
+	case err == nil, err == errStopScan, nosql.IsErrNotFound(err):
+		return nil
+	default:
+		return errors.Wrapf(err, "error listing %s", table)
+	}
+}
@@ -0,0 +1,201 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/nosql"
+)
+
+type cleanupCounter struct {
+	mu      sync.Mutex
+	deleted map[string]int
+}
+
+func (c *cleanupCounter) add(table string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleted[table] += n
+}
+
+func storeJSON(t *testing.T, db nosql.DB, table []byte, key string, v interface{}) {
+	b, err := json.Marshal(v)
+	assert.FatalError(t, err)
+	assert.FatalError(t, db.Set(table, []byte(key), b))
+}
+
+func storeCleanupCert(t *testing.T, db nosql.DB, id string, serial int64, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	assert.FatalError(t, err)
+	storeJSON(t, db, certTable, id, &certificate{ID: id, AccountID: "acc", Leaf: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	assert.FatalError(t, db.Set(certIDBySerialTable, []byte(tmpl.SerialNumber.String()), []byte(id)))
+}
+
+// populateCleanupDB stores expired and live ACME objects, the expired ones
+// are the ones with an "expired" prefix.
+func populateCleanupDB(t *testing.T, db nosql.DB, now time.Time) {
+	expired := now.Add(-48 * time.Hour)
+	live := now.Add(time.Hour)
+
+	storeJSON(t, db, orderTable, "expired-order", &order{ID: "expired-order", AccountID: "acc",
+		Status: StatusValid, Expires: expired, Authorizations: []string{"expired-authz"}})
+	storeJSON(t, db, orderTable, "live-order", &order{ID: "live-order", AccountID: "acc",
+		Status: StatusPending, Expires: live, Authorizations: []string{"referenced-authz"}})
+	storeJSON(t, db, orderTable, "expired-last-order", &order{ID: "expired-last-order", AccountID: "acc2",
+		Status: StatusInvalid, Expires: expired})
+	storeJSON(t, db, ordersByAccountIDTable, "acc", []string{"expired-order", "live-order"})
+	storeJSON(t, db, ordersByAccountIDTable, "acc2", []string{"expired-last-order"})
+
+	// The authorization of the live order is kept even if it has expired.
+	storeJSON(t, db, authzTable, "expired-authz", &baseAuthz{ID: "expired-authz", AccountID: "acc",
+		Expires: expired, Challenges: []string{"expired-ch1", "expired-ch2"}})
+	storeJSON(t, db, authzTable, "referenced-authz", &baseAuthz{ID: "referenced-authz", AccountID: "acc",
+		Expires: expired, Challenges: []string{"referenced-ch"}})
+	storeJSON(t, db, authzTable, "expired-orphan-authz", &baseAuthz{ID: "expired-orphan-authz", AccountID: "acc",
+		Expires: expired, Challenges: []string{"expired-ch3"}})
+	storeJSON(t, db, authzTable, "live-orphan-authz", &baseAuthz{ID: "live-orphan-authz", AccountID: "acc",
+		Expires: live, Challenges: []string{"live-ch"}})
+	for _, id := range []string{"expired-ch1", "expired-ch2", "expired-ch3", "referenced-ch", "live-ch"} {
+		storeJSON(t, db, challengeTable, id, &baseChallenge{ID: id, AccountID: "acc"})
+	}
+
+	storeCleanupCert(t, db, "expired-cert", 1, expired)
+	storeCleanupCert(t, db, "live-cert", 2, live)
+}
+
+func assertKeys(t *testing.T, db nosql.DB, table []byte, want ...string) {
+	t.Helper()
+	entries, err := db.List(table)
+	assert.FatalError(t, err)
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, string(e.Key))
+	}
+	assert.Equals(t, want, keys)
+}
+
+func TestAuthority_Cleanup(t *testing.T) {
+	now := time.Now()
+	db := newMemoryDB(t)
+	populateCleanupDB(t, db, now)
+	a := &Authority{db: db}
+
+	counter := &cleanupCounter{deleted: map[string]int{}}
+	opts := CleanupOptions{Retention: 24 * time.Hour, BatchSize: 1, Deleted: counter.add}
+	assert.FatalError(t, a.Cleanup(context.Background(), now, opts))
+	assert.Equals(t, map[string]int{
+		"acme_orders":     2,
+		"acme_authzs":     2,
+		"acme_challenges": 3,
+		"acme_certs":      1,
+	}, counter.deleted)
+
+	assertKeys(t, db, orderTable, "live-order")
+	assertKeys(t, db, authzTable, "live-orphan-authz", "referenced-authz")
+	assertKeys(t, db, challengeTable, "live-ch", "referenced-ch")
+	assertKeys(t, db, certTable, "live-cert")
+	assertKeys(t, db, certIDBySerialTable, "2")
+
+	oids, err := getOrderIDsByAccount(db, "acc")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"live-order"}, oids)
+	oids, err = getOrderIDsByAccount(db, "acc2")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{}, oids)
+
+	// A new order can be added to the account emptied by the cleanup.
+	o, err := newOrder(db, OrderOptions{AccountID: "acc2",
+		Identifiers: []Identifier{{Type: "dns", Value: "example.com"}}})
+	assert.FatalError(t, err)
+	oids, err = getOrderIDsByAccount(db, "acc2")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{o.ID}, oids)
+
+	// A second cleanup does not delete anything.
+	counter.deleted = map[string]int{}
+	assert.FatalError(t, a.Cleanup(context.Background(), now, opts))
+	assert.Equals(t, map[string]int{}, counter.deleted)
+
+	// The objects within the retention are kept.
+	db = newMemoryDB(t)
+	populateCleanupDB(t, db, now)
+	a = &Authority{db: db}
+	assert.FatalError(t, a.Cleanup(context.Background(), now, CleanupOptions{Retention: 72 * time.Hour}))
+	assertKeys(t, db, orderTable, "expired-last-order", "expired-order", "live-order")
+	assertKeys(t, db, certTable, "expired-cert", "live-cert")
+
+	// A cancelled cleanup stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equals(t, context.Canceled, a.Cleanup(ctx, now, opts))
+}
+
+func TestAuthority_Cleanup_concurrent(t *testing.T) {
+	now := time.Now()
+	db := newMemoryDB(t)
+	populateCleanupDB(t, db, now)
+
+	// Several CAs sharing the database only report the entries they delete.
+	counter := &cleanupCounter{deleted: map[string]int{}}
+	opts := CleanupOptions{Retention: 24 * time.Hour, BatchSize: 1, Deleted: counter.add}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := &Authority{db: db}
+			assert.NoError(t, a.Cleanup(context.Background(), now, opts))
+		}()
+	}
+	wg.Wait()
+	assert.Equals(t, map[string]int{
+		"acme_orders":     2,
+		"acme_authzs":     2,
+		"acme_challenges": 3,
+		"acme_certs":      1,
+	}, counter.deleted)
+	assertKeys(t, db, orderTable, "live-order")
+	oids, err := getOrderIDsByAccount(db, "acc")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"live-order"}, oids)
+}
+
+func TestAuthority_StartCleanup(t *testing.T) {
+	now := time.Now()
+	db := newMemoryDB(t)
+	populateCleanupDB(t, db, now)
+	a := &Authority{db: db}
+
+	counter := &cleanupCounter{deleted: map[string]int{}}
+	stop := a.StartCleanup(CleanupOptions{Interval: time.Millisecond, Retention: 24 * time.Hour, Deleted: counter.add})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		counter.mu.Lock()
+		n := counter.deleted["acme_certs"]
+		counter.mu.Unlock()
+		if n == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	assertKeys(t, db, orderTable, "live-order")
+	assertKeys(t, db, certTable, "live-cert")
+}
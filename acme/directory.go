@@ -15,6 +15,18 @@ type Directory struct {
 	NewAuthz   string `json:"newAuthz,omitempty"`
 	RevokeCert string `json:"revokeCert,omitempty"`
 	KeyChange  string `json:"keyChange,omitempty"`
+	// RenewalInfo is the base URL of the renewal information of the
+	// certificates.
+	RenewalInfo string         `json:"renewalInfo,omitempty"`
+	Meta        *DirectoryMeta `json:"meta,omitempty"`
+}
+
+// DirectoryMeta represents the metadata in the ACME directory.
+type DirectoryMeta struct {
+	TermsOfService          string   `json:"termsOfService,omitempty"`
+	Website                 string   `json:"website,omitempty"`
+	CAAIdentities           []string `json:"caaIdentities,omitempty"`
+	ExternalAccountRequired bool     `json:"externalAccountRequired,omitempty"`
 }
 
 // ToLog enables response logging for the Directory type.
@@ -67,6 +79,8 @@ const (
 	RevokeCertLink
 	// KeyChangeLink key rollover
 	KeyChangeLink
+	// RenewalInfoLink renewal information of a certificate
+	RenewalInfoLink
 )
 
 func (l Link) String() string {
@@ -95,6 +109,8 @@ func (l Link) String() string {
 		return "revoke-cert"
 	case KeyChangeLink:
 		return "key-change"
+	case RenewalInfoLink:
+		return "renewal-info"
 	default:
 		return "unexpected"
 	}
@@ -112,6 +128,12 @@ func (d *directory) getLink(typ Link, provisionerName string, abs bool, inputs .
 		link = fmt.Sprintf("/%s/%s/%s/orders", provisionerName, AccountLink.String(), inputs[0])
 	case FinalizeLink:
 		link = fmt.Sprintf("/%s/%s/%s/finalize", provisionerName, OrderLink.String(), inputs[0])
+	case RenewalInfoLink:
+		// The link without inputs is the base URL in the directory.
+		link = fmt.Sprintf("/%s/%s", provisionerName, typ.String())
+		if len(inputs) > 0 {
+			link += "/" + inputs[0]
+		}
 	}
 	if abs {
 		return fmt.Sprintf("https://%s/%s%s", d.dns, d.prefix, link)
@@ -57,4 +57,7 @@ func TestDirectoryGetLink(t *testing.T) {
 
 	assert.Equals(t, dir.getLink(CertificateLink, provID, true, id), fmt.Sprintf("https://ca.smallstep.com/acme/%s/certificate/1234", provID))
 	assert.Equals(t, dir.getLink(CertificateLink, provID, false, id), fmt.Sprintf("/%s/certificate/1234", provID))
+
+	assert.Equals(t, dir.getLink(RenewalInfoLink, provID, true), fmt.Sprintf("https://ca.smallstep.com/acme/%s/renewal-info", provID))
+	assert.Equals(t, dir.getLink(RenewalInfoLink, provID, false, id), fmt.Sprintf("/%s/renewal-info/1234", provID))
 }
@@ -0,0 +1,289 @@
+package acme
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/jose"
+	"github.com/smallstep/nosql"
+)
+
+// eabHmacKeyLen is the length in bytes of the HMAC keys used in the external
+// account bindings.
+const eabHmacKeyLen = 32
+
+// ExternalAccountKey is the representation of an external account binding
+// (EAB) key used in the admin API. The HMAC key is only returned when the key
+// is created.
+type ExternalAccountKey struct {
+	ID          string    `json:"id"`
+	Provisioner string    `json:"provisioner"`
+	Reference   string    `json:"reference,omitempty"`
+	HmacKey     string    `json:"hmacKey,omitempty"`
+	Status      string    `json:"status"`
+	Accounts    []string  `json:"accounts,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// externalAccountKey is the representation of an EAB key in the database.
+type externalAccountKey struct {
+	ID          string    `json:"id"`
+	Provisioner string    `json:"provisioner"`
+	Reference   string    `json:"reference,omitempty"`
+	HmacKey     []byte    `json:"hmacKey"`
+	Accounts    []string  `json:"accounts,omitempty"`
+	Created     time.Time `json:"created"`
+	Revoked     time.Time `json:"revoked"`
+}
+
+// newExternalAccountKey creates and stores a new EAB key for the provisioner
+// with the given id.
+func newExternalAccountKey(db nosql.DB, provID, reference string) (*externalAccountKey, error) {
+	id, err := randID()
+	if err != nil {
+		return nil, err
+	}
+	hmacKey := make([]byte, eabHmacKeyLen)
+	if _, err := rand.Read(hmacKey); err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error generating external account key"))
+	}
+	k := &externalAccountKey{
+		ID:          id,
+		Provisioner: provID,
+		Reference:   reference,
+		HmacKey:     hmacKey,
+		Created:     clock.Now(),
+	}
+	return k, k.save(db, nil)
+}
+
+// toACME converts the EAB key into the type used in the admin API, the HMAC
+// key is only included if withHmacKey is true.
+func (k *externalAccountKey) toACME(withHmacKey bool) *ExternalAccountKey {
+	eak := &ExternalAccountKey{
+		ID:          k.ID,
+		Provisioner: k.Provisioner,
+		Reference:   k.Reference,
+		Status:      StatusValid,
+		Accounts:    k.Accounts,
+		Created:     k.Created,
+	}
+	if withHmacKey {
+		eak.HmacKey = base64.RawURLEncoding.EncodeToString(k.HmacKey)
+	}
+	if k.isRevoked() {
+		eak.Status = StatusRevoked
+	}
+	return eak
+}
+
+func (k *externalAccountKey) isRevoked() bool {
+	return !k.Revoked.IsZero()
+}
+
+// save writes the EAB key to the database if, and only if, the key has not
+// changed since the last read.
+func (k *externalAccountKey) save(db nosql.DB, old *externalAccountKey) error {
+	var (
+		err  error
+		oldB []byte
+	)
+	if old != nil {
+		if oldB, err = json.Marshal(old); err != nil {
+			return ServerInternalErr(errors.Wrap(err, "error marshaling old external account key"))
+		}
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		return ServerInternalErr(errors.Wrap(err, "error marshaling external account key"))
+	}
+	_, swapped, err := db.CmpAndSwap(externalAccountKeyTable, []byte(k.ID), oldB, b)
+	switch {
+	case err != nil:
+		return ServerInternalErr(errors.Wrap(err, "error storing external account key"))
+	case !swapped:
+		return ServerInternalErr(errors.New("error storing external account key; " +
+			"value has changed since last read"))
+	default:
+		return nil
+	}
+}
+
+// bind adds the account with the given id to the list of accounts bound to
+// the EAB key.
+func (k *externalAccountKey) bind(db nosql.DB, accID string) error {
+	b := *k
+	b.Accounts = append(append([]string{}, k.Accounts...), accID)
+	return b.save(db, k)
+}
+
+// revoke disables the EAB key, the key cannot be used to create new accounts.
+func (k *externalAccountKey) revoke(db nosql.DB) (*externalAccountKey, error) {
+	b := *k
+	b.Revoked = clock.Now()
+	if err := b.save(db, k); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// getExternalAccountKey retrieves the EAB key with the given id.
+func getExternalAccountKey(db nosql.DB, id string) (*externalAccountKey, error) {
+	b, err := db.Get(externalAccountKeyTable, []byte(id))
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return nil, errors.Wrapf(err, "external account key %s not found", id)
+		}
+		return nil, ServerInternalErr(errors.Wrapf(err, "error loading external account key %s", id))
+	}
+	k := new(externalAccountKey)
+	if err := json.Unmarshal(b, k); err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling external account key"))
+	}
+	return k, nil
+}
+
+// getExternalAccountKeys retrieves all the EAB keys of the provisioner with
+// the given id, sorted by creation time.
+func getExternalAccountKeys(db nosql.DB, provID string) ([]*externalAccountKey, error) {
+	entries, err := db.List(externalAccountKeyTable)
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return []*externalAccountKey{}, nil
+		}
+		return nil, ServerInternalErr(errors.Wrap(err, "error loading external account keys"))
+	}
+	keys := []*externalAccountKey{}
+	for _, e := range entries {
+		k := new(externalAccountKey)
+		if err := json.Unmarshal(e.Value, k); err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling external account key"))
+		}
+		if k.Provisioner == provID {
+			keys = append(keys, k)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys, nil
+}
+
+// validateExternalAccountBinding validates the external account binding in
+// the new-account request. It returns the EAB key used if the binding is
+// valid, or nil if the request does not have a binding and the provisioner
+// does not require it.
+//
+// The binding is a JWS signed with the HMAC key, the payload is the account
+// key. The url header, that must match the new-account url, is validated by
+// the API handler.
+func (a *Authority) validateExternalAccountBinding(p provisioner.Interface, ao AccountOptions) (*externalAccountKey, error) {
+	prov, _ := p.(*provisioner.ACME)
+	eab := ao.ExternalAccountBinding
+	if eab == nil {
+		if prov != nil && prov.RequireEAB {
+			return nil, ExternalAccountRequiredErr(errors.New("external account binding is required"))
+		}
+		return nil, nil
+	}
+
+	if len(eab.Signatures) != 1 {
+		return nil, MalformedErr(errors.New("external account binding must have one signature"))
+	}
+	hdr := eab.Signatures[0].Protected
+	switch hdr.Algorithm {
+	case jose.HS256, jose.HS384, jose.HS512:
+	default:
+		return nil, BadSignatureAlgorithmErr(errors.Errorf("unsupported external account binding algorithm: %s", hdr.Algorithm))
+	}
+	if hdr.Nonce != "" {
+		return nil, MalformedErr(errors.New("external account binding must not have a nonce"))
+	}
+
+	k, err := getExternalAccountKey(a.db, hdr.KeyID)
+	switch {
+	case nosql.IsErrNotFound(err):
+		return nil, UnauthorizedErr(err)
+	case err != nil:
+		return nil, err
+	case k.Provisioner != p.GetID():
+		return nil, UnauthorizedErr(errors.Errorf("external account key %s does not belong to provisioner %s", k.ID, p.GetName()))
+	case k.isRevoked():
+		return nil, UnauthorizedErr(errors.Errorf("external account key %s has been revoked", k.ID))
+	case len(k.Accounts) > 0 && (prov == nil || !prov.AllowEABKeyReuse):
+		return nil, UnauthorizedErr(errors.Errorf("external account key %s has already been used", k.ID))
+	}
+
+	payload, err := eab.Verify(k.HmacKey)
+	if err != nil {
+		return nil, UnauthorizedErr(errors.Wrap(err, "error verifying external account binding"))
+	}
+	var key jose.JSONWebKey
+	if err := json.Unmarshal(payload, &key); err != nil {
+		return nil, MalformedErr(errors.Wrap(err, "error unmarshaling external account binding key"))
+	}
+	eabKeyID, err := keyToID(&key)
+	if err != nil {
+		return nil, err
+	}
+	accKeyID, err := keyToID(ao.Key)
+	if err != nil {
+		return nil, err
+	}
+	if eabKeyID != accKeyID {
+		return nil, UnauthorizedErr(errors.New("external account binding key does not match the account key"))
+	}
+	return k, nil
+}
+
+// CreateExternalAccountKey creates a new EAB key for the given provisioner.
+// The reference is an optional string used to identify the key.
+func (a *Authority) CreateExternalAccountKey(p provisioner.Interface, reference string) (*ExternalAccountKey, error) {
+	k, err := newExternalAccountKey(a.db, p.GetID(), reference)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "acme.CreateExternalAccountKey")
+	}
+	return k.toACME(true), nil
+}
+
+// GetExternalAccountKeys returns the EAB keys of the given provisioner and the
+// accounts bound to them.
+func (a *Authority) GetExternalAccountKeys(p provisioner.Interface) ([]*ExternalAccountKey, error) {
+	keys, err := getExternalAccountKeys(a.db, p.GetID())
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "acme.GetExternalAccountKeys")
+	}
+	ret := make([]*ExternalAccountKey, len(keys))
+	for i, k := range keys {
+		ret[i] = k.toACME(false)
+	}
+	return ret, nil
+}
+
+// RevokeExternalAccountKey disables the EAB key with the given id. The key
+// cannot be used to create new accounts, the accounts already bound to it are
+// not modified.
+func (a *Authority) RevokeExternalAccountKey(p provisioner.Interface, id string) (*ExternalAccountKey, error) {
+	k, err := getExternalAccountKey(a.db, id)
+	switch {
+	case nosql.IsErrNotFound(err):
+		return nil, errs.NotFound("acme.RevokeExternalAccountKey; external account key %s not found", id)
+	case err != nil:
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "acme.RevokeExternalAccountKey")
+	case k.Provisioner != p.GetID():
+		return nil, errs.NotFound("acme.RevokeExternalAccountKey; external account key %s not found", id)
+	case k.isRevoked():
+		return k.toACME(false), nil
+	}
+	if k, err = k.revoke(a.db); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "acme.RevokeExternalAccountKey")
+	}
+	return k.toACME(false), nil
+}
@@ -14,6 +14,18 @@ func AccountDoesNotExistErr(err error) *Error {
 	}
 }
 
+// AccountKeyConflictErr returns a new acme error used when the new key of a
+// key-change request is already bound to another account. It is a malformed
+// error with the 409 Conflict status.
+func AccountKeyConflictErr(err error) *Error {
+	return &Error{
+		Type:   malformedErr,
+		Detail: "The new account key is already in use",
+		Status: 409,
+		Err:    err,
+	}
+}
+
 // AlreadyRevokedErr returns a new acme error.
 func AlreadyRevokedErr(err error) *Error {
 	return &Error{
@@ -234,12 +246,13 @@ func UnsupportedIdentifierErr(err error) *Error {
 	}
 }
 
-// UserActionRequiredErr returns a new acme error.
+// UserActionRequiredErr returns a new acme error. RFC8555 sends it with a 403
+// status, e.g. when the terms of service must be agreed.
 func UserActionRequiredErr(err error) *Error {
 	return &Error{
 		Type:   userActionRequiredErr,
 		Detail: "Visit the “instance” URL and take actions specified there",
-		Status: 400,
+		Status: 403,
 		Err:    err,
 	}
 }
@@ -382,6 +395,37 @@ func Wrap(err error, wrap string) *Error {
 	}
 }
 
+// WithIdentifier sets the identifier the error applies to, it is reported in
+// the subproblems of an error.
+func (e *Error) WithIdentifier(id Identifier) *Error {
+	e.Identifier = &id
+	return e
+}
+
+// SubproblemsErr returns the error of an operation on several identifiers, or
+// nil if there are no errors. A single error is returned flat, without its
+// identifier. Several errors become the subproblems of an error of their type
+// if they all have the same one, or of a malformed error otherwise.
+func SubproblemsErr(errs ...*Error) *Error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		errs[0].Identifier = nil
+		return errs[0]
+	}
+	e := MalformedErr(errors.Errorf("%d of the identifiers requested were rejected", len(errs)))
+	sameType := true
+	for _, sub := range errs {
+		sameType = sameType && sub.Type == errs[0].Type
+	}
+	if sameType {
+		e.Type, e.Status = errs[0].Type, errs[0].Status
+	}
+	e.Sub = errs
+	return e
+}
+
 // Error implements the error interface.
 func (e *Error) Error() string {
 	if e.Err == nil {
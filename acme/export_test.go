@@ -0,0 +1,33 @@
+package acme
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+// SetValidateOptions replaces the functions used by the authority to validate
+// the challenges.
+func (a *Authority) SetValidateOptions(httpGet func(string) (*http.Response, error),
+	lookupTxt func(string) ([]string, error),
+	tlsDial func(network, addr string, config *tls.Config) (*tls.Conn, error)) {
+	a.validateOptions = &validateOptions{
+		httpGet:   httpGet,
+		lookupTxt: lookupTxt,
+		tlsDial:   tlsDial,
+	}
+}
+
+// TestDNSServer is the DNS server of the dns-01 tests, it can be used as the
+// resolver of an ACME provisioner.
+type TestDNSServer = testDNSServer
+
+// NewTestDNSServer starts a new DNS server listening on a local UDP port.
+func NewTestDNSServer(t *testing.T) *TestDNSServer {
+	return newTestDNSServer(t)
+}
+
+// SetTXT sets the TXT records of a fully qualified name.
+func (s *testDNSServer) SetTXT(name string, values ...string) {
+	s.setTXT(name, values...)
+}
@@ -14,6 +14,35 @@ import (
 type nonce struct {
 	ID      string
 	Created time.Time
+	Expires time.Time
+}
+
+// nonceTTL is the time an unused nonce is kept. The databases that support
+// expiring keys delete it by themselves, in the rest it is deleted by the
+// cleanup of the authority.
+const nonceTTL = time.Hour
+
+// nonceExpiry returns the expiration of a stored nonce. The nonces stored by
+// previous versions do not have one, and they expire nonceTTL after they were
+// created.
+func nonceExpiry(value []byte) (time.Time, bool) {
+	var n nonce
+	if err := json.Unmarshal(value, &n); err != nil {
+		return time.Time{}, false
+	}
+	switch {
+	case !n.Expires.IsZero():
+		return n.Expires, true
+	case !n.Created.IsZero():
+		return n.Created.Add(nonceTTL), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// ttlDB is implemented by the databases that can store expiring keys.
+type ttlDB interface {
+	SetWithTTL(bucket, key, value []byte, ttl time.Duration) error
 }
 
 // newNonce creates, stores, and returns an ACME replay-nonce.
@@ -24,14 +53,23 @@ func newNonce(db nosql.DB) (*nonce, error) {
 	}
 
 	id := base64.RawURLEncoding.EncodeToString([]byte(_id))
+	now := clock.Now()
 	n := &nonce{
 		ID:      id,
-		Created: clock.Now(),
+		Created: now,
+		Expires: now.Add(nonceTTL),
 	}
 	b, err := json.Marshal(n)
 	if err != nil {
 		return nil, ServerInternalErr(errors.Wrap(err, "error marshaling nonce"))
 	}
+	// The nonces that are never used expire if the database supports it.
+	if tdb, ok := db.(ttlDB); ok {
+		if err := tdb.SetWithTTL(nonceTable, []byte(id), b, nonceTTL); err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error storing nonce"))
+		}
+		return n, nil
+	}
 	_, swapped, err := db.CmpAndSwap(nonceTable, []byte(id), nil, b)
 	switch {
 	case err != nil:
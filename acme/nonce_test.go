@@ -1,6 +1,8 @@
 package acme
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -11,6 +13,16 @@ import (
 	"github.com/smallstep/nosql/database"
 )
 
+// mockTTLDB is a nosql.DB that supports expiring keys.
+type mockTTLDB struct {
+	*db.MockNoSQLDB
+	MSetWithTTL func(bucket, key, value []byte, ttl time.Duration) error
+}
+
+func (m *mockTTLDB) SetWithTTL(bucket, key, value []byte, ttl time.Duration) error {
+	return m.MSetWithTTL(bucket, key, value, ttl)
+}
+
 func TestNewNonce(t *testing.T) {
 	type test struct {
 		db  nosql.DB
@@ -57,6 +69,33 @@ func TestNewNonce(t *testing.T) {
 				id: id,
 			}
 		},
+		"fail/setWithTTL-error": func(t *testing.T) test {
+			return test{
+				db: &mockTTLDB{
+					MockNoSQLDB: &db.MockNoSQLDB{},
+					MSetWithTTL: func(bucket, key, value []byte, ttl time.Duration) error {
+						return errors.New("force")
+					},
+				},
+				err: ServerInternalErr(errors.Errorf("error storing nonce: force")),
+			}
+		},
+		"ok/setWithTTL": func(t *testing.T) test {
+			var _id string
+			id := &_id
+			return test{
+				db: &mockTTLDB{
+					MockNoSQLDB: &db.MockNoSQLDB{},
+					MSetWithTTL: func(bucket, key, value []byte, ttl time.Duration) error {
+						assert.Equals(t, bucket, nonceTable)
+						assert.Equals(t, ttl, nonceTTL)
+						*id = string(key)
+						return nil
+					},
+				},
+				id: id,
+			}
+		},
 	}
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -75,6 +114,7 @@ func TestNewNonce(t *testing.T) {
 
 					assert.True(t, n.Created.Before(time.Now().Add(time.Minute)))
 					assert.True(t, n.Created.After(time.Now().Add(-time.Minute)))
+					assert.Equals(t, n.Created.Add(nonceTTL), n.Expires)
 				}
 			}
 		})
@@ -161,3 +201,40 @@ func TestUseNonce(t *testing.T) {
 		})
 	}
 }
+
+func TestNonceExpiry(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	marshal := func(n *nonce) []byte {
+		b, err := json.Marshal(n)
+		assert.FatalError(t, err)
+		return b
+	}
+
+	exp, ok := nonceExpiry(marshal(&nonce{ID: "new", Created: now, Expires: now.Add(time.Minute)}))
+	assert.True(t, ok)
+	assert.True(t, now.Add(time.Minute).Equal(exp))
+	// The nonces stored by previous versions do not have an expiration.
+	exp, ok = nonceExpiry(marshal(&nonce{ID: "legacy", Created: now}))
+	assert.True(t, ok)
+	assert.True(t, now.Add(nonceTTL).Equal(exp))
+	_, ok = nonceExpiry(marshal(&nonce{ID: "empty"}))
+	assert.False(t, ok)
+	_, ok = nonceExpiry([]byte("foo"))
+	assert.False(t, ok)
+
+	// The cleanup of the authority database deletes the expired nonces.
+	adb := db.NewMemory().(*db.DB)
+	assert.FatalError(t, adb.CreateTable(nonceTable))
+	old := now.Add(-nonceTTL - db.ExpiryLeeway - time.Minute)
+	assert.FatalError(t, adb.Set(nonceTable, []byte("old"), marshal(&nonce{ID: "old", Created: old})))
+	assert.FatalError(t, adb.Set(nonceTable, []byte("fresh"), marshal(&nonce{ID: "fresh", Created: now, Expires: now.Add(nonceTTL)})))
+	deleted := map[string]int{}
+	assert.FatalError(t, adb.DeleteExpired(context.Background(), now, 10, func(table string, n int) {
+		deleted[table] += n
+	}))
+	assert.Equals(t, map[string]int{"nonces": 1}, deleted)
+	entries, err := adb.List(nonceTable)
+	assert.FatalError(t, err)
+	assert.Len(t, 1, entries)
+	assert.Equals(t, []byte("fresh"), entries[0].Key)
+}
@@ -1,9 +1,11 @@
 package acme
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/json"
+	"net"
 	"sort"
 	"strings"
 	"time"
@@ -49,20 +51,25 @@ type OrderOptions struct {
 	Identifiers []Identifier `json:"identifiers"`
 	NotBefore   time.Time    `json:"notBefore"`
 	NotAfter    time.Time    `json:"notAfter"`
+	Challenges  []string     `json:"challenges,omitempty"`
+	// UserData is the template data of the order, it is used when the
+	// certificate is signed.
+	UserData map[string]interface{} `json:"userData,omitempty"`
 }
 
 type order struct {
-	ID             string       `json:"id"`
-	AccountID      string       `json:"accountID"`
-	Created        time.Time    `json:"created"`
-	Expires        time.Time    `json:"expires,omitempty"`
-	Status         string       `json:"status"`
-	Identifiers    []Identifier `json:"identifiers"`
-	NotBefore      time.Time    `json:"notBefore,omitempty"`
-	NotAfter       time.Time    `json:"notAfter,omitempty"`
-	Error          *Error       `json:"error,omitempty"`
-	Authorizations []string     `json:"authorizations"`
-	Certificate    string       `json:"certificate,omitempty"`
+	ID             string                 `json:"id"`
+	AccountID      string                 `json:"accountID"`
+	Created        time.Time              `json:"created"`
+	Expires        time.Time              `json:"expires,omitempty"`
+	Status         string                 `json:"status"`
+	Identifiers    []Identifier           `json:"identifiers"`
+	NotBefore      time.Time              `json:"notBefore,omitempty"`
+	NotAfter       time.Time              `json:"notAfter,omitempty"`
+	Error          *AError                `json:"error,omitempty"`
+	Authorizations []string               `json:"authorizations"`
+	Certificate    string                 `json:"certificate,omitempty"`
+	UserData       map[string]interface{} `json:"userData,omitempty"`
 }
 
 // newOrder returns a new Order type.
@@ -74,7 +81,7 @@ func newOrder(db nosql.DB, ops OrderOptions) (*order, error) {
 
 	authzs := make([]string, len(ops.Identifiers))
 	for i, identifier := range ops.Identifiers {
-		az, err := newAuthz(db, ops.AccountID, identifier)
+		az, err := newAuthz(db, ops.AccountID, identifier, ops.Challenges)
 		if err != nil {
 			return nil, err
 		}
@@ -92,6 +99,7 @@ func newOrder(db nosql.DB, ops OrderOptions) (*order, error) {
 		NotBefore:      ops.NotBefore,
 		NotAfter:       ops.NotAfter,
 		Authorizations: authzs,
+		UserData:       ops.UserData,
 	}
 	if err := o.save(db, nil); err != nil {
 		return nil, err
@@ -129,7 +137,12 @@ func (oids orderIDs) save(db nosql.DB, old orderIDs, accID string) error {
 	if err != nil {
 		return ServerInternalErr(errors.Wrap(err, "error marshaling new order IDs slice"))
 	}
-	_, swapped, err := db.CmpAndSwap(ordersByAccountIDTable, []byte(accID), oldb, newb)
+	cur, swapped, err := db.CmpAndSwap(ordersByAccountIDTable, []byte(accID), oldb, newb)
+	if err == nil && !swapped && len(old) == 0 && isEmptyOrderIDs(cur) {
+		// The cleanup leaves an empty list after deleting the last order of
+		// the account.
+		_, swapped, err = db.CmpAndSwap(ordersByAccountIDTable, []byte(accID), cur, newb)
+	}
 	switch {
 	case err != nil:
 		return ServerInternalErr(errors.Wrapf(err, "error storing order IDs for account %s", accID))
@@ -141,6 +154,11 @@ func (oids orderIDs) save(db nosql.DB, old orderIDs, accID string) error {
 	}
 }
 
+// isEmptyOrderIDs returns true if the stored list of order IDs is empty.
+func isEmptyOrderIDs(b []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(b), []byte("[]"))
+}
+
 func (o *order) save(db nosql.DB, old *order) error {
 	var (
 		err  error
@@ -186,7 +204,7 @@ func (o *order) updateStatus(db nosql.DB) (*order, error) {
 		// check expiry
 		if now.After(o.Expires) {
 			newOrder.Status = StatusInvalid
-			newOrder.Error = MalformedErr(errors.New("order has expired"))
+			newOrder.Error = MalformedErr(errors.New("order has expired")).ToACME()
 			break
 		}
 		return o, nil
@@ -194,7 +212,7 @@ func (o *order) updateStatus(db nosql.DB) (*order, error) {
 		// check expiry
 		if now.After(o.Expires) {
 			newOrder.Status = StatusInvalid
-			newOrder.Error = MalformedErr(errors.New("order has expired"))
+			newOrder.Error = MalformedErr(errors.New("order has expired")).ToACME()
 			break
 		}
 
@@ -234,6 +252,71 @@ func (o *order) updateStatus(db nosql.DB) (*order, error) {
 	return newOrder, nil
 }
 
+// invalidate marks a pending or ready order, and its pending authzs, as
+// invalid with the given reason. Orders in any other state are not modified.
+func (o *order) invalidate(db nosql.DB, reason *Error) (*order, error) {
+	if o.Status != StatusPending && o.Status != StatusReady {
+		return o, nil
+	}
+	for _, azID := range o.Authorizations {
+		az, err := getAuthz(db, azID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = az.invalidate(db, reason); err != nil {
+			return nil, err
+		}
+	}
+
+	_newOrder := *o
+	newOrder := &_newOrder
+	newOrder.Status = StatusInvalid
+	newOrder.Error = reason.ToACME()
+	if err := newOrder.save(db, o); err != nil {
+		return nil, err
+	}
+	return newOrder, nil
+}
+
+// validateAttestedCSR checks that the CSR of a permanent-identifier order only
+// contains the attested key of its device-attest-01 challenge, and, optionally,
+// the permanent identifier as the common name.
+func (o *order) validateAttestedCSR(db nosql.DB, csr *x509.CertificateRequest) error {
+	id := o.Identifiers[0].Value
+	switch {
+	case csr.Subject.CommonName != "" && csr.Subject.CommonName != id:
+		return BadCSRErr(errors.Errorf("CSR common name %s does not match the permanent identifier %s",
+			csr.Subject.CommonName, id))
+	case len(csr.DNSNames) > 0 || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0:
+		return BadCSRErr(errors.New("CSR of a permanent-identifier order cannot contain subject alternative names"))
+	}
+
+	csrKey, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return BadCSRErr(errors.Wrap(err, "error marshaling CSR public key"))
+	}
+	for _, azID := range o.Authorizations {
+		az, err := getAuthz(db, azID)
+		if err != nil {
+			return err
+		}
+		for _, chID := range az.getChallenges() {
+			ch, err := getChallenge(db, chID)
+			if err != nil {
+				return err
+			}
+			if ch.getType() != "device-attest-01" || ch.getStatus() != StatusValid {
+				continue
+			}
+			if !bytes.Equal(ch.getAttestedKey(), csrKey) {
+				return BadCSRErr(errors.New("CSR public key does not match the attested key"))
+			}
+			return nil
+		}
+	}
+	return BadCSRErr(errors.Errorf("order %s does not have a valid device-attest-01 challenge", o.ID))
+}
+
 // finalize signs a certificate if the necessary conditions for Order completion
 // have been met.
 func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAuthority, p provisioner.Interface) (*order, error) {
@@ -254,33 +337,66 @@ func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAut
 		return nil, ServerInternalErr(errors.Errorf("unexpected status %s for order %s", o.Status, o.ID))
 	}
 
-	// RFC8555: The CSR MUST indicate the exact same set of requested
-	// identifiers as the initial newOrder request. Identifiers of type "dns"
-	// MUST appear either in the commonName portion of the requested subject
-	// name or in an extensionRequest attribute [RFC2985] requesting a
-	// subjectAltName extension, or both.
-	if csr.Subject.CommonName != "" {
-		csr.DNSNames = append(csr.DNSNames, csr.Subject.CommonName)
-	}
-	csr.DNSNames = uniqueLowerNames(csr.DNSNames)
-	orderNames := make([]string, len(o.Identifiers))
-	for i, n := range o.Identifiers {
-		orderNames[i] = n.Value
-	}
-	orderNames = uniqueLowerNames(orderNames)
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod)
+	if len(o.Identifiers) == 1 && o.Identifiers[0].Type == "permanent-identifier" {
+		// The key in the CSR must be the attested key, and the permanent
+		// identifier is recorded in the certificate by the provisioner.
+		if err := o.validateAttestedCSR(db, csr); err != nil {
+			return nil, err
+		}
+		ctx = provisioner.NewContextWithPermanentIdentifier(ctx, o.Identifiers[0].Value)
+	} else {
+		// RFC8555: The CSR MUST indicate the exact same set of requested
+		// identifiers as the initial newOrder request. Identifiers of type "dns"
+		// MUST appear either in the commonName portion of the requested subject
+		// name or in an extensionRequest attribute [RFC2985] requesting a
+		// subjectAltName extension, or both.
+		//
+		// RFC8738: Identifiers of type "ip" are signed as iPAddress SANs, a
+		// common name with an IP address is moved to them.
+		if cn := csr.Subject.CommonName; cn != "" {
+			if ip := net.ParseIP(cn); ip != nil {
+				csr.IPAddresses = append(csr.IPAddresses, ip)
+			} else {
+				csr.DNSNames = append(csr.DNSNames, cn)
+			}
+		}
+		csr.DNSNames = uniqueLowerNames(csr.DNSNames)
+		csr.IPAddresses = uniqueIPs(csr.IPAddresses)
+		orderNames := make([]string, 0, len(o.Identifiers))
+		var orderIPs []net.IP
+		for _, n := range o.Identifiers {
+			if n.Type == "ip" {
+				orderIPs = append(orderIPs, net.ParseIP(n.Value))
+			} else {
+				orderNames = append(orderNames, n.Value)
+			}
+		}
+		orderNames = uniqueLowerNames(orderNames)
+		orderIPs = uniqueIPs(orderIPs)
 
-	// Validate identifier names against CSR alternative names.
-	if len(csr.DNSNames) != len(orderNames) {
-		return nil, BadCSRErr(errors.Errorf("CSR names do not match identifiers exactly: CSR names = %v, Order names = %v", csr.DNSNames, orderNames))
-	}
-	for i := range csr.DNSNames {
-		if csr.DNSNames[i] != orderNames[i] {
+		// Validate identifier IP addresses against CSR IP addresses.
+		if len(csr.IPAddresses) != len(orderIPs) {
+			return nil, BadCSRErr(errors.Errorf("CSR IP addresses do not match identifiers exactly: CSR IP addresses = %v, Order IP addresses = %v", csr.IPAddresses, orderIPs))
+		}
+		for i := range csr.IPAddresses {
+			if !csr.IPAddresses[i].Equal(orderIPs[i]) {
+				return nil, BadCSRErr(errors.Errorf("CSR IP addresses do not match identifiers exactly: CSR IP addresses = %v, Order IP addresses = %v", csr.IPAddresses, orderIPs))
+			}
+		}
+
+		// Validate identifier names against CSR alternative names.
+		if len(csr.DNSNames) != len(orderNames) {
 			return nil, BadCSRErr(errors.Errorf("CSR names do not match identifiers exactly: CSR names = %v, Order names = %v", csr.DNSNames, orderNames))
 		}
+		for i := range csr.DNSNames {
+			if csr.DNSNames[i] != orderNames[i] {
+				return nil, BadCSRErr(errors.Errorf("CSR names do not match identifiers exactly: CSR names = %v, Order names = %v", csr.DNSNames, orderNames))
+			}
+		}
 	}
 
 	// Get authorizations from the ACME provisioner.
-	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod)
 	signOps, err := p.AuthorizeSign(ctx, "")
 	if err != nil {
 		return nil, ServerInternalErr(errors.Wrapf(err, "error retrieving authorization options from ACME provisioner"))
@@ -290,6 +406,7 @@ func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAut
 	certChain, err := auth.Sign(csr, provisioner.Options{
 		NotBefore: provisioner.NewTimeDuration(o.NotBefore),
 		NotAfter:  provisioner.NewTimeDuration(o.NotAfter),
+		UserData:  o.UserData,
 	}, signOps...)
 	if err != nil {
 		return nil, ServerInternalErr(errors.Wrapf(err, "error generating certificate for order %s", o.ID))
@@ -341,13 +458,21 @@ func (o *order) toACME(db nosql.DB, dir *directory, p provisioner.Interface) (*O
 		Status:         o.Status,
 		Expires:        o.Expires.Format(time.RFC3339),
 		Identifiers:    o.Identifiers,
-		NotBefore:      o.NotBefore.Format(time.RFC3339),
-		NotAfter:       o.NotAfter.Format(time.RFC3339),
 		Authorizations: azs,
 		Finalize:       dir.getLink(FinalizeLink, URLSafeProvisionerName(p), true, o.ID),
 		ID:             o.ID,
 	}
+	// The validity is only present if it was requested in the new-order.
+	if !o.NotBefore.IsZero() {
+		ao.NotBefore = o.NotBefore.Format(time.RFC3339)
+	}
+	if !o.NotAfter.IsZero() {
+		ao.NotAfter = o.NotAfter.Format(time.RFC3339)
+	}
 
+	if o.Error != nil {
+		ao.Error = o.Error
+	}
 	if o.Certificate != "" {
 		ao.Certificate = dir.getLink(CertificateLink, URLSafeProvisionerName(p), true, o.Certificate)
 	}
@@ -369,3 +494,20 @@ func uniqueLowerNames(names []string) (unique []string) {
 	sort.Strings(unique)
 	return
 }
+
+// uniqueIPs returns the set of unique IP addresses sorted by their 16-byte
+// form, an IPv4 address in its 4 or 16-byte form is the same address.
+func uniqueIPs(ips []net.IP) (unique []net.IP) {
+	ipMap := make(map[string]net.IP, len(ips))
+	for _, ip := range ips {
+		ipMap[string(ip.To16())] = ip
+	}
+	unique = make([]net.IP, 0, len(ipMap))
+	for _, ip := range ipMap {
+		unique = append(unique, ip)
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		return bytes.Compare(unique[i].To16(), unique[j].To16()) < 0
+	})
+	return
+}
@@ -6,13 +6,16 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/nosql"
 	"github.com/smallstep/nosql/database"
 )
@@ -618,7 +621,7 @@ func TestOrderUpdateStatus(t *testing.T) {
 
 			_o := *o
 			clone := &_o
-			clone.Error = MalformedErr(errors.New("order has expired"))
+			clone.Error = MalformedErr(errors.New("order has expired")).ToACME()
 			clone.Status = StatusInvalid
 			return test{
 				o:   o,
@@ -827,6 +830,10 @@ func TestOrderUpdateStatus(t *testing.T) {
 type mockSignAuth struct {
 	sign                func(csr *x509.CertificateRequest, signOpts provisioner.Options, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
 	loadProvisionerByID func(string) (provisioner.Interface, error)
+	intermediate        *x509.Certificate
+	getCertificate      func(serial string) (*authority.CertificateInfo, error)
+	isRevoked           func(serial string) (bool, error)
+	revoke              func(context.Context, *authority.RevokeOptions) error
 	ret1, ret2          interface{}
 	err                 error
 }
@@ -847,6 +854,31 @@ func (m *mockSignAuth) LoadProvisionerByID(id string) (provisioner.Interface, er
 	return m.ret1.(provisioner.Interface), m.err
 }
 
+func (m *mockSignAuth) GetIntermediateCertificate() *x509.Certificate {
+	return m.intermediate
+}
+
+func (m *mockSignAuth) GetCertificate(serial string) (*authority.CertificateInfo, error) {
+	if m.getCertificate != nil {
+		return m.getCertificate(serial)
+	}
+	return nil, errs.NotImplemented("the database does not support certificate lookups")
+}
+
+func (m *mockSignAuth) IsRevoked(serial string) (bool, error) {
+	if m.isRevoked != nil {
+		return m.isRevoked(serial)
+	}
+	return false, m.err
+}
+
+func (m *mockSignAuth) Revoke(ctx context.Context, opts *authority.RevokeOptions) error {
+	if m.revoke != nil {
+		return m.revoke(ctx, opts)
+	}
+	return m.err
+}
+
 func TestOrderFinalize(t *testing.T) {
 	prov := newProv()
 	type test struct {
@@ -1201,6 +1233,98 @@ func TestOrderFinalize(t *testing.T) {
 				},
 			}
 		},
+		"fail/ready/csr-ips-match-error": func(t *testing.T) test {
+			o, err := newO()
+			assert.FatalError(t, err)
+			o.Status = StatusReady
+			o.Identifiers = []Identifier{
+				{Type: "ip", Value: "10.0.0.1"},
+			}
+
+			csr := &x509.CertificateRequest{
+				IPAddresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+			}
+			return test{
+				o:   o,
+				csr: csr,
+				err: BadCSRErr(errors.Errorf("CSR IP addresses do not match identifiers exactly")),
+			}
+		},
+		"fail/ready/csr-ip-as-dns-name": func(t *testing.T) test {
+			o, err := newO()
+			assert.FatalError(t, err)
+			o.Status = StatusReady
+			o.Identifiers = []Identifier{
+				{Type: "ip", Value: "10.0.0.1"},
+			}
+
+			csr := &x509.CertificateRequest{
+				DNSNames:    []string{"10.0.0.1"},
+				IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+			}
+			return test{
+				o:   o,
+				csr: csr,
+				err: BadCSRErr(errors.Errorf("CSR names do not match identifiers exactly")),
+			}
+		},
+		"ok/ready/ips": func(t *testing.T) test {
+			o, err := newO()
+			assert.FatalError(t, err)
+			o.Status = StatusReady
+			o.Identifiers = []Identifier{
+				{Type: "dns", Value: "step.example.com"},
+				{Type: "ip", Value: "2001:db8::1"},
+				{Type: "ip", Value: "10.0.0.1"},
+			}
+
+			// The IP address in the common name is signed as an IP SAN.
+			csr := &x509.CertificateRequest{
+				Subject: pkix.Name{
+					CommonName: "10.0.0.1",
+				},
+				DNSNames:    []string{"step.example.com"},
+				IPAddresses: []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1").To4()},
+			}
+			crt := &x509.Certificate{
+				Subject: pkix.Name{
+					CommonName: "10.0.0.1",
+				},
+			}
+			inter := &x509.Certificate{
+				Subject: pkix.Name{
+					CommonName: "intermediate",
+				},
+			}
+
+			clone := *o
+			clone.Status = StatusValid
+			count := 0
+			return test{
+				o:   o,
+				res: &clone,
+				csr: csr,
+				sa: &mockSignAuth{
+					sign: func(csr *x509.CertificateRequest, pops provisioner.Options, signOps ...provisioner.SignOption) ([]*x509.Certificate, error) {
+						assert.Equals(t, []string{"step.example.com"}, csr.DNSNames)
+						if assert.Len(t, 2, csr.IPAddresses) {
+							assert.True(t, csr.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")))
+							assert.True(t, csr.IPAddresses[1].Equal(net.ParseIP("2001:db8::1")))
+						}
+						return []*x509.Certificate{crt, inter}, nil
+					},
+				},
+				db: &db.MockNoSQLDB{
+					MCmpAndSwap: func(bucket, key, old, newval []byte) ([]byte, bool, error) {
+						if count == 0 {
+							clone.Certificate = string(key)
+						}
+						count++
+						return nil, true, nil
+					},
+				},
+			}
+		},
 		"ok/ready/sans-and-name": func(t *testing.T) test {
 			o, err := newO()
 			assert.FatalError(t, err)
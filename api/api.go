@@ -19,10 +19,12 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/admin"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/logging"
-	"github.com/smallstep/cli/crypto/tlsutil"
+	"github.com/smallstep/certificates/ratelimit"
+	"github.com/smallstep/cli/jose"
 )
 
 // Authority is the interface implemented by a CA authority.
@@ -31,9 +33,10 @@ type Authority interface {
 	// context specifies the Authorize[Sign|Revoke|etc.] method.
 	Authorize(ctx context.Context, ott string) ([]provisioner.SignOption, error)
 	AuthorizeSign(ott string) ([]provisioner.SignOption, error)
-	GetTLSOptions() *tlsutil.TLSOptions
+	GetTLSOptions() *authority.TLSOptions
 	Root(shasum string) (*x509.Certificate, error)
 	Sign(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
+	SignWithContext(ctx context.Context, cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
 	Renew(peer *x509.Certificate) ([]*x509.Certificate, error)
 	LoadProvisionerByCertificate(*x509.Certificate) (provisioner.Interface, error)
 	LoadProvisionerByID(string) (provisioner.Interface, error)
@@ -43,6 +46,13 @@ type Authority interface {
 	GetRoots() (federation []*x509.Certificate, err error)
 	GetFederation() ([]*x509.Certificate, error)
 	Version() authority.Version
+	Health() *authority.Health
+	HealthErrors() map[string]string
+	AuthorizeAdmin(ctx context.Context, token string) (*admin.Admin, error)
+	IsRevoked(serial string) (bool, error)
+	GetCertificate(serial string) (*authority.CertificateInfo, error)
+	GetCertificatesBySAN(san string, status authority.CertificateStatus, cursor string, limit int) ([]*authority.CertificateInfo, string, error)
+	GetCRL() ([]byte, error)
 }
 
 // TimeDuration is an alias of provisioner.TimeDuration
@@ -195,12 +205,16 @@ type RouterHandler interface {
 // server.
 type VersionResponse struct {
 	Version                     string `json:"version"`
+	GitCommit                   string `json:"gitCommit,omitempty"`
+	BuildTime                   string `json:"buildTime,omitempty"`
+	GoVersion                   string `json:"goVersion,omitempty"`
 	RequireClientAuthentication bool   `json:"requireClientAuthentication,omitempty"`
 }
 
 // HealthResponse is the response object that returns the health of the server.
 type HealthResponse struct {
-	Status string `json:"status"`
+	Status     string                           `json:"status"`
+	Components map[string]authority.HealthCheck `json:"components,omitempty"`
 }
 
 // RootResponse is the response object that returns the PEM of a root certificate.
@@ -233,34 +247,111 @@ type FederationResponse struct {
 
 // caHandler is the type used to implement the different CA HTTP endpoints.
 type caHandler struct {
-	Authority Authority
+	Authority          Authority
+	ipLimiter          *ratelimit.Limiter
+	concurrencyLimiter *ratelimit.ConcurrencyLimiter
+	retryAfter         time.Duration
+	cors               *cors
+	renewGracePeriod   time.Duration
+}
+
+// Option is the type of options passed to the API constructor.
+type Option func(h *caHandler)
+
+// WithUnauthenticatedRateLimit sets the limiter used by client IP in the
+// endpoints that do not require a token.
+func WithUnauthenticatedRateLimit(l *ratelimit.Limiter) Option {
+	return func(h *caHandler) {
+		h.ipLimiter = l
+	}
+}
+
+// WithConcurrencyLimit sets the limiter of sign and renew requests in flight,
+// retryAfter is the time the requests shed are asked to wait.
+func WithConcurrencyLimit(l *ratelimit.ConcurrencyLimiter, retryAfter time.Duration) Option {
+	return func(h *caHandler) {
+		h.concurrencyLimiter = l
+		h.retryAfter = retryAfter
+	}
+}
+
+// WithCORS enables the CORS headers in the read only endpoints and in the
+// endpoints added in the configuration.
+func WithCORS(c *authority.CORSConfig) Option {
+	return func(h *caHandler) {
+		h.cors = newCORS(c)
+	}
+}
+
+// WithRenewGracePeriod allows the renewal using mTLS of certificates that have
+// expired less than the given duration ago.
+func WithRenewGracePeriod(d time.Duration) Option {
+	return func(h *caHandler) {
+		h.renewGracePeriod = d
+	}
 }
 
 // New creates a new RouterHandler with the CA endpoints.
-func New(authority Authority) RouterHandler {
-	return &caHandler{
+func New(authority Authority, opts ...Option) RouterHandler {
+	h := &caHandler{
 		Authority: authority,
 	}
+	for _, fn := range opts {
+		fn(h)
+	}
+	return h
+}
+
+// insecureHandler is the type used to implement the endpoints served over
+// plain HTTP.
+type insecureHandler struct {
+	*caHandler
+}
+
+// NewInsecure creates a new RouterHandler with the CA endpoints that can be
+// served over plain HTTP, the root certificate by fingerprint and the health.
+// The rest of the endpoints, like sign, renew or revoke, must only be served
+// over TLS.
+func NewInsecure(authority Authority, opts ...Option) RouterHandler {
+	return &insecureHandler{
+		caHandler: New(authority, opts...).(*caHandler),
+	}
+}
+
+func (h *insecureHandler) Route(r Router) {
+	if h.cors != nil {
+		r = h.cors.router(r)
+	}
+	r.MethodFunc("GET", "/health", h.limitByIP(h.Health))
+	r.MethodFunc("GET", "/root/{sha}", h.limitByIP(h.Root))
 }
 
 func (h *caHandler) Route(r Router) {
-	r.MethodFunc("GET", "/version", h.Version)
-	r.MethodFunc("GET", "/health", h.Health)
-	r.MethodFunc("GET", "/root/{sha}", h.Root)
-	r.MethodFunc("POST", "/sign", h.Sign)
-	r.MethodFunc("POST", "/renew", h.Renew)
+	if h.cors != nil {
+		r = h.cors.router(r)
+	}
+	r.MethodFunc("GET", "/version", h.limitByIP(h.Version))
+	r.MethodFunc("GET", "/health", h.limitByIP(h.Health))
+	r.MethodFunc("GET", "/root/{sha}", h.limitByIP(h.Root))
+	r.MethodFunc("POST", "/sign", h.limitConcurrency(h.Sign))
+	r.MethodFunc("POST", "/renew", h.limitConcurrency(h.Renew))
 	r.MethodFunc("POST", "/revoke", h.Revoke)
-	r.MethodFunc("GET", "/provisioners", h.Provisioners)
-	r.MethodFunc("GET", "/provisioners/{kid}/encrypted-key", h.ProvisionerKey)
-	r.MethodFunc("GET", "/roots", h.Roots)
-	r.MethodFunc("GET", "/federation", h.Federation)
+	r.MethodFunc("GET", "/crl", h.limitByIP(h.CRL))
+	r.MethodFunc("GET", "/provisioners", h.limitByIP(h.Provisioners))
+	r.MethodFunc("GET", "/provisioners/{kid}/encrypted-key", h.limitByIP(h.ProvisionerKey))
+	r.MethodFunc("GET", "/roots", h.limitByIP(h.Roots))
+	r.MethodFunc("GET", "/roots.pem", h.limitByIP(h.RootsPEM))
+	r.MethodFunc("GET", "/federation", h.limitByIP(h.Federation))
+	r.MethodFunc("GET", "/certificates", h.Certificates)
+	r.MethodFunc("GET", "/certificates/{serial}", h.Certificate)
 	// SSH CA
-	r.MethodFunc("POST", "/ssh/sign", h.SSHSign)
-	r.MethodFunc("POST", "/ssh/renew", h.SSHRenew)
+	r.MethodFunc("POST", "/ssh/sign", h.limitConcurrency(h.SSHSign))
+	r.MethodFunc("POST", "/ssh/renew", h.limitConcurrency(h.SSHRenew))
 	r.MethodFunc("POST", "/ssh/revoke", h.SSHRevoke)
-	r.MethodFunc("POST", "/ssh/rekey", h.SSHRekey)
-	r.MethodFunc("GET", "/ssh/roots", h.SSHRoots)
-	r.MethodFunc("GET", "/ssh/federation", h.SSHFederation)
+	r.MethodFunc("GET", "/ssh/revoked", h.limitByIP(h.SSHRevoked))
+	r.MethodFunc("POST", "/ssh/rekey", h.limitConcurrency(h.SSHRekey))
+	r.MethodFunc("GET", "/ssh/roots", h.limitByIP(h.SSHRoots))
+	r.MethodFunc("GET", "/ssh/federation", h.limitByIP(h.SSHFederation))
 	r.MethodFunc("POST", "/ssh/config", h.SSHConfig)
 	r.MethodFunc("POST", "/ssh/config/{type}", h.SSHConfig)
 	r.MethodFunc("POST", "/ssh/check-host", h.SSHCheckHost)
@@ -268,8 +359,8 @@ func (h *caHandler) Route(r Router) {
 	r.MethodFunc("POST", "/ssh/bastion", h.SSHBastion)
 
 	// For compatibility with old code:
-	r.MethodFunc("POST", "/re-sign", h.Renew)
-	r.MethodFunc("POST", "/sign-ssh", h.SSHSign)
+	r.MethodFunc("POST", "/re-sign", h.limitConcurrency(h.Renew))
+	r.MethodFunc("POST", "/sign-ssh", h.limitConcurrency(h.SSHSign))
 	r.MethodFunc("GET", "/ssh/get-hosts", h.SSHGetHosts)
 }
 
@@ -278,13 +369,27 @@ func (h *caHandler) Version(w http.ResponseWriter, r *http.Request) {
 	v := h.Authority.Version()
 	JSON(w, VersionResponse{
 		Version:                     v.Version,
+		GitCommit:                   v.GitCommit,
+		BuildTime:                   v.BuildTime,
+		GoVersion:                   v.GoVersion,
 		RequireClientAuthentication: v.RequireClientAuthentication,
 	})
 }
 
-// Health is an HTTP handler that returns the status of the server.
+// Health is an HTTP handler that returns the status of the server and its
+// components. It returns a 503 Service Unavailable if the authority is down,
+// a degraded authority can still issue certificates.
 func (h *caHandler) Health(w http.ResponseWriter, r *http.Request) {
-	JSON(w, HealthResponse{Status: "ok"})
+	health := h.Authority.Health()
+	status := http.StatusOK
+	if health.IsDown() {
+		status = http.StatusServiceUnavailable
+	}
+	logHealthErrors(w, h.Authority.HealthErrors())
+	JSONStatus(w, HealthResponse{
+		Status:     health.Status,
+		Components: health.Components,
+	}, status)
 }
 
 // Root is an HTTP handler that using the SHA256 from the URL, returns the root
@@ -310,7 +415,8 @@ func certChainToPEM(certChain []*x509.Certificate) []Certificate {
 	return certChainPEM
 }
 
-// Provisioners returns the list of provisioners configured in the authority.
+// Provisioners returns the list of provisioners configured in the authority,
+// without their secrets.
 func (h *caHandler) Provisioners(w http.ResponseWriter, r *http.Request) {
 	cursor, limit, err := parseCursor(r)
 	if err != nil {
@@ -324,12 +430,14 @@ func (h *caHandler) Provisioners(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	JSON(w, &ProvisionersResponse{
-		Provisioners: p,
+		Provisioners: p.Public(),
 		NextCursor:   next,
 	})
 }
 
-// ProvisionerKey returns the encrypted key of a provisioner by it's key id.
+// ProvisionerKey returns the encrypted key of a provisioner by it's key id. The
+// endpoint does not require authentication, the key is encrypted with the
+// password of the provisioner.
 func (h *caHandler) ProvisionerKey(w http.ResponseWriter, r *http.Request) {
 	kid := chi.URLParam(r, "kid")
 	key, err := h.Authority.GetEncryptedKey(kid)
@@ -337,16 +445,28 @@ func (h *caHandler) ProvisionerKey(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, errs.NotFoundErr(err))
 		return
 	}
+	// The response can be stored by caches, but keys can be rotated and
+	// removed, so the caches must revalidate it.
+	w.Header().Set("Cache-Control", "no-cache")
 	JSON(w, &ProvisionerKeyResponse{key})
 }
 
-// Roots returns all the root certificates for the CA.
+// Roots returns all the root certificates for the CA. It requires a client
+// certificate.
 func (h *caHandler) Roots(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		WriteError(w, errs.Unauthorized("missing peer certificate"))
+		return
+	}
 	roots, err := h.Authority.GetRoots()
 	if err != nil {
 		WriteError(w, errs.ForbiddenErr(err))
 		return
 	}
+	if _, err := h.verifyPeerCertificate(r.TLS, 0); err != nil {
+		WriteError(w, err)
+		return
+	}
 
 	certs := make([]Certificate, len(roots))
 	for i := range roots {
@@ -358,13 +478,42 @@ func (h *caHandler) Roots(w http.ResponseWriter, r *http.Request) {
 	}, http.StatusCreated)
 }
 
-// Federation returns all the public certificates in the federation.
+// RootsPEM returns all the root certificates for the CA as a PEM bundle.
+func (h *caHandler) RootsPEM(w http.ResponseWriter, r *http.Request) {
+	roots, err := h.Authority.GetRoots()
+	if err != nil {
+		WriteError(w, errs.InternalServerErr(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	for _, root := range roots {
+		if err := pem.Encode(w, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: root.Raw,
+		}); err != nil {
+			LogError(w, err)
+			return
+		}
+	}
+}
+
+// Federation returns all the public certificates in the federation. It
+// requires a client certificate.
 func (h *caHandler) Federation(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		WriteError(w, errs.Unauthorized("missing peer certificate"))
+		return
+	}
 	federated, err := h.Authority.GetFederation()
 	if err != nil {
 		WriteError(w, errs.ForbiddenErr(err))
 		return
 	}
+	if _, err := h.verifyPeerCertificate(r.TLS, 0); err != nil {
+		WriteError(w, err)
+		return
+	}
 
 	certs := make([]Certificate, len(federated))
 	for i := range federated {
@@ -384,11 +533,17 @@ type stepProvisioner struct {
 	CredentialID []byte
 }
 
+// logOtt adds the token and, if present, the key id in the token header to the
+// log entry. The token is not validated.
 func logOtt(w http.ResponseWriter, token string) {
 	if rl, ok := w.(logging.ResponseLogger); ok {
-		rl.WithFields(map[string]interface{}{
+		m := map[string]interface{}{
 			"ott": token,
-		})
+		}
+		if jwt, err := jose.ParseSigned(token); err == nil && len(jwt.Headers) > 0 && jwt.Headers[0].KeyID != "" {
+			m["kid"] = jwt.Headers[0].KeyID
+		}
+		rl.WithFields(m)
 	}
 }
 
@@ -418,6 +573,26 @@ func logCertificate(w http.ResponseWriter, cert *x509.Certificate) {
 	}
 }
 
+// logTemplate adds the source of the x509 template rendered by the sign
+// options to the log entry.
+func logTemplate(w http.ResponseWriter, signOpts []provisioner.SignOption) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		rl.WithFields(map[string]interface{}{
+			"template": provisioner.X509TemplateSource(signOpts),
+		})
+	}
+}
+
+// logHealthErrors adds the errors found by the health checks to the log entry,
+// the health response only contains a generic description of them.
+func logHealthErrors(w http.ResponseWriter, errs map[string]string) {
+	if rl, ok := w.(logging.ResponseLogger); ok && len(errs) > 0 {
+		rl.WithFields(map[string]interface{}{
+			"health-errors": errs,
+		})
+	}
+}
+
 func parseCursor(r *http.Request) (cursor string, limit int, err error) {
 	q := r.URL.Query()
 	cursor = q.Get("cursor")
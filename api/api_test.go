@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -27,12 +28,14 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/admin"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/logging"
+	"github.com/smallstep/certificates/ratelimit"
 	"github.com/smallstep/certificates/sshutil"
 	"github.com/smallstep/certificates/templates"
-	"github.com/smallstep/cli/crypto/tlsutil"
 	"github.com/smallstep/cli/jose"
 	"golang.org/x/crypto/ssh"
 )
@@ -424,6 +427,17 @@ func TestSignRequest_Validate(t *testing.T) {
 			}
 		})
 	}
+
+	s := &SignRequest{CsrPEM: CertificateRequest{csr}, OTT: "foobarzar", TemplateData: []byte(`{"deploymentID": "d-1234"}`)}
+	assert.FatalError(t, s.Validate())
+	assert.Equals(t, map[string]interface{}{"deploymentID": "d-1234"}, s.userData)
+
+	s.TemplateData = []byte(`{"deploymentID": "` + strings.Repeat("a", provisioner.MaxUserDataSize) + `"}`)
+	err := s.Validate()
+	if assert.Error(t, err) {
+		assert.HasPrefix(t, err.Error(), "invalid templateData: templateData cannot be larger than 4096 bytes")
+		assert.Equals(t, http.StatusBadRequest, err.(errs.StatusCoder).StatusCode())
+	}
 }
 
 type mockProvisioner struct {
@@ -434,6 +448,7 @@ type mockProvisioner struct {
 	getName            func() string
 	getType            func() provisioner.Type
 	getEncryptedKey    func() (string, string, bool)
+	isDisabled         func() bool
 	init               func(provisioner.Config) error
 	authorizeRenew     func(ctx context.Context, cert *x509.Certificate) error
 	authorizeRevoke    func(ctx context.Context, token string) error
@@ -483,6 +498,13 @@ func (m *mockProvisioner) GetEncryptedKey() (string, string, bool) {
 	return m.ret1.(string), m.ret2.(string), m.ret3.(bool)
 }
 
+func (m *mockProvisioner) IsDisabled() bool {
+	if m.isDisabled != nil {
+		return m.isDisabled()
+	}
+	return false
+}
+
 func (m *mockProvisioner) Init(c provisioner.Config) error {
 	if m.init != nil {
 		return m.init(c)
@@ -546,8 +568,9 @@ func (m *mockProvisioner) AuthorizeSSHRekey(ctx context.Context, token string) (
 type mockAuthority struct {
 	ret1, ret2                   interface{}
 	err                          error
+	authorize                    func(ctx context.Context, ott string) ([]provisioner.SignOption, error)
 	authorizeSign                func(ott string) ([]provisioner.SignOption, error)
-	getTLSOptions                func() *tlsutil.TLSOptions
+	getTLSOptions                func() *authority.TLSOptions
 	root                         func(shasum string) (*x509.Certificate, error)
 	sign                         func(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
 	signSSH                      func(key ssh.PublicKey, opts provisioner.SSHOptions, signOpts ...provisioner.SignOption) (*ssh.Certificate, error)
@@ -568,11 +591,22 @@ type mockAuthority struct {
 	getSSHConfig                 func(typ string, data map[string]string) ([]templates.Output, error)
 	checkSSHHost                 func(ctx context.Context, principal, token string) (bool, error)
 	getSSHBastion                func(user string, hostname string) (*authority.Bastion, error)
+	getSSHRevocations            func() ([]*db.RevokedCertificateInfo, error)
 	version                      func() authority.Version
+	health                       func() *authority.Health
+	healthErrors                 func() map[string]string
+	authorizeAdmin               func(ctx context.Context, token string) (*admin.Admin, error)
+	isRevoked                    func(serial string) (bool, error)
+	getCertificate               func(serial string) (*authority.CertificateInfo, error)
+	getCertificatesBySAN         func(san string, status authority.CertificateStatus, cursor string, limit int) ([]*authority.CertificateInfo, string, error)
+	getCRL                       func() ([]byte, error)
 }
 
 // TODO: remove once Authorize is deprecated.
 func (m *mockAuthority) Authorize(ctx context.Context, ott string) ([]provisioner.SignOption, error) {
+	if m.authorize != nil {
+		return m.authorize(ctx, ott)
+	}
 	return m.AuthorizeSign(ott)
 }
 
@@ -583,11 +617,11 @@ func (m *mockAuthority) AuthorizeSign(ott string) ([]provisioner.SignOption, err
 	return m.ret1.([]provisioner.SignOption), m.err
 }
 
-func (m *mockAuthority) GetTLSOptions() *tlsutil.TLSOptions {
+func (m *mockAuthority) GetTLSOptions() *authority.TLSOptions {
 	if m.getTLSOptions != nil {
 		return m.getTLSOptions()
 	}
-	return m.ret1.(*tlsutil.TLSOptions)
+	return m.ret1.(*authority.TLSOptions)
 }
 
 func (m *mockAuthority) Root(shasum string) (*x509.Certificate, error) {
@@ -604,6 +638,10 @@ func (m *mockAuthority) Sign(cr *x509.CertificateRequest, opts provisioner.Optio
 	return []*x509.Certificate{m.ret1.(*x509.Certificate), m.ret2.(*x509.Certificate)}, m.err
 }
 
+func (m *mockAuthority) SignWithContext(ctx context.Context, cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+	return m.Sign(cr, opts, signOpts...)
+}
+
 func (m *mockAuthority) SignSSH(key ssh.PublicKey, opts provisioner.SSHOptions, signOpts ...provisioner.SignOption) (*ssh.Certificate, error) {
 	if m.signSSH != nil {
 		return m.signSSH(key, opts, signOpts...)
@@ -730,6 +768,13 @@ func (m *mockAuthority) GetSSHBastion(user string, hostname string) (*authority.
 	return m.ret1.(*authority.Bastion), m.err
 }
 
+func (m *mockAuthority) GetSSHRevocations() ([]*db.RevokedCertificateInfo, error) {
+	if m.getSSHRevocations != nil {
+		return m.getSSHRevocations()
+	}
+	return m.ret1.([]*db.RevokedCertificateInfo), m.err
+}
+
 func (m *mockAuthority) Version() authority.Version {
 	if m.version != nil {
 		return m.version()
@@ -737,6 +782,55 @@ func (m *mockAuthority) Version() authority.Version {
 	return m.ret1.(authority.Version)
 }
 
+func (m *mockAuthority) Health() *authority.Health {
+	if m.health != nil {
+		return m.health()
+	}
+	return &authority.Health{Status: authority.HealthOK}
+}
+
+func (m *mockAuthority) HealthErrors() map[string]string {
+	if m.healthErrors != nil {
+		return m.healthErrors()
+	}
+	return nil
+}
+
+func (m *mockAuthority) AuthorizeAdmin(ctx context.Context, token string) (*admin.Admin, error) {
+	if m.authorizeAdmin != nil {
+		return m.authorizeAdmin(ctx, token)
+	}
+	return m.ret1.(*admin.Admin), m.err
+}
+
+func (m *mockAuthority) IsRevoked(serial string) (bool, error) {
+	if m.isRevoked != nil {
+		return m.isRevoked(serial)
+	}
+	return m.ret1.(bool), m.err
+}
+
+func (m *mockAuthority) GetCertificate(serial string) (*authority.CertificateInfo, error) {
+	if m.getCertificate != nil {
+		return m.getCertificate(serial)
+	}
+	return m.ret1.(*authority.CertificateInfo), m.err
+}
+
+func (m *mockAuthority) GetCertificatesBySAN(san string, status authority.CertificateStatus, cursor string, limit int) ([]*authority.CertificateInfo, string, error) {
+	if m.getCertificatesBySAN != nil {
+		return m.getCertificatesBySAN(san, status, cursor, limit)
+	}
+	return m.ret1.([]*authority.CertificateInfo), m.ret2.(string), m.err
+}
+
+func (m *mockAuthority) GetCRL() ([]byte, error) {
+	if m.getCRL != nil {
+		return m.getCRL()
+	}
+	return m.ret1.([]byte), m.err
+}
+
 func Test_caHandler_Route(t *testing.T) {
 	type fields struct {
 		Authority Authority
@@ -761,6 +855,36 @@ func Test_caHandler_Route(t *testing.T) {
 	}
 }
 
+func Test_caHandler_Version(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/version", nil)
+	w := httptest.NewRecorder()
+	h := New(&mockAuthority{
+		ret1: authority.Version{
+			Version:                     "1.2.3",
+			GitCommit:                   "abcdef0",
+			BuildTime:                   "2020-01-01 00:00 UTC",
+			GoVersion:                   "go1.14",
+			RequireClientAuthentication: true,
+		},
+	}).(*caHandler)
+	h.Version(w, req)
+
+	res := w.Result()
+	if res.StatusCode != 200 {
+		t.Errorf("caHandler.Version StatusCode = %d, wants 200", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Errorf("caHandler.Version unexpected error = %v", err)
+	}
+	expected := []byte(`{"version":"1.2.3","gitCommit":"abcdef0","buildTime":"2020-01-01 00:00 UTC","goVersion":"go1.14","requireClientAuthentication":true}` + "\n")
+	if !bytes.Equal(body, expected) {
+		t.Errorf("caHandler.Version Body = %s, wants %s", body, expected)
+	}
+}
+
 func Test_caHandler_Health(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://example.com/health", nil)
 	w := httptest.NewRecorder()
@@ -783,6 +907,132 @@ func Test_caHandler_Health(t *testing.T) {
 	}
 }
 
+func Test_caHandler_Health_failing(t *testing.T) {
+	tests := []struct {
+		name       string
+		health     *authority.Health
+		statusCode int
+		expected   string
+	}{
+		{"degraded", &authority.Health{
+			Status: authority.HealthDegraded,
+			Components: map[string]authority.HealthCheck{
+				"config": {Status: authority.HealthOK},
+				"db":     {Status: authority.HealthDegraded, Error: "db is slow"},
+				"signer": {Status: authority.HealthOK},
+			},
+		}, 200, `{"status":"degraded","components":{"config":{"status":"ok"},"db":{"status":"degraded","error":"db is slow"},"signer":{"status":"ok"}}}`},
+		{"down", &authority.Health{
+			Status: authority.HealthDown,
+			Components: map[string]authority.HealthCheck{
+				"config": {Status: authority.HealthOK},
+				"db":     {Status: authority.HealthDown, Error: "db is unavailable"},
+				"signer": {Status: authority.HealthOK},
+			},
+		}, 503, `{"status":"down","components":{"config":{"status":"ok"},"db":{"status":"down","error":"db is unavailable"},"signer":{"status":"ok"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/health", nil)
+			w := httptest.NewRecorder()
+			h := New(&mockAuthority{
+				health: func() *authority.Health { return tt.health },
+			}).(*caHandler)
+			h.Health(w, req)
+
+			res := w.Result()
+			if res.StatusCode != tt.statusCode {
+				t.Errorf("caHandler.Health StatusCode = %d, wants %d", res.StatusCode, tt.statusCode)
+			}
+
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Errorf("caHandler.Health unexpected error = %v", err)
+			}
+			if !bytes.Equal(body, []byte(tt.expected+"\n")) {
+				t.Errorf("caHandler.Health Body = %s, wants %s", body, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_caHandler_limitByIP(t *testing.T) {
+	h := New(&mockAuthority{}, WithUnauthenticatedRateLimit(ratelimit.New(ratelimit.Limit{
+		RequestsPerSecond: 0.5,
+		Burst:             1,
+	}))).(*caHandler)
+	health := h.limitByIP(h.Health)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		statusCode int
+		retryAfter string
+	}{
+		{"ok", "10.0.0.1:1234", 200, ""},
+		{"fail limited", "10.0.0.1:4321", 429, "2"},
+		{"ok other ip", "10.0.0.2:1234", 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/health", nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			health(w, req)
+
+			res := w.Result()
+			if res.StatusCode != tt.statusCode {
+				t.Errorf("caHandler.Health StatusCode = %d, wants %d", res.StatusCode, tt.statusCode)
+			}
+			if got := res.Header.Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("caHandler.Health Retry-After = %s, wants %s", got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func Test_caHandler_limitConcurrency(t *testing.T) {
+	l := ratelimit.NewConcurrencyLimiter(1, 0, 0, nil)
+	mux := chi.NewRouter()
+	New(&mockAuthority{
+		health: func() *authority.Health {
+			return &authority.Health{Status: authority.HealthOK}
+		},
+		getRoots: func() ([]*x509.Certificate, error) {
+			return []*x509.Certificate{parseCertificate(rootPEM)}, nil
+		},
+	}, WithConcurrencyLimit(l, 5*time.Second)).Route(mux)
+
+	do := func(method, path string) *http.Response {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader("{}"))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// Take the only slot
+	release, ok := l.Acquire(context.Background())
+	assert.True(t, ok)
+
+	for _, path := range []string{"/sign", "/renew", "/ssh/sign", "/ssh/renew", "/ssh/rekey"} {
+		res := do("POST", path)
+		assert.Equals(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equals(t, "5", res.Header.Get("Retry-After"))
+	}
+	assert.Equals(t, uint64(5), l.Shed())
+
+	// Health and roots bypass the limit
+	assert.Equals(t, http.StatusOK, do("GET", "/health").StatusCode)
+	assert.Equals(t, http.StatusOK, do("GET", "/roots.pem").StatusCode)
+
+	// Admitted once the slot is released, the request fails validating the
+	// empty body.
+	release()
+	assert.Equals(t, http.StatusBadRequest, do("POST", "/sign").StatusCode)
+	assert.Equals(t, 0, l.InFlight())
+}
+
 func Test_caHandler_Root(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -873,7 +1123,7 @@ func Test_caHandler_Sign(t *testing.T) {
 				authorizeSign: func(ott string) ([]provisioner.SignOption, error) {
 					return tt.certAttrOpts, tt.autherr
 				},
-				getTLSOptions: func() *tlsutil.TLSOptions {
+				getTLSOptions: func() *authority.TLSOptions {
 					return nil
 				},
 			}).(*caHandler)
@@ -900,34 +1150,159 @@ func Test_caHandler_Sign(t *testing.T) {
 	}
 }
 
-func Test_caHandler_Renew(t *testing.T) {
-	cs := &tls.ConnectionState{
-		PeerCertificates: []*x509.Certificate{parseCertificate(certPEM)},
-	}
+func Test_caHandler_logging(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, new(jose.SignerOptions).WithHeader("kid", "the-kid"))
+	assert.FatalError(t, err)
+	jws, err := signer.Sign([]byte(`{"sub":"test.example.com"}`))
+	assert.FatalError(t, err)
+	ott, err := jws.CompactSerialize()
+	assert.FatalError(t, err)
+	signBody, err := json.Marshal(SignRequest{
+		CsrPEM: CertificateRequest{parseCertificateRequest(csrPEM)},
+		OTT:    ott,
+	})
+	assert.FatalError(t, err)
+
+	cert := parseCertificate(stepCertPEM)
 	tests := []struct {
 		name       string
-		tls        *tls.ConnectionState
-		cert       *x509.Certificate
-		root       *x509.Certificate
-		err        error
+		method     string
+		path       string
+		body       string
 		statusCode int
+		fields     map[string]interface{}
 	}{
-		{"ok", cs, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusCreated},
-		{"no tls", nil, nil, nil, nil, http.StatusBadRequest},
-		{"no peer certificates", &tls.ConnectionState{}, nil, nil, nil, http.StatusBadRequest},
-		{"renew error", cs, nil, nil, errs.Forbidden("an error"), http.StatusForbidden},
+		{"sign", "POST", "/sign", string(signBody), http.StatusCreated, map[string]interface{}{
+			"kid":         "the-kid",
+			"serial":      cert.SerialNumber.String(),
+			"subject":     cert.Subject.CommonName,
+			"provisioner": "mariano@smallstep.com (jO37dtDbku-Qnabs5VR0Yw6YFFv9weA18dp3htvdEjs)",
+		}},
+		{"health", "GET", "/health", "", http.StatusServiceUnavailable, map[string]interface{}{
+			"health-errors": "map[db:connection refused]",
+		}},
+		{"not-found", "GET", "/not-found", "", http.StatusNotFound, nil},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := logging.New("ca", []byte(`{"format":"json"}`))
+			assert.FatalError(t, err)
+			var buf bytes.Buffer
+			logger.Out = &buf
+
+			mux := chi.NewRouter()
+			New(&mockAuthority{
+				ret1: cert, ret2: parseCertificate(rootPEM),
+				authorizeSign: func(ott string) ([]provisioner.SignOption, error) {
+					return nil, nil
+				},
+				getTLSOptions: func() *authority.TLSOptions {
+					return nil
+				},
+				health: func() *authority.Health {
+					return &authority.Health{Status: authority.HealthDown}
+				},
+				healthErrors: func() map[string]string {
+					return map[string]string{"db": "connection refused"}
+				},
+			}).Route(mux)
+			handler := logger.Middleware(mux)
 
-	expected := []byte(`{"crt":"` + strings.Replace(certPEM, "\n", `\n`, -1) + `\n","ca":"` + strings.Replace(rootPEM, "\n", `\n`, -1) + `\n","certChain":["` + strings.Replace(certPEM, "\n", `\n`, -1) + `\n","` + strings.Replace(rootPEM, "\n", `\n`, -1) + `\n"]}`)
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-Request-Id", "the-request-id")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			res := w.Result()
+			assert.Equals(t, tt.statusCode, res.StatusCode)
+			assert.Equals(t, "the-request-id", res.Header.Get("X-Request-Id"))
+
+			line := buf.String()
+			var entry map[string]interface{}
+			dec := json.NewDecoder(strings.NewReader(line))
+			dec.UseNumber()
+			assert.FatalError(t, dec.Decode(&entry))
+			for _, k := range []string{"request-id", "method", "path", "status", "duration", "remote-address"} {
+				if _, ok := entry[k]; !ok {
+					t.Errorf("log entry does not contain %s: %s", k, line)
+				}
+			}
+			assert.Equals(t, "the-request-id", entry["request-id"])
+			assert.Equals(t, tt.method, entry["method"])
+			assert.Equals(t, tt.path, entry["path"])
+			assert.Equals(t, json.Number(strconv.Itoa(tt.statusCode)), entry["status"])
+			for k, v := range tt.fields {
+				assert.Equals(t, v, fmt.Sprint(entry[k]))
+			}
+		})
+	}
+}
+
+func Test_caHandler_Renew(t *testing.T) {
+	now := time.Now()
+	root, rootKey := mustRootCertificate(t)
+	cert := mustLeafCertificate(t, root, rootKey, now.Add(-time.Hour), now.Add(time.Hour))
+	expiredCert := mustLeafCertificate(t, root, rootKey, now.Add(-2*time.Hour), now.Add(-10*time.Minute))
+	otherRoot, otherRootKey := mustRootCertificate(t)
+	otherCert := mustLeafCertificate(t, otherRoot, otherRootKey, now.Add(-time.Hour), now.Add(time.Hour))
+	changedCert := mustLeafCertificate(t, root, rootKey, now.Add(-time.Hour), now.Add(time.Hour))
+	changedCert.DNSNames = []string{"other.smallstep.com"}
+	cs := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+
+	tests := []struct {
+		name        string
+		tls         *tls.ConnectionState
+		gracePeriod time.Duration
+		cert        *x509.Certificate
+		err         error
+		statusCode  int
+	}{
+		{"ok", cs, 0, cert, nil, http.StatusCreated},
+		{"ok/expired in grace period", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{expiredCert},
+		}, time.Hour, expiredCert, nil, http.StatusCreated},
+		{"fail/no-tls", nil, 0, nil, nil, http.StatusUnauthorized},
+		{"fail/no-peer-certificates", &tls.ConnectionState{}, 0, nil, nil, http.StatusUnauthorized},
+		{"fail/wrong-ca", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{otherCert},
+		}, 0, otherCert, nil, http.StatusUnauthorized},
+		{"fail/expired", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{expiredCert},
+		}, 0, expiredCert, nil, http.StatusUnauthorized},
+		{"fail/expired after grace period", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{expiredCert},
+		}, 5 * time.Minute, expiredCert, nil, http.StatusUnauthorized},
+		{"fail/revoked", cs, 0, nil, errs.Unauthorized("authority.authorizeRenew: certificate has been revoked"), http.StatusUnauthorized},
+		{"fail/renew error", cs, 0, nil, errs.Forbidden("an error"), http.StatusForbidden},
+		{"fail/identity mismatch", cs, 0, changedCert, nil, http.StatusInternalServerError},
+	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			var expected []byte
+			if tt.cert != nil {
+				b, err := json.Marshal(&SignResponse{
+					ServerPEM:    Certificate{tt.cert},
+					CaPEM:        Certificate{root},
+					CertChainPEM: []Certificate{{tt.cert}, {root}},
+				})
+				assert.FatalError(t, err)
+				expected = b
+			}
+
 			h := New(&mockAuthority{
-				ret1: tt.cert, ret2: tt.root, err: tt.err,
-				getTLSOptions: func() *tlsutil.TLSOptions {
+				ret1: tt.cert, ret2: root, err: tt.err,
+				getRoots: func() ([]*x509.Certificate, error) {
+					return []*x509.Certificate{root}, nil
+				},
+				getTLSOptions: func() *authority.TLSOptions {
 					return nil
 				},
-			}).(*caHandler)
+			}, WithRenewGracePeriod(tt.gracePeriod)).(*caHandler)
 			req := httptest.NewRequest("POST", "http://example.com/renew", nil)
 			req.TLS = tt.tls
 			w := httptest.NewRecorder()
@@ -945,13 +1320,26 @@ func Test_caHandler_Renew(t *testing.T) {
 			}
 			if tt.statusCode < http.StatusBadRequest {
 				if !bytes.Equal(bytes.TrimSpace(body), expected) {
-					t.Errorf("caHandler.Root Body = %s, wants %s", body, expected)
+					t.Errorf("caHandler.Renew Body = %s, wants %s", body, expected)
 				}
 			}
 		})
 	}
 }
 
+func Test_caHandler_Renew_missingCertificate(t *testing.T) {
+	h := New(&mockAuthority{}).(*caHandler)
+	req := httptest.NewRequest("POST", "http://example.com/renew", nil)
+	w := httptest.NewRecorder()
+	h.Renew(w, req)
+	res := w.Result()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+
+	var body map[string]interface{}
+	assert.FatalError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equals(t, "The renew endpoint requires the certificate to renew as the TLS client certificate.", body["detail"])
+}
+
 func Test_caHandler_Provisioners(t *testing.T) {
 	type fields struct {
 		Authority Authority
@@ -1056,6 +1444,43 @@ func Test_caHandler_Provisioners(t *testing.T) {
 	}
 }
 
+func Test_caHandler_Provisioners_secrets(t *testing.T) {
+	p := provisioner.List{
+		&provisioner.JWK{
+			Type: "JWK",
+			Name: "webhooks",
+			Webhooks: []*provisioner.Webhook{
+				{Name: "people", URL: "https://example.com/people", Kind: "ENRICHING", BearerToken: "the-bearer-token"},
+			},
+		},
+		&provisioner.SCEP{
+			Type:                 "SCEP",
+			Name:                 "scep",
+			ChallengePassword:    "the-challenge",
+			DecrypterCertificate: "decrypter.crt",
+			DecrypterKey:         "decrypter.key",
+			DecrypterKeyPassword: "the-key-password",
+		},
+	}
+	req := httptest.NewRequest("GET", "http://example.com/provisioners", nil)
+	w := httptest.NewRecorder()
+	h := &caHandler{Authority: &mockAuthority{ret1: p, ret2: ""}}
+	h.Provisioners(w, req)
+	assert.Equals(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.True(t, strings.Contains(body, "https://example.com/people"), body)
+	assert.False(t, strings.Contains(body, "the-bearer-token"), body)
+	assert.False(t, strings.Contains(body, "bearerToken"), body)
+	assert.True(t, strings.Contains(body, "decrypter.crt"), body)
+	for _, secret := range []string{"the-challenge", `"challenge"`, "the-key-password", "decrypterKeyPassword"} {
+		assert.False(t, strings.Contains(body, secret), body)
+	}
+
+	// The provisioners of the authority keep their secrets.
+	assert.Equals(t, "the-bearer-token", p[0].(*provisioner.JWK).Webhooks[0].BearerToken)
+	assert.Equals(t, "the-challenge", p[1].(*provisioner.SCEP).ChallengePassword)
+}
+
 func Test_caHandler_ProvisionerKey(t *testing.T) {
 	type fields struct {
 		Authority Authority
@@ -1107,6 +1532,7 @@ func Test_caHandler_ProvisionerKey(t *testing.T) {
 				if !bytes.Equal(bytes.TrimSpace(body), expected) {
 					t.Errorf("caHandler.Provisioners Body = %s, wants %s", body, expected)
 				}
+				assert.Equals(t, "no-cache", res.Header.Get("Cache-Control"))
 			} else {
 				if !bytes.Equal(bytes.TrimSpace(body), expectedError404Bytes) {
 					t.Errorf("caHandler.Provisioners Body = %s, wants %s", body, expectedError404Bytes)
@@ -1117,8 +1543,12 @@ func Test_caHandler_ProvisionerKey(t *testing.T) {
 }
 
 func Test_caHandler_Roots(t *testing.T) {
+	root, rootKey := mustRootCertificate(t)
+	cert := mustLeafCertificate(t, root, rootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	otherRoot, otherRootKey := mustRootCertificate(t)
+	otherCert := mustLeafCertificate(t, otherRoot, otherRootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
 	cs := &tls.ConnectionState{
-		PeerCertificates: []*x509.Certificate{parseCertificate(certPEM)},
+		PeerCertificates: []*x509.Certificate{cert},
 	}
 	tests := []struct {
 		name       string
@@ -1128,12 +1558,17 @@ func Test_caHandler_Roots(t *testing.T) {
 		err        error
 		statusCode int
 	}{
-		{"ok", cs, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusCreated},
-		{"no peer certificates", &tls.ConnectionState{}, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusCreated},
+		{"ok", cs, cert, root, nil, http.StatusCreated},
+		{"fail/no-tls", nil, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusUnauthorized},
+		{"fail/no-peer-certificates", &tls.ConnectionState{}, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusUnauthorized},
 		{"fail", cs, nil, nil, fmt.Errorf("an error"), http.StatusForbidden},
+		{"fail/wrong-ca", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{otherCert},
+		}, cert, root, nil, http.StatusUnauthorized},
 	}
 
-	expected := []byte(`{"crts":["` + strings.Replace(rootPEM, "\n", `\n`, -1) + `\n"]}`)
+	expected, err := json.Marshal(&RootsResponse{Certificates: []Certificate{{root}}})
+	assert.FatalError(t, err)
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1162,9 +1597,109 @@ func Test_caHandler_Roots(t *testing.T) {
 	}
 }
 
+func Test_caHandler_RootsPEM(t *testing.T) {
+	tests := []struct {
+		name       string
+		roots      []*x509.Certificate
+		err        error
+		statusCode int
+		expected   []byte
+	}{
+		{"ok", []*x509.Certificate{parseCertificate(rootPEM)}, nil, http.StatusOK, []byte(rootPEM + "\n")},
+		{"ok/multiple", []*x509.Certificate{parseCertificate(rootPEM), parseCertificate(certPEM)}, nil, http.StatusOK, []byte(rootPEM + "\n" + certPEM + "\n")},
+		{"fail", nil, fmt.Errorf("an error"), http.StatusInternalServerError, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&mockAuthority{ret1: tt.roots, err: tt.err}).(*caHandler)
+			req := httptest.NewRequest("GET", "http://example.com/roots.pem", nil)
+			w := httptest.NewRecorder()
+			h.RootsPEM(w, req)
+			res := w.Result()
+
+			if res.StatusCode != tt.statusCode {
+				t.Errorf("caHandler.RootsPEM StatusCode = %d, wants %d", res.StatusCode, tt.statusCode)
+			}
+
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Errorf("caHandler.RootsPEM unexpected error = %v", err)
+			}
+			if tt.statusCode < http.StatusBadRequest {
+				if ct := res.Header.Get("Content-Type"); ct != "application/x-pem-file" {
+					t.Errorf("caHandler.RootsPEM Content-Type = %s, wants application/x-pem-file", ct)
+				}
+				if !bytes.Equal(body, tt.expected) {
+					t.Errorf("caHandler.RootsPEM Body = %s, wants %s", body, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func Test_caHandler_Roots_sameCertificates(t *testing.T) {
+	root, rootKey := mustRootCertificate(t)
+	roots := []*x509.Certificate{root, parseCertificate(rootPEM), parseCertificate(certPEM)}
+	h := New(&mockAuthority{ret1: roots}).(*caHandler)
+
+	// JSON format
+	req := httptest.NewRequest("GET", "http://example.com/roots", nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			mustLeafCertificate(t, root, rootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)),
+		},
+	}
+	w := httptest.NewRecorder()
+	h.Roots(w, req)
+	res := w.Result()
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("caHandler.Roots Content-Type = %s, wants application/json", ct)
+	}
+	var rootsResponse RootsResponse
+	if err := json.NewDecoder(res.Body).Decode(&rootsResponse); err != nil {
+		t.Fatalf("error decoding roots response: %v", err)
+	}
+	res.Body.Close()
+
+	// PEM format
+	req = httptest.NewRequest("GET", "http://example.com/roots.pem", nil)
+	w = httptest.NewRecorder()
+	h.RootsPEM(w, req)
+	body, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatalf("error reading roots.pem response: %v", err)
+	}
+	var pemCerts []*x509.Certificate
+	for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("error parsing roots.pem certificate: %v", err)
+		}
+		pemCerts = append(pemCerts, crt)
+	}
+
+	if len(rootsResponse.Certificates) != len(roots) || len(pemCerts) != len(roots) {
+		t.Fatalf("got %d certificates in /roots and %d in /roots.pem, want %d", len(rootsResponse.Certificates), len(pemCerts), len(roots))
+	}
+	for i, crt := range roots {
+		if !crt.Equal(rootsResponse.Certificates[i].Certificate) {
+			t.Errorf("/roots certificate %d does not match", i)
+		}
+		if !crt.Equal(pemCerts[i]) {
+			t.Errorf("/roots.pem certificate %d does not match", i)
+		}
+	}
+}
+
 func Test_caHandler_Federation(t *testing.T) {
+	root, rootKey := mustRootCertificate(t)
+	cert := mustLeafCertificate(t, root, rootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	otherRoot, otherRootKey := mustRootCertificate(t)
+	otherCert := mustLeafCertificate(t, otherRoot, otherRootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
 	cs := &tls.ConnectionState{
-		PeerCertificates: []*x509.Certificate{parseCertificate(certPEM)},
+		PeerCertificates: []*x509.Certificate{cert},
 	}
 	tests := []struct {
 		name       string
@@ -1174,12 +1709,17 @@ func Test_caHandler_Federation(t *testing.T) {
 		err        error
 		statusCode int
 	}{
-		{"ok", cs, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusCreated},
-		{"no peer certificates", &tls.ConnectionState{}, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusCreated},
+		{"ok", cs, cert, root, nil, http.StatusCreated},
+		{"fail/no-tls", nil, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusUnauthorized},
+		{"fail/no-peer-certificates", &tls.ConnectionState{}, parseCertificate(certPEM), parseCertificate(rootPEM), nil, http.StatusUnauthorized},
 		{"fail", cs, nil, nil, fmt.Errorf("an error"), http.StatusForbidden},
+		{"fail/wrong-ca", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{otherCert},
+		}, cert, root, nil, http.StatusUnauthorized},
 	}
 
-	expected := []byte(`{"crts":["` + strings.Replace(rootPEM, "\n", `\n`, -1) + `\n"]}`)
+	expected, err := json.Marshal(&RootsResponse{Certificates: []Certificate{{root}}})
+	assert.FatalError(t, err)
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1279,3 +1819,49 @@ func mustCertificate(t *testing.T, pub, priv interface{}) *x509.Certificate {
 	}
 	return cert
 }
+
+// mustRootCertificate returns a self-signed root certificate and its key.
+func mustRootCertificate(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key := mustKey()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// mustLeafCertificate returns a certificate signed by the given root that is
+// valid between notBefore and notAfter.
+func mustLeafCertificate(t *testing.T, root *x509.Certificate, rootKey *ecdsa.PrivateKey, notBefore, notAfter time.Time) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		Subject:      pkix.Name{CommonName: "test.smallstep.com"},
+		DNSNames:     []string{"test.smallstep.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, root, mustKey().Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/errs"
+)
+
+// defaultBodyLimit is the maximum size of the request bodies of the endpoints
+// without a limit.
+const defaultBodyLimit = 1 << 20
+
+// defaultEndpointBodyLimits are the built-in limits of the endpoints that
+// require a different limit than the default one.
+var defaultEndpointBodyLimits = map[string]int64{
+	"/revoke":               64 << 10,
+	"/ssh/revoke":           64 << 10,
+	"/scep/{provisionerID}": 2 << 20,
+}
+
+// BodyLimiter limits the size of the bodies of the POST, PUT and PATCH
+// requests. Bodies over the limit are rejected with a 413 error before they
+// are read into memory.
+type BodyLimiter struct {
+	def       int64
+	endpoints map[string]int64
+}
+
+// NewBodyLimiter creates a BodyLimiter with the given configuration, a nil
+// configuration uses the default limits.
+func NewBodyLimiter(c *authority.BodyLimitsConfig) *BodyLimiter {
+	l := &BodyLimiter{
+		def:       defaultBodyLimit,
+		endpoints: make(map[string]int64),
+	}
+	for e, n := range defaultEndpointBodyLimits {
+		l.endpoints[e] = n
+	}
+	if c != nil {
+		if c.Default > 0 {
+			l.def = c.Default
+		}
+		for e, n := range c.Endpoints {
+			l.endpoints[e] = n
+		}
+	}
+	return l
+}
+
+// limit returns the limit of the given endpoint.
+func (l *BodyLimiter) limit(endpoint string) int64 {
+	if n, ok := l.endpoints[endpoint]; ok {
+		return n
+	}
+	return l.def
+}
+
+// Router returns a Router that limits the bodies of the routes added to r.
+// The prefix is the path where the routes are mounted, the limits are looked
+// up using the prefix and the pattern of the route, e.g. /scep/{provisionerID}.
+func (l *BodyLimiter) Router(r Router, prefix string) Router {
+	return &bodyLimitRouter{
+		Router:  r,
+		limiter: l,
+		prefix:  prefix,
+	}
+}
+
+// bodyLimitRouter is a Router that adds the body limit middleware to the
+// routes that accept a body.
+type bodyLimitRouter struct {
+	Router
+	limiter *BodyLimiter
+	prefix  string
+}
+
+// MethodFunc implements the Router interface.
+func (r *bodyLimitRouter) MethodFunc(method, pattern string, h http.HandlerFunc) {
+	switch method {
+	case "POST", "PUT", "PATCH":
+		h = limitBody(r.limiter.limit(r.prefix+pattern), h)
+	}
+	r.Router.MethodFunc(method, pattern, h)
+}
+
+// limitBody is a middleware that rejects the requests with a Content-Length
+// over the limit, and limits the reads of the body of the rest.
+func limitBody(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			WriteError(w, errs.RequestEntityTooLarge("request body larger than %d bytes", limit))
+			return
+		}
+		r.Body = &maxBytesReader{
+			ReadCloser: http.MaxBytesReader(w, r.Body, limit),
+			limit:      limit,
+		}
+		next(w, r)
+	}
+}
+
+// maxBytesReader converts the error returned by http.MaxBytesReader when the
+// limit is reached into a 413 error.
+type maxBytesReader struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if err != nil && err != io.EOF && r.read >= r.limit {
+		return n, errs.RequestEntityTooLarge("request body larger than %d bytes", r.limit)
+	}
+	return n, err
+}
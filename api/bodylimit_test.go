@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/errs"
+)
+
+// endlessReader is an infinite request body that counts the bytes read.
+type endlessReader struct {
+	read int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestBodyLimiter(t *testing.T) {
+	mux := chi.NewRouter()
+	limiter := NewBodyLimiter(&authority.BodyLimitsConfig{
+		Default:   64 << 10,
+		Endpoints: map[string]int64{"/sign": 1 << 10},
+	})
+	New(&mockAuthority{}).Route(limiter.Router(mux, ""))
+
+	tests := []struct {
+		name          string
+		path          string
+		contentLength int64
+		limit         int64
+	}{
+		{"sign", "/sign", -1, 1 << 10},
+		{"sign with content-length", "/sign", 200 << 20, 1 << 10},
+		{"revoke", "/revoke", -1, 64 << 10},
+		{"ssh sign", "/ssh/sign", -1, 64 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := new(endlessReader)
+			req := httptest.NewRequest("POST", "http://example.com"+tt.path, body)
+			req.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			res := w.Result()
+			assert.Equals(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+			assert.Equals(t, "application/problem+json", res.Header.Get("Content-Type"))
+			var problem map[string]interface{}
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&problem))
+			assert.Equals(t, "urn:smallstep:error:request-too-large", problem["type"])
+			assert.Equals(t, errs.RequestEntityTooLargeDefaultMsg, problem["detail"])
+
+			// The body is never read over the limit and the buffer of the
+			// decoder.
+			if body.read > tt.limit+(64<<10) {
+				t.Errorf("read %d bytes from the body, want at most %d", body.read, tt.limit+(64<<10))
+			}
+		})
+	}
+}
+
+func TestBodyLimiter_underLimit(t *testing.T) {
+	mux := chi.NewRouter()
+	New(&mockAuthority{}).Route(NewBodyLimiter(nil).Router(mux, ""))
+
+	// The body is decoded and rejected by the validation of the request.
+	req := httptest.NewRequest("POST", "http://example.com/revoke", strings.NewReader(`{"serial":""}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equals(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestNewBodyLimiter(t *testing.T) {
+	l := NewBodyLimiter(nil)
+	assert.Equals(t, int64(defaultBodyLimit), l.limit("/sign"))
+	assert.Equals(t, int64(64<<10), l.limit("/revoke"))
+	assert.Equals(t, int64(2<<20), l.limit("/scep/{provisionerID}"))
+
+	l = NewBodyLimiter(&authority.BodyLimitsConfig{
+		Default:   2 << 20,
+		Endpoints: map[string]int64{"/revoke": 1 << 10},
+	})
+	assert.Equals(t, int64(2<<20), l.limit("/sign"))
+	assert.Equals(t, int64(1<<10), l.limit("/revoke"))
+	assert.Equals(t, int64(64<<10), l.limit("/ssh/revoke"))
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/errs"
+)
+
+// CertificateResponse is the response object of the certificate lookups, it
+// contains a stored certificate and its status.
+type CertificateResponse struct {
+	Serial           string                  `json:"serial"`
+	Status           string                  `json:"status"`
+	Certificate      Certificate             `json:"crt"`
+	Provisioner      *CertificateProvisioner `json:"provisioner,omitempty"`
+	NotBefore        time.Time               `json:"notBefore"`
+	NotAfter         time.Time               `json:"notAfter"`
+	RevokedAt        *time.Time              `json:"revokedAt,omitempty"`
+	RevocationReason string                  `json:"revocationReason,omitempty"`
+}
+
+// CertificateProvisioner is the provisioner used to get a certificate.
+type CertificateProvisioner struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// CertificatesResponse is the response object of the certificate searches.
+type CertificatesResponse struct {
+	Certificates []*CertificateResponse `json:"certificates"`
+	NextCursor   string                 `json:"nextCursor"`
+}
+
+func newCertificateResponse(info *authority.CertificateInfo) *CertificateResponse {
+	resp := &CertificateResponse{
+		Serial:      info.Certificate.SerialNumber.String(),
+		Status:      string(info.Status),
+		Certificate: Certificate{info.Certificate},
+		NotBefore:   info.Certificate.NotBefore,
+		NotAfter:    info.Certificate.NotAfter,
+	}
+	if p := info.Provisioner; p != nil {
+		resp.Provisioner = &CertificateProvisioner{Type: p.Type.String(), Name: p.Name}
+	}
+	if rci := info.Revocation; rci != nil {
+		revokedAt := rci.RevokedAt
+		resp.RevokedAt = &revokedAt
+		resp.RevocationReason = rci.Reason
+	}
+	return resp
+}
+
+// Certificate returns the stored certificate with the serial number in the
+// URL. It requires an admin token or a client certificate.
+func (h *caHandler) Certificate(w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeLookup(r); err != nil {
+		WriteError(w, err)
+		return
+	}
+	info, err := h.Authority.GetCertificate(chi.URLParam(r, "serial"))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	JSON(w, newCertificateResponse(info))
+}
+
+// Certificates returns the stored certificates with the subject alternative
+// name in the san parameter. The status parameter filters the certificates
+// by status, and the cursor and limit parameters paginate them. It requires an
+// admin token or a client certificate.
+func (h *caHandler) Certificates(w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeLookup(r); err != nil {
+		WriteError(w, err)
+		return
+	}
+	cursor, limit, err := parseCursor(r)
+	if err != nil {
+		WriteError(w, errs.BadRequestErr(err))
+		return
+	}
+	q := r.URL.Query()
+	san := q.Get("san")
+	if san == "" {
+		WriteError(w, errs.BadRequest("missing san"))
+		return
+	}
+
+	infos, next, err := h.Authority.GetCertificatesBySAN(san, authority.CertificateStatus(q.Get("status")), cursor, limit)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	certs := make([]*CertificateResponse, len(infos))
+	for i, info := range infos {
+		certs[i] = newCertificateResponse(info)
+	}
+	JSON(w, &CertificatesResponse{
+		Certificates: certs,
+		NextCursor:   next,
+	})
+}
+
+// authorizeLookup requires a bearer token generated by an admin, or a client
+// certificate issued by the CA that has not been revoked. The issued
+// certificates can reveal the internal names of an organization, so the
+// lookups are not public.
+func (h *caHandler) authorizeLookup(r *http.Request) error {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if _, err := h.Authority.AuthorizeAdmin(r.Context(), strings.TrimPrefix(auth, "Bearer ")); err != nil {
+			return err
+		}
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errs.Unauthorized("missing admin token or peer certificate")
+	}
+	crt, err := h.verifyPeerCertificate(r.TLS, 0)
+	if err != nil {
+		return err
+	}
+	revoked, err := h.Authority.IsRevoked(crt.SerialNumber.String())
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errs.Unauthorized("peer certificate has been revoked")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+)
+
+func Test_caHandler_Certificate(t *testing.T) {
+	root, rootKey := mustRootCertificate(t)
+	cert := mustLeafCertificate(t, root, rootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	otherRoot, otherRootKey := mustRootCertificate(t)
+	otherCert := mustLeafCertificate(t, otherRoot, otherRootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+
+	info := &authority.CertificateInfo{
+		Certificate: cert,
+		Status:      authority.CertificateStatusRevoked,
+		Provisioner: &provisioner.Extension{Type: provisioner.TypeJWK, Name: "jwk"},
+		Revocation:  &db.RevokedCertificateInfo{Reason: "foo", RevokedAt: revokedAt},
+	}
+	mock := func(revoked bool) *mockAuthority {
+		return &mockAuthority{
+			getRoots: func() ([]*x509.Certificate, error) {
+				return []*x509.Certificate{root}, nil
+			},
+			authorizeAdmin: func(ctx context.Context, token string) (*admin.Admin, error) {
+				if token != "admin-token" {
+					return nil, errs.Unauthorized("bad token")
+				}
+				return &admin.Admin{Subject: "admin"}, nil
+			},
+			isRevoked: func(serial string) (bool, error) {
+				return revoked, nil
+			},
+			getCertificate: func(serial string) (*authority.CertificateInfo, error) {
+				if serial != "1234" {
+					return nil, errs.NotFound("certificate not found")
+				}
+				return info, nil
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		auth       *mockAuthority
+		serial     string
+		token      string
+		tls        *tls.ConnectionState
+		statusCode int
+	}{
+		{"ok/mtls", mock(false), "1234", "", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, http.StatusOK},
+		{"ok/admin", mock(false), "1234", "admin-token", nil, http.StatusOK},
+		{"fail/not-found", mock(false), "1", "admin-token", nil, http.StatusNotFound},
+		{"fail/no-auth", mock(false), "1234", "", nil, http.StatusUnauthorized},
+		{"fail/no-peer-certificates", mock(false), "1234", "", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"fail/wrong-ca", mock(false), "1234", "", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherCert}}, http.StatusUnauthorized},
+		{"fail/revoked", mock(true), "1234", "", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, http.StatusUnauthorized},
+		{"fail/bad-token", mock(false), "1234", "foo", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			New(tt.auth).Route(r)
+			req := httptest.NewRequest("GET", "http://example.com/certificates/"+tt.serial, nil)
+			req.TLS = tt.tls
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equals(t, tt.statusCode, res.StatusCode)
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			var resp CertificateResponse
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&resp))
+			assert.Equals(t, "1234", resp.Serial)
+			assert.Equals(t, "revoked", resp.Status)
+			assert.Equals(t, cert.Raw, resp.Certificate.Raw)
+			assert.Equals(t, &CertificateProvisioner{Type: "JWK", Name: "jwk"}, resp.Provisioner)
+			assert.True(t, cert.NotAfter.Equal(resp.NotAfter))
+			assert.True(t, revokedAt.Equal(*resp.RevokedAt))
+			assert.Equals(t, "foo", resp.RevocationReason)
+		})
+	}
+}
+
+func Test_caHandler_Certificates(t *testing.T) {
+	root, rootKey := mustRootCertificate(t)
+	cert := mustLeafCertificate(t, root, rootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	cs := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	type args struct {
+		san    string
+		status authority.CertificateStatus
+		cursor string
+		limit  int
+	}
+	tests := []struct {
+		name       string
+		query      string
+		want       args
+		err        error
+		statusCode int
+	}{
+		{"ok", "?san=test.smallstep.com", args{san: "test.smallstep.com"}, nil, http.StatusOK},
+		{"ok/options", "?san=10.0.0.1&status=valid&cursor=1234&limit=10", args{"10.0.0.1", "valid", "1234", 10}, nil, http.StatusOK},
+		{"fail/no-san", "?status=valid", args{}, nil, http.StatusBadRequest},
+		{"fail/limit", "?san=test.smallstep.com&limit=foo", args{}, nil, http.StatusBadRequest},
+		{"fail/status", "?san=test.smallstep.com&status=foo", args{"test.smallstep.com", "foo", "", 0},
+			errs.BadRequest("bad status"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&mockAuthority{
+				getRoots: func() ([]*x509.Certificate, error) {
+					return []*x509.Certificate{root}, nil
+				},
+				isRevoked: func(serial string) (bool, error) {
+					return false, nil
+				},
+				getCertificatesBySAN: func(san string, status authority.CertificateStatus, cursor string, limit int) ([]*authority.CertificateInfo, string, error) {
+					assert.Equals(t, tt.want, args{san, status, cursor, limit})
+					if tt.err != nil {
+						return nil, "", tt.err
+					}
+					return []*authority.CertificateInfo{{Certificate: cert, Status: authority.CertificateStatusValid}}, "next", nil
+				},
+			}).(*caHandler)
+			req := httptest.NewRequest("GET", "http://example.com/certificates"+tt.query, nil)
+			req.TLS = cs
+			w := httptest.NewRecorder()
+			h.Certificates(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equals(t, tt.statusCode, res.StatusCode)
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			var resp CertificatesResponse
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&resp))
+			assert.Equals(t, 1, len(resp.Certificates))
+			assert.Equals(t, "valid", resp.Certificates[0].Status)
+			assert.Nil(t, resp.Certificates[0].Provisioner)
+			assert.Nil(t, resp.Certificates[0].RevokedAt)
+			assert.Equals(t, "next", resp.NextCursor)
+		})
+	}
+
+	t.Run("fail/no-auth", func(t *testing.T) {
+		h := New(&mockAuthority{}).(*caHandler)
+		req := httptest.NewRequest("GET", "http://example.com/certificates?san=test.smallstep.com", nil)
+		w := httptest.NewRecorder()
+		h.Certificates(w, req)
+		assert.Equals(t, http.StatusUnauthorized, w.Result().StatusCode)
+	})
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/errs"
+)
+
+// corsDefaultEndpoints are the read only endpoints that allow CORS requests
+// when CORS is enabled. The rest of the endpoints must be explicitly added in
+// the configuration.
+var corsDefaultEndpoints = []string{
+	"/version", "/health", "/root/{sha}", "/provisioners", "/roots", "/roots.pem",
+	"/federation", "/ssh/roots", "/ssh/federation",
+}
+
+var (
+	corsDefaultMethods = []string{"GET", "HEAD", "POST"}
+	corsDefaultHeaders = []string{"Content-Type"}
+)
+
+// cors adds the CORS headers to the responses of the allowed endpoints and
+// answers their preflight requests.
+type cors struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	wildcards   [][2]string
+	methods     []string
+	headers     []string
+	maxAge      string
+	credentials bool
+	endpoints   map[string]bool
+}
+
+func newCORS(c *authority.CORSConfig) *cors {
+	cs := &cors{
+		origins:     make(map[string]bool),
+		methods:     corsDefaultMethods,
+		headers:     corsDefaultHeaders,
+		credentials: c.AllowCredentials,
+		endpoints:   make(map[string]bool),
+	}
+	for _, o := range c.AllowedOrigins {
+		o = strings.ToLower(o)
+		switch {
+		case o == "*":
+			cs.anyOrigin = true
+		case strings.Contains(o, "://*."):
+			// Store the scheme and the rest of the host, the wildcard matches
+			// one label.
+			i := strings.Index(o, "*")
+			cs.wildcards = append(cs.wildcards, [2]string{o[:i], o[i+1:]})
+		default:
+			cs.origins[o] = true
+		}
+	}
+	if len(c.AllowedMethods) > 0 {
+		cs.methods = make([]string, len(c.AllowedMethods))
+		for i, m := range c.AllowedMethods {
+			cs.methods[i] = strings.ToUpper(m)
+		}
+	}
+	if len(c.AllowedHeaders) > 0 {
+		cs.headers = c.AllowedHeaders
+	}
+	if c.MaxAge != nil && c.MaxAge.Duration > 0 {
+		cs.maxAge = strconv.Itoa(int(c.MaxAge.Seconds()))
+	}
+	for _, e := range corsDefaultEndpoints {
+		cs.endpoints[e] = true
+	}
+	for _, e := range c.Endpoints {
+		cs.endpoints[e] = true
+	}
+	return cs
+}
+
+// allowOrigin returns true if the given origin is allowed.
+func (c *cors) allowOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	if c.anyOrigin || c.origins[origin] {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) {
+			label := origin[len(w[0]) : len(origin)-len(w[1])]
+			if label != "" && !strings.ContainsAny(label, ".:/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowMethod returns true if the given method is allowed.
+func (c *cors) allowMethod(method string) bool {
+	for _, m := range c.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders returns true if all the headers in the comma separated list
+// are allowed.
+func (c *cors) allowHeaders(headers string) bool {
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		var ok bool
+		for _, allowed := range c.headers {
+			if strings.EqualFold(h, allowed) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin adds the headers that allow the given origin.
+func (c *cors) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin && !c.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handler is a middleware that adds the CORS headers to the response if the
+// origin of the request is allowed.
+func (c *cors) handler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Add("Vary", "Origin")
+			if c.allowOrigin(origin) {
+				c.setOrigin(w.Header(), origin)
+			}
+		}
+		next(w, r)
+	}
+}
+
+// preflight is the HTTP handler that answers the preflight requests. It does
+// not require a client certificate, even in the endpoints that require one.
+func (c *cors) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	switch {
+	case origin == "":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case !c.allowOrigin(origin):
+		WriteError(w, errs.Forbidden("cors: origin %s is not allowed", origin))
+		return
+	case !c.allowMethod(method):
+		WriteError(w, errs.Forbidden("cors: method %s is not allowed", method))
+		return
+	case !c.allowHeaders(r.Header.Get("Access-Control-Request-Headers")):
+		WriteError(w, errs.Forbidden("cors: headers %s are not allowed", r.Header.Get("Access-Control-Request-Headers")))
+		return
+	}
+
+	c.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// corsRouter is a Router that adds the CORS middleware to the allowed
+// endpoints and the routes for their preflight requests.
+type corsRouter struct {
+	Router
+	cors      *cors
+	preflight map[string]bool
+}
+
+func (c *cors) router(r Router) Router {
+	return &corsRouter{
+		Router:    r,
+		cors:      c,
+		preflight: make(map[string]bool),
+	}
+}
+
+// MethodFunc implements the Router interface.
+func (r *corsRouter) MethodFunc(method, pattern string, h http.HandlerFunc) {
+	if !r.cors.endpoints[pattern] {
+		r.Router.MethodFunc(method, pattern, h)
+		return
+	}
+	r.Router.MethodFunc(method, pattern, r.cors.handler(h))
+	if !r.preflight[pattern] {
+		r.preflight[pattern] = true
+		r.Router.MethodFunc("OPTIONS", pattern, r.cors.preflight)
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+func Test_caHandler_cors(t *testing.T) {
+	mux := chi.NewRouter()
+	New(&mockAuthority{}, WithCORS(&authority.CORSConfig{
+		AllowedOrigins:   []string{"https://ui.example.com", "https://*.smallstep.com"},
+		AllowedHeaders:   []string{"Content-Type", "X-Request-Id"},
+		MaxAge:           &provisioner.Duration{Duration: 10 * time.Minute},
+		AllowCredentials: true,
+		Endpoints:        []string{"/renew"},
+	})).Route(mux)
+
+	type want struct {
+		statusCode  int
+		origin      string
+		credentials string
+		methods     string
+		headers     string
+		maxAge      string
+	}
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		want    want
+	}{
+		{"ok", "GET", "/health", map[string]string{"Origin": "https://ui.example.com"},
+			want{200, "https://ui.example.com", "true", "", "", ""}},
+		{"ok wildcard", "GET", "/health", map[string]string{"Origin": "https://ca.smallstep.com"},
+			want{200, "https://ca.smallstep.com", "true", "", "", ""}},
+		{"ok no origin", "GET", "/health", nil,
+			want{200, "", "", "", "", ""}},
+		{"ok preflight", "OPTIONS", "/health", map[string]string{
+			"Origin":                         "https://ui.example.com",
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "x-request-id",
+		}, want{204, "https://ui.example.com", "true", "GET, HEAD, POST", "Content-Type, X-Request-Id", "600"}},
+		{"ok preflight without client certificate", "OPTIONS", "/renew", map[string]string{
+			"Origin":                        "https://ui.example.com",
+			"Access-Control-Request-Method": "POST",
+		}, want{204, "https://ui.example.com", "true", "GET, HEAD, POST", "Content-Type, X-Request-Id", "600"}},
+		{"fail origin", "GET", "/health", map[string]string{"Origin": "https://evil.example.com"},
+			want{200, "", "", "", "", ""}},
+		{"fail wildcard subdomain", "GET", "/health", map[string]string{"Origin": "https://a.b.smallstep.com"},
+			want{200, "", "", "", "", ""}},
+		{"fail wildcard port", "GET", "/health", map[string]string{"Origin": "https://ca.smallstep.com:8443"},
+			want{200, "", "", "", "", ""}},
+		{"fail preflight origin", "OPTIONS", "/health", map[string]string{
+			"Origin":                        "https://evil.example.com",
+			"Access-Control-Request-Method": "GET",
+		}, want{403, "", "", "", "", ""}},
+		{"fail preflight method", "OPTIONS", "/health", map[string]string{
+			"Origin":                        "https://ui.example.com",
+			"Access-Control-Request-Method": "DELETE",
+		}, want{403, "", "", "", "", ""}},
+		{"fail preflight headers", "OPTIONS", "/health", map[string]string{
+			"Origin":                         "https://ui.example.com",
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "Authorization",
+		}, want{403, "", "", "", "", ""}},
+		{"fail preflight endpoint", "OPTIONS", "/sign", map[string]string{
+			"Origin":                        "https://ui.example.com",
+			"Access-Control-Request-Method": "POST",
+		}, want{405, "", "", "", "", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com"+tt.path, http.NoBody)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			res := w.Result()
+			if res.StatusCode != tt.want.statusCode {
+				t.Errorf("StatusCode = %d, wants %d", res.StatusCode, tt.want.statusCode)
+			}
+			for k, v := range map[string]string{
+				"Access-Control-Allow-Origin":      tt.want.origin,
+				"Access-Control-Allow-Credentials": tt.want.credentials,
+				"Access-Control-Allow-Methods":     tt.want.methods,
+				"Access-Control-Allow-Headers":     tt.want.headers,
+				"Access-Control-Max-Age":           tt.want.maxAge,
+			} {
+				if got := res.Header.Get(k); got != v {
+					t.Errorf("%s = %s, wants %s", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func Test_caHandler_cors_anyOrigin(t *testing.T) {
+	mux := chi.NewRouter()
+	New(&mockAuthority{}, WithCORS(&authority.CORSConfig{
+		AllowedOrigins: []string{"*"},
+	})).Route(mux)
+
+	req := httptest.NewRequest("GET", "http://example.com/health", http.NoBody)
+	req.Header.Set("Origin", "https://ui.example.com")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	res := w.Result()
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %s, wants *", got)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %s, wants empty", got)
+	}
+}
@@ -3,8 +3,10 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/acme"
@@ -12,16 +14,27 @@ import (
 	"github.com/smallstep/certificates/logging"
 )
 
-// WriteError writes to w a JSON representation of the given error.
+// WriteError writes to w an RFC 7807 representation of the given error. ACME
+// errors are written using the ACME problem types, the rest of the errors are
+// converted to an errs.Error, so only the status and the user friendly message
+// are written, the request identifier is added if it is in the response
+// headers. All the handlers must use this method to write errors.
 func WriteError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/problem+json")
 	switch k := err.(type) {
 	case *acme.Error:
-		w.Header().Set("Content-Type", "application/problem+json")
 		err = k.ToACME()
 	default:
-		w.Header().Set("Content-Type", "application/json")
+		e, _ := errs.NewErr(http.StatusInternalServerError, err).(*errs.Error)
+		if e.RequestID == "" {
+			e.RequestID = w.Header().Get(logging.RequestIDHeader)
+		}
+		err = e
 	}
 	cause := errors.Cause(err)
+	if e, ok := err.(*errs.Error); ok && e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
 	if sc, ok := err.(errs.StatusCoder); ok {
 		w.WriteHeader(sc.StatusCode())
 	} else {
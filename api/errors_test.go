@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/logging"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		requestID  string
+		wantStatus int
+		wantType   string
+		wantTitle  string
+		wantDetail string
+	}{
+		{"token-expired", errs.Unauthorized("token is expired", errs.WithType(errs.TypeTokenExpired)), "request-id",
+			401, "urn:smallstep:error:token-expired", "Expired token", errs.UnauthorizedDefaultMsg},
+		{"token-reused", errs.Unauthorized("token already used", errs.WithType(errs.TypeTokenReused)), "request-id",
+			401, "urn:smallstep:error:token-reused", "Token already used", errs.UnauthorizedDefaultMsg},
+		{"provisioner-disabled", errs.Unauthorized("provisioner foo is disabled",
+			errs.WithMessage("The provisioner foo is disabled."), errs.WithType(errs.TypeProvisionerDisabled)), "request-id",
+			401, "urn:smallstep:error:provisioner-disabled", "Provisioner disabled", "The provisioner foo is disabled."},
+		{"policy-violation", errs.Wrap(http.StatusUnauthorized, errors.New("dns name not allowed"), "authority.Sign",
+			errs.WithType(errs.TypePolicyViolation)), "request-id",
+			401, "urn:smallstep:error:policy-violation", "Policy violation", errs.UnauthorizedDefaultMsg},
+		{"db-unavailable", errs.Wrap(http.StatusInternalServerError, errors.New("connection refused"), "authority.Sign",
+			errs.WithType(errs.TypeDBUnavailable)), "request-id",
+			500, "urn:smallstep:error:db-unavailable", "Database unavailable", errs.InternalServerErrorDefaultMsg},
+		{"rate-limited", errs.TooManyRequests(time.Second, "rate limit exceeded"), "request-id",
+			429, "urn:smallstep:error:rate-limited", "Rate limit exceeded", errs.TooManyRequestsDefaultMsg},
+		{"not-found", errs.NotFound("not found"), "",
+			404, "urn:smallstep:error:not-found", "Not Found", errs.NotFoundDefaultMsg},
+		{"bad-request", errs.BadRequest("bad request"), "request-id",
+			400, "urn:smallstep:error:bad-request", "Bad Request", errs.BadRequestDefaultMsg},
+		{"plain error", errors.New("an internal error"), "request-id",
+			500, "urn:smallstep:error:internal", "Internal Server Error", "Internal Server Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if tt.requestID != "" {
+				w.Header().Set(logging.RequestIDHeader, tt.requestID)
+			}
+			WriteError(w, tt.err)
+			res := w.Result()
+			assert.Equals(t, tt.wantStatus, res.StatusCode)
+			assert.Equals(t, "application/problem+json", res.Header.Get("Content-Type"))
+
+			var body map[string]interface{}
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&body))
+			want := map[string]interface{}{
+				"type":    tt.wantType,
+				"title":   tt.wantTitle,
+				"detail":  tt.wantDetail,
+				"status":  float64(tt.wantStatus),
+				"message": tt.wantDetail,
+			}
+			if tt.requestID != "" {
+				want["requestId"] = tt.requestID
+			}
+			assert.Equals(t, want, body)
+		})
+	}
+}
+
+func TestWriteError_acme(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, acme.MalformedErr(errors.New("bad jws")))
+	res := w.Result()
+	assert.Equals(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equals(t, "application/problem+json", res.Header.Get("Content-Type"))
+
+	var body map[string]interface{}
+	assert.FatalError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equals(t, "urn:ietf:params:acme:error:malformed", body["type"])
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/smallstep/certificates/errs"
+)
+
+// limitByIP is a middleware that enforces the rate limit by client IP in the
+// endpoints that do not require a token. The IP is taken from the connection,
+// headers like X-Forwarded-For are not used as they can be forged.
+func (h *caHandler) limitByIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.ipLimiter != nil {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			if ok, wait := h.ipLimiter.Allow(ip); !ok {
+				WriteError(w, errs.TooManyRequests(wait, "client %s has exceeded the rate limit", ip))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// limitConcurrency is a middleware that enforces the limit of sign and renew
+// requests in flight. The requests shed get a 503 with a Retry-After header.
+func (h *caHandler) limitConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.concurrencyLimiter != nil {
+			release, ok := h.concurrencyLimiter.Acquire(r.Context())
+			if !ok {
+				WriteError(w, errs.ServiceUnavailable(h.retryAfter, "too many requests in flight"))
+				return
+			}
+			defer release()
+		}
+		next(w, r)
+	}
+}
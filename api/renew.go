@@ -1,8 +1,13 @@
 package api
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
+	"reflect"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/errs"
 )
 
@@ -10,15 +15,26 @@ import (
 // new one.
 func (h *caHandler) Renew(w http.ResponseWriter, r *http.Request) {
 	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
-		WriteError(w, errs.BadRequest("missing peer certificate"))
+		WriteError(w, errs.Unauthorized("missing peer certificate",
+			errs.WithMessage("The renew endpoint requires the certificate to renew as the TLS client certificate.")))
 		return
 	}
 
-	certChain, err := h.Authority.Renew(r.TLS.PeerCertificates[0])
+	cert, err := h.verifyPeerCertificate(r.TLS, h.renewGracePeriod)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	certChain, err := h.Authority.Renew(cert)
 	if err != nil {
 		WriteError(w, errs.Wrap(http.StatusInternalServerError, err, "cahandler.Renew"))
 		return
 	}
+	if err := equalIdentity(cert, certChain[0]); err != nil {
+		WriteError(w, errs.Wrap(http.StatusInternalServerError, err, "cahandler.Renew"))
+		return
+	}
 	certChainPEM := certChainToPEM(certChain)
 	var caPEM Certificate
 	if len(certChainPEM) > 1 {
@@ -33,3 +49,58 @@ func (h *caHandler) Renew(w http.ResponseWriter, r *http.Request) {
 		TLSOptions:   h.Authority.GetTLSOptions(),
 	}, http.StatusCreated)
 }
+
+// verifyPeerCertificate verifies the client certificate of the TLS connection
+// and returns it. The TLS server only requests the client certificate, so the
+// handlers that use it must check that it chains to one of the roots of the
+// CA. An expired certificate is accepted if it expired less than gracePeriod
+// ago.
+func (h *caHandler) verifyPeerCertificate(cs *tls.ConnectionState, gracePeriod time.Duration) (*x509.Certificate, error) {
+	cert := cs.PeerCertificates[0]
+	roots, err := h.Authority.GetRoots()
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "cahandler.verifyPeerCertificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, crt := range roots {
+		opts.Roots.AddCert(crt)
+	}
+	for _, crt := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(crt)
+	}
+
+	// Verify expired certificates at the time they expired.
+	if now := time.Now(); now.After(cert.NotAfter) {
+		if now.Sub(cert.NotAfter) > gracePeriod {
+			return nil, errs.Unauthorized("cahandler.verifyPeerCertificate: certificate expired on %s",
+				cert.NotAfter.Format(time.RFC3339))
+		}
+		opts.CurrentTime = cert.NotAfter
+	}
+
+	if _, err := cert.Verify(opts); err != nil {
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "cahandler.verifyPeerCertificate")
+	}
+	return cert, nil
+}
+
+// equalIdentity returns an error if the subject or the subject alternative
+// names of the renewed certificate are not the ones in the old certificate.
+func equalIdentity(oldCert, newCert *x509.Certificate) error {
+	switch {
+	case oldCert.Subject.String() != newCert.Subject.String():
+		return errors.Errorf("renewed certificate subject %s does not match %s", newCert.Subject, oldCert.Subject)
+	case !reflect.DeepEqual(oldCert.DNSNames, newCert.DNSNames),
+		!reflect.DeepEqual(oldCert.EmailAddresses, newCert.EmailAddresses),
+		!reflect.DeepEqual(oldCert.IPAddresses, newCert.IPAddresses),
+		!reflect.DeepEqual(oldCert.URIs, newCert.URIs):
+		return errors.New("renewed certificate subject alternative names do not match")
+	default:
+		return nil
+	}
+}
@@ -43,9 +43,9 @@ func (r *RevokeRequest) Validate() (err error) {
 
 // Revoke supports handful of different methods that revoke a Certificate.
 //
-// NOTE: currently only Passive revocation is supported.
+// NOTE: the revoked certificates are published in the CRL.
 //
-// TODO: Add CRL and OCSP support.
+// TODO: Add OCSP support.
 func (h *caHandler) Revoke(w http.ResponseWriter, r *http.Request) {
 	var body RevokeRequest
 	if err := ReadJSON(r.Body, &body); err != nil {
@@ -83,7 +83,12 @@ func (h *caHandler) Revoke(w http.ResponseWriter, r *http.Request) {
 			WriteError(w, errs.BadRequest("missing ott or peer certificate"))
 			return
 		}
-		opts.Crt = r.TLS.PeerCertificates[0]
+		crt, err := h.verifyPeerCertificate(r.TLS, 0)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		opts.Crt = crt
 		if opts.Crt.SerialNumber.String() != opts.Serial {
 			WriteError(w, errs.BadRequest("revoke: serial number in mtls certificate different than body"))
 			return
@@ -115,3 +120,16 @@ func logRevoke(w http.ResponseWriter, ri *authority.RevokeOptions) {
 		})
 	}
 }
+
+// CRL returns the DER encoded certificate revocation list of the CA.
+func (h *caHandler) CRL(w http.ResponseWriter, r *http.Request) {
+	crl, err := h.Authority.GetCRL()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	if _, err := w.Write(crl); err != nil {
+		LogError(w, err)
+	}
+}
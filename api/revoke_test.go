@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
@@ -135,11 +136,14 @@ func Test_caHandler_Revoke(t *testing.T) {
 			}
 		},
 		"200/no ott": func(t *testing.T) test {
+			root, rootKey := mustRootCertificate(t)
 			cs := &tls.ConnectionState{
-				PeerCertificates: []*x509.Certificate{parseCertificate(certPEM)},
+				PeerCertificates: []*x509.Certificate{
+					mustLeafCertificate(t, root, rootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)),
+				},
 			}
 			input, err := json.Marshal(RevokeRequest{
-				Serial:     "1404354960355712309",
+				Serial:     "1234",
 				ReasonCode: 4,
 				Reason:     "foo",
 				Passive:    true,
@@ -154,10 +158,13 @@ func Test_caHandler_Revoke(t *testing.T) {
 					authorizeSign: func(ott string) ([]provisioner.SignOption, error) {
 						return nil, nil
 					},
+					getRoots: func() ([]*x509.Certificate, error) {
+						return []*x509.Certificate{root}, nil
+					},
 					revoke: func(ctx context.Context, ri *authority.RevokeOptions) error {
 						assert.True(t, ri.PassiveOnly)
 						assert.True(t, ri.MTLS)
-						assert.Equals(t, ri.Serial, "1404354960355712309")
+						assert.Equals(t, ri.Serial, "1234")
 						assert.Equals(t, ri.ReasonCode, 4)
 						assert.Equals(t, ri.Reason, "foo")
 						return nil
@@ -173,6 +180,31 @@ func Test_caHandler_Revoke(t *testing.T) {
 				expected: []byte(`{"status":"ok"}`),
 			}
 		},
+		"401/no ott wrong ca": func(t *testing.T) test {
+			root, _ := mustRootCertificate(t)
+			otherRoot, otherRootKey := mustRootCertificate(t)
+			cs := &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{
+					mustLeafCertificate(t, otherRoot, otherRootKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)),
+				},
+			}
+			input, err := json.Marshal(RevokeRequest{
+				Serial:     "1234",
+				ReasonCode: 4,
+				Passive:    true,
+			})
+			assert.FatalError(t, err)
+			return test{
+				input:      string(input),
+				statusCode: http.StatusUnauthorized,
+				tls:        cs,
+				auth: &mockAuthority{
+					getRoots: func() ([]*x509.Certificate, error) {
+						return []*x509.Certificate{root}, nil
+					},
+				},
+			}
+		},
 		"500/ott authority.Revoke": func(t *testing.T) test {
 			input, err := json.Marshal(RevokeRequest{
 				Serial:     "sn",
@@ -245,3 +277,32 @@ func Test_caHandler_Revoke(t *testing.T) {
 		})
 	}
 }
+
+func Test_caHandler_CRL(t *testing.T) {
+	tests := []struct {
+		name       string
+		auth       *mockAuthority
+		statusCode int
+	}{
+		{"ok", &mockAuthority{ret1: []byte("crl")}, http.StatusOK},
+		{"fail/not-implemented", &mockAuthority{ret1: []byte(nil), err: errs.NotImplemented("not implemented")}, http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(tt.auth).(*caHandler)
+			req := httptest.NewRequest("GET", "http://example.com/crl", nil)
+			w := httptest.NewRecorder()
+			h.CRL(logging.NewResponseLogger(w), req)
+			res := w.Result()
+			assert.Equals(t, tt.statusCode, res.StatusCode)
+
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+			if tt.statusCode == http.StatusOK {
+				assert.Equals(t, "application/pkix-crl", res.Header.Get("Content-Type"))
+				assert.Equals(t, []byte("crl"), body)
+			}
+		})
+	}
+}
@@ -2,19 +2,25 @@ package api
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"net/http"
 
+	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/errs"
-	"github.com/smallstep/cli/crypto/tlsutil"
 )
 
 // SignRequest is the request body for a certificate signature request.
 type SignRequest struct {
-	CsrPEM    CertificateRequest `json:"csr"`
-	OTT       string             `json:"ott"`
-	NotAfter  TimeDuration       `json:"notAfter"`
-	NotBefore TimeDuration       `json:"notBefore"`
+	CsrPEM      CertificateRequest             `json:"csr"`
+	OTT         string                         `json:"ott"`
+	NotAfter    TimeDuration                   `json:"notAfter"`
+	NotBefore   TimeDuration                   `json:"notBefore"`
+	Attestation *provisioner.AttestationObject `json:"attestation,omitempty"`
+	// TemplateData is an optional JSON object available in the X.509
+	// templates as .Insecure.User. It is controlled by the requester.
+	TemplateData json.RawMessage `json:"templateData,omitempty"`
+	userData     map[string]interface{}
 }
 
 // Validate checks the fields of the SignRequest and returns nil if they are ok
@@ -29,17 +35,24 @@ func (s *SignRequest) Validate() error {
 	if s.OTT == "" {
 		return errs.BadRequest("missing ott")
 	}
+	if len(s.TemplateData) > 0 {
+		v, err := provisioner.ParseUserData(s.TemplateData)
+		if err != nil {
+			return errs.Wrap(http.StatusBadRequest, err, "invalid templateData")
+		}
+		s.userData = v
+	}
 
 	return nil
 }
 
 // SignResponse is the response object of the certificate signature request.
 type SignResponse struct {
-	ServerPEM    Certificate          `json:"crt"`
-	CaPEM        Certificate          `json:"ca"`
-	CertChainPEM []Certificate        `json:"certChain"`
-	TLSOptions   *tlsutil.TLSOptions  `json:"tlsOptions,omitempty"`
-	TLS          *tls.ConnectionState `json:"-"`
+	ServerPEM    Certificate           `json:"crt"`
+	CaPEM        Certificate           `json:"ca"`
+	CertChainPEM []Certificate         `json:"certChain"`
+	TLSOptions   *authority.TLSOptions `json:"tlsOptions,omitempty"`
+	TLS          *tls.ConnectionState  `json:"-"`
 }
 
 // Sign is an HTTP handler that reads a certificate request and an
@@ -59,17 +72,20 @@ func (h *caHandler) Sign(w http.ResponseWriter, r *http.Request) {
 	}
 
 	opts := provisioner.Options{
-		NotBefore: body.NotBefore,
-		NotAfter:  body.NotAfter,
+		NotBefore:   body.NotBefore,
+		NotAfter:    body.NotAfter,
+		Attestation: body.Attestation,
+		UserData:    body.userData,
 	}
 
-	signOpts, err := h.Authority.AuthorizeSign(body.OTT)
+	ctx := provisioner.NewContextWithMethod(r.Context(), provisioner.SignMethod)
+	signOpts, err := h.Authority.Authorize(ctx, body.OTT)
 	if err != nil {
 		WriteError(w, errs.UnauthorizedErr(err))
 		return
 	}
 
-	certChain, err := h.Authority.Sign(body.CsrPEM.CertificateRequest, opts, signOpts...)
+	certChain, err := h.Authority.SignWithContext(r.Context(), body.CsrPEM.CertificateRequest, opts, signOpts...)
 	if err != nil {
 		WriteError(w, errs.ForbiddenErr(err))
 		return
@@ -80,6 +96,7 @@ func (h *caHandler) Sign(w http.ResponseWriter, r *http.Request) {
 		caPEM = certChainPEM[1]
 	}
 	logCertificate(w, certChain[0])
+	logTemplate(w, signOpts)
 	JSONStatus(w, &SignResponse{
 		ServerPEM:    certChainPEM[0],
 		CaPEM:        caPEM,
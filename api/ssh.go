@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/base64"
@@ -11,6 +12,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/sshutil"
 	"github.com/smallstep/certificates/templates"
@@ -29,11 +31,12 @@ type SSHAuthority interface {
 	CheckSSHHost(ctx context.Context, principal string, token string) (bool, error)
 	GetSSHHosts(cert *x509.Certificate) ([]sshutil.Host, error)
 	GetSSHBastion(user string, hostname string) (*authority.Bastion, error)
+	GetSSHRevocations() ([]*db.RevokedCertificateInfo, error)
 }
 
 // SSHSignRequest is the request body of an SSH certificate request.
 type SSHSignRequest struct {
-	PublicKey        []byte             `json:"publicKey"` // base64 encoded
+	PublicKey        SSHPublicKeyBytes  `json:"publicKey"`
 	OTT              string             `json:"ott"`
 	CertType         string             `json:"certType,omitempty"`
 	Principals       []string           `json:"principals,omitempty"`
@@ -67,6 +70,7 @@ func (s *SSHSignRequest) Validate() error {
 // SSHSignResponse is the response object that returns the SSH certificate.
 type SSHSignResponse struct {
 	Certificate         SSHCertificate  `json:"crt"`
+	CAKey               *SSHPublicKey   `json:"caKey,omitempty"`
 	AddUserCertificate  *SSHCertificate `json:"addUserCrt,omitempty"`
 	IdentityCertificate []Certificate   `json:"identityCrt,omitempty"`
 }
@@ -165,6 +169,40 @@ func (p *SSHPublicKey) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// SSHPublicKeyBytes is a public key in the openssh wire format. In JSON it is
+// the base64 encoded wire format, or a key in the authorized_keys format.
+type SSHPublicKeyBytes []byte
+
+// MarshalJSON implements the json.Marshaler interface. Returns the base64
+// encoded wire format of the key.
+func (b SSHPublicKeyBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]byte(b))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. The key is expected
+// to be a quoted, base64 encoded, openssh wire formatted block of bytes, or a
+// quoted key in the authorized_keys format.
+func (b *SSHPublicKeyBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrap(err, "error decoding ssh public key")
+	}
+	if s == "" {
+		*b = nil
+		return nil
+	}
+	if data, err := base64.StdEncoding.DecodeString(s); err == nil {
+		*b = data
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return errors.Wrap(err, "error parsing ssh public key")
+	}
+	*b = pub.Marshal()
+	return nil
+}
+
 // Template represents the output of a template.
 type Template = templates.Output
 
@@ -333,13 +371,14 @@ func (h *caHandler) SSHSign(w http.ResponseWriter, r *http.Request) {
 
 	JSONStatus(w, &SSHSignResponse{
 		Certificate:         SSHCertificate{cert},
+		CAKey:               &SSHPublicKey{PublicKey: cert.SignatureKey},
 		AddUserCertificate:  addUserCertificate,
 		IdentityCertificate: identityCertificate,
 	}, http.StatusCreated)
 }
 
 // SSHRoots is an HTTP handler that returns the SSH public keys for user and host
-// certificates.
+// certificates, see writeSSHKeys for the formats.
 func (h *caHandler) SSHRoots(w http.ResponseWriter, r *http.Request) {
 	keys, err := h.Authority.GetSSHRoots()
 	if err != nil {
@@ -348,23 +387,17 @@ func (h *caHandler) SSHRoots(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(keys.HostKeys) == 0 && len(keys.UserKeys) == 0 {
-		WriteError(w, errs.NotFound("no keys found"))
+		WriteError(w, errs.NotFound("ssh roots; ssh is not configured",
+			errs.WithMessage("SSH is not configured on the certificate authority.")))
 		return
 	}
 
-	resp := new(SSHRootsResponse)
-	for _, k := range keys.HostKeys {
-		resp.HostKeys = append(resp.HostKeys, SSHPublicKey{PublicKey: k})
-	}
-	for _, k := range keys.UserKeys {
-		resp.UserKeys = append(resp.UserKeys, SSHPublicKey{PublicKey: k})
-	}
-
-	JSON(w, resp)
+	writeSSHKeys(w, r, keys)
 }
 
 // SSHFederation is an HTTP handler that returns the federated SSH public keys
-// for user and host certificates.
+// for user and host certificates, the keys of this CA and the ones of the
+// federated CAs, see writeSSHKeys for the formats.
 func (h *caHandler) SSHFederation(w http.ResponseWriter, r *http.Request) {
 	keys, err := h.Authority.GetSSHFederation()
 	if err != nil {
@@ -373,19 +406,60 @@ func (h *caHandler) SSHFederation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(keys.HostKeys) == 0 && len(keys.UserKeys) == 0 {
-		WriteError(w, errs.NotFound("no keys found"))
+		WriteError(w, errs.NotFound("ssh federation; ssh is not configured",
+			errs.WithMessage("SSH is not configured on the certificate authority.")))
+		return
+	}
+
+	writeSSHKeys(w, r, keys)
+}
+
+// writeSSHKeys writes the SSH keys in JSON by default. With
+// format=authorized_keys they are written one per line in the authorized_keys
+// format, labeled with the type in the comment. The type parameter limits the
+// keys to the user or host ones.
+func writeSSHKeys(w http.ResponseWriter, r *http.Request, keys *authority.SSHKeys) {
+	q := r.URL.Query()
+	format, typ := q.Get("format"), q.Get("type")
+	if format != "" && format != "json" && format != "authorized_keys" {
+		WriteError(w, errs.BadRequest("unsupported format %s", format))
+		return
+	}
+	if typ != "" && typ != provisioner.SSHUserCert && typ != provisioner.SSHHostCert {
+		WriteError(w, errs.BadRequest("unsupported type %s", typ))
 		return
 	}
 
 	resp := new(SSHRootsResponse)
-	for _, k := range keys.HostKeys {
-		resp.HostKeys = append(resp.HostKeys, SSHPublicKey{PublicKey: k})
+	if typ != provisioner.SSHUserCert {
+		for _, k := range keys.HostKeys {
+			resp.HostKeys = append(resp.HostKeys, SSHPublicKey{PublicKey: k})
+		}
 	}
-	for _, k := range keys.UserKeys {
-		resp.UserKeys = append(resp.UserKeys, SSHPublicKey{PublicKey: k})
+	if typ != provisioner.SSHHostCert {
+		for _, k := range keys.UserKeys {
+			resp.UserKeys = append(resp.UserKeys, SSHPublicKey{PublicKey: k})
+		}
 	}
 
-	JSON(w, resp)
+	if format != "authorized_keys" {
+		JSON(w, resp)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, k := range resp.UserKeys {
+		buf.Write(bytes.TrimSpace(ssh.MarshalAuthorizedKey(k.PublicKey)))
+		buf.WriteString(" " + provisioner.SSHUserCert + "\n")
+	}
+	for _, k := range resp.HostKeys {
+		buf.Write(bytes.TrimSpace(ssh.MarshalAuthorizedKey(k.PublicKey)))
+		buf.WriteString(" " + provisioner.SSHHostCert + "\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		LogError(w, err)
+	}
 }
 
 // SSHConfig is an HTTP handler that returns rendered templates for ssh clients
@@ -422,6 +496,9 @@ func (h *caHandler) SSHConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 // SSHCheckHost is the HTTP handler that returns if a hosts certificate exists or not.
+// The response reveals the known hosts, so the request must be authenticated
+// with a client certificate issued by the CA or with a valid token. The token
+// is not marked as used.
 func (h *caHandler) SSHCheckHost(w http.ResponseWriter, r *http.Request) {
 	var body SSHCheckPrincipalRequest
 	if err := ReadJSON(r.Body, &body); err != nil {
@@ -433,6 +510,23 @@ func (h *caHandler) SSHCheckHost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch {
+	case r.TLS != nil && len(r.TLS.PeerCertificates) > 0:
+		if _, err := h.verifyPeerCertificate(r.TLS, 0); err != nil {
+			WriteError(w, err)
+			return
+		}
+	case body.Token != "":
+		ctx := provisioner.NewContextWithMethod(r.Context(), provisioner.SSHCheckHostMethod)
+		if _, err := h.Authority.Authorize(ctx, body.Token); err != nil {
+			WriteError(w, errs.UnauthorizedErr(err))
+			return
+		}
+	default:
+		WriteError(w, errs.Unauthorized("missing client certificate or token"))
+		return
+	}
+
 	exists, err := h.Authority.CheckSSHHost(r.Context(), body.Principal, body.Token)
 	if err != nil {
 		WriteError(w, errs.InternalServerErr(err))
@@ -447,7 +541,11 @@ func (h *caHandler) SSHCheckHost(w http.ResponseWriter, r *http.Request) {
 func (h *caHandler) SSHGetHosts(w http.ResponseWriter, r *http.Request) {
 	var cert *x509.Certificate
 	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
-		cert = r.TLS.PeerCertificates[0]
+		var err error
+		if cert, err = h.verifyPeerCertificate(r.TLS, 0); err != nil {
+			WriteError(w, err)
+			return
+		}
 	}
 
 	hosts, err := h.Authority.GetSSHHosts(cert)
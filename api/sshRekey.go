@@ -32,11 +32,13 @@ func (s *SSHRekeyRequest) Validate() error {
 type SSHRekeyResponse struct {
 	Certificate         SSHCertificate `json:"crt"`
 	IdentityCertificate []Certificate  `json:"identityCrt,omitempty"`
+	// HostKeys are the current SSH host CA keys.
+	HostKeys []SSHPublicKey `json:"hostKey,omitempty"`
 }
 
 // SSHRekey is an HTTP handler that reads an RekeySSHRequest with a one-time-token
 // (ott) from the body and creates a new SSH certificate with the information in
-// the request.
+// the request. The response includes the SSH host CA keys.
 func (h *caHandler) SSHRekey(w http.ResponseWriter, r *http.Request) {
 	var body SSHRekeyRequest
 	if err := ReadJSON(r.Body, &body); err != nil {
@@ -65,6 +67,7 @@ func (h *caHandler) SSHRekey(w http.ResponseWriter, r *http.Request) {
 	oldCert, _, err := provisioner.ExtractSSHPOPCert(body.OTT)
 	if err != nil {
 		WriteError(w, errs.InternalServerErr(err))
+		return
 	}
 
 	newCert, err := h.Authority.RekeySSH(oldCert, publicKey, signOpts...)
@@ -79,8 +82,19 @@ func (h *caHandler) SSHRekey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keys, err := h.Authority.GetSSHRoots()
+	if err != nil {
+		WriteError(w, errs.InternalServerErr(err))
+		return
+	}
+	hostKeys := make([]SSHPublicKey, len(keys.HostKeys))
+	for i, k := range keys.HostKeys {
+		hostKeys[i] = SSHPublicKey{PublicKey: k}
+	}
+
 	JSONStatus(w, &SSHRekeyResponse{
 		Certificate:         SSHCertificate{newCert},
 		IdentityCertificate: identity,
+		HostKeys:            hostKeys,
 	}, http.StatusCreated)
 }
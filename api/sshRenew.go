@@ -55,6 +55,7 @@ func (h *caHandler) SSHRenew(w http.ResponseWriter, r *http.Request) {
 	oldCert, _, err := provisioner.ExtractSSHPOPCert(body.OTT)
 	if err != nil {
 		WriteError(w, errs.InternalServerErr(err))
+		return
 	}
 
 	newCert, err := h.Authority.RenewSSH(oldCert)
@@ -81,7 +82,12 @@ func (h *caHandler) renewIdentityCertificate(r *http.Request) ([]Certificate, er
 		return nil, nil
 	}
 
-	certChain, err := h.Authority.Renew(r.TLS.PeerCertificates[0])
+	cert, err := h.verifyPeerCertificate(r.TLS, h.renewGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	certChain, err := h.Authority.Renew(cert)
 	if err != nil {
 		return nil, err
 	}
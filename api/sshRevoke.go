@@ -2,10 +2,13 @@ package api
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/logging"
 	"golang.org/x/crypto/ocsp"
@@ -96,3 +99,58 @@ func logSSHRevoke(w http.ResponseWriter, ri *authority.RevokeOptions) {
 		})
 	}
 }
+
+// SSHRevokedCertificate is the revocation information of an SSH certificate.
+type SSHRevokedCertificate struct {
+	Serial     string    `json:"serial"`
+	RevokedAt  time.Time `json:"revokedAt"`
+	ReasonCode int       `json:"reasonCode"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// SSHRevokedResponse is the response object of the SSH revocations endpoint.
+type SSHRevokedResponse struct {
+	Revoked []SSHRevokedCertificate `json:"revoked"`
+}
+
+// SSHRevoked is an HTTP handler that returns the serial numbers of the revoked
+// SSH certificates. With format=krl the serial numbers are returned as a key
+// revocation list specification that can be compiled with `ssh-keygen -k -s
+// ssh_user_ca_key.pub -f revoked_keys spec`.
+func (h *caHandler) SSHRevoked(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "krl" {
+		WriteError(w, errs.BadRequest("unsupported format %s", format))
+		return
+	}
+	rcis, err := h.Authority.GetSSHRevocations()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if format == "krl" {
+		writeKRLSpec(w, rcis)
+		return
+	}
+	resp := &SSHRevokedResponse{Revoked: make([]SSHRevokedCertificate, len(rcis))}
+	for i, rci := range rcis {
+		resp.Revoked[i] = SSHRevokedCertificate{
+			Serial:     rci.Serial,
+			RevokedAt:  rci.RevokedAt,
+			ReasonCode: rci.ReasonCode,
+			Reason:     rci.Reason,
+		}
+	}
+	JSON(w, resp)
+}
+
+// writeKRLSpec writes one "serial: N" line per revoked certificate.
+func writeKRLSpec(w http.ResponseWriter, rcis []*db.RevokedCertificateInfo) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, rci := range rcis {
+		if _, err := fmt.Fprintf(w, "serial: %s\n", rci.Serial); err != nil {
+			LogError(w, err)
+			return
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -21,6 +22,8 @@ import (
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/logging"
 	"github.com/smallstep/certificates/sshutil"
 	"github.com/smallstep/certificates/templates"
@@ -259,6 +262,8 @@ func Test_caHandler_SSHSign(t *testing.T) {
 
 	userB64 := base64.StdEncoding.EncodeToString(user.Marshal())
 	hostB64 := base64.StdEncoding.EncodeToString(host.Marshal())
+	userCAB64 := base64.StdEncoding.EncodeToString(user.SignatureKey.Marshal())
+	hostCAB64 := base64.StdEncoding.EncodeToString(host.SignatureKey.Marshal())
 
 	userReq, err := json.Marshal(SSHSignRequest{
 		PublicKey: user.Key.Marshal(),
@@ -270,6 +275,11 @@ func Test_caHandler_SSHSign(t *testing.T) {
 		OTT:       "ott",
 	})
 	assert.FatalError(t, err)
+	userAuthorizedKeyReq, err := json.Marshal(map[string]string{
+		"publicKey": string(ssh.MarshalAuthorizedKey(user.Key)),
+		"ott":       "ott",
+	})
+	assert.FatalError(t, err)
 	userAddReq, err := json.Marshal(SSHSignRequest{
 		PublicKey:        user.Key.Marshal(),
 		OTT:              "ott",
@@ -300,13 +310,15 @@ func Test_caHandler_SSHSign(t *testing.T) {
 		body         []byte
 		statusCode   int
 	}{
-		{"ok-user", userReq, nil, user, nil, nil, nil, nil, nil, []byte(fmt.Sprintf(`{"crt":"%s"}`, userB64)), http.StatusCreated},
-		{"ok-host", hostReq, nil, host, nil, nil, nil, nil, nil, []byte(fmt.Sprintf(`{"crt":"%s"}`, hostB64)), http.StatusCreated},
-		{"ok-user-add", userAddReq, nil, user, nil, user, nil, nil, nil, []byte(fmt.Sprintf(`{"crt":"%s","addUserCrt":"%s"}`, userB64, userB64)), http.StatusCreated},
-		{"ok-user-identity", userIdentityReq, nil, user, nil, user, nil, identityCerts, nil, []byte(fmt.Sprintf(`{"crt":"%s","identityCrt":[%s]}`, userB64, identityCertsPEM)), http.StatusCreated},
+		{"ok-user", userReq, nil, user, nil, nil, nil, nil, nil, []byte(fmt.Sprintf(`{"crt":"%s","caKey":"%s"}`, userB64, userCAB64)), http.StatusCreated},
+		{"ok-user-authorized-key", userAuthorizedKeyReq, nil, user, nil, nil, nil, nil, nil, []byte(fmt.Sprintf(`{"crt":"%s","caKey":"%s"}`, userB64, userCAB64)), http.StatusCreated},
+		{"ok-host", hostReq, nil, host, nil, nil, nil, nil, nil, []byte(fmt.Sprintf(`{"crt":"%s","caKey":"%s"}`, hostB64, hostCAB64)), http.StatusCreated},
+		{"ok-user-add", userAddReq, nil, user, nil, user, nil, nil, nil, []byte(fmt.Sprintf(`{"crt":"%s","caKey":"%s","addUserCrt":"%s"}`, userB64, userCAB64, userB64)), http.StatusCreated},
+		{"ok-user-identity", userIdentityReq, nil, user, nil, user, nil, identityCerts, nil, []byte(fmt.Sprintf(`{"crt":"%s","caKey":"%s","identityCrt":[%s]}`, userB64, userCAB64, identityCertsPEM)), http.StatusCreated},
 		{"fail-body", []byte("bad-json"), nil, nil, nil, nil, nil, nil, nil, nil, http.StatusBadRequest},
 		{"fail-validate", []byte("{}"), nil, nil, nil, nil, nil, nil, nil, nil, http.StatusBadRequest},
 		{"fail-publicKey", []byte(`{"publicKey":"Zm9v","ott":"ott"}`), nil, nil, nil, nil, nil, nil, nil, nil, http.StatusBadRequest},
+		{"fail-authorized-key", []byte(`{"publicKey":"ssh-ed25519 foo","ott":"ott"}`), nil, nil, nil, nil, nil, nil, nil, nil, http.StatusBadRequest},
 		{"fail-publicKey", []byte(fmt.Sprintf(`{"publicKey":"%s","ott":"ott","addUserPublicKey":"Zm9v"}`, base64.StdEncoding.EncodeToString(user.Key.Marshal()))), nil, nil, nil, nil, nil, nil, nil, nil, http.StatusBadRequest},
 		{"fail-authorize", userReq, fmt.Errorf("an-error"), nil, nil, nil, nil, nil, nil, nil, http.StatusUnauthorized},
 		{"fail-signSSH", userReq, nil, nil, fmt.Errorf("an-error"), nil, nil, nil, nil, nil, http.StatusForbidden},
@@ -357,24 +369,33 @@ func Test_caHandler_SSHRoots(t *testing.T) {
 	user, err := ssh.NewPublicKey(sshUserKey.Public())
 	assert.FatalError(t, err)
 	userB64 := base64.StdEncoding.EncodeToString(user.Marshal())
+	userAuthorizedKey := "ecdsa-sha2-nistp256 " + userB64
 
 	host, err := ssh.NewPublicKey(sshHostKey.Public())
 	assert.FatalError(t, err)
 	hostB64 := base64.StdEncoding.EncodeToString(host.Marshal())
+	hostAuthorizedKey := "ecdsa-sha2-nistp256 " + hostB64
 
 	tests := []struct {
 		name       string
+		query      string
 		keys       *authority.SSHKeys
 		keysErr    error
 		body       []byte
 		statusCode int
 	}{
-		{"ok", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host}, UserKeys: []ssh.PublicKey{user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s"],"hostKey":["%s"]}`, userB64, hostB64)), http.StatusOK},
-		{"many", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host, host}, UserKeys: []ssh.PublicKey{user, user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s","%s"],"hostKey":["%s","%s"]}`, userB64, userB64, hostB64, hostB64)), http.StatusOK},
-		{"user", &authority.SSHKeys{UserKeys: []ssh.PublicKey{user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s"]}`, userB64)), http.StatusOK},
-		{"host", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host}}, nil, []byte(fmt.Sprintf(`{"hostKey":["%s"]}`, hostB64)), http.StatusOK},
-		{"empty", &authority.SSHKeys{}, nil, nil, http.StatusNotFound},
-		{"error", nil, fmt.Errorf("an error"), nil, http.StatusInternalServerError},
+		{"ok", "", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host}, UserKeys: []ssh.PublicKey{user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s"],"hostKey":["%s"]}`, userB64, hostB64)), http.StatusOK},
+		{"many", "", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host, host}, UserKeys: []ssh.PublicKey{user, user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s","%s"],"hostKey":["%s","%s"]}`, userB64, userB64, hostB64, hostB64)), http.StatusOK},
+		{"user", "", &authority.SSHKeys{UserKeys: []ssh.PublicKey{user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s"]}`, userB64)), http.StatusOK},
+		{"host", "", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host}}, nil, []byte(fmt.Sprintf(`{"hostKey":["%s"]}`, hostB64)), http.StatusOK},
+		{"json", "?format=json", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host}, UserKeys: []ssh.PublicKey{user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s"],"hostKey":["%s"]}`, userB64, hostB64)), http.StatusOK},
+		{"type-user", "?type=user", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host}, UserKeys: []ssh.PublicKey{user}}, nil, []byte(fmt.Sprintf(`{"userKey":["%s"]}`, userB64)), http.StatusOK},
+		{"authorized-keys", "?format=authorized_keys", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host, host}, UserKeys: []ssh.PublicKey{user}}, nil, []byte(userAuthorizedKey + " user\n" + hostAuthorizedKey + " host\n" + hostAuthorizedKey + " host"), http.StatusOK},
+		{"authorized-keys-host", "?format=authorized_keys&type=host", &authority.SSHKeys{HostKeys: []ssh.PublicKey{host}, UserKeys: []ssh.PublicKey{user}}, nil, []byte(hostAuthorizedKey + " host"), http.StatusOK},
+		{"empty", "", &authority.SSHKeys{}, nil, nil, http.StatusNotFound},
+		{"bad-format", "?format=pem", &authority.SSHKeys{UserKeys: []ssh.PublicKey{user}}, nil, nil, http.StatusBadRequest},
+		{"bad-type", "?type=foo", &authority.SSHKeys{UserKeys: []ssh.PublicKey{user}}, nil, nil, http.StatusBadRequest},
+		{"error", "", nil, fmt.Errorf("an error"), nil, http.StatusInternalServerError},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -384,7 +405,7 @@ func Test_caHandler_SSHRoots(t *testing.T) {
 				},
 			}).(*caHandler)
 
-			req := httptest.NewRequest("GET", "http://example.com/ssh/roots", http.NoBody)
+			req := httptest.NewRequest("GET", "http://example.com/ssh/roots"+tt.query, http.NoBody)
 			w := httptest.NewRecorder()
 			h.SSHRoots(logging.NewResponseLogger(w), req)
 			res := w.Result()
@@ -403,8 +424,23 @@ func Test_caHandler_SSHRoots(t *testing.T) {
 					t.Errorf("caHandler.SSHRoots Body = %s, wants %s", body, tt.body)
 				}
 			}
+			if tt.statusCode == http.StatusNotFound {
+				assert.True(t, strings.Contains(string(body), "SSH is not configured on the certificate authority."))
+			}
 		})
 	}
+
+	t.Run("content-type", func(t *testing.T) {
+		h := New(&mockAuthority{ret1: &authority.SSHKeys{UserKeys: []ssh.PublicKey{user}}}).(*caHandler)
+		for query, contentType := range map[string]string{
+			"":                        "application/json",
+			"?format=authorized_keys": "text/plain; charset=utf-8",
+		} {
+			w := httptest.NewRecorder()
+			h.SSHRoots(w, httptest.NewRequest("GET", "http://example.com/ssh/roots"+query, http.NoBody))
+			assert.Equals(t, contentType, w.Result().Header.Get("Content-Type"))
+		}
+	})
 }
 
 func Test_caHandler_SSHFederation(t *testing.T) {
@@ -459,6 +495,23 @@ func Test_caHandler_SSHFederation(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("authorized-keys", func(t *testing.T) {
+		other, err := ssh.NewPublicKey(sshSignerKey.Public())
+		assert.FatalError(t, err)
+		h := New(&mockAuthority{ret1: &authority.SSHKeys{
+			UserKeys: []ssh.PublicKey{user, other},
+			HostKeys: []ssh.PublicKey{host},
+		}}).(*caHandler)
+		w := httptest.NewRecorder()
+		h.SSHFederation(w, httptest.NewRequest("GET", "http://example.com/ssh/federation?format=authorized_keys", http.NoBody))
+		res := w.Result()
+		assert.Equals(t, http.StatusOK, res.StatusCode)
+		assert.Equals(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+		assert.Equals(t, "ecdsa-sha2-nistp256 "+userB64+" user\n"+
+			"ecdsa-sha2-nistp256 "+base64.StdEncoding.EncodeToString(other.Marshal())+" user\n"+
+			"ecdsa-sha2-nistp256 "+hostB64+" host\n", w.Body.String())
+	})
 }
 
 func Test_caHandler_SSHConfig(t *testing.T) {
@@ -489,6 +542,7 @@ func Test_caHandler_SSHConfig(t *testing.T) {
 		{"badType", `{"type":"bad"}`, userOutput, nil, nil, http.StatusBadRequest},
 		{"badData", `{"type":"user","data":{"bad"}}`, userOutput, nil, nil, http.StatusBadRequest},
 		{"error", `{"type": "user"}`, nil, fmt.Errorf("an error"), nil, http.StatusInternalServerError},
+		{"renderError", `{"type": "user"}`, nil, errs.BadRequest("error rendering template known_hosts.tpl"), nil, http.StatusBadRequest},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -522,30 +576,53 @@ func Test_caHandler_SSHConfig(t *testing.T) {
 }
 
 func Test_caHandler_SSHCheckHost(t *testing.T) {
+	now := time.Now()
+	root, rootKey := mustRootCertificate(t)
+	cert := mustLeafCertificate(t, root, rootKey, now.Add(-time.Hour), now.Add(time.Hour))
+	otherRoot, otherRootKey := mustRootCertificate(t)
+	otherCert := mustLeafCertificate(t, otherRoot, otherRootKey, now.Add(-time.Hour), now.Add(time.Hour))
+
 	tests := []struct {
 		name       string
 		req        string
+		tls        *tls.ConnectionState
 		exists     bool
 		err        error
 		body       []byte
 		statusCode int
 	}{
-		{"true", `{"type":"host","principal":"foo.example.com"}`, true, nil, []byte(`{"exists":true}`), http.StatusOK},
-		{"false", `{"type":"host","principal":"bar.example.com"}`, false, nil, []byte(`{"exists":false}`), http.StatusOK},
-		{"badType", `{"type":"user","principal":"bar.example.com"}`, false, nil, nil, http.StatusBadRequest},
-		{"badPrincipal", `{"type":"host","principal":""}`, false, nil, nil, http.StatusBadRequest},
-		{"badRequest", `{"foo"}`, false, nil, nil, http.StatusBadRequest},
-		{"error", `{"type":"host","principal":"foo.example.com"}`, false, fmt.Errorf("an error"), nil, http.StatusInternalServerError},
+		{"true", `{"type":"host","principal":"foo.example.com","token":"ott"}`, nil, true, nil, []byte(`{"exists":true}`), http.StatusOK},
+		{"false", `{"type":"host","principal":"bar.example.com","token":"ott"}`, nil, false, nil, []byte(`{"exists":false}`), http.StatusOK},
+		{"mTLS", `{"type":"host","principal":"foo.example.com"}`, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, true, nil, []byte(`{"exists":true}`), http.StatusOK},
+		{"badType", `{"type":"user","principal":"bar.example.com","token":"ott"}`, nil, false, nil, nil, http.StatusBadRequest},
+		{"badPrincipal", `{"type":"host","principal":"","token":"ott"}`, nil, false, nil, nil, http.StatusBadRequest},
+		{"badRequest", `{"foo"}`, nil, false, nil, nil, http.StatusBadRequest},
+		{"noAuth", `{"type":"host","principal":"foo.example.com"}`, nil, true, nil, nil, http.StatusUnauthorized},
+		{"badToken", `{"type":"host","principal":"foo.example.com","token":"bad"}`, nil, true, nil, nil, http.StatusUnauthorized},
+		{"badCertificate", `{"type":"host","principal":"foo.example.com","token":"ott"}`, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherCert}}, true, nil, nil, http.StatusUnauthorized},
+		{"error", `{"type":"host","principal":"foo.example.com","token":"ott"}`, nil, false, fmt.Errorf("an error"), nil, http.StatusInternalServerError},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			h := New(&mockAuthority{
+				authorize: func(ctx context.Context, ott string) ([]provisioner.SignOption, error) {
+					// The check-host authorization does not use the token.
+					assert.Equals(t, provisioner.SSHCheckHostMethod, provisioner.MethodFromContext(ctx))
+					if ott != "ott" {
+						return nil, errs.Unauthorized("invalid token")
+					}
+					return nil, nil
+				},
+				getRoots: func() ([]*x509.Certificate, error) {
+					return []*x509.Certificate{root}, nil
+				},
 				checkSSHHost: func(ctx context.Context, principal, token string) (bool, error) {
 					return tt.exists, tt.err
 				},
 			}).(*caHandler)
 
 			req := httptest.NewRequest("GET", "http://example.com/ssh/check-host", strings.NewReader(tt.req))
+			req.TLS = tt.tls
 			w := httptest.NewRecorder()
 			h.SSHCheckHost(logging.NewResponseLogger(w), req)
 			res := w.Result()
@@ -674,6 +751,53 @@ func Test_caHandler_SSHBastion(t *testing.T) {
 	}
 }
 
+func Test_caHandler_SSHRevoked(t *testing.T) {
+	revokedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	rcis := []*db.RevokedCertificateInfo{
+		{Serial: "1", RevokedAt: revokedAt, ReasonCode: 1, Reason: "lost laptop"},
+		{Serial: "42", RevokedAt: revokedAt},
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		revoked     []*db.RevokedCertificateInfo
+		err         error
+		contentType string
+		body        []byte
+		statusCode  int
+	}{
+		{"ok", "", rcis, nil, "application/json", []byte(`{"revoked":[{"serial":"1","revokedAt":"2020-01-02T03:04:05Z","reasonCode":1,"reason":"lost laptop"},{"serial":"42","revokedAt":"2020-01-02T03:04:05Z","reasonCode":0}]}`), http.StatusOK},
+		{"ok/empty", "", []*db.RevokedCertificateInfo{}, nil, "application/json", []byte(`{"revoked":[]}`), http.StatusOK},
+		{"ok/krl", "?format=krl", rcis, nil, "text/plain; charset=utf-8", []byte("serial: 1\nserial: 42"), http.StatusOK},
+		{"fail/format", "?format=pem", rcis, nil, "", nil, http.StatusBadRequest},
+		{"fail/not-implemented", "", nil, errs.NotImplemented("not implemented"), "", nil, http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&mockAuthority{
+				getSSHRevocations: func() ([]*db.RevokedCertificateInfo, error) {
+					return tt.revoked, tt.err
+				},
+			}).(*caHandler)
+
+			req := httptest.NewRequest("GET", "http://example.com/ssh/revoked"+tt.query, nil)
+			w := httptest.NewRecorder()
+			h.SSHRevoked(logging.NewResponseLogger(w), req)
+			res := w.Result()
+			assert.Equals(t, tt.statusCode, res.StatusCode)
+
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+			if tt.statusCode == http.StatusOK {
+				assert.Equals(t, tt.contentType, res.Header.Get("Content-Type"))
+				assert.Equals(t, tt.body, bytes.TrimSpace(body))
+			}
+		})
+	}
+}
+
 func TestSSHPublicKey_MarshalJSON(t *testing.T) {
 	key, err := ssh.NewPublicKey(sshUserKey.Public())
 	assert.FatalError(t, err)
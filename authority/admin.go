@@ -0,0 +1,333 @@
+package authority
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/jose"
+)
+
+// provisionerRecord is the representation of a provisioner in the database.
+//
+// The records in the database take precedence over the provisioners in the
+// configuration with the same id, a deleted record removes the provisioner
+// from the configuration.
+type provisionerRecord struct {
+	Provisioner json.RawMessage `json:"provisioner,omitempty"`
+	Deleted     bool            `json:"deleted,omitempty"`
+}
+
+// reloadAdmin loads again the provisioners and admins in the database after
+// other CA changes them.
+func (a *Authority) reloadAdmin() {
+	a.adminMutex.Lock()
+	defer a.adminMutex.Unlock()
+	if err := a.loadStoredProvisioners(); err != nil {
+		log.Printf("error reloading provisioners: %v", err)
+	}
+	if err := a.loadAdmins(); err != nil {
+		log.Printf("error reloading admins: %v", err)
+	}
+}
+
+// loadStoredProvisioners merges the provisioners in the database with the ones
+// already in the collection.
+func (a *Authority) loadStoredProvisioners() error {
+	records, err := a.db.GetProvisioners()
+	switch {
+	case errors.Cause(err) == db.ErrNotImplemented:
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "error loading provisioners")
+	}
+
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Deleted records are processed first, a rotated JWK provisioner can still
+	// be loaded by the id of the deleted one.
+	recs := make([]provisionerRecord, len(ids))
+	for i, id := range ids {
+		if err := json.Unmarshal(records[id], &recs[i]); err != nil {
+			return errors.Wrapf(err, "error unmarshaling provisioner %s", id)
+		}
+		if recs[i].Deleted {
+			if _, ok := a.provisioners.Load(id); ok {
+				if err := a.provisioners.Remove(id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for i, id := range ids {
+		if recs[i].Deleted {
+			continue
+		}
+		p, err := provisioner.Unmarshal(recs[i].Provisioner)
+		if err != nil {
+			return errors.Wrapf(err, "error loading provisioner %s", id)
+		}
+		if err := p.Init(a.provisionerConfig); err != nil {
+			return errors.Wrapf(err, "error initializing provisioner %s", id)
+		}
+		if _, ok := a.provisioners.Load(p.GetID()); ok {
+			err = a.provisioners.Update(p)
+		} else {
+			err = a.provisioners.Store(p)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error loading provisioner %s", id)
+		}
+	}
+	return nil
+}
+
+// LoadProvisionerByName returns the provisioner with the given name.
+func (a *Authority) LoadProvisionerByName(name string) (provisioner.Interface, error) {
+	p, ok := a.provisioners.LoadByName(name)
+	if !ok {
+		return nil, errs.NotFound("provisioner %s not found", name)
+	}
+	return p, nil
+}
+
+// CreateProvisioner initializes and adds a new provisioner to the authority,
+// and persists it in the database. The provisioner name must be unique.
+func (a *Authority) CreateProvisioner(p provisioner.Interface) error {
+	a.adminMutex.Lock()
+	defer a.adminMutex.Unlock()
+
+	if _, ok := a.provisioners.LoadByName(p.GetName()); ok {
+		return errs.BadRequest("authority.CreateProvisioner; provisioner %s already exists", p.GetName())
+	}
+	if err := provisioner.Validate(p, a.listProvisioners(), a.provisionerConfig); err != nil {
+		return errs.Wrap(http.StatusBadRequest, err, "authority.CreateProvisioner")
+	}
+	logPolicyWarnings(p, a.provisionerConfig)
+	if err := a.storeProvisioner(p); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.CreateProvisioner")
+	}
+	if err := a.provisioners.Store(p); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.CreateProvisioner")
+	}
+	return nil
+}
+
+// UpdateProvisioner replaces the provisioner with the given name by the given
+// provisioner, and persists the change in the database. The type of the
+// provisioner cannot be changed.
+func (a *Authority) UpdateProvisioner(name string, p provisioner.Interface) error {
+	a.adminMutex.Lock()
+	defer a.adminMutex.Unlock()
+	return a.updateProvisioner(name, p)
+}
+
+// RotateProvisionerKey adds a new key to the JWK provisioner with the given
+// name. The new key becomes the current key, and the encrypted key, if any,
+// must correspond to it. The previous keys can still validate tokens until
+// they are retired.
+func (a *Authority) RotateProvisionerKey(name string, key *jose.JSONWebKey, encryptedKey string) (provisioner.Interface, error) {
+	a.adminMutex.Lock()
+	defer a.adminMutex.Unlock()
+
+	p, err := a.copyJWK("authority.RotateProvisionerKey", name)
+	if err != nil {
+		return nil, err
+	}
+	for _, kid := range p.GetKeyIDs() {
+		if kid == key.KeyID {
+			return nil, errs.BadRequest("authority.RotateProvisionerKey; provisioner %s already has a key with kid %s", name, kid)
+		}
+	}
+	p.PreviousKeys = append(p.PreviousKeys, p.Key)
+	p.Key, p.EncryptedKey = key, encryptedKey
+	if err := a.updateProvisioner(name, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RetireProvisionerKey removes the previous key with the given kid from the
+// JWK provisioner with the given name. The tokens signed with the key are no
+// longer valid. The current key cannot be retired.
+func (a *Authority) RetireProvisionerKey(name, kid string) (provisioner.Interface, error) {
+	a.adminMutex.Lock()
+	defer a.adminMutex.Unlock()
+
+	p, err := a.copyJWK("authority.RetireProvisionerKey", name)
+	if err != nil {
+		return nil, err
+	}
+	if p.Key.KeyID == kid {
+		return nil, errs.BadRequest("authority.RetireProvisionerKey; the current key of provisioner %s cannot be retired", name)
+	}
+	keys := make([]*jose.JSONWebKey, 0, len(p.PreviousKeys))
+	for _, k := range p.PreviousKeys {
+		if k.KeyID != kid {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == len(p.PreviousKeys) {
+		return nil, errs.NotFound("authority.RetireProvisionerKey; provisioner %s does not have a key with kid %s", name, kid)
+	}
+	p.PreviousKeys = keys
+	if err := a.updateProvisioner(name, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// copyJWK returns a copy of the JWK provisioner with the given name, the copy
+// can be modified and used to update the provisioner.
+func (a *Authority) copyJWK(op, name string) (*provisioner.JWK, error) {
+	old, ok := a.provisioners.LoadByName(name)
+	if !ok {
+		return nil, errs.NotFound("%s; provisioner %s not found", op, name)
+	}
+	if _, ok := old.(*provisioner.JWK); !ok {
+		return nil, errs.BadRequest("%s; provisioner %s is not a JWK provisioner", op, name)
+	}
+	data, err := json.Marshal(old)
+	if err != nil {
+		return nil, errs.Wrapf(http.StatusInternalServerError, err, "%s; error marshaling provisioner", op)
+	}
+	p := new(provisioner.JWK)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errs.Wrapf(http.StatusInternalServerError, err, "%s; error unmarshaling provisioner", op)
+	}
+	return p, nil
+}
+
+func (a *Authority) updateProvisioner(name string, p provisioner.Interface) error {
+	old, ok := a.provisioners.LoadByName(name)
+	if !ok {
+		return errs.NotFound("authority.UpdateProvisioner; provisioner %s not found", name)
+	}
+	if old.GetType() != p.GetType() {
+		return errs.BadRequest("authority.UpdateProvisioner; provisioner type cannot be changed from %s to %s", old.GetType(), p.GetType())
+	}
+	if p.GetName() != name {
+		if _, ok := a.provisioners.LoadByName(p.GetName()); ok {
+			return errs.BadRequest("authority.UpdateProvisioner; provisioner %s already exists", p.GetName())
+		}
+	}
+	var list provisioner.List
+	for _, q := range a.listProvisioners() {
+		if q != old {
+			list = append(list, q)
+		}
+	}
+	if err := provisioner.Validate(p, list, a.provisionerConfig); err != nil {
+		return errs.Wrap(http.StatusBadRequest, err, "authority.UpdateProvisioner")
+	}
+	logPolicyWarnings(p, a.provisionerConfig)
+
+	// Same id, the provisioner can be replaced.
+	if p.GetID() == old.GetID() {
+		if err := a.storeProvisioner(p); err != nil {
+			return errs.Wrap(http.StatusInternalServerError, err, "authority.UpdateProvisioner")
+		}
+		if err := a.provisioners.Update(p); err != nil {
+			return errs.Wrap(http.StatusInternalServerError, err, "authority.UpdateProvisioner")
+		}
+		return nil
+	}
+
+	// The id has changed, e.g. the key of a JWK provisioner, the old
+	// provisioner is removed and the new one is added.
+	if err := a.storeProvisioner(p); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.UpdateProvisioner")
+	}
+	if err := a.removeProvisioner(old.GetID()); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.UpdateProvisioner")
+	}
+	if err := a.provisioners.Remove(old.GetID()); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.UpdateProvisioner")
+	}
+	if err := a.provisioners.Store(p); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.UpdateProvisioner")
+	}
+	return nil
+}
+
+// DeleteProvisioner removes the provisioner with the given name from the
+// authority and the database. The provisioner cannot be used to issue new
+// certificates, but the certificates already issued remain valid.
+func (a *Authority) DeleteProvisioner(name string) error {
+	a.adminMutex.Lock()
+	defer a.adminMutex.Unlock()
+
+	p, ok := a.provisioners.LoadByName(name)
+	if !ok {
+		return errs.NotFound("authority.DeleteProvisioner; provisioner %s not found", name)
+	}
+	if err := a.removeProvisioner(p.GetID()); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.DeleteProvisioner")
+	}
+	if err := a.provisioners.Remove(p.GetID()); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.DeleteProvisioner")
+	}
+	return nil
+}
+
+// listProvisioners returns all the provisioners in the collection.
+func (a *Authority) listProvisioners() provisioner.List {
+	var list provisioner.List
+	for cursor := ""; ; {
+		var page provisioner.List
+		page, cursor = a.provisioners.Find(cursor, provisioner.DefaultProvisionersMax)
+		list = append(list, page...)
+		if cursor == "" {
+			return list
+		}
+	}
+}
+
+// storeProvisioner persists the given provisioner in the database.
+func (a *Authority) storeProvisioner(p provisioner.Interface) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling provisioner")
+	}
+	b, err := json.Marshal(provisionerRecord{Provisioner: data})
+	if err != nil {
+		return errors.Wrap(err, "error marshaling provisioner")
+	}
+	return dbError(a.db.StoreProvisioner(p.GetID(), b))
+}
+
+// removeProvisioner deletes the provisioner with the given id from the
+// database. If the provisioner is defined in the configuration a deleted
+// record is stored instead, so the provisioner is not loaded again on the next
+// start.
+func (a *Authority) removeProvisioner(id string) error {
+	for _, p := range a.config.AuthorityConfig.Provisioners {
+		if p.GetID() == id {
+			b, err := json.Marshal(provisionerRecord{Deleted: true})
+			if err != nil {
+				return errors.Wrap(err, "error marshaling provisioner")
+			}
+			return dbError(a.db.StoreProvisioner(id, b))
+		}
+	}
+	return dbError(a.db.DeleteProvisioner(id))
+}
+
+// dbError returns a NotImplemented error if the database does not support the
+// persistence of provisioners.
+func dbError(err error) error {
+	if errors.Cause(err) == db.ErrNotImplemented {
+		return errs.NotImplemented("provisioners cannot be managed without a database")
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Type is the role of an admin.
+type Type string
+
+const (
+	// TypeSuper is the role of the admins that can use all the admin API,
+	// including the destructive operations and the management of the admins.
+	TypeSuper Type = "SUPER_ADMIN"
+	// TypeProvisioner is the role of the admins that can list and create
+	// provisioners, rotate their keys, and create external account keys.
+	TypeProvisioner Type = "ADMIN"
+)
+
+// Admin is a user of the admin API. An admin is identified by the subject of
+// the tokens and the name of the provisioner that issued them, or that issued
+// the certificate used to sign them.
+type Admin struct {
+	ID          string `json:"id"`
+	Subject     string `json:"subject"`
+	Provisioner string `json:"provisioner"`
+	Type        Type   `json:"type"`
+}
+
+// Validate validates the fields of the admin, an empty type defaults to
+// TypeProvisioner.
+func (a *Admin) Validate() error {
+	switch {
+	case a.Subject == "":
+		return errors.New("admin subject cannot be empty")
+	case a.Provisioner == "":
+		return errors.New("admin provisioner cannot be empty")
+	}
+	switch a.Type {
+	case "":
+		a.Type = TypeProvisioner
+	case TypeSuper, TypeProvisioner:
+	default:
+		return errors.Errorf("admin type %s is not valid", a.Type)
+	}
+	return nil
+}
+
+// HasRole returns true if the admin can perform the operations allowed to the
+// given role. Super-admins can perform all the operations.
+func (a *Admin) HasRole(t Type) bool {
+	return a.Type == TypeSuper || a.Type == t
+}
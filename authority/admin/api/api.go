@@ -0,0 +1,785 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/jose"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Authority is the interface implemented by the CA authority used by the
+// admin API.
+type Authority interface {
+	AuthorizeAdmin(ctx context.Context, token string) (*admin.Admin, error)
+	GetAdmins() []*admin.Admin
+	CreateAdmin(adm *admin.Admin) error
+	DeleteAdmin(id string) error
+	GetProvisioners(cursor string, limit int) (provisioner.List, string, error)
+	LoadProvisionerByName(name string) (provisioner.Interface, error)
+	CreateProvisioner(p provisioner.Interface) error
+	UpdateProvisioner(name string, p provisioner.Interface) error
+	DeleteProvisioner(name string) error
+	RotateProvisionerKey(name string, key *jose.JSONWebKey, encryptedKey string) (provisioner.Interface, error)
+	RetireProvisionerKey(name, kid string) (provisioner.Interface, error)
+	ExportDB(w io.Writer) error
+	BackupDB(ctx context.Context, w io.Writer) error
+	Unrevoke(serial string) error
+	RevokeSSHByAdmin(adm *admin.Admin, serial string, reasonCode int, reason string) error
+	RotateSSHKey(req *authority.RotateSSHKeyRequest) (*authority.RotateSSHKeyResponse, error)
+	RetireSSHKey(typ, fingerprint string) error
+}
+
+// ACMEAuthority is the interface implemented by the ACME authority used by the
+// admin API to manage the external account keys of the ACME provisioners.
+type ACMEAuthority interface {
+	CreateExternalAccountKey(p provisioner.Interface, reference string) (*acme.ExternalAccountKey, error)
+	GetExternalAccountKeys(p provisioner.Interface) ([]*acme.ExternalAccountKey, error)
+	RevokeExternalAccountKey(p provisioner.Interface, id string) (*acme.ExternalAccountKey, error)
+}
+
+// ProvisionerRequest is the request body used to create or update a
+// provisioner.
+//
+// If a JWK provisioner does not have a key, a new key pair is generated and
+// the private key is encrypted with the given password. On updates, a JWK
+// provisioner without a key and password keeps its current key.
+type ProvisionerRequest struct {
+	Provisioner json.RawMessage `json:"provisioner"`
+	Password    string          `json:"password,omitempty"`
+}
+
+// RotateKeyRequest is the request body used to add a new key to a JWK
+// provisioner. If the key is not set, a new key pair is generated and the
+// private key is encrypted with the given password.
+type RotateKeyRequest struct {
+	Key      *jose.JSONWebKey `json:"key,omitempty"`
+	Password string           `json:"password,omitempty"`
+}
+
+// RetireKeyRequest is the request body used to remove a previous key from a
+// JWK provisioner.
+type RetireKeyRequest struct {
+	KeyID string `json:"kid"`
+}
+
+// ExternalAccountKeyRequest is the request body used to create an external
+// account key. The reference is an optional string used to identify the key.
+type ExternalAccountKeyRequest struct {
+	Reference string `json:"reference,omitempty"`
+}
+
+// SSHRevokeRequest is the request body used to revoke an SSH certificate.
+type SSHRevokeRequest struct {
+	Serial     string `json:"serial"`
+	ReasonCode int    `json:"reasonCode"`
+	Reason     string `json:"reason"`
+}
+
+// SSHRotateKeyRequest is the request body used to replace the key that signs
+// the SSH user or host certificates. The new key is the path or the KMS uri in
+// signingKey, or a key generated in the KMS if generate is set. The password
+// decrypts the signing key, or encrypts the generated key in the response.
+type SSHRotateKeyRequest struct {
+	Type       string                `json:"type"`
+	SigningKey string                `json:"signingKey,omitempty"`
+	Password   string                `json:"password,omitempty"`
+	Generate   bool                  `json:"generate,omitempty"`
+	Name       string                `json:"name,omitempty"`
+	Overlap    *provisioner.Duration `json:"overlap,omitempty"`
+}
+
+// SSHRotateKeyResponse is the response body of an SSH key rotation. The
+// encrypted key is only set if the key has been generated in memory and a
+// password is given.
+type SSHRotateKeyResponse struct {
+	Type                string    `json:"type"`
+	PublicKey           string    `json:"publicKey"`
+	Fingerprint         string    `json:"fingerprint"`
+	Name                string    `json:"name,omitempty"`
+	EncryptedKey        string    `json:"encryptedKey,omitempty"`
+	PreviousKeyNotAfter time.Time `json:"previousKeyNotAfter"`
+}
+
+// SSHRetireKeyRequest is the request body used to stop advertising a previous
+// SSH CA key.
+type SSHRetireKeyRequest struct {
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// TemplateValidateRequest is the request body used to render a template with
+// sample data, without signing a certificate. The type is x509 or ssh, the CSR
+// is the PEM certificate request used in the X.509 templates, and the SSH
+// certificate is the one used in the SSH templates. The user data is the
+// template data of a sign request.
+type TemplateValidateRequest struct {
+	Type           string                 `json:"type"`
+	Template       string                 `json:"template"`
+	TemplateData   json.RawMessage        `json:"templateData,omitempty"`
+	Provisioner    string                 `json:"provisioner,omitempty"`
+	Claims         map[string]interface{} `json:"claims,omitempty"`
+	CSR            string                 `json:"csr,omitempty"`
+	SSHCertificate *SSHCertificateSample  `json:"sshCertificate,omitempty"`
+	Webhooks       map[string]interface{} `json:"webhooks,omitempty"`
+	UserData       json.RawMessage        `json:"userData,omitempty"`
+}
+
+// SSHCertificateSample is the SSH certificate of a template validation
+// request, in the format rendered by the SSH templates.
+type SSHCertificateSample struct {
+	CertType        string            `json:"certType,omitempty"`
+	KeyID           string            `json:"keyID,omitempty"`
+	Principals      []string          `json:"principals,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+	CriticalOptions map[string]string `json:"criticalOptions,omitempty"`
+}
+
+// TemplateValidateResponse is the response body of a template validation. It
+// contains the certificate fields rendered by the template, or the error of
+// the template and its line, if known.
+type TemplateValidateResponse struct {
+	Certificate json.RawMessage `json:"certificate,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Line        int             `json:"line,omitempty"`
+}
+
+// AdminRequest is the request body used to create an admin. The type defaults
+// to ADMIN.
+type AdminRequest struct {
+	Subject     string     `json:"subject"`
+	Provisioner string     `json:"provisioner"`
+	Type        admin.Type `json:"type,omitempty"`
+}
+
+// New returns a new admin API router. The external account keys cannot be
+// managed if the ACME authority is nil.
+func New(auth Authority, acmeAuth ACMEAuthority) api.RouterHandler {
+	return &Handler{Auth: auth, ACME: acmeAuth}
+}
+
+// Handler is the admin API request handler.
+type Handler struct {
+	Auth Authority
+	ACME ACMEAuthority
+}
+
+// Route traffic and implement the Router interface. The operations that
+// remove or change provisioners, keys and admins require a super-admin.
+func (h *Handler) Route(r api.Router) {
+	provisionerAdmin := func(next http.HandlerFunc) http.HandlerFunc {
+		return h.authorize(admin.TypeProvisioner, next)
+	}
+	superAdmin := func(next http.HandlerFunc) http.HandlerFunc {
+		return h.authorize(admin.TypeSuper, next)
+	}
+	r.MethodFunc("GET", "/provisioners", provisionerAdmin(h.GetProvisioners))
+	r.MethodFunc("POST", "/provisioners", provisionerAdmin(h.CreateProvisioner))
+	r.MethodFunc("GET", "/provisioners/{name}", provisionerAdmin(h.GetProvisioner))
+	r.MethodFunc("PUT", "/provisioners/{name}", superAdmin(h.UpdateProvisioner))
+	r.MethodFunc("DELETE", "/provisioners/{name}", superAdmin(h.DeleteProvisioner))
+	r.MethodFunc("POST", "/provisioners/{name}/rotate", superAdmin(h.RotateProvisionerKey))
+	r.MethodFunc("POST", "/provisioners/{name}/retire", superAdmin(h.RetireProvisionerKey))
+	r.MethodFunc("GET", "/provisioners/{name}/eab", provisionerAdmin(h.GetExternalAccountKeys))
+	r.MethodFunc("POST", "/provisioners/{name}/eab", provisionerAdmin(h.CreateExternalAccountKey))
+	r.MethodFunc("DELETE", "/provisioners/{name}/eab/{id}", superAdmin(h.RevokeExternalAccountKey))
+	r.MethodFunc("GET", "/admins", superAdmin(h.GetAdmins))
+	r.MethodFunc("POST", "/admins", superAdmin(h.CreateAdmin))
+	r.MethodFunc("DELETE", "/admins/{id}", superAdmin(h.DeleteAdmin))
+	r.MethodFunc("GET", "/db/export", superAdmin(h.ExportDB))
+	r.MethodFunc("POST", "/backup", superAdmin(h.BackupDB))
+	r.MethodFunc("DELETE", "/revocations/{serial}", superAdmin(h.Unrevoke))
+	r.MethodFunc("POST", "/ssh/revocations", superAdmin(h.RevokeSSH))
+	r.MethodFunc("POST", "/ssh/keys/rotate", superAdmin(h.RotateSSHKey))
+	r.MethodFunc("POST", "/ssh/keys/retire", superAdmin(h.RetireSSHKey))
+	r.MethodFunc("POST", "/templates/validate", provisionerAdmin(h.ValidateTemplate))
+}
+
+// authorize requires a bearer token generated by an admin with the given role.
+func (h *Handler) authorize(role admin.Type, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			api.WriteError(w, errs.Unauthorized("missing authorization bearer token"))
+			return
+		}
+		adm, err := h.Auth.AuthorizeAdmin(r.Context(), strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		if !adm.HasRole(role) {
+			api.WriteError(w, errs.Forbidden("admin %s of provisioner %s is not a %s", adm.Subject, adm.Provisioner, role))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), adminContextKey{}, adm)))
+	}
+}
+
+type adminContextKey struct{}
+
+// adminFromContext returns the admin that authorized the request.
+func adminFromContext(ctx context.Context) *admin.Admin {
+	adm, _ := ctx.Value(adminContextKey{}).(*admin.Admin)
+	return adm
+}
+
+// GetAdmins returns the list of admins.
+func (h *Handler) GetAdmins(w http.ResponseWriter, r *http.Request) {
+	api.JSON(w, h.Auth.GetAdmins())
+}
+
+// CreateAdmin adds a new admin.
+func (h *Handler) CreateAdmin(w http.ResponseWriter, r *http.Request) {
+	var body AdminRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	adm := &admin.Admin{
+		Subject:     body.Subject,
+		Provisioner: body.Provisioner,
+		Type:        body.Type,
+	}
+	if err := h.Auth.CreateAdmin(adm); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSONStatus(w, adm, http.StatusCreated)
+}
+
+// DeleteAdmin removes the admin with the given id.
+func (h *Handler) DeleteAdmin(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth.DeleteAdmin(chi.URLParam(r, "id")); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Unrevoke releases the certificate on hold with the given serial number.
+func (h *Handler) Unrevoke(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth.Unrevoke(chi.URLParam(r, "serial")); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeSSH revokes the SSH certificate with the serial number in the request.
+func (h *Handler) RevokeSSH(w http.ResponseWriter, r *http.Request) {
+	var body SSHRevokeRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if body.Serial == "" {
+		api.WriteError(w, errs.BadRequest("missing serial"))
+		return
+	}
+	if body.ReasonCode < ocsp.Unspecified || body.ReasonCode > ocsp.AACompromise {
+		api.WriteError(w, errs.BadRequest("reasonCode out of bounds"))
+		return
+	}
+	if err := h.Auth.RevokeSSHByAdmin(adminFromContext(r.Context()), body.Serial, body.ReasonCode, body.Reason); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateSSHKey replaces the key that signs the SSH user or host certificates.
+func (h *Handler) RotateSSHKey(w http.ResponseWriter, r *http.Request) {
+	var body SSHRotateKeyRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	req := &authority.RotateSSHKeyRequest{
+		Type:       body.Type,
+		SigningKey: body.SigningKey,
+		Generate:   body.Generate,
+		Name:       body.Name,
+	}
+	if body.Password != "" && !body.Generate {
+		req.Password = []byte(body.Password)
+	}
+	if body.Overlap != nil {
+		req.Overlap = body.Overlap.Duration
+	}
+	resp, err := h.Auth.RotateSSHKey(req)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	res := &SSHRotateKeyResponse{
+		Type:                body.Type,
+		PublicKey:           strings.TrimSpace(string(ssh.MarshalAuthorizedKey(resp.PublicKey))),
+		Fingerprint:         ssh.FingerprintSHA256(resp.PublicKey),
+		Name:                resp.Name,
+		PreviousKeyNotAfter: resp.PreviousKeyNotAfter,
+	}
+	if resp.PrivateKey != nil && body.Password != "" {
+		block, err := pemutil.Serialize(resp.PrivateKey, pemutil.WithPassword([]byte(body.Password)))
+		if err != nil {
+			api.WriteError(w, errs.Wrap(http.StatusInternalServerError, err, "error serializing ssh key"))
+			return
+		}
+		res.EncryptedKey = string(pem.EncodeToMemory(block))
+	}
+	api.JSON(w, res)
+}
+
+// RetireSSHKey stops advertising a previous SSH CA key.
+func (h *Handler) RetireSSHKey(w http.ResponseWriter, r *http.Request) {
+	var body SSHRetireKeyRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if body.Fingerprint == "" {
+		api.WriteError(w, errs.BadRequest("missing fingerprint"))
+		return
+	}
+	if err := h.Auth.RetireSSHKey(body.Type, body.Fingerprint); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ValidateTemplate renders a template with the sample data in the request
+// without signing a certificate. A template that cannot be rendered is not an
+// error of the request, the response contains the error of the template.
+func (h *Handler) ValidateTemplate(w http.ResponseWriter, r *http.Request) {
+	var body TemplateValidateRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if body.Type != "x509" && body.Type != "ssh" {
+		api.WriteError(w, errs.BadRequest("unsupported template type '%s'", body.Type))
+		return
+	}
+	sample := &provisioner.TemplateSample{
+		Provisioner:  body.Provisioner,
+		Claims:       body.Claims,
+		TemplateData: body.TemplateData,
+		Webhooks:     body.Webhooks,
+	}
+	if len(body.UserData) > 0 {
+		v, err := provisioner.ParseUserData(body.UserData)
+		if err != nil {
+			api.WriteError(w, errs.Wrap(http.StatusBadRequest, err, "invalid userData"))
+			return
+		}
+		sample.User = v
+	}
+	if body.CSR != "" {
+		block, _ := pem.Decode([]byte(body.CSR))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			api.WriteError(w, errs.BadRequest("csr must be a PEM certificate request"))
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			api.WriteError(w, errs.Wrap(http.StatusBadRequest, err, "error parsing csr"))
+			return
+		}
+		sample.CertificateRequest = csr
+	}
+	if c := body.SSHCertificate; c != nil {
+		sample.SSHCertificate = &ssh.Certificate{
+			CertType:        ssh.UserCert,
+			KeyId:           c.KeyID,
+			ValidPrincipals: c.Principals,
+			Permissions: ssh.Permissions{
+				CriticalOptions: c.CriticalOptions,
+				Extensions:      c.Extensions,
+			},
+		}
+		switch c.CertType {
+		case "", provisioner.SSHUserCert:
+		case provisioner.SSHHostCert:
+			sample.SSHCertificate.CertType = ssh.HostCert
+		default:
+			api.WriteError(w, errs.BadRequest("unsupported ssh certificate type '%s'", c.CertType))
+			return
+		}
+	}
+
+	b, err := provisioner.RenderTemplate(body.Type, body.Template, sample)
+	if err != nil {
+		if te, ok := err.(*provisioner.TemplateError); ok {
+			api.JSON(w, &TemplateValidateResponse{Error: te.Message, Line: te.Line})
+			return
+		}
+		api.WriteError(w, errs.Wrap(http.StatusBadRequest, err, "error rendering template"))
+		return
+	}
+	api.JSON(w, &TemplateValidateResponse{Certificate: b})
+}
+
+// ExportDB streams an export of the database, in the format of db.Export. If
+// the export fails after the first record is sent, the response is truncated
+// and the error is logged.
+func (h *Handler) ExportDB(w http.ResponseWriter, r *http.Request) {
+	ew := &exportWriter{ResponseWriter: w, filename: "step-ca-db.jsonl"}
+	if err := h.Auth.ExportDB(ew); err != nil {
+		if !ew.started {
+			api.WriteError(w, err)
+			return
+		}
+		api.LogError(w, err)
+	}
+}
+
+// BackupDB streams a backup of the database read from a consistent snapshot,
+// in the format of db.Export. Like the exports, the response is truncated if
+// the backup fails after the first record is sent.
+func (h *Handler) BackupDB(w http.ResponseWriter, r *http.Request) {
+	name := "step-ca-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".jsonl"
+	ew := &exportWriter{ResponseWriter: w, filename: name}
+	if err := h.Auth.BackupDB(r.Context(), ew); err != nil {
+		if !ew.started {
+			api.WriteError(w, err)
+			return
+		}
+		api.LogError(w, err)
+	}
+}
+
+// exportWriter writes the headers of an export before the first write.
+type exportWriter struct {
+	http.ResponseWriter
+	filename string
+	started  bool
+}
+
+func (w *exportWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+w.filename+`"`)
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// GetProvisioners returns the list of provisioners.
+func (h *Handler) GetProvisioners(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var limit int
+	if v := q.Get("limit"); len(v) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			api.WriteError(w, errs.Wrapf(http.StatusBadRequest, err, "error converting %s to integer", v))
+			return
+		}
+	}
+	p, next, err := h.Auth.GetProvisioners(q.Get("cursor"), limit)
+	if err != nil {
+		api.WriteError(w, errs.InternalServerErr(err))
+		return
+	}
+	api.JSON(w, &api.ProvisionersResponse{
+		Provisioners: p,
+		NextCursor:   next,
+	})
+}
+
+// GetProvisioner returns the provisioner with the given name.
+func (h *Handler) GetProvisioner(w http.ResponseWriter, r *http.Request) {
+	name, err := nameFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	p, err := h.Auth.LoadProvisionerByName(name)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, p)
+}
+
+// CreateProvisioner adds a new provisioner.
+func (h *Handler) CreateProvisioner(w http.ResponseWriter, r *http.Request) {
+	var body ProvisionerRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	p, err := parseProvisioner(&body, nil)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if err := h.Auth.CreateProvisioner(p); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSONStatus(w, p, http.StatusCreated)
+}
+
+// UpdateProvisioner replaces the provisioner with the given name.
+func (h *Handler) UpdateProvisioner(w http.ResponseWriter, r *http.Request) {
+	name, err := nameFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	old, err := h.Auth.LoadProvisionerByName(name)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	var body ProvisionerRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	p, err := parseProvisioner(&body, old)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if err := h.Auth.UpdateProvisioner(name, p); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, p)
+}
+
+// DeleteProvisioner removes the provisioner with the given name.
+func (h *Handler) DeleteProvisioner(w http.ResponseWriter, r *http.Request) {
+	name, err := nameFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if err := h.Auth.DeleteProvisioner(name); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateProvisionerKey adds a new key to a JWK provisioner. The tokens signed
+// with the previous keys are still valid until the keys are retired.
+func (h *Handler) RotateProvisionerKey(w http.ResponseWriter, r *http.Request) {
+	name, err := nameFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	var body RotateKeyRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	key, encryptedKey, err := newKey(body.Key, body.Password)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	p, err := h.Auth.RotateProvisionerKey(name, key, encryptedKey)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, p)
+}
+
+// RetireProvisionerKey removes a previous key from a JWK provisioner.
+func (h *Handler) RetireProvisionerKey(w http.ResponseWriter, r *http.Request) {
+	name, err := nameFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	var body RetireKeyRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if body.KeyID == "" {
+		api.WriteError(w, errs.BadRequest("key id cannot be empty"))
+		return
+	}
+	p, err := h.Auth.RetireProvisionerKey(name, body.KeyID)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, p)
+}
+
+// GetExternalAccountKeys returns the external account keys of an ACME
+// provisioner and the accounts bound to them.
+func (h *Handler) GetExternalAccountKeys(w http.ResponseWriter, r *http.Request) {
+	p, err := h.acmeProvisionerFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	keys, err := h.ACME.GetExternalAccountKeys(p)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, keys)
+}
+
+// CreateExternalAccountKey adds a new external account key to an ACME
+// provisioner. The response includes the HMAC key, it cannot be retrieved
+// later.
+func (h *Handler) CreateExternalAccountKey(w http.ResponseWriter, r *http.Request) {
+	p, err := h.acmeProvisionerFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	var body ExternalAccountKeyRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	key, err := h.ACME.CreateExternalAccountKey(p, body.Reference)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSONStatus(w, key, http.StatusCreated)
+}
+
+// RevokeExternalAccountKey disables an external account key of an ACME
+// provisioner.
+func (h *Handler) RevokeExternalAccountKey(w http.ResponseWriter, r *http.Request) {
+	p, err := h.acmeProvisionerFromRequest(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	key, err := h.ACME.RevokeExternalAccountKey(p, chi.URLParam(r, "id"))
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, key)
+}
+
+// acmeProvisionerFromRequest returns the ACME provisioner with the name in the
+// request.
+func (h *Handler) acmeProvisionerFromRequest(r *http.Request) (provisioner.Interface, error) {
+	if h.ACME == nil {
+		return nil, errs.NotImplemented("external account keys are not supported")
+	}
+	name, err := nameFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	p, err := h.Auth.LoadProvisionerByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.GetType() != provisioner.TypeACME {
+		return nil, errs.BadRequest("provisioner %s is not an ACME provisioner", name)
+	}
+	return p, nil
+}
+
+func nameFromRequest(r *http.Request) (string, error) {
+	name, err := url.PathUnescape(chi.URLParam(r, "name"))
+	if err != nil {
+		return "", errs.Wrap(http.StatusBadRequest, err, "error url unescaping provisioner name")
+	}
+	return name, nil
+}
+
+// parseProvisioner returns the provisioner in the request. If the request
+// updates the old provisioner, JWK provisioners without a key keep the old
+// key.
+func parseProvisioner(body *ProvisionerRequest, old provisioner.Interface) (provisioner.Interface, error) {
+	if len(body.Provisioner) == 0 {
+		return nil, errs.BadRequest("provisioner cannot be empty")
+	}
+	p, err := provisioner.Unmarshal(body.Provisioner)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusBadRequest, err, "error parsing provisioner")
+	}
+	if jwk, ok := p.(*provisioner.JWK); ok {
+		oldJWK, _ := old.(*provisioner.JWK)
+		if err := initJWK(jwk, oldJWK, body.Password); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// initJWK sets the key of a JWK provisioner. The key is generated if it is not
+// in the request and it cannot be taken from the old provisioner.
+func initJWK(p, old *provisioner.JWK, password string) error {
+	if p.Key == nil && password == "" && old != nil {
+		p.Key, p.EncryptedKey = old.Key, old.EncryptedKey
+		if p.PreviousKeys == nil {
+			p.PreviousKeys = old.PreviousKeys
+		}
+		return nil
+	}
+	key, encryptedKey, err := newKey(p.Key, password)
+	if err != nil {
+		return err
+	}
+	if encryptedKey != "" {
+		p.EncryptedKey = encryptedKey
+	}
+	p.Key = key
+	return nil
+}
+
+// newKey validates the given public key, or generates a new key pair if the
+// key is not set. It returns the public key and the private key encrypted with
+// the password if the key has been generated.
+func newKey(key *jose.JSONWebKey, password string) (*jose.JSONWebKey, string, error) {
+	switch {
+	case key == nil && password == "":
+		return nil, "", errs.BadRequest("provisioner key or password is required")
+	case key == nil:
+		pub, priv, err := jose.GenerateDefaultKeyPair([]byte(password))
+		if err != nil {
+			return nil, "", errs.Wrap(http.StatusInternalServerError, err, "error generating provisioner key")
+		}
+		encryptedKey, err := priv.CompactSerialize()
+		if err != nil {
+			return nil, "", errs.Wrap(http.StatusInternalServerError, err, "error serializing provisioner key")
+		}
+		return pub, encryptedKey, nil
+	case !key.IsPublic():
+		return nil, "", errs.BadRequest("provisioner key must be a public key")
+	case key.KeyID == "":
+		kid, err := jose.Thumbprint(key)
+		if err != nil {
+			return nil, "", errs.Wrap(http.StatusBadRequest, err, "error generating provisioner key id")
+		}
+		key.KeyID = kid
+	}
+	return key, "", nil
+}
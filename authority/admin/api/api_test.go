@@ -0,0 +1,931 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/crypto/randutil"
+	"github.com/smallstep/cli/jose"
+	"github.com/smallstep/nosql"
+)
+
+const (
+	adminAudience = "https://127.0.0.1/admin"
+	signAudience  = "https://127.0.0.1/1.0/sign"
+)
+
+func generateJWK(t *testing.T) *jose.JSONWebKey {
+	t.Helper()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	jwk.KeyID, err = jose.Thumbprint(jwk)
+	assert.FatalError(t, err)
+	return jwk
+}
+
+func publicJWK(jwk *jose.JSONWebKey) *jose.JSONWebKey {
+	pub := jwk.Public()
+	return &pub
+}
+
+func generateToken(t *testing.T, sub, iss, aud string, jwk *jose.JSONWebKey) string {
+	t.Helper()
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("kid", jwk.KeyID)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key}, so)
+	assert.FatalError(t, err)
+	id, err := randutil.ASCII(64)
+	assert.FatalError(t, err)
+	now := time.Now()
+	claims := struct {
+		jose.Claims
+		SANs []string `json:"sans"`
+	}{
+		Claims: jose.Claims{
+			ID:        id,
+			Subject:   sub,
+			Issuer:    iss,
+			IssuedAt:  jose.NewNumericDate(now),
+			NotBefore: jose.NewNumericDate(now),
+			Expiry:    jose.NewNumericDate(now.Add(5 * time.Minute)),
+			Audience:  []string{aud},
+		},
+		SANs: []string{sub},
+	}
+	tok, err := jose.Signed(sig).Claims(claims).CompactSerialize()
+	assert.FatalError(t, err)
+	return tok
+}
+
+type testServer struct {
+	t     *testing.T
+	url   string
+	admin *jose.JSONWebKey
+}
+
+func (s *testServer) do(method, path, token string, body interface{}) (int, []byte) {
+	s.t.Helper()
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		assert.FatalError(s.t, err)
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, s.url+path, r)
+	assert.FatalError(s.t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.FatalError(s.t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.FatalError(s.t, err)
+	return resp.StatusCode, b
+}
+
+func (s *testServer) adminDo(method, path string, body interface{}) (int, []byte) {
+	s.t.Helper()
+	return s.do(method, path, generateToken(s.t, "admin", "admin", adminAudience, s.admin), body)
+}
+
+func newAuthority(t *testing.T, dir string, admin, other *jose.JSONWebKey, superAdmin *authority.AdminConfig) *authority.Authority {
+	t.Helper()
+	a, err := authority.New(&authority.Config{
+		Root:             []string{"../../../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../../../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../../../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          "127.0.0.1:443",
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "badger", DataSource: filepath.Join(dir, "db")},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.JWK{Type: "JWK", Name: "admin", Key: publicJWK(admin), Admin: true},
+				&provisioner.JWK{Type: "JWK", Name: "static", Key: publicJWK(other)},
+			},
+			SuperAdmin: superAdmin,
+		},
+	})
+	assert.FatalError(t, err)
+	return a
+}
+
+func newServer(t *testing.T, a *authority.Authority, admin *jose.JSONWebKey) (*testServer, func()) {
+	t.Helper()
+	mux := chi.NewRouter()
+	acmeAuth, err := acme.NewAuthority(a.GetDatabase().(nosql.DB), "127.0.0.1", "acme", a)
+	assert.FatalError(t, err)
+	mux.Route("/admin", func(r chi.Router) {
+		New(a, acmeAuth).Route(r)
+	})
+	srv := httptest.NewServer(mux)
+	return &testServer{t: t, url: srv.URL + "/admin", admin: admin}, srv.Close
+}
+
+func sign(t *testing.T, a *authority.Authority, name string, jwk *jose.JSONWebKey) (*x509.Certificate, error) {
+	t.Helper()
+	certs, _, err := issue(t, a, name, "test.example.com", jwk)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// issue returns the certificate chain and the key of a certificate with the
+// given subject issued by the given provisioner.
+func issue(t *testing.T, a *authority.Authority, name, sub string, jwk *jose.JSONWebKey) ([]*x509.Certificate, *ecdsa.PrivateKey, error) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: sub},
+		DNSNames: []string{sub},
+	}, priv)
+	assert.FatalError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	assert.FatalError(t, err)
+
+	signOpts, err := a.AuthorizeSign(generateToken(t, sub, name, signAudience, jwk))
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := a.Sign(csr, provisioner.Options{}, signOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, priv, nil
+}
+
+// generateX5CToken returns a token signed with the given key and with the
+// certificate chain in the x5c header.
+func generateX5CToken(t *testing.T, aud string, chain []*x509.Certificate, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	x5c := make([]string, len(chain))
+	for i, crt := range chain {
+		x5c[i] = base64.StdEncoding.EncodeToString(crt.Raw)
+	}
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("x5c", x5c)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, so)
+	assert.FatalError(t, err)
+	id, err := randutil.ASCII(64)
+	assert.FatalError(t, err)
+	now := time.Now()
+	tok, err := jose.Signed(sig).Claims(jose.Claims{
+		ID:        id,
+		Subject:   chain[0].Subject.CommonName,
+		IssuedAt:  jose.NewNumericDate(now),
+		NotBefore: jose.NewNumericDate(now),
+		Expiry:    jose.NewNumericDate(now.Add(5 * time.Minute)),
+		Audience:  []string{aud},
+	}).CompactSerialize()
+	assert.FatalError(t, err)
+	return tok
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	adminKey := generateJWK(t)
+	staticKey := generateJWK(t)
+	clientKey := generateJWK(t)
+
+	a := newAuthority(t, dir, adminKey, staticKey, nil)
+	s, closeServer := newServer(t, a, adminKey)
+
+	root, err := pemutil.ReadCertificate("../../../ca/testdata/secrets/root_ca.crt")
+	assert.FatalError(t, err)
+	intermediate, err := pemutil.ReadCertificate("../../../ca/testdata/secrets/intermediate_ca.crt")
+	assert.FatalError(t, err)
+	verifyOpts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	verifyOpts.Roots.AddCert(root)
+	verifyOpts.Intermediates.AddCert(intermediate)
+
+	t.Run("fail/no-token", func(t *testing.T) {
+		code, _ := s.do("GET", "/provisioners", "", nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("fail/not-admin", func(t *testing.T) {
+		code, _ := s.do("GET", "/provisioners", generateToken(t, "static", "static", adminAudience, staticKey), nil)
+		assert.Equals(t, http.StatusForbidden, code)
+	})
+
+	t.Run("fail/sign-audience", func(t *testing.T) {
+		code, _ := s.do("GET", "/provisioners", generateToken(t, "admin", "admin", signAudience, adminKey), nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+	})
+
+	var generated *jose.JSONWebKey
+	t.Run("ok/create-generated-key", func(t *testing.T) {
+		code, b := s.adminDo("POST", "/provisioners", map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "JWK", "name": "generated"},
+			"password":    "password",
+		})
+		assert.Equals(t, http.StatusCreated, code)
+		var p provisioner.JWK
+		assert.FatalError(t, json.Unmarshal(b, &p))
+		assert.Equals(t, "generated", p.Name)
+		assert.True(t, p.Key.IsPublic())
+		assert.NotEquals(t, "", p.EncryptedKey)
+
+		data, err := jose.Decrypt("", []byte(p.EncryptedKey), jose.WithPassword([]byte("password")))
+		assert.FatalError(t, err)
+		generated = new(jose.JSONWebKey)
+		assert.FatalError(t, json.Unmarshal(data, generated))
+		assert.Equals(t, p.Key.KeyID, generated.KeyID)
+
+		crt, err := sign(t, a, "generated", generated)
+		assert.FatalError(t, err)
+		assert.Equals(t, "test.example.com", crt.Subject.CommonName)
+	})
+
+	t.Run("ok/create-client-key", func(t *testing.T) {
+		pub := publicJWK(clientKey)
+		pub.KeyID = ""
+		code, b := s.adminDo("POST", "/provisioners", map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "JWK", "name": "client", "key": pub},
+		})
+		assert.Equals(t, http.StatusCreated, code)
+		var p provisioner.JWK
+		assert.FatalError(t, json.Unmarshal(b, &p))
+		assert.Equals(t, clientKey.KeyID, p.Key.KeyID)
+		assert.Equals(t, "", p.EncryptedKey)
+
+		_, err := sign(t, a, "client", clientKey)
+		assert.FatalError(t, err)
+	})
+
+	t.Run("fail/create", func(t *testing.T) {
+		for name, body := range map[string]map[string]interface{}{
+			"duplicated-name": {"provisioner": map[string]interface{}{"type": "JWK", "name": "client", "key": publicJWK(generateJWK(t))}},
+			"private-key":     {"provisioner": map[string]interface{}{"type": "JWK", "name": "private", "key": generateJWK(t)}},
+			"no-password":     {"provisioner": map[string]interface{}{"type": "JWK", "name": "nopassword"}},
+			"bad-type":        {"provisioner": map[string]interface{}{"type": "FOO", "name": "foo"}},
+			"bad-provisioner": {"provisioner": map[string]interface{}{"type": "OIDC", "name": "oidc"}},
+			"empty":           {},
+		} {
+			t.Run(name, func(t *testing.T) {
+				code, _ := s.adminDo("POST", "/provisioners", body)
+				assert.Equals(t, http.StatusBadRequest, code)
+			})
+		}
+	})
+
+	t.Run("ok/validate-template", func(t *testing.T) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "requested", Organization: []string{"Smallstep"}},
+		}, priv)
+		assert.FatalError(t, err)
+		csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+		type response struct {
+			Certificate map[string]interface{} `json:"certificate"`
+			Error       string                 `json:"error"`
+			Line        int                    `json:"line"`
+		}
+		validate := func(body map[string]interface{}) (int, *response) {
+			code, b := s.adminDo("POST", "/templates/validate", body)
+			var res response
+			if code == http.StatusOK {
+				assert.FatalError(t, json.Unmarshal(b, &res))
+			}
+			return code, &res
+		}
+
+		code, res := validate(map[string]interface{}{
+			"type":     "x509",
+			"template": `{"subject": {"commonName": {{ toJson .Subject }}, "organization": {{ toJson .Insecure.CR.Subject.Organization }}}}`,
+			"claims":   map[string]interface{}{"sub": "sensor-1"},
+			"csr":      string(csr),
+		})
+		assert.Equals(t, http.StatusOK, code)
+		assert.Equals(t, "", res.Error)
+		assert.Equals(t, map[string]interface{}{
+			"subject": map[string]interface{}{"commonName": "sensor-1", "organization": []interface{}{"Smallstep"}},
+		}, res.Certificate)
+
+		code, res = validate(map[string]interface{}{
+			"type":           "ssh",
+			"template":       `{"principals": {{ append .Insecure.Cert.ValidPrincipals .Provisioner.Name | toJson }}}`,
+			"provisioner":    "admin",
+			"sshCertificate": map[string]interface{}{"certType": "host", "principals": []string{"host.example.com"}},
+		})
+		assert.Equals(t, http.StatusOK, code)
+		assert.Equals(t, map[string]interface{}{"principals": []interface{}{"host.example.com", "admin"}}, res.Certificate)
+
+		// A template with a syntax error.
+		code, res = validate(map[string]interface{}{"type": "x509", "template": "{\n\"subject\": {{ .Subject }\n}"})
+		assert.Equals(t, http.StatusOK, code)
+		assert.Nil(t, res.Certificate)
+		assert.True(t, strings.Contains(res.Error, "unexpected"), res.Error)
+		assert.Equals(t, 2, res.Line)
+
+		// A template that dereferences the missing certificate request.
+		code, res = validate(map[string]interface{}{"type": "x509", "template": `{"subject": {"commonName": {{ toJson .Insecure.CR.Subject.CommonName }}}}`})
+		assert.Equals(t, http.StatusOK, code)
+		assert.True(t, strings.Contains(res.Error, "nil pointer evaluating *x509.CertificateRequest.Subject"), res.Error)
+		assert.Equals(t, 1, res.Line)
+
+		for name, body := range map[string]map[string]interface{}{
+			"type":     {"type": "foo", "template": "{}"},
+			"csr":      {"type": "x509", "template": "{}", "csr": "foo"},
+			"ssh-type": {"type": "ssh", "template": "{}", "sshCertificate": map[string]interface{}{"certType": "foo"}},
+		} {
+			code, _ := validate(body)
+			assert.Equals(t, http.StatusBadRequest, code, name)
+		}
+		code, _ = s.do("POST", "/templates/validate", generateToken(t, "static", "static", adminAudience, staticKey), map[string]interface{}{"type": "x509", "template": "{}"})
+		assert.Equals(t, http.StatusForbidden, code)
+	})
+
+	t.Run("ok/list", func(t *testing.T) {
+		code, b := s.adminDo("GET", "/provisioners", nil)
+		assert.Equals(t, http.StatusOK, code)
+		var resp struct {
+			Provisioners provisioner.List `json:"provisioners"`
+		}
+		assert.FatalError(t, json.Unmarshal(b, &resp))
+		var names []string
+		for _, p := range resp.Provisioners {
+			names = append(names, p.GetName())
+		}
+		assert.Equals(t, []string{"admin", "client", "generated", "static"}, names)
+	})
+
+	t.Run("ok/get", func(t *testing.T) {
+		code, b := s.adminDo("GET", "/provisioners/client", nil)
+		assert.Equals(t, http.StatusOK, code)
+		var p provisioner.JWK
+		assert.FatalError(t, json.Unmarshal(b, &p))
+		assert.Equals(t, clientKey.KeyID, p.Key.KeyID)
+
+		code, _ = s.adminDo("GET", "/provisioners/missing", nil)
+		assert.Equals(t, http.StatusNotFound, code)
+	})
+
+	t.Run("ok/update", func(t *testing.T) {
+		disableRenewal := true
+		code, b := s.adminDo("PUT", "/provisioners/client", map[string]interface{}{
+			"provisioner": map[string]interface{}{
+				"type": "JWK", "name": "client",
+				"claims": &provisioner.Claims{DisableRenewal: &disableRenewal},
+			},
+		})
+		assert.Equals(t, http.StatusOK, code)
+		var p provisioner.JWK
+		assert.FatalError(t, json.Unmarshal(b, &p))
+		assert.Equals(t, clientKey.KeyID, p.Key.KeyID)
+
+		crt, err := sign(t, a, "client", clientKey)
+		assert.FatalError(t, err)
+		_, err = a.Renew(crt)
+		assert.Error(t, err)
+
+		code, _ = s.adminDo("PUT", "/provisioners/client", map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "OIDC", "name": "client"},
+		})
+		assert.Equals(t, http.StatusBadRequest, code)
+		code, _ = s.adminDo("PUT", "/provisioners/missing", map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "JWK", "name": "missing"},
+		})
+		assert.Equals(t, http.StatusNotFound, code)
+	})
+
+	var rotatedKey *jose.JSONWebKey
+	t.Run("ok/rotate", func(t *testing.T) {
+		code, b := s.adminDo("POST", "/provisioners/client/rotate", map[string]interface{}{
+			"password": "password",
+		})
+		assert.Equals(t, http.StatusOK, code)
+		var p provisioner.JWK
+		assert.FatalError(t, json.Unmarshal(b, &p))
+		assert.Equals(t, []string{p.Key.KeyID, clientKey.KeyID}, p.GetKeyIDs())
+		data, err := jose.Decrypt("", []byte(p.EncryptedKey), jose.WithPassword([]byte("password")))
+		assert.FatalError(t, err)
+		rotatedKey = new(jose.JSONWebKey)
+		assert.FatalError(t, json.Unmarshal(data, rotatedKey))
+
+		// The provisioners endpoint exposes all the active keys.
+		code, b = s.adminDo("GET", "/provisioners/client", nil)
+		assert.Equals(t, http.StatusOK, code)
+		assert.FatalError(t, json.Unmarshal(b, &p))
+		assert.Equals(t, []string{rotatedKey.KeyID, clientKey.KeyID}, p.GetKeyIDs())
+
+		// Only the encrypted key of the new key can be downloaded.
+		_, err = a.GetEncryptedKey(rotatedKey.KeyID)
+		assert.FatalError(t, err)
+		_, err = a.GetEncryptedKey(clientKey.KeyID)
+		assert.Error(t, err)
+
+		// The tokens signed with the old and the new key are valid.
+		_, err = sign(t, a, "client", clientKey)
+		assert.FatalError(t, err)
+		_, err = sign(t, a, "client", rotatedKey)
+		assert.FatalError(t, err)
+
+		// A key cannot be added twice.
+		code, _ = s.adminDo("POST", "/provisioners/client/rotate", map[string]interface{}{
+			"key": publicJWK(clientKey),
+		})
+		assert.Equals(t, http.StatusBadRequest, code)
+		code, _ = s.adminDo("POST", "/provisioners/missing/rotate", map[string]interface{}{
+			"password": "password",
+		})
+		assert.Equals(t, http.StatusNotFound, code)
+	})
+
+	t.Run("ok/retire", func(t *testing.T) {
+		crt, err := sign(t, a, "client", clientKey)
+		assert.FatalError(t, err)
+
+		code, _ := s.adminDo("POST", "/provisioners/client/retire", map[string]interface{}{
+			"kid": rotatedKey.KeyID,
+		})
+		assert.Equals(t, http.StatusBadRequest, code)
+		code, _ = s.adminDo("POST", "/provisioners/client/retire", map[string]interface{}{
+			"kid": "missing",
+		})
+		assert.Equals(t, http.StatusNotFound, code)
+		code, b := s.adminDo("POST", "/provisioners/client/retire", map[string]interface{}{
+			"kid": clientKey.KeyID,
+		})
+		assert.Equals(t, http.StatusOK, code)
+		var p provisioner.JWK
+		assert.FatalError(t, json.Unmarshal(b, &p))
+		assert.Equals(t, []string{rotatedKey.KeyID}, p.GetKeyIDs())
+
+		// The tokens signed with the old key are not valid.
+		_, err = sign(t, a, "client", clientKey)
+		assert.Error(t, err)
+		_, err = sign(t, a, "client", rotatedKey)
+		assert.FatalError(t, err)
+
+		// The certificates issued with the old key still belong to the
+		// provisioner.
+		p2, err := a.LoadProvisionerByCertificate(crt)
+		assert.FatalError(t, err)
+		assert.Equals(t, "client", p2.GetName())
+	})
+
+	t.Run("ok/disable", func(t *testing.T) {
+		crt, err := sign(t, a, "generated", generated)
+		assert.FatalError(t, err)
+
+		code, _ := s.adminDo("PUT", "/provisioners/generated", map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "JWK", "name": "generated", "disabled": true},
+		})
+		assert.Equals(t, http.StatusOK, code)
+
+		// New certificates cannot be issued, but renewals are still allowed.
+		_, err = sign(t, a, "generated", generated)
+		if assert.Error(t, err) {
+			assert.Equals(t, http.StatusUnauthorized, err.(errs.StatusCoder).StatusCode())
+			assert.HasPrefix(t, err.Error(), "authority.Authorize: authority.authorizeSign: authority.authorizeToken: provisioner generated is disabled")
+		}
+		_, err = a.Renew(crt)
+		assert.FatalError(t, err)
+		_, err = sign(t, a, "client", rotatedKey)
+		assert.FatalError(t, err)
+
+		code, _ = s.adminDo("PUT", "/provisioners/generated", map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "JWK", "name": "generated"},
+		})
+		assert.Equals(t, http.StatusOK, code)
+		_, err = sign(t, a, "generated", generated)
+		assert.FatalError(t, err)
+	})
+
+	t.Run("ok/delete", func(t *testing.T) {
+		crt, err := sign(t, a, "generated", generated)
+		assert.FatalError(t, err)
+
+		code, _ := s.adminDo("DELETE", "/provisioners/generated", nil)
+		assert.Equals(t, http.StatusNoContent, code)
+		code, _ = s.adminDo("DELETE", "/provisioners/static", nil)
+		assert.Equals(t, http.StatusNoContent, code)
+		code, _ = s.adminDo("DELETE", "/provisioners/generated", nil)
+		assert.Equals(t, http.StatusNotFound, code)
+
+		// New certificates cannot be issued.
+		_, err = sign(t, a, "generated", generated)
+		assert.Error(t, err)
+		_, err = sign(t, a, "static", staticKey)
+		assert.Error(t, err)
+
+		// The certificates already issued are still valid.
+		_, err = crt.Verify(verifyOpts)
+		assert.FatalError(t, err)
+		revoked, err := a.IsRevoked(crt.SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.False(t, revoked)
+	})
+
+	t.Run("ok/eab", func(t *testing.T) {
+		code, _ := s.adminDo("POST", "/provisioners", map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "ACME", "name": "acme", "requireEAB": true},
+		})
+		assert.Equals(t, http.StatusCreated, code)
+
+		code, b := s.adminDo("POST", "/provisioners/acme/eab", map[string]interface{}{"reference": "host-1"})
+		assert.Equals(t, http.StatusCreated, code)
+		var key acme.ExternalAccountKey
+		assert.FatalError(t, json.Unmarshal(b, &key))
+		assert.Equals(t, "acme/acme", key.Provisioner)
+		assert.Equals(t, "host-1", key.Reference)
+		assert.Equals(t, acme.StatusValid, key.Status)
+		assert.NotEquals(t, "", key.HmacKey)
+
+		// The HMAC key is only returned on creation.
+		code, b = s.adminDo("GET", "/provisioners/acme/eab", nil)
+		assert.Equals(t, http.StatusOK, code)
+		var keys []acme.ExternalAccountKey
+		assert.FatalError(t, json.Unmarshal(b, &keys))
+		assert.Len(t, 1, keys)
+		assert.Equals(t, key.ID, keys[0].ID)
+		assert.Equals(t, "", keys[0].HmacKey)
+
+		code, b = s.adminDo("DELETE", "/provisioners/acme/eab/"+key.ID, nil)
+		assert.Equals(t, http.StatusOK, code)
+		assert.FatalError(t, json.Unmarshal(b, &key))
+		assert.Equals(t, acme.StatusRevoked, key.Status)
+
+		code, _ = s.adminDo("DELETE", "/provisioners/acme/eab/missing", nil)
+		assert.Equals(t, http.StatusNotFound, code)
+		code, _ = s.adminDo("GET", "/provisioners/client/eab", nil)
+		assert.Equals(t, http.StatusBadRequest, code)
+		code, _ = s.adminDo("GET", "/provisioners/missing/eab", nil)
+		assert.Equals(t, http.StatusNotFound, code)
+	})
+
+	// The changes are loaded from the database on restart.
+	closeServer()
+	assert.FatalError(t, a.Shutdown())
+	a = newAuthority(t, dir, adminKey, staticKey, nil)
+	defer a.Shutdown()
+
+	_, err = a.LoadProvisionerByName("generated")
+	assert.Error(t, err)
+	_, err = a.LoadProvisionerByName("static")
+	assert.Error(t, err)
+	_, err = a.LoadProvisionerByName("client")
+	assert.FatalError(t, err)
+	_, err = sign(t, a, "client", clientKey)
+	assert.Error(t, err)
+	crt, err := sign(t, a, "client", rotatedKey)
+	assert.FatalError(t, err)
+	_, err = a.Renew(crt)
+	assert.Error(t, err)
+}
+
+func TestHandler_admins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	adminKey := generateJWK(t)
+	staticKey := generateJWK(t)
+	superAdmin := &authority.AdminConfig{Subject: "admin@example.com", Provisioner: "admin"}
+
+	a := newAuthority(t, dir, adminKey, staticKey, superAdmin)
+	s, closeServer := newServer(t, a, adminKey)
+	superDo := func(method, path string, body interface{}) (int, []byte) {
+		t.Helper()
+		return s.do(method, path, generateToken(t, "admin@example.com", "admin", adminAudience, adminKey), body)
+	}
+	certDo := func(method, path string, chain []*x509.Certificate, key *ecdsa.PrivateKey, body interface{}) (int, []byte) {
+		t.Helper()
+		return s.do(method, path, generateX5CToken(t, adminAudience, chain, key), body)
+	}
+
+	var bootstrap admin.Admin
+	t.Run("ok/bootstrap", func(t *testing.T) {
+		code, b := superDo("GET", "/admins", nil)
+		assert.Equals(t, http.StatusOK, code)
+		var admins []admin.Admin
+		assert.FatalError(t, json.Unmarshal(b, &admins))
+		assert.Len(t, 1, admins)
+		bootstrap = admins[0]
+		assert.NotEquals(t, "", bootstrap.ID)
+		assert.Equals(t, "admin@example.com", bootstrap.Subject)
+		assert.Equals(t, "admin", bootstrap.Provisioner)
+		assert.Equals(t, admin.TypeSuper, bootstrap.Type)
+	})
+
+	t.Run("fail/unregistered-subject", func(t *testing.T) {
+		// The tokens of the admin provisioner are not enough once there are
+		// admins registered.
+		code, _ := s.adminDo("GET", "/provisioners", nil)
+		assert.Equals(t, http.StatusForbidden, code)
+	})
+
+	t.Run("ok/create", func(t *testing.T) {
+		code, b := superDo("POST", "/admins", map[string]interface{}{
+			"subject": "ops.example.com", "provisioner": "static",
+		})
+		assert.Equals(t, http.StatusCreated, code)
+		var adm admin.Admin
+		assert.FatalError(t, json.Unmarshal(b, &adm))
+		assert.NotEquals(t, "", adm.ID)
+		assert.Equals(t, admin.TypeProvisioner, adm.Type)
+	})
+
+	t.Run("fail/create", func(t *testing.T) {
+		for name, body := range map[string]map[string]interface{}{
+			"duplicated":      {"subject": "ops.example.com", "provisioner": "static"},
+			"no-subject":      {"provisioner": "static"},
+			"no-provisioner":  {"subject": "ops.example.com"},
+			"bad-provisioner": {"subject": "ops.example.com", "provisioner": "missing"},
+			"bad-type":        {"subject": "foo.example.com", "provisioner": "static", "type": "FOO"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				code, _ := superDo("POST", "/admins", body)
+				assert.Equals(t, http.StatusBadRequest, code)
+			})
+		}
+	})
+
+	chain, key, err := issue(t, a, "static", "ops.example.com", staticKey)
+	assert.FatalError(t, err)
+
+	t.Run("ok/admin-certificate", func(t *testing.T) {
+		code, _ := certDo("GET", "/provisioners", chain, key, nil)
+		assert.Equals(t, http.StatusOK, code)
+		code, _ = certDo("POST", "/provisioners", chain, key, map[string]interface{}{
+			"provisioner": map[string]interface{}{"type": "JWK", "name": "ops"},
+			"password":    "password",
+		})
+		assert.Equals(t, http.StatusCreated, code)
+	})
+
+	t.Run("fail/role", func(t *testing.T) {
+		for name, req := range map[string][2]string{
+			"delete-provisioner": {"DELETE", "/provisioners/ops"},
+			"update-provisioner": {"PUT", "/provisioners/ops"},
+			"list-admins":        {"GET", "/admins"},
+			"create-admin":       {"POST", "/admins"},
+			"delete-admin":       {"DELETE", "/admins/" + bootstrap.ID},
+			"rotate-key":         {"POST", "/provisioners/ops/rotate"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				code, _ := certDo(req[0], req[1], chain, key, map[string]interface{}{})
+				assert.Equals(t, http.StatusForbidden, code)
+			})
+		}
+		_, err := a.LoadProvisionerByName("ops")
+		assert.FatalError(t, err)
+	})
+
+	t.Run("fail/rotate-admin-provisioner", func(t *testing.T) {
+		// A new key of the provisioner of the super-admin would allow the
+		// admin to sign tokens as the super-admin.
+		newKey := generateJWK(t)
+		pub := newKey.Public()
+		code, _ := certDo("POST", "/provisioners/admin/rotate", chain, key, map[string]interface{}{
+			"key": &pub,
+		})
+		assert.Equals(t, http.StatusForbidden, code)
+		p, err := a.LoadProvisionerByName("admin")
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{adminKey.KeyID}, p.(*provisioner.JWK).GetKeyIDs())
+		code, _ = s.do("GET", "/admins", generateToken(t, "admin@example.com", "admin", adminAudience, newKey), nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("fail/not-admin-certificate", func(t *testing.T) {
+		chain, key, err := issue(t, a, "static", "other.example.com", staticKey)
+		assert.FatalError(t, err)
+		code, _ := certDo("GET", "/provisioners", chain, key, nil)
+		assert.Equals(t, http.StatusForbidden, code)
+
+		// The admin is registered for the static provisioner.
+		chain, key, err = issue(t, a, "admin", "ops.example.com", adminKey)
+		assert.FatalError(t, err)
+		code, _ = certDo("GET", "/provisioners", chain, key, nil)
+		assert.Equals(t, http.StatusForbidden, code)
+	})
+
+	t.Run("fail/certificate-token", func(t *testing.T) {
+		// Token already used.
+		tok := generateX5CToken(t, adminAudience, chain, key)
+		code, _ := s.do("GET", "/provisioners", tok, nil)
+		assert.Equals(t, http.StatusOK, code)
+		code, _ = s.do("GET", "/provisioners", tok, nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+
+		// Bad audience.
+		code, _ = s.do("GET", "/provisioners", generateX5CToken(t, signAudience, chain, key), nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+
+		// Signed with a different key.
+		other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		code, _ = certDo("GET", "/provisioners", chain, other, nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+
+		// Certificate not issued by the CA.
+		tmpl := &x509.Certificate{
+			SerialNumber:    chain[0].SerialNumber,
+			Subject:         chain[0].Subject,
+			NotBefore:       time.Now(),
+			NotAfter:        time.Now().Add(time.Hour),
+			KeyUsage:        x509.KeyUsageDigitalSignature,
+			ExtraExtensions: chain[0].Extensions,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+		assert.FatalError(t, err)
+		selfSigned, err := x509.ParseCertificate(der)
+		assert.FatalError(t, err)
+		code, _ = certDo("GET", "/provisioners", []*x509.Certificate{selfSigned}, key, nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("ok/unrevoke", func(t *testing.T) {
+		hold, _, err := issue(t, a, "static", "hold.example.com", staticKey)
+		assert.FatalError(t, err)
+		revoked, _, err := issue(t, a, "static", "revoked.example.com", staticKey)
+		assert.FatalError(t, err)
+		for crt, code := range map[*x509.Certificate]int{hold[0]: 6, revoked[0]: 1} {
+			assert.FatalError(t, a.Revoke(context.Background(), &authority.RevokeOptions{
+				Serial: crt.SerialNumber.String(), ReasonCode: code, MTLS: true, Crt: crt,
+			}))
+		}
+		holdPath := "/revocations/" + hold[0].SerialNumber.String()
+
+		// Only super-admins can release a certificate.
+		code, _ := certDo("DELETE", holdPath, chain, key, nil)
+		assert.Equals(t, http.StatusForbidden, code)
+
+		code, _ = superDo("DELETE", holdPath, nil)
+		assert.Equals(t, http.StatusNoContent, code)
+		isRevoked, err := a.IsRevoked(hold[0].SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.False(t, isRevoked)
+		code, _ = superDo("DELETE", holdPath, nil)
+		assert.Equals(t, http.StatusNotFound, code)
+
+		code, _ = superDo("DELETE", "/revocations/"+revoked[0].SerialNumber.String(), nil)
+		assert.Equals(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("ok/export", func(t *testing.T) {
+		code, b := superDo("GET", "/db/export", nil)
+		assert.Equals(t, http.StatusOK, code)
+		lines := strings.Split(string(b), "\n")
+		assert.Equals(t, `{"format":"step-ca-db","version":1}`, lines[0])
+		assert.True(t, strings.Contains(string(b), `{"bucket":"admins"}`))
+
+		// The export can be imported in other databases.
+		dst := memory.New()
+		assert.FatalError(t, db.Import(bytes.NewReader(b), dst, nil))
+		entries, err := dst.List([]byte("admins"))
+		assert.FatalError(t, err)
+		assert.Equals(t, 2, len(entries))
+
+		// Only super-admins can export the database.
+		code, _ = certDo("GET", "/db/export", chain, key, nil)
+		assert.Equals(t, http.StatusForbidden, code)
+	})
+
+	t.Run("ok/backup", func(t *testing.T) {
+		code, b := superDo("POST", "/backup", nil)
+		assert.Equals(t, http.StatusOK, code)
+		assert.True(t, strings.HasPrefix(string(b), `{"format":"step-ca-db","version":1}`))
+
+		// Restore the backup in an empty database, the issued certificates
+		// are still found.
+		dst, err := db.New(&db.Config{Type: "memory"})
+		assert.FatalError(t, err)
+		assert.FatalError(t, dst.(*db.DB).Import(bytes.NewReader(b), nil))
+		crt, err := dst.(db.CertificateFinder).GetCertificate(chain[0].SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.Equals(t, chain[0].Raw, crt.Raw)
+		crts, err := dst.(db.CertificateFinder).GetCertificatesBySAN("ops.example.com")
+		assert.FatalError(t, err)
+		assert.True(t, len(crts) > 0)
+
+		// Only super-admins can back up the database.
+		code, _ = certDo("POST", "/backup", chain, key, nil)
+		assert.Equals(t, http.StatusForbidden, code)
+	})
+
+	t.Run("ok/ssh-revoke", func(t *testing.T) {
+		body := map[string]interface{}{"serial": "1234", "reasonCode": 1, "reason": "lost laptop"}
+		code, _ := certDo("POST", "/ssh/revocations", chain, key, body)
+		assert.Equals(t, http.StatusForbidden, code)
+
+		code, _ = superDo("POST", "/ssh/revocations", body)
+		assert.Equals(t, http.StatusNoContent, code)
+		isRevoked, err := a.GetDatabase().IsSSHRevoked("1234")
+		assert.FatalError(t, err)
+		assert.True(t, isRevoked)
+		code, _ = superDo("POST", "/ssh/revocations", body)
+		assert.Equals(t, http.StatusConflict, code)
+
+		code, _ = superDo("POST", "/ssh/revocations", map[string]interface{}{"reasonCode": 1})
+		assert.Equals(t, http.StatusBadRequest, code)
+		code, _ = superDo("POST", "/ssh/revocations", map[string]interface{}{"serial": "1235", "reasonCode": 11})
+		assert.Equals(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("fail/ssh-keys", func(t *testing.T) {
+		body := map[string]interface{}{"type": "user", "generate": true}
+		code, _ := certDo("POST", "/ssh/keys/rotate", chain, key, body)
+		assert.Equals(t, http.StatusForbidden, code)
+
+		// The test authority does not have an SSH CA.
+		code, _ = superDo("POST", "/ssh/keys/rotate", body)
+		assert.Equals(t, http.StatusNotImplemented, code)
+		code, _ = superDo("POST", "/ssh/keys/retire", map[string]interface{}{"type": "user", "fingerprint": "SHA256:foo"})
+		assert.Equals(t, http.StatusNotImplemented, code)
+		code, _ = superDo("POST", "/ssh/keys/retire", map[string]interface{}{"type": "user"})
+		assert.Equals(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("ok/delete", func(t *testing.T) {
+		code, b := superDo("POST", "/admins", map[string]interface{}{
+			"subject": "root.example.com", "provisioner": "static", "type": "SUPER_ADMIN",
+		})
+		assert.Equals(t, http.StatusCreated, code)
+		var root admin.Admin
+		assert.FatalError(t, json.Unmarshal(b, &root))
+		rootChain, rootKey, err := issue(t, a, "static", "root.example.com", staticKey)
+		assert.FatalError(t, err)
+
+		code, _ = certDo("DELETE", "/admins/"+bootstrap.ID, rootChain, rootKey, nil)
+		assert.Equals(t, http.StatusNoContent, code)
+		code, _ = certDo("DELETE", "/admins/"+bootstrap.ID, rootChain, rootKey, nil)
+		assert.Equals(t, http.StatusNotFound, code)
+		code, _ = superDo("GET", "/admins", nil)
+		assert.Equals(t, http.StatusForbidden, code)
+
+		// The last super-admin cannot be deleted.
+		code, _ = certDo("DELETE", "/admins/"+root.ID, rootChain, rootKey, nil)
+		assert.Equals(t, http.StatusBadRequest, code)
+
+		// Super-admins can delete provisioners.
+		code, _ = certDo("DELETE", "/provisioners/ops", rootChain, rootKey, nil)
+		assert.Equals(t, http.StatusNoContent, code)
+	})
+
+	t.Run("fail/revoked-certificate", func(t *testing.T) {
+		assert.FatalError(t, a.Revoke(context.Background(), &authority.RevokeOptions{
+			Serial: chain[0].SerialNumber.String(),
+			MTLS:   true,
+			Crt:    chain[0],
+		}))
+		code, _ := certDo("GET", "/provisioners", chain, key, nil)
+		assert.Equals(t, http.StatusUnauthorized, code)
+	})
+
+	// The admins are loaded from the database on restart, and the
+	// super-admin in the configuration is not added again.
+	closeServer()
+	assert.FatalError(t, a.Shutdown())
+	a = newAuthority(t, dir, adminKey, staticKey, superAdmin)
+	defer a.Shutdown()
+
+	var subjects []string
+	for _, adm := range a.GetAdmins() {
+		subjects = append(subjects, adm.Subject)
+	}
+	assert.Equals(t, []string{"ops.example.com", "root.example.com"}, subjects)
+}
@@ -0,0 +1,269 @@
+package authority
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+	stepJOSE "github.com/smallstep/cli/jose"
+)
+
+func mustProvisionerRecord(t *testing.T, p provisioner.Interface) []byte {
+	t.Helper()
+	rec := provisionerRecord{Deleted: p == nil}
+	if p != nil {
+		b, err := json.Marshal(p)
+		assert.FatalError(t, err)
+		rec.Provisioner = b
+	}
+	b, err := json.Marshal(rec)
+	assert.FatalError(t, err)
+	return b
+}
+
+func TestAuthority_loadStoredProvisioners(t *testing.T) {
+	maxjwk, err := stepJOSE.ParseKey("testdata/secrets/max_pub.jwk")
+	assert.FatalError(t, err)
+	clijwk, err := stepJOSE.ParseKey("testdata/secrets/step_cli_key_pub.jwk")
+	assert.FatalError(t, err)
+	disableRenewal := true
+
+	records := map[string][]byte{
+		// Overrides the provisioner in the configuration.
+		"Max:" + maxjwk.KeyID: mustProvisionerRecord(t, &provisioner.JWK{
+			Type: "JWK", Name: "Max", Key: maxjwk,
+			Claims: &provisioner.Claims{DisableRenewal: &disableRenewal},
+		}),
+		// Removes the provisioner in the configuration.
+		"step-cli:" + clijwk.KeyID: mustProvisionerRecord(t, nil),
+		// Adds a new provisioner.
+		"new:" + clijwk.KeyID: mustProvisionerRecord(t, &provisioner.JWK{
+			Type: "JWK", Name: "new", Key: clijwk,
+		}),
+	}
+	a := testAuthority(t, WithDatabase(&db.MockAuthDB{
+		MGetProvisioners: func() (map[string][]byte, error) {
+			return records, nil
+		},
+	}))
+
+	p, err := a.LoadProvisionerByName("Max")
+	assert.FatalError(t, err)
+	assert.True(t, *p.(*provisioner.JWK).Claims.DisableRenewal)
+	_, err = a.LoadProvisionerByName("step-cli")
+	assert.Error(t, err)
+	_, err = a.LoadProvisionerByName("new")
+	assert.FatalError(t, err)
+
+	list, _, err := a.GetProvisioners("", 0)
+	assert.FatalError(t, err)
+	var names []string
+	for _, p := range list {
+		names = append(names, p.GetName())
+	}
+	assert.Equals(t, []string{"Max", "dev", "new", "renew_disabled", "sshpop"}, names)
+
+	// Bad records and database errors fail the initialization.
+	for name, fn := range map[string]func() (map[string][]byte, error){
+		"json": func() (map[string][]byte, error) {
+			return map[string][]byte{"foo": []byte("{")}, nil
+		},
+		"type": func() (map[string][]byte, error) {
+			return map[string][]byte{"foo": []byte(`{"provisioner":{"type":"foo","name":"foo"}}`)}, nil
+		},
+		"init": func() (map[string][]byte, error) {
+			return map[string][]byte{"foo": []byte(`{"provisioner":{"type":"JWK","name":"foo"}}`)}, nil
+		},
+		"db": func() (map[string][]byte, error) {
+			return nil, errors.New("force")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			a := testAuthority(t)
+			a.db = &db.MockAuthDB{MGetProvisioners: fn}
+			assert.Error(t, a.loadStoredProvisioners())
+		})
+	}
+}
+
+func TestAuthority_manageProvisioners(t *testing.T) {
+	maxjwk, err := stepJOSE.ParseKey("testdata/secrets/max_pub.jwk")
+	assert.FatalError(t, err)
+	clijwk, err := stepJOSE.ParseKey("testdata/secrets/step_cli_key_pub.jwk")
+	assert.FatalError(t, err)
+
+	stored := map[string][]byte{}
+	var deleted []string
+	a := testAuthority(t, WithDatabase(&db.MockAuthDB{
+		MStoreProvisioner: func(id string, data []byte) error {
+			stored[id] = data
+			return nil
+		},
+		MDeleteProvisioner: func(id string) error {
+			deleted = append(deleted, id)
+			delete(stored, id)
+			return nil
+		},
+	}))
+
+	// Create
+	assert.FatalError(t, a.CreateProvisioner(&provisioner.JWK{Type: "JWK", Name: "new", Key: clijwk}))
+	assert.Equals(t, mustProvisionerRecord(t, &provisioner.JWK{Type: "JWK", Name: "new", Key: clijwk}), stored["new:"+clijwk.KeyID])
+	err = a.CreateProvisioner(&provisioner.JWK{Type: "JWK", Name: "new", Key: maxjwk})
+	assert.HasPrefix(t, err.Error(), "authority.CreateProvisioner; provisioner new already exists")
+	err = a.CreateProvisioner(&provisioner.JWK{Type: "JWK", Name: "foo"})
+	assert.HasPrefix(t, err.Error(), "authority.CreateProvisioner: provisioner foo: provisioner key cannot be empty")
+	assert.Equals(t, http.StatusBadRequest, err.(errs.StatusCoder).StatusCode())
+
+	// Update with a new id replaces the record.
+	assert.FatalError(t, a.UpdateProvisioner("new", &provisioner.JWK{Type: "JWK", Name: "new", Key: maxjwk}))
+	assert.Equals(t, []string{"new:" + clijwk.KeyID}, deleted)
+	_, ok := stored["new:"+maxjwk.KeyID]
+	assert.True(t, ok)
+	_, err = a.LoadProvisionerByID("new:" + clijwk.KeyID)
+	assert.Error(t, err)
+	_, err = a.LoadProvisionerByID("new:" + maxjwk.KeyID)
+	assert.FatalError(t, err)
+	err = a.UpdateProvisioner("new", &provisioner.SSHPOP{Type: "SSHPOP", Name: "new"})
+	assert.HasPrefix(t, err.Error(), "authority.UpdateProvisioner; provisioner type cannot be changed from JWK to SSHPOP")
+	err = a.UpdateProvisioner("new", &provisioner.JWK{Type: "JWK", Name: "Max", Key: maxjwk})
+	assert.HasPrefix(t, err.Error(), "authority.UpdateProvisioner; provisioner Max already exists")
+
+	// Delete from the configuration stores a deleted record.
+	deleted = nil
+	assert.FatalError(t, a.DeleteProvisioner("step-cli"))
+	assert.Equals(t, mustProvisionerRecord(t, nil), stored["step-cli:"+clijwk.KeyID])
+	assert.FatalError(t, a.DeleteProvisioner("new"))
+	assert.Equals(t, []string{"new:" + maxjwk.KeyID}, deleted)
+	err = a.DeleteProvisioner("new")
+	assert.Equals(t, http.StatusNotFound, err.(errs.StatusCoder).StatusCode())
+
+	// Without a database that stores them the provisioners cannot be managed.
+	a = testAuthority(t, WithDatabase(&db.SimpleDB{}))
+	err = a.CreateProvisioner(&provisioner.JWK{Type: "JWK", Name: "new", Key: clijwk})
+	assert.Equals(t, http.StatusNotImplemented, err.(errs.StatusCoder).StatusCode())
+	_, err = a.LoadProvisionerByName("new")
+	assert.Error(t, err)
+}
+
+func TestAuthority_rotateProvisionerKey(t *testing.T) {
+	clijwk, err := stepJOSE.ParseKey("testdata/secrets/step_cli_key_pub.jwk")
+	assert.FatalError(t, err)
+	newjwk, err := stepJOSE.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	newjwk.KeyID, err = stepJOSE.Thumbprint(newjwk)
+	assert.FatalError(t, err)
+	pub := newjwk.Public()
+
+	stored := map[string][]byte{}
+	mockDB := &db.MockAuthDB{
+		MGetProvisioners: func() (map[string][]byte, error) {
+			return stored, nil
+		},
+		MStoreProvisioner: func(id string, data []byte) error {
+			stored[id] = data
+			return nil
+		},
+		MDeleteProvisioner: func(id string) error {
+			delete(stored, id)
+			return nil
+		},
+	}
+	a := testAuthority(t, WithDatabase(mockDB))
+
+	// Rotate the key of a provisioner in the configuration.
+	p, err := a.RotateProvisionerKey("step-cli", &pub, "encrypted")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{pub.KeyID, clijwk.KeyID}, p.(*provisioner.JWK).GetKeyIDs())
+	_, err = a.RotateProvisionerKey("step-cli", &pub, "")
+	assert.Equals(t, http.StatusBadRequest, err.(errs.StatusCoder).StatusCode())
+	_, err = a.RotateProvisionerKey("sshpop", &pub, "")
+	assert.Equals(t, http.StatusBadRequest, err.(errs.StatusCoder).StatusCode())
+	_, err = a.RotateProvisionerKey("missing", &pub, "")
+	assert.Equals(t, http.StatusNotFound, err.(errs.StatusCoder).StatusCode())
+	assert.Equals(t, mustProvisionerRecord(t, nil), stored["step-cli:"+clijwk.KeyID])
+
+	// The rotated provisioner is loaded on restart with both keys.
+	a = testAuthority(t, WithDatabase(mockDB))
+	for _, id := range []string{"step-cli:" + clijwk.KeyID, "step-cli:" + pub.KeyID} {
+		got, err := a.LoadProvisionerByID(id)
+		assert.FatalError(t, err)
+		assert.Equals(t, p.GetID(), got.GetID())
+	}
+	key, err := a.GetEncryptedKey(pub.KeyID)
+	assert.FatalError(t, err)
+	assert.Equals(t, "encrypted", key)
+
+	// Retire the old key.
+	_, err = a.RetireProvisionerKey("step-cli", pub.KeyID)
+	assert.Equals(t, http.StatusBadRequest, err.(errs.StatusCoder).StatusCode())
+	_, err = a.RetireProvisionerKey("step-cli", "missing")
+	assert.Equals(t, http.StatusNotFound, err.(errs.StatusCoder).StatusCode())
+	p, err = a.RetireProvisionerKey("step-cli", clijwk.KeyID)
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{pub.KeyID}, p.(*provisioner.JWK).GetKeyIDs())
+	_, err = a.LoadProvisionerByID("step-cli:" + clijwk.KeyID)
+	assert.Error(t, err)
+
+	a = testAuthority(t, WithDatabase(mockDB))
+	_, err = a.LoadProvisionerByID("step-cli:" + clijwk.KeyID)
+	assert.Error(t, err)
+	_, err = a.LoadProvisionerByID("step-cli:" + pub.KeyID)
+	assert.FatalError(t, err)
+}
+
+// watcherDB is a database that notifies the changes made by other CAs.
+type watcherDB struct {
+	*db.MockAuthDB
+	notify  func()
+	stopped bool
+}
+
+func (w *watcherDB) WatchAdmin(fn func()) (func(), error) {
+	w.notify = fn
+	return func() { w.stopped = true }, nil
+}
+
+func TestAuthority_reloadAdmin(t *testing.T) {
+	clijwk, err := stepJOSE.ParseKey("testdata/secrets/step_cli_key_pub.jwk")
+	assert.FatalError(t, err)
+
+	records := map[string][]byte{}
+	wdb := &watcherDB{MockAuthDB: &db.MockAuthDB{
+		MGetProvisioners: func() (map[string][]byte, error) {
+			return records, nil
+		},
+	}}
+	a := testAuthority(t, WithDatabase(wdb))
+	_, err = a.LoadProvisionerByName("new")
+	assert.Error(t, err)
+
+	// Other CA adds a provisioner.
+	records["new:"+clijwk.KeyID] = mustProvisionerRecord(t, &provisioner.JWK{
+		Type: "JWK", Name: "new", Key: clijwk,
+	})
+	wdb.notify()
+	_, err = a.LoadProvisionerByName("new")
+	assert.FatalError(t, err)
+
+	assert.False(t, wdb.stopped)
+	a.CloseForReload()
+	assert.True(t, wdb.stopped)
+
+	// Databases without notifications are ok.
+	testAuthority(t, WithDatabase(&watcherErrDB{&db.MockAuthDB{}}))
+}
+
+// watcherErrDB is a database that does not send notifications.
+type watcherErrDB struct {
+	*db.MockAuthDB
+}
+
+func (w *watcherErrDB) WatchAdmin(fn func()) (func(), error) {
+	return nil, db.ErrNotImplemented
+}
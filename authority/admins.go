@@ -0,0 +1,172 @@
+package authority
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/randutil"
+)
+
+// loadAdmins loads the admins in the database. If there are none, the
+// super-admin in the configuration is added.
+func (a *Authority) loadAdmins() error {
+	records, err := a.db.GetAdmins()
+	switch {
+	case errors.Cause(err) == db.ErrNotImplemented:
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "error loading admins")
+	}
+
+	admins := make([]*admin.Admin, 0, len(records))
+	for id, b := range records {
+		adm := new(admin.Admin)
+		if err := json.Unmarshal(b, adm); err != nil {
+			return errors.Wrapf(err, "error unmarshaling admin %s", id)
+		}
+		admins = append(admins, adm)
+	}
+
+	c := a.config.AuthorityConfig.SuperAdmin
+	if len(admins) == 0 && c != nil {
+		if _, ok := a.provisioners.LoadByName(c.Provisioner); !ok {
+			return errors.Errorf("authority.superAdmin.provisioner %s not found", c.Provisioner)
+		}
+		adm := &admin.Admin{
+			Subject:     c.Subject,
+			Provisioner: c.Provisioner,
+			Type:        admin.TypeSuper,
+		}
+		if err := a.storeAdmin(adm); err != nil {
+			return errors.Wrap(err, "error storing super-admin")
+		}
+		admins = append(admins, adm)
+	}
+
+	a.adminsMutex.Lock()
+	a.admins = admins
+	a.adminsMutex.Unlock()
+	return nil
+}
+
+// GetAdmins returns the admins sorted by provisioner and subject.
+func (a *Authority) GetAdmins() []*admin.Admin {
+	a.adminsMutex.RLock()
+	admins := append([]*admin.Admin(nil), a.admins...)
+	a.adminsMutex.RUnlock()
+	sort.Slice(admins, func(i, j int) bool {
+		if admins[i].Provisioner != admins[j].Provisioner {
+			return admins[i].Provisioner < admins[j].Provisioner
+		}
+		return admins[i].Subject < admins[j].Subject
+	})
+	return admins
+}
+
+// CreateAdmin adds a new admin and persists it in the database. The
+// provisioner of the admin must exist, and the pair of subject and provisioner
+// must be unique. The id of the admin is generated.
+func (a *Authority) CreateAdmin(adm *admin.Admin) error {
+	if err := adm.Validate(); err != nil {
+		return errs.Wrap(http.StatusBadRequest, err, "authority.CreateAdmin")
+	}
+	if _, ok := a.provisioners.LoadByName(adm.Provisioner); !ok {
+		return errs.BadRequest("authority.CreateAdmin; provisioner %s not found", adm.Provisioner)
+	}
+
+	a.adminsMutex.Lock()
+	defer a.adminsMutex.Unlock()
+
+	if _, ok := findAdmin(a.admins, adm.Subject, adm.Provisioner); ok {
+		return errs.BadRequest("authority.CreateAdmin; admin %s of provisioner %s already exists", adm.Subject, adm.Provisioner)
+	}
+	if err := a.storeAdmin(adm); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.CreateAdmin")
+	}
+	a.admins = append(a.admins, adm)
+	return nil
+}
+
+// DeleteAdmin removes the admin with the given id from the authority and the
+// database. The last super-admin cannot be deleted.
+func (a *Authority) DeleteAdmin(id string) error {
+	a.adminsMutex.Lock()
+	defer a.adminsMutex.Unlock()
+
+	i := -1
+	supers := 0
+	for j, adm := range a.admins {
+		if adm.ID == id {
+			i = j
+		}
+		if adm.Type == admin.TypeSuper {
+			supers++
+		}
+	}
+	if i == -1 {
+		return errs.NotFound("authority.DeleteAdmin; admin %s not found", id)
+	}
+	if a.admins[i].Type == admin.TypeSuper && supers == 1 {
+		return errs.BadRequest("authority.DeleteAdmin; the last super-admin cannot be deleted")
+	}
+	if err := a.db.DeleteAdmin(id); err != nil {
+		return errs.Wrap(http.StatusInternalServerError, adminDBError(err), "authority.DeleteAdmin")
+	}
+	admins := make([]*admin.Admin, 0, len(a.admins)-1)
+	admins = append(admins, a.admins[:i]...)
+	a.admins = append(admins, a.admins[i+1:]...)
+	return nil
+}
+
+// loadAdmin returns the admin with the given subject of the given
+// provisioner.
+func (a *Authority) loadAdmin(subject, provisionerName string) (*admin.Admin, bool) {
+	a.adminsMutex.RLock()
+	defer a.adminsMutex.RUnlock()
+	return findAdmin(a.admins, subject, provisionerName)
+}
+
+// hasAdmins returns true if there is at least one admin registered.
+func (a *Authority) hasAdmins() bool {
+	a.adminsMutex.RLock()
+	defer a.adminsMutex.RUnlock()
+	return len(a.admins) > 0
+}
+
+func findAdmin(admins []*admin.Admin, subject, provisionerName string) (*admin.Admin, bool) {
+	for _, adm := range admins {
+		if adm.Subject == subject && adm.Provisioner == provisionerName {
+			return adm, true
+		}
+	}
+	return nil, false
+}
+
+// storeAdmin generates the id of the given admin and persists it in the
+// database.
+func (a *Authority) storeAdmin(adm *admin.Admin) error {
+	id, err := randutil.Alphanumeric(32)
+	if err != nil {
+		return errors.Wrap(err, "error generating admin id")
+	}
+	adm.ID = id
+	b, err := json.Marshal(adm)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling admin")
+	}
+	return adminDBError(a.db.StoreAdmin(id, b))
+}
+
+// adminDBError returns a NotImplemented error if the database does not
+// support the persistence of admins.
+func adminDBError(err error) error {
+	if errors.Cause(err) == db.ErrNotImplemented {
+		return errs.NotImplemented("admins cannot be managed without a database")
+	}
+	return err
+}
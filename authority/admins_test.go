@@ -0,0 +1,73 @@
+package authority
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/db"
+)
+
+func TestAuthority_loadAdmins(t *testing.T) {
+	stored := map[string][]byte{}
+	mockDB := &db.MockAuthDB{
+		MGetAdmins: func() (map[string][]byte, error) {
+			return stored, nil
+		},
+		MStoreAdmin: func(id string, data []byte) error {
+			stored[id] = data
+			return nil
+		},
+	}
+
+	a := testAuthority(t, WithDatabase(mockDB))
+	assert.Len(t, 0, a.GetAdmins())
+
+	// The super-admin is created if there are no admins.
+	a.config.AuthorityConfig.SuperAdmin = &AdminConfig{Subject: "admin@example.com", Provisioner: "Max"}
+	assert.FatalError(t, a.loadAdmins())
+	admins := a.GetAdmins()
+	assert.Len(t, 1, admins)
+	assert.Equals(t, admin.TypeSuper, admins[0].Type)
+	assert.Len(t, 1, stored)
+	var adm admin.Admin
+	assert.FatalError(t, json.Unmarshal(stored[admins[0].ID], &adm))
+	assert.Equals(t, *admins[0], adm)
+
+	// But only on the first start.
+	a.config.AuthorityConfig.SuperAdmin = &AdminConfig{Subject: "other@example.com", Provisioner: "Max"}
+	assert.FatalError(t, a.loadAdmins())
+	assert.Equals(t, admins, a.GetAdmins())
+	assert.Len(t, 1, stored)
+
+	for name, fn := range map[string]func(a *Authority){
+		"json": func(a *Authority) {
+			a.db = &db.MockAuthDB{MGetAdmins: func() (map[string][]byte, error) {
+				return map[string][]byte{"foo": []byte("{")}, nil
+			}}
+		},
+		"db": func(a *Authority) {
+			a.db = &db.MockAuthDB{MGetAdmins: func() (map[string][]byte, error) {
+				return nil, errors.New("force")
+			}}
+		},
+		"provisioner": func(a *Authority) {
+			a.db = &db.MockAuthDB{}
+			a.config.AuthorityConfig.SuperAdmin = &AdminConfig{Subject: "admin@example.com", Provisioner: "missing"}
+		},
+		"store": func(a *Authority) {
+			a.db = &db.MockAuthDB{MStoreAdmin: func(id string, data []byte) error {
+				return errors.New("force")
+			}}
+			a.config.AuthorityConfig.SuperAdmin = &AdminConfig{Subject: "admin@example.com", Provisioner: "Max"}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			a := testAuthority(t)
+			fn(a)
+			assert.Error(t, a.loadAdmins())
+		})
+	}
+}
@@ -6,12 +6,16 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"io"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/admin"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/kms"
 	kmsapi "github.com/smallstep/certificates/kms/apiv1"
 	"github.com/smallstep/certificates/sshutil"
@@ -31,6 +35,18 @@ type Authority struct {
 	provisioners *provisioner.Collection
 	db           db.AuthDB
 
+	// Provisioners management
+	provisionerConfig provisioner.Config
+	adminMutex        sync.Mutex
+
+	// Admins of the admin API
+	admins      []*admin.Admin
+	adminsMutex sync.RWMutex
+	stopWatch   func()
+
+	// Deletion of the expired entries of the database
+	stopCleanup func()
+
 	// X509 CA
 	rootX509Certs      []*x509.Certificate
 	federatedX509Certs []*x509.Certificate
@@ -45,16 +61,35 @@ type Authority struct {
 	sshCAHostCerts          []ssh.PublicKey
 	sshCAUserFederatedCerts []ssh.PublicKey
 	sshCAHostFederatedCerts []ssh.PublicKey
+	// End of the overlap period of the rotated keys by fingerprint
+	sshCAKeysNotAfter map[string]time.Time
+	sshKeysMutex      sync.RWMutex
 
 	// Do not re-initialize
 	initOnce  bool
 	startTime time.Time
 
+	// Cached health checks
+	health healthCache
+
+	// Last signed CRL
+	crl crlCache
+
+	// Metrics of the token validation
+	meter Meter
+
+	// Rate limits of the provisioners
+	rateLimiter *rateLimiter
+
 	// Custom functions
 	sshBastionFunc   func(user, hostname string) (*Bastion, error)
 	sshCheckHostFunc func(ctx context.Context, principal string, tok string, roots []*x509.Certificate) (bool, error)
 	sshGetHostsFunc  func(cert *x509.Certificate) ([]sshutil.Host, error)
 	getIdentityFunc  provisioner.GetIdentityFunc
+
+	// Variables and default templates used to render the ssh templates.
+	templateVars        templates.Step
+	sshDefaultTemplates *templates.SSHTemplates
 }
 
 // New creates and initiates a new Authority type.
@@ -109,11 +144,14 @@ func (a *Authority) init() error {
 	// Initialize step-ca Database if it's not already initialized with WithDB.
 	// If a.config.DB is nil then a simple, barebones in memory DB will be used.
 	if a.db == nil {
-		if a.db, err = db.New(a.config.DB); err != nil {
+		if a.db, err = db.New(a.config.DB, db.WithKMSSigner(a.kmsSigner)); err != nil {
 			return err
 		}
 	}
 
+	// Initialize the rate limits of the provisioners.
+	a.rateLimiter = newRateLimiter(a.config.AuthorityConfig.RateLimit)
+
 	// Read root certificates and store them in the certificates map.
 	if len(a.rootX509Certs) == 0 {
 		a.rootX509Certs = make([]*x509.Certificate, len(a.config.Root))
@@ -138,6 +176,9 @@ func (a *Authority) init() error {
 			if err != nil {
 				return err
 			}
+			if !crt.IsCA {
+				return errors.Errorf("federated root %s is not a CA certificate", path)
+			}
 			a.federatedX509Certs[i] = crt
 		}
 	}
@@ -166,33 +207,17 @@ func (a *Authority) init() error {
 	// Decrypt and load SSH keys
 	if a.config.SSH != nil {
 		if a.config.SSH.HostKey != "" {
-			signer, err := a.keyManager.CreateSigner(&kmsapi.CreateSignerRequest{
-				SigningKey: a.config.SSH.HostKey,
-				Password:   []byte(a.config.Password),
-			})
-			if err != nil {
+			if a.sshCAHostCertSignKey, err = a.loadSSHSigner(a.config.SSH.HostKey, a.config.SSH.HostPublicKey); err != nil {
 				return err
 			}
-			a.sshCAHostCertSignKey, err = ssh.NewSignerFromSigner(signer)
-			if err != nil {
-				return errors.Wrap(err, "error creating ssh signer")
-			}
 			// Append public key to list of host certs
 			a.sshCAHostCerts = append(a.sshCAHostCerts, a.sshCAHostCertSignKey.PublicKey())
 			a.sshCAHostFederatedCerts = append(a.sshCAHostFederatedCerts, a.sshCAHostCertSignKey.PublicKey())
 		}
 		if a.config.SSH.UserKey != "" {
-			signer, err := a.keyManager.CreateSigner(&kmsapi.CreateSignerRequest{
-				SigningKey: a.config.SSH.UserKey,
-				Password:   []byte(a.config.Password),
-			})
-			if err != nil {
+			if a.sshCAUserCertSignKey, err = a.loadSSHSigner(a.config.SSH.UserKey, a.config.SSH.UserPublicKey); err != nil {
 				return err
 			}
-			a.sshCAUserCertSignKey, err = ssh.NewSignerFromSigner(signer)
-			if err != nil {
-				return errors.Wrap(err, "error creating ssh signer")
-			}
 			// Append public key to list of user certs
 			a.sshCAUserCerts = append(a.sshCAUserCerts, a.sshCAUserCertSignKey.PublicKey())
 			a.sshCAUserFederatedCerts = append(a.sshCAUserFederatedCerts, a.sshCAUserCertSignKey.PublicKey())
@@ -219,14 +244,19 @@ func (a *Authority) init() error {
 		}
 	}
 
+	// Append the keys of the federated authorities
+	if k := a.config.FederatedSSHKeys; k != nil {
+		a.sshCAUserFederatedCerts = append(a.sshCAUserFederatedCerts, k.userKeys...)
+		a.sshCAHostFederatedCerts = append(a.sshCAHostFederatedCerts, k.hostKeys...)
+	}
+
 	// Merge global and configuration claims
 	claimer, err := provisioner.NewClaimer(a.config.AuthorityConfig.Claims, globalProvisionerClaims)
 	if err != nil {
 		return err
 	}
-	// TODO: should we also be combining the ssh federated roots here?
-	// If we rotate ssh roots keys, sshpop provisioner will lose ability to
-	// validate old SSH certificates, unless they are added as federated certs.
+	// The sshpop provisioners use the current ssh roots, the old keys are
+	// still valid during the overlap period of a rotation.
 	sshKeys, err := a.GetSSHRoots()
 	if err != nil {
 		return err
@@ -240,35 +270,77 @@ func (a *Authority) init() error {
 			UserKeys: sshKeys.UserKeys,
 			HostKeys: sshKeys.HostKeys,
 		},
+		GetSSHKeysFunc: func() *provisioner.SSHKeys {
+			keys, _ := a.GetSSHRoots()
+			return &provisioner.SSHKeys{
+				UserKeys: keys.UserKeys,
+				HostKeys: keys.HostKeys,
+			}
+		},
 		GetIdentityFunc: a.getIdentityFunc,
+		X509:            a.config.AuthorityConfig.X509,
+		X509Policy:      a.config.AuthorityConfig.X509Policy,
+		SSHPolicy:       a.config.AuthorityConfig.SSHPolicy,
 	}
 	// Store all the provisioners
-	for _, p := range a.config.AuthorityConfig.Provisioners {
-		if err := p.Init(config); err != nil {
+	for i, p := range a.config.AuthorityConfig.Provisioners {
+		if err := provisioner.Validate(p, a.config.AuthorityConfig.Provisioners[:i], config); err != nil {
 			return err
 		}
+		logPolicyWarnings(p, config)
 		if err := a.provisioners.Store(p); err != nil {
 			return err
 		}
 	}
+	// Merge the provisioners managed with the admin API, they take precedence
+	// over the ones in the configuration.
+	a.provisionerConfig = config
+	if err := a.loadStoredProvisioners(); err != nil {
+		return err
+	}
+	// Load the admins, or create the super-admin on the first start.
+	if err := a.loadAdmins(); err != nil {
+		return err
+	}
+	// Load them again when other CA using the same database changes them.
+	if w, ok := a.db.(db.AdminWatcher); ok {
+		stop, err := w.WatchAdmin(a.reloadAdmin)
+		switch {
+		case errors.Cause(err) == db.ErrNotImplemented:
+		case err != nil:
+			return errors.Wrap(err, "error watching provisioners and admins")
+		default:
+			a.stopWatch = stop
+		}
+	}
+	// Delete the expired used tokens and nonces in the background.
+	a.startCleanup()
 
 	// Configure protected template variables:
+	a.templateVars = templates.Step{CAURL: a.config.caURL()}
+	if a.config.SSH != nil {
+		if b := a.config.SSH.Bastion; b != nil && b.Hostname != "" {
+			a.templateVars.SSH.Bastion = &templates.StepSSHBastion{
+				Hostname: b.Hostname,
+				User:     b.User,
+				Port:     b.Port,
+				Command:  b.Command,
+				Flags:    b.Flags,
+			}
+		}
+		a.updateSSHTemplateVars()
+	}
 	if t := a.config.Templates; t != nil {
 		if t.Data == nil {
 			t.Data = make(map[string]interface{})
 		}
-		var vars templates.Step
-		if a.config.SSH != nil {
-			if a.sshCAHostCertSignKey != nil {
-				vars.SSH.HostKey = a.sshCAHostCertSignKey.PublicKey()
-				vars.SSH.HostFederatedKeys = append(vars.SSH.HostFederatedKeys, a.sshCAHostFederatedCerts[1:]...)
-			}
-			if a.sshCAUserCertSignKey != nil {
-				vars.SSH.UserKey = a.sshCAUserCertSignKey.PublicKey()
-				vars.SSH.UserFederatedKeys = append(vars.SSH.UserFederatedKeys, a.sshCAUserFederatedCerts[1:]...)
-			}
+		t.Data["Step"] = a.templateVars
+	}
+	// The default ssh templates are used if none are configured.
+	if t := a.config.Templates; t == nil || t.SSH == nil {
+		if a.sshDefaultTemplates, err = newDefaultSSHTemplates(); err != nil {
+			return err
 		}
-		t.Data["Step"] = vars
 	}
 
 	// JWT numeric dates are seconds.
@@ -280,13 +352,93 @@ func (a *Authority) init() error {
 	return nil
 }
 
+// kmsSigner returns the signer of a key in the KMS, it is used by the database
+// encryption keys with a KMS reference.
+func (a *Authority) kmsSigner(name string) (crypto.Signer, error) {
+	return a.keyManager.CreateSigner(&kmsapi.CreateSignerRequest{SigningKey: name})
+}
+
+// NewDatabase opens the database of the configuration c. It is used to wrap
+// the database before creating the authority, the KMS of the configuration is
+// only initialized if the database encryption uses it.
+func NewDatabase(c *Config) (db.AuthDB, error) {
+	return db.New(c.DB, db.WithKMSSigner(func(name string) (crypto.Signer, error) {
+		var options kmsapi.Options
+		if c.KMS != nil {
+			options = *c.KMS
+		}
+		k, err := kms.New(context.Background(), options)
+		if err != nil {
+			return nil, err
+		}
+		return k.CreateSigner(&kmsapi.CreateSignerRequest{SigningKey: name})
+	}))
+}
+
 // GetDatabase returns the authority database. If the configuration does not
-// define a database, GetDatabase will return a db.SimpleDB instance.
+// define a database, GetDatabase will return an in-memory database.
 func (a *Authority) GetDatabase() db.AuthDB {
 	return a.db
 }
 
+// ExportDB writes all the entries in the database to w, see db.Export.
+func (a *Authority) ExportDB(w io.Writer) error {
+	e, ok := a.db.(db.Exporter)
+	if !ok {
+		return errs.NotImplemented("authority.ExportDB; the database cannot be exported")
+	}
+	err := e.Export(w, nil)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Cause(err) == db.ErrNotImplemented:
+		return errs.NotImplemented("authority.ExportDB; the database cannot be exported")
+	default:
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.ExportDB")
+	}
+}
+
+// BackupMeter is implemented by the meters that report the backups of the
+// database.
+type BackupMeter interface {
+	DatabaseBackedUp(d time.Duration, size int64, err error)
+}
+
+// BackupDB writes a backup of the database to w, read from a consistent
+// snapshot if the database supports it, see db.Backup. The backup is restored
+// with db.Import.
+func (a *Authority) BackupDB(ctx context.Context, w io.Writer) error {
+	b, ok := a.db.(db.Backuper)
+	if !ok {
+		return errs.NotImplemented("authority.BackupDB; the database cannot be backed up")
+	}
+	t := time.Now()
+	size, err := b.Backup(ctx, w, nil)
+	if errors.Cause(err) == db.ErrNotImplemented {
+		return errs.NotImplemented("authority.BackupDB; the database cannot be backed up")
+	}
+	if m, ok := a.meter.(BackupMeter); ok {
+		m.DatabaseBackedUp(time.Since(t), size, err)
+	}
+	if err != nil {
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.BackupDB")
+	}
+	return nil
+}
+
 // Shutdown safely shuts down any clients, databases, etc. held by the Authority.
 func (a *Authority) Shutdown() error {
+	a.CloseForReload()
 	return a.db.Shutdown()
 }
+
+// CloseForReload stops the background work of an authority replaced by a
+// reload, the database is not closed because the new authority uses it.
+func (a *Authority) CloseForReload() {
+	if a.stopWatch != nil {
+		a.stopWatch()
+	}
+	if a.stopCleanup != nil {
+		a.stopCleanup()
+	}
+}
@@ -1,15 +1,21 @@
 package authority
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"io/ioutil"
+	"net/http"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
 	stepJOSE "github.com/smallstep/cli/jose"
 )
 
@@ -118,6 +124,31 @@ func TestAuthorityNew(t *testing.T) {
 				err:    errors.New("open wrong failed: no such file or directory"),
 			}
 		},
+		"fail bad provisioner template": func(t *testing.T) *newTest {
+			c, err := LoadConfiguration("../ca/testdata/ca.json")
+			assert.FatalError(t, err)
+			jwk, err := stepJOSE.ParseKey("testdata/secrets/max_pub.jwk")
+			assert.FatalError(t, err)
+			c.AuthorityConfig.Provisioners = append(c.AuthorityConfig.Provisioners, &provisioner.JWK{
+				Name: "bad-template", Type: "JWK", Key: jwk,
+				X509: &provisioner.X509Options{Template: `{{ .Subject `},
+			})
+			return &newTest{
+				config: c,
+				err:    errors.New("provisioner bad-template: error parsing x509 template of provisioner bad-template"),
+			}
+		},
+		"fail duplicated provisioner": func(t *testing.T) *newTest {
+			c, err := LoadConfiguration("../ca/testdata/ca.json")
+			assert.FatalError(t, err)
+			c.AuthorityConfig.Provisioners = append(c.AuthorityConfig.Provisioners, &provisioner.ACME{
+				Name: "step-cli", Type: "ACME",
+			})
+			return &newTest{
+				config: c,
+				err:    errors.New("provisioner step-cli: name is already used by another provisioner"),
+			}
+		},
 	}
 
 	for name, genTestCase := range tests {
@@ -182,3 +213,40 @@ func TestAuthority_GetDatabase(t *testing.T) {
 		})
 	}
 }
+
+type backupMeter struct {
+	calls int
+	size  int64
+	err   error
+}
+
+func (m *backupMeter) TokenValidationFailed(reason string) {}
+
+func (m *backupMeter) DatabaseBackedUp(d time.Duration, size int64, err error) {
+	m.calls++
+	m.size, m.err = size, err
+}
+
+func TestAuthority_BackupDB(t *testing.T) {
+	meter := &backupMeter{}
+	a := testAuthority(t, WithMeter(meter))
+	defer a.CloseForReload()
+
+	var buf bytes.Buffer
+	assert.FatalError(t, a.BackupDB(context.Background(), &buf))
+	assert.Equals(t, 1, meter.calls)
+	assert.Equals(t, int64(buf.Len()), meter.size)
+	assert.Nil(t, meter.err)
+
+	// Failed backups are recorded.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := a.BackupDB(ctx, ioutil.Discard)
+	assert.Equals(t, http.StatusInternalServerError, err.(errs.StatusCoder).StatusCode())
+	assert.Equals(t, 2, meter.calls)
+	assert.NotNil(t, meter.err)
+
+	a = testAuthority(t, WithDatabase(&db.SimpleDB{}))
+	err = a.BackupDB(context.Background(), ioutil.Discard)
+	assert.Equals(t, http.StatusNotImplemented, err.(errs.StatusCoder).StatusCode())
+}
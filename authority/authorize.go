@@ -3,11 +3,18 @@ package authority
 import (
 	"context"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/admin"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/tracing"
 	"github.com/smallstep/cli/jose"
 	"golang.org/x/crypto/ssh"
 )
@@ -41,7 +48,9 @@ func (a *Authority) authorizeToken(ctx context.Context, token string) (provision
 	// Validate payload
 	tok, err := jose.ParseSigned(token)
 	if err != nil {
-		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeToken: error parsing token")
+		a.tokenValidationFailed("malformed")
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeToken: error parsing token",
+			errs.WithType(errs.TypeTokenInvalid))
 	}
 
 	// Get claims w/out verification. We need to look up the provisioner
@@ -49,7 +58,9 @@ func (a *Authority) authorizeToken(ctx context.Context, token string) (provision
 	// before we can look up the provisioner.
 	var claims Claims
 	if err = tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
-		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeToken")
+		a.tokenValidationFailed("malformed")
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeToken",
+			errs.WithType(errs.TypeTokenInvalid))
 	}
 
 	// TODO: use new persistence layer abstraction.
@@ -57,15 +68,34 @@ func (a *Authority) authorizeToken(ctx context.Context, token string) (provision
 	// This check is meant as a stopgap solution to the current lack of a persistence layer.
 	if a.config.AuthorityConfig != nil && !a.config.AuthorityConfig.DisableIssuedAtCheck {
 		if claims.IssuedAt != nil && claims.IssuedAt.Time().Before(a.startTime) {
-			return nil, errs.Unauthorized("authority.authorizeToken: token issued before the bootstrap of certificate authority")
+			a.tokenValidationFailed("issued-before-start")
+			return nil, errs.Unauthorized("authority.authorizeToken: token issued before the bootstrap of certificate authority",
+				errs.WithType(errs.TypeTokenInvalid))
 		}
 	}
 
 	// This method will also validate the audiences for JWK provisioners.
 	p, ok := a.provisioners.LoadByToken(tok, &claims.Claims)
 	if !ok {
+		a.tokenValidationFailed("provisioner-not-found")
 		return nil, errs.Unauthorized("authority.authorizeToken: provisioner "+
-			"not found or invalid audience (%s)", strings.Join(claims.Audience, ", "))
+			"not found or invalid audience (%s)", strings.Join(claims.Audience, ", "),
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+
+	// Reject all the tokens of a disabled provisioner.
+	if p.IsDisabled() {
+		a.tokenValidationFailed("provisioner-disabled")
+		return nil, errs.Unauthorized("authority.authorizeToken: provisioner %s is disabled", p.GetName(),
+			errs.WithMessage("The provisioner %s is disabled.", p.GetName()),
+			errs.WithType(errs.TypeProvisionerDisabled))
+	}
+
+	// Reject the tokens of a provisioner that has exceeded its rate limit
+	// before storing them, so they can be used again once the limit allows
+	// it. The bucket is only charged once the provisioner verifies the token.
+	if err := a.checkRateLimit(p); err != nil {
+		return nil, err
 	}
 
 	// Store the token to protect against reuse unless it's skipped.
@@ -74,10 +104,17 @@ func (a *Authority) authorizeToken(ctx context.Context, token string) (provision
 			ok, err := a.db.UseToken(reuseKey, token)
 			if err != nil {
 				return nil, errs.Wrap(http.StatusInternalServerError, err,
-					"authority.authorizeToken: failed when attempting to store token")
+					"authority.authorizeToken: failed when attempting to store token",
+					errs.WithType(errs.TypeDBUnavailable))
 			}
 			if !ok {
-				return nil, errs.Unauthorized("authority.authorizeToken: token already used")
+				a.tokenValidationFailed("reused")
+				if isTrustOnFirstUse(p) {
+					return nil, errs.Unauthorized("authority.authorizeToken: instance already enrolled",
+						errs.WithType(errs.TypeTokenReused))
+				}
+				return nil, errs.Unauthorized("authority.authorizeToken: token already used",
+					errs.WithType(errs.TypeTokenReused))
 			}
 		}
 	}
@@ -85,6 +122,45 @@ func (a *Authority) authorizeToken(ctx context.Context, token string) (provision
 	return p, nil
 }
 
+// invalidToken reports a token rejected by the provisioner and sets the
+// problem type of the authorization errors, expired tokens have their own
+// type.
+func (a *Authority) invalidToken(err error) error {
+	reason, typ := "invalid", errs.TypeTokenInvalid
+	if errors.Cause(err) == jose.ErrExpired {
+		reason, typ = "expired", errs.TypeTokenExpired
+	}
+	a.tokenValidationFailed(reason)
+	if e, ok := err.(*errs.Error); ok && e.Status == http.StatusUnauthorized && e.Type == "" {
+		e.Type = typ
+	}
+	return err
+}
+
+// tokenValidationFailed reports a token rejected for the given reason if the
+// authority has a meter.
+func (a *Authority) tokenValidationFailed(reason string) {
+	if a.meter != nil {
+		a.meter.TokenValidationFailed(reason)
+	}
+}
+
+// isTrustOnFirstUse returns true if the token IDs of the given provisioner
+// identify an instance instead of a token, so only the first request of an
+// instance is accepted.
+func isTrustOnFirstUse(p provisioner.Interface) bool {
+	switch p := p.(type) {
+	case *provisioner.AWS:
+		return !p.DisableTrustOnFirstUse
+	case *provisioner.GCP:
+		return !p.DisableTrustOnFirstUse
+	case *provisioner.Azure:
+		return !p.DisableTrustOnFirstUse
+	default:
+		return false
+	}
+}
+
 // Authorize grabs the method from the context and authorizes the request by
 // validating the one-time-token.
 func (a *Authority) Authorize(ctx context.Context, token string) ([]provisioner.SignOption, error) {
@@ -97,13 +173,13 @@ func (a *Authority) Authorize(ctx context.Context, token string) ([]provisioner.
 	case provisioner.RevokeMethod:
 		return nil, errs.Wrap(http.StatusInternalServerError, a.authorizeRevoke(ctx, token), "authority.Authorize", opts...)
 	case provisioner.SSHSignMethod:
-		if a.sshCAHostCertSignKey == nil && a.sshCAUserCertSignKey == nil {
+		if user, host := a.sshSigners(); user == nil && host == nil {
 			return nil, errs.NotImplemented("authority.Authorize; ssh certificate flows are not enabled", opts...)
 		}
 		signOpts, err := a.authorizeSSHSign(ctx, token)
 		return signOpts, errs.Wrap(http.StatusInternalServerError, err, "authority.Authorize", opts...)
 	case provisioner.SSHRenewMethod:
-		if a.sshCAHostCertSignKey == nil && a.sshCAUserCertSignKey == nil {
+		if user, host := a.sshSigners(); user == nil && host == nil {
 			return nil, errs.NotImplemented("authority.Authorize; ssh certificate flows are not enabled", opts...)
 		}
 		_, err := a.authorizeSSHRenew(ctx, token)
@@ -111,11 +187,13 @@ func (a *Authority) Authorize(ctx context.Context, token string) ([]provisioner.
 	case provisioner.SSHRevokeMethod:
 		return nil, errs.Wrap(http.StatusInternalServerError, a.authorizeSSHRevoke(ctx, token), "authority.Authorize", opts...)
 	case provisioner.SSHRekeyMethod:
-		if a.sshCAHostCertSignKey == nil && a.sshCAUserCertSignKey == nil {
+		if user, host := a.sshSigners(); user == nil && host == nil {
 			return nil, errs.NotImplemented("authority.Authorize; ssh certificate flows are not enabled", opts...)
 		}
 		_, signOpts, err := a.authorizeSSHRekey(ctx, token)
 		return signOpts, errs.Wrap(http.StatusInternalServerError, err, "authority.Authorize", opts...)
+	case provisioner.SSHCheckHostMethod:
+		return nil, errs.Wrap(http.StatusInternalServerError, a.authorizeSSHCheckHost(ctx, token), "authority.Authorize", opts...)
 	default:
 		return nil, errs.InternalServer("authority.Authorize; method %d is not supported", append([]interface{}{m}, opts...)...)
 	}
@@ -124,12 +202,22 @@ func (a *Authority) Authorize(ctx context.Context, token string) ([]provisioner.
 // authorizeSign loads the provisioner from the token and calls the provisioner
 // AuthorizeSign method. Returns a list of methods to apply to the signing flow.
 func (a *Authority) authorizeSign(ctx context.Context, token string) ([]provisioner.SignOption, error) {
-	p, err := a.authorizeToken(ctx, token)
+	spanCtx, span := tracing.Start(ctx, "authority.authorizeSign")
+	defer span.End()
+	p, err := a.authorizeToken(spanCtx, token)
 	if err != nil {
+		span.RecordError(err)
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeSign")
 	}
+	span.SetAttributes(tracing.String("provisioner", p.GetName()))
+	// The sign options keep the request context, the spans of the webhooks and
+	// templates are not part of the token validation.
 	signOpts, err := p.AuthorizeSign(ctx, token)
 	if err != nil {
+		span.RecordError(err)
+		return nil, errs.Wrap(http.StatusInternalServerError, a.invalidToken(err), "authority.authorizeSign")
+	}
+	if err := a.chargeRateLimit(p); err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeSign")
 	}
 	return signOpts, nil
@@ -153,9 +241,166 @@ func (a *Authority) authorizeRevoke(ctx context.Context, token string) error {
 		return errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeRevoke")
 	}
 	if err = p.AuthorizeRevoke(ctx, token); err != nil {
-		return errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeRevoke")
+		return errs.Wrap(http.StatusInternalServerError, a.invalidToken(err), "authority.authorizeRevoke")
 	}
-	return nil
+	return errs.Wrap(http.StatusInternalServerError, a.chargeRateLimit(p), "authority.authorizeRevoke")
+}
+
+// AuthorizeAdmin validates a token used to authenticate a request to the admin
+// API and returns the admin that generated it. The token must be signed with
+// the key of a certificate issued by the CA, with the certificate chain in the
+// x5c header, or generated by a JWK provisioner with the admin flag. The
+// subject of the token, or the common name of the certificate, and the name of
+// the provisioner that generated the token, or that issued the certificate,
+// must match a registered admin.
+//
+// If there are no admins registered, the tokens of the JWK admin provisioners
+// authenticate a super-admin.
+func (a *Authority) AuthorizeAdmin(ctx context.Context, token string) (*admin.Admin, error) {
+	var subject, provisionerName string
+	if hasX5CHeader(token) {
+		leaf, err := a.authorizeAdminCertificate(ctx, token)
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.AuthorizeAdmin")
+		}
+		p, ok := a.provisioners.LoadByCertificate(leaf)
+		if !ok {
+			return nil, errs.Forbidden("authority.AuthorizeAdmin; provisioner of certificate %s not found", leaf.SerialNumber)
+		}
+		subject, provisionerName = leaf.Subject.CommonName, p.GetName()
+	} else {
+		p, err := a.authorizeToken(ctx, token)
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.AuthorizeAdmin")
+		}
+		jwk, ok := p.(*provisioner.JWK)
+		if !ok {
+			return nil, errs.Forbidden("authority.AuthorizeAdmin; provisioner %s is not an admin provisioner", p.GetID())
+		}
+		if subject, err = jwk.AuthorizeAdmin(ctx, token); err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.AuthorizeAdmin")
+		}
+		if err := a.chargeRateLimit(p); err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.AuthorizeAdmin")
+		}
+		provisionerName = p.GetName()
+		if !a.hasAdmins() {
+			return &admin.Admin{Subject: subject, Provisioner: provisionerName, Type: admin.TypeSuper}, nil
+		}
+	}
+	adm, ok := a.loadAdmin(subject, provisionerName)
+	if !ok {
+		return nil, errs.Forbidden("authority.AuthorizeAdmin; %s is not an admin of provisioner %s", subject, provisionerName)
+	}
+	return adm, nil
+}
+
+// authorizeAdminCertificate validates an admin token signed with the key of a
+// certificate issued by the CA and returns the certificate. The certificate
+// must not be revoked, and the token can only be used once.
+func (a *Authority) authorizeAdminCertificate(ctx context.Context, token string) (*x509.Certificate, error) {
+	tok, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeAdminCertificate: error parsing token",
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+	roots := x509.NewCertPool()
+	for _, crt := range a.rootX509Certs {
+		roots.AddCert(crt)
+	}
+	chains, err := tok.Headers[0].Certificates(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeAdminCertificate: error verifying x5c certificate chain",
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+	leaf := chains[0][0]
+	if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return nil, errs.Unauthorized("authority.authorizeAdminCertificate: certificate cannot be used for digital signature",
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+
+	var claims jose.Claims
+	if err := tok.Claims(leaf.PublicKey, &claims); err != nil {
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeAdminCertificate: error parsing claims",
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+	if err := claims.ValidateWithLeeway(jose.Expected{Time: time.Now().UTC()}, time.Minute); err != nil {
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeAdminCertificate: invalid claims",
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+	if !matchesAudience(claims.Audience, a.config.getAudiences().Admin) {
+		return nil, errs.Unauthorized("authority.authorizeAdminCertificate: invalid audience claim (aud) %s", strings.Join(claims.Audience, ", "),
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+	if claims.ID == "" {
+		return nil, errs.Unauthorized("authority.authorizeAdminCertificate: token id (jti) cannot be empty",
+			errs.WithType(errs.TypeTokenInvalid))
+	}
+
+	isRevoked, err := a.db.IsRevoked(leaf.SerialNumber.String())
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeAdminCertificate")
+	}
+	if isRevoked {
+		return nil, errs.Unauthorized("authority.authorizeAdminCertificate: certificate %s has been revoked", leaf.SerialNumber)
+	}
+
+	if !SkipTokenReuseFromContext(ctx) {
+		ok, err := a.db.UseToken(claims.ID, token)
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err,
+				"authority.authorizeAdminCertificate: failed when attempting to store token",
+				errs.WithType(errs.TypeDBUnavailable))
+		}
+		if !ok {
+			a.tokenValidationFailed("reused")
+			return nil, errs.Unauthorized("authority.authorizeAdminCertificate: token already used",
+				errs.WithType(errs.TypeTokenReused))
+		}
+	}
+	return leaf, nil
+}
+
+// hasX5CHeader returns true if the protected header of the given token
+// contains a x5c certificate chain.
+func hasX5CHeader(token string) bool {
+	parts := strings.Split(token, ".")
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var header struct {
+		X5C []string `json:"x5c"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return false
+	}
+	return len(header.X5C) > 0
+}
+
+// matchesAudience returns true if one of the audiences is one of the expected
+// ones, ignoring the ports.
+func matchesAudience(audiences, expected []string) bool {
+	for _, e := range expected {
+		for _, aud := range audiences {
+			if aud == e || stripPort(aud) == stripPort(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stripPort(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	u.Host = u.Hostname()
+	return u.String()
 }
 
 // authorizeRenew locates the provisioner (using the provisioner extension in the cert), and checks
@@ -195,11 +440,49 @@ func (a *Authority) authorizeSSHSign(ctx context.Context, token string) ([]provi
 	}
 	signOpts, err := p.AuthorizeSSHSign(ctx, token)
 	if err != nil {
-		return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeSSHSign")
+		return nil, errs.Wrap(http.StatusUnauthorized, a.invalidToken(err), "authority.authorizeSSHSign")
+	}
+	if err := a.chargeRateLimit(p); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeSSHSign")
 	}
 	return signOpts, nil
 }
 
+// authorizeSSHCheckHost authenticates a request to check if a host certificate
+// exists. Any token that the provisioner accepts to sign or revoke X.509 or SSH
+// certificates is valid. The token is not stored, so it can still be used for
+// the request it was generated for.
+func (a *Authority) authorizeSSHCheckHost(ctx context.Context, token string) error {
+	ctx = NewContextWithSkipTokenReuse(ctx)
+	p, err := a.authorizeToken(ctx, token)
+	if err != nil {
+		return errs.Wrap(http.StatusUnauthorized, err, "authority.authorizeSSHCheckHost")
+	}
+	authorizers := []func(context.Context, string) error{
+		func(ctx context.Context, token string) error {
+			_, err := p.AuthorizeSign(ctx, token)
+			return err
+		},
+		func(ctx context.Context, token string) error {
+			_, err := p.AuthorizeSSHSign(ctx, token)
+			return err
+		},
+		p.AuthorizeRevoke,
+		p.AuthorizeSSHRevoke,
+	}
+	var firstErr error
+	for _, authorize := range authorizers {
+		err := authorize(ctx, token)
+		if err == nil {
+			return errs.Wrap(http.StatusInternalServerError, a.chargeRateLimit(p), "authority.authorizeSSHCheckHost")
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return errs.Wrap(http.StatusUnauthorized, a.invalidToken(firstErr), "authority.authorizeSSHCheckHost")
+}
+
 // authorizeSSHRenew authorizes an SSH certificate renewal request, by
 // validating the contents of an SSHPOP token.
 func (a *Authority) authorizeSSHRenew(ctx context.Context, token string) (*ssh.Certificate, error) {
@@ -209,6 +492,9 @@ func (a *Authority) authorizeSSHRenew(ctx context.Context, token string) (*ssh.C
 	}
 	cert, err := p.AuthorizeSSHRenew(ctx, token)
 	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, a.invalidToken(err), "authority.authorizeSSHRenew")
+	}
+	if err := a.chargeRateLimit(p); err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeSSHRenew")
 	}
 	return cert, nil
@@ -223,6 +509,9 @@ func (a *Authority) authorizeSSHRekey(ctx context.Context, token string) (*ssh.C
 	}
 	cert, signOpts, err := p.AuthorizeSSHRekey(ctx, token)
 	if err != nil {
+		return nil, nil, errs.Wrap(http.StatusInternalServerError, a.invalidToken(err), "authority.authorizeSSHRekey")
+	}
+	if err := a.chargeRateLimit(p); err != nil {
 		return nil, nil, errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeSSHRekey")
 	}
 	return cert, signOpts, nil
@@ -236,7 +525,7 @@ func (a *Authority) authorizeSSHRevoke(ctx context.Context, token string) error
 		return errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeSSHRevoke")
 	}
 	if err = p.AuthorizeSSHRevoke(ctx, token); err != nil {
-		return errs.Wrap(http.StatusInternalServerError, err, "authority.authorizeSSHRevoke")
+		return errs.Wrap(http.StatusInternalServerError, a.invalidToken(err), "authority.authorizeSSHRevoke")
 	}
-	return nil
+	return errs.Wrap(http.StatusInternalServerError, a.chargeRateLimit(p), "authority.authorizeSSHRevoke")
 }
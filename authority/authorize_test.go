@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/ratelimit"
 	"github.com/smallstep/cli/crypto/pemutil"
 	"github.com/smallstep/cli/crypto/randutil"
 	"github.com/smallstep/cli/jose"
@@ -101,6 +103,7 @@ func TestAuthority_authorizeToken(t *testing.T) {
 		token string
 		err   error
 		code  int
+		typ   string
 	}
 	tests := map[string]func(t *testing.T) *authorizeTest{
 		"fail/invalid-token": func(t *testing.T) *authorizeTest {
@@ -109,6 +112,7 @@ func TestAuthority_authorizeToken(t *testing.T) {
 				token: "foo",
 				err:   errors.New("authority.authorizeToken: error parsing token"),
 				code:  http.StatusUnauthorized,
+				typ:   errs.TypeTokenInvalid,
 			}
 		},
 		"fail/prehistoric-token": func(t *testing.T) *authorizeTest {
@@ -152,6 +156,30 @@ func TestAuthority_authorizeToken(t *testing.T) {
 				code:  http.StatusUnauthorized,
 			}
 		},
+		"fail/provisioner-disabled": func(t *testing.T) *authorizeTest {
+			_a := testAuthority(t)
+			p, ok := _a.provisioners.LoadByName(validIssuer)
+			assert.Fatal(t, ok)
+			p.(*provisioner.JWK).Disabled = true
+
+			cl := jwt.Claims{
+				Subject:   "test.smallstep.com",
+				Issuer:    validIssuer,
+				NotBefore: jwt.NewNumericDate(now),
+				Expiry:    jwt.NewNumericDate(now.Add(time.Minute)),
+				Audience:  validAudience,
+				ID:        "44",
+			}
+			raw, err := jwt.Signed(sig).Claims(cl).CompactSerialize()
+			assert.FatalError(t, err)
+			return &authorizeTest{
+				auth:  _a,
+				token: raw,
+				err:   errors.New("authority.authorizeToken: provisioner step-cli is disabled"),
+				code:  http.StatusUnauthorized,
+				typ:   errs.TypeProvisionerDisabled,
+			}
+		},
 		"ok/simpledb": func(t *testing.T) *authorizeTest {
 			cl := jwt.Claims{
 				Subject:   "test.smallstep.com",
@@ -187,6 +215,7 @@ func TestAuthority_authorizeToken(t *testing.T) {
 				token: raw,
 				err:   errors.New("authority.authorizeToken: token already used"),
 				code:  http.StatusUnauthorized,
+				typ:   errs.TypeTokenReused,
 			}
 		},
 		"ok/mockNoSQLDB": func(t *testing.T) *authorizeTest {
@@ -235,6 +264,7 @@ func TestAuthority_authorizeToken(t *testing.T) {
 				token: raw,
 				err:   errors.New("authority.authorizeToken: failed when attempting to store token: force"),
 				code:  http.StatusInternalServerError,
+				typ:   errs.TypeDBUnavailable,
 			}
 		},
 		"fail/mockNoSQLDB/token-already-used": func(t *testing.T) *authorizeTest {
@@ -260,6 +290,7 @@ func TestAuthority_authorizeToken(t *testing.T) {
 				token: raw,
 				err:   errors.New("authority.authorizeToken: token already used"),
 				code:  http.StatusUnauthorized,
+				typ:   errs.TypeTokenReused,
 			}
 		},
 	}
@@ -275,6 +306,11 @@ func TestAuthority_authorizeToken(t *testing.T) {
 					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
 					assert.Equals(t, sc.StatusCode(), tc.code)
 					assert.HasPrefix(t, err.Error(), tc.err.Error())
+					if tc.typ != "" {
+						e, ok := err.(*errs.Error)
+						assert.Fatal(t, ok, "error is not an *errs.Error")
+						assert.Equals(t, tc.typ, e.Type)
+					}
 				}
 			} else {
 				if assert.Nil(t, tc.err) {
@@ -285,6 +321,80 @@ func TestAuthority_authorizeToken(t *testing.T) {
 	}
 }
 
+func TestAuthority_authorizeToken_rateLimit(t *testing.T) {
+	a := testAuthority(t)
+	a.rateLimiter = newRateLimiter(&RateLimitConfig{
+		Default: &ratelimit.Limit{RequestsPerSecond: 100, Burst: 100},
+		Provisioners: map[string]*ratelimit.Limit{
+			"Max": {RequestsPerSecond: 0.1, Burst: 2},
+		},
+	})
+
+	maxJWK, err := jose.ParseKey("testdata/secrets/max_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	cliJWK, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	// A forged token has the issuer and the kid of Max, both public, but it is
+	// signed with another key.
+	forgedJWK, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", maxJWK.KeyID, 0)
+	assert.FatalError(t, err)
+
+	authorize := func(t *testing.T, iss string, jwk *jose.JSONWebKey) error {
+		token, err := generateToken("test.smallstep.com", iss, testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), jwk)
+		assert.FatalError(t, err)
+		_, err = a.authorizeSign(context.Background(), token)
+		return err
+	}
+
+	// Forged tokens do not take tokens from the bucket of Max.
+	for i := 0; i < 5; i++ {
+		err := authorize(t, "Max", forgedJWK)
+		if assert.NotNil(t, err) {
+			assert.Equals(t, http.StatusUnauthorized, err.(*errs.Error).StatusCode())
+		}
+	}
+
+	// Max can only do two requests.
+	assert.FatalError(t, authorize(t, "Max", maxJWK))
+	assert.FatalError(t, authorize(t, "Max", maxJWK))
+	for _, jwk := range []*jose.JSONWebKey{maxJWK, forgedJWK} {
+		err = authorize(t, "Max", jwk)
+		if assert.NotNil(t, err) {
+			e, ok := err.(*errs.Error)
+			assert.Fatal(t, ok, "error is not an *errs.Error")
+			assert.Equals(t, http.StatusTooManyRequests, e.StatusCode())
+			assert.True(t, strings.Contains(e.Error(), "provisioner Max has exceeded its rate limit"), e.Error())
+			assert.True(t, e.RetryAfter > 0 && e.RetryAfter <= 10*time.Second)
+		}
+	}
+
+	// Other provisioners use the default limit.
+	for i := 0; i < 5; i++ {
+		assert.FatalError(t, authorize(t, "step-cli", cliJWK))
+	}
+}
+
+func Test_isTrustOnFirstUse(t *testing.T) {
+	tests := []struct {
+		name string
+		p    provisioner.Interface
+		want bool
+	}{
+		{"aws", &provisioner.AWS{}, true},
+		{"aws disabled", &provisioner.AWS{DisableTrustOnFirstUse: true}, false},
+		{"gcp", &provisioner.GCP{}, true},
+		{"gcp disabled", &provisioner.GCP{DisableTrustOnFirstUse: true}, false},
+		{"azure", &provisioner.Azure{}, true},
+		{"azure disabled", &provisioner.Azure{DisableTrustOnFirstUse: true}, false},
+		{"jwk", &provisioner.JWK{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, isTrustOnFirstUse(tt.p))
+		})
+	}
+}
+
 func TestAuthority_authorizeRevoke(t *testing.T) {
 	a := testAuthority(t)
 
@@ -389,6 +499,7 @@ func TestAuthority_authorizeSign(t *testing.T) {
 		token string
 		err   error
 		code  int
+		typ   string
 	}
 	tests := map[string]func(t *testing.T) *authorizeTest{
 		"fail/invalid-token": func(t *testing.T) *authorizeTest {
@@ -415,6 +526,26 @@ func TestAuthority_authorizeSign(t *testing.T) {
 				token: raw,
 				err:   errors.New("authority.authorizeSign: jwk.AuthorizeSign: jwk.authorizeToken; jwk token subject cannot be empty"),
 				code:  http.StatusUnauthorized,
+				typ:   errs.TypeTokenInvalid,
+			}
+		},
+		"fail/expired-token": func(t *testing.T) *authorizeTest {
+			cl := jwt.Claims{
+				Subject:   "test.smallstep.com",
+				Issuer:    validIssuer,
+				NotBefore: jwt.NewNumericDate(now.Add(-10 * time.Minute)),
+				Expiry:    jwt.NewNumericDate(now.Add(-5 * time.Minute)),
+				Audience:  validAudience,
+				ID:        "45",
+			}
+			raw, err := jwt.Signed(sig).Claims(cl).CompactSerialize()
+			assert.FatalError(t, err)
+			return &authorizeTest{
+				auth:  a,
+				token: raw,
+				err:   errors.New("authority.authorizeSign: jwk.AuthorizeSign: jwk.authorizeToken; invalid jwk claims"),
+				code:  http.StatusUnauthorized,
+				typ:   errs.TypeTokenExpired,
 			}
 		},
 		"ok": func(t *testing.T) *authorizeTest {
@@ -446,10 +577,15 @@ func TestAuthority_authorizeSign(t *testing.T) {
 					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
 					assert.Equals(t, sc.StatusCode(), tc.code)
 					assert.HasPrefix(t, err.Error(), tc.err.Error())
+					if tc.typ != "" {
+						e, ok := err.(*errs.Error)
+						assert.Fatal(t, ok, "error is not an *errs.Error")
+						assert.Equals(t, tc.typ, e.Type)
+					}
 				}
 			} else {
 				if assert.Nil(t, tc.err) {
-					assert.Len(t, 8, got)
+					assert.Len(t, 9, got)
 				}
 			}
 		})
@@ -597,7 +733,7 @@ func TestAuthority_Authorize(t *testing.T) {
 			sshSigner, err := ssh.NewSignerFromSigner(signer)
 			assert.FatalError(t, err)
 
-			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert}, sshSigner)
+			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"}}, sshSigner)
 			assert.FatalError(t, err)
 
 			p, ok := a.provisioners.Load("sshpop/sshpop")
@@ -667,7 +803,7 @@ func TestAuthority_Authorize(t *testing.T) {
 			sshSigner, err := ssh.NewSignerFromSigner(signer)
 			assert.FatalError(t, err)
 
-			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert}, sshSigner)
+			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"}}, sshSigner)
 			assert.FatalError(t, err)
 
 			p, ok := a.provisioners.Load("sshpop/sshpop")
@@ -968,6 +1104,73 @@ func TestAuthority_authorizeSSHSign(t *testing.T) {
 	}
 }
 
+func TestAuthority_authorizeSSHCheckHost(t *testing.T) {
+	a := testAuthority(t)
+
+	jwk, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", jwk.KeyID))
+	assert.FatalError(t, err)
+
+	now := time.Now().UTC()
+	validIssuer := "step-cli"
+	token := func(aud []string, id string, exp time.Time) string {
+		raw, err := jwt.Signed(sig).Claims(jwt.Claims{
+			Subject:   "test.smallstep.com",
+			Issuer:    validIssuer,
+			NotBefore: jwt.NewNumericDate(exp.Add(-5 * time.Minute)),
+			Expiry:    jwt.NewNumericDate(exp),
+			Audience:  aud,
+			ID:        id,
+		}).CompactSerialize()
+		assert.FatalError(t, err)
+		return raw
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"ok/sign", token(testAudiences.Sign, "1", now.Add(time.Minute)), nil},
+		{"ok/revoke", token(testAudiences.Revoke, "2", now.Add(time.Minute)), nil},
+		{"ok/sshRevoke", token(testAudiences.SSHRevoke, "3", now.Add(time.Minute)), nil},
+		{"fail/invalid-token", "foo", errors.New("authority.authorizeSSHCheckHost: authority.authorizeToken: error parsing token")},
+		{"fail/audience", token([]string{"https://example.com/foo"}, "4", now.Add(time.Minute)), errors.New("authority.authorizeSSHCheckHost: authority.authorizeToken: provisioner not found or invalid audience")},
+		{"fail/expired", token(testAudiences.Sign, "5", now.Add(-2*time.Minute)), errors.New("authority.authorizeSSHCheckHost: jwk.AuthorizeSign: jwk.authorizeToken; invalid jwk claims: square/go-jose/jwt: validation failed, token is expired")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.authorizeSSHCheckHost(context.Background(), tt.token)
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					sc, ok := err.(errs.StatusCoder)
+					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+					assert.Equals(t, http.StatusUnauthorized, sc.StatusCode())
+					assert.HasPrefix(t, err.Error(), tt.err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+
+	// The SSH sign token is not used by the check, it can still sign once.
+	raw, err := generateSimpleSSHUserToken(validIssuer, testAudiences.SSHSign[0], jwk)
+	assert.FatalError(t, err)
+	assert.FatalError(t, a.authorizeSSHCheckHost(context.Background(), raw))
+	assert.FatalError(t, a.authorizeSSHCheckHost(context.Background(), raw))
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SSHSignMethod)
+	_, err = a.Authorize(ctx, raw)
+	assert.FatalError(t, err)
+	_, err = a.Authorize(ctx, raw)
+	if assert.NotNil(t, err) {
+		assert.HasPrefix(t, err.Error(), "authority.Authorize: authority.authorizeSSHSign: authority.authorizeToken: token already used")
+	}
+}
+
 func TestAuthority_authorizeSSHRenew(t *testing.T) {
 	a := testAuthority(t)
 
@@ -1024,7 +1227,7 @@ func TestAuthority_authorizeSSHRenew(t *testing.T) {
 			sshSigner, err := ssh.NewSignerFromSigner(signer)
 			assert.FatalError(t, err)
 
-			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert}, sshSigner)
+			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"}}, sshSigner)
 			assert.FatalError(t, err)
 
 			p, ok := a.provisioners.Load("sshpop/sshpop")
@@ -1217,7 +1420,7 @@ func TestAuthority_authorizeSSHRekey(t *testing.T) {
 			sshSigner, err := ssh.NewSignerFromSigner(signer)
 			assert.FatalError(t, err)
 
-			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert}, sshSigner)
+			cert, _jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"}}, sshSigner)
 			assert.FatalError(t, err)
 
 			p, ok := a.provisioners.Load("sshpop/sshpop")
@@ -0,0 +1,159 @@
+package authority
+
+import (
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/nosql"
+)
+
+// DefaultCertificatesLimit is the default limit for listing certificates.
+const DefaultCertificatesLimit = 20
+
+// DefaultCertificatesMax is the maximum limit for listing certificates.
+const DefaultCertificatesMax = 100
+
+// CertificateStatus is the status of a stored certificate.
+type CertificateStatus string
+
+const (
+	// CertificateStatusValid is the status of the certificates that are not
+	// revoked or expired.
+	CertificateStatusValid CertificateStatus = "valid"
+	// CertificateStatusRevoked is the status of the revoked certificates.
+	CertificateStatusRevoked CertificateStatus = "revoked"
+	// CertificateStatusExpired is the status of the expired certificates that
+	// have not been revoked.
+	CertificateStatusExpired CertificateStatus = "expired"
+)
+
+// Validate returns an error if the status is not valid, revoked or expired.
+func (s CertificateStatus) Validate() error {
+	switch s {
+	case CertificateStatusValid, CertificateStatusRevoked, CertificateStatusExpired:
+		return nil
+	default:
+		return errs.BadRequest("certificate status %q is not supported", s)
+	}
+}
+
+// CertificateInfo is a certificate issued by the CA and its status. The
+// provisioner is nil if the certificate does not have the provisioner
+// extension, and the revocation is nil if it has not been revoked.
+type CertificateInfo struct {
+	Certificate *x509.Certificate
+	Status      CertificateStatus
+	Provisioner *provisioner.Extension
+	Revocation  *db.RevokedCertificateInfo
+}
+
+// GetCertificate returns the stored certificate with the given serial number
+// and its status.
+func (a *Authority) GetCertificate(serial string) (*CertificateInfo, error) {
+	opts := []interface{}{errs.WithKeyVal("serialNumber", serial)}
+	finder, err := a.certificateFinder()
+	if err != nil {
+		return nil, err
+	}
+	crt, err := finder.GetCertificate(serial)
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return nil, errs.NotFound("authority.GetCertificate; certificate %s not found", serial)
+		}
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.GetCertificate", opts...)
+	}
+	info, err := a.certificateInfo(finder, crt, time.Now())
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.GetCertificate", opts...)
+	}
+	return info, nil
+}
+
+// GetCertificatesBySAN returns the stored certificates with the given subject
+// alternative name, sorted by serial number. If the status is not empty only
+// the certificates with that status are returned. The cursor is the serial
+// number of the first certificate to return, and the next cursor is empty
+// when there are no more certificates.
+func (a *Authority) GetCertificatesBySAN(san string, status CertificateStatus, cursor string, limit int) ([]*CertificateInfo, string, error) {
+	opts := []interface{}{errs.WithKeyVal("san", san)}
+	if san == "" {
+		return nil, "", errs.BadRequest("authority.GetCertificatesBySAN; san cannot be empty")
+	}
+	if status != "" {
+		if err := status.Validate(); err != nil {
+			return nil, "", err
+		}
+	}
+	switch {
+	case limit <= 0:
+		limit = DefaultCertificatesLimit
+	case limit > DefaultCertificatesMax:
+		limit = DefaultCertificatesMax
+	}
+
+	finder, err := a.certificateFinder()
+	if err != nil {
+		return nil, "", err
+	}
+	crts, err := finder.GetCertificatesBySAN(san)
+	if err != nil {
+		return nil, "", errs.Wrap(http.StatusInternalServerError, err, "authority.GetCertificatesBySAN", opts...)
+	}
+
+	now := time.Now()
+	infos := []*CertificateInfo{}
+	for _, crt := range crts {
+		serial := crt.SerialNumber.String()
+		if serial < cursor {
+			continue
+		}
+		info, err := a.certificateInfo(finder, crt, now)
+		if err != nil {
+			return nil, "", errs.Wrap(http.StatusInternalServerError, err, "authority.GetCertificatesBySAN", opts...)
+		}
+		if status != "" && info.Status != status {
+			continue
+		}
+		if len(infos) == limit {
+			return infos, serial, nil
+		}
+		infos = append(infos, info)
+	}
+	return infos, "", nil
+}
+
+// certificateFinder returns the database used to look up the certificates.
+func (a *Authority) certificateFinder() (db.CertificateFinder, error) {
+	finder, ok := a.db.(db.CertificateFinder)
+	if !ok {
+		return nil, errs.NotImplemented("authority.certificateFinder; the database does not support certificate lookups")
+	}
+	return finder, nil
+}
+
+// certificateInfo returns the status of a stored certificate at the given
+// time.
+func (a *Authority) certificateInfo(finder db.CertificateFinder, crt *x509.Certificate, now time.Time) (*CertificateInfo, error) {
+	info := &CertificateInfo{
+		Certificate: crt,
+		Status:      CertificateStatusValid,
+	}
+	if p, ok := provisioner.GetExtension(crt); ok {
+		info.Provisioner = p
+	}
+	rci, err := finder.GetRevokedCertificate(crt.SerialNumber.String())
+	switch {
+	case err == nil:
+		info.Status = CertificateStatusRevoked
+		info.Revocation = rci
+	case !nosql.IsErrNotFound(err):
+		return nil, err
+	case now.After(crt.NotAfter):
+		info.Status = CertificateStatusExpired
+	}
+	return info, nil
+}
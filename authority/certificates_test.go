@@ -0,0 +1,141 @@
+package authority
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/keys"
+	"github.com/smallstep/cli/jose"
+)
+
+func TestAuthority_GetCertificate(t *testing.T) {
+	_, priv, err := keys.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	key, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+
+	a := testAuthority(t)
+	sign := func(sans ...string) *x509.Certificate {
+		t.Helper()
+		token, err := generateToken("smallstep test", "step-cli", testAudiences.Sign[0], sans, time.Now(), key)
+		assert.FatalError(t, err)
+		signOpts, err := a.AuthorizeSign(token)
+		assert.FatalError(t, err)
+		csr := getCSR(t, priv, func(csr *x509.CertificateRequest) {
+			csr.DNSNames = sans[:1]
+			csr.IPAddresses = []net.IP{net.ParseIP(sans[1])}
+		})
+		certs, err := a.Sign(csr, provisioner.Options{}, signOpts...)
+		assert.FatalError(t, err)
+		return certs[0]
+	}
+	crt1 := sign("Test.Smallstep.com", "10.0.0.1")
+	crt2 := sign("test.smallstep.com", "10.0.0.1")
+	other := sign("other.smallstep.com", "::ffff:10.0.0.2")
+	first, second := crt1, crt2
+	if first.SerialNumber.String() > second.SerialNumber.String() {
+		first, second = second, first
+	}
+	serials := func(infos []*CertificateInfo) []string {
+		s := make([]string, len(infos))
+		for i, info := range infos {
+			s[i] = info.Certificate.SerialNumber.String()
+		}
+		return s
+	}
+
+	t.Run("ok/serial", func(t *testing.T) {
+		info, err := a.GetCertificate(crt1.SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.Equals(t, crt1.Raw, info.Certificate.Raw)
+		assert.Equals(t, CertificateStatusValid, info.Status)
+		assert.Equals(t, provisioner.TypeJWK, info.Provisioner.Type)
+		assert.Equals(t, "step-cli", info.Provisioner.Name)
+		assert.Nil(t, info.Revocation)
+	})
+
+	t.Run("ok/san", func(t *testing.T) {
+		for _, san := range []string{"test.smallstep.com", "TEST.smallstep.com.", "10.0.0.1"} {
+			infos, next, err := a.GetCertificatesBySAN(san, "", "", 0)
+			assert.FatalError(t, err)
+			assert.Equals(t, []string{first.SerialNumber.String(), second.SerialNumber.String()}, serials(infos))
+			assert.Equals(t, "", next)
+		}
+		infos, _, err := a.GetCertificatesBySAN("10.0.0.2", "", "", 0)
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{other.SerialNumber.String()}, serials(infos))
+		infos, _, err = a.GetCertificatesBySAN("missing.smallstep.com", "", "", 0)
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{}, serials(infos))
+	})
+
+	t.Run("ok/pagination", func(t *testing.T) {
+		infos, next, err := a.GetCertificatesBySAN("test.smallstep.com", "", "", 1)
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{first.SerialNumber.String()}, serials(infos))
+		assert.Equals(t, second.SerialNumber.String(), next)
+		infos, next, err = a.GetCertificatesBySAN("test.smallstep.com", "", next, 1)
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{second.SerialNumber.String()}, serials(infos))
+		assert.Equals(t, "", next)
+	})
+
+	t.Run("ok/revoked", func(t *testing.T) {
+		assert.FatalError(t, a.Revoke(context.Background(), &RevokeOptions{
+			Serial: crt1.SerialNumber.String(),
+			Reason: "key compromise",
+			MTLS:   true,
+			Crt:    crt1,
+		}))
+		info, err := a.GetCertificate(crt1.SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.Equals(t, CertificateStatusRevoked, info.Status)
+		assert.Equals(t, "key compromise", info.Revocation.Reason)
+
+		infos, _, err := a.GetCertificatesBySAN("test.smallstep.com", CertificateStatusValid, "", 0)
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{crt2.SerialNumber.String()}, serials(infos))
+		infos, _, err = a.GetCertificatesBySAN("test.smallstep.com", CertificateStatusRevoked, "", 0)
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{crt1.SerialNumber.String()}, serials(infos))
+		infos, _, err = a.GetCertificatesBySAN("test.smallstep.com", CertificateStatusExpired, "", 0)
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{}, serials(infos))
+	})
+
+	t.Run("ok/expired", func(t *testing.T) {
+		info, err := a.certificateInfo(a.db.(db.CertificateFinder), crt2, crt2.NotAfter.Add(time.Second))
+		assert.FatalError(t, err)
+		assert.Equals(t, CertificateStatusExpired, info.Status)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		code := func(err error) int {
+			t.Helper()
+			e, ok := err.(*errs.Error)
+			assert.Fatal(t, ok, "error type %T is not *errs.Error", err)
+			return e.StatusCode()
+		}
+		_, err := a.GetCertificate("1234")
+		assert.Equals(t, http.StatusNotFound, code(err))
+		_, _, err = a.GetCertificatesBySAN("", "", "", 0)
+		assert.Equals(t, http.StatusBadRequest, code(err))
+		_, _, err = a.GetCertificatesBySAN("test.smallstep.com", "foo", "", 0)
+		assert.Equals(t, http.StatusBadRequest, code(err))
+
+		// The database does not support lookups.
+		_a := testAuthority(t, WithDatabase(&db.SimpleDB{}))
+		_, err = _a.GetCertificate(crt1.SerialNumber.String())
+		assert.Equals(t, http.StatusNotImplemented, code(err))
+		_, _, err = _a.GetCertificatesBySAN("test.smallstep.com", "", "", 0)
+		assert.Equals(t, http.StatusNotImplemented, code(err))
+	})
+}
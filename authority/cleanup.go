@@ -0,0 +1,128 @@
+package authority
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+)
+
+// DefaultCleanupInterval is the default time between the deletions of the
+// expired entries of the database.
+const DefaultCleanupInterval = time.Hour
+
+// DefaultCleanupBatchSize is the default number of expired entries deleted in
+// each transaction.
+const DefaultCleanupBatchSize = 1000
+
+// CleanupConfig is the configuration of the deletion of the expired used
+// tokens and ACME nonces. The entries are deleted some time after the
+// expiration stored in them, never based on the time they were stored, see
+// db.ExpiryLeeway.
+//
+// The same interval and batch size are used to delete the ACME orders,
+// authorizations, challenges and certificates, which are kept for
+// ACMERetention after they expire.
+type CleanupConfig struct {
+	// Disabled disables the deletion of the expired entries.
+	Disabled bool `json:"disabled,omitempty"`
+	// Interval is the time between deletions, 1h by default.
+	Interval *provisioner.Duration `json:"interval,omitempty"`
+	// BatchSize is the number of entries deleted in each transaction, 1000 by
+	// default.
+	BatchSize int `json:"batchSize,omitempty"`
+	// ACMERetention is the time the expired ACME objects are kept before they
+	// are deleted, 168h by default.
+	ACMERetention *provisioner.Duration `json:"acmeRetention,omitempty"`
+}
+
+// Validate validates the cleanup configuration, nil is ok.
+func (c *CleanupConfig) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case c.Interval != nil && c.Interval.Duration <= 0:
+		return errors.New("authority.cleanup.interval must be greater than 0")
+	case c.BatchSize < 0:
+		return errors.New("authority.cleanup.batchSize cannot be less than 0")
+	case c.ACMERetention != nil && c.ACMERetention.Duration <= 0:
+		return errors.New("authority.cleanup.acmeRetention must be greater than 0")
+	default:
+		return nil
+	}
+}
+
+func (c *CleanupConfig) interval() time.Duration {
+	if c == nil || c.Interval == nil {
+		return DefaultCleanupInterval
+	}
+	return c.Interval.Duration
+}
+
+func (c *CleanupConfig) batchSize() int {
+	if c == nil || c.BatchSize == 0 {
+		return DefaultCleanupBatchSize
+	}
+	return c.BatchSize
+}
+
+// CleanupMeter is implemented by the meters that report the expired entries
+// deleted from the database.
+type CleanupMeter interface {
+	ExpiredEntriesDeleted(table string, n int)
+}
+
+// startCleanup starts the deletion of the expired entries of the database, on
+// start and after every interval. The databases with native expiration only
+// need the first one, for the entries stored by previous versions.
+func (a *Authority) startCleanup() {
+	cleaner, ok := a.db.(db.Cleaner)
+	if !ok {
+		return
+	}
+	var c *CleanupConfig
+	if a.config.AuthorityConfig != nil {
+		c = a.config.AuthorityConfig.Cleanup
+	}
+	if c != nil && c.Disabled {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	a.stopCleanup = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(c.interval())
+		defer ticker.Stop()
+		for {
+			if err := a.cleanup(ctx, cleaner, c.batchSize()); err != nil && ctx.Err() == nil {
+				log.Printf("error deleting expired entries: %v", err)
+			}
+			if cleaner.NativeTTL() {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// cleanup deletes the expired entries of the database once.
+func (a *Authority) cleanup(ctx context.Context, cleaner db.Cleaner, batchSize int) error {
+	m, _ := a.meter.(CleanupMeter)
+	return cleaner.DeleteExpired(ctx, time.Now(), batchSize, func(table string, n int) {
+		if m != nil {
+			m.ExpiredEntriesDeleted(table, n)
+		}
+	})
+}
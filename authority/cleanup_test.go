@@ -0,0 +1,118 @@
+package authority
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/cli/jose"
+)
+
+type cleanupMeter struct {
+	mu      sync.Mutex
+	deleted map[string]int
+}
+
+func (m *cleanupMeter) TokenValidationFailed(reason string) {}
+
+func (m *cleanupMeter) ExpiredEntriesDeleted(table string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted[table] += n
+}
+
+func (m *cleanupMeter) count(table string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleted[table]
+}
+
+func TestCleanupConfig_Validate(t *testing.T) {
+	tests := map[string]struct {
+		config  *CleanupConfig
+		wantErr bool
+	}{
+		"ok/nil":             {nil, false},
+		"ok/empty":           {&CleanupConfig{}, false},
+		"ok":                 {&CleanupConfig{Interval: &provisioner.Duration{Duration: time.Minute}, BatchSize: 10}, false},
+		"ok/disabled":        {&CleanupConfig{Disabled: true}, false},
+		"fail/interval":      {&CleanupConfig{Interval: &provisioner.Duration{}}, true},
+		"ok/acmeRetention":   {&CleanupConfig{ACMERetention: &provisioner.Duration{Duration: time.Hour}}, false},
+		"fail/batchSize":     {&CleanupConfig{BatchSize: -1}, true},
+		"fail/acmeRetention": {&CleanupConfig{ACMERetention: &provisioner.Duration{Duration: -time.Hour}}, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tt.config.Validate()
+			assert.Equals(t, tt.wantErr, err != nil)
+		})
+	}
+	assert.Equals(t, DefaultCleanupInterval, (*CleanupConfig)(nil).interval())
+	assert.Equals(t, DefaultCleanupBatchSize, (*CleanupConfig)(nil).batchSize())
+}
+
+func TestAuthority_cleanup(t *testing.T) {
+	key, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+
+	meter := &cleanupMeter{deleted: map[string]int{}}
+	a := testAuthority(t, WithMeter(meter))
+	// Restart the cleanup with a short interval.
+	a.CloseForReload()
+	a.config.AuthorityConfig.Cleanup = &CleanupConfig{
+		Interval:  &provisioner.Duration{Duration: 10 * time.Millisecond},
+		BatchSize: 1,
+	}
+	a.startCleanup()
+	defer a.CloseForReload()
+
+	// A token used now is kept until it expires.
+	valid, err := generateToken("smallstep test", "step-cli", testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), key)
+	assert.FatalError(t, err)
+	_, err = a.AuthorizeSign(valid)
+	assert.FatalError(t, err)
+
+	// Short-lived tokens that expired before the leeway.
+	iat := time.Now().Add(-5*time.Minute - db.ExpiryLeeway - time.Minute)
+	rdb := a.db.(*db.DB)
+	for i := 0; i < 3; i++ {
+		tok, err := generateToken("smallstep test", "step-cli", testAudiences.Sign[0], nil, iat, key)
+		assert.FatalError(t, err)
+		ok, err := rdb.UseToken(tok, tok)
+		assert.FatalError(t, err)
+		assert.True(t, ok)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for meter.count("used_ott") < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired tokens deleted = %d, want 3", meter.count("used_ott"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, err := rdb.List([]byte("used_ott"))
+	assert.FatalError(t, err)
+	assert.Len(t, 1, entries)
+	assert.Equals(t, valid, string(entries[0].Value))
+
+	// The token is still rejected after the cleanup.
+	_, err = a.AuthorizeSign(valid)
+	assert.NotNil(t, err)
+
+	t.Run("disabled", func(t *testing.T) {
+		a := testAuthority(t)
+		a.CloseForReload()
+		a.stopCleanup = nil
+		a.config.AuthorityConfig.Cleanup = &CleanupConfig{Disabled: true}
+		a.startCleanup()
+		assert.Nil(t, a.stopCleanup)
+	})
+
+	t.Run("not-supported", func(t *testing.T) {
+		a := testAuthority(t, WithDatabase(&db.SimpleDB{}))
+		assert.Nil(t, a.stopCleanup)
+	})
+}
@@ -4,14 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	kms "github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/metrics"
+	"github.com/smallstep/certificates/ratelimit"
 	"github.com/smallstep/certificates/templates"
+	"github.com/smallstep/certificates/tracing"
 	"github.com/smallstep/cli/crypto/tlsutil"
 	"github.com/smallstep/cli/crypto/x509util"
 )
@@ -51,19 +56,40 @@ var (
 type Config struct {
 	Root             multiString          `json:"root"`
 	FederatedRoots   []string             `json:"federatedRoots"`
+	FederatedSSHKeys *FederatedSSHKeys    `json:"federatedSSHKeys,omitempty"`
 	IntermediateCert string               `json:"crt"`
 	IntermediateKey  string               `json:"key"`
+	ServerCert       string               `json:"serverCrt,omitempty"`
+	ServerKey        string               `json:"serverKey,omitempty"`
 	Address          string               `json:"address"`
+	InsecureAddress  string               `json:"insecureAddress,omitempty"`
 	DNSNames         []string             `json:"dnsNames"`
 	KMS              *kms.Options         `json:"kms,omitempty"`
 	SSH              *SSHConfig           `json:"ssh,omitempty"`
 	Logger           json.RawMessage      `json:"logger,omitempty"`
 	DB               *db.Config           `json:"db,omitempty"`
 	Monitoring       json.RawMessage      `json:"monitoring,omitempty"`
+	Metrics          *metrics.Config      `json:"metrics,omitempty"`
+	Tracing          *tracing.Config      `json:"tracing,omitempty"`
 	AuthorityConfig  *AuthConfig          `json:"authority,omitempty"`
 	TLS              *tlsutil.TLSOptions  `json:"tls,omitempty"`
+	TLSOptions       *TLSOptions          `json:"tlsOptions,omitempty"`
 	Password         string               `json:"password,omitempty"`
 	Templates        *templates.Templates `json:"templates,omitempty"`
+	// DisableVersionHeader disables the header with the version of step-ca in
+	// the HTTP responses.
+	DisableVersionHeader bool `json:"disableVersionHeader,omitempty"`
+	// ShutdownTimeout is the time the active requests have to finish when the
+	// CA is stopped, 60s by default.
+	ShutdownTimeout *provisioner.Duration `json:"shutdownTimeout,omitempty"`
+	CORS            *CORSConfig           `json:"cors,omitempty"`
+	BodyLimits      *BodyLimitsConfig     `json:"bodyLimits,omitempty"`
+	Server          *ServerConfig         `json:"server,omitempty"`
+	// ExternalURL is the URL of the CA for the clients when it is behind a
+	// proxy, with the host and the optional path where the proxy serves the
+	// CA, e.g. https://pki.example.com/step. It is used in the ACME links and
+	// in the templates.
+	ExternalURL string `json:"externalURL,omitempty"`
 }
 
 // AuthConfig represents the configuration options for the authority.
@@ -73,6 +99,251 @@ type AuthConfig struct {
 	Claims               *provisioner.Claims   `json:"claims,omitempty"`
 	DisableIssuedAtCheck bool                  `json:"disableIssuedAtCheck,omitempty"`
 	Backdate             *provisioner.Duration `json:"backdate,omitempty"`
+	RateLimit            *RateLimitConfig      `json:"rateLimit,omitempty"`
+	// RenewGracePeriod is the time after the expiration of a certificate in
+	// which it can still be renewed using mTLS. By default expired
+	// certificates cannot be renewed.
+	RenewGracePeriod *provisioner.Duration `json:"renewGracePeriod,omitempty"`
+	// SuperAdmin is the admin added to the database on the first start, when
+	// there are no admins registered.
+	SuperAdmin *AdminConfig `json:"superAdmin,omitempty"`
+	// Cleanup is the configuration of the deletion of the expired used tokens
+	// and ACME nonces.
+	Cleanup *CleanupConfig `json:"cleanup,omitempty"`
+	// X509 are the default x509 template options of the provisioners. Their
+	// template, inline or in a file, is used by the provisioners without a
+	// template of their own.
+	X509 *provisioner.X509Options `json:"x509,omitempty"`
+	// X509Policy and SSHPolicy are the policies of the authority, the outer
+	// boundary of the policies of the provisioners. A name must be allowed by
+	// the authority policy and by the policy of the provisioner.
+	X509Policy *provisioner.X509Policy `json:"x509Policy,omitempty"`
+	SSHPolicy  *provisioner.SSHPolicy  `json:"sshPolicy,omitempty"`
+}
+
+// RateLimitConfig is the configuration of the rate limits of the CA.
+type RateLimitConfig struct {
+	// Default is the limit of the provisioners without a limit.
+	Default *ratelimit.Limit `json:"default,omitempty"`
+	// Provisioners are the limits of the provisioners by name.
+	Provisioners map[string]*ratelimit.Limit `json:"provisioners,omitempty"`
+	// Unauthenticated is the limit by client IP of the endpoints that do not
+	// require a token, like health or roots.
+	Unauthenticated *ratelimit.Limit `json:"unauthenticated,omitempty"`
+	// Concurrency is the limit of sign and renew requests running at the same
+	// time.
+	Concurrency *ConcurrencyLimitConfig `json:"concurrency,omitempty"`
+}
+
+// ConcurrencyLimitConfig is the configuration of the limit of sign and renew
+// requests in flight. The requests over the limit wait in a queue, and when
+// the queue is full or they have waited for QueueTimeout, they get a 503
+// response with a Retry-After header.
+type ConcurrencyLimitConfig struct {
+	MaxInFlight  int                   `json:"maxInFlight"`
+	MaxQueued    int                   `json:"maxQueued,omitempty"`
+	QueueTimeout *provisioner.Duration `json:"queueTimeout,omitempty"`
+	RetryAfter   *provisioner.Duration `json:"retryAfter,omitempty"`
+}
+
+// Validate validates the concurrency limit configuration, nil is ok.
+func (c *ConcurrencyLimitConfig) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case c.MaxInFlight < 1:
+		return errors.New("maxInFlight must be greater than 0")
+	case c.MaxQueued < 0:
+		return errors.New("maxQueued cannot be less than 0")
+	case c.QueueTimeout != nil && c.QueueTimeout.Duration < 0:
+		return errors.New("queueTimeout cannot be less than 0")
+	case c.RetryAfter != nil && c.RetryAfter.Duration < 0:
+		return errors.New("retryAfter cannot be less than 0")
+	default:
+		return nil
+	}
+}
+
+// Validate validates the rate limits configuration, nil is ok.
+func (c *RateLimitConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if err := c.Default.Validate(); err != nil {
+		return errors.Wrap(err, "authority.rateLimit.default")
+	}
+	for name, l := range c.Provisioners {
+		if l == nil {
+			return errors.Errorf("authority.rateLimit.provisioners.%s cannot be empty", name)
+		}
+		if err := l.Validate(); err != nil {
+			return errors.Wrapf(err, "authority.rateLimit.provisioners.%s", name)
+		}
+	}
+	if err := c.Unauthenticated.Validate(); err != nil {
+		return errors.Wrap(err, "authority.rateLimit.unauthenticated")
+	}
+	if err := c.Concurrency.Validate(); err != nil {
+		return errors.Wrap(err, "authority.rateLimit.concurrency")
+	}
+	return nil
+}
+
+// AdminConfig is the configuration of the super-admin created on the first
+// start of the CA.
+type AdminConfig struct {
+	// Subject is the subject of the tokens of the admin, or the common name
+	// of the certificate used to sign them.
+	Subject string `json:"subject"`
+	// Provisioner is the name of the provisioner that generates the tokens
+	// of the admin, or that issued its certificate.
+	Provisioner string `json:"provisioner"`
+}
+
+// Validate validates the super-admin configuration, nil is ok.
+func (c *AdminConfig) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case c.Subject == "":
+		return errors.New("authority.superAdmin.subject cannot be empty")
+	case c.Provisioner == "":
+		return errors.New("authority.superAdmin.provisioner cannot be empty")
+	default:
+		return nil
+	}
+}
+
+// CORSConfig is the configuration of the CORS headers added to the responses
+// of the CA API, it allows browser based clients to call the API.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed, e.g. https://ca.example.com, a
+	// wildcard in the first label matches any subdomain, e.g.
+	// https://*.example.com, and "*" matches any origin.
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// AllowedMethods are the methods allowed, GET, HEAD and POST by default.
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+	// AllowedHeaders are the request headers allowed, Content-Type by default.
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	// MaxAge is the time the results of a preflight request can be cached.
+	MaxAge *provisioner.Duration `json:"maxAge,omitempty"`
+	// AllowCredentials allows requests with credentials, like cookies or
+	// client certificates.
+	AllowCredentials bool `json:"allowCredentials,omitempty"`
+	// Endpoints are the endpoints that allow CORS requests besides the read
+	// only endpoints, e.g. /sign.
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// Validate validates the CORS configuration, nil is ok.
+func (c *CORSConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return errors.New("cors.allowedOrigins cannot be empty")
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return errors.New("cors.allowedOrigins cannot be * if cors.allowCredentials is true")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" ||
+			strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return errors.Errorf("cors.allowedOrigins: %s is not a valid origin", o)
+		}
+	}
+	for _, m := range c.AllowedMethods {
+		if m == "" || strings.ContainsAny(m, " ,") {
+			return errors.Errorf("cors.allowedMethods: %s is not a valid method", m)
+		}
+	}
+	for _, h := range c.AllowedHeaders {
+		if h == "" || strings.ContainsAny(h, " ,") {
+			return errors.Errorf("cors.allowedHeaders: %s is not a valid header", h)
+		}
+	}
+	if c.MaxAge != nil && c.MaxAge.Duration < 0 {
+		return errors.New("cors.maxAge cannot be less than 0")
+	}
+	for _, e := range c.Endpoints {
+		if !strings.HasPrefix(e, "/") {
+			return errors.Errorf("cors.endpoints: %s is not a valid endpoint", e)
+		}
+	}
+	return nil
+}
+
+// BodyLimitsConfig is the configuration of the maximum size in bytes of the
+// bodies of the requests to the CA.
+type BodyLimitsConfig struct {
+	// Default is the limit of the endpoints not in Endpoints, 1MiB by default.
+	Default int64 `json:"default,omitempty"`
+	// Endpoints are the limits by endpoint, e.g. /sign, /acme/{provisionerID}/new-order
+	// or /scep/{provisionerID}. They replace the built-in limits of /revoke,
+	// /ssh/revoke and /scep/{provisionerID}.
+	Endpoints map[string]int64 `json:"endpoints,omitempty"`
+}
+
+// Validate validates the body limits configuration, nil is ok.
+func (c *BodyLimitsConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Default < 0 {
+		return errors.New("bodyLimits.default cannot be less than 0")
+	}
+	for e, n := range c.Endpoints {
+		if !strings.HasPrefix(e, "/") {
+			return errors.Errorf("bodyLimits.endpoints: %s is not a valid endpoint", e)
+		}
+		if n <= 0 {
+			return errors.Errorf("bodyLimits.endpoints: %s limit must be greater than 0", e)
+		}
+	}
+	return nil
+}
+
+// ServerConfig is the configuration of the timeouts and limits of the HTTP
+// servers of the CA. The options not set use the defaults of the server
+// package.
+type ServerConfig struct {
+	ReadTimeout       *provisioner.Duration `json:"readTimeout,omitempty"`
+	ReadHeaderTimeout *provisioner.Duration `json:"readHeaderTimeout,omitempty"`
+	WriteTimeout      *provisioner.Duration `json:"writeTimeout,omitempty"`
+	IdleTimeout       *provisioner.Duration `json:"idleTimeout,omitempty"`
+	MaxHeaderBytes    int                   `json:"maxHeaderBytes,omitempty"`
+	// DisableHTTP2 disables HTTP/2 on the TLS connections.
+	DisableHTTP2 bool `json:"disableHTTP2,omitempty"`
+	// TCPKeepAlivePeriod is the period of the TCP keep-alive probes, a 0
+	// duration disables them.
+	TCPKeepAlivePeriod *provisioner.Duration `json:"tcpKeepAlivePeriod,omitempty"`
+}
+
+// Validate validates the server configuration, nil is ok.
+func (c *ServerConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for name, d := range map[string]*provisioner.Duration{
+		"readTimeout":        c.ReadTimeout,
+		"readHeaderTimeout":  c.ReadHeaderTimeout,
+		"writeTimeout":       c.WriteTimeout,
+		"idleTimeout":        c.IdleTimeout,
+		"tcpKeepAlivePeriod": c.TCPKeepAlivePeriod,
+	} {
+		if d != nil && d.Duration < 0 {
+			return errors.Errorf("server.%s cannot be less than 0", name)
+		}
+	}
+	if c.MaxHeaderBytes < 0 {
+		return errors.New("server.maxHeaderBytes cannot be less than 0")
+	}
+	return nil
 }
 
 // Validate validates the authority configuration.
@@ -106,7 +377,34 @@ func (c *AuthConfig) Validate(audiences provisioner.Audiences) error {
 		}
 	}
 
-	return nil
+	if c.RenewGracePeriod != nil && c.RenewGracePeriod.Duration < 0 {
+		return errors.New("authority.renewGracePeriod cannot be less than 0")
+	}
+
+	// Validate super-admin: nil is ok
+	if err := c.SuperAdmin.Validate(); err != nil {
+		return err
+	}
+
+	// Validate cleanup: nil is ok
+	if err := c.Cleanup.Validate(); err != nil {
+		return err
+	}
+
+	// Parse the default x509 template: nil is ok
+	if err := c.X509.InitDefault(); err != nil {
+		return err
+	}
+
+	// Validate the authority policies: nil is ok
+	if err := c.X509Policy.InitAuthority(); err != nil {
+		return err
+	}
+	if err := c.SSHPolicy.InitAuthority(); err != nil {
+		return err
+	}
+
+	return c.RateLimit.Validate()
 }
 
 // LoadConfiguration parses the given filename in JSON format and returns the
@@ -163,6 +461,18 @@ func (c *Config) Validate() error {
 		return errors.Errorf("invalid address %s", c.Address)
 	}
 
+	// Validate the server certificate (both files or neither are required)
+	if (c.ServerCert == "") != (c.ServerKey == "") {
+		return errors.New("serverCrt and serverKey must be both set or empty")
+	}
+
+	// Validate insecure address (a port is required)
+	if c.InsecureAddress != "" {
+		if _, _, err := net.SplitHostPort(c.InsecureAddress); err != nil {
+			return errors.Errorf("invalid insecureAddress %s", c.InsecureAddress)
+		}
+	}
+
 	if c.TLS == nil {
 		c.TLS = &DefaultTLSOptions
 	} else {
@@ -175,30 +485,111 @@ func (c *Config) Validate() error {
 		if c.TLS.MinVersion == 0 {
 			c.TLS.MinVersion = c.TLS.MaxVersion
 		}
+		if err := c.TLS.MinVersion.Validate(); err != nil {
+			return errors.Errorf("tls minVersion %v is not supported", float64(c.TLS.MinVersion))
+		}
+		if err := c.TLS.MaxVersion.Validate(); err != nil {
+			return errors.Errorf("tls maxVersion %v is not supported", float64(c.TLS.MaxVersion))
+		}
 		if c.TLS.MinVersion > c.TLS.MaxVersion {
 			return errors.New("tls minVersion cannot exceed tls maxVersion")
 		}
+		if err := c.TLS.CipherSuites.Validate(); err != nil {
+			return errors.Wrap(err, "tls cipherSuites")
+		}
 		c.TLS.Renegotiation = c.TLS.Renegotiation || DefaultTLSOptions.Renegotiation
 	}
 
+	if err := c.TLSOptions.Validate(); err != nil {
+		return err
+	}
+
 	// Validate KMS options, nil is ok.
 	if err := c.KMS.Validate(); err != nil {
 		return err
 	}
 
+	// Validate db options, nil is ok.
+	if err := c.DB.Validate(); err != nil {
+		return err
+	}
+
 	// Validate ssh: nil is ok
 	if err := c.SSH.Validate(); err != nil {
 		return err
 	}
 
+	// Validate federated ssh keys: nil is ok
+	if err := c.FederatedSSHKeys.Validate(); err != nil {
+		return err
+	}
+
 	// Validate templates: nil is ok
 	if err := c.Templates.Validate(); err != nil {
 		return err
 	}
 
+	if c.ExternalURL != "" {
+		u, err := url.Parse(c.ExternalURL)
+		switch {
+		case err != nil:
+			return errors.Wrap(err, "error parsing externalURL")
+		case u.Scheme != "https" || u.Host == "":
+			return errors.Errorf("externalURL %s must be an https url", c.ExternalURL)
+		case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+			return errors.Errorf("externalURL %s cannot have user info, query or fragment", c.ExternalURL)
+		}
+	}
+
+	if c.ShutdownTimeout != nil && c.ShutdownTimeout.Duration < 0 {
+		return errors.New("shutdownTimeout cannot be less than 0")
+	}
+
+	// Validate metrics: nil is ok
+	if err := c.Metrics.Validate(); err != nil {
+		return err
+	}
+
+	// Validate tracing: nil is ok
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+
+	// Validate CORS: nil is ok
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+
+	// Validate body limits: nil is ok
+	if err := c.BodyLimits.Validate(); err != nil {
+		return err
+	}
+
+	// Validate server options: nil is ok
+	if err := c.Server.Validate(); err != nil {
+		return err
+	}
+
 	return c.AuthorityConfig.Validate(c.getAudiences())
 }
 
+// caURL returns the URL of the CA with the first DNS name and the port of the
+// address, the port is omitted if it is 443. If the externalURL is set, it is
+// returned instead.
+func (c *Config) caURL() string {
+	if c.ExternalURL != "" {
+		return strings.TrimSuffix(c.ExternalURL, "/")
+	}
+	if len(c.DNSNames) == 0 {
+		return ""
+	}
+	host := c.DNSNames[0]
+	if _, port, err := net.SplitHostPort(c.Address); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	return "https://" + host
+}
+
 // getAudiences returns the legacy and possible urls without the ports that will
 // be used as the default provisioner audiences. The CA might have proxies in
 // front so we cannot rely on the port.
@@ -209,6 +600,7 @@ func (c *Config) getAudiences() provisioner.Audiences {
 		SSHSign:   []string{},
 		SSHRevoke: []string{},
 		SSHRenew:  []string{},
+		Admin:     []string{},
 	}
 
 	for _, name := range c.DNSNames {
@@ -234,6 +626,8 @@ func (c *Config) getAudiences() provisioner.Audiences {
 		audiences.SSHRekey = append(audiences.SSHRekey,
 			fmt.Sprintf("https://%s/1.0/ssh/rekey", name),
 			fmt.Sprintf("https://%s/ssh/rekey", name))
+		audiences.Admin = append(audiences.Admin,
+			fmt.Sprintf("https://%s/admin", name))
 	}
 
 	return audiences
@@ -3,6 +3,7 @@ package authority
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
@@ -197,6 +198,180 @@ func TestConfigValidate(t *testing.T) {
 				err: errors.New("tls minVersion cannot exceed tls maxVersion"),
 			}
 		},
+		"tls-invalid-cipher-suite": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					TLS: &tlsutil.TLSOptions{
+						CipherSuites: x509util.CipherSuites{
+							"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+							"TLS_FOO_WITH_BAR",
+						},
+						MinVersion: 1.2,
+						MaxVersion: 1.2,
+					},
+				},
+				err: errors.New("tls cipherSuites: TLS_FOO_WITH_BAR is not a valid cipher suite"),
+			}
+		},
+		"server-crt-without-key": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					ServerCert:       "testdata/secrets/server.crt",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+				},
+				err: errors.New("serverCrt and serverKey must be both set or empty"),
+			}
+		},
+		"tls-invalid-min-version": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					TLS: &tlsutil.TLSOptions{
+						CipherSuites: x509util.CipherSuites{
+							"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+						},
+						MinVersion: 0.9,
+						MaxVersion: 1.2,
+					},
+				},
+				err: errors.New("tls minVersion 0.9 is not supported"),
+			}
+		},
+		"tls-invalid-max-version": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					TLS: &tlsutil.TLSOptions{
+						CipherSuites: x509util.CipherSuites{
+							"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+						},
+						MinVersion: 1.2,
+						MaxVersion: 1.4,
+					},
+				},
+				err: errors.New("tls maxVersion 1.4 is not supported"),
+			}
+		},
+		"tls-options": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					TLSOptions: &TLSOptions{
+						MinVersion: 1.3,
+					},
+				},
+				tls: DefaultTLSOptions,
+			}
+		},
+		"tls-options-invalid-version": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					TLSOptions: &TLSOptions{
+						MinVersion: 1.3,
+						MaxVersion: 1.2,
+					},
+				},
+				err: errors.New("tlsOptions minVersion cannot exceed tlsOptions maxVersion"),
+			}
+		},
+		"external-url": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					ExternalURL:      "https://pki.example.com/step",
+				},
+				tls: DefaultTLSOptions,
+			}
+		},
+		"external-url-http": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					ExternalURL:      "http://pki.example.com/step",
+				},
+				err: errors.New("externalURL http://pki.example.com/step must be an https url"),
+			}
+		},
+		"external-url-no-host": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					ExternalURL:      "https:///step",
+				},
+				err: errors.New("externalURL https:///step must be an https url"),
+			}
+		},
+		"external-url-query": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"testdata/secrets/root_ca.crt"},
+					IntermediateCert: "testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					ExternalURL:      "https://pki.example.com/step?foo=bar",
+				},
+				err: errors.New("externalURL https://pki.example.com/step?foo=bar cannot have user info, query or fragment"),
+			}
+		},
 	}
 
 	for name, get := range tests {
@@ -216,6 +391,168 @@ func TestConfigValidate(t *testing.T) {
 	}
 }
 
+func TestCORSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *CORSConfig
+		err    error
+	}{
+		{"ok nil", nil, nil},
+		{"ok", &CORSConfig{AllowedOrigins: []string{"https://ui.example.com", "http://localhost:8080"}}, nil},
+		{"ok wildcard", &CORSConfig{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true}, nil},
+		{"ok any", &CORSConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"},
+			AllowedHeaders: []string{"Content-Type"}, MaxAge: &provisioner.Duration{Duration: time.Minute}, Endpoints: []string{"/sign"}}, nil},
+		{"fail empty", &CORSConfig{}, errors.New("cors.allowedOrigins cannot be empty")},
+		{"fail any with credentials", &CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			errors.New("cors.allowedOrigins cannot be * if cors.allowCredentials is true")},
+		{"fail scheme", &CORSConfig{AllowedOrigins: []string{"ftp://ui.example.com"}},
+			errors.New("cors.allowedOrigins: ftp://ui.example.com is not a valid origin")},
+		{"fail path", &CORSConfig{AllowedOrigins: []string{"https://ui.example.com/"}},
+			errors.New("cors.allowedOrigins: https://ui.example.com/ is not a valid origin")},
+		{"fail wildcard", &CORSConfig{AllowedOrigins: []string{"https://ui.*.example.com"}},
+			errors.New("cors.allowedOrigins: https://ui.*.example.com is not a valid origin")},
+		{"fail method", &CORSConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET, POST"}},
+			errors.New("cors.allowedMethods: GET, POST is not a valid method")},
+		{"fail header", &CORSConfig{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{""}},
+			errors.New("cors.allowedHeaders:  is not a valid header")},
+		{"fail max age", &CORSConfig{AllowedOrigins: []string{"*"}, MaxAge: &provisioner.Duration{Duration: -time.Minute}},
+			errors.New("cors.maxAge cannot be less than 0")},
+		{"fail endpoint", &CORSConfig{AllowedOrigins: []string{"*"}, Endpoints: []string{"sign"}},
+			errors.New("cors.endpoints: sign is not a valid endpoint")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+}
+
+func TestBodyLimitsConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *BodyLimitsConfig
+		err    error
+	}{
+		{"ok nil", nil, nil},
+		{"ok", &BodyLimitsConfig{Default: 1 << 20, Endpoints: map[string]int64{"/revoke": 1 << 10}}, nil},
+		{"fail default", &BodyLimitsConfig{Default: -1},
+			errors.New("bodyLimits.default cannot be less than 0")},
+		{"fail endpoint", &BodyLimitsConfig{Endpoints: map[string]int64{"sign": 1 << 10}},
+			errors.New("bodyLimits.endpoints: sign is not a valid endpoint")},
+		{"fail endpoint limit", &BodyLimitsConfig{Endpoints: map[string]int64{"/sign": 0}},
+			errors.New("bodyLimits.endpoints: /sign limit must be greater than 0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *ServerConfig
+		err    error
+	}{
+		{"ok nil", nil, nil},
+		{"ok", &ServerConfig{
+			ReadHeaderTimeout:  &provisioner.Duration{Duration: 15 * time.Second},
+			IdleTimeout:        &provisioner.Duration{Duration: 2 * time.Minute},
+			MaxHeaderBytes:     64 << 10,
+			DisableHTTP2:       true,
+			TCPKeepAlivePeriod: &provisioner.Duration{Duration: 0},
+		}, nil},
+		{"fail readTimeout", &ServerConfig{ReadTimeout: &provisioner.Duration{Duration: -time.Second}},
+			errors.New("server.readTimeout cannot be less than 0")},
+		{"fail idleTimeout", &ServerConfig{IdleTimeout: &provisioner.Duration{Duration: -time.Second}},
+			errors.New("server.idleTimeout cannot be less than 0")},
+		{"fail maxHeaderBytes", &ServerConfig{MaxHeaderBytes: -1},
+			errors.New("server.maxHeaderBytes cannot be less than 0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimitConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *ConcurrencyLimitConfig
+		err    error
+	}{
+		{"ok nil", nil, nil},
+		{"ok", &ConcurrencyLimitConfig{MaxInFlight: 10, MaxQueued: 100,
+			QueueTimeout: &provisioner.Duration{Duration: time.Second}, RetryAfter: &provisioner.Duration{Duration: 5 * time.Second}}, nil},
+		{"fail maxInFlight", &ConcurrencyLimitConfig{}, errors.New("maxInFlight must be greater than 0")},
+		{"fail maxQueued", &ConcurrencyLimitConfig{MaxInFlight: 1, MaxQueued: -1}, errors.New("maxQueued cannot be less than 0")},
+		{"fail queueTimeout", &ConcurrencyLimitConfig{MaxInFlight: 1, QueueTimeout: &provisioner.Duration{Duration: -time.Second}},
+			errors.New("queueTimeout cannot be less than 0")},
+		{"fail retryAfter", &ConcurrencyLimitConfig{MaxInFlight: 1, RetryAfter: &provisioner.Duration{Duration: -time.Second}},
+			errors.New("retryAfter cannot be less than 0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+}
+
+func TestAdminConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *AdminConfig
+		err    error
+	}{
+		{"ok nil", nil, nil},
+		{"ok", &AdminConfig{Subject: "admin@example.com", Provisioner: "admin"}, nil},
+		{"fail subject", &AdminConfig{Provisioner: "admin"}, errors.New("authority.superAdmin.subject cannot be empty")},
+		{"fail provisioner", &AdminConfig{Subject: "admin@example.com"}, errors.New("authority.superAdmin.provisioner cannot be empty")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+}
+
 func TestAuthConfigValidate(t *testing.T) {
 	asn1dn := x509util.ASN1DN{
 		Country:       "Tazmania",
@@ -255,6 +592,67 @@ func TestAuthConfigValidate(t *testing.T) {
 				err: errors.New("authority cannot be undefined"),
 			}
 		},
+		"fail-negative-renew-grace-period": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					RenewGracePeriod: &provisioner.Duration{Duration: -time.Minute},
+				},
+				err: errors.New("authority.renewGracePeriod cannot be less than 0"),
+			}
+		},
+		"fail-x509-without-template": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					X509: &provisioner.X509Options{TemplateData: []byte(`{"ou": "Engineering"}`)},
+				},
+				err: errors.New("authority x509 must define a template or a templateFile"),
+			}
+		},
+		"fail-x509-template-and-file": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					X509: &provisioner.X509Options{Template: `{}`, TemplateFile: "leaf.tpl"},
+				},
+				err: errors.New("error parsing x509 template of provisioner authority: template and templateFile cannot be used together"),
+			}
+		},
+		"fail-x509-policy": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					X509Policy: &provisioner.X509Policy{AllowedIPRanges: []string{"10.0.0.0/33"}},
+				},
+				err: errors.New(`authority: x509Policy IP range "10.0.0.0/33" is not a valid CIDR or IP address`),
+			}
+		},
+		"fail-ssh-policy-require-identity-principals": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					SSHPolicy: &provisioner.SSHPolicy{RequireIdentityPrincipals: true},
+				},
+				err: errors.New("authority: sshPolicy requireIdentityPrincipals can only be used in the provisioners"),
+			}
+		},
+		"ok-policies": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					Provisioners: p,
+					X509Policy:   &provisioner.X509Policy{AllowedDNSNames: []string{".smallstep.com"}},
+					SSHPolicy:    &provisioner.SSHPolicy{AllowedHostDomains: []string{"smallstep.com"}},
+				},
+				asn1dn: x509util.ASN1DN{},
+			}
+		},
+		"ok-x509": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					Provisioners: p,
+					X509: &provisioner.X509Options{
+						Template: `{"subject": {"commonName": {{ toJson .Subject }}, "organizationalUnit": ["Engineering"]}}`,
+					},
+				},
+				asn1dn: x509util.ASN1DN{},
+			}
+		},
 		"ok-empty-provisioners": func(t *testing.T) AuthConfigValidateTest {
 			return AuthConfigValidateTest{
 				ac:     &AuthConfig{},
@@ -0,0 +1,201 @@
+package authority
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// healthCheckTTL is the time the result of the health checks is cached, it
+// allows to poll the health endpoint every few seconds without hitting the
+// database or the KMS on every request.
+const healthCheckTTL = 5 * time.Second
+
+// The database is down if it does not respond in healthDBTimeout, and degraded
+// if it takes more than healthDBSlow.
+var (
+	healthDBTimeout = 5 * time.Second
+	healthDBSlow    = time.Second
+)
+
+const (
+	// HealthOK is the status of a component or the authority that is working
+	// properly.
+	HealthOK = "ok"
+	// HealthDegraded is the status of a component that works but is slow, or
+	// the status of the authority if a component is slow or a component that
+	// it does not depend on is failing.
+	HealthDegraded = "degraded"
+	// HealthDown is the status of a component that is failing, or the status
+	// of the authority if a component that it depends on is failing.
+	HealthDown = "down"
+)
+
+// HealthCheck is the result of the health check of one of the components of
+// the authority. The health endpoint does not require authentication, so the
+// error is a generic description, the errors found are in HealthErrors.
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Health is the result of the health checks of the authority.
+type Health struct {
+	Status     string                 `json:"status"`
+	Components map[string]HealthCheck `json:"components"`
+}
+
+// IsOK returns true if all the components of the authority are working
+// properly.
+func (h *Health) IsOK() bool {
+	return h.Status == HealthOK
+}
+
+// IsDown returns true if a component that the authority depends on is
+// failing.
+func (h *Health) IsDown() bool {
+	return h.Status == HealthDown
+}
+
+// healthCache stores the last result of the health checks and the errors
+// found by them.
+type healthCache struct {
+	mu      sync.Mutex
+	health  *Health
+	errors  map[string]string
+	expires time.Time
+}
+
+// Health checks the configuration, the database and the X.509 signer of the
+// authority. A component is down if its check fails, and the database is
+// degraded if it is slow. The authority is down if the configuration or the
+// signer are down, or if the database is down and it is persistent; the
+// in-memory database does not need a server. The results are cached for a
+// few seconds.
+func (a *Authority) Health() *Health {
+	a.health.mu.Lock()
+	defer a.health.mu.Unlock()
+
+	now := time.Now()
+	if a.health.health != nil && now.Before(a.health.expires) {
+		return a.health.health
+	}
+
+	configErr, signerErr := a.checkConfig(), a.checkSigner()
+	dbCheck, dbErr := a.checkDB()
+	h := &Health{
+		Status: HealthOK,
+		Components: map[string]HealthCheck{
+			"config": newHealthCheck("config", configErr),
+			"db":     dbCheck,
+			"signer": newHealthCheck("signer", signerErr),
+		},
+	}
+	for name, c := range h.Components {
+		switch {
+		case c.Status == HealthOK:
+		case c.Status == HealthDown && (name != "db" || a.requiresDB()):
+			h.Status = HealthDown
+		case h.Status == HealthOK:
+			h.Status = HealthDegraded
+		}
+	}
+
+	errs := make(map[string]string)
+	for name, err := range map[string]error{"config": configErr, "db": dbErr, "signer": signerErr} {
+		if err != nil {
+			errs[name] = err.Error()
+		}
+	}
+
+	a.health.health = h
+	a.health.errors = errs
+	a.health.expires = now.Add(healthCheckTTL)
+	return h
+}
+
+// HealthErrors returns the errors found by the last health checks by
+// component, they are not part of the health response.
+func (a *Authority) HealthErrors() map[string]string {
+	a.health.mu.Lock()
+	defer a.health.mu.Unlock()
+	errs := make(map[string]string, len(a.health.errors))
+	for k, v := range a.health.errors {
+		errs[k] = v
+	}
+	return errs
+}
+
+func newHealthCheck(component string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: HealthDown, Error: component + " is unavailable"}
+	}
+	return HealthCheck{Status: HealthOK}
+}
+
+// checkConfig checks that the authority has been initialized with the
+// configuration.
+func (a *Authority) checkConfig() error {
+	switch {
+	case a.config == nil || !a.initOnce:
+		return errors.New("authority has not been initialized")
+	case len(a.rootX509Certs) == 0:
+		return errors.New("authority does not have root certificates")
+	default:
+		return nil
+	}
+}
+
+// checkDB checks that the database is reachable, it is degraded if the ping
+// takes more than healthDBSlow. It also returns the error found, if any.
+func (a *Authority) checkDB() (HealthCheck, error) {
+	if a.db == nil {
+		err := errors.New("database has not been initialized")
+		return newHealthCheck("db", err), err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthDBTimeout)
+	defer cancel()
+	t := time.Now()
+	if err := a.db.Ping(ctx); err != nil {
+		return newHealthCheck("db", err), err
+	}
+	if d := time.Since(t); d > healthDBSlow {
+		return HealthCheck{Status: HealthDegraded, Error: "db is slow"},
+			errors.Errorf("database ping took %s", d.Round(time.Millisecond))
+	}
+	return HealthCheck{Status: HealthOK}, nil
+}
+
+// requiresDB returns true if the authority uses a persistent database, the
+// CA cannot issue certificates without it.
+func (a *Authority) requiresDB() bool {
+	return a.config != nil && a.config.DB.Persistent()
+}
+
+// checkSigner checks that the X.509 signer is able to sign, this will reach
+// the KMS if the key is stored in one.
+func (a *Authority) checkSigner() error {
+	if a.x509Signer == nil {
+		return errors.New("x509 signer has not been initialized")
+	}
+	var (
+		digest []byte
+		opts   crypto.SignerOpts
+	)
+	if _, ok := a.x509Signer.Public().(ed25519.PublicKey); ok {
+		digest, opts = []byte("health"), crypto.Hash(0)
+	} else {
+		sum := sha256.Sum256([]byte("health"))
+		digest, opts = sum[:], crypto.SHA256
+	}
+	if _, err := a.x509Signer.Sign(rand.Reader, digest, opts); err != nil {
+		return errors.Wrap(err, "error signing with the x509 signer")
+	}
+	return nil
+}
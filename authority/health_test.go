@@ -0,0 +1,130 @@
+package authority
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db"
+)
+
+func TestAuthority_Health(t *testing.T) {
+	ok := HealthCheck{Status: HealthOK}
+	failingDB := func() *db.MockAuthDB {
+		return &db.MockAuthDB{
+			MPing: func(ctx context.Context) error { return errors.New("connection refused") },
+		}
+	}
+	slowDB := &db.MockAuthDB{
+		MPing: func(ctx context.Context) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		},
+	}
+	hangingDB := &db.MockAuthDB{
+		MPing: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	persistent := func(a *Authority) *Authority {
+		a.config.DB = &db.Config{Type: "badger", DataSource: "db"}
+		return a
+	}
+	defer func(timeout, slow time.Duration) {
+		healthDBTimeout, healthDBSlow = timeout, slow
+	}(healthDBTimeout, healthDBSlow)
+	healthDBTimeout, healthDBSlow = 100*time.Millisecond, 10*time.Millisecond
+
+	tests := []struct {
+		name       string
+		auth       *Authority
+		want       *Health
+		wantErrors map[string]string
+	}{
+		{"ok", testAuthority(t), &Health{Status: HealthOK, Components: map[string]HealthCheck{
+			"config": ok, "db": ok, "signer": ok,
+		}}, map[string]string{}},
+		{"ok/db-less", testAuthority(t, WithDatabase(failingDB())), &Health{Status: HealthDegraded, Components: map[string]HealthCheck{
+			"config": ok, "db": {Status: HealthDown, Error: "db is unavailable"}, "signer": ok,
+		}}, map[string]string{"db": "connection refused"}},
+		{"fail/db", persistent(testAuthority(t, WithDatabase(failingDB()))), &Health{Status: HealthDown, Components: map[string]HealthCheck{
+			"config": ok, "db": {Status: HealthDown, Error: "db is unavailable"}, "signer": ok,
+		}}, map[string]string{"db": "connection refused"}},
+		{"fail/db-timeout", persistent(testAuthority(t, WithDatabase(hangingDB))), &Health{Status: HealthDown, Components: map[string]HealthCheck{
+			"config": ok, "db": {Status: HealthDown, Error: "db is unavailable"}, "signer": ok,
+		}}, map[string]string{"db": "context deadline exceeded"}},
+		{"fail/not-initialized", &Authority{}, &Health{Status: HealthDown, Components: map[string]HealthCheck{
+			"config": {Status: HealthDown, Error: "config is unavailable"},
+			"db":     {Status: HealthDown, Error: "db is unavailable"},
+			"signer": {Status: HealthDown, Error: "signer is unavailable"},
+		}}, map[string]string{
+			"config": "authority has not been initialized",
+			"db":     "database has not been initialized",
+			"signer": "x509 signer has not been initialized",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.auth.Health()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Authority.Health() = %v, want %v", got, tt.want)
+			}
+			assert.Equals(t, tt.want.Status == HealthOK, got.IsOK())
+			assert.Equals(t, tt.want.Status == HealthDown, got.IsDown())
+			assert.Equals(t, tt.wantErrors, tt.auth.HealthErrors())
+		})
+	}
+
+	t.Run("degraded/slow-db", func(t *testing.T) {
+		got := persistent(testAuthority(t, WithDatabase(slowDB))).Health()
+		assert.Equals(t, HealthDegraded, got.Status)
+		assert.Equals(t, HealthCheck{Status: HealthDegraded, Error: "db is slow"}, got.Components["db"])
+		assert.False(t, got.IsDown())
+	})
+}
+
+func TestAuthority_Health_cache(t *testing.T) {
+	var pings int
+	a := testAuthority(t, WithDatabase(&db.MockAuthDB{
+		MPing: func(ctx context.Context) error {
+			pings++
+			return nil
+		},
+	}))
+	h1 := a.Health()
+	h2 := a.Health()
+	assert.Equals(t, 1, pings)
+	assert.True(t, h1 == h2)
+
+	// Expire the cache
+	a.health.expires = a.health.expires.Add(-healthCheckTTL)
+	a.Health()
+	assert.Equals(t, 2, pings)
+}
+
+func TestAuthority_Health_closedDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := testAuthority(t)
+	a.config.DB = &db.Config{Type: "bbolt", DataSource: filepath.Join(dir, "bbolt.db")}
+	a.db, err = db.New(a.config.DB)
+	assert.FatalError(t, err)
+	assert.Equals(t, HealthOK, a.Health().Status)
+
+	// The authority is down after the database is closed.
+	assert.FatalError(t, a.db.Shutdown())
+	a.health.expires = time.Time{}
+	h := a.Health()
+	assert.Equals(t, HealthDown, h.Status)
+	assert.Equals(t, HealthCheck{Status: HealthDown, Error: "db is unavailable"}, h.Components["db"])
+	assert.Equals(t, "database is closed", a.HealthErrors()["db"])
+}
@@ -26,6 +26,20 @@ func WithDatabase(db db.AuthDB) Option {
 	}
 }
 
+// Meter is the interface used to report the metrics of the authority.
+type Meter interface {
+	TokenValidationFailed(reason string)
+}
+
+// WithMeter sets the meter used to report the tokens rejected by the
+// authority.
+func WithMeter(m Meter) Option {
+	return func(a *Authority) error {
+		a.meter = m
+		return nil
+	}
+}
+
 // WithGetIdentityFunc sets a custom function to retrieve the identity from
 // an external resource.
 func WithGetIdentityFunc(fn func(p provisioner.Interface, email string) (*provisioner.Identity, error)) Option {
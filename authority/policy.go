@@ -0,0 +1,15 @@
+package authority
+
+import (
+	"log"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// logPolicyWarnings logs the allow rules of the policies of the provisioner
+// that the authority policies make useless.
+func logPolicyWarnings(p provisioner.Interface, config provisioner.Config) {
+	for _, w := range provisioner.PolicyWarnings(p, config) {
+		log.Printf("warning: %s", w)
+	}
+}
@@ -0,0 +1,220 @@
+package authority
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/crypto/keys"
+	"github.com/smallstep/cli/crypto/x509util"
+	"github.com/smallstep/cli/jose"
+	"golang.org/x/crypto/ssh"
+)
+
+// policyLayerTests is the cross product of the outcomes of the authority and
+// provisioner policies, with the layer expected in the error of a signature,
+// and in the error of the renewal of a certificate issued without policies;
+// the renewals are only checked with the authority policy.
+var policyLayerTests = []struct {
+	authority   string
+	provisioner string
+	wantLayer   string
+	renewLayer  string
+}{
+	{"none", "none", "", ""},
+	{"none", "allow", "", ""},
+	{"none", "deny", "provisioner", ""},
+	{"allow", "none", "", ""},
+	{"allow", "allow", "", ""},
+	{"allow", "deny", "provisioner", ""},
+	{"deny", "none", "authority", "authority"},
+	{"deny", "allow", "authority", "authority"},
+	{"deny", "deny", "provisioner", "authority"},
+}
+
+func checkPolicyLayer(t *testing.T, err error, wantLayer string) {
+	t.Helper()
+	if wantLayer == "" {
+		assert.NoError(t, err)
+		return
+	}
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "the "+wantLayer+" policy"), err.Error())
+	}
+}
+
+func TestAuthority_Sign_policyLayers(t *testing.T) {
+	x509Policies := map[string]*provisioner.X509Policy{
+		"none":  nil,
+		"allow": {AllowedDNSNames: []string{"*.smallstep.com"}, AllowedIPRanges: []string{"10.0.0.0/8"}},
+		"deny":  {DeniedDNSNames: []string{"test.smallstep.com"}, DeniedIPRanges: []string{"10.0.0.1"}},
+	}
+	priv, err := keys.GenerateDefaultKey()
+	assert.FatalError(t, err)
+
+	for _, tt := range policyLayerTests {
+		t.Run(tt.authority+"/"+tt.provisioner, func(t *testing.T) {
+			for _, csr := range []*x509.CertificateRequest{
+				getCSR(t, priv),
+				getCSR(t, priv, func(cr *x509.CertificateRequest) {
+					cr.DNSNames = nil
+					cr.IPAddresses = []net.IP{net.ParseIP("10.0.0.1")}
+				}),
+			} {
+				a := testAuthority(t)
+				if p := x509Policies[tt.authority]; p != nil {
+					authorityPolicy := *p
+					assert.FatalError(t, authorityPolicy.InitAuthority())
+					a.config.AuthorityConfig.X509Policy = &authorityPolicy
+				}
+				_, err := a.Sign(csr, provisioner.Options{}, x509Policies[tt.provisioner].SignOptions()...)
+				checkPolicyLayer(t, err, tt.wantLayer)
+			}
+		})
+	}
+
+	for _, tt := range policyLayerTests {
+		t.Run("renew/"+tt.authority+"/"+tt.provisioner, func(t *testing.T) {
+			for _, host := range []string{"test.smallstep.com", "10.0.0.1"} {
+				a := testAuthority(t)
+				leaf, err := x509util.NewLeafProfile(host, a.x509Issuer, a.x509Signer,
+					x509util.WithPublicKey(priv.(crypto.Signer).Public()), x509util.WithHosts(host),
+					withProvisionerOID("Max", a.config.AuthorityConfig.Provisioners[0].(*provisioner.JWK).Key.KeyID))
+				assert.FatalError(t, err)
+				der, err := leaf.CreateCertificate()
+				assert.FatalError(t, err)
+				oldCert, err := x509.ParseCertificate(der)
+				assert.FatalError(t, err)
+
+				if p := x509Policies[tt.authority]; p != nil {
+					authorityPolicy := *p
+					assert.FatalError(t, authorityPolicy.InitAuthority())
+					a.config.AuthorityConfig.X509Policy = &authorityPolicy
+				}
+				_, err = a.Renew(oldCert)
+				checkPolicyLayer(t, err, tt.renewLayer)
+			}
+		})
+	}
+}
+
+func TestAuthority_Sign_templatePolicyLayers(t *testing.T) {
+	x509Policies := map[string]*provisioner.X509Policy{
+		"none":  nil,
+		"allow": {AllowedDNSNames: []string{"*.smallstep.com"}, AllowedIPRanges: []string{"10.0.0.0/8"}},
+		"deny":  {DeniedDNSNames: []string{"test.smallstep.com"}, DeniedIPRanges: []string{"10.0.0.1"}},
+	}
+	jwk, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+	priv, err := keys.GenerateDefaultKey()
+	assert.FatalError(t, err)
+
+	// The request only has allowed names, the template replaces them.
+	for name, tmpl := range map[string]string{
+		"dns": `{"subject": {"commonName": "ok.smallstep.com"}, "dnsNames": ["test.smallstep.com"]}`,
+		"ip":  `{"subject": {"commonName": "ok.smallstep.com"}, "ipAddresses": ["10.0.0.1"]}`,
+	} {
+		for _, tt := range policyLayerTests {
+			t.Run(name+"/"+tt.authority+"/"+tt.provisioner, func(t *testing.T) {
+				a := testAuthority(t)
+				if p := x509Policies[tt.authority]; p != nil {
+					authorityPolicy := *p
+					assert.FatalError(t, authorityPolicy.InitAuthority())
+					a.config.AuthorityConfig.X509Policy = &authorityPolicy
+				}
+				p := &provisioner.JWK{
+					Name: "template", Type: "JWK", Key: &pub,
+					X509: &provisioner.X509Options{Template: tmpl},
+				}
+				assert.FatalError(t, p.Init(a.provisionerConfig))
+				assert.FatalError(t, a.provisioners.Store(p))
+
+				token, err := generateToken("ok.smallstep.com", "template", testAudiences.Sign[0], []string{"ok.smallstep.com"}, time.Now(), jwk)
+				assert.FatalError(t, err)
+				signOpts, err := a.AuthorizeSign(token)
+				assert.FatalError(t, err)
+				signOpts = append(signOpts, x509Policies[tt.provisioner].SignOptions()...)
+				_, err = a.Sign(getCSR(t, priv, func(cr *x509.CertificateRequest) {
+					cr.Subject.CommonName = "ok.smallstep.com"
+					cr.DNSNames = []string{"ok.smallstep.com"}
+				}), provisioner.Options{}, signOpts...)
+				checkPolicyLayer(t, err, tt.wantLayer)
+			})
+		}
+	}
+}
+
+func TestAuthority_SignSSH_policyLayers(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	pub, err := ssh.NewPublicKey(key.Public())
+	assert.FatalError(t, err)
+	signKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	signer, err := ssh.NewSignerFromKey(signKey)
+	assert.FatalError(t, err)
+
+	sshPolicies := map[string]*provisioner.SSHPolicy{
+		"none":  nil,
+		"allow": {AllowedUserPrincipals: []string{"deploy-*"}, AllowedHostDomains: []string{"smallstep.com"}},
+		"deny":  {DeniedUserPrincipals: []string{"deploy-prod"}, AllowedHostDomains: []string{"example.com"}},
+	}
+	for _, tt := range policyLayerTests {
+		t.Run(tt.authority+"/"+tt.provisioner, func(t *testing.T) {
+			for _, opts := range []provisioner.SSHOptions{
+				{CertType: "user", Principals: []string{"deploy-prod"}},
+				{CertType: "host", Principals: []string{"test.smallstep.com"}},
+			} {
+				a := testAuthority(t)
+				a.sshCAUserCertSignKey = signer
+				a.sshCAHostCertSignKey = signer
+				if p := sshPolicies[tt.authority]; p != nil {
+					authorityPolicy := *p
+					assert.FatalError(t, authorityPolicy.InitAuthority())
+					a.config.AuthorityConfig.SSHPolicy = &authorityPolicy
+				}
+				_, err := a.SignSSH(pub, opts, sshPolicies[tt.provisioner].SignOptions()...)
+				checkPolicyLayer(t, err, tt.wantLayer)
+			}
+		})
+	}
+}
+
+func TestAuthority_RenewSSH_authorityPolicy(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	pub, err := ssh.NewPublicKey(key.Public())
+	assert.FatalError(t, err)
+	signKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	signer, err := ssh.NewSignerFromKey(signKey)
+	assert.FatalError(t, err)
+
+	a := testAuthority(t)
+	a.sshCAHostCertSignKey = signer
+	a.config.AuthorityConfig.SSHPolicy = &provisioner.SSHPolicy{AllowedHostDomains: []string{"example.com"}}
+	assert.FatalError(t, a.config.AuthorityConfig.SSHPolicy.InitAuthority())
+
+	oldCert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"test.smallstep.com"},
+		ValidAfter:      1,
+		ValidBefore:     3601,
+	}
+	_, err = a.RenewSSH(oldCert)
+	checkPolicyLayer(t, err, "authority")
+
+	oldCert.ValidPrincipals = []string{"test.example.com"}
+	_, err = a.RenewSSH(oldCert)
+	assert.NoError(t, err)
+}
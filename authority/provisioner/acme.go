@@ -3,19 +3,103 @@ package provisioner
 import (
 	"context"
 	"crypto/x509"
+	"net"
+	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/x509util"
 )
 
+// ACME challenge types that can be enabled in an ACME provisioner.
+const (
+	ACMEChallengeHTTP01    = "http-01"
+	ACMEChallengeDNS01     = "dns-01"
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+	// ACMEChallengeDeviceAttest01 validates the permanent-identifier
+	// identifiers with an attestation of the device. It requires the
+	// attestation roots.
+	ACMEChallengeDeviceAttest01 = "device-attest-01"
+)
+
+// DefaultACMERetryAfter is the default delay sent to the ACME clients that
+// poll a challenge or an authorization while the challenge is validated.
+const DefaultACMERetryAfter = 3 * time.Second
+
 // ACME is the acme provisioner type, an entity that can authorize the ACME
 // provisioning flow.
 type ACME struct {
 	*base
-	Type    string  `json:"type"`
-	Name    string  `json:"name"`
-	Claims  *Claims `json:"claims,omitempty"`
-	claimer *Claimer
+	Type     string  `json:"type"`
+	Name     string  `json:"name"`
+	Disabled bool    `json:"disabled,omitempty"`
+	Claims   *Claims `json:"claims,omitempty"`
+	// Challenges is the list of challenge types enabled in the provisioner.
+	// If empty, all the supported challenge types are enabled.
+	Challenges []string `json:"challenges,omitempty"`
+	// RequireEAB requires new accounts to include an external account binding
+	// signed with an external account key of the provisioner.
+	RequireEAB bool `json:"requireEAB,omitempty"`
+	// AllowEABKeyReuse allows an external account key to be bound to more
+	// than one account.
+	AllowEABKeyReuse bool `json:"allowEABKeyReuse,omitempty"`
+	// TermsOfService is the URL of the terms of service in the directory. If
+	// set, new accounts must agree to them.
+	TermsOfService string `json:"termsOfService,omitempty"`
+	// Website is the URL of the website in the directory.
+	Website string `json:"website,omitempty"`
+	// CAAIdentities are the domain names of the CA in the CAA records, they
+	// are published in the directory.
+	CAAIdentities []string `json:"caaIdentities,omitempty"`
+	// Resolver is the address, host:port, of the DNS server used in the
+	// dns-01 validations, e.g. the internal server in split-horizon deployments.
+	// If empty, the system resolver is used.
+	Resolver string `json:"resolver,omitempty"`
+	// DNSPropagation is the time a dns-01 validation is retried while the TXT
+	// record propagates before the challenge fails. By default it is not
+	// retried.
+	DNSPropagation *Duration `json:"dnsPropagation,omitempty"`
+	// HTTP01Port is the port of the http-01 validations, 80 by default.
+	HTTP01Port int `json:"http01Port,omitempty"`
+	// TLSALPN01Port is the port of the tls-alpn-01 validations, 443 by
+	// default.
+	TLSALPN01Port int `json:"tlsALPN01Port,omitempty"`
+	// ValidationSourceAddress is the local IP address of the connections of
+	// the http-01 and tls-alpn-01 validations, e.g. the address of the
+	// interface the validations must egress through. If empty, it is chosen
+	// by the system.
+	ValidationSourceAddress string `json:"validationSourceAddress,omitempty"`
+	// RetryAfter is the delay, in seconds, sent in the Retry-After header to
+	// the clients that poll a challenge or an authorization while the
+	// challenge is validated, 3s by default.
+	RetryAfter *Duration `json:"retryAfter,omitempty"`
+	// DisableWildcardNames rejects the orders with wildcard identifiers like
+	// "*.example.com". Wildcard names are only validated with the dns-01
+	// challenge.
+	DisableWildcardNames bool `json:"disableWildcardNames,omitempty"`
+	// DisableIPIdentifiers rejects the orders with identifiers of type "ip".
+	// IP addresses are only validated with the http-01 and tls-alpn-01
+	// challenges.
+	DisableIPIdentifiers bool `json:"disableIPIdentifiers,omitempty"`
+	// X509Policy restricts the DNS names and the IP addresses that can be
+	// ordered and signed, within the limits of the authority policy.
+	X509Policy *X509Policy `json:"x509Policy,omitempty"`
+	// X509 are the options of the X.509 certificates, like the template used
+	// to customize them. The template data of an order is available in the
+	// template as .Insecure.User.
+	X509 *X509Options `json:"x509,omitempty"`
+	// AttestationFormats is the list of attestation formats allowed in the
+	// device-attest-01 challenge. If empty, all the supported formats are
+	// allowed.
+	AttestationFormats []string `json:"attestationFormats,omitempty"`
+	// AttestationRoots is a PEM bundle with the roots used to verify the
+	// attestations of the device-attest-01 challenge.
+	AttestationRoots []byte `json:"attestationRoots,omitempty"`
+	attestationRoots *x509.CertPool
+	claimer          *Claimer
+	x509             *X509Options
+	authorityPolicy  *X509Policy
 }
 
 // GetID returns the provisioner unique identifier.
@@ -38,11 +122,47 @@ func (p *ACME) GetType() Type {
 	return TypeACME
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *ACME) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey returns the base provisioner encrypted key if it's defined.
 func (p *ACME) GetEncryptedKey() (string, string, bool) {
 	return "", "", false
 }
 
+// GetRetryAfter returns the delay sent to the clients that poll a challenge or
+// an authorization while the challenge is validated.
+func (p *ACME) GetRetryAfter() time.Duration {
+	if p.RetryAfter == nil {
+		return DefaultACMERetryAfter
+	}
+	return p.RetryAfter.Duration
+}
+
+// GetHTTP01Port returns the port of the http-01 validations.
+func (p *ACME) GetHTTP01Port() int {
+	if p.HTTP01Port == 0 {
+		return 80
+	}
+	return p.HTTP01Port
+}
+
+// GetTLSALPN01Port returns the port of the tls-alpn-01 validations.
+func (p *ACME) GetTLSALPN01Port() int {
+	if p.TLSALPN01Port == 0 {
+		return 443
+	}
+	return p.TLSALPN01Port
+}
+
+// GetValidationSourceAddress returns the local IP address of the validation
+// connections, or nil if it is not set.
+func (p *ACME) GetValidationSourceAddress() net.IP {
+	return net.ParseIP(p.ValidationSourceAddress)
+}
+
 // Init initializes and validates the fields of a JWK type.
 func (p *ACME) Init(config Config) (err error) {
 	switch {
@@ -52,6 +172,69 @@ func (p *ACME) Init(config Config) (err error) {
 		return errors.New("provisioner name cannot be empty")
 	}
 
+	for _, ch := range p.Challenges {
+		switch ch {
+		case ACMEChallengeHTTP01, ACMEChallengeDNS01, ACMEChallengeTLSALPN01:
+		case ACMEChallengeDeviceAttest01:
+			if len(p.AttestationRoots) == 0 {
+				return errors.Errorf("challenge type '%s' requires the attestation roots", ch)
+			}
+		default:
+			return errors.Errorf("unsupported challenge type '%s'", ch)
+		}
+	}
+
+	for _, f := range p.AttestationFormats {
+		if _, ok := attestationVerifiers[f]; !ok {
+			return errors.Errorf("unsupported attestation format '%s'", f)
+		}
+	}
+	if len(p.AttestationRoots) > 0 {
+		if p.attestationRoots, err = parseAttestationRoots(p.AttestationRoots); err != nil {
+			return err
+		}
+	}
+
+	if err := validateDirectoryURL("termsOfService", p.TermsOfService); err != nil {
+		return err
+	}
+	if err := validateDirectoryURL("website", p.Website); err != nil {
+		return err
+	}
+	for _, id := range p.CAAIdentities {
+		if id == "" {
+			return errors.New("caaIdentities cannot contain empty names")
+		}
+	}
+
+	if p.Resolver != "" {
+		if _, _, err := net.SplitHostPort(p.Resolver); err != nil {
+			return errors.Errorf("invalid resolver '%s': address must be host:port", p.Resolver)
+		}
+	}
+	if p.DNSPropagation != nil && p.DNSPropagation.Duration < 0 {
+		return errors.New("dnsPropagation cannot be less than 0")
+	}
+	if p.HTTP01Port < 0 || p.HTTP01Port > 65535 {
+		return errors.Errorf("invalid http01Port %d: it must be between 1 and 65535", p.HTTP01Port)
+	}
+	if p.TLSALPN01Port < 0 || p.TLSALPN01Port > 65535 {
+		return errors.Errorf("invalid tlsALPN01Port %d: it must be between 1 and 65535", p.TLSALPN01Port)
+	}
+	if p.ValidationSourceAddress != "" && p.GetValidationSourceAddress() == nil {
+		return errors.Errorf("invalid validationSourceAddress '%s': it must be an IP address", p.ValidationSourceAddress)
+	}
+	if p.RetryAfter != nil && p.RetryAfter.Duration < time.Second {
+		return errors.New("retryAfter cannot be less than 1s")
+	}
+	if err = p.X509Policy.init(p.Name); err != nil {
+		return err
+	}
+	if p.x509, err = initTemplateOptions(p.X509, nil, nil, p.Name, config); err != nil {
+		return err
+	}
+	p.authorityPolicy = config.X509Policy
+
 	// Update claims with global ones
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
 		return err
@@ -60,18 +243,155 @@ func (p *ACME) Init(config Config) (err error) {
 	return err
 }
 
-// AuthorizeSign does not do any validation, because all validation is handled
-// in the ACME protocol. This method returns a list of modifiers / constraints
-// on the resulting certificate.
+// validateDirectoryURL returns an error if a URL published in the directory
+// is set and it is not an absolute URL.
+func validateDirectoryURL(name, u string) error {
+	if u == "" {
+		return nil
+	}
+	if parsed, err := url.Parse(u); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+		return errors.Errorf("invalid %s '%s': it must be an absolute URL", name, u)
+	}
+	return nil
+}
+
+// AuthorizeSign only validates that the provisioner is not disabled, because
+// all validation is handled in the ACME protocol. This method returns a list of
+// modifiers / constraints on the resulting certificate.
 func (p *ACME) AuthorizeSign(ctx context.Context, token string) ([]SignOption, error) {
-	return []SignOption{
+	if p.Disabled {
+		return nil, errs.Unauthorized("acme.AuthorizeSign; provisioner %s is disabled", p.GetName())
+	}
+	signOptions := []SignOption{
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeACME, p.Name, ""),
 		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	}, nil
+	}
+	// The attested permanent identifier is set after applying the template.
+	signOptions = append(signOptions, templateSignOptions(ctx, p.x509, nil, p.Name, &TemplateData{})...)
+	if id, ok := PermanentIdentifierFromContext(ctx); ok {
+		signOptions = append(signOptions, permanentIdentifierModifier(id))
+	}
+	return append(signOptions, x509PolicySignOptions(p.X509Policy)...), nil
+}
+
+// VerifyAttestation verifies an attestation statement of the device-attest-01
+// challenge. The statement must be bound to the given challenge, and its format
+// must be allowed by the provisioner.
+func (p *ACME) VerifyAttestation(format string, statement, challenge []byte) (*AttestationData, error) {
+	verifier, ok := attestationVerifiers[format]
+	if !ok || !p.isAttestationFormatAllowed(format) {
+		return nil, errors.Errorf("attestation format '%s' is not allowed", format)
+	}
+	if p.attestationRoots == nil {
+		return nil, errors.New("attestation roots are not configured")
+	}
+	data, err := verifier.Verify(statement, challenge, p.attestationRoots)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error verifying %s attestation", format)
+	}
+	return data, nil
+}
+
+// isAttestationFormatAllowed returns true if the given format is allowed.
+func (p *ACME) isAttestationFormatAllowed(format string) bool {
+	if len(p.AttestationFormats) == 0 {
+		return true
+	}
+	for _, f := range p.AttestationFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+type permanentIdentifierKey struct{}
+
+// NewContextWithPermanentIdentifier returns a new context with the permanent
+// identifier of the device attested in an ACME order. The ACME provisioner
+// records it in the subject serial number of the certificate.
+func NewContextWithPermanentIdentifier(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, permanentIdentifierKey{}, id)
+}
+
+// PermanentIdentifierFromContext returns the permanent identifier in the
+// context, if any.
+func PermanentIdentifierFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(permanentIdentifierKey{}).(string)
+	return id, ok && id != ""
+}
+
+// permanentIdentifierModifier sets the attested permanent identifier in the
+// subject serial number of the certificate.
+type permanentIdentifierModifier string
+
+// Option implements the ProfileModifier interface.
+func (m permanentIdentifierModifier) Option(Options) x509util.WithOption {
+	return func(p x509util.Profile) error {
+		p.Subject().Subject.SerialNumber = string(m)
+		return nil
+	}
+}
+
+// AllowsUserData returns false if the orders cannot have template data, it
+// uses the x509 options of the provisioner or the default ones of the
+// authority.
+func (p *ACME) AllowsUserData() bool {
+	return p.x509.AllowsUserData()
+}
+
+// X509TemplateSource returns the source of the x509 template used to sign
+// the certificates, see X509TemplateSource.
+func (p *ACME) X509TemplateSource() string {
+	if p.x509.hasTemplate() {
+		return p.x509.source
+	}
+	return TemplateSourceDefault
+}
+
+// AuthorizeDNSName returns an error if the DNS name cannot be ordered, it must
+// be allowed by the policy of the provisioner and by the authority policy.
+func (p *ACME) AuthorizeDNSName(name string) error {
+	return authorizeDNSNameLayers(name, p.X509Policy, p.authorityPolicy)
+}
+
+// AuthorizeIP returns an error if the IP address cannot be ordered, it must be
+// allowed by the policy of the provisioner and by the authority policy.
+func (p *ACME) AuthorizeIP(ip net.IP) error {
+	return authorizeIPLayers(ip, p.X509Policy, p.authorityPolicy)
+}
+
+// AuthorizeOrderValidity returns an error if the validity requested in an ACME
+// order is not allowed by the duration claims of the provisioner. A zero
+// notBefore is the time of the request, and a zero notAfter uses the default
+// duration.
+func (p *ACME) AuthorizeOrderValidity(notBefore, notAfter time.Time) error {
+	if notAfter.IsZero() {
+		return nil
+	}
+	now := now()
+	if notBefore.IsZero() {
+		notBefore = now
+	}
+	d := notAfter.Sub(notBefore)
+	switch {
+	case notAfter.Before(now):
+		return errors.Errorf("notAfter cannot be in the past; na=%v", notAfter)
+	case notAfter.Before(notBefore):
+		return errors.Errorf("notAfter cannot be before notBefore; na=%v, nb=%v", notAfter, notBefore)
+	case d < p.claimer.MinTLSCertDuration():
+		return errors.Errorf("requested duration of %v is less than the authorized minimum certificate duration of %v",
+			d, p.claimer.MinTLSCertDuration())
+	case d > p.claimer.MaxTLSCertDuration():
+		return errors.Errorf("requested duration of %v is more than the authorized maximum certificate duration of %v",
+			d, p.claimer.MaxTLSCertDuration())
+	default:
+		return nil
+	}
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
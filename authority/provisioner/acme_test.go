@@ -2,7 +2,12 @@ package provisioner
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
+	"net"
 	"net/http"
 	"testing"
 	"time"
@@ -10,6 +15,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/x509util"
 )
 
 func TestACME_Getters(t *testing.T) {
@@ -30,6 +36,32 @@ func TestACME_Getters(t *testing.T) {
 		t.Errorf("ACME.GetEncryptedKey() = (%v, %v, %v), want (%v, %v, %v)",
 			kid, key, ok, "", "", false)
 	}
+	if got := p.GetRetryAfter(); got != DefaultACMERetryAfter {
+		t.Errorf("ACME.GetRetryAfter() = %v, want %v", got, DefaultACMERetryAfter)
+	}
+	p.RetryAfter = &Duration{10 * time.Second}
+	if got := p.GetRetryAfter(); got != 10*time.Second {
+		t.Errorf("ACME.GetRetryAfter() = %v, want %v", got, 10*time.Second)
+	}
+	if got := p.GetHTTP01Port(); got != 80 {
+		t.Errorf("ACME.GetHTTP01Port() = %v, want %v", got, 80)
+	}
+	if got := p.GetTLSALPN01Port(); got != 443 {
+		t.Errorf("ACME.GetTLSALPN01Port() = %v, want %v", got, 443)
+	}
+	if got := p.GetValidationSourceAddress(); got != nil {
+		t.Errorf("ACME.GetValidationSourceAddress() = %v, want %v", got, nil)
+	}
+	p.HTTP01Port, p.TLSALPN01Port, p.ValidationSourceAddress = 8080, 8443, "10.0.0.1"
+	if got := p.GetHTTP01Port(); got != 8080 {
+		t.Errorf("ACME.GetHTTP01Port() = %v, want %v", got, 8080)
+	}
+	if got := p.GetTLSALPN01Port(); got != 8443 {
+		t.Errorf("ACME.GetTLSALPN01Port() = %v, want %v", got, 8443)
+	}
+	if got := p.GetValidationSourceAddress(); !got.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("ACME.GetValidationSourceAddress() = %v, want %v", got, "10.0.0.1")
+	}
 }
 
 func TestACME_Init(t *testing.T) {
@@ -64,11 +96,128 @@ func TestACME_Init(t *testing.T) {
 				err: errors.New("claims: DefaultTLSCertDuration must be greater than 0"),
 			}
 		},
+		"fail-bad-challenge": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Challenges: []string{"http-01", "tls-sni-01"}},
+				err: errors.New("unsupported challenge type 'tls-sni-01'"),
+			}
+		},
+		"fail-bad-resolver": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Resolver: "10.0.0.53"},
+				err: errors.New("invalid resolver '10.0.0.53': address must be host:port"),
+			}
+		},
+		"fail-bad-dns-propagation": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", DNSPropagation: &Duration{-time.Minute}},
+				err: errors.New("dnsPropagation cannot be less than 0"),
+			}
+		},
+		"fail-bad-terms-of-service": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", TermsOfService: "/tos"},
+				err: errors.New("invalid termsOfService '/tos': it must be an absolute URL"),
+			}
+		},
+		"fail-bad-website": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Website: "example.com"},
+				err: errors.New("invalid website 'example.com': it must be an absolute URL"),
+			}
+		},
+		"fail-empty-caa-identity": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", CAAIdentities: []string{"example.com", ""}},
+				err: errors.New("caaIdentities cannot contain empty names"),
+			}
+		},
+		"ok-directory-meta": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", TermsOfService: "https://example.com/tos",
+					Website: "https://example.com", CAAIdentities: []string{"example.com"}},
+			}
+		},
+		"fail-bad-retry-after": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", RetryAfter: &Duration{500 * time.Millisecond}},
+				err: errors.New("retryAfter cannot be less than 1s"),
+			}
+		},
+		"fail-bad-http01-port": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", HTTP01Port: 65536},
+				err: errors.New("invalid http01Port 65536: it must be between 1 and 65535"),
+			}
+		},
+		"fail-bad-tls-alpn01-port": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", TLSALPN01Port: -1},
+				err: errors.New("invalid tlsALPN01Port -1: it must be between 1 and 65535"),
+			}
+		},
+		"fail-bad-validation-source-address": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", ValidationSourceAddress: "eth0"},
+				err: errors.New("invalid validationSourceAddress 'eth0': it must be an IP address"),
+			}
+		},
+		"fail-bad-x509-policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", X509Policy: &X509Policy{AllowedDNSNames: []string{"*.*.example.com"}}},
+				err: errors.New(`provisioner foo: x509Policy name "*.*.example.com" is not a valid name`),
+			}
+		},
+		"ok-resolver": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", Resolver: "10.0.0.53:53", DNSPropagation: &Duration{time.Minute}},
+			}
+		},
 		"ok": func(t *testing.T) ProvisionerValidateTest {
 			return ProvisionerValidateTest{
 				p: &ACME{Name: "foo", Type: "bar"},
 			}
 		},
+		"ok-validation-network": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", HTTP01Port: 8080, TLSALPN01Port: 8443, ValidationSourceAddress: "2001:db8::1"},
+			}
+		},
+		"fail-device-attest-without-roots": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Challenges: []string{"device-attest-01"}},
+				err: errors.New("challenge type 'device-attest-01' requires the attestation roots"),
+			}
+		},
+		"fail-bad-attestation-format": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", AttestationFormats: []string{"packed"}},
+				err: errors.New("unsupported attestation format 'packed'"),
+			}
+		},
+		"fail-bad-attestation-roots": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", AttestationRoots: []byte("foo")},
+				err: errors.New("attestation roots cannot be empty"),
+			}
+		},
+		"fail-bad-x509-template": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", X509: &X509Options{Template: `{{ .Foo }}`}},
+				err: errors.New("error parsing x509 template of provisioner foo: foo:1:3: .Foo is not a field of the template data"),
+			}
+		},
+		"ok-challenges": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", Challenges: []string{"http-01", "dns-01", "tls-alpn-01"}},
+			}
+		},
+		"ok-device-attest": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", Challenges: []string{"device-attest-01"},
+					AttestationFormats: []string{"apple", "step", "tpm"}, AttestationRoots: newTestAttestationCA(t).pem},
+			}
+		},
 	}
 
 	config := Config{
@@ -90,6 +239,36 @@ func TestACME_Init(t *testing.T) {
 	}
 }
 
+func TestACME_AuthorizeOrderValidity(t *testing.T) {
+	p, err := generateACME()
+	assert.FatalError(t, err)
+	now := time.Now()
+	tests := map[string]struct {
+		nb, na time.Time
+		err    error
+	}{
+		"ok/zero":               {time.Time{}, time.Time{}, nil},
+		"ok/notAfter":           {time.Time{}, now.Add(time.Hour), nil},
+		"ok/notBefore":          {now.Add(time.Hour), time.Time{}, nil},
+		"ok/notBefore-notAfter": {now.Add(time.Hour), now.Add(2 * time.Hour), nil},
+		"fail/past":             {time.Time{}, now.Add(-time.Minute), errors.New("notAfter cannot be in the past")},
+		"fail/before-notBefore": {now.Add(2 * time.Hour), now.Add(time.Hour), errors.New("notAfter cannot be before notBefore")},
+		"fail/min":              {now, now.Add(time.Minute), errors.New("requested duration of 1m0s is less than the authorized minimum certificate duration of 5m0s")},
+		"fail/max":              {now, now.Add(25 * time.Hour), errors.New("requested duration of 25h0m0s is more than the authorized maximum certificate duration of 24h0m0s")},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := p.AuthorizeOrderValidity(tc.nb, tc.na); err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+			} else {
+				assert.Nil(t, tc.err)
+			}
+		})
+	}
+}
+
 func TestACME_AuthorizeRenew(t *testing.T) {
 	type test struct {
 		p    *ACME
@@ -142,6 +321,7 @@ func TestACME_AuthorizeRenew(t *testing.T) {
 func TestACME_AuthorizeSign(t *testing.T) {
 	type test struct {
 		p     *ACME
+		ctx   context.Context
 		token string
 		code  int
 		err   error
@@ -155,11 +335,54 @@ func TestACME_AuthorizeSign(t *testing.T) {
 				token: "foo",
 			}
 		},
+		"ok/permanent-identifier": func(t *testing.T) test {
+			p, err := generateACME()
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				ctx:   NewContextWithPermanentIdentifier(context.Background(), "12345678"),
+				token: "foo",
+			}
+		},
+		"ok/x509Policy": func(t *testing.T) test {
+			p, err := generateACME()
+			assert.FatalError(t, err)
+			p.X509Policy = &X509Policy{AllowedDNSNames: []string{"*.example.com"}}
+			return test{
+				p:     p,
+				token: "foo",
+			}
+		},
+		"ok/x509": func(t *testing.T) test {
+			p, err := generateACME()
+			assert.FatalError(t, err)
+			p.X509 = &X509Options{Template: `{"subject": {"commonName": {{ toJson .Insecure.User.deploymentID }}}}`}
+			assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims}))
+			return test{
+				p:     p,
+				token: "foo",
+			}
+		},
+		"fail/disabled": func(t *testing.T) test {
+			p, err := generateACME()
+			assert.FatalError(t, err)
+			p.Disabled = true
+			return test{
+				p:     p,
+				token: "foo",
+				code:  http.StatusUnauthorized,
+				err:   errors.Errorf("acme.AuthorizeSign; provisioner %s is disabled", p.GetName()),
+			}
+		},
 	}
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			tc := tt(t)
-			if opts, err := tc.p.AuthorizeSign(context.Background(), tc.token); err != nil {
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if opts, err := tc.p.AuthorizeSign(ctx, tc.token); err != nil {
 				if assert.NotNil(t, tc.err) {
 					sc, ok := err.(errs.StatusCoder)
 					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
@@ -168,9 +391,28 @@ func TestACME_AuthorizeSign(t *testing.T) {
 				}
 			} else {
 				if assert.Nil(t, tc.err) && assert.NotNil(t, opts) {
-					assert.Len(t, 4, opts)
+					n := 4 + len(x509PolicySignOptions(tc.p.X509Policy)) + len(templateSignOptions(ctx, tc.p.X509, nil, tc.p.Name, &TemplateData{}))
+					id, hasID := PermanentIdentifierFromContext(ctx)
+					if hasID {
+						n++
+					}
+					assert.Len(t, n, opts)
 					for _, o := range opts {
 						switch v := o.(type) {
+						case permanentIdentifierModifier:
+							assert.Equals(t, id, string(v))
+							prof := &x509util.Leaf{}
+							prof.SetSubject(&x509.Certificate{})
+							assert.FatalError(t, v.Option(Options{})(prof))
+							assert.Equals(t, "12345678", prof.Subject().Subject.SerialNumber)
+						case *x509PolicyValidator:
+							assert.Equals(t, v.policy, tc.p.X509Policy)
+						case *x509TemplateOption:
+							assert.Equals(t, tc.p.GetName(), v.data.Provisioner.Name)
+							prof := &x509util.Leaf{}
+							prof.SetSubject(&x509.Certificate{})
+							assert.FatalError(t, v.Option(Options{UserData: map[string]interface{}{"deploymentID": "d-1234"}})(prof))
+							assert.Equals(t, "d-1234", prof.Subject().Subject.CommonName)
 						case *provisionerExtensionOption:
 							assert.Equals(t, v.Type, int(TypeACME))
 							assert.Equals(t, v.Name, tc.p.GetName())
@@ -191,3 +433,52 @@ func TestACME_AuthorizeSign(t *testing.T) {
 		})
 	}
 }
+
+func TestACME_VerifyAttestation(t *testing.T) {
+	ca := newTestAttestationCA(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	challenge := sha256.Sum256([]byte("token.thumbprint"))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, challenge[:])
+	assert.FatalError(t, err)
+	statement := mustJSON(t, stepAttestationStatement{
+		X5C: [][]byte{ca.issue(t, key.Public())}, Alg: coseAlgES256, Sig: sig,
+	})
+
+	newACME := func(formats ...string) *ACME {
+		p, err := generateACME()
+		assert.FatalError(t, err)
+		p.AttestationFormats = formats
+		p.AttestationRoots = ca.pem
+		assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims, Audiences: testAudiences}))
+		return p
+	}
+	noRoots, err := generateACME()
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name   string
+		p      *ACME
+		format string
+		err    error
+	}{
+		{"ok", newACME(), "step", nil},
+		{"ok allowed", newACME("step"), "step", nil},
+		{"fail unknown format", newACME(), "packed", errors.New("attestation format 'packed' is not allowed")},
+		{"fail format not allowed", newACME("tpm"), "step", errors.New("attestation format 'step' is not allowed")},
+		{"fail no roots", noRoots, "step", errors.New("attestation roots are not configured")},
+		{"fail verify", newACME(), "tpm", errors.New("error verifying tpm attestation: unsupported tpm version ''")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.p.VerifyAttestation(tt.format, statement, challenge[:])
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else if assert.Nil(t, tt.err) {
+				assert.True(t, publicKeyEqual(key.Public(), data.PublicKey))
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package provisioner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Attestation modes supported by the provisioners.
+const (
+	// AttestationIgnore ignores any attestation object sent in the sign
+	// request. This is the default mode.
+	AttestationIgnore = "ignore"
+	// AttestationOptional verifies the attestation object if it is present in
+	// the sign request.
+	AttestationOptional = "optional"
+	// AttestationRequired requires a valid attestation object in the sign
+	// request.
+	AttestationRequired = "required"
+)
+
+// AttestationObject is the attestation statement that can be sent in a sign
+// request to prove that the key in the certificate request was generated and is
+// stored in a device. The statement must be bound to the SHA-256 digest of the
+// token of the request, so it cannot be replayed with another token.
+type AttestationObject struct {
+	Format    string          `json:"format"`
+	Statement json.RawMessage `json:"statement"`
+}
+
+// AttestationOptions are the options used to verify the attestation objects
+// sent to a provisioner.
+type AttestationOptions struct {
+	// Mode is one of "ignore", "optional" or "required". It defaults to
+	// "ignore".
+	Mode string `json:"mode,omitempty"`
+	// Formats is the list of attestation formats allowed. If empty, all the
+	// supported formats are allowed.
+	Formats []string `json:"formats,omitempty"`
+	// Roots is a PEM bundle with the attestation roots.
+	Roots    []byte `json:"roots,omitempty"`
+	rootPool *x509.CertPool
+}
+
+// init validates the attestation options and loads the attestation roots.
+func (o *AttestationOptions) init() error {
+	if o == nil {
+		return nil
+	}
+
+	switch strings.ToLower(o.Mode) {
+	case "", AttestationIgnore:
+		o.Mode = AttestationIgnore
+		return nil
+	case AttestationOptional, AttestationRequired:
+		o.Mode = strings.ToLower(o.Mode)
+	default:
+		return errors.Errorf("unsupported attestation mode '%s'", o.Mode)
+	}
+
+	for _, f := range o.Formats {
+		if _, ok := attestationVerifiers[f]; !ok {
+			return errors.Errorf("unsupported attestation format '%s'", f)
+		}
+	}
+
+	var err error
+	o.rootPool, err = parseAttestationRoots(o.Roots)
+	return err
+}
+
+// parseAttestationRoots parses a PEM bundle with the attestation roots.
+func parseAttestationRoots(b []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	var (
+		block *pem.Block
+		rest  = b
+	)
+	for rest != nil {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing attestation root")
+		}
+		pool.AddCert(cert)
+	}
+	if len(pool.Subjects()) == 0 {
+		return nil, errors.New("attestation roots cannot be empty")
+	}
+	return pool, nil
+}
+
+// isAllowed returns true if the given format is allowed.
+func (o *AttestationOptions) isAllowed(format string) bool {
+	if len(o.Formats) == 0 {
+		return true
+	}
+	for _, f := range o.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// AttestationData is the data of a verified attestation statement.
+type AttestationData struct {
+	// PublicKey is the attested key.
+	PublicKey crypto.PublicKey
+	// PermanentIdentifiers are the identifiers of the device found in the
+	// statement, like its serial number.
+	PermanentIdentifiers []string
+}
+
+// AttestationVerifier is the interface implemented by the attestation formats.
+// Verify validates the statement against the given roots and returns the
+// attested data. If the challenge is not empty, the statement must also be
+// bound to it; the ACME device-attest-01 challenge uses the SHA-256 digest of
+// the key authorization.
+type AttestationVerifier interface {
+	Verify(statement, challenge []byte, roots *x509.CertPool) (*AttestationData, error)
+}
+
+// attestationVerifiers contains the supported attestation formats.
+var attestationVerifiers = map[string]AttestationVerifier{
+	"apple": appleAttestationVerifier{},
+	"step":  stepAttestationVerifier{},
+	"tpm":   tpmAttestationVerifier{},
+}
+
+// RegisterAttestationFormat adds a new attestation format or replaces an
+// existing one. It is not safe for concurrent use, and it must be called
+// before the provisioners are initialized, e.g. in an init function.
+func RegisterAttestationFormat(format string, v AttestationVerifier) {
+	attestationVerifiers[format] = v
+}
+
+// attestationValidator is a CertificateValidator that verifies the attestation
+// object in the sign options and checks that the attested key is the key in
+// the certificate.
+type attestationValidator struct {
+	options   *AttestationOptions
+	challenge []byte
+}
+
+// newAttestationValidator returns a new attestationValidator with the given
+// options. The attestation must be bound to the SHA-256 digest of the token.
+func newAttestationValidator(o *AttestationOptions, token string) *attestationValidator {
+	sum := sha256.Sum256([]byte(token))
+	return &attestationValidator{options: o, challenge: sum[:]}
+}
+
+// Valid validates the attestation object in the sign options.
+func (v *attestationValidator) Valid(cert *x509.Certificate, so Options) error {
+	o := v.options
+	if o == nil || o.Mode == "" || o.Mode == AttestationIgnore {
+		return nil
+	}
+
+	att := so.Attestation
+	if att == nil {
+		if o.Mode == AttestationRequired {
+			return errors.New("attestation is required")
+		}
+		return nil
+	}
+
+	verifier, ok := attestationVerifiers[att.Format]
+	if !ok || !o.isAllowed(att.Format) {
+		return errors.Errorf("attestation format '%s' is not allowed", att.Format)
+	}
+	data, err := verifier.Verify(att.Statement, v.challenge, o.rootPool)
+	if err != nil {
+		return errors.Wrapf(err, "error verifying %s attestation", att.Format)
+	}
+	if !publicKeyEqual(data.PublicKey, cert.PublicKey) {
+		return errors.New("certificate request public key does not match the attested key")
+	}
+	return nil
+}
+
+// publicKeyEqual returns true if both public keys are equal.
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// verifyAttestationChain verifies the given DER chain against the attestation
+// roots and returns the leaf certificate.
+func verifyAttestationChain(x5c [][]byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	if len(x5c) == 0 {
+		return nil, errors.New("x5c cannot be empty")
+	}
+	certs := make([]*x509.Certificate, len(x5c))
+	for i, b := range x5c {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing x5c certificate")
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, errors.Wrap(err, "error verifying x5c chain")
+	}
+	return certs[0], nil
+}
+
+// COSE algorithm identifiers used in the attestation statements.
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+	coseAlgPS256 = -37
+)
+
+// verifyCOSESignature verifies the signature of the SHA-256 digest with the
+// given COSE algorithm.
+func verifyCOSESignature(key crypto.PublicKey, alg int, digest, sig []byte) error {
+	var ok bool
+	switch alg {
+	case coseAlgES256:
+		pub, isECDSA := key.(*ecdsa.PublicKey)
+		ok = isECDSA && ecdsa.VerifyASN1(pub, digest, sig)
+	case coseAlgRS256:
+		pub, isRSA := key.(*rsa.PublicKey)
+		ok = isRSA && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case coseAlgPS256:
+		pub, isRSA := key.(*rsa.PublicKey)
+		ok = isRSA && rsa.VerifyPSS(pub, crypto.SHA256, digest, sig, nil) == nil
+	default:
+		return errors.Errorf("unsupported signature algorithm %d", alg)
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// oidYubicoSerialNumber is the extension with the serial number of the device
+// in the YubiKey PIV attestation certificates.
+var oidYubicoSerialNumber = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}
+
+// stepAttestationStatement is the statement of the "step" format. The leaf
+// certificate in the chain is issued by the device for the attested key, as
+// YubiKey PIV attestation certificates are. When the statement is bound to a
+// challenge, sig is the signature of the challenge with the attested key using
+// the COSE algorithm alg.
+type stepAttestationStatement struct {
+	X5C [][]byte `json:"x5c"`
+	Alg int      `json:"alg,omitempty"`
+	Sig []byte   `json:"sig,omitempty"`
+}
+
+type stepAttestationVerifier struct{}
+
+// Verify verifies the certificate chain in the statement and the signature of
+// the challenge, if any. It returns the public key of the leaf, and its
+// permanent identifier is the YubiKey serial number or, in other devices, the
+// subject serial number of the leaf.
+func (stepAttestationVerifier) Verify(statement, challenge []byte, roots *x509.CertPool) (*AttestationData, error) {
+	var st stepAttestationStatement
+	if err := json.Unmarshal(statement, &st); err != nil {
+		return nil, errors.Wrap(err, "error parsing statement")
+	}
+	leaf, err := verifyAttestationChain(st.X5C, roots)
+	if err != nil {
+		return nil, err
+	}
+	if len(challenge) > 0 {
+		if err := verifyCOSESignature(leaf.PublicKey, st.Alg, challenge, st.Sig); err != nil {
+			return nil, errors.Wrap(err, "error verifying challenge signature")
+		}
+	}
+
+	data := &AttestationData{PublicKey: leaf.PublicKey}
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidYubicoSerialNumber) {
+			var serial int64
+			if _, err := asn1.Unmarshal(ext.Value, &serial); err != nil {
+				return nil, errors.Wrap(err, "error parsing serial number")
+			}
+			data.PermanentIdentifiers = []string{strconv.FormatInt(serial, 10)}
+			return data, nil
+		}
+	}
+	if leaf.Subject.SerialNumber != "" {
+		data.PermanentIdentifiers = []string{leaf.Subject.SerialNumber}
+	}
+	return data, nil
+}
@@ -0,0 +1,55 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Extensions of the Apple managed device attestation certificates.
+var (
+	oidAppleSerialNumber           = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 9, 1}
+	oidAppleUniqueDeviceIdentifier = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 9, 2}
+	oidAppleNonce                  = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 11, 1}
+)
+
+// appleAttestationStatement is the statement of the "apple" format. The leaf
+// certificate in the chain is issued by Apple for the attested key, and it
+// contains the serial number, the UDID and the nonce of the device.
+type appleAttestationStatement struct {
+	X5C [][]byte `json:"x5c"`
+}
+
+type appleAttestationVerifier struct{}
+
+// Verify verifies the certificate chain in the statement and that the nonce in
+// the leaf is the challenge, if any. It returns the public key of the leaf, and
+// the permanent identifiers are the serial number and the UDID of the device.
+func (appleAttestationVerifier) Verify(statement, challenge []byte, roots *x509.CertPool) (*AttestationData, error) {
+	var st appleAttestationStatement
+	if err := json.Unmarshal(statement, &st); err != nil {
+		return nil, errors.Wrap(err, "error parsing statement")
+	}
+	leaf, err := verifyAttestationChain(st.X5C, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce []byte
+	data := &AttestationData{PublicKey: leaf.PublicKey}
+	for _, ext := range leaf.Extensions {
+		switch {
+		case ext.Id.Equal(oidAppleSerialNumber), ext.Id.Equal(oidAppleUniqueDeviceIdentifier):
+			data.PermanentIdentifiers = append(data.PermanentIdentifiers, string(ext.Value))
+		case ext.Id.Equal(oidAppleNonce):
+			nonce = ext.Value
+		}
+	}
+	if len(challenge) > 0 && !bytes.Equal(nonce, challenge) {
+		return nil, errors.New("attestation nonce does not match the challenge")
+	}
+	return data, nil
+}
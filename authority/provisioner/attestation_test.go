@@ -0,0 +1,491 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+)
+
+// fakeAttestationVerifier is a fabricated attestation format whose statement is
+// the DER of the attested public key signed by a certificate in the roots.
+type fakeAttestationVerifier struct{}
+
+type fakeAttestationStatement struct {
+	Key  []byte `json:"key"`
+	X5C  []byte `json:"x5c"`
+	Sig  []byte `json:"sig"`
+	Fail bool   `json:"fail"`
+}
+
+func (fakeAttestationVerifier) Verify(statement, challenge []byte, roots *x509.CertPool) (*AttestationData, error) {
+	var st fakeAttestationStatement
+	if err := json.Unmarshal(statement, &st); err != nil {
+		return nil, err
+	}
+	if st.Fail {
+		return nil, errors.New("force")
+	}
+	leaf, err := verifyAttestationChain([][]byte{st.X5C}, roots)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(st.Key)
+	if !ecdsa.VerifyASN1(leaf.PublicKey.(*ecdsa.PublicKey), sum[:], st.Sig) {
+		return nil, errors.New("invalid signature")
+	}
+	key, err := x509.ParsePKIXPublicKey(st.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &AttestationData{PublicKey: key}, nil
+}
+
+type testAttestationCA struct {
+	root    *x509.Certificate
+	rootKey crypto.Signer
+	pem     []byte
+}
+
+func newTestAttestationCA(t *testing.T) *testAttestationCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Attestation Root"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	assert.FatalError(t, err)
+	root, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return &testAttestationCA{
+		root:    root,
+		rootKey: key,
+		pem:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}),
+	}
+}
+
+func (ca *testAttestationCA) issue(t *testing.T, pub crypto.PublicKey, exts ...pkix.Extension) []byte {
+	return ca.issueWith(t, pub, nil, false, exts...)
+}
+
+// issueAK issues a TPM AK certificate with the tcg-kp-AIKCertificate extended
+// key usage.
+func (ca *testAttestationCA) issueAK(t *testing.T, pub crypto.PublicKey, exts ...pkix.Extension) []byte {
+	return ca.issueWith(t, pub, []asn1.ObjectIdentifier{oidTCGKpAIKCertificate}, false, exts...)
+}
+
+func (ca *testAttestationCA) issueWith(t *testing.T, pub crypto.PublicKey, ekus []asn1.ObjectIdentifier, isCA bool, exts ...pkix.Extension) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Attested Key"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage:    ekus,
+		IsCA:                  isCA,
+		BasicConstraintsValid: isCA,
+		ExtraExtensions:       exts,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, tmpl, ca.root, pub, ca.rootKey)
+	assert.FatalError(t, err)
+	return b
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	assert.FatalError(t, err)
+	return b
+}
+
+func TestAttestationOptions_init(t *testing.T) {
+	ca := newTestAttestationCA(t)
+	tests := []struct {
+		name    string
+		o       *AttestationOptions
+		mode    string
+		wantErr bool
+	}{
+		{"ok nil", nil, "", false},
+		{"ok default", &AttestationOptions{}, AttestationIgnore, false},
+		{"ok ignore", &AttestationOptions{Mode: "ignore"}, AttestationIgnore, false},
+		{"ok optional", &AttestationOptions{Mode: "optional", Roots: ca.pem}, AttestationOptional, false},
+		{"ok required", &AttestationOptions{Mode: "Required", Formats: []string{"step", "tpm"}, Roots: ca.pem}, AttestationRequired, false},
+		{"fail mode", &AttestationOptions{Mode: "always", Roots: ca.pem}, "", true},
+		{"fail format", &AttestationOptions{Mode: "required", Formats: []string{"packed"}, Roots: ca.pem}, "", true},
+		{"fail no roots", &AttestationOptions{Mode: "required"}, "", true},
+		{"fail bad roots", &AttestationOptions{Mode: "required", Roots: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("foo")})}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.o.init()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AttestationOptions.init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.o != nil {
+				assert.Equals(t, tt.mode, tt.o.Mode)
+			}
+		})
+	}
+}
+
+func Test_attestationValidator_Valid(t *testing.T) {
+	RegisterAttestationFormat("fake", fakeAttestationVerifier{})
+	defer delete(attestationVerifiers, "fake")
+
+	ca := newTestAttestationCA(t)
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+
+	// fake attestation signed by a certificate issued by the attestation root
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	signerCert := ca.issue(t, signer.Public())
+	fakeStatement := func(key crypto.PublicKey, sigKey *ecdsa.PrivateKey) []byte {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		assert.FatalError(t, err)
+		sum := sha256.Sum256(der)
+		sig, err := ecdsa.SignASN1(rand.Reader, sigKey, sum[:])
+		assert.FatalError(t, err)
+		return mustJSON(t, fakeAttestationStatement{Key: der, X5C: signerCert, Sig: sig})
+	}
+
+	// a fake attestation root not trusted by the provisioner
+	untrusted := newTestAttestationCA(t)
+
+	newOptions := func(mode string, formats ...string) *AttestationOptions {
+		o := &AttestationOptions{Mode: mode, Formats: formats, Roots: ca.pem}
+		assert.FatalError(t, o.init())
+		return o
+	}
+
+	// step attestations bound to the token of the request and to another one
+	const token = "the.sign.token"
+	deviceCert := ca.issue(t, deviceKey.Public())
+	stepStatement := func(tok string) *AttestationObject {
+		sum := sha256.Sum256([]byte(tok))
+		sig, err := ecdsa.SignASN1(rand.Reader, deviceKey, sum[:])
+		assert.FatalError(t, err)
+		return &AttestationObject{
+			Format:    "step",
+			Statement: mustJSON(t, stepAttestationStatement{X5C: [][]byte{deviceCert}, Alg: coseAlgES256, Sig: sig}),
+		}
+	}
+
+	cert := &x509.Certificate{PublicKey: deviceKey.Public()}
+	stepAtt := stepStatement(token)
+
+	tests := []struct {
+		name    string
+		o       *AttestationOptions
+		att     *AttestationObject
+		wantErr bool
+	}{
+		{"ok nil options", nil, nil, false},
+		{"ok ignore", newOptions("ignore"), &AttestationObject{Format: "foo"}, false},
+		{"ok optional missing", newOptions("optional"), nil, false},
+		{"ok optional", newOptions("optional"), stepAtt, false},
+		{"ok required step", newOptions("required"), stepAtt, false},
+		{"ok required fake", newOptions("required", "fake"), &AttestationObject{Format: "fake", Statement: fakeStatement(deviceKey.Public(), signer)}, false},
+		{"fail required missing", newOptions("required"), nil, true},
+		{"fail unknown format", newOptions("required"), &AttestationObject{Format: "packed"}, true},
+		{"fail format not allowed", newOptions("required", "tpm"), stepAtt, true},
+		{"fail statement", newOptions("required"), &AttestationObject{Format: "step", Statement: []byte("{")}, true},
+		{"fail verify", newOptions("optional"), &AttestationObject{Format: "fake", Statement: mustJSON(t, fakeAttestationStatement{Fail: true})}, true},
+		{"fail bad signature", newOptions("required"), &AttestationObject{Format: "fake", Statement: fakeStatement(deviceKey.Public(), otherKey)}, true},
+		{"fail key mismatch", newOptions("required"), &AttestationObject{Format: "fake", Statement: fakeStatement(otherKey.Public(), signer)}, true},
+		{"fail step key mismatch", newOptions("required"), &AttestationObject{
+			Format:    "step",
+			Statement: mustJSON(t, stepAttestationStatement{X5C: [][]byte{ca.issue(t, otherKey.Public())}}),
+		}, true},
+		{"fail step untrusted", newOptions("required"), &AttestationObject{
+			Format:    "step",
+			Statement: mustJSON(t, stepAttestationStatement{X5C: [][]byte{untrusted.issue(t, deviceKey.Public())}}),
+		}, true},
+		{"fail step empty", newOptions("required"), &AttestationObject{Format: "step", Statement: []byte("{}")}, true},
+		{"fail step replay", newOptions("required"), stepStatement("another.sign.token"), true},
+		{"fail step without challenge", newOptions("required"), &AttestationObject{
+			Format:    "step",
+			Statement: mustJSON(t, stepAttestationStatement{X5C: [][]byte{deviceCert}}),
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newAttestationValidator(tt.o, token)
+			if err := v.Valid(cert, Options{Attestation: tt.att}); (err != nil) != tt.wantErr {
+				t.Errorf("attestationValidator.Valid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tpmTestWriter writes the big-endian TPM structures used in the tests.
+type tpmTestWriter struct {
+	bytes.Buffer
+}
+
+func (w *tpmTestWriter) write(v ...interface{}) *tpmTestWriter {
+	for _, i := range v {
+		if b, ok := i.([]byte); ok {
+			binary.Write(w, binary.BigEndian, uint16(len(b)))
+			w.Write(b)
+		} else {
+			binary.Write(w, binary.BigEndian, i)
+		}
+	}
+	return w
+}
+
+// tpmKeyAttributes are the object attributes of a TPM signing key:
+// fixedTPM, fixedParent, sensitiveDataOrigin, userWithAuth and sign.
+const tpmKeyAttributes = 0x00040072
+
+func tpmECCPublic(pub *ecdsa.PublicKey) []byte {
+	return tpmECCPublicWithAttributes(pub, tpmKeyAttributes)
+}
+
+func tpmECCPublicWithAttributes(pub *ecdsa.PublicKey, attributes uint32) []byte {
+	w := new(tpmTestWriter)
+	return w.write(uint16(tpmAlgECC), uint16(tpmAlgSHA256), attributes, []byte{},
+		uint16(tpmAlgNull), uint16(tpmAlgNull), uint16(tpmECCNistP256), uint16(tpmAlgNull),
+		pub.X.FillBytes(make([]byte, 32)), pub.Y.FillBytes(make([]byte, 32))).Bytes()
+}
+
+func tpmRSAPublic(pub *rsa.PublicKey) []byte {
+	w := new(tpmTestWriter)
+	return w.write(uint16(tpmAlgRSA), uint16(tpmAlgSHA256), uint32(tpmKeyAttributes), []byte{},
+		uint16(tpmAlgNull), uint16(tpmAlgNull), uint16(pub.N.BitLen()), uint32(0),
+		pub.N.Bytes()).Bytes()
+}
+
+func tpmCertifyInfo(magic uint32, pubArea, extraData []byte) []byte {
+	sum := sha256.Sum256(pubArea)
+	name := append([]byte{0x00, byte(tpmAlgSHA256)}, sum[:]...)
+	w := new(tpmTestWriter)
+	return w.write(magic, uint16(tpmSTAttestCertify), []byte("signer"), extraData,
+		[17]byte{}, uint64(1), name, []byte("qualified")).Bytes()
+}
+
+// permanentIdentifierSAN returns a subject alternative name extension with a
+// permanentIdentifier and a DNS name.
+func permanentIdentifierSAN(t *testing.T, id string) pkix.Extension {
+	pi, err := asn1.Marshal(permanentIdentifier{IdentifierValue: id})
+	assert.FatalError(t, err)
+	oid, err := asn1.Marshal(oidPermanentIdentifier)
+	assert.FatalError(t, err)
+	value, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: pi})
+	assert.FatalError(t, err)
+	on, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(oid, value...)})
+	assert.FatalError(t, err)
+	dns, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("tpm.example.com")})
+	assert.FatalError(t, err)
+	b, err := asn1.Marshal([]asn1.RawValue{{FullBytes: dns}, {FullBytes: on}})
+	assert.FatalError(t, err)
+	return pkix.Extension{Id: oidExtensionSubjectAltName, Value: b}
+}
+
+func Test_tpmAttestationVerifier_Verify(t *testing.T) {
+	ca := newTestAttestationCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+
+	ak, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	akCert := ca.issueAK(t, ak.Public(), permanentIdentifierSAN(t, "tpm-1234"))
+	rsaAK, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	rsaAKCert := ca.issueAK(t, rsaAK.Public())
+	// AK certificates without the tcg-kp-AIKCertificate usage or for a CA
+	noEKUCert := ca.issue(t, ak.Public())
+	anyEKUCert := ca.issueWith(t, ak.Public(), []asn1.ObjectIdentifier{{2, 5, 29, 37, 0}}, false)
+	caAKCert := ca.issueWith(t, ak.Public(), []asn1.ObjectIdentifier{oidTCGKpAIKCertificate}, true)
+
+	eccKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+
+	statement := func(alg int, x5c []byte, pubArea, certInfo []byte) []byte {
+		sum := sha256.Sum256(certInfo)
+		var sig []byte
+		var err error
+		switch alg {
+		case coseAlgES256:
+			sig, err = ecdsa.SignASN1(rand.Reader, ak, sum[:])
+		case coseAlgRS256:
+			sig, err = rsa.SignPKCS1v15(rand.Reader, rsaAK, crypto.SHA256, sum[:])
+		}
+		assert.FatalError(t, err)
+		return mustJSON(t, tpmAttestationStatement{
+			Ver: "2.0", Alg: alg, X5C: [][]byte{x5c}, Sig: sig, CertInfo: certInfo, PubArea: pubArea,
+		})
+	}
+
+	challenge := sha256.Sum256([]byte("token.thumbprint"))
+	eccPub := tpmECCPublic(&eccKey.PublicKey)
+	rsaPub := tpmRSAPublic(&rsaKey.PublicKey)
+	// a key that can be duplicated: without fixedTPM and fixedParent
+	movablePub := tpmECCPublicWithAttributes(&eccKey.PublicKey, 0x00040060)
+	// a key imported into the TPM: without sensitiveDataOrigin
+	importedPub := tpmECCPublicWithAttributes(&eccKey.PublicKey, 0x00040052)
+	tests := []struct {
+		name      string
+		statement []byte
+		challenge []byte
+		want      crypto.PublicKey
+		wantIDs   []string
+		wantErr   bool
+	}{
+		{"ok ecc", statement(coseAlgES256, akCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, []byte("extra"))), nil, eccKey.Public(), []string{"tpm-1234"}, false},
+		{"ok rsa", statement(coseAlgRS256, rsaAKCert, rsaPub, tpmCertifyInfo(tpmGeneratedValue, rsaPub, []byte("extra"))), nil, rsaKey.Public(), nil, false},
+		{"ok challenge", statement(coseAlgES256, akCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, challenge[:])), challenge[:], eccKey.Public(), []string{"tpm-1234"}, false},
+		{"fail challenge", statement(coseAlgES256, akCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, []byte("extra"))), challenge[:], nil, nil, true},
+		{"fail version", mustJSON(t, tpmAttestationStatement{Ver: "1.2"}), nil, nil, nil, true},
+		{"fail chain", statement(coseAlgES256, newTestAttestationCA(t).issueAK(t, ak.Public()), eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, nil)), nil, nil, nil, true},
+		{"fail AK without extended key usage", statement(coseAlgES256, noEKUCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, nil)), nil, nil, nil, true},
+		{"fail AK with any extended key usage", statement(coseAlgES256, anyEKUCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, nil)), nil, nil, nil, true},
+		{"fail AK is CA", statement(coseAlgES256, caAKCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, nil)), nil, nil, nil, true},
+		{"fail key not fixed", statement(coseAlgES256, akCert, movablePub, tpmCertifyInfo(tpmGeneratedValue, movablePub, nil)), nil, nil, nil, true},
+		{"fail key imported", statement(coseAlgES256, akCert, importedPub, tpmCertifyInfo(tpmGeneratedValue, importedPub, nil)), nil, nil, nil, true},
+		{"fail alg", statement(coseAlgRS256, akCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, eccPub, nil)), nil, nil, nil, true},
+		{"fail magic", statement(coseAlgES256, akCert, eccPub, tpmCertifyInfo(0, eccPub, nil)), nil, nil, nil, true},
+		{"fail name", statement(coseAlgES256, akCert, eccPub, tpmCertifyInfo(tpmGeneratedValue, rsaPub, nil)), nil, nil, nil, true},
+		{"fail certInfo", statement(coseAlgES256, akCert, eccPub, []byte{0xff}), nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tpmAttestationVerifier{}.Verify(tt.statement, tt.challenge, roots)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tpmAttestationVerifier.Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want != nil {
+				assert.True(t, publicKeyEqual(tt.want, got.PublicKey))
+				assert.Equals(t, tt.wantIDs, got.PermanentIdentifiers)
+			}
+		})
+	}
+}
+
+func Test_stepAttestationVerifier_Verify(t *testing.T) {
+	ca := newTestAttestationCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	serial, err := asn1.Marshal(12345678)
+	assert.FatalError(t, err)
+	yubikeyCert := ca.issue(t, key.Public(), pkix.Extension{Id: oidYubicoSerialNumber, Value: serial})
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Attested Key", SerialNumber: "SN-1234"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	deviceCert, err := x509.CreateCertificate(rand.Reader, tmpl, ca.root, key.Public(), ca.rootKey)
+	assert.FatalError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	rsaCert := ca.issue(t, rsaKey.Public())
+
+	challenge := sha256.Sum256([]byte("token.thumbprint"))
+	otherChallenge := sha256.Sum256([]byte("other.thumbprint"))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, challenge[:])
+	assert.FatalError(t, err)
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, challenge[:])
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name      string
+		statement stepAttestationStatement
+		challenge []byte
+		want      crypto.PublicKey
+		wantIDs   []string
+		wantErr   bool
+	}{
+		{"ok yubikey", stepAttestationStatement{X5C: [][]byte{yubikeyCert}}, nil, key.Public(), []string{"12345678"}, false},
+		{"ok subject serial", stepAttestationStatement{X5C: [][]byte{deviceCert}}, nil, key.Public(), []string{"SN-1234"}, false},
+		{"ok no identifiers", stepAttestationStatement{X5C: [][]byte{rsaCert}}, nil, rsaKey.Public(), nil, false},
+		{"ok challenge", stepAttestationStatement{X5C: [][]byte{yubikeyCert}, Alg: coseAlgES256, Sig: sig}, challenge[:], key.Public(), []string{"12345678"}, false},
+		{"ok challenge rsa", stepAttestationStatement{X5C: [][]byte{rsaCert}, Alg: coseAlgRS256, Sig: rsaSig}, challenge[:], rsaKey.Public(), nil, false},
+		{"fail challenge", stepAttestationStatement{X5C: [][]byte{yubikeyCert}, Alg: coseAlgES256, Sig: sig}, otherChallenge[:], nil, nil, true},
+		{"fail challenge without sig", stepAttestationStatement{X5C: [][]byte{yubikeyCert}}, challenge[:], nil, nil, true},
+		{"fail challenge alg", stepAttestationStatement{X5C: [][]byte{yubikeyCert}, Alg: coseAlgRS256, Sig: sig}, challenge[:], nil, nil, true},
+		{"fail chain", stepAttestationStatement{X5C: [][]byte{newTestAttestationCA(t).issue(t, key.Public())}}, nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stepAttestationVerifier{}.Verify(mustJSON(t, tt.statement), tt.challenge, roots)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stepAttestationVerifier.Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want != nil {
+				assert.True(t, publicKeyEqual(tt.want, got.PublicKey))
+				assert.Equals(t, tt.wantIDs, got.PermanentIdentifiers)
+			}
+		})
+	}
+}
+
+func Test_appleAttestationVerifier_Verify(t *testing.T) {
+	ca := newTestAttestationCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	challenge := sha256.Sum256([]byte("token.thumbprint"))
+	cert := ca.issue(t, key.Public(),
+		pkix.Extension{Id: oidAppleSerialNumber, Value: []byte("C02ABCDEF")},
+		pkix.Extension{Id: oidAppleUniqueDeviceIdentifier, Value: []byte("00008030-001A")},
+		pkix.Extension{Id: oidAppleNonce, Value: challenge[:]})
+	otherChallenge := sha256.Sum256([]byte("other.thumbprint"))
+
+	tests := []struct {
+		name      string
+		statement []byte
+		challenge []byte
+		want      crypto.PublicKey
+		wantErr   bool
+	}{
+		{"ok", mustJSON(t, appleAttestationStatement{X5C: [][]byte{cert}}), nil, key.Public(), false},
+		{"ok challenge", mustJSON(t, appleAttestationStatement{X5C: [][]byte{cert}}), challenge[:], key.Public(), false},
+		{"fail challenge", mustJSON(t, appleAttestationStatement{X5C: [][]byte{cert}}), otherChallenge[:], nil, true},
+		{"fail chain", mustJSON(t, appleAttestationStatement{X5C: [][]byte{newTestAttestationCA(t).issue(t, key.Public())}}), nil, nil, true},
+		{"fail statement", []byte("{"), nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appleAttestationVerifier{}.Verify(tt.statement, tt.challenge, roots)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("appleAttestationVerifier.Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want != nil {
+				assert.True(t, publicKeyEqual(tt.want, got.PublicKey))
+				assert.Equals(t, []string{"C02ABCDEF", "00008030-001A"}, got.PermanentIdentifiers)
+			}
+		})
+	}
+}
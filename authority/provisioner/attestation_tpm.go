@@ -0,0 +1,340 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// TPM 2.0 constants used to parse the attestation structures.
+const (
+	tpmGeneratedValue     = 0xff544347
+	tpmSTAttestCertify    = 0x8017
+	tpmAlgRSA             = 0x0001
+	tpmAlgSHA1            = 0x0004
+	tpmAlgSHA256          = 0x000B
+	tpmAlgSHA384          = 0x000C
+	tpmAlgSHA512          = 0x000D
+	tpmAlgNull            = 0x0010
+	tpmAlgECC             = 0x0023
+	tpmECCNistP256        = 0x0003
+	tpmECCNistP384        = 0x0004
+	tpmECCNistP521        = 0x0005
+	tpmDefaultRSAExponent = 65537
+
+	// TPMA_OBJECT attributes required in the certified keys.
+	tpmaObjectFixedTPM            = 0x00000002
+	tpmaObjectFixedParent         = 0x00000010
+	tpmaObjectSensitiveDataOrigin = 0x00000020
+	tpmaObjectRequired            = tpmaObjectFixedTPM | tpmaObjectFixedParent | tpmaObjectSensitiveDataOrigin
+)
+
+// oidTCGKpAIKCertificate is the extended key usage of the AK certificates.
+var oidTCGKpAIKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+
+// tpmAttestationStatement is the statement of the "tpm" format. It follows the
+// WebAuthn "tpm" attestation statement: certInfo is a TPMS_ATTEST structure
+// signed by the attestation key (AK) in x5c[0], certifying the key described by
+// the TPMT_PUBLIC structure in pubArea.
+type tpmAttestationStatement struct {
+	Ver      string   `json:"ver"`
+	Alg      int      `json:"alg"`
+	X5C      [][]byte `json:"x5c"`
+	Sig      []byte   `json:"sig"`
+	CertInfo []byte   `json:"certInfo"`
+	PubArea  []byte   `json:"pubArea"`
+}
+
+type tpmAttestationVerifier struct{}
+
+// Verify verifies the AK certificate chain, the signature of certInfo and that
+// certInfo certifies pubArea and, if given, the challenge in its extraData. The
+// AK certificate must be a leaf with the tcg-kp-AIKCertificate extended key
+// usage, and the key in pubArea must have been generated in the TPM and cannot
+// leave it: fixedTPM, fixedParent and sensitiveDataOrigin. It returns the
+// public key in pubArea, and the permanent identifiers are the ones in the
+// subject alternative names of the AK certificate.
+func (tpmAttestationVerifier) Verify(statement, challenge []byte, roots *x509.CertPool) (*AttestationData, error) {
+	var st tpmAttestationStatement
+	if err := json.Unmarshal(statement, &st); err != nil {
+		return nil, errors.Wrap(err, "error parsing statement")
+	}
+	if st.Ver != "2.0" {
+		return nil, errors.Errorf("unsupported tpm version '%s'", st.Ver)
+	}
+
+	ak, err := verifyAttestationChain(st.X5C, roots)
+	if err != nil {
+		return nil, err
+	}
+	if ak.IsCA {
+		return nil, errors.New("AK certificate cannot be a CA")
+	}
+	if !hasExtKeyUsage(ak, oidTCGKpAIKCertificate) {
+		return nil, errors.New("AK certificate does not have the tcg-kp-AIKCertificate extended key usage")
+	}
+
+	// Verify the certInfo signature with the AK
+	sum := crypto.SHA256.New()
+	sum.Write(st.CertInfo)
+	if err := verifyCOSESignature(ak.PublicKey, st.Alg, sum.Sum(nil), st.Sig); err != nil {
+		return nil, errors.Wrap(err, "error verifying certInfo signature")
+	}
+
+	// Verify that certInfo certifies pubArea
+	name, extraData, err := parseTPMCertifyInfo(st.CertInfo)
+	if err != nil {
+		return nil, err
+	}
+	if len(name) < 2 {
+		return nil, errors.New("error parsing certInfo: invalid attested name")
+	}
+	h, err := tpmHash(binary.BigEndian.Uint16(name))
+	if err != nil {
+		return nil, err
+	}
+	hh := h.New()
+	hh.Write(st.PubArea)
+	if !bytes.Equal(name[2:], hh.Sum(nil)) {
+		return nil, errors.New("certInfo attested name does not match pubArea")
+	}
+	if len(challenge) > 0 && !bytes.Equal(extraData, challenge) {
+		return nil, errors.New("certInfo extraData does not match the challenge")
+	}
+
+	key, attributes, err := parseTPMPublic(st.PubArea)
+	if err != nil {
+		return nil, err
+	}
+	if attributes&tpmaObjectRequired != tpmaObjectRequired {
+		return nil, errors.Errorf("pubArea object attributes 0x%08x are missing fixedTPM, fixedParent or sensitiveDataOrigin", attributes)
+	}
+	ids, err := parsePermanentIdentifiers(ak)
+	if err != nil {
+		return nil, err
+	}
+	return &AttestationData{
+		PublicKey:            key,
+		PermanentIdentifiers: ids,
+	}, nil
+}
+
+var (
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidPermanentIdentifier     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 3}
+)
+
+// hasExtKeyUsage returns true if the certificate has the given extended key
+// usage.
+func hasExtKeyUsage(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, eku := range cert.UnknownExtKeyUsage {
+		if eku.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// otherName is the otherName form of a subject alternative name.
+type otherName struct {
+	TypeID asn1.ObjectIdentifier
+	Value  asn1.RawValue `asn1:"tag:0,explicit"`
+}
+
+// permanentIdentifier is the PermanentIdentifier defined in RFC 4043.
+type permanentIdentifier struct {
+	IdentifierValue string                `asn1:"utf8,optional"`
+	Assigner        asn1.ObjectIdentifier `asn1:"optional"`
+}
+
+// parsePermanentIdentifiers returns the values of the permanentIdentifier
+// subject alternative names of the certificate, as used in the TPM AK
+// certificates.
+func parsePermanentIdentifiers(cert *x509.Certificate) ([]string, error) {
+	var ids []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return nil, errors.Wrap(err, "error parsing subject alternative names")
+		}
+		for _, name := range names {
+			// otherName [0]
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var on otherName
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &on, "tag:0"); err != nil {
+				return nil, errors.Wrap(err, "error parsing subject alternative names")
+			}
+			if !on.TypeID.Equal(oidPermanentIdentifier) {
+				continue
+			}
+			var pi permanentIdentifier
+			if _, err := asn1.Unmarshal(on.Value.Bytes, &pi); err != nil {
+				return nil, errors.Wrap(err, "error parsing permanent identifier")
+			}
+			if pi.IdentifierValue != "" {
+				ids = append(ids, pi.IdentifierValue)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// tpmHash returns the hash function for the given TPM algorithm.
+func tpmHash(alg uint16) (crypto.Hash, error) {
+	switch alg {
+	case tpmAlgSHA1:
+		return crypto.SHA1, nil
+	case tpmAlgSHA256:
+		return crypto.SHA256, nil
+	case tpmAlgSHA384:
+		return crypto.SHA384, nil
+	case tpmAlgSHA512:
+		return crypto.SHA512, nil
+	default:
+		return 0, errors.Errorf("unsupported tpm hash algorithm 0x%04x", alg)
+	}
+}
+
+// tpmReader reads the big-endian TPM structures.
+type tpmReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *tpmReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, v)
+	}
+}
+
+func (r *tpmReader) uint16() (v uint16) {
+	r.read(&v)
+	return
+}
+
+func (r *tpmReader) uint32() (v uint32) {
+	r.read(&v)
+	return
+}
+
+// sized reads a TPM2B structure.
+func (r *tpmReader) sized() []byte {
+	size := r.uint16()
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.err = err
+		return nil
+	}
+	return b
+}
+
+func (r *tpmReader) skip(n int64) {
+	if r.err == nil {
+		_, r.err = r.r.Seek(n, io.SeekCurrent)
+	}
+}
+
+// parseTPMCertifyInfo parses a TPMS_ATTEST structure of type
+// TPM_ST_ATTEST_CERTIFY and returns the name of the certified object and the
+// extraData.
+func parseTPMCertifyInfo(b []byte) ([]byte, []byte, error) {
+	r := &tpmReader{r: bytes.NewReader(b)}
+	magic := r.uint32()
+	typ := r.uint16()
+	r.sized() // qualifiedSigner
+	extraData := r.sized()
+	r.skip(17) // clockInfo
+	r.skip(8)  // firmwareVersion
+	name := r.sized()
+	r.sized() // qualifiedName
+	switch {
+	case r.err != nil:
+		return nil, nil, errors.Wrap(r.err, "error parsing certInfo")
+	case magic != tpmGeneratedValue:
+		return nil, nil, errors.New("error parsing certInfo: invalid magic value")
+	case typ != tpmSTAttestCertify:
+		return nil, nil, errors.New("error parsing certInfo: invalid type")
+	}
+	return name, extraData, nil
+}
+
+// parseTPMPublic parses a TPMT_PUBLIC structure and returns the public key and
+// the object attributes.
+func parseTPMPublic(b []byte) (crypto.PublicKey, uint32, error) {
+	r := &tpmReader{r: bytes.NewReader(b)}
+	typ := r.uint16()
+	r.uint16() // nameAlg
+	attributes := r.uint32()
+	r.sized() // authPolicy
+	// symmetric
+	if r.uint16() != tpmAlgNull {
+		r.skip(4)
+	}
+	// scheme
+	if r.uint16() != tpmAlgNull {
+		r.skip(2)
+	}
+
+	switch typ {
+	case tpmAlgRSA:
+		r.uint16() // keyBits
+		exp := r.uint32()
+		n := r.sized()
+		if r.err != nil {
+			return nil, 0, errors.Wrap(r.err, "error parsing pubArea")
+		}
+		if exp == 0 {
+			exp = tpmDefaultRSAExponent
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exp),
+		}, attributes, nil
+	case tpmAlgECC:
+		curveID := r.uint16()
+		// kdf
+		if r.uint16() != tpmAlgNull {
+			r.skip(2)
+		}
+		x, y := r.sized(), r.sized()
+		if r.err != nil {
+			return nil, 0, errors.Wrap(r.err, "error parsing pubArea")
+		}
+		var curve elliptic.Curve
+		switch curveID {
+		case tpmECCNistP256:
+			curve = elliptic.P256()
+		case tpmECCNistP384:
+			curve = elliptic.P384()
+		case tpmECCNistP521:
+			curve = elliptic.P521()
+		default:
+			return nil, 0, errors.Errorf("error parsing pubArea: unsupported curve 0x%04x", curveID)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, attributes, nil
+	default:
+		return nil, 0, errors.Errorf("error parsing pubArea: unsupported key type 0x%04x", typ)
+	}
+}
@@ -125,14 +125,21 @@ type awsInstanceIdentityDocument struct {
 // https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
 type AWS struct {
 	*base
-	Type                   string   `json:"type"`
-	Name                   string   `json:"name"`
-	Accounts               []string `json:"accounts"`
-	DisableCustomSANs      bool     `json:"disableCustomSANs"`
-	DisableTrustOnFirstUse bool     `json:"disableTrustOnFirstUse"`
-	InstanceAge            Duration `json:"instanceAge,omitempty"`
-	Claims                 *Claims  `json:"claims,omitempty"`
+	Type                   string              `json:"type"`
+	Name                   string              `json:"name"`
+	Disabled               bool                `json:"disabled,omitempty"`
+	Accounts               []string            `json:"accounts"`
+	DisableCustomSANs      bool                `json:"disableCustomSANs"`
+	DisableTrustOnFirstUse bool                `json:"disableTrustOnFirstUse"`
+	InstanceAge            Duration            `json:"instanceAge,omitempty"`
+	Claims                 *Claims             `json:"claims,omitempty"`
+	X509                   *X509Options        `json:"x509,omitempty"`
+	SSH                    *SSHTemplateOptions `json:"ssh,omitempty"`
+	SSHPolicy              *SSHPolicy          `json:"sshPolicy,omitempty"`
+	Webhooks               []*Webhook          `json:"webhooks,omitempty"`
+	Attestation            *AttestationOptions `json:"attestation,omitempty"`
 	claimer                *Claimer
+	x509                   *X509Options
 	config                 *awsConfig
 	audiences              Audiences
 }
@@ -154,7 +161,13 @@ func (p *AWS) GetTokenID(token string) (string, error) {
 		sum := sha256.Sum256([]byte(token))
 		return strings.ToLower(hex.EncodeToString(sum[:])), nil
 	}
-	return payload.ID, nil
+
+	// Create unique ID for Trust On First Use (TOFU). Only the first request
+	// per instance is allowed. The ID is derived from the signed identity
+	// document because the token ID is chosen by the client.
+	unique := fmt.Sprintf("%s.%s", p.GetID(), payload.document.InstanceID)
+	sum := sha256.Sum256([]byte(unique))
+	return strings.ToLower(hex.EncodeToString(sum[:])), nil
 }
 
 // GetName returns the name of the provisioner.
@@ -167,6 +180,11 @@ func (p *AWS) GetType() Type {
 	return TypeAWS
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *AWS) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey is not available in an AWS provisioner.
 func (p *AWS) GetEncryptedKey() (kid string, key string, ok bool) {
 	return "", "", false
@@ -259,6 +277,19 @@ func (p *AWS) Init(config Config) (err error) {
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
 		return err
 	}
+
+	// Parse the x509 and SSH templates and validate the webhooks
+	if p.x509, err = initTemplateOptions(p.X509, p.SSH, p.Webhooks, p.Name, config); err != nil {
+		return err
+	}
+	if err = p.SSHPolicy.init(p.Name); err != nil {
+		return err
+	}
+
+	// Load the attestation roots
+	if err = p.Attestation.init(); err != nil {
+		return err
+	}
 	// Add default config
 	if p.config, err = newAWSConfig(); err != nil {
 		return err
@@ -289,7 +320,7 @@ func (p *AWS) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 		}))
 	}
 
-	return append(so,
+	so = append(so,
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeAWS, p.Name, doc.AccountID, "InstanceID", doc.InstanceID),
 		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
@@ -297,7 +328,10 @@ func (p *AWS) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 		defaultPublicKeyValidator{},
 		commonNameValidator(payload.Claims.Subject),
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	), nil
+		newAttestationValidator(p.Attestation, token),
+	)
+	data := newTemplateData(payload.Claims.Subject, nil, token)
+	return append(so, templateSignOptions(ctx, p.x509, p.Webhooks, p.Name, data)...), nil
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
@@ -473,7 +507,7 @@ func (p *AWS) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 	// Set defaults if not given as user options
 	signOptions = append(signOptions, sshCertDefaultsModifier(defaults))
 
-	return append(signOptions,
+	signOptions = append(signOptions,
 		// Set the default extensions.
 		&sshDefaultExtensionModifier{},
 		// Set the validity bounds if not set.
@@ -484,5 +518,7 @@ func (p *AWS) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 		&sshCertValidityValidator{p.claimer},
 		// Require all the fields in the SSH certificate
 		&sshCertDefaultValidator{},
-	), nil
+	)
+	signOptions = append(signOptions, sshTemplateSignOptions(p.SSH, p.Name, token)...)
+	return append(signOptions, sshPolicySignOptions(p.SSHPolicy, nil, false)...), nil
 }
@@ -65,6 +65,25 @@ func TestAWS_GetTokenID(t *testing.T) {
 	sum = sha256.Sum256([]byte(t2))
 	w2 := strings.ToLower(hex.EncodeToString(sum[:]))
 
+	// With TOFU the id depends only on the instance, a different token for
+	// the same instance cannot be reused.
+	block, _ := pem.Decode([]byte(awsTestKey))
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		t.Fatal("error decoding AWS key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	assert.FatalError(t, err)
+	t3, err := generateAWSToken(
+		"foo.local", awsIssuer, p1.GetID(), p1.Accounts[0], claims.document.InstanceID,
+		"127.0.0.1", "us-west-1", time.Now().Add(-30*time.Second), key)
+	assert.FatalError(t, err)
+	t4, err := generateAWSToken(
+		"foo.local", awsIssuer, p2.GetID(), p2.Accounts[0], claims.document.InstanceID,
+		"127.0.0.1", "us-west-1", time.Now().Add(-30*time.Second), key)
+	assert.FatalError(t, err)
+	sum = sha256.Sum256([]byte(t4))
+	w4 := strings.ToLower(hex.EncodeToString(sum[:]))
+
 	type args struct {
 		token string
 	}
@@ -77,6 +96,8 @@ func TestAWS_GetTokenID(t *testing.T) {
 	}{
 		{"ok", p1, args{t1}, w1, false},
 		{"ok no TOFU", p2, args{t2}, w2, false},
+		{"ok same instance", p1, args{t3}, w1, false},
+		{"ok same instance no TOFU", p2, args{t4}, w4, false},
 		{"fail", p1, args{"bad-token"}, "", true},
 	}
 	for _, tt := range tests {
@@ -527,6 +548,11 @@ func TestAWS_AuthorizeSign(t *testing.T) {
 		"instance-id", awsIssuer, p2.GetID(), p2.Accounts[0], "instance-id",
 		"127.0.0.1", "us-west-1", time.Now().Add(-1*time.Minute), key)
 	assert.FatalError(t, err)
+	// p1 does not limit the instance age
+	oldInstance, err := generateAWSToken(
+		"instance-id", awsIssuer, p1.GetID(), p1.Accounts[0], "instance-id",
+		"127.0.0.1", "us-west-1", time.Now().Add(-1*time.Minute), key)
+	assert.FatalError(t, err)
 
 	type args struct {
 		token string
@@ -539,11 +565,12 @@ func TestAWS_AuthorizeSign(t *testing.T) {
 		code    int
 		wantErr bool
 	}{
-		{"ok", p1, args{t1}, 5, http.StatusOK, false},
-		{"ok", p2, args{t2}, 7, http.StatusOK, false},
-		{"ok", p2, args{t2Hostname}, 7, http.StatusOK, false},
-		{"ok", p2, args{t2PrivateIP}, 7, http.StatusOK, false},
-		{"ok", p1, args{t4}, 5, http.StatusOK, false},
+		{"ok", p1, args{t1}, 6, http.StatusOK, false},
+		{"ok", p2, args{t2}, 8, http.StatusOK, false},
+		{"ok", p2, args{t2Hostname}, 8, http.StatusOK, false},
+		{"ok", p2, args{t2PrivateIP}, 8, http.StatusOK, false},
+		{"ok", p1, args{t4}, 6, http.StatusOK, false},
+		{"ok no instance age", p1, args{oldInstance}, 6, http.StatusOK, false},
 		{"fail account", p3, args{t3}, 0, http.StatusUnauthorized, true},
 		{"fail token", p1, args{"token"}, 0, http.StatusUnauthorized, true},
 		{"fail subject", p1, args{failSubject}, 0, http.StatusUnauthorized, true},
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -21,14 +22,27 @@ import (
 const azureOIDCBaseURL = "https://login.microsoftonline.com"
 
 // azureIdentityTokenURL is the URL to get the identity token for an instance.
-const azureIdentityTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F"
+const azureIdentityTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// azureIdentityTokenAPIVersion is the API version used to get the identity
+// token.
+const azureIdentityTokenAPIVersion = "2018-02-01"
+
+// azureIdentityTokenMaxRetries is the maximum number of times the request to
+// get the identity token is retried.
+const azureIdentityTokenMaxRetries = 5
+
+// azureIdentityTokenBackoff is the initial time to wait before retrying the
+// request to get the identity token. It's doubled on each retry as the
+// instance metadata service documentation recommends.
+var azureIdentityTokenBackoff = time.Second
 
 // azureDefaultAudience is the default audience used.
 const azureDefaultAudience = "https://management.azure.com/"
 
 // azureXMSMirIDRegExp is the regular expression used to parse the xms_mirid claim.
 // Using case insensitive as resourceGroups appears as resourcegroups.
-var azureXMSMirIDRegExp = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft.Compute/virtualMachines/([^/]+)$`)
+var azureXMSMirIDRegExp = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Compute/virtualMachines/([^/]+)$`)
 
 type azureConfig struct {
 	oidcDiscoveryURL string
@@ -70,8 +84,12 @@ type azurePayload struct {
 //
 // The default audience is "https://management.azure.com/".
 //
-// If DisableCustomSANs is true, only the internal DNS and IP will be added as a
-// SAN. By default it will accept any SAN in the CSR.
+// If SubscriptionIDs or ResourceGroups are set, only the virtual machines in
+// the given subscriptions or resource groups will be accepted.
+//
+// If DisableCustomSANs is true, only the virtual machine name, and the name
+// with the DNSSuffix if configured, will be added as a SAN. By default it will
+// accept any SAN in the CSR.
 //
 // If DisableTrustOnFirstUse is true, multiple sign request for this provisioner
 // with the same instance will be accepted. By default only the first request
@@ -82,15 +100,24 @@ type azurePayload struct {
 // and https://docs.microsoft.com/en-us/azure/virtual-machines/windows/instance-metadata-service
 type Azure struct {
 	*base
-	Type                   string   `json:"type"`
-	Name                   string   `json:"name"`
-	TenantID               string   `json:"tenantId"`
-	ResourceGroups         []string `json:"resourceGroups"`
-	Audience               string   `json:"audience,omitempty"`
-	DisableCustomSANs      bool     `json:"disableCustomSANs"`
-	DisableTrustOnFirstUse bool     `json:"disableTrustOnFirstUse"`
-	Claims                 *Claims  `json:"claims,omitempty"`
+	Type                   string              `json:"type"`
+	Name                   string              `json:"name"`
+	Disabled               bool                `json:"disabled,omitempty"`
+	TenantID               string              `json:"tenantId"`
+	SubscriptionIDs        []string            `json:"subscriptionIDs,omitempty"`
+	ResourceGroups         []string            `json:"resourceGroups"`
+	Audience               string              `json:"audience,omitempty"`
+	DNSSuffix              string              `json:"dnsSuffix,omitempty"`
+	DisableCustomSANs      bool                `json:"disableCustomSANs"`
+	DisableTrustOnFirstUse bool                `json:"disableTrustOnFirstUse"`
+	Claims                 *Claims             `json:"claims,omitempty"`
+	X509                   *X509Options        `json:"x509,omitempty"`
+	SSH                    *SSHTemplateOptions `json:"ssh,omitempty"`
+	SSHPolicy              *SSHPolicy          `json:"sshPolicy,omitempty"`
+	Webhooks               []*Webhook          `json:"webhooks,omitempty"`
+	Attestation            *AttestationOptions `json:"attestation,omitempty"`
 	claimer                *Claimer
+	x509                   *X509Options
 	config                 *azureConfig
 	oidcConfig             openIDConfiguration
 	keyStore               *keyStore
@@ -137,34 +164,57 @@ func (p *Azure) GetType() Type {
 	return TypeAzure
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *Azure) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey is not available in an Azure provisioner.
 func (p *Azure) GetEncryptedKey() (kid string, key string, ok bool) {
 	return "", "", false
 }
 
 // GetIdentityToken retrieves from the metadata service the identity token and
-// returns it.
+// returns it. Requests that fail with a transient error are retried with an
+// exponential backoff.
 func (p *Azure) GetIdentityToken(subject, caURL string) (string, error) {
 	// Initialize the config if this method is used from the cli.
 	p.assertConfig()
 
-	req, err := http.NewRequest("GET", p.config.identityTokenURL, http.NoBody)
+	audience := p.Audience
+	if audience == "" {
+		audience = azureDefaultAudience
+	}
+	q := url.Values{}
+	q.Add("api-version", azureIdentityTokenAPIVersion)
+	q.Add("resource", audience)
+
+	req, err := http.NewRequest("GET", p.config.identityTokenURL+"?"+q.Encode(), http.NoBody)
 	if err != nil {
 		return "", errors.Wrap(err, "error creating request")
 	}
 	req.Header.Set("Metadata", "true")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", errors.Wrap(err, "error getting identity token, are you in a Azure VM?")
-	}
-	defer resp.Body.Close()
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", errors.Wrap(err, "error reading identity token response")
-	}
-	if resp.StatusCode >= 400 {
-		return "", errors.Errorf("error getting identity token: status=%d, response=%s", resp.StatusCode, b)
+	var b []byte
+	backoff := azureIdentityTokenBackoff
+	for i := 0; ; i++ {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", errors.Wrap(err, "error getting identity token, are you in a Azure VM?")
+		}
+		b, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", errors.Wrap(err, "error reading identity token response")
+		}
+		if resp.StatusCode < 400 {
+			break
+		}
+		if i == azureIdentityTokenMaxRetries || !isAzureRetryableStatus(resp.StatusCode) {
+			return "", errors.Errorf("error getting identity token: status=%d, response=%s", resp.StatusCode, b)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
 
 	var identityToken azureIdentityToken
@@ -175,6 +225,17 @@ func (p *Azure) GetIdentityToken(subject, caURL string) (string, error) {
 	return identityToken.AccessToken, nil
 }
 
+// isAzureRetryableStatus returns true if a request to the instance metadata
+// service that returned the given status code should be retried.
+func isAzureRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusNotFound, http.StatusGone, http.StatusTooManyRequests:
+		return true
+	default:
+		return code >= 500
+	}
+}
+
 // Init validates and initializes the Azure provisioner.
 func (p *Azure) Init(config Config) (err error) {
 	switch {
@@ -195,6 +256,19 @@ func (p *Azure) Init(config Config) (err error) {
 		return err
 	}
 
+	// Parse the x509 and SSH templates and validate the webhooks
+	if p.x509, err = initTemplateOptions(p.X509, p.SSH, p.Webhooks, p.Name, config); err != nil {
+		return err
+	}
+	if err = p.SSHPolicy.init(p.Name); err != nil {
+		return err
+	}
+
+	// Load the attestation roots
+	if err = p.Attestation.init(); err != nil {
+		return err
+	}
+
 	// Decode and validate openid-configuration endpoint
 	if err := getAndDecode(p.config.oidcDiscoveryURL, &p.oidcConfig); err != nil {
 		return err
@@ -242,58 +316,89 @@ func (p *Azure) authorizeToken(token string) (*azurePayload, string, string, err
 	}
 
 	// Validate TenantID
-	if claims.TenantID != p.TenantID {
+	if !strings.EqualFold(claims.TenantID, p.TenantID) {
 		return nil, "", "", errs.Unauthorized("azure.authorizeToken; azure token validation failed - invalid tenant id claim (tid)")
 	}
 
-	re := azureXMSMirIDRegExp.FindStringSubmatch(claims.XMSMirID)
-	if len(re) != 4 {
-		return nil, "", "", errs.Unauthorized("azure.authorizeToken; error parsing xms_mirid claim - %s", claims.XMSMirID)
+	subscription, group, name, err := parseAzureXMSMirID(claims.XMSMirID)
+	if err != nil {
+		return nil, "", "", errs.Unauthorized("azure.authorizeToken; %s", err)
 	}
-	group, name := re[2], re[3]
+
+	// Filter by subscription
+	if len(p.SubscriptionIDs) > 0 && !containsFold(p.SubscriptionIDs, subscription) {
+		return nil, "", "", errs.Unauthorized("azure.authorizeToken; azure token validation failed - invalid subscription id")
+	}
+
+	// Filter by resource group
+	if len(p.ResourceGroups) > 0 && !containsFold(p.ResourceGroups, group) {
+		return nil, "", "", errs.Unauthorized("azure.authorizeToken; azure token validation failed - invalid resource group")
+	}
+
 	return &claims, name, group, nil
 }
 
+// parseAzureXMSMirID parses the xms_mirid claim of a virtual machine and
+// returns the subscription id, resource group and virtual machine name.
+func parseAzureXMSMirID(mirID string) (subscription, group, name string, err error) {
+	re := azureXMSMirIDRegExp.FindStringSubmatch(mirID)
+	if len(re) != 4 {
+		return "", "", "", errors.Errorf("error parsing xms_mirid claim - %s", mirID)
+	}
+	return re[1], re[2], re[3], nil
+}
+
+// containsFold returns true if the slice contains the string s using a case
+// insensitive comparison. Azure resource ids are case insensitive.
+func containsFold(slice []string, s string) bool {
+	for _, v := range slice {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsNames returns the DNS names of a virtual machine, the name and if
+// configured the name with the DNS suffix.
+func (p *Azure) dnsNames(name string) []string {
+	if p.DNSSuffix == "" {
+		return []string{name}
+	}
+	return []string{name, name + "." + strings.TrimPrefix(p.DNSSuffix, ".")}
+}
+
 // AuthorizeSign validates the given token and returns the sign options that
 // will be used on certificate creation.
 func (p *Azure) AuthorizeSign(ctx context.Context, token string) ([]SignOption, error) {
-	_, name, group, err := p.authorizeToken(token)
+	claims, name, _, err := p.authorizeToken(token)
 	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "azure.AuthorizeSign")
 	}
 
-	// Filter by resource group
-	if len(p.ResourceGroups) > 0 {
-		var found bool
-		for _, g := range p.ResourceGroups {
-			if g == group {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return nil, errs.Unauthorized("azure.AuthorizeSign; azure token validation failed - invalid resource group")
-		}
-	}
-
 	// Enforce known common name and default DNS if configured.
 	// By default we'll accept the CN and SANs in the CSR.
 	// There's no way to trust them other than TOFU.
 	var so []SignOption
 	if p.DisableCustomSANs {
-		// name will work only inside the virtual network
-		so = append(so, commonNameValidator(name))
-		so = append(so, dnsNamesValidator([]string{name}))
+		// name will work only inside the virtual network, the DNS suffix can
+		// be used to add a fully qualified name.
+		dnsNames := p.dnsNames(name)
+		so = append(so, commonNameSliceValidator(dnsNames))
+		so = append(so, dnsNamesValidator(dnsNames))
 	}
 
-	return append(so,
+	so = append(so,
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeAzure, p.Name, p.TenantID),
 		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	), nil
+		newAttestationValidator(p.Attestation, token),
+	)
+	data := newTemplateData(claims.Subject, nil, token)
+	return append(so, templateSignOptions(ctx, p.x509, p.Webhooks, p.Name, data)...), nil
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
@@ -325,7 +430,7 @@ func (p *Azure) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOptio
 	// Only enforce known principals if disable custom sans is true.
 	var principals []string
 	if p.DisableCustomSANs {
-		principals = []string{name}
+		principals = p.dnsNames(name)
 	}
 
 	// Default to host + known hostnames
@@ -338,7 +443,7 @@ func (p *Azure) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOptio
 	// Set defaults if not given as user options
 	signOptions = append(signOptions, sshCertDefaultsModifier(defaults))
 
-	return append(signOptions,
+	signOptions = append(signOptions,
 		// Set the default extensions.
 		&sshDefaultExtensionModifier{},
 		// Set the validity bounds if not set.
@@ -349,7 +454,9 @@ func (p *Azure) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOptio
 		&sshCertValidityValidator{p.claimer},
 		// Require all the fields in the SSH certificate
 		&sshCertDefaultValidator{},
-	), nil
+	)
+	signOptions = append(signOptions, sshTemplateSignOptions(p.SSH, p.Name, token)...)
+	return append(signOptions, sshPolicySignOptions(p.SSHPolicy, nil, false)...), nil
 }
 
 // assertConfig initializes the config if it has not been initialized
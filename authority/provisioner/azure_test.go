@@ -145,6 +145,103 @@ func TestAzure_GetIdentityToken(t *testing.T) {
 	}
 }
 
+func TestAzure_GetIdentityToken_retry(t *testing.T) {
+	p1, err := generateAzure()
+	assert.FatalError(t, err)
+	p1.Audience = "https://ca.smallstep.com/"
+
+	defer func(d time.Duration) {
+		azureIdentityTokenBackoff = d
+	}(azureIdentityTokenBackoff)
+	azureIdentityTokenBackoff = time.Millisecond
+
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		assert.Equals(t, "true", r.Header.Get("Metadata"))
+		assert.Equals(t, "https://ca.smallstep.com/", r.URL.Query().Get("resource"))
+		assert.Equals(t, azureIdentityTokenAPIVersion, r.URL.Query().Get("api-version"))
+		switch r.URL.Path {
+		case "/gone":
+			// Returned by the metadata service while it's starting
+			if hits < 3 {
+				http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+				return
+			}
+		case "/throttled":
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		case "/bad-request":
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-token"}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		want     string
+		wantHits int
+		wantErr  bool
+	}{
+		{"ok", "/", "the-token", 1, false},
+		{"ok retry", "/gone", "the-token", 3, false},
+		{"fail retries", "/throttled", "", azureIdentityTokenMaxRetries + 1, true},
+		{"fail no retry", "/bad-request", "", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits = 0
+			p1.config.identityTokenURL = srv.URL + tt.path
+			got, err := p1.GetIdentityToken("subject", "caURL")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Azure.GetIdentityToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equals(t, tt.want, got)
+			assert.Equals(t, tt.wantHits, hits)
+		})
+	}
+}
+
+func Test_parseAzureXMSMirID(t *testing.T) {
+	tests := []struct {
+		name             string
+		mirID            string
+		wantSubscription string
+		wantGroup        string
+		wantName         string
+		wantErr          bool
+	}{
+		{"ok", "/subscriptions/subscriptionID/resourceGroups/resourceGroup/providers/Microsoft.Compute/virtualMachines/virtualMachine", "subscriptionID", "resourceGroup", "virtualMachine", false},
+		{"ok lowercase", "/subscriptions/subscriptionID/resourcegroups/resourceGroup/providers/microsoft.compute/virtualmachines/virtualMachine", "subscriptionID", "resourceGroup", "virtualMachine", false},
+		{"fail empty", "", "", "", "", true},
+		{"fail garbage", "foo", "", "", "", true},
+		{"fail no leading slash", "subscriptions/subscriptionID/resourceGroups/resourceGroup/providers/Microsoft.Compute/virtualMachines/virtualMachine", "", "", "", true},
+		{"fail trailing slash", "/subscriptions/subscriptionID/resourceGroups/resourceGroup/providers/Microsoft.Compute/virtualMachines/virtualMachine/", "", "", "", true},
+		{"fail empty subscription", "/subscriptions//resourceGroups/resourceGroup/providers/Microsoft.Compute/virtualMachines/virtualMachine", "", "", "", true},
+		{"fail empty group", "/subscriptions/subscriptionID/resourceGroups//providers/Microsoft.Compute/virtualMachines/virtualMachine", "", "", "", true},
+		{"fail empty name", "/subscriptions/subscriptionID/resourceGroups/resourceGroup/providers/Microsoft.Compute/virtualMachines/", "", "", "", true},
+		{"fail extra segments", "/subscriptions/subscriptionID/resourceGroups/resourceGroup/providers/Microsoft.Compute/virtualMachines/virtualMachine/extensions/foo", "", "", "", true},
+		{"fail user assigned identity", "/subscriptions/subscriptionID/resourcegroups/resourceGroup/providers/Microsoft.ManagedIdentity/userAssignedIdentities/identity", "", "", "", true},
+		{"fail scale set", "/subscriptions/subscriptionID/resourceGroups/resourceGroup/providers/Microsoft.Compute/virtualMachineScaleSets/scaleSet/virtualMachines/0", "", "", "", true},
+		{"fail provider", "/subscriptions/subscriptionID/resourceGroups/resourceGroup/providers/MicrosoftXCompute/virtualMachines/virtualMachine", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subscription, group, name, err := parseAzureXMSMirID(tt.mirID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAzureXMSMirID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equals(t, tt.wantSubscription, subscription)
+			assert.Equals(t, tt.wantGroup, group)
+			assert.Equals(t, tt.wantName, name)
+		})
+	}
+}
+
 func TestAzure_Init(t *testing.T) {
 	p1, srv, err := generateAzureWithServer()
 	assert.FatalError(t, err)
@@ -316,6 +413,38 @@ func TestAzure_authorizeToken(t *testing.T) {
 				err:   errors.New("azure.authorizeToken; error parsing xms_mirid claim - foo"),
 			}
 		},
+		"fail/invalid-subscription": func(t *testing.T) test {
+			p, srv, err := generateAzureWithServer()
+			assert.FatalError(t, err)
+			defer srv.Close()
+			p.SubscriptionIDs = []string{"otherSubscriptionID"}
+			tok, err := generateAzureToken("subject", p.oidcConfig.Issuer, azureDefaultAudience,
+				p.TenantID, "subscriptionID", "resourceGroup", "virtualMachine",
+				time.Now(), &p.keyStore.keySet.Keys[0])
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("azure.authorizeToken; azure token validation failed - invalid subscription id"),
+			}
+		},
+		"fail/invalid-resource-group": func(t *testing.T) test {
+			p, srv, err := generateAzureWithServer()
+			assert.FatalError(t, err)
+			defer srv.Close()
+			p.ResourceGroups = []string{"otherResourceGroup"}
+			tok, err := generateAzureToken("subject", p.oidcConfig.Issuer, azureDefaultAudience,
+				p.TenantID, "subscriptionID", "resourceGroup", "virtualMachine",
+				time.Now(), &p.keyStore.keySet.Keys[0])
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("azure.authorizeToken; azure token validation failed - invalid resource group"),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			p, srv, err := generateAzureWithServer()
 			assert.FatalError(t, err)
@@ -329,6 +458,22 @@ func TestAzure_authorizeToken(t *testing.T) {
 				token: tok,
 			}
 		},
+		"ok/allowlists": func(t *testing.T) test {
+			p, srv, err := generateAzureWithServer()
+			assert.FatalError(t, err)
+			defer srv.Close()
+			p.SubscriptionIDs = []string{"otherSubscriptionID", "SubscriptionID"}
+			p.ResourceGroups = []string{"resourcegroup"}
+			// tenant ids are case insensitive
+			tok, err := generateAzureToken("subject", p.oidcConfig.Issuer, azureDefaultAudience,
+				strings.ToUpper(p.TenantID), "subscriptionID", "resourceGroup", "virtualMachine",
+				time.Now(), &p.keyStore.keySet.Keys[0])
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+			}
+		},
 	}
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -382,6 +527,14 @@ func TestAzure_AuthorizeSign(t *testing.T) {
 	p4.oidcConfig = p1.oidcConfig
 	p4.keyStore = p1.keyStore
 
+	p5, err := generateAzure()
+	assert.FatalError(t, err)
+	p5.TenantID = p1.TenantID
+	p5.SubscriptionIDs = []string{"foobarzar"}
+	p5.config = p1.config
+	p5.oidcConfig = p1.oidcConfig
+	p5.keyStore = p1.keyStore
+
 	badKey, err := generateJSONWebKey()
 	assert.FatalError(t, err)
 
@@ -393,6 +546,8 @@ func TestAzure_AuthorizeSign(t *testing.T) {
 	assert.FatalError(t, err)
 	t4, err := p4.GetIdentityToken("subject", "caURL")
 	assert.FatalError(t, err)
+	t5, err := p5.GetIdentityToken("subject", "caURL")
+	assert.FatalError(t, err)
 
 	t11, err := generateAzureToken("subject", p1.oidcConfig.Issuer, azureDefaultAudience,
 		p1.TenantID, "subscriptionID", "resourceGroup", "virtualMachine",
@@ -431,11 +586,12 @@ func TestAzure_AuthorizeSign(t *testing.T) {
 		code    int
 		wantErr bool
 	}{
-		{"ok", p1, args{t1}, 4, http.StatusOK, false},
-		{"ok", p2, args{t2}, 6, http.StatusOK, false},
-		{"ok", p1, args{t11}, 4, http.StatusOK, false},
+		{"ok", p1, args{t1}, 5, http.StatusOK, false},
+		{"ok", p2, args{t2}, 7, http.StatusOK, false},
+		{"ok", p1, args{t11}, 5, http.StatusOK, false},
 		{"fail tenant", p3, args{t3}, 0, http.StatusUnauthorized, true},
 		{"fail resource group", p4, args{t4}, 0, http.StatusUnauthorized, true},
+		{"fail subscription", p5, args{t5}, 0, http.StatusUnauthorized, true},
 		{"fail token", p1, args{"token"}, 0, http.StatusUnauthorized, true},
 		{"fail issuer", p1, args{failIssuer}, 0, http.StatusUnauthorized, true},
 		{"fail audience", p1, args{failAudience}, 0, http.StatusUnauthorized, true},
@@ -461,6 +617,42 @@ func TestAzure_AuthorizeSign(t *testing.T) {
 	}
 }
 
+func TestAzure_AuthorizeSign_dnsSuffix(t *testing.T) {
+	p, srv, err := generateAzureWithServer()
+	assert.FatalError(t, err)
+	defer srv.Close()
+	p.DisableCustomSANs = true
+	p.DNSSuffix = "internal.example.com"
+
+	tok, err := generateAzureToken("subject", p.oidcConfig.Issuer, azureDefaultAudience,
+		p.TenantID, "subscriptionID", "resourceGroup", "virtualMachine",
+		time.Now(), &p.keyStore.keySet.Keys[0])
+	assert.FatalError(t, err)
+
+	ctx := NewContextWithMethod(context.Background(), SignMethod)
+	opts, err := p.AuthorizeSign(ctx, tok)
+	assert.FatalError(t, err)
+
+	want := []string{"virtualMachine", "virtualMachine.internal.example.com"}
+	var found int
+	for _, o := range opts {
+		switch v := o.(type) {
+		case commonNameSliceValidator:
+			assert.Equals(t, want, []string(v))
+			found++
+		case dnsNamesValidator:
+			assert.Equals(t, want, []string(v))
+			found++
+		}
+	}
+	assert.Equals(t, 2, found)
+
+	p.DNSSuffix = ""
+	assert.Equals(t, []string{"virtualMachine"}, p.dnsNames("virtualMachine"))
+	p.DNSSuffix = ".internal.example.com"
+	assert.Equals(t, want, p.dnsNames("virtualMachine"))
+}
+
 func TestAzure_AuthorizeRenew(t *testing.T) {
 	p1, err := generateAzure()
 	assert.FatalError(t, err)
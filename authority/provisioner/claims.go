@@ -1,6 +1,8 @@
 package provisioner
 
 import (
+	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/pkg/errors"
@@ -24,6 +26,33 @@ type Claims struct {
 	EnableSSHCA       *bool     `json:"enableSSHCA,omitempty"`
 }
 
+// UnmarshalJSON parses the claims in JSON format. On errors, the returned error
+// includes the name of the claim that could not be parsed.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type claimsAlias Claims
+	var v claimsAlias
+	if err := json.Unmarshal(data, &v); err != nil {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(data, &fields) != nil {
+			return errors.Wrap(err, "error unmarshaling claims")
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			b, _ := json.Marshal(map[string]json.RawMessage{name: fields[name]})
+			if err := json.Unmarshal(b, new(claimsAlias)); err != nil {
+				return errors.Wrapf(err, "error unmarshaling claims: %s", name)
+			}
+		}
+		return errors.Wrap(err, "error unmarshaling claims")
+	}
+	*c = Claims(v)
+	return nil
+}
+
 // Claimer is the type that controls claims. It provides an interface around the
 // current claim and the global one.
 type Claimer struct {
@@ -116,7 +145,7 @@ func (c *Claimer) DefaultSSHCertDuration(certType uint32) (time.Duration, error)
 // global default from the authority configuration will be used.
 func (c *Claimer) DefaultUserSSHCertDuration() time.Duration {
 	if c.claims == nil || c.claims.DefaultUserSSHDur == nil {
-		return c.global.DefaultUserSSHDur.Duration
+		return c.global.DefaultUserSSHDur.Value()
 	}
 	return c.claims.DefaultUserSSHDur.Duration
 }
@@ -126,7 +155,7 @@ func (c *Claimer) DefaultUserSSHCertDuration() time.Duration {
 // global minimum from the authority configuration will be used.
 func (c *Claimer) MinUserSSHCertDuration() time.Duration {
 	if c.claims == nil || c.claims.MinUserSSHDur == nil {
-		return c.global.MinUserSSHDur.Duration
+		return c.global.MinUserSSHDur.Value()
 	}
 	return c.claims.MinUserSSHDur.Duration
 }
@@ -136,7 +165,7 @@ func (c *Claimer) MinUserSSHCertDuration() time.Duration {
 // global maximum from the authority configuration will be used.
 func (c *Claimer) MaxUserSSHCertDuration() time.Duration {
 	if c.claims == nil || c.claims.MaxUserSSHDur == nil {
-		return c.global.MaxUserSSHDur.Duration
+		return c.global.MaxUserSSHDur.Value()
 	}
 	return c.claims.MaxUserSSHDur.Duration
 }
@@ -146,7 +175,7 @@ func (c *Claimer) MaxUserSSHCertDuration() time.Duration {
 // global default from the authority configuration will be used.
 func (c *Claimer) DefaultHostSSHCertDuration() time.Duration {
 	if c.claims == nil || c.claims.DefaultHostSSHDur == nil {
-		return c.global.DefaultHostSSHDur.Duration
+		return c.global.DefaultHostSSHDur.Value()
 	}
 	return c.claims.DefaultHostSSHDur.Duration
 }
@@ -156,7 +185,7 @@ func (c *Claimer) DefaultHostSSHCertDuration() time.Duration {
 // global minimum from the authority configuration will be used.
 func (c *Claimer) MinHostSSHCertDuration() time.Duration {
 	if c.claims == nil || c.claims.MinHostSSHDur == nil {
-		return c.global.MinHostSSHDur.Duration
+		return c.global.MinHostSSHDur.Value()
 	}
 	return c.claims.MinHostSSHDur.Duration
 }
@@ -166,7 +195,7 @@ func (c *Claimer) MinHostSSHCertDuration() time.Duration {
 // global maximum from the authority configuration will be used.
 func (c *Claimer) MaxHostSSHCertDuration() time.Duration {
 	if c.claims == nil || c.claims.MaxHostSSHDur == nil {
-		return c.global.MaxHostSSHDur.Duration
+		return c.global.MaxHostSSHDur.Value()
 	}
 	return c.claims.MaxHostSSHDur.Duration
 }
@@ -202,6 +231,35 @@ func (c *Claimer) Validate() error {
 		return errors.Errorf("claims: DefaultCertDuration cannot be less than MinCertDuration: DefaultCertDuration - %v, MinCertDuration - %v", def, min)
 	case max < def:
 		return errors.Errorf("claims: MaxCertDuration cannot be less than DefaultCertDuration: MaxCertDuration - %v, DefaultCertDuration - %v", max, def)
+	}
+	if err := validateSSHDurations("User", c.MinUserSSHCertDuration(), c.MaxUserSSHCertDuration(), c.DefaultUserSSHCertDuration()); err != nil {
+		return err
+	}
+	return validateSSHDurations("Host", c.MinHostSSHCertDuration(), c.MaxHostSSHCertDuration(), c.DefaultHostSSHCertDuration())
+}
+
+// validateSSHDurations validates the minimum, maximum and default durations of
+// the SSH certificates of the given kind, User or Host. The SSH durations are
+// not required if the SSH CA is not configured.
+func validateSSHDurations(kind string, min, max, def time.Duration) error {
+	var (
+		minName = "Min" + kind + "SSHCertDuration"
+		maxName = "Max" + kind + "SSHCertDuration"
+		defName = "Default" + kind + "SSHCertDuration"
+	)
+	switch {
+	case min < 0:
+		return errors.Errorf("claims: %s cannot be negative", minName)
+	case max < 0:
+		return errors.Errorf("claims: %s cannot be negative", maxName)
+	case def < 0:
+		return errors.Errorf("claims: %s cannot be negative", defName)
+	case max < min:
+		return errors.Errorf("claims: %s cannot be less than %s: %s - %v, %s - %v", maxName, minName, maxName, max, minName, min)
+	case def < min:
+		return errors.Errorf("claims: %s cannot be less than %s: %s - %v, %s - %v", defName, minName, defName, def, minName, min)
+	case max < def:
+		return errors.Errorf("claims: %s cannot be less than %s: %s - %v, %s - %v", maxName, defName, maxName, max, defName, def)
 	default:
 		return nil
 	}
@@ -4,9 +4,9 @@ import (
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/asn1"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
 	"net/url"
 	"sort"
 	"strings"
@@ -27,10 +27,16 @@ type uidProvisioner struct {
 	uid         string
 }
 
+// key returns the value used to sort the provisioners. Provisioners are sorted
+// by name and then by the order they were stored.
+func (p uidProvisioner) key() string {
+	return p.provisioner.GetName() + "\x00" + p.uid
+}
+
 type provisionerSlice []uidProvisioner
 
 func (p provisionerSlice) Len() int           { return len(p) }
-func (p provisionerSlice) Less(i, j int) bool { return p[i].uid < p[j].uid }
+func (p provisionerSlice) Less(i, j int) bool { return p[i].key() < p[j].key() }
 func (p provisionerSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 // loadByTokenPayload is a payload used to extract the id used to load the
@@ -44,9 +50,11 @@ type loadByTokenPayload struct {
 
 // Collection is a memory map of provisioners.
 type Collection struct {
+	mu        sync.RWMutex
 	byID      *sync.Map
 	byKey     *sync.Map
 	sorted    provisionerSlice
+	stored    uint32
 	audiences Audiences
 }
 
@@ -134,7 +142,15 @@ func (c *Collection) LoadByCertificate(cert *x509.Certificate) (Interface, bool)
 			}
 			switch Type(provisioner.Type) {
 			case TypeJWK:
-				return c.Load(string(provisioner.Name) + ":" + string(provisioner.CredentialID))
+				if p, ok := c.Load(string(provisioner.Name) + ":" + string(provisioner.CredentialID)); ok {
+					return p, ok
+				}
+				// The key used to issue the certificate might have been
+				// rotated and retired.
+				if p, ok := c.LoadByName(string(provisioner.Name)); ok && p.GetType() == TypeJWK {
+					return p, ok
+				}
+				return nil, false
 			case TypeAWS:
 				return c.Load("aws/" + string(provisioner.Name))
 			case TypeGCP:
@@ -145,6 +161,8 @@ func (c *Collection) LoadByCertificate(cert *x509.Certificate) (Interface, bool)
 				return c.Load("x5c/" + string(provisioner.Name))
 			case TypeK8sSA:
 				return c.Load(K8sSAID)
+			case TypeSCEP:
+				return c.Load("scep/" + string(provisioner.Name))
 			default:
 				return c.Load(string(provisioner.CredentialID))
 			}
@@ -170,9 +188,18 @@ func (c *Collection) LoadEncryptedKey(keyID string) (string, bool) {
 // Store adds a provisioner to the collection and enforces the uniqueness of
 // provisioner IDs.
 func (c *Collection) Store(p Interface) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	// Store provisioner always in byID. ID must be unique.
-	if _, loaded := c.byID.LoadOrStore(p.GetID(), p); loaded {
-		return errors.New("cannot add multiple provisioners with the same id")
+	ids := provisionerIDs(p)
+	for _, id := range ids {
+		if _, ok := c.byID.Load(id); ok {
+			return errors.New("cannot add multiple provisioners with the same id")
+		}
+	}
+	for _, id := range ids {
+		c.byID.Store(id, p)
 	}
 
 	// Store provisioner in byKey if EncryptedKey is defined.
@@ -186,8 +213,9 @@ func (c *Collection) Store(p Interface) error {
 	// 0x00000000, 0x00000001, 0x00000002, ...
 	bi := make([]byte, 4)
 	sum := provisionerSum(p)
-	binary.BigEndian.PutUint32(bi, uint32(c.sorted.Len()))
+	binary.BigEndian.PutUint32(bi, c.stored)
 	sum[0], sum[1], sum[2], sum[3] = bi[0], bi[1], bi[2], bi[3]
+	c.stored++
 	c.sorted = append(c.sorted, uidProvisioner{
 		provisioner: p,
 		uid:         hex.EncodeToString(sum),
@@ -196,7 +224,78 @@ func (c *Collection) Store(p Interface) error {
 	return nil
 }
 
-// Find implements pagination on a list of sorted provisioners.
+// Update replaces the provisioner with the same ID in the collection, keeping
+// its position in the sorted list unless the name changes.
+func (c *Collection) Update(p Interface) error {
+	old, ok := c.Load(p.GetID())
+	if !ok {
+		return errors.Errorf("provisioner %s not found", p.GetID())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range provisionerIDs(old) {
+		c.byID.Delete(id)
+	}
+	if kid, _, ok := old.GetEncryptedKey(); ok {
+		c.byKey.Delete(kid)
+	}
+	for _, id := range provisionerIDs(p) {
+		c.byID.Store(id, p)
+	}
+	if kid, _, ok := p.GetEncryptedKey(); ok {
+		c.byKey.Store(kid, p)
+	}
+	for i := range c.sorted {
+		if c.sorted[i].provisioner == old {
+			c.sorted[i].provisioner = p
+		}
+	}
+	sort.Sort(c.sorted)
+	return nil
+}
+
+// Remove deletes the provisioner with the given ID from the collection.
+func (c *Collection) Remove(id string) error {
+	p, ok := c.Load(id)
+	if !ok {
+		return errors.Errorf("provisioner %s not found", id)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range provisionerIDs(p) {
+		c.byID.Delete(id)
+	}
+	if kid, _, ok := p.GetEncryptedKey(); ok {
+		c.byKey.Delete(kid)
+	}
+	for i := range c.sorted {
+		if c.sorted[i].provisioner == p {
+			c.sorted = append(c.sorted[:i], c.sorted[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// LoadByName returns the first provisioner with the given name.
+func (c *Collection) LoadByName(name string) (Interface, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, up := range c.sorted {
+		if up.provisioner.GetName() == name {
+			return up.provisioner, true
+		}
+	}
+	return nil, false
+}
+
+// Find implements pagination on the list of provisioners sorted by name. The
+// cursor is an opaque value returned by a previous call, it points to the first
+// provisioner of the next page. Because the provisioners are sorted by name,
+// provisioners added or removed while iterating do not make the next pages skip
+// or repeat the rest.
 func (c *Collection) Find(cursor string, limit int) (List, string) {
 	switch {
 	case limit <= 0:
@@ -205,9 +304,11 @@ func (c *Collection) Find(cursor string, limit int) (List, string) {
 		limit = DefaultProvisionersMax
 	}
 
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	n := c.sorted.Len()
-	cursor = fmt.Sprintf("%040s", cursor)
-	i := sort.Search(n, func(i int) bool { return c.sorted[i].uid >= cursor })
+	key := decodeCursor(cursor)
+	i := sort.Search(n, func(i int) bool { return c.sorted[i].key() >= key })
 
 	slice := List{}
 	for ; i < n && len(slice) < limit; i++ {
@@ -215,11 +316,26 @@ func (c *Collection) Find(cursor string, limit int) (List, string) {
 	}
 
 	if i < n {
-		return slice, strings.TrimLeft(c.sorted[i].uid, "0")
+		return slice, encodeCursor(c.sorted[i])
 	}
 	return slice, ""
 }
 
+// encodeCursor returns the cursor that points to the given provisioner.
+func encodeCursor(p uidProvisioner) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(p.key()))
+}
+
+// decodeCursor returns the sort key in the given cursor. A cursor that was not
+// returned by Find is used as the name of the provisioner to start with.
+func decodeCursor(cursor string) string {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.Contains(string(b), "\x00") {
+		return cursor
+	}
+	return string(b)
+}
+
 func loadProvisioner(m *sync.Map, key string) (Interface, bool) {
 	i, ok := m.Load(key)
 	if !ok {
@@ -232,6 +348,20 @@ func loadProvisioner(m *sync.Map, key string) (Interface, bool) {
 	return p, true
 }
 
+// provisionerIDs returns the ID of the provisioner and the IDs that can also
+// be used to load it. A JWK provisioner can be loaded with the ID of all its
+// active keys.
+func provisionerIDs(p Interface) []string {
+	if jwk, ok := p.(*JWK); ok {
+		ids := make([]string, 0, len(jwk.PreviousKeys)+1)
+		for _, kid := range jwk.GetKeyIDs() {
+			ids = append(ids, jwk.Name+":"+kid)
+		}
+		return ids
+	}
+	return []string{p.GetID()}
+}
+
 // provisionerSum returns the SHA1 of the provisioners ID. From this we will
 // create the unique and sorted id.
 func provisionerSum(p Interface) []byte {
@@ -4,7 +4,6 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"reflect"
-	"strings"
 	"sync"
 	"testing"
 
@@ -292,13 +291,108 @@ func TestCollection_Store(t *testing.T) {
 	}
 }
 
+func TestCollection_UpdateRemove(t *testing.T) {
+	c := NewCollection(testAudiences)
+	p1, err := generateJWK()
+	assert.FatalError(t, err)
+	p2, err := generateOIDC()
+	assert.FatalError(t, err)
+	p3, err := generateJWK()
+	assert.FatalError(t, err)
+	// The generated names are random, the list is sorted by name.
+	p1.Name, p2.Name = "a", "b"
+	assert.FatalError(t, c.Store(p1))
+	assert.FatalError(t, c.Store(p2))
+
+	// Update keeps the position and updates the encrypted keys.
+	updated := *p1
+	updated.EncryptedKey = "updated"
+	assert.FatalError(t, c.Update(&updated))
+	assert.Error(t, c.Update(p3))
+	got, ok := c.LoadByName(p1.Name)
+	assert.True(t, ok)
+	assert.Equals(t, &updated, got)
+	key, ok := c.LoadEncryptedKey(p1.Key.KeyID)
+	assert.True(t, ok)
+	assert.Equals(t, "updated", key)
+	assert.Equals(t, Interface(&updated), c.sorted[0].provisioner)
+
+	// Remove deletes the provisioner from all the indexes.
+	assert.FatalError(t, c.Remove(p1.GetID()))
+	assert.Error(t, c.Remove(p1.GetID()))
+	_, ok = c.Load(p1.GetID())
+	assert.False(t, ok)
+	_, ok = c.LoadByName(p1.Name)
+	assert.False(t, ok)
+	_, ok = c.LoadEncryptedKey(p1.Key.KeyID)
+	assert.False(t, ok)
+	l, _ := c.Find("", 0)
+	assert.Equals(t, List{p2}, l)
+
+	// New provisioners are sorted by name.
+	p3.Name = "a"
+	assert.FatalError(t, c.Store(p3))
+	l, _ = c.Find("", 0)
+	assert.Equals(t, List{p3, p2}, l)
+}
+
+func TestCollection_PreviousKeys(t *testing.T) {
+	c := NewCollection(testAudiences)
+	p1, err := generateJWK()
+	assert.FatalError(t, err)
+	assert.FatalError(t, c.Store(p1))
+
+	key, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	pub := key.Public()
+	rotated := *p1
+	rotated.Key, rotated.EncryptedKey = &pub, "rotated"
+	rotated.PreviousKeys = []*jose.JSONWebKey{p1.Key}
+
+	// The ids of the previous keys must be unique too.
+	assert.Error(t, c.Store(&rotated))
+	assert.FatalError(t, c.Remove(p1.GetID()))
+	assert.FatalError(t, c.Store(&rotated))
+
+	// The provisioner can be loaded with all the keys, but only the encrypted
+	// key of the current key is available.
+	for _, id := range []string{p1.GetID(), rotated.GetID()} {
+		got, ok := c.Load(id)
+		assert.True(t, ok)
+		assert.Equals(t, &rotated, got)
+	}
+	_, ok := c.LoadEncryptedKey(p1.Key.KeyID)
+	assert.False(t, ok)
+	encryptedKey, ok := c.LoadEncryptedKey(pub.KeyID)
+	assert.True(t, ok)
+	assert.Equals(t, "rotated", encryptedKey)
+
+	// Certificates issued with a retired key still load the provisioner.
+	ext, err := createProvisionerExtension(int(TypeJWK), p1.Name, p1.Key.KeyID)
+	assert.FatalError(t, err)
+	cert := &x509.Certificate{Extensions: []pkix.Extension{ext}}
+	retired := rotated
+	retired.PreviousKeys = nil
+	assert.FatalError(t, c.Update(&retired))
+	_, ok = c.Load(p1.GetID())
+	assert.False(t, ok)
+	got, ok := c.LoadByCertificate(cert)
+	assert.True(t, ok)
+	assert.Equals(t, &retired, got)
+
+	// Remove deletes all the ids.
+	assert.FatalError(t, c.Update(&rotated))
+	assert.FatalError(t, c.Remove(p1.GetID()))
+	_, ok = c.Load(rotated.GetID())
+	assert.False(t, ok)
+	_, ok = c.LoadByCertificate(cert)
+	assert.False(t, ok)
+}
+
 func TestCollection_Find(t *testing.T) {
 	c, err := generateCollection(10, 10)
 	assert.FatalError(t, err)
 
-	trim := func(s string) string {
-		return strings.TrimLeft(s, "0")
-	}
 	toList := func(ps provisionerSlice) List {
 		l := List{}
 		for _, p := range ps {
@@ -319,10 +413,10 @@ func TestCollection_Find(t *testing.T) {
 	}{
 		{"all", args{"", DefaultProvisionersMax}, toList(c.sorted[0:20]), ""},
 		{"0 to 19", args{"", 20}, toList(c.sorted[0:20]), ""},
-		{"0 to 9", args{"", 10}, toList(c.sorted[0:10]), trim(c.sorted[10].uid)},
-		{"9 to 19", args{trim(c.sorted[10].uid), 10}, toList(c.sorted[10:20]), ""},
-		{"1", args{trim(c.sorted[1].uid), 1}, toList(c.sorted[1:2]), trim(c.sorted[2].uid)},
-		{"1 to 5", args{trim(c.sorted[1].uid), 4}, toList(c.sorted[1:5]), trim(c.sorted[5].uid)},
+		{"0 to 9", args{"", 10}, toList(c.sorted[0:10]), encodeCursor(c.sorted[10])},
+		{"9 to 19", args{encodeCursor(c.sorted[10]), 10}, toList(c.sorted[10:20]), ""},
+		{"1", args{encodeCursor(c.sorted[1]), 1}, toList(c.sorted[1:2]), encodeCursor(c.sorted[2])},
+		{"1 to 5", args{encodeCursor(c.sorted[1]), 4}, toList(c.sorted[1:5]), encodeCursor(c.sorted[5])},
 		{"defaultLimit", args{"", 0}, toList(c.sorted[0:20]), ""},
 		{"overTheLimit", args{"", DefaultProvisionersMax + 1}, toList(c.sorted[0:20]), ""},
 	}
@@ -339,6 +433,47 @@ func TestCollection_Find(t *testing.T) {
 	}
 }
 
+func TestCollection_Find_pages(t *testing.T) {
+	c, err := generateCollection(12, 12)
+	assert.FatalError(t, err)
+	want := make(map[string]bool)
+	for _, p := range c.sorted {
+		want[p.provisioner.GetID()] = true
+	}
+
+	var pages int
+	var cursor string
+	seen := make(map[string]bool)
+	for {
+		var page List
+		page, cursor = c.Find(cursor, 10)
+		pages++
+		for i, p := range page {
+			if seen[p.GetID()] {
+				t.Errorf("provisioner %s listed twice", p.GetName())
+			}
+			seen[p.GetID()] = true
+			if i > 0 && page[i-1].GetName() > p.GetName() {
+				t.Errorf("provisioner %s listed after %s", p.GetName(), page[i-1].GetName())
+			}
+		}
+		if cursor == "" {
+			break
+		}
+		// Provisioners added while iterating do not move the next pages.
+		p, err := generateJWK()
+		assert.FatalError(t, err)
+		assert.FatalError(t, c.Store(p))
+	}
+
+	assert.Equals(t, 3, pages)
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("provisioner %s not listed", id)
+		}
+	}
+}
+
 func Test_matchesAudience(t *testing.T) {
 	type matchesTest struct {
 		a, b []string
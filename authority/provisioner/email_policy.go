@@ -0,0 +1,89 @@
+package provisioner
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// emailPolicy evaluates the email addresses of the X.509 SANs and of the OIDC
+// identities with the email options of a policy. The domains are exact domains
+// like "example.com", or subtrees like ".example.com" that cover the domains
+// at any depth below it but not the domain itself. The domains are compared
+// like the DNS names of the policy, in lower case and in punycode, and the
+// local parts are matched with the patterns as they are, case-sensitively.
+type emailPolicy struct {
+	allowedDomains    []string
+	deniedDomains     []string
+	allowedLocalParts []string
+	layer             string
+}
+
+// validateEmailPolicy validates the domains and the local part patterns of
+// the policy kind, e.g. x509Policy, of the owner, e.g. "provisioner foo".
+func validateEmailPolicy(kind, owner string, p emailPolicy) error {
+	for _, domains := range [][]string{p.allowedDomains, p.deniedDomains} {
+		for _, s := range domains {
+			if s == "" {
+				return errors.Errorf("%s: %s email domains cannot be empty", owner, kind)
+			}
+			if strings.Contains(s, "*") || !isValidPolicyName(s) {
+				return errors.Errorf("%s: %s email domain %q is not a valid domain", owner, kind, s)
+			}
+		}
+	}
+	for _, s := range p.allowedLocalParts {
+		if s == "" {
+			return errors.Errorf("%s: %s email local parts cannot be empty", owner, kind)
+		}
+		if _, err := path.Match(s, ""); err != nil {
+			return errors.Errorf("%s: %s email local part %q is not a valid pattern", owner, kind, s)
+		}
+	}
+	return nil
+}
+
+// isEmpty returns true if the policy allows all the email addresses.
+func (p emailPolicy) isEmpty() bool {
+	return len(p.allowedDomains) == 0 && len(p.deniedDomains) == 0 && len(p.allowedLocalParts) == 0
+}
+
+// denyReason returns the reason why the email address is not allowed, or an
+// empty string if it is allowed. The local part is everything before the last
+// "@", so quoted local parts like "\"john@doe\"@example.com" are supported.
+func (p emailPolicy) denyReason(email string) string {
+	if p.isEmpty() {
+		return ""
+	}
+	i := strings.LastIndex(email, "@")
+	if i <= 0 {
+		return "is not a valid email address"
+	}
+	local := email[:i]
+	domain, ok := normalizePolicyName(email[i+1:])
+	if !ok || domain == "" || strings.HasPrefix(domain, ".") || strings.Contains(domain, "*") {
+		return "is not a valid email address"
+	}
+	if containsPolicyDomain(p.deniedDomains, domain) {
+		return "is denied by " + policyOf(p.layer)
+	}
+	if len(p.allowedDomains) > 0 && !containsPolicyDomain(p.allowedDomains, domain) {
+		return "is not allowed by " + policyOf(p.layer)
+	}
+	if len(p.allowedLocalParts) > 0 && !matchPrincipal(p.allowedLocalParts, local) {
+		return "has a local part not allowed by " + policyOf(p.layer)
+	}
+	return ""
+}
+
+// containsPolicyDomain returns true if the domain is one of the exact domains
+// or is below one of the subtrees.
+func containsPolicyDomain(domains []string, domain string) bool {
+	for _, s := range domains {
+		if rule, ok := normalizePolicyName(s); ok && (rule == domain || matchesSubtree(rule, domain)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package provisioner
+
+import (
+	"testing"
+)
+
+func Test_validateEmailPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  emailPolicy
+		wantErr bool
+	}{
+		{"ok-empty", emailPolicy{}, false},
+		{"ok", emailPolicy{
+			allowedDomains:    []string{"example.com", ".corp.example.com", "bücher.example"},
+			deniedDomains:     []string{"dev.corp.example.com"},
+			allowedLocalParts: []string{"svc-*", "jane"},
+		}, false},
+		{"fail-empty-domain", emailPolicy{allowedDomains: []string{""}}, true},
+		{"fail-wildcard-domain", emailPolicy{allowedDomains: []string{"*.example.com"}}, true},
+		{"fail-domain", emailPolicy{deniedDomains: []string{"example..com"}}, true},
+		{"fail-empty-local-part", emailPolicy{allowedLocalParts: []string{""}}, true},
+		{"fail-local-part-pattern", emailPolicy{allowedLocalParts: []string{"svc-["}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateEmailPolicy("x509Policy", "test", tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("validateEmailPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_emailPolicy_denyReason(t *testing.T) {
+	domains := emailPolicy{
+		allowedDomains: []string{"example.com", "corp.example.com", ".corp.example.com"},
+		deniedDomains:  []string{"dev.corp.example.com", ".lab.corp.example.com"},
+	}
+	localParts := emailPolicy{
+		allowedDomains:    []string{"example.com"},
+		allowedLocalParts: []string{"jane", "svc-*", "*+*"},
+	}
+	tests := []struct {
+		name   string
+		policy emailPolicy
+		email  string
+		want   string
+	}{
+		{"ok-empty", emailPolicy{}, "anything", ""},
+		{"ok-domain", domains, "jane@example.com", ""},
+		{"ok-domain-case", domains, "Jane.Doe@EXAMPLE.Com", ""},
+		{"ok-domain-trailing-dot", domains, "jane@example.com.", ""},
+		{"ok-subdomain", domains, "jane@corp.example.com", ""},
+		{"ok-subtree", domains, "jane@eu.corp.example.com", ""},
+		{"ok-plus", domains, "jane+smime@example.com", ""},
+		{"ok-quoted", domains, `"jane doe"@example.com`, ""},
+		{"ok-quoted-at", domains, `"jane@doe"@example.com`, ""},
+		{"fail-not-allowed", domains, "jane@example.org", "is not allowed by the provisioner policy"},
+		{"fail-not-subtree", domains, "jane@www.example.com", "is not allowed by the provisioner policy"},
+		{"fail-suffix", domains, "jane@evilexample.com", "is not allowed by the provisioner policy"},
+		{"fail-denied-subdomain", domains, "jane@dev.corp.example.com", "is denied by the provisioner policy"},
+		{"fail-denied-subdomain-case", domains, "jane@Dev.Corp.Example.com", "is denied by the provisioner policy"},
+		{"fail-denied-subtree", domains, "jane@a.lab.corp.example.com", "is denied by the provisioner policy"},
+		{"fail-quoted-domain", domains, `"jane@example.com"@example.org`, "is not allowed by the provisioner policy"},
+		{"fail-no-at", domains, "example.com", "is not a valid email address"},
+		{"fail-no-local-part", domains, "@example.com", "is not a valid email address"},
+		{"fail-no-domain", domains, "jane@", "is not a valid email address"},
+		{"fail-wildcard-domain", domains, "jane@*.example.com", "is not a valid email address"},
+		{"ok-local-part", localParts, "jane@example.com", ""},
+		{"ok-local-part-pattern", localParts, "svc-backup@example.com", ""},
+		{"ok-local-part-plus", localParts, "bob+smime@example.com", ""},
+		{"fail-local-part-case", localParts, "Jane@example.com", "has a local part not allowed by the provisioner policy"},
+		{"fail-local-part", localParts, "bob@example.com", "has a local part not allowed by the provisioner policy"},
+		{"fail-local-part-domain", localParts, "jane@example.org", "is not allowed by the provisioner policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.denyReason(tt.email); got != tt.want {
+				t.Errorf("emailPolicy.denyReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
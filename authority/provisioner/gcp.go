@@ -76,15 +76,22 @@ func newGCPConfig() *gcpConfig {
 // https://cloud.google.com/compute/docs/instances/verifying-instance-identity
 type GCP struct {
 	*base
-	Type                   string   `json:"type"`
-	Name                   string   `json:"name"`
-	ServiceAccounts        []string `json:"serviceAccounts"`
-	ProjectIDs             []string `json:"projectIDs"`
-	DisableCustomSANs      bool     `json:"disableCustomSANs"`
-	DisableTrustOnFirstUse bool     `json:"disableTrustOnFirstUse"`
-	InstanceAge            Duration `json:"instanceAge,omitempty"`
-	Claims                 *Claims  `json:"claims,omitempty"`
+	Type                   string              `json:"type"`
+	Name                   string              `json:"name"`
+	Disabled               bool                `json:"disabled,omitempty"`
+	ServiceAccounts        []string            `json:"serviceAccounts"`
+	ProjectIDs             []string            `json:"projectIDs"`
+	DisableCustomSANs      bool                `json:"disableCustomSANs"`
+	DisableTrustOnFirstUse bool                `json:"disableTrustOnFirstUse"`
+	InstanceAge            Duration            `json:"instanceAge,omitempty"`
+	Claims                 *Claims             `json:"claims,omitempty"`
+	X509                   *X509Options        `json:"x509,omitempty"`
+	SSH                    *SSHTemplateOptions `json:"ssh,omitempty"`
+	SSHPolicy              *SSHPolicy          `json:"sshPolicy,omitempty"`
+	Webhooks               []*Webhook          `json:"webhooks,omitempty"`
+	Attestation            *AttestationOptions `json:"attestation,omitempty"`
 	claimer                *Claimer
+	x509                   *X509Options
 	config                 *gcpConfig
 	keyStore               *keyStore
 	audiences              Audiences
@@ -135,6 +142,11 @@ func (p *GCP) GetType() Type {
 	return TypeGCP
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *GCP) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey is not available in a GCP provisioner.
 func (p *GCP) GetEncryptedKey() (kid string, key string, ok bool) {
 	return "", "", false
@@ -196,6 +208,19 @@ func (p *GCP) Init(config Config) error {
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
 		return err
 	}
+
+	// Parse the x509 and SSH templates and validate the webhooks
+	if p.x509, err = initTemplateOptions(p.X509, p.SSH, p.Webhooks, p.Name, config); err != nil {
+		return err
+	}
+	if err = p.SSHPolicy.init(p.Name); err != nil {
+		return err
+	}
+
+	// Load the attestation roots
+	if err = p.Attestation.init(); err != nil {
+		return err
+	}
 	// Initialize key store
 	p.keyStore, err = newKeyStore(p.config.CertsURL)
 	if err != nil {
@@ -230,14 +255,17 @@ func (p *GCP) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 		}))
 	}
 
-	return append(so,
+	so = append(so,
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeGCP, p.Name, claims.Subject, "InstanceID", ce.InstanceID, "InstanceName", ce.InstanceName),
 		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	), nil
+		newAttestationValidator(p.Attestation, token),
+	)
+	data := newTemplateData(claims.Subject, nil, token)
+	return append(so, templateSignOptions(ctx, p.x509, p.Webhooks, p.Name, data)...), nil
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
@@ -381,7 +409,7 @@ func (p *GCP) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 	// Set defaults if not given as user options
 	signOptions = append(signOptions, sshCertDefaultsModifier(defaults))
 
-	return append(signOptions,
+	signOptions = append(signOptions,
 		// Set the default extensions
 		&sshDefaultExtensionModifier{},
 		// Set the validity bounds if not set.
@@ -392,5 +420,7 @@ func (p *GCP) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 		&sshCertValidityValidator{p.claimer},
 		// Require all the fields in the SSH certificate
 		&sshCertDefaultValidator{},
-	), nil
+	)
+	signOptions = append(signOptions, sshTemplateSignOptions(p.SSH, p.Name, token)...)
+	return append(signOptions, sshPolicySignOptions(p.SSHPolicy, nil, false)...), nil
 }
@@ -458,6 +458,12 @@ func TestGCP_AuthorizeSign(t *testing.T) {
 		"instance-id", "instance-name", "project-id", "zone",
 		time.Now(), &p1.keyStore.keySet.Keys[0])
 	assert.FatalError(t, err)
+	// Tokens for another provisioner in the same CA are not valid either
+	failAudProvisioner, err := generateGCPToken(p1.ServiceAccounts[0],
+		"https://accounts.google.com", p2.GetID()+"-other",
+		"instance-id", "instance-name", "project-id", "zone",
+		time.Now(), &p1.keyStore.keySet.Keys[0])
+	assert.FatalError(t, err)
 	failExp, err := generateGCPToken(p1.ServiceAccounts[0],
 		"https://accounts.google.com", p1.GetID(),
 		"instance-id", "instance-name", "project-id", "zone",
@@ -515,13 +521,14 @@ func TestGCP_AuthorizeSign(t *testing.T) {
 		code    int
 		wantErr bool
 	}{
-		{"ok", p1, args{t1}, 4, http.StatusOK, false},
-		{"ok", p2, args{t2}, 6, http.StatusOK, false},
-		{"ok", p3, args{t3}, 4, http.StatusOK, false},
+		{"ok", p1, args{t1}, 5, http.StatusOK, false},
+		{"ok", p2, args{t2}, 7, http.StatusOK, false},
+		{"ok", p3, args{t3}, 5, http.StatusOK, false},
 		{"fail token", p1, args{"token"}, 0, http.StatusUnauthorized, true},
 		{"fail key", p1, args{failKey}, 0, http.StatusUnauthorized, true},
 		{"fail iss", p1, args{failIss}, 0, http.StatusUnauthorized, true},
 		{"fail aud", p1, args{failAud}, 0, http.StatusUnauthorized, true},
+		{"fail aud provisioner", p1, args{failAudProvisioner}, 0, http.StatusUnauthorized, true},
 		{"fail exp", p1, args{failExp}, 0, http.StatusUnauthorized, true},
 		{"fail nbf", p1, args{failNbf}, 0, http.StatusUnauthorized, true},
 		{"fail service account", p1, args{failServiceAccount}, 0, http.StatusUnauthorized, true},
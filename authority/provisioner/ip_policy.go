@@ -0,0 +1,120 @@
+package provisioner
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// The values of the defaultIPAction of the policies.
+const (
+	// IPActionAllow allows the IP addresses when the policy has no IP ranges.
+	IPActionAllow = "allow"
+	// IPActionDeny denies the IP addresses when the policy has no IP ranges.
+	IPActionDeny = "deny"
+)
+
+// ipPolicy evaluates the IP addresses of the X.509 SANs and common names, the
+// ACME IP identifiers and the SSH host principals with the IP ranges of a
+// policy. The ranges are IPv4 or IPv6 CIDRs, or single addresses as a
+// shorthand for a /32 or a /128. The denied ranges take precedence over the
+// allowed ones, and the default action decides the addresses when the policy
+// has no ranges.
+type ipPolicy struct {
+	allowed       []string
+	denied        []string
+	defaultAction string
+	layer         string
+}
+
+// validateIPPolicy validates the IP ranges and the default action of the
+// policy kind, e.g. x509Policy, of the owner, e.g. "provisioner foo".
+func validateIPPolicy(kind, owner string, allowed, denied []string, defaultAction string) error {
+	for _, ranges := range [][]string{allowed, denied} {
+		for _, s := range ranges {
+			if parsePolicyIPRange(s) == nil {
+				return errors.Errorf("%s: %s IP range %q is not a valid CIDR or IP address", owner, kind, s)
+			}
+		}
+	}
+	switch defaultAction {
+	case "", IPActionAllow, IPActionDeny:
+		return nil
+	default:
+		return errors.Errorf("%s: %s defaultIPAction %q is not valid, it must be %q or %q",
+			owner, kind, defaultAction, IPActionAllow, IPActionDeny)
+	}
+}
+
+// isEmpty returns true if the policy allows all the IP addresses.
+func (p ipPolicy) isEmpty() bool {
+	return len(p.allowed) == 0 && len(p.denied) == 0 && p.defaultAction != IPActionDeny
+}
+
+// deny returns the option of the policy that rejects the IP address,
+// "deniedIPRanges", "allowedIPRanges" or "defaultIPAction", and the denied
+// range that contains it, or empty strings if the address is allowed.
+func (p ipPolicy) deny(ip net.IP) (option, rule string) {
+	if r := policyIPRangeContaining(p.denied, ip); r != "" {
+		return "deniedIPRanges", r
+	}
+	if len(p.allowed) > 0 {
+		if policyIPRangeContaining(p.allowed, ip) == "" {
+			return "allowedIPRanges", ""
+		}
+		return "", ""
+	}
+	if len(p.denied) == 0 && p.defaultAction == IPActionDeny {
+		return "defaultIPAction", ""
+	}
+	return "", ""
+}
+
+// denyReason returns the reason why the IP address is not allowed, or an
+// empty string if it is allowed.
+func (p ipPolicy) denyReason(ip net.IP) string {
+	switch option, _ := p.deny(ip); option {
+	case "deniedIPRanges":
+		return "is denied by " + policyOf(p.layer)
+	case "allowedIPRanges":
+		return "is not allowed by " + policyOf(p.layer)
+	case "defaultIPAction":
+		return "is denied by default by " + policyOf(p.layer)
+	default:
+		return ""
+	}
+}
+
+// policyIPRangesContain returns true if any of the IP ranges contains the IP
+// address.
+func policyIPRangesContain(ranges []string, ip net.IP) bool {
+	return policyIPRangeContaining(ranges, ip) != ""
+}
+
+// policyIPRangeContaining returns the first of the IP ranges that contains
+// the IP address, or an empty string. The IPv4 ranges do not contain the IPv6
+// addresses, but they contain the IPv4-mapped ones, like ::ffff:10.0.0.1.
+func policyIPRangeContaining(ranges []string, ip net.IP) string {
+	for _, s := range ranges {
+		if ipNet := parsePolicyIPRange(s); ipNet != nil && ipNet.Contains(ip) {
+			return s
+		}
+	}
+	return ""
+}
+
+// parsePolicyIPRange returns the network of a CIDR or of a single IP address,
+// or nil if s is neither.
+func parsePolicyIPRange(s string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,72 @@
+package provisioner
+
+import (
+	"net"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func Test_validateIPPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowed       []string
+		denied        []string
+		defaultAction string
+		wantErr       bool
+	}{
+		{"ok-empty", nil, nil, "", false},
+		{"ok", []string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.0.1", "2001:db8::1"}, "", false},
+		{"ok-allow", nil, nil, "allow", false},
+		{"ok-deny", nil, nil, "deny", false},
+		{"fail-range", []string{"10.0.0.0/33"}, nil, "", true},
+		{"fail-name", nil, []string{"example.com"}, "", true},
+		{"fail-action", nil, nil, "reject", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateIPPolicy("x509Policy", "test", tt.allowed, tt.denied, tt.defaultAction); (err != nil) != tt.wantErr {
+				t.Errorf("validateIPPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_ipPolicy_deny(t *testing.T) {
+	rfc1918 := ipPolicy{
+		allowed: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fd00::/8"},
+		denied:  []string{"10.1.0.0/16", "10.1.2.3", "192.168.0.1", "fd00:1::/32", "fd00::1"},
+	}
+	tests := []struct {
+		name       string
+		policy     ipPolicy
+		ip         string
+		wantOption string
+		wantRule   string
+	}{
+		{"ok-empty", ipPolicy{}, "192.0.2.1", "", ""},
+		{"ok-empty-allow", ipPolicy{defaultAction: "allow"}, "2001:db8::1", "", ""},
+		{"fail-empty-deny", ipPolicy{defaultAction: "deny"}, "192.0.2.1", "defaultIPAction", ""},
+		{"fail-empty-deny-ipv6", ipPolicy{defaultAction: "deny"}, "2001:db8::1", "defaultIPAction", ""},
+		{"ok-deny-with-denied-ranges", ipPolicy{denied: []string{"10.0.0.0/8"}, defaultAction: "deny"}, "192.0.2.1", "", ""},
+		{"ok-ipv4", rfc1918, "10.0.0.1", "", ""},
+		{"ok-ipv4-mapped", rfc1918, "::ffff:172.16.0.1", "", ""},
+		{"ok-ipv6", rfc1918, "fd00::2", "", ""},
+		{"fail-denied-subnet", rfc1918, "10.1.200.1", "deniedIPRanges", "10.1.0.0/16"},
+		{"fail-denied-overlap", rfc1918, "10.1.2.3", "deniedIPRanges", "10.1.0.0/16"},
+		{"fail-denied-address", rfc1918, "192.168.0.1", "deniedIPRanges", "192.168.0.1"},
+		{"fail-denied-ipv6-subnet", rfc1918, "fd00:1::5", "deniedIPRanges", "fd00:1::/32"},
+		{"fail-denied-ipv6-address", rfc1918, "fd00::1", "deniedIPRanges", "fd00::1"},
+		{"fail-not-allowed", rfc1918, "192.0.2.1", "allowedIPRanges", ""},
+		{"fail-not-allowed-ipv6", rfc1918, "2001:db8::1", "allowedIPRanges", ""},
+		{"fail-not-allowed-family", ipPolicy{allowed: []string{"::/0"}}, "10.0.0.1", "allowedIPRanges", ""},
+		{"fail-not-allowed-family-ipv6", ipPolicy{allowed: []string{"0.0.0.0/0"}}, "fd00::2", "allowedIPRanges", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			option, rule := tt.policy.deny(net.ParseIP(tt.ip))
+			assert.Equals(t, tt.wantOption, option)
+			assert.Equals(t, tt.wantRule, rule)
+		})
+	}
+}
@@ -29,11 +29,25 @@ type JWK struct {
 	*base
 	Type         string           `json:"type"`
 	Name         string           `json:"name"`
+	Disabled     bool             `json:"disabled,omitempty"`
 	Key          *jose.JSONWebKey `json:"key"`
 	EncryptedKey string           `json:"encryptedKey,omitempty"`
-	Claims       *Claims          `json:"claims,omitempty"`
-	claimer      *Claimer
-	audiences    Audiences
+	// PreviousKeys are the keys replaced by a key rotation that can still be
+	// used to validate tokens, ordered from the oldest to the newest. The
+	// encrypted key always corresponds to the current key.
+	PreviousKeys []*jose.JSONWebKey  `json:"previousKeys,omitempty"`
+	Claims       *Claims             `json:"claims,omitempty"`
+	X509         *X509Options        `json:"x509,omitempty"`
+	SSH          *SSHTemplateOptions `json:"ssh,omitempty"`
+	SSHPolicy    *SSHPolicy          `json:"sshPolicy,omitempty"`
+	Webhooks     []*Webhook          `json:"webhooks,omitempty"`
+	Attestation  *AttestationOptions `json:"attestation,omitempty"`
+	// Admin allows the tokens of this provisioner to authenticate the requests
+	// to the admin API.
+	Admin     bool `json:"admin,omitempty"`
+	claimer   *Claimer
+	x509      *X509Options
+	audiences Audiences
 }
 
 // GetID returns the provisioner unique identifier. The name and credential id
@@ -70,11 +84,37 @@ func (p *JWK) GetType() Type {
 	return TypeJWK
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *JWK) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey returns the base provisioner encrypted key if it's defined.
 func (p *JWK) GetEncryptedKey() (string, string, bool) {
 	return p.Key.KeyID, p.EncryptedKey, len(p.EncryptedKey) > 0
 }
 
+// GetKeyIDs returns the ids of all the keys that can validate the tokens of
+// the provisioner, the current key first.
+func (p *JWK) GetKeyIDs() []string {
+	kids := []string{p.Key.KeyID}
+	for i := len(p.PreviousKeys) - 1; i >= 0; i-- {
+		kids = append(kids, p.PreviousKeys[i].KeyID)
+	}
+	return kids
+}
+
+// getKey returns the key with the given kid. It defaults to the current key if
+// the kid is not found.
+func (p *JWK) getKey(kid string) *jose.JSONWebKey {
+	for _, k := range p.PreviousKeys {
+		if k.KeyID == kid {
+			return k
+		}
+	}
+	return p.Key
+}
+
 // Init initializes and validates the fields of a JWK type.
 func (p *JWK) Init(config Config) (err error) {
 	switch {
@@ -86,11 +126,38 @@ func (p *JWK) Init(config Config) (err error) {
 		return errors.New("provisioner key cannot be empty")
 	}
 
+	// Validate the keys of previous rotations
+	kids := map[string]bool{p.Key.KeyID: true}
+	for _, k := range p.PreviousKeys {
+		switch {
+		case k == nil:
+			return errors.New("provisioner previous keys cannot be empty")
+		case k.KeyID == "":
+			return errors.New("provisioner previous keys must have a kid")
+		case kids[k.KeyID]:
+			return errors.Errorf("provisioner key with kid %s is duplicated", k.KeyID)
+		}
+		kids[k.KeyID] = true
+	}
+
 	// Update claims with global ones
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
 		return err
 	}
 
+	// Parse the x509 and SSH templates and validate the webhooks
+	if p.x509, err = initTemplateOptions(p.X509, p.SSH, p.Webhooks, p.Name, config); err != nil {
+		return err
+	}
+	if err = p.SSHPolicy.init(p.Name); err != nil {
+		return err
+	}
+
+	// Load the attestation roots
+	if err = p.Attestation.init(); err != nil {
+		return err
+	}
+
 	p.audiences = config.Audiences
 	return err
 }
@@ -104,8 +171,15 @@ func (p *JWK) authorizeToken(token string, audiences []string) (*jwtPayload, err
 		return nil, errs.Wrap(http.StatusUnauthorized, err, "jwk.authorizeToken; error parsing jwk token")
 	}
 
+	// Select the key using the kid header, tokens signed with a previous key
+	// are valid until the key is retired.
+	var kid string
+	if len(jwt.Headers) > 0 {
+		kid = jwt.Headers[0].KeyID
+	}
+
 	var claims jwtPayload
-	if err = jwt.Claims(p.Key, &claims); err != nil {
+	if err = jwt.Claims(p.getKey(kid), &claims); err != nil {
 		return nil, errs.Wrap(http.StatusUnauthorized, err, "jwk.authorizeToken; error parsing jwk claims")
 	}
 
@@ -138,6 +212,20 @@ func (p *JWK) AuthorizeRevoke(ctx context.Context, token string) error {
 	return errs.Wrap(http.StatusInternalServerError, err, "jwk.AuthorizeRevoke")
 }
 
+// AuthorizeAdmin returns the subject of the token, or an error if the token is
+// not valid for the admin API, or if the provisioner is not an admin
+// provisioner.
+func (p *JWK) AuthorizeAdmin(ctx context.Context, token string) (string, error) {
+	claims, err := p.authorizeToken(token, p.audiences.Admin)
+	if err != nil {
+		return "", errs.Wrap(http.StatusInternalServerError, err, "jwk.AuthorizeAdmin")
+	}
+	if !p.Admin {
+		return "", errs.Forbidden("jwk.AuthorizeAdmin; provisioner %s is not an admin provisioner", p.GetID())
+	}
+	return claims.Subject, nil
+}
+
 // AuthorizeSign validates the given token.
 func (p *JWK) AuthorizeSign(ctx context.Context, token string) ([]SignOption, error) {
 	claims, err := p.authorizeToken(token, p.audiences.Sign)
@@ -153,7 +241,8 @@ func (p *JWK) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 	}
 
 	dnsNames, ips, emails := x509util.SplitSANs(claims.SANs)
-	return []SignOption{
+	data := newTemplateData(claims.Subject, claims.SANs, token)
+	return append([]SignOption{
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeJWK, p.Name, p.Key.KeyID),
 		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
@@ -164,7 +253,8 @@ func (p *JWK) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 		emailAddressesValidator(emails),
 		ipAddressesValidator(ips),
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	}, nil
+		newAttestationValidator(p.Attestation, token),
+	}, templateSignOptions(ctx, p.x509, p.Webhooks, p.Name, data)...), nil
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
@@ -221,7 +311,7 @@ func (p *JWK) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 	// Default to a user certificate with no principals if not set
 	signOptions = append(signOptions, sshCertDefaultsModifier{CertType: SSHUserCert})
 
-	return append(signOptions,
+	signOptions = append(signOptions,
 		// Set the default extensions.
 		&sshDefaultExtensionModifier{},
 		// Set the validity bounds if not set.
@@ -234,7 +324,9 @@ func (p *JWK) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 		&sshCertValidityValidator{p.claimer},
 		// Require and validate all the default fields in the SSH certificate.
 		&sshCertDefaultValidator{},
-	), nil
+	)
+	signOptions = append(signOptions, sshTemplateSignOptions(p.SSH, p.Name, token)...)
+	return append(signOptions, sshPolicySignOptions(p.SSHPolicy, []string{claims.Subject}, false)...), nil
 }
 
 // AuthorizeSSHRevoke returns nil if the token is valid, false otherwise.
@@ -81,11 +81,34 @@ func TestJWK_Init(t *testing.T) {
 				err: errors.New("claims: DefaultTLSCertDuration must be greater than 0"),
 			}
 		},
+		"fail-empty-previous-key": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{KeyID: "foo"}, PreviousKeys: []*jose.JSONWebKey{nil}},
+				err: errors.New("provisioner previous keys cannot be empty"),
+			}
+		},
+		"fail-previous-key-kid": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{KeyID: "foo"}, PreviousKeys: []*jose.JSONWebKey{{}}},
+				err: errors.New("provisioner previous keys must have a kid"),
+			}
+		},
+		"fail-duplicated-kid": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{KeyID: "foo"}, PreviousKeys: []*jose.JSONWebKey{{KeyID: "bar"}, {KeyID: "foo"}}},
+				err: errors.New("provisioner key with kid foo is duplicated"),
+			}
+		},
 		"ok": func(t *testing.T) ProvisionerValidateTest {
 			return ProvisionerValidateTest{
 				p: &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{}, audiences: testAudiences},
 			}
 		},
+		"ok-previous-keys": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{KeyID: "foo"}, PreviousKeys: []*jose.JSONWebKey{{KeyID: "bar"}, {KeyID: "baz"}}},
+			}
+		},
 	}
 
 	config := Config{
@@ -157,6 +180,15 @@ func TestJWK_authorizeToken(t *testing.T) {
 	// Remove encrypted key for p2
 	p2.EncryptedKey = ""
 
+	// p3 is p1 after a key rotation
+	p3 := *p1
+	key4, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	pub4 := key4.Public()
+	p3.Key, p3.PreviousKeys = &pub4, []*jose.JSONWebKey{p1.Key}
+	t4, err := generateSimpleToken(p1.Name, testAudiences.Sign[0], key4)
+	assert.FatalError(t, err)
+
 	type args struct {
 		token string
 	}
@@ -179,6 +211,9 @@ func TestJWK_authorizeToken(t *testing.T) {
 		{"ok", p1, args{t1}, http.StatusOK, nil},
 		{"ok-no-encrypted-key", p2, args{t2}, http.StatusOK, nil},
 		{"ok-no-sans", p1, args{t3}, http.StatusOK, nil},
+		{"ok-current-key", &p3, args{t4}, http.StatusOK, nil},
+		{"ok-previous-key", &p3, args{t1}, http.StatusOK, nil},
+		{"fail-previous-key", p1, args{t4}, http.StatusUnauthorized, errors.New("jwk.authorizeToken; error parsing jwk claims")},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -278,7 +313,7 @@ func TestJWK_AuthorizeSign(t *testing.T) {
 				}
 			} else {
 				if assert.NotNil(t, got) {
-					assert.Len(t, 8, got)
+					assert.Len(t, 9, got)
 					for _, o := range got {
 						switch v := o.(type) {
 						case *provisionerExtensionOption:
@@ -300,6 +335,7 @@ func TestJWK_AuthorizeSign(t *testing.T) {
 						case *validityValidator:
 							assert.Equals(t, v.min, tt.prov.claimer.MinTLSCertDuration())
 							assert.Equals(t, v.max, tt.prov.claimer.MaxTLSCertDuration())
+						case *attestationValidator:
 						default:
 							assert.FatalError(t, errors.Errorf("unexpected sign option of type %T", v))
 						}
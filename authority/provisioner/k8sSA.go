@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"net/http"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/errs"
@@ -27,27 +28,78 @@ const (
 	k8sSAIssuer = "kubernetes/serviceaccount"
 )
 
-// jwtPayload extends jwt.Claims with step attributes.
+// k8sSAPayload extends jwt.Claims with the kubernetes attributes. The legacy
+// service account tokens use the flat kubernetes.io/serviceaccount/* claims,
+// and the audience-bound projected tokens use the kubernetes.io claim.
 type k8sSAPayload struct {
 	jose.Claims
-	Namespace          string `json:"kubernetes.io/serviceaccount/namespace,omitempty"`
-	SecretName         string `json:"kubernetes.io/serviceaccount/secret.name,omitempty"`
-	ServiceAccountName string `json:"kubernetes.io/serviceaccount/service-account.name,omitempty"`
-	ServiceAccountUID  string `json:"kubernetes.io/serviceaccount/service-account.uid,omitempty"`
+	Namespace          string                `json:"kubernetes.io/serviceaccount/namespace,omitempty"`
+	SecretName         string                `json:"kubernetes.io/serviceaccount/secret.name,omitempty"`
+	ServiceAccountName string                `json:"kubernetes.io/serviceaccount/service-account.name,omitempty"`
+	ServiceAccountUID  string                `json:"kubernetes.io/serviceaccount/service-account.uid,omitempty"`
+	Kubernetes         *k8sSAProjectedClaims `json:"kubernetes.io,omitempty"`
+}
+
+// k8sSAProjectedClaims are the kubernetes attributes of a projected service
+// account token.
+type k8sSAProjectedClaims struct {
+	Namespace      string            `json:"namespace"`
+	ServiceAccount k8sSAObjectClaim  `json:"serviceaccount"`
+	Pod            *k8sSAObjectClaim `json:"pod,omitempty"`
+}
+
+// k8sSAObjectClaim is the reference to a kubernetes object in a projected
+// service account token.
+type k8sSAObjectClaim struct {
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+}
+
+// isProjected returns true if the payload belongs to an audience-bound
+// projected token.
+func (c *k8sSAPayload) isProjected() bool {
+	return c.Kubernetes != nil
+}
+
+// serviceAccount returns the namespace and name of the service account.
+func (c *k8sSAPayload) serviceAccount() (namespace, name string) {
+	if c.Kubernetes != nil {
+		return c.Kubernetes.Namespace, c.Kubernetes.ServiceAccount.Name
+	}
+	return c.Namespace, c.ServiceAccountName
 }
 
 // K8sSA represents a Kubernetes ServiceAccount provisioner; an
 // entity trusted to make signature requests.
+//
+// The tokens are validated using the PubKeys, or using the kubernetes
+// TokenReview API if a Kubeconfig is configured. Projected tokens must have
+// one of the CA URLs as an audience, and if the Issuer is set, it must match.
+//
+// If Namespaces or ServiceAccounts are set, only the tokens of the given
+// namespaces or service accounts will be accepted. A service account can be
+// given as a name or as a namespace/name pair.
 type K8sSA struct {
 	*base
-	Type      string  `json:"type"`
-	Name      string  `json:"name"`
-	Claims    *Claims `json:"claims,omitempty"`
-	PubKeys   []byte  `json:"publicKeys,omitempty"`
-	claimer   *Claimer
-	audiences Audiences
-	//kauthn    kauthn.AuthenticationV1Interface
-	pubKeys []interface{}
+	Type            string              `json:"type"`
+	Name            string              `json:"name"`
+	Disabled        bool                `json:"disabled,omitempty"`
+	Claims          *Claims             `json:"claims,omitempty"`
+	X509            *X509Options        `json:"x509,omitempty"`
+	SSH             *SSHTemplateOptions `json:"ssh,omitempty"`
+	SSHPolicy       *SSHPolicy          `json:"sshPolicy,omitempty"`
+	Webhooks        []*Webhook          `json:"webhooks,omitempty"`
+	Attestation     *AttestationOptions `json:"attestation,omitempty"`
+	PubKeys         []byte              `json:"publicKeys,omitempty"`
+	Kubeconfig      string              `json:"kubeconfig,omitempty"`
+	Issuer          string              `json:"issuer,omitempty"`
+	Namespaces      []string            `json:"namespaces,omitempty"`
+	ServiceAccounts []string            `json:"serviceAccounts,omitempty"`
+	claimer         *Claimer
+	x509            *X509Options
+	audiences       Audiences
+	reviewer        *k8sTokenReviewer
+	pubKeys         []interface{}
 }
 
 // GetID returns the provisioner unique identifier. The name and credential id
@@ -71,6 +123,11 @@ func (p *K8sSA) GetType() Type {
 	return TypeK8sSA
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *K8sSA) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey returns false, because the kubernetes provisioner does not
 // have access to the private key.
 func (p *K8sSA) GetEncryptedKey() (string, string, bool) {
@@ -107,29 +164,34 @@ func (p *K8sSA) Init(config Config) (err error) {
 			}
 			p.pubKeys = append(p.pubKeys, key)
 		}
-	} else {
-		// TODO: Use the TokenReview API if no pub keys provided. This will need to
-		// be configured with additional attributes in the K8sSA struct for
-		// connecting to the kubernetes API server.
-		return errors.New("K8s Service Account provisioner cannot be initialized without pub keys")
 	}
-	/*
-		// NOTE: Not sure if we should be doing this initialization here ...
-		// If you have a k8sSA provisioner defined in your config, but you're not
-		// in a kubernetes pod then your CA will fail to startup. Maybe we just postpone
-		// creating the authn until token validation time?
-		if err := checkAccess(k8s.AuthorizationV1()); err != nil {
-			return errors.Wrapf(err, "error verifying access to kubernetes authz service for provisioner %s", p.GetID())
+	if p.Kubeconfig != "" {
+		if p.reviewer, err = newK8sTokenReviewer(p.Kubeconfig); err != nil {
+			return errors.Wrapf(err, "error loading kubeconfig in provisioner %s", p.GetID())
 		}
-
-		p.kauthn = k8s.AuthenticationV1()
-	*/
+	}
+	if p.pubKeys == nil && p.reviewer == nil {
+		return errors.New("K8s Service Account provisioner cannot be initialized without pub keys or kubeconfig")
+	}
 
 	// Update claims with global ones
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
 		return err
 	}
 
+	// Parse the x509 and SSH templates and validate the webhooks
+	if p.x509, err = initTemplateOptions(p.X509, p.SSH, p.Webhooks, p.Name, config); err != nil {
+		return err
+	}
+	if err = p.SSHPolicy.init(p.Name); err != nil {
+		return err
+	}
+
+	// Load the attestation roots
+	if err = p.Attestation.init(); err != nil {
+		return err
+	}
+
 	p.audiences = config.Audiences
 	return err
 }
@@ -147,28 +209,10 @@ func (p *K8sSA) authorizeToken(token string, audiences []string) (*k8sSAPayload,
 	var (
 		valid  bool
 		claims k8sSAPayload
+		status *k8sTokenReviewStatus
 	)
-	if p.pubKeys == nil {
-		return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA TokenReview API integration not implemented")
-		/* NOTE: We plan to support the TokenReview API in a future release.
-		         Below is some code that should be useful when we prioritize
-				 this integration.
-
-			tr := kauthnApi.TokenReview{Spec: kauthnApi.TokenReviewSpec{Token: string(token)}}
-			rvw, err := p.kauthn.TokenReviews().Create(&tr)
-			if err != nil {
-				return nil, errors.Wrap(err, "error using kubernetes TokenReview API")
-			}
-			if rvw.Status.Error != "" {
-				return nil, errors.Errorf("error from kubernetes TokenReviewAPI: %s", rvw.Status.Error)
-			}
-			if !rvw.Status.Authenticated {
-				return nil, errors.New("error from kubernetes TokenReviewAPI: token could not be authenticated")
-			}
-			if err = jwt.UnsafeClaimsWithoutVerification(&claims); err != nil {
-				return nil, errors.Wrap(err, "error parsing claims")
-			}
-		*/
+	if err = jwt.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, errs.Wrap(http.StatusUnauthorized, err, "k8ssa.authorizeToken; error parsing k8sSA token claims")
 	}
 	for _, pk := range p.pubKeys {
 		if err = jwt.Claims(pk, &claims); err == nil {
@@ -176,13 +220,37 @@ func (p *K8sSA) authorizeToken(token string, audiences []string) (*k8sSAPayload,
 			break
 		}
 	}
+	if !valid && p.reviewer != nil {
+		// Ask the API server to bind projected tokens to the CA audiences.
+		var auds []string
+		if claims.isProjected() {
+			auds = audiences
+		}
+		if status, err = p.reviewer.Review(token, auds); err != nil {
+			return nil, errs.Wrap(http.StatusUnauthorized, err, "k8ssa.authorizeToken; error reviewing k8sSA token")
+		}
+		if !status.Authenticated {
+			return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA token was not authenticated by the TokenReview API: %s", status.Error)
+		}
+		valid = true
+	}
 	if !valid {
 		return nil, errs.Unauthorized("k8ssa.authorizeToken; error validating k8sSA token and extracting claims")
 	}
 
 	// According to "rfc7519 JSON Web Token" acceptable skew should be no
 	// more than a few minutes.
-	if err = claims.Validate(jose.Expected{
+	if claims.isProjected() {
+		if err = claims.ValidateWithLeeway(jose.Expected{
+			Issuer: p.Issuer,
+			Time:   time.Now().UTC(),
+		}, time.Minute); err != nil {
+			return nil, errs.Wrap(http.StatusUnauthorized, err, "k8ssa.authorizeToken; invalid k8sSA token claims")
+		}
+		if !matchesAudience(claims.Audience, audiences) {
+			return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA token has invalid audience claim (aud)")
+		}
+	} else if err = claims.Validate(jose.Expected{
 		Issuer: k8sSAIssuer,
 	}); err != nil {
 		return nil, errs.Wrap(http.StatusUnauthorized, err, "k8ssa.authorizeToken; invalid k8sSA token claims")
@@ -192,6 +260,23 @@ func (p *K8sSA) authorizeToken(token string, audiences []string) (*k8sSAPayload,
 		return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA token subject cannot be empty")
 	}
 
+	namespace, name := claims.serviceAccount()
+	if namespace == "" || name == "" {
+		return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA token service account namespace and name cannot be empty")
+	}
+	if status != nil && status.User.Username != "system:serviceaccount:"+namespace+":"+name {
+		return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA token service account does not match the TokenReview user %s", status.User.Username)
+	}
+
+	// validate namespaces and service accounts
+	if len(p.Namespaces) > 0 && !containsString(p.Namespaces, namespace) {
+		return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA token namespace %s is not allowed", namespace)
+	}
+	if len(p.ServiceAccounts) > 0 &&
+		!containsString(p.ServiceAccounts, name) && !containsString(p.ServiceAccounts, namespace+"/"+name) {
+		return nil, errs.Unauthorized("k8ssa.authorizeToken; k8sSA token service account %s/%s is not allowed", namespace, name)
+	}
+
 	return &claims, nil
 }
 
@@ -204,18 +289,23 @@ func (p *K8sSA) AuthorizeRevoke(ctx context.Context, token string) error {
 
 // AuthorizeSign validates the given token.
 func (p *K8sSA) AuthorizeSign(ctx context.Context, token string) ([]SignOption, error) {
-	if _, err := p.authorizeToken(token, p.audiences.Sign); err != nil {
+	claims, err := p.authorizeToken(token, p.audiences.Sign)
+	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "k8ssa.AuthorizeSign")
 	}
+	dnsName := k8sSAServiceName(claims.serviceAccount())
+	data := newTemplateData(claims.Subject, []string{dnsName}, token)
 
-	return []SignOption{
+	return append([]SignOption{
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeK8sSA, p.Name, ""),
 		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
 		// validators
 		defaultPublicKeyValidator{},
+		k8sSANsValidator{dnsName},
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	}, nil
+		newAttestationValidator(p.Attestation, token),
+	}, templateSignOptions(ctx, p.x509, p.Webhooks, p.Name, data)...), nil
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
@@ -238,7 +328,7 @@ func (p *K8sSA) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOptio
 	// Default to a user certificate with no principals if not set
 	signOptions := []SignOption{sshCertDefaultsModifier{CertType: SSHUserCert}}
 
-	return append(signOptions,
+	signOptions = append(signOptions,
 		// Set the default extensions.
 		&sshDefaultExtensionModifier{},
 		// Set the validity bounds if not set.
@@ -249,29 +339,44 @@ func (p *K8sSA) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOptio
 		&sshCertValidityValidator{p.claimer},
 		// Require and validate all the default fields in the SSH certificate.
 		&sshCertDefaultValidator{},
-	), nil
+	)
+	signOptions = append(signOptions, sshTemplateSignOptions(p.SSH, p.Name, token)...)
+	return append(signOptions, sshPolicySignOptions(p.SSHPolicy, nil, false)...), nil
+}
+
+// k8sSAServiceName returns the DNS name authorized for a service account,
+// <name>.<namespace>.svc.
+func k8sSAServiceName(namespace, name string) string {
+	return name + "." + namespace + ".svc"
 }
 
-/*
-func checkAccess(authz kauthz.AuthorizationV1Interface) error {
-	r := &kauthzApi.SelfSubjectAccessReview{
-		Spec: kauthzApi.SelfSubjectAccessReviewSpec{
-			ResourceAttributes: &kauthzApi.ResourceAttributes{
-				Group:    "authentication.k8s.io",
-				Version:  "v1",
-				Resource: "tokenreviews",
-				Verb:     "create",
-			},
-		},
+// k8sSANsValidator validates that the common name and DNS names in the
+// certificate request are one of the names of the service account. Other SANs
+// are not allowed.
+type k8sSANsValidator []string
+
+// Valid implements the CertificateRequestValidator interface.
+func (v k8sSANsValidator) Valid(req *x509.CertificateRequest) error {
+	if req.Subject.CommonName != "" && !containsString(v, req.Subject.CommonName) {
+		return errors.Errorf("certificate request common name %s is not allowed", req.Subject.CommonName)
 	}
-	rvw, err := authz.SelfSubjectAccessReviews().Create(r)
-	if err != nil {
-		return err
+	for _, name := range req.DNSNames {
+		if !containsString(v, name) {
+			return errors.Errorf("certificate request DNS name %s is not allowed", name)
+		}
 	}
-	if !rvw.Status.Allowed {
-		return fmt.Errorf("Unable to create kubernetes token reviews: %s", rvw.Status.Reason)
+	if len(req.IPAddresses) > 0 || len(req.EmailAddresses) > 0 || len(req.URIs) > 0 {
+		return errors.New("certificate request can only contain DNS names")
 	}
-
 	return nil
 }
-*/
+
+// containsString returns true if the given slice contains s.
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
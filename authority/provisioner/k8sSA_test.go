@@ -3,7 +3,15 @@ package provisioner
 import (
 	"context"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -51,7 +59,7 @@ func TestK8sSA_authorizeToken(t *testing.T) {
 				err:   errors.New("k8ssa.authorizeToken; error parsing k8sSA token"),
 			}
 		},
-		"fail/not-implemented": func(t *testing.T) test {
+		"fail/no-keys": func(t *testing.T) test {
 			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
 			assert.FatalError(t, err)
 			p, err := generateK8sSA(nil)
@@ -63,7 +71,7 @@ func TestK8sSA_authorizeToken(t *testing.T) {
 			return test{
 				p:     p,
 				token: tok,
-				err:   errors.New("k8ssa.authorizeToken; k8sSA TokenReview API integration not implemented"),
+				err:   errors.New("k8ssa.authorizeToken; error validating k8sSA token and extracting claims"),
 				code:  http.StatusUnauthorized,
 			}
 		},
@@ -98,6 +106,114 @@ func TestK8sSA_authorizeToken(t *testing.T) {
 				err:   errors.New("k8ssa.authorizeToken; invalid k8sSA token claims: square/go-jose/jwt: validation failed, invalid issuer claim (iss)"),
 			}
 		},
+		"fail/missing-namespace": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			p, err := generateK8sSA(jwk.Public().Key)
+			assert.FatalError(t, err)
+			claims := getK8sSAPayload()
+			claims.Namespace = ""
+			tok, err := generateK8sSAToken(jwk, claims)
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("k8ssa.authorizeToken; k8sSA token service account namespace and name cannot be empty"),
+			}
+		},
+		"fail/namespace-not-allowed": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			p, err := generateK8sSA(jwk.Public().Key)
+			assert.FatalError(t, err)
+			p.Namespaces = []string{"ns-bar"}
+			tok, err := generateK8sSAToken(jwk, nil)
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("k8ssa.authorizeToken; k8sSA token namespace ns-foo is not allowed"),
+			}
+		},
+		"fail/service-account-not-allowed": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			p, err := generateK8sSA(jwk.Public().Key)
+			assert.FatalError(t, err)
+			p.ServiceAccounts = []string{"san-bar", "ns-bar/san-foo"}
+			tok, err := generateK8sSAToken(jwk, nil)
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("k8ssa.authorizeToken; k8sSA token service account ns-foo/san-foo is not allowed"),
+			}
+		},
+		"fail/projected-audience": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			p, err := generateK8sSA(jwk.Public().Key)
+			assert.FatalError(t, err)
+			claims := getK8sSAProjectedPayload()
+			claims.Audience = []string{"https://kubernetes.default.svc"}
+			tok, err := generateK8sSAToken(jwk, claims)
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("k8ssa.authorizeToken; k8sSA token has invalid audience claim (aud)"),
+			}
+		},
+		"fail/projected-issuer": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			p, err := generateK8sSA(jwk.Public().Key)
+			assert.FatalError(t, err)
+			p.Issuer = "https://oidc.cluster.example.com"
+			tok, err := generateK8sSAToken(jwk, getK8sSAProjectedPayload())
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("k8ssa.authorizeToken; invalid k8sSA token claims: square/go-jose/jwt: validation failed, invalid issuer claim (iss)"),
+			}
+		},
+		"fail/projected-expired": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			p, err := generateK8sSA(jwk.Public().Key)
+			assert.FatalError(t, err)
+			claims := getK8sSAProjectedPayload()
+			claims.Expiry = jose.NewNumericDate(time.Now().Add(-5 * time.Minute))
+			tok, err := generateK8sSAToken(jwk, claims)
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("k8ssa.authorizeToken; invalid k8sSA token claims: square/go-jose/jwt: validation failed, token is expired (exp)"),
+			}
+		},
+		"ok/projected": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			p, err := generateK8sSA(jwk.Public().Key)
+			assert.FatalError(t, err)
+			p.Issuer = "https://kubernetes.default.svc"
+			p.Namespaces = []string{"ns-foo"}
+			p.ServiceAccounts = []string{"ns-foo/san-foo"}
+			tok, err := generateK8sSAToken(jwk, getK8sSAProjectedPayload())
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+			}
+		},
 		"ok": func(t *testing.T) test {
 			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
 			assert.FatalError(t, err)
@@ -282,15 +398,18 @@ func TestK8sSA_AuthorizeSign(t *testing.T) {
 							case profileDefaultDuration:
 								assert.Equals(t, time.Duration(v), tc.p.claimer.DefaultTLSCertDuration())
 							case defaultPublicKeyValidator:
+							case k8sSANsValidator:
+								assert.Equals(t, v, k8sSANsValidator{"san-foo.ns-foo.svc"})
 							case *validityValidator:
 								assert.Equals(t, v.min, tc.p.claimer.MinTLSCertDuration())
 								assert.Equals(t, v.max, tc.p.claimer.MaxTLSCertDuration())
+							case *attestationValidator:
 							default:
 								assert.FatalError(t, errors.Errorf("unexpected sign option of type %T", v))
 							}
 							tot++
 						}
-						assert.Equals(t, tot, 4)
+						assert.Equals(t, tot, 6)
 					}
 				}
 			}
@@ -381,3 +500,133 @@ func TestK8sSA_AuthorizeSSHSign(t *testing.T) {
 		})
 	}
 }
+
+func TestK8sSA_authorizeToken_tokenReview(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	var reviewAudiences []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" || r.Header.Get("Authorization") != "Bearer admin-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var review k8sTokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reviewAudiences = review.Spec.Audiences
+		// Only the tokens signed by jwk are valid.
+		if tok, err := jose.ParseSigned(review.Spec.Token); err == nil {
+			var claims k8sSAPayload
+			if err := tok.Claims(jwk.Public().Key, &claims); err == nil {
+				ns, name := claims.serviceAccount()
+				review.Status.Authenticated = true
+				review.Status.User.Username = "system:serviceaccount:" + ns + ":" + name
+			} else {
+				review.Status.Error = "invalid bearer token"
+			}
+		}
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer srv.Close()
+
+	kubeconfig := map[string]interface{}{
+		"current-context": "test",
+		"clusters": []interface{}{map[string]interface{}{
+			"name": "test",
+			"cluster": map[string]interface{}{
+				"server": srv.URL,
+				"certificate-authority-data": pem.EncodeToMemory(&pem.Block{
+					Type: "CERTIFICATE", Bytes: srv.Certificate().Raw,
+				}),
+			},
+		}},
+		"users": []interface{}{map[string]interface{}{
+			"name": "test",
+			"user": map[string]interface{}{"token": "admin-token"},
+		}},
+		"contexts": []interface{}{map[string]interface{}{
+			"name":    "test",
+			"context": map[string]interface{}{"cluster": "test", "user": "test"},
+		}},
+	}
+	dir, err := ioutil.TempDir("", "k8ssa")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	b, err := json.Marshal(kubeconfig)
+	assert.FatalError(t, err)
+	filename := filepath.Join(dir, "kubeconfig.json")
+	assert.FatalError(t, ioutil.WriteFile(filename, b, 0600))
+
+	p := &K8sSA{
+		Type:       "K8sSA",
+		Name:       K8sSAName,
+		Kubeconfig: filename,
+	}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims, Audiences: testAudiences}))
+
+	otherJWK, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	legacy, err := generateK8sSAToken(jwk, nil)
+	assert.FatalError(t, err)
+	projected, err := generateK8sSAToken(jwk, getK8sSAProjectedPayload())
+	assert.FatalError(t, err)
+	invalid, err := generateK8sSAToken(otherJWK, nil)
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name      string
+		token     string
+		audiences []string
+		err       error
+	}{
+		{"ok/legacy", legacy, nil, nil},
+		{"ok/projected", projected, testAudiences.Sign, nil},
+		{"fail/not-authenticated", invalid, nil,
+			errors.New("k8ssa.authorizeToken; k8sSA token was not authenticated by the TokenReview API: invalid bearer token")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviewAudiences = nil
+			claims, err := p.authorizeToken(tt.token, testAudiences.Sign)
+			assert.Equals(t, tt.audiences, reviewAudiences)
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					sc, ok := err.(errs.StatusCoder)
+					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+					assert.Equals(t, http.StatusUnauthorized, sc.StatusCode())
+					assert.HasPrefix(t, err.Error(), tt.err.Error())
+				}
+			} else if assert.Nil(t, tt.err) {
+				ns, name := claims.serviceAccount()
+				assert.Equals(t, "ns-foo", ns)
+				assert.Equals(t, "san-foo", name)
+			}
+		})
+	}
+}
+
+func Test_k8sSANsValidator_Valid(t *testing.T) {
+	v := k8sSANsValidator{"san-foo.ns-foo.svc"}
+	tests := []struct {
+		name    string
+		req     *x509.CertificateRequest
+		wantErr bool
+	}{
+		{"ok", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "san-foo.ns-foo.svc"}, DNSNames: []string{"san-foo.ns-foo.svc"}}, false},
+		{"ok/no-cn", &x509.CertificateRequest{DNSNames: []string{"san-foo.ns-foo.svc"}}, false},
+		{"fail/cn", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo"}}, true},
+		{"fail/dns", &x509.CertificateRequest{DNSNames: []string{"san-foo.ns-foo.svc", "san-bar.ns-foo.svc"}}, true},
+		{"fail/ip", &x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, true},
+		{"fail/email", &x509.CertificateRequest{EmailAddresses: []string{"foo@smallstep.com"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := v.Valid(tt.req); (err != nil) != tt.wantErr {
+				t.Errorf("k8sSANsValidator.Valid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const k8sTokenReviewPath = "/apis/authentication.k8s.io/v1/tokenreviews"
+
+// k8sKubeconfig is the subset of a kubeconfig file used to connect to the
+// kubernetes API server. It must be in JSON format, `kubectl config view --raw
+// --flatten -o json` can be used to generate it.
+type k8sKubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData []byte `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData []byte `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         []byte `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+// k8sTokenReviewer validates service account tokens using the kubernetes
+// TokenReview API.
+type k8sTokenReviewer struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// k8sTokenReview is the TokenReview object sent and returned by the
+// kubernetes API server.
+type k8sTokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+	Status k8sTokenReviewStatus `json:"status"`
+}
+
+// k8sTokenReviewStatus is the result of a token review.
+type k8sTokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	Audiences     []string `json:"audiences,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	User          struct {
+		Username string `json:"username"`
+		UID      string `json:"uid"`
+	} `json:"user"`
+}
+
+// newK8sTokenReviewer reads the given kubeconfig and returns a reviewer that
+// connects to the API server of the current context.
+func newK8sTokenReviewer(filename string) (*k8sTokenReviewer, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", filename)
+	}
+	var kc k8sKubeconfig
+	if err := json.Unmarshal(b, &kc); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext || (kc.CurrentContext == "" && len(kc.Contexts) == 1) {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			break
+		}
+	}
+	if clusterName == "" {
+		return nil, errors.Errorf("error parsing %s: context '%s' not found", filename, kc.CurrentContext)
+	}
+
+	r := &k8sTokenReviewer{}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	var found bool
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		if c.Cluster.Server == "" {
+			return nil, errors.Errorf("error parsing %s: cluster '%s' server cannot be empty", filename, clusterName)
+		}
+		r.url = strings.TrimSuffix(c.Cluster.Server, "/") + k8sTokenReviewPath
+		ca := c.Cluster.CertificateAuthorityData
+		if c.Cluster.CertificateAuthority != "" {
+			if ca, err = ioutil.ReadFile(c.Cluster.CertificateAuthority); err != nil {
+				return nil, errors.Wrapf(err, "error reading %s", c.Cluster.CertificateAuthority)
+			}
+		}
+		if len(ca) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, errors.Errorf("error parsing %s: cluster '%s' certificate authority is not valid", filename, clusterName)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+	}
+	if !found {
+		return nil, errors.Errorf("error parsing %s: cluster '%s' not found", filename, clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		r.token = u.User.Token
+		if u.User.TokenFile != "" {
+			b, err := ioutil.ReadFile(u.User.TokenFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading %s", u.User.TokenFile)
+			}
+			r.token = strings.TrimSpace(string(b))
+		}
+		crt, key := u.User.ClientCertificateData, u.User.ClientKeyData
+		if u.User.ClientCertificate != "" {
+			if crt, err = ioutil.ReadFile(u.User.ClientCertificate); err != nil {
+				return nil, errors.Wrapf(err, "error reading %s", u.User.ClientCertificate)
+			}
+		}
+		if u.User.ClientKey != "" {
+			if key, err = ioutil.ReadFile(u.User.ClientKey); err != nil {
+				return nil, errors.Wrapf(err, "error reading %s", u.User.ClientKey)
+			}
+		}
+		if len(crt) > 0 {
+			cert, err := tls.X509KeyPair(crt, key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error parsing %s: user '%s' client certificate is not valid", filename, userName)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	r.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return r, nil
+}
+
+// Review sends the given token to the TokenReview API and returns the status
+// of the review. If audiences is not empty, the API server will also validate
+// that the token is bound to one of them.
+func (r *k8sTokenReviewer) Review(token string, audiences []string) (*k8sTokenReviewStatus, error) {
+	review := k8sTokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+	}
+	review.Spec.Token = token
+	review.Spec.Audiences = audiences
+	b, err := json.Marshal(review)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling token review")
+	}
+
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating token review request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error doing token review request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, errors.Errorf("error doing token review request: status code %d", resp.StatusCode)
+	}
+
+	var rvw k8sTokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&rvw); err != nil {
+		return nil, errors.Wrap(err, "error decoding token review response")
+	}
+	return &rvw.Status, nil
+}
@@ -18,15 +18,20 @@ const (
 	defaultCacheJitter = 1 * time.Hour
 )
 
+// minRefreshInterval is the minimum time between two reloads of the keys
+// triggered by an unknown kid.
+var minRefreshInterval = time.Minute
+
 var maxAgeRegex = regexp.MustCompile("max-age=([0-9]+)")
 
 type keyStore struct {
 	sync.RWMutex
-	uri    string
-	keySet jose.JSONWebKeySet
-	timer  *time.Timer
-	expiry time.Time
-	jitter time.Duration
+	uri        string
+	keySet     jose.JSONWebKeySet
+	timer      *time.Timer
+	expiry     time.Time
+	jitter     time.Duration
+	lastReload time.Time
 }
 
 func newKeyStore(uri string) (*keyStore, error) {
@@ -35,10 +40,11 @@ func newKeyStore(uri string) (*keyStore, error) {
 		return nil, err
 	}
 	ks := &keyStore{
-		uri:    uri,
-		keySet: keys,
-		expiry: getExpirationTime(age),
-		jitter: getCacheJitter(age),
+		uri:        uri,
+		keySet:     keys,
+		expiry:     getExpirationTime(age),
+		jitter:     getCacheJitter(age),
+		lastReload: time.Now(),
 	}
 	next := ks.nextReloadDuration(age)
 	ks.timer = time.AfterFunc(next, ks.reload)
@@ -58,10 +64,38 @@ func (ks *keyStore) Get(kid string) (keys []jose.JSONWebKey) {
 		ks.RLock()
 	}
 	keys = ks.keySet.Key(kid)
+	lastReload := ks.lastReload
 	ks.RUnlock()
+
+	// Refresh the keys if the kid is not found, the provider might have
+	// rotated them. Refreshes are rate limited to avoid hitting the provider
+	// with tokens signed by random keys.
+	if len(keys) == 0 && time.Since(lastReload) > minRefreshInterval {
+		if ks.refresh() {
+			ks.RLock()
+			keys = ks.keySet.Key(kid)
+			ks.RUnlock()
+		}
+	}
 	return
 }
 
+// refresh reloads the keys without resetting the reload timer. It returns true
+// if the keys have been reloaded.
+func (ks *keyStore) refresh() bool {
+	keys, age, err := getKeysFromJWKsURI(ks.uri)
+	ks.Lock()
+	defer ks.Unlock()
+	ks.lastReload = time.Now()
+	if err != nil {
+		return false
+	}
+	ks.keySet = keys
+	ks.expiry = getExpirationTime(age)
+	ks.jitter = getCacheJitter(age)
+	return true
+}
+
 func (ks *keyStore) reload() {
 	var next time.Duration
 	keys, age, err := getKeysFromJWKsURI(ks.uri)
@@ -72,6 +106,7 @@ func (ks *keyStore) reload() {
 		ks.keySet = keys
 		ks.expiry = getExpirationTime(age)
 		ks.jitter = getCacheJitter(age)
+		ks.lastReload = time.Now()
 		next = ks.nextReloadDuration(age)
 		ks.Unlock()
 	}
@@ -100,7 +135,27 @@ func getKeysFromJWKsURI(uri string) (jose.JSONWebKeySet, time.Duration, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
 		return keys, 0, errors.Wrapf(err, "error reading %s", uri)
 	}
-	return keys, getCacheAge(resp.Header.Get("cache-control")), nil
+	return keys, getCacheAgeFromHeader(resp.Header), nil
+}
+
+// getCacheAgeFromHeader returns the cache age of a response. The max-age
+// directive of the Cache-Control header has precedence over the Expires
+// header, if none of them are present the default age is used.
+func getCacheAgeFromHeader(h http.Header) time.Duration {
+	if cc := h.Get("Cache-Control"); maxAgeRegex.MatchString(cc) {
+		return getCacheAge(cc)
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if age := expires.Sub(date); age > 0 {
+			return age
+		}
+		return 0
+	}
+	return defaultCacheAge
 }
 
 func getCacheAge(cacheControl string) time.Duration {
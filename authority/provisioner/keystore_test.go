@@ -3,6 +3,7 @@ package provisioner
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"reflect"
 	"testing"
 	"time"
@@ -163,6 +164,36 @@ func Test_keyStore_Get(t *testing.T) {
 	}
 }
 
+func Test_getCacheAgeFromHeader(t *testing.T) {
+	now := time.Now().UTC()
+	header := func(kv ...string) http.Header {
+		h := make(http.Header)
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"max-age", header("Cache-Control", "public, max-age=3600"), time.Hour},
+		{"max-age over expires", header("Cache-Control", "max-age=60", "Expires", now.Add(time.Hour).Format(http.TimeFormat)), time.Minute},
+		{"no-cache", header("Cache-Control", "no-cache, no-store, max-age=0, must-revalidate"), 0},
+		{"expires", header("Date", now.Format(http.TimeFormat), "Expires", now.Add(2*time.Hour).Format(http.TimeFormat)), 2 * time.Hour},
+		{"expires in the past", header("Date", now.Format(http.TimeFormat), "Expires", now.Add(-time.Hour).Format(http.TimeFormat)), 0},
+		{"cache-control without max-age", header("Cache-Control", "public"), defaultCacheAge},
+		{"bad expires", header("Expires", "0"), defaultCacheAge},
+		{"empty", header(), defaultCacheAge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, getCacheAgeFromHeader(tt.header))
+		})
+	}
+}
+
 func Test_abs(t *testing.T) {
 	maxInt64 := time.Duration(1<<63 - 1)
 	minInt64 := time.Duration(-1 << 63)
@@ -26,6 +26,9 @@ const (
 	SSHRevokeMethod
 	// SSHRekeyMethod is the method used to rekey SSH certificates.
 	SSHRekeyMethod
+	// SSHCheckHostMethod is the method used to authenticate the requests to
+	// check if a host certificate exists.
+	SSHCheckHostMethod
 )
 
 // String returns a string representation of the context method.
@@ -45,6 +48,8 @@ func (m Method) String() string {
 		return "ssh-revoke-method"
 	case SSHRekeyMethod:
 		return "ssh-rekey-method"
+	case SSHCheckHostMethod:
+		return "ssh-check-host-method"
 	default:
 		return "unknown"
 	}
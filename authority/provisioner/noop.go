@@ -29,6 +29,10 @@ func (p *noop) GetEncryptedKey() (kid string, key string, ok bool) {
 	return "", "", false
 }
 
+func (p *noop) IsDisabled() bool {
+	return false
+}
+
 func (p *noop) Init(config Config) error {
 	return nil
 }
@@ -1,6 +1,7 @@
 package provisioner
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/json"
@@ -9,6 +10,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/pkg/errors"
@@ -52,22 +54,119 @@ type openIDPayload struct {
 // ClientSecret is mandatory, but it can be an empty string.
 type OIDC struct {
 	*base
-	Type                  string   `json:"type"`
-	Name                  string   `json:"name"`
-	ClientID              string   `json:"clientID"`
-	ClientSecret          string   `json:"clientSecret"`
-	ConfigurationEndpoint string   `json:"configurationEndpoint"`
-	Admins                []string `json:"admins,omitempty"`
-	Domains               []string `json:"domains,omitempty"`
-	Groups                []string `json:"groups,omitempty"`
-	ListenAddress         string   `json:"listenAddress,omitempty"`
-	Claims                *Claims  `json:"claims,omitempty"`
+	Type                  string              `json:"type"`
+	Name                  string              `json:"name"`
+	Disabled              bool                `json:"disabled,omitempty"`
+	ClientID              string              `json:"clientID"`
+	ClientSecret          string              `json:"clientSecret"`
+	ConfigurationEndpoint string              `json:"configurationEndpoint"`
+	Admins                []string            `json:"admins,omitempty"`
+	AdminGroups           []string            `json:"adminGroups,omitempty"`
+	GroupsClaim           string              `json:"groupsClaim,omitempty"`
+	Domains               []string            `json:"domains,omitempty"`
+	Groups                []string            `json:"groups,omitempty"`
+	ListenAddress         string              `json:"listenAddress,omitempty"`
+	ClockSkew             *Duration           `json:"clockSkew,omitempty"`
+	Claims                *Claims             `json:"claims,omitempty"`
+	X509                  *X509Options        `json:"x509,omitempty"`
+	X509Policy            *X509Policy         `json:"x509Policy,omitempty"`
+	SSH                   *SSHTemplateOptions `json:"ssh,omitempty"`
+	SSHPolicy             *SSHPolicy          `json:"sshPolicy,omitempty"`
+	SSHPrincipals         *OIDCSSHPrincipals  `json:"sshPrincipals,omitempty"`
+	Webhooks              []*Webhook          `json:"webhooks,omitempty"`
+	Attestation           *AttestationOptions `json:"attestation,omitempty"`
 	configuration         openIDConfiguration
 	keyStore              *keyStore
 	claimer               *Claimer
+	x509                  *X509Options
 	getIdentityFunc       GetIdentityFunc
 }
 
+// OIDCSSHPrincipals are the principals added to the SSH user certificates of
+// an OIDC provisioner. They are added to the principals of the identity, by
+// default the local part of the email and the email, and the non-admin users
+// can only request principals in the resulting set.
+type OIDCSSHPrincipals struct {
+	// Templates are text/templates that render additional principals, like
+	// "dev-{{.localpart}}". The data contains the sanitized local part of the
+	// email as .localpart, the email as .email and the groups as .groups. The
+	// templates rendering an empty string are ignored.
+	Templates []string `json:"templates,omitempty"`
+	// Groups are the principals added to the members of a group, like
+	// {"oncall": ["breakglass"]}.
+	Groups    map[string][]string `json:"groups,omitempty"`
+	templates []*template.Template
+}
+
+// init parses the templates and validates the group principals.
+func (p *OIDCSSHPrincipals) init(name string) error {
+	if p == nil {
+		return nil
+	}
+	p.templates = make([]*template.Template, len(p.Templates))
+	for i, text := range p.Templates {
+		tmpl, err := template.New(name).Funcs(TemplateFuncMap()).Parse(text)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing sshPrincipals template of provisioner %s", name)
+		}
+		p.templates[i] = tmpl
+	}
+	for group, principals := range p.Groups {
+		for _, s := range principals {
+			if strings.TrimSpace(s) == "" {
+				return errors.Errorf("provisioner %s: sshPrincipals of group %s cannot be empty", name, group)
+			}
+		}
+	}
+	return nil
+}
+
+// principals returns the given usernames with the principals rendered by the
+// templates and the ones of the groups of the user, without duplicates.
+func (p *OIDCSSHPrincipals) principals(usernames []string, claims *openIDPayload) ([]string, error) {
+	if p == nil {
+		return usernames, nil
+	}
+	principals := make([]string, 0, len(usernames))
+	add := func(s string) {
+		if !containsString(principals, s) {
+			principals = append(principals, s)
+		}
+	}
+	for _, s := range usernames {
+		add(s)
+	}
+
+	data := map[string]interface{}{
+		"localpart": SanitizeSSHUserPrincipal(claims.Email),
+		"email":     claims.Email,
+		"groups":    claims.Groups,
+	}
+	for _, tmpl := range p.templates {
+		buf := new(bytes.Buffer)
+		if err := tmpl.Execute(buf, data); err != nil {
+			return nil, errors.Wrap(err, "error executing sshPrincipals template")
+		}
+		if s := strings.TrimSpace(buf.String()); s != "" {
+			add(s)
+		}
+	}
+	for _, g := range claims.Groups {
+		for _, s := range p.Groups[g] {
+			add(s)
+		}
+	}
+	return principals, nil
+}
+
+// defaultGroupsClaim is the default name of the claim with the groups of a user.
+const defaultGroupsClaim = "groups"
+
+// defaultOIDCClockSkew is the default leeway used to validate the time claims.
+// According to "rfc7519 JSON Web Token" acceptable skew should be no more than a
+// few minutes.
+const defaultOIDCClockSkew = time.Minute
+
 // IsAdmin returns true if the given email is in the Admins whitelist, false
 // otherwise.
 func (o *OIDC) IsAdmin(email string) bool {
@@ -80,6 +179,49 @@ func (o *OIDC) IsAdmin(email string) bool {
 	return false
 }
 
+// isAdmin returns true if the email in the token is in the Admins whitelist or
+// if the user belongs to one of the AdminGroups.
+func (o *OIDC) isAdmin(p *openIDPayload) bool {
+	if o.IsAdmin(p.Email) {
+		return true
+	}
+	for _, group := range o.AdminGroups {
+		for _, g := range p.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupsClaim returns the name of the claim with the groups.
+func (o *OIDC) groupsClaim() string {
+	if o.GroupsClaim == "" {
+		return defaultGroupsClaim
+	}
+	return o.GroupsClaim
+}
+
+// parseGroups returns the groups in the given claim. The claim can be a list of
+// strings or a single string.
+func parseGroups(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		groups := make([]string, 0, len(v))
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	default:
+		return nil
+	}
+}
+
 func sanitizeEmail(email string) string {
 	if i := strings.LastIndex(email, "@"); i >= 0 {
 		email = email[:i] + strings.ToLower(email[i:])
@@ -122,6 +264,11 @@ func (o *OIDC) GetType() Type {
 	return TypeOIDC
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (o *OIDC) IsDisabled() bool {
+	return o.Disabled
+}
+
 // GetEncryptedKey is not available in an OIDC provisioner.
 func (o *OIDC) GetEncryptedKey() (kid string, key string, ok bool) {
 	return "", "", false
@@ -147,11 +294,35 @@ func (o *OIDC) Init(config Config) (err error) {
 		}
 	}
 
+	// Validate clockSkew if given
+	if o.ClockSkew != nil && o.ClockSkew.Duration < 0 {
+		return errors.New("clockSkew cannot be negative")
+	}
+
 	// Update claims with global ones
 	if o.claimer, err = NewClaimer(o.Claims, config.Claims); err != nil {
 		return err
 	}
 
+	// Parse the x509 and SSH templates and validate the webhooks
+	if o.x509, err = initTemplateOptions(o.X509, o.SSH, o.Webhooks, o.Name, config); err != nil {
+		return err
+	}
+	if err = o.X509Policy.init(o.Name); err != nil {
+		return err
+	}
+	if err = o.SSHPolicy.init(o.Name); err != nil {
+		return err
+	}
+	if err = o.SSHPrincipals.init(o.Name); err != nil {
+		return err
+	}
+
+	// Load the attestation roots
+	if err = o.Attestation.init(); err != nil {
+		return err
+	}
+
 	// Decode and validate openid-configuration endpoint
 	u, err := url.Parse(o.ConfigurationEndpoint)
 	if err != nil {
@@ -181,18 +352,29 @@ func (o *OIDC) Init(config Config) (err error) {
 	return nil
 }
 
+// clockSkew returns the leeway used to validate the time claims.
+func (o *OIDC) clockSkew() time.Duration {
+	if o.ClockSkew == nil {
+		return defaultOIDCClockSkew
+	}
+	return o.ClockSkew.Duration
+}
+
 // ValidatePayload validates the given token payload.
 func (o *OIDC) ValidatePayload(p openIDPayload) error {
-	// According to "rfc7519 JSON Web Token" acceptable skew should be no more
-	// than a few minutes.
 	if err := p.ValidateWithLeeway(jose.Expected{
 		Issuer:   o.configuration.Issuer,
 		Audience: jose.Audience{o.ClientID},
 		Time:     time.Now().UTC(),
-	}, time.Minute); err != nil {
+	}, o.clockSkew()); err != nil {
 		return errs.Wrap(http.StatusUnauthorized, err, "validatePayload: failed to validate oidc token payload")
 	}
 
+	// The nonce is used as the token id to protect against token reuse
+	if p.Nonce == "" {
+		return errs.Unauthorized("validatePayload: failed to validate oidc token payload: nonce not found")
+	}
+
 	// Validate azp if present
 	if p.AuthorizedParty != "" && p.AuthorizedParty != o.ClientID {
 		return errs.Unauthorized("validatePayload: failed to validate oidc token payload: invalid azp")
@@ -204,7 +386,7 @@ func (o *OIDC) ValidatePayload(p openIDPayload) error {
 	}
 
 	// Validate domains (case-insensitive)
-	if !o.IsAdmin(p.Email) && len(o.Domains) > 0 {
+	if !o.isAdmin(&p) && len(o.Domains) > 0 {
 		email := sanitizeEmail(p.Email)
 		var found bool
 		for _, d := range o.Domains {
@@ -218,6 +400,11 @@ func (o *OIDC) ValidatePayload(p openIDPayload) error {
 		}
 	}
 
+	// Validate the email with the x509 policy, also for the admins
+	if err := o.X509Policy.AuthorizeEmail(p.Email); err != nil {
+		return errs.Wrap(http.StatusUnauthorized, err, "validatePayload: failed to validate oidc token payload")
+	}
+
 	// Filter by oidc group claim
 	if len(o.Groups) > 0 {
 		var found bool
@@ -256,8 +443,9 @@ func (o *OIDC) authorizeToken(token string) (*openIDPayload, error) {
 	found := false
 	kid := jwt.Headers[0].KeyID
 	keys := o.keyStore.Get(kid)
+	raw := make(map[string]interface{})
 	for _, key := range keys {
-		if err := jwt.Claims(key, &claims); err == nil {
+		if err := jwt.Claims(key, &claims, &raw); err == nil {
 			found = true
 			break
 		}
@@ -266,6 +454,9 @@ func (o *OIDC) authorizeToken(token string) (*openIDPayload, error) {
 		return nil, errs.Unauthorized("oidc.AuthorizeToken; cannot validate oidc token")
 	}
 
+	// Read the groups from the configured claim
+	claims.Groups = parseGroups(raw, o.groupsClaim())
+
 	if err := o.ValidatePayload(claims); err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "oidc.AuthorizeToken")
 	}
@@ -283,7 +474,7 @@ func (o *OIDC) AuthorizeRevoke(ctx context.Context, token string) error {
 	}
 
 	// Only admins can revoke certificates.
-	if o.IsAdmin(claims.Email) {
+	if o.isAdmin(claims) {
 		return nil
 	}
 	return errs.Unauthorized("oidc.AuthorizeRevoke; cannot revoke with non-admin oidc token")
@@ -303,9 +494,15 @@ func (o *OIDC) AuthorizeSign(ctx context.Context, token string) ([]SignOption, e
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(o.claimer.MinTLSCertDuration(), o.claimer.MaxTLSCertDuration()),
+		newAttestationValidator(o.Attestation, token),
 	}
-	// Admins should be able to authorize any SAN
-	if o.IsAdmin(claims.Email) {
+	data := newTemplateData(claims.Subject, []string{claims.Email}, token)
+	so = append(so, templateSignOptions(ctx, o.x509, o.Webhooks, o.Name, data)...)
+	so = append(so, x509PolicySignOptions(o.X509Policy)...)
+
+	// Admins should be able to authorize any SAN, other users can only get
+	// a certificate for their own email.
+	if o.isAdmin(claims) {
 		return so, nil
 	}
 
@@ -343,15 +540,19 @@ func (o *OIDC) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption
 	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "oidc.AuthorizeSSHSign")
 	}
+	principals, err := o.SSHPrincipals.principals(iden.Usernames, claims)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "oidc.AuthorizeSSHSign")
+	}
 	defaults := SSHOptions{
 		CertType:   SSHUserCert,
-		Principals: iden.Usernames,
+		Principals: principals,
 	}
 
 	// Admin users can use any principal, and can sign user and host certificates.
 	// Non-admin users can only use principals returned by the identityFunc, and
 	// can only sign user certificates.
-	if !o.IsAdmin(claims.Email) {
+	if !o.isAdmin(claims) {
 		signOptions = append(signOptions, sshCertOptionsValidator(defaults))
 	}
 
@@ -359,7 +560,7 @@ func (o *OIDC) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption
 	// are not set.
 	signOptions = append(signOptions, sshCertDefaultsModifier(defaults))
 
-	return append(signOptions,
+	signOptions = append(signOptions,
 		// Set the default extensions
 		&sshDefaultExtensionModifier{},
 		// Set the validity bounds if not set.
@@ -370,7 +571,9 @@ func (o *OIDC) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption
 		&sshCertValidityValidator{o.claimer},
 		// Require all the fields in the SSH certificate
 		&sshCertDefaultValidator{},
-	), nil
+	)
+	signOptions = append(signOptions, sshTemplateSignOptions(o.SSH, o.Name, token)...)
+	return append(signOptions, sshPolicySignOptions(o.SSHPolicy, principals, o.isAdmin(claims))...), nil
 }
 
 // AuthorizeSSHRevoke returns nil if the token is valid, false otherwise.
@@ -381,7 +584,7 @@ func (o *OIDC) AuthorizeSSHRevoke(ctx context.Context, token string) error {
 	}
 
 	// Only admins can revoke certificates.
-	if !o.IsAdmin(claims.Email) {
+	if !o.isAdmin(claims) {
 		return errs.Unauthorized("oidc.AuthorizeSSHRevoke; cannot revoke with non-admin oidc token")
 	}
 	return nil
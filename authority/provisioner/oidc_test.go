@@ -6,9 +6,12 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -310,9 +313,9 @@ func TestOIDC_AuthorizeSign(t *testing.T) {
 			} else {
 				if assert.NotNil(t, got) {
 					if tt.name == "admin" {
-						assert.Len(t, 4, got)
-					} else {
 						assert.Len(t, 5, got)
+					} else {
+						assert.Len(t, 6, got)
 					}
 					for _, o := range got {
 						switch v := o.(type) {
@@ -327,6 +330,7 @@ func TestOIDC_AuthorizeSign(t *testing.T) {
 						case *validityValidator:
 							assert.Equals(t, v.min, tt.prov.claimer.MinTLSCertDuration())
 							assert.Equals(t, v.max, tt.prov.claimer.MaxTLSCertDuration())
+						case *attestationValidator:
 						case emailOnlyIdentity:
 							assert.Equals(t, string(v), "name@smallstep.com")
 						default:
@@ -681,3 +685,336 @@ func Test_sanitizeEmail(t *testing.T) {
 		})
 	}
 }
+
+// fakeOIDCProvider is an in-process OpenID provider that serves the
+// configuration and the JWKS, and mints id tokens.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	sync.Mutex
+	keys jose.JSONWebKeySet
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	p := &fakeOIDCProvider{}
+	p.rotate(t)
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(openIDConfiguration{Issuer: p.URL, JWKSetURI: p.URL + "/jwks"})
+		case "/jwks":
+			p.Lock()
+			defer p.Unlock()
+			var pub jose.JSONWebKeySet
+			for _, k := range p.keys.Keys {
+				pub.Keys = append(pub.Keys, k.Public())
+			}
+			w.Header().Set("Cache-Control", "max-age=3600")
+			json.NewEncoder(w).Encode(pub)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return p
+}
+
+// rotate replaces the signing keys of the provider.
+func (p *fakeOIDCProvider) rotate(t *testing.T) {
+	jwk, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	p.Lock()
+	p.keys = jose.JSONWebKeySet{Keys: []jose.JSONWebKey{*jwk}}
+	p.Unlock()
+}
+
+func (p *fakeOIDCProvider) token(t *testing.T, aud, email, nonce string, iat time.Time, extra ...map[string]interface{}) string {
+	p.Lock()
+	jwk := p.keys.Keys[0]
+	p.Unlock()
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("kid", jwk.KeyID)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key}, so)
+	assert.FatalError(t, err)
+	builder := jose.Signed(sig).Claims(struct {
+		jose.Claims
+		Email string `json:"email"`
+		Nonce string `json:"nonce,omitempty"`
+	}{
+		Claims: jose.Claims{
+			Subject:   "1234567890",
+			Issuer:    p.URL,
+			Audience:  jose.Audience{aud},
+			IssuedAt:  jose.NewNumericDate(iat),
+			NotBefore: jose.NewNumericDate(iat),
+			Expiry:    jose.NewNumericDate(iat.Add(5 * time.Minute)),
+		},
+		Email: email,
+		Nonce: nonce,
+	})
+	for _, m := range extra {
+		builder = builder.Claims(m)
+	}
+	tok, err := builder.CompactSerialize()
+	assert.FatalError(t, err)
+	return tok
+}
+
+func TestOIDC_authorizeToken_provider(t *testing.T) {
+	op := newFakeOIDCProvider(t)
+	defer op.Close()
+
+	config := Config{Claims: globalProvisionerClaims}
+	p := &OIDC{
+		Type:                  "OIDC",
+		Name:                  "okta",
+		ClientID:              "client-id",
+		ConfigurationEndpoint: op.URL,
+		Domains:               []string{"smallstep.com"},
+	}
+	assert.FatalError(t, p.Init(config))
+	defer p.keyStore.Close()
+
+	strict := &OIDC{
+		Type:                  "OIDC",
+		Name:                  "strict",
+		ClientID:              "client-id",
+		ConfigurationEndpoint: op.URL,
+		ClockSkew:             &Duration{0},
+	}
+	assert.FatalError(t, strict.Init(config))
+	defer strict.keyStore.Close()
+
+	// skewed tokens expired 30 seconds ago
+	skewed := time.Now().Add(-5*time.Minute - 30*time.Second)
+
+	t.Run("ok", func(t *testing.T) {
+		claims, err := p.authorizeToken(op.token(t, "client-id", "jane@smallstep.com", "the-nonce", time.Now()))
+		assert.FatalError(t, err)
+		assert.Equals(t, "jane@smallstep.com", claims.Email)
+		assert.Equals(t, "the-nonce", claims.Nonce)
+	})
+	t.Run("ok clock skew", func(t *testing.T) {
+		_, err := p.authorizeToken(op.token(t, "client-id", "jane@smallstep.com", "the-nonce", skewed))
+		assert.FatalError(t, err)
+	})
+	t.Run("fail clock skew", func(t *testing.T) {
+		_, err := strict.authorizeToken(op.token(t, "client-id", "jane@smallstep.com", "the-nonce", skewed))
+		assert.Error(t, err)
+	})
+	t.Run("fail audience", func(t *testing.T) {
+		_, err := p.authorizeToken(op.token(t, "other-client", "jane@smallstep.com", "the-nonce", time.Now()))
+		assert.Error(t, err)
+	})
+	t.Run("fail nonce", func(t *testing.T) {
+		_, err := p.authorizeToken(op.token(t, "client-id", "jane@smallstep.com", "", time.Now()))
+		if assert.Error(t, err) {
+			assert.True(t, strings.Contains(err.Error(), "nonce not found"), err.Error())
+		}
+	})
+	t.Run("fail domain", func(t *testing.T) {
+		_, err := p.authorizeToken(op.token(t, "client-id", "jane@example.com", "the-nonce", time.Now()))
+		assert.Error(t, err)
+	})
+
+	t.Run("refresh on unknown kid", func(t *testing.T) {
+		op.rotate(t)
+		tok := op.token(t, "client-id", "jane@smallstep.com", "the-nonce", time.Now())
+
+		// Refreshes are rate limited
+		_, err := p.authorizeToken(tok)
+		assert.Error(t, err)
+
+		p.keyStore.Lock()
+		p.keyStore.lastReload = time.Now().Add(-2 * minRefreshInterval)
+		p.keyStore.Unlock()
+		_, err = p.authorizeToken(tok)
+		assert.FatalError(t, err)
+	})
+}
+
+func TestOIDC_AuthorizeSign_admins(t *testing.T) {
+	op := newFakeOIDCProvider(t)
+	defer op.Close()
+
+	config := Config{Claims: globalProvisionerClaims}
+	p := &OIDC{
+		Type:                  "OIDC",
+		Name:                  "okta",
+		ClientID:              "client-id",
+		ConfigurationEndpoint: op.URL,
+		Admins:                []string{"root@smallstep.com"},
+		AdminGroups:           []string{"pki-admins"},
+		GroupsClaim:           "roles",
+	}
+	assert.FatalError(t, p.Init(config))
+	defer p.keyStore.Close()
+
+	key, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	csr := func(email string, dnsNames ...string) *x509.CertificateRequest {
+		cr := &x509.CertificateRequest{DNSNames: dnsNames, PublicKey: key.Public().Key}
+		if email != "" {
+			cr.EmailAddresses = []string{email}
+		}
+		return cr
+	}
+	validate := func(opts []SignOption, cr *x509.CertificateRequest) error {
+		for _, o := range opts {
+			if v, ok := o.(CertificateRequestValidator); ok {
+				if err := v.Valid(cr); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		csr    *x509.CertificateRequest
+		errMsg string
+	}{
+		{"ok admin group", op.token(t, "client-id", "jane@smallstep.com", "n1", time.Now(), map[string]interface{}{"roles": []string{"dev", "pki-admins"}}),
+			csr("", "foo.smallstep.com"), ""},
+		{"ok admin group string", op.token(t, "client-id", "jane@smallstep.com", "n2", time.Now(), map[string]interface{}{"roles": "pki-admins"}),
+			csr("mariano@smallstep.com"), ""},
+		{"ok admin email", op.token(t, "client-id", "root@smallstep.com", "n3", time.Now()),
+			csr("", "foo.smallstep.com"), ""},
+		{"ok non-admin own email", op.token(t, "client-id", "jane@smallstep.com", "n4", time.Now(), map[string]interface{}{"roles": []string{"dev"}}),
+			csr("jane@smallstep.com"), ""},
+		{"fail non-admin other email", op.token(t, "client-id", "jane@smallstep.com", "n5", time.Now(), map[string]interface{}{"roles": []string{"dev"}}),
+			csr("mariano@smallstep.com"), "certificate request does not contain the valid email address, got mariano@smallstep.com, want jane@smallstep.com"},
+		{"fail non-admin dns", op.token(t, "client-id", "jane@smallstep.com", "n6", time.Now()),
+			csr("jane@smallstep.com", "foo.smallstep.com"), "certificate request cannot contain DNS names, only the email address jane@smallstep.com is allowed: found foo.smallstep.com"},
+		{"fail missing groups claim", op.token(t, "client-id", "jane@smallstep.com", "n7", time.Now(), map[string]interface{}{"groups": []string{"pki-admins"}}),
+			csr("", "foo.smallstep.com"), "certificate request cannot contain DNS names"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := p.AuthorizeSign(context.Background(), tt.token)
+			assert.FatalError(t, err)
+			err = validate(opts, tt.csr)
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.HasPrefix(t, err.Error(), tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestOIDC_AuthorizeSign_x509Policy(t *testing.T) {
+	op := newFakeOIDCProvider(t)
+	defer op.Close()
+
+	p := &OIDC{
+		Type:                  "OIDC",
+		Name:                  "okta",
+		ClientID:              "client-id",
+		ConfigurationEndpoint: op.URL,
+		Admins:                []string{"root@example.org"},
+		X509Policy: &X509Policy{
+			AllowedEmailDomains:    []string{"example.com", "corp.example.com"},
+			AllowedEmailLocalParts: []string{"jane*", "root", `"*"`},
+		},
+	}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims}))
+	defer p.keyStore.Close()
+
+	tests := []struct {
+		name   string
+		email  string
+		errMsg string
+	}{
+		{"ok", "jane@example.com", ""},
+		{"ok plus", "jane+smime@Corp.Example.com", ""},
+		{"ok quoted", `"john doe"@example.com`, ""},
+		{"fail other domain", "jane@example.net", "email address jane@example.net is not allowed by the provisioner policy"},
+		{"fail subdomain", "jane@dev.example.com", "email address jane@dev.example.com is not allowed by the provisioner policy"},
+		{"fail local part", "Jane@example.com", "email address Jane@example.com has a local part not allowed by the provisioner policy"},
+		{"fail admin", "root@example.org", "email address root@example.org is not allowed by the provisioner policy"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := op.token(t, "client-id", tt.email, fmt.Sprintf("n%d", i), time.Now())
+			_, err := p.AuthorizeSign(context.Background(), token)
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.True(t, strings.HasSuffix(err.Error(), tt.errMsg), err.Error())
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, http.StatusUnauthorized, sc.StatusCode())
+			}
+		})
+	}
+}
+
+func TestOIDC_AuthorizeSSHSign_principals(t *testing.T) {
+	op := newFakeOIDCProvider(t)
+	defer op.Close()
+
+	config := Config{Claims: globalProvisionerClaims}
+	p := &OIDC{
+		Type:                  "OIDC",
+		Name:                  "okta",
+		ClientID:              "client-id",
+		ConfigurationEndpoint: op.URL,
+		Admins:                []string{"root@smallstep.com"},
+		SSHPrincipals: &OIDCSSHPrincipals{
+			Templates: []string{"dev-{{.localpart}}", `{{ if has "sre" .groups }}sre{{ end }}`},
+			Groups:    map[string][]string{"oncall": {"breakglass"}},
+		},
+	}
+	assert.FatalError(t, p.Init(config))
+	defer p.keyStore.Close()
+
+	key, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	signer, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		principals []string
+		want       []string
+		wantErr    bool
+	}{
+		{"ok default", op.token(t, "client-id", "jane@smallstep.com", "n1", time.Now()),
+			nil, []string{"jane", "jane@smallstep.com", "dev-jane"}, false},
+		{"ok template", op.token(t, "client-id", "jane@smallstep.com", "n2", time.Now()),
+			[]string{"dev-jane"}, []string{"dev-jane"}, false},
+		{"ok template groups", op.token(t, "client-id", "jane@smallstep.com", "n3", time.Now(), map[string]interface{}{"groups": []string{"sre"}}),
+			nil, []string{"jane", "jane@smallstep.com", "dev-jane", "sre"}, false},
+		{"ok group", op.token(t, "client-id", "jane@smallstep.com", "n4", time.Now(), map[string]interface{}{"groups": []string{"dev", "oncall"}}),
+			[]string{"jane", "breakglass"}, []string{"jane", "breakglass"}, false},
+		{"ok admin", op.token(t, "client-id", "root@smallstep.com", "n5", time.Now()),
+			[]string{"breakglass", "postgres"}, []string{"breakglass", "postgres"}, false},
+		{"fail group", op.token(t, "client-id", "jane@smallstep.com", "n6", time.Now(), map[string]interface{}{"groups": []string{"dev"}}),
+			[]string{"jane", "breakglass"}, nil, true},
+		{"fail other user", op.token(t, "client-id", "jane@smallstep.com", "n7", time.Now()),
+			[]string{"dev-mariano"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := p.AuthorizeSSHSign(context.Background(), tt.token)
+			assert.FatalError(t, err)
+			cert, err := signSSHCertificate(key.Public().Key, SSHOptions{Principals: tt.principals}, opts, signer.Key.(crypto.Signer))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, tt.want, cert.ValidPrincipals)
+		})
+	}
+}
+
+func TestOIDCSSHPrincipals_init(t *testing.T) {
+	assert.FatalError(t, (*OIDCSSHPrincipals)(nil).init("okta"))
+	assert.Error(t, (&OIDCSSHPrincipals{Templates: []string{"dev-{{.localpart"}}).init("okta"))
+	assert.Error(t, (&OIDCSSHPrincipals{Groups: map[string][]string{"oncall": {""}}}).init("okta"))
+}
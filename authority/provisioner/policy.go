@@ -0,0 +1,200 @@
+package provisioner
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The layers of the policies. The authority policy is the outer boundary of
+// the policies of the provisioners: a name must be allowed by the authority
+// policy and by the policy of the provisioner, the provisioner policy can only
+// narrow what the authority allows.
+const (
+	// PolicyLayerAuthority is the layer of the policies in the authority
+	// configuration.
+	PolicyLayerAuthority = "authority"
+	// PolicyLayerProvisioner is the layer of the policies of a provisioner.
+	PolicyLayerProvisioner = "provisioner"
+)
+
+// policyOf returns the name of the policy of the layer used in the errors,
+// like "the authority policy". The empty layer is the provisioner one.
+func policyOf(layer string) string {
+	if layer == "" {
+		layer = PolicyLayerProvisioner
+	}
+	return "the " + layer + " policy"
+}
+
+// SignOptions returns the options that validate the X.509 certificates with
+// the policy, they must be added after the options of the provisioner.
+func (p *X509Policy) SignOptions() []SignOption {
+	return x509PolicySignOptions(p)
+}
+
+// SignOptions returns the options that validate the SSH certificates with
+// the policy, they must be added after the options of the provisioner.
+func (p *SSHPolicy) SignOptions() []SignOption {
+	return sshPolicySignOptions(p, nil, false)
+}
+
+// PolicyWarnings returns the allow rules of the policies of the provisioner
+// that can never allow anything because they are outside the rules of the same
+// kind of the authority policies in the config. These rules are not errors,
+// the names are rejected by the authority policy, but they are probably a
+// mistake.
+func PolicyWarnings(p Interface, config Config) []string {
+	x509Policy, sshPolicy := provisionerPolicies(p)
+	var warnings []string
+	warn := func(kind, option string, rules, outer []string, intersect func(a, b string) bool) {
+		if len(outer) == 0 {
+			return
+		}
+		for _, rule := range rules {
+			if !anyIntersect(outer, rule, intersect) {
+				warnings = append(warnings, fmt.Sprintf("provisioner %s: %s %s rule %s is outside of the authority %s, it never allows anything",
+					p.GetName(), kind, option, rule, option))
+			}
+		}
+	}
+	if a := config.X509Policy; a != nil && x509Policy != nil {
+		warn("x509Policy", "allowedDNSNames", x509Policy.AllowedDNSNames, a.AllowedDNSNames, policyNamesIntersect)
+		warn("x509Policy", "allowedCommonNames", x509Policy.AllowedCommonNames, a.AllowedCommonNames, policyNamesIntersect)
+		warn("x509Policy", "allowedIPRanges", x509Policy.AllowedIPRanges, a.AllowedIPRanges, policyIPRangesIntersect)
+		warn("x509Policy", "allowedEmailDomains", x509Policy.AllowedEmailDomains, a.AllowedEmailDomains, policyNamesIntersect)
+		warn("x509Policy", "allowedURIs", x509Policy.AllowedURIs, a.AllowedURIs, uriRulesIntersect)
+	}
+	if a := config.SSHPolicy; a != nil && sshPolicy != nil {
+		warn("sshPolicy", "allowedUserPrincipals", sshPolicy.AllowedUserPrincipals, a.AllowedUserPrincipals, principalsIntersect)
+		warn("sshPolicy", "allowedHostDomains", sshPolicy.AllowedHostDomains, a.AllowedHostDomains, hostDomainsIntersect)
+		warn("sshPolicy", "allowedHostIPRanges", sshPolicy.AllowedHostIPRanges, a.AllowedHostIPRanges, policyIPRangesIntersect)
+	}
+	return warnings
+}
+
+// provisionerPolicies returns the X.509 and SSH policies of a provisioner.
+func provisionerPolicies(p Interface) (*X509Policy, *SSHPolicy) {
+	switch p := p.(type) {
+	case *ACME:
+		return p.X509Policy, nil
+	case *OIDC:
+		return p.X509Policy, p.SSHPolicy
+	case *JWK:
+		return nil, p.SSHPolicy
+	case *X5C:
+		return nil, p.SSHPolicy
+	case *GCP:
+		return nil, p.SSHPolicy
+	case *AWS:
+		return nil, p.SSHPolicy
+	case *Azure:
+		return nil, p.SSHPolicy
+	case *K8sSA:
+		return nil, p.SSHPolicy
+	case *SSHPOP:
+		return nil, p.SSHPolicy
+	default:
+		return nil, nil
+	}
+}
+
+// anyIntersect returns true if the rule intersects any of the rules.
+func anyIntersect(rules []string, rule string, intersect func(a, b string) bool) bool {
+	for _, s := range rules {
+		if intersect(s, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyNamesIntersect returns true if there is a name covered by the two
+// name rules, exact names, wildcards or subtrees.
+func policyNamesIntersect(a, b string) bool {
+	a, okA := normalizePolicyName(a)
+	b, okB := normalizePolicyName(b)
+	if !okA || !okB {
+		return false
+	}
+	if strings.HasPrefix(b, ".") {
+		a, b = b, a
+	}
+	if strings.HasPrefix(b, ".") {
+		// Two subtrees intersect if one is below the other.
+		return matchesSubtree(a, b) || matchesSubtree(b, a)
+	}
+	// The rule b is an exact name or a wildcard.
+	return policyNameOverlaps(a, b) || policyNameOverlaps(b, a)
+}
+
+// policyIPRangesIntersect returns true if the two IP ranges have a common
+// address. Two networks have a common address only if one contains the other.
+func policyIPRangesIntersect(a, b string) bool {
+	netA, netB := parsePolicyIPRange(a), parsePolicyIPRange(b)
+	if netA == nil || netB == nil {
+		return false
+	}
+	return netA.Contains(netB.IP) || netB.Contains(netA.IP)
+}
+
+// uriRulesIntersect returns true if there is a URI allowed by the two URI
+// rules.
+func uriRulesIntersect(a, b string) bool {
+	ruleA, okA := parseURIRule(a)
+	ruleB, okB := parseURIRule(b)
+	if !okA || !okB || ruleA.scheme != ruleB.scheme {
+		return false
+	}
+	return policyNamesIntersect(ruleA.host, ruleB.host) &&
+		(matchesPathPrefix(ruleA.path, ruleB.path) || matchesPathPrefix(ruleB.path, ruleA.path))
+}
+
+// principalsIntersect returns true if there can be a principal matched by the
+// two patterns. Only literal principals are compared, two glob patterns are
+// always considered to intersect.
+func principalsIntersect(a, b string) bool {
+	const meta = `*?[\`
+	switch {
+	case !strings.ContainsAny(b, meta):
+		return matchPrincipal([]string{a}, b)
+	case !strings.ContainsAny(a, meta):
+		return matchPrincipal([]string{b}, a)
+	default:
+		return true
+	}
+}
+
+// hostDomainsIntersect returns true if there is a host principal allowed by
+// the two domains of the allowedHostDomains. A domain allows itself and its
+// subdomains, and a domain starting with a dot only its subdomains.
+func hostDomainsIntersect(a, b string) bool {
+	below := func(domain, name string) bool {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		name = strings.ToLower(strings.TrimPrefix(name, "."))
+		return name == domain || strings.HasSuffix(name, "."+domain)
+	}
+	return below(a, b) || below(b, a)
+}
+
+// authorizeIPLayers returns the first error of the policies of the IP
+// address, evaluated in order.
+func authorizeIPLayers(ip net.IP, policies ...*X509Policy) error {
+	for _, p := range policies {
+		if err := p.AuthorizeIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeDNSNameLayers returns the first error of the policies of the DNS
+// name, evaluated in order.
+func authorizeDNSNameLayers(name string, policies ...*X509Policy) error {
+	for _, p := range policies {
+		if err := p.AuthorizeDNSName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
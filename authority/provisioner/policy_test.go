@@ -0,0 +1,283 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// policyLayerTests is the cross product of the outcomes of the authority and
+// provisioner policies, with the layer expected in the error. The provisioner
+// policy is evaluated first, so it is the one reported when both reject.
+var policyLayerTests = []struct {
+	authority   string
+	provisioner string
+	wantLayer   string
+}{
+	{"none", "none", ""},
+	{"none", "allow", ""},
+	{"none", "deny", "provisioner"},
+	{"allow", "none", ""},
+	{"allow", "allow", ""},
+	{"allow", "deny", "provisioner"},
+	{"deny", "none", "authority"},
+	{"deny", "allow", "authority"},
+	{"deny", "deny", "provisioner"},
+}
+
+func checkPolicyLayer(t *testing.T, err error, wantLayer string) {
+	t.Helper()
+	if wantLayer == "" {
+		assert.NoError(t, err)
+		return
+	}
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "the "+wantLayer+" policy"), err.Error())
+	}
+}
+
+// authorityX509Policy returns a copy of the policy initialized as an authority
+// policy.
+func authorityX509Policy(t *testing.T, p *X509Policy) *X509Policy {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	assert.FatalError(t, c.InitAuthority())
+	return &c
+}
+
+func authoritySSHPolicy(t *testing.T, p *SSHPolicy) *SSHPolicy {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	assert.FatalError(t, c.InitAuthority())
+	return &c
+}
+
+var x509LayerPolicies = map[string]*X509Policy{
+	"none": nil,
+	"allow": {
+		AllowedDNSNames: []string{"*.smallstep.com"},
+		AllowedIPRanges: []string{"10.0.0.0/8"},
+	},
+	"deny": {
+		DeniedDNSNames: []string{"test.smallstep.com"},
+		DeniedIPRanges: []string{"10.0.0.1"},
+	},
+}
+
+func TestX509Policy_layers(t *testing.T) {
+	certs := map[string]*x509.Certificate{
+		"dns": {Subject: pkix.Name{CommonName: "test.smallstep.com"}, DNSNames: []string{"test.smallstep.com"}},
+		"ip":  {IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+	}
+	for _, tt := range policyLayerTests {
+		for kind, cert := range certs {
+			t.Run(tt.authority+"/"+tt.provisioner+"/"+kind, func(t *testing.T) {
+				var opts []SignOption
+				opts = append(opts, x509LayerPolicies[tt.provisioner].SignOptions()...)
+				opts = append(opts, authorityX509Policy(t, x509LayerPolicies[tt.authority]).SignOptions()...)
+				var err error
+				for _, o := range opts {
+					if v, ok := o.(CertificateValidator); ok {
+						if err = v.Valid(cert, Options{}); err != nil {
+							break
+						}
+					}
+				}
+				checkPolicyLayer(t, err, tt.wantLayer)
+			})
+		}
+	}
+}
+
+func TestACME_AuthorizeIdentifier_layers(t *testing.T) {
+	for _, tt := range policyLayerTests {
+		t.Run(tt.authority+"/"+tt.provisioner, func(t *testing.T) {
+			p := &ACME{
+				X509Policy:      x509LayerPolicies[tt.provisioner],
+				authorityPolicy: authorityX509Policy(t, x509LayerPolicies[tt.authority]),
+			}
+			checkPolicyLayer(t, p.AuthorizeDNSName("test.smallstep.com"), tt.wantLayer)
+			checkPolicyLayer(t, p.AuthorizeIP(net.ParseIP("10.0.0.1")), tt.wantLayer)
+		})
+	}
+}
+
+func TestSSHPolicy_layers(t *testing.T) {
+	policies := map[string]*SSHPolicy{
+		"none": nil,
+		"allow": {
+			AllowedUserPrincipals: []string{"deploy-*"},
+			AllowedHostDomains:    []string{"smallstep.com"},
+			AllowedHostIPRanges:   []string{"10.0.0.0/8"},
+		},
+		"deny": {
+			DeniedUserPrincipals: []string{"deploy-prod"},
+			AllowedHostDomains:   []string{"example.com"},
+			DeniedHostIPRanges:   []string{"10.0.0.1"},
+		},
+	}
+	certs := map[string]*ssh.Certificate{
+		"user":    {CertType: ssh.UserCert, ValidPrincipals: []string{"deploy-prod"}},
+		"host":    {CertType: ssh.HostCert, ValidPrincipals: []string{"test.smallstep.com"}},
+		"host-ip": {CertType: ssh.HostCert, ValidPrincipals: []string{"10.0.0.1"}},
+	}
+	for _, tt := range policyLayerTests {
+		for kind, cert := range certs {
+			t.Run(tt.authority+"/"+tt.provisioner+"/"+kind, func(t *testing.T) {
+				var opts []SignOption
+				opts = append(opts, policies[tt.provisioner].SignOptions()...)
+				opts = append(opts, authoritySSHPolicy(t, policies[tt.authority]).SignOptions()...)
+				var err error
+				for _, o := range opts {
+					if v, ok := o.(SSHCertValidator); ok {
+						if err = v.Valid(cert, SSHOptions{}); err != nil {
+							break
+						}
+					}
+				}
+				checkPolicyLayer(t, err, tt.wantLayer)
+			})
+		}
+	}
+}
+
+func TestPolicy_InitAuthority(t *testing.T) {
+	x509Policy := &X509Policy{AllowedDNSNames: []string{"*.smallstep.com"}}
+	assert.FatalError(t, x509Policy.InitAuthority())
+	assert.Equals(t, PolicyLayerAuthority, x509Policy.layer)
+
+	err := (&X509Policy{AllowedDNSNames: []string{"*.*.smallstep.com"}}).InitAuthority()
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "authority: x509Policy"), err.Error())
+	}
+
+	sshPolicy := &SSHPolicy{AllowedUserPrincipals: []string{"deploy-*"}}
+	assert.FatalError(t, sshPolicy.InitAuthority())
+	assert.Equals(t, PolicyLayerAuthority, sshPolicy.layer)
+
+	err = (&SSHPolicy{RequireIdentityPrincipals: true}).InitAuthority()
+	assert.Equals(t, "authority: sshPolicy requireIdentityPrincipals can only be used in the provisioners", err.Error())
+
+	assert.NoError(t, (*X509Policy)(nil).InitAuthority())
+	assert.NoError(t, (*SSHPolicy)(nil).InitAuthority())
+}
+
+func TestPolicyWarnings(t *testing.T) {
+	config := Config{
+		X509Policy: &X509Policy{
+			AllowedDNSNames:     []string{".smallstep.com"},
+			AllowedIPRanges:     []string{"10.0.0.0/8"},
+			AllowedEmailDomains: []string{"smallstep.com"},
+			AllowedURIs:         []string{"spiffe://smallstep.com/ns/prod"},
+		},
+		SSHPolicy: &SSHPolicy{
+			AllowedUserPrincipals: []string{"deploy-*"},
+			AllowedHostDomains:    []string{"smallstep.com"},
+		},
+	}
+	tests := []struct {
+		name string
+		prov Interface
+		want []string
+	}{
+		{"ok-no-policy", &ACME{Name: "acme"}, nil},
+		{"ok-inside", &ACME{Name: "acme", X509Policy: &X509Policy{
+			AllowedDNSNames:     []string{"*.ca.smallstep.com", "test.smallstep.com"},
+			AllowedIPRanges:     []string{"10.1.0.0/16"},
+			AllowedEmailDomains: []string{"smallstep.com"},
+			AllowedURIs:         []string{"spiffe://smallstep.com/ns/prod/sa"},
+		}}, nil},
+		{"ok-no-authority-rules", &OIDC{Name: "oidc", X509Policy: &X509Policy{
+			AllowedCommonNames: []string{"example.com"},
+		}}, nil},
+		{"warn-x509", &ACME{Name: "acme", X509Policy: &X509Policy{
+			AllowedDNSNames:     []string{"*.smallstep.com", "*.example.com"},
+			AllowedIPRanges:     []string{"192.168.0.0/16"},
+			AllowedEmailDomains: []string{".example.com"},
+			AllowedURIs:         []string{"spiffe://smallstep.com/ns/dev"},
+		}}, []string{
+			"provisioner acme: x509Policy allowedDNSNames rule *.example.com is outside of the authority allowedDNSNames, it never allows anything",
+			"provisioner acme: x509Policy allowedIPRanges rule 192.168.0.0/16 is outside of the authority allowedIPRanges, it never allows anything",
+			"provisioner acme: x509Policy allowedEmailDomains rule .example.com is outside of the authority allowedEmailDomains, it never allows anything",
+			"provisioner acme: x509Policy allowedURIs rule spiffe://smallstep.com/ns/dev is outside of the authority allowedURIs, it never allows anything",
+		}},
+		{"warn-ssh", &JWK{Name: "jwk", SSHPolicy: &SSHPolicy{
+			AllowedUserPrincipals: []string{"deploy-prod", "root", "admin-*"},
+			AllowedHostDomains:    []string{".ca.smallstep.com", "example.com"},
+		}}, []string{
+			"provisioner jwk: sshPolicy allowedUserPrincipals rule root is outside of the authority allowedUserPrincipals, it never allows anything",
+			"provisioner jwk: sshPolicy allowedHostDomains rule example.com is outside of the authority allowedHostDomains, it never allows anything",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, PolicyWarnings(tt.prov, config))
+		})
+	}
+}
+
+func Test_policyNamesIntersect(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"test.smallstep.com", "test.smallstep.com", true},
+		{"test.smallstep.com", "TEST.smallstep.com", true},
+		{"*.smallstep.com", "test.smallstep.com", true},
+		{"*.smallstep.com", "*.smallstep.com", true},
+		{".smallstep.com", "*.ca.smallstep.com", true},
+		{".smallstep.com", ".ca.smallstep.com", true},
+		{".ca.smallstep.com", ".smallstep.com", true},
+		{"*.smallstep.com", "smallstep.com", false},
+		{"*.smallstep.com", "a.b.smallstep.com", false},
+		{".smallstep.com", "smallstep.com", false},
+		{".smallstep.com", ".example.com", false},
+		{"example.com", "smallstep.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			assert.Equals(t, tt.want, policyNamesIntersect(tt.a, tt.b))
+		})
+	}
+}
+
+func Test_policyIPRangesIntersect(t *testing.T) {
+	assert.True(t, policyIPRangesIntersect("10.0.0.0/8", "10.1.0.0/16"))
+	assert.True(t, policyIPRangesIntersect("10.1.2.3", "10.0.0.0/8"))
+	assert.False(t, policyIPRangesIntersect("10.0.0.0/8", "192.168.0.0/16"))
+	assert.False(t, policyIPRangesIntersect("10.0.0.0/8", "fd00::/8"))
+	assert.False(t, policyIPRangesIntersect("10.0.0.0/8", "example.com"))
+}
+
+func Test_uriRulesIntersect(t *testing.T) {
+	assert.True(t, uriRulesIntersect("spiffe://smallstep.com", "spiffe://smallstep.com/ns/prod"))
+	assert.True(t, uriRulesIntersect("spiffe://*.smallstep.com/ns", "spiffe://ca.smallstep.com/ns/prod"))
+	assert.False(t, uriRulesIntersect("spiffe://smallstep.com/ns/prod", "spiffe://smallstep.com/ns/production"))
+	assert.False(t, uriRulesIntersect("spiffe://smallstep.com", "https://smallstep.com"))
+	assert.False(t, uriRulesIntersect("spiffe://smallstep.com", "spiffe://example.com"))
+}
+
+func Test_principalsIntersect(t *testing.T) {
+	assert.True(t, principalsIntersect("deploy-*", "deploy-prod"))
+	assert.True(t, principalsIntersect("deploy-prod", "deploy-*"))
+	assert.True(t, principalsIntersect("deploy-*", "admin-*"))
+	assert.False(t, principalsIntersect("deploy-*", "root"))
+	assert.False(t, principalsIntersect("alice", "bob"))
+}
+
+func Test_hostDomainsIntersect(t *testing.T) {
+	assert.True(t, hostDomainsIntersect("smallstep.com", "ca.smallstep.com"))
+	assert.True(t, hostDomainsIntersect(".ca.smallstep.com", "smallstep.com"))
+	assert.True(t, hostDomainsIntersect("SMALLSTEP.com", "smallstep.com"))
+	assert.False(t, hostDomainsIntersect("smallstep.com", "example.com"))
+	assert.False(t, hostDomainsIntersect("smallstep.com", "notsmallstep.com"))
+}
@@ -21,6 +21,7 @@ type Interface interface {
 	GetName() string
 	GetType() Type
 	GetEncryptedKey() (kid string, key string, ok bool)
+	IsDisabled() bool
 	Init(config Config) error
 	AuthorizeSign(ctx context.Context, token string) ([]SignOption, error)
 	AuthorizeRevoke(ctx context.Context, token string) error
@@ -39,6 +40,7 @@ type Audiences struct {
 	SSHRevoke []string
 	SSHRenew  []string
 	SSHRekey  []string
+	Admin     []string
 }
 
 // All returns all supported audiences across all request types in one list.
@@ -49,6 +51,7 @@ func (a Audiences) All() (auds []string) {
 	auds = append(auds, a.SSHRevoke...)
 	auds = append(auds, a.SSHRenew...)
 	auds = append(auds, a.SSHRekey...)
+	auds = append(auds, a.Admin...)
 	return
 }
 
@@ -62,6 +65,7 @@ func (a Audiences) WithFragment(fragment string) Audiences {
 		SSHRevoke: make([]string, len(a.SSHRevoke)),
 		SSHRenew:  make([]string, len(a.SSHRenew)),
 		SSHRekey:  make([]string, len(a.SSHRekey)),
+		Admin:     make([]string, len(a.Admin)),
 	}
 	for i, s := range a.Sign {
 		if u, err := url.Parse(s); err == nil {
@@ -105,6 +109,13 @@ func (a Audiences) WithFragment(fragment string) Audiences {
 			ret.SSHRekey[i] = s
 		}
 	}
+	for i, s := range a.Admin {
+		if u, err := url.Parse(s); err == nil {
+			ret.Admin[i] = u.ResolveReference(&url.URL{Fragment: fragment}).String()
+		} else {
+			ret.Admin[i] = s
+		}
+	}
 	return ret
 }
 
@@ -141,6 +152,8 @@ const (
 	TypeK8sSA Type = 8
 	// TypeSSHPOP is used to indicate the SSHPOP provisioners.
 	TypeSSHPOP Type = 9
+	// TypeSCEP is used to indicate the SCEP provisioners.
+	TypeSCEP Type = 10
 )
 
 // String returns the string representation of the type.
@@ -164,6 +177,8 @@ func (t Type) String() string {
 		return "K8sSA"
 	case TypeSSHPOP:
 		return "SSHPOP"
+	case TypeSCEP:
+		return "SCEP"
 	default:
 		return ""
 	}
@@ -186,13 +201,26 @@ type Config struct {
 	DB db.AuthDB
 	// SSHKeys are the root SSH public keys
 	SSHKeys *SSHKeys
+	// GetSSHKeysFunc is a function that returns the current root SSH public
+	// keys, if set it is used instead of SSHKeys.
+	GetSSHKeysFunc GetSSHKeysFunc
 	// GetIdentityFunc is a function that returns an identity that will be
 	// used by the provisioner to populate certificate attributes.
 	GetIdentityFunc GetIdentityFunc
+	// X509 are the default x509 options of the authority, used by the
+	// provisioners without a template. They must be initialized with
+	// InitDefault.
+	X509 *X509Options
+	// X509Policy and SSHPolicy are the policies of the authority, the outer
+	// boundary of the policies of the provisioners. They must be initialized
+	// with InitAuthority.
+	X509Policy *X509Policy
+	SSHPolicy  *SSHPolicy
 }
 
 type provisioner struct {
 	Type string `json:"type"`
+	Name string `json:"name"`
 }
 
 // List represents a list of provisioners.
@@ -208,31 +236,8 @@ func (l *List) UnmarshalJSON(data []byte) error {
 
 	*l = List{}
 	for _, data := range ps {
-		var typ provisioner
-		if err := json.Unmarshal(data, &typ); err != nil {
-			return errors.Errorf("error unmarshaling provisioner")
-		}
-		var p Interface
-		switch strings.ToLower(typ.Type) {
-		case "jwk":
-			p = &JWK{}
-		case "oidc":
-			p = &OIDC{}
-		case "gcp":
-			p = &GCP{}
-		case "aws":
-			p = &AWS{}
-		case "azure":
-			p = &Azure{}
-		case "acme":
-			p = &ACME{}
-		case "x5c":
-			p = &X5C{}
-		case "k8ssa":
-			p = &K8sSA{}
-		case "sshpop":
-			p = &SSHPOP{}
-		default:
+		p, err := Unmarshal(data)
+		if err != nil {
 			// Skip unsupported provisioners. A client using this method may be
 			// compiled with a version of smallstep/certificates that does not
 			// support a specific provisioner type. If we don't skip unknown
@@ -242,10 +247,10 @@ func (l *List) UnmarshalJSON(data []byte) error {
 			// warn the user that an unknown provisioner was found and suggest
 			// that the user update their client's dependency on
 			// step/certificates and recompile.
-			continue
-		}
-		if err := json.Unmarshal(data, p); err != nil {
-			return errors.Errorf("error unmarshaling provisioner")
+			if err == errUnsupportedType {
+				continue
+			}
+			return err
 		}
 		*l = append(*l, p)
 	}
@@ -253,6 +258,136 @@ func (l *List) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Public returns a copy of the list without the secrets of the provisioners,
+// like the bearer tokens of the webhooks or the SCEP challenge. The list is served to anyone by the
+// provisioners endpoint, the provisioners in it must not be used.
+func (l List) Public() List {
+	public := make(List, len(l))
+	for i, p := range l {
+		public[i] = publicProvisioner(p)
+	}
+	return public
+}
+
+// publicProvisioner returns a copy of the provisioner without its secrets, or
+// the same provisioner if it does not have any.
+func publicProvisioner(p Interface) Interface {
+	switch p := p.(type) {
+	case *JWK:
+		c := *p
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	case *OIDC:
+		c := *p
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	case *X5C:
+		c := *p
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	case *GCP:
+		c := *p
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	case *AWS:
+		c := *p
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	case *Azure:
+		c := *p
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	case *K8sSA:
+		c := *p
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	case *SCEP:
+		c := *p
+		c.ChallengePassword = ""
+		c.DecrypterKeyPassword = ""
+		c.Webhooks = publicWebhooks(p.Webhooks)
+		return &c
+	default:
+		return p
+	}
+}
+
+// Validate initializes the provisioner p with the given configuration and
+// checks that it can be used together with the given list of provisioners. The
+// error returned names the provisioner and the property that is not valid.
+//
+// The provisioners in the list can have the same name only if all of them are
+// JWK provisioners with different keys.
+func Validate(p Interface, list List, config Config) error {
+	name := p.GetName()
+	if err := p.Init(config); err != nil {
+		return errors.Wrapf(err, "provisioner %s", name)
+	}
+
+	ids := provisionerIDs(p)
+	kid, _, hasEncryptedKey := p.GetEncryptedKey()
+	for _, q := range list {
+		if q == p {
+			continue
+		}
+		if q.GetName() == name && (q.GetType() != TypeJWK || p.GetType() != TypeJWK) {
+			return errors.Errorf("provisioner %s: name is already used by another provisioner", name)
+		}
+		for _, qid := range provisionerIDs(q) {
+			for _, id := range ids {
+				if id == qid {
+					return errors.Errorf("provisioner %s: id %s is already used by provisioner %s", name, id, q.GetName())
+				}
+			}
+		}
+		if hasEncryptedKey {
+			if qkid, _, ok := q.GetEncryptedKey(); ok && qkid == kid {
+				return errors.Errorf("provisioner %s: encrypted key with kid %s is already used by provisioner %s", name, kid, q.GetName())
+			}
+		}
+	}
+	return nil
+}
+
+var errUnsupportedType = errors.New("unsupported provisioner type")
+
+// Unmarshal parses a provisioner in JSON format into the right type.
+func Unmarshal(data []byte) (Interface, error) {
+	var typ provisioner
+	if err := json.Unmarshal(data, &typ); err != nil {
+		return nil, errors.Errorf("error unmarshaling provisioner")
+	}
+	var p Interface
+	switch strings.ToLower(typ.Type) {
+	case "jwk":
+		p = &JWK{}
+	case "oidc":
+		p = &OIDC{}
+	case "gcp":
+		p = &GCP{}
+	case "aws":
+		p = &AWS{}
+	case "azure":
+		p = &Azure{}
+	case "acme":
+		p = &ACME{}
+	case "x5c":
+		p = &X5C{}
+	case "k8ssa":
+		p = &K8sSA{}
+	case "sshpop":
+		p = &SSHPOP{}
+	case "scep":
+		p = &SCEP{}
+	default:
+		return nil, errUnsupportedType
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling provisioner %s", typ.Name)
+	}
+	return p, nil
+}
+
 var sshUserRegex = regexp.MustCompile("^[a-z][-a-z0-9_]*$")
 
 // SanitizeSSHUserPrincipal grabs an email or a string with the format
@@ -329,6 +464,10 @@ type Identity struct {
 	Usernames []string `json:"usernames"`
 }
 
+// GetSSHKeysFunc is a function that returns the root SSH public keys, they
+// change when the keys of the SSH CA are rotated.
+type GetSSHKeysFunc func() *SSHKeys
+
 // GetIdentityFunc is a function that returns an identity.
 type GetIdentityFunc func(p Interface, email string) (*Identity, error)
 
@@ -355,6 +494,7 @@ type MockProvisioner struct {
 	MgetName            func() string
 	MgetType            func() Type
 	MgetEncryptedKey    func() (string, string, bool)
+	MisDisabled         func() bool
 	Minit               func(Config) error
 	MauthorizeSign      func(ctx context.Context, ott string) ([]SignOption, error)
 	MauthorizeRenew     func(ctx context.Context, cert *x509.Certificate) error
@@ -408,6 +548,14 @@ func (m *MockProvisioner) GetEncryptedKey() (string, string, bool) {
 	return m.Mret1.(string), m.Mret2.(string), m.Mret3.(bool)
 }
 
+// IsDisabled mock
+func (m *MockProvisioner) IsDisabled() bool {
+	if m.MisDisabled != nil {
+		return m.MisDisabled()
+	}
+	return false
+}
+
 // Init mock
 func (m *MockProvisioner) Init(c Config) error {
 	if m.Minit != nil {
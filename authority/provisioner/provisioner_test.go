@@ -2,7 +2,10 @@ package provisioner
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -195,3 +198,120 @@ func TestUnimplementedMethods(t *testing.T) {
 		})
 	}
 }
+
+func TestValidate(t *testing.T) {
+	k1, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	k2, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	key1, err := json.Marshal(k1.Public())
+	assert.FatalError(t, err)
+	key2, err := json.Marshal(k2.Public())
+	assert.FatalError(t, err)
+
+	config := Config{Claims: globalProvisionerClaims, Audiences: testAudiences}
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"ok", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "encryptedKey": "foo"},
+			{"type": "JWK", "name": "foo", "key": %s, "encryptedKey": "bar"},
+			{"type": "JWK", "name": "bar", "key": %s},
+			{"type": "ACME", "name": "acme"}
+		]`, key1, key2, key1), ""},
+		{"fail/duration", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "claims": {"minTLSCertDuration": "5m", "maxTLSCertDuration": "24hh"}}
+		]`, key1), "error unmarshaling provisioner foo: error unmarshaling claims: maxTLSCertDuration: error parsing 24hh as duration"},
+		{"fail/tls-min-max", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "claims": {"minTLSCertDuration": "48h"}}
+		]`, key1), "provisioner foo: claims: MaxCertDuration cannot be less than MinCertDuration"},
+		{"fail/tls-default-max", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "claims": {"defaultTLSCertDuration": "48h"}}
+		]`, key1), "provisioner foo: claims: MaxCertDuration cannot be less than DefaultCertDuration"},
+		{"fail/user-ssh-min-max", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "claims": {"minUserSSHCertDuration": "48h"}}
+		]`, key1), "provisioner foo: claims: MaxUserSSHCertDuration cannot be less than MinUserSSHCertDuration"},
+		{"fail/user-ssh-default-max", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "claims": {"defaultUserSSHCertDuration": "48h"}}
+		]`, key1), "provisioner foo: claims: MaxUserSSHCertDuration cannot be less than DefaultUserSSHCertDuration"},
+		{"fail/host-ssh-default-min", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "claims": {"defaultHostSSHCertDuration": "1m"}}
+		]`, key1), "provisioner foo: claims: DefaultHostSSHCertDuration cannot be less than MinHostSSHCertDuration"},
+		{"fail/host-ssh-negative", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "claims": {"minHostSSHCertDuration": "-1m"}}
+		]`, key1), "provisioner foo: claims: MinHostSSHCertDuration cannot be negative"},
+		{"fail/template-file", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "x509": {"templateFile": "testdata/templates/missing.tpl"}}
+		]`, key1), "provisioner foo: error reading x509 template of provisioner foo"},
+		{"fail/x5c-roots", `[
+			{"type": "X5C", "name": "foo", "roots": "Zm9v"}
+		]`, "provisioner foo: no x509 certificates found in roots attribute for provisioner foo"},
+		{"fail/name", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s},
+			{"type": "ACME", "name": "foo"}
+		]`, key1), "provisioner foo: name is already used by another provisioner"},
+		{"fail/kid", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s},
+			{"type": "JWK", "name": "foo", "key": %s}
+		]`, key1, key1), fmt.Sprintf("provisioner foo: id foo:%s is already used by provisioner foo", k1.KeyID)},
+		{"fail/previous-kid", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s},
+			{"type": "JWK", "name": "foo", "key": %s, "previousKeys": [%s]}
+		]`, key1, key2, key1), fmt.Sprintf("provisioner foo: id foo:%s is already used by provisioner foo", k1.KeyID)},
+		{"fail/encrypted-kid", fmt.Sprintf(`[
+			{"type": "JWK", "name": "foo", "key": %s, "encryptedKey": "foo"},
+			{"type": "JWK", "name": "bar", "key": %s, "encryptedKey": "bar"}
+		]`, key1, key1), fmt.Sprintf("provisioner bar: encrypted key with kid %s is already used by provisioner foo", k1.KeyID)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var list List
+			err := json.Unmarshal([]byte(tt.config), &list)
+			if err == nil {
+				for i, p := range list {
+					if err = Validate(p, list[:i], config); err != nil {
+						break
+					}
+				}
+			}
+			if tt.err == "" {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.HasPrefix(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestList_Public(t *testing.T) {
+	webhooks := func() []*Webhook {
+		return []*Webhook{{Name: "people", URL: "https://example.com", Kind: WebhookKindEnriching, BearerToken: "secret"}}
+	}
+	list := List{
+		&JWK{Name: "jwk", Webhooks: webhooks()},
+		&OIDC{Name: "oidc", Webhooks: webhooks()},
+		&X5C{Name: "x5c", Webhooks: webhooks()},
+		&GCP{Name: "gcp", Webhooks: webhooks()},
+		&AWS{Name: "aws", Webhooks: webhooks()},
+		&Azure{Name: "azure", Webhooks: webhooks()},
+		&K8sSA{Name: "k8ssa", Webhooks: webhooks()},
+		&SCEP{Name: "scep", Webhooks: webhooks()},
+		&SCEP{Name: "scep-static", ChallengePassword: "secret", DecrypterKeyPassword: "secret-password"},
+		&ACME{Name: "acme"},
+	}
+	public := list.Public()
+	assert.Len(t, len(list), public)
+	for i, p := range public {
+		assert.Equals(t, list[i].GetName(), p.GetName())
+		b, err := json.Marshal(p)
+		assert.FatalError(t, err)
+		assert.False(t, strings.Contains(string(b), "secret"), string(b))
+		b, err = json.Marshal(list[i])
+		assert.FatalError(t, err)
+		if _, ok := p.(*ACME); !ok {
+			assert.True(t, strings.Contains(string(b), "secret"), string(b))
+		}
+	}
+}
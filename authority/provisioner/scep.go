@@ -0,0 +1,175 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/pemutil"
+)
+
+// SCEP is the SCEP provisioner type, an entity that can authorize the SCEP
+// provisioning flow.
+//
+// The SCEP messages are encrypted for the decrypter certificate, and the
+// responses are signed with the decrypter key. Both must be RSA, as most
+// SCEP clients only support RSA.
+type SCEP struct {
+	*base
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// ChallengePassword is the static challenge password that the clients
+	// must include in the certificate requests.
+	ChallengePassword    string  `json:"challenge,omitempty"`
+	DecrypterCertificate string  `json:"decrypterCertificate"`
+	DecrypterKey         string  `json:"decrypterKey"`
+	DecrypterKeyPassword string  `json:"decrypterKeyPassword,omitempty"`
+	Claims               *Claims `json:"claims,omitempty"`
+	// Webhooks are the SCEPCHALLENGE webhooks used to validate the challenge
+	// passwords instead of a static challenge.
+	Webhooks      []*Webhook `json:"webhooks,omitempty"`
+	claimer       *Claimer
+	decrypterCert *x509.Certificate
+	decrypter     *rsa.PrivateKey
+}
+
+// GetID returns the provisioner unique identifier.
+func (p *SCEP) GetID() string {
+	return "scep/" + p.Name
+}
+
+// GetTokenID returns the identifier of the token.
+func (p *SCEP) GetTokenID(ott string) (string, error) {
+	return "", errors.New("scep provisioner does not implement GetTokenID")
+}
+
+// GetName returns the name of the provisioner.
+func (p *SCEP) GetName() string {
+	return p.Name
+}
+
+// GetType returns the type of provisioner.
+func (p *SCEP) GetType() Type {
+	return TypeSCEP
+}
+
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *SCEP) IsDisabled() bool {
+	return p.Disabled
+}
+
+// GetEncryptedKey returns the base provisioner encrypted key if it's defined.
+func (p *SCEP) GetEncryptedKey() (string, string, bool) {
+	return "", "", false
+}
+
+// Init initializes and validates the fields of a SCEP type.
+func (p *SCEP) Init(config Config) (err error) {
+	switch {
+	case p.Type == "":
+		return errors.New("provisioner type cannot be empty")
+	case p.Name == "":
+		return errors.New("provisioner name cannot be empty")
+	case p.ChallengePassword == "" && len(p.Webhooks) == 0:
+		return errors.New("provisioner challenge or a SCEPCHALLENGE webhook must be set")
+	case p.ChallengePassword != "" && len(p.Webhooks) > 0:
+		return errors.New("provisioner challenge cannot be used with SCEPCHALLENGE webhooks")
+	case p.DecrypterCertificate == "":
+		return errors.New("provisioner decrypterCertificate cannot be empty")
+	case p.DecrypterKey == "":
+		return errors.New("provisioner decrypterKey cannot be empty")
+	}
+
+	if err := validateWebhooks(p.Webhooks, WebhookKindSCEPChallenge); err != nil {
+		return err
+	}
+
+	if p.decrypterCert, err = pemutil.ReadCertificate(p.DecrypterCertificate); err != nil {
+		return err
+	}
+	var opts []pemutil.Options
+	if p.DecrypterKeyPassword != "" {
+		opts = append(opts, pemutil.WithPassword([]byte(p.DecrypterKeyPassword)))
+	}
+	key, err := pemutil.Read(p.DecrypterKey, opts...)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if p.decrypter, ok = key.(*rsa.PrivateKey); !ok {
+		return errors.Errorf("provisioner decrypterKey must be an RSA key, but got %T", key)
+	}
+	if !publicKeyEqual(p.decrypterCert.PublicKey, p.decrypter.Public()) {
+		return errors.New("provisioner decrypterKey does not match the decrypterCertificate")
+	}
+
+	// Update claims with global ones
+	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetDecrypter returns the certificate and the key used to decrypt the SCEP
+// messages and to sign the responses.
+func (p *SCEP) GetDecrypter() (*x509.Certificate, *rsa.PrivateKey) {
+	return p.decrypterCert, p.decrypter
+}
+
+// ValidateChallenge returns an error if the given challenge password is not
+// valid for the certificate request. If SCEPCHALLENGE webhooks are configured
+// all of them must approve the challenge, otherwise the challenge must be the
+// one configured in the provisioner. Any webhook error rejects the challenge.
+func (p *SCEP) ValidateChallenge(ctx context.Context, challenge, transactionID string, csr *x509.CertificateRequest) error {
+	if len(p.Webhooks) == 0 {
+		if subtle.ConstantTimeCompare([]byte(challenge), []byte(p.ChallengePassword)) != 1 {
+			return errs.Unauthorized("scep.ValidateChallenge; invalid challenge password")
+		}
+		return nil
+	}
+
+	body := &webhookRequestBody{
+		Provisioner:            p.Name,
+		SCEPChallenge:          challenge,
+		SCEPTransactionID:      transactionID,
+		X509CertificateRequest: newWebhookCertificateRequest(csr),
+	}
+	for _, w := range p.Webhooks {
+		resp, err := w.call(ctx, body)
+		if err != nil {
+			return errs.Wrap(http.StatusUnauthorized, err, "scep.ValidateChallenge; error calling webhook")
+		}
+		if allow, _ := resp["allow"].(bool); !allow {
+			return errs.Unauthorized("scep.ValidateChallenge; challenge denied by webhook %s", w.Name)
+		}
+	}
+	return nil
+}
+
+// AuthorizeSign does not do any validation, because all validation is handled
+// in the SCEP protocol. This method returns a list of modifiers / constraints
+// on the resulting certificate.
+func (p *SCEP) AuthorizeSign(ctx context.Context, token string) ([]SignOption, error) {
+	return []SignOption{
+		// modifiers / withOptions
+		newProvisionerExtensionOption(TypeSCEP, p.Name, ""),
+		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
+		// validators
+		defaultPublicKeyValidator{},
+		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
+	}, nil
+}
+
+// AuthorizeRenew returns an error if the renewal is disabled.
+func (p *SCEP) AuthorizeRenew(ctx context.Context, cert *x509.Certificate) error {
+	if p.claimer.IsDisableRenewal() {
+		return errs.Unauthorized("scep.AuthorizeRenew; renew is disabled for scep provisioner %s", p.GetID())
+	}
+	return nil
+}
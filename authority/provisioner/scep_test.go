@@ -0,0 +1,268 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/errs"
+)
+
+// generateSCEPDecrypter writes an RSA certificate and key in the given
+// directory and returns their paths.
+func generateSCEPDecrypter(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SCEP RA"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	crtFile, keyFile := filepath.Join(dir, "ra.crt"), filepath.Join(dir, "ra.key")
+	assert.FatalError(t, ioutil.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der,
+	}), 0600))
+	assert.FatalError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+	return crtFile, keyFile
+}
+
+func TestSCEP_Getters(t *testing.T) {
+	p := &SCEP{Type: "SCEP", Name: "foo"}
+	if got := p.GetID(); got != "scep/foo" {
+		t.Errorf("SCEP.GetID() = %v, want %v", got, "scep/foo")
+	}
+	if got := p.GetName(); got != "foo" {
+		t.Errorf("SCEP.GetName() = %v, want %v", got, "foo")
+	}
+	if got := p.GetType(); got != TypeSCEP {
+		t.Errorf("SCEP.GetType() = %v, want %v", got, TypeSCEP)
+	}
+	kid, key, ok := p.GetEncryptedKey()
+	if kid != "" || key != "" || ok == true {
+		t.Errorf("SCEP.GetEncryptedKey() = (%v, %v, %v), want (%v, %v, %v)",
+			kid, key, ok, "", "", false)
+	}
+}
+
+func TestSCEP_Init(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scep")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	crtFile, keyFile := generateSCEPDecrypter(t, dir)
+	otherDir := filepath.Join(dir, "other")
+	assert.FatalError(t, os.Mkdir(otherDir, 0700))
+	_, otherKeyFile := generateSCEPDecrypter(t, otherDir)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	assert.FatalError(t, err)
+	ecKeyFile := filepath.Join(dir, "ec.key")
+	assert.FatalError(t, ioutil.WriteFile(ecKeyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: ecDER,
+	}), 0600))
+
+	mdm := &Webhook{Name: "mdm", URL: "https://mdm.example.com/scep", Kind: WebhookKindSCEPChallenge}
+	tests := map[string]struct {
+		p   *SCEP
+		err error
+	}{
+		"fail-empty-type":      {&SCEP{}, errors.New("provisioner type cannot be empty")},
+		"fail-empty-name":      {&SCEP{Type: "SCEP"}, errors.New("provisioner name cannot be empty")},
+		"fail-empty-challenge": {&SCEP{Type: "SCEP", Name: "foo"}, errors.New("provisioner challenge or a SCEPCHALLENGE webhook must be set")},
+		"fail-challenge-and-webhook": {
+			&SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret", Webhooks: []*Webhook{mdm}},
+			errors.New("provisioner challenge cannot be used with SCEPCHALLENGE webhooks"),
+		},
+		"fail-webhook-url": {
+			&SCEP{Type: "SCEP", Name: "foo", Webhooks: []*Webhook{{Name: "mdm", URL: "ftp://mdm.example.com/scep", Kind: WebhookKindSCEPChallenge}}, DecrypterCertificate: crtFile, DecrypterKey: keyFile},
+			errors.New("webhook mdm: url must use http or https"),
+		},
+		"fail-webhook-timeout": {
+			&SCEP{Type: "SCEP", Name: "foo", Webhooks: []*Webhook{{Name: "mdm", URL: "https://mdm.example.com/scep", Kind: WebhookKindSCEPChallenge, Timeout: &Duration{}}}, DecrypterCertificate: crtFile, DecrypterKey: keyFile},
+			errors.New("webhook mdm: timeout must be greater than 0"),
+		},
+		"fail-webhook-kind": {
+			&SCEP{Type: "SCEP", Name: "foo", Webhooks: []*Webhook{{Name: "mdm", URL: "https://mdm.example.com/scep", Kind: WebhookKindEnriching}}, DecrypterCertificate: crtFile, DecrypterKey: keyFile},
+			errors.New("webhook mdm: kind 'ENRICHING' is not supported by this provisioner"),
+		},
+		"fail-empty-certificate": {
+			&SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret"},
+			errors.New("provisioner decrypterCertificate cannot be empty"),
+		},
+		"fail-empty-key": {
+			&SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret", DecrypterCertificate: crtFile},
+			errors.New("provisioner decrypterKey cannot be empty"),
+		},
+		"fail-not-rsa": {
+			&SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret", DecrypterCertificate: crtFile, DecrypterKey: ecKeyFile},
+			errors.New("provisioner decrypterKey must be an RSA key, but got *ecdsa.PrivateKey"),
+		},
+		"fail-key-mismatch": {
+			&SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret", DecrypterCertificate: crtFile, DecrypterKey: otherKeyFile},
+			errors.New("provisioner decrypterKey does not match the decrypterCertificate"),
+		},
+		"fail-bad-claims": {
+			&SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret", DecrypterCertificate: crtFile, DecrypterKey: keyFile, Claims: &Claims{DefaultTLSDur: &Duration{0}}},
+			errors.New("claims: DefaultTLSCertDuration must be greater than 0"),
+		},
+		"ok": {
+			&SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret", DecrypterCertificate: crtFile, DecrypterKey: keyFile},
+			nil,
+		},
+		"ok-webhook": {
+			&SCEP{Type: "SCEP", Name: "foo", Webhooks: []*Webhook{mdm}, DecrypterCertificate: crtFile, DecrypterKey: keyFile},
+			nil,
+		},
+	}
+
+	config := Config{
+		Claims:    globalProvisionerClaims,
+		Audiences: testAudiences,
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.p.Init(config)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.Equals(t, tc.err.Error(), err.Error())
+				}
+			} else if assert.Nil(t, tc.err) {
+				crt, key := tc.p.GetDecrypter()
+				assert.NotNil(t, crt)
+				assert.NotNil(t, key)
+			}
+		})
+	}
+}
+
+func TestSCEP_ValidateChallenge(t *testing.T) {
+	csr := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "device-1", Organization: []string{"Smallstep"}},
+		DNSNames: []string{"device-1.example.com"},
+	}
+
+	var requests []webhookRequestBody
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		var req webhookRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, req)
+		switch req.SCEPChallenge {
+		case "approve":
+			w.Write([]byte(`{"allow":true}`))
+		case "deny":
+			w.Write([]byte(`{"allow":false}`))
+		case "timeout":
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte(`{"allow":true}`))
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"allow":true}`))
+		default:
+			w.Write([]byte(`not json`))
+		}
+	}))
+	defer srv.Close()
+
+	static := &SCEP{Type: "SCEP", Name: "static", ChallengePassword: "secret"}
+	webhook := &SCEP{Type: "SCEP", Name: "webhook", Webhooks: []*Webhook{{
+		Name:        "mdm",
+		URL:         srv.URL,
+		Kind:        WebhookKindSCEPChallenge,
+		BearerToken: "token",
+		Timeout:     &Duration{Duration: 100 * time.Millisecond},
+	}}}
+
+	tests := map[string]struct {
+		p         *SCEP
+		challenge string
+		err       error
+	}{
+		"ok/static":            {static, "secret", nil},
+		"fail/static-empty":    {static, "", errors.New("scep.ValidateChallenge; invalid challenge password")},
+		"fail/static-case":     {static, "Secret", errors.New("scep.ValidateChallenge; invalid challenge password")},
+		"fail/static-space":    {static, "secret ", errors.New("scep.ValidateChallenge; invalid challenge password")},
+		"ok/webhook-approve":   {webhook, "approve", nil},
+		"fail/webhook-deny":    {webhook, "deny", errors.New("scep.ValidateChallenge; challenge denied by webhook mdm")},
+		"fail/webhook-status":  {webhook, "error", errors.New("scep.ValidateChallenge; error calling webhook")},
+		"fail/webhook-body":    {webhook, "other", errors.New("scep.ValidateChallenge; error calling webhook")},
+		"fail/webhook-timeout": {webhook, "timeout", errors.New("scep.ValidateChallenge; error calling webhook")},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests = nil
+			err := tc.p.ValidateChallenge(context.Background(), tc.challenge, "transaction-1", csr)
+			if tc.err == nil {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, http.StatusUnauthorized, sc.StatusCode())
+				assert.HasPrefix(t, err.Error(), tc.err.Error())
+			}
+			if tc.p == webhook {
+				assert.Equals(t, "Bearer token", auth)
+				assert.Len(t, 1, requests)
+				assert.Equals(t, "webhook", requests[0].Provisioner)
+				assert.Equals(t, tc.challenge, requests[0].SCEPChallenge)
+				assert.Equals(t, "transaction-1", requests[0].SCEPTransactionID)
+				assert.Equals(t, "device-1", requests[0].X509CertificateRequest.CommonName)
+				assert.Equals(t, []string{"device-1.example.com"}, requests[0].X509CertificateRequest.DNSNames)
+			}
+		})
+	}
+}
+
+func TestSCEP_AuthorizeSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scep")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	crtFile, keyFile := generateSCEPDecrypter(t, dir)
+
+	p := &SCEP{Type: "SCEP", Name: "foo", ChallengePassword: "secret", DecrypterCertificate: crtFile, DecrypterKey: keyFile}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims, Audiences: testAudiences}))
+	opts, err := p.AuthorizeSign(context.Background(), "")
+	assert.FatalError(t, err)
+	assert.Len(t, 4, opts)
+	for _, o := range opts {
+		switch v := o.(type) {
+		case *provisionerExtensionOption:
+			assert.Equals(t, v.Type, int(TypeSCEP))
+			assert.Equals(t, v.Name, p.GetName())
+		case profileDefaultDuration:
+			assert.Equals(t, time.Duration(v), p.claimer.DefaultTLSCertDuration())
+		case defaultPublicKeyValidator:
+		case *validityValidator:
+			assert.Equals(t, v.min, p.claimer.MinTLSCertDuration())
+			assert.Equals(t, v.max, p.claimer.MaxTLSCertDuration())
+		default:
+			assert.FatalError(t, errors.Errorf("unexpected sign option of type %T", v))
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/asn1"
 	"net"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,9 +19,12 @@ import (
 // Options contains the options that can be passed to the Sign method. Backdate
 // is automatically filled and can only be configured in the CA.
 type Options struct {
-	NotAfter  TimeDuration  `json:"notAfter"`
-	NotBefore TimeDuration  `json:"notBefore"`
-	Backdate  time.Duration `json:"-"`
+	NotAfter    TimeDuration       `json:"notAfter"`
+	NotBefore   TimeDuration       `json:"notBefore"`
+	Backdate    time.Duration      `json:"-"`
+	Attestation *AttestationObject `json:"-"`
+	// UserData is the template data in the request, see ParseUserData.
+	UserData map[string]interface{} `json:"-"`
 }
 
 // SignOption is the interface used to collect all extra options used in the
@@ -40,6 +44,14 @@ type CertificateRequestValidator interface {
 	Valid(req *x509.CertificateRequest) error
 }
 
+// CertificateEnricher is the interface used to add data to the certificate
+// templates before they are rendered. It receives the certificate request that
+// is going to be signed.
+type CertificateEnricher interface {
+	SignOption
+	Enrich(req *x509.CertificateRequest) error
+}
+
 // ProfileModifier is the interface used to add custom options to the profile
 // constructor. The options are used to modify the final certificate.
 type ProfileModifier interface {
@@ -62,15 +74,23 @@ type emailOnlyIdentity string
 func (e emailOnlyIdentity) Valid(req *x509.CertificateRequest) error {
 	switch {
 	case len(req.DNSNames) > 0:
-		return errors.New("certificate request cannot contain DNS names")
+		return errors.Errorf("certificate request cannot contain DNS names, only the email address %s is allowed: found %s", e, strings.Join(req.DNSNames, ", "))
 	case len(req.IPAddresses) > 0:
-		return errors.New("certificate request cannot contain IP addresses")
+		ips := make([]string, len(req.IPAddresses))
+		for i, ip := range req.IPAddresses {
+			ips[i] = ip.String()
+		}
+		return errors.Errorf("certificate request cannot contain IP addresses, only the email address %s is allowed: found %s", e, strings.Join(ips, ", "))
 	case len(req.URIs) > 0:
-		return errors.New("certificate request cannot contain URIs")
+		uris := make([]string, len(req.URIs))
+		for i, u := range req.URIs {
+			uris[i] = u.String()
+		}
+		return errors.Errorf("certificate request cannot contain URIs, only the email address %s is allowed: found %s", e, strings.Join(uris, ", "))
 	case len(req.EmailAddresses) == 0:
-		return errors.New("certificate request does not contain any email address")
+		return errors.Errorf("certificate request does not contain any email address, want %s", e)
 	case len(req.EmailAddresses) > 1:
-		return errors.New("certificate request contains too many email addresses")
+		return errors.Errorf("certificate request contains too many email addresses, only %s is allowed: found %s", e, strings.Join(req.EmailAddresses, ", "))
 	case req.EmailAddresses[0] == "":
 		return errors.New("certificate request cannot contain an empty email address")
 	case req.EmailAddresses[0] != string(e):
@@ -352,6 +372,36 @@ func createProvisionerExtension(typ int, name, credentialID string, keyValuePair
 	}, nil
 }
 
+// Extension is the provisioner extension of the certificates issued by the
+// CA, it identifies the provisioner used to get the certificate.
+type Extension struct {
+	Type          Type
+	Name          string
+	CredentialID  string
+	KeyValuePairs []string
+}
+
+// GetExtension returns the provisioner extension of the given certificate.
+// It returns false if the certificate does not have the extension or if it
+// cannot be parsed.
+func GetExtension(cert *x509.Certificate) (*Extension, bool) {
+	for _, e := range cert.Extensions {
+		if e.Id.Equal(stepOIDProvisioner) {
+			var p stepProvisionerASN1
+			if _, err := asn1.Unmarshal(e.Value, &p); err != nil {
+				return nil, false
+			}
+			return &Extension{
+				Type:          Type(p.Type),
+				Name:          string(p.Name),
+				CredentialID:  string(p.CredentialID),
+				KeyValuePairs: p.KeyValuePairs,
+			}, true
+		}
+	}
+	return nil, false
+}
+
 func init() {
 	// Avoid dead-code warning in profileWithOption
 	_ = profileWithOption(nil)
@@ -543,3 +543,25 @@ func Test_profileLimitDuration_Option(t *testing.T) {
 		})
 	}
 }
+
+func TestGetExtension(t *testing.T) {
+	ext, err := createProvisionerExtension(int(TypeJWK), "jwk", "kid", "key", "value")
+	assert.FatalError(t, err)
+	tests := map[string]struct {
+		cert *x509.Certificate
+		want *Extension
+		ok   bool
+	}{
+		"ok": {&x509.Certificate{Extensions: []pkix.Extension{{Id: []int{2, 5, 29, 17}}, ext}},
+			&Extension{Type: TypeJWK, Name: "jwk", CredentialID: "kid", KeyValuePairs: []string{"key", "value"}}, true},
+		"fail/missing": {&x509.Certificate{}, nil, false},
+		"fail/asn1":    {&x509.Certificate{Extensions: []pkix.Extension{{Id: stepOIDProvisioner, Value: []byte("foo")}}}, nil, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := GetExtension(tt.cert)
+			assert.Equals(t, tt.ok, ok)
+			assert.Equals(t, tt.want, got)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rsa"
 	"encoding/binary"
 	"math/big"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -184,6 +185,16 @@ func (m sshCertDefaultsModifier) Modify(cert *ssh.Certificate) error {
 	return nil
 }
 
+// DefaultSSHExtensions are the extensions set by default in the SSH user
+// certificates.
+var DefaultSSHExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
 // sshDefaultExtensionModifier implements an SSHCertModifier that sets
 // the default extensions in an SSH certificate.
 type sshDefaultExtensionModifier struct{}
@@ -197,11 +208,9 @@ func (m *sshDefaultExtensionModifier) Modify(cert *ssh.Certificate) error {
 		if cert.Extensions == nil {
 			cert.Extensions = make(map[string]string)
 		}
-		cert.Extensions["permit-X11-forwarding"] = ""
-		cert.Extensions["permit-agent-forwarding"] = ""
-		cert.Extensions["permit-port-forwarding"] = ""
-		cert.Extensions["permit-pty"] = ""
-		cert.Extensions["permit-user-rc"] = ""
+		for k, v := range DefaultSSHExtensions {
+			cert.Extensions[k] = v
+		}
 		return nil
 	default:
 		return errors.New("ssh certificate type has not been set or is invalid")
@@ -320,14 +329,19 @@ func (v *sshCertValidityValidator) Valid(cert *ssh.Certificate, opts SSHOptions)
 		return errors.New("ssh certificate validBefore cannot be before validAfter")
 	}
 
-	var min, max time.Duration
+	var (
+		min, max time.Duration
+		certType string
+	)
 	switch cert.CertType {
 	case ssh.UserCert:
 		min = v.MinUserSSHCertDuration()
 		max = v.MaxUserSSHCertDuration()
+		certType = SSHUserCert
 	case ssh.HostCert:
 		min = v.MinHostSSHCertDuration()
 		max = v.MaxHostSSHCertDuration()
+		certType = SSHHostCert
 	case 0:
 		return errors.New("ssh certificate type has not been set")
 	default:
@@ -340,11 +354,11 @@ func (v *sshCertValidityValidator) Valid(cert *ssh.Certificate, opts SSHOptions)
 
 	switch {
 	case dur < min:
-		return errors.Errorf("requested duration of %s is less than minimum "+
-			"accepted duration for selected provisioner of %s", dur, min)
+		return errors.Errorf("requested duration of %s is less than the authorized "+
+			"minimum ssh %s certificate duration of %s", dur, certType, min)
 	case dur > max+opts.Backdate:
-		return errors.Errorf("requested duration of %s is greater than maximum "+
-			"accepted duration for selected provisioner of %s", dur, max+opts.Backdate)
+		return errors.Errorf("requested duration of %s is more than the authorized "+
+			"maximum ssh %s certificate duration of %s", dur, certType, max+opts.Backdate)
 	default:
 		return nil
 	}
@@ -427,6 +441,40 @@ func (v sshCertKeyIDValidator) Valid(cert *ssh.Certificate, o SSHOptions) error
 	return nil
 }
 
+// sshHostDomainsValidator implements a validator that requires the principals
+// of the host certificates to be one of the domains or a subdomain. A domain
+// starting with a dot only allows the subdomains.
+type sshHostDomainsValidator []string
+
+// Valid returns an error if a principal of a host certificate is not in the
+// allowed domains.
+func (v sshHostDomainsValidator) Valid(cert *ssh.Certificate, o SSHOptions) error {
+	if cert.CertType != ssh.HostCert {
+		return nil
+	}
+	for _, p := range cert.ValidPrincipals {
+		if !v.allowed(p) {
+			return errors.Errorf("ssh certificate principal %s is not allowed", p)
+		}
+	}
+	return nil
+}
+
+func (v sshHostDomainsValidator) allowed(principal string) bool {
+	principal = strings.ToLower(strings.TrimSuffix(principal, "."))
+	for _, d := range v {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if strings.HasPrefix(d, ".") {
+			if strings.HasSuffix(principal, d) {
+				return true
+			}
+		} else if principal == d || strings.HasSuffix(principal, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
 // sshCertTypeUInt32
 func sshCertTypeUInt32(ct string) uint32 {
 	switch ct {
@@ -723,7 +723,7 @@ func Test_sshCertValidityValidator(t *testing.T) {
 				ValidBefore: uint64(n.Add(4 * time.Minute).Unix()),
 			},
 			SSHOptions{Backdate: time.Second},
-			errors.New("requested duration of 4m0s is less than minimum accepted duration for selected provisioner of 5m0s"),
+			errors.New("requested duration of 4m0s is less than the authorized minimum ssh user certificate duration of 5m0s"),
 		},
 		{
 			"ok/duration-exactly-min",
@@ -743,7 +743,7 @@ func Test_sshCertValidityValidator(t *testing.T) {
 				ValidBefore: uint64(n.Add(48 * time.Hour).Unix()),
 			},
 			SSHOptions{Backdate: time.Second},
-			errors.New("requested duration of 48h0m0s is greater than maximum accepted duration for selected provisioner of 24h0m1s"),
+			errors.New("requested duration of 48h0m0s is more than the authorized maximum ssh user certificate duration of 24h0m1s"),
 		},
 		{
 			"ok/duration-exactly-max",
@@ -755,6 +755,46 @@ func Test_sshCertValidityValidator(t *testing.T) {
 			SSHOptions{Backdate: time.Second},
 			nil,
 		},
+		{
+			"fail/host-duration<min",
+			&ssh.Certificate{
+				CertType:    2,
+				ValidAfter:  uint64(n.Unix()),
+				ValidBefore: uint64(n.Add(4 * time.Minute).Unix()),
+			},
+			SSHOptions{Backdate: time.Second},
+			errors.New("requested duration of 4m0s is less than the authorized minimum ssh host certificate duration of 5m0s"),
+		},
+		{
+			"ok/host-duration-exactly-min",
+			&ssh.Certificate{
+				CertType:    2,
+				ValidAfter:  uint64(n.Unix()),
+				ValidBefore: uint64(n.Add(5 * time.Minute).Unix()),
+			},
+			SSHOptions{Backdate: time.Second},
+			nil,
+		},
+		{
+			"fail/host-duration>max",
+			&ssh.Certificate{
+				CertType:    2,
+				ValidAfter:  uint64(n.Unix()),
+				ValidBefore: uint64(n.Add(31 * 24 * time.Hour).Unix()),
+			},
+			SSHOptions{Backdate: time.Second},
+			errors.New("requested duration of 744h0m0s is more than the authorized maximum ssh host certificate duration of 720h0m1s"),
+		},
+		{
+			"ok/host-duration-exactly-max",
+			&ssh.Certificate{
+				CertType:    2,
+				ValidAfter:  uint64(n.Unix()),
+				ValidBefore: uint64(n.Add(30*24*time.Hour + time.Second).Unix()),
+			},
+			SSHOptions{Backdate: time.Second},
+			nil,
+		},
 		{
 			"ok",
 			&ssh.Certificate{
@@ -779,6 +819,70 @@ func Test_sshCertValidityValidator(t *testing.T) {
 	}
 }
 
+func Test_sshCertValidityValidator_provisionerClaims(t *testing.T) {
+	claimer, err := NewClaimer(&Claims{
+		MaxUserSSHDur:     &Duration{16 * time.Hour},
+		DefaultUserSSHDur: &Duration{8 * time.Hour},
+		MinHostSSHDur:     &Duration{time.Hour},
+	}, globalProvisionerClaims)
+	assert.FatalError(t, err)
+	v := sshCertValidityValidator{claimer}
+	n := now()
+	tests := []struct {
+		name string
+		cert *ssh.Certificate
+		err  error
+	}{
+		{"ok/user", &ssh.Certificate{CertType: ssh.UserCert, ValidAfter: uint64(n.Unix()), ValidBefore: uint64(n.Add(16 * time.Hour).Unix())}, nil},
+		{"fail/user>max", &ssh.Certificate{CertType: ssh.UserCert, ValidAfter: uint64(n.Unix()), ValidBefore: uint64(n.Add(17 * time.Hour).Unix())},
+			errors.New("requested duration of 17h0m0s is more than the authorized maximum ssh user certificate duration of 16h0m0s")},
+		{"ok/host", &ssh.Certificate{CertType: ssh.HostCert, ValidAfter: uint64(n.Unix()), ValidBefore: uint64(n.Add(time.Hour).Unix())}, nil},
+		{"fail/host<min", &ssh.Certificate{CertType: ssh.HostCert, ValidAfter: uint64(n.Unix()), ValidBefore: uint64(n.Add(30 * time.Minute).Unix())},
+			errors.New("requested duration of 30m0s is less than the authorized minimum ssh host certificate duration of 1h0m0s")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := v.Valid(tt.cert, SSHOptions{}); err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+}
+
+func Test_sshHostDomainsValidator_Valid(t *testing.T) {
+	v := sshHostDomainsValidator{".internal.example.com", "example.org."}
+	tests := []struct {
+		name string
+		cert *ssh.Certificate
+		err  error
+	}{
+		{"ok", &ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"foo.internal.example.com", "Bar.Internal.Example.com."}}, nil},
+		{"ok/domain", &ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"example.org", "foo.example.org"}}, nil},
+		{"ok/user", &ssh.Certificate{CertType: ssh.UserCert, ValidPrincipals: []string{"jane"}}, nil},
+		{"fail/suffix-domain", &ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"internal.example.com"}},
+			errors.New("ssh certificate principal internal.example.com is not allowed")},
+		{"fail/other", &ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"foo.internal.example.com", "fooexample.org"}},
+			errors.New("ssh certificate principal fooexample.org is not allowed")},
+		{"fail/ip", &ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: []string{"10.0.0.1"}},
+			errors.New("ssh certificate principal 10.0.0.1 is not allowed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := v.Valid(tt.cert, SSHOptions{}); err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, tt.err.Error(), err.Error())
+				}
+			} else {
+				assert.Nil(t, tt.err)
+			}
+		})
+	}
+}
+
 func Test_sshValidityModifier(t *testing.T) {
 	n, fn := mockNow()
 	defer fn()
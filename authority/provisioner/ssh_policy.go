@@ -0,0 +1,178 @@
+package provisioner
+
+import (
+	"net"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/errs"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHPolicy restricts the principals of the SSH certificates signed, renewed
+// or rekeyed by a provisioner. An empty policy allows all the principals.
+type SSHPolicy struct {
+	// AllowedUserPrincipals are the principals allowed in the user
+	// certificates, as exact names or glob patterns like "deploy-*". All the
+	// principals are allowed by default.
+	AllowedUserPrincipals []string `json:"allowedUserPrincipals,omitempty"`
+	// DeniedUserPrincipals are the principals, or glob patterns, never
+	// allowed in the user certificates. They take precedence over the allowed
+	// principals.
+	DeniedUserPrincipals []string `json:"deniedUserPrincipals,omitempty"`
+	// AllowedHostDomains are the domains allowed in the principals of the
+	// host certificates, with the same format as the ssh hostDomains.
+	AllowedHostDomains []string `json:"allowedHostDomains,omitempty"`
+	// AllowedHostIPRanges are the IP ranges allowed in the principals of the
+	// host certificates, with the same format as the IP ranges of the
+	// x509Policy. The principals that are IP addresses are checked with the IP
+	// ranges instead of the domains if any of the IP options is set.
+	AllowedHostIPRanges []string `json:"allowedHostIPRanges,omitempty"`
+	// DeniedHostIPRanges are the IP ranges never allowed in the principals of
+	// the host certificates.
+	DeniedHostIPRanges []string `json:"deniedHostIPRanges,omitempty"`
+	// DefaultHostIPAction is the action for the IP principals of the host
+	// certificates if the policy has no host IP ranges, "allow" or "deny".
+	DefaultHostIPAction string `json:"defaultHostIPAction,omitempty"`
+	// RequireIdentityPrincipals requires the principals of the user
+	// certificates to be the authenticated identity, e.g. the local part of
+	// the OIDC email, unless the requester is an admin of the provisioner.
+	RequireIdentityPrincipals bool `json:"requireIdentityPrincipals,omitempty"`
+	layer                     string
+}
+
+// init validates the patterns and the domains of the policy of a provisioner.
+func (p *SSHPolicy) init(name string) error {
+	if p == nil {
+		return nil
+	}
+	return p.validate("provisioner " + name)
+}
+
+// InitAuthority validates the authority policy, the outer boundary of the
+// policies of all the provisioners. The authority does not know the identity
+// of the requester, so it cannot require the identity principals.
+func (p *SSHPolicy) InitAuthority() error {
+	if p == nil {
+		return nil
+	}
+	if p.RequireIdentityPrincipals {
+		return errors.New("authority: sshPolicy requireIdentityPrincipals can only be used in the provisioners")
+	}
+	p.layer = PolicyLayerAuthority
+	return p.validate(PolicyLayerAuthority)
+}
+
+// validate validates the patterns and the domains of the policy of the owner,
+// e.g. "provisioner foo".
+func (p *SSHPolicy) validate(owner string) error {
+	for _, patterns := range [][]string{p.AllowedUserPrincipals, p.DeniedUserPrincipals} {
+		for _, s := range patterns {
+			if s == "" {
+				return errors.Errorf("%s: sshPolicy principals cannot be empty", owner)
+			}
+			if _, err := path.Match(s, ""); err != nil {
+				return errors.Errorf("%s: sshPolicy principal %q is not a valid pattern", owner, s)
+			}
+		}
+	}
+	for _, d := range p.AllowedHostDomains {
+		if d == "" || d == "." {
+			return errors.Errorf("%s: sshPolicy allowedHostDomains cannot contain empty domains", owner)
+		}
+	}
+	return validateIPPolicy("sshPolicy", owner, p.AllowedHostIPRanges, p.DeniedHostIPRanges, p.DefaultHostIPAction)
+}
+
+// isEmpty returns true if the policy does not restrict any principal.
+func (p *SSHPolicy) isEmpty() bool {
+	return p == nil || (len(p.AllowedUserPrincipals) == 0 && len(p.DeniedUserPrincipals) == 0 &&
+		len(p.AllowedHostDomains) == 0 && !p.RequireIdentityPrincipals && p.hostIPPolicy().isEmpty())
+}
+
+// hostIPPolicy returns the evaluator of the IP principals of the host
+// certificates.
+func (p *SSHPolicy) hostIPPolicy() ipPolicy {
+	return ipPolicy{
+		allowed:       p.AllowedHostIPRanges,
+		denied:        p.DeniedHostIPRanges,
+		defaultAction: p.DefaultHostIPAction,
+		layer:         p.layer,
+	}
+}
+
+// hasHostIPOptions returns true if the IP principals of the host certificates
+// are checked with the IP options instead of the domains.
+func (p *SSHPolicy) hasHostIPOptions() bool {
+	return len(p.AllowedHostIPRanges) > 0 || len(p.DeniedHostIPRanges) > 0 || p.DefaultHostIPAction != ""
+}
+
+// sshPolicySignOptions returns the validator of the SSH policy for a requester
+// with the given identity, or nil if the policy is empty.
+func sshPolicySignOptions(p *SSHPolicy, identity []string, admin bool) []SignOption {
+	if p.isEmpty() {
+		return nil
+	}
+	return []SignOption{&sshPolicyValidator{
+		policy:   p,
+		identity: identity,
+		admin:    admin,
+	}}
+}
+
+// sshPolicyValidator implements a validator that checks the principals of a
+// certificate with the SSH policy of the provisioner.
+type sshPolicyValidator struct {
+	policy   *SSHPolicy
+	identity []string
+	admin    bool
+}
+
+// Valid returns a forbidden error naming the first principal not allowed by
+// the policy.
+func (v *sshPolicyValidator) Valid(cert *ssh.Certificate, o SSHOptions) error {
+	for _, principal := range cert.ValidPrincipals {
+		if reason := v.deny(cert.CertType, principal); reason != "" {
+			return errs.Forbidden("ssh certificate principal %s %s",
+				principal, reason, errs.WithMessage("The ssh certificate principal %s %s.", principal, reason))
+		}
+	}
+	return nil
+}
+
+// deny returns the reason why the principal is not allowed, or an empty string
+// if it is allowed.
+func (v *sshPolicyValidator) deny(certType uint32, principal string) string {
+	p := v.policy
+	switch certType {
+	case ssh.UserCert:
+		if matchPrincipal(p.DeniedUserPrincipals, principal) {
+			return "is denied by " + policyOf(p.layer)
+		}
+		if len(p.AllowedUserPrincipals) > 0 && !matchPrincipal(p.AllowedUserPrincipals, principal) {
+			return "is not allowed by " + policyOf(p.layer)
+		}
+		if p.RequireIdentityPrincipals && !v.admin && !containsString(v.identity, principal) {
+			return "does not match the authenticated identity"
+		}
+	case ssh.HostCert:
+		if ip := net.ParseIP(principal); ip != nil && p.hasHostIPOptions() {
+			return p.hostIPPolicy().denyReason(ip)
+		}
+		if len(p.AllowedHostDomains) > 0 && !sshHostDomainsValidator(p.AllowedHostDomains).allowed(principal) {
+			return "is not in the domains allowed by " + policyOf(p.layer)
+		}
+	}
+	return ""
+}
+
+// matchPrincipal returns true if the principal is one of the names or matches
+// one of the glob patterns.
+func matchPrincipal(patterns []string, principal string) bool {
+	for _, s := range patterns {
+		if ok, _ := path.Match(s, principal); ok {
+			return true
+		}
+	}
+	return false
+}
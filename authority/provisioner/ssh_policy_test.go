@@ -0,0 +1,189 @@
+package provisioner
+
+import (
+	"context"
+	"crypto"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/jose"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHPolicy_init(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *SSHPolicy
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"empty", &SSHPolicy{}, false},
+		{"ok", &SSHPolicy{
+			AllowedUserPrincipals: []string{"deploy-*", "alice"},
+			DeniedUserPrincipals:  []string{"root"},
+			AllowedHostDomains:    []string{".internal.smallstep.com"},
+		}, false},
+		{"fail-empty-principal", &SSHPolicy{DeniedUserPrincipals: []string{""}}, true},
+		{"fail-pattern", &SSHPolicy{AllowedUserPrincipals: []string{"deploy-["}}, true},
+		{"fail-empty-domain", &SSHPolicy{AllowedHostDomains: []string{"."}}, true},
+		{"ok-host-ip-ranges", &SSHPolicy{
+			AllowedHostIPRanges: []string{"10.0.0.0/8", "fd00::/8"},
+			DeniedHostIPRanges:  []string{"10.0.0.1"},
+			DefaultHostIPAction: "deny",
+		}, false},
+		{"fail-host-ip-range", &SSHPolicy{DeniedHostIPRanges: []string{"10.0.0.0/33"}}, true},
+		{"fail-host-ip-action", &SSHPolicy{DefaultHostIPAction: "reject"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.init("test"); (err != nil) != tt.wantErr {
+				t.Errorf("SSHPolicy.init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sshPolicyValidator_Valid(t *testing.T) {
+	policy := &SSHPolicy{
+		AllowedUserPrincipals:     []string{"deploy-*", "alice", "root"},
+		DeniedUserPrincipals:      []string{"deploy-prod"},
+		AllowedHostDomains:        []string{"smallstep.com"},
+		RequireIdentityPrincipals: true,
+	}
+	ipPolicy := &SSHPolicy{
+		AllowedHostDomains:  []string{"smallstep.com"},
+		AllowedHostIPRanges: []string{"10.0.0.0/8", "fd00::/8"},
+		DeniedHostIPRanges:  []string{"10.0.0.1"},
+	}
+	user := func(principals ...string) *ssh.Certificate {
+		return &ssh.Certificate{CertType: ssh.UserCert, ValidPrincipals: principals}
+	}
+	host := func(principals ...string) *ssh.Certificate {
+		return &ssh.Certificate{CertType: ssh.HostCert, ValidPrincipals: principals}
+	}
+	tests := []struct {
+		name      string
+		validator *sshPolicyValidator
+		cert      *ssh.Certificate
+		err       string
+	}{
+		{"ok-identity", &sshPolicyValidator{policy, []string{"alice"}, false}, user("alice"), ""},
+		{"ok-admin", &sshPolicyValidator{policy, []string{"alice"}, true}, user("alice", "root", "deploy-dev"), ""},
+		{"ok-host", &sshPolicyValidator{policy, nil, false}, host("smallstep.com", "foo.smallstep.com"), ""},
+		{"fail-identity", &sshPolicyValidator{policy, []string{"alice"}, false}, user("alice", "root"),
+			"ssh certificate principal root does not match the authenticated identity"},
+		{"fail-denied", &sshPolicyValidator{policy, nil, true}, user("deploy-dev", "deploy-prod"),
+			"ssh certificate principal deploy-prod is denied by the provisioner policy"},
+		{"fail-not-allowed", &sshPolicyValidator{policy, nil, true}, user("bob"),
+			"ssh certificate principal bob is not allowed by the provisioner policy"},
+		{"fail-host", &sshPolicyValidator{policy, nil, true}, host("foo.smallstep.com", "foo.example.com"),
+			"ssh certificate principal foo.example.com is not in the domains allowed by the provisioner policy"},
+		{"fail-host-ip-domains", &sshPolicyValidator{policy, nil, false}, host("10.0.0.1"),
+			"ssh certificate principal 10.0.0.1 is not in the domains allowed by the provisioner policy"},
+		{"ok-host-ip", &sshPolicyValidator{ipPolicy, nil, false}, host("smallstep.com", "10.0.0.2", "fd00::2"), ""},
+		{"fail-host-ip-denied", &sshPolicyValidator{ipPolicy, nil, false}, host("smallstep.com", "10.0.0.1"),
+			"ssh certificate principal 10.0.0.1 is denied by the provisioner policy"},
+		{"fail-host-ip-not-allowed", &sshPolicyValidator{ipPolicy, nil, false}, host("192.168.0.1"),
+			"ssh certificate principal 192.168.0.1 is not allowed by the provisioner policy"},
+		{"fail-host-ip-domain", &sshPolicyValidator{ipPolicy, nil, false}, host("10.0.0.2", "foo.example.com"),
+			"ssh certificate principal foo.example.com is not in the domains allowed by the provisioner policy"},
+		{"ok-host-ip-default-allow", &sshPolicyValidator{&SSHPolicy{AllowedHostDomains: []string{"smallstep.com"}, DefaultHostIPAction: "allow"}, nil, false},
+			host("smallstep.com", "192.168.0.1"), ""},
+		{"fail-host-ip-default-deny", &sshPolicyValidator{&SSHPolicy{DefaultHostIPAction: "deny"}, nil, false}, host("foo.example.com", "2001:db8::1"),
+			"ssh certificate principal 2001:db8::1 is denied by default by the provisioner policy"},
+		{"ok-user-ip-default-deny", &sshPolicyValidator{&SSHPolicy{DefaultHostIPAction: "deny"}, nil, false}, user("10.0.0.1"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.validator.Valid(tt.cert, SSHOptions{})
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, http.StatusForbidden, sc.StatusCode())
+			}
+		})
+	}
+}
+
+func TestSSHPolicy_AuthorizeSSHSign(t *testing.T) {
+	srv := generateJWKServer(2)
+	defer srv.Close()
+	var keys jose.JSONWebKeySet
+	assert.FatalError(t, getAndDecode(srv.URL+"/private", &keys))
+
+	policy := &SSHPolicy{
+		RequireIdentityPrincipals: true,
+		AllowedHostDomains:        []string{"smallstep.com"},
+	}
+
+	// OIDC admins can request any principal.
+	o, err := generateOIDC()
+	assert.FatalError(t, err)
+	o.Admins = []string{"root@example.com"}
+	o.SSHPolicy = policy
+	o.ConfigurationEndpoint = srv.URL + "/.well-known/openid-configuration"
+	assert.FatalError(t, o.Init(Config{Claims: globalProvisionerClaims}))
+	o.getIdentityFunc = func(p Interface, email string) (*Identity, error) {
+		return &Identity{Usernames: []string{"name"}}, nil
+	}
+	okAdmin, err := generateToken("subject", "the-issuer", o.ClientID, "root@example.com", []string{}, time.Now(), &keys.Keys[0])
+	assert.FatalError(t, err)
+
+	// JWK tokens can only request the subject.
+	p, err := generateJWK()
+	assert.FatalError(t, err)
+	p.SSHPolicy = policy
+	jwk, err := decryptJSONWebKey(p.EncryptedKey)
+	assert.FatalError(t, err)
+	rootToken, err := generateSSHToken("name", p.Name, testAudiences.SSHSign[0], time.Now(), &SSHOptions{
+		CertType: "user", Principals: []string{"root"},
+	}, jwk)
+	assert.FatalError(t, err)
+	userToken, err := generateSSHToken("name", p.Name, testAudiences.SSHSign[0], time.Now(), &SSHOptions{
+		CertType: "user", Principals: []string{"name"},
+	}, jwk)
+	assert.FatalError(t, err)
+	hostToken, err := generateSSHToken("name", p.Name, testAudiences.SSHSign[0], time.Now(), &SSHOptions{
+		CertType: "host", Principals: []string{"foo.smallstep.com", "foo.example.com"},
+	}, jwk)
+	assert.FatalError(t, err)
+
+	key, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	signer, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name    string
+		prov    Interface
+		token   string
+		sshOpts SSHOptions
+		err     string
+	}{
+		{"ok-admin-root", o, okAdmin, SSHOptions{Principals: []string{"root"}}, ""},
+		{"ok-identity", p, userToken, SSHOptions{}, ""},
+		{"fail-root", p, rootToken, SSHOptions{}, "ssh certificate principal root does not match the authenticated identity"},
+		{"fail-host-domain", p, hostToken, SSHOptions{}, "ssh certificate principal foo.example.com is not in the domains allowed by the provisioner policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.prov.AuthorizeSSHSign(context.Background(), tt.token)
+			assert.FatalError(t, err)
+			cert, err := signSSHCertificate(key.Public().Key, tt.sshOpts, opts, signer.Key.(crypto.Signer))
+			if tt.err == "" {
+				assert.NoError(t, err)
+				assert.NotNil(t, cert)
+			} else if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+			}
+		})
+	}
+}
@@ -26,13 +26,22 @@ type sshPOPPayload struct {
 // signature requests.
 type SSHPOP struct {
 	*base
-	Type       string  `json:"type"`
-	Name       string  `json:"name"`
-	Claims     *Claims `json:"claims,omitempty"`
-	db         db.AuthDB
-	claimer    *Claimer
-	audiences  Audiences
-	sshPubKeys *SSHKeys
+	Type     string  `json:"type"`
+	Name     string  `json:"name"`
+	Disabled bool    `json:"disabled,omitempty"`
+	Claims   *Claims `json:"claims,omitempty"`
+	// RenewGracePeriod is the time after the expiration of a host certificate
+	// in which it can still be renewed. By default expired certificates
+	// cannot be renewed.
+	RenewGracePeriod *Duration `json:"renewGracePeriod,omitempty"`
+	// SSHPolicy restricts the principals of the renewed and rekeyed
+	// certificates.
+	SSHPolicy      *SSHPolicy `json:"sshPolicy,omitempty"`
+	db             db.AuthDB
+	claimer        *Claimer
+	audiences      Audiences
+	sshPubKeys     *SSHKeys
+	getSSHKeysFunc GetSSHKeysFunc
 }
 
 // GetID returns the provisioner unique identifier. The name and credential id
@@ -69,6 +78,11 @@ func (p *SSHPOP) GetType() Type {
 	return TypeSSHPOP
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *SSHPOP) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey returns the base provisioner encrypted key if it's defined.
 func (p *SSHPOP) GetEncryptedKey() (string, string, bool) {
 	return "", "", false
@@ -81,8 +95,10 @@ func (p *SSHPOP) Init(config Config) error {
 		return errors.New("provisioner type cannot be empty")
 	case p.Name == "":
 		return errors.New("provisioner name cannot be empty")
-	case config.SSHKeys == nil:
+	case config.SSHKeys == nil && config.GetSSHKeysFunc == nil:
 		return errors.New("provisioner public SSH validation keys cannot be empty")
+	case p.RenewGracePeriod != nil && p.RenewGracePeriod.Duration < 0:
+		return errors.New("provisioner renewGracePeriod cannot be less than 0")
 	}
 
 	// Update claims with global ones
@@ -94,13 +110,20 @@ func (p *SSHPOP) Init(config Config) error {
 	p.audiences = config.Audiences.WithFragment(p.GetID())
 	p.db = config.DB
 	p.sshPubKeys = config.SSHKeys
-	return nil
+	p.getSSHKeysFunc = config.GetSSHKeysFunc
+	return p.SSHPolicy.init(p.Name)
 }
 
 // authorizeToken performs common jwt authorization actions and returns the
 // claims for case specific downstream parsing.
 // e.g. a Sign request will auth/validate different fields than a Revoke request.
 func (p *SSHPOP) authorizeToken(token string, audiences []string) (*sshPOPPayload, error) {
+	return p.authorizeTokenWithGrace(token, audiences, 0)
+}
+
+// authorizeTokenWithGrace is like authorizeToken, but it accepts certificates
+// that expired less than the given grace period ago.
+func (p *SSHPOP) authorizeTokenWithGrace(token string, audiences []string, grace time.Duration) (*sshPOPPayload, error) {
 	sshCert, jwt, err := ExtractSSHPOPCert(token)
 	if err != nil {
 		return nil, errs.Wrap(http.StatusUnauthorized, err,
@@ -120,7 +143,7 @@ func (p *SSHPOP) authorizeToken(token string, audiences []string) (*sshPOPPayloa
 	if sshCert.ValidAfter != 0 && time.Unix(int64(sshCert.ValidAfter), 0).After(n) {
 		return nil, errs.Unauthorized("sshpop.authorizeToken; sshpop certificate validAfter is in the future")
 	}
-	if sshCert.ValidBefore != 0 && time.Unix(int64(sshCert.ValidBefore), 0).Before(n) {
+	if sshCert.ValidBefore != 0 && time.Unix(int64(sshCert.ValidBefore), 0).Add(grace).Before(n) {
 		return nil, errs.Unauthorized("sshpop.authorizeToken; sshpop certificate validBefore is in the past")
 	}
 	sshCryptoPubKey, ok := sshCert.Key.(ssh.CryptoPublicKey)
@@ -134,10 +157,15 @@ func (p *SSHPOP) authorizeToken(token string, audiences []string) (*sshPOPPayloa
 		data  = bytesForSigning(sshCert)
 		keys  []ssh.PublicKey
 	)
+	// The keys of the CA can be rotated.
+	sshKeys := p.sshPubKeys
+	if p.getSSHKeysFunc != nil {
+		sshKeys = p.getSSHKeysFunc()
+	}
 	if sshCert.CertType == ssh.UserCert {
-		keys = p.sshPubKeys.UserKeys
+		keys = sshKeys.UserKeys
 	} else {
-		keys = p.sshPubKeys.HostKeys
+		keys = sshKeys.HostKeys
 	}
 	for _, k := range keys {
 		if err = (&ssh.Certificate{Key: k}).Verify(data, sshCert.Signature); err == nil {
@@ -178,6 +206,11 @@ func (p *SSHPOP) authorizeToken(token string, audiences []string) (*sshPOPPayloa
 		return nil, errs.Unauthorized("sshpop.authorizeToken; sshpop token subject cannot be empty")
 	}
 
+	// The token id is used by the authority to prevent the reuse of a token.
+	if claims.ID == "" {
+		return nil, errs.Unauthorized("sshpop.authorizeToken; sshpop token id (jti) cannot be empty")
+	}
+
 	claims.sshCert = sshCert
 	return &claims, nil
 }
@@ -199,16 +232,30 @@ func (p *SSHPOP) AuthorizeSSHRevoke(ctx context.Context, token string) error {
 // AuthorizeSSHRenew validates the authorization token and extracts/validates
 // the SSH certificate from the ssh-pop header.
 func (p *SSHPOP) AuthorizeSSHRenew(ctx context.Context, token string) (*ssh.Certificate, error) {
-	claims, err := p.authorizeToken(token, p.audiences.SSHRenew)
+	var grace time.Duration
+	if p.RenewGracePeriod != nil {
+		grace = p.RenewGracePeriod.Duration
+	}
+	claims, err := p.authorizeTokenWithGrace(token, p.audiences.SSHRenew, grace)
 	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "sshpop.AuthorizeSSHRenew")
 	}
 	if claims.sshCert.CertType != ssh.HostCert {
 		return nil, errs.BadRequest("sshpop.AuthorizeSSHRenew; sshpop certificate must be a host ssh certificate")
 	}
+	if len(claims.sshCert.ValidPrincipals) == 0 {
+		return nil, errs.BadRequest("sshpop.AuthorizeSSHRenew; sshpop certificate must have at least one principal")
+	}
+	// The renewed certificate has the same principals.
+	if !p.SSHPolicy.isEmpty() {
+		v := &sshPolicyValidator{policy: p.SSHPolicy}
+		if err := v.Valid(claims.sshCert, SSHOptions{}); err != nil {
+			return nil, errs.Wrap(http.StatusForbidden, err, "sshpop.AuthorizeSSHRenew",
+				errs.WithType(errs.TypePolicyViolation))
+		}
+	}
 
 	return claims.sshCert, nil
-
 }
 
 // AuthorizeSSHRekey validates the authorization token and extracts/validates
@@ -221,14 +268,18 @@ func (p *SSHPOP) AuthorizeSSHRekey(ctx context.Context, token string) (*ssh.Cert
 	if claims.sshCert.CertType != ssh.HostCert {
 		return nil, nil, errs.BadRequest("sshpop.AuthorizeSSHRekey; sshpop certificate must be a host ssh certificate")
 	}
-	return claims.sshCert, []SignOption{
+	if len(claims.sshCert.ValidPrincipals) == 0 {
+		return nil, nil, errs.BadRequest("sshpop.AuthorizeSSHRekey; sshpop certificate must have at least one principal")
+	}
+	signOptions := []SignOption{
 		// Validate public key
 		&sshDefaultPublicKeyValidator{},
 		// Validate the validity period.
 		&sshCertValidityValidator{p.claimer},
 		// Require and validate all the default fields in the SSH certificate.
 		&sshCertDefaultValidator{},
-	}, nil
+	}
+	return claims.sshCert, append(signOptions, sshPolicySignOptions(p.SSHPolicy, nil, false)...), nil
 
 }
 
@@ -265,6 +265,37 @@ func TestSSHPOP_authorizeToken(t *testing.T) {
 				err:   errors.New("sshpop.authorizeToken; sshpop token subject cannot be empty"),
 			}
 		},
+		"fail/no-token-id": func(t *testing.T) test {
+			p, err := generateSSHPOP()
+			assert.FatalError(t, err)
+			p.db = &db.MockAuthDB{
+				MIsSSHRevoked: func(sn string) (bool, error) {
+					return false, nil
+				},
+			}
+			cert, jwk, err := createSSHCert(&ssh.Certificate{CertType: ssh.UserCert}, sshSigner)
+			assert.FatalError(t, err)
+			so := new(jose.SignerOptions)
+			so.WithType("JWT")
+			so.WithHeader("sshpop", base64.StdEncoding.EncodeToString(cert.Marshal()))
+			sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key}, so)
+			assert.FatalError(t, err)
+			now := time.Now()
+			tok, err := jose.Signed(sig).Claims(jose.Claims{
+				Subject:   "foo",
+				Issuer:    p.GetName(),
+				NotBefore: jose.NewNumericDate(now),
+				Expiry:    jose.NewNumericDate(now.Add(5 * time.Minute)),
+				Audience:  []string{testAudiences.Sign[0]},
+			}).CompactSerialize()
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("sshpop.authorizeToken; sshpop token id (jti) cannot be empty"),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			p, err := generateSSHPOP()
 			assert.FatalError(t, err)
@@ -436,7 +467,7 @@ func TestSSHPOP_AuthorizeSSHRenew(t *testing.T) {
 				err:   errors.New("sshpop.AuthorizeSSHRenew; sshpop certificate must be a host ssh certificate"),
 			}
 		},
-		"ok": func(t *testing.T) test {
+		"fail/no-principals": func(t *testing.T) test {
 			p, err := generateSSHPOP()
 			assert.FatalError(t, err)
 			p.db = &db.MockAuthDB{
@@ -449,6 +480,90 @@ func TestSSHPOP_AuthorizeSSHRenew(t *testing.T) {
 			tok, err := generateToken("123455", p.GetName(), testAudiences.SSHRenew[0], "",
 				[]string{"test.smallstep.com"}, time.Now(), jwk, withSSHPOPFile(cert))
 			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusBadRequest,
+				err:   errors.New("sshpop.AuthorizeSSHRenew; sshpop certificate must have at least one principal"),
+			}
+		},
+		"fail/expired": func(t *testing.T) test {
+			p, err := generateSSHPOP()
+			assert.FatalError(t, err)
+			p.RenewGracePeriod = &Duration{Duration: time.Hour}
+			p.db = &db.MockAuthDB{
+				MIsSSHRevoked: func(sn string) (bool, error) {
+					return false, nil
+				},
+			}
+			cert, jwk, err := createSSHCert(&ssh.Certificate{Serial: 123455, CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"},
+				ValidAfter: uint64(time.Now().Add(-3 * time.Hour).Unix()), ValidBefore: uint64(time.Now().Add(-2 * time.Hour).Unix())}, sshHostSigner)
+			assert.FatalError(t, err)
+			tok, err := generateToken("123455", p.GetName(), testAudiences.SSHRenew[0], "",
+				[]string{"test.smallstep.com"}, time.Now(), jwk, withSSHPOPFile(cert))
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusUnauthorized,
+				err:   errors.New("sshpop.AuthorizeSSHRenew: sshpop.authorizeToken; sshpop certificate validBefore is in the past"),
+			}
+		},
+		"fail/ssh-policy": func(t *testing.T) test {
+			p, err := generateSSHPOP()
+			assert.FatalError(t, err)
+			p.SSHPolicy = &SSHPolicy{AllowedHostDomains: []string{"internal.smallstep.com"}}
+			p.db = &db.MockAuthDB{
+				MIsSSHRevoked: func(sn string) (bool, error) {
+					return false, nil
+				},
+			}
+			cert, jwk, err := createSSHCert(&ssh.Certificate{Serial: 123455, CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"}}, sshHostSigner)
+			assert.FatalError(t, err)
+			tok, err := generateToken("123455", p.GetName(), testAudiences.SSHRenew[0], "",
+				[]string{"test.smallstep.com"}, time.Now(), jwk, withSSHPOPFile(cert))
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				code:  http.StatusForbidden,
+				err:   errors.New("sshpop.AuthorizeSSHRenew: ssh certificate principal foo.smallstep.com is not in the domains allowed by the provisioner policy"),
+			}
+		},
+		"ok/grace-period": func(t *testing.T) test {
+			p, err := generateSSHPOP()
+			assert.FatalError(t, err)
+			p.RenewGracePeriod = &Duration{Duration: time.Hour}
+			p.db = &db.MockAuthDB{
+				MIsSSHRevoked: func(sn string) (bool, error) {
+					return false, nil
+				},
+			}
+			cert, jwk, err := createSSHCert(&ssh.Certificate{Serial: 123455, CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"},
+				ValidAfter: uint64(time.Now().Add(-time.Hour).Unix()), ValidBefore: uint64(time.Now().Add(-time.Minute).Unix())}, sshHostSigner)
+			assert.FatalError(t, err)
+			tok, err := generateToken("123455", p.GetName(), testAudiences.SSHRenew[0], "",
+				[]string{"test.smallstep.com"}, time.Now(), jwk, withSSHPOPFile(cert))
+			assert.FatalError(t, err)
+			return test{
+				p:     p,
+				token: tok,
+				cert:  cert,
+			}
+		},
+		"ok": func(t *testing.T) test {
+			p, err := generateSSHPOP()
+			assert.FatalError(t, err)
+			p.db = &db.MockAuthDB{
+				MIsSSHRevoked: func(sn string) (bool, error) {
+					return false, nil
+				},
+			}
+			cert, jwk, err := createSSHCert(&ssh.Certificate{Serial: 123455, CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"}}, sshHostSigner)
+			assert.FatalError(t, err)
+			tok, err := generateToken("123455", p.GetName(), testAudiences.SSHRenew[0], "",
+				[]string{"test.smallstep.com"}, time.Now(), jwk, withSSHPOPFile(cert))
+			assert.FatalError(t, err)
 			return test{
 				p:     p,
 				token: tok,
@@ -536,7 +651,7 @@ func TestSSHPOP_AuthorizeSSHRekey(t *testing.T) {
 					return false, nil
 				},
 			}
-			cert, jwk, err := createSSHCert(&ssh.Certificate{Serial: 123455, CertType: ssh.HostCert}, sshHostSigner)
+			cert, jwk, err := createSSHCert(&ssh.Certificate{Serial: 123455, CertType: ssh.HostCert, ValidPrincipals: []string{"foo.smallstep.com"}}, sshHostSigner)
 			assert.FatalError(t, err)
 			tok, err := generateToken("123455", p.GetName(), testAudiences.SSHRekey[0], "",
 				[]string{"test.smallstep.com"}, time.Now(), jwk, withSSHPOPFile(cert))
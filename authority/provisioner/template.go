@@ -0,0 +1,789 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/tracing"
+	"github.com/smallstep/cli/crypto/x509util"
+	"github.com/smallstep/cli/jose"
+	"golang.org/x/crypto/ssh"
+)
+
+// TemplateData is the data available in the certificate templates. The
+// templates are checked against this struct when they are parsed, and a
+// template that uses a field that does not exist is not valid. The fields of
+// the maps and of the custom template data are only known when the template
+// is executed.
+type TemplateData struct {
+	// Subject is the subject in the token.
+	Subject string
+	// SANs are the subject alternative names in the token.
+	SANs []string
+	// Token are the claims of the token.
+	Token map[string]interface{}
+	// Insecure are the values controlled by the requester.
+	Insecure TemplateInsecureData
+	// Webhooks are the responses of the enriching webhooks by name.
+	Webhooks map[string]interface{}
+	// AuthorizationCrt is the certificate that authorized the request, in the
+	// X5C provisioners.
+	AuthorizationCrt *x509.Certificate
+	// Provisioner is the provisioner that signs the certificate.
+	Provisioner TemplateProvisionerData
+	// TemplateData is the custom data configured in the provisioner.
+	TemplateData interface{}
+}
+
+// TemplateInsecureData is the insecure section of the template data. The
+// values in this section are controlled by the requester and should not be
+// trusted.
+type TemplateInsecureData struct {
+	// CR is the certificate request, in the X.509 templates.
+	CR *x509.CertificateRequest
+	// Cert is the certificate after applying the default options, in the SSH
+	// templates.
+	Cert *ssh.Certificate
+	// User is the template data in the sign request, in the X.509 templates.
+	User map[string]interface{}
+}
+
+// TemplateProvisionerData is the provisioner section of the template data.
+type TemplateProvisionerData struct {
+	Name string
+}
+
+// newTemplateData returns the template data for the given subject, SANs and
+// the claims of an already validated token.
+func newTemplateData(subject string, sans []string, token string) *TemplateData {
+	data := &TemplateData{
+		Subject: subject,
+		SANs:    sans,
+	}
+	data.setToken(token)
+	return data
+}
+
+// setToken sets the claims of an already validated token in the template
+// data.
+func (t *TemplateData) setToken(token string) {
+	if tok, err := jose.ParseSigned(token); err == nil {
+		var claims map[string]interface{}
+		if err := tok.UnsafeClaimsWithoutVerification(&claims); err == nil {
+			t.Token = claims
+		}
+	}
+}
+
+// setProvisioner sets the provisioner name and the custom template data
+// configured in the provisioner.
+func (t *TemplateData) setProvisioner(name string, v interface{}) {
+	t.Provisioner = TemplateProvisionerData{Name: name}
+	t.TemplateData = v
+}
+
+// SetWebhook sets the data returned by the webhook with the given name.
+func (t *TemplateData) SetWebhook(name string, v interface{}) {
+	if t.Webhooks == nil {
+		t.Webhooks = make(map[string]interface{})
+	}
+	t.Webhooks[name] = v
+}
+
+// X509Options are the options used to customize the X.509 certificates
+// signed by a provisioner.
+type X509Options struct {
+	// Template is an inline text/template that renders a JSON representation
+	// of the certificate.
+	Template string `json:"template,omitempty"`
+	// TemplateFile is the path to a file with the template, it cannot be used
+	// with an inline template.
+	TemplateFile string `json:"templateFile,omitempty"`
+	// TemplateData is a custom block of data available in the template as
+	// .TemplateData.
+	TemplateData json.RawMessage `json:"templateData,omitempty"`
+	// DisableUserData rejects the sign requests with template data, by
+	// default it is available in the template as .Insecure.User.
+	DisableUserData bool `json:"disableUserData,omitempty"`
+	// Limits are the limits of the execution of the template.
+	Limits   *TemplateLimits `json:"limits,omitempty"`
+	template *template.Template
+	data     interface{}
+	source   string
+}
+
+// The sources of the x509 template used to sign a certificate, in order of
+// precedence. The sign requests cannot reference a template, they can only
+// add template data.
+const (
+	// TemplateSourceProvisioner is the template of the provisioner.
+	TemplateSourceProvisioner = "provisioner"
+	// TemplateSourceAuthority is the default template of the authority, used
+	// by the provisioners without a template.
+	TemplateSourceAuthority = "authority"
+	// TemplateSourceDefault is the built-in default, the certificates get the
+	// subject and the SANs of the certificate request.
+	TemplateSourceDefault = "default"
+)
+
+// init parses the configured template.
+func (o *X509Options) init(name string) (err error) {
+	if o == nil {
+		return nil
+	}
+	if err := o.Limits.validate("x509", name); err != nil {
+		return err
+	}
+	o.template, o.data, err = parseTemplate("x509", name, o.Template, o.TemplateFile, o.TemplateData)
+	o.source = TemplateSourceProvisioner
+	return err
+}
+
+// InitDefault parses the default template of an authority, the x509 options
+// used by the provisioners without a template. The template is required.
+func (o *X509Options) InitDefault() (err error) {
+	if o == nil {
+		return nil
+	}
+	if o.Template == "" && o.TemplateFile == "" {
+		return errors.New("authority x509 must define a template or a templateFile")
+	}
+	if err := o.Limits.validate("x509", TemplateSourceAuthority); err != nil {
+		return err
+	}
+	o.template, o.data, err = parseTemplate("x509", TemplateSourceAuthority, o.Template, o.TemplateFile, o.TemplateData)
+	o.source = TemplateSourceAuthority
+	return err
+}
+
+// withDefault returns the x509 options used by a provisioner with the default
+// options of the authority, def. The template of the provisioner takes
+// precedence, and without it the provisioner uses the default template with
+// its own template data and limits, if it has them. It is an error if both
+// define the template data or the limits, as it is not clear which ones the
+// default template expects.
+func (o *X509Options) withDefault(def *X509Options, name string) (*X509Options, error) {
+	if o.hasTemplate() || !def.hasTemplate() {
+		return o, nil
+	}
+	opts := *def
+	if o == nil {
+		return &opts, nil
+	}
+	if len(o.TemplateData) > 0 {
+		if len(def.TemplateData) > 0 {
+			return nil, errors.Errorf("provisioner %s: x509 templateData requires a template, the authority default template defines its own templateData", name)
+		}
+		opts.TemplateData, opts.data = o.TemplateData, o.data
+	}
+	if o.Limits != nil {
+		if def.Limits != nil {
+			return nil, errors.Errorf("provisioner %s: x509 limits require a template, the authority default template defines its own limits", name)
+		}
+		opts.Limits = o.Limits
+	}
+	opts.DisableUserData = o.DisableUserData || def.DisableUserData
+	return &opts, nil
+}
+
+// hasTemplate returns true if the options define a template.
+func (o *X509Options) hasTemplate() bool {
+	return o != nil && o.template != nil
+}
+
+// AllowsUserData returns false if the sign requests cannot have template
+// data.
+func (o *X509Options) AllowsUserData() bool {
+	return o == nil || !o.DisableUserData
+}
+
+// templateSignOptions returns the sign options used to render the configured
+// template and to call the enriching webhooks. It returns nil if neither of
+// them are configured. The context is the one of the request, it is used to
+// trace the rendering and the webhook calls.
+func templateSignOptions(ctx context.Context, o *X509Options, webhooks []*Webhook, provisionerName string, data *TemplateData) []SignOption {
+	var so []SignOption
+	if o.hasTemplate() {
+		data.setProvisioner(provisionerName, o.data)
+		so = append(so, &x509TemplateOption{
+			ctx:             ctx,
+			template:        o.template,
+			source:          o.source,
+			limits:          o.Limits,
+			data:            data,
+			disableUserData: o.DisableUserData,
+		})
+	}
+	if len(webhooks) > 0 {
+		so = append(so, &webhookController{
+			ctx:             ctx,
+			provisionerName: provisionerName,
+			webhooks:        webhooks,
+			data:            data,
+		})
+	}
+	return so
+}
+
+// x509TemplateOption is a SignOption that renders the provisioner template
+// and applies the result to the certificate.
+type x509TemplateOption struct {
+	ctx             context.Context
+	template        *template.Template
+	source          string
+	limits          *TemplateLimits
+	data            *TemplateData
+	disableUserData bool
+}
+
+// X509TemplateSource returns the source of the x509 template rendered by the
+// given sign options, TemplateSourceProvisioner, TemplateSourceAuthority or,
+// if they do not render a template, TemplateSourceDefault.
+func X509TemplateSource(so []SignOption) string {
+	for _, o := range so {
+		if t, ok := o.(*x509TemplateOption); ok {
+			return t.source
+		}
+	}
+	return TemplateSourceDefault
+}
+
+// Enrich adds the certificate request to the insecure section of the template
+// data.
+func (o *x509TemplateOption) Enrich(cr *x509.CertificateRequest) error {
+	o.data.Insecure.CR = cr
+	return nil
+}
+
+// Option implements the ProfileModifier interface. The template data of the
+// sign request is available in the insecure section of the template data.
+func (o *x509TemplateOption) Option(so Options) x509util.WithOption {
+	return func(p x509util.Profile) error {
+		if so.UserData != nil {
+			if o.disableUserData {
+				return errors.New("error executing x509 template: the provisioner does not allow template data in the request")
+			}
+			o.data.Insecure.User = so.UserData
+		}
+		_, span := tracing.Start(o.ctx, "provisioner.renderTemplate")
+		defer span.End()
+		var tmpl x509Template
+		if err := renderTemplate("x509", o.template, o.limits, o.data, &tmpl); err != nil {
+			span.RecordError(err)
+			return err
+		}
+		return tmpl.apply(p.Subject())
+	}
+}
+
+// x509Template is the JSON representation of the certificate fields that can
+// be set by a template.
+type x509Template struct {
+	Subject        *x509Subject    `json:"subject,omitempty"`
+	DNSNames       []string        `json:"dnsNames,omitempty"`
+	EmailAddresses []string        `json:"emailAddresses,omitempty"`
+	IPAddresses    []string        `json:"ipAddresses,omitempty"`
+	URIs           []string        `json:"uris,omitempty"`
+	KeyUsage       []string        `json:"keyUsage,omitempty"`
+	ExtKeyUsage    []string        `json:"extKeyUsage,omitempty"`
+	Extensions     []x509Extension `json:"extensions,omitempty"`
+}
+
+// x509Subject is the JSON representation of a certificate subject.
+type x509Subject struct {
+	CommonName         string   `json:"commonName,omitempty"`
+	Country            []string `json:"country,omitempty"`
+	Organization       []string `json:"organization,omitempty"`
+	OrganizationalUnit []string `json:"organizationalUnit,omitempty"`
+	Locality           []string `json:"locality,omitempty"`
+	Province           []string `json:"province,omitempty"`
+	StreetAddress      []string `json:"streetAddress,omitempty"`
+	SerialNumber       string   `json:"serialNumber,omitempty"`
+}
+
+// x509Extension is the JSON representation of a certificate extension. The
+// value is the base64 encoding of the DER extension value.
+type x509Extension struct {
+	ID       string `json:"id"`
+	Critical bool   `json:"critical"`
+	Value    []byte `json:"value"`
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalsignature":  x509.KeyUsageDigitalSignature,
+	"contentcommitment": x509.KeyUsageContentCommitment,
+	"keyencipherment":   x509.KeyUsageKeyEncipherment,
+	"dataencipherment":  x509.KeyUsageDataEncipherment,
+	"keyagreement":      x509.KeyUsageKeyAgreement,
+	"certsign":          x509.KeyUsageCertSign,
+	"crlsign":           x509.KeyUsageCRLSign,
+	"encipheronly":      x509.KeyUsageEncipherOnly,
+	"decipheronly":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverauth":      x509.ExtKeyUsageServerAuth,
+	"clientauth":      x509.ExtKeyUsageClientAuth,
+	"codesigning":     x509.ExtKeyUsageCodeSigning,
+	"emailprotection": x509.ExtKeyUsageEmailProtection,
+	"timestamping":    x509.ExtKeyUsageTimeStamping,
+	"ocspsigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// apply sets in the given certificate the values defined in the template.
+func (t *x509Template) apply(crt *x509.Certificate) error {
+	if s := t.Subject; s != nil {
+		crt.Subject = pkix.Name{
+			CommonName:         s.CommonName,
+			Country:            s.Country,
+			Organization:       s.Organization,
+			OrganizationalUnit: s.OrganizationalUnit,
+			Locality:           s.Locality,
+			Province:           s.Province,
+			StreetAddress:      s.StreetAddress,
+			SerialNumber:       s.SerialNumber,
+		}
+	}
+	if t.DNSNames != nil {
+		crt.DNSNames = t.DNSNames
+	}
+	if t.EmailAddresses != nil {
+		crt.EmailAddresses = t.EmailAddresses
+	}
+	if t.IPAddresses != nil {
+		crt.IPAddresses = make([]net.IP, len(t.IPAddresses))
+		for i, s := range t.IPAddresses {
+			if crt.IPAddresses[i] = net.ParseIP(s); crt.IPAddresses[i] == nil {
+				return errors.Errorf("error parsing x509 template: invalid ip address %s", s)
+			}
+		}
+	}
+	if t.URIs != nil {
+		crt.URIs = make([]*url.URL, len(t.URIs))
+		for i, s := range t.URIs {
+			u, err := url.Parse(s)
+			if err != nil {
+				return errors.Wrapf(err, "error parsing x509 template: invalid uri %s", s)
+			}
+			crt.URIs[i] = u
+		}
+	}
+	if t.KeyUsage != nil {
+		var ku x509.KeyUsage
+		for _, s := range t.KeyUsage {
+			v, ok := keyUsages[strings.ToLower(s)]
+			if !ok {
+				return errors.Errorf("error parsing x509 template: unsupported keyUsage %s", s)
+			}
+			ku |= v
+		}
+		crt.KeyUsage = ku
+	}
+	if t.ExtKeyUsage != nil {
+		crt.ExtKeyUsage = make([]x509.ExtKeyUsage, len(t.ExtKeyUsage))
+		for i, s := range t.ExtKeyUsage {
+			v, ok := extKeyUsages[strings.ToLower(s)]
+			if !ok {
+				return errors.Errorf("error parsing x509 template: unsupported extKeyUsage %s", s)
+			}
+			crt.ExtKeyUsage[i] = v
+		}
+	}
+	for _, e := range t.Extensions {
+		oid, err := parseObjectIdentifier(e.ID)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing x509 template")
+		}
+		crt.ExtraExtensions = append(crt.ExtraExtensions, pkix.Extension{
+			Id:       oid,
+			Critical: e.Critical,
+			Value:    e.Value,
+		})
+	}
+	return nil
+}
+
+// parseObjectIdentifier parses an object identifier in the dot notation.
+func parseObjectIdentifier(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid object identifier %s", s)
+		}
+		oid[i] = n
+	}
+	if len(oid) < 2 {
+		return nil, errors.Errorf("invalid object identifier %s", s)
+	}
+	return oid, nil
+}
+
+// parseTemplate parses the inline template or the template in the given file,
+// and decodes the custom template data. It returns a nil template if none is
+// configured.
+func parseTemplate(kind, name, text, filename string, data json.RawMessage) (*template.Template, interface{}, error) {
+	if text != "" && filename != "" {
+		return nil, nil, errors.Errorf("error parsing %s template of provisioner %s: template and templateFile cannot be used together", kind, name)
+	}
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error reading %s template of provisioner %s", kind, name)
+		}
+		text = string(b)
+	}
+	var v interface{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, nil, errors.Wrapf(err, "error parsing %s template data of provisioner %s", kind, name)
+		}
+	}
+	if text == "" {
+		return nil, v, nil
+	}
+	tmpl, err := template.New(name).Funcs(TemplateFuncMap()).Parse(text)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error parsing %s template of provisioner %s", kind, name)
+	}
+	if err := checkTemplateFields(tmpl, reflect.TypeOf(TemplateData{})); err != nil {
+		return nil, nil, errors.Wrapf(err, "error parsing %s template of provisioner %s", kind, name)
+	}
+	instrumentTemplate(tmpl)
+	return tmpl, v, nil
+}
+
+// MaxUserDataSize is the maximum size, in bytes, of the template data in a
+// sign request.
+const MaxUserDataSize = 4096
+
+// MaxUserDataDepth is the maximum depth of the objects and arrays nested in the
+// template data of a sign request, the data itself is at depth 1.
+const MaxUserDataDepth = 5
+
+// ParseUserData parses the template data of a sign request, a JSON object
+// that is available in the X.509 templates as .Insecure.User. The data is
+// controlled by the requester, it must not be trusted.
+func ParseUserData(b json.RawMessage) (map[string]interface{}, error) {
+	if len(b) > MaxUserDataSize {
+		return nil, errors.Errorf("templateData cannot be larger than %d bytes", MaxUserDataSize)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, errors.Wrap(err, "error parsing templateData: it must be a JSON object")
+	}
+	if jsonDepth(v) > MaxUserDataDepth {
+		return nil, errors.Errorf("templateData cannot be nested more than %d levels", MaxUserDataDepth)
+	}
+	return v, nil
+}
+
+// jsonDepth returns the depth of the objects and arrays in a decoded JSON
+// value.
+func jsonDepth(v interface{}) int {
+	var max int
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, vv := range v {
+			if d := jsonDepth(vv); d > max {
+				max = d
+			}
+		}
+	case []interface{}:
+		for _, vv := range v {
+			if d := jsonDepth(vv); d > max {
+				max = d
+			}
+		}
+	default:
+		return 0
+	}
+	return max + 1
+}
+
+// renderTemplate executes a template of the given kind within its limits and
+// decodes the certificate fields it renders in v.
+func renderTemplate(kind string, tmpl *template.Template, limits *TemplateLimits, data *TemplateData, v interface{}) error {
+	b, err := executeTemplate(kind, tmpl, limits, data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrapf(err, "error unmarshaling %s template", kind)
+	}
+	return nil
+}
+
+// checkTemplateFields returns an error if the template uses a field of the
+// data that does not exist in the given type. Only the fields of the data
+// itself are checked, as the dot inside range and with blocks, and the values
+// of maps and interfaces, are only known when the template is executed.
+func checkTemplateFields(tmpl *template.Template, typ reflect.Type) error {
+	if tmpl.Tree == nil {
+		return nil
+	}
+	c := &templateFieldsChecker{tree: tmpl.Tree, typ: typ}
+	return c.node(tmpl.Tree.Root, true)
+}
+
+type templateFieldsChecker struct {
+	tree *parse.Tree
+	typ  reflect.Type
+}
+
+// node checks the fields used in a node, dotIsData is true if the dot is the
+// data of the template.
+func (c *templateFieldsChecker) node(n parse.Node, dotIsData bool) error {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, nn := range n.Nodes {
+			if err := c.node(nn, dotIsData); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return c.pipe(n.Pipe, dotIsData)
+	case *parse.TemplateNode:
+		return c.pipe(n.Pipe, dotIsData)
+	case *parse.IfNode:
+		return c.branch(&n.BranchNode, dotIsData, dotIsData)
+	case *parse.RangeNode:
+		return c.branch(&n.BranchNode, dotIsData, false)
+	case *parse.WithNode:
+		return c.branch(&n.BranchNode, dotIsData, false)
+	case *parse.PipeNode:
+		return c.pipe(n, dotIsData)
+	case *parse.ChainNode:
+		return c.node(n.Node, dotIsData)
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if err := c.node(arg, dotIsData); err != nil {
+				return err
+			}
+		}
+	case *parse.FieldNode:
+		if dotIsData {
+			return c.fields(n, "", n.Ident)
+		}
+	case *parse.VariableNode:
+		// $ is the data of the template.
+		if n.Ident[0] == "$" {
+			return c.fields(n, "$", n.Ident[1:])
+		}
+	}
+	return nil
+}
+
+func (c *templateFieldsChecker) pipe(p *parse.PipeNode, dotIsData bool) error {
+	if p == nil {
+		return nil
+	}
+	for _, cmd := range p.Cmds {
+		if err := c.node(cmd, dotIsData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// branch checks an if, range or with block, dotInList is true if the dot of
+// the block is the data of the template.
+func (c *templateFieldsChecker) branch(b *parse.BranchNode, dotIsData, dotInList bool) error {
+	if err := c.pipe(b.Pipe, dotIsData); err != nil {
+		return err
+	}
+	if err := c.node(b.List, dotInList && dotIsData); err != nil {
+		return err
+	}
+	return c.node(b.ElseList, dotIsData)
+}
+
+// fields checks a chain of fields of the data, the prefix is the variable
+// used to access the data, if any.
+func (c *templateFieldsChecker) fields(n parse.Node, prefix string, idents []string) error {
+	typ := c.typ
+	for i, ident := range idents {
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if _, ok := reflect.PtrTo(typ).MethodByName(ident); ok {
+			return nil
+		}
+		switch typ.Kind() {
+		case reflect.Map, reflect.Interface:
+			return nil
+		case reflect.Struct:
+			if f, ok := typ.FieldByName(ident); ok && f.PkgPath == "" {
+				typ = f.Type
+				continue
+			}
+		}
+		location, _ := c.tree.ErrorContext(n)
+		return errors.Errorf("%s: %s.%s is not a field of the template data", location, prefix, strings.Join(idents[:i+1], "."))
+	}
+	return nil
+}
+
+// SSHTemplateOptions are the options used to customize the SSH certificates
+// signed by a provisioner.
+type SSHTemplateOptions struct {
+	// Template is an inline text/template that renders a JSON representation
+	// of the certificate type, key id, principals, extensions and critical
+	// options, see DefaultSSHTemplate.
+	Template string `json:"template,omitempty"`
+	// TemplateFile is the path to a file with the template, it cannot be used
+	// with an inline template.
+	TemplateFile string `json:"templateFile,omitempty"`
+	// TemplateData is a custom block of data available in the template as
+	// .TemplateData.
+	TemplateData json.RawMessage `json:"templateData,omitempty"`
+	// HostDomains are the domains allowed in the principals of the host
+	// certificates, a principal must be one of the domains or a subdomain, or
+	// only a subdomain if the domain starts with a dot. All the principals are
+	// allowed by default.
+	HostDomains []string `json:"hostDomains,omitempty"`
+	// Limits are the limits of the execution of the template.
+	Limits   *TemplateLimits `json:"limits,omitempty"`
+	template *template.Template
+	data     interface{}
+}
+
+// init parses the configured template and validates the host domains.
+func (o *SSHTemplateOptions) init(name string) (err error) {
+	if o == nil {
+		return nil
+	}
+	for _, d := range o.HostDomains {
+		if strings.Trim(d, ".") == "" {
+			return errors.Errorf("provisioner %s: ssh hostDomains cannot contain empty domains", name)
+		}
+	}
+	if err := o.Limits.validate("ssh", name); err != nil {
+		return err
+	}
+	o.template, o.data, err = parseTemplate("ssh", name, o.Template, o.TemplateFile, o.TemplateData)
+	return err
+}
+
+// hasTemplate returns true if the options define a template.
+func (o *SSHTemplateOptions) hasTemplate() bool {
+	return o != nil && o.template != nil
+}
+
+// sshTemplateSignOptions returns the sign options used to render the
+// configured SSH template and to validate the principals of the host
+// certificates. It returns nil if none of them is configured.
+func sshTemplateSignOptions(o *SSHTemplateOptions, provisionerName, token string) []SignOption {
+	var opts []SignOption
+	if o.hasTemplate() {
+		data := &TemplateData{}
+		data.setToken(token)
+		data.setProvisioner(provisionerName, o.data)
+		opts = append(opts, &sshTemplateModifier{
+			template: o.template,
+			limits:   o.Limits,
+			data:     data,
+		})
+	}
+	if o != nil && len(o.HostDomains) > 0 {
+		opts = append(opts, sshHostDomainsValidator(o.HostDomains))
+	}
+	return opts
+}
+
+// sshTemplateModifier is an SSHCertModifier that renders the provisioner
+// template and applies the result to the certificate.
+type sshTemplateModifier struct {
+	template *template.Template
+	limits   *TemplateLimits
+	data     *TemplateData
+}
+
+// Modify implements the SSHCertModifier interface. The certificate is
+// available in the insecure section of the template data.
+func (m *sshTemplateModifier) Modify(cert *ssh.Certificate) error {
+	m.data.Insecure.Cert = cert
+	var tmpl sshTemplate
+	if err := renderTemplate("ssh", m.template, m.limits, m.data, &tmpl); err != nil {
+		return err
+	}
+	return tmpl.apply(cert)
+}
+
+// DefaultSSHTemplate is the SSH template that keeps the values of the
+// certificate, the certificates signed with it are the same as the ones signed
+// without a template. It can be used as the base of custom templates.
+const DefaultSSHTemplate = `{
+	"certType": {{ if eq .Insecure.Cert.CertType 2 }}"host"{{ else }}"user"{{ end }},
+	"keyID": {{ toJson .Insecure.Cert.KeyId }},
+	"principals": {{ toJson .Insecure.Cert.ValidPrincipals }},
+	"extensions": {{ toJson .Insecure.Cert.Extensions }},
+	"criticalOptions": {{ toJson .Insecure.Cert.CriticalOptions }}
+}`
+
+// sshTemplate is the JSON representation of the SSH certificate fields that
+// can be set by a template. The extensions and critical options are copied
+// as they are, including the unknown names and the empty values.
+type sshTemplate struct {
+	CertType        string            `json:"certType,omitempty"`
+	KeyID           string            `json:"keyID,omitempty"`
+	Principals      []string          `json:"principals,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+	CriticalOptions map[string]string `json:"criticalOptions,omitempty"`
+}
+
+// apply sets in the given certificate the values defined in the template.
+func (t *sshTemplate) apply(cert *ssh.Certificate) error {
+	if t.CertType != "" {
+		if cert.CertType = sshCertTypeUInt32(t.CertType); cert.CertType == 0 {
+			return errors.Errorf("ssh template certType %s is not valid", t.CertType)
+		}
+	}
+	if t.KeyID != "" {
+		cert.KeyId = t.KeyID
+	}
+	if t.Principals != nil {
+		cert.ValidPrincipals = t.Principals
+	}
+	if t.Extensions != nil {
+		cert.Extensions = t.Extensions
+	}
+	if t.CriticalOptions != nil {
+		cert.CriticalOptions = t.CriticalOptions
+	}
+	return nil
+}
+
+// initTemplateOptions parses the x509 and SSH templates and validates the
+// webhooks configured in a provisioner. It returns the x509 options used to
+// sign the certificates, the ones of the provisioner or, if it does not have a
+// template, the default ones of the authority in the config.
+func initTemplateOptions(o *X509Options, so *SSHTemplateOptions, webhooks []*Webhook, name string, config Config) (*X509Options, error) {
+	if err := o.init(name); err != nil {
+		return nil, err
+	}
+	if err := so.init(name); err != nil {
+		return nil, err
+	}
+	if err := validateWebhooks(webhooks, WebhookKindEnriching); err != nil {
+		return nil, err
+	}
+	return o.withDefault(config.X509, name)
+}
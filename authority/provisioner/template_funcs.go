@@ -0,0 +1,53 @@
+package provisioner
+
+import (
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// TemplateFuncsVersion is the version of the functions available in the
+// certificate templates. It changes when a function is added or removed.
+const TemplateFuncsVersion = 1
+
+// templateFuncNames are the sprig functions available in the certificate
+// templates. The functions that read the environment, the file system or the
+// network, like env, expandenv or getHostByName, and the ones that generate
+// keys and certificates are not available.
+var templateFuncNames = []string{
+	// Strings.
+	"trim", "trimAll", "trimPrefix", "trimSuffix", "upper", "lower", "title",
+	"replace", "contains", "hasPrefix", "hasSuffix", "split", "splitList",
+	"join", "quote", "squote", "substr", "trunc", "repeat", "nospace", "indent",
+	"nindent", "toString", "regexMatch", "regexFind", "regexReplaceAll",
+	"regexSplit",
+	// Encodings and digests.
+	"b64enc", "b64dec", "b32enc", "b32dec", "sha1sum", "sha256sum",
+	"toJson", "toPrettyJson", "toRawJson",
+	// Lists.
+	"list", "first", "rest", "last", "initial", "append", "prepend", "concat",
+	"has", "uniq", "without", "compact", "sortAlpha", "reverse", "slice",
+	// Dictionaries.
+	"dict", "get", "set", "unset", "hasKey", "keys", "values", "pick", "omit",
+	"merge", "pluck",
+	// Defaults, conversions and math.
+	"default", "empty", "coalesce", "ternary", "atoi", "int", "int64", "add",
+	"sub", "mul", "div", "mod", "max", "min", "typeOf", "kindIs",
+	// Dates.
+	"toDate", "date", "dateModify", "unixEpoch",
+	// Others.
+	"urlParse", "fail",
+}
+
+// TemplateFuncMap returns the functions available in the X.509 and SSH
+// certificate templates and in the sshPrincipals templates of the OIDC
+// provisioners. They are a subset of the sprig functions, see
+// templateFuncNames.
+func TemplateFuncMap() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	m := make(template.FuncMap, len(templateFuncNames))
+	for _, name := range templateFuncNames {
+		m[name] = funcs[name]
+	}
+	return m
+}
@@ -0,0 +1,138 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func TestTemplateFuncMap(t *testing.T) {
+	// Every function available in the templates must be tested here.
+	tests := map[string]struct {
+		template string
+		want     string
+	}{
+		"trim":            {`{{ trim "  foo  " }}`, "foo"},
+		"trimAll":         {`{{ trimAll "$" "$5.00$" }}`, "5.00"},
+		"trimPrefix":      {`{{ trimPrefix "-" "-foo" }}`, "foo"},
+		"trimSuffix":      {`{{ trimSuffix ".example.com" "foo.example.com" }}`, "foo"},
+		"upper":           {`{{ upper "foo" }}`, "FOO"},
+		"lower":           {`{{ .Insecure.CR.Subject.CommonName | lower }}`, "jane"},
+		"title":           {`{{ title "hello world" }}`, "Hello World"},
+		"replace":         {`{{ replace "." "-" "a.b.c" }}`, "a-b-c"},
+		"contains":        {`{{ contains "Smallstep" (join "," .Insecure.CR.Subject.Organization) }}`, "true"},
+		"hasPrefix":       {`{{ hasPrefix "cat" "catch" }}`, "true"},
+		"hasSuffix":       {`{{ hasSuffix "ch" "catch" }}`, "true"},
+		"split":           {`{{ (split "." "foo.example.com")._0 }}`, "foo"},
+		"splitList":       {`{{ index (splitList "." "a.b") 1 }}`, "b"},
+		"join":            {`{{ join "," .SANs }}`, "foo.example.com,bar.example.com"},
+		"quote":           {`{{ quote "a" }}`, `"a"`},
+		"squote":          {`{{ squote "a" }}`, `'a'`},
+		"substr":          {`{{ substr 0 3 "foobar" }}`, "foo"},
+		"trunc":           {`{{ trunc 3 "foobar" }}`, "foo"},
+		"repeat":          {`{{ repeat 3 "a" }}`, "aaa"},
+		"nospace":         {`{{ nospace "a b c" }}`, "abc"},
+		"indent":          {`{{ indent 2 "a" }}`, "  a"},
+		"nindent":         {`{{ nindent 2 "a" }}`, "\n  a"},
+		"toString":        {`{{ toString 42 }}`, "42"},
+		"regexMatch":      {`{{ regexMatch "^[a-z]+$" "foo" }}`, "true"},
+		"regexFind":       {`{{ regexFind "[0-9]+" "abc123def" }}`, "123"},
+		"regexReplaceAll": {`{{ regexReplaceAll "[0-9]" "a1b2" "x" }}`, "axbx"},
+		"regexSplit":      {`{{ regexSplit "-" "a-b-c" -1 }}`, "[a b c]"},
+		"b64enc":          {`{{ b64enc "foo" }}`, "Zm9v"},
+		"b64dec":          {`{{ b64dec "Zm9v" }}`, "foo"},
+		"b32enc":          {`{{ b32enc "foo" }}`, "MZXW6==="},
+		"b32dec":          {`{{ b32dec "MZXW6===" }}`, "foo"},
+		"sha1sum":         {`{{ sha1sum "foo" }}`, "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"},
+		"sha256sum":       {`{{ sha256sum "foo" }}`, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+		"toJson":          {`{{ toJson .Insecure.CR.Subject.Organization }}`, `["Smallstep"]`},
+		"toPrettyJson":    {`{{ toPrettyJson (list 1) }}`, "[\n  1\n]"},
+		"toRawJson":       {`{{ toRawJson "<a>" }}`, `"<a>"`},
+		"list":            {`{{ list 1 2 }}`, "[1 2]"},
+		"first":           {`{{ first .SANs }}`, "foo.example.com"},
+		"rest":            {`{{ rest (list "a" "b") }}`, "[b]"},
+		"last":            {`{{ last (list "a" "b") }}`, "b"},
+		"initial":         {`{{ initial (list "a" "b") }}`, "[a]"},
+		"append":          {`{{ append (list "a") "b" }}`, "[a b]"},
+		"prepend":         {`{{ prepend (list "b") "a" }}`, "[a b]"},
+		"concat":          {`{{ concat (list "a") (list "b") }}`, "[a b]"},
+		"has":             {`{{ has "a" (list "a") }}`, "true"},
+		"uniq":            {`{{ uniq (list "a" "a") }}`, "[a]"},
+		"without":         {`{{ without (list "a" "b") "a" }}`, "[b]"},
+		"compact":         {`{{ compact (list "a" "") }}`, "[a]"},
+		"sortAlpha":       {`{{ sortAlpha (list "b" "a") }}`, "[a b]"},
+		"reverse":         {`{{ reverse (list "a" "b") }}`, "[b a]"},
+		"slice":           {`{{ slice (list "a" "b" "c") 1 2 }}`, "[b]"},
+		"dict":            {`{{ dict "a" 1 }}`, "map[a:1]"},
+		"get":             {`{{ get .TemplateData "team" }}`, "infra"},
+		"set":             {`{{ set (dict) "a" "b" }}`, "map[a:b]"},
+		"unset":           {`{{ unset (dict "a" "b") "a" }}`, "map[]"},
+		"hasKey":          {`{{ hasKey .Token "sub" }}`, "true"},
+		"keys":            {`{{ keys .Token }}`, "[sub]"},
+		"values":          {`{{ values (dict "a" 1) }}`, "[1]"},
+		"pick":            {`{{ pick (dict "a" 1 "b" 2) "a" }}`, "map[a:1]"},
+		"omit":            {`{{ omit (dict "a" 1 "b" 2) "a" }}`, "map[b:2]"},
+		"merge":           {`{{ merge (dict "a" 1) (dict "b" 2) }}`, "map[a:1 b:2]"},
+		"pluck":           {`{{ pluck "a" (dict "a" 1) (dict "a" 2) }}`, "[1 2]"},
+		"default":         {`{{ .Token.email | default "none" }}`, "none"},
+		"empty":           {`{{ empty "" }}`, "true"},
+		"coalesce":        {`{{ coalesce .Token.email .Provisioner.Name }}`, "test"},
+		"ternary":         {`{{ ternary "a" "b" true }}`, "a"},
+		"atoi":            {`{{ atoi "42" }}`, "42"},
+		"int":             {`{{ int "42" }}`, "42"},
+		"int64":           {`{{ int64 "42" }}`, "42"},
+		"add":             {`{{ add 1 2 }}`, "3"},
+		"sub":             {`{{ sub 3 2 }}`, "1"},
+		"mul":             {`{{ mul 2 3 }}`, "6"},
+		"div":             {`{{ div 6 3 }}`, "2"},
+		"mod":             {`{{ mod 7 3 }}`, "1"},
+		"max":             {`{{ max 1 3 2 }}`, "3"},
+		"min":             {`{{ min 2 1 3 }}`, "1"},
+		"typeOf":          {`{{ typeOf .SANs }}`, "[]string"},
+		"kindIs":          {`{{ kindIs "string" .Subject }}`, "true"},
+		"toDate":          {`{{ toDate "2006-01-02" "2020-05-01" | date "2006" }}`, "2020"},
+		"date":            {`{{ date "2006-01-02" (toDate "2006-01-02" "2020-05-01") }}`, "2020-05-01"},
+		"dateModify":      {`{{ toDate "2006-01-02" "2020-05-01" | dateModify "24h" | date "2006-01-02" }}`, "2020-05-02"},
+		"unixEpoch":       {`{{ toDate "2006-01-02T15:04:05Z07:00" "2020-05-01T00:00:00Z" | unixEpoch }}`, "1588291200"},
+		"urlParse":        {`{{ (urlParse "https://example.com/foo").host }}`, "example.com"},
+		"fail":            {`{{ if not .Subject }}{{ fail "subject is required" }}{{ end }}ok`, "ok"},
+	}
+
+	funcs := TemplateFuncMap()
+	for name := range funcs {
+		if _, ok := tests[name]; !ok {
+			t.Errorf("function %s is not tested", name)
+		}
+	}
+
+	data := &TemplateData{
+		Subject: "foo.example.com",
+		SANs:    []string{"foo.example.com", "bar.example.com"},
+		Token:   map[string]interface{}{"sub": "foo.example.com"},
+		Insecure: TemplateInsecureData{
+			CR: &x509.CertificateRequest{Subject: pkix.Name{CommonName: "Jane", Organization: []string{"Smallstep"}}},
+		},
+		Provisioner:  TemplateProvisionerData{Name: "test"},
+		TemplateData: map[string]interface{}{"team": "infra"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := funcs[name]; !ok {
+				t.Fatalf("function %s is not available", name)
+			}
+			o := &X509Options{Template: tt.template}
+			assert.FatalError(t, o.init("test"))
+			b, err := executeTemplate("x509", o.template, nil, data)
+			assert.FatalError(t, err)
+			assert.Equals(t, tt.want, string(b))
+		})
+	}
+
+	// The functions with access to the environment or the network are not
+	// available.
+	for _, name := range []string{"env", "expandenv", "getHostByName", "genPrivateKey"} {
+		assert.Error(t, (&X509Options{Template: `{{ ` + name + ` "foo" }}`}).init("test"))
+	}
+}
@@ -0,0 +1,136 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// TemplateSample is the sample data used by RenderTemplate instead of the
+// data of a sign request.
+type TemplateSample struct {
+	// Provisioner is the name of the provisioner.
+	Provisioner string
+	// Claims are the claims of the token. The subject and the SANs of the
+	// template data are the sub and sans claims.
+	Claims map[string]interface{}
+	// CertificateRequest is the certificate request of the X.509 templates.
+	CertificateRequest *x509.CertificateRequest
+	// SSHCertificate is the certificate of the SSH templates, after applying
+	// the default options.
+	SSHCertificate *ssh.Certificate
+	// TemplateData is the custom template data configured in the provisioner.
+	TemplateData json.RawMessage
+	// Webhooks are the responses of the enriching webhooks by name.
+	Webhooks map[string]interface{}
+	// User is the template data of the sign request, in the X.509 templates.
+	User map[string]interface{}
+}
+
+// TemplateError is the error returned by RenderTemplate if the template
+// cannot be parsed, executed or applied to a certificate. Line is the line of
+// the template with the error, or 0 if it is not known.
+type TemplateError struct {
+	Message string
+	Line    int
+}
+
+// Error implements the error interface.
+func (e *TemplateError) Error() string {
+	return e.Message
+}
+
+// RenderTemplate parses a template of the given kind, x509 or ssh, and
+// executes it with the sample data as when a certificate is signed, but
+// without signing anything. It returns the JSON description of the
+// certificate fields rendered by the template, or a TemplateError. It can be
+// used to check a template before it is configured in a provisioner.
+func RenderTemplate(kind, text string, sample *TemplateSample) (json.RawMessage, error) {
+	if kind != "x509" && kind != "ssh" {
+		return nil, errors.Errorf("unsupported template type '%s'", kind)
+	}
+	if sample == nil {
+		sample = &TemplateSample{}
+	}
+	name := sample.Provisioner
+	if name == "" {
+		name = "template"
+	}
+	tmpl, v, err := parseTemplate(kind, name, text, "", sample.TemplateData)
+	if err != nil {
+		return nil, newTemplateError(name, err)
+	}
+	if tmpl == nil {
+		return nil, &TemplateError{Message: "template cannot be empty"}
+	}
+
+	data := &TemplateData{
+		Token:    sample.Claims,
+		Webhooks: sample.Webhooks,
+	}
+	data.Subject, _ = sample.Claims["sub"].(string)
+	if sans, ok := sample.Claims["sans"].([]interface{}); ok {
+		for _, san := range sans {
+			if s, ok := san.(string); ok {
+				data.SANs = append(data.SANs, s)
+			}
+		}
+	}
+	data.setProvisioner(sample.Provisioner, v)
+
+	var rendered interface{}
+	switch kind {
+	case "x509":
+		cr := sample.CertificateRequest
+		data.Insecure.CR = cr
+		data.Insecure.User = sample.User
+		var t x509Template
+		if err := renderTemplate(kind, tmpl, nil, data, &t); err != nil {
+			return nil, newTemplateError(name, err)
+		}
+		crt := new(x509.Certificate)
+		if cr != nil {
+			crt.Subject = cr.Subject
+			crt.DNSNames = cr.DNSNames
+		}
+		if err := t.apply(crt); err != nil {
+			return nil, newTemplateError(name, err)
+		}
+		rendered = &t
+	default:
+		cert := new(ssh.Certificate)
+		if sample.SSHCertificate != nil {
+			*cert = *sample.SSHCertificate
+		}
+		data.Insecure.Cert = cert
+		var t sshTemplate
+		if err := renderTemplate(kind, tmpl, nil, data, &t); err != nil {
+			return nil, newTemplateError(name, err)
+		}
+		if err := t.apply(cert); err != nil {
+			return nil, newTemplateError(name, err)
+		}
+		rendered = &t
+	}
+	b, err := json.Marshal(rendered)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling rendered template")
+	}
+	return b, nil
+}
+
+// newTemplateError returns the TemplateError of an error of the template with
+// the given name. The line is taken from the location in the errors of the
+// text/template package and of checkTemplateFields, "name:line:".
+func newTemplateError(name string, err error) *TemplateError {
+	te := &TemplateError{Message: err.Error()}
+	re := regexp.MustCompile(regexp.QuoteMeta(name) + `:(\d+):`)
+	if m := re.FindStringSubmatch(te.Message); m != nil {
+		te.Line, _ = strconv.Atoi(m[1])
+	}
+	return te
+}
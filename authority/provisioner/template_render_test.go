@@ -0,0 +1,134 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	sample := &TemplateSample{
+		Provisioner: "iot",
+		Claims:      map[string]interface{}{"sub": "sensor-1", "sans": []interface{}{"sensor-1.example.com"}},
+		CertificateRequest: &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "requested", Organization: []string{"Smallstep"}},
+			DNSNames: []string{"requested.example.com"},
+		},
+		SSHCertificate: &ssh.Certificate{
+			CertType:        ssh.UserCert,
+			KeyId:           "jane@example.com",
+			ValidPrincipals: []string{"jane"},
+		},
+		TemplateData: json.RawMessage(`{"deviceOID": "1.3.6.1.4.1.99999.1"}`),
+		Webhooks:     map[string]interface{}{"device": map[string]interface{}{"assetTag": "A-1234"}},
+	}
+
+	tests := map[string]struct {
+		kind     string
+		template string
+		sample   *TemplateSample
+		want     string
+		wantErr  string
+		wantLine int
+	}{
+		"ok x509": {
+			kind: "x509",
+			template: `{
+				"subject": {"commonName": {{ toJson .Subject }}, "organization": {{ toJson .Insecure.CR.Subject.Organization }}},
+				"dnsNames": {{ toJson .SANs }},
+				"extensions": [{"id": {{ toJson .TemplateData.deviceOID }}, "critical": false, "value": {{ .Webhooks.device.assetTag | b64enc | toJson }}}]
+			}`,
+			sample: sample,
+			want:   `{"subject":{"commonName":"sensor-1","organization":["Smallstep"]},"dnsNames":["sensor-1.example.com"],"extensions":[{"id":"1.3.6.1.4.1.99999.1","critical":false,"value":"QS0xMjM0"}]}`,
+		},
+		"ok ssh": {
+			kind:     "ssh",
+			template: `{"principals": {{ append .Insecure.Cert.ValidPrincipals (print .Provisioner.Name "-admin") | toJson }}}`,
+			sample:   sample,
+			want:     `{"principals":["jane","iot-admin"]}`,
+		},
+		"ok ssh default": {
+			kind:     "ssh",
+			template: DefaultSSHTemplate,
+			sample:   sample,
+			want:     `{"certType":"user","keyID":"jane@example.com","principals":["jane"]}`,
+		},
+		"fail syntax": {
+			kind:     "x509",
+			template: "{\n\"subject\": {{ toJson .Subject }\n}",
+			sample:   sample,
+			wantErr:  "error parsing x509 template of provisioner iot: template: iot:2: unexpected \"}\" in operand",
+			wantLine: 2,
+		},
+		"fail unknown field": {
+			kind:     "x509",
+			template: "{\n\n\"subject\": {\"commonName\": {{ toJson .Insecure.CR.Subject.Name }}}}",
+			sample:   sample,
+			wantErr:  ".Insecure.CR.Subject.Name is not a field of the template data",
+			wantLine: 3,
+		},
+		"fail nil dereference": {
+			kind:     "x509",
+			template: "{\n\"subject\": {\"commonName\": {{ toJson .Insecure.CR.Subject.CommonName }}}}",
+			sample:   &TemplateSample{Provisioner: "iot"},
+			wantErr:  "nil pointer evaluating *x509.CertificateRequest.Subject",
+			wantLine: 2,
+		},
+		"fail ssh nil dereference": {
+			kind:     "ssh",
+			template: `{"keyID": {{ toJson .AuthorizationCrt.Subject.CommonName }}}`,
+			sample:   sample,
+			wantErr:  "nil pointer evaluating *x509.Certificate.Subject",
+			wantLine: 1,
+		},
+		"fail json": {
+			kind:     "x509",
+			template: `{"subject": }`,
+			wantErr:  "error unmarshaling x509 template",
+		},
+		"fail apply": {
+			kind:     "x509",
+			template: `{"ipAddresses": ["foo"]}`,
+			sample:   sample,
+			wantErr:  "invalid ip address foo",
+		},
+		"fail ssh apply": {
+			kind:     "ssh",
+			template: `{"certType": "foo"}`,
+			sample:   sample,
+			wantErr:  "ssh template certType foo is not valid",
+		},
+		"fail empty": {kind: "ssh", template: "", sample: sample, wantErr: "template cannot be empty"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := RenderTemplate(tt.kind, tt.template, tt.sample)
+			if tt.wantErr == "" {
+				assert.FatalError(t, err)
+				assert.Equals(t, tt.want, string(got))
+				return
+			}
+			if assert.Error(t, err) {
+				te, ok := err.(*TemplateError)
+				if assert.True(t, ok) {
+					assert.True(t, strings.Contains(te.Message, tt.wantErr), te.Message)
+					assert.Equals(t, tt.wantLine, te.Line)
+				}
+			}
+		})
+	}
+
+	// The sample certificate is not modified.
+	assert.Equals(t, []string{"jane"}, sample.SSHCertificate.ValidPrincipals)
+
+	_, err := RenderTemplate("foo", `{}`, sample)
+	if assert.Error(t, err) {
+		_, ok := err.(*TemplateError)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,465 @@
+package provisioner
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTemplateTimeout is the default maximum time to execute a certificate
+// template.
+const DefaultTemplateTimeout = time.Second
+
+// DefaultTemplateMaxOutputSize is the default maximum size, in bytes, of the
+// output of a certificate template.
+const DefaultTemplateMaxOutputSize = 64 * 1024
+
+// DefaultTemplateMaxIterations is the default maximum number of iterations of
+// the ranges of a certificate template.
+const DefaultTemplateMaxIterations = 100000
+
+// The limits of the certificate templates reported in a TemplateLimitError.
+const (
+	TemplateLimitTimeout    = "timeout"
+	TemplateLimitOutputSize = "outputSize"
+	TemplateLimitIterations = "iterations"
+	TemplateLimitPanic      = "panic"
+)
+
+// templateTickFunc is the function called at the start of every iteration of
+// a range and of every template, see instrumentTemplate. It is not available
+// when the templates are parsed, so the templates cannot use it.
+const templateTickFunc = "stepTemplateTick"
+
+// errTemplateStopped stops the execution of a template after its timeout.
+var errTemplateStopped = errors.New("template execution stopped")
+
+// errTemplateLimit stops the execution of a template that exceeds one of its
+// limits.
+var errTemplateLimit = errors.New("template limit exceeded")
+
+// TemplateLimits are the limits of the execution of a certificate template.
+// The zero values use the defaults.
+type TemplateLimits struct {
+	// Timeout is the maximum time to execute the template, 1s by default.
+	Timeout *Duration `json:"timeout,omitempty"`
+	// MaxOutputSize is the maximum size in bytes of the output of the
+	// template, and of the values returned by its functions, 64KiB by
+	// default.
+	MaxOutputSize int `json:"maxOutputSize,omitempty"`
+	// MaxIterations is the maximum number of iterations of the ranges of the
+	// template, including the templates it calls, 100000 by default.
+	MaxIterations int `json:"maxIterations,omitempty"`
+}
+
+// validate validates the limits of a template, nil is ok.
+func (l *TemplateLimits) validate(kind, name string) error {
+	switch {
+	case l == nil:
+		return nil
+	case l.Timeout != nil && l.Timeout.Value() <= 0:
+		return errors.Errorf("provisioner %s: %s template timeout must be greater than 0", name, kind)
+	case l.MaxOutputSize < 0:
+		return errors.Errorf("provisioner %s: %s template maxOutputSize cannot be negative", name, kind)
+	case l.MaxIterations < 0:
+		return errors.Errorf("provisioner %s: %s template maxIterations cannot be negative", name, kind)
+	default:
+		return nil
+	}
+}
+
+func (l *TemplateLimits) timeout() time.Duration {
+	if l == nil || l.Timeout == nil {
+		return DefaultTemplateTimeout
+	}
+	return l.Timeout.Value()
+}
+
+func (l *TemplateLimits) maxOutputSize() int {
+	if l == nil || l.MaxOutputSize == 0 {
+		return DefaultTemplateMaxOutputSize
+	}
+	return l.MaxOutputSize
+}
+
+func (l *TemplateLimits) maxIterations() int {
+	if l == nil || l.MaxIterations == 0 {
+		return DefaultTemplateMaxIterations
+	}
+	return l.MaxIterations
+}
+
+// TemplateLimitError is the error returned when the execution of a template
+// exceeds its timeout or its maximum output size, or panics. Template is the
+// name of the template, the provisioner name, and Limit is one of
+// TemplateLimitTimeout, TemplateLimitOutputSize or TemplateLimitPanic.
+type TemplateLimitError struct {
+	Template string
+	Limit    string
+	Message  string
+}
+
+// Error implements the error interface.
+func (e *TemplateLimitError) Error() string {
+	return e.Message
+}
+
+// templateExecution is the state of an execution of a template. It is the
+// writer of the output, and it is shared with the functions of the template,
+// so an execution that has timed out stops at its next output, function call
+// or iteration, and its goroutine ends.
+type templateExecution struct {
+	buf           bytes.Buffer
+	max           int
+	maxIterations int
+	iterations    int
+	limit         string
+	limitMessage  string
+	stopped       int32
+	panicked      int32
+}
+
+// Write implements the io.Writer interface.
+func (e *templateExecution) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&e.stopped) == 1 {
+		return 0, errTemplateStopped
+	}
+	if e.buf.Len()+len(p) > e.max {
+		e.limit, e.limitMessage = TemplateLimitOutputSize, fmt.Sprintf("output is larger than %d bytes", e.max)
+		return 0, errTemplateLimit
+	}
+	return e.buf.Write(p)
+}
+
+// exceed records the limit exceeded and stops the execution. The panic is
+// converted to an error by the text/template package.
+func (e *templateExecution) exceed(limit, format string, args ...interface{}) {
+	e.limit, e.limitMessage = limit, fmt.Sprintf(format, args...)
+	panic(errTemplateLimit)
+}
+
+// tick is called at the start of every iteration of a range and of every
+// template, it stops the execution after the timeout or after the maximum
+// number of iterations.
+func (e *templateExecution) tick() string {
+	e.count(1)
+	return ""
+}
+
+// count adds n iterations to the execution.
+func (e *templateExecution) count(n int) {
+	if atomic.LoadInt32(&e.stopped) == 1 {
+		panic(errTemplateStopped)
+	}
+	if n > e.maxIterations-e.iterations {
+		e.exceed(TemplateLimitIterations, "more than %d iterations", e.maxIterations)
+	}
+	e.iterations += n
+}
+
+// funcs returns the functions of the templates wrapped to stop the execution
+// after the timeout, to bound the size of the values they return and to
+// record the panics. The panics are converted to errors by the text/template
+// package.
+func (e *templateExecution) funcs() template.FuncMap {
+	funcs := TemplateFuncMap()
+	for name, fn := range funcs {
+		funcs[name] = e.wrap(name, reflect.ValueOf(fn))
+	}
+	funcs[templateTickFunc] = e.tick
+	return funcs
+}
+
+func (e *templateExecution) wrap(name string, fn reflect.Value) interface{} {
+	variadic := fn.Type().IsVariadic()
+	return reflect.MakeFunc(fn.Type(), func(args []reflect.Value) []reflect.Value {
+		if atomic.LoadInt32(&e.stopped) == 1 {
+			panic(errTemplateStopped)
+		}
+		e.checkArgs(name, args)
+		results := e.call(fn, variadic, args)
+		if len(results) > 0 && valueSize(results[0], e.max) > e.max {
+			e.exceed(TemplateLimitOutputSize, "the result of %s is larger than %d bytes", name, e.max)
+		}
+		return results
+	}).Interface()
+}
+
+func (e *templateExecution) call(fn reflect.Value, variadic bool, args []reflect.Value) []reflect.Value {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.StoreInt32(&e.panicked, 1)
+			panic(r)
+		}
+	}()
+	if variadic {
+		return fn.CallSlice(args)
+	}
+	return fn.Call(args)
+}
+
+// checkArgs stops the execution before calling the functions whose result
+// would be larger than the maximum size, or that would take more than the
+// remaining iterations, the result of the other functions is at most a few
+// times the size of their arguments.
+func (e *templateExecution) checkArgs(name string, args []reflect.Value) {
+	tooLarge := func(size int) {
+		if size > e.max {
+			e.exceed(TemplateLimitOutputSize, "the result of %s is larger than %d bytes", name, e.max)
+		}
+	}
+	switch name {
+	case "repeat":
+		// repeat COUNT STRING
+		count, str := int(args[0].Int()), args[1].String()
+		if len(str) > 0 && count > e.max/len(str) {
+			tooLarge(e.max + 1)
+		}
+	case "indent", "nindent":
+		// indent SPACES STRING
+		spaces, str := int(args[0].Int()), args[1].String()
+		if lines := strings.Count(str, "\n") + 1; spaces > e.max/lines {
+			tooLarge(e.max + 1)
+		} else {
+			tooLarge(spaces*lines + len(str))
+		}
+	case "replace":
+		// replace OLD NEW SOURCE
+		old, replacement, src := args[0].String(), args[1].String(), args[2].String()
+		if n := strings.Count(src, old); len(replacement) > len(old) && n > 0 {
+			if len(replacement)-len(old) > e.max/n {
+				tooLarge(e.max + 1)
+			}
+			tooLarge(len(src) + n*(len(replacement)-len(old)))
+		}
+	case "regexReplaceAll":
+		// regexReplaceAll REGEX SOURCE REPLACEMENT, every $ of the
+		// replacement expands to at most the length of the match.
+		re, err := regexp.Compile(args[0].String())
+		if err != nil {
+			return
+		}
+		src, replacement := args[1].String(), args[2].String()
+		n := len(re.FindAllStringIndex(src, -1))
+		if len(replacement) > 0 && n > e.max/len(replacement) {
+			tooLarge(e.max + 1)
+		}
+		dollars := strings.Count(replacement, "$")
+		if len(src) > 0 && dollars > e.max/len(src) {
+			tooLarge(e.max + 1)
+		}
+		tooLarge(len(src) + n*len(replacement) + dollars*len(src))
+	case "join":
+		// join SEPARATOR LIST
+		sep, size := args[0].String(), valueSize(args[1], e.max)
+		if size > e.max/(len(sep)+2) {
+			tooLarge(e.max + 1)
+		}
+	case "toPrettyJson":
+		// The indentation of a value is proportional to its depth.
+		size, depth := valueSize(args[0], e.max), valueDepth(args[0], e.max)
+		if depth > 0 && size > e.max/(2*depth) {
+			tooLarge(e.max + 1)
+		}
+	case "uniq":
+		// uniq compares every item with the unique ones.
+		if v := indirectInterface(args[0]); v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			n := v.Len()
+			if n > 0 && n > e.maxIterations/n {
+				e.count(e.maxIterations + 1)
+			}
+			e.count(n * n)
+		}
+	}
+}
+
+// indirectInterface returns the value inside an interface.
+func indirectInterface(v reflect.Value) reflect.Value {
+	for v.IsValid() && v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+// valueSize returns the size of a value used by the functions of a template,
+// the bytes of its strings plus the number of its items, recursively. It stops
+// counting once the size is larger than max, so the values that contain
+// themselves are not a problem.
+func valueSize(v reflect.Value, max int) int {
+	var size int
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		v = indirectInterface(v)
+		if size > max || !v.IsValid() {
+			return
+		}
+		switch v.Kind() {
+		case reflect.Ptr:
+			if !v.IsNil() {
+				walk(v.Elem())
+			}
+		case reflect.String:
+			size += v.Len()
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len() && size <= max; i++ {
+				size++
+				walk(v.Index(i))
+			}
+		case reflect.Map:
+			iter := v.MapRange()
+			for size <= max && iter.Next() {
+				size++
+				walk(iter.Key())
+				walk(iter.Value())
+			}
+		}
+	}
+	walk(v)
+	return size
+}
+
+// valueDepth returns the depth of the lists and dictionaries nested in a
+// value, it stops once the depth is larger than max.
+func valueDepth(v reflect.Value, max int) int {
+	v = indirectInterface(v)
+	if max < 0 || !v.IsValid() {
+		return 0
+	}
+	var depth int
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len() && depth <= max; i++ {
+			if d := valueDepth(v.Index(i), max-1) + 1; d > depth {
+				depth = d
+			}
+		}
+		if depth == 0 {
+			depth = 1
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for depth <= max && iter.Next() {
+			if d := valueDepth(iter.Value(), max-1) + 1; d > depth {
+				depth = d
+			}
+		}
+		if depth == 0 {
+			depth = 1
+		}
+	}
+	return depth
+}
+
+// instrumentTemplate adds a call to templateTickFunc at the start of every
+// template and of every iteration of their ranges, so the iterations that do
+// not write or call a function can also be counted and stopped. It must be
+// called once after parsing the template, before it is executed.
+func instrumentTemplate(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && t.Tree.Root != nil {
+			instrumentList(t.Tree.Root)
+			prependTick(t.Tree.Root)
+		}
+	}
+}
+
+func instrumentList(list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+	for _, n := range list.Nodes {
+		switch n := n.(type) {
+		case *parse.IfNode:
+			instrumentList(n.List)
+			instrumentList(n.ElseList)
+		case *parse.WithNode:
+			instrumentList(n.List)
+			instrumentList(n.ElseList)
+		case *parse.RangeNode:
+			instrumentList(n.List)
+			instrumentList(n.ElseList)
+			prependTick(n.List)
+		}
+	}
+}
+
+// templateTick is the action that calls templateTickFunc, parsed so it
+// belongs to a tree like the nodes of the templates.
+var templateTick = func() parse.Node {
+	trees, err := parse.Parse("tick", "{{"+templateTickFunc+"}}", "", "", map[string]interface{}{
+		templateTickFunc: func() string { return "" },
+	})
+	if err != nil {
+		panic(err)
+	}
+	return trees["tick"].Root.Nodes[0]
+}()
+
+func prependTick(list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+	list.Nodes = append([]parse.Node{templateTick.Copy()}, list.Nodes...)
+}
+
+// executeTemplate executes a template of the given kind within its limits and
+// returns its output. The template must be instrumented with
+// instrumentTemplate. The template is executed in its own goroutine, and a
+// TemplateLimitError is returned if it does not finish before the timeout, if
+// its output or the values of its functions are too large, if it takes too
+// many iterations or if it panics.
+func executeTemplate(kind string, tmpl *template.Template, limits *TemplateLimits, data interface{}) ([]byte, error) {
+	e := &templateExecution{max: limits.maxOutputSize(), maxIterations: limits.maxIterations()}
+	t, err := tmpl.Clone()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error executing %s template", kind)
+	}
+	t.Funcs(e.funcs())
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.StoreInt32(&e.panicked, 1)
+				done <- fmt.Errorf("%v", r)
+			}
+		}()
+		done <- t.Execute(e, data)
+	}()
+
+	timeout := limits.timeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	limitError := func(limit, format string, args ...interface{}) error {
+		return &TemplateLimitError{
+			Template: tmpl.Name(),
+			Limit:    limit,
+			Message:  fmt.Sprintf("error executing %s template of provisioner %s: ", kind, tmpl.Name()) + fmt.Sprintf(format, args...),
+		}
+	}
+	select {
+	case err := <-done:
+		switch {
+		case atomic.LoadInt32(&e.panicked) == 1:
+			return nil, limitError(TemplateLimitPanic, "template panicked: %v", err)
+		case e.limit != "":
+			return nil, limitError(e.limit, "%s", e.limitMessage)
+		case err != nil:
+			return nil, errors.Wrapf(err, "error executing %s template", kind)
+		default:
+			return e.buf.Bytes(), nil
+		}
+	case <-timer.C:
+		atomic.StoreInt32(&e.stopped, 1)
+		return nil, limitError(TemplateLimitTimeout, "execution took longer than %s", timeout)
+	}
+}
@@ -0,0 +1,153 @@
+package provisioner
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+// slowTemplate calls a function in every iteration of a loop that takes
+// much longer than the timeouts of the tests.
+const slowTemplate = `{{ $l := splitList "" (repeat 100 "x") }}{{ range $l }}{{ range $l }}{{ range $l }}{{ $_ := add 1 1 }}{{ end }}{{ end }}{{ end }}{}`
+
+// idleTemplate is a loop that takes much longer than the timeouts of the
+// tests without writing anything or calling any function.
+const idleTemplate = `{{ $l := splitList "" (repeat 300 "x") }}{{ range $l }}{{ range $l }}{{ range $l }}{{ end }}{{ end }}{{ end }}{}`
+
+func parseTestTemplate(t *testing.T, text string) *template.Template {
+	t.Helper()
+	tmpl, err := template.New("test").Funcs(TemplateFuncMap()).Parse(text)
+	assert.FatalError(t, err)
+	instrumentTemplate(tmpl)
+	return tmpl
+}
+
+func TestTemplateLimits_validate(t *testing.T) {
+	tests := map[string]struct {
+		limits  *TemplateLimits
+		wantErr bool
+	}{
+		"ok nil":          {nil, false},
+		"ok empty":        {&TemplateLimits{}, false},
+		"ok":              {&TemplateLimits{Timeout: &Duration{Duration: time.Second}, MaxOutputSize: 1024}, false},
+		"fail timeout":    {&TemplateLimits{Timeout: &Duration{}}, true},
+		"fail outputSize": {&TemplateLimits{MaxOutputSize: -1}, true},
+		"fail iterations": {&TemplateLimits{MaxIterations: -1}, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.limits.validate("x509", "test"); (err != nil) != tt.wantErr {
+				t.Errorf("TemplateLimits.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_executeTemplate(t *testing.T) {
+	limits := &TemplateLimits{Timeout: &Duration{Duration: 50 * time.Millisecond}, MaxOutputSize: 1024, MaxIterations: 1000}
+	unlimited := &TemplateLimits{Timeout: &Duration{Duration: 50 * time.Millisecond}, MaxOutputSize: 1024, MaxIterations: 1 << 30}
+
+	tests := map[string]struct {
+		template  string
+		limits    *TemplateLimits
+		want      string
+		wantLimit string
+		wantErr   bool
+	}{
+		"ok":                  {`{"commonName": {{ toJson .Subject }}}`, limits, `{"commonName": "foo"}`, "", false},
+		"ok range":            {`{{ range $i, $_ := splitList "" "abc" }}{{ $i }}{{ end }}`, limits, "012", "", false},
+		"ok template":         {`{{ define "x" }}x{{ end }}{{ template "x" }}{{ template "x" }}`, limits, "xx", "", false},
+		"ok indent":           {`{{ indent 2 "a\nb" }}`, limits, "  a\n  b", "", false},
+		"ok regexReplaceAll":  {`{{ regexReplaceAll "(a)" "banana" "[$1]" }}`, limits, "b[a]n[a]n[a]", "", false},
+		"fail timeout":        {slowTemplate, unlimited, "", TemplateLimitTimeout, true},
+		"fail idle timeout":   {idleTemplate, unlimited, "", TemplateLimitTimeout, true},
+		"fail outputSize":     {`{{ repeat 2048 "x" }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail range":          {`{{ range splitList "" (repeat 1000 "x") }}{{ . }}{{ end }}`, unlimited, "", TemplateLimitOutputSize, true},
+		"fail repeat":         {`{{ $_ := repeat 100000000 "x" }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail splitList":      {`{{ $_ := splitList "" (printf "%01000d" 0) }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail indent":         {`{{ $_ := indent 100000000 "x" }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail replace":        {`{{ $_ := replace "" (repeat 100 "x") (repeat 100 "y") }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail regex":          {`{{ $_ := regexReplaceAll "" (repeat 100 "x") (repeat 100 "y") }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail join":           {`{{ $_ := join (repeat 100 "y") (splitList "" (repeat 100 "x")) }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail nested list":    {`{{ $l := list 1 }}{{ range splitList "" (repeat 20 "x") }}{{ $l = list $l $l }}{{ end }}`, unlimited, "", TemplateLimitOutputSize, true},
+		"fail self dict":      {`{{ $d := dict }}{{ $_ := set $d "self" $d }}`, limits, "", TemplateLimitOutputSize, true},
+		"fail iterations":     {idleTemplate, limits, "", TemplateLimitIterations, true},
+		"fail default limits": {`{{ $l := splitList "" (repeat 100000 "x") }}{{ range $l }}{{ range $l }}{{ end }}{{ end }}`, nil, "", TemplateLimitOutputSize, true},
+		"fail uniq":           {`{{ $_ := uniq (splitList "" (repeat 100 "x")) }}`, limits, "", TemplateLimitIterations, true},
+		"fail recursion":      {`{{ define "a" }}{{ template "b" }}{{ template "b" }}{{ end }}{{ define "b" }}{{ template "c" }}{{ template "c" }}{{ end }}{{ define "c" }}{{ template "d" }}{{ template "d" }}{{ end }}{{ define "d" }}{{ template "e" }}{{ template "e" }}{{ end }}{{ define "e" }}{{ template "f" }}{{ template "f" }}{{ end }}{{ define "f" }}{{ template "g" }}{{ template "g" }}{{ end }}{{ define "g" }}{{ template "h" }}{{ template "h" }}{{ end }}{{ define "h" }}{{ template "i" }}{{ template "i" }}{{ end }}{{ define "i" }}{{ template "j" }}{{ template "j" }}{{ end }}{{ define "j" }}{{ template "k" }}{{ template "k" }}{{ end }}{{ define "k" }}{{ end }}{{ template "a" }}`, limits, "", TemplateLimitIterations, true},
+		"fail panic":          {`{{ div 1 0 }}`, limits, "", TemplateLimitPanic, true},
+		"fail error":          {`{{ fail "bad" }}`, limits, "", "", true},
+		"fail tick":           {`{{ stepTemplateTick }}`, limits, "", "", true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := template.New("test").Funcs(TemplateFuncMap()).Parse(tt.template)
+			if name == "fail tick" {
+				// The templates cannot call the instrumentation.
+				assert.Error(t, err)
+				return
+			}
+			assert.FatalError(t, err)
+			instrumentTemplate(tmpl)
+			got, err := executeTemplate("x509", tmpl, tt.limits, &TemplateData{Subject: "foo"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("executeTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if e, ok := err.(*TemplateLimitError); ok {
+				assert.Equals(t, tt.wantLimit, e.Limit)
+				assert.Equals(t, "test", e.Template)
+				assert.True(t, strings.Contains(e.Error(), "provisioner test"))
+			} else {
+				assert.Equals(t, "", tt.wantLimit)
+			}
+			assert.Equals(t, tt.want, string(got))
+		})
+	}
+}
+
+func Test_executeTemplate_timeout(t *testing.T) {
+	limits := &TemplateLimits{Timeout: &Duration{Duration: 10 * time.Millisecond}, MaxIterations: 1 << 30}
+
+	n := runtime.NumGoroutine()
+	for _, text := range []string{slowTemplate, idleTemplate} {
+		tmpl := parseTestTemplate(t, text)
+		for i := 0; i < 5; i++ {
+			_, err := executeTemplate("x509", tmpl, limits, nil)
+			e, ok := err.(*TemplateLimitError)
+			assert.True(t, ok)
+			assert.Equals(t, TemplateLimitTimeout, e.Limit)
+		}
+	}
+
+	// The executions stopped end after their next function call or
+	// iteration, even the ones that do not call any function.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= n)
+
+	// The template can still be executed.
+	b, err := executeTemplate("x509", parseTestTemplate(t, `{{ add 1 1 }}`), limits, nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "2", string(b))
+}
+
+func Test_instrumentTemplate(t *testing.T) {
+	tmpl := parseTestTemplate(t, `{{ define "x" }}{{ range . }}{{ if . }}{{ range . }}{{ end }}{{ else }}{{ with . }}{{ range . }}{{ end }}{{ end }}{{ end }}{{ end }}{{ end }}`)
+	ticks := 0
+	for _, tt := range tmpl.Templates() {
+		ticks += strings.Count(tt.Tree.Root.String(), templateTickFunc)
+	}
+	// The two templates and the three ranges.
+	assert.Equals(t, 5, ticks)
+
+	// The output does not change.
+	b, err := executeTemplate("x509", parseTestTemplate(t, `{{ range $i, $v := list "a" "b" }}{{ $i }}={{ $v }} {{ end }}`), nil, nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "0=a 1=b ", string(b))
+}
@@ -0,0 +1,544 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/cli/crypto/x509util"
+	"github.com/smallstep/cli/jose"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestX509Options_init(t *testing.T) {
+	var nilOptions *X509Options
+	assert.NoError(t, nilOptions.init("nil"))
+	assert.False(t, nilOptions.hasTemplate())
+
+	empty := &X509Options{}
+	assert.NoError(t, empty.init("empty"))
+	assert.False(t, empty.hasTemplate())
+
+	ok := &X509Options{Template: `{"subject": {"commonName": {{ toJson .Subject }}}}`}
+	assert.NoError(t, ok.init("ok"))
+	assert.True(t, ok.hasTemplate())
+
+	fail := &X509Options{Template: `{{ .Subject `}
+	err := fail.init("fail")
+	if assert.Error(t, err) {
+		assert.HasPrefix(t, err.Error(), "error parsing x509 template of provisioner fail")
+	}
+
+	dir, err := ioutil.TempDir("", "templates")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "x509.tpl")
+	assert.FatalError(t, ioutil.WriteFile(filename, []byte(`{"subject": {"commonName": {{ toJson .TemplateData.name }}}}`), 0600))
+
+	file := &X509Options{TemplateFile: filename, TemplateData: []byte(`{"name": "foo"}`)}
+	assert.NoError(t, file.init("file"))
+	assert.True(t, file.hasTemplate())
+	assert.Equals(t, map[string]interface{}{"name": "foo"}, file.data)
+
+	assert.Error(t, (&X509Options{Template: `{}`, TemplateFile: filename}).init("both"))
+	assert.Error(t, (&X509Options{TemplateFile: filepath.Join(dir, "missing.tpl")}).init("missing"))
+	assert.Error(t, (&X509Options{Template: `{}`, TemplateData: []byte(`{`)}).init("data"))
+}
+
+func TestX509Options_withDefault(t *testing.T) {
+	def := &X509Options{Template: `{"subject": {"organizationalUnit": ["Engineering"]}}`}
+	assert.FatalError(t, def.InitDefault())
+	defData := &X509Options{Template: `{}`, TemplateData: []byte(`{"oid": "1.2.3.4"}`), Limits: &TemplateLimits{MaxOutputSize: 1024}}
+	assert.FatalError(t, defData.InitDefault())
+	own := &X509Options{Template: `{"subject": {"commonName": "own"}}`}
+	assert.FatalError(t, own.init("own"))
+	data := &X509Options{TemplateData: []byte(`{"oid": "1.2.3.5"}`), DisableUserData: true}
+	assert.FatalError(t, data.init("data"))
+	limits := &X509Options{Limits: &TemplateLimits{MaxOutputSize: 2048}}
+	assert.FatalError(t, limits.init("limits"))
+
+	tests := map[string]struct {
+		options    *X509Options
+		def        *X509Options
+		wantSource string
+		wantData   interface{}
+		wantErr    bool
+	}{
+		"ok nil":                {nil, nil, "", nil, false},
+		"ok provisioner":        {own, def, TemplateSourceProvisioner, nil, false},
+		"ok provisioner no def": {own, nil, TemplateSourceProvisioner, nil, false},
+		"ok authority":          {nil, def, TemplateSourceAuthority, nil, false},
+		"ok authority data":     {nil, defData, TemplateSourceAuthority, map[string]interface{}{"oid": "1.2.3.4"}, false},
+		"ok provisioner data":   {data, def, TemplateSourceAuthority, map[string]interface{}{"oid": "1.2.3.5"}, false},
+		"ok provisioner limits": {limits, def, TemplateSourceAuthority, nil, false},
+		"ok built-in":           {data, nil, "", nil, false},
+		"fail ambiguous data":   {data, defData, "", nil, true},
+		"fail ambiguous limits": {limits, defData, "", nil, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.options.withDefault(tt.def, "test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("X509Options.withDefault() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantSource == "" {
+				assert.False(t, got.hasTemplate())
+				return
+			}
+			assert.True(t, got.hasTemplate())
+			assert.Equals(t, tt.wantSource, got.source)
+			assert.Equals(t, tt.wantData, got.data)
+		})
+	}
+
+	// The provisioner options override the default ones, without modifying
+	// them.
+	got, err := data.withDefault(def, "test")
+	assert.FatalError(t, err)
+	assert.True(t, got.DisableUserData)
+	assert.False(t, def.DisableUserData)
+	got, err = limits.withDefault(def, "test")
+	assert.FatalError(t, err)
+	assert.Equals(t, limits.Limits, got.Limits)
+	assert.Nil(t, def.Limits)
+}
+
+func TestX509Options_InitDefault(t *testing.T) {
+	var nilOptions *X509Options
+	assert.NoError(t, nilOptions.InitDefault())
+
+	ok := &X509Options{Template: `{"subject": {"organizationalUnit": ["Engineering"]}}`}
+	assert.NoError(t, ok.InitDefault())
+	assert.True(t, ok.hasTemplate())
+	assert.Equals(t, TemplateSourceAuthority, ok.source)
+
+	assert.Error(t, (&X509Options{}).InitDefault())
+	assert.Error(t, (&X509Options{TemplateData: []byte(`{}`)}).InitDefault())
+	assert.Error(t, (&X509Options{Template: `{{ .Subject `}).InitDefault())
+	assert.Error(t, (&X509Options{Template: `{}`, Limits: &TemplateLimits{MaxOutputSize: -1}}).InitDefault())
+}
+
+func TestX509TemplateSource(t *testing.T) {
+	assert.Equals(t, TemplateSourceDefault, X509TemplateSource(nil))
+	assert.Equals(t, TemplateSourceDefault, X509TemplateSource([]SignOption{defaultPublicKeyValidator{}}))
+	assert.Equals(t, TemplateSourceAuthority, X509TemplateSource([]SignOption{
+		defaultPublicKeyValidator{}, &x509TemplateOption{source: TemplateSourceAuthority},
+	}))
+}
+
+func Test_checkTemplateFields(t *testing.T) {
+	tests := map[string]struct {
+		template string
+		wantErr  string
+	}{
+		"ok":                {template: `{{ .Subject }} {{ .SANs }} {{ .Provisioner.Name }} {{ .AuthorizationCrt.Subject.CommonName }}`},
+		"ok csr":            {template: `{{ toJson .Insecure.CR.Subject.Organization }} {{ .Insecure.CR.DNSNames | first }}`},
+		"ok ssh":            {template: `{{ .Insecure.Cert.KeyId }} {{ .Insecure.Cert.Key.Type }}`},
+		"ok maps":           {template: `{{ .Token.sub }} {{ .Webhooks.device.assetTag }} {{ .TemplateData.foo.bar }}`},
+		"ok range":          {template: `{{ range .SANs }}{{ .Foo }}{{ $.Subject }}{{ end }}`},
+		"ok with":           {template: `{{ with .Insecure.CR }}{{ .Subject.CommonName }}{{ else }}{{ .Subject }}{{ end }}`},
+		"ok variable":       {template: `{{ $cr := .Insecure.CR }}{{ $cr.Foo }}`},
+		"ok method":         {template: `{{ .AuthorizationCrt.Subject.String }}`},
+		"fail field":        {template: `{{ .Foo }}`, wantErr: "test:1:3: .Foo is not a field of the template data"},
+		"fail nested":       {template: `{{ toJson .Insecure.CR.Subject.Org }}`, wantErr: ".Insecure.CR.Subject.Org is not a field"},
+		"fail string":       {template: `{{ .Subject.Name }}`, wantErr: ".Subject.Name is not a field"},
+		"fail unexported":   {template: `{{ .Insecure.Cert.Signature.blob }}`, wantErr: ".Insecure.Cert.Signature.blob is not a field"},
+		"fail if":           {template: `{{ if .Subject }}{{ .Foo }}{{ end }}`, wantErr: ".Foo is not a field"},
+		"fail range else":   {template: `{{ range .SANs }}{{ else }}{{ .Foo }}{{ end }}`, wantErr: ".Foo is not a field"},
+		"fail root":         {template: `{{ range .SANs }}{{ $.Foo }}{{ end }}`, wantErr: "$.Foo is not a field"},
+		"fail parenthesis":  {template: `{{ (.Foo) }}`, wantErr: ".Foo is not a field"},
+		"fail template arg": {template: `{{ define "t" }}{{ end }}{{ template "t" .Foo }}`, wantErr: ".Foo is not a field"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := (&X509Options{Template: tt.template}).init("test")
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.True(t, strings.Contains(err.Error(), tt.wantErr), err.Error())
+			}
+		})
+	}
+}
+
+func TestSSHTemplateOptions_init(t *testing.T) {
+	var nilOptions *SSHTemplateOptions
+	assert.NoError(t, nilOptions.init("nil"))
+	assert.False(t, nilOptions.hasTemplate())
+	assert.Len(t, 0, sshTemplateSignOptions(nilOptions, "nil", ""))
+
+	ok := &SSHTemplateOptions{Template: `{"principals": {{ toJson .Insecure.Cert.ValidPrincipals }}}`}
+	assert.NoError(t, ok.init("ok"))
+	assert.True(t, ok.hasTemplate())
+	assert.Len(t, 1, sshTemplateSignOptions(ok, "ok", ""))
+
+	fail := &SSHTemplateOptions{Template: `{{ .Subject `}
+	err := fail.init("fail")
+	if assert.Error(t, err) {
+		assert.HasPrefix(t, err.Error(), "error parsing ssh template of provisioner fail")
+	}
+
+	domains := &SSHTemplateOptions{HostDomains: []string{".internal.example.com"}}
+	assert.NoError(t, domains.init("domains"))
+	assert.False(t, domains.hasTemplate())
+	assert.Equals(t, []SignOption{sshHostDomainsValidator{".internal.example.com"}}, sshTemplateSignOptions(domains, "domains", ""))
+	assert.Error(t, (&SSHTemplateOptions{HostDomains: []string{"."}}).init("fail"))
+}
+
+func Test_sshTemplateModifier_Modify(t *testing.T) {
+	jwk, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	token, err := generateSimpleToken("issuer", "audience", jwk)
+	assert.FatalError(t, err)
+
+	// A token with the source addresses of an automation certificate.
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key}, new(jose.SignerOptions))
+	assert.FatalError(t, err)
+	sourceToken, err := jose.Signed(sig).Claims(map[string]interface{}{
+		"sub":           "deploy",
+		"sourceAddress": "10.0.0.0/8,192.168.1.1",
+	}).CompactSerialize()
+	assert.FatalError(t, err)
+
+	newModifier := func(s string, data json.RawMessage, tok string) SSHCertModifier {
+		o := &SSHTemplateOptions{Template: s, TemplateData: data}
+		assert.FatalError(t, o.init("test"))
+		if tok == "" {
+			tok = token
+		}
+		so := sshTemplateSignOptions(o, "test", tok)
+		assert.Len(t, 1, so)
+		return so[0].(SSHCertModifier)
+	}
+
+	tests := map[string]struct {
+		template   string
+		data       json.RawMessage
+		token      string
+		extensions map[string]string
+		valid      func(*ssh.Certificate)
+		wantErr    bool
+	}{
+		"ok default": {
+			template: DefaultSSHTemplate,
+			valid: func(cert *ssh.Certificate) {
+				assert.Equals(t, uint32(ssh.UserCert), cert.CertType)
+				assert.Equals(t, "foo", cert.KeyId)
+				assert.Equals(t, []string{"foo"}, cert.ValidPrincipals)
+				assert.Equals(t, map[string]string{"permit-X11-forwarding": ""}, cert.Extensions)
+				assert.Equals(t, map[string]string{"verify-required": ""}, cert.CriticalOptions)
+			},
+		},
+		"ok source-address": {
+			template: `{
+				"keyID": {{ toJson .Token.sub }},
+				"principals": [{{ toJson .Token.sub }}],
+				"criticalOptions": {
+					"source-address": {{ toJson .Token.sourceAddress }},
+					"force-command": "/usr/local/bin/deploy",
+					"verify-required": ""
+				}
+			}`,
+			token: sourceToken,
+			valid: func(cert *ssh.Certificate) {
+				assert.Equals(t, "deploy", cert.KeyId)
+				assert.Equals(t, []string{"deploy"}, cert.ValidPrincipals)
+				assert.Equals(t, map[string]string{
+					"source-address":  "10.0.0.0/8,192.168.1.1",
+					"force-command":   "/usr/local/bin/deploy",
+					"verify-required": "",
+				}, cert.CriticalOptions)
+			},
+		},
+		"ok strip extension": {
+			template: `{
+				"extensions": {
+					{{- range $k, $v := .Insecure.Cert.Extensions }}
+					{{- if ne $k "permit-port-forwarding" }}
+					{{ toJson $k }}: {{ toJson $v }},
+					{{- end }}
+					{{- end }}
+					"custom@example.com": ""
+				}
+			}`,
+			extensions: map[string]string{
+				"permit-X11-forwarding":  "",
+				"permit-port-forwarding": "",
+				"permit-pty":             "",
+			},
+			valid: func(cert *ssh.Certificate) {
+				assert.Equals(t, map[string]string{
+					"permit-X11-forwarding": "",
+					"permit-pty":            "",
+					"custom@example.com":    "",
+				}, cert.Extensions)
+			},
+		},
+		"ok host": {
+			template: `{"certType": "host", "principals": ["foo.example.com"]}`,
+			valid: func(cert *ssh.Certificate) {
+				assert.Equals(t, uint32(ssh.HostCert), cert.CertType)
+				assert.Equals(t, []string{"foo.example.com"}, cert.ValidPrincipals)
+			},
+		},
+		"fail certType": {template: `{"certType": "foo"}`, wantErr: true},
+		"ok": {
+			template: `{
+				"principals": [{{ toJson .Token.sub }}, {{ toJson .Provisioner.Name }}],
+				"extensions": {"permit-pty": "", "login@example.com": {{ toJson .TemplateData.login }}},
+				"criticalOptions": {"force-command": "/bin/true"}
+			}`,
+			data: []byte(`{"login": "jane"}`),
+			valid: func(cert *ssh.Certificate) {
+				assert.Equals(t, []string{"subject", "test"}, cert.ValidPrincipals)
+				assert.Equals(t, map[string]string{"permit-pty": "", "login@example.com": "jane"}, cert.Extensions)
+				assert.Equals(t, map[string]string{"force-command": "/bin/true"}, cert.CriticalOptions)
+			},
+		},
+		"ok insecure cert": {
+			template: `{"principals": [{{ .Insecure.Cert.KeyId | upper | toJson }}]}`,
+			valid: func(cert *ssh.Certificate) {
+				assert.Equals(t, []string{"FOO"}, cert.ValidPrincipals)
+				assert.Equals(t, map[string]string{"permit-X11-forwarding": ""}, cert.Extensions)
+			},
+		},
+		"fail execute": {template: `{{ fail "bad request" }}`, wantErr: true},
+		"fail json":    {template: `{"principals": `, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				CertType:        ssh.UserCert,
+				KeyId:           "foo",
+				ValidPrincipals: []string{"foo"},
+				Permissions: ssh.Permissions{
+					CriticalOptions: map[string]string{"verify-required": ""},
+					Extensions:      map[string]string{"permit-X11-forwarding": ""},
+				},
+			}
+			if tt.extensions != nil {
+				cert.Extensions = tt.extensions
+			}
+			err := newModifier(tt.template, tt.data, tt.token).Modify(cert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sshTemplateModifier.Modify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.valid != nil {
+				tt.valid(cert)
+			}
+		})
+	}
+}
+
+func Test_newTemplateData(t *testing.T) {
+	jwk, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	token, err := generateSimpleToken("issuer", "audience", jwk)
+	assert.FatalError(t, err)
+
+	data := newTemplateData("subject", []string{"foo.example.com"}, token)
+	assert.Equals(t, "subject", data.Subject)
+	assert.Equals(t, []string{"foo.example.com"}, data.SANs)
+	assert.Equals(t, "issuer", data.Token["iss"])
+
+	data = newTemplateData("subject", nil, "not-a-token")
+	assert.Nil(t, data.Token)
+}
+
+func Test_templateSignOptions(t *testing.T) {
+	tmpl := &X509Options{Template: `{}`}
+	assert.FatalError(t, tmpl.init("test"))
+	webhooks := []*Webhook{{Name: "device", URL: "https://example.com", Kind: WebhookKindEnriching}}
+
+	assert.Len(t, 0, templateSignOptions(context.Background(), nil, nil, "test", &TemplateData{}))
+	assert.Len(t, 1, templateSignOptions(context.Background(), tmpl, nil, "test", &TemplateData{}))
+	assert.Len(t, 1, templateSignOptions(context.Background(), nil, webhooks, "test", &TemplateData{}))
+	data := &TemplateData{}
+	so := templateSignOptions(context.Background(), tmpl, webhooks, "test", data)
+	assert.Len(t, 2, so)
+	assert.Equals(t, TemplateProvisionerData{Name: "test"}, data.Provisioner)
+	for _, o := range so {
+		_, ok := o.(CertificateEnricher)
+		assert.True(t, ok)
+	}
+}
+
+func Test_x509TemplateOption_Option(t *testing.T) {
+	newOption := func(s string, data *TemplateData) *x509TemplateOption {
+		o := &X509Options{Template: s}
+		assert.FatalError(t, o.init("test"))
+		return &x509TemplateOption{ctx: context.Background(), template: o.template, data: data}
+	}
+
+	csr := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "requested"},
+		DNSNames: []string{"requested.example.com"},
+	}
+
+	tests := map[string]struct {
+		template string
+		data     *TemplateData
+		valid    func(*x509.Certificate)
+		wantErr  bool
+	}{
+		"ok": {
+			template: `{
+				"subject": {"commonName": {{ toJson .Subject }}, "organization": ["Smallstep"]},
+				"dnsNames": {{ toJson .SANs }},
+				"ipAddresses": ["127.0.0.1"],
+				"uris": ["spiffe://example.com/foo"],
+				"emailAddresses": ["jane@example.com"],
+				"keyUsage": ["digitalSignature", "keyEncipherment"],
+				"extKeyUsage": ["serverAuth", "clientAuth"]
+			}`,
+			data: &TemplateData{Subject: "foo.example.com", SANs: []string{"foo.example.com", "bar.example.com"}},
+			valid: func(crt *x509.Certificate) {
+				u, _ := url.Parse("spiffe://example.com/foo")
+				assert.Equals(t, pkix.Name{CommonName: "foo.example.com", Organization: []string{"Smallstep"}}, crt.Subject)
+				assert.Equals(t, []string{"foo.example.com", "bar.example.com"}, crt.DNSNames)
+				assert.Equals(t, []net.IP{net.ParseIP("127.0.0.1")}, crt.IPAddresses)
+				assert.Equals(t, []*url.URL{u}, crt.URIs)
+				assert.Equals(t, []string{"jane@example.com"}, crt.EmailAddresses)
+				assert.Equals(t, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment, crt.KeyUsage)
+				assert.Equals(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, crt.ExtKeyUsage)
+			},
+		},
+		"ok webhook extension": {
+			template: `{"extensions": [{"id": "1.2.3.4", "critical": false, "value": {{ .Webhooks.device.assetTag | b64enc | toJson }}}]}`,
+			data:     &TemplateData{Webhooks: map[string]interface{}{"device": map[string]interface{}{"assetTag": "A-1234"}}},
+			valid: func(crt *x509.Certificate) {
+				assert.Len(t, 1, crt.ExtraExtensions)
+				assert.Equals(t, asn1.ObjectIdentifier{1, 2, 3, 4}, crt.ExtraExtensions[0].Id)
+				assert.Equals(t, []byte("A-1234"), crt.ExtraExtensions[0].Value)
+			},
+		},
+		"ok insecure csr": {
+			template: `{"subject": {"commonName": {{ toJson .Insecure.CR.Subject.CommonName }}}}`,
+			data:     &TemplateData{},
+			valid: func(crt *x509.Certificate) {
+				assert.Equals(t, "requested", crt.Subject.CommonName)
+				assert.Equals(t, []string{"requested.example.com"}, crt.DNSNames)
+			},
+		},
+		"fail execute":   {template: `{{ fail "bad request" }}`, data: &TemplateData{}, wantErr: true},
+		"fail json":      {template: `{"subject": `, data: &TemplateData{}, wantErr: true},
+		"fail ip":        {template: `{"ipAddresses": ["foo"]}`, data: &TemplateData{}, wantErr: true},
+		"fail uri":       {template: `{"uris": ["%%"]}`, data: &TemplateData{}, wantErr: true},
+		"fail keyUsage":  {template: `{"keyUsage": ["foo"]}`, data: &TemplateData{}, wantErr: true},
+		"fail extKeyUse": {template: `{"extKeyUsage": ["foo"]}`, data: &TemplateData{}, wantErr: true},
+		"fail oid":       {template: `{"extensions": [{"id": "1.foo", "value": "AA=="}]}`, data: &TemplateData{}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			o := newOption(tt.template, tt.data)
+			assert.FatalError(t, o.Enrich(csr))
+			prof := &x509util.Leaf{}
+			prof.SetSubject(&x509.Certificate{
+				Subject:  csr.Subject,
+				DNSNames: csr.DNSNames,
+			})
+			err := o.Option(Options{NotAfter: NewTimeDuration(time.Now())})(prof)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("x509TemplateOption.Option() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.valid != nil {
+				tt.valid(prof.Subject())
+			}
+		})
+	}
+}
+
+func Test_x509TemplateOption_userData(t *testing.T) {
+	o := &X509Options{Template: `{"extensions": [{"id": "1.2.3.4", "critical": false, "value": {{ .Insecure.User.deploymentID | b64enc | toJson }}}]}`}
+	assert.FatalError(t, o.init("test"))
+	so := templateSignOptions(context.Background(), o, nil, "test", &TemplateData{})
+	assert.Len(t, 1, so)
+	opts := Options{UserData: map[string]interface{}{"deploymentID": "d-1234"}}
+
+	prof := &x509util.Leaf{}
+	prof.SetSubject(&x509.Certificate{})
+	assert.FatalError(t, so[0].(ProfileModifier).Option(opts)(prof))
+	exts := prof.Subject().ExtraExtensions
+	assert.Len(t, 1, exts)
+	assert.Equals(t, asn1.ObjectIdentifier{1, 2, 3, 4}, exts[0].Id)
+	assert.Equals(t, []byte("d-1234"), exts[0].Value)
+
+	// The provisioner can reject the template data.
+	o.DisableUserData = true
+	assert.False(t, o.AllowsUserData())
+	so = templateSignOptions(context.Background(), o, nil, "test", &TemplateData{})
+	err := so[0].(ProfileModifier).Option(opts)(prof)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "does not allow template data"), err.Error())
+	}
+	var nilOptions *X509Options
+	assert.True(t, nilOptions.AllowsUserData())
+}
+
+func TestParseUserData(t *testing.T) {
+	v, err := ParseUserData([]byte(`{"deploymentID": "d-1234", "labels": {"team": ["infra"]}}`))
+	assert.FatalError(t, err)
+	assert.Equals(t, map[string]interface{}{
+		"deploymentID": "d-1234",
+		"labels":       map[string]interface{}{"team": []interface{}{"infra"}},
+	}, v)
+
+	_, err = ParseUserData([]byte(`{"a": [[[{"b": 1}]]]}`))
+	assert.FatalError(t, err)
+
+	tests := map[string]struct {
+		data    string
+		wantErr string
+	}{
+		"oversized":  {`{"a": "` + strings.Repeat("a", MaxUserDataSize) + `"}`, "templateData cannot be larger than 4096 bytes"},
+		"too deep":   {`{"a": [[[{"b": [1]}]]]}`, "templateData cannot be nested more than 5 levels"},
+		"not object": {`["a"]`, "error parsing templateData: it must be a JSON object"},
+		"bad json":   {`{`, "error parsing templateData: it must be a JSON object"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseUserData([]byte(tt.data))
+			if assert.Error(t, err) {
+				assert.HasPrefix(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseObjectIdentifier(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    asn1.ObjectIdentifier
+		wantErr bool
+	}{
+		{"1.2.3.4", asn1.ObjectIdentifier{1, 2, 3, 4}, false},
+		{"1.3.6.1.4.1.37476.9000.64.1", asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37476, 9000, 64, 1}, false},
+		{"1", nil, true},
+		{"", nil, true},
+		{"1.-2", nil, true},
+		{"1.a", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseObjectIdentifier(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseObjectIdentifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equals(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package provisioner
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// uriRule is a parsed URI rule of a policy, like
+// "spiffe://example.org/ns/prod". The host is an exact name, a wildcard or a
+// subtree like the DNS names of the policy, and the optional path is a prefix
+// that matches whole segments.
+type uriRule struct {
+	scheme string
+	host   string
+	path   string
+}
+
+// parseURIRule parses a URI rule, it returns false if the rule does not have
+// a scheme and a valid host, or if the path does not start with a slash.
+func parseURIRule(s string) (uriRule, bool) {
+	i := strings.Index(s, "://")
+	if i <= 0 {
+		return uriRule{}, false
+	}
+	scheme, rest := s[:i], s[i+3:]
+	if !isValidURIScheme(scheme) {
+		return uriRule{}, false
+	}
+	host, path := rest, ""
+	if j := strings.Index(rest, "/"); j >= 0 {
+		host, path = rest[:j], rest[j:]
+	}
+	if !isValidPolicyName(host) {
+		return uriRule{}, false
+	}
+	host, _ = normalizePolicyName(host)
+	if !isValidURIPath(path) {
+		return uriRule{}, false
+	}
+	return uriRule{scheme: strings.ToLower(scheme), host: host, path: path}, true
+}
+
+// isValidURIScheme returns true if the scheme has the characters of RFC 3986.
+func isValidURIScheme(scheme string) bool {
+	for i, c := range scheme {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return scheme != ""
+}
+
+// isValidURIPath returns true if the path is empty, or is absolute and
+// without dot segments that could escape a path prefix.
+func isValidURIPath(path string) bool {
+	if path == "" {
+		return true
+	}
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(path[1:], "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// uriPolicy evaluates the URI SANs of the X.509 certificates with the URI
+// rules of a policy. The denied rules take precedence over the allowed ones.
+type uriPolicy struct {
+	allowed []string
+	denied  []string
+	layer   string
+}
+
+// validateURIPolicy validates the URI rules of the policy kind, e.g.
+// x509Policy, of the owner, e.g. "provisioner foo".
+func validateURIPolicy(kind, owner string, p uriPolicy) error {
+	for _, rules := range [][]string{p.allowed, p.denied} {
+		for _, s := range rules {
+			if _, ok := parseURIRule(s); !ok {
+				return errors.Errorf("%s: %s URI %q is not valid, it must be like scheme://host/path", owner, kind, s)
+			}
+		}
+	}
+	return nil
+}
+
+// isEmpty returns true if the policy allows all the URIs.
+func (p uriPolicy) isEmpty() bool {
+	return len(p.allowed) == 0 && len(p.denied) == 0
+}
+
+// denyReason returns the reason why the URI is not allowed, naming the rule
+// that rejects it, or an empty string if it is allowed. The relative URIs, the
+// URIs without a host, like the URNs, and the URIs with dot segments are not
+// valid.
+func (p uriPolicy) denyReason(u *url.URL) string {
+	if p.isEmpty() {
+		return ""
+	}
+	if u == nil || u.Scheme == "" || u.Host == "" || u.Opaque != "" || !isValidURIPath(u.Path) {
+		return "is not a valid URI"
+	}
+	host, ok := normalizePolicyName(u.Hostname())
+	if !ok || host == "" || strings.HasPrefix(host, ".") || strings.Contains(host, "*") {
+		return "is not a valid URI"
+	}
+	scheme := strings.ToLower(u.Scheme)
+	for _, s := range p.denied {
+		if r, ok := parseURIRule(s); ok && r.scheme == scheme && policyNameOverlaps(r.host, host) && matchesPathPrefix(r.path, u.Path) {
+			return fmt.Sprintf("is denied by the rule %s of %s", s, policyOf(p.layer))
+		}
+	}
+	if len(p.allowed) == 0 {
+		return ""
+	}
+	for _, s := range p.allowed {
+		if r, ok := parseURIRule(s); ok && r.scheme == scheme && policyNameCovers(r.host, host, false) && matchesPathPrefix(r.path, u.Path) {
+			return ""
+		}
+	}
+	return "is not allowed by " + policyOf(p.layer)
+}
+
+// matchesPathPrefix returns true if the prefix is empty, or if the path is the
+// prefix or one of the paths below it: "/ns/prod" matches "/ns/prod" and
+// "/ns/prod/sa/web" but not "/ns/production".
+func matchesPathPrefix(prefix, path string) bool {
+	switch {
+	case prefix == "" || prefix == path:
+		return true
+	case strings.HasSuffix(prefix, "/"):
+		return strings.HasPrefix(path, prefix)
+	default:
+		return strings.HasPrefix(path, prefix+"/")
+	}
+}
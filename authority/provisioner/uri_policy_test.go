@@ -0,0 +1,116 @@
+package provisioner
+
+import (
+	"net/url"
+	"testing"
+)
+
+func Test_validateURIPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  uriPolicy
+		wantErr bool
+	}{
+		{"ok-empty", uriPolicy{}, false},
+		{"ok", uriPolicy{
+			allowed: []string{"spiffe://example.org", "spiffe://example.org/ns/prod/", "https://*.example.com/api", "spiffe://.example.org"},
+			denied:  []string{"SPIFFE://example.org/ns/prod/sa/admin"},
+		}, false},
+		{"fail-relative", uriPolicy{allowed: []string{"/ns/prod"}}, true},
+		{"fail-no-scheme", uriPolicy{allowed: []string{"://example.org"}}, true},
+		{"fail-scheme", uriPolicy{allowed: []string{"1spiffe://example.org"}}, true},
+		{"fail-no-host", uriPolicy{denied: []string{"spiffe:///ns/prod"}}, true},
+		{"fail-host", uriPolicy{allowed: []string{"spiffe://www.*.example.org"}}, true},
+		{"fail-urn", uriPolicy{allowed: []string{"urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6"}}, true},
+		{"fail-dot-segment", uriPolicy{allowed: []string{"spiffe://example.org/ns/../admin"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateURIPolicy("x509Policy", "test", tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("validateURIPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_uriPolicy_denyReason(t *testing.T) {
+	spiffe := uriPolicy{
+		allowed: []string{"spiffe://example.org/ns/prod", "spiffe://example.org/ns/dev/", "https://*.example.com", "spiffe://.mesh.example.org"},
+		denied:  []string{"spiffe://example.org/ns/prod/sa/admin", "spiffe://legacy.mesh.example.org"},
+	}
+	tests := []struct {
+		name   string
+		policy uriPolicy
+		uri    string
+		want   string
+	}{
+		{"ok-empty", uriPolicy{}, "anything", ""},
+		{"ok-trust-domain", spiffe, "spiffe://example.org/ns/prod/sa/web", ""},
+		{"ok-prefix", spiffe, "spiffe://example.org/ns/prod", ""},
+		{"ok-prefix-slash", spiffe, "spiffe://example.org/ns/dev/sa/web", ""},
+		{"ok-case", spiffe, "SPIFFE://Example.ORG/ns/prod/sa/web", ""},
+		{"ok-wildcard", spiffe, "https://www.example.com/index.html", ""},
+		{"ok-subtree", spiffe, "spiffe://eu.prod.mesh.example.org/sa/web", ""},
+		{"fail-foreign-trust-domain", spiffe, "spiffe://other.org/ns/prod/sa/web",
+			"is not allowed by the provisioner policy"},
+		{"fail-sub-trust-domain", spiffe, "spiffe://evil.example.org/ns/prod/sa/web",
+			"is not allowed by the provisioner policy"},
+		{"fail-path-prefix", spiffe, "spiffe://example.org/ns/production/sa/web",
+			"is not allowed by the provisioner policy"},
+		{"fail-path-outside", spiffe, "spiffe://example.org/ns/staging",
+			"is not allowed by the provisioner policy"},
+		{"fail-path-slash", spiffe, "spiffe://example.org/ns/dev",
+			"is not allowed by the provisioner policy"},
+		{"fail-path-case", spiffe, "spiffe://example.org/NS/prod/sa/web",
+			"is not allowed by the provisioner policy"},
+		{"fail-scheme", spiffe, "http://www.example.com",
+			"is not allowed by the provisioner policy"},
+		{"fail-wildcard-depth", spiffe, "https://a.www.example.com",
+			"is not allowed by the provisioner policy"},
+		{"fail-denied", spiffe, "spiffe://example.org/ns/prod/sa/admin",
+			"is denied by the rule spiffe://example.org/ns/prod/sa/admin of the provisioner policy"},
+		{"fail-denied-below", spiffe, "spiffe://example.org/ns/prod/sa/admin/x",
+			"is denied by the rule spiffe://example.org/ns/prod/sa/admin of the provisioner policy"},
+		{"fail-denied-host", spiffe, "spiffe://legacy.mesh.example.org/sa/web",
+			"is denied by the rule spiffe://legacy.mesh.example.org of the provisioner policy"},
+		{"fail-relative", spiffe, "/ns/prod/sa/web", "is not a valid URI"},
+		{"fail-no-host", spiffe, "spiffe:///ns/prod", "is not a valid URI"},
+		{"fail-urn", spiffe, "urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6", "is not a valid URI"},
+		{"fail-dot-segment", spiffe, "spiffe://example.org/ns/prod/../../admin", "is not a valid URI"},
+		{"fail-wildcard-host", spiffe, "https://*.example.com", "is not a valid URI"},
+		{"fail-garbage", spiffe, "spiffe//example.org", "is not a valid URI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.uri)
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			if got := tt.policy.denyReason(u); got != tt.want {
+				t.Errorf("uriPolicy.denyReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_matchesPathPrefix(t *testing.T) {
+	tests := []struct {
+		prefix, path string
+		want         bool
+	}{
+		{"", "", true},
+		{"", "/foo", true},
+		{"/", "/foo", true},
+		{"/", "", false},
+		{"/foo", "/foo", true},
+		{"/foo", "/foo/bar", true},
+		{"/foo", "/foobar", false},
+		{"/foo/", "/foo/bar", true},
+		{"/foo/", "/foo", false},
+	}
+	for _, tt := range tests {
+		if got := matchesPathPrefix(tt.prefix, tt.path); got != tt.want {
+			t.Errorf("matchesPathPrefix(%q, %q) = %v, want %v", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
@@ -644,6 +644,7 @@ func generateToken(sub, iss, aud string, email string, sans []string, iat time.T
 		jose.Claims
 		Email string   `json:"email"`
 		SANS  []string `json:"sans"`
+		Nonce string   `json:"nonce"`
 	}{
 		Claims: jose.Claims{
 			ID:        id,
@@ -656,6 +657,7 @@ func generateToken(sub, iss, aud string, email string, sans []string, iat time.T
 		},
 		Email: email,
 		SANS:  sans,
+		Nonce: id,
 	}
 	return jose.Signed(sig).Claims(claims).CompactSerialize()
 }
@@ -691,6 +693,25 @@ func getK8sSAPayload() *k8sSAPayload {
 	}
 }
 
+func getK8sSAProjectedPayload() *k8sSAPayload {
+	now := time.Now()
+	return &k8sSAPayload{
+		Claims: jose.Claims{
+			Issuer:    "https://kubernetes.default.svc",
+			Subject:   "system:serviceaccount:ns-foo:san-foo",
+			Audience:  []string{testAudiences.Sign[0]},
+			IssuedAt:  jose.NewNumericDate(now),
+			NotBefore: jose.NewNumericDate(now),
+			Expiry:    jose.NewNumericDate(now.Add(time.Hour)),
+		},
+		Kubernetes: &k8sSAProjectedClaims{
+			Namespace:      "ns-foo",
+			ServiceAccount: k8sSAObjectClaim{Name: "san-foo", UID: "sauid-foo"},
+			Pod:            &k8sSAObjectClaim{Name: "pod-foo", UID: "poduid-foo"},
+		},
+	}
+}
+
 func generateK8sSAToken(jwk *jose.JSONWebKey, claims *k8sSAPayload, tokOpts ...tokOption) (string, error) {
 	so := new(jose.SignerOptions)
 	so.WithHeader("kid", jwk.KeyID)
@@ -0,0 +1,277 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/tracing"
+)
+
+const (
+	// WebhookKindEnriching is the kind of the webhooks that add data to the
+	// certificate templates.
+	WebhookKindEnriching = "ENRICHING"
+	// WebhookKindSCEPChallenge is the kind of the webhooks that validate the
+	// challenge passwords of a SCEP provisioner.
+	WebhookKindSCEPChallenge = "SCEPCHALLENGE"
+	// WebhookKindSSHCheckHost is the kind of the webhook that checks if a
+	// principal belongs to a known host in the /ssh/check-host requests.
+	WebhookKindSSHCheckHost = "SSHCHECKHOST"
+)
+
+// maxWebhookResponseSize is the maximum size in bytes that a webhook response
+// can have.
+const maxWebhookResponseSize = 64 * 1024
+
+// defaultWebhookTimeout is the time that the CA will wait for a webhook
+// response.
+const defaultWebhookTimeout = 10 * time.Second
+
+var webhookNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// webhookClient is the http client used to call the webhooks.
+var webhookClient = &http.Client{
+	Timeout: defaultWebhookTimeout,
+}
+
+// Webhook is an external endpoint called by the CA during the signing flow.
+//
+// Enriching webhooks receive the token claims and the certificate request, and
+// must return a flat JSON object that will be available in the certificate
+// templates as {{ .Webhooks.<name> }}.
+//
+// SCEP challenge webhooks receive the challenge password, the transaction id
+// and the certificate request, and must return {"allow": true} to approve the
+// enrollment.
+//
+// SSH check host webhooks receive the principal and if the CA has a valid host
+// certificate for it, and must return {"exists": true} if the principal is a
+// known host.
+type Webhook struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Kind        string `json:"kind"`
+	BearerToken string `json:"bearerToken,omitempty"`
+	// Timeout is the time to wait for the webhook response, it defaults to 10
+	// seconds.
+	Timeout *Duration `json:"timeout,omitempty"`
+}
+
+// Validate validates the webhook configuration.
+func (w *Webhook) Validate() error {
+	switch {
+	case w == nil:
+		return errors.New("webhook cannot be empty")
+	case !webhookNameRegexp.MatchString(w.Name):
+		return errors.Errorf("invalid webhook name '%s'", w.Name)
+	case w.Kind != WebhookKindEnriching && w.Kind != WebhookKindSCEPChallenge && w.Kind != WebhookKindSSHCheckHost:
+		return errors.Errorf("webhook %s: unsupported kind '%s'", w.Name, w.Kind)
+	case w.Timeout != nil && w.Timeout.Value() <= 0:
+		return errors.Errorf("webhook %s: timeout must be greater than 0", w.Name)
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return errors.Wrapf(err, "webhook %s: error parsing url", w.Name)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.Errorf("webhook %s: url must use http or https", w.Name)
+	}
+	return nil
+}
+
+// publicWebhooks returns a copy of the webhooks without the bearer tokens.
+func publicWebhooks(webhooks []*Webhook) []*Webhook {
+	if webhooks == nil {
+		return nil
+	}
+	public := make([]*Webhook, len(webhooks))
+	for i, w := range webhooks {
+		c := *w
+		c.BearerToken = ""
+		public[i] = &c
+	}
+	return public
+}
+
+// validateWebhooks validates a list of webhooks and checks that the names are
+// not repeated and that all of them are of the given kind.
+func validateWebhooks(webhooks []*Webhook, kind string) error {
+	names := make(map[string]bool, len(webhooks))
+	for _, w := range webhooks {
+		if err := w.Validate(); err != nil {
+			return err
+		}
+		if w.Kind != kind {
+			return errors.Errorf("webhook %s: kind '%s' is not supported by this provisioner", w.Name, w.Kind)
+		}
+		if names[w.Name] {
+			return errors.Errorf("webhook %s is defined more than once", w.Name)
+		}
+		names[w.Name] = true
+	}
+	return nil
+}
+
+// webhookRequestBody is the body sent to the webhooks.
+type webhookRequestBody struct {
+	Provisioner            string                     `json:"provisioner"`
+	Token                  interface{}                `json:"token,omitempty"`
+	SCEPChallenge          string                     `json:"scepChallenge,omitempty"`
+	SCEPTransactionID      string                     `json:"scepTransactionID,omitempty"`
+	X509CertificateRequest *webhookCertificateRequest `json:"x509CertificateRequest,omitempty"`
+	SSHHost                *webhookSSHHost            `json:"sshHost,omitempty"`
+}
+
+// webhookSSHHost is the representation of a check host request sent to the
+// webhooks.
+type webhookSSHHost struct {
+	Principal string `json:"principal"`
+	Exists    bool   `json:"exists"`
+}
+
+// webhookCertificateRequest is the representation of a certificate request
+// sent to the webhooks.
+type webhookCertificateRequest struct {
+	PEM            string   `json:"pem"`
+	CommonName     string   `json:"commonName"`
+	DNSNames       []string `json:"dnsNames,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+	IPAddresses    []net.IP `json:"ipAddresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+}
+
+func newWebhookCertificateRequest(cr *x509.CertificateRequest) *webhookCertificateRequest {
+	uris := make([]string, len(cr.URIs))
+	for i, u := range cr.URIs {
+		uris[i] = u.String()
+	}
+	return &webhookCertificateRequest{
+		PEM: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE REQUEST",
+			Bytes: cr.Raw,
+		})),
+		CommonName:     cr.Subject.CommonName,
+		DNSNames:       cr.DNSNames,
+		EmailAddresses: cr.EmailAddresses,
+		IPAddresses:    cr.IPAddresses,
+		URIs:           uris,
+	}
+}
+
+// webhookController is a SignOption that calls the provisioner webhooks and
+// stores the responses in the template data.
+type webhookController struct {
+	ctx             context.Context
+	provisionerName string
+	webhooks        []*Webhook
+	data            *TemplateData
+}
+
+// Enrich calls the enriching webhooks with the given certificate request and
+// adds the responses to the template data.
+func (c *webhookController) Enrich(cr *x509.CertificateRequest) error {
+	body := &webhookRequestBody{
+		Provisioner:            c.provisionerName,
+		X509CertificateRequest: newWebhookCertificateRequest(cr),
+	}
+	if c.data.Token != nil {
+		body.Token = c.data.Token
+	}
+	for _, w := range c.webhooks {
+		if w.Kind != WebhookKindEnriching {
+			continue
+		}
+		resp, err := w.call(c.ctx, body)
+		if err != nil {
+			return err
+		}
+		c.data.SetWebhook(w.Name, resp)
+	}
+	return nil
+}
+
+// CheckSSHHost calls an SSHCHECKHOST webhook with the given principal and the
+// result of the lookup in the CA database, and returns if the webhook reports
+// the principal as a known host.
+func (w *Webhook) CheckSSHHost(ctx context.Context, principal string, exists bool) (bool, error) {
+	if w.Kind != WebhookKindSSHCheckHost {
+		return false, errors.Errorf("webhook %s: kind '%s' cannot check ssh hosts", w.Name, w.Kind)
+	}
+	resp, err := w.call(ctx, &webhookRequestBody{
+		SSHHost: &webhookSSHHost{
+			Principal: principal,
+			Exists:    exists,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	ok, _ := resp["exists"].(bool)
+	return ok, nil
+}
+
+// call sends the given body to the webhook and returns the decoded response.
+func (w *Webhook) call(ctx context.Context, body *webhookRequestBody) (data map[string]interface{}, err error) {
+	ctx, span := tracing.Start(ctx, "provisioner.callWebhook")
+	span.SetAttributes(tracing.String("webhook.name", w.Name), tracing.String("webhook.kind", w.Kind))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "webhook %s: error marshaling request", w.Name)
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "webhook %s: error creating request", w.Name)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.BearerToken)
+	}
+
+	client := webhookClient
+	if w.Timeout != nil {
+		client = &http.Client{Timeout: w.Timeout.Value()}
+	}
+	resp, err := tracing.Do(client, nil, req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "webhook %s: error calling %s", w.Name, w.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errors.Errorf("webhook %s: %s responded with status code %d", w.Name, w.URL, resp.StatusCode)
+	}
+
+	b, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "webhook %s: error reading response", w.Name)
+	}
+	if len(b) > maxWebhookResponseSize {
+		return nil, errors.Errorf("webhook %s: response exceeds the maximum size of %d bytes", w.Name, maxWebhookResponseSize)
+	}
+
+	if err := json.Unmarshal(b, &data); err != nil || data == nil {
+		return nil, errors.Errorf("webhook %s: response is not a JSON object", w.Name)
+	}
+	for k, v := range data {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, errors.Errorf("webhook %s: response is not a flat JSON object, property '%s' is not a string, number, boolean or null", w.Name, k)
+		}
+	}
+	return data, nil
+}
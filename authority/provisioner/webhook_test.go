@@ -0,0 +1,143 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestWebhook_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		w       *Webhook
+		wantErr bool
+	}{
+		{"ok", &Webhook{Name: "device_1", URL: "https://example.com/hook", Kind: WebhookKindEnriching}, false},
+		{"ok http", &Webhook{Name: "device", URL: "http://localhost:8080", Kind: WebhookKindEnriching}, false},
+		{"fail nil", nil, true},
+		{"fail name", &Webhook{Name: "1device", URL: "https://example.com/hook", Kind: WebhookKindEnriching}, true},
+		{"fail name chars", &Webhook{Name: "dev-ice", URL: "https://example.com/hook", Kind: WebhookKindEnriching}, true},
+		{"ok scep challenge", &Webhook{Name: "mdm", URL: "https://example.com/hook", Kind: WebhookKindSCEPChallenge}, false},
+		{"ok timeout", &Webhook{Name: "device", URL: "https://example.com/hook", Kind: WebhookKindEnriching, Timeout: &Duration{Duration: time.Second}}, false},
+		{"fail kind", &Webhook{Name: "device", URL: "https://example.com/hook", Kind: "AUTHORIZING"}, true},
+		{"fail timeout", &Webhook{Name: "device", URL: "https://example.com/hook", Kind: WebhookKindEnriching, Timeout: &Duration{}}, true},
+		{"fail url", &Webhook{Name: "device", URL: "%%", Kind: WebhookKindEnriching}, true},
+		{"fail scheme", &Webhook{Name: "device", URL: "ftp://example.com", Kind: WebhookKindEnriching}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.w.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Webhook.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateWebhooks(t *testing.T) {
+	w1 := &Webhook{Name: "device", URL: "https://example.com/hook", Kind: WebhookKindEnriching}
+	w2 := &Webhook{Name: "user", URL: "https://example.com/hook", Kind: WebhookKindEnriching}
+	w3 := &Webhook{Name: "mdm", URL: "https://example.com/hook", Kind: WebhookKindSCEPChallenge}
+	assert.NoError(t, validateWebhooks(nil, WebhookKindEnriching))
+	assert.NoError(t, validateWebhooks([]*Webhook{w1, w2}, WebhookKindEnriching))
+	assert.NoError(t, validateWebhooks([]*Webhook{w3}, WebhookKindSCEPChallenge))
+	assert.Error(t, validateWebhooks([]*Webhook{w1, w2, w1}, WebhookKindEnriching))
+	assert.Error(t, validateWebhooks([]*Webhook{w1, {Name: "bad-name"}}, WebhookKindEnriching))
+	assert.Error(t, validateWebhooks([]*Webhook{w1, w3}, WebhookKindEnriching))
+}
+
+func Test_webhookController_Enrich(t *testing.T) {
+	var gotBody webhookRequestBody
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/ok":
+			if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"assetTag":"A-1234","managed":true,"owner":null}`)
+		case "/status":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "/big":
+			fmt.Fprintf(w, `{"data":"%s"}`, strings.Repeat("a", maxWebhookResponseSize))
+		case "/array":
+			fmt.Fprint(w, `["a","b"]`)
+		case "/null":
+			fmt.Fprint(w, `null`)
+		case "/nested":
+			fmt.Fprint(w, `{"device":{"assetTag":"A-1234"}}`)
+		case "/nested-array":
+			fmt.Fprint(w, `{"tags":["a","b"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	csr := &x509.CertificateRequest{
+		Raw:      []byte("raw"),
+		DNSNames: []string{"foo.example.com"},
+	}
+	csr.Subject.CommonName = "foo.example.com"
+
+	newController := func(path, bearer string) *webhookController {
+		return &webhookController{
+			ctx:             context.Background(),
+			provisionerName: "step-cli",
+			webhooks: []*Webhook{{
+				Name: "device", URL: srv.URL + path, Kind: WebhookKindEnriching, BearerToken: bearer,
+			}},
+			data: &TemplateData{Token: map[string]interface{}{"sub": "foo.example.com"}},
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		c := newController("/ok", "secret")
+		assert.FatalError(t, c.Enrich(csr))
+		assert.Equals(t, "Bearer secret", gotAuth)
+		assert.Equals(t, "step-cli", gotBody.Provisioner)
+		assert.Equals(t, map[string]interface{}{"sub": "foo.example.com"}, gotBody.Token)
+		assert.Equals(t, "foo.example.com", gotBody.X509CertificateRequest.CommonName)
+		assert.Equals(t, []string{"foo.example.com"}, gotBody.X509CertificateRequest.DNSNames)
+		assert.True(t, strings.HasPrefix(gotBody.X509CertificateRequest.PEM, "-----BEGIN CERTIFICATE REQUEST-----"))
+		assert.Equals(t, map[string]interface{}{
+			"device": map[string]interface{}{"assetTag": "A-1234", "managed": true, "owner": nil},
+		}, c.data.Webhooks)
+	})
+
+	t.Run("ok no bearer", func(t *testing.T) {
+		c := newController("/ok", "")
+		assert.FatalError(t, c.Enrich(csr))
+		assert.Equals(t, "", gotAuth)
+	})
+
+	failures := map[string]string{
+		"/status":       "responded with status code 403",
+		"/big":          "exceeds the maximum size",
+		"/array":        "is not a JSON object",
+		"/null":         "is not a JSON object",
+		"/nested":       "property 'device'",
+		"/nested-array": "property 'tags'",
+		"/missing":      "responded with status code 404",
+	}
+	for path, msg := range failures {
+		t.Run("fail "+path, func(t *testing.T) {
+			c := newController(path, "")
+			err := c.Enrich(csr)
+			if assert.Error(t, err) {
+				assert.HasPrefix(t, err.Error(), "webhook device: ")
+				assert.True(t, strings.Contains(err.Error(), msg), err.Error())
+			}
+			assert.Nil(t, c.data.Webhooks)
+		})
+	}
+}
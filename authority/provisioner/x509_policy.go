@@ -0,0 +1,511 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/x509util"
+	"golang.org/x/net/idna"
+)
+
+// X509Policy restricts the DNS names, the IP addresses, the email addresses,
+// the URIs and the common name of the X.509 certificates signed by a
+// provisioner. An empty policy allows all the names.
+//
+// The names in the policy are exact names like "www.example.com", wildcards
+// like "*.example.com" which, as in a certificate, cover exactly one label:
+// "www.example.com" but not "example.com" nor "a.www.example.com", or subtrees
+// like ".example.com" which cover the names at any depth below the domain:
+// "www.example.com" and "a.www.example.com" but not "example.com". The names
+// are compared in lower case, without the trailing dot and with the
+// internationalized labels in punycode. The IP ranges are IPv4 or IPv6 CIDRs
+// like "10.0.0.0/8" or single addresses like "10.0.0.1", and they only
+// restrict the IP addresses and the common names that are IP addresses.
+type X509Policy struct {
+	// AllowedDNSNames are the names allowed in the certificates. All the names
+	// are allowed by default. A wildcard name in a certificate is only allowed
+	// by the same wildcard in the policy, or by a subtree if
+	// AllowSubtreeWildcards is set.
+	AllowedDNSNames []string `json:"allowedDNSNames,omitempty"`
+	// DeniedDNSNames are the names never allowed in the certificates. They
+	// take precedence over the allowed names. A wildcard name in a certificate
+	// is denied if it covers any of the denied names.
+	DeniedDNSNames []string `json:"deniedDNSNames,omitempty"`
+	// AllowedIPRanges are the IP ranges allowed in the certificates. All the
+	// addresses are allowed by default.
+	AllowedIPRanges []string `json:"allowedIPRanges,omitempty"`
+	// DeniedIPRanges are the IP ranges never allowed in the certificates. They
+	// take precedence over the allowed ranges.
+	DeniedIPRanges []string `json:"deniedIPRanges,omitempty"`
+	// DefaultIPAction is the action for the IP addresses if the policy has no
+	// IP ranges, "allow", the default, or "deny".
+	DefaultIPAction string `json:"defaultIPAction,omitempty"`
+	// AllowedEmailDomains are the domains allowed in the email addresses of
+	// the certificates, as exact domains like "example.com" or subtrees like
+	// ".example.com". All the domains are allowed by default.
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+	// DeniedEmailDomains are the domains never allowed in the email
+	// addresses. They take precedence over the allowed domains.
+	DeniedEmailDomains []string `json:"deniedEmailDomains,omitempty"`
+	// AllowedEmailLocalParts are the local parts allowed in the email
+	// addresses, as exact names or case-sensitive glob patterns like
+	// "svc-*". All the local parts are allowed by default.
+	AllowedEmailLocalParts []string `json:"allowedEmailLocalParts,omitempty"`
+	// AllowedURIs are the URIs allowed in the certificates, as rules like
+	// "spiffe://example.org/ns/prod" with a scheme, a host with the same
+	// format as AllowedDNSNames and an optional path prefix. All the URIs are
+	// allowed by default.
+	AllowedURIs []string `json:"allowedURIs,omitempty"`
+	// DeniedURIs are the URIs never allowed in the certificates. They take
+	// precedence over the allowed URIs.
+	DeniedURIs []string `json:"deniedURIs,omitempty"`
+	// AllowSubtreeWildcards allows the wildcard names below the subtrees of
+	// AllowedDNSNames, like "*.www.example.com" with ".example.com".
+	AllowSubtreeWildcards bool `json:"allowSubtreeWildcards,omitempty"`
+	// AllowedCommonNames are the common names allowed in the certificates,
+	// with the same rules as AllowedDNSNames. All the common names are allowed
+	// by default. A common name that is an IP address is checked with the IP
+	// ranges instead.
+	AllowedCommonNames []string `json:"allowedCommonNames,omitempty"`
+	// DeniedCommonNames are the common names never allowed in the
+	// certificates, with the same rules as DeniedDNSNames.
+	DeniedCommonNames []string `json:"deniedCommonNames,omitempty"`
+	// DisableCommonName removes the common name from the certificates.
+	DisableCommonName bool `json:"disableCommonName,omitempty"`
+	// RequireCommonNameInSANs rejects the certificates with a common name that
+	// is not one of their SANs.
+	RequireCommonNameInSANs bool `json:"requireCommonNameInSANs,omitempty"`
+	layer                   string
+}
+
+// init validates the names and the IP ranges of the policy of a provisioner.
+func (p *X509Policy) init(name string) error {
+	if p == nil {
+		return nil
+	}
+	return p.validate("provisioner " + name)
+}
+
+// InitAuthority validates the authority policy, the outer boundary of the
+// policies of all the provisioners. The errors of the names rejected by the
+// policy say that the authority policy rejected them.
+func (p *X509Policy) InitAuthority() error {
+	if p == nil {
+		return nil
+	}
+	p.layer = PolicyLayerAuthority
+	return p.validate(PolicyLayerAuthority)
+}
+
+// validate validates the names and the IP ranges of the policy of the owner,
+// e.g. "provisioner foo".
+func (p *X509Policy) validate(owner string) error {
+	if p.DisableCommonName && (p.RequireCommonNameInSANs || len(p.AllowedCommonNames) > 0 || len(p.DeniedCommonNames) > 0) {
+		return errors.Errorf("%s: x509Policy disableCommonName cannot be used with other common name options", owner)
+	}
+	for _, names := range [][]string{p.AllowedDNSNames, p.DeniedDNSNames, p.AllowedCommonNames, p.DeniedCommonNames} {
+		for _, s := range names {
+			if s == "" {
+				return errors.Errorf("%s: x509Policy names cannot be empty", owner)
+			}
+			if !isValidPolicyName(s) {
+				return errors.Errorf("%s: x509Policy name %q is not a valid name", owner, s)
+			}
+		}
+	}
+	if err := validateEmailPolicy("x509Policy", owner, p.emailPolicy()); err != nil {
+		return err
+	}
+	if err := validateURIPolicy("x509Policy", owner, p.uriPolicy()); err != nil {
+		return err
+	}
+	return validateIPPolicy("x509Policy", owner, p.AllowedIPRanges, p.DeniedIPRanges, p.DefaultIPAction)
+}
+
+// isEmpty returns true if the policy does not restrict any SAN.
+func (p *X509Policy) isEmpty() bool {
+	return p == nil || (len(p.AllowedDNSNames) == 0 && len(p.DeniedDNSNames) == 0 &&
+		p.ipPolicy().isEmpty() && p.emailPolicy().isEmpty() && p.uriPolicy().isEmpty())
+}
+
+// uriPolicy returns the evaluator of the URIs of the policy.
+func (p *X509Policy) uriPolicy() uriPolicy {
+	if p == nil {
+		return uriPolicy{}
+	}
+	return uriPolicy{allowed: p.AllowedURIs, denied: p.DeniedURIs, layer: p.layer}
+}
+
+// emailPolicy returns the evaluator of the email addresses of the policy.
+func (p *X509Policy) emailPolicy() emailPolicy {
+	if p == nil {
+		return emailPolicy{}
+	}
+	return emailPolicy{
+		allowedDomains:    p.AllowedEmailDomains,
+		deniedDomains:     p.DeniedEmailDomains,
+		allowedLocalParts: p.AllowedEmailLocalParts,
+		layer:             p.layer,
+	}
+}
+
+// ipPolicy returns the evaluator of the IP ranges of the policy.
+func (p *X509Policy) ipPolicy() ipPolicy {
+	if p == nil {
+		return ipPolicy{}
+	}
+	return ipPolicy{
+		allowed:       p.AllowedIPRanges,
+		denied:        p.DeniedIPRanges,
+		defaultAction: p.DefaultIPAction,
+		layer:         p.layer,
+	}
+}
+
+// hasCommonNameRules returns true if the policy restricts the common name.
+func (p *X509Policy) hasCommonNameRules() bool {
+	return p != nil && (len(p.AllowedCommonNames) > 0 || len(p.DeniedCommonNames) > 0 ||
+		p.DisableCommonName || p.RequireCommonNameInSANs)
+}
+
+// AuthorizeDNSName returns an error if the DNS name is not allowed by the
+// policy.
+func (p *X509Policy) AuthorizeDNSName(name string) error {
+	if reason := p.deny(name); reason != "" {
+		return errors.Errorf("dns name %s %s", name, reason)
+	}
+	return nil
+}
+
+// deny returns the reason why the DNS name is not allowed, or an empty string
+// if it is allowed.
+func (p *X509Policy) deny(name string) string {
+	if p.isEmpty() {
+		return ""
+	}
+	name, ok := normalizePolicyName(name)
+	if !ok || strings.HasPrefix(name, ".") {
+		return "is not a valid name"
+	}
+	for _, s := range p.DeniedDNSNames {
+		if rule, ok := normalizePolicyName(s); ok && policyNameOverlaps(rule, name) {
+			return "is denied by " + policyOf(p.layer)
+		}
+	}
+	if len(p.AllowedDNSNames) == 0 {
+		return ""
+	}
+	for _, s := range p.AllowedDNSNames {
+		if rule, ok := normalizePolicyName(s); ok && policyNameCovers(rule, name, p.AllowSubtreeWildcards) {
+			return ""
+		}
+	}
+	return "is not allowed by " + policyOf(p.layer)
+}
+
+// denyCommonName returns the reason why the common name of a certificate is
+// not allowed, naming the rule that rejects it, or an empty string if it is
+// allowed. A common name that is an IP address is checked with the IP ranges.
+func (p *X509Policy) denyCommonName(cn string, cert *x509.Certificate) string {
+	if cn == "" {
+		return ""
+	}
+	if p.RequireCommonNameInSANs && !isCertificateSAN(cert, cn) {
+		return "is not one of the SANs, required by requireCommonNameInSANs of " + policyOf(p.layer)
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		switch option, rule := p.ipPolicy().deny(ip); option {
+		case "":
+			return ""
+		case "deniedIPRanges":
+			return fmt.Sprintf("is denied by the deniedIPRanges rule %s of %s", rule, policyOf(p.layer))
+		default:
+			return fmt.Sprintf("is not allowed by the %s of %s", option, policyOf(p.layer))
+		}
+	}
+	if len(p.AllowedCommonNames) == 0 && len(p.DeniedCommonNames) == 0 {
+		return ""
+	}
+	name, ok := normalizePolicyName(cn)
+	if !ok || strings.HasPrefix(name, ".") {
+		return "is not a valid name"
+	}
+	for _, s := range p.DeniedCommonNames {
+		if rule, ok := normalizePolicyName(s); ok && policyNameOverlaps(rule, name) {
+			return fmt.Sprintf("is denied by the deniedCommonNames rule %s of %s", s, policyOf(p.layer))
+		}
+	}
+	if len(p.AllowedCommonNames) == 0 {
+		return ""
+	}
+	for _, s := range p.AllowedCommonNames {
+		if rule, ok := normalizePolicyName(s); ok && policyNameCovers(rule, name, p.AllowSubtreeWildcards) {
+			return ""
+		}
+	}
+	return "is not allowed by the allowedCommonNames of " + policyOf(p.layer)
+}
+
+// x509URIValidator implements a validator that checks the URIs of a
+// certificate, after applying the template, with the X.509 policy of the
+// provisioner.
+type x509URIValidator struct {
+	policy *X509Policy
+}
+
+// Valid returns a forbidden error naming the first URI not allowed by the
+// policy.
+func (v *x509URIValidator) Valid(cert *x509.Certificate, o Options) error {
+	for _, u := range cert.URIs {
+		if reason := v.policy.uriPolicy().denyReason(u); reason != "" {
+			return errs.Forbidden("certificate URI %s %s",
+				u, reason, errs.WithMessage("The certificate URI %s %s.", u, reason))
+		}
+	}
+	return nil
+}
+
+// isCertificateSAN returns true if the string is literally one of the SANs of
+// the certificate.
+func isCertificateSAN(cert *x509.Certificate, s string) bool {
+	for _, name := range cert.DNSNames {
+		if name == s {
+			return true
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.String() == s {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == s {
+			return true
+		}
+	}
+	for _, u := range cert.URIs {
+		if u.String() == s {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizeIP returns an error if the IP address is not allowed by the policy.
+func (p *X509Policy) AuthorizeIP(ip net.IP) error {
+	if reason := p.denyIP(ip); reason != "" {
+		return errors.Errorf("IP address %s %s", ip, reason)
+	}
+	return nil
+}
+
+// denyIP returns the reason why the IP address is not allowed, or an empty
+// string if it is allowed.
+func (p *X509Policy) denyIP(ip net.IP) string {
+	return p.ipPolicy().denyReason(ip)
+}
+
+// AuthorizeEmail returns an error if the email address is not allowed by the
+// policy.
+func (p *X509Policy) AuthorizeEmail(email string) error {
+	if reason := p.emailPolicy().denyReason(email); reason != "" {
+		return errors.Errorf("email address %s %s", email, reason)
+	}
+	return nil
+}
+
+// x509PolicySignOptions returns the validators of the X.509 policy, and the
+// modifier that removes the common name if it is disabled, or nil if the
+// policy is empty. They must be added after the template. The common name is
+// validated with the common name options, and with the IP ranges if it is an
+// IP address. The names, the IP addresses, the email addresses and the URIs
+// are validated in the certificate, so the ones added by the template are also
+// checked.
+func x509PolicySignOptions(p *X509Policy) []SignOption {
+	if p == nil {
+		return nil
+	}
+	var so []SignOption
+	if !p.isEmpty() {
+		so = append(so, &x509PolicyValidator{policy: p})
+	}
+	switch {
+	case p.DisableCommonName:
+		so = append(so, disableCommonNameModifier{})
+	case p.hasCommonNameRules() || !p.ipPolicy().isEmpty():
+		so = append(so, &x509CommonNameValidator{policy: p})
+	}
+	if !p.uriPolicy().isEmpty() {
+		so = append(so, &x509URIValidator{policy: p})
+	}
+	return so
+}
+
+// disableCommonNameModifier removes the common name of the certificates.
+type disableCommonNameModifier struct{}
+
+// Option implements the ProfileModifier interface.
+func (disableCommonNameModifier) Option(Options) x509util.WithOption {
+	return func(p x509util.Profile) error {
+		p.Subject().Subject.CommonName = ""
+		return nil
+	}
+}
+
+// x509CommonNameValidator implements a validator that checks the common name
+// of a certificate, after applying the template, with the X.509 policy of the
+// provisioner.
+type x509CommonNameValidator struct {
+	policy *X509Policy
+}
+
+// Valid returns a forbidden error naming the common name and the rule that
+// rejects it.
+func (v *x509CommonNameValidator) Valid(cert *x509.Certificate, o Options) error {
+	cn := cert.Subject.CommonName
+	if reason := v.policy.denyCommonName(cn, cert); reason != "" {
+		return errs.Forbidden("certificate common name %s %s",
+			cn, reason, errs.WithMessage("The certificate common name %s %s.", cn, reason))
+	}
+	return nil
+}
+
+// x509PolicyValidator implements a validator that checks the DNS names, the IP
+// addresses and the email addresses of a certificate, after applying the
+// template, with the X.509 policy of the provisioner.
+type x509PolicyValidator struct {
+	policy *X509Policy
+}
+
+// Valid returns a forbidden error naming the first DNS name, IP address or
+// email address not allowed by the policy.
+func (v *x509PolicyValidator) Valid(cert *x509.Certificate, o Options) error {
+	for _, name := range cert.DNSNames {
+		if reason := v.policy.deny(name); reason != "" {
+			return errs.Forbidden("certificate dns name %s %s",
+				name, reason, errs.WithMessage("The certificate dns name %s %s.", name, reason))
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if reason := v.policy.denyIP(ip); reason != "" {
+			return errs.Forbidden("certificate IP address %s %s",
+				ip, reason, errs.WithMessage("The certificate IP address %s %s.", ip, reason))
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if reason := v.policy.emailPolicy().denyReason(email); reason != "" {
+			return errs.Forbidden("certificate email address %s %s",
+				email, reason, errs.WithMessage("The certificate email address %s %s.", email, reason))
+		}
+	}
+	return nil
+}
+
+// normalizePolicyName returns the name in lower case, without the trailing
+// dot and with the internationalized labels in punycode, as they are
+// resolved. It returns false if a label cannot be converted to punycode.
+func normalizePolicyName(name string) (string, bool) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			labels[i] = strings.ToLower(label)
+			continue
+		}
+		s, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", false
+		}
+		labels[i] = s
+	}
+	return strings.Join(labels, "."), true
+}
+
+// isASCII returns true if s only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidPolicyName returns true if the name is an exact name, a wildcard
+// with a single '*' as the leftmost label, or a subtree starting with a dot.
+func isValidPolicyName(name string) bool {
+	name, ok := normalizePolicyName(name)
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(name, "*.") {
+		name = name[2:]
+	} else if strings.HasPrefix(name, ".") {
+		name = name[1:]
+	}
+	if name == "" {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || strings.Contains(label, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+// policyNameCovers returns true if every name covered by name is also covered
+// by the rule. A wildcard name is only covered by the same wildcard rule or, if
+// subtreeWildcards is true, by a subtree rule of its base domain or above.
+func policyNameCovers(rule, name string, subtreeWildcards bool) bool {
+	if rule == name {
+		return true
+	}
+	if strings.HasPrefix(name, "*.") {
+		return subtreeWildcards && matchesSubtree(rule, name[1:])
+	}
+	return matchesWildcard(rule, name) || matchesSubtree(rule, name)
+}
+
+// policyNameOverlaps returns true if any of the names covered by name is also
+// covered by the rule. A wildcard name overlaps an exact rule one label below
+// its base domain, and a subtree rule of its base domain or above.
+func policyNameOverlaps(rule, name string) bool {
+	if rule == name {
+		return true
+	}
+	if strings.HasPrefix(name, "*.") {
+		return matchesWildcard(name, rule) || matchesSubtree(rule, name[1:])
+	}
+	return matchesWildcard(rule, name) || matchesSubtree(rule, name)
+}
+
+// matchesWildcard returns true if wildcard is a name like "*.example.com" and
+// name is exactly one label below its base domain.
+func matchesWildcard(wildcard, name string) bool {
+	if !strings.HasPrefix(wildcard, "*.") {
+		return false
+	}
+	i := strings.Index(name, ".")
+	if i <= 0 {
+		return false
+	}
+	return name[i+1:] == wildcard[2:]
+}
+
+// matchesSubtree returns true if subtree is a name like ".example.com" and name
+// is below it at any depth. A name starting with a dot, the base domain of a
+// wildcard, is below the subtree if it is the subtree itself.
+func matchesSubtree(subtree, name string) bool {
+	if !strings.HasPrefix(subtree, ".") {
+		return false
+	}
+	if strings.HasPrefix(name, ".") {
+		return strings.HasSuffix(name, subtree)
+	}
+	return len(name) > len(subtree) && strings.HasSuffix(name, subtree)
+}
@@ -0,0 +1,461 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/crypto/x509util"
+)
+
+func TestX509Policy_init(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *X509Policy
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"empty", &X509Policy{}, false},
+		{"ok", &X509Policy{
+			AllowedDNSNames: []string{"*.example.com", "example.com", "www.example.com."},
+			DeniedDNSNames:  []string{"admin.example.com"},
+		}, false},
+		{"fail-empty", &X509Policy{DeniedDNSNames: []string{""}}, true},
+		{"fail-star", &X509Policy{AllowedDNSNames: []string{"*"}}, true},
+		{"fail-inner-wildcard", &X509Policy{AllowedDNSNames: []string{"www.*.example.com"}}, true},
+		{"fail-partial-wildcard", &X509Policy{AllowedDNSNames: []string{"www*.example.com"}}, true},
+		{"fail-empty-label", &X509Policy{DeniedDNSNames: []string{"www..example.com"}}, true},
+		{"ok-subtree", &X509Policy{AllowedDNSNames: []string{".example.com"}, AllowSubtreeWildcards: true}, false},
+		{"ok-idn", &X509Policy{AllowedDNSNames: []string{"bücher.example.com", ".例え.jp"}}, false},
+		{"fail-subtree-dot", &X509Policy{AllowedDNSNames: []string{"."}}, true},
+		{"fail-subtree-wildcard", &X509Policy{AllowedDNSNames: []string{".*.example.com"}}, true},
+		{"fail-subtree-empty-label", &X509Policy{AllowedDNSNames: []string{"..example.com"}}, true},
+		{"fail-idn", &X509Policy{AllowedDNSNames: []string{"-bé.example.com"}}, true},
+		{"ok-ip-ranges", &X509Policy{
+			AllowedIPRanges: []string{"10.0.0.0/8", "2001:db8::/32"},
+			DeniedIPRanges:  []string{"10.0.0.1", "2001:db8::1"},
+		}, false},
+		{"fail-ip-range", &X509Policy{AllowedIPRanges: []string{"10.0.0.0/33"}}, true},
+		{"fail-ip-range-name", &X509Policy{DeniedIPRanges: []string{"example.com"}}, true},
+		{"ok-common-names", &X509Policy{
+			AllowedCommonNames:      []string{"*.example.com", ".internal"},
+			DeniedCommonNames:       []string{"admin.example.com"},
+			RequireCommonNameInSANs: true,
+		}, false},
+		{"ok-disable-common-name", &X509Policy{DisableCommonName: true}, false},
+		{"fail-common-name", &X509Policy{AllowedCommonNames: []string{"www.*.example.com"}}, true},
+		{"fail-disable-require", &X509Policy{DisableCommonName: true, RequireCommonNameInSANs: true}, true},
+		{"ok-default-deny", &X509Policy{DefaultIPAction: "deny"}, false},
+		{"ok-email", &X509Policy{
+			AllowedEmailDomains:    []string{"example.com", ".corp.example.com"},
+			DeniedEmailDomains:     []string{"dev.corp.example.com"},
+			AllowedEmailLocalParts: []string{"svc-*"},
+		}, false},
+		{"fail-email-domain", &X509Policy{AllowedEmailDomains: []string{"*.example.com"}}, true},
+		{"ok-uris", &X509Policy{
+			AllowedURIs: []string{"spiffe://example.org/ns/prod"},
+			DeniedURIs:  []string{"spiffe://example.org/ns/prod/sa/admin"},
+		}, false},
+		{"fail-uri", &X509Policy{AllowedURIs: []string{"example.org/ns/prod"}}, true},
+		{"fail-email-local-part", &X509Policy{AllowedEmailLocalParts: []string{"["}}, true},
+		{"fail-default-action", &X509Policy{DefaultIPAction: "reject"}, true},
+		{"fail-disable-rules", &X509Policy{DisableCommonName: true, DeniedCommonNames: []string{"example.com"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.init("test"); (err != nil) != tt.wantErr {
+				t.Errorf("X509Policy.init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestX509Policy_AuthorizeDNSName(t *testing.T) {
+	policy := &X509Policy{
+		AllowedDNSNames: []string{"*.example.com", "example.com", "*.dev.example.com", "www.example.org"},
+		DeniedDNSNames:  []string{"admin.example.com", "*.prod.example.com"},
+	}
+	tests := []struct {
+		name   string
+		policy *X509Policy
+		dns    string
+		err    string
+	}{
+		{"ok-nil", nil, "*.example.net", ""},
+		{"ok-empty", &X509Policy{}, "*.example.net", ""},
+		{"ok-exact", policy, "example.com", ""},
+		{"ok-one-label", policy, "www.example.com", ""},
+		{"ok-case", policy, "WWW.Example.COM.", ""},
+		{"ok-wildcard", policy, "*.dev.example.com", ""},
+		{"ok-deny-only", &X509Policy{DeniedDNSNames: []string{"admin.example.com"}}, "*.dev.example.com", ""},
+		{"fail-two-labels", policy, "a.www.example.com", "dns name a.www.example.com is not allowed by the provisioner policy"},
+		{"fail-wildcard-base", policy, "www.example.org.example.com", "dns name www.example.org.example.com is not allowed by the provisioner policy"},
+		{"fail-wildcard-not-allowed", policy, "*.example.org", "dns name *.example.org is not allowed by the provisioner policy"},
+		{"fail-wildcard-by-exact", &X509Policy{AllowedDNSNames: []string{"www.example.com"}}, "*.example.com",
+			"dns name *.example.com is not allowed by the provisioner policy"},
+		{"fail-wildcard-deeper", policy, "*.www.example.com", "dns name *.www.example.com is not allowed by the provisioner policy"},
+		{"fail-denied", policy, "admin.example.com", "dns name admin.example.com is denied by the provisioner policy"},
+		{"fail-denied-wildcard", policy, "api.prod.example.com", "dns name api.prod.example.com is denied by the provisioner policy"},
+		{"fail-wildcard-covers-denied", policy, "*.example.com", "dns name *.example.com is denied by the provisioner policy"},
+		{"fail-wildcard-denied", policy, "*.prod.example.com", "dns name *.prod.example.com is denied by the provisioner policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.AuthorizeDNSName(tt.dns)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestX509Policy_AuthorizeDNSName_subtrees(t *testing.T) {
+	policy := &X509Policy{
+		AllowedDNSNames: []string{"*.teams.example.com", ".dev.example.com", "*.wild.example.com", "bücher.example.com"},
+		DeniedDNSNames:  []string{".secret.dev.example.com", "admin.example.com"},
+	}
+	wildcards := &X509Policy{
+		AllowedDNSNames:       []string{".teams.example.com"},
+		DeniedDNSNames:        []string{"admin.ops.teams.example.com"},
+		AllowSubtreeWildcards: true,
+	}
+	denyOnly := &X509Policy{DeniedDNSNames: []string{".example.com", "admin.example.org"}}
+	tests := []struct {
+		name   string
+		policy *X509Policy
+		dns    string
+		err    string
+	}{
+		// A wildcard rule covers one label.
+		{"ok-wildcard-rule", policy, "a.teams.example.com", ""},
+		{"fail-wildcard-rule-two-labels", policy, "a.b.teams.example.com", "dns name a.b.teams.example.com is not allowed by the provisioner policy"},
+		{"fail-wildcard-rule-base", policy, "teams.example.com", "dns name teams.example.com is not allowed by the provisioner policy"},
+		// A subtree rule covers any depth, but not the domain.
+		{"ok-subtree", policy, "a.dev.example.com", ""},
+		{"ok-subtree-deep", policy, "a.b.c.dev.example.com", ""},
+		{"fail-subtree-base", policy, "dev.example.com", "dns name dev.example.com is not allowed by the provisioner policy"},
+		{"fail-subtree-suffix", policy, "mydev.example.com", "dns name mydev.example.com is not allowed by the provisioner policy"},
+		{"fail-subtree-denied", policy, "a.secret.dev.example.com", "dns name a.secret.dev.example.com is denied by the provisioner policy"},
+		{"ok-subtree-denied-base", policy, "secret.dev.example.com", ""},
+		{"ok-deny-subtree-base", denyOnly, "example.com", ""},
+		{"fail-deny-subtree", denyOnly, "a.b.example.com", "dns name a.b.example.com is denied by the provisioner policy"},
+		// Wildcard names need an explicit rule.
+		{"ok-wildcard-same-rule", policy, "*.wild.example.com", ""},
+		{"fail-wildcard-by-one-label", policy, "*.a.teams.example.com", "dns name *.a.teams.example.com is not allowed by the provisioner policy"},
+		{"fail-wildcard-by-subtree", policy, "*.a.dev.example.com", "dns name *.a.dev.example.com is not allowed by the provisioner policy"},
+		{"ok-subtree-wildcards", wildcards, "*.teams.example.com", ""},
+		{"ok-subtree-wildcards-deep", wildcards, "*.a.b.teams.example.com", ""},
+		{"fail-subtree-wildcards-above", wildcards, "*.example.com", "dns name *.example.com is not allowed by the provisioner policy"},
+		{"fail-subtree-wildcards-denied", wildcards, "*.ops.teams.example.com", "dns name *.ops.teams.example.com is denied by the provisioner policy"},
+		{"fail-wildcard-covers-denied-subtree", denyOnly, "*.example.com", "dns name *.example.com is denied by the provisioner policy"},
+		{"fail-wildcard-below-denied-subtree", denyOnly, "*.a.example.com", "dns name *.a.example.com is denied by the provisioner policy"},
+		// Names are normalized before matching.
+		{"ok-normalized", policy, "A.Dev.Example.COM.", ""},
+		{"ok-idn-unicode", policy, "BÜCHER.example.com", ""},
+		{"ok-idn-punycode", policy, "xn--bcher-kva.example.com", ""},
+		{"fail-denied-normalized", denyOnly, "ADMIN.example.org.", "dns name ADMIN.example.org. is denied by the provisioner policy"},
+		{"fail-denied-fullwidth", denyOnly, "ａｄｍｉｎ.example.org", "dns name ａｄｍｉｎ.example.org is denied by the provisioner policy"},
+		{"fail-lookalike-cyrillic", policy, "a.tеams.example.com", "dns name a.tеams.example.com is not allowed by the provisioner policy"},
+		{"fail-lookalike-greek", policy, "a.dev.exampΙe.com", "dns name a.dev.exampΙe.com is not allowed by the provisioner policy"},
+		{"fail-invalid-idn", policy, "-bé.dev.example.com", "dns name -bé.dev.example.com is not a valid name"},
+		{"fail-leading-dot", policy, ".a.dev.example.com", "dns name .a.dev.example.com is not a valid name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.AuthorizeDNSName(tt.dns)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestX509Policy_AuthorizeEmail(t *testing.T) {
+	policy := &X509Policy{
+		AllowedEmailDomains: []string{"example.com", "corp.example.com"},
+		DeniedEmailDomains:  []string{".corp.example.com"},
+	}
+	tests := []struct {
+		name   string
+		policy *X509Policy
+		email  string
+		err    string
+	}{
+		{"ok-nil", nil, "jane@example.org", ""},
+		{"ok-empty", &X509Policy{}, "jane@example.org", ""},
+		{"ok-dns-only", &X509Policy{AllowedDNSNames: []string{"example.com"}}, "jane@example.org", ""},
+		{"ok", policy, "jane@corp.example.com", ""},
+		{"fail-not-allowed", policy, "jane@example.org", "email address jane@example.org is not allowed by the provisioner policy"},
+		{"fail-denied", policy, "jane@dev.corp.example.com", "email address jane@dev.corp.example.com is denied by the provisioner policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.AuthorizeEmail(tt.email)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestX509Policy_AuthorizeIP(t *testing.T) {
+	policy := &X509Policy{
+		AllowedIPRanges: []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"},
+		DeniedIPRanges:  []string{"10.0.0.0/24", "2001:db8::1"},
+	}
+	tests := []struct {
+		name   string
+		policy *X509Policy
+		ip     string
+		err    string
+	}{
+		{"ok-nil", nil, "10.0.0.1", ""},
+		{"ok-empty", &X509Policy{}, "10.0.0.1", ""},
+		{"ok-dns-only", &X509Policy{AllowedDNSNames: []string{"example.com"}}, "10.0.0.1", ""},
+		{"ok-range", policy, "10.1.2.3", ""},
+		{"ok-address", policy, "192.168.1.10", ""},
+		{"ok-ipv6", policy, "2001:db8::2", ""},
+		{"ok-deny-only", &X509Policy{DeniedIPRanges: []string{"10.0.0.0/24"}}, "192.168.0.1", ""},
+		{"fail-not-allowed", policy, "192.168.1.11", "IP address 192.168.1.11 is not allowed by the provisioner policy"},
+		{"fail-ipv6-not-allowed", policy, "2001:db9::1", "IP address 2001:db9::1 is not allowed by the provisioner policy"},
+		{"fail-denied", policy, "10.0.0.1", "IP address 10.0.0.1 is denied by the provisioner policy"},
+		{"fail-ipv6-denied", policy, "2001:db8::1", "IP address 2001:db8::1 is denied by the provisioner policy"},
+		{"ok-default-allow", &X509Policy{DefaultIPAction: "allow"}, "10.0.0.1", ""},
+		{"fail-default-deny-dns-only", &X509Policy{AllowedDNSNames: []string{"example.com"}, DefaultIPAction: "deny"}, "10.0.0.1",
+			"IP address 10.0.0.1 is denied by default by the provisioner policy"},
+		{"fail-default-deny", &X509Policy{DefaultIPAction: "deny"}, "2001:db8::1",
+			"IP address 2001:db8::1 is denied by default by the provisioner policy"},
+		{"ok-default-deny-with-ranges", &X509Policy{AllowedIPRanges: []string{"10.0.0.0/8"}, DefaultIPAction: "deny"}, "10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.AuthorizeIP(net.ParseIP(tt.ip))
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func Test_x509PolicyValidator_Valid(t *testing.T) {
+	v := &x509PolicyValidator{policy: &X509Policy{
+		AllowedDNSNames: []string{"*.example.com", "example.com"},
+		DeniedDNSNames:  []string{"admin.example.com"},
+		AllowedIPRanges: []string{"10.0.0.0/8"},
+
+		AllowedEmailDomains: []string{"example.com", ".example.com"},
+		DeniedEmailDomains:  []string{"dev.example.com"},
+	}}
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		err  string
+	}{
+		{"ok", &x509.Certificate{DNSNames: []string{"example.com", "www.example.com"}}, ""},
+		{"fail-wildcard", &x509.Certificate{DNSNames: []string{"example.com", "*.example.com"}},
+			"certificate dns name *.example.com is denied by the provisioner policy"},
+		{"fail-not-allowed", &x509.Certificate{DNSNames: []string{"example.net"}},
+			"certificate dns name example.net is not allowed by the provisioner policy"},
+		{"ok-ip", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, ""},
+		{"fail-ip-not-allowed", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("192.168.0.1")}},
+			"certificate IP address 192.168.0.1 is not allowed by the provisioner policy"},
+		{"fail-ipv6-not-allowed", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}},
+			"certificate IP address fd00::1 is not allowed by the provisioner policy"},
+		{"ok-email", &x509.Certificate{EmailAddresses: []string{"jane@example.com", "jane+smime@corp.example.com"}}, ""},
+		{"fail-email-denied", &x509.Certificate{EmailAddresses: []string{"jane@example.com", "jane@DEV.example.com"}},
+			"certificate email address jane@DEV.example.com is denied by the provisioner policy"},
+		{"fail-email-not-allowed", &x509.Certificate{EmailAddresses: []string{`"jane@example.com"@example.org`}},
+			`certificate email address "jane@example.com"@example.org is not allowed by the provisioner policy`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Valid(tt.cert, Options{})
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, http.StatusForbidden, sc.StatusCode())
+			}
+		})
+	}
+}
+
+func Test_x509CommonNameValidator_Valid(t *testing.T) {
+	cert := func(cn string, dns ...string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:        pkix.Name{CommonName: cn},
+			DNSNames:       dns,
+			IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+			EmailAddresses: []string{"jane@example.com"},
+			URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/foo"}},
+		}
+	}
+	rules := &X509Policy{
+		AllowedCommonNames: []string{"*.example.com", "example.com"},
+		DeniedCommonNames:  []string{"admin.example.com"},
+		AllowedIPRanges:    []string{"10.0.0.0/8"},
+		DeniedIPRanges:     []string{"10.0.0.2"},
+	}
+	require := &X509Policy{RequireCommonNameInSANs: true}
+	tests := []struct {
+		name   string
+		policy *X509Policy
+		cert   *x509.Certificate
+		err    string
+	}{
+		{"ok-empty", rules, cert(""), ""},
+		{"ok-allowed", rules, cert("www.example.com"), ""},
+		{"ok-allowed-case", rules, cert("WWW.Example.COM"), ""},
+		{"fail-denied", rules, cert("admin.example.com"),
+			"certificate common name admin.example.com is denied by the deniedCommonNames rule admin.example.com of the provisioner policy"},
+		{"fail-not-allowed", rules, cert("example.net"),
+			"certificate common name example.net is not allowed by the allowedCommonNames of the provisioner policy"},
+		{"fail-not-dns", rules, cert("Jane Doe"),
+			"certificate common name Jane Doe is not allowed by the allowedCommonNames of the provisioner policy"},
+		{"ok-not-dns-denied-only", &X509Policy{DeniedCommonNames: []string{"example.com"}}, cert("Jane Doe"), ""},
+		{"fail-denied-subtree", &X509Policy{DeniedCommonNames: []string{".internal"}}, cert("db.prod.internal"),
+			"certificate common name db.prod.internal is denied by the deniedCommonNames rule .internal of the provisioner policy"},
+		{"ok-ip", rules, cert("10.0.0.1"), ""},
+		{"fail-ip-denied", rules, cert("10.0.0.2"),
+			"certificate common name 10.0.0.2 is denied by the deniedIPRanges rule 10.0.0.2 of the provisioner policy"},
+		{"fail-ip-not-allowed", rules, cert("192.168.0.1"),
+			"certificate common name 192.168.0.1 is not allowed by the allowedIPRanges of the provisioner policy"},
+		{"ok-ip-no-ip-rules", &X509Policy{AllowedCommonNames: []string{"example.com"}}, cert("192.168.0.1"), ""},
+		{"ok-ip-without-common-name-rules", &X509Policy{AllowedIPRanges: []string{"10.0.0.0/8"}}, cert("10.0.0.1"), ""},
+		{"fail-ip-without-common-name-rules", &X509Policy{AllowedIPRanges: []string{"10.0.0.0/8"}}, cert("fd00::1"),
+			"certificate common name fd00::1 is not allowed by the allowedIPRanges of the provisioner policy"},
+		{"ok-name-without-common-name-rules", &X509Policy{AllowedIPRanges: []string{"10.0.0.0/8"}}, cert("Jane Doe"), ""},
+		{"fail-ip-default-deny", &X509Policy{DefaultIPAction: "deny"}, cert("10.0.0.1"),
+			"certificate common name 10.0.0.1 is not allowed by the defaultIPAction of the provisioner policy"},
+		{"ok-require-dns", require, cert("www.example.com", "example.com", "www.example.com"), ""},
+		{"ok-require-ip", require, cert("10.0.0.1"), ""},
+		{"ok-require-email", require, cert("jane@example.com"), ""},
+		{"ok-require-uri", require, cert("spiffe://example.com/foo"), ""},
+		{"fail-require", require, cert("www.example.com", "example.com"),
+			"certificate common name www.example.com is not one of the SANs, required by requireCommonNameInSANs of the provisioner policy"},
+		{"fail-require-literal", require, cert("WWW.example.com", "www.example.com"),
+			"certificate common name WWW.example.com is not one of the SANs, required by requireCommonNameInSANs of the provisioner policy"},
+		{"fail-require-ip", require, cert("10.0.0.2"),
+			"certificate common name 10.0.0.2 is not one of the SANs, required by requireCommonNameInSANs of the provisioner policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &x509CommonNameValidator{policy: tt.policy}
+			err := v.Valid(tt.cert, Options{})
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, http.StatusForbidden, sc.StatusCode())
+			}
+		})
+	}
+}
+
+func Test_x509PolicySignOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *X509Policy
+		want   []SignOption
+	}{
+		{"nil", nil, nil},
+		{"empty", &X509Policy{}, nil},
+		{"dns", &X509Policy{AllowedDNSNames: []string{"example.com"}}, []SignOption{
+			&x509PolicyValidator{policy: &X509Policy{AllowedDNSNames: []string{"example.com"}}},
+		}},
+		{"ip", &X509Policy{DefaultIPAction: "deny"}, []SignOption{
+			&x509PolicyValidator{policy: &X509Policy{DefaultIPAction: "deny"}},
+			&x509CommonNameValidator{policy: &X509Policy{DefaultIPAction: "deny"}},
+		}},
+		{"ip-allow", &X509Policy{DefaultIPAction: "allow"}, nil},
+		{"uri", &X509Policy{AllowedURIs: []string{"spiffe://example.org"}}, []SignOption{
+			&x509PolicyValidator{policy: &X509Policy{AllowedURIs: []string{"spiffe://example.org"}}},
+			&x509URIValidator{policy: &X509Policy{AllowedURIs: []string{"spiffe://example.org"}}},
+		}},
+		{"disable", &X509Policy{DisableCommonName: true}, []SignOption{disableCommonNameModifier{}}},
+		{"require", &X509Policy{RequireCommonNameInSANs: true}, []SignOption{
+			&x509CommonNameValidator{policy: &X509Policy{RequireCommonNameInSANs: true}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, x509PolicySignOptions(tt.policy))
+		})
+	}
+}
+
+func Test_disableCommonNameModifier_Option(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "example.com", Organization: []string{"Smallstep"}}}
+	prof := &x509util.Leaf{}
+	prof.SetSubject(cert)
+	assert.FatalError(t, disableCommonNameModifier{}.Option(Options{})(prof))
+	assert.Equals(t, pkix.Name{Organization: []string{"Smallstep"}}, cert.Subject)
+}
+
+func Test_x509URIValidator_Valid(t *testing.T) {
+	v := &x509URIValidator{policy: &X509Policy{
+		AllowedURIs: []string{"spiffe://example.org/ns/prod"},
+		DeniedURIs:  []string{"spiffe://example.org/ns/prod/sa/admin"},
+	}}
+	uris := func(ss ...string) *x509.Certificate {
+		cert := &x509.Certificate{}
+		for _, s := range ss {
+			u, err := url.Parse(s)
+			assert.FatalError(t, err)
+			cert.URIs = append(cert.URIs, u)
+		}
+		return cert
+	}
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		err  string
+	}{
+		{"ok-none", uris(), ""},
+		{"ok", uris("spiffe://example.org/ns/prod/sa/web", "spiffe://example.org/ns/prod/sa/db"), ""},
+		{"fail-foreign-trust-domain", uris("spiffe://example.org/ns/prod/sa/web", "spiffe://other.org/ns/prod/sa/web"),
+			"certificate URI spiffe://other.org/ns/prod/sa/web is not allowed by the provisioner policy"},
+		{"fail-path-prefix", uris("spiffe://example.org/ns/dev/sa/web"),
+			"certificate URI spiffe://example.org/ns/dev/sa/web is not allowed by the provisioner policy"},
+		{"fail-denied", uris("spiffe://example.org/ns/prod/sa/admin"),
+			"certificate URI spiffe://example.org/ns/prod/sa/admin is denied by the rule spiffe://example.org/ns/prod/sa/admin of the provisioner policy"},
+		{"fail-relative", uris("ns/prod/sa/web"),
+			"certificate URI ns/prod/sa/web is not a valid URI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Valid(tt.cert, Options{})
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equals(t, tt.err, err.Error())
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, http.StatusForbidden, sc.StatusCode())
+			}
+		})
+	}
+}
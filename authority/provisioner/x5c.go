@@ -3,8 +3,11 @@ package provisioner
 import (
 	"context"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -25,13 +28,20 @@ type x5cPayload struct {
 // signature requests.
 type X5C struct {
 	*base
-	Type      string  `json:"type"`
-	Name      string  `json:"name"`
-	Roots     []byte  `json:"roots"`
-	Claims    *Claims `json:"claims,omitempty"`
-	claimer   *Claimer
-	audiences Audiences
-	rootPool  *x509.CertPool
+	Type        string              `json:"type"`
+	Name        string              `json:"name"`
+	Disabled    bool                `json:"disabled,omitempty"`
+	Roots       []byte              `json:"roots"`
+	Claims      *Claims             `json:"claims,omitempty"`
+	X509        *X509Options        `json:"x509,omitempty"`
+	SSH         *SSHTemplateOptions `json:"ssh,omitempty"`
+	SSHPolicy   *SSHPolicy          `json:"sshPolicy,omitempty"`
+	Webhooks    []*Webhook          `json:"webhooks,omitempty"`
+	Attestation *AttestationOptions `json:"attestation,omitempty"`
+	claimer     *Claimer
+	x509        *X509Options
+	audiences   Audiences
+	rootPool    *x509.CertPool
 }
 
 // GetID returns the provisioner unique identifier. The name and credential id
@@ -68,6 +78,11 @@ func (p *X5C) GetType() Type {
 	return TypeX5C
 }
 
+// IsDisabled returns true if the provisioner has been disabled.
+func (p *X5C) IsDisabled() bool {
+	return p.Disabled
+}
+
 // GetEncryptedKey returns the base provisioner encrypted key if it's defined.
 func (p *X5C) GetEncryptedKey() (string, string, bool) {
 	return "", "", false
@@ -113,6 +128,19 @@ func (p *X5C) Init(config Config) error {
 		return err
 	}
 
+	// Parse the x509 and SSH templates and validate the webhooks
+	if p.x509, err = initTemplateOptions(p.X509, p.SSH, p.Webhooks, p.Name, config); err != nil {
+		return err
+	}
+	if err = p.SSHPolicy.init(p.Name); err != nil {
+		return err
+	}
+
+	// Load the attestation roots
+	if err = p.Attestation.init(); err != nil {
+		return err
+	}
+
 	p.audiences = config.Audiences.WithFragment(p.GetID())
 	return nil
 }
@@ -126,10 +154,25 @@ func (p *X5C) authorizeToken(token string, audiences []string) (*x5cPayload, err
 		return nil, errs.Wrap(http.StatusUnauthorized, err, "x5c.authorizeToken; error parsing x5c token")
 	}
 
+	if len(jwt.Headers) == 0 || !hasX5CHeader(token) {
+		return nil, errs.Unauthorized("x5c.authorizeToken; x5c token is missing the x5c header")
+	}
+
 	verifiedChains, err := jwt.Headers[0].Certificates(x509.VerifyOptions{
-		Roots: p.rootPool,
+		Roots:     p.rootPool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
 	})
 	if err != nil {
+		switch e := err.(type) {
+		case x509.CertificateInvalidError:
+			if e.Reason == x509.Expired {
+				return nil, errs.Wrap(http.StatusUnauthorized, err,
+					"x5c.authorizeToken; x5c certificate chain in token is expired or not yet valid")
+			}
+		case x509.UnknownAuthorityError:
+			return nil, errs.Wrap(http.StatusUnauthorized, err,
+				"x5c.authorizeToken; x5c certificate chain in token is not signed by the provisioner roots")
+		}
 		return nil, errs.Wrap(http.StatusUnauthorized, err,
 			"x5c.authorizeToken; error verifying x5c certificate chain in token")
 	}
@@ -173,6 +216,23 @@ func (p *X5C) authorizeToken(token string, audiences []string) (*x5cPayload, err
 	return &claims, nil
 }
 
+// hasX5CHeader returns true if the protected header of the given token contains
+// a x5c certificate chain.
+func hasX5CHeader(token string) bool {
+	parts := strings.Split(token, ".")
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var header struct {
+		X5C []string `json:"x5c"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return false
+	}
+	return len(header.X5C) > 0
+}
+
 // AuthorizeRevoke returns an error if the provisioner does not have rights to
 // revoke the certificate with serial number in the `sub` property.
 func (p *X5C) AuthorizeRevoke(ctx context.Context, token string) error {
@@ -195,8 +255,10 @@ func (p *X5C) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 	}
 
 	dnsNames, ips, emails := x509util.SplitSANs(claims.SANs)
+	data := newTemplateData(claims.Subject, claims.SANs, token)
+	data.AuthorizationCrt = claims.chains[0][0]
 
-	return []SignOption{
+	return append([]SignOption{
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeX5C, p.Name, ""),
 		profileLimitDuration{p.claimer.DefaultTLSCertDuration(), claims.chains[0][0].NotAfter},
@@ -207,7 +269,8 @@ func (p *X5C) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 		emailAddressesValidator(emails),
 		ipAddressesValidator(ips),
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	}, nil
+		newAttestationValidator(p.Attestation, token),
+	}, templateSignOptions(ctx, p.x509, p.Webhooks, p.Name, data)...), nil
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
@@ -262,7 +325,7 @@ func (p *X5C) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 	// Default to a user certificate with no principals if not set
 	signOptions = append(signOptions, sshCertDefaultsModifier{CertType: SSHUserCert})
 
-	return append(signOptions,
+	signOptions = append(signOptions,
 		// Set the default extensions.
 		&sshDefaultExtensionModifier{},
 		// Checks the validity bounds, and set the validity if has not been set.
@@ -275,5 +338,7 @@ func (p *X5C) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption,
 		&sshCertValidityValidator{p.claimer},
 		// Require all the fields in the SSH certificate
 		&sshCertDefaultValidator{},
-	), nil
+	)
+	signOptions = append(signOptions, sshTemplateSignOptions(p.SSH, p.Name, token)...)
+	return append(signOptions, sshPolicySignOptions(p.SSHPolicy, []string{claims.Subject}, false)...), nil
 }
@@ -2,6 +2,13 @@ package provisioner
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"net"
 	"net/http"
 	"testing"
@@ -200,7 +207,7 @@ a5wpg+9s6QIgHIW6L60F8klQX+EO3o0SBqLeNcaskA4oSZsKjEdpSGo=
 				p:     p,
 				token: tok,
 				code:  http.StatusUnauthorized,
-				err:   errors.New("x5c.authorizeToken; error verifying x5c certificate chain in token"),
+				err:   errors.New("x5c.authorizeToken; x5c certificate chain in token is not signed by the provisioner roots"),
 			}
 		},
 		"fail/doubled-up-self-signed-cert": func(t *testing.T) test {
@@ -239,7 +246,7 @@ EXAHTA9L
 				p:     p,
 				token: tok,
 				code:  http.StatusUnauthorized,
-				err:   errors.New("x5c.authorizeToken; error verifying x5c certificate chain in token"),
+				err:   errors.New("x5c.authorizeToken; x5c certificate chain in token is not signed by the provisioner roots"),
 			}
 		},
 		"fail/digital-signature-ext-required": func(t *testing.T) test {
@@ -400,6 +407,144 @@ lgsqsR63is+0YQ==
 	}
 }
 
+// x5cTestPKI is a root, intermediate and leaf generated for a test.
+type x5cTestPKI struct {
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	leaf         *x509.Certificate
+	leafKey      *jose.JSONWebKey
+}
+
+func (pki *x5cTestPKI) rootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.root.Raw})
+}
+
+func (pki *x5cTestPKI) chain() []*x509.Certificate {
+	return []*x509.Certificate{pki.leaf, pki.intermediate}
+}
+
+// newX5CTestPKI creates a new PKI, the leaf template is modified with the
+// given function.
+func newX5CTestPKI(t *testing.T, fn func(leaf *x509.Certificate)) *x5cTestPKI {
+	newCert := func(tmpl, parent *x509.Certificate, pub, signer interface{}) *x509.Certificate {
+		b, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+		assert.FatalError(t, err)
+		cert, err := x509.ParseCertificate(b)
+		assert.FatalError(t, err)
+		return cert
+	}
+	now := time.Now()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "X5C Test Root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	root := newCert(rootTmpl, rootTmpl, rootKey.Public(), rootKey)
+
+	intKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	intermediate := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "X5C Test Intermediate"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}, root, intKey.Public(), rootKey)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "x5c-leaf"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if fn != nil {
+		fn(leafTmpl)
+	}
+	leaf := newCert(leafTmpl, intermediate, leafKey.Public(), intKey)
+
+	return &x5cTestPKI{
+		root:         root,
+		intermediate: intermediate,
+		leaf:         leaf,
+		leafKey:      &jose.JSONWebKey{Key: leafKey, KeyID: "x5c-leaf", Algorithm: jose.ES256},
+	}
+}
+
+func TestX5C_authorizeToken_chain(t *testing.T) {
+	pki := newX5CTestPKI(t, nil)
+	other := newX5CTestPKI(t, nil)
+	expired := newX5CTestPKI(t, func(leaf *x509.Certificate) {
+		leaf.NotBefore = time.Now().Add(-2 * time.Hour)
+		leaf.NotAfter = time.Now().Add(-time.Hour)
+	})
+	noDigitalSignature := newX5CTestPKI(t, func(leaf *x509.Certificate) {
+		leaf.KeyUsage = x509.KeyUsageKeyEncipherment
+	})
+	serverAuth := newX5CTestPKI(t, func(leaf *x509.Certificate) {
+		leaf.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+
+	newToken := func(pki *x5cTestPKI, opts ...tokOption) string {
+		tok, err := generateToken("foo", "x5c-test", testAudiences.Sign[0], "",
+			[]string{"test.smallstep.com"}, time.Now(), pki.leafKey, opts...)
+		assert.FatalError(t, err)
+		return tok
+	}
+
+	tests := []struct {
+		name  string
+		pki   *x5cTestPKI
+		token string
+		err   error
+	}{
+		{"ok", pki, newToken(pki, withX5CHdr(pki.chain())), nil},
+		{"ok/serverAuth", serverAuth, newToken(serverAuth, withX5CHdr(serverAuth.chain())), nil},
+		{"fail/missing-x5c", pki, newToken(pki),
+			errors.New("x5c.authorizeToken; x5c token is missing the x5c header")},
+		{"fail/expired", expired, newToken(expired, withX5CHdr(expired.chain())),
+			errors.New("x5c.authorizeToken; x5c certificate chain in token is expired or not yet valid")},
+		{"fail/other-root", pki, newToken(other, withX5CHdr(other.chain())),
+			errors.New("x5c.authorizeToken; x5c certificate chain in token is not signed by the provisioner roots")},
+		{"fail/missing-intermediate", pki, newToken(pki, withX5CHdr([]*x509.Certificate{pki.leaf})),
+			errors.New("x5c.authorizeToken; x5c certificate chain in token is not signed by the provisioner roots")},
+		{"fail/key-usage", noDigitalSignature, newToken(noDigitalSignature, withX5CHdr(noDigitalSignature.chain())),
+			errors.New("x5c.authorizeToken; certificate used to sign x5c token cannot be used for digital signature")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := generateX5C(tt.pki.rootPEM())
+			assert.FatalError(t, err)
+			p.Name = "x5c-test"
+			claims, err := p.authorizeToken(tt.token, testAudiences.Sign)
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					sc, ok := err.(errs.StatusCoder)
+					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+					assert.Equals(t, http.StatusUnauthorized, sc.StatusCode())
+					assert.HasPrefix(t, err.Error(), tt.err.Error())
+				}
+			} else if assert.Nil(t, tt.err) {
+				assert.Equals(t, tt.pki.leaf.Raw, claims.chains[0][0].Raw)
+				assert.Equals(t, "x5c-leaf", claims.chains[0][0].Subject.CommonName)
+			}
+		})
+	}
+}
+
 func TestX5C_AuthorizeSign(t *testing.T) {
 	certs, err := pemutil.ReadCertificateBundle("./testdata/certs/x5c-leaf.crt")
 	assert.FatalError(t, err)
@@ -496,12 +641,13 @@ func TestX5C_AuthorizeSign(t *testing.T) {
 							case *validityValidator:
 								assert.Equals(t, v.min, tc.p.claimer.MinTLSCertDuration())
 								assert.Equals(t, v.max, tc.p.claimer.MaxTLSCertDuration())
+							case *attestationValidator:
 							default:
 								assert.FatalError(t, errors.Errorf("unexpected sign option of type %T", v))
 							}
 							tot++
 						}
-						assert.Equals(t, tot, 8)
+						assert.Equals(t, tot, 9)
 					}
 				}
 			}
@@ -2,6 +2,7 @@ package authority
 
 import (
 	"net/http"
+	"sort"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -28,6 +29,24 @@ func TestGetEncryptedKey(t *testing.T) {
 				kid: c.AuthorityConfig.Provisioners[1].(*provisioner.JWK).Key.KeyID,
 			}
 		},
+		"fail-oidc": func(t *testing.T) *ek {
+			c, err := LoadConfiguration("../ca/testdata/ca.json")
+			assert.FatalError(t, err)
+			a, err := New(c)
+			assert.FatalError(t, err)
+			// OIDC provisioners do not have an encrypted key.
+			assert.FatalError(t, a.provisioners.Store(&provisioner.OIDC{
+				Type:     "OIDC",
+				Name:     "google",
+				ClientID: "oidc-client-id",
+			}))
+			return &ek{
+				a:    a,
+				kid:  "oidc-client-id",
+				err:  errors.New("encrypted key with kid oidc-client-id was not found"),
+				code: http.StatusNotFound,
+			}
+		},
 		"fail-not-found": func(t *testing.T) *ek {
 			c, err := LoadConfiguration("../ca/testdata/ca.json")
 			assert.FatalError(t, err)
@@ -97,7 +116,12 @@ func TestGetProvisioners(t *testing.T) {
 				}
 			} else {
 				if assert.Nil(t, tc.err) {
-					assert.Equals(t, ps, tc.a.config.AuthorityConfig.Provisioners)
+					// The provisioners are sorted by name.
+					want := append(provisioner.List{}, tc.a.config.AuthorityConfig.Provisioners...)
+					sort.SliceStable(want, func(i, j int) bool {
+						return want[i].GetName() < want[j].GetName()
+					})
+					assert.Equals(t, want, ps)
 					assert.Equals(t, "", next)
 				}
 			}
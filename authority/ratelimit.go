@@ -0,0 +1,75 @@
+package authority
+
+import (
+	"time"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/ratelimit"
+)
+
+// rateLimiter holds the token buckets of the provisioners. The provisioners
+// with a limit in the configuration have their own limiter, the rest share
+// the default one, but each provisioner has its own bucket.
+type rateLimiter struct {
+	defaultLimiter *ratelimit.Limiter
+	provisioners   map[string]*ratelimit.Limiter
+}
+
+func newRateLimiter(c *RateLimitConfig) *rateLimiter {
+	if c == nil || (c.Default == nil && len(c.Provisioners) == 0) {
+		return nil
+	}
+	rl := &rateLimiter{
+		provisioners: make(map[string]*ratelimit.Limiter, len(c.Provisioners)),
+	}
+	if c.Default != nil {
+		rl.defaultLimiter = ratelimit.New(*c.Default)
+	}
+	for name, l := range c.Provisioners {
+		rl.provisioners[name] = ratelimit.New(*l)
+	}
+	return rl
+}
+
+// checkRateLimit returns a 429 error if the provisioner has exceeded its
+// limit, without taking a token from its bucket. It is used before the token
+// is verified, so the tokens of others cannot empty the bucket, and before the
+// token is stored, so the token can be used again once the limit allows it.
+func (a *Authority) checkRateLimit(p provisioner.Interface) error {
+	if l := a.rateLimiter.limiter(p); l != nil {
+		if ok, wait := l.Check(p.GetID()); !ok {
+			return rateLimitError(p, wait)
+		}
+	}
+	return nil
+}
+
+// chargeRateLimit takes a token from the bucket of the provisioner, and
+// returns a 429 error if the provisioner has exceeded its limit. It must only
+// be called once the provisioner has verified the token.
+func (a *Authority) chargeRateLimit(p provisioner.Interface) error {
+	if l := a.rateLimiter.limiter(p); l != nil {
+		if ok, wait := l.Allow(p.GetID()); !ok {
+			return rateLimitError(p, wait)
+		}
+	}
+	return nil
+}
+
+// limiter returns the limiter of the provisioner, or nil if the provisioner is
+// not limited.
+func (rl *rateLimiter) limiter(p provisioner.Interface) *ratelimit.Limiter {
+	if rl == nil {
+		return nil
+	}
+	if l, ok := rl.provisioners[p.GetName()]; ok {
+		return l
+	}
+	return rl.defaultLimiter
+}
+
+func rateLimitError(p provisioner.Interface, wait time.Duration) error {
+	return errs.TooManyRequests(wait, "provisioner %s has exceeded its rate limit", p.GetName(),
+		errs.WithMessage("The provisioner %s has exceeded its rate limit, please retry later.", p.GetName()))
+}
@@ -2,6 +2,8 @@ package authority
 
 import (
 	"crypto/x509"
+	"log"
+	"time"
 
 	"github.com/smallstep/certificates/errs"
 )
@@ -36,15 +38,23 @@ func (a *Authority) GetRootCertificates() []*x509.Certificate {
 	return a.rootX509Certs
 }
 
+// GetIntermediateCertificate returns the certificate used to sign the X.509
+// certificates.
+func (a *Authority) GetIntermediateCertificate() *x509.Certificate {
+	return a.x509Issuer
+}
+
 // GetRoots returns all the root certificates for this CA.
 // This method implements the Authority interface.
 func (a *Authority) GetRoots() ([]*x509.Certificate, error) {
 	return a.rootX509Certs, nil
 }
 
-// GetFederation returns all the root certificates in the federation.
+// GetFederation returns all the root certificates in the federation, the
+// roots of this CA and the federated roots. Expired certificates are skipped.
 // This method implements the Authority interface.
 func (a *Authority) GetFederation() (federation []*x509.Certificate, err error) {
+	now := time.Now()
 	a.certificates.Range(func(k, v interface{}) bool {
 		crt, ok := v.(*x509.Certificate)
 		if !ok {
@@ -52,6 +62,10 @@ func (a *Authority) GetFederation() (federation []*x509.Certificate, err error)
 			err = errs.InternalServer("stored value is not a *x509.Certificate")
 			return false
 		}
+		if now.After(crt.NotAfter) {
+			log.Printf("skipping expired root certificate %s with fingerprint %s, it expired on %s", crt.Subject, k, crt.NotAfter.Format(time.RFC3339))
+			return true
+		}
 		federation = append(federation, crt)
 		return true
 	})
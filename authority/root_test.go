@@ -1,10 +1,20 @@
 package authority
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
@@ -151,3 +161,84 @@ func TestAuthority_GetFederation(t *testing.T) {
 		})
 	}
 }
+
+// writeTestRoot creates a self-signed certificate with the given common name
+// and expiration, and writes it in the given directory.
+func writeTestRoot(t *testing.T, dir, cn string, notAfter time.Time, isCA bool) (string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notAfter.Add(-24 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	assert.FatalError(t, err)
+	path := filepath.Join(dir, cn+".crt")
+	assert.FatalError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}), 0600))
+	return path, crt
+}
+
+func TestAuthority_GetFederation_federatedRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "federation")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	root, err := pemutil.ReadCertificate("testdata/certs/root_ca.crt")
+	assert.FatalError(t, err)
+	now := time.Now()
+	fed1, fed1Crt := writeTestRoot(t, dir, "federated-1", now.Add(time.Hour), true)
+	fed2, fed2Crt := writeTestRoot(t, dir, "federated-2", now.Add(time.Hour), true)
+	expired, _ := writeTestRoot(t, dir, "expired", now.Add(-time.Hour), true)
+	leaf, _ := writeTestRoot(t, dir, "leaf", now.Add(time.Hour), false)
+
+	tests := []struct {
+		name           string
+		federatedRoots []string
+		want           []*x509.Certificate
+		wantErr        bool
+	}{
+		{"ok", []string{fed1, fed2}, []*x509.Certificate{root, fed1Crt, fed2Crt}, false},
+		{"ok/expired", []string{fed1, fed2, expired}, []*x509.Certificate{root, fed1Crt, fed2Crt}, false},
+		{"fail/not-ca", []string{fed1, leaf}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := *testAuthority(t).config
+			config.FederatedRoots = tt.federatedRoots
+			a, err := New(&config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := a.GetFederation()
+			assert.FatalError(t, err)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Authority.GetFederation() returned %d certificates, want %d", len(got), len(tt.want))
+			}
+			for _, want := range tt.want {
+				var found bool
+				for _, crt := range got {
+					if crt.Equal(want) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("Authority.GetFederation() does not contain %s", want.Subject)
+				}
+			}
+		})
+	}
+}
@@ -1,15 +1,19 @@
 package authority
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/binary"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/admin"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
@@ -34,12 +38,26 @@ const (
 
 // SSHConfig contains the user and host keys.
 type SSHConfig struct {
-	HostKey          string          `json:"hostKey"`
-	UserKey          string          `json:"userKey"`
+	// HostKey and UserKey are the files or the KMS uris of the keys that sign
+	// the host and user certificates.
+	HostKey string `json:"hostKey"`
+	UserKey string `json:"userKey"`
+	// HostPublicKey and UserPublicKey are optional files with the public keys
+	// of HostKey and UserKey in the authorized_keys format, the CA does not
+	// start if they do not match the keys in the KMS.
+	HostPublicKey    string          `json:"hostPublicKey,omitempty"`
+	UserPublicKey    string          `json:"userPublicKey,omitempty"`
 	Keys             []*SSHPublicKey `json:"keys,omitempty"`
 	AddUserPrincipal string          `json:"addUserPrincipal,omitempty"`
 	AddUserCommand   string          `json:"addUserCommand,omitempty"`
 	Bastion          *Bastion        `json:"bastion,omitempty"`
+	// RotationOverlap is the time the previous signing key is advertised
+	// after a key rotation, it defaults to the maximum duration of the
+	// certificates.
+	RotationOverlap *provisioner.Duration `json:"rotationOverlap,omitempty"`
+	// CheckHostWebhook is an SSHCHECKHOST webhook that decides if a principal
+	// is a known host in the /ssh/check-host requests.
+	CheckHostWebhook *provisioner.Webhook `json:"checkHostWebhook,omitempty"`
 }
 
 // Bastion contains the custom properties used on bastion.
@@ -56,6 +74,17 @@ func (c *SSHConfig) Validate() error {
 	if c == nil {
 		return nil
 	}
+	if c.RotationOverlap != nil && c.RotationOverlap.Duration < 0 {
+		return errors.New("ssh rotationOverlap cannot be negative")
+	}
+	if w := c.CheckHostWebhook; w != nil {
+		if err := w.Validate(); err != nil {
+			return errors.Wrap(err, "ssh checkHostWebhook")
+		}
+		if w.Kind != provisioner.WebhookKindSSHCheckHost {
+			return errors.Errorf("ssh checkHostWebhook: kind must be %s", provisioner.WebhookKindSSHCheckHost)
+		}
+	}
 	for _, k := range c.Keys {
 		if err := k.Validate(); err != nil {
 			return err
@@ -97,6 +126,44 @@ func (k *SSHPublicKey) PublicKey() ssh.PublicKey {
 	return k.publicKey
 }
 
+// FederatedSSHKeys contains the SSH user and host CA public keys, in the
+// authorized_keys format, of the other authorities in the federation. They are
+// served at /ssh/federation with the keys of this authority.
+type FederatedSSHKeys struct {
+	User     []string `json:"user,omitempty"`
+	Host     []string `json:"host,omitempty"`
+	userKeys []ssh.PublicKey
+	hostKeys []ssh.PublicKey
+}
+
+// Validate parses the federated keys, the error names the first key that
+// cannot be parsed.
+func (k *FederatedSSHKeys) Validate() error {
+	if k == nil {
+		return nil
+	}
+	var err error
+	if k.userKeys, err = parseFederatedSSHKeys(provisioner.SSHUserCert, k.User); err != nil {
+		return err
+	}
+	if k.hostKeys, err = parseFederatedSSHKeys(provisioner.SSHHostCert, k.Host); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseFederatedSSHKeys(typ string, keys []string) ([]ssh.PublicKey, error) {
+	pubs := make([]ssh.PublicKey, len(keys))
+	for i, s := range keys {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+		if err != nil {
+			return nil, errors.Wrapf(err, "federatedSSHKeys.%s[%d]: error parsing %q", typ, i, s)
+		}
+		pubs[i] = pub
+	}
+	return pubs, nil
+}
+
 // SSHKeys represents the SSH User and Host public keys.
 type SSHKeys struct {
 	UserKeys []ssh.PublicKey
@@ -105,6 +172,9 @@ type SSHKeys struct {
 
 // GetSSHRoots returns the SSH User and Host public keys.
 func (a *Authority) GetSSHRoots() (*SSHKeys, error) {
+	a.sshKeysMutex.Lock()
+	defer a.sshKeysMutex.Unlock()
+	a.expireSSHKeys(time.Now())
 	return &SSHKeys{
 		HostKeys: a.sshCAHostCerts,
 		UserKeys: a.sshCAUserCerts,
@@ -113,6 +183,9 @@ func (a *Authority) GetSSHRoots() (*SSHKeys, error) {
 
 // GetSSHFederation returns the public keys for federated SSH signers.
 func (a *Authority) GetSSHFederation() (*SSHKeys, error) {
+	a.sshKeysMutex.Lock()
+	defer a.sshKeysMutex.Unlock()
+	a.expireSSHKeys(time.Now())
 	return &SSHKeys{
 		HostKeys: a.sshCAHostFederatedCerts,
 		UserKeys: a.sshCAUserFederatedCerts,
@@ -121,49 +194,83 @@ func (a *Authority) GetSSHFederation() (*SSHKeys, error) {
 
 // GetSSHConfig returns rendered templates for clients (user) or servers (host).
 func (a *Authority) GetSSHConfig(typ string, data map[string]string) ([]templates.Output, error) {
-	if a.sshCAUserCertSignKey == nil && a.sshCAHostCertSignKey == nil {
+	if user, host := a.sshSigners(); user == nil && host == nil {
 		return nil, errs.NotFound("getSSHConfig: ssh is not configured")
 	}
 
+	sshTemplates := a.sshDefaultTemplates
+	if a.config.Templates != nil && a.config.Templates.SSH != nil {
+		sshTemplates = a.config.Templates.SSH
+	}
+
 	var ts []templates.Template
 	switch typ {
 	case provisioner.SSHUserCert:
-		if a.config.Templates != nil && a.config.Templates.SSH != nil {
-			ts = a.config.Templates.SSH.User
-		}
+		ts = sshTemplates.User
 	case provisioner.SSHHostCert:
-		if a.config.Templates != nil && a.config.Templates.SSH != nil {
-			ts = a.config.Templates.SSH.Host
-		}
+		ts = sshTemplates.Host
 	default:
 		return nil, errs.BadRequest("getSSHConfig: type %s is not valid", typ)
 	}
 
 	// Merge user and default data
-	var mergedData map[string]interface{}
-
-	if len(data) == 0 {
-		mergedData = a.config.Templates.Data
-	} else {
-		mergedData = make(map[string]interface{}, len(a.config.Templates.Data)+1)
-		mergedData["User"] = data
+	// The ssh keys in the variables change with the key rotations.
+	a.sshKeysMutex.Lock()
+	a.expireSSHKeys(time.Now())
+	mergedData := map[string]interface{}{
+		"Step": a.templateVars,
+	}
+	if a.config.Templates != nil {
 		for k, v := range a.config.Templates.Data {
 			mergedData[k] = v
 		}
 	}
+	a.sshKeysMutex.Unlock()
+	if data == nil {
+		data = map[string]string{}
+	}
+	mergedData["User"] = data
 
 	// Render templates
 	output := []templates.Output{}
 	for _, t := range ts {
 		o, err := t.Output(mergedData)
 		if err != nil {
-			return nil, err
+			return nil, errs.Wrap(http.StatusBadRequest, err, "getSSHConfig: error rendering template "+t.Name,
+				errs.WithMessage("Error rendering template %s: %s", t.Name, errors.Cause(err)))
 		}
 		output = append(output, o)
 	}
 	return output, nil
 }
 
+// newDefaultSSHTemplates returns the default ssh templates with their contents
+// loaded, they are used if the configuration does not define the ssh
+// templates.
+func newDefaultSSHTemplates() (*templates.SSHTemplates, error) {
+	load := func(ts []templates.Template) ([]templates.Template, error) {
+		loaded := make([]templates.Template, len(ts))
+		for i, t := range ts {
+			t.TemplatePath = ""
+			t.Content = []byte(templates.DefaultSSHTemplateData[t.Name])
+			if err := t.Load(); err != nil {
+				return nil, err
+			}
+			loaded[i] = t
+		}
+		return loaded, nil
+	}
+	user, err := load(templates.DefaultSSHTemplates.User)
+	if err != nil {
+		return nil, err
+	}
+	host, err := load(templates.DefaultSSHTemplates.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &templates.SSHTemplates{User: user, Host: host}, nil
+}
+
 // GetSSHBastion returns the bastion configuration, for the given pair user,
 // hostname.
 func (a *Authority) GetSSHBastion(user string, hostname string) (*Bastion, error) {
@@ -182,6 +289,8 @@ func (a *Authority) GetSSHBastion(user string, hostname string) (*Bastion, error
 
 // SignSSH creates a signed SSH certificate with the given public key and options.
 func (a *Authority) SignSSH(key ssh.PublicKey, opts provisioner.SSHOptions, signOpts ...provisioner.SignOption) (*ssh.Certificate, error) {
+	// The authority policy is validated after the options of the provisioner.
+	signOpts = append(signOpts, a.config.AuthorityConfig.SSHPolicy.SignOptions()...)
 	var mods []provisioner.SSHCertModifier
 	var validators []provisioner.SSHCertValidator
 
@@ -202,7 +311,8 @@ func (a *Authority) SignSSH(key ssh.PublicKey, opts provisioner.SSHOptions, sign
 		// validate the given SSHOptions
 		case provisioner.SSHCertOptionsValidator:
 			if err := o.Valid(opts); err != nil {
-				return nil, errs.Wrap(http.StatusForbidden, err, "signSSH")
+				return nil, errs.Wrap(http.StatusForbidden, err, "signSSH",
+					errs.WithType(errs.TypePolicyViolation))
 			}
 		default:
 			return nil, errs.InternalServer("signSSH: invalid extra option type %T", o)
@@ -214,8 +324,8 @@ func (a *Authority) SignSSH(key ssh.PublicKey, opts provisioner.SSHOptions, sign
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSH")
 	}
 
-	var serial uint64
-	if err := binary.Read(rand.Reader, binary.BigEndian, &serial); err != nil {
+	serial, err := newSSHSerial()
+	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSH: error reading random number")
 	}
 
@@ -234,51 +344,82 @@ func (a *Authority) SignSSH(key ssh.PublicKey, opts provisioner.SSHOptions, sign
 	// Use provisioner modifiers
 	for _, m := range mods {
 		if err := m.Modify(cert); err != nil {
+			if e := a.templateLimitExceeded("ssh", err); e != nil {
+				return nil, errs.Wrap(http.StatusBadRequest, e, "signSSH",
+					errs.WithMessage("%s", e.Message))
+			}
 			return nil, errs.Wrap(http.StatusForbidden, err, "signSSH")
 		}
 	}
 
 	// Get signer from authority keys
 	var signer ssh.Signer
+	userSigner, hostSigner := a.sshSigners()
 	switch cert.CertType {
 	case ssh.UserCert:
-		if a.sshCAUserCertSignKey == nil {
+		if userSigner == nil {
 			return nil, errs.NotImplemented("signSSH: user certificate signing is not enabled")
 		}
-		signer = a.sshCAUserCertSignKey
+		signer = userSigner
 	case ssh.HostCert:
-		if a.sshCAHostCertSignKey == nil {
+		if hostSigner == nil {
 			return nil, errs.NotImplemented("signSSH: host certificate signing is not enabled")
 		}
-		signer = a.sshCAHostCertSignKey
+		signer = hostSigner
 	default:
 		return nil, errs.InternalServer("signSSH: unexpected ssh certificate type: %d", cert.CertType)
 	}
 	cert.SignatureKey = signer.PublicKey()
 
-	// Get bytes for signing trailing the signature length.
-	data := cert.Marshal()
-	data = data[:len(data)-4]
+	// The serial numbers are unique, the certificate is signed again with a
+	// new serial if the serial is already in the database.
+	for i := 1; ; i++ {
+		// Get bytes for signing trailing the signature length.
+		cert.Signature = nil
+		data := cert.Marshal()
+		data = data[:len(data)-4]
 
-	// Sign the certificate
-	sig, err := signer.Sign(rand.Reader, data)
-	if err != nil {
-		return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSH: error signing certificate")
-	}
-	cert.Signature = sig
+		// Sign the certificate
+		sig, err := signer.Sign(rand.Reader, data)
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSH: error signing certificate")
+		}
+		cert.Signature = sig
 
-	// User provisioners validators
-	for _, v := range validators {
-		if err := v.Valid(cert, opts); err != nil {
-			return nil, errs.Wrap(http.StatusForbidden, err, "signSSH")
+		// User provisioners validators
+		for _, v := range validators {
+			if err := v.Valid(cert, opts); err != nil {
+				return nil, errs.Wrap(http.StatusForbidden, err, "signSSH",
+					errs.WithType(errs.TypePolicyViolation))
+			}
 		}
-	}
 
-	if err = a.db.StoreSSHCertificate(cert); err != nil && err != db.ErrNotImplemented {
-		return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSH: error storing certificate in db")
+		err = a.db.StoreSSHCertificate(cert)
+		switch {
+		case err == nil, err == db.ErrNotImplemented:
+			return cert, nil
+		case err == db.ErrAlreadyExists && i < maxSSHSerialAttempts:
+			if cert.Serial, err = newSSHSerial(); err != nil {
+				return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSH: error reading random number")
+			}
+		default:
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSH: error storing certificate in db",
+				errs.WithType(errs.TypeDBUnavailable))
+		}
 	}
+}
 
-	return cert, nil
+// maxSSHSerialAttempts is the number of serial numbers tried when signing an
+// SSH certificate.
+const maxSSHSerialAttempts = 3
+
+// newSSHSerial returns a random serial number for an SSH certificate.
+func newSSHSerial() (uint64, error) {
+	var serial uint64
+	if err := binary.Read(rand.Reader, binary.BigEndian, &serial); err != nil {
+		return 0, err
+	}
+	return serial, nil
 }
 
 // RenewSSH creates a signed SSH certificate using the old SSH certificate as a template.
@@ -316,19 +457,31 @@ func (a *Authority) RenewSSH(oldCert *ssh.Certificate) (*ssh.Certificate, error)
 		ValidBefore:     uint64(vb.Unix()),
 	}
 
+	// The renewed certificate must be allowed by the authority policy, the
+	// provisioner policy is validated in AuthorizeSSHRenew.
+	for _, op := range a.config.AuthorityConfig.SSHPolicy.SignOptions() {
+		if v, ok := op.(provisioner.SSHCertValidator); ok {
+			if err := v.Valid(cert, provisioner.SSHOptions{}); err != nil {
+				return nil, errs.Wrap(http.StatusForbidden, err, "renewSSH",
+					errs.WithType(errs.TypePolicyViolation))
+			}
+		}
+	}
+
 	// Get signer from authority keys
 	var signer ssh.Signer
+	userSigner, hostSigner := a.sshSigners()
 	switch cert.CertType {
 	case ssh.UserCert:
-		if a.sshCAUserCertSignKey == nil {
+		if userSigner == nil {
 			return nil, errs.NotImplemented("renewSSH: user certificate signing is not enabled")
 		}
-		signer = a.sshCAUserCertSignKey
+		signer = userSigner
 	case ssh.HostCert:
-		if a.sshCAHostCertSignKey == nil {
+		if hostSigner == nil {
 			return nil, errs.NotImplemented("renewSSH: host certificate signing is not enabled")
 		}
-		signer = a.sshCAHostCertSignKey
+		signer = hostSigner
 	default:
 		return nil, errs.InternalServer("renewSSH: unexpected ssh certificate type: %d", cert.CertType)
 	}
@@ -346,7 +499,8 @@ func (a *Authority) RenewSSH(oldCert *ssh.Certificate) (*ssh.Certificate, error)
 	cert.Signature = sig
 
 	if err = a.db.StoreSSHCertificate(cert); err != nil && err != db.ErrNotImplemented {
-		return nil, errs.Wrap(http.StatusInternalServerError, err, "renewSSH: error storing certificate in db")
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "renewSSH: error storing certificate in db",
+			errs.WithType(errs.TypeDBUnavailable))
 	}
 
 	return cert, nil
@@ -354,6 +508,7 @@ func (a *Authority) RenewSSH(oldCert *ssh.Certificate) (*ssh.Certificate, error)
 
 // RekeySSH creates a signed SSH certificate using the old SSH certificate as a template.
 func (a *Authority) RekeySSH(oldCert *ssh.Certificate, pub ssh.PublicKey, signOpts ...provisioner.SignOption) (*ssh.Certificate, error) {
+	signOpts = append(signOpts, a.config.AuthorityConfig.SSHPolicy.SignOptions()...)
 	var validators []provisioner.SSHCertValidator
 
 	for _, op := range signOpts {
@@ -379,6 +534,9 @@ func (a *Authority) RekeySSH(oldCert *ssh.Certificate, pub ssh.PublicKey, signOp
 	if oldCert.ValidAfter == 0 || oldCert.ValidBefore == 0 {
 		return nil, errs.BadRequest("rekeySSH; cannot rekey certificate without validity period")
 	}
+	if oldCert.Key != nil && bytes.Equal(oldCert.Key.Marshal(), pub.Marshal()) {
+		return nil, errs.BadRequest("rekeySSH; new public key must be different from the current key")
+	}
 
 	backdate := a.config.AuthorityConfig.Backdate.Duration
 	duration := time.Duration(oldCert.ValidBefore-oldCert.ValidAfter) * time.Second
@@ -401,17 +559,18 @@ func (a *Authority) RekeySSH(oldCert *ssh.Certificate, pub ssh.PublicKey, signOp
 
 	// Get signer from authority keys
 	var signer ssh.Signer
+	userSigner, hostSigner := a.sshSigners()
 	switch cert.CertType {
 	case ssh.UserCert:
-		if a.sshCAUserCertSignKey == nil {
+		if userSigner == nil {
 			return nil, errs.NotImplemented("rekeySSH; user certificate signing is not enabled")
 		}
-		signer = a.sshCAUserCertSignKey
+		signer = userSigner
 	case ssh.HostCert:
-		if a.sshCAHostCertSignKey == nil {
+		if hostSigner == nil {
 			return nil, errs.NotImplemented("rekeySSH; host certificate signing is not enabled")
 		}
-		signer = a.sshCAHostCertSignKey
+		signer = hostSigner
 	default:
 		return nil, errs.BadRequest("rekeySSH; unexpected ssh certificate type: %d", cert.CertType)
 	}
@@ -431,12 +590,24 @@ func (a *Authority) RekeySSH(oldCert *ssh.Certificate, pub ssh.PublicKey, signOp
 	// Apply validators from provisioner.
 	for _, v := range validators {
 		if err := v.Valid(cert, provisioner.SSHOptions{Backdate: backdate}); err != nil {
-			return nil, errs.Wrap(http.StatusForbidden, err, "rekeySSH")
+			return nil, errs.Wrap(http.StatusForbidden, err, "rekeySSH",
+				errs.WithType(errs.TypePolicyViolation))
 		}
 	}
 
 	if err = a.db.StoreSSHCertificate(cert); err != nil && err != db.ErrNotImplemented {
-		return nil, errs.Wrap(http.StatusInternalServerError, err, "rekeySSH; error storing certificate in db")
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "rekeySSH; error storing certificate in db",
+			errs.WithType(errs.TypeDBUnavailable))
+	}
+
+	// Record the old certificate as superseded, only the first rekey of a
+	// certificate is recorded.
+	if s, ok := a.db.(db.SSHSuperseder); ok {
+		err := s.SupersedeSSHCertificate(strconv.FormatUint(oldCert.Serial, 10), strconv.FormatUint(cert.Serial, 10))
+		if err != nil && err != db.ErrAlreadyExists && err != db.ErrNotImplemented {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "rekeySSH; error storing superseded certificate in db",
+				errs.WithType(errs.TypeDBUnavailable))
+		}
 	}
 
 	return cert, nil
@@ -444,7 +615,8 @@ func (a *Authority) RekeySSH(oldCert *ssh.Certificate, pub ssh.PublicKey, signOp
 
 // SignSSHAddUser signs a certificate that provisions a new user in a server.
 func (a *Authority) SignSSHAddUser(key ssh.PublicKey, subject *ssh.Certificate) (*ssh.Certificate, error) {
-	if a.sshCAUserCertSignKey == nil {
+	signer, _ := a.sshSigners()
+	if signer == nil {
 		return nil, errs.NotImplemented("signSSHAddUser: user certificate signing is not enabled")
 	}
 	if subject.CertType != ssh.UserCert {
@@ -464,7 +636,6 @@ func (a *Authority) SignSSHAddUser(key ssh.PublicKey, subject *ssh.Certificate)
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSHAddUser: error reading random number")
 	}
 
-	signer := a.sshCAUserCertSignKey
 	principal := subject.ValidPrincipals[0]
 	addUserPrincipal := a.getAddUserPrincipal()
 
@@ -497,13 +668,78 @@ func (a *Authority) SignSSHAddUser(key ssh.PublicKey, subject *ssh.Certificate)
 	cert.Signature = sig
 
 	if err = a.db.StoreSSHCertificate(cert); err != nil && err != db.ErrNotImplemented {
-		return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSHAddUser: error storing certificate in db")
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "signSSHAddUser: error storing certificate in db",
+			errs.WithType(errs.TypeDBUnavailable))
 	}
 
 	return cert, nil
 }
 
-// CheckSSHHost checks the given principal has been registered before.
+// revokeSSH stores the revocation of an SSH certificate. SSH certificates are
+// revoked only once, a second revocation is a conflict.
+func (a *Authority) revokeSSH(rci *db.RevokedCertificateInfo, opts []interface{}) error {
+	switch err := a.db.RevokeSSH(rci); err {
+	case nil:
+		return nil
+	case db.ErrNotImplemented:
+		return errs.NotImplemented("authority.Revoke; no persistence layer configured", opts...)
+	case db.ErrAlreadyExists:
+		return errs.Conflict("authority.Revoke; ssh certificate with serial "+
+			"number %s has already been revoked", append([]interface{}{rci.Serial}, opts...)...)
+	default:
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.Revoke",
+			append(opts, errs.WithType(errs.TypeDBUnavailable))...)
+	}
+}
+
+// RevokeSSHByAdmin revokes the SSH certificate with the given serial number on
+// behalf of an admin, without a provisioner token.
+func (a *Authority) RevokeSSHByAdmin(adm *admin.Admin, serial string, reasonCode int, reason string) error {
+	opts := []interface{}{
+		errs.WithKeyVal("serialNumber", serial),
+		errs.WithKeyVal("reasonCode", reasonCode),
+		errs.WithKeyVal("reason", reason),
+		errs.WithKeyVal("admin", adm.Subject),
+	}
+	rci := &db.RevokedCertificateInfo{
+		Serial:     serial,
+		ReasonCode: reasonCode,
+		Reason:     reason,
+		RevokedAt:  time.Now().UTC(),
+		RevokedBy:  adm.Subject,
+	}
+	if p, err := a.LoadProvisionerByName(adm.Provisioner); err == nil {
+		rci.ProvisionerID = p.GetID()
+	}
+	return a.revokeSSH(rci, opts)
+}
+
+// GetSSHRevocations returns the revoked SSH certificates sorted by serial
+// number.
+func (a *Authority) GetSSHRevocations() ([]*db.RevokedCertificateInfo, error) {
+	store, ok := a.db.(db.RevocationStore)
+	if !ok {
+		return nil, errs.NotImplemented("authority.GetSSHRevocations; the database does not support listing revocations")
+	}
+	rcis, err := store.GetRevokedSSHCertificates()
+	if err != nil {
+		if err == db.ErrNotImplemented {
+			return nil, errs.NotImplemented("authority.GetSSHRevocations; no persistence layer configured")
+		}
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.GetSSHRevocations",
+			errs.WithType(errs.TypeDBUnavailable))
+	}
+	sort.Slice(rcis, func(i, j int) bool {
+		si, _ := strconv.ParseUint(rcis[i].Serial, 10, 64)
+		sj, _ := strconv.ParseUint(rcis[j].Serial, 10, 64)
+		return si < sj
+	})
+	return rcis, nil
+}
+
+// CheckSSHHost checks if the given principal is in an unexpired and unrevoked
+// host certificate. If the SSH configuration has a checkHostWebhook, the
+// webhook makes the final decision.
 func (a *Authority) CheckSSHHost(ctx context.Context, principal string, token string) (bool, error) {
 	if a.sshCheckHostFunc != nil {
 		exists, err := a.sshCheckHostFunc(ctx, principal, token, a.GetRootCertificates())
@@ -522,6 +758,12 @@ func (a *Authority) CheckSSHHost(ctx context.Context, principal string, token st
 		return false, errs.Wrap(http.StatusInternalServerError, err,
 			"checkSSHHost: error checking if hosts exists")
 	}
+	if a.config.SSH != nil && a.config.SSH.CheckHostWebhook != nil {
+		if exists, err = a.config.SSH.CheckHostWebhook.CheckSSHHost(ctx, principal, exists); err != nil {
+			return false, errs.Wrap(http.StatusInternalServerError, err,
+				"checkSSHHost: error calling webhook")
+		}
+	}
 
 	return exists, nil
 }
@@ -0,0 +1,323 @@
+package authority
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/templates"
+	"golang.org/x/crypto/ssh"
+)
+
+// RotateSSHKeyRequest is the request used to replace the key that signs the
+// SSH user or host certificates. The new key is loaded from a file or a KMS
+// using SigningKey, or it is generated in the KMS if Generate is set.
+type RotateSSHKeyRequest struct {
+	// Type is the type of the certificates signed with the key, user or
+	// host.
+	Type string
+	// SigningKey is the path or the KMS uri of the new key.
+	SigningKey string
+	// Password decrypts the new key, it defaults to the password of the
+	// configuration.
+	Password []byte
+	// Generate creates a new key in the KMS with the given Name.
+	Generate bool
+	Name     string
+	// Overlap is the time the previous key is still advertised, it defaults
+	// to the rotationOverlap of the configuration or to the maximum duration
+	// of the certificates of the given type.
+	Overlap time.Duration
+}
+
+// RotateSSHKeyResponse contains the new key that signs the SSH certificates.
+type RotateSSHKeyResponse struct {
+	PublicKey ssh.PublicKey
+	// Name is the name of a key generated in the KMS.
+	Name string
+	// PrivateKey is only set if the key has been generated in memory, it
+	// must be saved to keep using the key after a restart.
+	PrivateKey crypto.PrivateKey
+	// PreviousKeyNotAfter is the time the previous key stops being
+	// advertised.
+	PreviousKeyNotAfter time.Time
+}
+
+// RotateSSHKey replaces the key that signs the SSH certificates of the given
+// type. The new certificates are signed with the new key, and the previous key
+// is still advertised in the ssh roots and federation, and accepted by the
+// SSHPOP provisioners, until the end of the overlap period.
+//
+// The rotation is not persisted, the configuration must be updated to keep the
+// new key after a restart.
+func (a *Authority) RotateSSHKey(req *RotateSSHKeyRequest) (*RotateSSHKeyResponse, error) {
+	if req.Type != provisioner.SSHUserCert && req.Type != provisioner.SSHHostCert {
+		return nil, errs.BadRequest("authority.RotateSSHKey; type %s is not valid", req.Type)
+	}
+	if req.Overlap < 0 {
+		return nil, errs.BadRequest("authority.RotateSSHKey; overlap cannot be negative")
+	}
+	if user, host := a.sshSigners(); (req.Type == provisioner.SSHUserCert && user == nil) ||
+		(req.Type == provisioner.SSHHostCert && host == nil) {
+		return nil, errs.NotImplemented("authority.RotateSSHKey; %s certificate signing is not enabled", req.Type)
+	}
+
+	resp := new(RotateSSHKeyResponse)
+	var signReq *kmsapi.CreateSignerRequest
+	switch {
+	case req.Generate:
+		kr, err := a.keyManager.CreateKey(&kmsapi.CreateKeyRequest{
+			Name:               req.Name,
+			SignatureAlgorithm: kmsapi.ECDSAWithSHA256,
+		})
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.RotateSSHKey; error creating key")
+		}
+		resp.Name, resp.PrivateKey = kr.Name, kr.PrivateKey
+		signReq = &kr.CreateSignerRequest
+	case req.SigningKey != "":
+		password := req.Password
+		if password == nil && a.config.Password != "" {
+			password = []byte(a.config.Password)
+		}
+		signReq = &kmsapi.CreateSignerRequest{
+			SigningKey: req.SigningKey,
+			Password:   password,
+		}
+	default:
+		return nil, errs.BadRequest("authority.RotateSSHKey; signing key or generate is required")
+	}
+	s, err := a.keyManager.CreateSigner(signReq)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusBadRequest, err, "authority.RotateSSHKey; error loading signing key")
+	}
+	signer, err := newSSHSigner(s)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusBadRequest, err, "authority.RotateSSHKey; error creating ssh signer")
+	}
+
+	overlap := req.Overlap
+	if overlap == 0 {
+		if overlap, err = a.sshRotationOverlap(req.Type); err != nil {
+			return nil, err
+		}
+	}
+
+	a.sshKeysMutex.Lock()
+	defer a.sshKeysMutex.Unlock()
+
+	pub := signer.PublicKey()
+	fp := ssh.FingerprintSHA256(pub)
+	old := a.sshCAUserCertSignKey
+	if req.Type == provisioner.SSHHostCert {
+		old = a.sshCAHostCertSignKey
+	}
+	if ssh.FingerprintSHA256(old.PublicKey()) == fp {
+		return nil, errs.BadRequest("authority.RotateSSHKey; key %s is already the %s signing key", fp, req.Type)
+	}
+	if a.sshCAKeysNotAfter == nil {
+		a.sshCAKeysNotAfter = make(map[string]time.Time)
+	}
+	resp.PublicKey = pub
+	resp.PreviousKeyNotAfter = time.Now().Add(overlap)
+	a.sshCAKeysNotAfter[ssh.FingerprintSHA256(old.PublicKey())] = resp.PreviousKeyNotAfter
+	delete(a.sshCAKeysNotAfter, fp)
+
+	// The signing key is always the first one.
+	if req.Type == provisioner.SSHUserCert {
+		a.sshCAUserCertSignKey = signer
+		a.sshCAUserCerts = append([]ssh.PublicKey{pub}, removeSSHKey(a.sshCAUserCerts, fp)...)
+		a.sshCAUserFederatedCerts = append([]ssh.PublicKey{pub}, removeSSHKey(a.sshCAUserFederatedCerts, fp)...)
+	} else {
+		a.sshCAHostCertSignKey = signer
+		a.sshCAHostCerts = append([]ssh.PublicKey{pub}, removeSSHKey(a.sshCAHostCerts, fp)...)
+		a.sshCAHostFederatedCerts = append([]ssh.PublicKey{pub}, removeSSHKey(a.sshCAHostFederatedCerts, fp)...)
+	}
+	a.updateSSHTemplateVars()
+	return resp, nil
+}
+
+// RetireSSHKey stops advertising the SSH CA key of the given type with the
+// given SHA256 fingerprint before the end of its overlap period. The
+// certificates signed with the key are no longer accepted by the SSHPOP
+// provisioners. The current signing key cannot be retired.
+func (a *Authority) RetireSSHKey(typ, fingerprint string) error {
+	a.sshKeysMutex.Lock()
+	defer a.sshKeysMutex.Unlock()
+
+	var signer ssh.Signer
+	var keys []ssh.PublicKey
+	switch typ {
+	case provisioner.SSHUserCert:
+		signer, keys = a.sshCAUserCertSignKey, a.sshCAUserCerts
+	case provisioner.SSHHostCert:
+		signer, keys = a.sshCAHostCertSignKey, a.sshCAHostCerts
+	default:
+		return errs.BadRequest("authority.RetireSSHKey; type %s is not valid", typ)
+	}
+	if signer == nil {
+		return errs.NotImplemented("authority.RetireSSHKey; %s certificate signing is not enabled", typ)
+	}
+	if ssh.FingerprintSHA256(signer.PublicKey()) == fingerprint {
+		return errs.BadRequest("authority.RetireSSHKey; the current %s signing key cannot be retired", typ)
+	}
+	remaining := removeSSHKey(keys, fingerprint)
+	if len(remaining) == len(keys) {
+		return errs.NotFound("authority.RetireSSHKey; %s key %s not found", typ, fingerprint)
+	}
+	if typ == provisioner.SSHUserCert {
+		a.sshCAUserCerts = remaining
+		a.sshCAUserFederatedCerts = removeSSHKey(a.sshCAUserFederatedCerts, fingerprint)
+	} else {
+		a.sshCAHostCerts = remaining
+		a.sshCAHostFederatedCerts = removeSSHKey(a.sshCAHostFederatedCerts, fingerprint)
+	}
+	delete(a.sshCAKeysNotAfter, fingerprint)
+	a.updateSSHTemplateVars()
+	return nil
+}
+
+// sshRotationOverlap returns the default overlap period of the rotated keys of
+// the given type.
+func (a *Authority) sshRotationOverlap(typ string) (time.Duration, error) {
+	if a.config.SSH != nil && a.config.SSH.RotationOverlap != nil {
+		return a.config.SSH.RotationOverlap.Duration, nil
+	}
+	claimer, err := provisioner.NewClaimer(nil, a.provisionerConfig.Claims)
+	if err != nil {
+		return 0, errs.Wrap(http.StatusInternalServerError, err, "authority.RotateSSHKey")
+	}
+	if typ == provisioner.SSHHostCert {
+		return claimer.MaxHostSSHCertDuration(), nil
+	}
+	return claimer.MaxUserSSHCertDuration(), nil
+}
+
+// sshSigners returns the keys that sign the SSH user and host certificates.
+func (a *Authority) sshSigners() (user, host ssh.Signer) {
+	a.sshKeysMutex.RLock()
+	defer a.sshKeysMutex.RUnlock()
+	return a.sshCAUserCertSignKey, a.sshCAHostCertSignKey
+}
+
+// expireSSHKeys removes the rotated keys at the end of their overlap period.
+// It must be called with the sshKeysMutex locked.
+func (a *Authority) expireSSHKeys(now time.Time) {
+	var expired bool
+	for fp, notAfter := range a.sshCAKeysNotAfter {
+		if now.Before(notAfter) {
+			continue
+		}
+		a.sshCAUserCerts = removeSSHKey(a.sshCAUserCerts, fp)
+		a.sshCAHostCerts = removeSSHKey(a.sshCAHostCerts, fp)
+		a.sshCAUserFederatedCerts = removeSSHKey(a.sshCAUserFederatedCerts, fp)
+		a.sshCAHostFederatedCerts = removeSSHKey(a.sshCAHostFederatedCerts, fp)
+		delete(a.sshCAKeysNotAfter, fp)
+		expired = true
+	}
+	if expired {
+		a.updateSSHTemplateVars()
+	}
+}
+
+// updateSSHTemplateVars sets the SSH keys in the variables of the ssh
+// templates, the first key of each list is the signing key. It must be called
+// with the sshKeysMutex locked.
+func (a *Authority) updateSSHTemplateVars() {
+	var vars = a.templateVars.SSH
+	if a.sshCAHostCertSignKey != nil {
+		vars.HostKey = a.sshCAHostCertSignKey.PublicKey()
+		vars.HostKeyFingerprint = ssh.FingerprintSHA256(vars.HostKey)
+		vars.HostFederatedKeys = append([]ssh.PublicKey(nil), a.sshCAHostFederatedCerts[1:]...)
+	}
+	if a.sshCAUserCertSignKey != nil {
+		vars.UserKey = a.sshCAUserCertSignKey.PublicKey()
+		vars.UserKeyFingerprint = ssh.FingerprintSHA256(vars.UserKey)
+		vars.UserFederatedKeys = append([]ssh.PublicKey(nil), a.sshCAUserFederatedCerts[1:]...)
+	}
+	a.templateVars.SSH = vars
+	if t := a.config.Templates; t != nil {
+		if _, ok := t.Data["Step"].(templates.Step); ok {
+			t.Data["Step"] = a.templateVars
+		}
+	}
+}
+
+// loadSSHSigner loads the SSH CA key with the given file name or KMS uri. If
+// publicKeyFile is set, the public key of the signer must be the one in the
+// file.
+func (a *Authority) loadSSHSigner(signingKey, publicKeyFile string) (ssh.Signer, error) {
+	s, err := a.keyManager.CreateSigner(&kmsapi.CreateSignerRequest{
+		SigningKey: signingKey,
+		Password:   []byte(a.config.Password),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newSSHSigner(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating ssh signer for %s", signingKey)
+	}
+	if publicKeyFile != "" {
+		b, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", publicKeyFile)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing %s", publicKeyFile)
+		}
+		if !bytes.Equal(pub.Marshal(), signer.PublicKey().Marshal()) {
+			return nil, errors.Errorf("public key of %s does not match %s", signingKey, publicKeyFile)
+		}
+	}
+	return signer, nil
+}
+
+// kmsSSHSigner is an ssh.Signer that signs with a crypto.Signer, it signs with
+// rsa-sha2-256 by default because the KMS do not support SHA-1 digests.
+type kmsSSHSigner struct {
+	ssh.AlgorithmSigner
+}
+
+// newSSHSigner returns an ssh.Signer that signs with the given crypto.Signer,
+// the ECDSA and Ed25519 signatures are converted to the SSH format. The
+// public keys of the KMS are validated, Public returns an error in some of
+// them if the key cannot be retrieved.
+func newSSHSigner(s crypto.Signer) (ssh.Signer, error) {
+	if err, ok := s.Public().(error); ok {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(s)
+	if err != nil {
+		return nil, err
+	}
+	as, ok := signer.(ssh.AlgorithmSigner)
+	if !ok || signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer, nil
+	}
+	return &kmsSSHSigner{as}, nil
+}
+
+// Sign signs the data with rsa-sha2-256.
+func (s *kmsSSHSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2256)
+}
+
+// removeSSHKey returns a new list without the keys with the given fingerprint.
+func removeSSHKey(keys []ssh.PublicKey, fingerprint string) []ssh.PublicKey {
+	ret := make([]ssh.PublicKey, 0, len(keys))
+	for _, k := range keys {
+		if ssh.FingerprintSHA256(k) != fingerprint {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,313 @@
+package authority
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/kms"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/kms/softkms"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthority_RotateSSHKey(t *testing.T) {
+	a := testAuthority(t)
+	readSigner := func(filename string) ssh.Signer {
+		key, err := pemutil.Read(filename)
+		assert.FatalError(t, err)
+		signer, err := ssh.NewSignerFromSigner(key.(crypto.Signer))
+		assert.FatalError(t, err)
+		return signer
+	}
+	oldUserSigner := readSigner("./testdata/secrets/ssh_user_ca_key")
+	oldHostSigner := readSigner("./testdata/secrets/ssh_host_ca_key")
+
+	p, ok := a.provisioners.Load("sshpop/sshpop")
+	assert.Fatal(t, ok, "sshpop provisioner not found in test authority")
+	now := time.Now()
+	newSSHPOPCert := func(serial uint64, certType uint32, signer ssh.Signer) (*ssh.Certificate, string) {
+		cert, jwk, err := createSSHCert(&ssh.Certificate{
+			Serial:          serial,
+			CertType:        certType,
+			KeyId:           "foo.smallstep.com",
+			ValidPrincipals: []string{"foo.smallstep.com"},
+			ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		}, signer)
+		assert.FatalError(t, err)
+		aud := testAudiences.SSHRenew[0] + "#sshpop/sshpop"
+		if certType == ssh.UserCert {
+			aud = testAudiences.SSHRevoke[0] + "#sshpop/sshpop"
+		}
+		tok, err := generateToken(strconv.FormatUint(serial, 10), p.GetName(), aud, nil, now, jwk, withSSHPOPFile(cert))
+		assert.FatalError(t, err)
+		return cert, tok
+	}
+	revokeCtx := provisioner.NewContextWithMethod(context.Background(), provisioner.SSHRevokeMethod)
+	renewCtx := provisioner.NewContextWithMethod(context.Background(), provisioner.SSHRenewMethod)
+	assertStatus := func(err error, code int) {
+		t.Helper()
+		if assert.Error(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, code, sc.StatusCode())
+		}
+	}
+
+	// Rotate the user CA with a generated key.
+	resp, err := a.RotateSSHKey(&RotateSSHKeyRequest{Type: "user", Generate: true})
+	assert.FatalError(t, err)
+	assert.NotNil(t, resp.PrivateKey)
+	newUserKey := resp.PublicKey
+	assert.True(t, resp.PreviousKeyNotAfter.After(now.Add(23*time.Hour)))
+
+	roots, err := a.GetSSHRoots()
+	assert.FatalError(t, err)
+	assert.Equals(t, []ssh.PublicKey{newUserKey, oldUserSigner.PublicKey()}, roots.UserKeys)
+	assert.Equals(t, []ssh.PublicKey{oldHostSigner.PublicKey()}, roots.HostKeys)
+	federation, err := a.GetSSHFederation()
+	assert.FatalError(t, err)
+	assert.Equals(t, []ssh.PublicKey{newUserKey, oldUserSigner.PublicKey()}, federation.UserKeys)
+	assert.Equals(t, newUserKey, a.templateVars.SSH.UserKey)
+	assert.Equals(t, []ssh.PublicKey{oldUserSigner.PublicKey()}, a.templateVars.SSH.UserFederatedKeys)
+
+	// The old user certificates are still accepted by the SSHPOP provisioner.
+	_, tok := newSSHPOPCert(1000, ssh.UserCert, oldUserSigner)
+	_, err = a.Authorize(revokeCtx, tok)
+	assert.FatalError(t, err)
+
+	// The new user certificates are signed with the new key.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	pub, err := ssh.NewPublicKey(key.Public())
+	assert.FatalError(t, err)
+	cert, err := a.SignSSH(pub, provisioner.SSHOptions{
+		CertType:    "user",
+		KeyID:       "jane@smallstep.com",
+		Principals:  []string{"jane"},
+		ValidAfter:  provisioner.NewTimeDuration(now),
+		ValidBefore: provisioner.NewTimeDuration(now.Add(time.Hour)),
+	})
+	assert.FatalError(t, err)
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), newUserKey.Marshal())
+		},
+		Clock: func() time.Time { return now.Add(time.Minute) },
+	}
+	assert.FatalError(t, checker.CheckCert("jane", cert))
+
+	// Rotate the host CA with a key in a file.
+	dir, err := ioutil.TempDir("", "ssh-keys")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	block, err := pemutil.Serialize(hostKey, pemutil.WithPassword([]byte("other")))
+	assert.FatalError(t, err)
+	hostKeyFile := filepath.Join(dir, "ssh_host_ca_key")
+	assert.FatalError(t, ioutil.WriteFile(hostKeyFile, pem.EncodeToMemory(block), 0600))
+
+	_, err = a.RotateSSHKey(&RotateSSHKeyRequest{Type: "host", SigningKey: hostKeyFile})
+	assertStatus(err, http.StatusBadRequest)
+	resp, err = a.RotateSSHKey(&RotateSSHKeyRequest{Type: "host", SigningKey: hostKeyFile, Password: []byte("other"), Overlap: time.Hour})
+	assert.FatalError(t, err)
+	assert.Nil(t, resp.PrivateKey)
+	newHostKey := resp.PublicKey
+
+	// The old host certificates are renewed with the new key.
+	oldCert, tok := newSSHPOPCert(1001, ssh.HostCert, oldHostSigner)
+	_, err = a.Authorize(renewCtx, tok)
+	assert.FatalError(t, err)
+	cert, err = a.RenewSSH(oldCert)
+	assert.FatalError(t, err)
+	assert.Equals(t, newHostKey.Marshal(), cert.SignatureKey.Marshal())
+
+	// Retire the old user key.
+	_, tok = newSSHPOPCert(1002, ssh.UserCert, oldUserSigner)
+	assert.FatalError(t, a.RetireSSHKey("user", ssh.FingerprintSHA256(oldUserSigner.PublicKey())))
+	roots, err = a.GetSSHRoots()
+	assert.FatalError(t, err)
+	assert.Equals(t, []ssh.PublicKey{newUserKey}, roots.UserKeys)
+	assert.Equals(t, 0, len(a.templateVars.SSH.UserFederatedKeys))
+	_, err = a.Authorize(revokeCtx, tok)
+	assertStatus(err, http.StatusUnauthorized)
+
+	// The old host key is removed at the end of the overlap period.
+	a.sshKeysMutex.Lock()
+	a.expireSSHKeys(now.Add(2 * time.Hour))
+	a.sshKeysMutex.Unlock()
+	roots, err = a.GetSSHRoots()
+	assert.FatalError(t, err)
+	assert.Equals(t, []ssh.PublicKey{newHostKey}, roots.HostKeys)
+
+	// Errors
+	assertStatus(a.RetireSSHKey("user", ssh.FingerprintSHA256(newUserKey)), http.StatusBadRequest)
+	assertStatus(a.RetireSSHKey("user", ssh.FingerprintSHA256(oldUserSigner.PublicKey())), http.StatusNotFound)
+	assertStatus(a.RetireSSHKey("foo", "SHA256:foo"), http.StatusBadRequest)
+	_, err = a.RotateSSHKey(&RotateSSHKeyRequest{Type: "foo", Generate: true})
+	assertStatus(err, http.StatusBadRequest)
+	_, err = a.RotateSSHKey(&RotateSSHKeyRequest{Type: "user"})
+	assertStatus(err, http.StatusBadRequest)
+	_, err = a.RotateSSHKey(&RotateSSHKeyRequest{Type: "user", Generate: true, Overlap: -time.Second})
+	assertStatus(err, http.StatusBadRequest)
+	_, err = a.RotateSSHKey(&RotateSSHKeyRequest{Type: "host", SigningKey: hostKeyFile, Password: []byte("other")})
+	assertStatus(err, http.StatusBadRequest)
+
+	a.sshCAUserCertSignKey = nil
+	_, err = a.RotateSSHKey(&RotateSSHKeyRequest{Type: "user", Generate: true})
+	assertStatus(err, http.StatusNotImplemented)
+}
+
+// fakeKMS is a KMS with the keys in memory for the names with the fake:
+// prefix, the other keys are loaded with softkms. Like the KMS, the signers
+// only accept SHA-2 digests.
+type fakeKMS struct {
+	kms.KeyManager
+	keys map[string]crypto.Signer
+}
+
+func (k *fakeKMS) CreateSigner(req *kmsapi.CreateSignerRequest) (crypto.Signer, error) {
+	if !strings.HasPrefix(req.SigningKey, "fake:") {
+		return k.KeyManager.CreateSigner(req)
+	}
+	s, ok := k.keys[req.SigningKey]
+	if !ok {
+		return nil, errors.Errorf("key %s not found", req.SigningKey)
+	}
+	return &fakeKMSSigner{s}, nil
+}
+
+type fakeKMSSigner struct {
+	crypto.Signer
+}
+
+func (s *fakeKMSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch h := opts.HashFunc(); h {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+		return s.Signer.Sign(rand, digest, opts)
+	case 0:
+		if _, ok := s.Public().(ed25519.PublicKey); ok {
+			return s.Signer.Sign(rand, digest, opts)
+		}
+	}
+	return nil, errors.Errorf("unsupported hash function %v", opts.HashFunc())
+}
+
+func TestAuthority_kmsSSHKeys(t *testing.T) {
+	userKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.FatalError(t, err)
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.FatalError(t, err)
+	softKMS, err := softkms.New(context.Background(), kmsapi.Options{})
+	assert.FatalError(t, err)
+	km := &fakeKMS{KeyManager: softKMS, keys: map[string]crypto.Signer{
+		"fake:user": userKey,
+		"fake:host": hostKey,
+		"fake:ed":   edKey,
+	}}
+
+	dir, err := ioutil.TempDir("", "ssh-keys")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	writePublicKey := func(name string, key crypto.PublicKey) string {
+		pub, err := ssh.NewPublicKey(key)
+		assert.FatalError(t, err)
+		filename := filepath.Join(dir, name)
+		assert.FatalError(t, ioutil.WriteFile(filename, ssh.MarshalAuthorizedKey(pub), 0600))
+		return filename
+	}
+	userPublicKey := writePublicKey("ssh_user_ca_key.pub", userKey.Public())
+	hostPublicKey := writePublicKey("ssh_host_ca_key.pub", hostKey.Public())
+	withSSHKeys := func(userKey, userPub, hostKey, hostPub string) Option {
+		return func(a *Authority) error {
+			a.config.SSH.UserKey, a.config.SSH.UserPublicKey = userKey, userPub
+			a.config.SSH.HostKey, a.config.SSH.HostPublicKey = hostKey, hostPub
+			return nil
+		}
+	}
+
+	now := time.Now()
+	signAndVerify := func(a *Authority, certType string, want crypto.PublicKey) {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		pub, err := ssh.NewPublicKey(key.Public())
+		assert.FatalError(t, err)
+		cert, err := a.SignSSH(pub, provisioner.SSHOptions{
+			CertType:    certType,
+			KeyID:       "foo",
+			Principals:  []string{"foo"},
+			ValidAfter:  provisioner.NewTimeDuration(now),
+			ValidBefore: provisioner.NewTimeDuration(now.Add(time.Hour)),
+		})
+		assert.FatalError(t, err)
+		caKey, err := ssh.NewPublicKey(want)
+		assert.FatalError(t, err)
+		isAuthority := func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caKey.Marshal())
+		}
+		checker := &ssh.CertChecker{
+			IsUserAuthority: isAuthority,
+			IsHostAuthority: func(auth ssh.PublicKey, _ string) bool { return isAuthority(auth) },
+			Clock:           func() time.Time { return now.Add(time.Minute) },
+		}
+		if certType == provisioner.SSHHostCert {
+			assert.FatalError(t, checker.CheckHostKey("foo:22", &net.TCPAddr{}, cert))
+		} else {
+			assert.FatalError(t, checker.CheckCert("foo", cert))
+		}
+	}
+
+	a := testAuthority(t, WithKeyManager(km), withSSHKeys("fake:user", userPublicKey, "fake:host", hostPublicKey))
+	signAndVerify(a, provisioner.SSHUserCert, userKey.Public())
+	signAndVerify(a, provisioner.SSHHostCert, hostKey.Public())
+	userSigner, hostSigner := a.sshSigners()
+	sig, err := hostSigner.Sign(rand.Reader, []byte("data"))
+	assert.FatalError(t, err)
+	assert.Equals(t, ssh.SigAlgoRSASHA2256, sig.Format)
+	sig, err = userSigner.Sign(rand.Reader, []byte("data"))
+	assert.FatalError(t, err)
+	assert.Equals(t, ssh.KeyAlgoECDSA384, sig.Format)
+
+	// Ed25519 keys and file keys.
+	a = testAuthority(t, WithKeyManager(km), withSSHKeys("fake:ed", "", "testdata/secrets/ssh_host_ca_key", ""))
+	signAndVerify(a, provisioner.SSHUserCert, edKey.Public())
+	hostFileKey, err := pemutil.Read("testdata/secrets/ssh_host_ca_key")
+	assert.FatalError(t, err)
+	signAndVerify(a, provisioner.SSHHostCert, hostFileKey.(crypto.Signer).Public())
+
+	// The public key files must match.
+	for _, opt := range []Option{
+		withSSHKeys("fake:user", hostPublicKey, "fake:host", hostPublicKey),
+		withSSHKeys("fake:user", userPublicKey, "fake:host", filepath.Join(dir, "missing.pub")),
+		withSSHKeys("fake:missing", "", "fake:host", ""),
+	} {
+		_, err := New(a.config, WithKeyManager(km), opt)
+		assert.NotNil(t, err)
+	}
+}
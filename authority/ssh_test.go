@@ -1,25 +1,33 @@
 package authority
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/admin"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
 	"github.com/smallstep/certificates/sshutil"
 	"github.com/smallstep/certificates/templates"
+	"github.com/smallstep/cli/crypto/pemutil"
 	"github.com/smallstep/cli/jose"
 	"golang.org/x/crypto/ssh"
 )
@@ -168,11 +176,129 @@ func TestAuthority_SignSSH(t *testing.T) {
 				assert.NotEquals(t, 0, got.Serial)
 				assert.NotNil(t, got.Signature)
 				assert.NotNil(t, got.SignatureKey)
+
+				unsigned := *got
+				unsigned.Signature = nil
+				data := unsigned.Marshal()
+				assert.FatalError(t, got.SignatureKey.Verify(data[:len(data)-4], got.Signature))
 			}
 		})
 	}
 }
 
+func TestAuthority_SignSSH_serial(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	pub, err := ssh.NewPublicKey(key.Public())
+	assert.FatalError(t, err)
+	signKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	signer, err := ssh.NewSignerFromKey(signKey)
+	assert.FatalError(t, err)
+
+	now := time.Now().Truncate(time.Second)
+	opts := provisioner.SSHOptions{
+		CertType:    "user",
+		KeyID:       "jane@smallstep.com",
+		Principals:  []string{"jane", "jane@smallstep.com"},
+		ValidAfter:  provisioner.NewTimeDuration(now),
+		ValidBefore: provisioner.NewTimeDuration(now.Add(time.Hour)),
+	}
+
+	// The serial numbers in the database are not reused.
+	var serials []uint64
+	a := testAuthority(t, WithDatabase(&db.MockAuthDB{
+		MStoreSSHCertificate: func(cert *ssh.Certificate) error {
+			serials = append(serials, cert.Serial)
+			if len(serials) == 1 {
+				return db.ErrAlreadyExists
+			}
+			return nil
+		},
+	}))
+	a.sshCAUserCertSignKey = signer
+	cert, err := a.SignSSH(pub, opts)
+	assert.FatalError(t, err)
+	assert.Len(t, 2, serials)
+	assert.NotEquals(t, serials[0], serials[1])
+	assert.Equals(t, serials[1], cert.Serial)
+	assert.Equals(t, "jane@smallstep.com", cert.KeyId)
+	assert.Equals(t, []string{"jane", "jane@smallstep.com"}, cert.ValidPrincipals)
+	assert.Equals(t, uint64(now.Unix()), cert.ValidAfter)
+	assert.Equals(t, uint64(now.Add(time.Hour).Unix()), cert.ValidBefore)
+
+	// The certificate is signed by the user CA key.
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), signer.PublicKey().Marshal())
+		},
+		Clock: func() time.Time { return now.Add(time.Minute) },
+	}
+	assert.FatalError(t, checker.CheckCert("jane", cert))
+
+	// The signing fails after a few attempts.
+	a = testAuthority(t, WithDatabase(&db.MockAuthDB{
+		MStoreSSHCertificate: func(cert *ssh.Certificate) error {
+			return db.ErrAlreadyExists
+		},
+	}))
+	a.sshCAUserCertSignKey = signer
+	_, err = a.SignSSH(pub, opts)
+	if assert.NotNil(t, err) {
+		sc, ok := err.(errs.StatusCoder)
+		assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+		assert.Equals(t, http.StatusInternalServerError, sc.StatusCode())
+	}
+}
+
+func TestAuthority_SignSSH_host(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		signer, err := ssh.NewSignerFromKey(key)
+		assert.FatalError(t, err)
+		return signer
+	}
+	pub := newSigner().PublicKey()
+	userSigner, hostSigner := newSigner(), newSigner()
+
+	now := time.Now().Truncate(time.Second)
+	opts := provisioner.SSHOptions{
+		CertType:    "host",
+		KeyID:       "foo.internal.example.com",
+		Principals:  []string{"foo.internal.example.com", "10.0.0.1"},
+		ValidAfter:  provisioner.NewTimeDuration(now),
+		ValidBefore: provisioner.NewTimeDuration(now.Add(24 * time.Hour)),
+	}
+
+	// Host certificates are signed with the host CA key.
+	a := testAuthority(t)
+	a.sshCAUserCertSignKey = userSigner
+	a.sshCAHostCertSignKey = hostSigner
+	cert, err := a.SignSSH(pub, opts)
+	assert.FatalError(t, err)
+	assert.Equals(t, uint32(ssh.HostCert), cert.CertType)
+	assert.Equals(t, hostSigner.PublicKey().Marshal(), cert.SignatureKey.Marshal())
+	assert.Len(t, 0, cert.Extensions)
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), hostSigner.PublicKey().Marshal())
+		},
+		Clock: func() time.Time { return now.Add(time.Minute) },
+	}
+	assert.FatalError(t, checker.CheckHostKey("foo.internal.example.com:22", nil, cert))
+	assert.Error(t, checker.CheckHostKey("bar.internal.example.com:22", nil, cert))
+
+	// The user CA key does not sign host certificates.
+	a.sshCAHostCertSignKey = nil
+	_, err = a.SignSSH(pub, opts)
+	if assert.NotNil(t, err) {
+		sc, ok := err.(errs.StatusCoder)
+		assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+		assert.Equals(t, http.StatusNotImplemented, sc.StatusCode())
+	}
+}
+
 func TestAuthority_SignSSHAddUser(t *testing.T) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	assert.FatalError(t, err)
@@ -349,6 +475,91 @@ func TestAuthority_GetSSHFederation(t *testing.T) {
 	}
 }
 
+func TestAuthority_federatedSSHKeys(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		pub, err := ssh.NewPublicKey(key.Public())
+		assert.FatalError(t, err)
+		return pub
+	}
+	authorizedKey := func(pub ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " region-b"
+	}
+	user1, user2, host := newKey(), newKey(), newKey()
+
+	newConfig := func(k *FederatedSSHKeys) *Config {
+		return &Config{
+			Address:          "127.0.0.1:443",
+			Root:             []string{"testdata/certs/root_ca.crt"},
+			IntermediateCert: "testdata/certs/intermediate_ca.crt",
+			IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+			SSH: &SSHConfig{
+				HostKey: "testdata/secrets/ssh_host_ca_key",
+				UserKey: "testdata/secrets/ssh_user_ca_key",
+			},
+			FederatedSSHKeys: k,
+			DNSNames:         []string{"example.com"},
+			Password:         "pass",
+			AuthorityConfig:  &AuthConfig{},
+		}
+	}
+
+	a, err := New(newConfig(&FederatedSSHKeys{
+		User: []string{authorizedKey(user1), authorizedKey(user2)},
+		Host: []string{authorizedKey(host)},
+	}))
+	assert.FatalError(t, err)
+
+	// The federation has the local keys first.
+	keys, err := a.GetSSHFederation()
+	assert.FatalError(t, err)
+	assert.Equals(t, []ssh.PublicKey{a.sshCAUserCertSignKey.PublicKey(), user1, user2}, keys.UserKeys)
+	assert.Equals(t, []ssh.PublicKey{a.sshCAHostCertSignKey.PublicKey(), host}, keys.HostKeys)
+
+	// The roots only have the local keys.
+	keys, err = a.GetSSHRoots()
+	assert.FatalError(t, err)
+	assert.Equals(t, []ssh.PublicKey{a.sshCAUserCertSignKey.PublicKey()}, keys.UserKeys)
+	assert.Equals(t, []ssh.PublicKey{a.sshCAHostCertSignKey.PublicKey()}, keys.HostKeys)
+
+	// Keys that cannot be parsed fail the validation.
+	_, err = New(newConfig(&FederatedSSHKeys{
+		User: []string{authorizedKey(user1)},
+		Host: []string{authorizedKey(host), "ssh-ed25519 foo"},
+	}))
+	if assert.NotNil(t, err) {
+		assert.HasPrefix(t, err.Error(), `federatedSSHKeys.host[1]: error parsing "ssh-ed25519 foo"`)
+	}
+}
+
+func TestFederatedSSHKeys_Validate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	pub, err := ssh.NewPublicKey(key.Public())
+	assert.FatalError(t, err)
+	authorizedKey := string(ssh.MarshalAuthorizedKey(pub))
+
+	tests := []struct {
+		name    string
+		keys    *FederatedSSHKeys
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"empty", &FederatedSSHKeys{}, false},
+		{"ok", &FederatedSSHKeys{User: []string{authorizedKey}, Host: []string{authorizedKey}}, false},
+		{"badUser", &FederatedSSHKeys{User: []string{authorizedKey, "foo"}}, true},
+		{"badHost", &FederatedSSHKeys{Host: []string{""}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.keys.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("FederatedSSHKeys.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestAuthority_GetSSHConfig(t *testing.T) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	assert.FatalError(t, err)
@@ -475,6 +686,76 @@ func TestAuthority_GetSSHConfig(t *testing.T) {
 	}
 }
 
+func TestAuthority_GetSSHConfig_defaults(t *testing.T) {
+	a := testAuthority(t)
+	hostKey := a.sshCAHostCertSignKey.PublicKey()
+	userKey := a.sshCAUserCertSignKey.PublicKey()
+	authorizedKey := func(k ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+	}
+
+	// Without templates in the configuration the default ones are used.
+	got, err := a.GetSSHConfig("user", map[string]string{"StepPath": "/home/user/.step"})
+	assert.FatalError(t, err)
+	assert.Len(t, 3, got)
+	assert.Equals(t, "known_hosts.tpl", got[2].Name)
+	assert.Equals(t, "ssh/known_hosts", got[2].Path)
+	assert.Equals(t, "@cert-authority * "+authorizedKey(hostKey)+"\n", string(got[2].Content))
+
+	// Without a bastion the hosts are reached with the step proxycommand.
+	assert.Equals(t, "config.tpl", got[1].Name)
+	assert.Equals(t, "Match exec \"step ssh check-host %h\"\n"+
+		"\tForwardAgent yes\n"+
+		"\tUserKnownHostsFile \"/home/user/.step/ssh/known_hosts\"\n"+
+		"\tProxyCommand step ssh proxycommand %r %h %p\n", string(got[1].Content))
+
+	// With a bastion the hosts are reached with ProxyJump.
+	ab := testAuthority(t, func(a *Authority) error {
+		a.config.SSH.Bastion = &Bastion{Hostname: "bastion.smallstep.com", User: "jane", Port: "2222"}
+		return nil
+	})
+	bastionConfig, err := ab.GetSSHConfig("user", map[string]string{"StepPath": "/home/user/.step"})
+	assert.FatalError(t, err)
+	assert.Equals(t, "Host bastion.smallstep.com\n"+
+		"\tProxyJump none\n\n"+
+		"Match exec \"step ssh check-host %h\"\n"+
+		"\tForwardAgent yes\n"+
+		"\tUserKnownHostsFile \"/home/user/.step/ssh/known_hosts\"\n"+
+		"\tProxyJump jane@bastion.smallstep.com:2222\n", string(bastionConfig[1].Content))
+
+	got, err = a.GetSSHConfig("host", nil)
+	assert.FatalError(t, err)
+	assert.Len(t, 2, got)
+	assert.Equals(t, "TrustedUserCAKeys /etc/ssh/ca.pub\n"+
+		"HostCertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\n"+
+		"HostKey /etc/ssh/ssh_host_ecdsa_key", string(got[0].Content))
+	assert.Equals(t, authorizedKey(userKey)+"\n", string(got[1].Content))
+
+	// The templates have the CA URL and the fingerprints of the keys.
+	a.config.Templates = &templates.Templates{
+		SSH: &templates.SSHTemplates{
+			User: []templates.Template{
+				{Name: "step.tpl", Type: templates.File, Path: "ssh/step", Content: []byte("{{.Step.CAURL}} {{.Step.SSH.HostKeyFingerprint}} {{.Step.SSH.UserKeyFingerprint}}")},
+			},
+			Host: []templates.Template{
+				{Name: "broken.tpl", Type: templates.File, Path: "/etc/ssh/broken", Content: []byte(`{{ required "name is required" .User.Name }}`)},
+			},
+		},
+	}
+	got, err = a.GetSSHConfig("user", nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "https://example.com "+ssh.FingerprintSHA256(hostKey)+" "+ssh.FingerprintSHA256(userKey), string(got[0].Content))
+
+	// Rendering errors are bad requests with the name of the template.
+	_, err = a.GetSSHConfig("host", nil)
+	if assert.NotNil(t, err) {
+		e, ok := err.(*errs.Error)
+		assert.Fatal(t, ok, "error is not an *errs.Error")
+		assert.Equals(t, http.StatusBadRequest, e.StatusCode())
+		assert.HasPrefix(t, e.Message(), "Error rendering template broken.tpl: ")
+	}
+}
+
 func TestAuthority_CheckSSHHost(t *testing.T) {
 	type fields struct {
 		exists bool
@@ -519,6 +800,72 @@ func TestAuthority_CheckSSHHost(t *testing.T) {
 	}
 }
 
+func TestAuthority_CheckSSHHost_issued(t *testing.T) {
+	a := testAuthority(t)
+	a.db = db.NewMemory()
+	ctx := context.Background()
+
+	exists, err := a.CheckSSHHost(ctx, "web-3.prod.internal", "")
+	assert.FatalError(t, err)
+	assert.False(t, exists)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	pub, err := ssh.NewPublicKey(key.Public())
+	assert.FatalError(t, err)
+	now := time.Now()
+	cert, err := a.SignSSH(pub, provisioner.SSHOptions{
+		CertType:    "host",
+		KeyID:       "web-3.prod.internal",
+		Principals:  []string{"web-3.prod.internal", "web-3"},
+		ValidAfter:  provisioner.NewTimeDuration(now),
+		ValidBefore: provisioner.NewTimeDuration(now.Add(time.Hour)),
+	})
+	assert.FatalError(t, err)
+	for _, p := range []string{"web-3.prod.internal", "WEB-3"} {
+		exists, err = a.CheckSSHHost(ctx, p, "")
+		assert.FatalError(t, err)
+		assert.True(t, exists, p)
+	}
+
+	assert.FatalError(t, a.db.RevokeSSH(&db.RevokedCertificateInfo{
+		Serial: strconv.FormatUint(cert.Serial, 10),
+	}))
+	exists, err = a.CheckSSHHost(ctx, "web-3.prod.internal", "")
+	assert.FatalError(t, err)
+	assert.False(t, exists)
+
+	// The webhook makes the final decision.
+	var received map[string]interface{}
+	reply := `{"exists": true}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		assert.FatalError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Write([]byte(reply))
+	}))
+	defer srv.Close()
+	a.config.SSH.CheckHostWebhook = &provisioner.Webhook{
+		Name: "inventory",
+		URL:  srv.URL,
+		Kind: provisioner.WebhookKindSSHCheckHost,
+	}
+	exists, err = a.CheckSSHHost(ctx, "web-3.prod.internal", "")
+	assert.FatalError(t, err)
+	assert.True(t, exists)
+	assert.Equals(t, map[string]interface{}{
+		"principal": "web-3.prod.internal",
+		"exists":    false,
+	}, received["sshHost"])
+
+	reply = `{"exists": false}`
+	exists, err = a.CheckSSHHost(ctx, "web-3", "")
+	assert.FatalError(t, err)
+	assert.False(t, exists)
+
+	reply = `[]`
+	_, err = a.CheckSSHHost(ctx, "web-3", "")
+	assert.NotNil(t, err)
+}
 func TestSSHConfig_Validate(t *testing.T) {
 	key, err := jose.GenerateJWK("EC", "P-256", "", "sig", "", 0)
 	assert.FatalError(t, err)
@@ -533,6 +880,9 @@ func TestSSHConfig_Validate(t *testing.T) {
 		{"ok", &SSHConfig{Keys: []*SSHPublicKey{{Type: "host", Key: key.Public()}}}, false},
 		{"badType", &SSHConfig{Keys: []*SSHPublicKey{{Type: "bad", Key: key.Public()}}}, true},
 		{"badKey", &SSHConfig{Keys: []*SSHPublicKey{{Type: "user", Key: *key}}}, true},
+		{"okCheckHostWebhook", &SSHConfig{CheckHostWebhook: &provisioner.Webhook{Name: "inventory", URL: "https://inventory.example.com", Kind: "SSHCHECKHOST"}}, false},
+		{"badCheckHostWebhook", &SSHConfig{CheckHostWebhook: &provisioner.Webhook{Name: "inventory", URL: "ftp://inventory.example.com", Kind: "SSHCHECKHOST"}}, true},
+		{"badCheckHostWebhookKind", &SSHConfig{CheckHostWebhook: &provisioner.Webhook{Name: "inventory", URL: "https://inventory.example.com", Kind: "ENRICHING"}}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -917,3 +1267,269 @@ func TestAuthority_RekeySSH(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthority_RenewSSH_sshpop(t *testing.T) {
+	a := testAuthority(t)
+	key, err := pemutil.Read("./testdata/secrets/ssh_host_ca_key")
+	assert.FatalError(t, err)
+	signer, ok := key.(crypto.Signer)
+	assert.Fatal(t, ok, "could not cast ssh signing key to crypto signer")
+	hostSigner, err := ssh.NewSignerFromSigner(signer)
+	assert.FatalError(t, err)
+	key, err = pemutil.Read("./testdata/secrets/ssh_user_ca_key")
+	assert.FatalError(t, err)
+	signer, ok = key.(crypto.Signer)
+	assert.Fatal(t, ok, "could not cast ssh signing key to crypto signer")
+	userSigner, err := ssh.NewSignerFromSigner(signer)
+	assert.FatalError(t, err)
+
+	p, ok := a.provisioners.Load("sshpop/sshpop")
+	assert.Fatal(t, ok, "sshpop provisioner not found in test authority")
+	aud := testAudiences.SSHRenew[0] + "#sshpop/sshpop"
+	now := time.Now()
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SSHRenewMethod)
+
+	// Host certificate signed by the SSH host CA.
+	hostCert, hostJWK, err := createSSHCert(&ssh.Certificate{
+		Serial:          1234,
+		CertType:        ssh.HostCert,
+		KeyId:           "foo.smallstep.com",
+		ValidPrincipals: []string{"foo.smallstep.com", "foo"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}, hostSigner)
+	assert.FatalError(t, err)
+	tok, err := generateToken("foo", p.GetName(), aud, nil, now, hostJWK, withSSHPOPFile(hostCert))
+	assert.FatalError(t, err)
+
+	_, err = a.Authorize(ctx, tok)
+	assert.FatalError(t, err)
+	oldCert, _, err := provisioner.ExtractSSHPOPCert(tok)
+	assert.FatalError(t, err)
+	cert, err := a.RenewSSH(oldCert)
+	assert.FatalError(t, err)
+	assert.Equals(t, uint32(ssh.HostCert), cert.CertType)
+	assert.Equals(t, hostCert.KeyId, cert.KeyId)
+	assert.Equals(t, hostCert.ValidPrincipals, cert.ValidPrincipals)
+	assert.Equals(t, hostCert.Key.Marshal(), cert.Key.Marshal())
+	assert.Equals(t, hostSigner.PublicKey().Marshal(), cert.SignatureKey.Marshal())
+	assert.NotEquals(t, hostCert.Serial, cert.Serial)
+	assert.Equals(t, hostCert.ValidBefore-hostCert.ValidAfter, cert.ValidBefore-cert.ValidAfter)
+	assert.True(t, cert.ValidAfter > hostCert.ValidAfter)
+	assert.True(t, cert.ValidBefore > hostCert.ValidBefore)
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), hostSigner.PublicKey().Marshal())
+		},
+	}
+	assert.FatalError(t, checker.CheckCert("foo.smallstep.com", cert))
+
+	// Tokens cannot be reused.
+	_, err = a.Authorize(ctx, tok)
+	assert.HasPrefix(t, err.Error(), "authority.Authorize: authority.authorizeSSHRenew: authority.authorizeToken: token already used")
+
+	// User certificates cannot be renewed.
+	userCert, userJWK, err := createSSHCert(&ssh.Certificate{
+		Serial:          1235,
+		CertType:        ssh.UserCert,
+		KeyId:           "foo@smallstep.com",
+		ValidPrincipals: []string{"foo"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}, userSigner)
+	assert.FatalError(t, err)
+	tok, err = generateToken("foo", p.GetName(), aud, nil, now, userJWK, withSSHPOPFile(userCert))
+	assert.FatalError(t, err)
+	_, err = a.Authorize(ctx, tok)
+	assert.HasPrefix(t, err.Error(), "authority.Authorize: authority.authorizeSSHRenew: sshpop.AuthorizeSSHRenew; sshpop certificate must be a host ssh certificate")
+
+	// Host certificates signed by other keys are not accepted.
+	otherCert, otherJWK, err := createSSHCert(&ssh.Certificate{
+		Serial:          1236,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"foo.smallstep.com"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}, userSigner)
+	assert.FatalError(t, err)
+	tok, err = generateToken("foo", p.GetName(), aud, nil, now, otherJWK, withSSHPOPFile(otherCert))
+	assert.FatalError(t, err)
+	_, err = a.Authorize(ctx, tok)
+	assert.HasPrefix(t, err.Error(), "authority.Authorize: authority.authorizeSSHRenew: sshpop.AuthorizeSSHRenew: sshpop.authorizeToken; could not find valid ca signer to verify sshpop certificate")
+}
+
+func TestAuthority_RekeySSH_sshpop(t *testing.T) {
+	a := testAuthority(t)
+	key, err := pemutil.Read("./testdata/secrets/ssh_host_ca_key")
+	assert.FatalError(t, err)
+	signer, ok := key.(crypto.Signer)
+	assert.Fatal(t, ok, "could not cast ssh signing key to crypto signer")
+	hostSigner, err := ssh.NewSignerFromSigner(signer)
+	assert.FatalError(t, err)
+
+	p, ok := a.provisioners.Load("sshpop/sshpop")
+	assert.Fatal(t, ok, "sshpop provisioner not found in test authority")
+	aud := testAudiences.SSHRekey[0] + "#sshpop/sshpop"
+	now := time.Now()
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SSHRekeyMethod)
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	newPub, err := ssh.NewPublicKey(newKey.Public())
+	assert.FatalError(t, err)
+
+	hostCert, hostJWK, err := createSSHCert(&ssh.Certificate{
+		Serial:          1234,
+		CertType:        ssh.HostCert,
+		KeyId:           "foo.smallstep.com",
+		ValidPrincipals: []string{"foo.smallstep.com", "foo"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}, hostSigner)
+	assert.FatalError(t, err)
+	rekey := func(cert *ssh.Certificate, jwk *jose.JSONWebKey, pub ssh.PublicKey) (*ssh.Certificate, error) {
+		tok, err := generateToken("foo", p.GetName(), aud, nil, now, jwk, withSSHPOPFile(cert))
+		assert.FatalError(t, err)
+		signOpts, err := a.Authorize(ctx, tok)
+		if err != nil {
+			return nil, err
+		}
+		oldCert, _, err := provisioner.ExtractSSHPOPCert(tok)
+		assert.FatalError(t, err)
+		return a.RekeySSH(oldCert, pub, signOpts...)
+	}
+
+	// The new certificate has the new key and the old identity.
+	cert, err := rekey(hostCert, hostJWK, newPub)
+	assert.FatalError(t, err)
+	assert.Equals(t, uint32(ssh.HostCert), cert.CertType)
+	assert.Equals(t, hostCert.KeyId, cert.KeyId)
+	assert.Equals(t, hostCert.ValidPrincipals, cert.ValidPrincipals)
+	assert.Equals(t, newPub.Marshal(), cert.Key.Marshal())
+	assert.Equals(t, hostSigner.PublicKey().Marshal(), cert.SignatureKey.Marshal())
+	assert.NotEquals(t, hostCert.Serial, cert.Serial)
+
+	// The old certificate is superseded by the new one.
+	info, err := a.db.(db.SSHSuperseder).GetSSHSupersededBy("1234")
+	assert.FatalError(t, err)
+	if assert.NotNil(t, info) {
+		assert.Equals(t, strconv.FormatUint(cert.Serial, 10), info.NewSerial)
+	}
+
+	// The key must change.
+	_, err = rekey(hostCert, hostJWK, hostCert.Key)
+	if assert.NotNil(t, err) {
+		sc, ok := err.(errs.StatusCoder)
+		assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+		assert.Equals(t, http.StatusBadRequest, sc.StatusCode())
+		assert.HasPrefix(t, err.Error(), "rekeySSH; new public key must be different from the current key")
+	}
+
+	// Expired certificates cannot be rekeyed.
+	expiredCert, expiredJWK, err := createSSHCert(&ssh.Certificate{
+		Serial:          1235,
+		CertType:        ssh.HostCert,
+		KeyId:           "foo.smallstep.com",
+		ValidPrincipals: []string{"foo.smallstep.com"},
+		ValidAfter:      uint64(now.Add(-2 * time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(-time.Hour).Unix()),
+	}, hostSigner)
+	assert.FatalError(t, err)
+	_, err = rekey(expiredCert, expiredJWK, newPub)
+	if assert.NotNil(t, err) {
+		assert.HasPrefix(t, err.Error(), "authority.Authorize: authority.authorizeSSHRekey: sshpop.AuthorizeSSHRekey: sshpop.authorizeToken; sshpop certificate validBefore is in the past")
+	}
+}
+
+func TestAuthority_RevokeSSH(t *testing.T) {
+	a := testAuthority(t)
+	jwk, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	key, err := pemutil.Read("./testdata/secrets/ssh_user_ca_key")
+	assert.FatalError(t, err)
+	signer, ok := key.(crypto.Signer)
+	assert.Fatal(t, ok, "could not cast ssh signing key to crypto signer")
+	userSigner, err := ssh.NewSignerFromSigner(signer)
+	assert.FatalError(t, err)
+
+	p, ok := a.provisioners.Load("sshpop/sshpop")
+	assert.Fatal(t, ok, "sshpop provisioner not found in test authority")
+	now := time.Now()
+	revokeCtx := provisioner.NewContextWithMethod(context.Background(), provisioner.SSHRevokeMethod)
+	revoke := func(serial string) error {
+		tok, err := generateToken("foo@smallstep.com", "step-cli", testAudiences.SSHRevoke[0], nil, now, jwk)
+		assert.FatalError(t, err)
+		return a.Revoke(revokeCtx, &RevokeOptions{
+			Serial:      serial,
+			OTT:         tok,
+			ReasonCode:  1,
+			Reason:      "lost laptop",
+			PassiveOnly: true,
+		})
+	}
+
+	userCert, userJWK, err := createSSHCert(&ssh.Certificate{
+		Serial:          4321,
+		CertType:        ssh.UserCert,
+		KeyId:           "foo@smallstep.com",
+		ValidPrincipals: []string{"foo"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}, userSigner)
+	assert.FatalError(t, err)
+	assert.FatalError(t, revoke("4321"))
+
+	// Revoked certificates cannot be renewed or rekeyed.
+	for aud, method := range map[string]provisioner.Method{
+		testAudiences.SSHRenew[0]: provisioner.SSHRenewMethod,
+		testAudiences.SSHRekey[0]: provisioner.SSHRekeyMethod,
+	} {
+		tok, err := generateToken("foo", p.GetName(), aud+"#sshpop/sshpop", nil, now, userJWK, withSSHPOPFile(userCert))
+		assert.FatalError(t, err)
+		_, err = a.Authorize(provisioner.NewContextWithMethod(context.Background(), method), tok)
+		if assert.NotNil(t, err) {
+			assert.True(t, strings.Contains(err.Error(), "sshpop certificate is revoked"))
+		}
+	}
+
+	// A second revocation is a conflict.
+	for _, fn := range []func() error{
+		func() error { return revoke("4321") },
+		func() error {
+			return a.RevokeSSHByAdmin(&admin.Admin{Subject: "admin@smallstep.com", Provisioner: "step-cli"}, "4321", 0, "")
+		},
+	} {
+		err := fn()
+		if assert.NotNil(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, http.StatusConflict, sc.StatusCode())
+			assert.HasPrefix(t, err.Error(), "authority.Revoke; ssh certificate with serial number 4321 has already been revoked")
+		}
+	}
+
+	// Admins revoke certificates without a token.
+	assert.FatalError(t, a.RevokeSSHByAdmin(&admin.Admin{Subject: "admin@smallstep.com", Provisioner: "step-cli"}, "123", 4, "superseded"))
+	isRevoked, err := a.db.IsSSHRevoked("123")
+	assert.FatalError(t, err)
+	assert.True(t, isRevoked)
+
+	// The revocations are listed by serial number.
+	rcis, err := a.GetSSHRevocations()
+	assert.FatalError(t, err)
+	assert.Len(t, 2, rcis)
+	assert.Equals(t, "123", rcis[0].Serial)
+	assert.Equals(t, "admin@smallstep.com", rcis[0].RevokedBy)
+	assert.Equals(t, 4, rcis[0].ReasonCode)
+	assert.Equals(t, "4321", rcis[1].Serial)
+	assert.Equals(t, "foo@smallstep.com", rcis[1].RevokedBy)
+	assert.Equals(t, "lost laptop", rcis[1].Reason)
+
+	t.Run("not-implemented", func(t *testing.T) {
+		a := testAuthority(t, WithDatabase(&db.SimpleDB{}))
+		_, err := a.GetSSHRevocations()
+		sc, ok := err.(errs.StatusCoder)
+		assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+		assert.Equals(t, http.StatusNotImplemented, sc.StatusCode())
+	})
+}
@@ -2,28 +2,40 @@ package authority
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/tracing"
 	"github.com/smallstep/cli/crypto/pemutil"
-	"github.com/smallstep/cli/crypto/tlsutil"
 	"github.com/smallstep/cli/crypto/x509util"
 	"github.com/smallstep/cli/jose"
+	"github.com/smallstep/nosql"
+	"golang.org/x/crypto/ocsp"
 )
 
-// GetTLSOptions returns the tls options configured.
-func (a *Authority) GetTLSOptions() *tlsutil.TLSOptions {
-	return a.config.TLS
+// GetTLSOptions returns the tls options recommended to the services that get a
+// certificate. If they are not configured, it returns the tls options of the
+// CA.
+func (a *Authority) GetTLSOptions() *TLSOptions {
+	if a.config.TLSOptions != nil {
+		return a.config.TLSOptions
+	}
+	return newTLSOptions(a.config.TLS)
 }
 
 var oidAuthorityKeyIdentifier = asn1.ObjectIdentifier{2, 5, 29, 35}
@@ -58,27 +70,64 @@ func withDefaultASN1DN(def *x509util.ASN1DN) x509util.WithOption {
 	}
 }
 
+// TemplateMeter is implemented by the meters that report the certificate
+// templates that exceed their limits.
+type TemplateMeter interface {
+	TemplateLimitExceeded(kind, limit string)
+}
+
+// templateLimitExceeded returns the provisioner.TemplateLimitError in err, or
+// nil, and reports it if the authority has a TemplateMeter.
+func (a *Authority) templateLimitExceeded(kind string, err error) *provisioner.TemplateLimitError {
+	e, ok := errors.Cause(err).(*provisioner.TemplateLimitError)
+	if !ok {
+		return nil
+	}
+	if m, ok := a.meter.(TemplateMeter); ok {
+		m.TemplateLimitExceeded(kind, e.Limit)
+	}
+	return e
+}
+
 // Sign creates a signed certificate from a certificate signing request.
 func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.Options, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+	return a.SignWithContext(context.Background(), csr, signOpts, extraOpts...)
+}
+
+// SignWithContext creates a signed certificate from a certificate signing
+// request. The context is used to trace the signature and the database
+// operations.
+func (a *Authority) SignWithContext(ctx context.Context, csr *x509.CertificateRequest, signOpts provisioner.Options, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+	// The authority policy is validated after the options of the provisioner.
+	extraOpts = append(extraOpts, a.config.AuthorityConfig.X509Policy.SignOptions()...)
 	var (
 		opts           = []interface{}{errs.WithKeyVal("csr", csr), errs.WithKeyVal("signOptions", signOpts)}
 		mods           = []x509util.WithOption{withDefaultASN1DN(a.config.AuthorityConfig.Template)}
 		certValidators = []provisioner.CertificateValidator{}
+		enrichers      = []provisioner.CertificateEnricher{}
 	)
 
 	// Set backdate with the configured value
 	signOpts.Backdate = a.config.AuthorityConfig.Backdate.Duration
 
 	for _, op := range extraOpts {
+		// Enrichers can also be profile modifiers, they are collected before
+		// the type switch.
+		if e, ok := op.(provisioner.CertificateEnricher); ok {
+			enrichers = append(enrichers, e)
+		}
 		switch k := op.(type) {
 		case provisioner.CertificateValidator:
 			certValidators = append(certValidators, k)
 		case provisioner.CertificateRequestValidator:
 			if err := k.Valid(csr); err != nil {
-				return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.Sign", opts...)
+				return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.Sign",
+					append(opts, errs.WithType(errs.TypePolicyViolation))...)
 			}
 		case provisioner.ProfileModifier:
 			mods = append(mods, k.Option(signOpts))
+		case provisioner.CertificateEnricher:
+			// already collected
 		default:
 			return nil, errs.InternalServer("authority.Sign; invalid extra option type %T", append([]interface{}{k}, opts...)...)
 		}
@@ -88,18 +137,32 @@ func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.Opti
 		return nil, errs.Wrap(http.StatusBadRequest, err, "authority.Sign; invalid certificate request", opts...)
 	}
 
+	for _, e := range enrichers {
+		if err := e.Enrich(csr); err != nil {
+			return nil, errs.Wrap(http.StatusForbidden, err, "authority.Sign; error enriching certificate template", opts...)
+		}
+	}
+
 	leaf, err := x509util.NewLeafProfileWithCSR(csr, a.x509Issuer, a.x509Signer, mods...)
 	if err != nil {
+		if e := a.templateLimitExceeded("x509", err); e != nil {
+			return nil, errs.Wrap(http.StatusBadRequest, e, "authority.Sign",
+				append(opts, errs.WithMessage("%s", e.Message))...)
+		}
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Sign", opts...)
 	}
 
 	for _, v := range certValidators {
 		if err := v.Valid(leaf.Subject(), signOpts); err != nil {
-			return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.Sign", opts...)
+			return nil, errs.Wrap(http.StatusUnauthorized, err, "authority.Sign",
+				append(opts, errs.WithType(errs.TypePolicyViolation))...)
 		}
 	}
 
+	_, span := tracing.Start(ctx, "authority.createCertificate")
 	crtBytes, err := leaf.CreateCertificate()
+	span.RecordError(err)
+	span.End()
 	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err,
 			"authority.Sign; error creating new leaf certificate", opts...)
@@ -111,10 +174,17 @@ func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.Opti
 			"authority.Sign; error parsing new leaf certificate", opts...)
 	}
 
-	if err = a.db.StoreCertificate(serverCert); err != nil {
+	_, span = tracing.Start(ctx, "db.StoreCertificate")
+	err = a.db.StoreCertificate(serverCert)
+	if err != db.ErrNotImplemented {
+		span.RecordError(err)
+	}
+	span.End()
+	if err != nil {
 		if err != db.ErrNotImplemented {
 			return nil, errs.Wrap(http.StatusInternalServerError, err,
-				"authority.Sign; error storing certificate in db", opts...)
+				"authority.Sign; error storing certificate in db",
+				append(opts, errs.WithType(errs.TypeDBUnavailable))...)
 		}
 	}
 
@@ -178,6 +248,17 @@ func (a *Authority) Renew(oldCert *x509.Certificate) ([]*x509.Certificate, error
 		}
 	}
 
+	// The renewed certificate must be allowed by the authority policy, it
+	// might have been issued before the policy was configured.
+	for _, op := range a.config.AuthorityConfig.X509Policy.SignOptions() {
+		if v, ok := op.(provisioner.CertificateValidator); ok {
+			if err := v.Valid(newCert, provisioner.Options{}); err != nil {
+				return nil, errs.Wrap(http.StatusForbidden, err, "authority.Renew",
+					append(opts, errs.WithType(errs.TypePolicyViolation))...)
+			}
+		}
+	}
+
 	leaf, err := x509util.NewLeafProfileWithTemplate(newCert, a.x509Issuer, a.x509Signer)
 	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Renew", opts...)
@@ -196,7 +277,8 @@ func (a *Authority) Renew(oldCert *x509.Certificate) ([]*x509.Certificate, error
 
 	if err = a.db.StoreCertificate(serverCert); err != nil {
 		if err != db.ErrNotImplemented {
-			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Renew; error storing certificate in db", opts...)
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Renew; error storing certificate in db",
+				append(opts, errs.WithType(errs.TypeDBUnavailable))...)
 		}
 	}
 
@@ -216,10 +298,12 @@ type RevokeOptions struct {
 
 // Revoke revokes a certificate.
 //
-// NOTE: Only supports passive revocation - prevent existing certificates from
-// being renewed.
+// NOTE: Besides preventing existing certificates from being renewed, the
+// revoked X.509 certificates are published in the CRL. A certificate revoked
+// with the certificateHold reason is on hold and can be released with
+// Unrevoke.
 //
-// TODO: Add OCSP and CRL support.
+// TODO: Add OCSP support.
 func (a *Authority) Revoke(ctx context.Context, revokeOpts *RevokeOptions) error {
 	opts := []interface{}{
 		errs.WithKeyVal("serialNumber", revokeOpts.Serial),
@@ -227,7 +311,7 @@ func (a *Authority) Revoke(ctx context.Context, revokeOpts *RevokeOptions) error
 		errs.WithKeyVal("reason", revokeOpts.Reason),
 		errs.WithKeyVal("passiveOnly", revokeOpts.PassiveOnly),
 		errs.WithKeyVal("MTLS", revokeOpts.MTLS),
-		errs.WithKeyVal("context", string(provisioner.MethodFromContext(ctx))),
+		errs.WithKeyVal("context", provisioner.MethodFromContext(ctx).String()),
 	}
 	if revokeOpts.MTLS {
 		opts = append(opts, errs.WithKeyVal("certificate", base64.StdEncoding.EncodeToString(revokeOpts.Crt.Raw)))
@@ -241,6 +325,8 @@ func (a *Authority) Revoke(ctx context.Context, revokeOpts *RevokeOptions) error
 		Reason:     revokeOpts.Reason,
 		MTLS:       revokeOpts.MTLS,
 		RevokedAt:  time.Now().UTC(),
+		// A hold is the only revocation that can be released.
+		Provisional: revokeOpts.ReasonCode == ocsp.CertificateHold,
 	}
 
 	var (
@@ -267,6 +353,7 @@ func (a *Authority) Revoke(ctx context.Context, revokeOpts *RevokeOptions) error
 		if !ok {
 			return errs.InternalServer("authority.Revoke; provisioner not found", opts...)
 		}
+		rci.RevokedBy = claims.Subject
 		rci.TokenID, err = p.GetTokenID(revokeOpts.OTT)
 		if err != nil {
 			return errs.Wrap(http.StatusInternalServerError, err,
@@ -280,17 +367,18 @@ func (a *Authority) Revoke(ctx context.Context, revokeOpts *RevokeOptions) error
 			return errs.Wrap(http.StatusUnauthorized, err,
 				"authority.Revoke: unable to load certificate provisioner", opts...)
 		}
+		rci.RevokedBy = revokeOpts.Crt.Subject.CommonName
 	}
 	rci.ProvisionerID = p.GetID()
 	opts = append(opts, errs.WithKeyVal("provisionerID", rci.ProvisionerID))
 
 	if provisioner.MethodFromContext(ctx) == provisioner.SSHRevokeMethod {
-		err = a.db.RevokeSSH(rci)
-	} else { // default to revoke x509
-		err = a.db.Revoke(rci)
+		return a.revokeSSH(rci, opts)
 	}
-	switch err {
+	// default to revoke x509
+	switch err := a.db.Revoke(rci); err {
 	case nil:
+		a.invalidateCRL()
 		return nil
 	case db.ErrNotImplemented:
 		return errs.NotImplemented("authority.Revoke; no persistence layer configured", opts...)
@@ -298,10 +386,130 @@ func (a *Authority) Revoke(ctx context.Context, revokeOpts *RevokeOptions) error
 		return errs.BadRequest("authority.Revoke; certificate with serial "+
 			"number %s has already been revoked", append([]interface{}{rci.Serial}, opts...)...)
 	default:
-		return errs.Wrap(http.StatusInternalServerError, err, "authority.Revoke", opts...)
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.Revoke",
+			append(opts, errs.WithType(errs.TypeDBUnavailable))...)
 	}
 }
 
+// IsRevoked returns true if the certificate with the given serial number has
+// been revoked.
+func (a *Authority) IsRevoked(serial string) (bool, error) {
+	isRevoked, err := a.db.IsRevoked(serial)
+	if err != nil {
+		return false, errs.Wrap(http.StatusInternalServerError, err, "authority.IsRevoked")
+	}
+	return isRevoked, nil
+}
+
+// Unrevoke releases a certificate on hold, the certificate can be used and
+// renewed again and it is removed from the next CRL. Only the certificates
+// revoked with the certificateHold reason can be released.
+func (a *Authority) Unrevoke(serial string) error {
+	opts := []interface{}{errs.WithKeyVal("serialNumber", serial)}
+	store, ok := a.db.(db.RevocationStore)
+	if !ok {
+		return errs.NotImplemented("authority.Unrevoke; the database does not support releasing certificates", opts...)
+	}
+	err := store.Unrevoke(serial)
+	switch {
+	case err == nil:
+		a.invalidateCRL()
+		return nil
+	case nosql.IsErrNotFound(err):
+		return errs.NotFound("authority.Unrevoke; certificate with serial number %s has not been revoked",
+			append([]interface{}{serial}, opts...)...)
+	case err == db.ErrNotOnHold:
+		return errs.BadRequest("authority.Unrevoke; certificate with serial number %s is not on hold",
+			append([]interface{}{serial}, opts...)...)
+	case err == db.ErrNotImplemented:
+		return errs.NotImplemented("authority.Unrevoke; no persistence layer configured", opts...)
+	default:
+		return errs.Wrap(http.StatusInternalServerError, err, "authority.Unrevoke",
+			append(opts, errs.WithType(errs.TypeDBUnavailable))...)
+	}
+}
+
+// DefaultCRLValidity is the time until the next update of the CRL.
+const DefaultCRLValidity = 24 * time.Hour
+
+// crlCache stores the last CRL signed by the authority.
+type crlCache struct {
+	mu      sync.Mutex
+	crl     []byte
+	number  *big.Int
+	refresh time.Time
+}
+
+// invalidateCRL makes the next call to GetCRL sign a new CRL.
+func (a *Authority) invalidateCRL() {
+	a.crl.mu.Lock()
+	a.crl.crl = nil
+	a.crl.mu.Unlock()
+}
+
+// GetCRL returns a DER encoded CRL with the revoked X.509 certificates, signed
+// by the intermediate. The CRL is valid for DefaultCRLValidity, it is cached
+// and signed again after a revocation or a release, or when half of its
+// validity has passed. Each new CRL has a greater CRL number.
+func (a *Authority) GetCRL() ([]byte, error) {
+	store, ok := a.db.(db.RevocationStore)
+	if !ok {
+		return nil, errs.NotImplemented("authority.GetCRL; the database does not support listing revoked certificates")
+	}
+
+	a.crl.mu.Lock()
+	defer a.crl.mu.Unlock()
+
+	now := time.Now().UTC()
+	if a.crl.crl != nil && now.Before(a.crl.refresh) {
+		return a.crl.crl, nil
+	}
+
+	rcis, err := store.GetRevokedCertificates()
+	if err != nil {
+		if err == db.ErrNotImplemented {
+			return nil, errs.NotImplemented("authority.GetCRL; no persistence layer configured")
+		}
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.GetCRL",
+			errs.WithType(errs.TypeDBUnavailable))
+	}
+
+	revoked := make([]x509.RevocationListEntry, 0, len(rcis))
+	for _, rci := range rcis {
+		sn, ok := new(big.Int).SetString(rci.Serial, 10)
+		if !ok {
+			// Not an X.509 serial number.
+			continue
+		}
+		// The unspecified reason is not included, as RFC 5280 recommends.
+		revoked = append(revoked, x509.RevocationListEntry{
+			SerialNumber:   sn,
+			RevocationTime: rci.RevokedAt,
+			ReasonCode:     rci.ReasonCode,
+		})
+	}
+
+	// The number is based on the time, so it also increases after a restart.
+	number := big.NewInt(now.UnixNano())
+	if a.crl.number != nil && number.Cmp(a.crl.number) <= 0 {
+		number.Add(a.crl.number, big.NewInt(1))
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(DefaultCRLValidity),
+		RevokedCertificateEntries: revoked,
+	}, a.x509Issuer, a.x509Signer)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.GetCRL; error signing CRL")
+	}
+
+	a.crl.crl = crl
+	a.crl.number = number
+	a.crl.refresh = now.Add(DefaultCRLValidity / 2)
+	return crl, nil
+}
+
 // GetTLSCertificate creates a new leaf certificate to be used by the CA HTTPS server.
 func (a *Authority) GetTLSCertificate() (*tls.Certificate, error) {
 	profile, err := x509util.NewLeafProfile("Step Online CA", a.x509Issuer, a.x509Signer,
@@ -331,9 +539,8 @@ func (a *Authority) GetTLSCertificate() (*tls.Certificate, error) {
 	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.GetTLSCertificate")
 	}
-	tlsCrt, err := tls.X509KeyPair(append(crtPEM,
-		pem.EncodeToMemory(intermediatePEM)...),
-		pem.EncodeToMemory(keyPEM))
+	chainPEM := append(crtPEM, pem.EncodeToMemory(intermediatePEM)...)
+	tlsCrt, err := tls.X509KeyPair(chainPEM, pem.EncodeToMemory(keyPEM))
 	if err != nil {
 		return nil, errs.Wrap(http.StatusInternalServerError, err,
 			"authority.GetTLSCertificate; error creating tls certificate")
@@ -347,5 +554,80 @@ func (a *Authority) GetTLSCertificate() (*tls.Certificate, error) {
 	}
 	tlsCrt.Leaf = leaf
 
+	// Store the certificate so it can be used after a restart.
+	if a.config.ServerCert != "" {
+		if err := ioutil.WriteFile(a.config.ServerKey, pem.EncodeToMemory(keyPEM), 0600); err != nil {
+			return nil, errs.Wrapf(http.StatusInternalServerError, err,
+				"authority.GetTLSCertificate; error writing %s", a.config.ServerKey)
+		}
+		if err := ioutil.WriteFile(a.config.ServerCert, chainPEM, 0644); err != nil {
+			return nil, errs.Wrapf(http.StatusInternalServerError, err,
+				"authority.GetTLSCertificate; error writing %s", a.config.ServerCert)
+		}
+	}
+
+	return &tlsCrt, nil
+}
+
+// LoadTLSCertificate returns the certificate of the CA HTTPS server stored in
+// the serverCrt and serverKey files. If the files do not exist, or the
+// certificate does not include all the dnsNames, was not issued by the
+// current intermediate or must be renewed, it creates and stores a new one.
+func (a *Authority) LoadTLSCertificate() (*tls.Certificate, error) {
+	if a.config.ServerCert == "" {
+		return a.GetTLSCertificate()
+	}
+	tlsCrt, err := tls.LoadX509KeyPair(a.config.ServerCert, a.config.ServerKey)
+	if err != nil {
+		return a.GetTLSCertificate()
+	}
+	leaf, err := x509.ParseCertificate(tlsCrt.Certificate[0])
+	if err != nil || !a.isValidTLSCertificate(leaf) {
+		return a.GetTLSCertificate()
+	}
+	tlsCrt.Leaf = leaf
 	return &tlsCrt, nil
 }
+
+// isValidTLSCertificate returns true if the given certificate was issued by
+// the intermediate, includes all the dnsNames, and does not need to be renewed
+// yet. The certificates are renewed after two thirds of their lifetime, the
+// same schedule used by the clients.
+func (a *Authority) isValidTLSCertificate(leaf *x509.Certificate) bool {
+	if err := leaf.CheckSignatureFrom(a.x509Issuer); err != nil {
+		return false
+	}
+	now := time.Now()
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	if now.Before(leaf.NotBefore) || leaf.NotAfter.Sub(now) < lifetime/3 {
+		return false
+	}
+	for _, name := range a.config.DNSNames {
+		if ip := net.ParseIP(name); ip != nil {
+			if !containsIP(leaf.IPAddresses, ip) {
+				return false
+			}
+		} else if !containsName(leaf.DNSNames, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
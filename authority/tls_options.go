@@ -0,0 +1,108 @@
+package authority
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/crypto/tlsutil"
+	"github.com/smallstep/cli/crypto/x509util"
+)
+
+// TLSVersion represents a TLS version number, e.g. 1.2 or 1.3. Unlike
+// x509util.TLSVersion it supports TLS 1.3.
+type TLSVersion float64
+
+// tlsVersions has the list of supported TLS versions.
+var tlsVersions = map[TLSVersion]uint16{
+	1.0: tls.VersionTLS10,
+	1.1: tls.VersionTLS11,
+	1.2: tls.VersionTLS12,
+	1.3: tls.VersionTLS13,
+}
+
+// Validate returns an error if the version is not supported. The zero value is
+// valid and means that the version is not set.
+func (v TLSVersion) Validate() error {
+	if _, ok := tlsVersions[v]; ok || v == 0 {
+		return nil
+	}
+	return errors.Errorf("%v is not a valid tls version", float64(v))
+}
+
+// Value returns the Go constant for the TLSVersion, or 0 if it is not set.
+func (v TLSVersion) Value() uint16 {
+	return tlsVersions[v]
+}
+
+// String returns the version number.
+func (v TLSVersion) String() string {
+	return fmt.Sprintf("%.1f", float64(v))
+}
+
+// TLSOptions are the TLS options recommended to the services that get a
+// certificate from the CA. The options are sent in the sign and renew
+// responses, and the bootstrap helpers of the ca package use them to build the
+// tls.Config of the clients and servers. Options that are not set use the
+// defaults of the client.
+type TLSOptions struct {
+	CipherSuites  x509util.CipherSuites `json:"cipherSuites"`
+	MinVersion    TLSVersion            `json:"minVersion"`
+	MaxVersion    TLSVersion            `json:"maxVersion"`
+	Renegotiation bool                  `json:"renegotiation"`
+	// RequireClientCert sets if the servers must require and verify the client
+	// certificates. The servers require them if it is not set.
+	RequireClientCert *bool `json:"requireClientCert,omitempty"`
+}
+
+// newTLSOptions returns the TLSOptions with the same values than the given
+// tlsutil.TLSOptions.
+func newTLSOptions(o *tlsutil.TLSOptions) *TLSOptions {
+	if o == nil {
+		return nil
+	}
+	return &TLSOptions{
+		CipherSuites:  o.CipherSuites,
+		MinVersion:    TLSVersion(o.MinVersion),
+		MaxVersion:    TLSVersion(o.MaxVersion),
+		Renegotiation: o.Renegotiation,
+	}
+}
+
+// Validate validates the TLS options.
+func (o *TLSOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if err := o.MinVersion.Validate(); err != nil {
+		return errors.Wrap(err, "tlsOptions minVersion")
+	}
+	if err := o.MaxVersion.Validate(); err != nil {
+		return errors.Wrap(err, "tlsOptions maxVersion")
+	}
+	if o.MinVersion != 0 && o.MaxVersion != 0 && o.MinVersion > o.MaxVersion {
+		return errors.New("tlsOptions minVersion cannot exceed tlsOptions maxVersion")
+	}
+	if err := o.CipherSuites.Validate(); err != nil {
+		return errors.Wrap(err, "tlsOptions cipherSuites")
+	}
+	return nil
+}
+
+// TLSConfig returns the tls.Config equivalent of the TLSOptions.
+func (o *TLSOptions) TLSConfig() *tls.Config {
+	rs := tls.RenegotiateNever
+	if o.Renegotiation {
+		rs = tls.RenegotiateFreelyAsClient
+	}
+	var cipherSuites []uint16
+	if len(o.CipherSuites) > 0 {
+		cipherSuites = o.CipherSuites.Value()
+	}
+	return &tls.Config{
+		CipherSuites:  cipherSuites,
+		MinVersion:    o.MinVersion.Value(),
+		MaxVersion:    o.MaxVersion.Value(),
+		Renegotiation: rs,
+	}
+}
@@ -0,0 +1,66 @@
+package authority
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+
+	"github.com/smallstep/cli/crypto/x509util"
+)
+
+func TestTLSOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *TLSOptions
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"empty", &TLSOptions{}, false},
+		{"tls 1.3", &TLSOptions{MinVersion: 1.3, MaxVersion: 1.3}, false},
+		{"min version only", &TLSOptions{MinVersion: 1.2}, false},
+		{"cipher suites", &TLSOptions{CipherSuites: x509util.CipherSuites{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, false},
+		{"fail min version", &TLSOptions{MinVersion: 0.9}, true},
+		{"fail max version", &TLSOptions{MaxVersion: 1.4}, true},
+		{"fail min over max", &TLSOptions{MinVersion: 1.3, MaxVersion: 1.2}, true},
+		{"fail cipher suites", &TLSOptions{CipherSuites: x509util.CipherSuites{"TLS_FOO_WITH_BAR"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("TLSOptions.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSOptions_TLSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *TLSOptions
+		want    *tls.Config
+	}{
+		{"empty", &TLSOptions{}, &tls.Config{Renegotiation: tls.RenegotiateNever}},
+		{"tls 1.3", &TLSOptions{MinVersion: 1.3, MaxVersion: 1.3}, &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			MaxVersion: tls.VersionTLS13,
+		}},
+		{"all", &TLSOptions{
+			CipherSuites:  x509util.CipherSuites{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			MinVersion:    1.0,
+			MaxVersion:    1.2,
+			Renegotiation: true,
+		}, &tls.Config{
+			CipherSuites:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			MinVersion:    tls.VersionTLS10,
+			MaxVersion:    tls.VersionTLS12,
+			Renegotiation: tls.RenegotiateFreelyAsClient,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.TLSConfig(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TLSOptions.TLSConfig() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
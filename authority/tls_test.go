@@ -8,9 +8,13 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -332,6 +336,239 @@ ZYtQ9Ot36qc=
 	}
 }
 
+func TestAuthority_Sign_provisionerTemplates(t *testing.T) {
+	a := testAuthority(t)
+	jwk, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+
+	dir, err := ioutil.TempDir("", "templates")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	webTemplate := filepath.Join(dir, "web.tpl")
+	assert.FatalError(t, ioutil.WriteFile(webTemplate, []byte(`{
+		"subject": {"commonName": {{ toJson .Subject }}},
+		"dnsNames": {{ toJson .SANs }},
+		"extKeyUsage": ["serverAuth"]
+	}`), 0600))
+
+	deviceOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	deviceValue, err := asn1.Marshal("sensor")
+	assert.FatalError(t, err)
+	iotData, err := json.Marshal(map[string]interface{}{
+		"deviceOID":   deviceOID.String(),
+		"deviceValue": deviceValue,
+	})
+	assert.FatalError(t, err)
+
+	for _, p := range []provisioner.Interface{
+		&provisioner.JWK{
+			Name: "iot", Type: "JWK", Key: &pub,
+			X509: &provisioner.X509Options{
+				Template: `{
+					"subject": {"commonName": {{ toJson .Subject }}, "organizationalUnit": [{{ toJson .Provisioner.Name }}]},
+					"extKeyUsage": ["clientAuth"],
+					"extensions": [{"id": {{ toJson .TemplateData.deviceOID }}, "value": {{ toJson .TemplateData.deviceValue }}}]
+				}`,
+				TemplateData: iotData,
+			},
+		},
+		&provisioner.JWK{
+			Name: "web", Type: "JWK", Key: &pub,
+			X509: &provisioner.X509Options{TemplateFile: webTemplate},
+		},
+		&provisioner.JWK{
+			Name: "workload", Type: "JWK", Key: &pub,
+			X509: &provisioner.X509Options{
+				Template:     `{"extensions": [{"id": {{ toJson .TemplateData.deviceOID }}, "value": {{ .Insecure.User.deploymentID | b64enc | toJson }}}]}`,
+				TemplateData: iotData,
+			},
+		},
+	} {
+		assert.FatalError(t, p.Init(a.provisionerConfig))
+		assert.FatalError(t, a.provisioners.Store(p))
+	}
+
+	sign := func(name string, opts provisioner.Options) *x509.Certificate {
+		token, err := generateToken("smallstep test", name, testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), jwk)
+		assert.FatalError(t, err)
+		signOpts, err := a.AuthorizeSign(token)
+		assert.FatalError(t, err)
+		priv, err := keys.GenerateDefaultKey()
+		assert.FatalError(t, err)
+		certs, err := a.Sign(getCSR(t, priv), opts, signOpts...)
+		assert.FatalError(t, err)
+		return certs[0]
+	}
+
+	iot := sign("iot", provisioner.Options{})
+	assert.Equals(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, iot.ExtKeyUsage)
+	assert.Equals(t, []string{"iot"}, iot.Subject.OrganizationalUnit)
+	var found bool
+	for _, ext := range iot.Extensions {
+		if ext.Id.Equal(deviceOID) {
+			found = true
+			assert.Equals(t, deviceValue, ext.Value)
+		}
+	}
+	assert.True(t, found)
+
+	web := sign("web", provisioner.Options{})
+	assert.Equals(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, web.ExtKeyUsage)
+	assert.Equals(t, []string{"test.smallstep.com"}, web.DNSNames)
+	for _, ext := range web.Extensions {
+		assert.False(t, ext.Id.Equal(deviceOID))
+	}
+
+	// The template data of the request is embedded in an extension.
+	userData, err := provisioner.ParseUserData([]byte(`{"deploymentID": "d-1234"}`))
+	assert.FatalError(t, err)
+	workload := sign("workload", provisioner.Options{UserData: userData})
+	found = false
+	for _, ext := range workload.Extensions {
+		if ext.Id.Equal(deviceOID) {
+			found = true
+			assert.Equals(t, []byte("d-1234"), ext.Value)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestAuthority_Sign_defaultTemplate(t *testing.T) {
+	a := testAuthority(t)
+	jwk, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+
+	policyOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+	a.provisionerConfig.X509 = &provisioner.X509Options{
+		Template: `{
+			"subject": {"commonName": {{ toJson .Subject }}, "organizationalUnit": ["Engineering"]},
+			"extensions": [{"id": {{ toJson .TemplateData.policyOID }}, "value": "MAA="}]
+		}`,
+		TemplateData: []byte(`{"policyOID": "` + policyOID.String() + `"}`),
+	}
+	assert.FatalError(t, a.provisionerConfig.X509.InitDefault())
+
+	for _, p := range []provisioner.Interface{
+		&provisioner.JWK{Name: "baseline", Type: "JWK", Key: &pub},
+		&provisioner.JWK{
+			Name: "override", Type: "JWK", Key: &pub,
+			X509: &provisioner.X509Options{Template: `{"subject": {"commonName": {{ toJson .Subject }}, "organizationalUnit": ["Web"]}}`},
+		},
+	} {
+		assert.FatalError(t, p.Init(a.provisionerConfig))
+		assert.FatalError(t, a.provisioners.Store(p))
+	}
+
+	// The default template cannot be combined with the template data of a
+	// provisioner without a template.
+	ambiguous := &provisioner.JWK{
+		Name: "ambiguous", Type: "JWK", Key: &pub,
+		X509: &provisioner.X509Options{TemplateData: []byte(`{"policyOID": "1.2.3.4"}`)},
+	}
+	assert.Error(t, ambiguous.Init(a.provisionerConfig))
+
+	sign := func(name string) (*x509.Certificate, string) {
+		token, err := generateToken("smallstep test", name, testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), jwk)
+		assert.FatalError(t, err)
+		signOpts, err := a.AuthorizeSign(token)
+		assert.FatalError(t, err)
+		priv, err := keys.GenerateDefaultKey()
+		assert.FatalError(t, err)
+		certs, err := a.Sign(getCSR(t, priv), provisioner.Options{}, signOpts...)
+		assert.FatalError(t, err)
+		return certs[0], provisioner.X509TemplateSource(signOpts)
+	}
+	hasPolicy := func(cert *x509.Certificate) bool {
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(policyOID) {
+				return true
+			}
+		}
+		return false
+	}
+
+	baseline, source := sign("baseline")
+	assert.Equals(t, provisioner.TemplateSourceAuthority, source)
+	assert.Equals(t, []string{"Engineering"}, baseline.Subject.OrganizationalUnit)
+	assert.True(t, hasPolicy(baseline))
+
+	override, source := sign("override")
+	assert.Equals(t, provisioner.TemplateSourceProvisioner, source)
+	assert.Equals(t, []string{"Web"}, override.Subject.OrganizationalUnit)
+	assert.False(t, hasPolicy(override))
+
+	// The provisioners initialized without a default template use the built-in
+	// one.
+	builtin, source := sign("step-cli")
+	assert.Equals(t, provisioner.TemplateSourceDefault, source)
+	assert.Len(t, 0, builtin.Subject.OrganizationalUnit)
+}
+
+type templateMeter struct {
+	limits []string
+}
+
+func (m *templateMeter) TokenValidationFailed(reason string) {}
+
+func (m *templateMeter) TemplateLimitExceeded(kind, limit string) {
+	m.limits = append(m.limits, kind+"/"+limit)
+}
+
+func TestAuthority_Sign_templateLimits(t *testing.T) {
+	meter := &templateMeter{}
+	a := testAuthority(t, WithMeter(meter))
+	jwk, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+
+	limits := &provisioner.TemplateLimits{
+		Timeout:       &provisioner.Duration{Duration: 50 * time.Millisecond},
+		MaxOutputSize: 1024,
+		MaxIterations: 1 << 30,
+	}
+	for name, tmpl := range map[string]string{
+		"slow":  `{{ $l := splitList "" (repeat 100 "x") }}{{ range $l }}{{ range $l }}{{ range $l }}{{ $_ := add 1 1 }}{{ end }}{{ end }}{{ end }}{}`,
+		"bomb":  `{"subject": {"commonName": {{ repeat 2048 "x" | toJson }}}}`,
+		"panic": `{"subject": {"commonName": "{{ div 1 0 }}"}}`,
+		"ok":    `{"subject": {"commonName": {{ toJson .Subject }}}}`,
+	} {
+		p := &provisioner.JWK{
+			Name: name, Type: "JWK", Key: &pub,
+			X509: &provisioner.X509Options{Template: tmpl, Limits: limits},
+		}
+		assert.FatalError(t, p.Init(a.provisionerConfig))
+		assert.FatalError(t, a.provisioners.Store(p))
+	}
+
+	sign := func(name string) ([]*x509.Certificate, error) {
+		token, err := generateToken("smallstep test", name, testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), jwk)
+		assert.FatalError(t, err)
+		signOpts, err := a.AuthorizeSign(token)
+		assert.FatalError(t, err)
+		priv, err := keys.GenerateDefaultKey()
+		assert.FatalError(t, err)
+		return a.Sign(getCSR(t, priv), provisioner.Options{}, signOpts...)
+	}
+
+	for _, name := range []string{"slow", "bomb", "panic"} {
+		_, err := sign(name)
+		if assert.NotNil(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, http.StatusBadRequest, sc.StatusCode())
+			assert.HasPrefix(t, err.(*errs.Error).Msg, "error executing x509 template of provisioner "+name)
+		}
+	}
+	assert.Equals(t, []string{"x509/timeout", "x509/outputSize", "x509/panic"}, meter.limits)
+
+	// The next requests are signed.
+	certs, err := sign("ok")
+	assert.FatalError(t, err)
+	assert.Equals(t, "smallstep test", certs[0].Subject.CommonName)
+}
+
 func TestAuthority_Renew(t *testing.T) {
 	pub, _, err := keys.GenerateDefaultKeyPair()
 	assert.FatalError(t, err)
@@ -546,12 +783,17 @@ func TestAuthority_Renew(t *testing.T) {
 func TestAuthority_GetTLSOptions(t *testing.T) {
 	type renewTest struct {
 		auth *Authority
-		opts *tlsutil.TLSOptions
+		opts *TLSOptions
 	}
 	tests := map[string]func() (*renewTest, error){
 		"default": func() (*renewTest, error) {
 			a := testAuthority(t)
-			return &renewTest{auth: a, opts: &DefaultTLSOptions}, nil
+			return &renewTest{auth: a, opts: &TLSOptions{
+				CipherSuites:  DefaultTLSOptions.CipherSuites,
+				MinVersion:    1.2,
+				MaxVersion:    1.2,
+				Renegotiation: false,
+			}}, nil
 		},
 		"non-default": func() (*renewTest, error) {
 			a := testAuthority(t)
@@ -564,7 +806,21 @@ func TestAuthority_GetTLSOptions(t *testing.T) {
 				MaxVersion:    1.1,
 				Renegotiation: true,
 			}
-			return &renewTest{auth: a, opts: a.config.TLS}, nil
+			return &renewTest{auth: a, opts: &TLSOptions{
+				CipherSuites:  a.config.TLS.CipherSuites,
+				MinVersion:    1.0,
+				MaxVersion:    1.1,
+				Renegotiation: true,
+			}}, nil
+		},
+		"tls-options": func() (*renewTest, error) {
+			a := testAuthority(t)
+			requireClientCert := false
+			a.config.TLSOptions = &TLSOptions{
+				MinVersion:        1.3,
+				RequireClientCert: &requireClientCert,
+			}
+			return &renewTest{auth: a, opts: a.config.TLSOptions}, nil
 		},
 	}
 
@@ -616,7 +872,7 @@ func TestAuthority_Revoke(t *testing.T) {
 				code: http.StatusUnauthorized,
 			}
 		},
-		"fail/nil-db": func() test {
+		"fail/no-persistence": func() test {
 			cl := jwt.Claims{
 				Subject:   "sn",
 				Issuer:    validIssuer,
@@ -628,8 +884,18 @@ func TestAuthority_Revoke(t *testing.T) {
 			raw, err := jwt.Signed(sig).Claims(cl).CompactSerialize()
 			assert.FatalError(t, err)
 
+			// SimpleDB does not store the revocations.
+			_a := testAuthority(t, WithDatabase(&db.MockAuthDB{
+				MUseToken: func(id, tok string) (bool, error) {
+					return true, nil
+				},
+				MRevoke: func(rci *db.RevokedCertificateInfo) error {
+					return db.ErrNotImplemented
+				},
+			}))
+
 			return test{
-				auth: a,
+				auth: _a,
 				opts: &RevokeOptions{
 					Serial:     "sn",
 					ReasonCode: reasonCode,
@@ -779,7 +1045,7 @@ func TestAuthority_Revoke(t *testing.T) {
 					assert.Equals(t, ctxErr.Details["reasonCode"], tc.opts.ReasonCode)
 					assert.Equals(t, ctxErr.Details["reason"], tc.opts.Reason)
 					assert.Equals(t, ctxErr.Details["MTLS"], tc.opts.MTLS)
-					assert.Equals(t, ctxErr.Details["context"], string(provisioner.RevokeMethod))
+					assert.Equals(t, ctxErr.Details["context"], provisioner.RevokeMethod.String())
 
 					if tc.checkErrDetails != nil {
 						tc.checkErrDetails(ctxErr)
@@ -791,3 +1057,156 @@ func TestAuthority_Revoke(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthority_Unrevoke(t *testing.T) {
+	_, priv, err := keys.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	key, err := jose.ParseKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+
+	a := testAuthority(t)
+	sign := func(cn string) *x509.Certificate {
+		t.Helper()
+		token, err := generateToken(cn, "step-cli", testAudiences.Sign[0], []string{cn}, time.Now(), key)
+		assert.FatalError(t, err)
+		signOpts, err := a.AuthorizeSign(token)
+		assert.FatalError(t, err)
+		csr := getCSR(t, priv, func(csr *x509.CertificateRequest) {
+			csr.Subject.CommonName = cn
+			csr.DNSNames = []string{cn}
+		})
+		certs, err := a.Sign(csr, provisioner.Options{}, signOpts...)
+		assert.FatalError(t, err)
+		return certs[0]
+	}
+	code := func(err error) int {
+		t.Helper()
+		e, ok := err.(*errs.Error)
+		assert.Fatal(t, ok, "error type %T is not *errs.Error", err)
+		return e.StatusCode()
+	}
+
+	t.Run("ok/revoke", func(t *testing.T) {
+		crt := sign("test.smallstep.com")
+		serial := crt.SerialNumber.String()
+		token, err := generateToken("revoker", "step-cli", testAudiences.Revoke[0], nil, time.Now(), key)
+		assert.FatalError(t, err)
+		assert.FatalError(t, a.Revoke(context.Background(), &RevokeOptions{
+			Serial: serial, ReasonCode: 1, Reason: "key compromise", OTT: token,
+		}))
+		rci, err := a.db.(db.CertificateFinder).GetRevokedCertificate(serial)
+		assert.FatalError(t, err)
+		assert.Equals(t, serial, rci.Serial)
+		assert.Equals(t, 1, rci.ReasonCode)
+		assert.Equals(t, "key compromise", rci.Reason)
+		assert.Equals(t, "revoker", rci.RevokedBy)
+		assert.False(t, rci.Provisional)
+		assert.False(t, rci.RevokedAt.IsZero())
+
+		// Revoking twice is a conflict, even with a different reason.
+		err = a.Revoke(context.Background(), &RevokeOptions{
+			Serial: serial, ReasonCode: 6, MTLS: true, Crt: crt,
+		})
+		assert.Equals(t, http.StatusBadRequest, code(err))
+
+		// Only holds can be released.
+		assert.Equals(t, http.StatusBadRequest, code(a.Unrevoke(serial)))
+		isRevoked, err := a.IsRevoked(serial)
+		assert.FatalError(t, err)
+		assert.True(t, isRevoked)
+	})
+
+	t.Run("ok/hold", func(t *testing.T) {
+		crt := sign("hold.smallstep.com")
+		serial := crt.SerialNumber.String()
+		assert.FatalError(t, a.Revoke(context.Background(), &RevokeOptions{
+			Serial: serial, ReasonCode: 6, MTLS: true, Crt: crt,
+		}))
+		rci, err := a.db.(db.CertificateFinder).GetRevokedCertificate(serial)
+		assert.FatalError(t, err)
+		assert.Equals(t, "hold.smallstep.com", rci.RevokedBy)
+		assert.True(t, rci.Provisional)
+		assert.True(t, rci.MTLS)
+
+		assert.FatalError(t, a.Unrevoke(serial))
+		isRevoked, err := a.IsRevoked(serial)
+		assert.FatalError(t, err)
+		assert.False(t, isRevoked)
+		assert.Equals(t, http.StatusNotFound, code(a.Unrevoke(serial)))
+
+		// A released certificate can be revoked again.
+		assert.FatalError(t, a.Revoke(context.Background(), &RevokeOptions{
+			Serial: serial, ReasonCode: 4, MTLS: true, Crt: crt,
+		}))
+	})
+
+	t.Run("fail/not-implemented", func(t *testing.T) {
+		_a := testAuthority(t, WithDatabase(&db.SimpleDB{}))
+		assert.Equals(t, http.StatusNotImplemented, code(_a.Unrevoke("1234")))
+		_, err := _a.GetCRL()
+		assert.Equals(t, http.StatusNotImplemented, code(err))
+	})
+}
+
+func TestAuthority_GetCRL(t *testing.T) {
+	a := testAuthority(t)
+	rdb := a.db.(*db.DB)
+
+	crl, err := a.GetCRL()
+	assert.FatalError(t, err)
+	list, err := x509.ParseRevocationList(crl)
+	assert.FatalError(t, err)
+	assert.Equals(t, 0, len(list.RevokedCertificateEntries))
+	number := list.Number
+
+	// The CRL is cached and it is not signed again if nothing has changed.
+	cached, err := a.GetCRL()
+	assert.FatalError(t, err)
+	assert.Equals(t, crl, cached)
+
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+	for _, rci := range []*db.RevokedCertificateInfo{
+		{Serial: "100", ReasonCode: 1, RevokedAt: revokedAt},
+		{Serial: "200", ReasonCode: 0, RevokedAt: revokedAt},
+		{Serial: "300", ReasonCode: 6, RevokedAt: revokedAt, Provisional: true},
+		{Serial: "400", ReasonCode: 6, RevokedAt: revokedAt, Provisional: true},
+	} {
+		assert.FatalError(t, rdb.Revoke(rci))
+	}
+	// The release signs a new CRL.
+	assert.FatalError(t, a.Unrevoke("400"))
+
+	crl, err = a.GetCRL()
+	assert.FatalError(t, err)
+	list, err = x509.ParseRevocationList(crl)
+	assert.FatalError(t, err)
+	assert.FatalError(t, list.CheckSignatureFrom(a.x509Issuer))
+	assert.True(t, list.Number.Cmp(number) > 0)
+	assert.True(t, list.NextUpdate.After(time.Now().Add(DefaultCRLValidity-time.Minute)))
+
+	reasons := map[string]int{}
+	for _, rc := range list.RevokedCertificateEntries {
+		assert.True(t, revokedAt.Equal(rc.RevocationTime))
+		reasons[rc.SerialNumber.String()] = rc.ReasonCode
+		// The unspecified reason is omitted.
+		if rc.ReasonCode == 0 {
+			assert.Equals(t, 0, len(rc.Extensions))
+		}
+	}
+	// The released hold is not in the list.
+	assert.Equals(t, map[string]int{"100": 1, "200": 0, "300": 6}, reasons)
+
+	// A revocation signs a new CRL.
+	number = list.Number
+	crt, err := pemutil.ReadCertificate("./testdata/certs/foo.crt")
+	assert.FatalError(t, err)
+	assert.FatalError(t, a.Revoke(context.Background(), &RevokeOptions{
+		Serial: "500", ReasonCode: 1, MTLS: true, Crt: crt,
+	}))
+	crl, err = a.GetCRL()
+	assert.FatalError(t, err)
+	list, err = x509.ParseRevocationList(crl)
+	assert.FatalError(t, err)
+	assert.True(t, list.Number.Cmp(number) > 0)
+	assert.Equals(t, 4, len(list.RevokedCertificateEntries))
+}
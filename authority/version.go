@@ -1,17 +1,30 @@
 package authority
 
+import "github.com/smallstep/certificates/version"
+
 // GlobalVersion stores the version information of the server.
 var GlobalVersion = Version{
-	Version: "0.0.0",
+	Version:   version.Version,
+	GitCommit: version.GitCommit,
+	BuildTime: version.BuildTime,
+	GoVersion: version.GoVersion(),
 }
 
-// Version defines the
+// Version defines the version information of the server, and whether clients
+// must use a client certificate to renew.
 type Version struct {
 	Version                     string
+	GitCommit                   string
+	BuildTime                   string
+	GoVersion                   string
 	RequireClientAuthentication bool
 }
 
-// Version returns the version information of the server.
+// Version returns the version information of the server. Renewals are always
+// authenticated with the certificate being renewed, so the server requires
+// client authentication on renew.
 func (a *Authority) Version() Version {
-	return GlobalVersion
+	v := GlobalVersion
+	v.RequireClientAuthentication = true
+	return v
 }
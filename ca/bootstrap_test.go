@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/cli/crypto/randutil"
@@ -44,6 +45,10 @@ func startCABootstrapServer() *httptest.Server {
 	if err != nil {
 		panic(err)
 	}
+	return startCABootstrapServerWithConfig(config)
+}
+
+func startCABootstrapServerWithConfig(config *authority.Config) *httptest.Server {
 	srv := httptest.NewUnstartedServer(nil)
 	config.Address = srv.Listener.Addr().String()
 	ca, err := New(config)
@@ -311,6 +316,48 @@ func TestBootstrapClient(t *testing.T) {
 	}
 }
 
+func TestBootstrap_tlsOptions(t *testing.T) {
+	config, err := authority.LoadConfiguration("testdata/ca.json")
+	assert.FatalError(t, err)
+	requireClientCert := false
+	config.TLSOptions = &authority.TLSOptions{
+		MinVersion:        1.3,
+		MaxVersion:        1.3,
+		RequireClientCert: &requireClientCert,
+	}
+	srv := startCABootstrapServerWithConfig(config)
+	defer srv.Close()
+	token := func() string {
+		return generateBootstrapToken(srv.URL, "subject", "ef742f95dc0d8aa82d3cca4017af6dac3fce84290344159891952d18c53eefe7")
+	}
+
+	// The client uses the recommended TLS 1.3, but the CA listener keeps its
+	// own tls settings and only accepts up to TLS 1.2.
+	client, err := BootstrapClient(context.Background(), token())
+	assert.FatalError(t, err)
+	tlsConfig := client.Transport.(*http.Transport).TLSClientConfig
+	assert.Equals(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.Equals(t, uint16(tls.VersionTLS13), tlsConfig.MaxVersion)
+	_, err = client.Post(srv.URL+"/renew", "application/json", http.NoBody)
+	assert.Error(t, err)
+	assert.Equals(t, uint16(tls.VersionTLS12), srv.TLS.MaxVersion)
+
+	// The server does not require client certificates.
+	server, err := BootstrapServer(context.Background(), token(), &http.Server{})
+	assert.FatalError(t, err)
+	assert.Equals(t, uint16(tls.VersionTLS13), server.TLSConfig.MinVersion)
+	assert.Equals(t, tls.VerifyClientCertIfGiven, server.TLSConfig.ClientAuth)
+
+	// Local options override the recommended ones.
+	server, err = BootstrapServer(context.Background(), token(), &http.Server{}, RequireAndVerifyClientCert(), func(ctx *TLSOptionCtx) error {
+		ctx.Config.MinVersion = tls.VersionTLS12
+		return nil
+	})
+	assert.FatalError(t, err)
+	assert.Equals(t, uint16(tls.VersionTLS12), server.TLSConfig.MinVersion)
+	assert.Equals(t, tls.RequireAndVerifyClientCert, server.TLSConfig.ClientAuth)
+}
+
 func TestBootstrapClientServerRotation(t *testing.T) {
 	reset := setMinCertDuration(1 * time.Second)
 	defer reset()
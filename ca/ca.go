@@ -1,13 +1,17 @@
 package ca
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
@@ -15,10 +19,17 @@ import (
 	acmeAPI "github.com/smallstep/certificates/acme/api"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority"
+	adminAPI "github.com/smallstep/certificates/authority/admin/api"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/logging"
+	"github.com/smallstep/certificates/metrics"
 	"github.com/smallstep/certificates/monitoring"
+	"github.com/smallstep/certificates/ratelimit"
+	"github.com/smallstep/certificates/scep"
+	scepAPI "github.com/smallstep/certificates/scep/api"
 	"github.com/smallstep/certificates/server"
+	"github.com/smallstep/certificates/tracing"
+	"github.com/smallstep/certificates/version"
 	"github.com/smallstep/nosql"
 )
 
@@ -26,6 +37,9 @@ type options struct {
 	configFile string
 	password   []byte
 	database   db.AuthDB
+	metrics    *metrics.Metrics
+	tracer     tracing.Tracer
+	exporter   *tracing.OTLPExporter
 }
 
 func (o *options) apply(opts []Option) {
@@ -60,14 +74,35 @@ func WithDatabase(db db.AuthDB) Option {
 	}
 }
 
+// WithMetrics sets the metrics of the CA, they will be recorded even if the
+// metrics listener is not configured. Applications embedding the CA can use it
+// to expose the metrics in their own registry.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithTracer sets the tracer used to trace the requests to the CA, it is used
+// instead of the tracing configuration. Applications embedding the CA can use
+// it to send the spans to their own tracing library.
+func WithTracer(t tracing.Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
 // CA is the type used to build the complete certificate authority. It builds
 // the HTTP server, set ups the middlewares and the HTTP handlers.
 type CA struct {
-	auth    *authority.Authority
-	config  *authority.Config
-	srv     *server.Server
-	opts    *options
-	renewer *TLSRenewer
+	auth        *authority.Authority
+	config      *authority.Config
+	srv         *server.Server
+	insecureSrv *server.Server
+	metricsSrv  *http.Server
+	opts        *options
+	renewer     *TLSRenewer
+	stopACME    func()
 }
 
 // New creates and initializes the CA with the given configuration and options.
@@ -86,8 +121,34 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 		ca.config.Password = string(ca.opts.password)
 	}
 
+	// Create the metrics if configured, they are kept on reloads.
+	if ca.opts.metrics == nil && config.Metrics != nil {
+		ca.opts.metrics = metrics.New()
+	}
+
+	// Create the tracer if configured, it is kept on reloads.
+	if ca.opts.tracer == nil && config.Tracing != nil {
+		exporter, err := tracing.NewOTLPExporter(config.Tracing)
+		if err != nil {
+			return nil, err
+		}
+		ca.opts.tracer = tracing.NewTracer(exporter)
+		ca.opts.exporter = exporter
+	}
+
 	var opts []authority.Option
-	if ca.opts.database != nil {
+	if m := ca.opts.metrics; m != nil {
+		// Initialize the database here to record the duration of the
+		// operations of the authority, ACME will use it without the metrics.
+		if ca.opts.database == nil {
+			database, err := authority.NewDatabase(config)
+			if err != nil {
+				return nil, err
+			}
+			ca.opts.database = database
+		}
+		opts = append(opts, authority.WithDatabase(m.WrapDB(ca.opts.database)), authority.WithMeter(m))
+	} else if ca.opts.database != nil {
 		opts = append(opts, authority.WithDatabase(ca.opts.database))
 	}
 
@@ -106,10 +167,26 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 	handler := http.Handler(mux)
 
 	// Add regular CA api endpoints in / and /1.0
-	routerHandler := api.New(auth)
-	routerHandler.Route(mux)
+	var apiOpts []api.Option
+	if rl := config.AuthorityConfig.RateLimit; rl != nil && rl.Unauthenticated != nil {
+		apiOpts = append(apiOpts, api.WithUnauthenticatedRateLimit(ratelimit.New(*rl.Unauthenticated)))
+	}
+	if rl := config.AuthorityConfig.RateLimit; rl != nil && rl.Concurrency != nil {
+		apiOpts = append(apiOpts, concurrencyLimit(rl.Concurrency, ca.opts.metrics))
+	}
+	if config.CORS != nil {
+		apiOpts = append(apiOpts, api.WithCORS(config.CORS))
+	}
+	if d := config.AuthorityConfig.RenewGracePeriod; d != nil {
+		apiOpts = append(apiOpts, api.WithRenewGracePeriod(d.Duration))
+	}
+	// Limit the size of the request bodies of all the endpoints
+	bodyLimiter := api.NewBodyLimiter(config.BodyLimits)
+
+	routerHandler := api.New(auth, apiOpts...)
+	routerHandler.Route(bodyLimiter.Router(mux, ""))
 	mux.Route("/1.0", func(r chi.Router) {
-		routerHandler.Route(r)
+		routerHandler.Route(bodyLimiter.Router(r, ""))
 	})
 
 	//Add ACME api endpoints in /acme and /1.0/acme
@@ -122,20 +199,53 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 	if port != "" && port != "443" {
 		dns = fmt.Sprintf("%s:%s", dns, port)
 	}
+	// Behind a proxy the ACME links use the external URL.
+	if config.ExternalURL != "" {
+		if u, err = url.Parse(config.ExternalURL); err != nil {
+			return nil, errors.Wrap(err, "error parsing externalURL")
+		}
+		dns = u.Host + strings.TrimSuffix(u.Path, "/")
+	}
+
+	acmeDB := ca.opts.database
+	if acmeDB == nil {
+		acmeDB = auth.GetDatabase()
+	}
 
 	prefix := "acme"
-	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), dns, prefix, auth)
+	acmeAuth, err := acme.NewAuthority(acmeDB.(nosql.DB), dns, prefix, auth)
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating ACME authority")
 	}
+	// Stop the cleanup and the challenge validations on shutdown and reload.
+	stopCleanup := func() {}
+	if c := config.AuthorityConfig.Cleanup; c == nil || !c.Disabled {
+		stopCleanup = acmeAuth.StartCleanup(acmeCleanupOptions(c, ca.opts.metrics))
+	}
+	ca.stopACME = func() {
+		stopCleanup()
+		acmeAuth.Shutdown()
+	}
 	acmeRouterHandler := acmeAPI.New(acmeAuth)
 	mux.Route("/"+prefix, func(r chi.Router) {
-		acmeRouterHandler.Route(r)
+		acmeRouterHandler.Route(bodyLimiter.Router(r, "/"+prefix))
 	})
 	// Use 2.0 because, at the moment, our ACME api is only compatible with v2.0
 	// of the ACME spec.
 	mux.Route("/2.0/"+prefix, func(r chi.Router) {
-		acmeRouterHandler.Route(r)
+		acmeRouterHandler.Route(bodyLimiter.Router(r, "/"+prefix))
+	})
+
+	// Add SCEP api endpoints in /scep
+	scepRouterHandler := scepAPI.New(scep.NewAuthority(auth))
+	mux.Route("/scep", func(r chi.Router) {
+		scepRouterHandler.Route(bodyLimiter.Router(r, "/scep"))
+	})
+
+	// Add admin api endpoints in /admin
+	adminRouterHandler := adminAPI.New(auth, acmeAuth)
+	mux.Route("/admin", func(r chi.Router) {
+		adminRouterHandler.Route(bodyLimiter.Router(r, "/admin"))
 	})
 
 	/*
@@ -149,6 +259,22 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 		}
 	*/
 
+	// Add tracing if configured, it runs inside the metrics middleware to use
+	// the same routing context.
+	if ca.opts.tracer != nil {
+		handler = tracing.Middleware(ca.opts.tracer, handler)
+	}
+
+	// Add metrics if configured
+	if ca.opts.metrics != nil {
+		handler = ca.opts.metrics.Middleware(handler)
+	}
+
+	// Add the version header unless disabled
+	if !config.DisableVersionHeader {
+		handler = versionHeader(handler)
+	}
+
 	// Add monitoring if configured
 	if len(config.Monitoring) > 0 {
 		m, err := monitoring.New(config.Monitoring)
@@ -159,31 +285,121 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 	}
 
 	// Add logger if configured
+	var logger *logging.Logger
 	if len(config.Logger) > 0 {
-		logger, err := logging.New("ca", config.Logger)
-		if err != nil {
+		if logger, err = logging.New("ca", config.Logger); err != nil {
 			return nil, err
 		}
 		handler = logger.Middleware(handler)
 	}
 
 	ca.auth = auth
-	ca.srv = server.New(config.Address, handler, tlsConfig)
+	serverOpts := serverOptions(config.Server)
+	ca.srv = server.New(config.Address, handler, tlsConfig, serverOpts...)
+
+	// Add the endpoints served over plain HTTP if configured
+	if config.InsecureAddress != "" {
+		insecureMux := chi.NewRouter()
+		insecureHandler := http.Handler(insecureMux)
+		insecureRouterHandler := api.NewInsecure(auth, apiOpts...)
+		insecureRouterHandler.Route(insecureMux)
+		insecureMux.Route("/1.0", func(r chi.Router) {
+			insecureRouterHandler.Route(r)
+		})
+		if ca.opts.tracer != nil {
+			insecureHandler = tracing.Middleware(ca.opts.tracer, insecureHandler)
+		}
+		if logger != nil {
+			insecureHandler = logger.Middleware(insecureHandler)
+		}
+		ca.insecureSrv = server.New(config.InsecureAddress, insecureHandler, nil, serverOpts...)
+	}
+	if config.Metrics != nil {
+		ca.metricsSrv = &http.Server{
+			Addr:    config.Metrics.Address,
+			Handler: ca.opts.metrics.Handler(),
+		}
+	}
 	return ca, nil
 }
 
-// Run starts the CA calling to the server ListenAndServe method.
+// Run starts the CA listeners and calls to the server Serve method.
 func (ca *CA) Run() error {
-	return ca.srv.ListenAndServe()
+	log.Printf("Starting %s", version.String())
+	if ca.metricsSrv != nil {
+		ln, err := net.Listen("tcp", ca.metricsSrv.Addr)
+		if err != nil {
+			return errors.Wrap(err, "error starting metrics listener")
+		}
+		log.Printf("Serving metrics on %s", ln.Addr())
+		go func() {
+			if err := ca.metricsSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Printf("error serving metrics: %v", err)
+			}
+		}()
+	}
+
+	// Listen on the main address first, so it uses the socket activation
+	// listener if any.
+	ln, err := server.Listen(ca.srv.Addr)
+	if err != nil {
+		return err
+	}
+	if ca.insecureSrv != nil {
+		insecureLn, err := server.Listen(ca.insecureSrv.Addr)
+		if err != nil {
+			ln.Close()
+			return errors.Wrap(err, "error starting insecure listener")
+		}
+		go func() {
+			if err := ca.insecureSrv.Serve(insecureLn); err != nil && err != http.ErrServerClosed {
+				log.Printf("error serving insecure listener: %v", err)
+			}
+		}()
+	}
+	return ca.srv.Serve(ln)
 }
 
-// Stop stops the CA calling to the server Shutdown method.
+// Stop stops the CA calling to the server Shutdown method. The active requests
+// have the configured shutdown timeout to finish.
 func (ca *CA) Stop() error {
+	timeout := server.ServerShutdownTimeout
+	if ca.config.ShutdownTimeout != nil {
+		timeout = ca.config.ShutdownTimeout.Duration
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ca.Shutdown(ctx)
+}
+
+// Shutdown gracefully shuts down the CA. It stops accepting new connections,
+// waits for the active requests to finish until the context is done, and then
+// stops the authority.
+func (ca *CA) Shutdown(ctx context.Context) error {
+	err := ca.srv.Shutdown(ctx)
+	if ca.insecureSrv != nil {
+		if err := ca.insecureSrv.Shutdown(ctx); err != nil {
+			log.Printf("error stopping insecure listener: %v\n", err)
+		}
+	}
+	if ca.metricsSrv != nil {
+		if err := ca.metricsSrv.Close(); err != nil {
+			log.Printf("error stopping metrics listener: %v\n", err)
+		}
+	}
 	ca.renewer.Stop()
+	if ca.stopACME != nil {
+		ca.stopACME()
+	}
 	if err := ca.auth.Shutdown(); err != nil {
 		log.Printf("error stopping ca.Authority: %+v\n", err)
 	}
-	return ca.srv.Shutdown()
+	if ca.opts.exporter != nil {
+		if err := ca.opts.exporter.Shutdown(ctx); err != nil {
+			log.Printf("error exporting the pending spans: %v\n", err)
+		}
+	}
+	return err
 }
 
 // Reload reloads the configuration of the CA and calls to the server Reload
@@ -200,16 +416,58 @@ func (ca *CA) Reload() error {
 		log.Println("You can force a restart by sending a SIGTERM signal and then restarting the step-ca.")
 	}
 
-	// Do not allow reload if the database configuration has changed.
-	if !reflect.DeepEqual(ca.config.DB, config.DB) {
+	// Do not allow reload if the database configuration has changed, except
+	// the data source of the databases that can reload it.
+	reloadDB := db.CanReload(ca.config.DB, config.DB)
+	if !reloadDB && !reflect.DeepEqual(ca.config.DB, config.DB) {
 		logContinue("Reload failed because the database configuration has changed.")
 		return errors.New("error reloading ca: database configuration cannot change")
 	}
 
+	// Do not allow reload if the metrics configuration has changed.
+	if !reflect.DeepEqual(ca.config.Metrics, config.Metrics) {
+		logContinue("Reload failed because the metrics configuration has changed.")
+		return errors.New("error reloading ca: metrics configuration cannot change")
+	}
+
+	// Do not allow reload if the tracing configuration has changed.
+	if !reflect.DeepEqual(ca.config.Tracing, config.Tracing) {
+		logContinue("Reload failed because the tracing configuration has changed.")
+		return errors.New("error reloading ca: tracing configuration cannot change")
+	}
+
+	// Do not allow reload if the insecure listener is added or removed.
+	if (ca.config.InsecureAddress == "") != (config.InsecureAddress == "") {
+		logContinue("Reload failed because the insecure address has been added or removed.")
+		return errors.New("error reloading ca: insecureAddress cannot be added or removed")
+	}
+
+	// Reuse the database without the metrics, they are added again by the
+	// new CA.
+	database := ca.opts.database
+	if database == nil {
+		database = ca.auth.GetDatabase()
+	}
+
+	// Reconnect to the database to use the new credentials.
+	if reloadDB {
+		rdb, ok := database.(interface{ Reload(*db.Config) error })
+		if !ok {
+			logContinue("Reload failed because the database cannot be reloaded.")
+			return errors.New("error reloading ca: database cannot be reloaded")
+		}
+		if err := rdb.Reload(config.DB); err != nil {
+			logContinue("Reload failed because the database could not be reloaded.")
+			return errors.Wrap(err, "error reloading ca")
+		}
+	}
+
 	newCA, err := New(config,
 		WithPassword(ca.opts.password),
 		WithConfigFile(ca.opts.configFile),
-		WithDatabase(ca.auth.GetDatabase()),
+		WithDatabase(database),
+		WithMetrics(ca.opts.metrics),
+		WithTracer(ca.opts.tracer),
 	)
 	if err != nil {
 		logContinue("Reload failed because the CA with new configuration could not be initialized.")
@@ -221,12 +479,25 @@ func (ca *CA) Reload() error {
 		return errors.Wrap(err, "error reloading server")
 	}
 
+	if ca.insecureSrv != nil {
+		if err = ca.insecureSrv.Reload(newCA.insecureSrv); err != nil {
+			logContinue("Reload failed because insecure server could not be replaced.")
+			return errors.Wrap(err, "error reloading insecure server")
+		}
+	}
+
 	// 1. Stop previous renewer
 	// 2. Replace ca properties
 	// Do not replace ca.srv
 	ca.renewer.Stop()
+	if ca.stopACME != nil {
+		ca.stopACME()
+	}
+	ca.auth.CloseForReload()
 	ca.auth = newCA.auth
+	ca.stopACME = newCA.stopACME
 	ca.config = newCA.config
+	newCA.opts.exporter = ca.opts.exporter
 	ca.opts = newCA.opts
 	ca.renewer = newCA.renewer
 	return nil
@@ -235,8 +506,8 @@ func (ca *CA) Reload() error {
 // getTLSConfig returns a TLSConfig for the CA server with a self-renewing
 // server certificate.
 func (ca *CA) getTLSConfig(auth *authority.Authority) (*tls.Config, error) {
-	// Create initial TLS certificate
-	tlsCrt, err := auth.GetTLSCertificate()
+	// Load or create the initial TLS certificate
+	tlsCrt, err := auth.LoadTLSCertificate()
 	if err != nil {
 		return nil, err
 	}
@@ -277,8 +548,10 @@ func (ca *CA) getTLSConfig(auth *authority.Authority) (*tls.Config, error) {
 	tlsConfig.Certificates = []tls.Certificate{}
 	tlsConfig.GetCertificate = ca.renewer.GetCertificateForCA
 
-	// Add support for mutual tls to renew certificates
-	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	// Add support for mutual tls to renew certificates. The client certificate
+	// is requested but verified by the handlers, this allows the renewal of
+	// expired certificates in the configured grace period.
+	tlsConfig.ClientAuth = tls.RequestClientCert
 	tlsConfig.ClientCAs = certPool
 
 	// Use server's most preferred ciphersuite
@@ -286,3 +559,83 @@ func (ca *CA) getTLSConfig(auth *authority.Authority) (*tls.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// VersionHeader is the name of the HTTP header with the version of step-ca.
+const VersionHeader = "X-Smallstep-Version"
+
+// acmeCleanupOptions returns the options of the deletion of the expired ACME
+// objects. The metrics are optional.
+func acmeCleanupOptions(c *authority.CleanupConfig, m *metrics.Metrics) acme.CleanupOptions {
+	var opts acme.CleanupOptions
+	if c != nil {
+		opts.BatchSize = c.BatchSize
+		if c.Interval != nil {
+			opts.Interval = c.Interval.Duration
+		}
+		if c.ACMERetention != nil {
+			opts.Retention = c.ACMERetention.Duration
+		}
+	}
+	if m != nil {
+		opts.Deleted = m.ExpiredEntriesDeleted
+	}
+	return opts
+}
+
+// concurrencyLimit returns the API option that limits the sign and renew
+// requests in flight. The metrics are optional.
+func concurrencyLimit(c *authority.ConcurrencyLimitConfig, m *metrics.Metrics) api.Option {
+	timeout, retryAfter := time.Second, time.Second
+	if c.QueueTimeout != nil {
+		timeout = c.QueueTimeout.Duration
+	}
+	if c.RetryAfter != nil {
+		retryAfter = c.RetryAfter.Duration
+	}
+	var observer ratelimit.Observer
+	if m != nil {
+		observer = m
+	}
+	l := ratelimit.NewConcurrencyLimiter(c.MaxInFlight, c.MaxQueued, timeout, observer)
+	return api.WithConcurrencyLimit(l, retryAfter)
+}
+
+// serverOptions returns the options of the HTTP servers of the CA, the options
+// not configured use the defaults of the server package.
+func serverOptions(c *authority.ServerConfig) []server.Option {
+	if c == nil {
+		return nil
+	}
+	var opts []server.Option
+	if c.ReadTimeout != nil {
+		opts = append(opts, server.WithReadTimeout(c.ReadTimeout.Duration))
+	}
+	if c.ReadHeaderTimeout != nil {
+		opts = append(opts, server.WithReadHeaderTimeout(c.ReadHeaderTimeout.Duration))
+	}
+	if c.WriteTimeout != nil {
+		opts = append(opts, server.WithWriteTimeout(c.WriteTimeout.Duration))
+	}
+	if c.IdleTimeout != nil {
+		opts = append(opts, server.WithIdleTimeout(c.IdleTimeout.Duration))
+	}
+	if c.MaxHeaderBytes > 0 {
+		opts = append(opts, server.WithMaxHeaderBytes(c.MaxHeaderBytes))
+	}
+	if c.DisableHTTP2 {
+		opts = append(opts, server.WithHTTP2(false))
+	}
+	if c.TCPKeepAlivePeriod != nil {
+		opts = append(opts, server.WithKeepAlivePeriod(c.TCPKeepAlivePeriod.Duration))
+	}
+	return opts
+}
+
+// versionHeader is a middleware that adds the version of step-ca to the
+// responses, it can be disabled with the disableVersionHeader option.
+func versionHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(VersionHeader, version.Version)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -23,9 +29,13 @@ import (
 	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/metrics"
+	"github.com/smallstep/certificates/tracing"
+	"github.com/smallstep/certificates/version"
 	"github.com/smallstep/cli/crypto/keys"
 	"github.com/smallstep/cli/crypto/pemutil"
 	"github.com/smallstep/cli/crypto/randutil"
+	"github.com/smallstep/cli/crypto/tlsutil"
 	"github.com/smallstep/cli/crypto/x509util"
 	stepJOSE "github.com/smallstep/cli/jose"
 	jose "gopkg.in/square/go-jose.v2"
@@ -357,7 +367,12 @@ func TestCAProvisioners(t *testing.T) {
 					var resp api.ProvisionersResponse
 
 					assert.FatalError(t, readJSON(body, &resp))
-					a, err := json.Marshal(config.AuthorityConfig.Provisioners)
+					// The provisioners are sorted by name.
+					want := append(provisioner.List{}, config.AuthorityConfig.Provisioners...)
+					sort.SliceStable(want, func(i, j int) bool {
+						return want[i].GetName() < want[j].GetName()
+					})
+					a, err := json.Marshal(want)
 					assert.FatalError(t, err)
 					b, err := json.Marshal(resp.Provisioners)
 					assert.FatalError(t, err)
@@ -420,9 +435,13 @@ func TestCAProvisionerEncryptedKey(t *testing.T) {
 			if assert.Equals(t, rr.Code, tc.status) {
 				body := &ClosingBuffer{rr.Body}
 				if rr.Code < http.StatusBadRequest {
-					var ek api.ProvisionerKeyResponse
-					assert.FatalError(t, readJSON(body, &ek))
-					assert.Equals(t, ek.Key, tc.expectedKey)
+					assert.Equals(t, "no-cache", rr.Header().Get("Cache-Control"))
+					// The response only contains the encrypted key.
+					var m map[string]interface{}
+					assert.FatalError(t, readJSON(body, &m))
+					assert.Equals(t, map[string]interface{}{"key": tc.expectedKey}, m)
+					_, err := jose.ParseEncrypted(tc.expectedKey)
+					assert.FatalError(t, err)
 				} else {
 					err := readError(body)
 					if len(tc.errMsg) == 0 {
@@ -496,6 +515,40 @@ func TestCARoot(t *testing.T) {
 	}
 }
 
+func TestCAVersionHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		disable bool
+		want    string
+	}{
+		{"enabled", false, version.Version},
+		{"disabled", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := authority.LoadConfiguration("testdata/ca.json")
+			assert.FatalError(t, err)
+			config.DisableVersionHeader = tt.disable
+			ca, err := New(config)
+			assert.FatalError(t, err)
+
+			rq, err := http.NewRequest("GET", "/version", strings.NewReader(""))
+			assert.FatalError(t, err)
+			rr := httptest.NewRecorder()
+			ca.srv.Handler.ServeHTTP(rr, rq)
+
+			assert.Equals(t, http.StatusOK, rr.Code)
+			assert.Equals(t, tt.want, rr.Header().Get(VersionHeader))
+
+			var v api.VersionResponse
+			assert.FatalError(t, readJSON(&ClosingBuffer{rr.Body}, &v))
+			assert.Equals(t, version.Version, v.Version)
+			assert.Equals(t, version.GoVersion(), v.GoVersion)
+			assert.True(t, v.RequireClientAuthentication)
+		})
+	}
+}
+
 func TestCAHealth(t *testing.T) {
 	config, err := authority.LoadConfiguration("testdata/ca.json")
 	assert.FatalError(t, err)
@@ -530,13 +583,299 @@ func TestCAHealth(t *testing.T) {
 				if rr.Code < http.StatusBadRequest {
 					var health api.HealthResponse
 					assert.FatalError(t, readJSON(body, &health))
-					assert.Equals(t, health, api.HealthResponse{Status: "ok"})
+					assert.Equals(t, health, api.HealthResponse{Status: "ok", Components: map[string]authority.HealthCheck{
+						"config": {Status: "ok"},
+						"db":     {Status: "ok"},
+						"signer": {Status: "ok"},
+					}})
 				}
 			}
 		})
 	}
 }
 
+func TestCAMetrics(t *testing.T) {
+	_, priv, err := keys.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+
+	config, err := authority.LoadConfiguration("testdata/ca.json")
+	assert.FatalError(t, err)
+	config.Metrics = &metrics.Config{Address: "127.0.0.1:0"}
+	ca, err := New(config)
+	assert.FatalError(t, err)
+
+	clijwk, err := stepJOSE.ParseKey("testdata/secrets/step_cli_key_priv.jwk",
+		stepJOSE.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: clijwk.Key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", clijwk.KeyID))
+	assert.FatalError(t, err)
+
+	now := time.Now().UTC()
+	signBody := func(t *testing.T) string {
+		jti, err := randutil.ASCII(32)
+		assert.FatalError(t, err)
+		raw, err := jwt.Signed(sig).Claims(jwt.Claims{
+			Subject:   "test.smallstep.com",
+			Issuer:    "step-cli",
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(time.Minute)),
+			Audience:  []string{"https://127.0.0.1:0/sign"},
+			ID:        jti,
+		}).CompactSerialize()
+		assert.FatalError(t, err)
+		csr, err := getCSR(priv)
+		assert.FatalError(t, err)
+		body, err := json.Marshal(&api.SignRequest{
+			CsrPEM: api.CertificateRequest{CertificateRequest: csr},
+			OTT:    raw,
+		})
+		assert.FatalError(t, err)
+		return string(body)
+	}
+	sign := func(t *testing.T, body string) int {
+		rq, err := http.NewRequest("POST", "/sign", strings.NewReader(body))
+		assert.FatalError(t, err)
+		rr := httptest.NewRecorder()
+		ca.srv.Handler.ServeHTTP(rr, rq)
+		return rr.Code
+	}
+
+	// Two certificates signed and a token reused.
+	body := signBody(t)
+	assert.Equals(t, http.StatusCreated, sign(t, body))
+	assert.Equals(t, http.StatusCreated, sign(t, signBody(t)))
+	assert.Equals(t, http.StatusUnauthorized, sign(t, body))
+
+	rq, err := http.NewRequest("GET", "/metrics", nil)
+	assert.FatalError(t, err)
+	rr := httptest.NewRecorder()
+	ca.metricsSrv.Handler.ServeHTTP(rr, rq)
+	assert.Equals(t, http.StatusOK, rr.Code)
+
+	scraped := rr.Body.String()
+	for _, want := range []string{
+		`step_ca_http_requests_total{endpoint="/sign",provisioner="step-cli",status="201"} 2`,
+		`step_ca_http_requests_total{endpoint="/sign",provisioner="",status="401"} 1`,
+		`step_ca_http_request_duration_seconds_count{endpoint="/sign",provisioner="step-cli",status="201"} 2`,
+		`step_ca_certificates_total{operation="issued",provisioner="step-cli"} 2`,
+		`step_ca_token_validation_failures_total{reason="reused"} 1`,
+		`step_ca_db_operation_duration_seconds_count{operation="use_token"} 3`,
+		`step_ca_db_operation_duration_seconds_count{operation="store_certificate"} 2`,
+	} {
+		assert.True(t, strings.Contains(scraped, want+"\n"), fmt.Sprintf("metrics do not contain %s", want))
+	}
+}
+
+func TestCATracing(t *testing.T) {
+	_, priv, err := keys.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+
+	// The webhook receives the trace context of its span.
+	var traceparent string
+	whSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(tracing.TraceparentHeader)
+		w.Write([]byte(`{"serial":"1234"}`))
+	}))
+	defer whSrv.Close()
+
+	config, err := authority.LoadConfiguration("testdata/ca.json")
+	assert.FatalError(t, err)
+	config.Metrics = &metrics.Config{Address: "127.0.0.1:0"}
+	for _, p := range config.AuthorityConfig.Provisioners {
+		if p, ok := p.(*provisioner.JWK); ok && p.Name == "step-cli" {
+			p.X509 = &provisioner.X509Options{Template: `{"dnsNames": {{ toJson .SANs }}}`}
+			p.Webhooks = []*provisioner.Webhook{{Name: "device", URL: whSrv.URL, Kind: provisioner.WebhookKindEnriching}}
+		}
+	}
+	exporter := new(tracing.InMemoryExporter)
+	tracer := tracing.NewTracer(exporter)
+	ca, err := New(config, WithTracer(tracer))
+	assert.FatalError(t, err)
+	srv := httptest.NewServer(ca.srv.Handler)
+	defer srv.Close()
+
+	clijwk, err := stepJOSE.ParseKey("testdata/secrets/step_cli_key_priv.jwk",
+		stepJOSE.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: clijwk.Key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", clijwk.KeyID))
+	assert.FatalError(t, err)
+	jti, err := randutil.ASCII(32)
+	assert.FatalError(t, err)
+	now := time.Now().UTC()
+	raw, err := jwt.Signed(sig).Claims(jwt.Claims{
+		Subject:   "test.smallstep.com",
+		Issuer:    "step-cli",
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(time.Minute)),
+		Audience:  []string{"https://127.0.0.1:0/sign"},
+		ID:        jti,
+	}).CompactSerialize()
+	assert.FatalError(t, err)
+	csr, err := getCSR(priv)
+	assert.FatalError(t, err)
+
+	client, err := NewClient(srv.URL, WithTransport(http.DefaultTransport), WithClientTracer(tracer))
+	assert.FatalError(t, err)
+	_, err = client.Sign(&api.SignRequest{
+		CsrPEM: api.CertificateRequest{CertificateRequest: csr},
+		OTT:    raw,
+	})
+	assert.FatalError(t, err)
+
+	spans := make(map[string]*tracing.SpanData)
+	for _, s := range exporter.Spans() {
+		spans[s.Name] = s
+	}
+	clientSpan, ok := spans["HTTP POST"]
+	assert.Fatal(t, ok, "client span not found")
+	assert.Equals(t, tracing.SpanKindClient, clientSpan.Kind)
+	assert.False(t, clientSpan.Parent.IsValid())
+
+	serverSpan, ok := spans["POST /sign"]
+	assert.Fatal(t, ok, "server span not found")
+	assert.Equals(t, tracing.SpanKindServer, serverSpan.Kind)
+	assert.Equals(t, clientSpan.SpanContext.SpanID, serverSpan.Parent.SpanID)
+	assert.True(t, serverSpan.Parent.Remote)
+	assert.Equals(t, 201, serverSpan.Attribute("http.status_code"))
+
+	// The operations of the sign request are children of the server span.
+	for _, name := range []string{
+		"authority.authorizeSign",
+		"provisioner.callWebhook",
+		"provisioner.renderTemplate",
+		"authority.createCertificate",
+		"db.StoreCertificate",
+	} {
+		s, ok := spans[name]
+		assert.Fatal(t, ok, fmt.Sprintf("span %s not found", name))
+		assert.Equals(t, serverSpan.SpanContext.TraceID, s.SpanContext.TraceID)
+		assert.Equals(t, serverSpan.SpanContext.SpanID, s.Parent.SpanID, fmt.Sprintf("span %s is not a child of the server span", name))
+		assert.Equals(t, "", s.Error)
+	}
+	assert.Equals(t, "step-cli", spans["authority.authorizeSign"].Attribute("provisioner"))
+	assert.Equals(t, "device", spans["provisioner.callWebhook"].Attribute("webhook.name"))
+
+	// The webhook call has its own client span.
+	var webhookClientSpan *tracing.SpanData
+	for _, s := range exporter.Spans() {
+		if s.Kind == tracing.SpanKindClient && s.Parent.SpanID == spans["provisioner.callWebhook"].SpanContext.SpanID {
+			webhookClientSpan = s
+		}
+	}
+	assert.Fatal(t, webhookClientSpan != nil, "webhook client span not found")
+	assert.Equals(t, "00-"+serverSpan.SpanContext.TraceID.String()+"-"+webhookClientSpan.SpanContext.SpanID.String()+"-01", traceparent)
+}
+
+func TestCATLSOptions(t *testing.T) {
+	config, err := authority.LoadConfiguration("testdata/ca.json")
+	assert.FatalError(t, err)
+	config.TLS = &tlsutil.TLSOptions{
+		CipherSuites: x509util.CipherSuites{
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		},
+		MinVersion: 1.2,
+		MaxVersion: 1.2,
+	}
+	ca, err := New(config)
+	assert.FatalError(t, err)
+
+	crt, err := ca.auth.GetTLSCertificate()
+	assert.FatalError(t, err)
+	srv := httptest.NewUnstartedServer(ca.srv.Handler)
+	srv.TLS = ca.srv.TLSConfig.Clone()
+	srv.TLS.Certificates = []tls.Certificate{*crt}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		config  *tls.Config
+		wantErr bool
+	}{
+		{"ok", &tls.Config{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12}, false},
+		{"ok cipher suite", &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}, false},
+		{"fail tls 1.1", &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, true},
+		{"fail tls 1.3", &tls.Config{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS13}, true},
+		{"fail cbc cipher suite", &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.InsecureSkipVerify = true
+			conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tls.Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				assert.Equals(t, uint16(tls.VersionTLS12), conn.ConnectionState().Version)
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestCAInsecure(t *testing.T) {
+	config, err := authority.LoadConfiguration("testdata/ca.json")
+	assert.FatalError(t, err)
+	config.InsecureAddress = "127.0.0.1:0"
+	ca, err := New(config)
+	assert.FatalError(t, err)
+
+	root := ca.auth.GetRootCertificate()
+	sum := sha256.Sum256(root.Raw)
+	fp := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"ok root", "GET", "/root/" + fp, "", http.StatusOK},
+		{"ok root 1.0", "GET", "/1.0/root/" + fp, "", http.StatusOK},
+		{"ok health", "GET", "/health", "", http.StatusOK},
+		{"fail root fingerprint", "GET", "/root/" + strings.Repeat("0", 64), "", http.StatusNotFound},
+		{"fail sign", "POST", "/sign", "{}", http.StatusNotFound},
+		{"fail sign 1.0", "POST", "/1.0/sign", "{}", http.StatusNotFound},
+		{"fail renew", "POST", "/renew", "", http.StatusNotFound},
+		{"fail revoke", "POST", "/revoke", "{}", http.StatusNotFound},
+		{"fail ssh sign", "POST", "/ssh/sign", "{}", http.StatusNotFound},
+		{"fail roots", "GET", "/roots", "", http.StatusNotFound},
+		{"fail crl", "GET", "/crl", "", http.StatusNotFound},
+		{"fail provisioners", "GET", "/provisioners", "", http.StatusNotFound},
+		{"fail acme", "GET", "/acme/step-cli/directory", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			assert.FatalError(t, err)
+			rr := httptest.NewRecorder()
+			ca.insecureSrv.Handler.ServeHTTP(rr, rq)
+			assert.Equals(t, tt.status, rr.Code)
+
+			if rr.Code == http.StatusOK && strings.Contains(tt.path, "/root/") {
+				var res api.RootResponse
+				assert.FatalError(t, readJSON(&ClosingBuffer{rr.Body}, &res))
+				assert.Equals(t, root.Raw, res.RootPEM.Raw)
+			}
+		})
+	}
+
+	// The insecure listener does not use TLS.
+	assert.Nil(t, ca.insecureSrv.TLSConfig)
+}
+
 func TestCARenew(t *testing.T) {
 	pub, _, err := keys.GenerateDefaultKeyPair()
 	assert.FatalError(t, err)
@@ -575,16 +914,16 @@ func TestCARenew(t *testing.T) {
 			return &renewTest{
 				ca:           ca,
 				tlsConnState: nil,
-				status:       http.StatusBadRequest,
-				errMsg:       errs.BadRequestDefaultMsg,
+				status:       http.StatusUnauthorized,
+				errMsg:       "The renew endpoint requires the certificate to renew",
 			}
 		},
 		"request-missing-peer-certificate": func(t *testing.T) *renewTest {
 			return &renewTest{
 				ca:           ca,
 				tlsConnState: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{}},
-				status:       http.StatusBadRequest,
-				errMsg:       errs.BadRequestDefaultMsg,
+				status:       http.StatusUnauthorized,
+				errMsg:       "The renew endpoint requires the certificate to renew",
 			}
 		},
 		"success": func(t *testing.T) *renewTest {
@@ -600,7 +939,7 @@ func TestCARenew(t *testing.T) {
 			return &renewTest{
 				ca: ca,
 				tlsConnState: &tls.ConnectionState{
-					PeerCertificates: []*x509.Certificate{crt},
+					PeerCertificates: []*x509.Certificate{crt, intermediateIdentity.Crt},
 				},
 				status: http.StatusCreated,
 			}
@@ -652,7 +991,11 @@ func TestCARenew(t *testing.T) {
 					assert.FatalError(t, err)
 					assert.Equals(t, intermediate, realIntermediate)
 
-					assert.Equals(t, *sign.TLSOptions, authority.DefaultTLSOptions)
+					assert.Equals(t, *sign.TLSOptions, authority.TLSOptions{
+						CipherSuites: authority.DefaultTLSOptions.CipherSuites,
+						MinVersion:   1.2,
+						MaxVersion:   1.2,
+					})
 				} else {
 					err := readError(body)
 					if len(tc.errMsg) == 0 {
@@ -664,3 +1007,49 @@ func TestCARenew(t *testing.T) {
 		})
 	}
 }
+
+func TestCAServerCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	newCA := func(t *testing.T, dnsNames ...string) *x509.Certificate {
+		config, err := authority.LoadConfiguration("testdata/ca.json")
+		assert.FatalError(t, err)
+		config.ServerCert = filepath.Join(dir, "server.crt")
+		config.ServerKey = filepath.Join(dir, "server_key")
+		config.DNSNames = append(config.DNSNames, dnsNames...)
+		ca, err := New(config)
+		assert.FatalError(t, err)
+		defer ca.renewer.Stop()
+		crt, err := ca.srv.TLSConfig.GetCertificate(&tls.ClientHelloInfo{})
+		assert.FatalError(t, err)
+		return crt.Leaf
+	}
+
+	// The certificate is stored and used again after a restart.
+	crt1 := newCA(t)
+	fi, err := os.Stat(filepath.Join(dir, "server_key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, os.FileMode(0600), fi.Mode().Perm())
+	crt2 := newCA(t)
+	assert.Equals(t, crt1.SerialNumber, crt2.SerialNumber)
+
+	// A new certificate is created if a name is added.
+	crt3 := newCA(t, "ca.smallstep.com", "10.1.2.3")
+	assert.NotEquals(t, crt1.SerialNumber, crt3.SerialNumber)
+	assert.Equals(t, []string{"ca.smallstep.com"}, crt3.DNSNames)
+	assert.Len(t, 2, crt3.IPAddresses)
+	assert.True(t, crt3.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+	assert.True(t, crt3.IPAddresses[1].Equal(net.ParseIP("10.1.2.3")))
+
+	// The new certificate is also stored.
+	crt4 := newCA(t, "ca.smallstep.com", "10.1.2.3")
+	assert.Equals(t, crt3.SerialNumber, crt4.SerialNumber)
+
+	// And replaced if it is not valid for the names.
+	crt5 := newCA(t, "10.1.2.3")
+	assert.Equals(t, crt3.SerialNumber, crt5.SerialNumber)
+	crt6 := newCA(t, "ca2.smallstep.com")
+	assert.NotEquals(t, crt3.SerialNumber, crt6.SerialNumber)
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/ca/identity"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/tracing"
 	"github.com/smallstep/cli/config"
 	"github.com/smallstep/cli/crypto/keys"
 	"github.com/smallstep/cli/crypto/pemutil"
@@ -43,6 +44,7 @@ var UserAgent = "step-http-client/1.0"
 
 type uaClient struct {
 	Client *http.Client
+	tracer tracing.Tracer
 }
 
 func newClient(transport http.RoundTripper) *uaClient {
@@ -77,7 +79,21 @@ func (c *uaClient) Get(url string) (*http.Response, error) {
 		return nil, errors.Wrapf(err, "new request GET %s failed", url)
 	}
 	req.Header.Set("User-Agent", UserAgent)
-	return c.Client.Do(req)
+	return c.do(req)
+}
+
+// GetWithToken is like Get, but it sends the given token in the Authorization
+// header if it is not empty.
+func (c *uaClient) GetWithToken(url, token string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request GET %s failed", url)
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.do(req)
 }
 
 func (c *uaClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
@@ -87,7 +103,15 @@ func (c *uaClient) Post(url, contentType string, body io.Reader) (*http.Response
 	}
 	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("User-Agent", UserAgent)
-	return c.Client.Do(req)
+	return c.do(req)
+}
+
+// do sends the request in a client span if the client has a tracer.
+func (c *uaClient) do(req *http.Request) (*http.Response, error) {
+	if c.tracer == nil {
+		return c.Client.Do(req)
+	}
+	return tracing.Do(c.Client, c.tracer, req)
 }
 
 // RetryFunc defines the method used to retry a request. If it returns true, the
@@ -104,6 +128,7 @@ type clientOptions struct {
 	rootBundle   []byte
 	certificate  tls.Certificate
 	retryFunc    RetryFunc
+	tracer       tracing.Tracer
 }
 
 func (o *clientOptions) apply(opts []ClientOption) (err error) {
@@ -274,6 +299,16 @@ func WithRetryFunc(fn RetryFunc) ClientOption {
 	}
 }
 
+// WithClientTracer sets the tracer used to create a span for each request to
+// the CA. The requests include the traceparent header, so the spans of the CA
+// are part of the same trace.
+func WithClientTracer(t tracing.Tracer) ClientOption {
+	return func(o *clientOptions) error {
+		o.tracer = t
+		return nil
+	}
+}
+
 func getTransportFromFile(filename string) (http.RoundTripper, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -403,6 +438,77 @@ func WithProvisionerLimit(limit int) ProvisionerOption {
 	}
 }
 
+// CertificateOption is the type of options passed to the Certificate and
+// Certificates methods.
+type CertificateOption func(o *certificateOptions) error
+
+type certificateOptions struct {
+	token  string
+	status string
+	cursor string
+	limit  int
+}
+
+func (o *certificateOptions) apply(opts []CertificateOption) (err error) {
+	for _, fn := range opts {
+		if err = fn(o); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (o *certificateOptions) rawQuery(san string) string {
+	v := url.Values{}
+	v.Set("san", san)
+	if len(o.status) > 0 {
+		v.Set("status", o.status)
+	}
+	if len(o.cursor) > 0 {
+		v.Set("cursor", o.cursor)
+	}
+	if o.limit > 0 {
+		v.Set("limit", strconv.Itoa(o.limit))
+	}
+	return v.Encode()
+}
+
+// WithCertificateToken authenticates the certificate lookups with the given
+// admin token. Without it, the client must use a transport with a client
+// certificate issued by the CA.
+func WithCertificateToken(token string) CertificateOption {
+	return func(o *certificateOptions) error {
+		o.token = token
+		return nil
+	}
+}
+
+// WithCertificateStatus will request the certificates with the given status,
+// valid, revoked or expired.
+func WithCertificateStatus(status string) CertificateOption {
+	return func(o *certificateOptions) error {
+		o.status = status
+		return nil
+	}
+}
+
+// WithCertificateCursor will request the certificates starting with the given
+// cursor.
+func WithCertificateCursor(cursor string) CertificateOption {
+	return func(o *certificateOptions) error {
+		o.cursor = cursor
+		return nil
+	}
+}
+
+// WithCertificateLimit will request the given number of certificates.
+func WithCertificateLimit(limit int) CertificateOption {
+	return func(o *certificateOptions) error {
+		o.limit = limit
+		return nil
+	}
+}
+
 // Client implements an HTTP client for the CA server.
 type Client struct {
 	client    *uaClient
@@ -427,8 +533,10 @@ func NewClient(endpoint string, opts ...ClientOption) (*Client, error) {
 		return nil, err
 	}
 
+	client := newClient(tr)
+	client.tracer = o.tracer
 	return &Client{
-		client:    newClient(tr),
+		client:    client,
 		endpoint:  u,
 		retryFunc: o.retryFunc,
 		opts:      opts,
@@ -436,6 +544,10 @@ func NewClient(endpoint string, opts ...ClientOption) (*Client, error) {
 }
 
 func (c *Client) retryOnError(r *http.Response) bool {
+	// Sending the same body again will fail.
+	if r.StatusCode == http.StatusRequestEntityTooLarge {
+		return false
+	}
 	if c.retryFunc != nil {
 		if c.retryFunc(r.StatusCode) {
 			o := new(clientOptions)
@@ -503,7 +615,8 @@ retry:
 }
 
 // Health performs the health request to the CA and returns the
-// api.HealthResponse struct.
+// api.HealthResponse struct. If the CA is not healthy, the status of the
+// response is not "ok", and the components report the failures.
 func (c *Client) Health() (*api.HealthResponse, error) {
 	var retried bool
 	u := c.endpoint.ResolveReference(&url.URL{Path: "/health"})
@@ -512,7 +625,7 @@ retry:
 	if err != nil {
 		return nil, errs.Wrapf(http.StatusInternalServerError, err, "client.Health; client GET %s failed", u)
 	}
-	if resp.StatusCode >= 400 {
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusServiceUnavailable {
 		if !retried && c.retryOnError(resp) {
 			retried = true
 			goto retry
@@ -626,6 +739,7 @@ func (c *Client) Revoke(req *api.RevokeRequest, tr http.RoundTripper) (*api.Revo
 retry:
 	if tr != nil {
 		client = newClient(tr)
+		client.tracer = c.client.tracer
 	} else {
 		client = c.client
 	}
@@ -683,6 +797,24 @@ retry:
 	return &provisioners, nil
 }
 
+// ListProvisioners performs the provisioners requests to the CA following the
+// cursors and returns the list of all the provisioners.
+func (c *Client) ListProvisioners() (provisioner.List, error) {
+	var cursor string
+	var provisioners provisioner.List
+	for {
+		resp, err := c.Provisioners(WithProvisionerCursor(cursor), WithProvisionerLimit(provisioner.DefaultProvisionersMax))
+		if err != nil {
+			return nil, err
+		}
+		provisioners = append(provisioners, resp.Provisioners...)
+		if resp.NextCursor == "" {
+			return provisioners, nil
+		}
+		cursor = resp.NextCursor
+	}
+}
+
 // ProvisionerKey performs the request to the CA to get the encrypted key for
 // the given provisioner kid and returns the api.ProvisionerKeyResponse struct
 // with the encrypted key.
@@ -756,6 +888,70 @@ retry:
 	return &federation, nil
 }
 
+// Certificate performs the GET /certificates/{serial} request to the CA and
+// returns the stored certificate with the given serial number and its status.
+// The request requires an admin token, see WithCertificateToken, or a client
+// certificate.
+func (c *Client) Certificate(serial string, opts ...CertificateOption) (*api.CertificateResponse, error) {
+	var retried bool
+	o := new(certificateOptions)
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	u := c.endpoint.ResolveReference(&url.URL{Path: "/certificates/" + url.PathEscape(serial)})
+retry:
+	resp, err := c.client.GetWithToken(u.String(), o.token)
+	if err != nil {
+		return nil, errors.Wrapf(err, "client GET %s failed", u)
+	}
+	if resp.StatusCode >= 400 {
+		if !retried && c.retryOnError(resp) {
+			retried = true
+			goto retry
+		}
+		return nil, readError(resp.Body)
+	}
+	var crt api.CertificateResponse
+	if err := readJSON(resp.Body, &crt); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", u)
+	}
+	return &crt, nil
+}
+
+// Certificates performs the GET /certificates request to the CA and returns
+// a page of the stored certificates with the given subject alternative name.
+// WithCertificateStatus filters the certificates by status, and
+// WithCertificateCursor and WithCertificateLimit select the page. Like
+// Certificate, it requires an admin token or a client certificate.
+func (c *Client) Certificates(san string, opts ...CertificateOption) (*api.CertificatesResponse, error) {
+	var retried bool
+	o := new(certificateOptions)
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	u := c.endpoint.ResolveReference(&url.URL{
+		Path:     "/certificates",
+		RawQuery: o.rawQuery(san),
+	})
+retry:
+	resp, err := c.client.GetWithToken(u.String(), o.token)
+	if err != nil {
+		return nil, errors.Wrapf(err, "client GET %s failed", u)
+	}
+	if resp.StatusCode >= 400 {
+		if !retried && c.retryOnError(resp) {
+			retried = true
+			goto retry
+		}
+		return nil, readError(resp.Body)
+	}
+	var crts api.CertificatesResponse
+	if err := readJSON(resp.Body, &crts); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", u)
+	}
+	return &crts, nil
+}
+
 // SSHSign performs the POST /ssh/sign request to the CA and returns the
 // api.SSHSignResponse struct.
 func (c *Client) SSHSign(req *api.SSHSignRequest) (*api.SSHSignResponse, error) {
@@ -1168,15 +1364,42 @@ func getRootCAPath() string {
 }
 
 func readJSON(r io.ReadCloser, v interface{}) error {
-	defer r.Close()
+	defer closeBody(r)
 	return json.NewDecoder(r).Decode(v)
 }
 
 func readError(r io.ReadCloser) error {
-	defer r.Close()
+	defer closeBody(r)
 	apiErr := new(errs.Error)
 	if err := json.NewDecoder(r).Decode(apiErr); err != nil {
 		return err
 	}
+	if apiErr.StatusCode() == http.StatusRequestEntityTooLarge {
+		return &RequestTooLargeError{Err: apiErr}
+	}
 	return apiErr
 }
+
+// closeBody reads the rest of a response body and closes it, so the connection
+// can be reused for the next requests.
+func closeBody(r io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(r, 4<<10))
+	r.Close()
+}
+
+// RequestTooLargeError is the error returned when the CA rejects a request
+// because its body is larger than the limit of the endpoint. These requests
+// are never retried, sending the same body again would fail too.
+type RequestTooLargeError struct {
+	Err *errs.Error
+}
+
+// Error implements the error interface.
+func (e *RequestTooLargeError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the error returned by the CA.
+func (e *RequestTooLargeError) Cause() error {
+	return e.Err
+}
@@ -5,14 +5,19 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -203,8 +208,55 @@ func TestClient_Version(t *testing.T) {
 	}
 }
 
+func TestClient_connectionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		http2     bool
+		wantProto string
+	}{
+		{"http/1.1", false, "HTTP/1.1"},
+		{"http/2", true, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns int32
+			var proto atomic.Value
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				proto.Store(req.Proto)
+				api.JSON(w, api.HealthResponse{Status: "ok"})
+			}))
+			srv.EnableHTTP2 = tt.http2
+			srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&conns, 1)
+				}
+			}
+			srv.StartTLS()
+			defer srv.Close()
+
+			pool := x509.NewCertPool()
+			pool.AddCert(srv.Certificate())
+			tr, err := getDefaultTransport(&tls.Config{RootCAs: pool})
+			assert.FatalError(t, err)
+			c, err := NewClient(srv.URL, WithTransport(tr))
+			assert.FatalError(t, err)
+			for i := 0; i < 5; i++ {
+				_, err := c.Health()
+				assert.FatalError(t, err)
+			}
+			assert.Equals(t, int32(1), atomic.LoadInt32(&conns))
+			assert.Equals(t, tt.wantProto, proto.Load())
+		})
+	}
+}
+
 func TestClient_Health(t *testing.T) {
 	ok := &api.HealthResponse{Status: "ok"}
+	degraded := &api.HealthResponse{Status: "degraded", Components: map[string]authority.HealthCheck{
+		"config": {Status: "ok"},
+		"db":     {Status: "degraded", Error: "connection refused"},
+		"signer": {Status: "ok"},
+	}}
 
 	tests := []struct {
 		name         string
@@ -214,6 +266,7 @@ func TestClient_Health(t *testing.T) {
 		expectedErr  error
 	}{
 		{"ok", ok, 200, false, nil},
+		{"degraded", degraded, 503, false, nil},
 		{"not ok", errs.InternalServer("force"), 500, true, errors.New(errs.InternalServerErrorDefaultMsg)},
 	}
 
@@ -529,6 +582,82 @@ func TestClient_Renew(t *testing.T) {
 	}
 }
 
+func TestClient_SSHRenew(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.FatalError(t, err)
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          1234,
+		CertType:        ssh.HostCert,
+		KeyId:           "foo.smallstep.com",
+		ValidPrincipals: []string{"foo.smallstep.com"},
+		ValidAfter:      uint64(time.Now().Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	assert.FatalError(t, cert.SignCert(rand.Reader, signer))
+	ok := &api.SSHRenewResponse{
+		Certificate: api.SSHCertificate{Certificate: cert},
+	}
+
+	tests := []struct {
+		name         string
+		request      *api.SSHRenewRequest
+		response     interface{}
+		responseCode int
+		wantErr      bool
+		err          error
+	}{
+		{"ok", &api.SSHRenewRequest{OTT: "the-ott"}, ok, 201, false, nil},
+		{"unauthorized", &api.SSHRenewRequest{OTT: "the-ott"}, errs.Unauthorized("force"), 401, true, errors.New(errs.UnauthorizedDefaultMsg)},
+		{"forbidden", &api.SSHRenewRequest{OTT: "the-ott"}, errs.Forbidden("force"), 403, true, errors.New(errs.ForbiddenDefaultMsg)},
+	}
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(srv.URL, WithTransport(http.DefaultTransport))
+			if err != nil {
+				t.Errorf("NewClient() error = %v", err)
+				return
+			}
+
+			srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var body api.SSHRenewRequest
+				if err := api.ReadJSON(req.Body, &body); err != nil || req.URL.Path != "/ssh/renew" {
+					api.WriteError(w, errs.BadRequest("bad request"))
+					return
+				}
+				assert.Equals(t, tt.request, &body)
+				api.JSONStatus(w, tt.response, tt.responseCode)
+			})
+
+			got, err := c.SSHRenew(tt.request)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Client.SSHRenew() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			switch {
+			case err != nil:
+				if got != nil {
+					t.Errorf("Client.SSHRenew() = %v, want nil", got)
+				}
+
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, sc.StatusCode(), tt.responseCode)
+				assert.HasPrefix(t, tt.err.Error(), err.Error())
+			default:
+				assert.Equals(t, cert.Marshal(), got.Certificate.Marshal())
+			}
+		})
+	}
+}
+
 func TestClient_Provisioners(t *testing.T) {
 	ok := &api.ProvisionersResponse{
 		Provisioners: provisioner.List{},
@@ -589,6 +718,117 @@ func TestClient_Provisioners(t *testing.T) {
 	}
 }
 
+func TestClient_ListProvisioners(t *testing.T) {
+	// The client requests the maximum page size, 250 provisioners are three
+	// pages.
+	const total = 2*provisioner.DefaultProvisionersMax + 50
+	c := provisioner.NewCollection(provisioner.Audiences{})
+	for i := 0; i < total; i++ {
+		assert.FatalError(t, c.Store(&provisioner.ACME{Type: "ACME", Name: fmt.Sprintf("acme-%03d", total-i)}))
+	}
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		assert.FatalError(t, err)
+		list, next := c.Find(req.URL.Query().Get("cursor"), limit)
+		api.JSON(w, &api.ProvisionersResponse{
+			Provisioners: list,
+			NextCursor:   next,
+		})
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL, WithTransport(http.DefaultTransport))
+	assert.FatalError(t, err)
+	got, err := client.ListProvisioners()
+	assert.FatalError(t, err)
+	assert.Equals(t, 3, requests)
+	assert.Len(t, total, got)
+	for i, p := range got {
+		// Sorted by name, without duplicates or gaps.
+		assert.Equals(t, fmt.Sprintf("acme-%03d", i+1), p.GetName())
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		api.WriteError(w, errs.InternalServer("force"))
+	})
+	got, err = client.ListProvisioners()
+	assert.Error(t, err)
+	assert.Nil(t, got)
+}
+
+func TestClient_Certificates(t *testing.T) {
+	ok := &api.CertificatesResponse{
+		Certificates: []*api.CertificateResponse{{Serial: "1234", Status: "valid"}},
+		NextCursor:   "5678",
+	}
+	tests := []struct {
+		name         string
+		san          string
+		args         []CertificateOption
+		expectedURI  string
+		expectedAuth string
+		response     interface{}
+		responseCode int
+		wantErr      bool
+	}{
+		{"ok", "test.smallstep.com", nil, "/certificates?san=test.smallstep.com", "", ok, 200, false},
+		{"ok with options", "10.0.0.1", []CertificateOption{
+			WithCertificateToken("token"), WithCertificateStatus("revoked"), WithCertificateCursor("1234"), WithCertificateLimit(10),
+		}, "/certificates?cursor=1234&limit=10&san=10.0.0.1&status=revoked", "Bearer token", ok, 200, false},
+		{"fail", "test.smallstep.com", nil, "/certificates?san=test.smallstep.com", "", errs.Unauthorized("force"), 401, true},
+	}
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(srv.URL, WithTransport(http.DefaultTransport))
+			assert.FatalError(t, err)
+			srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				assert.Equals(t, tt.expectedURI, req.RequestURI)
+				assert.Equals(t, tt.expectedAuth, req.Header.Get("Authorization"))
+				api.JSONStatus(w, tt.response, tt.responseCode)
+			})
+
+			got, err := c.Certificates(tt.san, tt.args...)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, got)
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, ok, got)
+		})
+	}
+}
+
+func TestClient_Certificate(t *testing.T) {
+	ok := &api.CertificateResponse{Serial: "1234", Status: "revoked", RevocationReason: "foo"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.RequestURI != "/certificates/1234" {
+			api.WriteError(w, errs.NotFound("certificate not found"))
+			return
+		}
+		assert.Equals(t, "Bearer token", req.Header.Get("Authorization"))
+		api.JSON(w, ok)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL, WithTransport(http.DefaultTransport))
+	assert.FatalError(t, err)
+	got, err := c.Certificate("1234", WithCertificateToken("token"))
+	assert.FatalError(t, err)
+	assert.Equals(t, ok, got)
+
+	got, err = c.Certificate("5678")
+	assert.Error(t, err)
+	assert.Nil(t, got)
+}
+
 func TestClient_ProvisionerKey(t *testing.T) {
 	ok := &api.ProvisionerKeyResponse{
 		Key: "an encrypted key",
@@ -787,6 +1027,7 @@ func TestClient_SSHRoots(t *testing.T) {
 	}{
 		{"ok", ok, 200, false, nil},
 		{"not found", errs.NotFound("force"), 404, true, errors.New(errs.NotFoundDefaultMsg)},
+		{"not configured", errs.NotFound("force", errs.WithMessage("SSH is not configured on the certificate authority.")), 404, true, errors.New("SSH is not configured on the certificate authority.")},
 	}
 
 	srv := httptest.NewServer(nil)
@@ -991,3 +1232,69 @@ func TestClient_SSHBastion(t *testing.T) {
 		})
 	}
 }
+
+func Test_readError(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    *errs.Error
+		wantErr bool
+	}{
+		{"ok problem", `{"type":"urn:smallstep:error:token-expired","title":"Expired token","detail":"The token has expired.","status":401,"requestId":"request-id","message":"The token has expired."}`,
+			&errs.Error{Status: 401, Type: errs.TypeTokenExpired, RequestID: "request-id", Err: fmt.Errorf("The token has expired.")}, false},
+		{"ok problem without message", `{"type":"urn:smallstep:error:db-unavailable","title":"Database unavailable","detail":"The certificate authority encountered an Internal Server Error.","status":500}`,
+			&errs.Error{Status: 500, Type: errs.TypeDBUnavailable, Err: fmt.Errorf("The certificate authority encountered an Internal Server Error.")}, false},
+		{"ok legacy", `{"status":400,"message":"The request could not be completed."}`,
+			&errs.Error{Status: 400, Err: fmt.Errorf("The request could not be completed.")}, false},
+		{"fail", `Forbidden.`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := readError(ioutil.NopCloser(bytes.NewBufferString(tt.body)))
+			if tt.wantErr {
+				if _, ok := err.(*errs.Error); ok {
+					t.Errorf("readError() = %v, want a decoding error", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("readError() = %#v, want %#v", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readError_requestTooLarge(t *testing.T) {
+	body := `{"type":"urn:smallstep:error:request-too-large","title":"Request Entity Too Large","detail":"The request body is larger than the limit allowed by the certificate authority.","status":413}`
+	err := readError(ioutil.NopCloser(bytes.NewBufferString(body)))
+	e, ok := err.(*RequestTooLargeError)
+	if !ok {
+		t.Fatalf("readError() = %#v, want a *RequestTooLargeError", err)
+	}
+	if e.Err.StatusCode() != http.StatusRequestEntityTooLarge || e.Err.Type != errs.TypeRequestTooLarge {
+		t.Errorf("readError() = %#v, want a 413 request-too-large error", e.Err)
+	}
+}
+
+func TestClient_Sign_requestTooLarge(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		api.WriteError(w, errs.RequestEntityTooLarge("request body larger than 10 bytes"))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL, WithTransport(http.DefaultTransport), WithRetryFunc(func(code int) bool {
+		return true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Sign(&api.SignRequest{OTT: "the-token"})
+	if _, ok := err.(*RequestTooLargeError); !ok {
+		t.Errorf("Client.Sign() error = %#v, want a *RequestTooLargeError", err)
+	}
+	if requests != 1 {
+		t.Errorf("Client.Sign() sent %d requests, want 1", requests)
+	}
+}
@@ -179,9 +179,9 @@ func loadProvisionerJWKByKid(client *Client, kid string, password []byte) (*jose
 	return decryptProvisionerJWK(encrypted, password)
 }
 
-// loadProvisionerJWKByName retrieves the list of provisioners and encrypted key then
-// returns the key of the first provisioner with a matching name that can be successfully
-// decrypted with the specified password.
+// loadProvisionerJWKByName retrieves the list of provisioners, then downloads the
+// encrypted keys of the JWK provisioners with a matching name and returns the
+// first one that can be successfully decrypted with the specified password.
 func loadProvisionerJWKByName(client *Client, name string, password []byte) (key *jose.JSONWebKey, err error) {
 	provisioners, err := getProvisioners(client)
 	if err != nil {
@@ -189,13 +189,10 @@ func loadProvisionerJWKByName(client *Client, name string, password []byte) (key
 		return
 	}
 
-	for _, provisioner := range provisioners {
-		if provisioner.GetName() == name {
-			if _, encryptedKey, ok := provisioner.GetEncryptedKey(); ok {
-				key, err = decryptProvisionerJWK(encryptedKey, password)
-				if err == nil {
-					return
-				}
+	for _, p := range provisioners {
+		if jwk, ok := p.(*provisioner.JWK); ok && jwk.Name == name && jwk.Key != nil {
+			if key, err = loadProvisionerJWKByKid(client, jwk.Key.KeyID, password); err == nil {
+				return
 			}
 		}
 	}
@@ -204,19 +201,7 @@ func loadProvisionerJWKByName(client *Client, name string, password []byte) (key
 
 // getProvisioners returns the list of provisioners using the configured client.
 func getProvisioners(client *Client) (provisioner.List, error) {
-	var cursor string
-	var provisioners provisioner.List
-	for {
-		resp, err := client.Provisioners(WithProvisionerCursor(cursor), WithProvisionerLimit(100))
-		if err != nil {
-			return nil, err
-		}
-		provisioners = append(provisioners, resp.Provisioners...)
-		if resp.NextCursor == "" {
-			return provisioners, nil
-		}
-		cursor = resp.NextCursor
-	}
+	return client.ListProvisioners()
 }
 
 // getProvisionerKey returns the encrypted provisioner key for the given kid.
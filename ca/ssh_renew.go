@@ -0,0 +1,327 @@
+package ca
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHRenewFunc is called with the new certificate and key after each renewal.
+// The key only changes after a rekey.
+type SSHRenewFunc func(cert *ssh.Certificate, key crypto.Signer) error
+
+// SSHRenewer automatically renews an SSH host certificate using an SSHPOP
+// provisioner. The certificate is renewed with /ssh/renew, or with /ssh/rekey
+// and a new key if a rekey policy is set.
+type SSHRenewer struct {
+	sync.RWMutex
+	client      *Client
+	provisioner string
+	cert        *ssh.Certificate
+	key         crypto.Signer
+	timer       *time.Timer
+	renewBefore time.Duration
+	renewJitter time.Duration
+	rekeyEvery  int
+	renewals    int
+	failures    int
+	certPath    string
+	keyPath     string
+	onRenew     SSHRenewFunc
+	renewMutex  sync.Mutex
+}
+
+// SSHRenewerOption is the type of the options of NewSSHRenewer.
+type SSHRenewerOption func(r *SSHRenewer) error
+
+// WithSSHRenewBefore sets how long before the expiration the certificate is
+// renewed, by default 1/3 of the validity period.
+func WithSSHRenewBefore(b time.Duration) SSHRenewerOption {
+	return func(r *SSHRenewer) error {
+		r.renewBefore = b
+		return nil
+	}
+}
+
+// WithSSHRenewJitter sets the maximum random delay subtracted from the renewal
+// time, by default 1/20th of the validity period.
+func WithSSHRenewJitter(j time.Duration) SSHRenewerOption {
+	return func(r *SSHRenewer) error {
+		r.renewJitter = j
+		return nil
+	}
+}
+
+// WithSSHRekeyEvery rekeys the certificate with a new key instead of renewing
+// it every n renewals.
+func WithSSHRekeyEvery(n int) SSHRenewerOption {
+	return func(r *SSHRenewer) error {
+		if n < 0 {
+			return errors.New("rekey interval cannot be negative")
+		}
+		r.rekeyEvery = n
+		return nil
+	}
+}
+
+// WithSSHCertificateFile writes the new certificate to certPath, in the
+// authorized_keys format, and the new keys to keyPath, in PEM format.
+func WithSSHCertificateFile(certPath, keyPath string) SSHRenewerOption {
+	return func(r *SSHRenewer) error {
+		r.certPath = certPath
+		r.keyPath = keyPath
+		return nil
+	}
+}
+
+// WithSSHRenewFunc sets a function called after each renewal, it can be used
+// to reload sshd.
+func WithSSHRenewFunc(fn SSHRenewFunc) SSHRenewerOption {
+	return func(r *SSHRenewer) error {
+		r.onRenew = fn
+		return nil
+	}
+}
+
+// NewSSHRenewer creates an SSHRenewer for the given host certificate and key.
+// The tokens are signed with the key and issued by the given SSHPOP
+// provisioner.
+func NewSSHRenewer(client *Client, provisionerName string, cert *ssh.Certificate, key crypto.Signer, opts ...SSHRenewerOption) (*SSHRenewer, error) {
+	if cert.CertType != ssh.HostCert {
+		return nil, errors.New("certificate must be a host certificate")
+	}
+	r := &SSHRenewer{
+		client:      client,
+		provisioner: provisionerName,
+		cert:        cert,
+		key:         key,
+	}
+
+	for _, f := range opts {
+		if err := f(r); err != nil {
+			return nil, errors.Wrap(err, "error applying options")
+		}
+	}
+
+	period := time.Duration(cert.ValidBefore-cert.ValidAfter) * time.Second
+	if cert.ValidBefore <= cert.ValidAfter || period < minCertDuration {
+		return nil, errors.Errorf("period must be greater than or equal to %s, but got %v.", minCertDuration, period)
+	}
+	// By default we will try to renew the cert before 2/3 of the validity
+	// period have expired.
+	if r.renewBefore == 0 {
+		r.renewBefore = period / 3
+	}
+	// By default we set the jitter to 1/20th of the validity period.
+	if r.renewJitter == 0 {
+		r.renewJitter = period / 20
+	}
+
+	return r, nil
+}
+
+// Run starts the certificate renewer for the given certificate.
+func (r *SSHRenewer) Run() {
+	cert, _ := r.GetCertificate()
+	next := r.nextRenewDuration(cert)
+	r.Lock()
+	r.timer = time.AfterFunc(next, r.renewCertificate)
+	r.Unlock()
+}
+
+// RunContext starts the certificate renewer for the given certificate.
+func (r *SSHRenewer) RunContext(ctx context.Context) {
+	r.Run()
+	go func() {
+		<-ctx.Done()
+		r.Stop()
+	}()
+}
+
+// Stop prevents the renew timer from firing.
+func (r *SSHRenewer) Stop() bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.timer != nil {
+		return r.timer.Stop()
+	}
+	return true
+}
+
+// GetCertificate returns the current certificate and key.
+func (r *SSHRenewer) GetCertificate() (*ssh.Certificate, crypto.Signer) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, r.key
+}
+
+// Renew renews the certificate now and schedules the next renewal if the
+// renewer is running.
+func (r *SSHRenewer) Renew() error {
+	return r.renewNow(false)
+}
+
+// Rekey rekeys the certificate with a new key now and schedules the next
+// renewal if the renewer is running.
+func (r *SSHRenewer) Rekey() error {
+	return r.renewNow(true)
+}
+
+func (r *SSHRenewer) renewNow(rekey bool) error {
+	if err := r.renew(rekey); err != nil {
+		return err
+	}
+	cert, _ := r.GetCertificate()
+	r.Lock()
+	if r.timer != nil && r.timer.Stop() {
+		r.timer.Reset(r.nextRenewDuration(cert))
+	}
+	r.Unlock()
+	return nil
+}
+
+// renewCertificate is called by the timer, it renews or rekeys the
+// certificate and schedules the next renewal. After a failure it retries with
+// an exponential backoff, but never after the expiration of the certificate.
+func (r *SSHRenewer) renewCertificate() {
+	r.RLock()
+	rekey := r.rekeyEvery > 0 && (r.renewals+1)%r.rekeyEvery == 0
+	r.RUnlock()
+
+	var next time.Duration
+	if err := r.renew(rekey); err != nil {
+		r.Lock()
+		r.failures++
+		next = r.renewJitter / 2
+		for i := 1; i < r.failures && next < r.renewBefore; i++ {
+			next *= 2
+		}
+		r.Unlock()
+		next += time.Duration(rand.Int63n(int64(next)))
+		cert, _ := r.GetCertificate()
+		if untilExpiry := time.Until(time.Unix(int64(cert.ValidBefore), 0)); untilExpiry > 0 && next > untilExpiry {
+			next = untilExpiry
+		}
+	} else {
+		cert, _ := r.GetCertificate()
+		next = r.nextRenewDuration(cert)
+	}
+	r.Lock()
+	r.timer.Reset(next)
+	r.Unlock()
+}
+
+// renew calls /ssh/renew or /ssh/rekey and stores the new certificate.
+func (r *SSHRenewer) renew(rekey bool) error {
+	r.renewMutex.Lock()
+	defer r.renewMutex.Unlock()
+
+	cert, key := r.GetCertificate()
+	var newCert *ssh.Certificate
+	if rekey {
+		newKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			return errors.Wrap(err, "error generating key")
+		}
+		pub, err := ssh.NewPublicKey(newKey.Public())
+		if err != nil {
+			return errors.Wrap(err, "error creating public key")
+		}
+		tok, err := r.token(cert, key, true)
+		if err != nil {
+			return err
+		}
+		resp, err := r.client.SSHRekey(&api.SSHRekeyRequest{OTT: tok, PublicKey: pub.Marshal()})
+		if err != nil {
+			return err
+		}
+		newCert, key = resp.Certificate.Certificate, newKey
+	} else {
+		tok, err := r.token(cert, key, false)
+		if err != nil {
+			return err
+		}
+		resp, err := r.client.SSHRenew(&api.SSHRenewRequest{OTT: tok})
+		if err != nil {
+			return err
+		}
+		newCert = resp.Certificate.Certificate
+	}
+	if newCert == nil {
+		return errors.New("error renewing ssh certificate: response does not contain a certificate")
+	}
+
+	if err := r.write(newCert, key, rekey); err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.cert, r.key = newCert, key
+	r.failures = 0
+	if rekey {
+		r.renewals = 0
+	} else {
+		r.renewals++
+	}
+	r.Unlock()
+
+	if r.onRenew != nil {
+		return r.onRenew(newCert, key)
+	}
+	return nil
+}
+
+// write writes the certificate, and the key after a rekey, to the configured
+// files.
+func (r *SSHRenewer) write(cert *ssh.Certificate, key crypto.Signer, rekey bool) error {
+	if rekey && r.keyPath != "" {
+		block, err := pemutil.Serialize(key)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(r.keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+			return errors.Wrapf(err, "error writing %s", r.keyPath)
+		}
+	}
+	if r.certPath != "" {
+		if err := ioutil.WriteFile(r.certPath, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+			return errors.Wrapf(err, "error writing %s", r.certPath)
+		}
+	}
+	return nil
+}
+
+// token returns an SSHPOP token for ssh/renew or ssh/rekey, signed with the
+// key of the certificate.
+func (r *SSHRenewer) token(cert *ssh.Certificate, key crypto.Signer, rekey bool) (string, error) {
+	s, err := NewSSHPOPSigner(cert, key)
+	if err != nil {
+		return "", err
+	}
+	if rekey {
+		return r.client.SSHPOPRekeyToken(s, r.provisioner)
+	}
+	return r.client.SSHPOPRenewToken(s, r.provisioner)
+}
+
+func (r *SSHRenewer) nextRenewDuration(cert *ssh.Certificate) time.Duration {
+	d := time.Until(time.Unix(int64(cert.ValidBefore), 0)) - r.renewBefore
+	n := rand.Int63n(int64(r.renewJitter))
+	d -= time.Duration(n)
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
@@ -0,0 +1,202 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/cli/jose"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSSHRenewerCert(t *testing.T, caSigner ssh.Signer, pub crypto.PublicKey, lifetime time.Duration) *ssh.Certificate {
+	key, err := ssh.NewPublicKey(pub)
+	assert.FatalError(t, err)
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          uint64(now.UnixNano()),
+		CertType:        ssh.HostCert,
+		KeyId:           "foo.smallstep.com",
+		ValidPrincipals: []string{"foo.smallstep.com"},
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(lifetime).Unix()),
+	}
+	assert.FatalError(t, cert.SignCert(rand.Reader, caSigner))
+	return cert
+}
+
+func TestSSHRenewer(t *testing.T) {
+	tmp := minCertDuration
+	minCertDuration = time.Second
+	defer func() {
+		minCertDuration = tmp
+	}()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	assert.FatalError(t, err)
+
+	// The CA verifies the sshpop tokens and signs certificates of 3 seconds.
+	lifetime := 3 * time.Second
+	var srvURL string
+	verify := func(ott, path string) (*ssh.Certificate, error) {
+		cert, jwt, err := provisioner.ExtractSSHPOPCert(ott)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := cert.Key.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, errs.BadRequest("bad key")
+		}
+		var claims jose.Claims
+		if err := jwt.Claims(pub.CryptoPublicKey(), &claims); err != nil {
+			return nil, errs.Unauthorized("bad signature")
+		}
+		if claims.Issuer != "sshpop" || !reflect.DeepEqual(claims.Audience, jose.Audience{srvURL + path + "#sshpop/sshpop"}) {
+			return nil, errs.Unauthorized("bad claims")
+		}
+		return cert, nil
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ssh/renew":
+			var body api.SSHRenewRequest
+			assert.FatalError(t, api.ReadJSON(req.Body, &body))
+			cert, err := verify(body.OTT, "/1.0/ssh/renew")
+			if err != nil {
+				api.WriteError(w, err)
+				return
+			}
+			pub := cert.Key.(ssh.CryptoPublicKey).CryptoPublicKey()
+			api.JSONStatus(w, &api.SSHRenewResponse{
+				Certificate: api.SSHCertificate{Certificate: newSSHRenewerCert(t, caSigner, pub, lifetime)},
+			}, http.StatusCreated)
+		case "/ssh/rekey":
+			var body api.SSHRekeyRequest
+			assert.FatalError(t, api.ReadJSON(req.Body, &body))
+			if _, err := verify(body.OTT, "/1.0/ssh/rekey"); err != nil {
+				api.WriteError(w, err)
+				return
+			}
+			key, err := ssh.ParsePublicKey(body.PublicKey)
+			assert.FatalError(t, err)
+			pub := key.(ssh.CryptoPublicKey).CryptoPublicKey()
+			api.JSONStatus(w, &api.SSHRekeyResponse{
+				Certificate: api.SSHCertificate{Certificate: newSSHRenewerCert(t, caSigner, pub, lifetime)},
+			}, http.StatusCreated)
+		default:
+			api.WriteError(w, errs.NotFound("not found"))
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	client, err := NewClient(srv.URL, WithTransport(http.DefaultTransport))
+	assert.FatalError(t, err)
+
+	dir, err := ioutil.TempDir("", "ssh-renewer")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "ssh_host_ecdsa_key-cert.pub")
+	keyPath := filepath.Join(dir, "ssh_host_ecdsa_key")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	cert := newSSHRenewerCert(t, caSigner, key.Public(), lifetime)
+
+	renewed := make(chan *ssh.Certificate, 10)
+	r, err := NewSSHRenewer(client, "sshpop", cert, key,
+		WithSSHRekeyEvery(2),
+		WithSSHCertificateFile(certPath, keyPath),
+		WithSSHRenewFunc(func(cert *ssh.Certificate, key crypto.Signer) error {
+			renewed <- cert
+			return nil
+		}))
+	assert.FatalError(t, err)
+	r.Run()
+	defer r.Stop()
+
+	// The first renewal keeps the key.
+	select {
+	case c := <-renewed:
+		assert.NotEquals(t, cert.Serial, c.Serial)
+		assert.Equals(t, cert.Key.Marshal(), c.Key.Marshal())
+		_, k := r.GetCertificate()
+		assert.Equals(t, crypto.Signer(key), k)
+		b, err := ioutil.ReadFile(certPath)
+		assert.FatalError(t, err)
+		assert.Equals(t, ssh.MarshalAuthorizedKey(c), b)
+		_, err = os.Stat(keyPath)
+		assert.True(t, os.IsNotExist(err))
+	case <-time.After(10 * time.Second):
+		t.Fatal("certificate was not renewed")
+	}
+
+	// A rekey changes the key and writes it.
+	assert.FatalError(t, r.Rekey())
+	c, k := r.GetCertificate()
+	assert.Equals(t, c, <-renewed)
+	assert.NotEquals(t, crypto.Signer(key), k)
+	assert.Equals(t, c.Key.(ssh.CryptoPublicKey).CryptoPublicKey(), k.Public())
+	b, err := ioutil.ReadFile(certPath)
+	assert.FatalError(t, err)
+	assert.Equals(t, ssh.MarshalAuthorizedKey(c), b)
+	_, err = ioutil.ReadFile(keyPath)
+	assert.FatalError(t, err)
+
+	// The new key is used in the next tokens.
+	assert.FatalError(t, r.Renew())
+	c2, k2 := r.GetCertificate()
+	assert.Equals(t, k, k2)
+	assert.Equals(t, c.Key.Marshal(), c2.Key.Marshal())
+}
+
+func TestNewSSHRenewer(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	assert.FatalError(t, err)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	client, err := NewClient("https://ca.smallstep.com", WithTransport(http.DefaultTransport))
+	assert.FatalError(t, err)
+
+	userCert := newSSHRenewerCert(t, caSigner, key.Public(), time.Hour)
+	userCert.CertType = ssh.UserCert
+
+	tests := []struct {
+		name    string
+		cert    *ssh.Certificate
+		opts    []SSHRenewerOption
+		wantErr bool
+	}{
+		{"ok", newSSHRenewerCert(t, caSigner, key.Public(), time.Hour), nil, false},
+		{"ok with options", newSSHRenewerCert(t, caSigner, key.Public(), time.Hour), []SSHRenewerOption{WithSSHRenewBefore(time.Minute), WithSSHRenewJitter(time.Second), WithSSHRekeyEvery(3)}, false},
+		{"fail user cert", userCert, nil, true},
+		{"fail period", newSSHRenewerCert(t, caSigner, key.Public(), time.Second), nil, true},
+		{"fail rekey", newSSHRenewerCert(t, caSigner, key.Public(), time.Hour), []SSHRenewerOption{WithSSHRekeyEvery(-1)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSSHRenewer(client, "sshpop", tt.cert, key, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewSSHRenewer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/crypto/randutil"
+	"github.com/smallstep/cli/jose"
+	"github.com/smallstep/cli/token"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHPOPSigner creates the SSHPOP tokens used to authenticate the ssh/renew,
+// ssh/rekey and ssh/revoke requests with an SSH certificate. The tokens
+// contain the certificate in the sshpop header and they are signed with the
+// key of the certificate, held in memory or in an ssh-agent.
+type SSHPOPSigner struct {
+	cert        *ssh.Certificate
+	signer      opaqueSigner
+	gracePeriod time.Duration
+}
+
+// SSHPOPSignerOption is the type of the options of the SSHPOPSigner
+// constructors.
+type SSHPOPSignerOption func(s *SSHPOPSigner) error
+
+// WithSSHPOPGracePeriod allows the creation of tokens for certificates that
+// expired less than the given duration ago. It must match the
+// renewGracePeriod of the SSHPOP provisioner, by default the tokens of expired
+// certificates are not created.
+func WithSSHPOPGracePeriod(d time.Duration) SSHPOPSignerOption {
+	return func(s *SSHPOPSigner) error {
+		if d < 0 {
+			return errors.New("grace period cannot be negative")
+		}
+		s.gracePeriod = d
+		return nil
+	}
+}
+
+// NewSSHPOPSigner creates an SSHPOPSigner that signs the tokens with the given
+// key, the private key of the certificate.
+func NewSSHPOPSigner(cert *ssh.Certificate, key crypto.Signer, opts ...SSHPOPSignerOption) (*SSHPOPSigner, error) {
+	alg, err := sshPOPAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return newSSHPOPSigner(cert, &keySigner{key: key, alg: alg}, opts)
+}
+
+// NewSSHPOPAgentSigner creates an SSHPOPSigner that signs the tokens using the
+// given agent. The agent must hold the private key of the certificate.
+func NewSSHPOPAgentSigner(cert *ssh.Certificate, a agent.Agent, opts ...SSHPOPSignerOption) (*SSHPOPSigner, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing agent keys")
+	}
+	var found bool
+	for _, k := range keys {
+		if k.Type() == cert.Key.Type() && string(k.Marshal()) == string(cert.Key.Marshal()) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("agent does not hold the key of the certificate")
+	}
+	pub, ok := cert.Key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.Errorf("unsupported ssh key type %s", cert.Key.Type())
+	}
+	alg, err := sshPOPAlgorithm(pub.CryptoPublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return newSSHPOPSigner(cert, &agentSigner{agent: a, key: cert.Key, pub: pub.CryptoPublicKey(), alg: alg}, opts)
+}
+
+func newSSHPOPSigner(cert *ssh.Certificate, signer opaqueSigner, opts []SSHPOPSignerOption) (*SSHPOPSigner, error) {
+	if cert == nil || cert.Key == nil {
+		return nil, errors.New("ssh certificate cannot be empty")
+	}
+	s := &SSHPOPSigner{
+		cert:   cert,
+		signer: signer,
+	}
+	for _, fn := range opts {
+		if err := fn(s); err != nil {
+			return nil, errors.Wrap(err, "error applying options")
+		}
+	}
+	return s, nil
+}
+
+// Certificate returns the certificate embedded in the tokens.
+func (s *SSHPOPSigner) Certificate() *ssh.Certificate {
+	return s.cert
+}
+
+// Token returns an SSHPOP token for the given provisioner and audience. The
+// subject of the token is the serial number of the certificate. It fails if
+// the certificate is not valid yet or if it expired before the grace period.
+func (s *SSHPOPSigner) Token(provisionerName, audience string) (string, error) {
+	now := time.Now()
+	if s.cert.ValidAfter != 0 && time.Unix(int64(s.cert.ValidAfter), 0).After(now) {
+		return "", errors.Errorf("ssh certificate is not valid until %s", time.Unix(int64(s.cert.ValidAfter), 0).UTC().Format(time.RFC3339))
+	}
+	if s.cert.ValidBefore != 0 && s.cert.ValidBefore != ssh.CertTimeInfinity {
+		if notAfter := time.Unix(int64(s.cert.ValidBefore), 0); notAfter.Add(s.gracePeriod).Before(now) {
+			return "", errors.Errorf("ssh certificate expired at %s", notAfter.UTC().Format(time.RFC3339))
+		}
+	}
+
+	jwtID, err := randutil.Hex(64) // 256 bits
+	if err != nil {
+		return "", err
+	}
+	claims, err := token.NewClaims(
+		token.WithJWTID(jwtID),
+		token.WithSubject(strconv.FormatUint(s.cert.Serial, 10)),
+		token.WithIssuer(provisionerName),
+		token.WithAudience(audience),
+		token.WithValidity(now, now.Add(tokenLifetime)),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	pub := s.signer.Public()
+	thumbprint, err := pub.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", errors.Wrap(err, "error generating kid")
+	}
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("kid", base64.RawURLEncoding.EncodeToString(thumbprint))
+	so.WithHeader("sshpop", base64.StdEncoding.EncodeToString(s.cert.Marshal()))
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(pub.Algorithm),
+		Key:       s.signer,
+	}, so)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating JWT signer")
+	}
+	tok, err := jose.Signed(signer).Claims(claims.Claims).CompactSerialize()
+	if err != nil {
+		return "", errors.Wrap(err, "error signing sshpop token")
+	}
+	return tok, nil
+}
+
+// SSHPOPRenewToken returns an SSHPOP token for the ssh/renew endpoint of the
+// CA and the given provisioner.
+func (c *Client) SSHPOPRenewToken(s *SSHPOPSigner, provisionerName string) (string, error) {
+	return s.Token(provisionerName, c.sshPOPAudience("/1.0/ssh/renew", provisionerName))
+}
+
+// SSHPOPRekeyToken returns an SSHPOP token for the ssh/rekey endpoint of the
+// CA and the given provisioner.
+func (c *Client) SSHPOPRekeyToken(s *SSHPOPSigner, provisionerName string) (string, error) {
+	return s.Token(provisionerName, c.sshPOPAudience("/1.0/ssh/rekey", provisionerName))
+}
+
+// sshPOPAudience returns the audience of an SSHPOP token, the endpoint with
+// the provisioner id as fragment.
+func (c *Client) sshPOPAudience(path, provisionerName string) string {
+	return c.endpoint.ResolveReference(&url.URL{
+		Path:     path,
+		Fragment: "sshpop/" + provisionerName,
+	}).String()
+}
+
+// sshPOPAlgorithm returns the signature algorithm used with the given key.
+func sshPOPAlgorithm(pub crypto.PublicKey) (jose.SignatureAlgorithm, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	case *rsa.PublicKey:
+		return jose.RS256, nil
+	case ed25519.PublicKey:
+		return jose.EdDSA, nil
+	}
+	return "", errors.Errorf("unsupported key type %T", pub)
+}
+
+// opaqueSigner is the jose.OpaqueSigner interface used to sign the tokens.
+type opaqueSigner interface {
+	Public() *jose.JSONWebKey
+	Algs() []jose.SignatureAlgorithm
+	SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error)
+}
+
+// keySigner signs the tokens with a crypto.Signer.
+type keySigner struct {
+	key crypto.Signer
+	alg jose.SignatureAlgorithm
+}
+
+func (s *keySigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: s.key.Public(), Algorithm: string(s.alg)}
+}
+
+func (s *keySigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{s.alg}
+}
+
+func (s *keySigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	var hash crypto.Hash
+	switch alg {
+	case jose.ES256, jose.RS256:
+		hash = crypto.SHA256
+	case jose.ES384:
+		hash = crypto.SHA384
+	case jose.ES512:
+		hash = crypto.SHA512
+	case jose.EdDSA:
+		return s.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		return nil, errors.Errorf("unsupported signature algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(payload)
+	sig, err := s.key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := s.key.Public().(*ecdsa.PublicKey); ok {
+		var es struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			return nil, errors.Wrap(err, "error parsing ecdsa signature")
+		}
+		return ecdsaJWSSignature(pub, es.R, es.S), nil
+	}
+	return sig, nil
+}
+
+// agentSigner signs the tokens with a key held in an ssh-agent.
+type agentSigner struct {
+	agent agent.Agent
+	key   ssh.PublicKey
+	pub   crypto.PublicKey
+	alg   jose.SignatureAlgorithm
+}
+
+func (s *agentSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: s.pub, Algorithm: string(s.alg)}
+}
+
+func (s *agentSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{s.alg}
+}
+
+// SignPayload signs the payload with the agent. The agent hashes the payload
+// with the hash of the ECDSA curve, or with SHA-256 for RSA keys, and the
+// signatures are converted from the SSH wire format.
+func (s *agentSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != s.alg {
+		return nil, errors.Errorf("unsupported signature algorithm %s", alg)
+	}
+	var (
+		sig *ssh.Signature
+		err error
+	)
+	if alg == jose.RS256 {
+		ea, ok := s.agent.(agent.ExtendedAgent)
+		if !ok {
+			return nil, errors.New("agent does not support rsa-sha2-256 signatures")
+		}
+		sig, err = ea.SignWithFlags(s.key, payload, agent.SignatureFlagRsaSha256)
+	} else {
+		sig, err = s.agent.Sign(s.key, payload)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error signing with agent")
+	}
+
+	switch pub := s.pub.(type) {
+	case *ecdsa.PublicKey:
+		var es struct{ R, S *big.Int }
+		if err := ssh.Unmarshal(sig.Blob, &es); err != nil {
+			return nil, errors.Wrap(err, "error parsing ecdsa signature")
+		}
+		return ecdsaJWSSignature(pub, es.R, es.S), nil
+	default:
+		return sig.Blob, nil
+	}
+}
+
+// ecdsaJWSSignature returns the JWS encoding of an ECDSA signature, the
+// concatenation of r and s padded to the size of the curve.
+func ecdsaJWSSignature(pub *ecdsa.PublicKey, r, s *big.Int) []byte {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	out := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(out[size-len(rb):size], rb)
+	copy(out[2*size-len(sb):], sb)
+	return out
+}
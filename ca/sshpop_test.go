@@ -0,0 +1,125 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/jose"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHPOPSigner(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	assert.FatalError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.FatalError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.FatalError(t, err)
+
+	// The agent holds all the keys.
+	keyring := agent.NewKeyring()
+	for _, k := range []interface{}{ecKey, rsaKey, edKey} {
+		assert.FatalError(t, keyring.Add(agent.AddedKey{PrivateKey: k}))
+	}
+
+	client, err := NewClient("https://ca.smallstep.com:9000", WithTransport(http.DefaultTransport))
+	assert.FatalError(t, err)
+	renewAudience := "https://ca.smallstep.com:9000/1.0/ssh/renew#sshpop/sshpop"
+	rekeyAudience := "https://ca.smallstep.com:9000/1.0/ssh/rekey#sshpop/sshpop"
+
+	verify := func(t *testing.T, tok string, want *ssh.Certificate, aud string) {
+		cert, jwt, err := provisioner.ExtractSSHPOPCert(tok)
+		assert.FatalError(t, err)
+		assert.Equals(t, want.Marshal(), cert.Marshal())
+		var claims jose.Claims
+		assert.FatalError(t, jwt.Claims(cert.Key.(ssh.CryptoPublicKey).CryptoPublicKey(), &claims))
+		assert.FatalError(t, claims.Validate(jose.Expected{
+			Issuer:   "sshpop",
+			Subject:  "1234",
+			Audience: jose.Audience{aud},
+			Time:     time.Now(),
+		}))
+		assert.True(t, claims.ID != "")
+	}
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey, edKey} {
+		cert := newSSHRenewerCert(t, caSigner, key.Public(), time.Hour)
+		cert.Serial = 1234
+		name := strings.TrimPrefix(cert.Key.Type(), "ssh-")
+
+		t.Run("key/"+name, func(t *testing.T) {
+			s, err := NewSSHPOPSigner(cert, key)
+			assert.FatalError(t, err)
+			tok, err := client.SSHPOPRenewToken(s, "sshpop")
+			assert.FatalError(t, err)
+			verify(t, tok, cert, renewAudience)
+		})
+		t.Run("agent/"+name, func(t *testing.T) {
+			s, err := NewSSHPOPAgentSigner(cert, keyring)
+			assert.FatalError(t, err)
+			tok, err := client.SSHPOPRekeyToken(s, "sshpop")
+			assert.FatalError(t, err)
+			verify(t, tok, cert, rekeyAudience)
+		})
+	}
+
+	t.Run("fail/agent-without-key", func(t *testing.T) {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		cert := newSSHRenewerCert(t, caSigner, otherKey.Public(), time.Hour)
+		_, err = NewSSHPOPAgentSigner(cert, keyring)
+		assert.Equals(t, "agent does not hold the key of the certificate", err.Error())
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		cert := newSSHRenewerCert(t, caSigner, ecKey.Public(), time.Hour)
+		cert.Serial = 1234
+		cert.ValidAfter = uint64(time.Now().Add(-2 * time.Hour).Unix())
+		cert.ValidBefore = uint64(time.Now().Add(-time.Hour).Unix())
+
+		s, err := NewSSHPOPAgentSigner(cert, keyring)
+		assert.FatalError(t, err)
+		_, err = client.SSHPOPRenewToken(s, "sshpop")
+		if assert.Error(t, err) {
+			assert.HasPrefix(t, err.Error(), "ssh certificate expired at ")
+		}
+
+		// The tokens are created in the grace period.
+		s, err = NewSSHPOPAgentSigner(cert, keyring, WithSSHPOPGracePeriod(2*time.Hour))
+		assert.FatalError(t, err)
+		tok, err := client.SSHPOPRenewToken(s, "sshpop")
+		assert.FatalError(t, err)
+		verify(t, tok, cert, renewAudience)
+	})
+
+	t.Run("fail/not-yet-valid", func(t *testing.T) {
+		cert := newSSHRenewerCert(t, caSigner, ecKey.Public(), time.Hour)
+		cert.ValidAfter = uint64(time.Now().Add(time.Hour).Unix())
+		s, err := NewSSHPOPSigner(cert, ecKey)
+		assert.FatalError(t, err)
+		_, err = s.Token("sshpop", renewAudience)
+		assert.Error(t, err)
+	})
+
+	t.Run("fail/grace-period", func(t *testing.T) {
+		cert := newSSHRenewerCert(t, caSigner, ecKey.Public(), time.Hour)
+		_, err := NewSSHPOPSigner(cert, ecKey, WithSSHPOPGracePeriod(-time.Second))
+		assert.Error(t, err)
+	})
+}
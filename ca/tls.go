@@ -45,6 +45,9 @@ func (c *Client) getClientTLSConfig(ctx context.Context, sign *api.SignResponse,
 	tlsConfig.PreferServerCipherSuites = true
 
 	// Apply options and initialize mutable tls.Config
+	if err := c.setClientCertificate(renewer); err != nil {
+		return nil, nil, err
+	}
 	tlsCtx := newTLSOptionCtx(c, tlsConfig, sign)
 	if err := tlsCtx.apply(options); err != nil {
 		return nil, nil, err
@@ -89,9 +92,12 @@ func (c *Client) GetServerTLSConfig(ctx context.Context, sign *api.SignResponse,
 	tlsConfig.GetCertificate = renewer.GetCertificate
 	tlsConfig.GetClientCertificate = renewer.GetClientCertificate
 	tlsConfig.PreferServerCipherSuites = true
-	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientAuth = getDefaultClientAuth(sign)
 
 	// Apply options and initialize mutable tls.Config
+	if err := c.setClientCertificate(renewer); err != nil {
+		return nil, err
+	}
 	tlsCtx := newTLSOptionCtx(c, tlsConfig, sign)
 	if err := tlsCtx.apply(options); err != nil {
 		return nil, err
@@ -228,18 +234,57 @@ func TLSCertificate(sign *api.SignResponse, pk crypto.PrivateKey) (*tls.Certific
 	return &cert, nil
 }
 
+// setClientCertificate updates the transport of the client to present the
+// certificate of the given renewer. The roots request used by some TLS options
+// requires a client certificate, and the options are applied before the
+// client transport is replaced with the final one. A new transport is used so
+// the connections without a client certificate are not reused.
+func (c *Client) setClientCertificate(renewer *TLSRenewer) error {
+	tr, ok := c.client.GetTransport().(*http.Transport)
+	if !ok {
+		return nil
+	}
+	tlsConfig := tr.TLSClientConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = renewer.GetClientCertificate
+	tr, err := getDefaultTransport(tlsConfig)
+	if err != nil {
+		return err
+	}
+	c.client.SetTransport(tr)
+	return nil
+}
+
+// getDefaultTLSConfig returns the tls.Config with the options recommended by
+// the CA in the sign response. The TLSOption functions are applied after it, so
+// they can override the recommended options.
 func getDefaultTLSConfig(sign *api.SignResponse) *tls.Config {
+	tlsConfig := &tls.Config{}
 	if sign.TLSOptions != nil {
-		return sign.TLSOptions.TLSConfig()
+		tlsConfig = sign.TLSOptions.TLSConfig()
 	}
-	return &tls.Config{
-		MinVersion: tls.VersionTLS12,
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	return tlsConfig
+}
+
+// getDefaultClientAuth returns the tls.ClientAuthType of the servers, they
+// require and verify the client certificates unless the CA recommends
+// otherwise.
+func getDefaultClientAuth(sign *api.SignResponse) tls.ClientAuthType {
+	if o := sign.TLSOptions; o != nil && o.RequireClientCert != nil && !*o.RequireClientCert {
+		return tls.VerifyClientCertIfGiven
 	}
+	return tls.RequireAndVerifyClientCert
 }
 
 // getDefaultTransport returns an http.Transport with the same parameters than
-// http.DefaultTransport, but adds the given tls.Config and configures the
-// transport for HTTP/2.
+// http.DefaultTransport, but adds the given tls.Config, configures the
+// transport for HTTP/2 and keeps more idle connections to the CA for reuse.
 func getDefaultTransport(tlsConfig *tls.Config) (*http.Transport, error) {
 	tr := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -248,7 +293,9 @@ func getDefaultTransport(tlsConfig *tls.Config) (*http.Transport, error) {
 			KeepAlive: 30 * time.Second,
 			DualStack: true,
 		}).DialContext,
+		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
@@ -296,6 +343,10 @@ func getRenewFunc(ctx *TLSOptionCtx, client *Client, tr *http.Transport, pk cryp
 		if err != nil {
 			return nil, err
 		}
+		// The CA verifies the client certificate on every request, close the
+		// connections using the old certificate so new requests use the new
+		// one.
+		defer tr.CloseIdleConnections()
 		return TLSCertificate(sign, pk)
 	}
 }
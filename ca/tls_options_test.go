@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
 	"testing"
@@ -188,11 +189,23 @@ func TestAddClientCA(t *testing.T) {
 	}
 }
 
+// newClientWithCertificate returns a client that uses a certificate issued by
+// the given CA, the roots and federation requests require a client
+// certificate.
+func newClientWithCertificate(srv *httptest.Server) (*Client, error) {
+	_, sr, pk := signDuration(srv, "127.0.0.1", 0)
+	crt, err := TLSCertificate(sr, pk)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(srv.URL, WithRootFile("testdata/secrets/root_ca.crt"), WithCertificate(*crt))
+}
+
 func TestAddRootsToRootCAs(t *testing.T) {
 	ca := startCATestServer()
 	defer ca.Close()
 
-	client, err := NewClient(ca.URL, WithRootFile("testdata/secrets/root_ca.crt"))
+	client, err := newClientWithCertificate(ca)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -246,7 +259,7 @@ func TestAddRootsToClientCAs(t *testing.T) {
 	ca := startCATestServer()
 	defer ca.Close()
 
-	client, err := NewClient(ca.URL, WithRootFile("testdata/secrets/root_ca.crt"))
+	client, err := newClientWithCertificate(ca)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -300,7 +313,7 @@ func TestAddFederationToRootCAs(t *testing.T) {
 	ca := startCATestServer()
 	defer ca.Close()
 
-	client, err := NewClient(ca.URL, WithRootFile("testdata/secrets/root_ca.crt"))
+	client, err := newClientWithCertificate(ca)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -364,7 +377,7 @@ func TestAddFederationToClientCAs(t *testing.T) {
 	ca := startCATestServer()
 	defer ca.Close()
 
-	client, err := NewClient(ca.URL, WithRootFile("testdata/secrets/root_ca.crt"))
+	client, err := newClientWithCertificate(ca)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -428,7 +441,7 @@ func TestAddRootsToCAs(t *testing.T) {
 	ca := startCATestServer()
 	defer ca.Close()
 
-	client, err := NewClient(ca.URL, WithRootFile("testdata/secrets/root_ca.crt"))
+	client, err := newClientWithCertificate(ca)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -482,7 +495,7 @@ func TestAddFederationToCAs(t *testing.T) {
 	ca := startCATestServer()
 	defer ca.Close()
 
-	client, err := NewClient(ca.URL, WithRootFile("testdata/secrets/root_ca.crt"))
+	client, err := newClientWithCertificate(ca)
 	if err != nil {
 		t.Fatal(err)
 	}
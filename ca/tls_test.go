@@ -522,3 +522,41 @@ func TestRootCertificateCertificate(t *testing.T) {
 		})
 	}
 }
+
+func Test_getDefaultTLSConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		want           *tls.Config
+		wantClientAuth tls.ClientAuthType
+	}{
+		{"no options", `{}`, &tls.Config{MinVersion: tls.VersionTLS12}, tls.RequireAndVerifyClientCert},
+		{"tls 1.3", `{"tlsOptions":{"minVersion":1.3,"maxVersion":1.3,"requireClientCert":false}}`, &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			MaxVersion: tls.VersionTLS13,
+		}, tls.VerifyClientCertIfGiven},
+		{"cipher suites", `{"tlsOptions":{"cipherSuites":["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"],"maxVersion":1.2,"renegotiation":true,"requireClientCert":true}}`, &tls.Config{
+			CipherSuites:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			MinVersion:    tls.VersionTLS12,
+			MaxVersion:    tls.VersionTLS12,
+			Renegotiation: tls.RenegotiateFreelyAsClient,
+		}, tls.RequireAndVerifyClientCert},
+		{"unknown fields", `{"tlsOptions":{"minVersion":1.3,"curvePreferences":["X25519"]},"newField":true}`, &tls.Config{
+			MinVersion: tls.VersionTLS13,
+		}, tls.RequireAndVerifyClientCert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sign api.SignResponse
+			if err := readJSON(ioutil.NopCloser(bytes.NewBufferString(tt.body)), &sign); err != nil {
+				t.Fatalf("readJSON() error = %v", err)
+			}
+			if got := getDefaultTLSConfig(&sign); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getDefaultTLSConfig() = %#v, want %#v", got, tt.want)
+			}
+			if got := getDefaultClientAuth(&sign); got != tt.wantClientAuth {
+				t.Errorf("getDefaultClientAuth() = %v, want %v", got, tt.wantClientAuth)
+			}
+		})
+	}
+}
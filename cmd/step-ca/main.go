@@ -16,24 +16,18 @@ import (
 	// Server profiler
 	_ "net/http/pprof"
 
-	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/commands"
+	"github.com/smallstep/certificates/version"
 	"github.com/smallstep/cli/command"
-	"github.com/smallstep/cli/command/version"
+	cliVersion "github.com/smallstep/cli/command/version"
 	"github.com/smallstep/cli/config"
 	"github.com/smallstep/cli/usage"
 	"github.com/urfave/cli"
 )
 
-// commit and buildTime are filled in during build by the Makefile
-var (
-	BuildTime = "N/A"
-	Version   = "N/A"
-)
-
 func init() {
-	config.Set("Smallstep CA", Version, BuildTime)
-	authority.GlobalVersion.Version = Version
+	// The version information is filled in during build by the Makefile.
+	config.Set("Smallstep CA", version.Version, version.BuildTime)
 	rand.Seed(time.Now().UnixNano())
 }
 
@@ -76,7 +70,7 @@ Please send us a sentence or two, good or bad: **feedback@smallstep.com** or joi
 func main() {
 	// Override global framework components
 	cli.VersionPrinter = func(c *cli.Context) {
-		version.Command(c)
+		cliVersion.Command(c)
 	}
 	cli.AppHelpTemplate = appHelpTemplate
 	cli.SubcommandHelpTemplate = usage.SubcommandHelpTemplate
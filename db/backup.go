@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// DefaultBackupTimeout is the default maximum duration of a backup.
+const DefaultBackupTimeout = 10 * time.Minute
+
+// Snapshotter is implemented by the databases that can read all the tables
+// from a consistent snapshot. The snapshot is released when fn returns, and
+// the writes are not blocked while it runs, or only while the snapshot is
+// taken in the in-memory database.
+type Snapshotter interface {
+	// Snapshot calls fn with a function that iterates a table of the
+	// snapshot, sorted by key, like Iterator.
+	Snapshot(ctx context.Context, fn func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error) error
+}
+
+// Backuper is implemented by the databases that can be backed up, see Backup.
+type Backuper interface {
+	Backup(ctx context.Context, w io.Writer, opts *BackupOptions) (int64, error)
+}
+
+// BackupOptions are the options of Backup, the zero value is ok.
+type BackupOptions struct {
+	// Tables are the tables to back up, all the known tables by default.
+	Tables [][]byte
+	// Timeout is the maximum duration of the backup, 10m by default. The
+	// backup fails and the snapshot is released after it.
+	Timeout time.Duration
+}
+
+// Backup writes a backup of the database to w and returns the number of bytes
+// written. The backup uses the format of Export, so it is restored with
+// Import, and it is read from a consistent snapshot if the database
+// implements Snapshotter. Other databases are exported table by table.
+func Backup(ctx context.Context, w io.Writer, db nosql.DB, opts *BackupOptions) (int64, error) {
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultBackupTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cw := &countingWriter{w: w}
+	export := func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error {
+		return Export(cw, &snapshotDB{DB: db, ctx: ctx, iterate: iterate}, &ExportOptions{
+			Tables: opts.Tables,
+		})
+	}
+
+	var err error
+	if s, ok := db.(Snapshotter); ok {
+		err = s.Snapshot(ctx, export)
+	} else {
+		err = export(func(bucket []byte, fn func(e *database.Entry) error) error {
+			return iterate(db, bucket, fn)
+		})
+	}
+	if err != nil {
+		return cw.n, errors.Wrap(err, "error backing up database")
+	}
+	return cw.n, nil
+}
+
+// Backup writes a backup of the database to w, see Backup. Like the exports,
+// the backups contain the values as they are stored.
+func (db *DB) Backup(ctx context.Context, w io.Writer, opts *BackupOptions) (int64, error) {
+	return Backup(ctx, w, db.DB, opts)
+}
+
+// snapshotDB is the database exported by a backup, it reads the tables from a
+// snapshot and stops when the context is done.
+type snapshotDB struct {
+	nosql.DB
+	ctx     context.Context
+	iterate func(bucket []byte, fn func(e *database.Entry) error) error
+}
+
+func (db *snapshotDB) Iterate(bucket []byte, fn func(e *database.Entry) error) error {
+	if err := db.ctx.Err(); err != nil {
+		return err
+	}
+	return db.iterate(bucket, func(e *database.Entry) error {
+		if err := db.ctx.Err(); err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
+
+// countingWriter counts the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/badger"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+func newBadgerDB(t *testing.T, dir string) nosql.DB {
+	db := &badger.DB{}
+	assert.FatalError(t, db.Open(filepath.Join(dir, "badger")))
+	return db
+}
+
+func TestBackup(t *testing.T) {
+	tables := [][]byte{certsTable, revokedCertsTable, sshHostsTable, []byte("acme_accounts")}
+	tests := map[string]func(t *testing.T, dir string) nosql.DB{
+		"memory": newMemoryDB,
+		"bolt":   newBoltDB,
+		"badger": newBadgerDB,
+		// Without snapshots the tables are exported one by one.
+		"list": func(t *testing.T, dir string) nosql.DB { return &listDB{memory.New()} },
+	}
+	for name, open := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "backup")
+			assert.FatalError(t, err)
+			defer os.RemoveAll(dir)
+			src := open(t, dir)
+			defer src.Close()
+			fillDB(t, src)
+
+			var buf bytes.Buffer
+			n, err := Backup(context.Background(), &buf, src, &BackupOptions{
+				Tables: append(tables, []byte("missing")),
+			})
+			assert.FatalError(t, err)
+			assert.Equals(t, int64(buf.Len()), n)
+			assert.True(t, strings.HasPrefix(buf.String(), `{"format":"step-ca-db","version":1}`+"\n"))
+
+			// The backups are restored with Import.
+			dst := memory.New()
+			assert.FatalError(t, Import(&buf, dst, nil))
+			assert.Equals(t, testEntries, listAll(t, dst, tables))
+
+			// The backups stop when the context is done.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err = Backup(ctx, ioutil.Discard, src, nil)
+			assert.Equals(t, context.Canceled, errors.Cause(err))
+			_, err = Backup(context.Background(), ioutil.Discard, src, &BackupOptions{Timeout: time.Nanosecond})
+			assert.Equals(t, context.DeadlineExceeded, errors.Cause(err))
+		})
+	}
+}
+
+func TestDB_Backup(t *testing.T) {
+	adb, err := newDB(memory.New())
+	assert.FatalError(t, err)
+	d := adb.(*DB)
+	assert.FatalError(t, d.StoreCertificate(newCertificate(t, 1234, "backup.example.com")))
+
+	var buf bytes.Buffer
+	_, err = d.Backup(context.Background(), &buf, nil)
+	assert.FatalError(t, err)
+
+	// Restore the backup in an empty database.
+	radb, err := newDB(memory.New())
+	assert.FatalError(t, err)
+	restored := radb.(*DB)
+	assert.FatalError(t, restored.Import(&buf, nil))
+	crt, err := restored.GetCertificate("1234")
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"backup.example.com"}, crt.DNSNames)
+	crts, err := restored.GetCertificatesBySAN("backup.example.com")
+	assert.FatalError(t, err)
+	assert.Len(t, 1, crts)
+
+	// Writes are not blocked by the snapshot.
+	_, err = d.Backup(context.Background(), writerFunc(func(b []byte) (int, error) {
+		tx := new(database.Tx)
+		tx.Set(certsTable, []byte("other"), []byte("value"))
+		if err := d.Update(tx); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}), nil)
+	assert.FatalError(t, err)
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (fn writerFunc) Write(b []byte) (int, error) {
+	return fn(b)
+}
@@ -0,0 +1,661 @@
+// Package badger implements the nosql database interface over Badger.
+//
+// The tables are emulated with key prefixes, each key is the length of the
+// table name, the table name, the length of the key and the key, with the
+// lengths encoded in 2 bytes. The encoding is the one used by
+// github.com/smallstep/nosql/badger, so the databases created by it can be
+// opened with this package.
+//
+// The writes of different goroutines that do not need to read, Set, Del and
+// SetWithTTL, are grouped in a single transaction, reducing the number of
+// commits and disk syncs under load. The transactions that read and write,
+// CmpAndSwap and Update, are retried if they conflict with another one.
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+const (
+	// DefaultMaxBatchSize is the default maximum number of writes grouped in
+	// a transaction.
+	DefaultMaxBatchSize = 1000
+	// DefaultValueLogGCDiscardRatio is the default ratio of the value log
+	// file that must be discarded to rewrite it.
+	DefaultValueLogGCDiscardRatio = 0.5
+	// maxConflictRetries is the number of times a transaction is retried if
+	// it conflicts with another.
+	maxConflictRetries = 10
+	// conflictRetryBackoff is the time added to the wait of each retry of a
+	// conflicting transaction.
+	conflictRetryBackoff = time.Millisecond
+	// deleteTableBatchSize is the number of keys deleted in each
+	// transaction when a table is deleted.
+	deleteTableBatchSize = 1000
+)
+
+// Options are the Badger specific options of the database, the zero value
+// uses the defaults of Badger.
+type Options struct {
+	// FileLoadingMode is the way the LSM tables are loaded, "ram" (the
+	// default), "mmap" or "fileio". The memory used by "ram" grows with the
+	// size of the database.
+	FileLoadingMode string
+	// ValueLogLoadingMode is the way the value log files are loaded, "mmap"
+	// (the default), "ram" or "fileio".
+	ValueLogLoadingMode string
+	// ValueLogFileSize is the maximum size in bytes of a value log file.
+	ValueLogFileSize int64
+	// ValueLogMaxEntries is the maximum number of entries in a value log
+	// file.
+	ValueLogMaxEntries uint32
+	// ValueLogGCInterval is the interval between the value log garbage
+	// collections, they reclaim the space of deleted and expired entries.
+	// It is disabled by default.
+	ValueLogGCInterval time.Duration
+	// ValueLogGCDiscardRatio is the ratio of a value log file that must be
+	// discarded to rewrite it, 0.5 by default.
+	ValueLogGCDiscardRatio float64
+	// MaxBatchSize is the maximum number of writes grouped in a
+	// transaction, 1000 by default.
+	MaxBatchSize int
+}
+
+// ParseFileLoadingMode returns the Badger loading mode with the given name,
+// "ram", "mmap" or "fileio". The empty string returns the given default.
+func ParseFileLoadingMode(s string, def options.FileLoadingMode) (options.FileLoadingMode, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return def, nil
+	case "ram":
+		return options.LoadToRAM, nil
+	case "mmap":
+		return options.MemoryMap, nil
+	case "fileio":
+		return options.FileIO, nil
+	default:
+		return 0, errors.Errorf("unsupported file loading mode %s, it must be ram, mmap or fileio", s)
+	}
+}
+
+// DB is a nosql database over *badger.DB. The Options must be set before
+// calling Open.
+type DB struct {
+	Options Options
+
+	db       *badger.DB
+	writes   chan *write
+	stop     chan struct{}
+	done     sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// write is a Set, SetWithTTL or Del waiting to be committed.
+type write struct {
+	key    []byte
+	value  []byte
+	ttl    time.Duration
+	delete bool
+	errc   chan error
+}
+
+// Open opens or creates a Badger database in the given directory. The value
+// log is stored in the same directory unless the ValueDir option is set.
+func (db *DB) Open(dir string, opt ...database.Option) (err error) {
+	opts := &database.Options{}
+	for _, o := range opt {
+		if err := o(opts); err != nil {
+			return err
+		}
+	}
+
+	bo := badger.DefaultOptions
+	bo.Dir = dir
+	if opts.ValueDir != "" {
+		bo.ValueDir = opts.ValueDir
+	} else {
+		bo.ValueDir = dir
+	}
+	if bo.TableLoadingMode, err = ParseFileLoadingMode(db.Options.FileLoadingMode, bo.TableLoadingMode); err != nil {
+		return err
+	}
+	if bo.ValueLogLoadingMode, err = ParseFileLoadingMode(db.Options.ValueLogLoadingMode, bo.ValueLogLoadingMode); err != nil {
+		return err
+	}
+	if db.Options.ValueLogFileSize > 0 {
+		bo.ValueLogFileSize = db.Options.ValueLogFileSize
+	}
+	if db.Options.ValueLogMaxEntries > 0 {
+		bo.ValueLogMaxEntries = db.Options.ValueLogMaxEntries
+	}
+
+	if db.db, err = badger.Open(bo); err != nil {
+		return errors.Wrap(err, "error opening Badger database")
+	}
+
+	db.writes = make(chan *write)
+	db.stop = make(chan struct{})
+	db.done.Add(1)
+	go db.runWrites()
+	if db.Options.ValueLogGCInterval > 0 {
+		db.done.Add(1)
+		go db.runValueLogGC()
+	}
+	return nil
+}
+
+// Close waits for the pending writes and closes the database.
+func (db *DB) Close() error {
+	db.stopOnce.Do(func() { close(db.stop) })
+	db.done.Wait()
+	return errors.Wrap(db.db.Close(), "error closing Badger database")
+}
+
+// runWrites commits the writes sent by Set, SetWithTTL and Del. The writes
+// waiting when a transaction starts are committed in the same transaction.
+func (db *DB) runWrites() {
+	defer db.done.Done()
+	max := db.Options.MaxBatchSize
+	if max <= 0 {
+		max = DefaultMaxBatchSize
+	}
+	batch := make([]*write, 0, max)
+	for {
+		select {
+		case w := <-db.writes:
+			batch = append(batch[:0], w)
+		case <-db.stop:
+			return
+		}
+	collect:
+		for len(batch) < max {
+			select {
+			case w := <-db.writes:
+				batch = append(batch, w)
+			default:
+				break collect
+			}
+		}
+		db.commit(batch)
+	}
+}
+
+// commit writes the given batch, if it does not fit in a transaction it is
+// split in multiple ones.
+func (db *DB) commit(batch []*write) {
+	txn := db.db.NewTransaction(true)
+	pending := batch[:0:0]
+	flush := func(err error) {
+		if err == nil {
+			err = errors.Wrap(txn.Commit(nil), "failed to commit badger transaction")
+		} else {
+			txn.Discard()
+		}
+		for _, w := range pending {
+			w.errc <- err
+		}
+		pending = pending[:0]
+		txn = db.db.NewTransaction(true)
+	}
+	for _, w := range batch {
+		err := w.apply(txn)
+		if err == badger.ErrTxnTooBig && len(pending) > 0 {
+			flush(nil)
+			err = w.apply(txn)
+		}
+		if err != nil {
+			// Only this write fails, the previous ones are committed.
+			flush(nil)
+			w.errc <- err
+			continue
+		}
+		pending = append(pending, w)
+	}
+	flush(nil)
+	txn.Discard()
+}
+
+func (w *write) apply(txn *badger.Txn) error {
+	switch {
+	case w.delete:
+		return txn.Delete(w.key)
+	case w.ttl > 0:
+		return txn.SetWithTTL(w.key, w.value, w.ttl)
+	default:
+		return txn.Set(w.key, w.value)
+	}
+}
+
+// write sends a write to the goroutine that commits them and waits for the
+// result.
+func (db *DB) write(w *write) error {
+	w.errc = make(chan error, 1)
+	select {
+	case db.writes <- w:
+		return <-w.errc
+	case <-db.stop:
+		return errors.New("badger database is closed")
+	}
+}
+
+// runValueLogGC runs the value log garbage collection on each interval until
+// there are no files to rewrite.
+func (db *DB) runValueLogGC() {
+	defer db.done.Done()
+	ratio := db.Options.ValueLogGCDiscardRatio
+	if ratio <= 0 || ratio >= 1 {
+		ratio = DefaultValueLogGCDiscardRatio
+	}
+	ticker := time.NewTicker(db.Options.ValueLogGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for {
+				err := db.db.RunValueLogGC(ratio)
+				if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+					break
+				}
+				if err != nil {
+					log.Printf("badger: error running value log garbage collection: %v", err)
+					break
+				}
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// CreateTable creates a token element with the 'bucket' prefix so that such
+// that their appears to be a table.
+func (db *DB) CreateTable(bucket []byte) error {
+	bk, err := badgerEncode(bucket)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(bk, []byte{})
+	}), "failed to create %s/", bucket)
+}
+
+// DeleteTable deletes a table and all its entries. Returns an error if the
+// table cannot be found. The keys are deleted in batches, so a failure can
+// leave some of the entries.
+func (db *DB) DeleteTable(bucket []byte) error {
+	prefix, err := badgerEncode(bucket)
+	if err != nil {
+		return err
+	}
+	var tableExists bool
+	for {
+		var keys [][]byte
+		err := db.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Seek(prefix); it.ValidForPrefix(prefix) && len(keys) < deleteTableBatchSize; it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete table %s", bucket)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		tableExists = true
+		if err := db.db.Update(func(txn *badger.Txn) error {
+			for _, k := range keys {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "failed to delete table %s", bucket)
+		}
+	}
+	if !tableExists {
+		return errors.Wrapf(database.ErrNotFound, "table %s does not exist", bucket)
+	}
+	return nil
+}
+
+// Get returns the value stored in the given bucket and key.
+func (db *DB) Get(bucket, key []byte) (ret []byte, err error) {
+	bk, err := toBadgerKey(bucket, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error converting %s/%s to badgerKey", bucket, key)
+	}
+	err = db.db.View(func(txn *badger.Txn) error {
+		ret, err = badgerGet(txn, bk)
+		return err
+	})
+	return
+}
+
+// Set stores the given value on bucket and key.
+func (db *DB) Set(bucket, key, value []byte) error {
+	return db.SetWithTTL(bucket, key, value, 0)
+}
+
+// SetWithTTL stores the given value on bucket and key, the entry expires
+// after the given time to live, with a precision of seconds. A ttl of 0 does
+// not expire.
+func (db *DB) SetWithTTL(bucket, key, value []byte, ttl time.Duration) error {
+	bk, err := toBadgerKey(bucket, key)
+	if err != nil {
+		return errors.Wrapf(err, "error converting %s/%s to badgerKey", bucket, key)
+	}
+	return errors.Wrapf(db.write(&write{key: bk, value: value, ttl: ttl}),
+		"failed to set %s/%s", bucket, key)
+}
+
+// Del deletes the value stored in the given bucket and key.
+func (db *DB) Del(bucket, key []byte) error {
+	bk, err := toBadgerKey(bucket, key)
+	if err != nil {
+		return errors.Wrapf(err, "error converting %s/%s to badgerKey", bucket, key)
+	}
+	return errors.Wrapf(db.write(&write{key: bk, delete: true}),
+		"failed to delete %s/%s", bucket, key)
+}
+
+// List returns the full list of entries in a bucket sorted by key.
+func (db *DB) List(bucket []byte) ([]*database.Entry, error) {
+	var entries []*database.Entry
+	err := db.Iterate(bucket, func(e *database.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Iterate calls fn with the entries in a bucket sorted by key, without
+// loading all of them in memory. The iteration runs in a read transaction and
+// stops if fn returns an error.
+func (db *DB) Iterate(bucket []byte, fn func(e *database.Entry) error) error {
+	return db.db.View(func(txn *badger.Txn) error {
+		return iterate(txn, bucket, fn)
+	})
+}
+
+// Snapshot calls fn with a function that iterates the tables in a read
+// transaction, the writes are not blocked by it.
+func (db *DB) Snapshot(ctx context.Context, fn func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error) error {
+	return db.db.View(func(txn *badger.Txn) error {
+		return fn(func(bucket []byte, fn func(e *database.Entry) error) error {
+			return iterate(txn, bucket, fn)
+		})
+	})
+}
+
+func iterate(txn *badger.Txn, bucket []byte, fn func(e *database.Entry) error) error {
+	prefix, err := badgerEncode(bucket)
+	if err != nil {
+		return err
+	}
+	var tableExists bool
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		tableExists = true
+		item := it.Item()
+		bk := item.KeyCopy(nil)
+		if isBadgerTable(bk) {
+			continue
+		}
+		_bucket, key, err := fromBadgerKey(bk)
+		if err != nil {
+			return errors.Wrapf(err, "error converting from badgerKey %s", bk)
+		}
+		if !bytes.Equal(_bucket, bucket) {
+			return errors.Errorf("bucket names do not match; want %v, but got %v",
+				bucket, _bucket)
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return errors.Wrap(err, "error retrieving contents from database value")
+		}
+		if err := fn(&database.Entry{
+			Bucket: _bucket,
+			Key:    key,
+			Value:  v,
+		}); err != nil {
+			return err
+		}
+	}
+	if !tableExists {
+		return errors.Wrapf(database.ErrNotFound, "bucket %s not found", bucket)
+	}
+	return nil
+}
+
+// CmpAndSwap modifies the value at the given bucket and key (to newValue)
+// only if the existing (current) value matches oldValue.
+func (db *DB) CmpAndSwap(bucket, key, oldValue, newValue []byte) (val []byte, swapped bool, err error) {
+	bk, err := toBadgerKey(bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	err = db.update(func(txn *badger.Txn) error {
+		val, swapped, err = cmpAndSwap(txn, bk, oldValue, newValue)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, swapped, nil
+}
+
+// CmpAndSwapWithTTL is like CmpAndSwap, but the new value expires after the
+// given time to live, with a precision of seconds.
+func (db *DB) CmpAndSwapWithTTL(bucket, key, oldValue, newValue []byte, ttl time.Duration) (val []byte, swapped bool, err error) {
+	bk, err := toBadgerKey(bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	err = db.update(func(txn *badger.Txn) error {
+		val, swapped, err = cmpAndSwapWithTTL(txn, bk, oldValue, newValue, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, swapped, nil
+}
+
+// Update performs multiple commands on one read-write transaction. If a
+// command fails none of the changes are applied. The creation and deletion of
+// tables are not part of the transaction.
+func (db *DB) Update(tx *database.Tx) error {
+	return db.update(func(txn *badger.Txn) (err error) {
+		for _, q := range tx.Operations {
+			switch q.Cmd {
+			case database.CreateTable:
+				if err = db.CreateTable(q.Bucket); err != nil {
+					return err
+				}
+				continue
+			case database.DeleteTable:
+				if err = db.DeleteTable(q.Bucket); err != nil {
+					return err
+				}
+				continue
+			}
+			bk, err := toBadgerKey(q.Bucket, q.Key)
+			if err != nil {
+				return err
+			}
+			switch q.Cmd {
+			case database.Get:
+				if q.Result, err = badgerGet(txn, bk); err != nil {
+					return errors.Wrapf(err, "failed to get %s/%s", q.Bucket, q.Key)
+				}
+			case database.Set:
+				if err := txn.Set(bk, q.Value); err != nil {
+					return errors.Wrapf(err, "failed to set %s/%s", q.Bucket, q.Key)
+				}
+			case database.Delete:
+				if err = txn.Delete(bk); err != nil {
+					return errors.Wrapf(err, "failed to delete %s/%s", q.Bucket, q.Key)
+				}
+			case database.CmpAndSwap:
+				q.Result, q.Swapped, err = cmpAndSwap(txn, bk, q.CmpValue, q.Value)
+				if err != nil {
+					return errors.Wrapf(err, "failed to CmpAndSwap %s/%s", q.Bucket, q.Key)
+				}
+			default:
+				return database.ErrOpNotSupported
+			}
+		}
+		return nil
+	})
+}
+
+// update runs fn in a read-write transaction, it is retried if the
+// transaction conflicts with another one. Badger makes the commits visible to
+// new transactions asynchronously, so the retries wait an increasing time to
+// read the value of the transaction that won.
+func (db *DB) update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * conflictRetryBackoff)
+		}
+		if err = db.db.Update(fn); err != badger.ErrConflict {
+			return err
+		}
+	}
+	return errors.Wrap(err, "failed to commit badger transaction")
+}
+
+// badgerGet is a helper for the Get method.
+func badgerGet(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	switch {
+	case err == badger.ErrKeyNotFound:
+		return nil, errors.Wrapf(database.ErrNotFound, "key %s not found", key)
+	case err != nil:
+		return nil, errors.Wrapf(err, "failed to get key %s", key)
+	default:
+		// Make sure to return a copy as the value is only valid during the
+		// transaction.
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "error accessing value returned by database")
+		}
+		return val, nil
+	}
+}
+
+func cmpAndSwap(txn *badger.Txn, bk, oldValue, newValue []byte) ([]byte, bool, error) {
+	return cmpAndSwapWithTTL(txn, bk, oldValue, newValue, 0)
+}
+
+func cmpAndSwapWithTTL(txn *badger.Txn, bk, oldValue, newValue []byte, ttl time.Duration) ([]byte, bool, error) {
+	current, err := badgerGet(txn, bk)
+	// If value does not exist but expected is not nil, then return w/out swapping.
+	if err != nil && !database.IsErrNotFound(err) {
+		return nil, false, err
+	}
+	if !bytes.Equal(current, oldValue) {
+		return current, false, nil
+	}
+	if ttl > 0 {
+		err = txn.SetWithTTL(bk, newValue, ttl)
+	} else {
+		err = txn.Set(bk, newValue)
+	}
+	if err != nil {
+		return current, false, errors.Wrapf(err, "failed to set %s", bk)
+	}
+	return newValue, true, nil
+}
+
+// toBadgerKey returns the Badger database key using the following algorithm:
+// First 2 bytes are the length of the bucket/table name in little endian format,
+// followed by the bucket/table name,
+// followed by 2 bytes representing the length of the key in little endian format,
+// followed by the key.
+func toBadgerKey(bucket, key []byte) ([]byte, error) {
+	first, err := badgerEncode(bucket)
+	if err != nil {
+		return nil, err
+	}
+	second, err := badgerEncode(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// isBadgerTable returns true if the slice is a table token, a key with only
+// the table section.
+func isBadgerTable(bk []byte) bool {
+	k, rest := parseBadgerEncode(bk)
+	return len(k) > 0 && len(rest) == 0
+}
+
+// fromBadgerKey returns the bucket and key encoded in a badger key.
+// See documentation for toBadgerKey.
+func fromBadgerKey(bk []byte) ([]byte, []byte, error) {
+	bucket, rest := parseBadgerEncode(bk)
+	if len(bucket) == 0 || len(rest) == 0 {
+		return nil, nil, errors.Errorf("invalid badger key: %v", bk)
+	}
+	key, rest2 := parseBadgerEncode(rest)
+	if len(key) == 0 || len(rest2) != 0 {
+		return nil, nil, errors.Errorf("invalid badger key: %v", bk)
+	}
+	return bucket, key, nil
+}
+
+// badgerEncode encodes a byte slice into a section of a badger key.
+// See documentation for toBadgerKey.
+func badgerEncode(val []byte) ([]byte, error) {
+	l := len(val)
+	switch {
+	case l == 0:
+		return nil, errors.Errorf("input cannot be empty")
+	case l > 65535:
+		return nil, errors.Errorf("length of input cannot be greater than 65535")
+	default:
+		b := make([]byte, 2, 2+l)
+		binary.LittleEndian.PutUint16(b, uint16(l))
+		return append(b, val...), nil
+	}
+}
+
+func parseBadgerEncode(bk []byte) (value, rest []byte) {
+	if len(bk) < 2 {
+		return nil, bk
+	}
+	// First 2 bytes stores the length of the value.
+	end := 2 + int(binary.LittleEndian.Uint16(bk[:2]))
+	switch {
+	case len(bk) < end:
+		return nil, bk
+	case len(bk) == end:
+		return bk[2:end], nil
+	default:
+		return bk[2:end], bk[end:]
+	}
+}
@@ -0,0 +1,257 @@
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/options"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/dbtest"
+	"github.com/smallstep/nosql"
+)
+
+func openDB(t *testing.T, dir string, opts Options) *DB {
+	t.Helper()
+	db := &DB{Options: opts}
+	if err := db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDB(t *testing.T) {
+	var mu sync.Mutex
+	dirs := make(map[nosql.DB]string)
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	open := func(t *testing.T) nosql.DB {
+		dir := tempDir(t)
+		db := openDB(t, dir, Options{})
+		mu.Lock()
+		dirs[db] = dir
+		mu.Unlock()
+		return db
+	}
+	reopen := func(t *testing.T, db nosql.DB) nosql.DB {
+		mu.Lock()
+		dir := dirs[db]
+		mu.Unlock()
+		assert.FatalError(t, db.Close())
+		return openDB(t, dir, Options{FileLoadingMode: "mmap"})
+	}
+	dbtest.Run(t, open, reopen)
+}
+
+func TestDB_SetWithTTL(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	db := openDB(t, dir, Options{})
+	defer db.Close()
+
+	bucket := []byte("nonces")
+	assert.FatalError(t, db.CreateTable(bucket))
+	assert.FatalError(t, db.SetWithTTL(bucket, []byte("expires"), []byte("value"), time.Second))
+	assert.FatalError(t, db.Set(bucket, []byte("persists"), []byte("value")))
+
+	v, err := db.Get(bucket, []byte("expires"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+
+	// Badger expiration has a precision of seconds.
+	time.Sleep(2 * time.Second)
+	_, err = db.Get(bucket, []byte("expires"))
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+	entries, err := db.List(bucket)
+	assert.FatalError(t, err)
+	assert.Len(t, 1, entries)
+	assert.Equals(t, []byte("persists"), entries[0].Key)
+}
+
+func TestDB_CmpAndSwapWithTTL(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	db := openDB(t, dir, Options{})
+	defer db.Close()
+
+	bucket := []byte("used_ott")
+	assert.FatalError(t, db.CreateTable(bucket))
+	_, swapped, err := db.CmpAndSwapWithTTL(bucket, []byte("token"), nil, []byte("value"), time.Second)
+	assert.FatalError(t, err)
+	assert.True(t, swapped)
+	v, swapped, err := db.CmpAndSwapWithTTL(bucket, []byte("token"), nil, []byte("other"), time.Second)
+	assert.FatalError(t, err)
+	assert.False(t, swapped)
+	assert.Equals(t, []byte("value"), v)
+
+	// Badger expiration has a precision of seconds.
+	time.Sleep(2 * time.Second)
+	_, err = db.Get(bucket, []byte("token"))
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+	_, swapped, err = db.CmpAndSwapWithTTL(bucket, []byte("token"), nil, []byte("other"), time.Second)
+	assert.FatalError(t, err)
+	assert.True(t, swapped)
+}
+
+func TestDB_batch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	db := openDB(t, dir, Options{MaxBatchSize: 7})
+
+	bucket := []byte("bucket")
+	assert.FatalError(t, db.CreateTable(bucket))
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 500)
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			if err := db.Set(bucket, key, []byte("value")); err != nil {
+				errc <- err
+				return
+			}
+			if i%2 == 0 {
+				errc <- db.Del(bucket, key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		assert.FatalError(t, err)
+	}
+
+	entries, err := db.List(bucket)
+	assert.FatalError(t, err)
+	assert.Len(t, 250, entries)
+
+	// Writes after Close fail.
+	assert.FatalError(t, db.Close())
+	assert.Error(t, db.Set(bucket, []byte("key"), []byte("value")))
+}
+
+func TestDB_Open(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := &DB{Options: Options{FileLoadingMode: "foo"}}
+	assert.Error(t, db.Open(dir))
+	db = &DB{Options: Options{ValueLogLoadingMode: "foo"}}
+	assert.Error(t, db.Open(dir))
+
+	valueDir := filepath.Join(dir, "values")
+	db = &DB{Options: Options{
+		FileLoadingMode:     "fileio",
+		ValueLogLoadingMode: "fileio",
+		ValueLogFileSize:    1 << 20,
+		ValueLogMaxEntries:  1000,
+		ValueLogGCInterval:  10 * time.Millisecond,
+	}}
+	assert.FatalError(t, db.Open(dir, nosql.WithValueDir(valueDir)))
+	assert.FatalError(t, db.CreateTable([]byte("bucket")))
+	assert.FatalError(t, db.Set([]byte("bucket"), []byte("key"), []byte("value")))
+	// Let the value log garbage collection run.
+	time.Sleep(50 * time.Millisecond)
+	assert.FatalError(t, db.Close())
+
+	vlogs, err := filepath.Glob(filepath.Join(valueDir, "*.vlog"))
+	assert.FatalError(t, err)
+	assert.Len(t, 1, vlogs)
+}
+
+func TestParseFileLoadingMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		want    options.FileLoadingMode
+		wantErr bool
+	}{
+		{"default", "", options.MemoryMap, false},
+		{"ram", "ram", options.LoadToRAM, false},
+		{"mmap", "MMAP", options.MemoryMap, false},
+		{"fileio", "fileio", options.FileIO, false},
+		{"fail", "disk", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFileLoadingMode(tt.mode, options.MemoryMap)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseFileLoadingMode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equals(t, tt.want, got)
+		})
+	}
+}
+
+// crashHelperEnv is the environment variable with the directory of the
+// database written by TestHelperCrash.
+const crashHelperEnv = "BADGER_CRASH_HELPER_DIR"
+
+// TestDB_crashRecovery checks that the acknowledged writes survive a process
+// that exits without closing the database.
+func TestDB_crashRecovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping crash recovery test in short mode")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperCrash$")
+	cmd.Env = append(os.Environ(), crashHelperEnv+"="+dir)
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("helper process error = %v, want exit status 3; output:\n%s", err, out)
+	}
+
+	db := openDB(t, dir, Options{})
+	defer db.Close()
+	entries, err := db.List([]byte("bucket"))
+	assert.FatalError(t, err)
+	assert.Len(t, 100, entries)
+	for i, e := range entries {
+		assert.Equals(t, []byte(fmt.Sprintf("key-%03d", i)), e.Key)
+	}
+	v, swapped, err := db.CmpAndSwap([]byte("bucket"), []byte("key-000"), nil, []byte("other"))
+	assert.FatalError(t, err)
+	assert.False(t, swapped)
+	assert.Equals(t, []byte("value"), v)
+}
+
+// TestHelperCrash is run in a child process by TestDB_crashRecovery, it
+// writes to the database and exits without closing it.
+func TestHelperCrash(t *testing.T) {
+	dir := os.Getenv(crashHelperEnv)
+	if dir == "" {
+		t.Skip("only run by TestDB_crashRecovery")
+	}
+	db := openDB(t, dir, Options{})
+	if err := db.CreateTable([]byte("bucket")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte("bucket"), []byte(fmt.Sprintf("key-%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Exit(3)
+}
@@ -0,0 +1,367 @@
+// Package bolt implements the nosql database interface over bbolt, a single
+// file database that does not need any external service.
+//
+// Each table is a bbolt bucket, a table name with slashes is a nested bucket.
+// The layout is the one used by github.com/smallstep/nosql/bolt, so the
+// databases created by it can be opened with this package.
+//
+// bbolt allows multiple readers but only one writer at a time, and each
+// commit syncs the file to disk. To reduce the time spent waiting for the
+// lock, the writes of concurrent goroutines, Set, Del, CmpAndSwap and Update,
+// are grouped in a single transaction using bbolt batches. A write waits at
+// most MaxBatchDelay for other writes to join its batch. If one of the writes
+// in a batch fails, the others are committed again without it, so a failed
+// write never discards the changes of another one. Only one process can open
+// the database file.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultTimeout is the default time to wait for the lock of the database
+// file.
+const DefaultTimeout = 5 * time.Second
+
+var boltSep = []byte("/")
+
+// Options are the bbolt specific options of the database, the zero value uses
+// the defaults of bbolt.
+type Options struct {
+	// Timeout is the time to wait for the lock of the database file, 5s by
+	// default.
+	Timeout time.Duration
+	// NoSync disables the sync of the file to disk after each commit. It
+	// makes the writes faster, but the last writes can be lost or the file
+	// can be corrupted if the system crashes.
+	NoSync bool
+	// NoFreelistSync disables the write of the list of free pages in each
+	// commit. It makes the writes faster, but the list must be rebuilt when
+	// the database is opened.
+	NoFreelistSync bool
+	// FreelistType is the type of the list of free pages, "array" (the
+	// default) or "hashmap". The hashmap is faster with large fragmented
+	// databases.
+	FreelistType string
+	// MaxBatchSize is the maximum number of writes grouped in a
+	// transaction, 1000 by default.
+	MaxBatchSize int
+	// MaxBatchDelay is the maximum time a write waits for other writes to
+	// join its transaction, 10ms by default.
+	MaxBatchDelay time.Duration
+}
+
+// ParseFreelistType returns the bbolt freelist type with the given name,
+// "array" or "hashmap". The empty string returns the default, array.
+func ParseFreelistType(s string) (bolt.FreelistType, error) {
+	switch s {
+	case "", string(bolt.FreelistArrayType):
+		return bolt.FreelistArrayType, nil
+	case string(bolt.FreelistMapType):
+		return bolt.FreelistMapType, nil
+	default:
+		return "", errors.Errorf("unsupported freelist type %s, it must be array or hashmap", s)
+	}
+}
+
+// DB is a nosql database over *bolt.DB. The Options must be set before
+// calling Open.
+type DB struct {
+	Options Options
+
+	db *bolt.DB
+}
+
+// Open opens or creates a bbolt database in the given file.
+func (db *DB) Open(path string, opt ...database.Option) (err error) {
+	opts := &database.Options{}
+	for _, o := range opt {
+		if err := o(opts); err != nil {
+			return err
+		}
+	}
+
+	bo := &bolt.Options{
+		Timeout:        db.Options.Timeout,
+		NoSync:         db.Options.NoSync,
+		NoFreelistSync: db.Options.NoFreelistSync,
+	}
+	if bo.Timeout <= 0 {
+		bo.Timeout = DefaultTimeout
+	}
+	if bo.FreelistType, err = ParseFreelistType(db.Options.FreelistType); err != nil {
+		return err
+	}
+	if db.db, err = bolt.Open(path, 0600, bo); err != nil {
+		return errors.Wrap(err, "error opening bbolt database")
+	}
+	if db.Options.MaxBatchSize > 0 {
+		db.db.MaxBatchSize = db.Options.MaxBatchSize
+	}
+	if db.Options.MaxBatchDelay > 0 {
+		db.db.MaxBatchDelay = db.Options.MaxBatchDelay
+	}
+	return nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	return errors.Wrap(db.db.Close(), "error closing bbolt database")
+}
+
+// CreateTable creates a table or a nested table if it does not exist.
+func (db *DB) CreateTable(bucket []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return createBucket(tx, bucket)
+	})
+}
+
+// DeleteTable deletes a table or a nested table. It returns a not found error
+// if the table does not exist.
+func (db *DB) DeleteTable(bucket []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return deleteBucket(tx, bucket)
+	})
+}
+
+// Get returns the value stored in the given table and key.
+func (db *DB) Get(bucket, key []byte) (ret []byte, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		if ret = b.Get(key); ret == nil {
+			return errors.Wrapf(database.ErrNotFound, "key %s not found", key)
+		}
+		// Make sure to return a copy as ret is only valid during the
+		// transaction.
+		ret = cloneBytes(ret)
+		return nil
+	})
+	return
+}
+
+// Set stores the given value on the given table and key.
+func (db *DB) Set(bucket, key, value []byte) error {
+	return db.db.Batch(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(b.Put(key, value), "failed to set %s/%s", bucket, key)
+	})
+}
+
+// Del deletes the value stored in the given table and key.
+func (db *DB) Del(bucket, key []byte) error {
+	return db.db.Batch(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(b.Delete(key), "failed to delete %s/%s", bucket, key)
+	})
+}
+
+// List returns the entries of a table sorted by key.
+func (db *DB) List(bucket []byte) ([]*database.Entry, error) {
+	var entries []*database.Entry
+	err := db.Iterate(bucket, func(e *database.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Iterate calls fn with the entries of a table sorted by key, without loading
+// all of them in memory. The iteration runs in a read transaction and stops
+// if fn returns an error.
+func (db *DB) Iterate(bucket []byte, fn func(e *database.Entry) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		return iterate(tx, bucket, fn)
+	})
+}
+
+// Snapshot calls fn with a function that iterates the tables in a read
+// transaction. The writes are not blocked by it, except the ones that need to
+// grow the file, they wait until fn returns.
+func (db *DB) Snapshot(ctx context.Context, fn func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		return fn(func(bucket []byte, fn func(e *database.Entry) error) error {
+			return iterate(tx, bucket, fn)
+		})
+	})
+}
+
+func iterate(tx *bolt.Tx, bucket []byte, fn func(e *database.Entry) error) error {
+	b, err := getBucket(tx, bucket)
+	if err != nil {
+		return err
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		// Skip the nested tables.
+		if v == nil {
+			continue
+		}
+		if err := fn(&database.Entry{
+			Bucket: bucket,
+			Key:    cloneBytes(k),
+			Value:  cloneBytes(v),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CmpAndSwap modifies the value at the given table and key (to newValue) only
+// if the existing (current) value matches oldValue.
+func (db *DB) CmpAndSwap(bucket, key, oldValue, newValue []byte) (val []byte, swapped bool, err error) {
+	err = db.db.Batch(func(tx *bolt.Tx) error {
+		b, err := getBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		val, swapped, err = cmpAndSwap(b, key, oldValue, newValue)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, swapped, nil
+}
+
+// Update performs multiple commands on one read-write transaction. If a
+// command fails none of the changes are applied, so the changes of multiple
+// keys that must be atomic use it.
+func (db *DB) Update(tx *database.Tx) error {
+	return db.db.Batch(func(btx *bolt.Tx) (err error) {
+		for _, q := range tx.Operations {
+			switch q.Cmd {
+			case database.CreateTable:
+				if err = createBucket(btx, q.Bucket); err != nil {
+					return err
+				}
+				continue
+			case database.DeleteTable:
+				if err = deleteBucket(btx, q.Bucket); err != nil {
+					return err
+				}
+				continue
+			}
+
+			b, err := getBucket(btx, q.Bucket)
+			if err != nil {
+				return err
+			}
+			switch q.Cmd {
+			case database.Get:
+				ret := b.Get(q.Key)
+				if ret == nil {
+					return errors.Wrapf(database.ErrNotFound, "key %s/%s not found", q.Bucket, q.Key)
+				}
+				q.Result = cloneBytes(ret)
+			case database.Set:
+				if err = b.Put(q.Key, q.Value); err != nil {
+					return errors.Wrapf(err, "failed to set %s/%s", q.Bucket, q.Key)
+				}
+			case database.Delete:
+				if err = b.Delete(q.Key); err != nil {
+					return errors.Wrapf(err, "failed to delete %s/%s", q.Bucket, q.Key)
+				}
+			case database.CmpAndSwap:
+				q.Result, q.Swapped, err = cmpAndSwap(b, q.Key, q.CmpValue, q.Value)
+				if err != nil {
+					return errors.Wrapf(err, "failed to CmpAndSwap %s/%s", q.Bucket, q.Key)
+				}
+			default:
+				return database.ErrOpNotSupported
+			}
+		}
+		return nil
+	})
+}
+
+func cmpAndSwap(b *bolt.Bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	current := b.Get(key)
+	if !bytes.Equal(current, oldValue) {
+		return cloneBytes(current), false, nil
+	}
+	if err := b.Put(key, newValue); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to set key %s", key)
+	}
+	return newValue, true, nil
+}
+
+// getBucket returns a table, nested tables are names separated by '/'.
+func getBucket(tx *bolt.Tx, name []byte) (b *bolt.Bucket, err error) {
+	for i, n := range bytes.Split(name, boltSep) {
+		if i == 0 {
+			b = tx.Bucket(n)
+		} else {
+			b = b.Bucket(n)
+		}
+		if b == nil {
+			return nil, errors.Wrapf(database.ErrNotFound, "table %s not found", name)
+		}
+	}
+	return b, nil
+}
+
+// boltBucket is the common interface of bolt.Tx and bolt.Bucket used to
+// create and delete nested tables.
+type boltBucket interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// createBucket creates a table or a nested table.
+func createBucket(tx *bolt.Tx, name []byte) (err error) {
+	var b boltBucket = tx
+	for _, n := range bytes.Split(name, boltSep) {
+		if b, err = b.CreateBucketIfNotExists(n); err != nil {
+			return errors.Wrapf(err, "failed to create table %s", name)
+		}
+	}
+	return nil
+}
+
+// deleteBucket deletes a table or a nested table.
+func deleteBucket(tx *bolt.Tx, name []byte) error {
+	var b boltBucket = tx
+	buckets := bytes.Split(name, boltSep)
+	last := len(buckets) - 1
+	for _, n := range buckets[:last] {
+		nb := b.Bucket(n)
+		if nb == nil {
+			return errors.Wrapf(database.ErrNotFound, "table %s not found", name)
+		}
+		b = nb
+	}
+	err := b.DeleteBucket(buckets[last])
+	if err == bolt.ErrBucketNotFound {
+		return errors.Wrapf(database.ErrNotFound, "table %s not found", name)
+	}
+	return errors.Wrapf(err, "failed to delete table %s", name)
+}
+
+func cloneBytes(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	ret := make([]byte, len(v))
+	copy(ret, v)
+	return ret
+}
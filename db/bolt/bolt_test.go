@@ -0,0 +1,183 @@
+package bolt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/dbtest"
+	"github.com/smallstep/nosql"
+	nosqlbolt "github.com/smallstep/nosql/bolt"
+	bolt "go.etcd.io/bbolt"
+)
+
+func tempFile(t *testing.T, dir string) string {
+	t.Helper()
+	return filepath.Join(dir, fmt.Sprintf("bolt-%d.db", time.Now().UnixNano()))
+}
+
+func openDB(t *testing.T, path string, opts Options) *DB {
+	t.Helper()
+	db := &DB{Options: opts}
+	if err := db.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	paths := make(map[nosql.DB]string)
+	open := func(t *testing.T) nosql.DB {
+		path := tempFile(t, dir)
+		db := openDB(t, path, Options{})
+		paths[db] = path
+		return db
+	}
+	reopen := func(t *testing.T, db nosql.DB) nosql.DB {
+		assert.FatalError(t, db.Close())
+		return openDB(t, paths[db], Options{FreelistType: "hashmap", NoFreelistSync: true})
+	}
+	dbtest.Run(t, open, reopen)
+}
+
+func TestDB_nestedTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	db := openDB(t, tempFile(t, dir), Options{})
+	defer db.Close()
+
+	assert.FatalError(t, db.CreateTable([]byte("acme/nonces")))
+	assert.FatalError(t, db.Set([]byte("acme"), []byte("key"), []byte("value")))
+	assert.FatalError(t, db.Set([]byte("acme/nonces"), []byte("nonce"), []byte("value")))
+
+	// The nested tables are not returned as entries.
+	entries, err := db.List([]byte("acme"))
+	assert.FatalError(t, err)
+	assert.Len(t, 1, entries)
+	assert.Equals(t, []byte("key"), entries[0].Key)
+
+	v, err := db.Get([]byte("acme/nonces"), []byte("nonce"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+
+	assert.FatalError(t, db.DeleteTable([]byte("acme/nonces")))
+	_, err = db.List([]byte("acme/nonces"))
+	assert.True(t, nosql.IsErrNotFound(err), "List() error = %v, want not found", err)
+	err = db.DeleteTable([]byte("missing/nonces"))
+	assert.True(t, nosql.IsErrNotFound(err), "DeleteTable() error = %v, want not found", err)
+	_, err = db.Get([]byte("acme"), []byte("key"))
+	assert.FatalError(t, err)
+}
+
+func TestDB_batch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	db := openDB(t, tempFile(t, dir), Options{MaxBatchSize: 10, MaxBatchDelay: time.Millisecond})
+	defer db.Close()
+	bucket := []byte("bucket")
+	assert.FatalError(t, db.CreateTable(bucket))
+
+	// A failed write does not discard the writes in the same batch.
+	var wg sync.WaitGroup
+	errc := make(chan error, 200)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%10 == 0 {
+				_, _, err := db.CmpAndSwap([]byte("missing"), []byte("key"), nil, []byte("value"))
+				if !nosql.IsErrNotFound(err) {
+					errc <- fmt.Errorf("CmpAndSwap() error = %v, want not found", err)
+				}
+				return
+			}
+			errc <- db.Set(bucket, []byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		assert.FatalError(t, err)
+	}
+	entries, err := db.List(bucket)
+	assert.FatalError(t, err)
+	assert.Len(t, 180, entries)
+}
+
+func TestDB_Open(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	path := tempFile(t, dir)
+
+	db := &DB{Options: Options{FreelistType: "list"}}
+	assert.Error(t, db.Open(path))
+
+	db = openDB(t, path, Options{NoSync: true, MaxBatchSize: 10, MaxBatchDelay: time.Millisecond})
+	assert.True(t, db.db.NoSync)
+	assert.Equals(t, 10, db.db.MaxBatchSize)
+	assert.Equals(t, time.Millisecond, db.db.MaxBatchDelay)
+
+	// The file is locked by the first database.
+	locked := &DB{Options: Options{Timeout: 10 * time.Millisecond}}
+	assert.Error(t, locked.Open(path))
+	assert.FatalError(t, db.Close())
+}
+
+// TestDB_compatibility checks that the databases created by the nosql bolt
+// implementation can be opened.
+func TestDB_compatibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	path := tempFile(t, dir)
+
+	old := new(nosqlbolt.DB)
+	assert.FatalError(t, old.Open(path))
+	assert.FatalError(t, old.CreateTable([]byte("x509_certs")))
+	assert.FatalError(t, old.Set([]byte("x509_certs"), []byte("1"), []byte("cert")))
+	assert.FatalError(t, old.Close())
+
+	db := openDB(t, path, Options{})
+	defer db.Close()
+	v, err := db.Get([]byte("x509_certs"), []byte("1"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("cert"), v)
+}
+
+func TestParseFreelistType(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    bolt.FreelistType
+		wantErr bool
+	}{
+		{"default", "", bolt.FreelistArrayType, false},
+		{"array", "array", bolt.FreelistArrayType, false},
+		{"hashmap", "hashmap", bolt.FreelistMapType, false},
+		{"fail", "map", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFreelistType(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseFreelistType() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equals(t, tt.want, got)
+		})
+	}
+}
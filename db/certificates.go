@@ -0,0 +1,147 @@
+package db
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// CertificateFinder is implemented by the databases that can look up the
+// stored X.509 certificates.
+type CertificateFinder interface {
+	GetCertificate(serial string) (*x509.Certificate, error)
+	GetRevokedCertificate(serial string) (*RevokedCertificateInfo, error)
+	GetCertificatesBySAN(san string) ([]*x509.Certificate, error)
+}
+
+// PrefixLister is implemented by the databases that can list the entries of a
+// table with keys starting with a prefix without reading the whole table.
+type PrefixLister interface {
+	ListPrefix(bucket, prefix []byte) ([]*database.Entry, error)
+}
+
+// errStopIteration stops an iteration without an error.
+var errStopIteration = errors.New("stop iteration")
+
+// NormalizeSAN returns the form of a subject alternative name used in the
+// index of the certificates. IPs use their canonical text, URIs their
+// lowercase scheme and host, and the DNS names and emails are lowercase, the
+// DNS names without the trailing dot.
+func NormalizeSAN(san string) string {
+	san = strings.TrimSpace(san)
+	if ip := net.ParseIP(san); ip != nil {
+		return ip.String()
+	}
+	if strings.Contains(san, ":") {
+		if u, err := url.Parse(san); err == nil && u.Scheme != "" {
+			return normalizeURI(u)
+		}
+	}
+	return strings.TrimSuffix(strings.ToLower(san), ".")
+}
+
+func normalizeURI(u *url.URL) string {
+	uu := *u
+	uu.Scheme = strings.ToLower(uu.Scheme)
+	uu.Host = strings.ToLower(uu.Host)
+	return uu.String()
+}
+
+// certificateSANs returns the normalized subject alternative names of a
+// certificate without duplicates.
+func certificateSANs(crt *x509.Certificate) []string {
+	var sans []string
+	seen := make(map[string]bool)
+	add := func(s string) {
+		if s != "" && !seen[s] {
+			seen[s] = true
+			sans = append(sans, s)
+		}
+	}
+	for _, s := range crt.DNSNames {
+		add(NormalizeSAN(s))
+	}
+	for _, ip := range crt.IPAddresses {
+		add(ip.String())
+	}
+	for _, s := range crt.EmailAddresses {
+		add(NormalizeSAN(s))
+	}
+	for _, u := range crt.URIs {
+		add(normalizeURI(u))
+	}
+	return sans
+}
+
+// sanIndexKey returns the key of a certificate in the SAN index. The SAN and
+// the serial number are separated by a zero byte, so the certificates of a
+// SAN are listed with the prefix of the SAN and the separator.
+func sanIndexKey(san, serial string) []byte {
+	return []byte(san + "\x00" + serial)
+}
+
+// GetCertificate returns the stored certificate with the given serial number.
+func (db *DB) GetCertificate(serial string) (*x509.Certificate, error) {
+	b, err := db.Get(certsTable, []byte(serial))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading certificate %s", serial)
+	}
+	crt, err := x509.ParseCertificate(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing certificate %s", serial)
+	}
+	return crt, nil
+}
+
+// GetCertificatesBySAN returns the stored certificates with the given subject
+// alternative name, sorted by serial number. The SAN is normalized with
+// NormalizeSAN. Only the certificates stored after the SAN index was added
+// are returned.
+func (db *DB) GetCertificatesBySAN(san string) ([]*x509.Certificate, error) {
+	if san = NormalizeSAN(san); san == "" {
+		return nil, errors.New("san cannot be empty")
+	}
+	entries, err := listPrefix(db.DB, certsBySANTable, sanIndexKey(san, ""))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing certificates of %s", san)
+	}
+	crts := make([]*x509.Certificate, 0, len(entries))
+	for _, e := range entries {
+		crt, err := db.GetCertificate(string(e.Value))
+		if err != nil {
+			return nil, err
+		}
+		crts = append(crts, crt)
+	}
+	return crts, nil
+}
+
+// listPrefix returns the entries of a table with keys starting with the given
+// prefix. If the database does not implement PrefixLister, the table is read
+// until the keys are after the prefix.
+func listPrefix(db nosql.DB, bucket, prefix []byte) ([]*database.Entry, error) {
+	if pl, ok := db.(PrefixLister); ok {
+		return pl.ListPrefix(bucket, prefix)
+	}
+	_, sorted := db.(Iterator)
+	var entries []*database.Entry
+	err := iterate(db, bucket, func(e *database.Entry) error {
+		switch {
+		case bytes.HasPrefix(e.Key, prefix):
+			entries = append(entries, e)
+		case sorted && bytes.Compare(e.Key, prefix) > 0:
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+	return entries, nil
+}
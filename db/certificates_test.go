@@ -0,0 +1,165 @@
+package db
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+func TestNormalizeSAN(t *testing.T) {
+	tests := map[string]string{
+		"Test.Example.COM.":            "test.example.com",
+		" test.example.com ":           "test.example.com",
+		"*.Example.com":                "*.example.com",
+		"User@Example.com":             "user@example.com",
+		"10.0.0.1":                     "10.0.0.1",
+		"::ffff:10.0.0.1":              "10.0.0.1",
+		"2001:DB8:0:0:0:0:0:1":         "2001:db8::1",
+		"SPIFFE://Example.com/Foo/Bar": "spiffe://example.com/Foo/Bar",
+		"urn:uuid:A-B":                 "urn:uuid:A-B",
+	}
+	for san, want := range tests {
+		t.Run(san, func(t *testing.T) {
+			assert.Equals(t, want, NormalizeSAN(san))
+		})
+	}
+}
+
+func newCertificate(t *testing.T, serial int64, dnsNames ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	u, err := url.Parse("spiffe://Example.com/foo")
+	assert.FatalError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: "test"},
+		NotBefore:      time.Now(),
+		NotAfter:       time.Now().Add(time.Hour),
+		DNSNames:       dnsNames,
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::ffff:10.0.0.1")},
+		EmailAddresses: []string{"Test@Example.com"},
+		URIs:           []*url.URL{u},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	assert.FatalError(t, err)
+	return crt
+}
+
+func TestDB_GetCertificatesBySAN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := map[string]nosql.DB{
+		"memory": memory.New(),
+		"bbolt":  newBoltDB(t, dir),
+		"list":   &listDB{memory.New()},
+	}
+	for name, ndb := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer ndb.Close()
+			adb, err := newDB(ndb)
+			assert.FatalError(t, err)
+			d := adb.(*DB)
+
+			crt1 := newCertificate(t, 10, "Test.Example.com")
+			crt2 := newCertificate(t, 2, "test.example.com", "www.example.com")
+			// A name with the first one as prefix.
+			crt3 := newCertificate(t, 3, "test.example.com.evil")
+			for _, crt := range []*x509.Certificate{crt1, crt2, crt3} {
+				assert.FatalError(t, d.StoreCertificate(crt))
+			}
+
+			crt, err := d.GetCertificate("10")
+			assert.FatalError(t, err)
+			assert.Equals(t, crt1.Raw, crt.Raw)
+			_, err = d.GetCertificate("1")
+			assert.True(t, nosql.IsErrNotFound(err), "GetCertificate() error = %v, want not found", err)
+
+			for san, want := range map[string][]*x509.Certificate{
+				"test.example.com.":         {crt1, crt2},
+				"www.example.com":           {crt2},
+				"test.example.com.evil":     {crt3},
+				"10.0.0.1":                  {crt1, crt2, crt3},
+				"test@example.com":          {crt1, crt2, crt3},
+				"spiffe://example.com/foo":  {crt1, crt2, crt3},
+				"missing.example.com":       {},
+				"spiffe://example.com/FOO/": {},
+			} {
+				crts, err := d.GetCertificatesBySAN(san)
+				assert.FatalError(t, err)
+				assert.Equals(t, len(want), len(crts))
+				for i := range want {
+					assert.Equals(t, want[i].Raw, crts[i].Raw)
+				}
+			}
+			_, err = d.GetCertificatesBySAN(" ")
+			assert.Error(t, err)
+
+			_, err = d.GetRevokedCertificate("10")
+			assert.True(t, nosql.IsErrNotFound(err), "GetRevokedCertificate() error = %v, want not found", err)
+			assert.FatalError(t, d.Revoke(&RevokedCertificateInfo{Serial: "10", Reason: "foo"}))
+			rci, err := d.GetRevokedCertificate("10")
+			assert.FatalError(t, err)
+			assert.Equals(t, "foo", rci.Reason)
+		})
+	}
+}
+
+// listDB is a database that does not implement Iterator or PrefixLister.
+type listDB struct {
+	nosql.DB
+}
+
+// countDB is an Iterator that counts the entries read.
+type countDB struct {
+	nosql.DB
+	n int
+}
+
+func (db *countDB) Iterate(bucket []byte, fn func(e *database.Entry) error) error {
+	entries, err := db.List(bucket)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		db.n++
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestListPrefix(t *testing.T) {
+	db := &countDB{DB: memory.New()}
+	assert.FatalError(t, db.CreateTable(certsTable))
+	for _, k := range []string{"a", "b\x00", "b\x001", "b\x002", "c", "d"} {
+		assert.FatalError(t, db.Set(certsTable, []byte(k), []byte(k)))
+	}
+	entries, err := listPrefix(db, certsTable, []byte("b\x00"))
+	assert.FatalError(t, err)
+	assert.Equals(t, 3, len(entries))
+	// The iteration stops after the prefix.
+	assert.Equals(t, 5, db.n)
+
+	_, err = listPrefix(db, []byte("missing"), []byte("b"))
+	assert.True(t, nosql.IsErrNotFound(err), "listPrefix() error = %v, want not found", err)
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+// ExpiryLeeway is the time an entry is kept after its stored expiration. It
+// covers the leeway used to validate the tokens and the clock skew between the
+// CAs sharing a database.
+const ExpiryLeeway = 5 * time.Minute
+
+// ExpiryFunc returns the expiration time stored in the value of an entry. It
+// returns false if the value does not have one, those entries are never
+// deleted.
+type ExpiryFunc func(value []byte) (time.Time, bool)
+
+type expiringTable struct {
+	table  []byte
+	expiry ExpiryFunc
+}
+
+var (
+	expiryMutex    sync.RWMutex
+	expiringTables = []expiringTable{
+		{usedOTTTable, tokenExpiry},
+	}
+)
+
+// RegisterExpiry registers a table created by other packages, like the ACME
+// nonces, whose entries are deleted by DeleteExpired after the time returned
+// by fn. Registering a table again replaces its function.
+func RegisterExpiry(table []byte, fn ExpiryFunc) {
+	expiryMutex.Lock()
+	defer expiryMutex.Unlock()
+	for i, t := range expiringTables {
+		if bytes.Equal(t.table, table) {
+			expiringTables[i].expiry = fn
+			return
+		}
+	}
+	expiringTables = append(expiringTables, expiringTable{table, fn})
+}
+
+// Cleaner is implemented by the databases that can delete the expired entries
+// of the used tokens and the tables registered with RegisterExpiry.
+type Cleaner interface {
+	// DeleteExpired deletes the entries that expired before now minus
+	// ExpiryLeeway, in transactions of at most batchSize entries, and calls fn
+	// with the table and the number of entries deleted after each
+	// transaction. It stops between transactions if ctx is done.
+	DeleteExpired(ctx context.Context, now time.Time, batchSize int, fn func(table string, n int)) error
+	// NativeTTL returns true if the database expires the entries by itself,
+	// then DeleteExpired is only needed for the entries stored without an
+	// expiration by previous versions.
+	NativeTTL() bool
+}
+
+// ttlDB is implemented by the databases that can store expiring keys.
+type ttlDB interface {
+	SetWithTTL(bucket, key, value []byte, ttl time.Duration) error
+	CmpAndSwapWithTTL(bucket, key, oldValue, newValue []byte, ttl time.Duration) ([]byte, bool, error)
+}
+
+// NativeTTL returns true if the database expires the entries by itself. Only
+// Badger does.
+func (db *DB) NativeTTL() bool {
+	_, ok := db.DB.(ttlDB)
+	return ok
+}
+
+// DeleteExpired deletes the used tokens and the entries of the registered
+// tables that expired before now minus ExpiryLeeway. The expiration is the
+// one stored in the value, never the time the entry was stored, so an entry
+// without an expiration is never deleted.
+func (db *DB) DeleteExpired(ctx context.Context, now time.Time, batchSize int, fn func(table string, n int)) error {
+	if batchSize <= 0 {
+		return errors.New("batch size must be greater than 0")
+	}
+	expiryMutex.RLock()
+	tables := append([]expiringTable(nil), expiringTables...)
+	expiryMutex.RUnlock()
+
+	deadline := now.Add(-ExpiryLeeway)
+	for _, t := range tables {
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			keys, err := db.expiredKeys(t, deadline, batchSize)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				break
+			}
+			tx := new(database.Tx)
+			for _, k := range keys {
+				tx.Del(t.table, k)
+			}
+			if err := db.Update(tx); err != nil {
+				return errors.Wrapf(err, "error deleting expired entries of %s", t.table)
+			}
+			if fn != nil {
+				fn(string(t.table), len(keys))
+			}
+			if len(keys) < batchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// expiredKeys returns up to n keys of the table that expired before the
+// deadline. The deleted entries are not read again, so a table is scanned
+// from the beginning on each batch.
+func (db *DB) expiredKeys(t expiringTable, deadline time.Time, n int) ([][]byte, error) {
+	var keys [][]byte
+	collect := func(e *database.Entry) error {
+		if exp, ok := t.expiry(e.Value); ok && exp.Before(deadline) {
+			keys = append(keys, e.Key)
+			if len(keys) == n {
+				return errStopIteration
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if it, ok := db.DB.(Iterator); ok {
+		err = it.Iterate(t.table, collect)
+	} else {
+		var entries []*database.Entry
+		if entries, err = db.List(t.table); err == nil {
+			for _, e := range entries {
+				if err = collect(e); err != nil {
+					break
+				}
+			}
+		}
+	}
+	switch {
+	case err == nil, err == errStopIteration:
+		return keys, nil
+	case database.IsErrNotFound(err):
+		// The table has not been created, e.g. ACME is not used.
+		return nil, nil
+	default:
+		return nil, errors.Wrapf(err, "error listing %s", t.table)
+	}
+}
+
+// tokenExpiry returns the expiration claim of a used token, a JWT in compact
+// serialization. The signature is not verified, the token was verified before
+// storing it.
+func tokenExpiry(value []byte) (time.Time, bool) {
+	parts := strings.Split(string(value), ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Expiry *float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Expiry == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.Expiry), 0), true
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/badger"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/nosql"
+)
+
+// newToken returns a JWT-like token with the given claims, the signature is
+// not verified by the cleanup.
+func newToken(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"ES256"}`)) + "." + enc([]byte(claims)) + ".c2ln"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	tests := map[string]struct {
+		token string
+		want  time.Time
+		ok    bool
+	}{
+		"ok":            {newToken(`{"exp":1600000000}`), time.Unix(1600000000, 0), true},
+		"ok/float":      {newToken(`{"exp":1600000000.5}`), time.Unix(1600000000, 0), true},
+		"fail/no-exp":   {newToken(`{"sub":"foo"}`), time.Time{}, false},
+		"fail/bad-exp":  {newToken(`{"exp":"foo"}`), time.Time{}, false},
+		"fail/parts":    {"foo.bar", time.Time{}, false},
+		"fail/encoding": {"foo.b@r.baz", time.Time{}, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := tokenExpiry([]byte(tt.token))
+			assert.Equals(t, tt.ok, ok)
+			assert.True(t, tt.want.Equal(got), "tokenExpiry() = %v, want %v", got, tt.want)
+		})
+	}
+}
+
+func TestDB_DeleteExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	exp := func(d time.Duration) string {
+		return newToken(fmt.Sprintf(`{"exp":%d}`, now.Add(d).Unix()))
+	}
+	tokens := map[string]string{
+		"expired-1": exp(-ExpiryLeeway - time.Minute),
+		"expired-2": exp(-ExpiryLeeway - time.Hour),
+		"expired-3": exp(-24 * time.Hour),
+		// Expired but in the leeway, another CA could still accept it.
+		"leeway": exp(-time.Minute),
+		"valid":  exp(time.Minute),
+		"no-exp": newToken(`{"sub":"foo"}`),
+		"opaque": "foo",
+	}
+	keys := func(t *testing.T, d *DB, bucket []byte) []string {
+		entries, err := d.List(bucket)
+		assert.FatalError(t, err)
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, string(e.Key))
+		}
+		return keys
+	}
+
+	otherTable := []byte("test_expiring")
+	RegisterExpiry(otherTable, func(value []byte) (time.Time, bool) {
+		return now.Add(-time.Hour), string(value) == "expired"
+	})
+
+	tests := map[string]nosql.DB{
+		"memory": memory.New(),
+		"bbolt":  newBoltDB(t, dir),
+		"list":   &listDB{memory.New()},
+	}
+	for name, ndb := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer ndb.Close()
+			adb, err := newDB(ndb)
+			assert.FatalError(t, err)
+			d := adb.(*DB)
+			assert.False(t, d.NativeTTL())
+
+			// The registered tables may not exist.
+			assert.FatalError(t, d.DeleteExpired(context.Background(), now, 2, nil))
+
+			for id, tok := range tokens {
+				ok, err := d.UseToken(id, tok)
+				assert.FatalError(t, err)
+				assert.True(t, ok)
+			}
+			assert.FatalError(t, d.CreateTable(otherTable))
+			assert.FatalError(t, d.Set(otherTable, []byte("a"), []byte("expired")))
+			assert.FatalError(t, d.Set(otherTable, []byte("b"), []byte("valid")))
+
+			var batches []string
+			deleted := map[string]int{}
+			assert.FatalError(t, d.DeleteExpired(context.Background(), now, 2, func(table string, n int) {
+				batches = append(batches, fmt.Sprintf("%s/%d", table, n))
+				deleted[table] += n
+			}))
+			assert.Equals(t, []string{"used_ott/2", "used_ott/1", "test_expiring/1"}, batches)
+			assert.Equals(t, map[string]int{"used_ott": 3, "test_expiring": 1}, deleted)
+			assert.Equals(t, []string{"leeway", "no-exp", "opaque", "valid"}, keys(t, d, usedOTTTable))
+			assert.Equals(t, []string{"b"}, keys(t, d, otherTable))
+
+			// A deleted token is still rejected by its expiration.
+			ok, err := d.UseToken("leeway", tokens["leeway"])
+			assert.FatalError(t, err)
+			assert.False(t, ok)
+
+			// Nothing else expires until the leeway passes.
+			assert.FatalError(t, d.DeleteExpired(context.Background(), now.Add(ExpiryLeeway-2*time.Minute), 2, func(table string, n int) {
+				t.Errorf("unexpected deletion of %d entries in %s", n, table)
+			}))
+			assert.FatalError(t, d.DeleteExpired(context.Background(), now.Add(ExpiryLeeway+2*time.Minute), 10, nil))
+			assert.Equals(t, []string{"no-exp", "opaque"}, keys(t, d, usedOTTTable))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			assert.Equals(t, context.Canceled, d.DeleteExpired(ctx, now, 2, nil))
+			assert.Error(t, d.DeleteExpired(context.Background(), now, 0, nil))
+		})
+	}
+}
+
+func TestDB_NativeTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	bdb := &badger.DB{}
+	assert.FatalError(t, bdb.Open(filepath.Join(dir, "badger")))
+	defer bdb.Close()
+	adb, err := newDB(bdb)
+	assert.FatalError(t, err)
+	d := adb.(*DB)
+	assert.True(t, d.NativeTTL())
+
+	// The tokens expire by themselves, the ones without an expiration are
+	// stored as usual.
+	for _, tok := range []string{newToken(fmt.Sprintf(`{"exp":%d}`, time.Now().Unix())), "opaque"} {
+		ok, err := d.UseToken(tok, tok)
+		assert.FatalError(t, err)
+		assert.True(t, ok)
+		ok, err = d.UseToken(tok, tok)
+		assert.FatalError(t, err)
+		assert.False(t, ok)
+	}
+}
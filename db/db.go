@@ -1,27 +1,64 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"io/ioutil"
+	"log"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/db/badger"
+	"github.com/smallstep/certificates/db/bolt"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/certificates/db/mysql"
+	"github.com/smallstep/certificates/db/postgresql"
 	"github.com/smallstep/nosql"
 	"github.com/smallstep/nosql/database"
 	"golang.org/x/crypto/ssh"
 )
 
 var (
-	certsTable             = []byte("x509_certs")
-	revokedCertsTable      = []byte("revoked_x509_certs")
-	revokedSSHCertsTable   = []byte("revoked_ssh_certs")
-	usedOTTTable           = []byte("used_ott")
-	sshCertsTable          = []byte("ssh_certs")
-	sshHostsTable          = []byte("ssh_hosts")
-	sshUsersTable          = []byte("ssh_users")
-	sshHostPrincipalsTable = []byte("ssh_host_principals")
+	certsTable               = []byte("x509_certs")
+	revokedCertsTable        = []byte("revoked_x509_certs")
+	revokedSSHCertsTable     = []byte("revoked_ssh_certs")
+	usedOTTTable             = []byte("used_ott")
+	sshCertsTable            = []byte("ssh_certs")
+	sshHostsTable            = []byte("ssh_hosts")
+	sshUsersTable            = []byte("ssh_users")
+	sshHostPrincipalsTable   = []byte("ssh_host_principals")
+	provisionersTable        = []byte("provisioners")
+	adminsTable              = []byte("admins")
+	certsBySANTable          = []byte("x509_certs_san")
+	sshSupersededTable       = []byte("ssh_superseded_certs")
+	sshHostsByPrincipalTable = []byte("ssh_hosts_principal")
+
+	// authorityTables are the tables created by New.
+	authorityTables = [][]byte{
+		revokedCertsTable, certsTable, usedOTTTable,
+		sshCertsTable, sshHostsTable, sshHostPrincipalsTable, sshUsersTable,
+		revokedSSHCertsTable, provisionersTable, adminsTable, certsBySANTable,
+		sshSupersededTable, sshHostsByPrincipalTable,
+	}
+)
+
+const (
+	// badgerType is the type of the Badger databases.
+	badgerType = "badger"
+	// boltType is the type of the bbolt databases.
+	boltType = "bbolt"
+	// mysqlType is the type of the MySQL databases.
+	mysqlType = "mysql"
+	// postgresqlType is the type of the PostgreSQL databases.
+	postgresqlType = "postgresql"
+	// memoryType is the type of the in-memory databases.
+	memoryType = "memory"
 )
 
 // ErrAlreadyExists can be returned if the DB attempts to set a key that has
@@ -30,10 +67,314 @@ var ErrAlreadyExists = errors.New("already exists")
 
 // Config represents the JSON attributes used for configuring a step-ca DB.
 type Config struct {
-	Type       string `json:"type"`
-	DataSource string `json:"dataSource"`
-	ValueDir   string `json:"valueDir,omitempty"`
-	Database   string `json:"database,omitempty"`
+	Type                  string                `json:"type"`
+	DataSource            string                `json:"dataSource"`
+	ValueDir              string                `json:"valueDir,omitempty"`
+	Database              string                `json:"database,omitempty"`
+	BadgerFileLoadingMode string                `json:"badgerFileLoadingMode,omitempty"`
+	BadgerValueLog        *BadgerValueLogConfig `json:"badgerValueLog,omitempty"`
+	Bolt                  *BoltConfig           `json:"bolt,omitempty"`
+	MySQL                 *MySQLConfig          `json:"mysql,omitempty"`
+	PostgreSQL            *PostgreSQLConfig     `json:"postgresql,omitempty"`
+	Encryption            *EncryptionConfig     `json:"encryption,omitempty"`
+}
+
+// BadgerValueLogConfig contains the options used to tune the value log of a
+// Badger database.
+type BadgerValueLogConfig struct {
+	LoadingMode    string  `json:"loadingMode,omitempty"`
+	FileSize       int64   `json:"fileSize,omitempty"`
+	MaxEntries     uint32  `json:"maxEntries,omitempty"`
+	GCInterval     string  `json:"gcInterval,omitempty"`
+	GCDiscardRatio float64 `json:"gcDiscardRatio,omitempty"`
+}
+
+// BoltConfig contains the options used to tune a bbolt database.
+type BoltConfig struct {
+	Timeout        string `json:"timeout,omitempty"`
+	NoSync         bool   `json:"noSync,omitempty"`
+	NoFreelistSync bool   `json:"noFreelistSync,omitempty"`
+	FreelistType   string `json:"freelistType,omitempty"`
+	MaxBatchSize   int    `json:"maxBatchSize,omitempty"`
+	MaxBatchDelay  string `json:"maxBatchDelay,omitempty"`
+}
+
+// MySQLConfig contains the connection pool and TLS options of a MySQL
+// database.
+type MySQLConfig struct {
+	MaxOpenConns    int              `json:"maxOpenConns,omitempty"`
+	MaxIdleConns    int              `json:"maxIdleConns,omitempty"`
+	ConnMaxLifetime string           `json:"connMaxLifetime,omitempty"`
+	DeadlockRetries int              `json:"deadlockRetries,omitempty"`
+	TLS             *ClientTLSConfig `json:"tls,omitempty"`
+}
+
+// PostgreSQLConfig contains the connection pool, statement timeout, TLS and
+// notification options of a PostgreSQL database.
+type PostgreSQLConfig struct {
+	MaxConns         int32            `json:"maxConns,omitempty"`
+	MinConns         int32            `json:"minConns,omitempty"`
+	MaxConnLifetime  string           `json:"maxConnLifetime,omitempty"`
+	StatementTimeout string           `json:"statementTimeout,omitempty"`
+	Retries          int              `json:"retries,omitempty"`
+	Notify           bool             `json:"notify,omitempty"`
+	TLS              *ClientTLSConfig `json:"tls,omitempty"`
+}
+
+// ClientTLSConfig contains the files used to connect to a database server
+// using TLS. The root certificates default to the system ones, and the client
+// certificate is optional.
+type ClientTLSConfig struct {
+	Root        string `json:"root,omitempty"`
+	Certificate string `json:"crt,omitempty"`
+	Key         string `json:"key,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+}
+
+// Validate validates the database configuration, nil is ok.
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Type != badgerType && (c.BadgerFileLoadingMode != "" || c.BadgerValueLog != nil) {
+		return errors.Errorf("db.badgerFileLoadingMode and db.badgerValueLog are only supported by the %s database", badgerType)
+	}
+	if c.Type != boltType && c.Bolt != nil {
+		return errors.Errorf("db.bolt is only supported by the %s database", boltType)
+	}
+	if c.Type != mysqlType && c.MySQL != nil {
+		return errors.Errorf("db.mysql is only supported by the %s database", mysqlType)
+	}
+	if c.Type != postgresqlType && c.PostgreSQL != nil {
+		return errors.Errorf("db.postgresql is only supported by the %s database", postgresqlType)
+	}
+	if _, err := c.badgerOptions(); err != nil {
+		return err
+	}
+	if _, err := c.boltOptions(); err != nil {
+		return err
+	}
+	if err := c.MySQL.validate(); err != nil {
+		return err
+	}
+	if err := c.PostgreSQL.validate(); err != nil {
+		return err
+	}
+	return c.Encryption.validate()
+}
+
+// badgerOptions returns the options of a Badger database.
+func (c *Config) badgerOptions() (badger.Options, error) {
+	var opts badger.Options
+	if _, err := badger.ParseFileLoadingMode(c.BadgerFileLoadingMode, 0); err != nil {
+		return opts, errors.Wrap(err, "db.badgerFileLoadingMode is not valid")
+	}
+	opts.FileLoadingMode = c.BadgerFileLoadingMode
+	if vl := c.BadgerValueLog; vl != nil {
+		if _, err := badger.ParseFileLoadingMode(vl.LoadingMode, 0); err != nil {
+			return opts, errors.Wrap(err, "db.badgerValueLog.loadingMode is not valid")
+		}
+		switch {
+		case vl.FileSize < 0:
+			return opts, errors.New("db.badgerValueLog.fileSize cannot be negative")
+		case vl.GCDiscardRatio < 0 || vl.GCDiscardRatio >= 1:
+			return opts, errors.New("db.badgerValueLog.gcDiscardRatio must be greater or equal than 0 and less than 1")
+		}
+		d, err := parseDuration("db.badgerValueLog.gcInterval", vl.GCInterval)
+		if err != nil {
+			return opts, err
+		}
+		opts.ValueLogGCInterval = d
+		opts.ValueLogLoadingMode = vl.LoadingMode
+		opts.ValueLogFileSize = vl.FileSize
+		opts.ValueLogMaxEntries = vl.MaxEntries
+		opts.ValueLogGCDiscardRatio = vl.GCDiscardRatio
+	}
+	return opts, nil
+}
+
+// boltOptions returns the options of a bbolt database.
+func (c *Config) boltOptions() (bolt.Options, error) {
+	var (
+		opts bolt.Options
+		err  error
+	)
+	bc := c.Bolt
+	if bc == nil {
+		return opts, nil
+	}
+	if _, err = bolt.ParseFreelistType(bc.FreelistType); err != nil {
+		return opts, errors.Wrap(err, "db.bolt.freelistType is not valid")
+	}
+	if bc.MaxBatchSize < 0 {
+		return opts, errors.New("db.bolt.maxBatchSize cannot be negative")
+	}
+	if opts.Timeout, err = parseDuration("db.bolt.timeout", bc.Timeout); err != nil {
+		return opts, err
+	}
+	if opts.MaxBatchDelay, err = parseDuration("db.bolt.maxBatchDelay", bc.MaxBatchDelay); err != nil {
+		return opts, err
+	}
+	opts.NoSync = bc.NoSync
+	opts.NoFreelistSync = bc.NoFreelistSync
+	opts.FreelistType = bc.FreelistType
+	opts.MaxBatchSize = bc.MaxBatchSize
+	return opts, nil
+}
+
+// validate validates the MySQL options, nil is ok.
+func (c *MySQLConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch {
+	case c.MaxOpenConns < 0:
+		return errors.New("db.mysql.maxOpenConns cannot be negative")
+	case c.MaxIdleConns < 0:
+		return errors.New("db.mysql.maxIdleConns cannot be negative")
+	case c.DeadlockRetries < 0:
+		return errors.New("db.mysql.deadlockRetries cannot be negative")
+	}
+	if _, err := parseDuration("db.mysql.connMaxLifetime", c.ConnMaxLifetime); err != nil {
+		return err
+	}
+	return c.TLS.validate("db.mysql.tls")
+}
+
+// mysqlOptions returns the options of a MySQL database. The TLS files are
+// read every time it is called.
+func (c *Config) mysqlOptions() (mysql.Options, error) {
+	var (
+		opts mysql.Options
+		err  error
+	)
+	mc := c.MySQL
+	if mc == nil {
+		return opts, nil
+	}
+	if err = mc.validate(); err != nil {
+		return opts, err
+	}
+	opts.MaxOpenConns = mc.MaxOpenConns
+	opts.MaxIdleConns = mc.MaxIdleConns
+	opts.DeadlockRetries = mc.DeadlockRetries
+	if opts.ConnMaxLifetime, err = parseDuration("db.mysql.connMaxLifetime", mc.ConnMaxLifetime); err != nil {
+		return opts, err
+	}
+	if mc.TLS != nil {
+		if opts.TLSConfig, err = mc.TLS.tlsConfig("db.mysql.tls"); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// validate validates the TLS options with the given configuration
+// property, nil is ok.
+func (c *ClientTLSConfig) validate(name string) error {
+	if c != nil && (c.Certificate == "") != (c.Key == "") {
+		return errors.Errorf("%s.crt and %s.key must be both set", name, name)
+	}
+	return nil
+}
+
+// validate validates the PostgreSQL options, nil is ok.
+func (c *PostgreSQLConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch {
+	case c.MaxConns < 0:
+		return errors.New("db.postgresql.maxConns cannot be negative")
+	case c.MinConns < 0:
+		return errors.New("db.postgresql.minConns cannot be negative")
+	case c.MaxConns > 0 && c.MinConns > c.MaxConns:
+		return errors.New("db.postgresql.minConns cannot be greater than db.postgresql.maxConns")
+	case c.Retries < 0:
+		return errors.New("db.postgresql.retries cannot be negative")
+	}
+	if _, err := parseDuration("db.postgresql.maxConnLifetime", c.MaxConnLifetime); err != nil {
+		return err
+	}
+	if _, err := parseDuration("db.postgresql.statementTimeout", c.StatementTimeout); err != nil {
+		return err
+	}
+	return c.TLS.validate("db.postgresql.tls")
+}
+
+// postgresqlOptions returns the options of a PostgreSQL database. The TLS
+// files are read every time it is called.
+func (c *Config) postgresqlOptions() (postgresql.Options, error) {
+	var (
+		opts postgresql.Options
+		err  error
+	)
+	pc := c.PostgreSQL
+	if pc == nil {
+		return opts, nil
+	}
+	if err = pc.validate(); err != nil {
+		return opts, err
+	}
+	opts.MaxConns = pc.MaxConns
+	opts.MinConns = pc.MinConns
+	opts.Retries = pc.Retries
+	opts.Notify = pc.Notify
+	if opts.MaxConnLifetime, err = parseDuration("db.postgresql.maxConnLifetime", pc.MaxConnLifetime); err != nil {
+		return opts, err
+	}
+	if opts.StatementTimeout, err = parseDuration("db.postgresql.statementTimeout", pc.StatementTimeout); err != nil {
+		return opts, err
+	}
+	if pc.TLS != nil {
+		if opts.TLSConfig, err = pc.TLS.tlsConfig("db.postgresql.tls"); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// tlsConfig reads the files and returns the TLS configuration, name is the
+// configuration property used in the errors.
+func (c *ClientTLSConfig) tlsConfig(name string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.Root != "" {
+		b, err := ioutil.ReadFile(c.Root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s.root", name)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("error reading %s.root: %s does not contain any certificate", name, c.Root)
+		}
+	}
+	if c.Certificate != "" {
+		crt, err := tls.LoadX509KeyPair(c.Certificate, c.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s.crt and %s.key", name, name)
+		}
+		conf.Certificates = []tls.Certificate{crt}
+	}
+	return conf, nil
+}
+
+// parseDuration parses the duration in the given configuration property, the
+// empty string is 0.
+func parseDuration(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s is not valid", name)
+	}
+	if d < 0 {
+		return 0, errors.Errorf("%s cannot be negative", name)
+	}
+	return d, nil
 }
 
 // AuthDB is an interface over an Authority DB client that implements a nosql.DB interface.
@@ -47,6 +388,13 @@ type AuthDB interface {
 	IsSSHHost(name string) (bool, error)
 	StoreSSHCertificate(crt *ssh.Certificate) error
 	GetSSHHostPrincipals() ([]string, error)
+	GetProvisioners() (map[string][]byte, error)
+	StoreProvisioner(id string, data []byte) error
+	DeleteProvisioner(id string) error
+	GetAdmins() (map[string][]byte, error)
+	StoreAdmin(id string, data []byte) error
+	DeleteAdmin(id string) error
+	Ping(ctx context.Context) error
 	Shutdown() error
 }
 
@@ -54,45 +402,208 @@ type AuthDB interface {
 type DB struct {
 	nosql.DB
 	isUp bool
+	enc  *encrypter
 }
 
-// New returns a new database client that implements the AuthDB interface.
-func New(c *Config) (AuthDB, error) {
+// New returns a new database client that implements the AuthDB interface. A
+// nil configuration returns an in-memory database. If the configuration has
+// an encryption section, the values of the sensitive tables are encrypted.
+func New(c *Config, opts ...Option) (AuthDB, error) {
 	if c == nil {
-		return newSimpleDB(c)
+		return New(&Config{Type: memoryType})
 	}
 
-	db, err := nosql.New(c.Type, c.DataSource, nosql.WithDatabase(c.Database),
-		nosql.WithValueDir(c.ValueDir))
+	o := new(options)
+	for _, fn := range opts {
+		fn(o)
+	}
+	var enc *encrypter
+	if c.Encryption != nil {
+		var err error
+		if enc, err = newEncrypter(c.Encryption, o); err != nil {
+			return nil, err
+		}
+	}
+
+	var ndb nosql.DB
+	if c.Type == memoryType {
+		log.Println("warning: using an in-memory database, the certificates, revocations and used tokens will not persist after a restart")
+		ndb = memory.New()
+	} else {
+		var err error
+		if ndb, err = open(c); err != nil {
+			return nil, errors.Wrapf(err, "Error opening database of Type %s with source %s", c.Type, c.DataSource)
+		}
+	}
+	adb, err := newDB(ndb)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error opening database of Type %s with source %s", c.Type, c.DataSource)
+		return nil, err
 	}
+	adb.(*DB).enc = enc
+	return adb, nil
+}
 
-	tables := [][]byte{
-		revokedCertsTable, certsTable, usedOTTTable,
-		sshCertsTable, sshHostsTable, sshHostPrincipalsTable, sshUsersTable,
-		revokedSSHCertsTable,
+// NewMemory returns a new database client stored in memory. The data is lost
+// when the process exits. It can be used to create an authority that does not
+// need a database configuration.
+func NewMemory() AuthDB {
+	db, err := newDB(memory.New())
+	if err != nil {
+		// The in-memory database does not fail.
+		panic(err)
 	}
-	for _, b := range tables {
+	return db
+}
+
+// newDB creates the authority tables in the given database.
+func newDB(db nosql.DB) (AuthDB, error) {
+	for _, b := range authorityTables {
 		if err := db.CreateTable(b); err != nil {
 			return nil, errors.Wrapf(err, "error creating table %s",
 				string(b))
 		}
 	}
 
-	return &DB{db, true}, nil
+	return &DB{DB: db, isUp: true}, nil
+}
+
+// open opens the database of the configured type. Badger, bbolt, MySQL and
+// PostgreSQL databases use the implementations in the badger, bolt, mysql and
+// postgresql packages, the rest use the nosql ones.
+func open(c *Config) (nosql.DB, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var db nosql.DB
+	switch c.Type {
+	case badgerType:
+		opts, err := c.badgerOptions()
+		if err != nil {
+			return nil, err
+		}
+		db = &badger.DB{Options: opts}
+	case boltType:
+		opts, err := c.boltOptions()
+		if err != nil {
+			return nil, err
+		}
+		db = &bolt.DB{Options: opts}
+	case mysqlType:
+		opts, err := c.mysqlOptions()
+		if err != nil {
+			return nil, err
+		}
+		db = &mysql.DB{Options: opts}
+	case postgresqlType:
+		opts, err := c.postgresqlOptions()
+		if err != nil {
+			return nil, err
+		}
+		db = &postgresql.DB{Options: opts}
+	default:
+		return nosql.New(c.Type, c.DataSource, nosql.WithDatabase(c.Database),
+			nosql.WithValueDir(c.ValueDir))
+	}
+	if err := db.Open(c.DataSource, nosql.WithDatabase(c.Database), nosql.WithValueDir(c.ValueDir)); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// CanReload returns true if a database opened with the old configuration can
+// be reloaded with the new one. Only MySQL and PostgreSQL databases support
+// it, and only the data source can change.
+func CanReload(old, new *Config) bool {
+	if old == nil || new == nil || old.Type != new.Type {
+		return false
+	}
+	if old.Type != mysqlType && old.Type != postgresqlType {
+		return false
+	}
+	c := *new
+	c.DataSource = old.DataSource
+	return reflect.DeepEqual(old, &c)
+}
+
+// Reload reconnects to the database with the data source in the given
+// configuration, and re-reads the TLS files. It is used to rotate the
+// credentials of the databases that support it, see CanReload.
+func (db *DB) Reload(c *Config) error {
+	if c == nil {
+		return errors.New("database does not support reloads")
+	}
+	switch rdb := db.DB.(type) {
+	case *mysql.DB:
+		if c.Type != mysqlType {
+			break
+		}
+		opts, err := c.mysqlOptions()
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(rdb.Reload(c.DataSource, opts.TLSConfig), "error reloading database")
+	case *postgresql.DB:
+		if c.Type != postgresqlType {
+			break
+		}
+		opts, err := c.postgresqlOptions()
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(rdb.Reload(c.DataSource, opts.TLSConfig), "error reloading database")
+	}
+	return errors.New("database does not support reloads")
+}
+
+// AdminWatcher is implemented by the databases that notify the changes in
+// the provisioners and admins made by other CAs using the same database.
+type AdminWatcher interface {
+	// WatchAdmin calls fn after other CA changes the provisioners or admins,
+	// until the returned function is called. It returns ErrNotImplemented if
+	// the database does not send notifications.
+	WatchAdmin(fn func()) (stop func(), err error)
+}
+
+// WatchAdmin calls fn after other CA changes the provisioners or admins. Only
+// PostgreSQL databases with notifications enabled support it.
+func (db *DB) WatchAdmin(fn func()) (func(), error) {
+	pdb, ok := db.DB.(*postgresql.DB)
+	if !ok || !pdb.Options.Notify {
+		return nil, ErrNotImplemented
+	}
+	return pdb.Watch(func(bucket []byte) {
+		if bytes.Equal(bucket, provisionersTable) || bytes.Equal(bucket, adminsTable) {
+			fn()
+		}
+	})
+}
+
+// SetWithTTL sets the value of the given key in the given table that will
+// expire after the given duration. If the database does not support expiring
+// keys the value is stored without expiration.
+func (db *DB) SetWithTTL(bucket, key, value []byte, ttl time.Duration) error {
+	if tdb, ok := db.DB.(interface {
+		SetWithTTL(bucket, key, value []byte, ttl time.Duration) error
+	}); ok {
+		return tdb.SetWithTTL(bucket, key, value, ttl)
+	}
+	return db.Set(bucket, key, value)
 }
 
 // RevokedCertificateInfo contains information regarding the certificate
-// revocation action.
+// revocation action. RevokedBy is the subject of the token or the common name
+// of the client certificate used to revoke, and Provisional is true if the
+// certificate is on hold and the revocation can be released with Unrevoke.
 type RevokedCertificateInfo struct {
 	Serial        string
 	ProvisionerID string
 	ReasonCode    int
 	Reason        string
 	RevokedAt     time.Time
+	RevokedBy     string
 	TokenID       string
 	MTLS          bool
+	Provisional   bool
 }
 
 // IsRevoked returns whether or not a certificate with the given identifier
@@ -177,18 +688,38 @@ func (db *DB) RevokeSSH(rci *RevokedCertificateInfo) error {
 	}
 }
 
-// StoreCertificate stores a certificate PEM.
+// StoreCertificate stores a certificate and adds it to the index of subject
+// alternative names.
 func (db *DB) StoreCertificate(crt *x509.Certificate) error {
-	if err := db.Set(certsTable, []byte(crt.SerialNumber.String()), crt.Raw); err != nil {
-		return errors.Wrap(err, "database Set error")
+	serial := crt.SerialNumber.String()
+	tx := new(database.Tx)
+	tx.Set(certsTable, []byte(serial), crt.Raw)
+	for _, san := range certificateSANs(crt) {
+		tx.Set(certsBySANTable, sanIndexKey(san, serial), []byte(serial))
+	}
+	if err := db.Update(tx); err != nil {
+		return errors.Wrap(err, "database Update error")
 	}
 	return nil
 }
 
 // UseToken returns true if we were able to successfully store the token for
-// for the first time, false otherwise.
+// for the first time, false otherwise. In the databases with native
+// expiration the token expires ExpiryLeeway after its expiration claim.
 func (db *DB) UseToken(id, tok string) (bool, error) {
-	_, swapped, err := db.CmpAndSwap(usedOTTTable, []byte(id), nil, []byte(tok))
+	var (
+		swapped bool
+		err     error
+	)
+	if exp, ok := tokenExpiry([]byte(tok)); ok && db.NativeTTL() {
+		ttl := time.Until(exp) + ExpiryLeeway
+		if ttl < ExpiryLeeway {
+			ttl = ExpiryLeeway
+		}
+		_, swapped, err = db.DB.(ttlDB).CmpAndSwapWithTTL(usedOTTTable, []byte(id), nil, []byte(tok), ttl)
+	} else {
+		_, swapped, err = db.CmpAndSwap(usedOTTTable, []byte(id), nil, []byte(tok))
+	}
 	if err != nil {
 		return false, errors.Wrapf(err, "error storing used token %s/%s",
 			string(usedOTTTable), id)
@@ -196,15 +727,43 @@ func (db *DB) UseToken(id, tok string) (bool, error) {
 	return swapped, nil
 }
 
-// IsSSHHost returns if a principal is present in the ssh hosts table.
+// IsSSHHost returns if a principal is in an unexpired and unrevoked host
+// certificate. The host certificates stored before the principal index was
+// added are looked up in the ssh host principals table.
 func (db *DB) IsSSHHost(principal string) (bool, error) {
-	if _, err := db.Get(sshHostsTable, []byte(strings.ToLower(principal))); err != nil {
-		if database.IsErrNotFound(err) {
-			return false, nil
+	principal = strings.ToLower(principal)
+	entries, err := listPrefix(db.DB, sshHostsByPrincipalTable, sanIndexKey(principal, ""))
+	if err != nil {
+		return false, errors.Wrapf(err, "error listing host certificates of %s", principal)
+	}
+	if len(entries) == 0 {
+		b, err := db.Get(sshHostPrincipalsTable, []byte(principal))
+		if err != nil {
+			if database.IsErrNotFound(err) {
+				return false, nil
+			}
+			return false, errors.Wrap(err, "database Get error")
 		}
-		return false, errors.Wrap(err, "database Get error")
+		entries = append(entries, &database.Entry{Value: b})
 	}
-	return true, nil
+	now := time.Now()
+	for _, e := range entries {
+		var data sshHostPrincipalData
+		if err := json.Unmarshal(e.Value, &data); err != nil {
+			return false, errors.Wrapf(err, "error unmarshaling host principal %s", principal)
+		}
+		if !data.isValid(now) {
+			continue
+		}
+		revoked, err := db.IsSSHRevoked(data.Serial)
+		if err != nil {
+			return false, err
+		}
+		if !revoked {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 type sshHostPrincipalData struct {
@@ -212,11 +771,24 @@ type sshHostPrincipalData struct {
 	Expiry uint64
 }
 
-// StoreSSHCertificate stores an SSH certificate.
+// isValid returns if the certificate has not expired at the given time.
+func (d *sshHostPrincipalData) isValid(now time.Time) bool {
+	return d.Expiry == ssh.CertTimeInfinity || time.Unix(int64(d.Expiry), 0).After(now)
+}
+
+// StoreSSHCertificate stores an SSH certificate. It returns ErrAlreadyExists
+// if a certificate with the same serial number has already been stored.
 func (db *DB) StoreSSHCertificate(crt *ssh.Certificate) error {
 	serial := strconv.FormatUint(crt.Serial, 10)
+	_, swapped, err := db.CmpAndSwap(sshCertsTable, []byte(serial), nil, crt.Marshal())
+	switch {
+	case err != nil:
+		return errors.Wrap(err, "error AuthDB CmpAndSwap")
+	case !swapped:
+		return ErrAlreadyExists
+	}
+
 	tx := new(database.Tx)
-	tx.Set(sshCertsTable, []byte(serial), crt.Marshal())
 	if crt.CertType == ssh.HostCert {
 		for _, p := range crt.ValidPrincipals {
 			hostPrincipalData, err := json.Marshal(sshHostPrincipalData{
@@ -228,12 +800,16 @@ func (db *DB) StoreSSHCertificate(crt *ssh.Certificate) error {
 			}
 			tx.Set(sshHostsTable, []byte(strings.ToLower(p)), []byte(serial))
 			tx.Set(sshHostPrincipalsTable, []byte(strings.ToLower(p)), hostPrincipalData)
+			tx.Set(sshHostsByPrincipalTable, sanIndexKey(strings.ToLower(p), serial), hostPrincipalData)
 		}
 	} else {
 		for _, p := range crt.ValidPrincipals {
 			tx.Set(sshUsersTable, []byte(strings.ToLower(p)), []byte(serial))
 		}
 	}
+	if len(tx.Operations) == 0 {
+		return nil
+	}
 	if err := db.Update(tx); err != nil {
 		return errors.Wrap(err, "database Update error")
 	}
@@ -252,13 +828,118 @@ func (db *DB) GetSSHHostPrincipals() ([]string, error) {
 		if err := json.Unmarshal(e.Value, &data); err != nil {
 			return nil, err
 		}
-		if time.Unix(int64(data.Expiry), 0).After(time.Now()) {
+		if data.isValid(time.Now()) {
 			principals = append(principals, string(e.Key))
 		}
 	}
 	return principals, nil
 }
 
+// GetProvisioners returns the provisioners stored in the database indexed by
+// their id.
+func (db *DB) GetProvisioners() (map[string][]byte, error) {
+	entries, err := db.List(provisionersTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing provisioners")
+	}
+	provisioners := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		provisioners[string(e.Key)] = e.Value
+	}
+	return provisioners, nil
+}
+
+// StoreProvisioner stores the given provisioner data, replacing the previous
+// one if it exists.
+func (db *DB) StoreProvisioner(id string, data []byte) error {
+	if err := db.Set(provisionersTable, []byte(id), data); err != nil {
+		return errors.Wrapf(err, "error storing provisioner %s", id)
+	}
+	return nil
+}
+
+// DeleteProvisioner deletes the provisioner with the given id.
+func (db *DB) DeleteProvisioner(id string) error {
+	if err := db.Del(provisionersTable, []byte(id)); err != nil {
+		return errors.Wrapf(err, "error deleting provisioner %s", id)
+	}
+	return nil
+}
+
+// GetAdmins returns the admins stored in the database indexed by their id.
+func (db *DB) GetAdmins() (map[string][]byte, error) {
+	entries, err := db.List(adminsTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing admins")
+	}
+	admins := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		admins[string(e.Key)] = e.Value
+	}
+	return admins, nil
+}
+
+// StoreAdmin stores the given admin data, replacing the previous one if it
+// exists.
+func (db *DB) StoreAdmin(id string, data []byte) error {
+	if err := db.Set(adminsTable, []byte(id), data); err != nil {
+		return errors.Wrapf(err, "error storing admin %s", id)
+	}
+	return nil
+}
+
+// DeleteAdmin deletes the admin with the given id.
+func (db *DB) DeleteAdmin(id string) error {
+	if err := db.Del(adminsTable, []byte(id)); err != nil {
+		return errors.Wrapf(err, "error deleting admin %s", id)
+	}
+	return nil
+}
+
+// pinger is implemented by the databases that can check the connection to
+// their server, like MySQL and PostgreSQL.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks that the database is reachable, it fails if ctx is done before
+// the database responds. The databases without a server are checked reading
+// a key.
+func (db *DB) Ping(ctx context.Context) error {
+	if !db.isUp {
+		return errors.New("database is closed")
+	}
+	var err error
+	if p, ok := db.DB.(pinger); ok {
+		err = p.Ping(ctx)
+	} else {
+		done := make(chan error, 1)
+		go func() {
+			_, err := db.DB.Get(provisionersTable, []byte("ping"))
+			if nosql.IsErrNotFound(err) {
+				err = nil
+			}
+			done <- err
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "error reaching the database")
+	}
+	return nil
+}
+
+// Persistent returns true if the configuration uses a database that keeps the
+// data after a restart, the CA depends on it to work. The in-memory database
+// used without a configuration is not.
+func (c *Config) Persistent() bool {
+	return c != nil && c.Type != memoryType
+}
+
 // Shutdown sends a shutdown message to the database.
 func (db *DB) Shutdown() error {
 	if db.isUp {
@@ -283,6 +964,13 @@ type MockAuthDB struct {
 	MIsSSHHost            func(principal string) (bool, error)
 	MStoreSSHCertificate  func(crt *ssh.Certificate) error
 	MGetSSHHostPrincipals func() ([]string, error)
+	MGetProvisioners      func() (map[string][]byte, error)
+	MStoreProvisioner     func(id string, data []byte) error
+	MDeleteProvisioner    func(id string) error
+	MGetAdmins            func() (map[string][]byte, error)
+	MStoreAdmin           func(id string, data []byte) error
+	MDeleteAdmin          func(id string) error
+	MPing                 func(ctx context.Context) error
 	MShutdown             func() error
 }
 
@@ -361,6 +1049,65 @@ func (m *MockAuthDB) GetSSHHostPrincipals() ([]string, error) {
 	return m.Ret1.([]string), m.Err
 }
 
+// GetProvisioners mock. The authority calls this method on initialization, so
+// it does not use Ret1 and Err, and it only returns provisioners or an error
+// if MGetProvisioners is set.
+func (m *MockAuthDB) GetProvisioners() (map[string][]byte, error) {
+	if m.MGetProvisioners != nil {
+		return m.MGetProvisioners()
+	}
+	return nil, nil
+}
+
+// StoreProvisioner mock.
+func (m *MockAuthDB) StoreProvisioner(id string, data []byte) error {
+	if m.MStoreProvisioner != nil {
+		return m.MStoreProvisioner(id, data)
+	}
+	return m.Err
+}
+
+// DeleteProvisioner mock.
+func (m *MockAuthDB) DeleteProvisioner(id string) error {
+	if m.MDeleteProvisioner != nil {
+		return m.MDeleteProvisioner(id)
+	}
+	return m.Err
+}
+
+// GetAdmins mock. Like GetProvisioners, it only returns admins or an error
+// if MGetAdmins is set.
+func (m *MockAuthDB) GetAdmins() (map[string][]byte, error) {
+	if m.MGetAdmins != nil {
+		return m.MGetAdmins()
+	}
+	return nil, nil
+}
+
+// StoreAdmin mock.
+func (m *MockAuthDB) StoreAdmin(id string, data []byte) error {
+	if m.MStoreAdmin != nil {
+		return m.MStoreAdmin(id, data)
+	}
+	return m.Err
+}
+
+// DeleteAdmin mock.
+func (m *MockAuthDB) DeleteAdmin(id string) error {
+	if m.MDeleteAdmin != nil {
+		return m.MDeleteAdmin(id)
+	}
+	return m.Err
+}
+
+// Ping mock.
+func (m *MockAuthDB) Ping(ctx context.Context) error {
+	if m.MPing != nil {
+		return m.MPing(ctx)
+	}
+	return m.Err
+}
+
 // Shutdown mock.
 func (m *MockAuthDB) Shutdown() error {
 	if m.MShutdown != nil {
@@ -0,0 +1,396 @@
+// Package dbtest implements a conformance test suite for the nosql databases
+// used by the CA. Every database backend must pass it.
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// Run runs the conformance tests. The open function must return a new empty
+// database; reopen, if not nil, must close the given database and open it
+// again with the same data, it is used to check that the data persists.
+func Run(t *testing.T, open func(t *testing.T) nosql.DB, reopen func(t *testing.T, db nosql.DB) nosql.DB) {
+	tests := map[string]func(t *testing.T, db nosql.DB){
+		"tables":        testTables,
+		"get-set-del":   testGetSetDel,
+		"list":          testList,
+		"iterate":       testIterate,
+		"snapshot":      testSnapshot,
+		"cmp-and-swap":  testCmpAndSwap,
+		"concurrent":    testConcurrentCmpAndSwap,
+		"update":        testUpdate,
+		"update-failed": testUpdateRollback,
+	}
+	for name, fn := range tests {
+		t.Run(name, func(t *testing.T) {
+			db := open(t)
+			defer db.Close()
+			fn(t, db)
+		})
+	}
+	if reopen != nil {
+		t.Run("reopen", func(t *testing.T) {
+			db := open(t)
+			assert.FatalError(t, db.CreateTable([]byte("persist")))
+			assert.FatalError(t, db.Set([]byte("persist"), []byte("key"), []byte("value")))
+			db = reopen(t, db)
+			defer db.Close()
+			v, err := db.Get([]byte("persist"), []byte("key"))
+			assert.FatalError(t, err)
+			assert.Equals(t, []byte("value"), v)
+		})
+	}
+}
+
+func testTables(t *testing.T, db nosql.DB) {
+	bucket := []byte("table")
+	assert.FatalError(t, db.CreateTable(bucket))
+	// Creating an existing table is not an error.
+	assert.FatalError(t, db.CreateTable(bucket))
+
+	entries, err := db.List(bucket)
+	assert.FatalError(t, err)
+	assert.Len(t, 0, entries)
+
+	assert.FatalError(t, db.Set(bucket, []byte("key"), []byte("value")))
+	assert.FatalError(t, db.DeleteTable(bucket))
+	_, err = db.List(bucket)
+	assert.True(t, nosql.IsErrNotFound(err), "List() error = %v, want not found", err)
+	_, err = db.Get(bucket, []byte("key"))
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+
+	err = db.DeleteTable([]byte("missing"))
+	assert.True(t, nosql.IsErrNotFound(err), "DeleteTable() error = %v, want not found", err)
+	_, err = db.List([]byte("missing"))
+	assert.True(t, nosql.IsErrNotFound(err), "List() error = %v, want not found", err)
+}
+
+func testGetSetDel(t *testing.T, db nosql.DB) {
+	bucket := []byte("bucket")
+	assert.FatalError(t, db.CreateTable(bucket))
+
+	_, err := db.Get(bucket, []byte("key"))
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+
+	assert.FatalError(t, db.Set(bucket, []byte("key"), []byte("value")))
+	v, err := db.Get(bucket, []byte("key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+
+	// The returned value is a copy.
+	v[0] = 'x'
+	v, err = db.Get(bucket, []byte("key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+
+	assert.FatalError(t, db.Set(bucket, []byte("key"), []byte("other")))
+	v, err = db.Get(bucket, []byte("key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("other"), v)
+
+	assert.FatalError(t, db.Del(bucket, []byte("key")))
+	_, err = db.Get(bucket, []byte("key"))
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+}
+
+func testList(t *testing.T, db nosql.DB) {
+	// The tables must not see the entries of the tables with the same prefix.
+	tables := [][]byte{[]byte("tab"), []byte("table"), []byte("tables")}
+	for _, b := range tables {
+		assert.FatalError(t, db.CreateTable(b))
+	}
+	for i, b := range tables {
+		for j := 9; j >= 0; j-- {
+			key := []byte(fmt.Sprintf("key-%d", j))
+			assert.FatalError(t, db.Set(b, key, []byte(fmt.Sprintf("%s-%d-%d", b, i, j))))
+		}
+	}
+	assert.FatalError(t, db.Set([]byte("table"), []byte("key"), []byte("the key")))
+
+	for i, b := range tables {
+		entries, err := db.List(b)
+		assert.FatalError(t, err)
+		n := 10
+		if string(b) == "table" {
+			n = 11
+		}
+		assert.Len(t, n, entries)
+		for _, e := range entries {
+			assert.Equals(t, b, e.Bucket)
+			if string(e.Key) == "key" {
+				assert.Equals(t, []byte("the key"), e.Value)
+				continue
+			}
+			var j int
+			_, err := fmt.Sscanf(string(e.Key), "key-%d", &j)
+			assert.FatalError(t, err)
+			assert.Equals(t, []byte(fmt.Sprintf("%s-%d-%d", b, i, j)), e.Value)
+		}
+		// The entries are sorted by key.
+		for k := 1; k < len(entries); k++ {
+			assert.True(t, bytes.Compare(entries[k-1].Key, entries[k].Key) < 0,
+				"List() entries are not sorted: %s >= %s", entries[k-1].Key, entries[k].Key)
+		}
+	}
+}
+
+// iterator is the db.Iterator interface, it is optional.
+type iterator interface {
+	Iterate(bucket []byte, fn func(e *database.Entry) error) error
+}
+
+func testIterate(t *testing.T, db nosql.DB) {
+	it, ok := db.(iterator)
+	if !ok {
+		t.Skip("database does not implement Iterate")
+	}
+	bucket := []byte("bucket")
+	assert.FatalError(t, db.CreateTable(bucket))
+	for i := 0; i < 5; i++ {
+		assert.FatalError(t, db.Set(bucket, []byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	var keys []string
+	assert.FatalError(t, it.Iterate(bucket, func(e *database.Entry) error {
+		assert.Equals(t, bucket, e.Bucket)
+		assert.Equals(t, []byte("value-"+string(e.Key[4:])), e.Value)
+		keys = append(keys, string(e.Key))
+		return nil
+	}))
+	assert.Equals(t, []string{"key-0", "key-1", "key-2", "key-3", "key-4"}, keys)
+
+	// The iteration stops on errors.
+	calls := 0
+	errStop := fmt.Errorf("stop")
+	err := it.Iterate(bucket, func(e *database.Entry) error {
+		calls++
+		return errStop
+	})
+	assert.Equals(t, errStop, err)
+	assert.Equals(t, 1, calls)
+
+	err = it.Iterate([]byte("missing"), func(e *database.Entry) error { return nil })
+	assert.True(t, nosql.IsErrNotFound(err), "Iterate() error = %v, want not found", err)
+}
+
+type snapshotter interface {
+	Snapshot(ctx context.Context, fn func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error) error
+}
+
+func testSnapshot(t *testing.T, db nosql.DB) {
+	s, ok := db.(snapshotter)
+	if !ok {
+		t.Skip("database does not implement Snapshot")
+	}
+	first, second := []byte("first"), []byte("second")
+	assert.FatalError(t, db.CreateTable(first))
+	assert.FatalError(t, db.CreateTable(second))
+	assert.FatalError(t, db.Set(first, []byte("key"), []byte("value")))
+	assert.FatalError(t, db.Set(second, []byte("key"), []byte("value")))
+
+	keys := func(iterate func(bucket []byte, fn func(e *database.Entry) error) error, bucket []byte) []string {
+		var keys []string
+		assert.FatalError(t, iterate(bucket, func(e *database.Entry) error {
+			keys = append(keys, string(e.Key)+"="+string(e.Value))
+			return nil
+		}))
+		return keys
+	}
+
+	done := make(chan error, 1)
+	assert.FatalError(t, s.Snapshot(context.Background(), func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error {
+		assert.Equals(t, []string{"key=value"}, keys(iterate, first))
+
+		// The writes made after the snapshot are not seen by it. Some
+		// databases may delay them until the snapshot is released.
+		go func() {
+			tx := new(database.Tx)
+			tx.Set(second, []byte("key"), []byte("changed"))
+			tx.Set(second, []byte("other"), []byte("value"))
+			done <- db.Update(tx)
+		}()
+		select {
+		case err := <-done:
+			assert.FatalError(t, err)
+			done <- nil
+		case <-time.After(time.Second):
+		}
+		assert.Equals(t, []string{"key=value"}, keys(iterate, second))
+
+		// A missing table does not break the snapshot.
+		err := iterate([]byte("missing"), func(e *database.Entry) error { return nil })
+		assert.True(t, nosql.IsErrNotFound(err), "iterate() error = %v, want not found", err)
+		assert.Equals(t, []string{"key=value"}, keys(iterate, first))
+		return nil
+	}))
+	assert.FatalError(t, <-done)
+	v, err := db.Get(second, []byte("key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("changed"), v)
+
+	// The errors of fn are returned.
+	errStop := fmt.Errorf("stop")
+	assert.Equals(t, errStop, s.Snapshot(context.Background(), func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error {
+		return errStop
+	}))
+}
+
+func testCmpAndSwap(t *testing.T, db nosql.DB) {
+	bucket := []byte("bucket")
+	key := []byte("key")
+	assert.FatalError(t, db.CreateTable(bucket))
+
+	// A nil old value creates the entry if it does not exist.
+	v, swapped, err := db.CmpAndSwap(bucket, key, nil, []byte("first"))
+	assert.FatalError(t, err)
+	assert.True(t, swapped)
+	assert.Equals(t, []byte("first"), v)
+
+	v, swapped, err = db.CmpAndSwap(bucket, key, nil, []byte("second"))
+	assert.FatalError(t, err)
+	assert.False(t, swapped)
+	assert.Equals(t, []byte("first"), v)
+
+	v, swapped, err = db.CmpAndSwap(bucket, key, []byte("wrong"), []byte("second"))
+	assert.FatalError(t, err)
+	assert.False(t, swapped)
+	assert.Equals(t, []byte("first"), v)
+
+	v, swapped, err = db.CmpAndSwap(bucket, key, []byte("first"), []byte("second"))
+	assert.FatalError(t, err)
+	assert.True(t, swapped)
+	assert.Equals(t, []byte("second"), v)
+
+	v, err = db.Get(bucket, key)
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("second"), v)
+}
+
+// testConcurrentCmpAndSwap checks that only one of many concurrent writers
+// can create the same entry, like the used tokens.
+func testConcurrentCmpAndSwap(t *testing.T, db nosql.DB) {
+	bucket := []byte("used_ott")
+	assert.FatalError(t, db.CreateTable(bucket))
+
+	const writers = 20
+	for k := 0; k < 5; k++ {
+		key := []byte(fmt.Sprintf("token-%d", k))
+		var (
+			wg      sync.WaitGroup
+			swaps   int32
+			errorsN int32
+		)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, swapped, err := db.CmpAndSwap(bucket, key, nil, []byte(fmt.Sprintf("writer-%d", i)))
+				if err != nil {
+					atomic.AddInt32(&errorsN, 1)
+					return
+				}
+				if swapped {
+					atomic.AddInt32(&swaps, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.Equals(t, int32(0), errorsN)
+		assert.Equals(t, int32(1), swaps)
+	}
+
+	// Concurrent writes of different keys.
+	var wg sync.WaitGroup
+	errc := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errc <- db.Set(bucket, []byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		assert.FatalError(t, err)
+	}
+	entries, err := db.List(bucket)
+	assert.FatalError(t, err)
+	assert.Len(t, 105, entries)
+}
+
+func testUpdate(t *testing.T, db nosql.DB) {
+	certs, revoked := []byte("certs"), []byte("revoked")
+	assert.FatalError(t, db.CreateTable(certs))
+	assert.FatalError(t, db.CreateTable(revoked))
+	assert.FatalError(t, db.Set(certs, []byte("1"), []byte("cert-1")))
+	assert.FatalError(t, db.Set(certs, []byte("2"), []byte("cert-2")))
+
+	tx := new(database.Tx)
+	tx.Get(certs, []byte("1"))
+	tx.Set(revoked, []byte("1"), []byte("revoked-1"))
+	tx.Del(certs, []byte("2"))
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket:   certs,
+		Key:      []byte("3"),
+		Value:    []byte("cert-3"),
+		Cmd:      database.CmpAndSwap,
+		CmpValue: nil,
+	}, &database.TxEntry{
+		Bucket:   certs,
+		Key:      []byte("1"),
+		Value:    []byte("cert-1-new"),
+		Cmd:      database.CmpAndSwap,
+		CmpValue: []byte("wrong"),
+	})
+	assert.FatalError(t, db.Update(tx))
+
+	assert.Equals(t, []byte("cert-1"), tx.Operations[0].Result)
+	assert.True(t, tx.Operations[3].Swapped)
+	assert.Equals(t, []byte("cert-3"), tx.Operations[3].Result)
+	assert.False(t, tx.Operations[4].Swapped)
+	assert.Equals(t, []byte("cert-1"), tx.Operations[4].Result)
+
+	v, err := db.Get(revoked, []byte("1"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("revoked-1"), v)
+	_, err = db.Get(certs, []byte("2"))
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+	v, err = db.Get(certs, []byte("3"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("cert-3"), v)
+	v, err = db.Get(certs, []byte("1"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("cert-1"), v)
+}
+
+// testUpdateRollback checks that a failed transaction does not apply any
+// change, the ACME nonces rely on it.
+func testUpdateRollback(t *testing.T, db nosql.DB) {
+	bucket := []byte("nonces")
+	assert.FatalError(t, db.CreateTable(bucket))
+	assert.FatalError(t, db.Set(bucket, []byte("used"), []byte("value")))
+
+	tx := new(database.Tx)
+	tx.Set(bucket, []byte("new"), []byte("value"))
+	tx.Del(bucket, []byte("used"))
+	tx.Get(bucket, []byte("missing"))
+	err := db.Update(tx)
+	assert.True(t, nosql.IsErrNotFound(err), "Update() error = %v, want not found", err)
+
+	_, err = db.Get(bucket, []byte("new"))
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+	v, err := db.Get(bucket, []byte("used"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+}
@@ -0,0 +1,426 @@
+package db
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptedPrefix is the prefix of the encrypted values, it is followed by the
+// id of the master key, a '$', the nonce and the AES-GCM ciphertext.
+var encryptedPrefix = []byte("$step-enc-v1$")
+
+// minMasterKeySize is the minimum size of the master keys read from files or
+// environment variables.
+const minMasterKeySize = 32
+
+// defaultEncryptedTables are the tables encrypted by default, they store the
+// encrypted keys of the provisioners, the ACME accounts and the HMAC keys of
+// the ACME external account bindings.
+var defaultEncryptedTables = []string{
+	string(provisionersTable), "acme_accounts", "acme_external_account_keys",
+}
+
+// EncryptionConfig is the configuration of the encryption at rest of the
+// sensitive tables of the database.
+type EncryptionConfig struct {
+	// Keys are the master keys. The first one encrypts the values, the rest
+	// only decrypt the values encrypted before a rotation, and those values
+	// are encrypted with the first key when they are read.
+	Keys []*MasterKeyConfig `json:"keys"`
+	// Tables are the encrypted tables, by default the provisioners, the ACME
+	// accounts and the ACME external account keys.
+	Tables []string `json:"tables,omitempty"`
+}
+
+// MasterKeyConfig is a master key of the database encryption. The key is read
+// from a file, from an environment variable, or derived from the signature of
+// a KMS key. The files and the variables must have at least 32 bytes, e.g. the
+// output of `openssl rand -base64 32`.
+type MasterKeyConfig struct {
+	// ID identifies the key in the encrypted values.
+	ID string `json:"id"`
+	// File is the path of the file with the key.
+	File string `json:"file,omitempty"`
+	// Env is the environment variable with the key.
+	Env string `json:"env,omitempty"`
+	// KMS is the name of a key in the KMS of the CA. The key must produce
+	// deterministic signatures, like RSA PKCS #1 v1.5 or Ed25519 keys.
+	KMS string `json:"kms,omitempty"`
+}
+
+// validate validates the encryption configuration, nil is ok.
+func (c *EncryptionConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Keys) == 0 {
+		return errors.New("db.encryption.keys cannot be empty")
+	}
+	ids := make(map[string]bool)
+	for i, k := range c.Keys {
+		var sources int
+		switch {
+		case k == nil:
+			return errors.Errorf("db.encryption.keys[%d] cannot be empty", i)
+		case k.ID == "":
+			return errors.Errorf("db.encryption.keys[%d].id cannot be empty", i)
+		case strings.Contains(k.ID, "$"):
+			return errors.Errorf("db.encryption.keys[%d].id cannot contain '$'", i)
+		case ids[k.ID]:
+			return errors.Errorf("db.encryption.keys[%d].id %s is duplicated", i, k.ID)
+		}
+		ids[k.ID] = true
+		for _, s := range []string{k.File, k.Env, k.KMS} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return errors.Errorf("db.encryption.keys[%d] must have one of file, env or kms", i)
+		}
+	}
+	for i, t := range c.Tables {
+		if t == "" {
+			return errors.Errorf("db.encryption.tables[%d] cannot be empty", i)
+		}
+	}
+	return nil
+}
+
+// KMSSignerFunc returns the signer of a key in the KMS, it is used to derive
+// the master keys with a KMS reference.
+type KMSSignerFunc func(name string) (crypto.Signer, error)
+
+// Option is the type of the options of New.
+type Option func(o *options)
+
+type options struct {
+	kmsSigner KMSSignerFunc
+}
+
+// WithKMSSigner sets the function used to load the KMS keys of the database
+// encryption.
+func WithKMSSigner(fn KMSSignerFunc) Option {
+	return func(o *options) {
+		o.kmsSigner = fn
+	}
+}
+
+// encrypter encrypts and decrypts the values of the encrypted tables.
+type encrypter struct {
+	current string
+	aeads   map[string]cipher.AEAD
+	tables  map[string]bool
+}
+
+// newEncrypter loads the master keys and derives the data encryption keys.
+func newEncrypter(c *EncryptionConfig, o *options) (*encrypter, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	e := &encrypter{
+		current: c.Keys[0].ID,
+		aeads:   make(map[string]cipher.AEAD),
+		tables:  make(map[string]bool),
+	}
+	for _, k := range c.Keys {
+		secret, err := k.load(o)
+		if err != nil {
+			return nil, err
+		}
+		dek := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("step-ca db encryption "+k.ID)), dek); err != nil {
+			return nil, errors.Wrap(err, "error deriving the data encryption key")
+		}
+		block, err := aes.NewCipher(dek)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating the data encryption cipher")
+		}
+		if e.aeads[k.ID], err = cipher.NewGCM(block); err != nil {
+			return nil, errors.Wrap(err, "error creating the data encryption cipher")
+		}
+	}
+	tables := c.Tables
+	if len(tables) == 0 {
+		tables = defaultEncryptedTables
+	}
+	for _, t := range tables {
+		e.tables[t] = true
+	}
+	return e, nil
+}
+
+// load returns the secret of a master key.
+func (k *MasterKeyConfig) load(o *options) ([]byte, error) {
+	var secret []byte
+	switch {
+	case k.File != "":
+		b, err := ioutil.ReadFile(k.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading db.encryption key %s", k.ID)
+		}
+		secret = bytes.TrimSpace(b)
+	case k.Env != "":
+		secret = []byte(strings.TrimSpace(os.Getenv(k.Env)))
+	default:
+		return k.loadKMS(o)
+	}
+	if len(secret) < minMasterKeySize {
+		return nil, errors.Errorf("db.encryption key %s must have at least %d bytes", k.ID, minMasterKeySize)
+	}
+	return secret, nil
+}
+
+// loadKMS returns the signature of a fixed message with the KMS key, it is
+// only known by the holders of the key. The signature is verified to be
+// deterministic, otherwise the values could not be decrypted after a restart.
+func (k *MasterKeyConfig) loadKMS(o *options) ([]byte, error) {
+	if o.kmsSigner == nil {
+		return nil, errors.Errorf("db.encryption key %s requires a KMS", k.ID)
+	}
+	signer, err := o.kmsSigner(k.KMS)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading db.encryption key %s", k.ID)
+	}
+	msg := []byte("step-ca db encryption " + k.ID)
+	var digest []byte
+	var opts crypto.SignerOpts
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(msg)
+		digest, opts = sum[:], crypto.SHA256
+	case ed25519.PublicKey:
+		digest, opts = msg, crypto.Hash(0)
+	default:
+		return nil, errors.Errorf("db.encryption key %s must be an RSA or Ed25519 key", k.ID)
+	}
+	sig1, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error signing with db.encryption key %s", k.ID)
+	}
+	sig2, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error signing with db.encryption key %s", k.ID)
+	}
+	if !bytes.Equal(sig1, sig2) {
+		return nil, errors.Errorf("db.encryption key %s does not produce deterministic signatures", k.ID)
+	}
+	return sig1, nil
+}
+
+// encrypts returns true if the values of the table are encrypted.
+func (e *encrypter) encrypts(bucket []byte) bool {
+	return e != nil && e.tables[string(bucket)]
+}
+
+// additionalData binds a ciphertext to its table and key.
+func additionalData(bucket, key []byte) []byte {
+	return append(append(append([]byte(nil), bucket...), 0), key...)
+}
+
+// encrypt encrypts a value with the current key. The values already encrypted,
+// e.g. imported from other database, are returned as they are.
+func (e *encrypter) encrypt(bucket, key, value []byte) ([]byte, error) {
+	if value == nil || bytes.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	aead := e.aeads[e.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "error generating nonce")
+	}
+	out := append(append(append(append([]byte(nil), encryptedPrefix...), e.current...), '$'), nonce...)
+	return aead.Seal(out, nonce, value, additionalData(bucket, key)), nil
+}
+
+// decrypt decrypts a value, the values without the encryption prefix are
+// stored in plain text by previous versions. It returns true if the value is
+// not encrypted with the current key.
+func (e *encrypter) decrypt(bucket, key, value []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(value, encryptedPrefix) {
+		return value, true, nil
+	}
+	rest := value[len(encryptedPrefix):]
+	i := bytes.IndexByte(rest, '$')
+	if i < 0 {
+		return nil, false, errors.Errorf("error decrypting %s/%s: malformed value", bucket, key)
+	}
+	id := string(rest[:i])
+	aead, ok := e.aeads[id]
+	if !ok {
+		return nil, false, errors.Errorf("error decrypting %s/%s: unknown key %s", bucket, key, id)
+	}
+	rest = rest[i+1:]
+	if len(rest) < aead.NonceSize() {
+		return nil, false, errors.Errorf("error decrypting %s/%s: malformed value", bucket, key)
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], additionalData(bucket, key))
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "error decrypting %s/%s", bucket, key)
+	}
+	return plain, id != e.current, nil
+}
+
+// open decrypts a stored value and encrypts it again with the current key if
+// it was stored in plain text or encrypted with a previous key. The value is
+// only replaced if it has not changed since it was read.
+func (db *DB) open(bucket, key, raw []byte) ([]byte, error) {
+	plain, stale, err := db.enc.decrypt(bucket, key, raw)
+	if err != nil {
+		return nil, err
+	}
+	if stale {
+		if b, err := db.enc.encrypt(bucket, key, plain); err == nil {
+			// An error does not fail the read, the value is encrypted again
+			// on the next one.
+			db.DB.CmpAndSwap(bucket, key, raw, b) // nolint:errcheck
+		}
+	}
+	return plain, nil
+}
+
+// Get returns the value stored in the given table and key, decrypting it if
+// the table is encrypted.
+func (db *DB) Get(bucket, key []byte) ([]byte, error) {
+	v, err := db.DB.Get(bucket, key)
+	if err != nil || !db.enc.encrypts(bucket) {
+		return v, err
+	}
+	return db.open(bucket, key, v)
+}
+
+// Set stores the value in the given table and key, encrypting it if the table
+// is encrypted.
+func (db *DB) Set(bucket, key, value []byte) error {
+	if db.enc.encrypts(bucket) {
+		var err error
+		if value, err = db.enc.encrypt(bucket, key, value); err != nil {
+			return err
+		}
+	}
+	return db.DB.Set(bucket, key, value)
+}
+
+// List returns the entries of the given table, decrypting them if the table is
+// encrypted.
+func (db *DB) List(bucket []byte) ([]*database.Entry, error) {
+	entries, err := db.DB.List(bucket)
+	if err != nil || !db.enc.encrypts(bucket) {
+		return entries, err
+	}
+	for _, e := range entries {
+		if e.Value, err = db.open(bucket, e.Key, e.Value); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// CmpAndSwap stores newValue in the given table and key if the current value
+// is oldValue. In the encrypted tables the current value is decrypted before
+// comparing it.
+func (db *DB) CmpAndSwap(bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	if !db.enc.encrypts(bucket) {
+		return db.DB.CmpAndSwap(bucket, key, oldValue, newValue)
+	}
+	rawOld, err := db.rawValue(bucket, key, oldValue)
+	if err != nil {
+		return nil, false, err
+	}
+	rawNew, err := db.enc.encrypt(bucket, key, newValue)
+	if err != nil {
+		return nil, false, err
+	}
+	v, swapped, err := db.DB.CmpAndSwap(bucket, key, rawOld, rawNew)
+	if err != nil || swapped {
+		return newValue, swapped, err
+	}
+	if v == nil {
+		return nil, false, nil
+	}
+	plain, _, err := db.enc.decrypt(bucket, key, v)
+	if err != nil {
+		return nil, false, err
+	}
+	return plain, false, nil
+}
+
+// rawValue returns the stored value that decrypts to the given one, or the
+// given value if it does not match the stored value, so a compare and swap
+// fails as expected.
+func (db *DB) rawValue(bucket, key, value []byte) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	raw, err := db.DB.Get(bucket, key)
+	switch {
+	case database.IsErrNotFound(err):
+		return value, nil
+	case err != nil:
+		return nil, err
+	}
+	plain, _, err := db.enc.decrypt(bucket, key, raw)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(plain, value) {
+		return raw, nil
+	}
+	return value, nil
+}
+
+// Update runs a transaction, encrypting the values written to the encrypted
+// tables and decrypting the values read from them.
+func (db *DB) Update(tx *database.Tx) error {
+	if db.enc == nil {
+		return db.DB.Update(tx)
+	}
+	var err error
+	for _, op := range tx.Operations {
+		if !db.enc.encrypts(op.Bucket) {
+			continue
+		}
+		switch op.Cmd {
+		case database.Set:
+			if op.Value, err = db.enc.encrypt(op.Bucket, op.Key, op.Value); err != nil {
+				return err
+			}
+		case database.CmpAndSwap:
+			if op.CmpValue, err = db.rawValue(op.Bucket, op.Key, op.CmpValue); err != nil {
+				return err
+			}
+			if op.Value, err = db.enc.encrypt(op.Bucket, op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+	}
+	if err := db.DB.Update(tx); err != nil {
+		return err
+	}
+	for _, op := range tx.Operations {
+		if !db.enc.encrypts(op.Bucket) || op.Result == nil {
+			continue
+		}
+		switch op.Cmd {
+		case database.Get, database.CmpAndSwap:
+			if op.Result, _, err = db.enc.decrypt(op.Bucket, op.Key, op.Result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
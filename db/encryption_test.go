@@ -0,0 +1,261 @@
+package db
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+const (
+	testMasterKey1 = "rcIA8BpyvfuLQEgUFFJ9w1X5ft6WcdWvG6pD0XlEUXo="
+	testMasterKey2 = "0Lx0IbXgReeNZtV9mo1usnMcjFtuAPBaYbPQa1E4MLs="
+)
+
+func TestEncryptionConfig_validate(t *testing.T) {
+	tests := map[string]struct {
+		config  *EncryptionConfig
+		wantErr bool
+	}{
+		"ok/nil":         {nil, false},
+		"ok":             {&EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "1", Env: "KEY"}}}, false},
+		"ok/rotation":    {&EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "2", File: "key"}, {ID: "1", KMS: "key"}}, Tables: []string{"foo"}}, false},
+		"fail/no-keys":   {&EncryptionConfig{}, true},
+		"fail/nil-key":   {&EncryptionConfig{Keys: []*MasterKeyConfig{nil}}, true},
+		"fail/no-id":     {&EncryptionConfig{Keys: []*MasterKeyConfig{{Env: "KEY"}}}, true},
+		"fail/bad-id":    {&EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "a$b", Env: "KEY"}}}, true},
+		"fail/dup-id":    {&EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "1", Env: "KEY"}, {ID: "1", File: "key"}}}, true},
+		"fail/no-source": {&EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "1"}}}, true},
+		"fail/sources":   {&EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "1", Env: "KEY", File: "key"}}}, true},
+		"fail/table":     {&EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "1", Env: "KEY"}}, Tables: []string{""}}, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tt.config.validate()
+			assert.Equals(t, tt.wantErr, err != nil)
+			err = (&Config{Type: memoryType, Encryption: tt.config}).Validate()
+			assert.Equals(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestNewEncrypter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	assert.FatalError(t, ioutil.WriteFile(keyFile, []byte(testMasterKey1+"\n"), 0600))
+	shortFile := filepath.Join(dir, "short")
+	assert.FatalError(t, ioutil.WriteFile(shortFile, []byte("short"), 0600))
+	os.Setenv("STEP_TEST_DB_KEY", testMasterKey2)
+	defer os.Unsetenv("STEP_TEST_DB_KEY")
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.FatalError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	kmsSigner := func(name string) (crypto.Signer, error) {
+		switch name {
+		case "ed25519":
+			return edKey, nil
+		case "ecdsa":
+			return ecKey, nil
+		default:
+			return nil, errors.New("key not found")
+		}
+	}
+	withKMS := &options{kmsSigner: kmsSigner}
+
+	tests := map[string]struct {
+		key     *MasterKeyConfig
+		opts    *options
+		wantErr bool
+	}{
+		"ok/file":           {&MasterKeyConfig{ID: "1", File: keyFile}, withKMS, false},
+		"ok/env":            {&MasterKeyConfig{ID: "1", Env: "STEP_TEST_DB_KEY"}, withKMS, false},
+		"ok/kms":            {&MasterKeyConfig{ID: "1", KMS: "ed25519"}, withKMS, false},
+		"fail/file":         {&MasterKeyConfig{ID: "1", File: filepath.Join(dir, "missing")}, withKMS, true},
+		"fail/short-file":   {&MasterKeyConfig{ID: "1", File: shortFile}, withKMS, true},
+		"fail/env":          {&MasterKeyConfig{ID: "1", Env: "STEP_TEST_DB_MISSING"}, withKMS, true},
+		"fail/no-kms":       {&MasterKeyConfig{ID: "1", KMS: "ed25519"}, &options{}, true},
+		"fail/kms-missing":  {&MasterKeyConfig{ID: "1", KMS: "missing"}, withKMS, true},
+		"fail/kms-ecdsa":    {&MasterKeyConfig{ID: "1", KMS: "ecdsa"}, withKMS, true},
+		"fail/kms-unstable": {&MasterKeyConfig{ID: "1", KMS: "unstable"}, &options{kmsSigner: func(string) (crypto.Signer, error) { return &randomSigner{edKey}, nil }}, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := newEncrypter(&EncryptionConfig{Keys: []*MasterKeyConfig{tt.key}}, tt.opts)
+			assert.Equals(t, tt.wantErr, err != nil)
+		})
+	}
+
+	// The same key derives the same data encryption key.
+	c := &EncryptionConfig{Keys: []*MasterKeyConfig{{ID: "1", KMS: "ed25519"}}}
+	e1, err := newEncrypter(c, withKMS)
+	assert.FatalError(t, err)
+	e2, err := newEncrypter(c, withKMS)
+	assert.FatalError(t, err)
+	b, err := e1.encrypt(provisionersTable, []byte("foo"), []byte("secret"))
+	assert.FatalError(t, err)
+	v, _, err := e2.decrypt(provisionersTable, []byte("foo"), b)
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("secret"), v)
+}
+
+// randomSigner returns a different signature each time.
+type randomSigner struct {
+	ed25519.PrivateKey
+}
+
+func (s *randomSigner) Sign(rnd io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	b := make([]byte, 64)
+	_, err := rnd.Read(b)
+	return b, err
+}
+
+func newEncryptedDB(t *testing.T, ndb nosql.DB, keys ...string) *DB {
+	t.Helper()
+	c := &EncryptionConfig{}
+	for _, k := range keys {
+		env := "STEP_TEST_DB_KEY_" + k
+		os.Setenv(env, map[string]string{"1": testMasterKey1, "2": testMasterKey2}[k])
+		defer os.Unsetenv(env)
+		c.Keys = append(c.Keys, &MasterKeyConfig{ID: k, Env: env})
+	}
+	enc, err := newEncrypter(c, &options{})
+	assert.FatalError(t, err)
+	adb, err := newDB(ndb)
+	assert.FatalError(t, err)
+	d := adb.(*DB)
+	d.enc = enc
+	return d
+}
+
+// rawGet returns the value stored in the underlying database.
+func rawGet(t *testing.T, d *DB, bucket, key []byte) []byte {
+	t.Helper()
+	v, err := d.DB.Get(bucket, key)
+	assert.FatalError(t, err)
+	return v
+}
+
+func TestDB_encryption(t *testing.T) {
+	mem := memory.New()
+	d := newEncryptedDB(t, mem, "1")
+	secret := []byte(`{"encryptedKey":"secret"}`)
+	key := []byte("foo")
+
+	// Set, Get and List.
+	assert.FatalError(t, d.Set(provisionersTable, key, secret))
+	raw := rawGet(t, d, provisionersTable, key)
+	assert.True(t, bytes.HasPrefix(raw, []byte("$step-enc-v1$1$")))
+	assert.False(t, bytes.Contains(raw, []byte("secret")))
+	v, err := d.Get(provisionersTable, key)
+	assert.FatalError(t, err)
+	assert.Equals(t, secret, v)
+	entries, err := d.List(provisionersTable)
+	assert.FatalError(t, err)
+	assert.Len(t, 1, entries)
+	assert.Equals(t, secret, entries[0].Value)
+
+	// The ciphertext is bound to its key.
+	assert.FatalError(t, mem.Set(provisionersTable, []byte("bar"), raw))
+	_, err = d.Get(provisionersTable, []byte("bar"))
+	assert.Error(t, err)
+	assert.FatalError(t, mem.Del(provisionersTable, []byte("bar")))
+
+	// Other tables are not encrypted.
+	assert.FatalError(t, d.Set(certsTable, key, []byte("cert")))
+	assert.Equals(t, []byte("cert"), rawGet(t, d, certsTable, key))
+
+	// Compare and swap compares the decrypted values.
+	updated := []byte(`{"encryptedKey":"updated"}`)
+	v, swapped, err := d.CmpAndSwap(provisionersTable, key, []byte("other"), updated)
+	assert.FatalError(t, err)
+	assert.False(t, swapped)
+	assert.Equals(t, secret, v)
+	v, swapped, err = d.CmpAndSwap(provisionersTable, key, secret, updated)
+	assert.FatalError(t, err)
+	assert.True(t, swapped)
+	assert.Equals(t, updated, v)
+	assert.False(t, bytes.Contains(rawGet(t, d, provisionersTable, key), []byte("updated")))
+	_, swapped, err = d.CmpAndSwap(provisionersTable, []byte("new"), nil, secret)
+	assert.FatalError(t, err)
+	assert.True(t, swapped)
+	assert.False(t, bytes.Contains(rawGet(t, d, provisionersTable, []byte("new")), []byte("secret")))
+
+	// Transactions.
+	tx := new(database.Tx)
+	tx.Set(provisionersTable, []byte("tx"), secret)
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket: provisionersTable, Key: key, CmpValue: updated, Value: secret, Cmd: database.CmpAndSwap,
+	})
+	tx.Get(provisionersTable, key)
+	assert.FatalError(t, d.Update(tx))
+	assert.True(t, tx.Operations[1].Swapped)
+	assert.Equals(t, secret, tx.Operations[2].Result)
+	assert.False(t, bytes.Contains(rawGet(t, d, provisionersTable, []byte("tx")), []byte("secret")))
+	v, err = d.Get(provisionersTable, key)
+	assert.FatalError(t, err)
+	assert.Equals(t, secret, v)
+
+	// The values stored by previous versions still load and are encrypted
+	// when they are read.
+	assert.FatalError(t, mem.Set(provisionersTable, []byte("legacy"), secret))
+	v, err = d.Get(provisionersTable, []byte("legacy"))
+	assert.FatalError(t, err)
+	assert.Equals(t, secret, v)
+	assert.True(t, bytes.HasPrefix(rawGet(t, d, provisionersTable, []byte("legacy")), []byte("$step-enc-v1$1$")))
+}
+
+func TestDB_encryptionRotation(t *testing.T) {
+	mem := memory.New()
+	old := newEncryptedDB(t, mem, "1")
+	secret := []byte("secret")
+	for _, k := range []string{"a", "b"} {
+		assert.FatalError(t, old.Set(provisionersTable, []byte(k), secret))
+	}
+
+	// The values encrypted with the old key are encrypted with the new one
+	// when they are read.
+	d := newEncryptedDB(t, mem, "2", "1")
+	v, err := d.Get(provisionersTable, []byte("a"))
+	assert.FatalError(t, err)
+	assert.Equals(t, secret, v)
+	assert.True(t, bytes.HasPrefix(rawGet(t, d, provisionersTable, []byte("a")), []byte("$step-enc-v1$2$")))
+	assert.True(t, bytes.HasPrefix(rawGet(t, d, provisionersTable, []byte("b")), []byte("$step-enc-v1$1$")))
+	entries, err := d.List(provisionersTable)
+	assert.FatalError(t, err)
+	assert.Len(t, 2, entries)
+	for _, e := range entries {
+		assert.Equals(t, secret, e.Value)
+	}
+	assert.True(t, bytes.HasPrefix(rawGet(t, d, provisionersTable, []byte("b")), []byte("$step-enc-v1$2$")))
+
+	// The old key is no longer needed.
+	d = newEncryptedDB(t, mem, "2")
+	v, err = d.Get(provisionersTable, []byte("b"))
+	assert.FatalError(t, err)
+	assert.Equals(t, secret, v)
+
+	// Without the key the values cannot be read.
+	assert.FatalError(t, old.Set(provisionersTable, []byte("c"), secret))
+	_, err = d.Get(provisionersTable, []byte("c"))
+	assert.Error(t, err)
+	_, err = d.List(provisionersTable)
+	assert.Error(t, err)
+}
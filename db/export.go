@@ -0,0 +1,315 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// ExportFormat is the format of the exported databases.
+const ExportFormat = "step-ca-db"
+
+// ExportVersion is the version of the export format.
+const ExportVersion = 1
+
+// defaultImportBatchSize is the default number of entries written on each
+// transaction of an import.
+const defaultImportBatchSize = 100
+
+var (
+	tablesMutex      sync.RWMutex
+	registeredTables [][]byte
+)
+
+// RegisterTables registers the tables created by other packages, like the
+// ACME ones, so they are exported with the authority tables. The tables
+// already registered are ignored.
+func RegisterTables(tables ...[]byte) {
+	tablesMutex.Lock()
+	defer tablesMutex.Unlock()
+	for _, t := range tables {
+		if !containsTable(authorityTables, t) && !containsTable(registeredTables, t) {
+			registeredTables = append(registeredTables, t)
+		}
+	}
+}
+
+func containsTable(tables [][]byte, t []byte) bool {
+	for _, tt := range tables {
+		if bytes.Equal(tt, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tables returns the authority tables and the registered ones.
+func Tables() [][]byte {
+	tablesMutex.RLock()
+	defer tablesMutex.RUnlock()
+	tables := append([][]byte(nil), authorityTables...)
+	return append(tables, registeredTables...)
+}
+
+// Iterator is implemented by the databases that can read the entries of a
+// table one by one, without loading all of them in memory. The entries are
+// sorted by key, and the iteration stops if fn returns an error.
+type Iterator interface {
+	Iterate(bucket []byte, fn func(e *database.Entry) error) error
+}
+
+// Exporter is implemented by the databases that can be exported, see Export.
+type Exporter interface {
+	Export(w io.Writer, opts *ExportOptions) error
+}
+
+// Progress is the state of an export or an import, it is sent to the
+// progress callbacks after each table and every batch of entries.
+type Progress struct {
+	// Table is the table being processed.
+	Table string
+	// Entries is the number of entries processed in the table.
+	Entries int
+	// Total is the number of entries processed in all the tables.
+	Total int
+}
+
+// ExportOptions are the options of Export, the zero value is ok.
+type ExportOptions struct {
+	// Tables are the tables to export, all the known tables by default. The
+	// tables that do not exist are skipped.
+	Tables [][]byte
+	// Progress is called with the state of the export.
+	Progress func(Progress)
+}
+
+// ImportOptions are the options of Import, the zero value is ok.
+type ImportOptions struct {
+	// DryRun validates the records without writing them.
+	DryRun bool
+	// BatchSize is the number of entries written on each transaction, 100 by
+	// default.
+	BatchSize int
+	// Progress is called with the state of the import.
+	Progress func(Progress)
+}
+
+// exportHeader is the first record of an export.
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// exportRecord is a table or an entry of an export. Table records do not have
+// a key, they create the empty tables on imports.
+type exportRecord struct {
+	Bucket string `json:"bucket"`
+	Key    []byte `json:"key,omitempty"`
+	Value  []byte `json:"value,omitempty"`
+}
+
+// Export writes all the entries of the tables in the given database to w. The
+// export is a JSON Lines stream with a header followed by a record for each
+// table and entry; the keys and values are base64 encoded. The tables are
+// streamed if the database implements Iterator.
+func Export(w io.Writer, db nosql.DB, opts *ExportOptions) error {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	tables := opts.Tables
+	if tables == nil {
+		tables = Tables()
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(exportHeader{Format: ExportFormat, Version: ExportVersion}); err != nil {
+		return errors.Wrap(err, "error writing export")
+	}
+
+	var p Progress
+	for _, bucket := range tables {
+		p.Table, p.Entries = string(bucket), 0
+		written := false
+		fn := func(e *database.Entry) error {
+			if !written {
+				if err := enc.Encode(exportRecord{Bucket: p.Table}); err != nil {
+					return errors.Wrap(err, "error writing export")
+				}
+				written = true
+			}
+			if e == nil {
+				return nil
+			}
+			if err := enc.Encode(exportRecord{Bucket: p.Table, Key: e.Key, Value: nonNilBytes(e.Value)}); err != nil {
+				return errors.Wrap(err, "error writing export")
+			}
+			p.Entries++
+			p.Total++
+			if opts.Progress != nil && p.Entries%defaultImportBatchSize == 0 {
+				opts.Progress(p)
+			}
+			return nil
+		}
+		err := iterate(db, bucket, fn)
+		switch {
+		case database.IsErrNotFound(err):
+			continue
+		case err != nil:
+			return errors.Wrapf(err, "error exporting table %s", bucket)
+		}
+		// Empty tables are exported too.
+		if err := fn(nil); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+	return errors.Wrap(bw.Flush(), "error writing export")
+}
+
+// iterate calls fn with the entries of a table, it uses List if the database
+// does not implement Iterator.
+func iterate(db nosql.DB, bucket []byte, fn func(e *database.Entry) error) error {
+	if it, ok := db.(Iterator); ok {
+		return it.Iterate(bucket, fn)
+	}
+	entries, err := db.List(bucket)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads an export created by Export and writes the tables and entries
+// in the given database, existing entries with the same key are overwritten.
+// The records are read one by one and written in batches. On dry runs the
+// records are validated but not written.
+func Import(r io.Reader, db nosql.DB, opts *ImportOptions) error {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	dec := json.NewDecoder(r)
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil {
+		return errors.Wrap(err, "error reading import header")
+	}
+	if header.Format != ExportFormat {
+		return errors.Errorf("error reading import: format %q is not supported", header.Format)
+	}
+	if header.Version != ExportVersion {
+		return errors.Errorf("error reading import: version %d is not supported", header.Version)
+	}
+
+	var (
+		p      Progress
+		tx     = new(database.Tx)
+		tables = make(map[string]bool)
+	)
+	flush := func() error {
+		if len(tx.Operations) > 0 && !opts.DryRun {
+			if err := db.Update(tx); err != nil {
+				return errors.Wrapf(err, "error importing table %s", p.Table)
+			}
+		}
+		tx = new(database.Tx)
+		return nil
+	}
+	done := func() {
+		if opts.Progress != nil && p.Table != "" {
+			opts.Progress(p)
+		}
+	}
+
+	for line := 2; ; line++ {
+		var rec exportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error reading import record %d", line)
+		}
+		if rec.Bucket == "" {
+			return errors.Errorf("error reading import record %d: bucket is required", line)
+		}
+
+		// A table record starts a new table.
+		if rec.Key == nil {
+			if tables[rec.Bucket] {
+				return errors.Errorf("error reading import record %d: table %s is repeated", line, rec.Bucket)
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			done()
+			tables[rec.Bucket] = true
+			p.Table, p.Entries = rec.Bucket, 0
+			if !opts.DryRun {
+				if err := db.CreateTable([]byte(rec.Bucket)); err != nil {
+					return errors.Wrapf(err, "error creating table %s", rec.Bucket)
+				}
+			}
+			continue
+		}
+		if rec.Bucket != p.Table {
+			return errors.Errorf("error reading import record %d: entry of table %s is not after its table record", line, rec.Bucket)
+		}
+		if len(rec.Key) == 0 {
+			return errors.Errorf("error reading import record %d: key is required", line)
+		}
+
+		tx.Set([]byte(rec.Bucket), rec.Key, nonNilBytes(rec.Value))
+		p.Entries++
+		p.Total++
+		if len(tx.Operations) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			if opts.Progress != nil {
+				opts.Progress(p)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	done()
+	return nil
+}
+
+// Export writes all the entries in the database to w, see Export.
+func (db *DB) Export(w io.Writer, opts *ExportOptions) error {
+	return Export(w, db.DB, opts)
+}
+
+// Import writes the entries exported with Export in the database, see Import.
+func (db *DB) Import(r io.Reader, opts *ImportOptions) error {
+	return Import(r, db.DB, opts)
+}
+
+// nonNilBytes returns an empty slice instead of nil, the values are always
+// exported and imported with a value.
+func nonNilBytes(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/bolt"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// testEntries are entries with binary and empty values.
+var testEntries = []*database.Entry{
+	{Bucket: certsTable, Key: []byte("1"), Value: []byte{0, 1, 2, 0xff, '\n', '"'}},
+	{Bucket: certsTable, Key: []byte("2"), Value: []byte{}},
+	{Bucket: revokedCertsTable, Key: []byte{0xfe, 0}, Value: []byte(`{"Serial":"1"}`)},
+	{Bucket: []byte("acme_accounts"), Key: []byte("account"), Value: []byte("value")},
+}
+
+func newBoltDB(t *testing.T, dir string) nosql.DB {
+	db := &bolt.DB{}
+	assert.FatalError(t, db.Open(filepath.Join(dir, "bbolt.db")))
+	return db
+}
+
+func newMemoryDB(t *testing.T, dir string) nosql.DB {
+	return memory.New()
+}
+
+func fillDB(t *testing.T, db nosql.DB) {
+	for _, e := range testEntries {
+		assert.FatalError(t, db.CreateTable(e.Bucket))
+		assert.FatalError(t, db.Set(e.Bucket, e.Key, e.Value))
+	}
+	// An empty table.
+	assert.FatalError(t, db.CreateTable(sshHostsTable))
+}
+
+func listAll(t *testing.T, db nosql.DB, tables [][]byte) []*database.Entry {
+	var entries []*database.Entry
+	for _, b := range tables {
+		l, err := db.List(b)
+		assert.FatalError(t, err)
+		entries = append(entries, l...)
+	}
+	return entries
+}
+
+func TestExport_roundTrip(t *testing.T) {
+	tables := [][]byte{certsTable, revokedCertsTable, sshHostsTable, []byte("acme_accounts")}
+	tests := map[string]struct {
+		src, dst func(t *testing.T, dir string) nosql.DB
+	}{
+		"bolt to memory": {newBoltDB, newMemoryDB},
+		"memory to bolt": {newMemoryDB, newBoltDB},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "export")
+			assert.FatalError(t, err)
+			defer os.RemoveAll(dir)
+			src, dst := tc.src(t, dir), tc.dst(t, dir)
+			defer src.Close()
+			defer dst.Close()
+			fillDB(t, src)
+
+			var (
+				buf      bytes.Buffer
+				progress []Progress
+			)
+			assert.FatalError(t, Export(&buf, src, &ExportOptions{
+				// Missing tables are skipped.
+				Tables:   append(tables, []byte("missing")),
+				Progress: func(p Progress) { progress = append(progress, p) },
+			}))
+			assert.Equals(t, []Progress{
+				{Table: "x509_certs", Entries: 2, Total: 2},
+				{Table: "revoked_x509_certs", Entries: 1, Total: 3},
+				{Table: "ssh_hosts", Entries: 0, Total: 3},
+				{Table: "acme_accounts", Entries: 1, Total: 4},
+			}, progress)
+
+			progress = nil
+			assert.FatalError(t, Import(bytes.NewReader(buf.Bytes()), dst, &ImportOptions{
+				BatchSize: 1,
+				Progress:  func(p Progress) { progress = append(progress, p) },
+			}))
+			assert.Equals(t, Progress{Table: "acme_accounts", Entries: 1, Total: 4}, progress[len(progress)-1])
+			assert.Equals(t, testEntries, listAll(t, dst, tables))
+
+			// Importing again overwrites the entries.
+			assert.FatalError(t, Import(bytes.NewReader(buf.Bytes()), dst, nil))
+			assert.Equals(t, testEntries, listAll(t, dst, tables))
+		})
+	}
+}
+
+func TestImport_dryRun(t *testing.T) {
+	src := memory.New()
+	fillDB(t, src)
+	var buf bytes.Buffer
+	assert.FatalError(t, Export(&buf, src, &ExportOptions{
+		Tables: [][]byte{certsTable, revokedCertsTable, []byte("acme_accounts")},
+	}))
+
+	dst := memory.New()
+	var last Progress
+	assert.FatalError(t, Import(&buf, dst, &ImportOptions{
+		DryRun:   true,
+		Progress: func(p Progress) { last = p },
+	}))
+	assert.Equals(t, len(testEntries), last.Total)
+	// Nothing is written.
+	_, err := dst.List(certsTable)
+	assert.True(t, nosql.IsErrNotFound(err), "List() error = %v, want not found", err)
+}
+
+func TestImport_invalid(t *testing.T) {
+	header := `{"format":"step-ca-db","version":1}` + "\n"
+	tests := map[string]string{
+		"empty":          "",
+		"format":         `{"format":"other","version":1}`,
+		"version":        `{"format":"step-ca-db","version":2}`,
+		"json":           header + `{"bucket":`,
+		"bucket":         header + `{"key":"YQ==","value":"YQ=="}`,
+		"entry first":    header + `{"bucket":"x509_certs","key":"YQ==","value":"YQ=="}`,
+		"empty key":      header + `{"bucket":"x509_certs"}` + "\n" + `{"bucket":"x509_certs","key":"","value":"YQ=="}`,
+		"other table":    header + `{"bucket":"x509_certs"}` + "\n" + `{"bucket":"used_ott","key":"YQ==","value":"YQ=="}`,
+		"repeated table": header + `{"bucket":"x509_certs"}` + "\n" + `{"bucket":"x509_certs"}`,
+		"base64":         header + `{"bucket":"x509_certs"}` + "\n" + `{"bucket":"x509_certs","key":"!","value":"YQ=="}`,
+	}
+	for name, in := range tests {
+		t.Run(name, func(t *testing.T) {
+			db := memory.New()
+			// Dry runs validate the records.
+			assert.Error(t, Import(strings.NewReader(in), db, &ImportOptions{DryRun: true}))
+			assert.Error(t, Import(strings.NewReader(in), db, nil))
+		})
+	}
+}
+
+// iteratorDB is a database that fails if the entries are listed, it checks
+// that the tables are streamed.
+type iteratorDB struct {
+	*memory.DB
+}
+
+func (db *iteratorDB) List(bucket []byte) ([]*database.Entry, error) {
+	panic("List should not be called")
+}
+
+func (db *iteratorDB) Iterate(bucket []byte, fn func(e *database.Entry) error) error {
+	entries, err := db.DB.List(bucket)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errWriter fails after n bytes.
+type errWriter struct {
+	n int
+}
+
+func (w *errWriter) Write(b []byte) (int, error) {
+	if w.n -= len(b); w.n < 0 {
+		return 0, io.ErrShortWrite
+	}
+	return len(b), nil
+}
+
+func TestExport(t *testing.T) {
+	src := &iteratorDB{memory.New()}
+	fillDB(t, src)
+
+	var buf bytes.Buffer
+	assert.FatalError(t, Export(&buf, src, nil))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equals(t, `{"format":"step-ca-db","version":1}`, lines[0])
+	assert.Equals(t, `{"bucket":"revoked_x509_certs"}`, lines[1])
+
+	dst := &DB{DB: memory.New()}
+	assert.FatalError(t, dst.Import(&buf, nil))
+	entries := listAll(t, dst, [][]byte{certsTable, revokedCertsTable})
+	assert.Equals(t, testEntries[:3], entries)
+
+	// The acme tables are exported after registering them.
+	buf.Reset()
+	RegisterTables([]byte("acme_accounts"), certsTable)
+	RegisterTables([]byte("acme_accounts"))
+	assert.Equals(t, len(authorityTables)+1, len(Tables()))
+	assert.FatalError(t, (&DB{DB: src}).Export(&buf, nil))
+	assert.True(t, strings.Contains(buf.String(), `{"bucket":"acme_accounts"}`))
+
+	// Write errors are returned.
+	assert.FatalError(t, Export(&errWriter{n: 100}, memory.New(), nil))
+	assert.Error(t, Export(&errWriter{n: 100}, src, nil))
+}
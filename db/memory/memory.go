@@ -0,0 +1,294 @@
+// Package memory implements the nosql database interface in memory.
+//
+// The data is lost when the process exits, it is meant for tests and for
+// ephemeral CAs that do not need to persist the certificates, revocations or
+// used tokens. All the operations are serialized by a single lock, reads can
+// run concurrently.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+// DB is a nosql database stored in memory. The zero value is an empty
+// database ready to use, Open is not required.
+type DB struct {
+	mu     sync.RWMutex
+	tables map[string]map[string][]byte
+}
+
+// New returns an empty in-memory database.
+func New() *DB {
+	return &DB{}
+}
+
+// Open does nothing, the data source and options are ignored.
+func (db *DB) Open(dataSourceName string, opt ...database.Option) error {
+	return nil
+}
+
+// Close does nothing, the data is kept until the database is discarded.
+func (db *DB) Close() error {
+	return nil
+}
+
+// CreateTable creates a table if it does not exist.
+func (db *DB) CreateTable(bucket []byte) error {
+	db.mu.Lock()
+	db.createTable(bucket)
+	db.mu.Unlock()
+	return nil
+}
+
+// DeleteTable deletes a table. It returns a not found error if the table does
+// not exist.
+func (db *DB) DeleteTable(bucket []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err := db.deleteTable(bucket)
+	return err
+}
+
+// Get returns a copy of the value stored in the given table and key.
+func (db *DB) Get(bucket, key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.get(bucket, key)
+}
+
+// Set stores a copy of the given value on the given table and key.
+func (db *DB) Set(bucket, key, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err := db.set(bucket, key, value)
+	return err
+}
+
+// Del deletes the value stored in the given table and key.
+func (db *DB) Del(bucket, key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err := db.del(bucket, key)
+	return err
+}
+
+// List returns the entries of a table sorted by key.
+func (db *DB) List(bucket []byte) ([]*database.Entry, error) {
+	return db.ListPrefix(bucket, nil)
+}
+
+// ListPrefix returns the entries of a table with keys starting with the given
+// prefix sorted by key.
+func (db *DB) ListPrefix(bucket, prefix []byte) ([]*database.Entry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	t, err := db.table(bucket)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	entries := make([]*database.Entry, len(keys))
+	for i, k := range keys {
+		entries[i] = &database.Entry{
+			Bucket: cloneBytes(bucket),
+			Key:    []byte(k),
+			Value:  cloneBytes(t[k]),
+		}
+	}
+	return entries, nil
+}
+
+// Snapshot calls fn with a function that iterates the tables of a copy of the
+// database. The writes are only blocked while the tables are copied, the
+// values are never modified in place.
+func (db *DB) Snapshot(ctx context.Context, fn func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error) error {
+	db.mu.RLock()
+	snapshot := &DB{tables: make(map[string]map[string][]byte, len(db.tables))}
+	for name, t := range db.tables {
+		tt := make(map[string][]byte, len(t))
+		for k, v := range t {
+			tt[k] = v
+		}
+		snapshot.tables[name] = tt
+	}
+	db.mu.RUnlock()
+
+	return fn(func(bucket []byte, fn func(e *database.Entry) error) error {
+		entries, err := snapshot.List(bucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CmpAndSwap modifies the value at the given table and key (to newValue) only
+// if the existing (current) value matches oldValue.
+func (db *DB) CmpAndSwap(bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	val, swapped, _, err := db.cmpAndSwap(bucket, key, oldValue, newValue)
+	return val, swapped, err
+}
+
+// Update performs multiple commands on one transaction. If a command fails
+// the previous ones are undone, and none of the changes are applied.
+func (db *DB) Update(tx *database.Tx) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var undo []func()
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	for _, q := range tx.Operations {
+		var (
+			fn  func()
+			err error
+		)
+		switch q.Cmd {
+		case database.CreateTable:
+			fn = db.createTable(q.Bucket)
+		case database.DeleteTable:
+			fn, err = db.deleteTable(q.Bucket)
+		case database.Get:
+			q.Result, err = db.get(q.Bucket, q.Key)
+		case database.Set:
+			fn, err = db.set(q.Bucket, q.Key, q.Value)
+		case database.Delete:
+			fn, err = db.del(q.Bucket, q.Key)
+		case database.CmpAndSwap:
+			q.Result, q.Swapped, fn, err = db.cmpAndSwap(q.Bucket, q.Key, q.CmpValue, q.Value)
+		default:
+			err = database.ErrOpNotSupported
+		}
+		if err != nil {
+			rollback()
+			return err
+		}
+		if fn != nil {
+			undo = append(undo, fn)
+		}
+	}
+	return nil
+}
+
+// The following methods must be called holding the lock, the write methods
+// return a function that undoes the change, or nil if there is no change.
+
+func (db *DB) table(bucket []byte) (map[string][]byte, error) {
+	t, ok := db.tables[string(bucket)]
+	if !ok {
+		return nil, errors.Wrapf(database.ErrNotFound, "table %s not found", bucket)
+	}
+	return t, nil
+}
+
+func (db *DB) createTable(bucket []byte) func() {
+	if db.tables == nil {
+		db.tables = make(map[string]map[string][]byte)
+	}
+	name := string(bucket)
+	if _, ok := db.tables[name]; ok {
+		return nil
+	}
+	db.tables[name] = make(map[string][]byte)
+	return func() { delete(db.tables, name) }
+}
+
+func (db *DB) deleteTable(bucket []byte) (func(), error) {
+	t, err := db.table(bucket)
+	if err != nil {
+		return nil, err
+	}
+	name := string(bucket)
+	delete(db.tables, name)
+	return func() { db.tables[name] = t }, nil
+}
+
+func (db *DB) get(bucket, key []byte) ([]byte, error) {
+	t, err := db.table(bucket)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := t[string(key)]
+	if !ok {
+		return nil, errors.Wrapf(database.ErrNotFound, "%s/%s not found", bucket, key)
+	}
+	return cloneBytes(v), nil
+}
+
+func (db *DB) set(bucket, key, value []byte) (func(), error) {
+	t, err := db.table(bucket)
+	if err != nil {
+		return nil, err
+	}
+	k := string(key)
+	old, existed := t[k]
+	t[k] = cloneBytes(value)
+	return func() {
+		if existed {
+			t[k] = old
+		} else {
+			delete(t, k)
+		}
+	}, nil
+}
+
+func (db *DB) del(bucket, key []byte) (func(), error) {
+	t, err := db.table(bucket)
+	if err != nil {
+		return nil, err
+	}
+	k := string(key)
+	old, existed := t[k]
+	if !existed {
+		return nil, nil
+	}
+	delete(t, k)
+	return func() { t[k] = old }, nil
+}
+
+func (db *DB) cmpAndSwap(bucket, key, oldValue, newValue []byte) ([]byte, bool, func(), error) {
+	t, err := db.table(bucket)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	current, found := t[string(key)]
+	switch {
+	case !found && oldValue != nil:
+		return nil, false, nil, nil
+	case found && (oldValue == nil || !bytes.Equal(current, oldValue)):
+		return cloneBytes(current), false, nil, nil
+	}
+	fn, err := db.set(bucket, key, newValue)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	return cloneBytes(newValue), true, fn, nil
+}
+
+// cloneBytes returns a copy of the given slice, it returns an empty slice
+// instead of nil so the stored values are never nil.
+func cloneBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/dbtest"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+func TestDB(t *testing.T) {
+	// The data does not persist, the reopen test does not apply.
+	dbtest.Run(t, func(t *testing.T) nosql.DB {
+		return New()
+	}, nil)
+}
+
+func TestDB_copies(t *testing.T) {
+	db := New()
+	bucket := []byte("bucket")
+	assert.FatalError(t, db.CreateTable(bucket))
+
+	// The stored values do not share memory with the callers.
+	value := []byte("value")
+	assert.FatalError(t, db.Set(bucket, []byte("key"), value))
+	value[0] = 'V'
+	v, err := db.Get(bucket, []byte("key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+	v[0] = 'V'
+	entries, err := db.List(bucket)
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), entries[0].Value)
+
+	// A nil value is stored as an empty one.
+	assert.FatalError(t, db.Set(bucket, []byte("nil"), nil))
+	v, err = db.Get(bucket, []byte("nil"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte{}, v)
+}
+
+func TestDB_ListPrefix(t *testing.T) {
+	db := New()
+	bucket := []byte("bucket")
+	assert.FatalError(t, db.CreateTable(bucket))
+	for _, k := range []string{"b/2", "a/1", "b/1", "c", "b"} {
+		assert.FatalError(t, db.Set(bucket, []byte(k), []byte(k)))
+	}
+	entries, err := db.ListPrefix(bucket, []byte("b/"))
+	assert.FatalError(t, err)
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, string(e.Key))
+	}
+	assert.Equals(t, []string{"b/1", "b/2"}, keys)
+
+	_, err = db.ListPrefix([]byte("missing"), nil)
+	assert.True(t, nosql.IsErrNotFound(err), "ListPrefix() error = %v, want not found", err)
+}
+
+func TestDB_Update_rollbackTables(t *testing.T) {
+	db := New()
+	assert.FatalError(t, db.CreateTable([]byte("old")))
+	assert.FatalError(t, db.Set([]byte("old"), []byte("key"), []byte("value")))
+
+	tx := new(database.Tx)
+	tx.CreateTable([]byte("new"))
+	tx.Set([]byte("new"), []byte("key"), []byte("value"))
+	tx.DeleteTable([]byte("old"))
+	tx.Get([]byte("missing"), []byte("key"))
+	assert.Error(t, db.Update(tx))
+
+	_, err := db.List([]byte("new"))
+	assert.True(t, nosql.IsErrNotFound(err), "List() error = %v, want not found", err)
+	v, err := db.Get([]byte("old"), []byte("key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+}
@@ -0,0 +1,578 @@
+// Package mysql implements the nosql database interface over MySQL.
+//
+// Each table is a MySQL table with the columns nkey, the primary key, and
+// nvalue. The layout is the one used by github.com/smallstep/nosql/mysql, so
+// the databases created by it can be opened with this package, the schema
+// migrations in this package upgrade them.
+//
+// The schema version is stored in the step_ca_schema table. When a database
+// is opened, the pending migrations are applied holding a named lock, so
+// multiple CAs can be started at the same time against the same database.
+//
+// CmpAndSwap and Update lock the rows they read until the transaction
+// finishes. The transactions that fail because of a deadlock or a lock wait
+// timeout are retried.
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+const (
+	// DefaultDeadlockRetries is the default number of times a transaction is
+	// retried if it fails because of a deadlock.
+	DefaultDeadlockRetries = 5
+	// deadlockRetryBackoff is the time added to the wait of each retry of a
+	// transaction.
+	deadlockRetryBackoff = 10 * time.Millisecond
+	// schemaTable is the table with the applied migrations.
+	schemaTable = "step_ca_schema"
+	// schemaLock is the name of the lock held while the migrations are
+	// applied.
+	schemaLock = "step_ca_schema"
+	// schemaLockTimeout is the time in seconds to wait for the migration lock.
+	schemaLockTimeout = 60
+)
+
+// MySQL error numbers.
+const (
+	errDupEntry        = 1062
+	errBadTable        = 1051
+	errNoSuchTable     = 1146
+	errLockWaitTimeout = 1205
+	errLockDeadlock    = 1213
+)
+
+// tlsConfigID is used to generate unique names for the registered TLS
+// configurations.
+var tlsConfigID uint64
+
+// Options are the MySQL specific options of the database, the zero value uses
+// the defaults of database/sql.
+type Options struct {
+	// MaxOpenConns is the maximum number of open connections, unlimited by
+	// default.
+	MaxOpenConns int
+	// MaxIdleConns is the maximum number of idle connections, 2 by default.
+	MaxIdleConns int
+	// ConnMaxLifetime is the maximum time a connection is reused, unlimited
+	// by default.
+	ConnMaxLifetime time.Duration
+	// DeadlockRetries is the number of times a transaction is retried if it
+	// fails because of a deadlock, 5 by default.
+	DeadlockRetries int
+	// TLSConfig is the TLS configuration used to connect to the server. If
+	// it is nil the tls parameter of the data source is used.
+	TLSConfig *tls.Config
+}
+
+// DB is a nosql database over *sql.DB. The Options must be set before calling
+// Open.
+type DB struct {
+	Options Options
+
+	mu       sync.RWMutex
+	db       *sql.DB
+	database string
+	tlsName  string
+}
+
+// Open connects to the MySQL server with the given data source, creates the
+// database if it does not exist and applies the schema migrations. The name
+// of the database is the one in the Database option, or the one in the data
+// source.
+func (db *DB) Open(dataSourceName string, opt ...database.Option) error {
+	opts := &database.Options{}
+	for _, o := range opt {
+		if err := o(opts); err != nil {
+			return err
+		}
+	}
+	db.database = opts.Database
+
+	sqlDB, tlsName, err := db.connect(dataSourceName, db.Options.TLSConfig)
+	if err != nil {
+		return err
+	}
+	if err := migrate(sqlDB); err != nil {
+		sqlDB.Close()
+		mysql.DeregisterTLSConfig(tlsName)
+		return err
+	}
+	db.db, db.tlsName = sqlDB, tlsName
+	return nil
+}
+
+// Reload connects to the server with the given data source and TLS
+// configuration, and replaces the existing connections with the new ones. It
+// is used to rotate the credentials without restarting the CA. The queries in
+// progress finish with the previous connections.
+func (db *DB) Reload(dataSourceName string, tlsConfig *tls.Config) error {
+	sqlDB, tlsName, err := db.connect(dataSourceName, tlsConfig)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	oldDB, oldTLSName := db.db, db.tlsName
+	db.db, db.tlsName = sqlDB, tlsName
+	db.Options.TLSConfig = tlsConfig
+	db.mu.Unlock()
+
+	err = oldDB.Close()
+	mysql.DeregisterTLSConfig(oldTLSName)
+	return errors.Wrap(err, "error closing previous mysql connections")
+}
+
+// connect creates the database if necessary and returns a connection pool to
+// it, and the name of the registered TLS configuration.
+func (db *DB) connect(dataSourceName string, tlsConfig *tls.Config) (_ *sql.DB, tlsName string, err error) {
+	cfg, err := mysql.ParseDSN(dataSourceName)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error parsing mysql data source")
+	}
+	name := db.database
+	if name == "" {
+		name = cfg.DBName
+	}
+	if name == "" {
+		return nil, "", errors.New("error connecting to mysql: the database name is required")
+	}
+	if tlsConfig != nil {
+		tlsName = fmt.Sprintf("step-ca-%d", atomic.AddUint64(&tlsConfigID, 1))
+		if err := mysql.RegisterTLSConfig(tlsName, tlsConfig); err != nil {
+			return nil, "", errors.Wrap(err, "error registering mysql tls configuration")
+		}
+		cfg.TLSConfig = tlsName
+		defer func() {
+			if err != nil {
+				mysql.DeregisterTLSConfig(tlsName)
+			}
+		}()
+	}
+
+	// Create the database using a connection without it.
+	cfg.DBName = ""
+	sqlDB, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error connecting to mysql")
+	}
+	_, err = sqlDB.Exec("CREATE DATABASE IF NOT EXISTS " + quote([]byte(name)))
+	sqlDB.Close()
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "error creating database %s", name)
+	}
+
+	cfg.DBName = name
+	if sqlDB, err = sql.Open("mysql", cfg.FormatDSN()); err != nil {
+		return nil, "", errors.Wrap(err, "error connecting to mysql database")
+	}
+	sqlDB.SetMaxOpenConns(db.Options.MaxOpenConns)
+	if db.Options.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(db.Options.MaxIdleConns)
+	}
+	sqlDB.SetConnMaxLifetime(db.Options.ConnMaxLifetime)
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, "", errors.Wrap(err, "error connecting to mysql database")
+	}
+	return sqlDB, tlsName, nil
+}
+
+// Close closes the connections to the database.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := db.db.Close()
+	mysql.DeregisterTLSConfig(db.tlsName)
+	return errors.Wrap(err, "error closing mysql database")
+}
+
+// conn returns the current connection pool.
+func (db *DB) conn() *sql.DB {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.db
+}
+
+// Ping checks the connection to the MySQL server.
+func (db *DB) Ping(ctx context.Context) error {
+	return errors.Wrap(db.conn().PingContext(ctx), "failed to ping mysql")
+}
+
+// CreateTable creates a table if it does not exist.
+func (db *DB) CreateTable(bucket []byte) error {
+	_, err := db.conn().Exec(createTableQry(bucket))
+	return errors.Wrapf(err, "failed to create table %s", bucket)
+}
+
+// DeleteTable deletes a table. It returns a not found error if the table does
+// not exist.
+func (db *DB) DeleteTable(bucket []byte) error {
+	_, err := db.conn().Exec("DROP TABLE " + quote(bucket))
+	if errorNumber(err) == errBadTable {
+		return errors.Wrapf(database.ErrNotFound, "table %s not found", bucket)
+	}
+	return errors.Wrapf(err, "failed to delete table %s", bucket)
+}
+
+// Get returns the value stored in the given table and key.
+func (db *DB) Get(bucket, key []byte) ([]byte, error) {
+	return get(db.conn(), bucket, key, false)
+}
+
+// Set stores the given value on the given table and key.
+func (db *DB) Set(bucket, key, value []byte) error {
+	return set(db.conn(), bucket, key, value)
+}
+
+// Del deletes the value stored in the given table and key.
+func (db *DB) Del(bucket, key []byte) error {
+	return del(db.conn(), bucket, key)
+}
+
+// List returns the entries of a table sorted by key.
+func (db *DB) List(bucket []byte) ([]*database.Entry, error) {
+	var entries []*database.Entry
+	err := db.Iterate(bucket, func(e *database.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Iterate calls fn with the entries of a table sorted by key, reading the rows
+// one by one. The iteration stops if fn returns an error.
+func (db *DB) Iterate(bucket []byte, fn func(e *database.Entry) error) error {
+	return iterate(context.Background(), db.conn(), bucket, fn)
+}
+
+// Snapshot calls fn with a function that iterates the tables in a read-only
+// repeatable read transaction, all the tables are read from the snapshot of
+// the first read. The writes are not blocked by it.
+func (db *DB) Snapshot(ctx context.Context, fn func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error) error {
+	tx, err := db.conn().BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "failed to begin mysql transaction")
+	}
+	defer tx.Rollback()
+	return fn(func(bucket []byte, fn func(e *database.Entry) error) error {
+		return iterate(ctx, tx, bucket, fn)
+	})
+}
+
+// rowsQuerier is the common interface of *sql.DB and *sql.Tx used to read
+// multiple rows.
+type rowsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func iterate(ctx context.Context, q rowsQuerier, bucket []byte, fn func(e *database.Entry) error) error {
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT nkey, nvalue FROM %s ORDER BY nkey", quote(bucket)))
+	if err != nil {
+		return tableError(err, bucket, "failed to list table %s", bucket)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return errors.Wrapf(err, "failed to list table %s", bucket)
+		}
+		if err := fn(&database.Entry{
+			Bucket: bucket,
+			Key:    key,
+			Value:  value,
+		}); err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(rows.Err(), "failed to list table %s", bucket)
+}
+
+// CmpAndSwap modifies the value at the given table and key (to newValue) only
+// if the existing (current) value matches oldValue.
+func (db *DB) CmpAndSwap(bucket, key, oldValue, newValue []byte) (val []byte, swapped bool, err error) {
+	err = db.transaction(func(tx *sql.Tx) error {
+		val, swapped, err = cmpAndSwap(tx, bucket, key, oldValue, newValue)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, swapped, nil
+}
+
+// Update performs multiple commands on one transaction. If a command fails
+// none of the changes are applied. The creation and deletion of tables are
+// not part of the transaction, MySQL commits them immediately.
+func (db *DB) Update(tx *database.Tx) error {
+	return db.transaction(func(sqlTx *sql.Tx) (err error) {
+		for _, q := range tx.Operations {
+			switch q.Cmd {
+			case database.CreateTable:
+				if _, err = sqlTx.Exec(createTableQry(q.Bucket)); err != nil {
+					return errors.Wrapf(err, "failed to create table %s", q.Bucket)
+				}
+			case database.DeleteTable:
+				if _, err = sqlTx.Exec("DROP TABLE " + quote(q.Bucket)); err != nil {
+					if errorNumber(err) == errBadTable {
+						return errors.Wrapf(database.ErrNotFound, "table %s not found", q.Bucket)
+					}
+					return errors.Wrapf(err, "failed to delete table %s", q.Bucket)
+				}
+			case database.Get:
+				if q.Result, err = get(sqlTx, q.Bucket, q.Key, true); err != nil {
+					return err
+				}
+			case database.Set:
+				if err = set(sqlTx, q.Bucket, q.Key, q.Value); err != nil {
+					return err
+				}
+			case database.Delete:
+				if err = del(sqlTx, q.Bucket, q.Key); err != nil {
+					return err
+				}
+			case database.CmpAndSwap:
+				if q.Result, q.Swapped, err = cmpAndSwap(sqlTx, q.Bucket, q.Key, q.CmpValue, q.Value); err != nil {
+					return err
+				}
+			default:
+				return database.ErrOpNotSupported
+			}
+		}
+		return nil
+	})
+}
+
+// transaction runs fn in a transaction, it is retried if it fails because of
+// a deadlock, a lock wait timeout or a concurrent insert of the same key.
+func (db *DB) transaction(fn func(tx *sql.Tx) error) error {
+	retries := db.Options.DeadlockRetries
+	if retries <= 0 {
+		retries = DefaultDeadlockRetries
+	}
+	for i := 0; ; i++ {
+		err := runTransaction(db.conn(), fn)
+		switch errorNumber(err) {
+		case errLockDeadlock, errLockWaitTimeout, errDupEntry:
+			if i < retries {
+				time.Sleep(time.Duration(i+1) * deadlockRetryBackoff)
+				continue
+			}
+			return errors.Wrap(err, "failed to commit mysql transaction")
+		default:
+			return err
+		}
+	}
+}
+
+func runTransaction(sqlDB *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin mysql transaction")
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit mysql transaction")
+}
+
+// querier is the common interface of *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// get returns the value of the given key, if lock is true the row is locked
+// until the end of the transaction.
+func get(q querier, bucket, key []byte, lock bool) ([]byte, error) {
+	qry := fmt.Sprintf("SELECT nvalue FROM %s WHERE nkey = ?", quote(bucket))
+	if lock {
+		qry += " FOR UPDATE"
+	}
+	var val []byte
+	err := q.QueryRow(qry, key).Scan(&val)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errors.Wrapf(database.ErrNotFound, "%s/%s not found", bucket, key)
+	case err != nil:
+		return nil, tableError(err, bucket, "failed to get %s/%s", bucket, key)
+	case val == nil:
+		return []byte{}, nil
+	default:
+		return val, nil
+	}
+}
+
+func set(q querier, bucket, key, value []byte) error {
+	qry := fmt.Sprintf("INSERT INTO %s (nkey, nvalue) VALUES (?, ?) ON DUPLICATE KEY UPDATE nvalue = VALUES(nvalue)", quote(bucket))
+	if _, err := q.Exec(qry, key, nonNil(value)); err != nil {
+		return tableError(err, bucket, "failed to set %s/%s", bucket, key)
+	}
+	return nil
+}
+
+func del(q querier, bucket, key []byte) error {
+	if _, err := q.Exec(fmt.Sprintf("DELETE FROM %s WHERE nkey = ?", quote(bucket)), key); err != nil {
+		return tableError(err, bucket, "failed to delete %s/%s", bucket, key)
+	}
+	return nil
+}
+
+func cmpAndSwap(q querier, bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	current, err := get(q, bucket, key, true)
+	found := err == nil
+	if err != nil && !database.IsErrNotFound(err) {
+		return nil, false, err
+	}
+	// A nil oldValue only matches a key that does not exist.
+	if found != (oldValue != nil) || !bytes.Equal(current, oldValue) {
+		return current, false, nil
+	}
+	if found {
+		_, err = q.Exec(fmt.Sprintf("UPDATE %s SET nvalue = ? WHERE nkey = ?", quote(bucket)), nonNil(newValue), key)
+	} else {
+		_, err = q.Exec(fmt.Sprintf("INSERT INTO %s (nkey, nvalue) VALUES (?, ?)", quote(bucket)), key, nonNil(newValue))
+	}
+	if err != nil {
+		return nil, false, tableError(err, bucket, "failed to set %s/%s", bucket, key)
+	}
+	return newValue, true, nil
+}
+
+// migration is a change in the schema of the database.
+type migration struct {
+	version     int
+	description string
+	migrate     func(ctx context.Context, conn *sql.Conn) error
+}
+
+// migrations is the list of schema migrations, sorted by version. The
+// migrations cannot be modified once released, a change requires a new one.
+var migrations = []migration{
+	{1, "store the values of the existing tables as LONGBLOB", migrateLongBlobValues},
+}
+
+// migrate applies the pending migrations.
+func migrate(sqlDB *sql.DB) error {
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error migrating mysql database")
+	}
+	defer conn.Close()
+
+	// The lock belongs to the connection, all the migration must use it.
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", schemaLock, schemaLockTimeout).Scan(&locked); err != nil {
+		return errors.Wrap(err, "error acquiring mysql migration lock")
+	}
+	if locked.Int64 != 1 {
+		return errors.New("error acquiring mysql migration lock: timeout")
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", schemaLock)
+
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+schemaTable+
+		" (version INT NOT NULL, description VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (version))"); err != nil {
+		return errors.Wrap(err, "error creating mysql schema table")
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+schemaTable).Scan(&current); err != nil {
+		return errors.Wrap(err, "error reading mysql schema version")
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return errors.Errorf("mysql schema version %d is newer than the supported version %d", current, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.migrate(ctx, conn); err != nil {
+			return errors.Wrapf(err, "error applying mysql schema migration %d", m.version)
+		}
+		if _, err := conn.ExecContext(ctx, "INSERT INTO "+schemaTable+" (version, description) VALUES (?, ?)", m.version, m.description); err != nil {
+			return errors.Wrapf(err, "error applying mysql schema migration %d", m.version)
+		}
+	}
+	return nil
+}
+
+// migrateLongBlobValues changes the type of the values of the tables created
+// by previous versions, BLOB, that cannot store more than 64KB.
+func migrateLongBlobValues(ctx context.Context, conn *sql.Conn) error {
+	rows, err := conn.QueryContext(ctx, "SELECT table_name FROM information_schema.columns "+
+		"WHERE table_schema = DATABASE() AND column_name = 'nvalue' AND data_type = 'blob'")
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range tables {
+		if _, err := conn.ExecContext(ctx, "ALTER TABLE "+quote([]byte(name))+" MODIFY nvalue LONGBLOB"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createTableQry(bucket []byte) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (nkey VARBINARY(255) NOT NULL, nvalue LONGBLOB, PRIMARY KEY (nkey))", quote(bucket))
+}
+
+// quote returns the given identifier quoted with backticks.
+func quote(name []byte) string {
+	return "`" + strings.Replace(string(name), "`", "``", -1) + "`"
+}
+
+// nonNil returns an empty slice instead of nil, nil values are stored as
+// NULL.
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+// errorNumber returns the number of a MySQL error, or 0 if it is not one.
+func errorNumber(err error) uint16 {
+	if e, ok := errors.Cause(err).(*mysql.MySQLError); ok {
+		return e.Number
+	}
+	return 0
+}
+
+// tableError returns a not found error if the given error is caused by a
+// missing table, or wraps the error if not.
+func tableError(err error, bucket []byte, format string, args ...interface{}) error {
+	if errorNumber(err) == errNoSuchTable {
+		return errors.Wrapf(database.ErrNotFound, "table %s not found", bucket)
+	}
+	return errors.Wrapf(err, format, args...)
+}
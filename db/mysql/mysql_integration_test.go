@@ -0,0 +1,118 @@
+//go:build mysql
+// +build mysql
+
+package mysql
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/dbtest"
+	"github.com/smallstep/nosql"
+	nosqlmysql "github.com/smallstep/nosql/mysql"
+)
+
+// testDataSource returns the data source of the MySQL server used by the
+// tests in this file, they run with:
+//
+//	STEP_TEST_MYSQL_DSN="root:password@tcp(127.0.0.1:3306)/" go test -tags=mysql ./db/mysql
+//
+// or with `make test-mysql`, that starts the server in docker.
+func testDataSource(t *testing.T) string {
+	dsn := os.Getenv("STEP_TEST_MYSQL_DSN")
+	if dsn == "" {
+		dsn = "root:password@tcp(127.0.0.1:3306)/"
+	}
+	return dsn
+}
+
+func testDatabase() string {
+	return fmt.Sprintf("step_ca_test_%d", time.Now().UnixNano())
+}
+
+func dropDatabase(t *testing.T, db *DB) {
+	_, err := db.conn().Exec("DROP DATABASE " + quote([]byte(db.database)))
+	assert.FatalError(t, err)
+}
+
+func TestDB_integration(t *testing.T) {
+	dsn := testDataSource(t)
+	open := func(t *testing.T) nosql.DB {
+		db := &DB{Options: Options{MaxOpenConns: 16, DeadlockRetries: 20}}
+		assert.FatalError(t, db.Open(dsn, nosql.WithDatabase(testDatabase())))
+		return &dropOnClose{t: t, DB: db}
+	}
+	reopen := func(t *testing.T, db nosql.DB) nosql.DB {
+		mdb := db.(*dropOnClose).DB
+		assert.FatalError(t, mdb.Close())
+		reopened := &DB{}
+		assert.FatalError(t, reopened.Open(dsn, nosql.WithDatabase(mdb.database)))
+		return &dropOnClose{t: t, DB: reopened}
+	}
+	dbtest.Run(t, open, reopen)
+}
+
+// dropOnClose drops the test database when it is closed.
+type dropOnClose struct {
+	t *testing.T
+	*DB
+}
+
+func (d *dropOnClose) Close() error {
+	dropDatabase(d.t, d.DB)
+	return d.DB.Close()
+}
+
+func TestDB_Reload_integration(t *testing.T) {
+	dsn := testDataSource(t)
+	db := &DB{}
+	assert.FatalError(t, db.Open(dsn, nosql.WithDatabase(testDatabase())))
+	defer db.Close()
+	defer dropDatabase(t, db)
+
+	assert.FatalError(t, db.CreateTable([]byte("bucket")))
+	assert.FatalError(t, db.Set([]byte("bucket"), []byte("key"), []byte("value")))
+	old := db.conn()
+	assert.FatalError(t, db.Reload(dsn, nil))
+	assert.NotEquals(t, old, db.conn())
+	assert.Error(t, old.Ping())
+
+	v, err := db.Get([]byte("bucket"), []byte("key"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("value"), v)
+	assert.Error(t, db.Reload("user:wrong@tcp(127.0.0.1:1)/", nil))
+}
+
+// TestDB_migration_integration checks that the databases created by the
+// nosql mysql implementation are upgraded.
+func TestDB_migration_integration(t *testing.T) {
+	dsn := testDataSource(t)
+	name := testDatabase()
+	old := new(nosqlmysql.DB)
+	assert.FatalError(t, old.Open(dsn, nosql.WithDatabase(name)))
+	assert.FatalError(t, old.CreateTable([]byte("x509_certs")))
+	assert.FatalError(t, old.Set([]byte("x509_certs"), []byte("1"), []byte("cert")))
+	assert.FatalError(t, old.Close())
+
+	db := &DB{}
+	assert.FatalError(t, db.Open(dsn, nosql.WithDatabase(name)))
+	defer db.Close()
+	defer dropDatabase(t, db)
+
+	var dataType string
+	assert.FatalError(t, db.conn().QueryRow("SELECT data_type FROM information_schema.columns "+
+		"WHERE table_schema = DATABASE() AND table_name = 'x509_certs' AND column_name = 'nvalue'").Scan(&dataType))
+	assert.Equals(t, "longblob", dataType)
+	var version int
+	assert.FatalError(t, db.conn().QueryRow("SELECT MAX(version) FROM "+schemaTable).Scan(&version))
+	assert.Equals(t, migrations[len(migrations)-1].version, version)
+
+	big := make([]byte, 1<<17)
+	assert.FatalError(t, db.Set([]byte("x509_certs"), []byte("2"), big))
+	v, err := db.Get([]byte("x509_certs"), []byte("1"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []byte("cert"), v)
+}
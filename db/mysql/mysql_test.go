@@ -0,0 +1,301 @@
+package mysql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// fakeDriver is a database/sql driver that sends the queries to the handler
+// registered with the data source name. It is used to test the errors of the
+// server without a MySQL server.
+type fakeDriver struct {
+	mu       sync.Mutex
+	handlers map[string]*fakeHandler
+}
+
+type fakeHandler struct {
+	mu        sync.Mutex
+	queries   []string
+	commits   int
+	rollbacks int
+	fn        func(query string, args []driver.Value) (*fakeRows, error)
+}
+
+func (h *fakeHandler) handle(query string, args []driver.Value) (*fakeRows, error) {
+	h.mu.Lock()
+	h.queries = append(h.queries, query)
+	h.mu.Unlock()
+	return h.fn(query, args)
+}
+
+var fake = &fakeDriver{handlers: make(map[string]*fakeHandler)}
+
+func init() {
+	sql.Register("mysqlfake", fake)
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return &fakeConn{d.handlers[name]}, nil
+}
+
+// newFakeDB returns a database that uses the given handler.
+func newFakeDB(t *testing.T, fn func(query string, args []driver.Value) (*fakeRows, error)) (*DB, *fakeHandler) {
+	h := &fakeHandler{fn: fn}
+	fake.mu.Lock()
+	fake.handlers[t.Name()] = h
+	fake.mu.Unlock()
+	sqlDB, err := sql.Open("mysqlfake", t.Name())
+	assert.FatalError(t, err)
+	return &DB{db: sqlDB}, h
+}
+
+type fakeConn struct {
+	h *fakeHandler
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.h, query}, nil
+}
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return &fakeTx{c.h}, nil
+}
+
+type fakeTx struct {
+	h *fakeHandler
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.h.mu.Lock()
+	tx.h.commits++
+	tx.h.mu.Unlock()
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.h.mu.Lock()
+	tx.h.rollbacks++
+	tx.h.mu.Unlock()
+	return nil
+}
+
+type fakeStmt struct {
+	h     *fakeHandler
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.h.handle(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.h.handle(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		rows = &fakeRows{}
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func newRows(columns string, values ...[]driver.Value) *fakeRows {
+	return &fakeRows{columns: strings.Split(columns, ","), values: values}
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func mysqlError(n uint16) error {
+	return &mysql.MySQLError{Number: n, Message: fmt.Sprintf("error %d", n)}
+}
+
+func TestDB_CmpAndSwap_retry(t *testing.T) {
+	attempts := 0
+	db, h := newFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT nvalue FROM `used_ott` WHERE nkey = ? FOR UPDATE"):
+			attempts++
+			switch attempts {
+			case 1:
+				return nil, mysqlError(errLockDeadlock)
+			case 2:
+				return newRows("nvalue"), nil
+			default:
+				return newRows("nvalue", []driver.Value{[]byte("other")}), nil
+			}
+		case strings.HasPrefix(query, "INSERT INTO `used_ott` (nkey, nvalue) VALUES (?, ?)"):
+			// Other CA inserted the key.
+			return nil, mysqlError(errDupEntry)
+		default:
+			return nil, fmt.Errorf("unexpected query %s", query)
+		}
+	})
+	val, swapped, err := db.CmpAndSwap([]byte("used_ott"), []byte("token"), nil, []byte("value"))
+	assert.FatalError(t, err)
+	assert.False(t, swapped)
+	assert.Equals(t, []byte("other"), val)
+	assert.Equals(t, 3, attempts)
+	assert.Equals(t, 2, h.rollbacks)
+	assert.Equals(t, 1, h.commits)
+}
+
+func TestDB_Update_retriesExhausted(t *testing.T) {
+	db, h := newFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		return nil, mysqlError(errLockWaitTimeout)
+	})
+	db.Options.DeadlockRetries = 2
+	tx := new(database.Tx)
+	tx.Del([]byte("nonces"), []byte("nonce"))
+	err := db.Update(tx)
+	assert.Error(t, err)
+	assert.Equals(t, uint16(errLockWaitTimeout), errorNumber(err))
+	assert.Equals(t, 3, h.rollbacks)
+	assert.Equals(t, 0, h.commits)
+}
+
+func TestDB_Update_noRetry(t *testing.T) {
+	db, h := newFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		return nil, mysqlError(1064)
+	})
+	tx := new(database.Tx)
+	tx.Set([]byte("x509_certs"), []byte("1"), []byte("cert"))
+	assert.Error(t, db.Update(tx))
+	assert.Len(t, 1, h.queries)
+	assert.Equals(t, 1, h.rollbacks)
+}
+
+func TestDB_missingTable(t *testing.T) {
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.HasPrefix(query, "DROP TABLE") {
+			return nil, mysqlError(errBadTable)
+		}
+		return nil, mysqlError(errNoSuchTable)
+	})
+	bucket, key := []byte("missing"), []byte("key")
+
+	_, err := db.Get(bucket, key)
+	assert.True(t, nosql.IsErrNotFound(err), "Get() error = %v, want not found", err)
+	err = db.Set(bucket, key, []byte("value"))
+	assert.True(t, nosql.IsErrNotFound(err), "Set() error = %v, want not found", err)
+	err = db.Del(bucket, key)
+	assert.True(t, nosql.IsErrNotFound(err), "Del() error = %v, want not found", err)
+	_, err = db.List(bucket)
+	assert.True(t, nosql.IsErrNotFound(err), "List() error = %v, want not found", err)
+	_, _, err = db.CmpAndSwap(bucket, key, nil, []byte("value"))
+	assert.True(t, nosql.IsErrNotFound(err), "CmpAndSwap() error = %v, want not found", err)
+	err = db.DeleteTable(bucket)
+	assert.True(t, nosql.IsErrNotFound(err), "DeleteTable() error = %v, want not found", err)
+}
+
+func TestDB_List(t *testing.T) {
+	db, h := newFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		return newRows("nkey,nvalue",
+			[]driver.Value{[]byte("a"), []byte("1")},
+			[]driver.Value{[]byte("b"), nil},
+		), nil
+	})
+	entries, err := db.List([]byte("we`ird"))
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"SELECT nkey, nvalue FROM `we``ird` ORDER BY nkey"}, h.queries)
+	assert.Equals(t, []*database.Entry{
+		{Bucket: []byte("we`ird"), Key: []byte("a"), Value: []byte("1")},
+		{Bucket: []byte("we`ird"), Key: []byte("b")},
+	}, entries)
+}
+
+func Test_migrate(t *testing.T) {
+	type test struct {
+		version int
+		locked  int64
+		wantErr bool
+		want    []string
+	}
+	tests := map[string]test{
+		"ok new": {
+			version: 0, locked: 1,
+			want: []string{
+				"SELECT GET_LOCK(?, ?)",
+				"CREATE TABLE IF NOT EXISTS step_ca_schema",
+				"SELECT COALESCE(MAX(version), 0) FROM step_ca_schema",
+				"SELECT table_name FROM information_schema.columns",
+				"ALTER TABLE `x509_certs` MODIFY nvalue LONGBLOB",
+				"INSERT INTO step_ca_schema (version, description) VALUES (?, ?)",
+				"SELECT RELEASE_LOCK(?)",
+			},
+		},
+		"ok up to date": {
+			version: 1, locked: 1,
+			want: []string{
+				"SELECT GET_LOCK(?, ?)",
+				"CREATE TABLE IF NOT EXISTS step_ca_schema",
+				"SELECT COALESCE(MAX(version), 0) FROM step_ca_schema",
+				"SELECT RELEASE_LOCK(?)",
+			},
+		},
+		"fail newer version": {version: 2, locked: 1, wantErr: true},
+		"fail lock timeout":  {locked: 0, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, h := newFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+				switch {
+				case strings.HasPrefix(query, "SELECT GET_LOCK"):
+					return newRows("locked", []driver.Value{tc.locked}), nil
+				case strings.HasPrefix(query, "SELECT COALESCE"):
+					return newRows("version", []driver.Value{int64(tc.version)}), nil
+				case strings.HasPrefix(query, "SELECT table_name"):
+					return newRows("table_name", []driver.Value{[]byte("x509_certs")}), nil
+				default:
+					return nil, nil
+				}
+			})
+			err := migrate(db.db)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("migrate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.want != nil {
+				assert.Len(t, len(tc.want), h.queries)
+				for i, q := range tc.want {
+					assert.HasPrefix(t, h.queries[i], q)
+				}
+			}
+		})
+	}
+}
+
+func TestDB_Open(t *testing.T) {
+	db := new(DB)
+	assert.Error(t, db.Open("user:password@tcp(localhost:3306"))
+	// The database name is required.
+	assert.Error(t, db.Open("user:password@tcp(localhost:3306)/"))
+}
@@ -0,0 +1,766 @@
+// Package postgresql implements the nosql database interface over
+// PostgreSQL using pgx.
+//
+// Each table is a PostgreSQL table with the columns nkey, a bytea primary
+// key, and nvalue. The entries are listed with range queries on the primary
+// key, so the listings by prefix use the index. The schema version is stored
+// in the step_ca_schema table, the pending migrations are applied when the
+// database is opened holding an advisory lock.
+//
+// Set, Del and CmpAndSwap are single statements, the compare-and-swap
+// operations use upserts and conditional updates, so only one of multiple
+// CAs using the same database can create a key. Update runs in a transaction
+// that locks the rows it reads, it is retried if it fails because of a
+// deadlock or a serialization failure.
+//
+// If the Notify option is set, the writes send a notification with the name
+// of the table, and the changes made by other CAs can be received with
+// Watch. They are used to invalidate the data loaded in memory.
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/crypto/randutil"
+	"github.com/smallstep/nosql/database"
+)
+
+const (
+	// DefaultRetries is the default number of times a transaction is retried
+	// if it fails because of a deadlock or a serialization failure.
+	DefaultRetries = 5
+	// NotifyChannel is the channel used to notify the changes.
+	NotifyChannel = "step_ca_changes"
+	// retryBackoff is the time added to the wait of each retry of a
+	// transaction.
+	retryBackoff = 10 * time.Millisecond
+	// listenBackoff is the time to wait before connecting again if the
+	// connection that receives the notifications fails.
+	listenBackoff = 5 * time.Second
+	// schemaTable is the table with the applied migrations.
+	schemaTable = "step_ca_schema"
+	// schemaLock is the key of the advisory lock held while the migrations
+	// are applied.
+	schemaLock = 0x73746570 // "step"
+)
+
+// PostgreSQL error codes.
+const (
+	errUndefinedTable       = "42P01"
+	errDuplicateDatabase    = "42P04"
+	errUniqueViolation      = "23505"
+	errSerializationFailure = "40001"
+	errDeadlockDetected     = "40P01"
+)
+
+// Options are the PostgreSQL specific options of the database, the zero value
+// uses the defaults of pgx.
+type Options struct {
+	// MaxConns is the maximum number of connections, the greater of 4 and the
+	// number of CPUs by default.
+	MaxConns int32
+	// MinConns is the minimum number of connections kept open.
+	MinConns int32
+	// MaxConnLifetime is the maximum time a connection is reused, 1h by
+	// default.
+	MaxConnLifetime time.Duration
+	// StatementTimeout is the maximum time a statement can run, unlimited by
+	// default.
+	StatementTimeout time.Duration
+	// Retries is the number of times a transaction is retried if it fails
+	// because of a deadlock or a serialization failure, 5 by default.
+	Retries int
+	// TLSConfig is the TLS configuration used to connect to the server. If it
+	// is nil the sslmode parameters of the data source are used.
+	TLSConfig *tls.Config
+	// Notify enables the notifications of the changes to other CAs.
+	Notify bool
+}
+
+// DB is a nosql database over *pgxpool.Pool. The Options must be set before
+// calling Open.
+type DB struct {
+	Options Options
+
+	mu       sync.RWMutex
+	pool     *pgxpool.Pool
+	database string
+	id       string
+	cancel   context.CancelFunc
+	done     sync.WaitGroup
+	watchers map[int]func(bucket []byte)
+	nextID   int
+}
+
+// Open connects to the PostgreSQL server with the given data source, creates
+// the database if it does not exist and applies the schema migrations. The
+// name of the database is the one in the Database option, or the one in the
+// data source.
+func (db *DB) Open(dataSourceName string, opt ...database.Option) (err error) {
+	opts := &database.Options{}
+	for _, o := range opt {
+		if err := o(opts); err != nil {
+			return err
+		}
+	}
+	db.database = opts.Database
+	if db.id, err = randutil.Alphanumeric(16); err != nil {
+		return errors.Wrap(err, "error generating postgresql instance id")
+	}
+
+	pool, err := db.connect(dataSourceName, db.Options.TLSConfig)
+	if err != nil {
+		return err
+	}
+	if err := migrate(pool); err != nil {
+		pool.Close()
+		return err
+	}
+	db.pool = pool
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db.cancel = cancel
+	if db.Options.Notify {
+		db.done.Add(1)
+		go db.listen(ctx)
+	}
+	return nil
+}
+
+// Reload connects to the server with the given data source and TLS
+// configuration, and replaces the existing connections with the new ones. It
+// is used to rotate the credentials without restarting the CA.
+func (db *DB) Reload(dataSourceName string, tlsConfig *tls.Config) error {
+	pool, err := db.connect(dataSourceName, tlsConfig)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	old := db.pool
+	db.pool = pool
+	db.Options.TLSConfig = tlsConfig
+	db.mu.Unlock()
+	old.Close()
+	return nil
+}
+
+// poolConfig returns the pgx configuration for the given data source.
+func (db *DB) poolConfig(dataSourceName string, tlsConfig *tls.Config) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(dataSourceName)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing postgresql data source")
+	}
+	if db.database != "" {
+		config.ConnConfig.Database = db.database
+	}
+	if config.ConnConfig.Database == "" {
+		return nil, errors.New("error connecting to postgresql: the database name is required")
+	}
+	if db.Options.MaxConns > 0 {
+		config.MaxConns = db.Options.MaxConns
+	}
+	if db.Options.MinConns > 0 {
+		config.MinConns = db.Options.MinConns
+	}
+	if db.Options.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = db.Options.MaxConnLifetime
+	}
+	if db.Options.StatementTimeout > 0 {
+		config.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(db.Options.StatementTimeout.Milliseconds(), 10)
+	}
+	if tlsConfig != nil {
+		config.ConnConfig.TLSConfig = tlsConfig
+		config.ConnConfig.Fallbacks = nil
+	}
+	return config, nil
+}
+
+// connect creates the database if necessary and returns a connection pool to
+// it.
+func (db *DB) connect(dataSourceName string, tlsConfig *tls.Config) (*pgxpool.Pool, error) {
+	config, err := db.poolConfig(dataSourceName, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if err := createDatabase(ctx, config); err != nil {
+		return nil, err
+	}
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to postgresql database")
+	}
+	return pool, nil
+}
+
+// createDatabase creates the database in the configuration if it does not
+// exist, using a connection to the postgres database.
+func createDatabase(ctx context.Context, config *pgxpool.Config) error {
+	name := config.ConnConfig.Database
+	cc := config.ConnConfig.Copy()
+	cc.Database = "postgres"
+	conn, err := pgx.ConnectConfig(ctx, cc)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to postgresql")
+	}
+	defer conn.Close(ctx)
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists); err != nil {
+		return errors.Wrapf(err, "error checking database %s", name)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := conn.Exec(ctx, "CREATE DATABASE "+quote([]byte(name))); err != nil && errorCode(err) != errDuplicateDatabase {
+		return errors.Wrapf(err, "error creating database %s", name)
+	}
+	return nil
+}
+
+// Close stops the notifications and closes the connections to the database.
+func (db *DB) Close() error {
+	db.cancel()
+	db.done.Wait()
+	db.mu.Lock()
+	db.pool.Close()
+	db.mu.Unlock()
+	return nil
+}
+
+// conn returns the current connection pool.
+func (db *DB) conn() *pgxpool.Pool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.pool
+}
+
+// Watch registers a function that is called with the name of the tables
+// changed by other CAs, until the returned function is called. It requires
+// the Notify option.
+func (db *DB) Watch(fn func(bucket []byte)) (stop func(), err error) {
+	if !db.Options.Notify {
+		return nil, errors.New("postgresql notifications are not enabled")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.watchers == nil {
+		db.watchers = make(map[int]func(bucket []byte))
+	}
+	id := db.nextID
+	db.nextID++
+	db.watchers[id] = fn
+	return func() {
+		db.mu.Lock()
+		delete(db.watchers, id)
+		db.mu.Unlock()
+	}, nil
+}
+
+// listen receives the notifications of the changes and calls the watchers.
+// The connection is opened again if it fails.
+func (db *DB) listen(ctx context.Context) {
+	defer db.done.Done()
+	for {
+		err := db.receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("error receiving postgresql notifications: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenBackoff):
+		}
+	}
+}
+
+func (db *DB) receive(ctx context.Context) error {
+	// A listening connection cannot be shared, it does not use the pool.
+	conn, err := pgx.ConnectConfig(ctx, db.conn().Config().ConnConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+NotifyChannel); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		// The payload is the id of the CA and the table name.
+		parts := strings.SplitN(n.Payload, ":", 2)
+		if len(parts) != 2 || parts[0] == db.id {
+			continue
+		}
+		db.mu.RLock()
+		watchers := make([]func(bucket []byte), 0, len(db.watchers))
+		for _, fn := range db.watchers {
+			watchers = append(watchers, fn)
+		}
+		db.mu.RUnlock()
+		for _, fn := range watchers {
+			fn([]byte(parts[1]))
+		}
+	}
+}
+
+// querier is the common interface of *pgxpool.Pool and pgx.Tx.
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// notify sends the notification of a change in the given table.
+func (db *DB) notify(ctx context.Context, q querier, bucket []byte) error {
+	if !db.Options.Notify {
+		return nil
+	}
+	_, err := q.Exec(ctx, "SELECT pg_notify($1, $2)", NotifyChannel, db.id+":"+string(bucket))
+	return errors.Wrapf(err, "failed to notify change in table %s", bucket)
+}
+
+// Ping checks the connection to the PostgreSQL server.
+func (db *DB) Ping(ctx context.Context) error {
+	_, err := db.conn().Exec(ctx, "SELECT 1")
+	return errors.Wrap(err, "failed to ping postgresql")
+}
+
+// CreateTable creates a table if it does not exist.
+func (db *DB) CreateTable(bucket []byte) error {
+	_, err := db.conn().Exec(context.Background(), createTableQry(bucket))
+	return errors.Wrapf(err, "failed to create table %s", bucket)
+}
+
+// DeleteTable deletes a table. It returns a not found error if the table does
+// not exist.
+func (db *DB) DeleteTable(bucket []byte) error {
+	_, err := db.conn().Exec(context.Background(), "DROP TABLE "+quote(bucket))
+	if err != nil {
+		return tableError(err, bucket, "failed to delete table %s", bucket)
+	}
+	return nil
+}
+
+// Get returns the value stored in the given table and key.
+func (db *DB) Get(bucket, key []byte) ([]byte, error) {
+	return get(context.Background(), db.conn(), bucket, key, false)
+}
+
+// Set stores the given value on the given table and key.
+func (db *DB) Set(bucket, key, value []byte) error {
+	return db.write(func(ctx context.Context, q querier) error {
+		return set(ctx, q, bucket, key, value)
+	}, bucket)
+}
+
+// Del deletes the value stored in the given table and key.
+func (db *DB) Del(bucket, key []byte) error {
+	return db.write(func(ctx context.Context, q querier) error {
+		return del(ctx, q, bucket, key)
+	}, bucket)
+}
+
+// write runs a single write, and sends the notification of the change in the
+// same transaction if the notifications are enabled.
+func (db *DB) write(fn func(ctx context.Context, q querier) error, bucket []byte) error {
+	if !db.Options.Notify {
+		return fn(context.Background(), db.conn())
+	}
+	return db.transaction(func(ctx context.Context, tx pgx.Tx) error {
+		if err := fn(ctx, tx); err != nil {
+			return err
+		}
+		return db.notify(ctx, tx, bucket)
+	})
+}
+
+// List returns the entries of a table sorted by key.
+func (db *DB) List(bucket []byte) ([]*database.Entry, error) {
+	return db.ListPrefix(bucket, nil)
+}
+
+// ListPrefix returns the entries of a table with keys starting with the given
+// prefix sorted by key.
+func (db *DB) ListPrefix(bucket, prefix []byte) ([]*database.Entry, error) {
+	var entries []*database.Entry
+	err := iterate(context.Background(), db.conn(), bucket, prefix, func(e *database.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Iterate calls fn with the entries of a table sorted by key, reading the rows
+// one by one. The iteration stops if fn returns an error.
+func (db *DB) Iterate(bucket []byte, fn func(e *database.Entry) error) error {
+	return iterate(context.Background(), db.conn(), bucket, nil, fn)
+}
+
+// Snapshot calls fn with a function that iterates the tables in a read-only
+// repeatable read transaction, all the tables are read from the snapshot of
+// the first read. The writes are not blocked by it.
+func (db *DB) Snapshot(ctx context.Context, fn func(iterate func(bucket []byte, fn func(e *database.Entry) error) error) error) error {
+	tx, err := db.conn().BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return errors.Wrap(err, "failed to begin postgresql transaction")
+	}
+	defer tx.Rollback(context.Background())
+	return fn(func(bucket []byte, fn func(e *database.Entry) error) error {
+		// The errors abort the transaction, a missing table only rolls back
+		// to the savepoint.
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to create postgresql savepoint")
+		}
+		if err := iterate(ctx, sp, bucket, nil, fn); err != nil {
+			sp.Rollback(context.Background())
+			return err
+		}
+		return errors.Wrap(sp.Commit(ctx), "failed to release postgresql savepoint")
+	})
+}
+
+// rowsQuerier is the common interface of *pgxpool.Pool and pgx.Tx used to
+// read multiple rows.
+type rowsQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+func iterate(ctx context.Context, q rowsQuerier, bucket, prefix []byte, fn func(e *database.Entry) error) error {
+	var (
+		rows pgx.Rows
+		err  error
+	)
+	qry := "SELECT nkey, nvalue FROM " + quote(bucket)
+	switch end := prefixEnd(prefix); {
+	case len(prefix) == 0:
+		rows, err = q.Query(ctx, qry+" ORDER BY nkey")
+	case end == nil:
+		rows, err = q.Query(ctx, qry+" WHERE nkey >= $1 ORDER BY nkey", prefix)
+	default:
+		rows, err = q.Query(ctx, qry+" WHERE nkey >= $1 AND nkey < $2 ORDER BY nkey", prefix, end)
+	}
+	if err != nil {
+		return tableError(err, bucket, "failed to list table %s", bucket)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return errors.Wrapf(err, "failed to list table %s", bucket)
+		}
+		if err := fn(&database.Entry{
+			Bucket: bucket,
+			Key:    key,
+			Value:  value,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return tableError(err, bucket, "failed to list table %s", bucket)
+	}
+	return nil
+}
+
+// CmpAndSwap modifies the value at the given table and key (to newValue) only
+// if the existing (current) value matches oldValue.
+func (db *DB) CmpAndSwap(bucket, key, oldValue, newValue []byte) (val []byte, swapped bool, err error) {
+	if !db.Options.Notify {
+		return cmpAndSwap(context.Background(), db.conn(), bucket, key, oldValue, newValue)
+	}
+	err = db.transaction(func(ctx context.Context, tx pgx.Tx) error {
+		if val, swapped, err = cmpAndSwap(ctx, tx, bucket, key, oldValue, newValue); err != nil || !swapped {
+			return err
+		}
+		return db.notify(ctx, tx, bucket)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, swapped, nil
+}
+
+// Update performs multiple commands on one transaction. If a command fails
+// none of the changes are applied.
+func (db *DB) Update(tx *database.Tx) error {
+	return db.transaction(func(ctx context.Context, pgTx pgx.Tx) (err error) {
+		changed := make(map[string]bool)
+		for _, q := range tx.Operations {
+			switch q.Cmd {
+			case database.CreateTable:
+				if _, err = pgTx.Exec(ctx, createTableQry(q.Bucket)); err != nil {
+					return errors.Wrapf(err, "failed to create table %s", q.Bucket)
+				}
+			case database.DeleteTable:
+				if _, err = pgTx.Exec(ctx, "DROP TABLE "+quote(q.Bucket)); err != nil {
+					return tableError(err, q.Bucket, "failed to delete table %s", q.Bucket)
+				}
+			case database.Get:
+				if q.Result, err = get(ctx, pgTx, q.Bucket, q.Key, true); err != nil {
+					return err
+				}
+			case database.Set:
+				if err = set(ctx, pgTx, q.Bucket, q.Key, q.Value); err != nil {
+					return err
+				}
+				changed[string(q.Bucket)] = true
+			case database.Delete:
+				if err = del(ctx, pgTx, q.Bucket, q.Key); err != nil {
+					return err
+				}
+				changed[string(q.Bucket)] = true
+			case database.CmpAndSwap:
+				if q.Result, q.Swapped, err = cmpAndSwap(ctx, pgTx, q.Bucket, q.Key, q.CmpValue, q.Value); err != nil {
+					return err
+				}
+				changed[string(q.Bucket)] = changed[string(q.Bucket)] || q.Swapped
+			default:
+				return database.ErrOpNotSupported
+			}
+		}
+		for bucket, ok := range changed {
+			if ok {
+				if err := db.notify(ctx, pgTx, []byte(bucket)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// transaction runs fn in a transaction, it is retried if it fails because of
+// a deadlock or a serialization failure.
+func (db *DB) transaction(fn func(ctx context.Context, tx pgx.Tx) error) error {
+	retries := db.Options.Retries
+	if retries <= 0 {
+		retries = DefaultRetries
+	}
+	ctx := context.Background()
+	for i := 0; ; i++ {
+		err := runTransaction(ctx, db.conn(), fn)
+		switch errorCode(err) {
+		case errDeadlockDetected, errSerializationFailure, errUniqueViolation:
+			if i < retries {
+				time.Sleep(time.Duration(i+1) * retryBackoff)
+				continue
+			}
+			return errors.Wrap(err, "failed to commit postgresql transaction")
+		default:
+			return err
+		}
+	}
+}
+
+func runTransaction(ctx context.Context, pool *pgxpool.Pool, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin postgresql transaction")
+	}
+	if err := fn(ctx, tx); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	return errors.Wrap(tx.Commit(ctx), "failed to commit postgresql transaction")
+}
+
+// get returns the value of the given key, if lock is true the row is locked
+// until the end of the transaction.
+func get(ctx context.Context, q querier, bucket, key []byte, lock bool) ([]byte, error) {
+	qry := "SELECT nvalue FROM " + quote(bucket) + " WHERE nkey = $1"
+	if lock {
+		qry += " FOR UPDATE"
+	}
+	var val []byte
+	err := q.QueryRow(ctx, qry, key).Scan(&val)
+	switch {
+	case err == pgx.ErrNoRows:
+		return nil, errors.Wrapf(database.ErrNotFound, "%s/%s not found", bucket, key)
+	case err != nil:
+		return nil, tableError(err, bucket, "failed to get %s/%s", bucket, key)
+	case val == nil:
+		return []byte{}, nil
+	default:
+		return val, nil
+	}
+}
+
+func set(ctx context.Context, q querier, bucket, key, value []byte) error {
+	qry := "INSERT INTO " + quote(bucket) + " (nkey, nvalue) VALUES ($1, $2) ON CONFLICT (nkey) DO UPDATE SET nvalue = EXCLUDED.nvalue"
+	if _, err := q.Exec(ctx, qry, key, nonNil(value)); err != nil {
+		return tableError(err, bucket, "failed to set %s/%s", bucket, key)
+	}
+	return nil
+}
+
+func del(ctx context.Context, q querier, bucket, key []byte) error {
+	if _, err := q.Exec(ctx, "DELETE FROM "+quote(bucket)+" WHERE nkey = $1", key); err != nil {
+		return tableError(err, bucket, "failed to delete %s/%s", bucket, key)
+	}
+	return nil
+}
+
+// cmpAndSwap swaps the value with a single statement, a nil oldValue inserts
+// the key if it does not exist. If it is not swapped the current value is
+// returned.
+func cmpAndSwap(ctx context.Context, q querier, bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	var (
+		qry  string
+		args []interface{}
+	)
+	if oldValue == nil {
+		qry = "INSERT INTO " + quote(bucket) + " (nkey, nvalue) VALUES ($1, $2) ON CONFLICT (nkey) DO NOTHING RETURNING nvalue"
+		args = []interface{}{key, nonNil(newValue)}
+	} else {
+		qry = "UPDATE " + quote(bucket) + " SET nvalue = $2 WHERE nkey = $1 AND COALESCE(nvalue, '') = $3 RETURNING nvalue"
+		args = []interface{}{key, nonNil(newValue), oldValue}
+	}
+	var val []byte
+	err := q.QueryRow(ctx, qry, args...).Scan(&val)
+	switch {
+	case err == nil:
+		return newValue, true, nil
+	case err != pgx.ErrNoRows:
+		return nil, false, tableError(err, bucket, "failed to set %s/%s", bucket, key)
+	}
+
+	current, err := get(ctx, q, bucket, key, false)
+	switch {
+	case database.IsErrNotFound(err):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	case bytes.Equal(current, oldValue) && oldValue != nil:
+		// The value has been changed and restored since the update.
+		return cmpAndSwap(ctx, q, bucket, key, oldValue, newValue)
+	default:
+		return current, false, nil
+	}
+}
+
+// migration is a change in the schema of the database.
+type migration struct {
+	version     int
+	description string
+	migrate     func(ctx context.Context, conn *pgxpool.Conn) error
+}
+
+// migrations is the list of schema migrations, sorted by version. The
+// migrations cannot be modified once released, a change requires a new one.
+// The first version is the initial schema, the tables are created by the
+// authority.
+var migrations = []migration{
+	{1, "initial schema", func(ctx context.Context, conn *pgxpool.Conn) error { return nil }},
+}
+
+// migrate applies the pending migrations.
+func migrate(pool *pgxpool.Pool) error {
+	ctx := context.Background()
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error migrating postgresql database")
+	}
+	defer conn.Release()
+
+	// The lock belongs to the session, all the migration must use the same
+	// connection.
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", schemaLock); err != nil {
+		return errors.Wrap(err, "error acquiring postgresql migration lock")
+	}
+	defer conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", schemaLock)
+
+	if _, err := conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+schemaTable+
+		" (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())"); err != nil {
+		return errors.Wrap(err, "error creating postgresql schema table")
+	}
+	var current int
+	if err := conn.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+schemaTable).Scan(&current); err != nil {
+		return errors.Wrap(err, "error reading postgresql schema version")
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return errors.Errorf("postgresql schema version %d is newer than the supported version %d", current, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.migrate(ctx, conn); err != nil {
+			return errors.Wrapf(err, "error applying postgresql schema migration %d", m.version)
+		}
+		if _, err := conn.Exec(ctx, "INSERT INTO "+schemaTable+" (version, description) VALUES ($1, $2)", m.version, m.description); err != nil {
+			return errors.Wrapf(err, "error applying postgresql schema migration %d", m.version)
+		}
+	}
+	return nil
+}
+
+func createTableQry(bucket []byte) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (nkey BYTEA PRIMARY KEY, nvalue BYTEA)", quote(bucket))
+}
+
+// quote returns the given identifier quoted with double quotes.
+func quote(name []byte) string {
+	return pgx.Identifier{string(name)}.Sanitize()
+}
+
+// prefixEnd returns the smallest key greater than all the keys with the given
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// nonNil returns an empty slice instead of nil, nil values are stored as
+// NULL. NULL values are read as empty values.
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+// errorCode returns the SQLSTATE code of a PostgreSQL error, or the empty
+// string if it is not one.
+func errorCode(err error) string {
+	if e, ok := errors.Cause(err).(*pgconn.PgError); ok {
+		return e.Code
+	}
+	return ""
+}
+
+// tableError returns a not found error if the given error is caused by a
+// missing table, or wraps the error if not.
+func tableError(err error, bucket []byte, format string, args ...interface{}) error {
+	if errorCode(err) == errUndefinedTable {
+		return errors.Wrapf(database.ErrNotFound, "table %s not found", bucket)
+	}
+	return errors.Wrapf(err, format, args...)
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ErrNotOnHold is returned by Unrevoke if the revocation of a certificate is
+// not provisional.
+var ErrNotOnHold = errors.New("certificate is not on hold")
+
+// RevocationStore is implemented by the databases that can list the revoked
+// X.509 and SSH certificates and release the certificates on hold.
+type RevocationStore interface {
+	GetRevokedCertificates() ([]*RevokedCertificateInfo, error)
+	GetRevokedSSHCertificates() ([]*RevokedCertificateInfo, error)
+	Unrevoke(serial string) error
+}
+
+// decodeRevokedCertificate decodes a record of the revocation table. The
+// records written by previous versions may not have the serial number or the
+// provisional flag, and some of them only mark the key as revoked, so those
+// fields are completed from the key and the reason code.
+func decodeRevokedCertificate(key, value []byte) (*RevokedCertificateInfo, error) {
+	rci := new(RevokedCertificateInfo)
+	if v := bytes.TrimSpace(value); len(v) > 0 && v[0] == '{' {
+		if err := json.Unmarshal(v, rci); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshaling revoked certificate %s", key)
+		}
+	}
+	if rci.Serial == "" {
+		rci.Serial = string(key)
+	}
+	if rci.ReasonCode == ocsp.CertificateHold {
+		rci.Provisional = true
+	}
+	return rci, nil
+}
+
+// GetRevokedCertificate returns the revocation information of the certificate
+// with the given serial number. It returns a not found error if the
+// certificate has not been revoked.
+func (db *DB) GetRevokedCertificate(serial string) (*RevokedCertificateInfo, error) {
+	b, err := db.Get(revokedCertsTable, []byte(serial))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading revoked certificate %s", serial)
+	}
+	return decodeRevokedCertificate([]byte(serial), b)
+}
+
+// GetRevokedCertificates returns the revocation information of all the
+// revoked X.509 certificates.
+func (db *DB) GetRevokedCertificates() ([]*RevokedCertificateInfo, error) {
+	return db.listRevoked(revokedCertsTable)
+}
+
+// GetRevokedSSHCertificates returns the revocation information of all the
+// revoked SSH certificates.
+func (db *DB) GetRevokedSSHCertificates() ([]*RevokedCertificateInfo, error) {
+	return db.listRevoked(revokedSSHCertsTable)
+}
+
+func (db *DB) listRevoked(bucket []byte) ([]*RevokedCertificateInfo, error) {
+	entries, err := db.List(bucket)
+	if err != nil {
+		if database.IsErrNotFound(err) {
+			return []*RevokedCertificateInfo{}, nil
+		}
+		return nil, errors.Wrap(err, "error listing revoked certificates")
+	}
+	rcis := make([]*RevokedCertificateInfo, 0, len(entries))
+	for _, e := range entries {
+		rci, err := decodeRevokedCertificate(e.Key, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		rcis = append(rcis, rci)
+	}
+	return rcis, nil
+}
+
+// Unrevoke releases a certificate on hold, removing it from the revocation
+// table. It returns a not found error if the certificate has not been
+// revoked, and ErrNotOnHold if the revocation is not provisional.
+func (db *DB) Unrevoke(serial string) error {
+	rci, err := db.GetRevokedCertificate(serial)
+	if err != nil {
+		return err
+	}
+	if !rci.Provisional {
+		return ErrNotOnHold
+	}
+	if err := db.Del(revokedCertsTable, []byte(serial)); err != nil {
+		return errors.Wrapf(err, "error deleting revoked certificate %s", serial)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/memory"
+	"github.com/smallstep/nosql"
+)
+
+func TestDB_GetRevokedCertificates(t *testing.T) {
+	adb, err := newDB(memory.New())
+	assert.FatalError(t, err)
+	d := adb.(*DB)
+
+	rcis, err := d.GetRevokedCertificates()
+	assert.FatalError(t, err)
+	assert.Equals(t, 0, len(rcis))
+
+	// Records written by previous versions.
+	for k, v := range map[string]string{
+		"1": `{"Serial":"1","ReasonCode":6,"Reason":"hold","MTLS":true}`,
+		"2": `{"ReasonCode":1}`,
+		"3": ``,
+		"4": `revoked`,
+	} {
+		assert.FatalError(t, d.Set(revokedCertsTable, []byte(k), []byte(v)))
+	}
+	assert.FatalError(t, d.Revoke(&RevokedCertificateInfo{Serial: "5", ReasonCode: 6, RevokedBy: "admin", Provisional: true}))
+	assert.Equals(t, ErrAlreadyExists, d.Revoke(&RevokedCertificateInfo{Serial: "5"}))
+
+	rcis, err = d.GetRevokedCertificates()
+	assert.FatalError(t, err)
+	got := map[string]*RevokedCertificateInfo{}
+	for _, rci := range rcis {
+		got[rci.Serial] = rci
+	}
+	assert.Equals(t, map[string]*RevokedCertificateInfo{
+		"1": {Serial: "1", ReasonCode: 6, Reason: "hold", MTLS: true, Provisional: true},
+		"2": {Serial: "2", ReasonCode: 1},
+		"3": {Serial: "3"},
+		"4": {Serial: "4"},
+		"5": {Serial: "5", ReasonCode: 6, RevokedBy: "admin", Provisional: true},
+	}, got)
+
+	// Holds can be released, including the ones written by previous versions.
+	for _, serial := range []string{"1", "5"} {
+		assert.FatalError(t, d.Unrevoke(serial))
+		isRevoked, err := d.IsRevoked(serial)
+		assert.FatalError(t, err)
+		assert.False(t, isRevoked)
+		err = d.Unrevoke(serial)
+		assert.True(t, nosql.IsErrNotFound(err), "Unrevoke() error = %v, want not found", err)
+	}
+	assert.Equals(t, ErrNotOnHold, d.Unrevoke("2"))
+	assert.Equals(t, ErrNotOnHold, d.Unrevoke("3"))
+}
+
+func TestDB_GetRevokedSSHCertificates(t *testing.T) {
+	adb, err := newDB(memory.New())
+	assert.FatalError(t, err)
+	d := adb.(*DB)
+
+	rcis, err := d.GetRevokedSSHCertificates()
+	assert.FatalError(t, err)
+	assert.Equals(t, 0, len(rcis))
+
+	assert.FatalError(t, d.RevokeSSH(&RevokedCertificateInfo{Serial: "1", ReasonCode: 1, Reason: "lost laptop"}))
+	assert.Equals(t, ErrAlreadyExists, d.RevokeSSH(&RevokedCertificateInfo{Serial: "1"}))
+	// The x509 revocations are stored separately.
+	assert.FatalError(t, d.Revoke(&RevokedCertificateInfo{Serial: "2"}))
+
+	rcis, err = d.GetRevokedSSHCertificates()
+	assert.FatalError(t, err)
+	assert.Equals(t, []*RevokedCertificateInfo{
+		{Serial: "1", ReasonCode: 1, Reason: "lost laptop"},
+	}, rcis)
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"crypto/x509"
 	"sync"
 	"time"
@@ -84,6 +85,41 @@ func (s *SimpleDB) GetSSHHostPrincipals() ([]string, error) {
 	return nil, ErrNotImplemented
 }
 
+// GetProvisioners returns a "NotImplemented" error.
+func (s *SimpleDB) GetProvisioners() (map[string][]byte, error) {
+	return nil, ErrNotImplemented
+}
+
+// StoreProvisioner returns a "NotImplemented" error.
+func (s *SimpleDB) StoreProvisioner(id string, data []byte) error {
+	return ErrNotImplemented
+}
+
+// DeleteProvisioner returns a "NotImplemented" error.
+func (s *SimpleDB) DeleteProvisioner(id string) error {
+	return ErrNotImplemented
+}
+
+// GetAdmins returns a "NotImplemented" error.
+func (s *SimpleDB) GetAdmins() (map[string][]byte, error) {
+	return nil, ErrNotImplemented
+}
+
+// StoreAdmin returns a "NotImplemented" error.
+func (s *SimpleDB) StoreAdmin(id string, data []byte) error {
+	return ErrNotImplemented
+}
+
+// DeleteAdmin returns a "NotImplemented" error.
+func (s *SimpleDB) DeleteAdmin(id string) error {
+	return ErrNotImplemented
+}
+
+// Ping returns nil
+func (s *SimpleDB) Ping(ctx context.Context) error {
+	return nil
+}
+
 // Shutdown returns nil
 func (s *SimpleDB) Shutdown() error {
 	return nil
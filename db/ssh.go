@@ -0,0 +1,64 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+)
+
+// SSHSuperseder is implemented by the databases that record the SSH
+// certificates replaced by a new certificate for a new key.
+type SSHSuperseder interface {
+	SupersedeSSHCertificate(serial, newSerial string) error
+	GetSSHSupersededBy(serial string) (*SupersededSSHCertificateInfo, error)
+}
+
+// SupersededSSHCertificateInfo contains the serial number of the certificate
+// that replaced an SSH certificate.
+type SupersededSSHCertificateInfo struct {
+	Serial       string    `json:"serial"`
+	NewSerial    string    `json:"newSerial"`
+	SupersededAt time.Time `json:"supersededAt"`
+}
+
+// SupersedeSSHCertificate records that the SSH certificate with the given
+// serial number has been replaced by the certificate with newSerial. It
+// returns ErrAlreadyExists if the certificate has already been replaced.
+func (db *DB) SupersedeSSHCertificate(serial, newSerial string) error {
+	b, err := json.Marshal(&SupersededSSHCertificateInfo{
+		Serial:       serial,
+		NewSerial:    newSerial,
+		SupersededAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error marshaling superseded ssh certificate info")
+	}
+	_, swapped, err := db.CmpAndSwap(sshSupersededTable, []byte(serial), nil, b)
+	switch {
+	case err != nil:
+		return errors.Wrap(err, "error AuthDB CmpAndSwap")
+	case !swapped:
+		return ErrAlreadyExists
+	default:
+		return nil
+	}
+}
+
+// GetSSHSupersededBy returns the certificate that replaced the SSH certificate
+// with the given serial number, or nil if it has not been replaced.
+func (db *DB) GetSSHSupersededBy(serial string) (*SupersededSSHCertificateInfo, error) {
+	b, err := db.Get(sshSupersededTable, []byte(serial))
+	switch {
+	case nosql.IsErrNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "error loading superseded ssh certificate")
+	}
+	info := new(SupersededSSHCertificateInfo)
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling superseded ssh certificate info")
+	}
+	return info, nil
+}
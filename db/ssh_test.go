@@ -0,0 +1,31 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db/memory"
+)
+
+func TestDB_SupersedeSSHCertificate(t *testing.T) {
+	adb, err := newDB(memory.New())
+	assert.FatalError(t, err)
+	db := adb.(*DB)
+
+	info, err := db.GetSSHSupersededBy("1234")
+	assert.FatalError(t, err)
+	assert.Nil(t, info)
+
+	assert.FatalError(t, db.SupersedeSSHCertificate("1234", "5678"))
+	info, err = db.GetSSHSupersededBy("1234")
+	assert.FatalError(t, err)
+	assert.Equals(t, "1234", info.Serial)
+	assert.Equals(t, "5678", info.NewSerial)
+	assert.False(t, info.SupersededAt.IsZero())
+
+	// Only the first replacement is recorded.
+	assert.Equals(t, ErrAlreadyExists, db.SupersedeSSHCertificate("1234", "9012"))
+	info, err = db.GetSSHSupersededBy("1234")
+	assert.FatalError(t, err)
+	assert.Equals(t, "5678", info.NewSerial)
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -54,18 +56,86 @@ func WithKeyVal(key string, val interface{}) Option {
 	}
 }
 
-// Error represents the CA API errors.
-type Error struct {
-	Status  int
-	Err     error
-	Msg     string
-	Details map[string]interface{}
+// WithType returns an Option that modifies the error by setting the problem
+// type returned to the clients.
+func WithType(typ string) Option {
+	return func(e *Error) error {
+		e.Type = typ
+		return e
+	}
 }
 
-// ErrorResponse represents an error in JSON format.
+// TypePrefix is the prefix of the problem type URIs of the errors.
+const TypePrefix = "urn:smallstep:error:"
+
+// Problem types of the errors. The type of an error without an explicit one
+// is derived from its status code.
+const (
+	TypeBadRequest          = "bad-request"
+	TypeUnauthorized        = "unauthorized"
+	TypeForbidden           = "forbidden"
+	TypeNotFound            = "not-found"
+	TypeConflict            = "conflict"
+	TypeRequestTooLarge     = "request-too-large"
+	TypeRateLimited         = "rate-limited"
+	TypeInternal            = "internal"
+	TypeNotImplemented      = "not-implemented"
+	TypeUnavailable         = "unavailable"
+	TypeTokenInvalid        = "token-invalid"
+	TypeTokenExpired        = "token-expired"
+	TypeTokenReused         = "token-reused"
+	TypeProvisionerDisabled = "provisioner-disabled"
+	TypePolicyViolation     = "policy-violation"
+	TypeDBUnavailable       = "db-unavailable"
+)
+
+// typeTitles are the titles of the problem types that are not derived from a
+// status code.
+var typeTitles = map[string]string{
+	TypeRateLimited:         "Rate limit exceeded",
+	TypeTokenInvalid:        "Invalid token",
+	TypeTokenExpired:        "Expired token",
+	TypeTokenReused:         "Token already used",
+	TypeProvisionerDisabled: "Provisioner disabled",
+	TypePolicyViolation:     "Policy violation",
+	TypeDBUnavailable:       "Database unavailable",
+}
+
+// statusTypes are the problem types derived from the status codes.
+var statusTypes = map[int]string{
+	http.StatusBadRequest:            TypeBadRequest,
+	http.StatusUnauthorized:          TypeUnauthorized,
+	http.StatusForbidden:             TypeForbidden,
+	http.StatusNotFound:              TypeNotFound,
+	http.StatusConflict:              TypeConflict,
+	http.StatusRequestEntityTooLarge: TypeRequestTooLarge,
+	http.StatusTooManyRequests:       TypeRateLimited,
+	http.StatusInternalServerError:   TypeInternal,
+	http.StatusNotImplemented:        TypeNotImplemented,
+	http.StatusServiceUnavailable:    TypeUnavailable,
+}
+
+// Error represents the CA API errors.
+type Error struct {
+	Status     int
+	Type       string
+	Err        error
+	Msg        string
+	Details    map[string]interface{}
+	RetryAfter time.Duration
+	RequestID  string
+}
+
+// ErrorResponse represents an error in JSON format, it follows the problem
+// details format defined in RFC 7807. The message member is the same as the
+// detail and it is kept for compatibility with older clients.
 type ErrorResponse struct {
-	Status  int    `json:"status"`
-	Message string `json:"message"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Detail    string `json:"detail"`
+	Status    int    `json:"status"`
+	RequestID string `json:"requestId,omitempty"`
+	Message   string `json:"message"`
 }
 
 // Cause implements the errors.Causer interface and returns the original error.
@@ -84,6 +154,18 @@ func (e *Error) StatusCode() int {
 	return e.Status
 }
 
+// ProblemType returns the problem type of the error, if the type is not set
+// it is derived from the status code.
+func (e *Error) ProblemType() string {
+	if e.Type != "" {
+		return e.Type
+	}
+	if typ, ok := statusTypes[e.Status]; ok {
+		return typ
+	}
+	return "about:blank"
+}
+
 // Message returns a user friendly error, if one is set.
 func (e *Error) Message() string {
 	if len(e.Msg) > 0 {
@@ -124,7 +206,9 @@ func Wrapf(status int, e error, format string, args ...interface{}) error {
 	return StatusCodeError(status, e, opts...)
 }
 
-// MarshalJSON implements json.Marshaller interface for the Error struct.
+// MarshalJSON implements json.Marshaller interface for the Error struct. The
+// error is marshaled as an RFC 7807 problem, the internal error is never
+// included.
 func (e *Error) MarshalJSON() ([]byte, error) {
 	var msg string
 	if len(e.Msg) > 0 {
@@ -132,17 +216,40 @@ func (e *Error) MarshalJSON() ([]byte, error) {
 	} else {
 		msg = http.StatusText(e.Status)
 	}
-	return json.Marshal(&ErrorResponse{Status: e.Status, Message: msg})
-}
-
-// UnmarshalJSON implements json.Unmarshaler interface for the Error struct.
+	typ := e.ProblemType()
+	title, ok := typeTitles[typ]
+	if !ok {
+		title = http.StatusText(e.Status)
+	}
+	if typ != "about:blank" {
+		typ = TypePrefix + typ
+	}
+	return json.Marshal(&ErrorResponse{
+		Type:      typ,
+		Title:     title,
+		Detail:    msg,
+		Status:    e.Status,
+		RequestID: e.RequestID,
+		Message:   msg,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface for the Error struct. It
+// supports the RFC 7807 problems and the legacy format used by older versions
+// of the certificate authority, with only the status and the message.
 func (e *Error) UnmarshalJSON(data []byte) error {
 	var er ErrorResponse
 	if err := json.Unmarshal(data, &er); err != nil {
 		return err
 	}
+	msg := er.Detail
+	if msg == "" {
+		msg = er.Message
+	}
 	e.Status = er.Status
-	e.Err = fmt.Errorf(er.Message)
+	e.Type = strings.TrimPrefix(er.Type, TypePrefix)
+	e.RequestID = er.RequestID
+	e.Err = fmt.Errorf("%s", msg)
 	return nil
 }
 
@@ -188,8 +295,16 @@ var (
 	ForbiddenDefaultMsg = "The request was forbidden by the certificate authority. " + seeLogs
 	// NotFoundDefaultMsg 404 default msg
 	NotFoundDefaultMsg = "The requested resource could not be found. " + seeLogs
+	// ConflictDefaultMsg 409 default msg
+	ConflictDefaultMsg = "The request conflicts with the current state of the resource. " + seeLogs
+	// RequestEntityTooLargeDefaultMsg 413 default msg
+	RequestEntityTooLargeDefaultMsg = "The request body is larger than the limit allowed by the certificate authority. " + seeLogs
 	// InternalServerErrorDefaultMsg 500 default msg
 	InternalServerErrorDefaultMsg = "The certificate authority encountered an Internal Server Error. " + seeLogs
+	// TooManyRequestsDefaultMsg 429 default msg
+	TooManyRequestsDefaultMsg = "The request was rate limited by the certificate authority, please retry later. " + seeLogs
+	// ServiceUnavailableDefaultMsg 503 default msg
+	ServiceUnavailableDefaultMsg = "The certificate authority is overloaded, please retry later. " + seeLogs
 	// NotImplementedDefaultMsg 501 default msg
 	NotImplementedDefaultMsg = "The requested method is not implemented by the certificate authority. " + seeLogs
 )
@@ -326,6 +441,12 @@ func NotFoundErr(err error, opts ...Option) error {
 	return NewErr(http.StatusNotFound, err, opts...)
 }
 
+// Conflict creates a 409 error with the given format and arguments.
+func Conflict(format string, args ...interface{}) error {
+	args = append(args, withDefaultMessage(ConflictDefaultMsg))
+	return Errorf(http.StatusConflict, format, args...)
+}
+
 // UnexpectedErr will be used when the certificate authority makes an outgoing
 // request and receives an unhandled status code.
 func UnexpectedErr(code int, err error, opts ...Option) error {
@@ -333,3 +454,28 @@ func UnexpectedErr(code int, err error, opts ...Option) error {
 		"unexpected HTTP status code - '%d'. "+seeLogs, code))
 	return NewErr(code, err, opts...)
 }
+
+// RequestEntityTooLarge creates a 413 error with the given format and
+// arguments.
+func RequestEntityTooLarge(format string, args ...interface{}) error {
+	args = append(args, withDefaultMessage(RequestEntityTooLargeDefaultMsg))
+	return Errorf(http.StatusRequestEntityTooLarge, format, args...)
+}
+
+// ServiceUnavailable creates a 503 error with the given format and arguments,
+// retryAfter is the time the client should wait before retrying the request.
+func ServiceUnavailable(retryAfter time.Duration, format string, args ...interface{}) error {
+	args = append(args, withDefaultMessage(ServiceUnavailableDefaultMsg))
+	e := Errorf(http.StatusServiceUnavailable, format, args...).(*Error)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// TooManyRequests creates a 429 error with the given format and arguments,
+// retryAfter is the time the client should wait before retrying the request.
+func TooManyRequests(retryAfter time.Duration, format string, args ...interface{}) error {
+	args = append(args, withDefaultMessage(TooManyRequestsDefaultMsg))
+	e := Errorf(http.StatusTooManyRequests, format, args...).(*Error)
+	e.RetryAfter = retryAfter
+	return e
+}
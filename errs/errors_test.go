@@ -8,8 +8,11 @@ import (
 
 func TestError_MarshalJSON(t *testing.T) {
 	type fields struct {
-		Status int
-		Err    error
+		Status    int
+		Type      string
+		Err       error
+		Msg       string
+		RequestID string
 	}
 	tests := []struct {
 		name    string
@@ -17,14 +20,19 @@ func TestError_MarshalJSON(t *testing.T) {
 		want    []byte
 		wantErr bool
 	}{
-		{"ok", fields{400, fmt.Errorf("bad request")}, []byte(`{"status":400,"message":"Bad Request"}`), false},
-		{"ok no error", fields{500, nil}, []byte(`{"status":500,"message":"Internal Server Error"}`), false},
+		{"ok", fields{400, "", fmt.Errorf("bad request"), "", ""}, []byte(`{"type":"urn:smallstep:error:bad-request","title":"Bad Request","detail":"Bad Request","status":400,"message":"Bad Request"}`), false},
+		{"ok no error", fields{500, "", nil, "", ""}, []byte(`{"type":"urn:smallstep:error:internal","title":"Internal Server Error","detail":"Internal Server Error","status":500,"message":"Internal Server Error"}`), false},
+		{"ok with type", fields{401, TypeTokenExpired, fmt.Errorf("token is expired"), "The token has expired.", "request-id"}, []byte(`{"type":"urn:smallstep:error:token-expired","title":"Expired token","detail":"The token has expired.","status":401,"requestId":"request-id","message":"The token has expired."}`), false},
+		{"ok unknown status", fields{418, "", fmt.Errorf("teapot"), "", ""}, []byte(`{"type":"about:blank","title":"I'm a teapot","detail":"I'm a teapot","status":418,"message":"I'm a teapot"}`), false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			e := &Error{
-				Status: tt.fields.Status,
-				Err:    tt.fields.Err,
+				Status:    tt.fields.Status,
+				Type:      tt.fields.Type,
+				Err:       tt.fields.Err,
+				Msg:       tt.fields.Msg,
+				RequestID: tt.fields.RequestID,
 			}
 			got, err := e.MarshalJSON()
 			if (err != nil) != tt.wantErr {
@@ -49,6 +57,9 @@ func TestError_UnmarshalJSON(t *testing.T) {
 		wantErr  bool
 	}{
 		{"ok", args{[]byte(`{"status":400,"message":"bad request"}`)}, &Error{Status: 400, Err: fmt.Errorf("bad request")}, false},
+		{"ok problem", args{[]byte(`{"type":"urn:smallstep:error:provisioner-disabled","title":"Provisioner disabled","detail":"The provisioner foo is disabled.","status":401,"requestId":"request-id"}`)}, &Error{Status: 401, Type: TypeProvisionerDisabled, RequestID: "request-id", Err: fmt.Errorf("The provisioner foo is disabled.")}, false},
+		{"ok problem with message", args{[]byte(`{"type":"urn:smallstep:error:internal","title":"Internal Server Error","detail":"Internal Server Error","status":500,"message":"Internal Server Error"}`)}, &Error{Status: 500, Type: TypeInternal, Err: fmt.Errorf("Internal Server Error")}, false},
+		{"ok other type", args{[]byte(`{"type":"about:blank","title":"I'm a teapot","detail":"teapot","status":418}`)}, &Error{Status: 418, Type: "about:blank", Err: fmt.Errorf("teapot")}, false},
 		{"fail", args{[]byte(`{"status":"400","message":"bad request"}`)}, &Error{}, true},
 	}
 	for _, tt := range tests {
@@ -5,19 +5,27 @@ go 1.13
 require (
 	cloud.google.com/go v0.51.0
 	github.com/Masterminds/sprig/v3 v3.0.0
+	github.com/dgraph-io/badger v1.5.3
+	github.com/fxamacker/cbor/v2 v2.3.0
 	github.com/go-chi/chi v4.0.2+incompatible
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/google/go-cmp v0.4.0 // indirect
 	github.com/googleapis/gax-go/v2 v2.0.5
+	github.com/jackc/pgconn v1.8.0
+	github.com/jackc/pgx/v4 v4.10.1
 	github.com/newrelic/go-agent v2.15.0+incompatible
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.3.0
 	github.com/rs/xid v1.2.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/smallstep/assert v0.0.0-20200103212524-b99dc1097b15
 	github.com/smallstep/cli v0.14.0-rc.3
 	github.com/smallstep/nosql v0.2.0
 	github.com/urfave/cli v1.22.2
-	golang.org/x/crypto v0.0.0-20191227163750-53104e6ec876
+	go.etcd.io/bbolt v1.3.2
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae
 	google.golang.org/api v0.15.0
 	google.golang.org/genproto v0.0.0-20191230161307-f3c370f40bfb
 	google.golang.org/grpc v1.26.0
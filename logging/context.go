@@ -21,18 +21,27 @@ func NewRequestID() string {
 	return xid.New().String()
 }
 
+// RequestIDHeader is the standard header used to propagate the request
+// identifier.
+const RequestIDHeader = "X-Request-Id"
+
 // RequestID returns a new middleware that gets the given header and sets it
 // in the context so it can be written in the logger. If the header does not
-// exists or it's the empty string, it uses github.com/rs/xid to create a new
-// one.
+// exists or it's the empty string, it will try with the X-Request-Id header,
+// and if it's also empty it uses github.com/rs/xid to create a new one. The
+// request identifier is also added to the response headers.
 func RequestID(headerName string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, req *http.Request) {
 			requestID := req.Header.Get(headerName)
 			if requestID == "" {
-				requestID = NewRequestID()
+				if requestID = req.Header.Get(RequestIDHeader); requestID == "" {
+					requestID = NewRequestID()
+				}
 				req.Header.Set(headerName, requestID)
 			}
+			w.Header().Set(headerName, requestID)
+			w.Header().Set(RequestIDHeader, requestID)
 
 			ctx := WithRequestID(req.Context(), requestID)
 			next.ServeHTTP(w, req.WithContext(ctx))
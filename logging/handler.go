@@ -85,6 +85,10 @@ func (l *LoggerHandler) writeEntry(w ResponseLogger, r *http.Request, t time.Tim
 		"user-agent":     r.UserAgent(),
 	}
 
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		fields["peer-common-name"] = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
 	for k, v := range w.Fields() {
 		fields[k] = v
 	}
@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func TestLoggerHandler(t *testing.T) {
+	peer := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "client.example.com"}}},
+	}
+	tests := []struct {
+		name      string
+		header    http.Header
+		tls       *tls.ConnectionState
+		requestID string
+		fields    map[string]interface{}
+	}{
+		{"ok/generated", http.Header{}, nil, "", map[string]interface{}{}},
+		{"ok/trace-header", http.Header{"X-Smallstep-Id": []string{"trace-id"}}, nil, "trace-id", map[string]interface{}{}},
+		{"ok/request-id", http.Header{"X-Request-Id": []string{"request-id"}}, nil, "request-id", map[string]interface{}{}},
+		{"ok/peer", http.Header{}, peer, "", map[string]interface{}{"peer-common-name": "client.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := New("ca", []byte(`{"format":"json"}`))
+			assert.FatalError(t, err)
+			var buf bytes.Buffer
+			logger.Out = &buf
+
+			h := logger.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if rl, ok := w.(ResponseLogger); ok {
+					rl.WithFields(map[string]interface{}{"serial": "1234"})
+				}
+				w.WriteHeader(http.StatusNotFound)
+			}))
+			req := httptest.NewRequest("GET", "/not-found", nil)
+			req.Header = tt.header
+			req.TLS = tt.tls
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			var entry map[string]interface{}
+			assert.FatalError(t, json.Unmarshal(buf.Bytes(), &entry))
+			requestID := w.Result().Header.Get(RequestIDHeader)
+			if tt.requestID != "" {
+				assert.Equals(t, tt.requestID, requestID)
+			} else {
+				assert.True(t, requestID != "")
+			}
+			assert.Equals(t, requestID, w.Result().Header.Get(defaultTraceIDHeader))
+			assert.Equals(t, requestID, entry["request-id"])
+			assert.Equals(t, "/not-found", entry["path"])
+			assert.Equals(t, float64(http.StatusNotFound), entry["status"])
+			assert.Equals(t, "1234", entry["serial"])
+			for k, v := range tt.fields {
+				assert.Equals(t, v, entry[k])
+			}
+		})
+	}
+}
+
+func TestNew_output(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ca.log")
+
+	tests := []struct {
+		name    string
+		config  string
+		want    interface{}
+		wantErr bool
+	}{
+		{"ok/default", `{}`, os.Stderr, false},
+		{"ok/stderr", `{"output":"stderr"}`, os.Stderr, false},
+		{"ok/stdout", `{"output":"stdout"}`, os.Stdout, false},
+		{"ok/file", `{"output":"` + path + `"}`, nil, false},
+		{"fail/file", `{"output":"` + filepath.Join(dir, "missing", "ca.log") + `"}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := New("ca", []byte(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.want != nil {
+				assert.Equals(t, tt.want, logger.Out)
+			} else {
+				f, ok := logger.Out.(*os.File)
+				assert.Fatal(t, ok)
+				assert.Equals(t, path, f.Name())
+				f.Close()
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package logging
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -26,6 +28,7 @@ type Logger struct {
 type loggerConfig struct {
 	Format      string `json:"format"`
 	TraceHeader string `json:"traceHeader"`
+	Output      string `json:"output"`
 }
 
 // New initializes the logger with the given options.
@@ -46,11 +49,26 @@ func New(name string, raw json.RawMessage) (*Logger, error) {
 		return nil, errors.Errorf("unsupported logger.format '%s'", config.Format)
 	}
 
+	var out io.Writer
+	switch strings.ToLower(config.Output) {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(config.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error opening logger.output '%s'", config.Output)
+		}
+		out = f
+	}
+
 	logger := &Logger{
 		Logger:      logrus.New(),
 		name:        name,
 		traceHeader: config.TraceHeader,
 	}
+	logger.Out = out
 	if formatter != nil {
 		logger.Formatter = formatter
 	}
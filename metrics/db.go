@@ -0,0 +1,224 @@
+package metrics
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"time"
+
+	"github.com/smallstep/certificates/db"
+	"golang.org/x/crypto/ssh"
+)
+
+// WrapDB returns an authority database that records the duration of the
+// operations of the given one.
+func (m *Metrics) WrapDB(d db.AuthDB) db.AuthDB {
+	return &instrumentedDB{AuthDB: d, metrics: m}
+}
+
+type instrumentedDB struct {
+	db.AuthDB
+	metrics *Metrics
+}
+
+func (d *instrumentedDB) IsRevoked(sn string) (bool, error) {
+	defer d.metrics.observeDB("is_revoked", time.Now())
+	return d.AuthDB.IsRevoked(sn)
+}
+
+func (d *instrumentedDB) IsSSHRevoked(sn string) (bool, error) {
+	defer d.metrics.observeDB("is_ssh_revoked", time.Now())
+	return d.AuthDB.IsSSHRevoked(sn)
+}
+
+func (d *instrumentedDB) Revoke(rci *db.RevokedCertificateInfo) error {
+	defer d.metrics.observeDB("revoke", time.Now())
+	return d.AuthDB.Revoke(rci)
+}
+
+func (d *instrumentedDB) RevokeSSH(rci *db.RevokedCertificateInfo) error {
+	defer d.metrics.observeDB("revoke_ssh", time.Now())
+	return d.AuthDB.RevokeSSH(rci)
+}
+
+func (d *instrumentedDB) StoreCertificate(crt *x509.Certificate) error {
+	defer d.metrics.observeDB("store_certificate", time.Now())
+	return d.AuthDB.StoreCertificate(crt)
+}
+
+func (d *instrumentedDB) UseToken(id, tok string) (bool, error) {
+	defer d.metrics.observeDB("use_token", time.Now())
+	return d.AuthDB.UseToken(id, tok)
+}
+
+func (d *instrumentedDB) IsSSHHost(name string) (bool, error) {
+	defer d.metrics.observeDB("is_ssh_host", time.Now())
+	return d.AuthDB.IsSSHHost(name)
+}
+
+func (d *instrumentedDB) StoreSSHCertificate(crt *ssh.Certificate) error {
+	defer d.metrics.observeDB("store_ssh_certificate", time.Now())
+	return d.AuthDB.StoreSSHCertificate(crt)
+}
+
+func (d *instrumentedDB) GetSSHHostPrincipals() ([]string, error) {
+	defer d.metrics.observeDB("get_ssh_host_principals", time.Now())
+	return d.AuthDB.GetSSHHostPrincipals()
+}
+
+func (d *instrumentedDB) GetProvisioners() (map[string][]byte, error) {
+	defer d.metrics.observeDB("get_provisioners", time.Now())
+	return d.AuthDB.GetProvisioners()
+}
+
+func (d *instrumentedDB) StoreProvisioner(id string, data []byte) error {
+	defer d.metrics.observeDB("store_provisioner", time.Now())
+	return d.AuthDB.StoreProvisioner(id, data)
+}
+
+func (d *instrumentedDB) DeleteProvisioner(id string) error {
+	defer d.metrics.observeDB("delete_provisioner", time.Now())
+	return d.AuthDB.DeleteProvisioner(id)
+}
+
+func (d *instrumentedDB) GetAdmins() (map[string][]byte, error) {
+	defer d.metrics.observeDB("get_admins", time.Now())
+	return d.AuthDB.GetAdmins()
+}
+
+func (d *instrumentedDB) StoreAdmin(id string, data []byte) error {
+	defer d.metrics.observeDB("store_admin", time.Now())
+	return d.AuthDB.StoreAdmin(id, data)
+}
+
+func (d *instrumentedDB) DeleteAdmin(id string) error {
+	defer d.metrics.observeDB("delete_admin", time.Now())
+	return d.AuthDB.DeleteAdmin(id)
+}
+
+func (d *instrumentedDB) Ping(ctx context.Context) error {
+	defer d.metrics.observeDB("ping", time.Now())
+	return d.AuthDB.Ping(ctx)
+}
+
+// WatchAdmin forwards the notifications of the wrapped database, if it
+// supports them.
+func (d *instrumentedDB) WatchAdmin(fn func()) (func(), error) {
+	if w, ok := d.AuthDB.(db.AdminWatcher); ok {
+		return w.WatchAdmin(fn)
+	}
+	return nil, db.ErrNotImplemented
+}
+
+// Export forwards the export of the wrapped database, if it supports it.
+func (d *instrumentedDB) Export(w io.Writer, opts *db.ExportOptions) error {
+	if e, ok := d.AuthDB.(db.Exporter); ok {
+		return e.Export(w, opts)
+	}
+	return db.ErrNotImplemented
+}
+
+// Backup forwards the backup of the wrapped database, if it supports it.
+func (d *instrumentedDB) Backup(ctx context.Context, w io.Writer, opts *db.BackupOptions) (int64, error) {
+	if b, ok := d.AuthDB.(db.Backuper); ok {
+		return b.Backup(ctx, w, opts)
+	}
+	return 0, db.ErrNotImplemented
+}
+
+// GetCertificate forwards the lookup to the wrapped database, if it supports
+// it.
+func (d *instrumentedDB) GetCertificate(serial string) (*x509.Certificate, error) {
+	if f, ok := d.AuthDB.(db.CertificateFinder); ok {
+		defer d.metrics.observeDB("get_certificate", time.Now())
+		return f.GetCertificate(serial)
+	}
+	return nil, db.ErrNotImplemented
+}
+
+// GetRevokedCertificate forwards the lookup to the wrapped database, if it
+// supports it.
+func (d *instrumentedDB) GetRevokedCertificate(serial string) (*db.RevokedCertificateInfo, error) {
+	if f, ok := d.AuthDB.(db.CertificateFinder); ok {
+		defer d.metrics.observeDB("get_revoked_certificate", time.Now())
+		return f.GetRevokedCertificate(serial)
+	}
+	return nil, db.ErrNotImplemented
+}
+
+// GetCertificatesBySAN forwards the lookup to the wrapped database, if it
+// supports it.
+func (d *instrumentedDB) GetCertificatesBySAN(san string) ([]*x509.Certificate, error) {
+	if f, ok := d.AuthDB.(db.CertificateFinder); ok {
+		defer d.metrics.observeDB("get_certificates_by_san", time.Now())
+		return f.GetCertificatesBySAN(san)
+	}
+	return nil, db.ErrNotImplemented
+}
+
+// GetRevokedCertificates forwards the listing to the wrapped database, if it
+// supports it.
+func (d *instrumentedDB) GetRevokedCertificates() ([]*db.RevokedCertificateInfo, error) {
+	if s, ok := d.AuthDB.(db.RevocationStore); ok {
+		defer d.metrics.observeDB("get_revoked_certificates", time.Now())
+		return s.GetRevokedCertificates()
+	}
+	return nil, db.ErrNotImplemented
+}
+
+// GetRevokedSSHCertificates forwards the listing to the wrapped database, if
+// it supports it.
+func (d *instrumentedDB) GetRevokedSSHCertificates() ([]*db.RevokedCertificateInfo, error) {
+	if s, ok := d.AuthDB.(db.RevocationStore); ok {
+		defer d.metrics.observeDB("get_revoked_ssh_certificates", time.Now())
+		return s.GetRevokedSSHCertificates()
+	}
+	return nil, db.ErrNotImplemented
+}
+
+// Unrevoke forwards the release of a certificate on hold to the wrapped
+// database, if it supports it.
+func (d *instrumentedDB) Unrevoke(serial string) error {
+	if s, ok := d.AuthDB.(db.RevocationStore); ok {
+		defer d.metrics.observeDB("unrevoke", time.Now())
+		return s.Unrevoke(serial)
+	}
+	return db.ErrNotImplemented
+}
+
+// SupersedeSSHCertificate forwards the record of a replaced SSH certificate to
+// the wrapped database, if it supports it.
+func (d *instrumentedDB) SupersedeSSHCertificate(serial, newSerial string) error {
+	if s, ok := d.AuthDB.(db.SSHSuperseder); ok {
+		defer d.metrics.observeDB("supersede_ssh_certificate", time.Now())
+		return s.SupersedeSSHCertificate(serial, newSerial)
+	}
+	return db.ErrNotImplemented
+}
+
+// GetSSHSupersededBy forwards the lookup to the wrapped database, if it
+// supports it.
+func (d *instrumentedDB) GetSSHSupersededBy(serial string) (*db.SupersededSSHCertificateInfo, error) {
+	if s, ok := d.AuthDB.(db.SSHSuperseder); ok {
+		defer d.metrics.observeDB("get_ssh_superseded_by", time.Now())
+		return s.GetSSHSupersededBy(serial)
+	}
+	return nil, db.ErrNotImplemented
+}
+
+// DeleteExpired forwards the cleanup to the wrapped database, if it supports
+// it.
+func (d *instrumentedDB) DeleteExpired(ctx context.Context, now time.Time, batchSize int, fn func(table string, n int)) error {
+	if c, ok := d.AuthDB.(db.Cleaner); ok {
+		defer d.metrics.observeDB("delete_expired", time.Now())
+		return c.DeleteExpired(ctx, now, batchSize, fn)
+	}
+	return db.ErrNotImplemented
+}
+
+// NativeTTL returns true if the wrapped database expires the entries by
+// itself.
+func (d *instrumentedDB) NativeTTL() bool {
+	c, ok := d.AuthDB.(db.Cleaner)
+	return ok && c.NativeTTL()
+}
@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/smallstep/certificates/logging"
+)
+
+const namespace = "step_ca"
+
+// unmatchedEndpoint is the endpoint label used for requests that do not match
+// any route.
+const unmatchedEndpoint = "unmatched"
+
+// Config is the configuration of the metrics listener.
+type Config struct {
+	// Address is the address of the plain HTTP listener that serves the
+	// metrics, e.g. ":9090".
+	Address string `json:"address"`
+}
+
+// Validate validates the metrics configuration.
+func (c *Config) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case c.Address == "":
+		return errors.New("metrics.address cannot be empty")
+	default:
+		return nil
+	}
+}
+
+// Metrics holds the Prometheus collectors of the CA.
+//
+// The labels used are bounded: endpoints are the patterns of the routes, not
+// the paths requested, and provisioners are only reported on successful
+// requests, so they are always provisioners present in the configuration.
+type Metrics struct {
+	registry      *prometheus.Registry
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	certificates  *prometheus.CounterVec
+	tokenFailures *prometheus.CounterVec
+	dbOperations  *prometheus.HistogramVec
+	inFlight      prometheus.Gauge
+	shed          *prometheus.CounterVec
+	expired       *prometheus.CounterVec
+	backups       *prometheus.HistogramVec
+	backupSize    prometheus.Gauge
+	templates     *prometheus.CounterVec
+}
+
+// New creates the collectors of the CA and registers them, and the Go and
+// process collectors, in a new registry.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by endpoint, status code and provisioner.",
+		}, []string{"endpoint", "status", "provisioner"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of the HTTP requests by endpoint, status code and provisioner.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint", "status", "provisioner"}),
+		certificates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "certificates_total",
+			Help:      "Number of certificates issued, renewed and revoked by provisioner.",
+		}, []string{"operation", "provisioner"}),
+		tokenFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "token_validation_failures_total",
+			Help:      "Number of tokens rejected by reason.",
+		}, []string{"reason"}),
+		dbOperations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_operation_duration_seconds",
+			Help:      "Duration of the database operations by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "requests_in_flight",
+			Help:      "Number of sign and renew requests running.",
+		}),
+		shed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_shed_total",
+			Help:      "Number of sign and renew requests shed by the concurrency limit by reason.",
+		}, []string{"reason"}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "db_expired_entries_deleted_total",
+			Help:      "Number of expired used tokens, nonces and ACME objects deleted from the database by table.",
+		}, []string{"table"}),
+		backups: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_backup_duration_seconds",
+			Help:      "Duration of the database backups by result.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}, []string{"result"}),
+		backupSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "db_backup_size_bytes",
+			Help:      "Size of the last successful database backup.",
+		}),
+		templates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "template_limits_exceeded_total",
+			Help:      "Number of certificate templates that exceeded their limits by kind and limit.",
+		}, []string{"kind", "limit"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	if err := m.Register(m.registry); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Register registers the collectors of the CA in the given registerer. It
+// allows applications embedding the CA to expose the metrics in their own
+// registry.
+func (m *Metrics) Register(r prometheus.Registerer) error {
+	for _, c := range m.collectors() {
+		if err := r.Register(c); err != nil {
+			return errors.Wrap(err, "error registering metrics")
+		}
+	}
+	return nil
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.requests, m.duration, m.certificates, m.tokenFailures, m.dbOperations,
+		m.inFlight, m.shed, m.expired, m.backups, m.backupSize, m.templates,
+	}
+}
+
+// Handler returns the HTTP handler that serves the metrics in the Prometheus
+// exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware is an HTTP middleware that records the number and the duration of
+// the requests, and the certificates issued, renewed and revoked. It must wrap
+// the router, so the pattern of the route matched is available after serving
+// the request.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		rw := logging.NewResponseLogger(w)
+
+		// Add the routing context, chi will use it instead of creating a new
+		// one and we will be able to read the pattern matched.
+		rctx := chi.NewRouteContext()
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+		next.ServeHTTP(rw, r)
+
+		endpoint := rctx.RoutePattern()
+		if endpoint == "" || strings.HasSuffix(endpoint, "/*") {
+			endpoint = unmatchedEndpoint
+		}
+		status := rw.StatusCode()
+		var prov string
+		if status < http.StatusBadRequest {
+			prov = provisionerName(rw, rctx)
+		}
+
+		code := strconv.Itoa(status)
+		m.requests.WithLabelValues(endpoint, code, prov).Inc()
+		m.duration.WithLabelValues(endpoint, code, prov).Observe(time.Since(t).Seconds())
+		if op := certificateOperation(endpoint); op != "" && status < http.StatusBadRequest {
+			m.certificates.WithLabelValues(op, prov).Inc()
+		}
+	})
+}
+
+// TokenValidationFailed records a token rejected for the given reason.
+func (m *Metrics) TokenValidationFailed(reason string) {
+	m.tokenFailures.WithLabelValues(reason).Inc()
+}
+
+// ExpiredEntriesDeleted implements the authority.CleanupMeter interface, it
+// records the expired entries deleted from a table of the database. It is also
+// used for the expired ACME objects.
+func (m *Metrics) ExpiredEntriesDeleted(table string, n int) {
+	m.expired.WithLabelValues(table).Add(float64(n))
+}
+
+// DatabaseBackedUp implements the authority.BackupMeter interface, it records
+// the duration of a backup of the database and the size of the successful
+// ones.
+func (m *Metrics) DatabaseBackedUp(d time.Duration, size int64, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	} else {
+		m.backupSize.Set(float64(size))
+	}
+	m.backups.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// TemplateLimitExceeded implements the authority.TemplateMeter interface, it
+// records a certificate template of the given kind, x509 or ssh, that
+// exceeded its timeout or its output size, or panicked.
+func (m *Metrics) TemplateLimitExceeded(kind, limit string) {
+	m.templates.WithLabelValues(kind, limit).Inc()
+}
+
+// RequestAdmitted implements the ratelimit.Observer interface, it records a
+// request admitted by the concurrency limit.
+func (m *Metrics) RequestAdmitted() {
+	m.inFlight.Inc()
+}
+
+// RequestReleased implements the ratelimit.Observer interface, it records the
+// end of a request admitted by the concurrency limit.
+func (m *Metrics) RequestReleased() {
+	m.inFlight.Dec()
+}
+
+// RequestShed implements the ratelimit.Observer interface, it records a
+// request shed by the concurrency limit.
+func (m *Metrics) RequestShed(reason string) {
+	m.shed.WithLabelValues(reason).Inc()
+}
+
+// observeDB records the duration of a database operation started at t.
+func (m *Metrics) observeDB(operation string, t time.Time) {
+	m.dbOperations.WithLabelValues(operation).Observe(time.Since(t).Seconds())
+}
+
+// provisionerName returns the name of the provisioner used in the request. It
+// is the provisioner in the certificate logged by the API, or the provisioner
+// in the path in the ACME API.
+func provisionerName(rw logging.ResponseLogger, rctx *chi.Context) string {
+	if v, ok := rw.Fields()["provisioner"].(string); ok {
+		// The API logs the provisioner as "name (credential-id)".
+		if i := strings.Index(v, " ("); i >= 0 {
+			return v[:i]
+		}
+		return v
+	}
+	return rctx.URLParam("provisionerID")
+}
+
+// certificateOperation returns the operation, issued, renewed or revoked, of
+// the certificate endpoints, or an empty string for the rest.
+func certificateOperation(endpoint string) string {
+	endpoint = strings.TrimPrefix(endpoint, "/1.0")
+	switch {
+	case endpoint == "/sign", endpoint == "/ssh/sign", endpoint == "/sign-ssh":
+		return "issued"
+	case strings.HasSuffix(endpoint, "/finalize"):
+		return "issued"
+	case endpoint == "/renew", endpoint == "/re-sign", endpoint == "/ssh/renew", endpoint == "/ssh/rekey":
+		return "renewed"
+	case endpoint == "/revoke", endpoint == "/ssh/revoke":
+		return "revoked"
+	default:
+		return ""
+	}
+}
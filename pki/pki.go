@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority"
@@ -49,6 +50,14 @@ const (
 	templatesPath = "templates"
 )
 
+const (
+	// DefaultRootValidity is the default validity of a root certificate.
+	DefaultRootValidity = 10 * 365 * 24 * time.Hour
+	// DefaultIntermediateValidity is the default validity of an intermediate
+	// certificate.
+	DefaultIntermediateValidity = 5 * 365 * 24 * time.Hour
+)
+
 // GetDBPath returns the path where the file-system persistence is stored
 // based on the STEPPATH environment variable.
 func GetDBPath() string {
@@ -145,16 +154,29 @@ type PKI struct {
 	dnsNames                       []string
 	caURL                          string
 	enableSSH                      bool
+	base, db                       string
+	kty, crv                       string
+	size                           int
+	rootValidity                   time.Duration
+	intermediateValidity           time.Duration
 }
 
-// New creates a new PKI configuration.
+// New creates a new PKI configuration using the STEPPATH as the base
+// directory.
 func New() (*PKI, error) {
-	public := GetPublicPath()
-	private := GetSecretsPath()
-	config := GetConfigPath()
+	return NewWithPath(config.StepPath())
+}
+
+// NewWithPath creates a new PKI configuration that stores the certificates,
+// keys and configuration files in the given directory, using the same layout
+// as the STEPPATH.
+func NewWithPath(base string) (*PKI, error) {
+	public := filepath.Join(base, publicPath)
+	private := filepath.Join(base, privatePath)
+	config := filepath.Join(base, configPath)
 
 	// Create directories
-	dirs := []string{public, private, config, GetTemplatesPath()}
+	dirs := []string{public, private, config, filepath.Join(base, templatesPath)}
 	for _, name := range dirs {
 		if _, err := os.Stat(name); os.IsNotExist(err) {
 			if err = os.MkdirAll(name, 0700); err != nil {
@@ -171,9 +193,16 @@ func New() (*PKI, error) {
 
 	var err error
 	p := &PKI{
-		provisioner: "step-cli",
-		address:     "127.0.0.1:9000",
-		dnsNames:    []string{"127.0.0.1"},
+		provisioner:          "step-cli",
+		address:              "127.0.0.1:9000",
+		dnsNames:             []string{"127.0.0.1"},
+		base:                 base,
+		db:                   filepath.Join(base, dbPath),
+		kty:                  keys.DefaultKeyType,
+		crv:                  keys.DefaultKeyCurve,
+		size:                 keys.DefaultKeySize,
+		rootValidity:         DefaultRootValidity,
+		intermediateValidity: DefaultIntermediateValidity,
 	}
 	if p.root, err = getPath(public, "root_ca.crt"); err != nil {
 		return nil, err
@@ -241,6 +270,24 @@ func (p *PKI) SetCAURL(s string) {
 	p.caURL = s
 }
 
+// SetKeyType sets the key type, curve and size used to generate the root and
+// intermediate keys. It defaults to EC P-256.
+func (p *PKI) SetKeyType(kty, crv string, size int) {
+	p.kty, p.crv, p.size = kty, crv, size
+}
+
+// SetRootValidity sets the validity of the root certificate. It defaults to
+// 10 years.
+func (p *PKI) SetRootValidity(d time.Duration) {
+	p.rootValidity = d
+}
+
+// SetIntermediateValidity sets the validity of the intermediate certificate.
+// It defaults to 5 years.
+func (p *PKI) SetIntermediateValidity(d time.Duration) {
+	p.intermediateValidity = d
+}
+
 // GenerateKeyPairs generates the key pairs used by the certificate authority.
 func (p *PKI) GenerateKeyPairs(pass []byte) error {
 	var err error
@@ -255,7 +302,9 @@ func (p *PKI) GenerateKeyPairs(pass []byte) error {
 
 // GenerateRootCertificate generates a root certificate with the given name.
 func (p *PKI) GenerateRootCertificate(name string, pass []byte) (*x509.Certificate, interface{}, error) {
-	rootProfile, err := x509util.NewRootProfile(name)
+	rootProfile, err := x509util.NewRootProfile(name,
+		x509util.GenerateKeyPair(p.kty, p.crv, p.size),
+		x509util.WithNotBeforeAfterDuration(time.Time{}, time.Time{}, p.rootValidity))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -295,7 +344,9 @@ func (p *PKI) WriteRootCertificate(rootCrt *x509.Certificate, rootKey interface{
 // GenerateIntermediateCertificate generates an intermediate certificate with
 // the given name.
 func (p *PKI) GenerateIntermediateCertificate(name string, rootCrt *x509.Certificate, rootKey interface{}, pass []byte) error {
-	interProfile, err := x509util.NewIntermediateProfile(name, rootCrt, rootKey)
+	interProfile, err := x509util.NewIntermediateProfile(name, rootCrt, rootKey,
+		x509util.GenerateKeyPair(p.kty, p.crv, p.size),
+		x509util.WithNotBeforeAfterDuration(time.Time{}, time.Time{}, p.intermediateValidity))
 	if err != nil {
 		return err
 	}
@@ -367,7 +418,9 @@ func (p *PKI) tellPKI() {
 	}
 }
 
-type caDefaults struct {
+// Defaults is the representation of the defaults.json file used by the step
+// cli.
+type Defaults struct {
 	CAUrl       string `json:"ca-url"`
 	CAConfig    string `json:"ca-config"`
 	Fingerprint string `json:"fingerprint"`
@@ -422,7 +475,7 @@ func (p *PKI) GenerateConfig(opt ...Option) (*authority.Config, error) {
 		Logger:           []byte(`{"format": "text"}`),
 		DB: &db.Config{
 			Type:       "badger",
-			DataSource: GetDBPath(),
+			DataSource: p.db,
 		},
 		AuthorityConfig: &authority.AuthConfig{
 			DisableIssuedAtCheck: false,
@@ -457,57 +510,75 @@ func (p *PKI) GenerateConfig(opt ...Option) (*authority.Config, error) {
 	return config, nil
 }
 
-// Save stores the pki on a json file that will be used as the certificate
-// authority configuration.
-func (p *PKI) Save(opt ...Option) error {
-	p.tellPKI()
+// GenerateDefaults returns the defaults.json configuration used by the step
+// cli to connect to the CA.
+func (p *PKI) GenerateDefaults() (*Defaults, error) {
+	caURL := p.caURL
+	if caURL == "" {
+		_, port, err := net.SplitHostPort(p.address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing %s", p.address)
+		}
+		if port == "443" {
+			caURL = fmt.Sprintf("https://%s", p.dnsNames[0])
+		} else {
+			caURL = fmt.Sprintf("https://%s:%s", p.dnsNames[0], port)
+		}
+	}
+	return &Defaults{
+		Root:        p.root,
+		CAConfig:    p.config,
+		CAUrl:       caURL,
+		Fingerprint: p.rootFingerprint,
+	}, nil
+}
 
+// Write stores the ca.json, the defaults.json and the templates in the PKI
+// directory and returns the generated configuration. Unlike Save, it does not
+// print anything.
+func (p *PKI) Write(opt ...Option) (*authority.Config, error) {
 	// Generate and write ca.json
 	config, err := p.GenerateConfig(opt...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	b, err := json.MarshalIndent(config, "", "   ")
 	if err != nil {
-		return errors.Wrapf(err, "error marshaling %s", p.config)
+		return nil, errors.Wrapf(err, "error marshaling %s", p.config)
 	}
 	if err = utils.WriteFile(p.config, b, 0644); err != nil {
-		return errs.FileError(err, p.config)
-	}
-
-	// Generate the CA URL.
-	if p.caURL == "" {
-		p.caURL = p.dnsNames[0]
-		var port string
-		_, port, err = net.SplitHostPort(p.address)
-		if err != nil {
-			return errors.Wrapf(err, "error parsing %s", p.address)
-		}
-		if port == "443" {
-			p.caURL = fmt.Sprintf("https://%s", p.caURL)
-		} else {
-			p.caURL = fmt.Sprintf("https://%s:%s", p.caURL, port)
-		}
+		return nil, errs.FileError(err, p.config)
 	}
 
 	// Generate and write defaults.json
-	defaults := &caDefaults{
-		Root:        p.root,
-		CAConfig:    p.config,
-		CAUrl:       p.caURL,
-		Fingerprint: p.rootFingerprint,
+	defaults, err := p.GenerateDefaults()
+	if err != nil {
+		return nil, err
 	}
 	b, err = json.MarshalIndent(defaults, "", "   ")
 	if err != nil {
-		return errors.Wrapf(err, "error marshaling %s", p.defaults)
+		return nil, errors.Wrapf(err, "error marshaling %s", p.defaults)
 	}
 	if err = utils.WriteFile(p.defaults, b, 0644); err != nil {
-		return errs.FileError(err, p.defaults)
+		return nil, errs.FileError(err, p.defaults)
 	}
 
 	// Generate and write templates
-	if err := generateTemplates(config.Templates); err != nil {
+	if err := generateTemplates(p.base, config.Templates); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Save stores the pki on a json file that will be used as the certificate
+// authority configuration.
+func (p *PKI) Save(opt ...Option) error {
+	p.tellPKI()
+
+	config, err := p.Write(opt...)
+	if err != nil {
 		return err
 	}
 
@@ -515,7 +586,7 @@ func (p *PKI) Save(opt ...Option) error {
 		ui.PrintSelected("Database folder", config.DB.DataSource)
 	}
 	if config.Templates != nil {
-		ui.PrintSelected("Templates folder", GetTemplatesPath())
+		ui.PrintSelected("Templates folder", filepath.Join(p.base, templatesPath))
 	}
 
 	ui.PrintSelected("Default configuration", p.defaults)
@@ -0,0 +1,183 @@
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/crypto/randutil"
+	"github.com/smallstep/cli/jose"
+)
+
+func newTestPKI(t *testing.T, pass []byte, fn func(p *PKI)) (*PKI, string) {
+	dir, err := ioutil.TempDir("", "pki")
+	assert.FatalError(t, err)
+
+	p, err := NewWithPath(dir)
+	assert.FatalError(t, err)
+	p.SetDNSNames([]string{"ca.smallstep.com"})
+	if fn != nil {
+		fn(p)
+	}
+	assert.FatalError(t, p.GenerateKeyPairs(pass))
+	rootCrt, rootKey, err := p.GenerateRootCertificate("Test Root CA", pass)
+	assert.FatalError(t, err)
+	assert.FatalError(t, p.GenerateIntermediateCertificate("Test Intermediate CA", rootCrt, rootKey, pass))
+	return p, dir
+}
+
+func generateTestToken(t *testing.T, p *provisioner.JWK, pass []byte, sub string, sans []string) string {
+	jwe, err := jose.ParseEncrypted(p.EncryptedKey)
+	assert.FatalError(t, err)
+	b, err := jwe.Decrypt(pass)
+	assert.FatalError(t, err)
+	var jwk jose.JSONWebKey
+	assert.FatalError(t, json.Unmarshal(b, &jwk))
+
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("kid", jwk.KeyID)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key}, so)
+	assert.FatalError(t, err)
+
+	id, err := randutil.ASCII(64)
+	assert.FatalError(t, err)
+	now := time.Now()
+	claims := struct {
+		jose.Claims
+		SANs []string `json:"sans"`
+	}{
+		Claims: jose.Claims{
+			ID:        id,
+			Subject:   sub,
+			Issuer:    p.Name,
+			IssuedAt:  jose.NewNumericDate(now),
+			NotBefore: jose.NewNumericDate(now),
+			Expiry:    jose.NewNumericDate(now.Add(5 * time.Minute)),
+			Audience:  []string{"https://ca.smallstep.com/1.0/sign"},
+		},
+		SANs: sans,
+	}
+	tok, err := jose.Signed(sig).Claims(claims).CompactSerialize()
+	assert.FatalError(t, err)
+	return tok
+}
+
+func TestPKI_Write(t *testing.T) {
+	pass := []byte("password")
+	p, dir := newTestPKI(t, pass, nil)
+	defer os.RemoveAll(dir)
+
+	config, err := p.Write(WithoutDB())
+	assert.FatalError(t, err)
+	assert.Nil(t, config.DB)
+	assert.Equals(t, filepath.Join(dir, "config", "ca.json"), p.GetCAConfigPath())
+
+	// defaults.json
+	b, err := ioutil.ReadFile(filepath.Join(dir, "config", "defaults.json"))
+	assert.FatalError(t, err)
+	var defaults Defaults
+	assert.FatalError(t, json.Unmarshal(b, &defaults))
+	assert.Equals(t, Defaults{
+		CAUrl:       "https://ca.smallstep.com:9000",
+		CAConfig:    p.GetCAConfigPath(),
+		Fingerprint: p.GetRootFingerprint(),
+		Root:        filepath.Join(dir, "certs", "root_ca.crt"),
+	}, defaults)
+
+	// Default key types and validities
+	root, err := pemutil.ReadCertificate(filepath.Join(dir, "certs", "root_ca.crt"))
+	assert.FatalError(t, err)
+	intermediate, err := pemutil.ReadCertificate(filepath.Join(dir, "certs", "intermediate_ca.crt"))
+	assert.FatalError(t, err)
+	assert.FatalError(t, intermediate.CheckSignatureFrom(root))
+	assert.Equals(t, DefaultRootValidity, root.NotAfter.Sub(root.NotBefore))
+	assert.Equals(t, DefaultIntermediateValidity, intermediate.NotAfter.Sub(intermediate.NotBefore))
+	pub, ok := intermediate.PublicKey.(*ecdsa.PublicKey)
+	assert.Fatal(t, ok)
+	assert.Equals(t, elliptic.P256(), pub.Curve)
+
+	// Start an authority with the generated configuration and sign a
+	// certificate.
+	c, err := authority.LoadConfiguration(p.GetCAConfigPath())
+	assert.FatalError(t, err)
+	c.Password = string(pass)
+	a, err := authority.New(c)
+	assert.FatalError(t, err)
+	defer a.Shutdown()
+
+	jwk, ok := c.AuthorityConfig.Provisioners[0].(*provisioner.JWK)
+	assert.Fatal(t, ok)
+	token := generateTestToken(t, jwk, pass, "test.smallstep.com", []string{"test.smallstep.com"})
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod)
+	signOpts, err := a.Authorize(ctx, token)
+	assert.FatalError(t, err)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "test.smallstep.com"},
+		DNSNames: []string{"test.smallstep.com"},
+	}, priv)
+	assert.FatalError(t, err)
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	assert.FatalError(t, err)
+
+	certs, err := a.Sign(csr, provisioner.Options{}, signOpts...)
+	assert.FatalError(t, err)
+	assert.Len(t, 2, certs)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       "test.smallstep.com",
+	})
+	assert.FatalError(t, err)
+}
+
+func TestPKI_SetKeyType(t *testing.T) {
+	pass := []byte("password")
+	p, dir := newTestPKI(t, pass, func(p *PKI) {
+		p.SetKeyType("RSA", "", 2048)
+		p.SetRootValidity(24 * time.Hour)
+		p.SetIntermediateValidity(12 * time.Hour)
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := p.Write()
+	assert.FatalError(t, err)
+
+	root, err := pemutil.ReadCertificate(filepath.Join(dir, "certs", "root_ca.crt"))
+	assert.FatalError(t, err)
+	intermediate, err := pemutil.ReadCertificate(filepath.Join(dir, "certs", "intermediate_ca.crt"))
+	assert.FatalError(t, err)
+	assert.Equals(t, 24*time.Hour, root.NotAfter.Sub(root.NotBefore))
+	assert.Equals(t, 12*time.Hour, intermediate.NotAfter.Sub(intermediate.NotBefore))
+	for _, crt := range []*x509.Certificate{root, intermediate} {
+		pub, ok := crt.PublicKey.(*rsa.PublicKey)
+		assert.Fatal(t, ok)
+		assert.Equals(t, 2048, pub.N.BitLen())
+	}
+
+	c, err := p.GenerateConfig()
+	assert.FatalError(t, err)
+	assert.Equals(t, filepath.Join(dir, "db"), c.DB.DataSource)
+}
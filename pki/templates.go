@@ -6,74 +6,16 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/templates"
-	"github.com/smallstep/cli/config"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/utils"
 )
 
 // SSHTemplates contains the configuration of default templates used on ssh.
 // Relative paths are relative to the StepPath.
-var SSHTemplates = &templates.SSHTemplates{
-	User: []templates.Template{
-		{Name: "include.tpl", Type: templates.Snippet, TemplatePath: "templates/ssh/include.tpl", Path: "~/.ssh/config", Comment: "#"},
-		{Name: "config.tpl", Type: templates.File, TemplatePath: "templates/ssh/config.tpl", Path: "ssh/config", Comment: "#"},
-		{Name: "known_hosts.tpl", Type: templates.File, TemplatePath: "templates/ssh/known_hosts.tpl", Path: "ssh/known_hosts", Comment: "#"},
-	},
-	Host: []templates.Template{
-		{Name: "sshd_config.tpl", Type: templates.Snippet, TemplatePath: "templates/ssh/sshd_config.tpl", Path: "/etc/ssh/sshd_config", Comment: "#"},
-		{Name: "ca.tpl", Type: templates.Snippet, TemplatePath: "templates/ssh/ca.tpl", Path: "/etc/ssh/ca.pub", Comment: "#"},
-	},
-}
+var SSHTemplates = templates.DefaultSSHTemplates
 
 // SSHTemplateData contains the data of the default templates used on ssh.
-var SSHTemplateData = map[string]string{
-	// include.tpl adds the step ssh config file.
-	//
-	// Note: on windows `Include C:\...` is treated as a relative path.
-	"include.tpl": `Host *
-{{- if or .User.GOOS "none" | eq "windows" }}
-	Include "{{ .User.StepPath | replace "\\" "/" | trimPrefix "C:" }}/ssh/config"
-{{- else }}
-	Include "{{.User.StepPath}}/ssh/config"
-{{- end }}`,
-
-	// config.tpl is the step ssh config file, it includes the Match rule and
-	// references the step known_hosts file.
-	//
-	// Note: on windows ProxyCommand requires the full path
-	"config.tpl": `Match exec "step ssh check-host %h"
-	ForwardAgent yes
-{{- if .User.User }}
-	User {{.User.User}}
-{{- end }}
-{{- if or .User.GOOS "none" | eq "windows" }}
-	UserKnownHostsFile "{{.User.StepPath}}\ssh\known_hosts"
-	ProxyCommand C:\Windows\System32\cmd.exe /c step ssh proxycommand %r %h %p
-{{- else }}
-	UserKnownHostsFile "{{.User.StepPath}}/ssh/known_hosts"
-	ProxyCommand step ssh proxycommand %r %h %p
-{{- end }}
-`,
-
-	// known_hosts.tpl authorizes the ssh hosts key
-	"known_hosts.tpl": `@cert-authority * {{.Step.SSH.HostKey.Type}} {{.Step.SSH.HostKey.Marshal | toString | b64enc}}
-{{- range .Step.SSH.HostFederatedKeys}}
-@cert-authority * {{.Type}} {{.Marshal | toString | b64enc}}
-{{- end }}
-`,
-
-	// sshd_config.tpl adds the configuration to support certificates
-	"sshd_config.tpl": `TrustedUserCAKeys /etc/ssh/ca.pub
-HostCertificate /etc/ssh/{{.User.Certificate}}
-HostKey /etc/ssh/{{.User.Key}}`,
-
-	// ca.tpl contains the public key used to authorized clients
-	"ca.tpl": `{{.Step.SSH.UserKey.Type}} {{.Step.SSH.UserKey.Marshal | toString | b64enc}}
-{{- range .Step.SSH.UserFederatedKeys}}
-{{.Type}} {{.Marshal | toString | b64enc}}
-{{- end }}
-`,
-}
+var SSHTemplateData = templates.DefaultSSHTemplateData
 
 // getTemplates returns all the templates enabled
 func (p *PKI) getTemplates() *templates.Templates {
@@ -87,17 +29,17 @@ func (p *PKI) getTemplates() *templates.Templates {
 	}
 }
 
-// generateTemplates generates given templates.
-func generateTemplates(t *templates.Templates) error {
+// generateTemplates generates given templates. Relative template paths are
+// relative to the given base directory.
+func generateTemplates(base string, t *templates.Templates) error {
 	if t == nil {
 		return nil
 	}
 
-	base := GetTemplatesPath()
 	// Generate SSH templates
 	if t.SSH != nil {
 		// all ssh templates are under ssh:
-		sshDir := filepath.Join(base, "ssh")
+		sshDir := filepath.Join(base, templatesPath, "ssh")
 		if _, err := os.Stat(sshDir); os.IsNotExist(err) {
 			if err = os.MkdirAll(sshDir, 0700); err != nil {
 				return errs.FileError(err, sshDir)
@@ -109,7 +51,7 @@ func generateTemplates(t *templates.Templates) error {
 			if !ok {
 				return errors.Errorf("template %s does not exists", t.Name)
 			}
-			if err := utils.WriteFile(config.StepAbs(t.TemplatePath), []byte(data), 0644); err != nil {
+			if err := utils.WriteFile(absPath(base, t.TemplatePath), []byte(data), 0644); err != nil {
 				return err
 			}
 		}
@@ -118,7 +60,7 @@ func generateTemplates(t *templates.Templates) error {
 			if !ok {
 				return errors.Errorf("template %s does not exists", t.Name)
 			}
-			if err := utils.WriteFile(config.StepAbs(t.TemplatePath), []byte(data), 0644); err != nil {
+			if err := utils.WriteFile(absPath(base, t.TemplatePath), []byte(data), 0644); err != nil {
 				return err
 			}
 		}
@@ -126,3 +68,12 @@ func generateTemplates(t *templates.Templates) error {
 
 	return nil
 }
+
+// absPath returns the given path if it is absolute, or the path joined to the
+// base directory if it is relative.
+func absPath(base, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons used to shed a request.
+const (
+	ShedQueueFull = "queue_full"
+	ShedTimeout   = "timeout"
+)
+
+// Observer receives the events of a ConcurrencyLimiter, it allows to export
+// them as metrics.
+type Observer interface {
+	// RequestAdmitted is called when a request starts running.
+	RequestAdmitted()
+	// RequestReleased is called when an admitted request finishes.
+	RequestReleased()
+	// RequestShed is called when a request is rejected with the reason, one
+	// of ShedQueueFull or ShedTimeout.
+	RequestShed(reason string)
+}
+
+// ConcurrencyLimiter limits the number of requests running at the same time.
+// The requests over the limit wait in a bounded queue until a running request
+// finishes, or they are shed if the queue is full or they have waited for too
+// long.
+type ConcurrencyLimiter struct {
+	shed     uint64 // first for 64-bit alignment of atomic operations
+	slots    chan struct{}
+	queue    chan struct{}
+	timeout  time.Duration
+	observer Observer
+}
+
+// NewConcurrencyLimiter creates a limiter that runs up to maxInFlight requests
+// at the same time, and queues up to maxQueued requests for up to timeout. The
+// observer is optional.
+func NewConcurrencyLimiter(maxInFlight, maxQueued int, timeout time.Duration, observer Observer) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:    make(chan struct{}, maxInFlight),
+		queue:    make(chan struct{}, maxQueued),
+		timeout:  timeout,
+		observer: observer,
+	}
+}
+
+// Acquire waits for a slot to run a request. If the request is admitted, it
+// returns true and the function that must be called when the request
+// finishes. It returns false if the request has been shed.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), ok bool) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), true
+	default:
+	}
+
+	// Wait in the queue if there is room.
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		l.reject(ShedQueueFull)
+		return nil, false
+	}
+	defer func() { <-l.queue }()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), true
+	case <-timer.C:
+		l.reject(ShedTimeout)
+		return nil, false
+	case <-ctx.Done():
+		l.reject(ShedTimeout)
+		return nil, false
+	}
+}
+
+// InFlight returns the number of requests running.
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+// Queued returns the number of requests waiting for a slot.
+func (l *ConcurrencyLimiter) Queued() int {
+	return len(l.queue)
+}
+
+// Shed returns the number of requests shed.
+func (l *ConcurrencyLimiter) Shed() uint64 {
+	return atomic.LoadUint64(&l.shed)
+}
+
+func (l *ConcurrencyLimiter) admit() func() {
+	if l.observer != nil {
+		l.observer.RequestAdmitted()
+	}
+	var once int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			<-l.slots
+			if l.observer != nil {
+				l.observer.RequestReleased()
+			}
+		}
+	}
+}
+
+func (l *ConcurrencyLimiter) reject(reason string) {
+	atomic.AddUint64(&l.shed, 1)
+	if l.observer != nil {
+		l.observer.RequestShed(reason)
+	}
+}
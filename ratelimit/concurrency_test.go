@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+type mockObserver struct {
+	mu       sync.Mutex
+	inFlight int
+	shed     map[string]int
+}
+
+func (o *mockObserver) RequestAdmitted() {
+	o.mu.Lock()
+	o.inFlight++
+	o.mu.Unlock()
+}
+
+func (o *mockObserver) RequestReleased() {
+	o.mu.Lock()
+	o.inFlight--
+	o.mu.Unlock()
+}
+
+func (o *mockObserver) RequestShed(reason string) {
+	o.mu.Lock()
+	o.shed[reason]++
+	o.mu.Unlock()
+}
+
+func TestConcurrencyLimiter_Acquire(t *testing.T) {
+	o := &mockObserver{shed: make(map[string]int)}
+	l := NewConcurrencyLimiter(1, 1, 50*time.Millisecond, o)
+
+	release, ok := l.Acquire(context.Background())
+	assert.True(t, ok)
+	assert.Equals(t, 1, l.InFlight())
+	assert.Equals(t, 1, o.inFlight)
+
+	// Queued until the timeout
+	_, ok = l.Acquire(context.Background())
+	assert.False(t, ok)
+	assert.Equals(t, 1, o.shed[ShedTimeout])
+
+	// Queued until the running request finishes
+	done := make(chan bool)
+	go func() {
+		r, ok := l.Acquire(context.Background())
+		if ok {
+			r()
+		}
+		done <- ok
+	}()
+	for l.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Queue is full
+	_, ok = l.Acquire(context.Background())
+	assert.False(t, ok)
+	assert.Equals(t, 1, o.shed[ShedQueueFull])
+
+	release()
+	release() // no-op
+	assert.True(t, <-done)
+	assert.Equals(t, 0, l.InFlight())
+	assert.Equals(t, 0, l.Queued())
+	assert.Equals(t, 0, o.inFlight)
+	assert.Equals(t, uint64(2), l.Shed())
+
+	// Canceled context
+	release, ok = l.Acquire(context.Background())
+	assert.True(t, ok)
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok = l.Acquire(ctx)
+	assert.False(t, ok)
+	assert.Equals(t, 2, o.shed[ShedTimeout])
+}
+
+// TestConcurrencyLimiter_load sends a burst of requests much larger than the
+// limit and checks that the admitted requests finish in a bounded time while
+// the rest are shed.
+func TestConcurrencyLimiter_load(t *testing.T) {
+	const (
+		maxInFlight = 4
+		maxQueued   = 8
+		requests    = 200
+		work        = 10 * time.Millisecond
+		timeout     = 50 * time.Millisecond
+	)
+	l := NewConcurrencyLimiter(maxInFlight, maxQueued, timeout, nil)
+
+	var (
+		wg        sync.WaitGroup
+		running   int32
+		peak      int32
+		admitted  int32
+		slowest   int64
+		startLine = make(chan struct{})
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-startLine
+			t0 := time.Now()
+			release, ok := l.Acquire(context.Background())
+			if !ok {
+				return
+			}
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(work)
+			atomic.AddInt32(&running, -1)
+			release()
+
+			atomic.AddInt32(&admitted, 1)
+			d := int64(time.Since(t0))
+			for {
+				s := atomic.LoadInt64(&slowest)
+				if d <= s || atomic.CompareAndSwapInt64(&slowest, s, d) {
+					break
+				}
+			}
+		}()
+	}
+	close(startLine)
+	wg.Wait()
+
+	if peak > maxInFlight {
+		t.Errorf("peak of %d requests in flight, want at most %d", peak, maxInFlight)
+	}
+	if admitted == 0 || l.Shed() == 0 {
+		t.Errorf("admitted %d requests and shed %d, want both greater than 0", admitted, l.Shed())
+	}
+	if int(admitted)+int(l.Shed()) != requests {
+		t.Errorf("admitted %d requests and shed %d, want a total of %d", admitted, l.Shed(), requests)
+	}
+	// An admitted request waits at most the queue timeout, allow a generous
+	// margin for slow machines.
+	if max := timeout + work + 200*time.Millisecond; time.Duration(slowest) > max {
+		t.Errorf("slowest admitted request took %s, want less than %s", time.Duration(slowest), max)
+	}
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// purgeInterval is the interval used to remove the buckets that have been
+// refilled, so the number of buckets does not grow with every key seen.
+const purgeInterval = time.Minute
+
+var now = time.Now
+
+// Limit is the configuration of a token bucket. The bucket is refilled with
+// RequestsPerSecond tokens per second, up to Burst tokens.
+type Limit struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+}
+
+// Validate validates the limit, nil is ok.
+func (l *Limit) Validate() error {
+	switch {
+	case l == nil:
+		return nil
+	case l.RequestsPerSecond <= 0:
+		return errors.New("requestsPerSecond must be greater than 0")
+	case l.Burst < 1:
+		return errors.New("burst must be greater than 0")
+	default:
+		return nil
+	}
+}
+
+// Limiter is a set of token buckets with the same limit, each bucket is
+// identified by a key, e.g. the provisioner or the IP of a client.
+type Limiter struct {
+	mu        sync.Mutex
+	limit     Limit
+	buckets   map[string]*bucket
+	nextPurge time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a new limiter with the given limit.
+func New(limit Limit) *Limiter {
+	return &Limiter{
+		limit:     limit,
+		buckets:   make(map[string]*bucket),
+		nextPurge: now().Add(purgeInterval),
+	}
+}
+
+// Allow takes a token from the bucket with the given key. If the bucket is
+// empty, it returns false and the time to wait until the next token is
+// available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.take(key, true)
+}
+
+// Check returns false and the time to wait until the next token is available
+// if the bucket with the given key is empty, like Allow, but it does not take
+// a token from the bucket.
+func (l *Limiter) Check(key string) (bool, time.Duration) {
+	return l.take(key, false)
+}
+
+func (l *Limiter) take(key string, consume bool) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t := now()
+	if t.After(l.nextPurge) {
+		l.purge(t)
+	}
+
+	b, ok := l.buckets[key]
+	switch {
+	case ok:
+		b.refill(t, l.limit)
+	case !consume:
+		return true, 0
+	default:
+		b = &bucket{tokens: float64(l.limit.Burst), last: t}
+		l.buckets[key] = b
+	}
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / l.limit.RequestsPerSecond
+		return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+	}
+	if consume {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// purge removes the buckets that are full.
+func (l *Limiter) purge(t time.Time) {
+	for key, b := range l.buckets {
+		b.refill(t, l.limit)
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.nextPurge = t.Add(purgeInterval)
+}
+
+func (b *bucket) refill(t time.Time, limit Limit) {
+	if elapsed := t.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.RequestsPerSecond)
+		b.last = t
+	}
+}
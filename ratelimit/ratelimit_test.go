@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func mockNow(t time.Time) func() {
+	old := now
+	now = func() time.Time { return t }
+	return func() { now = old }
+}
+
+func TestLimit_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   *Limit
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"ok", &Limit{RequestsPerSecond: 0.5, Burst: 1}, false},
+		{"fail requestsPerSecond", &Limit{RequestsPerSecond: 0, Burst: 1}, true},
+		{"fail burst", &Limit{RequestsPerSecond: 1, Burst: 0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limit.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Limit.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	t0 := time.Now()
+	defer mockNow(t0)()
+
+	l := New(Limit{RequestsPerSecond: 2, Burst: 2})
+
+	// Burst
+	for i := 0; i < 2; i++ {
+		ok, wait := l.Allow("foo")
+		assert.True(t, ok)
+		assert.Equals(t, time.Duration(0), wait)
+	}
+	ok, wait := l.Allow("foo")
+	assert.False(t, ok)
+	assert.Equals(t, 500*time.Millisecond, wait)
+
+	// Other buckets are not affected
+	ok, _ = l.Allow("bar")
+	assert.True(t, ok)
+
+	// Refill
+	now = func() time.Time { return t0.Add(250 * time.Millisecond) }
+	ok, wait = l.Allow("foo")
+	assert.False(t, ok)
+	assert.Equals(t, 250*time.Millisecond, wait)
+	now = func() time.Time { return t0.Add(500 * time.Millisecond) }
+	ok, _ = l.Allow("foo")
+	assert.True(t, ok)
+
+	// Purge full buckets
+	now = func() time.Time { return t0.Add(2 * purgeInterval) }
+	ok, _ = l.Allow("foo")
+	assert.True(t, ok)
+	assert.Len(t, 1, l.buckets)
+}
+
+func TestLimiter_Check(t *testing.T) {
+	t0 := time.Now()
+	defer mockNow(t0)()
+
+	l := New(Limit{RequestsPerSecond: 2, Burst: 1})
+
+	// Checking does not take tokens nor create buckets.
+	for i := 0; i < 3; i++ {
+		ok, wait := l.Check("foo")
+		assert.True(t, ok)
+		assert.Equals(t, time.Duration(0), wait)
+	}
+	assert.Len(t, 0, l.buckets)
+
+	ok, _ := l.Allow("foo")
+	assert.True(t, ok)
+	ok, wait := l.Check("foo")
+	assert.False(t, ok)
+	assert.Equals(t, 500*time.Millisecond, wait)
+
+	now = func() time.Time { return t0.Add(500 * time.Millisecond) }
+	ok, _ = l.Check("foo")
+	assert.True(t, ok)
+	ok, _ = l.Allow("foo")
+	assert.True(t, ok)
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/scep"
+)
+
+const (
+	opnGetCACert    = "GetCACert"
+	opnGetCACaps    = "GetCACaps"
+	opnPKIOperation = "PKIOperation"
+)
+
+type contextKey string
+
+const provisionerContextKey = contextKey("provisioner")
+
+type nextHTTP = func(http.ResponseWriter, *http.Request)
+
+func provisionerFromContext(r *http.Request) (*provisioner.SCEP, error) {
+	val, ok := r.Context().Value(provisionerContextKey).(*provisioner.SCEP)
+	if !ok || val == nil {
+		return nil, errs.InternalServer("provisioner expected in request context")
+	}
+	return val, nil
+}
+
+// New returns a new SCEP API router.
+func New(scepAuth scep.Interface) api.RouterHandler {
+	return &Handler{scepAuth}
+}
+
+// Handler is the SCEP request handler.
+type Handler struct {
+	Auth scep.Interface
+}
+
+// Route traffic and implement the Router interface.
+func (h *Handler) Route(r api.Router) {
+	r.MethodFunc("GET", "/{provisionerID}", h.lookupProvisioner(h.Get))
+	r.MethodFunc("POST", "/{provisionerID}", h.lookupProvisioner(h.Post))
+}
+
+// Get handles the GetCACert, GetCACaps and PKIOperation GET requests.
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch query.Get("operation") {
+	case opnGetCACert:
+		h.GetCACert(w, r)
+	case opnGetCACaps:
+		h.GetCACaps(w, r)
+	case opnPKIOperation:
+		// Some clients do not escape the message, so '+' might have been
+		// decoded as a space.
+		message := strings.Replace(query.Get("message"), " ", "+", -1)
+		data, err := base64.StdEncoding.DecodeString(message)
+		if err != nil {
+			api.WriteError(w, errs.Wrap(http.StatusBadRequest, err, "error decoding message"))
+			return
+		}
+		h.pkiOperation(w, r, data)
+	default:
+		api.WriteError(w, errs.BadRequest("unsupported operation '%s'", query.Get("operation")))
+	}
+}
+
+// Post handles the PKIOperation POST requests.
+func (h *Handler) Post(w http.ResponseWriter, r *http.Request) {
+	if op := r.URL.Query().Get("operation"); op != opnPKIOperation {
+		api.WriteError(w, errs.BadRequest("unsupported operation '%s'", op))
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		api.WriteError(w, errs.Wrap(http.StatusBadRequest, err, "error reading request body"))
+		return
+	}
+	h.pkiOperation(w, r, data)
+}
+
+// GetCACert returns the CA certificates. If there is only one certificate it
+// is returned in DER format, otherwise it returns a degenerate PKCS#7 with
+// the certificates.
+func (h *Handler) GetCACert(w http.ResponseWriter, r *http.Request) {
+	p, err := provisionerFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	certs := h.Auth.GetCACertificates(p)
+	if len(certs) == 1 {
+		writeResponse(w, "application/x-x509-ca-cert", certs[0].Raw)
+		return
+	}
+	data, err := scep.DegenerateCertificates(certs)
+	if err != nil {
+		api.WriteError(w, errs.Wrap(http.StatusInternalServerError, err, "error creating GetCACert response"))
+		return
+	}
+	writeResponse(w, "application/x-x509-ca-ra-cert", data)
+}
+
+// GetCACaps returns the capabilities of the CA.
+func (h *Handler) GetCACaps(w http.ResponseWriter, r *http.Request) {
+	p, err := provisionerFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	caps := h.Auth.GetCACaps(p)
+	writeResponse(w, "text/plain", []byte(strings.Join(caps, "\n")))
+}
+
+func (h *Handler) pkiOperation(w http.ResponseWriter, r *http.Request, data []byte) {
+	p, err := provisionerFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	resp, err := h.Auth.PKIOperation(r.Context(), p, data)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	// Record the result of the operation in the audit log.
+	api.LogEnabledResponse(w, resp)
+	if resp.Err != nil {
+		api.LogError(w, resp.Err)
+	}
+	writeResponse(w, "application/x-pki-message", resp.Data)
+}
+
+func (h *Handler) lookupProvisioner(next nextHTTP) nextHTTP {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "provisionerID")
+		provID, err := url.PathUnescape(name)
+		if err != nil {
+			api.WriteError(w, errs.Wrapf(http.StatusBadRequest, err, "error url unescaping provisioner id '%s'", name))
+			return
+		}
+		p, err := h.Auth.LoadProvisionerByID("scep/" + provID)
+		if err != nil {
+			api.WriteError(w, errs.Wrapf(http.StatusNotFound, err, "provisioner '%s' not found", provID))
+			return
+		}
+		prov, ok := p.(*provisioner.SCEP)
+		if !ok {
+			api.WriteError(w, errs.NotFound("provisioner '%s' not found", provID))
+			return
+		}
+		ctx := context.WithValue(r.Context(), provisionerContextKey, prov)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func writeResponse(w http.ResponseWriter, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		api.LogError(w, errors.Wrap(err, "error writing response"))
+	}
+}
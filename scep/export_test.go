@@ -0,0 +1,94 @@
+package scep
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// Content encryption algorithms used by the SCEP clients in the tests.
+var (
+	EncryptionDESEDE3CBC = oidEncryptionDESEDE3CBC
+	EncryptionAES128CBC  = oidEncryptionAES128CBC
+	EncryptionAES256CBC  = oidEncryptionAES256CBC
+)
+
+// Message types used by the SCEP clients in the tests.
+const (
+	MessageTypeRenewalReq     = messageTypeRenewalReq
+	MessageTypePKCSReq        = messageTypePKCSReq
+	MessageTypeGetCertInitial = messageTypeGetCertInitial
+)
+
+// CertRep is a parsed CertRep message.
+type CertRep struct {
+	MessageType    string
+	PKIStatus      string
+	FailInfo       string
+	TransactionID  string
+	RecipientNonce []byte
+	Signer         *x509.Certificate
+	Certificates   []*x509.Certificate
+}
+
+// NewPKIMessage returns a pkiMessage, as created by a SCEP client, with the
+// given certificate request encrypted for the recipient.
+func NewPKIMessage(messageType, transactionID string, nonce, csr []byte, recipient *x509.Certificate, alg asn1.ObjectIdentifier, signer *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	envelope, err := encryptEnvelopedData(csr, recipient, alg)
+	if err != nil {
+		return nil, err
+	}
+	var attrs []attribute
+	for _, v := range []struct {
+		oid    asn1.ObjectIdentifier
+		value  interface{}
+		params string
+	}{
+		{oidSCEPMessageType, messageType, "printable"},
+		{oidSCEPTransactionID, transactionID, "printable"},
+		{oidSCEPSenderNonce, nonce, ""},
+	} {
+		attr, err := newAttribute(v.oid, v.value, v.params)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	return signData(envelope, signer, key, nil, attrs)
+}
+
+// ParseCertRep verifies and parses a CertRep message, decrypting the issued
+// certificates with the given key.
+func ParseCertRep(data []byte, recipient *x509.Certificate, key *rsa.PrivateKey) (*CertRep, error) {
+	sm, err := parseSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+	rep := &CertRep{Signer: sm.signer}
+	sm.attribute(oidSCEPMessageType, &rep.MessageType)
+	sm.attribute(oidSCEPPKIStatus, &rep.PKIStatus)
+	sm.attribute(oidSCEPFailInfo, &rep.FailInfo)
+	sm.attribute(oidSCEPTransactionID, &rep.TransactionID)
+	sm.attribute(oidSCEPRecipientNonce, &rep.RecipientNonce)
+	if rep.PKIStatus != pkiStatusSuccess {
+		return rep, nil
+	}
+	certs, err := decryptEnvelopedData(sm.content, recipient, key)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Certificates, err = ParseCertificates(certs); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// ParseCertificates returns the certificates in a degenerate certs-only
+// signed-data.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	sm, err := parseSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+	return sm.certificates, nil
+}
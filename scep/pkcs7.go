@@ -0,0 +1,545 @@
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// The subset of PKCS #7 (RFC 2315) used by SCEP: signed-data and
+// enveloped-data content types, with RSA signatures and RSA key transport.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidDigestSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidDigestSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidDigestSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidEncryptionRSA      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSignatureSHA1RSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSignatureSHA256RSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureSHA512RSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+
+	oidEncryptionDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidEncryptionAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidEncryptionAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// signedMessage is a parsed and verified signed-data structure.
+type signedMessage struct {
+	content      []byte
+	certificates []*x509.Certificate
+	signer       *x509.Certificate
+	attributes   []attribute
+}
+
+// attribute returns the first value of the authenticated attribute with the
+// given type unmarshaled in v.
+func (m *signedMessage) attribute(oid asn1.ObjectIdentifier, v interface{}) error {
+	for _, attr := range m.attributes {
+		if attr.Type.Equal(oid) {
+			if _, err := asn1.Unmarshal(attr.Value.Bytes, v); err != nil {
+				return errors.Wrapf(err, "error parsing attribute %s", oid)
+			}
+			return nil
+		}
+	}
+	return errors.Errorf("attribute %s not found", oid)
+}
+
+// newAttribute returns an attribute with the given single value.
+func newAttribute(oid asn1.ObjectIdentifier, v interface{}, params string) (attribute, error) {
+	b, err := asn1.MarshalWithParams(v, params)
+	if err != nil {
+		return attribute{}, errors.Wrapf(err, "error marshaling attribute %s", oid)
+	}
+	return attribute{
+		Type:  oid,
+		Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: b},
+	}, nil
+}
+
+// marshalAttributes returns the DER encoding of the given attributes as a
+// SET OF, the elements are sorted as DER requires.
+func marshalAttributes(attrs []attribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		b, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, errors.Wrap(err, "error marshaling attributes")
+		}
+		encoded[i] = b
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return asn1.Marshal(asn1.RawValue{
+		Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil),
+	})
+}
+
+// parseContentInfo parses a ContentInfo and checks its type.
+func parseContentInfo(data []byte, typ asn1.ObjectIdentifier) (asn1.RawValue, error) {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(data, &ci)
+	switch {
+	case err != nil:
+		return asn1.RawValue{}, errors.Wrap(err, "error parsing pkcs7 content info")
+	case len(rest) > 0:
+		return asn1.RawValue{}, errors.New("error parsing pkcs7 content info: trailing data")
+	case !ci.ContentType.Equal(typ):
+		return asn1.RawValue{}, errors.Errorf("unexpected pkcs7 content type %s", ci.ContentType)
+	}
+	// The explicit tag is not removed when parsing a RawValue.
+	var content asn1.RawValue
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &content); err != nil {
+		return asn1.RawValue{}, errors.Wrap(err, "error parsing pkcs7 content info")
+	}
+	return content, nil
+}
+
+// octetString returns the bytes of a primitive or constructed OCTET STRING.
+func octetString(v asn1.RawValue) ([]byte, error) {
+	if !v.IsCompound {
+		return v.Bytes, nil
+	}
+	var (
+		buf  []byte
+		rest = v.Bytes
+	)
+	for len(rest) > 0 {
+		var chunk asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &chunk); err != nil {
+			return nil, errors.Wrap(err, "error parsing octet string")
+		}
+		b, err := octetString(chunk)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
+
+// parseSignedData parses a signed-data ContentInfo and verifies the signature
+// of its only signer. The signer certificate must be included in the message.
+func parseSignedData(data []byte) (*signedMessage, error) {
+	content, err := parseContentInfo(data, oidSignedData)
+	if err != nil {
+		return nil, err
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(content.FullBytes, &sd); err != nil {
+		return nil, errors.Wrap(err, "error parsing pkcs7 signed data")
+	}
+
+	msg := new(signedMessage)
+	if len(sd.Certificates.Bytes) > 0 {
+		if msg.certificates, err = x509.ParseCertificates(sd.Certificates.Bytes); err != nil {
+			return nil, errors.Wrap(err, "error parsing pkcs7 certificates")
+		}
+	}
+	if len(sd.ContentInfo.Content.Bytes) > 0 || sd.ContentInfo.Content.IsCompound {
+		if msg.content, err = octetString(sd.ContentInfo.Content); err != nil {
+			return nil, err
+		}
+	}
+
+	// Degenerate certs-only messages are not signed.
+	if len(sd.SignerInfos) == 0 {
+		return msg, nil
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, errors.New("pkcs7 signed data must have only one signer")
+	}
+	si := sd.SignerInfos[0]
+	for _, cert := range msg.certificates {
+		if cert.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 &&
+			bytes.Equal(cert.RawIssuer, si.IssuerAndSerialNumber.IssuerName.FullBytes) {
+			msg.signer = cert
+			break
+		}
+	}
+	if msg.signer == nil {
+		return nil, errors.New("pkcs7 signer certificate not found")
+	}
+
+	hash, err := getHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(msg.content)
+	contentDigest := h.Sum(nil)
+
+	// The signature covers the DER encoding of the attributes as a SET OF.
+	signed, err := asn1.Marshal(asn1.RawValue{
+		Tag: asn1.TagSet, IsCompound: true, Bytes: si.AuthenticatedAttributes.Bytes,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling pkcs7 attributes")
+	}
+	for rest := si.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+		var attr attribute
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, errors.Wrap(err, "error parsing pkcs7 attributes")
+		}
+		msg.attributes = append(msg.attributes, attr)
+	}
+	var digest []byte
+	if err := msg.attribute(oidAttributeMessageDigest, &digest); err != nil {
+		return nil, errors.Wrap(err, "error verifying pkcs7 signature")
+	}
+	if !bytes.Equal(digest, contentDigest) {
+		return nil, errors.New("error verifying pkcs7 signature: message digest does not match")
+	}
+
+	pub, ok := msg.signer.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("error verifying pkcs7 signature: unsupported public key type %T", msg.signer.PublicKey)
+	}
+	h = hash.New()
+	h.Write(signed)
+	if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), si.EncryptedDigest); err != nil {
+		return nil, errors.Wrap(err, "error verifying pkcs7 signature")
+	}
+	return msg, nil
+}
+
+// signData returns a signed-data ContentInfo with the given content,
+// certificates and authenticated attributes. The content type and message
+// digest attributes are always added. The signature uses SHA-256.
+func signData(content []byte, signer *x509.Certificate, key *rsa.PrivateKey, certs []*x509.Certificate, attrs []attribute) ([]byte, error) {
+	h := crypto.SHA256.New()
+	h.Write(content)
+	ct, err := newAttribute(oidAttributeContentType, oidData, "")
+	if err != nil {
+		return nil, err
+	}
+	md, err := newAttribute(oidAttributeMessageDigest, h.Sum(nil), "")
+	if err != nil {
+		return nil, err
+	}
+	signed, err := marshalAttributes(append([]attribute{ct, md}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	h = crypto.SHA256.New()
+	h.Write(signed)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return nil, errors.Wrap(err, "error signing pkcs7 signed data")
+	}
+	// Replace the SET OF tag with the implicit [0]
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(signed, &raw); err != nil {
+		return nil, errors.Wrap(err, "error marshaling pkcs7 attributes")
+	}
+
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidDigestSHA256, Parameters: asn1.NullRawValue}
+	si := signerInfo{
+		Version: 1,
+		IssuerAndSerialNumber: issuerAndSerial{
+			IssuerName:   asn1.RawValue{FullBytes: signer.RawIssuer},
+			SerialNumber: signer.SerialNumber,
+		},
+		DigestAlgorithm:           sha256Alg,
+		AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw.Bytes},
+		DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidEncryptionRSA, Parameters: asn1.NullRawValue},
+		EncryptedDigest:           sig,
+	}
+	return marshalSignedData(content, append([]*x509.Certificate{signer}, certs...), []pkix.AlgorithmIdentifier{sha256Alg}, []signerInfo{si})
+}
+
+// DegenerateCertificates returns a certs-only signed-data ContentInfo with
+// the given certificates.
+func DegenerateCertificates(certs []*x509.Certificate) ([]byte, error) {
+	return marshalSignedData(nil, certs, []pkix.AlgorithmIdentifier{}, []signerInfo{})
+}
+
+func marshalSignedData(content []byte, certs []*x509.Certificate, algs []pkix.AlgorithmIdentifier, signers []signerInfo) ([]byte, error) {
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: algs,
+		ContentInfo:      contentInfo{ContentType: oidData},
+		SignerInfos:      signers,
+	}
+	if content != nil {
+		b, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, errors.Wrap(err, "error marshaling pkcs7 content")
+		}
+		sd.ContentInfo.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b}
+	}
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	if len(raw) > 0 {
+		sd.Certificates = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw}
+	}
+	b, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling pkcs7 signed data")
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b},
+	})
+}
+
+// decryptEnvelopedData parses an enveloped-data ContentInfo and decrypts the
+// content with the given RSA key. The recipient certificate must be one of the
+// recipients of the message.
+func decryptEnvelopedData(data []byte, recipient *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	content, err := parseContentInfo(data, oidEnvelopedData)
+	if err != nil {
+		return nil, err
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(content.FullBytes, &ed); err != nil {
+		return nil, errors.Wrap(err, "error parsing pkcs7 enveloped data")
+	}
+
+	var ri *recipientInfo
+	for i, r := range ed.RecipientInfos {
+		if r.IssuerAndSerialNumber.SerialNumber.Cmp(recipient.SerialNumber) == 0 &&
+			bytes.Equal(r.IssuerAndSerialNumber.IssuerName.FullBytes, recipient.RawIssuer) {
+			ri = &ed.RecipientInfos[i]
+			break
+		}
+	}
+	if ri == nil {
+		return nil, errors.New("error decrypting pkcs7 enveloped data: recipient not found")
+	}
+	if !ri.KeyEncryptionAlgorithm.Algorithm.Equal(oidEncryptionRSA) {
+		return nil, errors.Errorf("error decrypting pkcs7 enveloped data: unsupported key encryption algorithm %s", ri.KeyEncryptionAlgorithm.Algorithm)
+	}
+	cek, err := rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decrypting pkcs7 enveloped data")
+	}
+
+	eci := ed.EncryptedContentInfo
+	block, err := newBlockCipher(eci.ContentEncryptionAlgorithm.Algorithm, cek)
+	if err != nil {
+		return nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.Wrap(err, "error decrypting pkcs7 enveloped data: invalid iv")
+	}
+	ciphertext, err := octetString(eci.EncryptedContent)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("error decrypting pkcs7 enveloped data: invalid ciphertext")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return unpad(plaintext, block.BlockSize())
+}
+
+// encryptEnvelopedData returns an enveloped-data ContentInfo with the content
+// encrypted for the given RSA recipient with the given algorithm.
+func encryptEnvelopedData(content []byte, recipient *x509.Certificate, alg asn1.ObjectIdentifier) ([]byte, error) {
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("error encrypting pkcs7 enveloped data: unsupported public key type %T", recipient.PublicKey)
+	}
+	var cek []byte
+	switch {
+	case alg.Equal(oidEncryptionDESEDE3CBC):
+		cek = make([]byte, 24)
+	case alg.Equal(oidEncryptionAES128CBC):
+		cek = make([]byte, 16)
+	case alg.Equal(oidEncryptionAES256CBC):
+		cek = make([]byte, 32)
+	default:
+		return nil, errors.Errorf("error encrypting pkcs7 enveloped data: unsupported algorithm %s", alg)
+	}
+	if _, err := rand.Read(cek); err != nil {
+		return nil, errors.Wrap(err, "error encrypting pkcs7 enveloped data")
+	}
+	block, err := newBlockCipher(alg, cek)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, errors.Wrap(err, "error encrypting pkcs7 enveloped data")
+	}
+	plaintext := pad(content, block.BlockSize())
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, cek)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encrypting pkcs7 enveloped data")
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encrypting pkcs7 enveloped data")
+	}
+	b, err := asn1.Marshal(envelopedData{
+		Version: 0,
+		RecipientInfos: []recipientInfo{{
+			Version: 0,
+			IssuerAndSerialNumber: issuerAndSerial{
+				IssuerName:   asn1.RawValue{FullBytes: recipient.RawIssuer},
+				SerialNumber: recipient.SerialNumber,
+			},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidEncryptionRSA, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling pkcs7 enveloped data")
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b},
+	})
+}
+
+// envelopedDataAlgorithm returns the content encryption algorithm of an
+// enveloped-data ContentInfo.
+func envelopedDataAlgorithm(data []byte) (asn1.ObjectIdentifier, error) {
+	content, err := parseContentInfo(data, oidEnvelopedData)
+	if err != nil {
+		return nil, err
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(content.FullBytes, &ed); err != nil {
+		return nil, errors.Wrap(err, "error parsing pkcs7 enveloped data")
+	}
+	return ed.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm, nil
+}
+
+func getHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidDigestSHA1), oid.Equal(oidSignatureSHA1RSA):
+		return crypto.SHA1, nil
+	case oid.Equal(oidDigestSHA256), oid.Equal(oidSignatureSHA256RSA):
+		return crypto.SHA256, nil
+	case oid.Equal(oidDigestSHA512), oid.Equal(oidSignatureSHA512RSA):
+		return crypto.SHA512, nil
+	default:
+		return 0, errors.Errorf("unsupported pkcs7 digest algorithm %s", oid)
+	}
+}
+
+func newBlockCipher(oid asn1.ObjectIdentifier, key []byte) (cipher.Block, error) {
+	var (
+		block cipher.Block
+		err   error
+	)
+	switch {
+	case oid.Equal(oidEncryptionDESEDE3CBC):
+		block, err = des.NewTripleDESCipher(key)
+	case oid.Equal(oidEncryptionAES128CBC), oid.Equal(oidEncryptionAES256CBC):
+		block, err = aes.NewCipher(key)
+	default:
+		return nil, errors.Errorf("unsupported pkcs7 content encryption algorithm %s", oid)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating pkcs7 cipher")
+	}
+	return block, nil
+}
+
+// pad adds the PKCS #7 padding to the given data.
+func pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	return append(append([]byte{}, data...), bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+// unpad removes the PKCS #7 padding of the given data.
+func unpad(data []byte, blockSize int) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, errors.New("error decrypting pkcs7 enveloped data: invalid padding")
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errors.New("error decrypting pkcs7 enveloped data: invalid padding")
+		}
+	}
+	return data[:len(data)-n], nil
+}
@@ -0,0 +1,397 @@
+package scep
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+)
+
+// SCEP message types (RFC 8894 section 3.2.1.2).
+const (
+	messageTypeCertRep        = "3"
+	messageTypeRenewalReq     = "17"
+	messageTypePKCSReq        = "19"
+	messageTypeGetCertInitial = "20"
+)
+
+// SCEP pkiStatus and failInfo values (RFC 8894 sections 3.2.1.3 and 3.2.1.4).
+const (
+	pkiStatusSuccess        = "0"
+	pkiStatusFailure        = "2"
+	failInfoBadAlg          = "0"
+	failInfoBadMessageCheck = "1"
+	failInfoBadRequest      = "2"
+)
+
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+	oidChallengePassword  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+// capabilities are the capabilities returned by the GetCACaps operation.
+var capabilities = []string{
+	"Renewal", "SHA-1", "SHA-256", "SHA-512", "AES", "DES3", "SCEPStandard", "POSTPKIOperation",
+}
+
+// Interface is the SCEP authority interface.
+type Interface interface {
+	LoadProvisionerByID(string) (provisioner.Interface, error)
+	GetCACertificates(*provisioner.SCEP) []*x509.Certificate
+	GetCACaps(*provisioner.SCEP) []string
+	PKIOperation(context.Context, *provisioner.SCEP, []byte) (*PKIResponse, error)
+}
+
+// SignAuthority is the interface implemented by a CA authority.
+type SignAuthority interface {
+	Sign(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
+	LoadProvisionerByID(string) (provisioner.Interface, error)
+	LoadProvisionerByCertificate(*x509.Certificate) (provisioner.Interface, error)
+	GetRootCertificates() []*x509.Certificate
+	GetIntermediateCertificate() *x509.Certificate
+	IsRevoked(serial string) (bool, error)
+}
+
+// Authority is the layer that handles all SCEP interactions.
+type Authority struct {
+	signAuth SignAuthority
+}
+
+// NewAuthority returns a new Authority that implements the SCEP interface.
+func NewAuthority(signAuth SignAuthority) *Authority {
+	return &Authority{signAuth: signAuth}
+}
+
+// LoadProvisionerByID calls out to the SignAuthority interface to load a
+// provisioner by ID.
+func (a *Authority) LoadProvisionerByID(id string) (provisioner.Interface, error) {
+	return a.signAuth.LoadProvisionerByID(id)
+}
+
+// GetCACertificates returns the certificates returned by the GetCACert
+// operation: the decrypter certificate of the provisioner followed by the
+// intermediate certificate of the CA.
+func (a *Authority) GetCACertificates(p *provisioner.SCEP) []*x509.Certificate {
+	decrypter, _ := p.GetDecrypter()
+	certs := []*x509.Certificate{decrypter}
+	if crt := a.signAuth.GetIntermediateCertificate(); crt != nil && !crt.Equal(decrypter) {
+		certs = append(certs, crt)
+	}
+	return certs
+}
+
+// GetCACaps returns the capabilities of the provisioner.
+func (a *Authority) GetCACaps(p *provisioner.SCEP) []string {
+	return capabilities
+}
+
+// pkiMessage is a parsed SCEP request.
+type pkiMessage struct {
+	messageType   string
+	transactionID string
+	senderNonce   []byte
+	signer        *x509.Certificate
+	certificates  []*x509.Certificate
+	envelope      []byte
+}
+
+// parsePKIMessage parses and verifies the signature of a SCEP pkiMessage.
+func parsePKIMessage(data []byte) (*pkiMessage, error) {
+	sm, err := parseSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+	if sm.signer == nil {
+		return nil, errors.New("pkiMessage must be signed")
+	}
+	msg := &pkiMessage{
+		signer:       sm.signer,
+		certificates: sm.certificates,
+		envelope:     sm.content,
+	}
+	if err := sm.attribute(oidSCEPMessageType, &msg.messageType); err != nil {
+		return nil, err
+	}
+	if err := sm.attribute(oidSCEPTransactionID, &msg.transactionID); err != nil {
+		return nil, err
+	}
+	if err := sm.attribute(oidSCEPSenderNonce, &msg.senderNonce); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// certRepError is an error that is returned to the client as a CertRep
+// message with a FAILURE status.
+type certRepError struct {
+	failInfo string
+	err      error
+}
+
+func (e *certRepError) Error() string {
+	return e.err.Error()
+}
+
+func failure(failInfo string, err error) *certRepError {
+	return &certRepError{failInfo: failInfo, err: err}
+}
+
+// PKIResponse is the result of a PKIOperation. Data is the CertRep message
+// returned to the client, the rest of the fields are used in the audit log.
+type PKIResponse struct {
+	Data          []byte
+	MessageType   string
+	TransactionID string
+	Status        string
+	FailInfo      string
+	Challenge     string
+	Err           error
+}
+
+// ToLog implements the EnableLogger interface.
+func (r *PKIResponse) ToLog() (interface{}, error) {
+	m := map[string]interface{}{
+		"messageType":   r.MessageType,
+		"transactionID": r.TransactionID,
+		"pkiStatus":     r.Status,
+	}
+	if r.FailInfo != "" {
+		m["failInfo"] = failInfoNames[r.FailInfo]
+	}
+	if r.Challenge != "" {
+		m["challenge"] = r.Challenge
+	}
+	return m, nil
+}
+
+var failInfoNames = map[string]string{
+	failInfoBadAlg:          "badAlg",
+	failInfoBadMessageCheck: "badMessageCheck",
+	failInfoBadRequest:      "badRequest",
+}
+
+// Values of the Challenge field of a PKIResponse.
+const (
+	challengeApproved = "approved"
+	challengeDenied   = "denied"
+)
+
+// PKIOperation processes a PKCSReq or RenewalReq message and returns the
+// CertRep message with the signed certificate.
+func (a *Authority) PKIOperation(ctx context.Context, p *provisioner.SCEP, data []byte) (*PKIResponse, error) {
+	msg, err := parsePKIMessage(data)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusBadRequest, err, "scep.PKIOperation; error parsing pkiMessage")
+	}
+
+	res := &PKIResponse{
+		MessageType:   msg.messageType,
+		TransactionID: msg.transactionID,
+		Status:        "SUCCESS",
+	}
+	var chain []*x509.Certificate
+	switch msg.messageType {
+	case messageTypePKCSReq, messageTypeRenewalReq:
+		chain, err = a.signRequest(ctx, p, msg, res)
+	default:
+		err = failure(failInfoBadRequest, errors.Errorf("unsupported message type %s", msg.messageType))
+	}
+	if err != nil {
+		fe, ok := err.(*certRepError)
+		if !ok {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation")
+		}
+		res.Status, res.FailInfo, res.Err = "FAILURE", fe.failInfo, fe.err
+	}
+	if res.Data, err = a.certRep(p, msg, chain, res.FailInfo); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// signRequest decrypts the certificate request of a PKCSReq or RenewalReq
+// message, authorizes it and signs it.
+func (a *Authority) signRequest(ctx context.Context, p *provisioner.SCEP, msg *pkiMessage, res *PKIResponse) ([]*x509.Certificate, error) {
+	crt, key := p.GetDecrypter()
+	der, err := decryptEnvelopedData(msg.envelope, crt, key)
+	if err != nil {
+		return nil, failure(failInfoBadMessageCheck, err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, failure(failInfoBadRequest, errors.Wrap(err, "error parsing certificate request"))
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, failure(failInfoBadMessageCheck, errors.Wrap(err, "error validating certificate request signature"))
+	}
+
+	if msg.messageType == messageTypeRenewalReq {
+		if err := a.authorizeRenewal(ctx, p, msg); err != nil {
+			return nil, failure(failInfoBadRequest, err)
+		}
+	} else {
+		if p.IsDisabled() {
+			return nil, failure(failInfoBadRequest, errs.Unauthorized("scep.PKIOperation; provisioner %s is disabled", p.GetName()))
+		}
+		challenge, err := parseChallengePassword(csr)
+		if err != nil {
+			return nil, failure(failInfoBadRequest, err)
+		}
+		if err := p.ValidateChallenge(ctx, challenge, msg.transactionID, csr); err != nil {
+			res.Challenge = challengeDenied
+			return nil, failure(failInfoBadRequest, err)
+		}
+		res.Challenge = challengeApproved
+	}
+
+	signOps, err := p.AuthorizeSign(ctx, "")
+	if err != nil {
+		return nil, failure(failInfoBadRequest, err)
+	}
+	chain, err := a.signAuth.Sign(csr, provisioner.Options{}, signOps...)
+	if err != nil {
+		return nil, failure(failInfoBadRequest, err)
+	}
+	return chain, nil
+}
+
+// authorizeRenewal validates that the signer of a RenewalReq message is a
+// valid certificate issued by the same provisioner.
+func (a *Authority) authorizeRenewal(ctx context.Context, p *provisioner.SCEP, msg *pkiMessage) error {
+	roots := x509.NewCertPool()
+	for _, crt := range a.signAuth.GetRootCertificates() {
+		roots.AddCert(crt)
+	}
+	intermediates := x509.NewCertPool()
+	if crt := a.signAuth.GetIntermediateCertificate(); crt != nil {
+		intermediates.AddCert(crt)
+	}
+	for _, crt := range msg.certificates {
+		intermediates.AddCert(crt)
+	}
+	if _, err := msg.signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return errors.Wrap(err, "error verifying renewal certificate")
+	}
+
+	isRevoked, err := a.signAuth.IsRevoked(msg.signer.SerialNumber.String())
+	if err != nil {
+		return errors.Wrap(err, "error checking renewal certificate revocation")
+	}
+	if isRevoked {
+		return errors.New("renewal certificate has been revoked")
+	}
+
+	prov, err := a.signAuth.LoadProvisionerByCertificate(msg.signer)
+	if err != nil || prov.GetID() != p.GetID() {
+		return errors.Errorf("renewal certificate was not issued by provisioner %s", p.GetID())
+	}
+	return p.AuthorizeRenew(ctx, msg.signer)
+}
+
+// certRep returns a signed CertRep message. If failInfo is empty, the
+// message contains the given certificate chain encrypted for the signer of
+// the request, otherwise it has a FAILURE status.
+func (a *Authority) certRep(p *provisioner.SCEP, msg *pkiMessage, chain []*x509.Certificate, failInfo string) ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation; error generating nonce")
+	}
+
+	status := pkiStatusSuccess
+	if failInfo != "" {
+		status = pkiStatusFailure
+	}
+	var attrs []attribute
+	for _, v := range []struct {
+		oid    asn1.ObjectIdentifier
+		value  interface{}
+		params string
+	}{
+		{oidSCEPMessageType, messageTypeCertRep, "printable"},
+		{oidSCEPPKIStatus, status, "printable"},
+		{oidSCEPTransactionID, msg.transactionID, "printable"},
+		{oidSCEPSenderNonce, nonce, ""},
+		{oidSCEPRecipientNonce, msg.senderNonce, ""},
+	} {
+		attr, err := newAttribute(v.oid, v.value, v.params)
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation")
+		}
+		attrs = append(attrs, attr)
+	}
+
+	var content []byte
+	if failInfo != "" {
+		attr, err := newAttribute(oidSCEPFailInfo, failInfo, "printable")
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation")
+		}
+		attrs = append(attrs, attr)
+	} else {
+		certs, err := DegenerateCertificates(chain)
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation")
+		}
+		// Answer with the algorithm used by the client.
+		alg, err := envelopedDataAlgorithm(msg.envelope)
+		if err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation")
+		}
+		if content, err = encryptEnvelopedData(certs, msg.signer, alg); err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation")
+		}
+	}
+
+	crt, key := p.GetDecrypter()
+	b, err := signData(content, crt, key, nil, attrs)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "scep.PKIOperation")
+	}
+	return b, nil
+}
+
+// parseChallengePassword returns the challengePassword attribute of a
+// certificate request. The x509 package does not parse it because its value
+// is not a set of attribute type and value pairs.
+func parseChallengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes asn1.RawValue `asn1:"optional,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", errors.Wrap(err, "error parsing certificate request")
+	}
+	for rest := tbs.Attributes.Bytes; len(rest) > 0; {
+		var (
+			attr attribute
+			err  error
+		)
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return "", errors.Wrap(err, "error parsing certificate request attributes")
+		}
+		if attr.Type.Equal(oidChallengePassword) {
+			var challenge string
+			if _, err := asn1.Unmarshal(attr.Value.Bytes, &challenge); err != nil {
+				return "", errors.Wrap(err, "error parsing certificate request challenge password")
+			}
+			return challenge, nil
+		}
+	}
+	return "", errors.New("certificate request does not have a challenge password")
+}
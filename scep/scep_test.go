@@ -0,0 +1,504 @@
+package scep_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/logging"
+	"github.com/smallstep/certificates/scep"
+	scepAPI "github.com/smallstep/certificates/scep/api"
+	"github.com/smallstep/cli/crypto/pemutil"
+)
+
+var (
+	oidChallengePassword  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+	oidSignatureSHA256RSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+)
+
+// newCSR returns a certificate request with the given challenge password.
+// The x509 package cannot encode the challengePassword attribute.
+func newCSR(t *testing.T, key *rsa.PrivateKey, commonName, challenge string) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	assert.FatalError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	assert.FatalError(t, err)
+
+	attr, err := asn1.Marshal(struct {
+		Type  asn1.ObjectIdentifier
+		Value []string `asn1:"set"`
+	}{oidChallengePassword, []string{challenge}})
+	assert.FatalError(t, err)
+	tbs, err := asn1.Marshal(struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []asn1.RawValue `asn1:"tag:0"`
+	}{0, asn1.RawValue{FullBytes: csr.RawSubject}, asn1.RawValue{FullBytes: csr.RawSubjectPublicKeyInfo}, []asn1.RawValue{{FullBytes: attr}}})
+	assert.FatalError(t, err)
+
+	sum := sha256.Sum256(tbs)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	assert.FatalError(t, err)
+	der, err = asn1.Marshal(struct {
+		TBS       asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}{
+		asn1.RawValue{FullBytes: tbs},
+		pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA256RSA, Parameters: asn1.NullRawValue},
+		asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	assert.FatalError(t, err)
+	return der
+}
+
+// newSelfSigned returns the self-signed certificate used by the clients that
+// do not have a certificate yet.
+func newSelfSigned(t *testing.T, key *rsa.PrivateKey, commonName string, keyUsage x509.KeyUsage) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              keyUsage,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	assert.FatalError(t, err)
+	return crt
+}
+
+type scepClient struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+}
+
+func (c *scepClient) get(operation string, message []byte) *http.Response {
+	u := c.url + "?operation=" + operation
+	if message != nil {
+		u += "&message=" + url.QueryEscape(base64.StdEncoding.EncodeToString(message))
+	}
+	resp, err := c.client.Get(u)
+	assert.FatalError(c.t, err)
+	return resp
+}
+
+func (c *scepClient) post(message []byte) *http.Response {
+	resp, err := c.client.Post(c.url+"?operation=PKIOperation", "application/x-pki-message", bytes.NewReader(message))
+	assert.FatalError(c.t, err)
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) []byte {
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.FatalError(t, err)
+	return b
+}
+
+func TestSCEP_endToEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scep")
+	assert.FatalError(t, err)
+	defer os.RemoveAll(dir)
+
+	// RA certificate used to decrypt the requests and sign the responses.
+	raKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	raCert := newSelfSigned(t, raKey, "SCEP RA", x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment)
+	raCertFile, raKeyFile := filepath.Join(dir, "ra.crt"), filepath.Join(dir, "ra.key")
+	assert.FatalError(t, ioutil.WriteFile(raCertFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: raCert.Raw,
+	}), 0600))
+	assert.FatalError(t, ioutil.WriteFile(raKeyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(raKey),
+	}), 0600))
+
+	// Webhook used to validate the challenges of the mdm provisioner.
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Challenge              string `json:"scepChallenge"`
+			TransactionID          string `json:"scepTransactionID"`
+			X509CertificateRequest struct {
+				CommonName string `json:"commonName"`
+			} `json:"x509CertificateRequest"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.X509CertificateRequest.CommonName != "device-"+req.Challenge:
+			w.Write([]byte(`{"allow":false}`))
+		case req.Challenge == "timeout":
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte(`{"allow":true}`))
+		default:
+			w.Write([]byte(`{"allow":` + strconv.FormatBool(req.Challenge == "approve") + `}`))
+		}
+	}))
+	defer webhook.Close()
+
+	srv := httptest.NewUnstartedServer(nil)
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          srv.Listener.Addr().String(),
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.SCEP{
+					Type:                 "SCEP",
+					Name:                 "scep",
+					ChallengePassword:    "secret",
+					DecrypterCertificate: raCertFile,
+					DecrypterKey:         raKeyFile,
+					Claims: &provisioner.Claims{
+						DefaultTLSDur: &provisioner.Duration{Duration: time.Hour},
+					},
+				},
+				&provisioner.SCEP{
+					Type: "SCEP",
+					Name: "mdm",
+					Webhooks: []*provisioner.Webhook{{
+						Name:    "mdm",
+						URL:     webhook.URL,
+						Kind:    provisioner.WebhookKindSCEPChallenge,
+						Timeout: &provisioner.Duration{Duration: 100 * time.Millisecond},
+					}},
+					DecrypterCertificate: raCertFile,
+					DecrypterKey:         raKeyFile,
+					Claims: &provisioner.Claims{
+						DefaultTLSDur: &provisioner.Duration{Duration: time.Hour},
+					},
+				},
+			},
+			Backdate: &provisioner.Duration{},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	mux := chi.NewRouter()
+	mux.Route("/scep", func(r chi.Router) {
+		scepAPI.New(scep.NewAuthority(auth)).Route(r)
+	})
+	// Capture the audit log of the mdm provisioner requests.
+	audit := make(chan map[string]interface{}, 10)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl := logging.NewResponseLogger(w)
+		mux.ServeHTTP(rl, r)
+		if strings.HasPrefix(r.URL.Path, "/scep/mdm") {
+			audit <- rl.Fields()
+		}
+	})
+	srv.StartTLS()
+	defer srv.Close()
+
+	root, err := pemutil.ReadCertificate("../ca/testdata/secrets/root_ca.crt")
+	assert.FatalError(t, err)
+	intermediate, err := pemutil.ReadCertificate("../ca/testdata/secrets/intermediate_ca.crt")
+	assert.FatalError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+
+	client := &scepClient{t: t, url: srv.URL + "/scep/scep", client: srv.Client()}
+
+	t.Run("GetCACaps", func(t *testing.T) {
+		resp := client.get("GetCACaps", nil)
+		assert.Equals(t, http.StatusOK, resp.StatusCode)
+		assert.Equals(t, "text/plain", resp.Header.Get("Content-Type"))
+		caps := string(readBody(t, resp))
+		for _, s := range []string{"Renewal", "SHA-256", "AES", "POSTPKIOperation"} {
+			assert.True(t, bytes.Contains([]byte(caps), []byte(s)), s)
+		}
+	})
+
+	t.Run("GetCACert", func(t *testing.T) {
+		resp := client.get("GetCACert", nil)
+		assert.Equals(t, http.StatusOK, resp.StatusCode)
+		assert.Equals(t, "application/x-x509-ca-ra-cert", resp.Header.Get("Content-Type"))
+		certs, err := scep.ParseCertificates(readBody(t, resp))
+		assert.FatalError(t, err)
+		assert.Len(t, 2, certs)
+		assert.Equals(t, raCert.Raw, certs[0].Raw)
+		assert.Equals(t, intermediate.Raw, certs[1].Raw)
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		resp, err := srv.Client().Get(srv.URL + "/scep/foo?operation=GetCACaps")
+		assert.FatalError(t, err)
+		readBody(t, resp)
+		assert.Equals(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("bad-operation", func(t *testing.T) {
+		resp := client.get("GetNextCACert", nil)
+		readBody(t, resp)
+		assert.Equals(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	// pkiOperation sends the request and returns the parsed response.
+	pkiOperation := func(t *testing.T, client *scepClient, usePost bool, messageType string, alg asn1.ObjectIdentifier, csr []byte, signer *x509.Certificate, key *rsa.PrivateKey) *scep.CertRep {
+		nonce := make([]byte, 16)
+		_, err := rand.Read(nonce)
+		assert.FatalError(t, err)
+		msg, err := scep.NewPKIMessage(messageType, "transaction-"+messageType, nonce, csr, raCert, alg, signer, key)
+		assert.FatalError(t, err)
+
+		var resp *http.Response
+		if usePost {
+			resp = client.post(msg)
+		} else {
+			resp = client.get("PKIOperation", msg)
+		}
+		assert.Equals(t, http.StatusOK, resp.StatusCode)
+		assert.Equals(t, "application/x-pki-message", resp.Header.Get("Content-Type"))
+		rep, err := scep.ParseCertRep(readBody(t, resp), signer, key)
+		assert.FatalError(t, err)
+		assert.Equals(t, "3", rep.MessageType)
+		assert.Equals(t, "transaction-"+messageType, rep.TransactionID)
+		assert.Equals(t, nonce, rep.RecipientNonce)
+		assert.Equals(t, raCert.Raw, rep.Signer.Raw)
+		return rep
+	}
+
+	verify := func(t *testing.T, rep *scep.CertRep, commonName string) *x509.Certificate {
+		assert.Equals(t, "0", rep.PKIStatus)
+		assert.Len(t, 2, rep.Certificates)
+		leaf := rep.Certificates[0]
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		assert.FatalError(t, err)
+		assert.Equals(t, commonName, leaf.Subject.CommonName)
+		assert.Equals(t, time.Hour, leaf.NotAfter.Sub(leaf.NotBefore))
+		return leaf
+	}
+
+	var (
+		issued    *x509.Certificate
+		issuedKey *rsa.PrivateKey
+	)
+	for _, tt := range []struct {
+		name    string
+		usePost bool
+		alg     asn1.ObjectIdentifier
+	}{
+		{"aes256-post", true, scep.EncryptionAES256CBC},
+		{"aes128-get", false, scep.EncryptionAES128CBC},
+		{"des3-post", true, scep.EncryptionDESEDE3CBC},
+	} {
+		t.Run("PKCSReq/"+tt.name, func(t *testing.T) {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			assert.FatalError(t, err)
+			csr := newCSR(t, key, "device-"+tt.name, "secret")
+			signer := newSelfSigned(t, key, "device-"+tt.name, x509.KeyUsageDigitalSignature)
+			rep := pkiOperation(t, client, tt.usePost, scep.MessageTypePKCSReq, tt.alg, csr, signer, key)
+			issued, issuedKey = verify(t, rep, "device-"+tt.name), key
+		})
+	}
+
+	t.Run("PKCSReq/bad-challenge", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.FatalError(t, err)
+		csr := newCSR(t, key, "device", "wrong")
+		signer := newSelfSigned(t, key, "device", x509.KeyUsageDigitalSignature)
+		rep := pkiOperation(t, client, true, scep.MessageTypePKCSReq, scep.EncryptionAES256CBC, csr, signer, key)
+		assert.Equals(t, "2", rep.PKIStatus)
+		assert.Equals(t, "2", rep.FailInfo)
+		assert.Len(t, 0, rep.Certificates)
+	})
+
+	t.Run("RenewalReq/ok", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.FatalError(t, err)
+		csr := newCSR(t, key, "renewed", "")
+		rep := pkiOperation(t, client, true, scep.MessageTypeRenewalReq, scep.EncryptionAES256CBC, csr, issued, issuedKey)
+		verify(t, rep, "renewed")
+	})
+
+	t.Run("RenewalReq/self-signed", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.FatalError(t, err)
+		csr := newCSR(t, key, "renewed", "secret")
+		signer := newSelfSigned(t, key, "renewed", x509.KeyUsageDigitalSignature)
+		rep := pkiOperation(t, client, true, scep.MessageTypeRenewalReq, scep.EncryptionAES256CBC, csr, signer, key)
+		assert.Equals(t, "2", rep.PKIStatus)
+		assert.Equals(t, "2", rep.FailInfo)
+	})
+
+	t.Run("GetCertInitial", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.FatalError(t, err)
+		csr := newCSR(t, key, "device", "secret")
+		signer := newSelfSigned(t, key, "device", x509.KeyUsageDigitalSignature)
+		rep := pkiOperation(t, client, true, scep.MessageTypeGetCertInitial, scep.EncryptionAES256CBC, csr, signer, key)
+		assert.Equals(t, "2", rep.PKIStatus)
+		assert.Equals(t, "2", rep.FailInfo)
+	})
+
+	mdm := &scepClient{t: t, url: srv.URL + "/scep/mdm", client: srv.Client()}
+	for _, tt := range []struct {
+		challenge string
+		status    string
+		decision  string
+	}{
+		{"approve", "SUCCESS", "approved"},
+		{"deny", "FAILURE", "denied"},
+		{"timeout", "FAILURE", "denied"},
+	} {
+		t.Run("PKCSReq/webhook-"+tt.challenge, func(t *testing.T) {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			assert.FatalError(t, err)
+			csr := newCSR(t, key, "device-"+tt.challenge, tt.challenge)
+			signer := newSelfSigned(t, key, "device-"+tt.challenge, x509.KeyUsageDigitalSignature)
+			rep := pkiOperation(t, mdm, true, scep.MessageTypePKCSReq, scep.EncryptionAES256CBC, csr, signer, key)
+			if tt.status == "SUCCESS" {
+				verify(t, rep, "device-"+tt.challenge)
+			} else {
+				assert.Equals(t, "2", rep.PKIStatus)
+				assert.Equals(t, "2", rep.FailInfo)
+			}
+
+			// The decision is recorded in the audit log.
+			fields := <-audit
+			res, ok := fields["response"].(map[string]interface{})
+			assert.Fatal(t, ok, "audit log does not contain the response")
+			assert.Equals(t, "transaction-"+scep.MessageTypePKCSReq, res["transactionID"])
+			assert.Equals(t, tt.status, res["pkiStatus"])
+			assert.Equals(t, tt.decision, res["challenge"])
+			if tt.status == "FAILURE" {
+				assert.Equals(t, "badRequest", res["failInfo"])
+				assert.NotNil(t, fields["error"])
+			}
+		})
+	}
+
+	t.Run("PKIOperation/bad-message", func(t *testing.T) {
+		resp := client.post([]byte("not a pkcs7"))
+		readBody(t, resp)
+		assert.Equals(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+// TestSCEP_opensslFixtures processes the requests created with OpenSSL by
+// testdata/gen.sh, with the same calls as sscep, to check the codec against an
+// independent implementation of PKCS#7.
+func TestSCEP_opensslFixtures(t *testing.T) {
+	auth, err := authority.New(&authority.Config{
+		Root:             []string{"../ca/testdata/secrets/root_ca.crt"},
+		IntermediateCert: "../ca/testdata/secrets/intermediate_ca.crt",
+		IntermediateKey:  "../ca/testdata/secrets/intermediate_ca_key",
+		Password:         "password",
+		Address:          "127.0.0.1:0",
+		DNSNames:         []string{"127.0.0.1"},
+		DB:               &db.Config{Type: "memory"},
+		AuthorityConfig: &authority.AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.SCEP{
+					Type:                 "SCEP",
+					Name:                 "scep",
+					ChallengePassword:    "secret",
+					DecrypterCertificate: "testdata/ra.crt",
+					DecrypterKey:         "testdata/ra.key",
+				},
+			},
+		},
+	})
+	assert.FatalError(t, err)
+	defer auth.Shutdown()
+
+	a := scep.NewAuthority(auth)
+	prov, err := a.LoadProvisionerByID("scep/scep")
+	assert.FatalError(t, err)
+	p := prov.(*provisioner.SCEP)
+
+	raCert, err := pemutil.ReadCertificate("testdata/ra.crt")
+	assert.FatalError(t, err)
+	device, err := pemutil.ReadCertificate("testdata/device.crt")
+	assert.FatalError(t, err)
+	key, err := pemutil.Read("testdata/device.key")
+	assert.FatalError(t, err)
+	deviceKey := key.(*rsa.PrivateKey)
+	nonce := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	t.Run("GetCACert", func(t *testing.T) {
+		want, err := ioutil.ReadFile("testdata/getcacert.der")
+		assert.FatalError(t, err)
+		got, err := scep.DegenerateCertificates(a.GetCACertificates(p))
+		assert.FatalError(t, err)
+		assert.Equals(t, want, got)
+	})
+
+	for _, tt := range []struct {
+		name          string
+		transactionID string
+		status        string
+	}{
+		{"pkcsreq-des3", "openssl-des3", "0"},
+		{"pkcsreq-aes128", "openssl-aes128", "0"},
+		{"pkcsreq-aes256", "openssl-aes256", "0"},
+		{"pkcsreq-bad-challenge", "openssl-wrong", "2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ioutil.ReadFile(filepath.Join("testdata", tt.name+".der"))
+			assert.FatalError(t, err)
+			res, err := a.PKIOperation(context.Background(), p, msg)
+			assert.FatalError(t, err)
+			assert.Equals(t, scep.MessageTypePKCSReq, res.MessageType)
+			assert.Equals(t, tt.transactionID, res.TransactionID)
+
+			rep, err := scep.ParseCertRep(res.Data, device, deviceKey)
+			assert.FatalError(t, err)
+			assert.Equals(t, "3", rep.MessageType)
+			assert.Equals(t, tt.status, rep.PKIStatus)
+			assert.Equals(t, tt.transactionID, rep.TransactionID)
+			assert.Equals(t, nonce, rep.RecipientNonce)
+			assert.Equals(t, raCert.Raw, rep.Signer.Raw)
+			if tt.status != "0" {
+				assert.Equals(t, "2", rep.FailInfo)
+				return
+			}
+			assert.Len(t, 2, rep.Certificates)
+			assert.Equals(t, "device-openssl", rep.Certificates[0].Subject.CommonName)
+			assert.Equals(t, device.PublicKey, rep.Certificates[0].PublicKey)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+#!/bin/sh
+#
+# gen.sh creates the SCEP fixtures with OpenSSL, independently of the PKCS#7
+# code of the scep package. It requires OpenSSL 3 and a C compiler:
+#
+#   cd scep/testdata && ./gen.sh
+#
+# The requests are created by pkimessage.c, that uses the same OpenSSL calls
+# as sscep, and the GetCACert response by "openssl crl2pkcs7".
+set -e
+
+OPENSSL=${OPENSSL:-openssl}
+NONCE=000102030405060708090a0b0c0d0e0f
+
+${CC:-cc} -o pkimessage pkimessage.c $CFLAGS $LDFLAGS -lcrypto
+trap 'rm -f pkimessage device.der device-wrong.der' EXIT
+
+# RA certificate that decrypts the requests and signs the responses.
+$OPENSSL req -x509 -newkey rsa:2048 -nodes -days 36500 -subj "/CN=SCEP RA" \
+    -addext "keyUsage=critical,digitalSignature,keyEncipherment" \
+    -keyout ra.key -out ra.crt
+
+# Self-signed certificate and key of the client.
+$OPENSSL req -x509 -newkey rsa:2048 -nodes -days 36500 -subj "/CN=device-openssl" \
+    -addext "keyUsage=critical,digitalSignature" \
+    -keyout device.key -out device.crt
+
+# Certificate requests with the challenge passwords.
+for challenge in secret wrong; do
+    cat > device.cnf <<EOF
+[req]
+distinguished_name = dn
+attributes = attrs
+prompt = no
+[dn]
+CN = device-openssl
+[attrs]
+challengePassword = $challenge
+EOF
+    out=device.der
+    [ $challenge = wrong ] && out=device-wrong.der
+    $OPENSSL req -new -key device.key -config device.cnf -outform DER -out $out
+done
+rm -f device.cnf
+
+./pkimessage 19 des-ede3-cbc ra.crt device.crt device.key device.der openssl-des3 $NONCE pkcsreq-des3.der
+./pkimessage 19 aes-128-cbc ra.crt device.crt device.key device.der openssl-aes128 $NONCE pkcsreq-aes128.der
+./pkimessage 19 aes-256-cbc ra.crt device.crt device.key device.der openssl-aes256 $NONCE pkcsreq-aes256.der
+./pkimessage 19 aes-256-cbc ra.crt device.crt device.key device-wrong.der openssl-wrong $NONCE pkcsreq-bad-challenge.der
+
+# GetCACert response with the RA and the intermediate certificates.
+cat ra.crt ../../ca/testdata/secrets/intermediate_ca.crt > cacert.pem
+$OPENSSL crl2pkcs7 -nocrl -certfile cacert.pem -outform DER -out getcacert.der
+rm -f cacert.pem
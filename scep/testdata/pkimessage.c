@@ -0,0 +1,117 @@
+/*
+ * pkimessage creates a SCEP pkiMessage with the OpenSSL PKCS#7 API, with the
+ * same calls that sscep uses to wrap its requests: the content is encrypted
+ * with PKCS7_encrypt and signed with PKCS7_add_signature and the transId,
+ * messageType and senderNonce signed attributes.
+ *
+ * Usage: pkimessage <messageType> <cipher> <recipient.crt> <signer.crt>
+ *            <signer.key> <content.der> <transId> <nonce-hex> <out.der>
+ */
+#include <stdio.h>
+#include <string.h>
+
+#include <openssl/bio.h>
+#include <openssl/err.h>
+#include <openssl/evp.h>
+#include <openssl/objects.h>
+#include <openssl/pem.h>
+#include <openssl/pkcs7.h>
+#include <openssl/x509.h>
+
+static int fail(const char *msg)
+{
+    fprintf(stderr, "pkimessage: %s\n", msg);
+    ERR_print_errors_fp(stderr);
+    return 1;
+}
+
+static int add_attribute(STACK_OF(X509_ATTRIBUTE) *attrs, const char *oid, const char *name, int type, const unsigned char *data, int len)
+{
+    int nid = OBJ_create(oid, name, name);
+    ASN1_STRING *s = ASN1_STRING_type_new(type);
+    X509_ATTRIBUTE *attr;
+
+    if (nid == NID_undef || s == NULL || !ASN1_STRING_set(s, data, len))
+        return 0;
+    if ((attr = X509_ATTRIBUTE_create(nid, type, s)) == NULL)
+        return 0;
+    return sk_X509_ATTRIBUTE_push(attrs, attr) > 0;
+}
+
+int main(int argc, char **argv)
+{
+    X509 *recipient, *signer;
+    EVP_PKEY *key;
+    BIO *in, *out, *data, *enc, *p7bio;
+    STACK_OF(X509) *recipients;
+    STACK_OF(X509_ATTRIBUTE) *attrs;
+    PKCS7 *p7enc, *p7;
+    PKCS7_SIGNER_INFO *si;
+    unsigned char nonce[64], *der;
+    long nonce_len, der_len;
+    const EVP_CIPHER *cipher;
+
+    if (argc != 10) {
+        fprintf(stderr, "usage: %s <messageType> <cipher> <recipient.crt> <signer.crt> <signer.key> <content.der> <transId> <nonce-hex> <out.der>\n", argv[0]);
+        return 2;
+    }
+    if ((cipher = EVP_get_cipherbyname(argv[2])) == NULL)
+        return fail("unknown cipher");
+
+    in = BIO_new_file(argv[3], "r");
+    if (in == NULL || (recipient = PEM_read_bio_X509(in, NULL, NULL, NULL)) == NULL)
+        return fail("error reading recipient");
+    BIO_free(in);
+    in = BIO_new_file(argv[4], "r");
+    if (in == NULL || (signer = PEM_read_bio_X509(in, NULL, NULL, NULL)) == NULL)
+        return fail("error reading signer");
+    BIO_free(in);
+    in = BIO_new_file(argv[5], "r");
+    if (in == NULL || (key = PEM_read_bio_PrivateKey(in, NULL, NULL, NULL)) == NULL)
+        return fail("error reading key");
+    BIO_free(in);
+
+    /* Encrypt the content for the recipient. */
+    if ((data = BIO_new_file(argv[6], "rb")) == NULL)
+        return fail("error reading content");
+    recipients = sk_X509_new_null();
+    sk_X509_push(recipients, recipient);
+    if ((p7enc = PKCS7_encrypt(recipients, data, cipher, PKCS7_BINARY)) == NULL)
+        return fail("error encrypting content");
+    enc = BIO_new(BIO_s_mem());
+    if (!i2d_PKCS7_bio(enc, p7enc))
+        return fail("error encoding enveloped data");
+    der_len = BIO_get_mem_data(enc, &der);
+
+    /* Sign the enveloped data with the SCEP attributes. */
+    p7 = PKCS7_new();
+    PKCS7_set_type(p7, NID_pkcs7_signed);
+    if ((si = PKCS7_add_signature(p7, signer, key, EVP_sha256())) == NULL)
+        return fail("error adding signature");
+    if (!PKCS7_add_certificate(p7, signer))
+        return fail("error adding certificate");
+    if ((nonce_len = strlen(argv[8]) / 2) > (long)sizeof(nonce))
+        return fail("nonce is too long");
+    for (long i = 0; i < nonce_len; i++)
+        sscanf(argv[8] + 2 * i, "%2hhx", &nonce[i]);
+    attrs = sk_X509_ATTRIBUTE_new_null();
+    if (!add_attribute(attrs, "2.16.840.1.113733.1.9.7", "transId", V_ASN1_PRINTABLESTRING, (unsigned char *)argv[7], strlen(argv[7])) ||
+        !add_attribute(attrs, "2.16.840.1.113733.1.9.2", "messageType", V_ASN1_PRINTABLESTRING, (unsigned char *)argv[1], strlen(argv[1])) ||
+        !add_attribute(attrs, "2.16.840.1.113733.1.9.5", "senderNonce", V_ASN1_OCTET_STRING, nonce, nonce_len))
+        return fail("error creating attributes");
+    PKCS7_set_signed_attributes(si, attrs);
+    PKCS7_add_signed_attribute(si, NID_pkcs9_contentType, V_ASN1_OBJECT, OBJ_nid2obj(NID_pkcs7_data));
+    PKCS7_content_new(p7, NID_pkcs7_data);
+    if ((p7bio = PKCS7_dataInit(p7, NULL)) == NULL)
+        return fail("error initializing signed data");
+    if (BIO_write(p7bio, der, der_len) != der_len)
+        return fail("error writing signed data");
+    if (!PKCS7_dataFinal(p7, p7bio))
+        return fail("error signing data");
+
+    out = BIO_new_file(argv[9], "wb");
+    if (out == NULL || !i2d_PKCS7_bio(out, p7))
+        return fail("error writing pkiMessage");
+    BIO_free(out);
+    return 0;
+}
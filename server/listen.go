@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+var listenFdsStart = 3
+
+// Listen announces on the TCP network address addr. If the process has been
+// started using systemd socket activation, it returns the listener passed by
+// systemd instead. Otherwise, on the systems that support it, the socket is
+// created with SO_REUSEPORT, so a new process can bind the address before the
+// old one has been drained.
+func Listen(addr string) (net.Listener, error) {
+	ln, err := activationListener()
+	if err != nil || ln != nil {
+		return ln, err
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// activationListener returns the first listener passed using systemd socket
+// activation or nil if the process was not started this way. The environment
+// variables are unset, so the listener is only used once.
+func activationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_"+strconv.Itoa(listenFdsStart))
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "error using socket activation listener")
+	}
+	if _, ok := ln.(*net.TCPListener); !ok {
+		ln.Close()
+		return nil, errors.New("error using socket activation listener: socket is not a TCP socket")
+	}
+	return ln, nil
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package server
+
+import "syscall"
+
+// reusePort does nothing, SO_REUSEPORT is not supported in this system.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -7,52 +7,133 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-// ServerShutdownTimeout is the default time to wait before closing
-// connections on shutdown.
+// ServerShutdownTimeout is the default time to wait for the active
+// connections to finish on shutdown and reloads.
 const ServerShutdownTimeout = 60 * time.Second
 
+// Default values of the server timeouts and limits.
+const (
+	DefaultReadTimeout       = 15 * time.Second
+	DefaultReadHeaderTimeout = 15 * time.Second
+	DefaultWriteTimeout      = 15 * time.Second
+	DefaultIdleTimeout       = 15 * time.Second
+	DefaultMaxHeaderBytes    = 1 << 20
+	DefaultKeepAlivePeriod   = 3 * time.Minute
+)
+
 // Server is a incomplete component that implements a basic HTTP/HTTPS
 // server.
 type Server struct {
 	*http.Server
-	listener   *net.TCPListener
-	reloadCh   chan net.Listener
-	shutdownCh chan struct{}
+	listener        *net.TCPListener
+	keepAlivePeriod time.Duration
+	reloadCh        chan net.Listener
+	shutdownCh      chan struct{}
+	shutdownOnce    sync.Once
+}
+
+// Option is the type of the options passed to New.
+type Option func(srv *Server)
+
+// WithReadTimeout sets the maximum duration to read a request.
+func WithReadTimeout(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.ReadTimeout = d
+	}
+}
+
+// WithReadHeaderTimeout sets the maximum duration to read the headers of a
+// request.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.ReadHeaderTimeout = d
+	}
+}
+
+// WithWriteTimeout sets the maximum duration to write a response.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.WriteTimeout = d
+	}
+}
+
+// WithIdleTimeout sets the maximum duration an idle keep-alive connection is
+// kept open.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.IdleTimeout = d
+	}
+}
+
+// WithMaxHeaderBytes sets the maximum size of the headers of a request.
+func WithMaxHeaderBytes(n int) Option {
+	return func(srv *Server) {
+		srv.MaxHeaderBytes = n
+	}
+}
+
+// WithHTTP2 enables or disables HTTP/2 on the TLS connections, it is enabled by
+// default.
+func WithHTTP2(enabled bool) Option {
+	return func(srv *Server) {
+		if enabled {
+			srv.TLSNextProto = nil
+		} else {
+			srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
+}
+
+// WithKeepAlivePeriod sets the period of the TCP keep-alive probes of the
+// accepted connections, 0 disables them.
+func WithKeepAlivePeriod(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.keepAlivePeriod = d
+	}
 }
 
 // New creates a new HTTP/HTTPS server configured with the passed
 // address, http.Handler and tls.Config.
-func New(addr string, handler http.Handler, tlsConfig *tls.Config) *Server {
-	return &Server{
-		reloadCh:   make(chan net.Listener),
-		shutdownCh: make(chan struct{}),
-		Server:     newHTTPServer(addr, handler, tlsConfig),
+func New(addr string, handler http.Handler, tlsConfig *tls.Config, opts ...Option) *Server {
+	srv := &Server{
+		reloadCh:        make(chan net.Listener),
+		shutdownCh:      make(chan struct{}),
+		keepAlivePeriod: DefaultKeepAlivePeriod,
+		Server:          newHTTPServer(addr, handler, tlsConfig),
+	}
+	for _, fn := range opts {
+		fn(srv)
 	}
+	return srv
 }
 
 // newHTTPServer creates a new http.Server with the TCP address, handler and
 // tls.Config.
 func newHTTPServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
 	return &http.Server{
-		Addr:         addr,
-		Handler:      handler,
-		TLSConfig:    tlsConfig,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-		IdleTimeout:  15 * time.Second,
-		ErrorLog:     log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Llongfile),
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		WriteTimeout:      DefaultWriteTimeout,
+		ReadTimeout:       DefaultReadTimeout,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+		MaxHeaderBytes:    DefaultMaxHeaderBytes,
+		ErrorLog:          log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Llongfile),
 	}
 }
 
-// ListenAndServe listens on the TCP network address srv.Addr and then calls
-// Serve to handle requests on incoming connections.
+// ListenAndServe listens on the TCP network address srv.Addr, or uses the
+// socket passed by systemd, and then calls Serve to handle requests on incoming
+// connections.
 func (srv *Server) ListenAndServe() error {
-	ln, err := net.Listen("tcp", srv.Addr)
+	ln, err := Listen(srv.Addr)
 	if err != nil {
 		return err
 	}
@@ -72,10 +153,10 @@ func (srv *Server) Serve(ln net.Listener) error {
 		// Start server
 		if srv.TLSConfig == nil || (len(srv.TLSConfig.Certificates) == 0 && srv.TLSConfig.GetCertificate == nil) {
 			log.Printf("Serving HTTP on %s ...", srv.Addr)
-			err = srv.Server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+			err = srv.Server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener), srv.keepAlivePeriod})
 		} else {
 			log.Printf("Serving HTTPS on %s ...", srv.Addr)
-			err = srv.Server.ServeTLS(tcpKeepAliveListener{ln.(*net.TCPListener)}, "", "")
+			err = srv.Server.ServeTLS(tcpKeepAliveListener{ln.(*net.TCPListener), srv.keepAlivePeriod}, "", "")
 		}
 
 		// log unexpected errors
@@ -93,12 +174,18 @@ func (srv *Server) Serve(ln net.Listener) error {
 }
 
 // Shutdown gracefully shuts down the server without interrupting any active
-// connections.
-func (srv *Server) Shutdown() error {
-	ctx, cancel := context.WithTimeout(context.Background(), ServerShutdownTimeout)
-	defer cancel()              // release resources if Shutdown ends before the timeout
-	defer close(srv.shutdownCh) // close shutdown channel
-	return srv.Server.Shutdown(ctx)
+// connections. It stops accepting new connections and waits for the active
+// ones to finish, if the context is done before, the remaining connections are
+// closed and the context error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	defer srv.shutdownOnce.Do(func() {
+		close(srv.shutdownCh)
+	})
+	if err := srv.Server.Shutdown(ctx); err != nil {
+		srv.Server.Close()
+		return err
+	}
+	return nil
 }
 
 func (srv *Server) reloadShutdown() error {
@@ -115,7 +202,7 @@ func (srv *Server) Reload(ns *Server) error {
 
 	if srv.Addr != ns.Addr {
 		// Open new address
-		ln, err = net.Listen("tcp", ns.Addr)
+		ln, err = Listen(ns.Addr)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -142,6 +229,7 @@ func (srv *Server) Reload(ns *Server) error {
 
 	// Update old server
 	srv.Server = ns.Server
+	srv.keepAlivePeriod = ns.keepAlivePeriod
 	srv.reloadCh <- ln
 	return nil
 }
@@ -162,6 +250,7 @@ func (srv *Server) Forbidden(w http.ResponseWriter) {
 // go away.
 type tcpKeepAliveListener struct {
 	*net.TCPListener
+	period time.Duration
 }
 
 func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
@@ -169,7 +258,11 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	if err != nil {
 		return
 	}
-	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(3 * time.Minute)
+	if ln.period > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(ln.period)
+	} else {
+		tc.SetKeepAlive(false)
+	}
 	return tc, nil
 }
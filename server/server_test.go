@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := New("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("ok"))
+	}), nil)
+
+	ln, err := Listen(srv.Addr)
+	assert.FatalError(t, err)
+	addr := ln.Addr().String()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	// Start a slow request.
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		done <- result{string(b), err}
+	}()
+	<-started
+
+	// Shutdown while the request is active.
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	// New connections are refused once the listener is closed.
+	var dialErr error
+	for i := 0; i < 100 && dialErr == nil; i++ {
+		var c net.Conn
+		if c, dialErr = net.DialTimeout("tcp", addr, time.Second); dialErr == nil {
+			c.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	assert.Error(t, dialErr)
+
+	// The active request finishes.
+	close(release)
+	res := <-done
+	assert.FatalError(t, res.err)
+	assert.Equals(t, "ok", res.body)
+	assert.FatalError(t, <-shutdown)
+	assert.Equals(t, http.ErrServerClosed, <-served)
+}
+
+func TestServer_Shutdown_timeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := New("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), nil)
+
+	ln, err := Listen(srv.Addr)
+	assert.FatalError(t, err)
+	go srv.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equals(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+}
+
+func TestListen_socketActivation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	assert.FatalError(t, err)
+	defer f.Close()
+
+	defer func(fd int) { listenFdsStart = fd }(listenFdsStart)
+	listenFdsStart = int(f.Fd())
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+
+	ln, err := Listen("127.0.0.1:0")
+	assert.FatalError(t, err)
+	defer ln.Close()
+	assert.Equals(t, l.Addr().String(), ln.Addr().String())
+	assert.Equals(t, "", os.Getenv("LISTEN_PID"))
+	assert.Equals(t, "", os.Getenv("LISTEN_FDS"))
+}
+
+func TestListen_reusePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported on windows")
+	}
+	ln1, err := Listen("127.0.0.1:0")
+	assert.FatalError(t, err)
+	defer ln1.Close()
+
+	// A second process, or listener, can bind the same address.
+	ln2, err := Listen(ln1.Addr().String())
+	assert.FatalError(t, err)
+	ln2.Close()
+}
+
+func TestNew(t *testing.T) {
+	srv := New("127.0.0.1:0", http.NotFoundHandler(), nil)
+	assert.Equals(t, DefaultReadTimeout, srv.ReadTimeout)
+	assert.Equals(t, DefaultReadHeaderTimeout, srv.ReadHeaderTimeout)
+	assert.Equals(t, DefaultWriteTimeout, srv.WriteTimeout)
+	assert.Equals(t, DefaultIdleTimeout, srv.IdleTimeout)
+	assert.Equals(t, DefaultMaxHeaderBytes, srv.MaxHeaderBytes)
+	assert.Equals(t, DefaultKeepAlivePeriod, srv.keepAlivePeriod)
+	assert.Nil(t, srv.TLSNextProto)
+
+	srv = New("127.0.0.1:0", http.NotFoundHandler(), nil,
+		WithReadTimeout(time.Second), WithReadHeaderTimeout(2*time.Second),
+		WithWriteTimeout(3*time.Second), WithIdleTimeout(4*time.Second),
+		WithMaxHeaderBytes(1024), WithHTTP2(false), WithKeepAlivePeriod(0))
+	assert.Equals(t, time.Second, srv.ReadTimeout)
+	assert.Equals(t, 2*time.Second, srv.ReadHeaderTimeout)
+	assert.Equals(t, 3*time.Second, srv.WriteTimeout)
+	assert.Equals(t, 4*time.Second, srv.IdleTimeout)
+	assert.Equals(t, 1024, srv.MaxHeaderBytes)
+	assert.Equals(t, time.Duration(0), srv.keepAlivePeriod)
+	assert.NotNil(t, srv.TLSNextProto)
+	assert.Len(t, 0, srv.TLSNextProto)
+}
+
+func TestServer_idleTimeout(t *testing.T) {
+	srv := New("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), nil, WithIdleTimeout(100*time.Millisecond))
+
+	ln, err := Listen(srv.Addr)
+	assert.FatalError(t, err)
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	assert.FatalError(t, err)
+	defer c.Close()
+
+	// Send a keep-alive request and read the full response.
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.FatalError(t, err)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	assert.FatalError(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.FatalError(t, err)
+	resp.Body.Close()
+	assert.False(t, resp.Close)
+
+	// The server closes the idle connection after the timeout.
+	start := time.Now()
+	assert.FatalError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = br.ReadByte()
+	assert.Equals(t, io.EOF, err)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle connection closed after %s, want about 100ms", d)
+	}
+}
@@ -0,0 +1,76 @@
+package templates
+
+// DefaultSSHTemplates contains the configuration of the default templates used
+// on ssh. Relative paths are relative to the StepPath, and the contents of the
+// templates are in DefaultSSHTemplateData.
+var DefaultSSHTemplates = &SSHTemplates{
+	User: []Template{
+		{Name: "include.tpl", Type: Snippet, TemplatePath: "templates/ssh/include.tpl", Path: "~/.ssh/config", Comment: "#"},
+		{Name: "config.tpl", Type: File, TemplatePath: "templates/ssh/config.tpl", Path: "ssh/config", Comment: "#"},
+		{Name: "known_hosts.tpl", Type: File, TemplatePath: "templates/ssh/known_hosts.tpl", Path: "ssh/known_hosts", Comment: "#"},
+	},
+	Host: []Template{
+		{Name: "sshd_config.tpl", Type: Snippet, TemplatePath: "templates/ssh/sshd_config.tpl", Path: "/etc/ssh/sshd_config", Comment: "#"},
+		{Name: "ca.tpl", Type: Snippet, TemplatePath: "templates/ssh/ca.tpl", Path: "/etc/ssh/ca.pub", Comment: "#"},
+	},
+}
+
+// DefaultSSHTemplateData contains the data of the default templates used on
+// ssh.
+var DefaultSSHTemplateData = map[string]string{
+	// include.tpl adds the step ssh config file.
+	//
+	// Note: on windows `Include C:\...` is treated as a relative path.
+	"include.tpl": `Host *
+{{- if or .User.GOOS "none" | eq "windows" }}
+	Include "{{ .User.StepPath | replace "\\" "/" | trimPrefix "C:" }}/ssh/config"
+{{- else }}
+	Include "{{.User.StepPath}}/ssh/config"
+{{- end }}`,
+
+	// config.tpl is the step ssh config file, it includes the Match rule and
+	// references the step known_hosts file. With a bastion the hosts are
+	// reached with ProxyJump, and the bastion itself is reached directly.
+	//
+	// Note: on windows ProxyCommand requires the full path
+	"config.tpl": `{{- with .Step.SSH.Bastion }}Host {{ .Hostname }}
+	ProxyJump none
+
+{{ end }}Match exec "step ssh check-host %h"
+	ForwardAgent yes
+{{- if .User.User }}
+	User {{.User.User}}
+{{- end }}
+{{- if or .User.GOOS "none" | eq "windows" }}
+	UserKnownHostsFile "{{.User.StepPath}}\ssh\known_hosts"
+{{- else }}
+	UserKnownHostsFile "{{.User.StepPath}}/ssh/known_hosts"
+{{- end }}
+{{- if .Step.SSH.Bastion }}
+	ProxyJump {{ with .Step.SSH.Bastion }}{{ if .User }}{{ .User }}@{{ end }}{{ .Hostname }}{{ if .Port }}:{{ .Port }}{{ end }}{{ end }}
+{{- else if or .User.GOOS "none" | eq "windows" }}
+	ProxyCommand C:\Windows\System32\cmd.exe /c step ssh proxycommand %r %h %p
+{{- else }}
+	ProxyCommand step ssh proxycommand %r %h %p
+{{- end }}
+`,
+
+	// known_hosts.tpl authorizes the ssh hosts key
+	"known_hosts.tpl": `@cert-authority * {{.Step.SSH.HostKey.Type}} {{.Step.SSH.HostKey.Marshal | toString | b64enc}}
+{{- range .Step.SSH.HostFederatedKeys}}
+@cert-authority * {{.Type}} {{.Marshal | toString | b64enc}}
+{{- end }}
+`,
+
+	// sshd_config.tpl adds the configuration to support certificates
+	"sshd_config.tpl": `TrustedUserCAKeys /etc/ssh/ca.pub
+HostCertificate /etc/ssh/{{ .User.Certificate | default "ssh_host_ecdsa_key-cert.pub" }}
+HostKey /etc/ssh/{{ .User.Key | default "ssh_host_ecdsa_key" }}`,
+
+	// ca.tpl contains the public key used to authorized clients
+	"ca.tpl": `{{.Step.SSH.UserKey.Type}} {{.Step.SSH.UserKey.Marshal | toString | b64enc}}
+{{- range .Step.SSH.UserFederatedKeys}}
+{{.Type}} {{.Marshal | toString | b64enc}}
+{{- end }}
+`,
+}
@@ -188,7 +188,7 @@ func (t *Template) Render(data interface{}) ([]byte, error) {
 
 	buf := new(bytes.Buffer)
 	if err := t.Execute(buf, data); err != nil {
-		return nil, errors.Wrapf(err, "error executing %s", t.TemplatePath)
+		return nil, errors.Wrapf(err, "error executing %s", t.Name)
 	}
 	return buf.Bytes(), nil
 }
@@ -7,12 +7,29 @@ import (
 // Step represents the default variables available in the CA.
 type Step struct {
 	SSH StepSSH
+	// CAURL is the URL of the CA, with the first DNS name and the port of
+	// the address.
+	CAURL string
 }
 
 // StepSSH holds SSH-related values for the CA.
 type StepSSH struct {
-	HostKey           ssh.PublicKey
-	UserKey           ssh.PublicKey
-	HostFederatedKeys []ssh.PublicKey
-	UserFederatedKeys []ssh.PublicKey
+	HostKey            ssh.PublicKey
+	UserKey            ssh.PublicKey
+	HostKeyFingerprint string
+	UserKeyFingerprint string
+	HostFederatedKeys  []ssh.PublicKey
+	UserFederatedKeys  []ssh.PublicKey
+	// Bastion is the bastion configured in the CA, it is nil if there is no
+	// bastion.
+	Bastion *StepSSHBastion
+}
+
+// StepSSHBastion holds the bastion used to reach the ssh hosts.
+type StepSSHBastion struct {
+	Hostname string
+	User     string
+	Port     string
+	Command  string
+	Flags    string
 }
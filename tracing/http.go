@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/certificates/logging"
+)
+
+// Middleware is an HTTP middleware that creates a server span for each
+// request, continuing the trace in the traceparent header if present, and
+// adds the tracer to the request context so the handlers can create child
+// spans. It must wrap the router, so the pattern of the route matched can be
+// used as the name of the span.
+func Middleware(t Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := NewContext(Extract(r.Context(), r.Header), t)
+
+		// Reuse the routing context if another middleware has already added
+		// it, chi only uses the one in the request.
+		rctx, _ := ctx.Value(chi.RouteCtxKey).(*chi.Context)
+		if rctx == nil {
+			rctx = chi.NewRouteContext()
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		}
+
+		ctx, span := start(ctx, t, "HTTP "+r.Method, SpanKindServer)
+		defer span.End()
+		rw := logging.NewResponseLogger(w)
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			span.SetName(r.Method + " " + pattern)
+			span.SetAttributes(String("http.route", pattern))
+		}
+		status := rw.StatusCode()
+		span.SetAttributes(
+			String("http.method", r.Method),
+			String("http.target", r.URL.Path),
+			Int("http.status_code", status),
+		)
+		if status >= http.StatusInternalServerError {
+			span.RecordError(statusError(status))
+		}
+	})
+}
+
+// Do sends an HTTP request with the given client in a client span, and adds
+// the traceparent header to the request. If the tracer is nil, it uses the
+// tracer in the request context; if there is none, it just sends the request.
+func Do(client *http.Client, t Tracer, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if t == nil {
+		if t = FromContext(ctx); t == nil {
+			return client.Do(req)
+		}
+	}
+
+	ctx, span := start(ctx, t, "HTTP "+req.Method, SpanKindClient)
+	defer span.End()
+	span.SetAttributes(
+		String("http.method", req.Method),
+		String("http.url", redactURL(req.URL)),
+	)
+
+	// Do not modify the headers of the caller.
+	req = req.WithContext(ctx)
+	req.Header = cloneHeader(req.Header)
+	Inject(ctx, req.Header)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.RecordError(statusError(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// statusError is the error recorded in the spans of the requests that fail
+// with a server error.
+type statusError int
+
+func (e statusError) Error() string {
+	return http.StatusText(int(e))
+}
+
+// redactURL returns the url without the user information and query, they
+// might contain credentials.
+func redactURL(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return make(http.Header)
+	}
+	return h.Clone()
+}
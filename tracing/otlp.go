@@ -0,0 +1,340 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultServiceName is the service name reported in the exported spans if
+// one is not configured.
+const DefaultServiceName = "step-ca"
+
+const (
+	// otlpBatchSize is the number of spans that triggers an export.
+	otlpBatchSize = 512
+	// otlpMaxQueueSize is the maximum number of spans waiting to be exported,
+	// new spans are dropped if the queue is full.
+	otlpMaxQueueSize = 2048
+	// otlpExportInterval is the maximum time a span waits to be exported.
+	otlpExportInterval = 5 * time.Second
+	// otlpExportTimeout is the timeout of the export requests.
+	otlpExportTimeout = 10 * time.Second
+)
+
+// Config is the configuration of the tracing of the CA.
+type Config struct {
+	// Endpoint is the base URL of an OpenTelemetry collector accepting
+	// OTLP/HTTP, e.g. http://localhost:4318. The spans are sent to the
+	// /v1/traces path.
+	Endpoint string `json:"endpoint"`
+	// ServiceName is the service.name of the spans, it defaults to step-ca.
+	ServiceName string `json:"serviceName,omitempty"`
+	// Headers are added to the export requests, e.g. for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Validate validates the tracing configuration.
+func (c *Config) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case c.Endpoint == "":
+		return errors.New("tracing.endpoint cannot be empty")
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return errors.Wrap(err, "tracing.endpoint is not a valid url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("tracing.endpoint must use http or https")
+	}
+	return nil
+}
+
+// OTLPExporter is an Exporter that sends the spans in batches to an
+// OpenTelemetry collector using OTLP/HTTP with the JSON encoding.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+	mu          sync.Mutex
+	queue       []*SpanData
+	dropped     int
+	flush       chan struct{}
+	stop        chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+// NewOTLPExporter creates an OTLPExporter with the given configuration and
+// starts the goroutine that exports the spans. Shutdown must be called to
+// export the pending spans and stop it.
+func NewOTLPExporter(c *Config) (*OTLPExporter, error) {
+	if c == nil {
+		return nil, errors.New("tracing configuration cannot be empty")
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	name := c.ServiceName
+	if name == "" {
+		name = DefaultServiceName
+	}
+	e := &OTLPExporter{
+		url:         strings.TrimSuffix(c.Endpoint, "/") + "/v1/traces",
+		serviceName: name,
+		headers:     c.Headers,
+		client:      &http.Client{Timeout: otlpExportTimeout},
+		flush:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// ExportSpan implements the Exporter interface, it adds the span to the queue
+// of spans to export.
+func (e *OTLPExporter) ExportSpan(s *SpanData) {
+	e.mu.Lock()
+	if len(e.queue) >= otlpMaxQueueSize {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+	e.queue = append(e.queue, s)
+	n := len(e.queue)
+	e.mu.Unlock()
+	if n >= otlpBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Shutdown exports the pending spans and stops the exporter. It waits until
+// the export finishes or the context is done.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.stopOnce.Do(func() { close(e.stop) })
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flush:
+		case <-e.stop:
+			for e.export() {
+			}
+			return
+		}
+		for e.export() {
+		}
+	}
+}
+
+// export sends a batch of spans, it returns true if there are more spans in
+// the queue.
+func (e *OTLPExporter) export() bool {
+	e.mu.Lock()
+	n := len(e.queue)
+	if n > otlpBatchSize {
+		n = otlpBatchSize
+	}
+	batch := e.queue[:n:n]
+	e.queue = e.queue[n:]
+	dropped := e.dropped
+	e.dropped = 0
+	more := len(e.queue) > 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("tracing: %d spans dropped, the export queue is full", dropped)
+	}
+	if len(batch) == 0 {
+		return false
+	}
+	if err := e.send(batch); err != nil {
+		log.Printf("tracing: error exporting %d spans: %v", len(batch), err)
+	}
+	return more
+}
+
+func (e *OTLPExporter) send(batch []*SpanData) error {
+	b, err := json.Marshal(e.newRequest(batch))
+	if err != nil {
+		return errors.Wrap(err, "error marshaling spans")
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error sending spans to %s", e.url)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("%s responded with status code %d", e.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// The following types are the JSON encoding of an OTLP export request, see
+// https://github.com/open-telemetry/opentelemetry-proto.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+// OTLP span kinds and status codes.
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+	otlpStatusCodeError  = 2
+)
+
+func (e *OTLPExporter) newRequest(batch []*SpanData) *otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = newOTLPSpan(s)
+	}
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{newOTLPKeyValue(String("service.name", e.serviceName))},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/smallstep/certificates"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func newOTLPSpan(s *SpanData) otlpSpan {
+	kind := otlpSpanKindInternal
+	switch s.Kind {
+	case SpanKindServer:
+		kind = otlpSpanKindServer
+	case SpanKindClient:
+		kind = otlpSpanKindClient
+	}
+	span := otlpSpan{
+		TraceID:           s.SpanContext.TraceID.String(),
+		SpanID:            s.SpanContext.SpanID.String(),
+		Name:              s.Name,
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+	}
+	if s.Parent.IsValid() {
+		span.ParentSpanID = s.Parent.SpanID.String()
+	}
+	for _, a := range s.Attributes {
+		span.Attributes = append(span.Attributes, newOTLPKeyValue(a))
+	}
+	if s.Error != "" {
+		span.Status = &otlpStatus{Code: otlpStatusCodeError, Message: s.Error}
+	}
+	return span
+}
+
+func newOTLPKeyValue(a Attribute) otlpKeyValue {
+	var v otlpValue
+	switch t := a.Value.(type) {
+	case string:
+		v.StringValue = &t
+	case int:
+		s := strconv.Itoa(t)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(t, 10)
+		v.IntValue = &s
+	case bool:
+		v.BoolValue = &t
+	default:
+		s := ""
+		if t != nil {
+			b, _ := json.Marshal(t)
+			s = string(b)
+		}
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: a.Key, Value: v}
+}
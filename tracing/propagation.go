@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader is the W3C Trace Context header used to propagate the
+// span context.
+const TraceparentHeader = "traceparent"
+
+// Inject adds the traceparent header with the span context in ctx to the
+// given headers. It does nothing if the context does not have a valid span
+// context.
+func Inject(ctx context.Context, h http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	h.Set(TraceparentHeader, "00-"+sc.TraceID.String()+"-"+sc.SpanID.String()+"-"+flags)
+}
+
+// Extract returns a copy of the context with the remote span context in the
+// traceparent header. It returns the same context if the header is missing or
+// invalid.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := parseTraceparent(h.Get(TraceparentHeader)); ok {
+		return ContextWithRemoteSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+// parseTraceparent parses a traceparent header value. Values with a version
+// greater than 00 are accepted if they start with the fields of version 00.
+func parseTraceparent(s string) (SpanContext, bool) {
+	if len(s) < 55 || (len(s) > 55 && s[55] != '-') {
+		return SpanContext{}, false
+	}
+	parts := strings.Split(s[:55], "-")
+	if len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if n, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || n != len(sc.TraceID) {
+		return SpanContext{}, false
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || n != len(sc.SpanID) {
+		return SpanContext{}, false
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// SpanData is the information of a finished span.
+type SpanData struct {
+	Name        string
+	Kind        SpanKind
+	SpanContext SpanContext
+	// Parent is the span context of the parent span, it is not valid if the
+	// span is the root of the trace.
+	Parent     SpanContext
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []Attribute
+	// Error is the message of the error recorded, if any.
+	Error string
+}
+
+// Attribute returns the value of the attribute with the given key, or nil if
+// it is not set.
+func (s *SpanData) Attribute(key string) interface{} {
+	for i := len(s.Attributes) - 1; i >= 0; i-- {
+		if s.Attributes[i].Key == key {
+			return s.Attributes[i].Value
+		}
+	}
+	return nil
+}
+
+// Exporter receives the spans of a tracer created with NewTracer when they
+// end. ExportSpan is called in the goroutine that ends the span and must not
+// block.
+type Exporter interface {
+	ExportSpan(s *SpanData)
+}
+
+// NewTracer returns a Tracer that sends the finished spans to the given
+// exporter. All the traces started by the tracer are sampled, the traces
+// started in other services are sampled if the parent is.
+func NewTracer(e Exporter) Tracer {
+	return &tracer{exporter: e}
+}
+
+type tracer struct {
+	exporter Exporter
+}
+
+// Start implements the Tracer interface.
+func (t *tracer) Start(ctx context.Context, name string, kind SpanKind) Span {
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{
+		TraceID: parent.TraceID,
+		Sampled: true,
+	}
+	if parent.IsValid() {
+		sc.Sampled = parent.Sampled
+	} else {
+		parent = SpanContext{}
+		sc.TraceID = newTraceID()
+	}
+	sc.SpanID = newSpanID()
+	return &span{
+		tracer: t,
+		data: SpanData{
+			Name:        name,
+			Kind:        kind,
+			SpanContext: sc,
+			Parent:      parent,
+			StartTime:   time.Now(),
+		},
+	}
+}
+
+// span is the span created by the tracer returned by NewTracer.
+type span struct {
+	mu     sync.Mutex
+	tracer *tracer
+	data   SpanData
+	ended  bool
+}
+
+func (s *span) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *span) SetName(name string) {
+	s.mu.Lock()
+	s.data.Name = name
+	s.mu.Unlock()
+}
+
+func (s *span) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+	s.mu.Unlock()
+}
+
+func (s *span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Error = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if data.SpanContext.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(&data)
+	}
+}
+
+func newTraceID() (id TraceID) {
+	// crypto/rand only fails if the system source of randomness does, an id
+	// of zeros is invalid and will not be propagated.
+	rand.Read(id[:])
+	return
+}
+
+func newSpanID() (id SpanID) {
+	rand.Read(id[:])
+	return
+}
+
+// InMemoryExporter is an Exporter that keeps the spans in memory, it can be
+// used to test the instrumentation.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+// ExportSpan implements the Exporter interface.
+func (e *InMemoryExporter) ExportSpan(s *SpanData) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	e.mu.Unlock()
+}
+
+// Spans returns the spans exported in the order they ended.
+func (e *InMemoryExporter) Spans() []*SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*SpanData(nil), e.spans...)
+}
+
+// Reset removes the spans exported.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+}
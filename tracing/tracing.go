@@ -0,0 +1,182 @@
+// Package tracing implements a small distributed tracing API used to
+// instrument the CA and its client.
+//
+// Spans are identified using the W3C Trace Context format, so a trace can
+// start in a client, go through the CA, and continue in the webhooks, and the
+// spans can be exported to an OpenTelemetry collector. Tracing is disabled by
+// default: if a context does not have a Tracer, Start returns a no-op span and
+// the instrumentation adds almost no overhead.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+)
+
+// TraceID is the identifier of a trace.
+type TraceID [16]byte
+
+// IsValid returns true if the TraceID is not all zeros.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// String returns the hex encoding of the TraceID.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID is the identifier of a span.
+type SpanID [8]byte
+
+// IsValid returns true if the SpanID is not all zeros.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// String returns the hex encoding of the SpanID.
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext identifies a span in a trace, it is the information propagated
+// between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	// Remote is true if the span context has been extracted from an incoming
+	// request.
+	Remote bool
+}
+
+// IsValid returns true if the SpanContext has a trace and a span id.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind describes the relationship between a span and its parent and
+// children.
+type SpanKind int
+
+const (
+	// SpanKindInternal is the kind of the spans of internal operations.
+	SpanKindInternal SpanKind = iota
+	// SpanKindServer is the kind of the spans of incoming requests.
+	SpanKindServer
+	// SpanKindClient is the kind of the spans of outgoing requests.
+	SpanKindClient
+)
+
+// Attribute is a key-value pair that describes a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is an operation in a trace.
+type Span interface {
+	// SpanContext returns the identifiers of the span.
+	SpanContext() SpanContext
+	// SetName changes the name of the span.
+	SetName(name string)
+	// SetAttributes adds the given attributes to the span.
+	SetAttributes(attrs ...Attribute)
+	// RecordError marks the span as failed with the given error, nil errors
+	// are ignored.
+	RecordError(err error)
+	// End completes the span, calls after the first one are ignored.
+	End()
+}
+
+// Tracer creates spans. The tracer returned by NewTracer exports the spans to
+// an Exporter, applications embedding the CA can implement this interface to
+// use their own tracing library, e.g. an OpenTelemetry TracerProvider.
+type Tracer interface {
+	// Start creates a span with the given name and kind. The parent of the
+	// new span is the span context returned by SpanContextFromContext.
+	Start(ctx context.Context, name string, kind SpanKind) Span
+}
+
+type tracerKey struct{}
+
+type spanKey struct{}
+
+type remoteSpanContextKey struct{}
+
+// NewContext returns a copy of the context with the given tracer. Start uses
+// it to create the spans.
+func NewContext(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// FromContext returns the tracer in the context, or nil if tracing is not
+// enabled.
+func FromContext(ctx context.Context) Tracer {
+	t, _ := ctx.Value(tracerKey{}).(Tracer)
+	return t
+}
+
+// ContextWithRemoteSpanContext returns a copy of the context with a span
+// context extracted from an incoming request.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteSpanContextKey{}, sc)
+}
+
+// SpanFromContext returns the current span in the context, or nil if there is
+// none.
+func SpanFromContext(ctx context.Context) Span {
+	s, _ := ctx.Value(spanKey{}).(Span)
+	return s
+}
+
+// SpanContextFromContext returns the span context of the current span in the
+// context, or the remote span context if there is no current span.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteSpanContextKey{}).(SpanContext)
+	return sc
+}
+
+// Start creates an internal span with the tracer in the context, and returns
+// a copy of the context with the new span. If the context does not have a
+// tracer it returns the same context and a span that does nothing.
+func Start(ctx context.Context, name string) (context.Context, Span) {
+	t := FromContext(ctx)
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+	return start(ctx, t, name, SpanKindInternal)
+}
+
+func start(ctx context.Context, t Tracer, name string, kind SpanKind) (context.Context, Span) {
+	s := t.Start(ctx, name, kind)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// noopSpan is the span returned when tracing is not enabled.
+type noopSpan struct{}
+
+func (noopSpan) SpanContext() SpanContext   { return SpanContext{} }
+func (noopSpan) SetName(string)             {}
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
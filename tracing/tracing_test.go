@@ -0,0 +1,258 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/assert"
+)
+
+func Test_parseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantOk  bool
+		sampled bool
+	}{
+		{"ok", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"ok not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"ok future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-foo", true, true},
+		{"fail empty", "", false, false},
+		{"fail version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"fail version 00 with extra", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-foo", false, false},
+		{"fail zero trace", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"fail zero span", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"fail not hex", "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", false, false},
+		{"fail separators", "00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := parseTraceparent(tt.value)
+			assert.Equals(t, tt.wantOk, ok)
+			if ok {
+				assert.Equals(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+				assert.Equals(t, "00f067aa0ba902b7", sc.SpanID.String())
+				assert.Equals(t, tt.sampled, sc.Sampled)
+			} else {
+				assert.Equals(t, SpanContext{}, sc)
+			}
+		})
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	h := make(http.Header)
+	Inject(context.Background(), h)
+	assert.Equals(t, "", h.Get(TraceparentHeader))
+
+	ctx, span := start(context.Background(), NewTracer(nil), "test", SpanKindInternal)
+	Inject(ctx, h)
+	sc := span.SpanContext()
+	assert.Equals(t, "00-"+sc.TraceID.String()+"-"+sc.SpanID.String()+"-01", h.Get(TraceparentHeader))
+
+	got := SpanContextFromContext(Extract(context.Background(), h))
+	sc.Remote = true
+	assert.Equals(t, sc, got)
+}
+
+func TestStart_noTracer(t *testing.T) {
+	ctx := context.Background()
+	got, span := Start(ctx, "test")
+	assert.Equals(t, ctx, got)
+	assert.Equals(t, noopSpan{}, span)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, span := Start(ctx, "test")
+		span.RecordError(nil)
+		span.End()
+	})
+	assert.Equals(t, float64(0), allocs)
+}
+
+func TestTracer(t *testing.T) {
+	exporter := new(InMemoryExporter)
+	ctx := NewContext(context.Background(), NewTracer(exporter))
+
+	ctx, root := Start(ctx, "root")
+	_, child := Start(ctx, "child")
+	child.SetAttributes(String("key", "value"), Int("n", 1), Bool("ok", true))
+	child.RecordError(errors.New("an error"))
+	child.End()
+	child.End()
+	root.End()
+
+	spans := exporter.Spans()
+	assert.Len(t, 2, spans)
+	assert.Equals(t, "child", spans[0].Name)
+	assert.Equals(t, "root", spans[1].Name)
+	assert.False(t, spans[1].Parent.IsValid())
+	assert.Equals(t, spans[1].SpanContext.TraceID, spans[0].SpanContext.TraceID)
+	assert.Equals(t, spans[1].SpanContext, spans[0].Parent)
+	assert.Equals(t, "value", spans[0].Attribute("key"))
+	assert.Equals(t, 1, spans[0].Attribute("n"))
+	assert.Equals(t, true, spans[0].Attribute("ok"))
+	assert.Nil(t, spans[0].Attribute("missing"))
+	assert.Equals(t, "an error", spans[0].Error)
+
+	// Traces not sampled by the caller are not exported.
+	exporter.Reset()
+	h := make(http.Header)
+	h.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx = NewContext(Extract(context.Background(), h), NewTracer(exporter))
+	_, span := Start(ctx, "not sampled")
+	span.End()
+	assert.Equals(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID.String())
+	assert.False(t, span.SpanContext().Sampled)
+	assert.Len(t, 0, exporter.Spans())
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := new(InMemoryExporter)
+	tracer := NewTracer(exporter)
+
+	mux := chi.NewRouter()
+	mux.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "handler")
+		span.End()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(Middleware(tracer, mux))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/users/1?token=secret", nil)
+	assert.FatalError(t, err)
+	resp, err := Do(http.DefaultClient, tracer, req)
+	assert.FatalError(t, err)
+	resp.Body.Close()
+	assert.Equals(t, "", req.Header.Get(TraceparentHeader))
+
+	spans := exporter.Spans()
+	assert.Len(t, 3, spans)
+	handler, server, client := spans[0], spans[1], spans[2]
+	assert.Equals(t, "handler", handler.Name)
+	assert.Equals(t, server.SpanContext, handler.Parent)
+
+	assert.Equals(t, "GET /users/{id}", server.Name)
+	assert.Equals(t, SpanKindServer, server.Kind)
+	assert.Equals(t, client.SpanContext.SpanID, server.Parent.SpanID)
+	assert.Equals(t, "/users/{id}", server.Attribute("http.route"))
+	assert.Equals(t, "/users/1", server.Attribute("http.target"))
+	assert.Equals(t, 500, server.Attribute("http.status_code"))
+	assert.Equals(t, "Internal Server Error", server.Error)
+
+	assert.Equals(t, "HTTP GET", client.Name)
+	assert.Equals(t, SpanKindClient, client.Kind)
+	assert.Equals(t, srv.URL+"/users/1", client.Attribute("http.url"))
+	assert.Equals(t, 500, client.Attribute("http.status_code"))
+
+	// Without a tracer in the context the request is not traced.
+	exporter.Reset()
+	req, err = http.NewRequest("GET", srv.URL+"/users/1", nil)
+	assert.FatalError(t, err)
+	resp, err = Do(http.DefaultClient, nil, req)
+	assert.FatalError(t, err)
+	resp.Body.Close()
+	spans = exporter.Spans()
+	assert.Len(t, 2, spans)
+	assert.False(t, spans[1].Parent.IsValid())
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"ok", &Config{Endpoint: "http://localhost:4318"}, false},
+		{"ok https", &Config{Endpoint: "https://collector.example.com", ServiceName: "ca"}, false},
+		{"fail empty", &Config{}, true},
+		{"fail url", &Config{Endpoint: "http://[::1"}, true},
+		{"fail scheme", &Config{Endpoint: "grpc://localhost:4317"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	type request struct {
+		path   string
+		header http.Header
+		body   otlpRequest
+	}
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests <- request{r.URL.Path, r.Header, body}
+	}))
+	defer srv.Close()
+
+	_, err := NewOTLPExporter(nil)
+	assert.Error(t, err)
+	_, err = NewOTLPExporter(&Config{})
+	assert.Error(t, err)
+
+	exporter, err := NewOTLPExporter(&Config{
+		Endpoint: srv.URL + "/",
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+	})
+	assert.FatalError(t, err)
+
+	ctx := NewContext(context.Background(), NewTracer(exporter))
+	ctx, root := start(ctx, FromContext(ctx), "root", SpanKindServer)
+	_, child := Start(ctx, "child")
+	child.SetAttributes(String("key", "value"), Int("n", 1), Bool("ok", true))
+	child.RecordError(errors.New("an error"))
+	child.End()
+	root.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.FatalError(t, exporter.Shutdown(ctx))
+	assert.FatalError(t, exporter.Shutdown(ctx))
+
+	req := <-requests
+	assert.Equals(t, "/v1/traces", req.path)
+	assert.Equals(t, "application/json", req.header.Get("Content-Type"))
+	assert.Equals(t, "Bearer secret", req.header.Get("Authorization"))
+	assert.Len(t, 1, req.body.ResourceSpans)
+	rs := req.body.ResourceSpans[0]
+	assert.Equals(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equals(t, DefaultServiceName, *rs.Resource.Attributes[0].Value.StringValue)
+	assert.Len(t, 1, rs.ScopeSpans)
+	spans := rs.ScopeSpans[0].Spans
+	assert.Len(t, 2, spans)
+
+	c, r := spans[0], spans[1]
+	assert.Equals(t, "child", c.Name)
+	assert.Equals(t, otlpSpanKindInternal, c.Kind)
+	assert.Equals(t, r.TraceID, c.TraceID)
+	assert.Equals(t, r.SpanID, c.ParentSpanID)
+	assert.Len(t, 32, c.TraceID)
+	assert.Len(t, 16, c.SpanID)
+	assert.Equals(t, "value", *c.Attributes[0].Value.StringValue)
+	assert.Equals(t, "1", *c.Attributes[1].Value.IntValue)
+	assert.True(t, *c.Attributes[2].Value.BoolValue)
+	assert.Equals(t, &otlpStatus{Code: otlpStatusCodeError, Message: "an error"}, c.Status)
+
+	assert.Equals(t, "root", r.Name)
+	assert.Equals(t, otlpSpanKindServer, r.Kind)
+	assert.Equals(t, "", r.ParentSpanID)
+	assert.Nil(t, r.Status)
+	assert.True(t, r.StartTimeUnixNano <= r.EndTimeUnixNano)
+}
@@ -0,0 +1,31 @@
+// Package version contains the build information of step-ca. The variables in
+// this package are set at build time using ldflags, e.g.:
+//
+//	go build -ldflags='-X "github.com/smallstep/certificates/version.Version=0.15.0"'
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	// Version is the version of step-ca.
+	Version = "N/A"
+	// GitCommit is the git SHA used to build step-ca.
+	GitCommit = "N/A"
+	// BuildTime is the date and time step-ca was built.
+	BuildTime = "N/A"
+)
+
+// GoVersion returns the version of Go used to build step-ca.
+func GoVersion() string {
+	return runtime.Version()
+}
+
+// String returns a string with the version, git SHA, build time and Go
+// version, it is used in logs.
+func String() string {
+	return fmt.Sprintf("Smallstep CA/%s (%s/%s) commit %s, built %s with %s",
+		Version, runtime.GOOS, runtime.GOARCH, GitCommit, BuildTime, GoVersion())
+}